@@ -0,0 +1,934 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+// Package comqtt builds a fully configured single or cluster broker, with the storage,
+// auth, bridge and listeners of a config, for applications which embed comqtt.
+package comqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	rv8 "github.com/redis/go-redis/v9"
+	"github.com/wind-c/comqtt/v2/cluster"
+	"github.com/wind-c/comqtt/v2/cluster/log"
+	csRt "github.com/wind-c/comqtt/v2/cluster/rest"
+	"github.com/wind-c/comqtt/v2/cluster/standby"
+	coredis "github.com/wind-c/comqtt/v2/cluster/storage/redis"
+	"github.com/wind-c/comqtt/v2/config"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/est"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/objectstore"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/security"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage/badger"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage/bolt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage/cassandra"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage/dynamodb"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage/memory"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage/postgres"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage/redis"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage/sqlite"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/usage"
+	"github.com/wind-c/comqtt/v2/mqtt/listeners"
+	mqttRt "github.com/wind-c/comqtt/v2/mqtt/rest"
+	"github.com/wind-c/comqtt/v2/plugin"
+	pa "github.com/wind-c/comqtt/v2/plugin/auth"
+	gauth "github.com/wind-c/comqtt/v2/plugin/auth/grpc"
+	hauth "github.com/wind-c/comqtt/v2/plugin/auth/http"
+	jauth "github.com/wind-c/comqtt/v2/plugin/auth/jwt"
+	mauth "github.com/wind-c/comqtt/v2/plugin/auth/mysql"
+	oauth "github.com/wind-c/comqtt/v2/plugin/auth/oauth2"
+	pauth "github.com/wind-c/comqtt/v2/plugin/auth/postgresql"
+	rauth "github.com/wind-c/comqtt/v2/plugin/auth/redis"
+	sauth "github.com/wind-c/comqtt/v2/plugin/auth/sqlite"
+	vauth "github.com/wind-c/comqtt/v2/plugin/auth/vault"
+	xauth "github.com/wind-c/comqtt/v2/plugin/auth/x509"
+	coaws "github.com/wind-c/comqtt/v2/plugin/bridge/aws"
+	coinfluxdb "github.com/wind-c/comqtt/v2/plugin/bridge/influxdb"
+	cokafka "github.com/wind-c/comqtt/v2/plugin/bridge/kafka"
+	comqttbridge "github.com/wind-c/comqtt/v2/plugin/bridge/mqtt"
+	"go.etcd.io/bbolt"
+)
+
+var (
+	ErrBrokerStarted    = errors.New("broker already started")
+	ErrBrokerNotStarted = errors.New("broker not started")
+)
+
+// Broker is a comqtt broker, which runs an mqtt server and, in cluster mode, the cluster
+// node it belongs to.
+type Broker struct {
+	sync.Mutex
+	conf               *config.Config
+	cluster            bool
+	logger             *slog.Logger
+	server             *mqtt.Server
+	agent              *cluster.Agent
+	store              *coredis.Storage
+	bans               *pa.BlacklistManager
+	hooks              []hookSpec
+	listeners          []listeners.Listener
+	handlers           map[string]listeners.Handler
+	noDefaultListeners bool
+	started            bool
+	agentStarted       bool
+	cancel             context.CancelFunc
+	errCh              chan error
+}
+
+// NewBroker returns a broker configured by the options. Its hooks are added, but its
+// listeners are not opened until the broker is started.
+func NewBroker(opts ...Option) (*Broker, error) {
+	b := &Broker{
+		conf:     config.New(),
+		handlers: make(map[string]listeners.Handler),
+		errCh:    make(chan error, 1),
+	}
+
+	for _, opt := range opts {
+		if err := opt(b); err != nil {
+			return nil, err
+		}
+	}
+
+	if b.logger != nil {
+		b.conf.Mqtt.Options.Logger = b.logger
+	} else if b.conf.Mqtt.Options.Logger == nil {
+		b.conf.Mqtt.Options.Logger = log.Default()
+	}
+
+	if b.cluster && b.conf.Cluster.Members == nil {
+		return nil, config.ErrClusterOpts
+	}
+
+	b.server = mqtt.New(&b.conf.Mqtt.Options)
+	if err := b.initStorage(); err != nil {
+		return nil, err
+	}
+
+	if err := b.initAuth(); err != nil {
+		return nil, err
+	}
+
+	if err := b.initBridge(); err != nil {
+		return nil, err
+	}
+
+	if err := b.initUsageExport(); err != nil {
+		return nil, err
+	}
+
+	if err := b.initObjectStore(); err != nil {
+		return nil, err
+	}
+
+	if err := b.initSecurityEvents(); err != nil {
+		return nil, err
+	}
+
+	for _, h := range b.hooks {
+		if err := b.server.AddHook(h.hook, h.config); err != nil {
+			return nil, err
+		}
+	}
+
+	if b.cluster {
+		if err := b.initClusterNode(); err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+// Config returns the config of the broker.
+func (b *Broker) Config() *config.Config {
+	return b.conf
+}
+
+// Server returns the mqtt server of the broker.
+func (b *Broker) Server() *mqtt.Server {
+	return b.server
+}
+
+// Agent returns the cluster node of the broker, or nil if it is not running in cluster mode.
+func (b *Broker) Agent() *cluster.Agent {
+	return b.agent
+}
+
+// Start joins the cluster in cluster mode, then opens the listeners and starts serving
+// clients. If standby is enabled, the broker serves only once it becomes the active node
+// of its pair. Errors of the running broker are returned by Err.
+func (b *Broker) Start(ctx context.Context) error {
+	b.Lock()
+	defer b.Unlock()
+	if b.started {
+		return ErrBrokerStarted
+	}
+	b.started = true
+
+	ctx, b.cancel = context.WithCancel(ctx)
+	if b.agent != nil {
+		if err := b.agent.Start(); err != nil {
+			return err
+		}
+		b.agentStarted = true
+		log.Info("cluster node created")
+	}
+
+	if b.conf.Standby.Enable && !b.cluster {
+		// serve only once this node becomes the active node of the pair
+		go b.runStandby(ctx)
+		return nil
+	}
+
+	return b.serve()
+}
+
+// Run starts the broker and blocks until the context is done or the broker fails,
+// closing it before returning.
+func (b *Broker) Run(ctx context.Context) error {
+	if err := b.Start(ctx); err != nil {
+		if !errors.Is(err, ErrBrokerStarted) {
+			b.Close()
+		}
+		return err
+	}
+
+	var err error
+	select {
+	case err = <-b.errCh:
+	case <-ctx.Done():
+		log.Warn("caught signal, stopping...")
+	}
+
+	b.Close()
+	return err
+}
+
+// Err returns a channel which receives the error the running broker failed with.
+func (b *Broker) Err() <-chan error {
+	return b.errCh
+}
+
+// Close leaves the cluster and stops the server, disconnecting its clients.
+func (b *Broker) Close() error {
+	b.Lock()
+	defer b.Unlock()
+	if !b.started {
+		return ErrBrokerNotStarted
+	}
+	b.started = false
+
+	b.cancel()
+	if b.bans != nil {
+		b.bans.Stop()
+	}
+	if b.agentStarted {
+		b.agent.Stop()
+		b.agentStarted = false
+	}
+
+	return b.server.Close()
+}
+
+// serve opens the listeners and starts the server.
+func (b *Broker) serve() error {
+	if err := b.addListeners(); err != nil {
+		return err
+	}
+
+	return b.server.Serve()
+}
+
+// addListeners adds the tcp, websocket, quic and http listeners of the config and the
+// listeners of the options to the server.
+func (b *Broker) addListeners() error {
+	for _, l := range b.listeners {
+		if err := b.server.AddListener(l); err != nil {
+			return err
+		}
+	}
+
+	if b.noDefaultListeners {
+		return nil
+	}
+
+	// gen tls config
+	var listenerConfig *listeners.Config
+	tlsConfig, err := config.GenTlsConfig(b.conf)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		listenerConfig = &listeners.Config{TLSConfig: tlsConfig}
+	}
+
+	// add tcp listeners, with a separate ipv6 listener if configured
+	tcp := listeners.NewTCP("tcp", b.conf.Mqtt.TCP, b.tcpConfig(b.listenerConfig("tcp", tlsConfig, b.conf.Mqtt.ProxyProtocol, ipv4Family(b.conf.Mqtt.TCP6))))
+	if err := b.server.AddListener(tcp); err != nil {
+		return err
+	}
+	if b.conf.Mqtt.TCP6 != "" {
+		tcp6 := listeners.NewTCP("tcp6", b.conf.Mqtt.TCP6, b.tcpConfig(b.listenerConfig("tcp6", tlsConfig, b.conf.Mqtt.ProxyProtocol, listeners.FamilyIPv6)))
+		if err := b.server.AddListener(tcp6); err != nil {
+			return err
+		}
+	}
+
+	// add websocket listeners
+	ws := listeners.NewWebsocket("ws", b.conf.Mqtt.WS, b.websocketConfig(b.listenerConfig("ws", tlsConfig, false, ipv4Family(b.conf.Mqtt.WS6))))
+	if err := b.server.AddListener(ws); err != nil {
+		return err
+	}
+	if b.conf.Mqtt.WS6 != "" {
+		ws6 := listeners.NewWebsocket("ws6", b.conf.Mqtt.WS6, b.websocketConfig(b.listenerConfig("ws6", tlsConfig, false, listeners.FamilyIPv6)))
+		if err := b.server.AddListener(ws6); err != nil {
+			return err
+		}
+	}
+
+	// add quic listeners
+	if b.conf.Mqtt.QUIC != "" {
+		quic := listeners.NewQUIC("quic", b.conf.Mqtt.QUIC, b.listenerConfig("quic", tlsConfig, false, ipv4Family(b.conf.Mqtt.QUIC6)))
+		if err := b.server.AddListener(quic); err != nil {
+			return err
+		}
+	}
+	if b.conf.Mqtt.QUIC6 != "" {
+		quic6 := listeners.NewQUIC("quic6", b.conf.Mqtt.QUIC6, b.listenerConfig("quic6", tlsConfig, false, listeners.FamilyIPv6))
+		if err := b.server.AddListener(quic6); err != nil {
+			return err
+		}
+	}
+
+	// add coap gateway listener
+	if b.conf.Mqtt.CoAP != "" {
+		coap := listeners.NewCoAP("coap", b.conf.Mqtt.CoAP, b.listenerConfig("coap", nil, false, ""), b.server)
+		if err := b.server.AddListener(coap); err != nil {
+			return err
+		}
+	}
+
+	// add the listeners of the config
+	for _, lc := range b.conf.Mqtt.Listeners {
+		l, err := b.configuredListener(lc)
+		if err != nil {
+			return fmt.Errorf("listener %s: %w", lc.ID, err)
+		}
+		if err := b.server.AddListener(l); err != nil {
+			return fmt.Errorf("listener %s: %w", lc.ID, err)
+		}
+	}
+
+	// add http listener
+	handlers := make(map[string]listeners.Handler)
+	if b.agent != nil {
+		handlers = csRt.New(b.agent).GenHandlers()
+	}
+	maps.Copy(handlers, mqttRt.New(b.server).GenHandlers())
+	maps.Copy(handlers, b.handlers)
+	httpConfig, err := b.httpConfig(listenerConfig, handlers)
+	if err != nil {
+		return err
+	}
+	stats := listeners.NewHTTP("stats", b.conf.Mqtt.HTTP, httpConfig, handlers)
+	if err := b.server.AddListener(stats); err != nil {
+		return err
+	}
+
+	// add the listener serving mqtt, mqtt over websockets and the http api on one port
+	if b.conf.Mqtt.Mux != "" {
+		muxConfig := b.websocketConfig(b.listenerConfig("mux", tlsConfig, false, ""))
+		if b.conf.Mqtt.HTTPAuth != nil {
+			if muxConfig == nil {
+				muxConfig = new(listeners.Config)
+			}
+			muxConfig.HTTPAuth = b.conf.Mqtt.HTTPAuth
+		}
+		mux := listeners.NewMux("mux", b.conf.Mqtt.Mux, muxConfig, handlers)
+		if err := b.server.AddListener(mux); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// configuredListener returns a listener of the config, with its tls profile, options,
+// auth policy and ip filter.
+func (b *Broker) configuredListener(lc config.Listener) (listeners.Listener, error) {
+	if lc.ID == "" || lc.Address == "" {
+		return nil, config.ErrListenerConfig
+	}
+
+	tlsConfig, err := config.GenListenerTlsConfig(b.conf, lc.Tls)
+	if err != nil {
+		return nil, err
+	}
+
+	c := b.listenerConfig(lc.ID, tlsConfig, lc.ProxyProtocol, lc.Family)
+	if c == nil {
+		c = new(listeners.Config)
+	}
+
+	switch lc.Type {
+	case config.ListenerTCP:
+		c.Acceptors, c.Socket = lc.Acceptors, lc.Socket
+		return listeners.NewTCP(lc.ID, lc.Address, c), nil
+	case config.ListenerWebsocket:
+		c.Websocket = lc.Websocket
+		return listeners.NewWebsocket(lc.ID, lc.Address, c), nil
+	case config.ListenerQUIC:
+		return listeners.NewQUIC(lc.ID, lc.Address, c), nil
+	case config.ListenerUnix:
+		return listeners.NewUnixSock(lc.ID, lc.Address), nil
+	case config.ListenerWebTransport:
+		c.Websocket = lc.Websocket
+		return listeners.NewWebTransport(lc.ID, lc.Address, c), nil
+	}
+
+	return nil, config.ErrListenerType
+}
+
+// httpConfig returns the config of the http listener, served over tls with the http
+// certificate or the enrollment tls config, and with the ip filter and credentials
+// configured for the http api, or nil if it needs none.
+func (b *Broker) httpConfig(listenerConfig *listeners.Config, handlers map[string]listeners.Handler) (*listeners.Config, error) {
+	httpTLS, err := config.GenHTTPTlsConfig(b.conf)
+	if err != nil {
+		return nil, err
+	}
+	if httpTLS != nil {
+		listenerConfig = &listeners.Config{TLSConfig: httpTLS}
+	}
+
+	c, err := b.initEnrollment(listenerConfig, handlers)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil && httpTLS != nil {
+		c = listenerConfig
+	}
+
+	filter, auth := b.conf.Mqtt.ListenerIPFilter["stats"], b.conf.Mqtt.HTTPAuth
+	if filter == nil && auth == nil {
+		return c, nil
+	}
+	if c == nil {
+		c = new(listeners.Config)
+	}
+	c.IPFilter, c.HTTPAuth = filter, auth
+
+	return c, nil
+}
+
+// listenerConfig returns the config of a default mqtt listener, with the address family
+// and auth policy configured for the listener, or nil if it needs none.
+func (b *Broker) listenerConfig(id string, tlsConfig *tls.Config, proxyProtocol bool, family string) *listeners.Config {
+	policy, ok := b.conf.Mqtt.ListenerAuth[id]
+	filter := b.conf.Mqtt.ListenerIPFilter[id]
+	if tlsConfig == nil && !proxyProtocol && !ok && family == "" && filter == nil {
+		return nil
+	}
+
+	c := &listeners.Config{TLSConfig: tlsConfig, ProxyProtocol: proxyProtocol, Family: family, IPFilter: filter}
+	if ok {
+		c.Auth = &policy
+	}
+
+	return c
+}
+
+// tcpConfig returns the config of a tcp listener with the configured number of acceptors
+// and socket options.
+func (b *Broker) tcpConfig(c *listeners.Config) *listeners.Config {
+	if b.conf.Mqtt.TCPAcceptors <= 1 && b.conf.Mqtt.TCPSocket == nil {
+		return c
+	}
+
+	if c == nil {
+		c = new(listeners.Config)
+	}
+	c.Socket = b.conf.Mqtt.TCPSocket
+	if b.conf.Mqtt.TCPAcceptors > 1 {
+		c.Acceptors = b.conf.Mqtt.TCPAcceptors
+	}
+
+	return c
+}
+
+// websocketConfig returns the config of a websocket listener with the configured path,
+// origin checks and compression.
+func (b *Broker) websocketConfig(c *listeners.Config) *listeners.Config {
+	if b.conf.Mqtt.Websocket == nil {
+		return c
+	}
+
+	if c == nil {
+		c = new(listeners.Config)
+	}
+	c.Websocket = b.conf.Mqtt.Websocket
+
+	return c
+}
+
+// ipv4Family returns the family of a default listener, which serves only ipv4 if it has a
+// separate ipv6 listener, or both families if it does not.
+func ipv4Family(addr6 string) string {
+	if addr6 == "" {
+		return ""
+	}
+
+	return listeners.FamilyIPv4
+}
+
+// runStandby runs this node as one of an active/passive pair sharing the redis store,
+// starting the server when it is promoted to the active node.
+func (b *Broker) runStandby(ctx context.Context) {
+	if b.conf.StorageWay != config.StorageWayRedis {
+		b.errCh <- config.ErrStandbyWay
+		return
+	}
+
+	dial, err := config.GenOutboundDialer(b.conf)
+	if err != nil {
+		b.errCh <- err
+		return
+	}
+
+	client := rv8.NewUniversalClient(redisOptions(b.conf, dial))
+	defer client.Close()
+
+	pair := standby.New(&b.conf.Standby, client, b.conf.Redis.HPrefix)
+	if b.conf.Standby.ReadinessAddr != "" {
+		srv := &http.Server{Addr: b.conf.Standby.ReadinessAddr, Handler: pair}
+		go func() {
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Error("standby readiness", "error", err)
+			}
+		}()
+		defer srv.Close()
+	}
+
+	if err := pair.Run(ctx, b.serve); err != nil {
+		b.errCh <- err
+	}
+}
+
+func (b *Broker) initAuth() error {
+	conf := b.conf
+	if conf.Auth.Way != config.AuthModeAnonymous && conf.Auth.Way != config.AuthModeUsername &&
+		conf.Auth.Way != config.AuthModeClientid && conf.Auth.Way != config.AuthModeAnonymousACL {
+		return config.ErrAuthWay
+	}
+
+	// the blacklist and its bans deny clients before any auth hook is called, whatever the
+	// auth way, including the clients of anonymous listeners
+	ledger := auth.Ledger{}
+	bans := pa.NewBlacklistManager(b.server, &ledger, conf.Auth.BlacklistPath)
+	if _, err := bans.Load(); err != nil {
+		return err
+	}
+	b.server.SetBlacklist(&ledger)
+	b.server.Bans = bans
+	b.bans = bans
+	bans.Watch(time.Duration(conf.Auth.BlacklistReload) * time.Second)
+
+	if conf.Auth.Way == config.AuthModeAnonymous {
+		return b.server.AddHook(new(auth.AllowHook), nil)
+	}
+
+	// clients without a username are restricted to the anonymous acl, the others are
+	// authenticated by the datasources
+	if conf.Auth.Way == config.AuthModeAnonymousACL {
+		opts := &auth.AnonymousOptions{ACL: conf.Auth.AnonymousACL}
+		opts.SetBlacklist(&ledger)
+		if err := b.server.AddHook(new(auth.AnonymousHook), opts); err != nil {
+			return err
+		}
+	}
+
+	if conf.Auth.Datasource == config.AuthDSFree {
+		return nil
+	}
+
+	// the datasources of the chain authenticate the clients unknown to the previous ones
+	links := append([]config.AuthLink{{Datasource: conf.Auth.Datasource, ConfPath: conf.Auth.ConfPath}}, conf.Auth.Chain...)
+	for i, link := range links {
+		if link.Datasource == config.AuthDSFree || slices.ContainsFunc(links[:i], func(l config.AuthLink) bool {
+			return l.Datasource == link.Datasource
+		}) {
+			return config.ErrAuthChain
+		}
+	}
+	for _, link := range links {
+		if err := b.addAuthHook(link, &ledger); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addAuthHook adds the auth hook of a datasource, sharing the blacklist ledger.
+func (b *Broker) addAuthHook(link config.AuthLink, ledger *auth.Ledger) error {
+	var hook mqtt.Hook
+	var opts interface{ SetBlacklist(*auth.Ledger) }
+	switch link.Datasource {
+	case config.AuthDSRedis:
+		hook, opts = new(rauth.Auth), new(rauth.Options)
+	case config.AuthDSMysql:
+		hook, opts = new(mauth.Auth), new(mauth.Options)
+	case config.AuthDSPostgresql:
+		hook, opts = new(pauth.Auth), new(pauth.Options)
+	case config.AuthDSHttp:
+		hook, opts = new(hauth.Auth), new(hauth.Options)
+	case config.AuthDSX509:
+		hook, opts = new(xauth.Auth), new(xauth.Options)
+	case config.AuthDSJWT:
+		hook, opts = new(jauth.Auth), new(jauth.Options)
+	case config.AuthDSOAuth2:
+		hook, opts = new(oauth.Auth), new(oauth.Options)
+	case config.AuthDSVault:
+		hook, opts = new(vauth.Auth), new(vauth.Options)
+	case config.AuthDSGrpc:
+		hook, opts = new(gauth.Auth), new(gauth.Options)
+	case config.AuthDSSqlite:
+		hook, opts = new(sauth.Auth), new(sauth.Options)
+	default:
+		return nil
+	}
+
+	if err := plugin.LoadYaml(link.ConfPath, opts); err != nil {
+		return err
+	}
+	if err := b.server.AddHook(hook, opts); err != nil {
+		return err
+	}
+	opts.SetBlacklist(ledger)
+
+	return nil
+}
+
+func (b *Broker) initStorage() error {
+	conf := b.conf
+	enc, err := storageEncryption(conf)
+	if err != nil {
+		return err
+	}
+	if enc.Enabled() && (b.cluster || (conf.StorageWay != config.StorageWayBolt && conf.StorageWay != config.StorageWayBadger)) {
+		return config.ErrEncryption
+	}
+
+	if b.cluster {
+		if conf.StorageWay != config.StorageWayRedis {
+			return config.ErrStorageWay
+		}
+		return b.initClusterStorage()
+	}
+
+	switch conf.StorageWay {
+	case config.StorageWayBolt:
+		return b.server.AddHook(new(bolt.Hook), &bolt.Options{
+			Path: conf.StoragePath,
+			Options: &bbolt.Options{
+				Timeout: 500 * time.Millisecond,
+			},
+			Expiry:      storageExpiry(conf),
+			WriteBehind: writeBehind(conf),
+			Encryption:  enc,
+		})
+	case config.StorageWayBadger:
+		return b.server.AddHook(new(badger.Hook), &badger.Options{
+			Path:             conf.StoragePath,
+			Expiry:           storageExpiry(conf),
+			WriteBehind:      writeBehind(conf),
+			Encryption:       enc,
+			GcInterval:       time.Duration(conf.Badger.GcInterval) * time.Second,
+			GcDiscardRatio:   conf.Badger.GcDiscardRatio,
+			MaxTableSize:     conf.Badger.MaxTableSize,
+			NumMemtables:     conf.Badger.NumMemtables,
+			NumCompactors:    conf.Badger.NumCompactors,
+			ValueLogFileSize: conf.Badger.ValueLogFileSize,
+			ValueThreshold:   conf.Badger.ValueThreshold,
+		})
+	case config.StorageWayRedis:
+		dial, err := config.GenOutboundDialer(conf)
+		if err != nil {
+			return err
+		}
+		return b.server.AddHook(new(redis.Hook), &redis.Options{
+			HPrefix:     conf.Redis.HPrefix,
+			Universal:   redisOptions(conf, dial),
+			Expiry:      storageExpiry(conf),
+			WriteBehind: writeBehind(conf),
+			Pipeline:    conf.Redis.Pipeline,
+			Multi:       conf.Redis.Multi,
+			Health:      conf.Redis.Health,
+		})
+	case config.StorageWayPostgres:
+		return b.server.AddHook(new(postgres.Hook), &postgres.Options{
+			Dsn:          conf.Postgres.Dsn,
+			Prefix:       conf.Postgres.Prefix,
+			MaxOpenConns: conf.Postgres.MaxOpenConns,
+		})
+	case config.StorageWayCassandra:
+		return b.server.AddHook(new(cassandra.Hook), &cassandra.Options{
+			Hosts:           conf.Cassandra.Hosts,
+			Keyspace:        conf.Cassandra.Keyspace,
+			Replication:     conf.Cassandra.Replication,
+			Prefix:          conf.Cassandra.Prefix,
+			Username:        conf.Cassandra.Username,
+			Password:        conf.Cassandra.Password,
+			Timeout:         time.Duration(conf.Cassandra.Timeout) * time.Second,
+			Consistency:     conf.Cassandra.Consistency,
+			ReadConsistency: conf.Cassandra.ReadConsistency,
+			Expiry:          storageExpiry(conf),
+		})
+	case config.StorageWayDynamoDB:
+		return b.server.AddHook(new(dynamodb.Hook), &dynamodb.Options{
+			Table:           conf.DynamoDB.Table,
+			Region:          conf.DynamoDB.Region,
+			Endpoint:        conf.DynamoDB.Endpoint,
+			AccessKeyID:     conf.DynamoDB.AccessKeyID,
+			SecretAccessKey: conf.DynamoDB.SecretAccessKey,
+			BillingMode:     conf.DynamoDB.BillingMode,
+			ReadCapacity:    conf.DynamoDB.ReadCapacity,
+			WriteCapacity:   conf.DynamoDB.WriteCapacity,
+			TTLAttribute:    conf.DynamoDB.TTLAttribute,
+			ConsistentRead:  conf.DynamoDB.ConsistentRead,
+			Expiry:          storageExpiry(conf),
+		})
+	case config.StorageWaySqlite:
+		return b.server.AddHook(new(sqlite.Hook), &sqlite.Options{
+			Path: conf.StoragePath,
+		})
+	case config.StorageWaySnapshot:
+		return b.server.AddHook(new(memory.Hook), &memory.Options{
+			Path:     conf.StoragePath,
+			Interval: time.Duration(conf.Memory.SnapshotInterval) * time.Second,
+		})
+	}
+
+	return nil
+}
+
+// initClusterStorage adds the redis storage shared by the nodes of a cluster.
+func (b *Broker) initClusterStorage() error {
+	conf := b.conf
+	dial, err := config.GenOutboundDialer(conf)
+	if err != nil {
+		return err
+	}
+
+	b.store = new(coredis.Storage)
+	err = b.server.AddHook(b.store, &coredis.Options{
+		HPrefix:   conf.Redis.HPrefix,
+		NodeName:  conf.Cluster.NodeName,
+		Universal: redisOptions(conf, dial),
+	})
+	if err != nil {
+		return err
+	}
+
+	// enforce rate limits across the cluster rather than on each node
+	b.server.SetRateLimiter(b.store.RateLimiter())
+	return nil
+}
+
+// storageExpiry returns the ages after which the storage hook deletes its records.
+func storageExpiry(conf *config.Config) storage.Expiry {
+	return storage.Expiry{
+		Retained: time.Duration(conf.StorageExpiry.Retained) * time.Second,
+		Inflight: time.Duration(conf.StorageExpiry.Inflight) * time.Second,
+		Session:  time.Duration(conf.StorageExpiry.Session) * time.Second,
+		Interval: time.Duration(conf.StorageExpiry.GcInterval) * time.Second,
+
+		SessionInterval: conf.StorageExpiry.SessionInterval,
+	}
+}
+
+// writeBehind returns the buffering of the writes of the storage hook.
+func writeBehind(conf *config.Config) storage.WriteBehind {
+	return storage.WriteBehind{
+		Enabled:  conf.StorageWriteBehind.Enable,
+		Size:     conf.StorageWriteBehind.Size,
+		Batch:    conf.StorageWriteBehind.Batch,
+		Interval: time.Duration(conf.StorageWriteBehind.Interval) * time.Millisecond,
+	}
+}
+
+// storageEncryption returns the encryption at rest of the storage hook, reading its key from
+// the key file or environment variable if set, e.g. as provided by a secrets manager or kms agent.
+func storageEncryption(conf *config.Config) (storage.Encryption, error) {
+	var e storage.Encryption
+	c := conf.StorageEncryption
+	key := c.Key
+	if c.KeyFile != "" {
+		b, err := os.ReadFile(c.KeyFile)
+		if err != nil {
+			return e, fmt.Errorf("read storage encryption key; %w", err)
+		}
+		key = string(b)
+	} else if c.KeyEnv != "" {
+		key = os.Getenv(c.KeyEnv)
+		if key == "" {
+			return e, fmt.Errorf("storage encryption key environment variable %s is not set", c.KeyEnv)
+		}
+	}
+
+	if key = strings.TrimSpace(key); key == "" {
+		return e, nil
+	}
+
+	var err error
+	if e.Key, err = storage.DecodeKey(key); err != nil {
+		return e, err
+	}
+	for _, k := range c.PreviousKeys {
+		prev, err := storage.DecodeKey(strings.TrimSpace(k))
+		if err != nil {
+			return e, fmt.Errorf("previous key: %w", err)
+		}
+		e.PreviousKeys = append(e.PreviousKeys, prev)
+	}
+
+	return e, nil
+}
+
+// redisOptions returns the options of the redis storage, a single node unless a cluster or
+// sentinel failover group is configured.
+func redisOptions(conf *config.Config, dial plugin.DialFunc) *rv8.UniversalOptions {
+	ro := conf.Redis.Options
+	addrs := ro.Addrs
+	if len(addrs) == 0 {
+		addrs = []string{ro.Addr}
+	}
+
+	return &rv8.UniversalOptions{
+		Addrs:            addrs,
+		IsClusterMode:    ro.ClusterMode,
+		MasterName:       ro.MasterName,
+		Username:         ro.Username,
+		Password:         ro.Password,
+		SentinelUsername: ro.SentinelUsername,
+		SentinelPassword: ro.SentinelPassword,
+		DB:               ro.DB,
+		Dialer:           dial,
+	}
+}
+
+func (b *Broker) initBridge() error {
+	conf := b.conf
+	switch conf.BridgeWay {
+	case config.BridgeWayKafka:
+		opts := cokafka.Options{}
+		if err := plugin.LoadYaml(conf.BridgePath, &opts); err != nil {
+			return err
+		}
+		return b.server.AddHook(new(cokafka.Bridge), &opts)
+	case config.BridgeWayMqtt:
+		opts := comqttbridge.Options{}
+		if err := plugin.LoadYaml(conf.BridgePath, &opts); err != nil {
+			return err
+		}
+		opts.Server = b.server
+		return b.server.AddHook(new(comqttbridge.Bridge), &opts)
+	case config.BridgeWayAws:
+		opts := coaws.Options{}
+		if err := plugin.LoadYaml(conf.BridgePath, &opts); err != nil {
+			return err
+		}
+		return b.server.AddHook(new(coaws.Bridge), &opts)
+	case config.BridgeWayInfluxDB:
+		opts := coinfluxdb.Options{}
+		if err := plugin.LoadYaml(conf.BridgePath, &opts); err != nil {
+			return err
+		}
+		return b.server.AddHook(new(coinfluxdb.Bridge), &opts)
+	default:
+		return nil
+	}
+}
+
+func (b *Broker) initUsageExport() error {
+	conf := b.conf
+	if conf.UsageExport.CSVFile == "" && conf.UsageExport.Webhook == "" {
+		return nil
+	}
+
+	return b.server.AddHook(new(usage.Hook), &conf.UsageExport)
+}
+
+// initObjectStore adds the hook uploading the snapshots of export jobs, if configured.
+func (b *Broker) initObjectStore() error {
+	if b.conf.ObjectStore.Bucket == "" {
+		return nil
+	}
+
+	return b.server.AddHook(new(objectstore.Hook), &b.conf.ObjectStore)
+}
+
+// initSecurityEvents adds the hook posting security events to a webhook, if configured.
+func (b *Broker) initSecurityEvents() error {
+	if b.conf.Security.Webhook == "" {
+		return nil
+	}
+
+	return b.server.AddHook(new(security.Hook), &b.conf.Security)
+}
+
+// initClusterNode creates the cluster node of the broker, which joins the cluster when
+// the broker is started.
+func (b *Broker) initClusterNode() error {
+	dial, err := config.GenOutboundDialer(b.conf)
+	if err != nil {
+		return err
+	}
+
+	b.agent = cluster.NewAgent(&b.conf.Cluster)
+	b.agent.BindMqttServer(b.server)
+	b.agent.BindWillStore(b.store)
+	b.agent.BindDialer(dial)
+	return nil
+}
+
+// initEnrollment adds the certificate enrollment handlers to the http handlers, returning
+// the tls config of the http listener serving them.
+func (b *Broker) initEnrollment(listenerConfig *listeners.Config, handlers map[string]listeners.Handler) (*listeners.Config, error) {
+	if !b.conf.Est.Enable {
+		return nil, nil
+	}
+
+	ca, err := est.NewCA(&b.conf.Est)
+	if err != nil {
+		return nil, err
+	}
+
+	e := est.New(b.server, ca)
+	var base *tls.Config
+	if listenerConfig != nil {
+		base = listenerConfig.TLSConfig
+	}
+	tlsConfig, err := e.TLSConfig(base)
+	if err != nil {
+		return nil, err
+	}
+
+	maps.Copy(handlers, e.GenHandlers())
+	return &listeners.Config{TLSConfig: tlsConfig}, nil
+}
@@ -0,0 +1,537 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package comqtt
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	rv8 "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/config"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
+	"github.com/wind-c/comqtt/v2/mqtt/listeners"
+)
+
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// testHook records whether it was added to the server.
+type testHook struct {
+	mqtt.HookBase
+	config any
+}
+
+func (h *testHook) ID() string {
+	return "test-hook"
+}
+
+func (h *testHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{mqtt.OnStarted}, []byte{b})
+}
+
+func (h *testHook) Init(config any) error {
+	h.config = config
+	return nil
+}
+
+func TestNewBroker(t *testing.T) {
+	hook := new(testHook)
+	b, err := NewBroker(WithLogger(logger), WithHook(hook, "opts"))
+	require.NoError(t, err)
+	require.NotNil(t, b.Server())
+	require.Nil(t, b.Agent())
+	require.Equal(t, "opts", hook.config)
+	require.Equal(t, logger, b.Config().Mqtt.Options.Logger)
+}
+
+func TestNewBrokerConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conf.yml")
+	err := os.WriteFile(path, []byte("storage-way: 0\nauth:\n  way: 0\nmqtt:\n  tcp: :11883\n"), 0600)
+	require.NoError(t, err)
+
+	b, err := NewBroker(WithConfigFile(path), WithLogger(logger))
+	require.NoError(t, err)
+	require.Equal(t, ":11883", b.Config().Mqtt.TCP)
+
+	_, err = NewBroker(WithConfigFile(filepath.Join(t.TempDir(), "missing.yml")))
+	require.Error(t, err)
+}
+
+func TestNewBrokerInvalid(t *testing.T) {
+	conf := config.New()
+	conf.Auth.Way = 9
+	_, err := NewBroker(WithConfig(conf), WithLogger(logger))
+	require.ErrorIs(t, err, config.ErrAuthWay)
+
+	conf = config.New()
+	conf.Auth.Way = config.AuthModeUsername
+	conf.Auth.Datasource = config.AuthDSRedis
+	conf.Auth.Chain = []config.AuthLink{{Datasource: config.AuthDSHttp}, {Datasource: config.AuthDSRedis}}
+	_, err = NewBroker(WithConfig(conf), WithLogger(logger))
+	require.ErrorIs(t, err, config.ErrAuthChain)
+
+	_, err = NewBroker(WithCluster(), WithLogger(logger))
+	require.ErrorIs(t, err, config.ErrClusterOpts)
+
+	conf = config.New()
+	conf.Cluster.Members = []string{"127.0.0.1:7946"}
+	_, err = NewBroker(WithConfig(conf), WithCluster(), WithLogger(logger))
+	require.ErrorIs(t, err, config.ErrStorageWay)
+}
+
+func TestBrokerLifecycle(t *testing.T) {
+	l := listeners.NewMockListener("t1", ":1882")
+	b, err := NewBroker(WithLogger(logger), WithoutDefaultListeners(), WithListener(l))
+	require.NoError(t, err)
+	require.ErrorIs(t, b.Close(), ErrBrokerNotStarted)
+
+	require.NoError(t, b.Start(context.Background()))
+	require.ErrorIs(t, b.Start(context.Background()), ErrBrokerStarted)
+	require.Eventually(t, l.IsServing, time.Second, time.Millisecond)
+	_, ok := b.Server().Listeners.Get("tcp")
+	require.False(t, ok)
+
+	require.NoError(t, b.Close())
+	require.False(t, l.IsServing())
+}
+
+func TestBrokerDefaultListeners(t *testing.T) {
+	conf := config.New()
+	conf.Mqtt.TCP = "127.0.0.1:0"
+	conf.Mqtt.WS = "127.0.0.1:0"
+	conf.Mqtt.HTTP = "127.0.0.1:0"
+	conf.Mqtt.ProxyProtocol = true
+
+	b, err := NewBroker(WithConfig(conf), WithLogger(logger), WithHandlers(map[string]listeners.Handler{
+		"GET /custom": func(w http.ResponseWriter, r *http.Request) {},
+	}))
+	require.NoError(t, err)
+	require.NoError(t, b.Start(context.Background()))
+	defer b.Close()
+
+	for _, id := range []string{"tcp", "ws", "stats"} {
+		_, ok := b.Server().Listeners.Get(id)
+		require.True(t, ok, id)
+	}
+	_, ok := b.Server().Listeners.Get("quic")
+	require.False(t, ok)
+}
+
+func TestBrokerRun(t *testing.T) {
+	l := listeners.NewMockListener("t1", ":1882")
+	b, err := NewBroker(WithLogger(logger), WithoutDefaultListeners(), WithListener(l))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- b.Run(ctx)
+	}()
+
+	require.Eventually(t, l.IsServing, time.Second, time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		require.Fail(t, "broker did not stop")
+	}
+	require.False(t, l.IsServing())
+}
+
+func TestBrokerListenerAuth(t *testing.T) {
+	conf := config.New()
+	conf.Mqtt.TCP = "127.0.0.1:0"
+	conf.Mqtt.WS = "127.0.0.1:0"
+	conf.Mqtt.HTTP = "127.0.0.1:0"
+	conf.Mqtt.ListenerAuth = map[string]listeners.AuthPolicy{"tcp": {Anonymous: true}}
+
+	b, err := NewBroker(WithConfig(conf), WithLogger(logger))
+	require.NoError(t, err)
+	require.NoError(t, b.Start(context.Background()))
+	defer b.Close()
+
+	l, ok := b.Server().Listeners.Get("tcp")
+	require.True(t, ok)
+	require.True(t, l.(listeners.Configurable).Config().Auth.Anonymous)
+
+	l, ok = b.Server().Listeners.Get("ws")
+	require.True(t, ok)
+	require.Nil(t, l.(listeners.Configurable).Config().Auth)
+}
+
+func TestBrokerAnonymousBans(t *testing.T) {
+	conf := config.New()
+	conf.Auth.Way = config.AuthModeAnonymous
+
+	b, err := NewBroker(WithConfig(conf), WithLogger(logger))
+	require.NoError(t, err)
+	defer b.Close()
+
+	require.NotNil(t, b.Server().Bans)
+	_, err = b.Server().Bans.Ban(mqtt.BanClient, "banned")
+	require.NoError(t, err)
+	require.Equal(t, []mqtt.Ban{{Kind: mqtt.BanClient, Value: "banned"}}, b.Server().Bans.Bans())
+}
+
+func TestBrokerAnonymousACL(t *testing.T) {
+	conf := config.New()
+	conf.Auth.Way = config.AuthModeAnonymousACL
+	conf.Auth.Datasource = config.AuthDSFree
+	conf.Auth.AnonymousACL = auth.Filters{"public/#": auth.ReadOnly}
+
+	b, err := NewBroker(WithConfig(conf), WithLogger(logger))
+	require.NoError(t, err)
+	defer b.Close()
+
+	ids := make([]string, 0)
+	for _, st := range b.Server().HookStats() {
+		ids = append(ids, st.ID)
+	}
+	require.Contains(t, ids, "anonymous-auth")
+}
+
+func TestBrokerWebsocketConfig(t *testing.T) {
+	conf := config.New()
+	conf.Mqtt.TCP = "127.0.0.1:0"
+	conf.Mqtt.WS = "127.0.0.1:0"
+	conf.Mqtt.HTTP = "127.0.0.1:0"
+	conf.Mqtt.Websocket = &listeners.WebsocketConfig{Path: "/mqtt", Compression: true}
+
+	b, err := NewBroker(WithConfig(conf), WithLogger(logger))
+	require.NoError(t, err)
+	require.NoError(t, b.Start(context.Background()))
+	defer b.Close()
+
+	l, ok := b.Server().Listeners.Get("ws")
+	require.True(t, ok)
+	require.Equal(t, conf.Mqtt.Websocket, l.(listeners.Configurable).Config().Websocket)
+
+	l, ok = b.Server().Listeners.Get("tcp")
+	require.True(t, ok)
+	require.Nil(t, l.(listeners.Configurable).Config().Websocket)
+}
+
+func TestBrokerDualStackListeners(t *testing.T) {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("ipv6 is not available")
+	}
+	_ = ln.Close()
+
+	conf := config.New()
+	conf.Mqtt.TCP = "127.0.0.1:0"
+	conf.Mqtt.TCP6 = "[::1]:0"
+	conf.Mqtt.WS = "127.0.0.1:0"
+	conf.Mqtt.HTTP = "127.0.0.1:0"
+
+	b, err := NewBroker(WithConfig(conf), WithLogger(logger))
+	require.NoError(t, err)
+	require.NoError(t, b.Start(context.Background()))
+	defer b.Close()
+
+	l, ok := b.Server().Listeners.Get("tcp")
+	require.True(t, ok)
+	require.Equal(t, listeners.FamilyIPv4, l.(listeners.Configurable).Config().Family)
+
+	l, ok = b.Server().Listeners.Get("tcp6")
+	require.True(t, ok)
+	require.Equal(t, listeners.FamilyIPv6, l.(listeners.Configurable).Config().Family)
+
+	l, ok = b.Server().Listeners.Get("ws")
+	require.True(t, ok)
+	require.Equal(t, "", l.(listeners.Configurable).Config().Family)
+}
+
+func TestBrokerCoAPListener(t *testing.T) {
+	conf := config.New()
+	conf.Mqtt.TCP = "127.0.0.1:0"
+	conf.Mqtt.WS = "127.0.0.1:0"
+	conf.Mqtt.HTTP = "127.0.0.1:0"
+	conf.Mqtt.CoAP = "127.0.0.1:0"
+
+	b, err := NewBroker(WithConfig(conf), WithLogger(logger))
+	require.NoError(t, err)
+	require.NoError(t, b.Start(context.Background()))
+	defer b.Close()
+
+	l, ok := b.Server().Listeners.Get("coap")
+	require.True(t, ok)
+	require.Equal(t, "coap", l.Protocol())
+}
+
+func TestBrokerTCPAcceptors(t *testing.T) {
+	conf := config.New()
+	conf.Mqtt.TCP = "127.0.0.1:0"
+	conf.Mqtt.TCPAcceptors = 2
+	conf.Mqtt.WS = "127.0.0.1:0"
+	conf.Mqtt.HTTP = "127.0.0.1:0"
+
+	b, err := NewBroker(WithConfig(conf), WithLogger(logger))
+	require.NoError(t, err)
+	require.NoError(t, b.Start(context.Background()))
+	defer b.Close()
+
+	l, ok := b.Server().Listeners.Get("tcp")
+	require.True(t, ok)
+	require.Equal(t, 2, l.(listeners.Configurable).Config().Acceptors)
+}
+
+func TestBrokerMuxListener(t *testing.T) {
+	conf := config.New()
+	conf.Mqtt.TCP = "127.0.0.1:0"
+	conf.Mqtt.WS = "127.0.0.1:0"
+	conf.Mqtt.HTTP = "127.0.0.1:0"
+	conf.Mqtt.Mux = "127.0.0.1:0"
+
+	b, err := NewBroker(WithConfig(conf), WithLogger(logger))
+	require.NoError(t, err)
+	require.NoError(t, b.Start(context.Background()))
+	defer b.Close()
+
+	l, ok := b.Server().Listeners.Get("mux")
+	require.True(t, ok)
+	require.Equal(t, "mux", l.Protocol())
+
+	resp, err := http.Get("http://" + l.Address() + "/api/v1/mqtt/stat/overall")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestBrokerHTTPAuth(t *testing.T) {
+	conf := config.New()
+	conf.Mqtt.TCP = "127.0.0.1:0"
+	conf.Mqtt.WS = "127.0.0.1:0"
+	conf.Mqtt.HTTP = "127.0.0.1:0"
+	conf.Mqtt.Mux = "127.0.0.1:0"
+	conf.Mqtt.HTTPAuth = &listeners.HTTPAuth{ReadTokens: []string{"read-token"}}
+
+	b, err := NewBroker(WithConfig(conf), WithLogger(logger))
+	require.NoError(t, err)
+	require.NoError(t, b.Start(context.Background()))
+	defer b.Close()
+
+	l, ok := b.Server().Listeners.Get("stats")
+	require.True(t, ok)
+	require.Equal(t, conf.Mqtt.HTTPAuth, l.(listeners.Configurable).Config().HTTPAuth)
+	require.Equal(t, "http", l.Protocol())
+
+	l, ok = b.Server().Listeners.Get("mux")
+	require.True(t, ok)
+	url := "http://" + l.Address() + "/api/v1/mqtt/stat/overall"
+
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer read-token")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = http.Get("http://" + l.Address() + "/livez")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestBrokerHTTPTlsMissingKey(t *testing.T) {
+	conf := config.New()
+	conf.Mqtt.TCP = "127.0.0.1:0"
+	conf.Mqtt.WS = "127.0.0.1:0"
+	conf.Mqtt.HTTP = "127.0.0.1:0"
+	conf.Mqtt.HTTPTls.ServerCert = "server.pem"
+
+	b, err := NewBroker(WithConfig(conf), WithLogger(logger))
+	require.NoError(t, err)
+	require.ErrorIs(t, b.Start(context.Background()), config.ErrMissingCertOrKey)
+	_ = b.Close()
+}
+
+func TestBrokerConfiguredListeners(t *testing.T) {
+	conf := config.New()
+	conf.Mqtt.TCP = "127.0.0.1:0"
+	conf.Mqtt.WS = "127.0.0.1:0"
+	conf.Mqtt.HTTP = "127.0.0.1:0"
+	conf.Mqtt.ListenerAuth = map[string]listeners.AuthPolicy{"internal": {Anonymous: true}}
+	conf.Mqtt.Listeners = []config.Listener{
+		{ID: "internal", Type: config.ListenerTCP, Address: "127.0.0.1:0", Acceptors: 1},
+		{ID: "ws-internal", Type: config.ListenerWebsocket, Address: "127.0.0.1:0", Websocket: &listeners.WebsocketConfig{Path: "/mqtt"}},
+		{ID: "local", Type: config.ListenerUnix, Address: filepath.Join(t.TempDir(), "comqtt.sock")},
+	}
+
+	b, err := NewBroker(WithConfig(conf), WithLogger(logger))
+	require.NoError(t, err)
+	require.NoError(t, b.Start(context.Background()))
+	defer b.Close()
+
+	l, ok := b.Server().Listeners.Get("internal")
+	require.True(t, ok)
+	require.Equal(t, "tcp", l.Protocol())
+	require.True(t, l.(listeners.Configurable).Config().Auth.Anonymous)
+
+	l, ok = b.Server().Listeners.Get("ws-internal")
+	require.True(t, ok)
+	require.Equal(t, "/mqtt", l.(listeners.Configurable).Config().Websocket.Path)
+
+	l, ok = b.Server().Listeners.Get("local")
+	require.True(t, ok)
+	require.Equal(t, "unix", l.Protocol())
+
+	_, ok = b.Server().Listeners.Get("tcp")
+	require.True(t, ok)
+}
+
+func TestBrokerConfiguredListenersInvalid(t *testing.T) {
+	tt := []struct {
+		listener config.Listener
+		err      error
+	}{
+		{config.Listener{Type: config.ListenerTCP, Address: "127.0.0.1:0"}, config.ErrListenerConfig},
+		{config.Listener{ID: "x", Type: "sctp", Address: "127.0.0.1:0"}, config.ErrListenerType},
+		{config.Listener{ID: "x", Type: config.ListenerTCP, Address: "127.0.0.1:0", Tls: "public"}, config.ErrTlsProfile},
+		{config.Listener{ID: "x", Type: config.ListenerTCP, Address: "127.0.0.1:0", Tls: config.TlsProfileDefault}, config.ErrMissingCertOrKey},
+		{config.Listener{ID: "tcp", Type: config.ListenerTCP, Address: "127.0.0.1:0"}, mqtt.ErrListenerIDExists},
+		{config.Listener{ID: "x", Type: config.ListenerWebTransport, Address: "127.0.0.1:0"}, listeners.ErrWebTransportRequiresTLS},
+	}
+
+	for _, tx := range tt {
+		conf := config.New()
+		conf.Mqtt.TCP = "127.0.0.1:0"
+		conf.Mqtt.WS = "127.0.0.1:0"
+		conf.Mqtt.HTTP = "127.0.0.1:0"
+		conf.Mqtt.Listeners = []config.Listener{tx.listener}
+
+		b, err := NewBroker(WithConfig(conf), WithLogger(logger))
+		require.NoError(t, err)
+		require.ErrorIs(t, b.Start(context.Background()), tx.err)
+		_ = b.Close()
+	}
+}
+
+func TestRedisOptions(t *testing.T) {
+	conf := config.New()
+	conf.Redis.Options.Addr = "127.0.0.1:6379"
+	opts := redisOptions(conf, nil)
+	require.Equal(t, []string{"127.0.0.1:6379"}, opts.Addrs)
+	require.IsType(t, new(rv8.Client), rv8.NewUniversalClient(opts))
+
+	conf.Redis.Options.Addrs = []string{"10.0.0.1:26379", "10.0.0.2:26379"}
+	conf.Redis.Options.MasterName = "comqtt"
+	opts = redisOptions(conf, nil)
+	require.Equal(t, conf.Redis.Options.Addrs, opts.Addrs)
+	require.Equal(t, "comqtt", opts.MasterName)
+	require.IsType(t, new(rv8.Client), rv8.NewUniversalClient(opts)) // a sentinel failover client
+
+	conf.Redis.Options.MasterName = ""
+	require.IsType(t, new(rv8.ClusterClient), rv8.NewUniversalClient(redisOptions(conf, nil)))
+
+	conf.Redis.Options.Addrs = nil
+	conf.Redis.Options.ClusterMode = true
+	require.IsType(t, new(rv8.ClusterClient), rv8.NewUniversalClient(redisOptions(conf, nil)))
+}
+
+func TestStorageExpiry(t *testing.T) {
+	conf := config.New()
+	require.False(t, storageExpiry(conf).Enabled())
+
+	conf.StorageExpiry.Retained = 60
+	conf.StorageExpiry.Session = 3600
+	conf.StorageExpiry.GcInterval = 300
+	e := storageExpiry(conf)
+	require.Equal(t, time.Minute, e.Retained)
+	require.Equal(t, time.Duration(0), e.Inflight)
+	require.Equal(t, time.Hour, e.Session)
+	require.Equal(t, 5*time.Minute, e.GcInterval())
+	require.False(t, e.SessionInterval)
+
+	conf = config.New()
+	conf.StorageExpiry.SessionInterval = true
+	require.True(t, storageExpiry(conf).Enabled())
+}
+
+func TestWriteBehind(t *testing.T) {
+	conf := config.New()
+	require.False(t, writeBehind(conf).Enabled)
+
+	conf.StorageWriteBehind.Enable = true
+	conf.StorageWriteBehind.Size = 100
+	conf.StorageWriteBehind.Batch = 10
+	conf.StorageWriteBehind.Interval = 50
+	require.Equal(t, storage.WriteBehind{Enabled: true, Size: 100, Batch: 10, Interval: 50 * time.Millisecond}, writeBehind(conf))
+}
+
+func TestStorageEncryption(t *testing.T) {
+	conf := config.New()
+	e, err := storageEncryption(conf)
+	require.NoError(t, err)
+	require.False(t, e.Enabled())
+
+	key := bytes.Repeat([]byte{1}, 32)
+	prev := bytes.Repeat([]byte{2}, 16)
+	conf.StorageEncryption.Key = base64.StdEncoding.EncodeToString(key)
+	conf.StorageEncryption.PreviousKeys = []string{base64.StdEncoding.EncodeToString(prev)}
+	e, err = storageEncryption(conf)
+	require.NoError(t, err)
+	require.Equal(t, storage.Encryption{Key: key, PreviousKeys: [][]byte{prev}}, e)
+
+	t.Setenv("COMQTT_TEST_STORAGE_KEY", base64.StdEncoding.EncodeToString(prev))
+	conf.StorageEncryption.KeyEnv = "COMQTT_TEST_STORAGE_KEY"
+	e, err = storageEncryption(conf)
+	require.NoError(t, err)
+	require.Equal(t, prev, e.Key)
+
+	path := filepath.Join(t.TempDir(), "storage.key")
+	require.NoError(t, os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600))
+	conf.StorageEncryption.KeyFile = path
+	e, err = storageEncryption(conf)
+	require.NoError(t, err)
+	require.Equal(t, key, e.Key)
+
+	conf.StorageEncryption.KeyFile = ""
+	conf.StorageEncryption.KeyEnv = "COMQTT_TEST_STORAGE_KEY_UNSET"
+	_, err = storageEncryption(conf)
+	require.Error(t, err)
+
+	conf.StorageEncryption.KeyEnv = ""
+	conf.StorageEncryption.Key = "c2hvcnQ="
+	_, err = storageEncryption(conf)
+	require.ErrorIs(t, err, storage.ErrInvalidEncryptionKey)
+}
+
+func TestStorageEncryptionUnsupported(t *testing.T) {
+	conf := config.New()
+	conf.StorageWay = config.StorageWayRedis
+	conf.StorageEncryption.Key = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	_, err := NewBroker(WithConfig(conf), WithLogger(logger))
+	require.ErrorIs(t, err, config.ErrEncryption)
+}
+
+func TestBrokerSnapshotStorage(t *testing.T) {
+	conf := config.New()
+	conf.StorageWay = config.StorageWaySnapshot
+	conf.StoragePath = filepath.Join(t.TempDir(), "comqtt.snapshot")
+	conf.Memory.SnapshotInterval = -1
+
+	b, err := NewBroker(WithConfig(conf), WithLogger(logger))
+	require.NoError(t, err)
+	require.True(t, b.Server().EnableHook("memory-snapshot"))
+}
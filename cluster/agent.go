@@ -7,12 +7,15 @@ package cluster
 import (
 	"bytes"
 	"context"
+	"errors"
 	"math/rand"
 	"net"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/panjf2000/ants/v2"
 	"github.com/wind-c/comqtt/v2/cluster/discovery"
@@ -27,7 +30,10 @@ import (
 	"github.com/wind-c/comqtt/v2/cluster/utils"
 	"github.com/wind-c/comqtt/v2/config"
 	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/faults"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
 	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/plugin"
 )
 
 const (
@@ -40,6 +46,13 @@ const (
 	PeersFIle = "peers.json"
 )
 
+// WillStore is implemented by storages which keep the will messages of clients
+// visible to every node, so that the wills of a failed node's clients can be issued.
+type WillStore interface {
+	StoredWillsByNode(node string) (map[string]storage.ClientWill, error)
+	ClaimWill(cid, node string) bool
+}
+
 type Agent struct {
 	membership        discovery.Node
 	ctx               context.Context
@@ -56,6 +69,11 @@ type Agent struct {
 	raftNotifyCh      chan *message.Message
 	inboundMsgCh      chan []byte
 	grpcMsgCh         chan *message.Message
+	willStore         WillStore
+	dialer            plugin.DialFunc
+	relaySpool        *relaySpool
+	incompatible      sync.Map      // nodes whose relays are refused, and why
+	sessions          *sessionIndex // the node holding the session of each client
 }
 
 func NewAgent(conf *config.Cluster) *Agent {
@@ -65,6 +83,7 @@ func NewAgent(conf *config.Cluster) *Agent {
 		cancel:       cancel,
 		Config:       conf,
 		subTree:      topics.New(),
+		sessions:     newSessionIndex(),
 		raftNotifyCh: make(chan *message.Message, 1024),
 		inboundMsgCh: make(chan []byte, 10240),
 		grpcMsgCh:    make(chan *message.Message, 10240),
@@ -83,18 +102,6 @@ func (a *Agent) Start() (err error) {
 	// listen for raft apply notifications
 	go a.raftApplyListener()
 
-	if a.Config.RaftImpl == config.RaftImplEtcd {
-		if a.raftPeer, err = etcd.Setup(a.Config, a.raftNotifyCh); err != nil {
-			return
-		}
-	} else {
-		if a.raftPeer, err = hashicorp.Setup(a.Config, a.raftNotifyCh); err != nil {
-			return
-		}
-	}
-	raftAddr := net.JoinHostPort(a.Config.BindAddr, strconv.Itoa(a.Config.RaftPort))
-	OnJoinLog(a.Config.NodeName, raftAddr, "setup raft", nil)
-
 	// create and join cluster
 	if utils.PathExists(a.getNodesFile()) {
 		ms := discovery.GenMemberAddrs(discovery.ReadMembers(a.getNodesFile()))
@@ -125,6 +132,53 @@ func (a *Agent) Start() (err error) {
 		log.Info("grpc listen at", "addr", net.JoinHostPort(a.Config.BindAddr, strconv.Itoa(a.Config.GrpcPort)))
 	}
 
+	// fetch the cluster state from a peer and install it before raft starts, so that raft
+	// restores it rather than replaying the raft log
+	install := hashicorp.InstallSnapshot
+	if a.Config.RaftImpl == config.RaftImplEtcd {
+		install = etcd.InstallSnapshot
+	}
+	if a.Config.SnapshotBootstrap && a.Config.GrpcEnable && !a.Config.RaftBootstrap {
+		a.bootstrapFromPeer(func(s *raft.Snapshot) error {
+			return install(a.Config, s)
+		})
+	}
+
+	// setup raft
+	if a.Config.RaftImpl == config.RaftImplEtcd {
+		if a.raftPeer, err = etcd.Setup(a.Config, a.raftNotifyCh); err != nil {
+			return
+		}
+	} else {
+		if a.raftPeer, err = hashicorp.Setup(a.Config, a.raftNotifyCh); err != nil {
+			return
+		}
+	}
+	raftAddr := net.JoinHostPort(a.Config.BindAddr, strconv.Itoa(a.Config.RaftPort))
+	OnJoinLog(a.Config.NodeName, raftAddr, "setup raft", nil)
+
+	// leader only scheduled jobs run on the raft leader
+	if a.mqttServer != nil {
+		a.mqttServer.Scheduler.SetLeader(a.raftPeer.IsLeader)
+	}
+
+	// the node is not ready while raft has no leader or the node is alone in the cluster
+	if a.mqttServer != nil {
+		a.mqttServer.AddReadyCheck("raft", a.raftHealth)
+		a.mqttServer.AddReadyCheck("cluster", a.clusterHealth)
+	}
+
+	// spool qos 1 and 2 messages for nodes which cannot be reached
+	if a.Config.RelaySpoolSize > 0 {
+		dir := a.Config.RelaySpoolDir
+		if dir == "" {
+			dir = a.Config.RaftDir
+		}
+		if a.relaySpool, err = openRelaySpool(a.ctx, dir, a.Config.RelaySpoolSize, a.sendPublish); err != nil {
+			return err
+		}
+	}
+
 	// init goroutine pool
 	a.initPool()
 
@@ -176,14 +230,31 @@ func (a *Agent) Stop() {
 	a.membership.Stop()
 	a.grpcService.StopRpcServer()
 	log.Info("grpc server stopped")
+	if a.relaySpool != nil {
+		a.relaySpool.Close()
+	}
 	log.Info("node stopped")
 }
 
 func (a *Agent) BindMqttServer(server *mqtt.Server) {
 	server.AddHook(new(MqttEventHook), a)
+	if server.Options.Annotation != nil && server.Options.Annotation.Node == "" {
+		server.Options.Annotation.Node = a.Config.NodeName
+	}
 	a.mqttServer = server
 }
 
+// BindWillStore sets the store used to issue the will messages of clients
+// connected to nodes which leave the cluster.
+func (a *Agent) BindWillStore(ws WillStore) {
+	a.willStore = ws
+}
+
+// BindDialer sets the dialer of the grpc connections to the other nodes.
+func (a *Agent) BindDialer(dial plugin.DialFunc) {
+	a.dialer = dial
+}
+
 func (a *Agent) GetLocalName() string {
 	return a.Config.NodeName
 }
@@ -248,6 +319,11 @@ func (a *Agent) raftApplyListener() {
 
 // send the message to the leader apply
 func (a *Agent) raftPropose(msg *message.Message) {
+	if err := a.injectFault(faults.PointRaftApply); err != nil {
+		OnApplyLog(a.GetLocalName(), msg.NodeID, msg.Type, msg.Payload, "raft apply fault", err)
+		return
+	}
+
 	if a.raftPeer.IsApplyRight() {
 		err := a.raftPeer.Propose(msg)
 		OnApplyLog(a.GetLocalName(), msg.NodeID, msg.Type, msg.Payload, "raft apply log", err)
@@ -302,17 +378,30 @@ func (a *Agent) processNodeEvent() {
 			addr := getRaftPeerAddr(&event.Member)
 			//addr := event.Addr
 			if event.Type == discovery.EventJoin {
-				if nodeName != a.GetLocalName() && a.raftPeer.IsApplyRight() {
-					err = a.raftPeer.Join(nodeName, addr)
-					prompt = "raft join"
+				if !a.checkMember(&event.Member) {
+					prompt = "raft join refused"
+				} else {
+					if nodeName != a.GetLocalName() && a.raftPeer.IsApplyRight() {
+						err = a.raftPeer.Join(nodeName, addr)
+						prompt = "raft join"
+					}
+					if a.relaySpool != nil {
+						a.relaySpool.Drain(nodeName)
+					}
 				}
 			} else if event.Type == discovery.EventLeave {
+				a.forgetMember(nodeName)
+				a.sessions.DelByNode(nodeName)
 				err = a.raftPeer.Leave(nodeName)
 				if a.Config.GrpcEnable {
 					a.grpcClientManager.RemoveGrpcClient(nodeName)
 				}
+				if nodeName != a.GetLocalName() {
+					go a.sendNodeWills(nodeName)
+				}
 				prompt = "raft leave"
 			} else {
+				a.checkMember(&event.Member)
 				prompt = "raft update"
 			}
 			OnJoinLog(nodeName, addr, prompt, err)
@@ -323,7 +412,35 @@ func (a *Agent) processNodeEvent() {
 	}
 }
 
+// sendNodeWills issues the will messages of clients which were connected to a node
+// that has left the cluster. Every remaining node tries to claim each will, so that
+// only one of them issues it.
+func (a *Agent) sendNodeWills(node string) {
+	if a.willStore == nil {
+		return
+	}
+
+	wills, err := a.willStore.StoredWillsByNode(node)
+	if err != nil {
+		log.Error("load node wills", "error", err, "node", node)
+		return
+	}
+
+	for cid, will := range wills {
+		if !a.willStore.ClaimWill(cid, node) {
+			continue
+		}
+		a.mqttServer.SendRemoteLWT(cid, mqtt.Will(will))
+		log.Info("send will of failed node", "node", node, "cid", cid, "topic", will.TopicName)
+	}
+}
+
 func (a *Agent) processRelayMsg(msg *message.Message) {
+	if !a.IsCompatible(msg.NodeID) {
+		log.Debug("relay refused", "from", msg.NodeID, "type", msg.Type, "cid", msg.ClientID)
+		return
+	}
+
 	switch msg.Type {
 	case message.RaftJoin:
 		addr := string(msg.Payload)
@@ -340,18 +457,27 @@ func (a *Agent) processRelayMsg(msg *message.Message) {
 		}
 		offset := len(msg.Payload) - pk.FixedHeader.Remaining          // Unpack fixedheader.
 		if err := pk.PublishDecode(msg.Payload[offset:]); err == nil { // Unpack skips fixedheader
+			// the relayed expiry interval is the remaining interval, so restart the clock here,
+			// and keep the origin and retain flag for the no local and retain as published options.
+			pk.Created = time.Now().Unix()
+			if pk.FixedHeader.Retain {
+				// the origin node has already persisted the retained message.
+				a.mqttServer.Topics.RetainMessage(pk.Copy(false))
+			}
 			a.mqttServer.PublishToSubscribers(pk, false)
 			OnPublishPacketLog(DirectionInbound, msg.NodeID, msg.ClientID, pk.TopicName, pk.PacketID)
 		}
 	case packets.Connect:
 		//If a client is connected to another node, the client's data cached on the node needs to be cleared
 		if existing, ok := a.mqttServer.Clients.Get(msg.ClientID); ok {
-			// connection notify from other node
+			// connection notify from other node, which now owns any persisted qos flows
+			existing.ReleaseInflights()
 			existing.Stop(packets.ErrSessionTakenOver)
 			// clean local session and subscriptions
 			a.mqttServer.UnsubscribeClient(existing)
 			a.mqttServer.Clients.Delete(msg.ClientID)
 		}
+		a.sessions.Set(msg.ClientID, msg.NodeID)
 		OnConnectPacketLog(DirectionInbound, msg.NodeID, msg.ClientID)
 	}
 }
@@ -417,6 +543,14 @@ func (a *Agent) processOutboundPublish(pk *packets.Packet, sharedFilters map[str
 		ProtocolVersion: pk.ProtocolVersion,
 	}
 
+	// relay only the remaining expiry interval, as the receiving node restarts the clock.
+	if remaining, ok := mqtt.RemainingMessageExpiry(*pk, time.Now().Unix()); ok {
+		if remaining <= 0 {
+			return
+		}
+		pk.Properties.MessageExpiryInterval = uint32(remaining)
+	}
+
 	var buf bytes.Buffer
 	pk.Mods.AllowResponseInfo = true
 	if err := pk.PublishEncode(&buf); err != nil {
@@ -435,18 +569,70 @@ func (a *Agent) processOutboundPublish(pk *packets.Packet, sharedFilters map[str
 	for _, filter := range filters {
 		ns := a.pickNodes(filter, sharedFilters)
 		for _, node := range ns {
-			if node != a.GetLocalName() && !utils.Contains(oldNodes, node) {
-				if a.Config.GrpcEnable {
-					a.grpcClientManager.RelayPublishPacket(node, &msg)
-				} else {
-					bs := msg.MsgpackBytes()
-					a.membership.SendToNode(node, bs)
-				}
+			if node != a.GetLocalName() && !utils.Contains(oldNodes, node) && a.IsCompatible(node) {
+				a.relayPublish(node, &msg, pk.FixedHeader.Qos)
 				oldNodes = append(oldNodes, node)
 				OnPublishPacketLog(DirectionOutbound, node, pk.Origin, pk.TopicName, pk.PacketID)
 			}
 		}
 	}
+
+	// retained messages are relayed to every node, so that any node can
+	// serve them to clients which subscribe later.
+	if pk.FixedHeader.Retain {
+		for _, m := range a.membership.Members() {
+			if m.Name == a.GetLocalName() || utils.Contains(oldNodes, m.Name) || !a.IsCompatible(m.Name) {
+				continue
+			}
+			a.relayPublish(m.Name, &msg, pk.FixedHeader.Qos)
+			oldNodes = append(oldNodes, m.Name)
+			OnPublishPacketLog(DirectionOutbound, m.Name, pk.Origin, pk.TopicName, pk.PacketID)
+		}
+	}
+}
+
+// relayPublish relays a publish message to a node. Qos 1 and 2 messages are spooled
+// if the node cannot be reached and the relay spool is enabled.
+func (a *Agent) relayPublish(node string, msg *message.Message, qos byte) {
+	if a.relaySpool != nil && qos > 0 {
+		a.relaySpool.Relay(node, msg)
+		return
+	}
+
+	if err := a.injectFault(faults.PointClusterRelay); err != nil {
+		log.Debug("relay fault", "error", err, "to", node, "cid", msg.ClientID)
+		return
+	}
+
+	if a.Config.GrpcEnable {
+		a.grpcClientManager.RelayPublishPacket(node, msg)
+	} else {
+		a.membership.SendToNode(node, msg.MsgpackBytes())
+	}
+}
+
+// sendPublish sends a publish message to a node over grpc or gossip, returning any error.
+func (a *Agent) sendPublish(node string, msg *message.Message) error {
+	if err := a.injectFault(faults.PointClusterRelay); errors.Is(err, faults.ErrDropped) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if a.Config.GrpcEnable {
+		return a.grpcClientManager.relayPublishPacket(node, msg)
+	}
+
+	return a.membership.SendToNode(node, msg.MsgpackBytes())
+}
+
+// injectFault injects the fault set at a point of the bound mqtt server, if any.
+func (a *Agent) injectFault(point string) error {
+	if a.mqttServer == nil {
+		return nil
+	}
+
+	return a.mqttServer.Faults.Inject(point)
 }
 
 // processOutboundConnect process outbound connect msg
@@ -461,6 +647,7 @@ func (a *Agent) processOutboundConnect(pk *packets.Packet) {
 	if msg.ClientID == "" {
 		msg.ClientID = pk.Connect.ClientIdentifier
 	}
+	a.sessions.Set(msg.ClientID, a.GetLocalName())
 	if a.Config.GrpcEnable {
 		a.grpcClientManager.ConnectNotifyToOthers(&msg)
 	} else {
@@ -559,3 +746,9 @@ func (a *Agent) GetValue(key string) []string {
 	log.Info("get value", "key", key)
 	return a.raftPeer.Lookup(key)
 }
+
+// SessionNode returns the node which last announced a connection of a client, and so holds
+// its session.
+func (a *Agent) SessionNode(cid string) (string, bool) {
+	return a.sessions.Get(cid)
+}
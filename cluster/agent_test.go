@@ -1,14 +1,22 @@
 package cluster
 
 import (
+	"bytes"
+	"io"
+	"log/slog"
 	"strconv"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/wind-c/comqtt/v2/cluster/log"
+	"github.com/wind-c/comqtt/v2/cluster/message"
+	"github.com/wind-c/comqtt/v2/cluster/raft"
 	"github.com/wind-c/comqtt/v2/cluster/utils"
 	"github.com/wind-c/comqtt/v2/config"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/faults"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
 )
 
 func TestCluster(t *testing.T) {
@@ -138,3 +146,65 @@ func TestCluster(t *testing.T) {
 
 	t.Log("Test completed successfully")
 }
+
+func TestProcessRelayMsgRetained(t *testing.T) {
+	a := newSnapshotAgent("node1")
+	pk := packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Publish, Retain: true, Qos: 1},
+		ProtocolVersion: 5,
+		TopicName:       "a/b",
+		Payload:         []byte("hello"),
+		PacketID:        1,
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, pk.PublishEncode(&buf))
+	a.processRelayMsg(&message.Message{
+		Type:            packets.Publish,
+		NodeID:          "node2",
+		ClientID:        "cl1",
+		ProtocolVersion: 5,
+		Payload:         buf.Bytes(),
+	})
+
+	msgs := a.mqttServer.Topics.Messages("a/b")
+	require.Len(t, msgs, 1)
+	require.True(t, msgs[0].FixedHeader.Retain)
+	require.Equal(t, "cl1", msgs[0].Origin)
+	require.NotZero(t, msgs[0].Created)
+}
+
+// proposePeer counts the messages proposed to raft.
+type proposePeer struct {
+	routesPeer
+	proposed int
+}
+
+func (p *proposePeer) Propose(msg *message.Message) error {
+	p.proposed++
+	return nil
+}
+
+func TestAgentFaultInjected(t *testing.T) {
+	a := newSnapshotAgent("node1")
+	a.mqttServer = mqtt.New(&mqtt.Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil)), FaultInjection: true})
+	peer := &proposePeer{routesPeer: routesPeer{KV: raft.NewKV()}}
+	a.raftPeer = peer
+
+	msg := &message.Message{Type: packets.Subscribe, NodeID: "node1", Payload: []byte("a/b")}
+	a.raftPropose(msg)
+	require.Equal(t, 1, peer.proposed)
+
+	_, err := a.mqttServer.Faults.Set(faults.Fault{Point: faults.PointRaftApply, ErrorRate: 1})
+	require.NoError(t, err)
+	a.raftPropose(msg)
+	require.Equal(t, 1, peer.proposed)
+
+	_, err = a.mqttServer.Faults.Set(faults.Fault{Point: faults.PointClusterRelay, ErrorRate: 1})
+	require.NoError(t, err)
+	require.ErrorIs(t, a.sendPublish("node2", msg), faults.ErrInjected)
+
+	_, err = a.mqttServer.Faults.Set(faults.Fault{Point: faults.PointClusterRelay, DropRate: 1})
+	require.NoError(t, err)
+	require.NoError(t, a.sendPublish("node2", msg))
+}
@@ -0,0 +1,79 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package cluster
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/wind-c/comqtt/v2/cluster/discovery"
+	"github.com/wind-c/comqtt/v2/cluster/log"
+	"github.com/wind-c/comqtt/v2/cluster/message"
+	"github.com/wind-c/comqtt/v2/mqtt"
+)
+
+// legacySchemaVersion is the message schema assumed for nodes which do not advertise
+// one, such as nodes running a release which predates the tag, or nodes discovered
+// using memberlist, which does not support tags.
+const legacySchemaVersion = 1
+
+// memberSchema returns the message schema version advertised by a member.
+func memberSchema(m *discovery.Member) (int, error) {
+	v, ok := m.Tags[discovery.TagSchema]
+	if !ok {
+		return legacySchemaVersion, nil
+	}
+
+	schema, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid schema tag %q", v)
+	}
+
+	return schema, nil
+}
+
+// checkMember checks whether the messages relayed by a member are compatible with the
+// local node, logging any difference in version. Relays to and from an incompatible
+// member are refused until it advertises a compatible schema, so that mixed version
+// clusters fail safely during rolling upgrades.
+func (a *Agent) checkMember(m *discovery.Member) bool {
+	if m.Name == a.GetLocalName() {
+		return true
+	}
+
+	version := m.Tags[discovery.TagVersion]
+	schema, err := memberSchema(m)
+	if err == nil && schema != message.SchemaVersion {
+		err = fmt.Errorf("schema %d is not supported, local schema is %d", schema, message.SchemaVersion)
+	}
+
+	if err != nil {
+		if _, loaded := a.incompatible.Swap(m.Name, err.Error()); !loaded {
+			log.Error("incompatible node, relays refused", "error", err, "node", m.Name, "version", version, "local-version", mqtt.Version)
+		}
+		return false
+	}
+
+	if _, ok := a.incompatible.LoadAndDelete(m.Name); ok {
+		log.Info("node compatible, relays resumed", "node", m.Name, "version", version, "schema", schema)
+	}
+
+	if version != mqtt.Version {
+		log.Warn("node runs a different version", "node", m.Name, "version", version, "local-version", mqtt.Version, "schema", schema)
+	}
+
+	return true
+}
+
+// forgetMember clears the compatibility state of a member which has left the cluster.
+func (a *Agent) forgetMember(name string) {
+	a.incompatible.Delete(name)
+}
+
+// IsCompatible returns true if messages may be relayed to and from a node.
+func (a *Agent) IsCompatible(node string) bool {
+	_, ok := a.incompatible.Load(node)
+	return !ok
+}
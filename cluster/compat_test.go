@@ -0,0 +1,62 @@
+package cluster
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/cluster/discovery"
+	"github.com/wind-c/comqtt/v2/cluster/message"
+	"github.com/wind-c/comqtt/v2/config"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+func TestMemberSchema(t *testing.T) {
+	schema, err := memberSchema(&discovery.Member{Name: "node2"})
+	require.NoError(t, err)
+	require.Equal(t, legacySchemaVersion, schema)
+
+	schema, err = memberSchema(&discovery.Member{Name: "node2", Tags: map[string]string{discovery.TagSchema: "2"}})
+	require.NoError(t, err)
+	require.Equal(t, 2, schema)
+
+	_, err = memberSchema(&discovery.Member{Name: "node2", Tags: map[string]string{discovery.TagSchema: "x"}})
+	require.Error(t, err)
+}
+
+func TestCheckMember(t *testing.T) {
+	a := NewAgent(&config.Cluster{NodeName: "node1"})
+	m := &discovery.Member{Name: "node2", Tags: map[string]string{
+		discovery.TagVersion: mqtt.Version,
+		discovery.TagSchema:  strconv.Itoa(message.SchemaVersion + 1),
+	}}
+
+	require.False(t, a.checkMember(m))
+	require.False(t, a.IsCompatible("node2"))
+	require.True(t, a.IsCompatible("node3"))
+
+	m.Tags[discovery.TagSchema] = strconv.Itoa(message.SchemaVersion)
+	m.Tags[discovery.TagVersion] = "0.0.1"
+	require.True(t, a.checkMember(m))
+	require.True(t, a.IsCompatible("node2"))
+
+	require.True(t, a.checkMember(&discovery.Member{Name: "node3"}))
+
+	m.Tags[discovery.TagSchema] = "x"
+	require.False(t, a.checkMember(m))
+	a.forgetMember("node2")
+	require.True(t, a.IsCompatible("node2"))
+}
+
+func TestProcessRelayMsgIncompatible(t *testing.T) {
+	a := NewAgent(&config.Cluster{NodeName: "node1"})
+	a.incompatible.Store("node2", "schema 2 is not supported")
+
+	// refused before the message is processed, so no mqtt server is needed
+	a.processRelayMsg(&message.Message{
+		Type:     packets.Connect,
+		NodeID:   "node2",
+		ClientID: "cl1",
+	})
+}
@@ -135,7 +135,7 @@ func (m *Membership) GetNodeByIP(ipAddr net.IP) *memberlist.Node {
 		if node.Name == m.config.NodeName {
 			continue // skip self
 		}
-		if node.Addr.To4().Equal(ipAddr.To4()) {
+		if node.Addr.Equal(ipAddr) { // To4 is nil for every ipv6 address, so compare the full addresses
 			return node
 		}
 	}
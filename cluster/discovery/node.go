@@ -24,6 +24,8 @@ const (
 const (
 	TagRaftPort = "raft-port"
 	TagGrpcPort = "grpc-port"
+	TagVersion  = "version" // the comqtt version of the node
+	TagSchema   = "schema"  // the relayed message schema version of the node
 )
 
 type Node interface {
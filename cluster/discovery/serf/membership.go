@@ -11,6 +11,7 @@ import (
 	"github.com/hashicorp/serf/serf"
 	mb "github.com/wind-c/comqtt/v2/cluster/discovery"
 	"github.com/wind-c/comqtt/v2/cluster/log"
+	"github.com/wind-c/comqtt/v2/cluster/message"
 	"github.com/wind-c/comqtt/v2/config"
 	"github.com/wind-c/comqtt/v2/mqtt"
 )
@@ -27,6 +28,11 @@ func wrapOptions(conf *config.Cluster, ech chan serf.Event) *serf.Config {
 	config.Init()
 	config.MemberlistConfig.BindAddr = conf.BindAddr
 	config.MemberlistConfig.BindPort = conf.BindPort
+	config.MemberlistConfig.AdvertiseAddr = conf.AdvertiseAddr
+	config.MemberlistConfig.AdvertisePort = conf.BindPort
+	if conf.AdvertisePort != 0 {
+		config.MemberlistConfig.AdvertisePort = conf.AdvertisePort
+	}
 	config.NodeName = conf.NodeName
 	config.EventCh = ech
 	if conf.Tags == nil {
@@ -36,6 +42,9 @@ func wrapOptions(conf *config.Cluster, ech chan serf.Event) *serf.Config {
 		conf.Tags[mb.TagRaftPort] = strconv.Itoa(conf.RaftPort)
 		conf.Tags[mb.TagGrpcPort] = strconv.Itoa(conf.GrpcPort)
 	}
+	// always advertised, so that nodes can detect incompatible peers during rolling upgrades
+	conf.Tags[mb.TagVersion] = mqtt.Version
+	conf.Tags[mb.TagSchema] = strconv.Itoa(message.SchemaVersion)
 	config.Tags = conf.Tags
 	if conf.QueueDepth != 0 {
 		config.MaxQueueDepth = conf.QueueDepth
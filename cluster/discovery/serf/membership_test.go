@@ -7,9 +7,12 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	mb "github.com/wind-c/comqtt/v2/cluster/discovery"
 	"github.com/wind-c/comqtt/v2/cluster/log"
+	"github.com/wind-c/comqtt/v2/cluster/message"
 	"github.com/wind-c/comqtt/v2/cluster/utils"
 	"github.com/wind-c/comqtt/v2/config"
+	"github.com/wind-c/comqtt/v2/mqtt"
 )
 
 func TestMain(m *testing.M) {
@@ -168,3 +171,35 @@ func TestSendToOthers(t *testing.T) {
 		t.Fatal("Did not receive the message in membership3")
 	}
 }
+
+func TestWrapOptionsTags(t *testing.T) {
+	conf := &config.Cluster{
+		NodeName: "test-node-1",
+		Tags:     map[string]string{"zone": "a"},
+	}
+	c := wrapOptions(conf, nil)
+	assert.Equal(t, "a", c.Tags["zone"])
+	assert.Equal(t, mqtt.Version, c.Tags[mb.TagVersion])
+	assert.Equal(t, strconv.Itoa(message.SchemaVersion), c.Tags[mb.TagSchema])
+	_, ok := c.Tags[mb.TagRaftPort]
+	assert.False(t, ok)
+}
+
+func TestWrapOptionsAdvertise(t *testing.T) {
+	conf := &config.Cluster{
+		NodeName: "test-node-1",
+		BindAddr: "::",
+		BindPort: 7947,
+	}
+	c := wrapOptions(conf, nil)
+	assert.Equal(t, "", c.MemberlistConfig.AdvertiseAddr)
+
+	conf.AdvertiseAddr = "2001:db8::10"
+	c = wrapOptions(conf, nil)
+	assert.Equal(t, "2001:db8::10", c.MemberlistConfig.AdvertiseAddr)
+	assert.Equal(t, 7947, c.MemberlistConfig.AdvertisePort)
+
+	conf.AdvertisePort = 17946
+	c = wrapOptions(conf, nil)
+	assert.Equal(t, 17946, c.MemberlistConfig.AdvertisePort)
+}
@@ -0,0 +1,58 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package cluster
+
+import (
+	"errors"
+	"net"
+	"strconv"
+)
+
+var (
+	ErrNoRaftLeader  = errors.New("raft has no leader")
+	ErrClusterAbsent = errors.New("node has not joined the cluster")
+)
+
+// raftHealth returns an error if the raft of the node has no leader, in which case
+// subscriptions cannot be routed across the cluster.
+func (a *Agent) raftHealth() error {
+	if a.raftPeer == nil {
+		return ErrNoRaftLeader
+	}
+
+	if _, id := a.raftPeer.GetLeader(); id == "" {
+		return ErrNoRaftLeader
+	}
+
+	return nil
+}
+
+// clusterHealth returns an error if the node has not joined the cluster, or sees no
+// other alive member although seed members other than itself are configured.
+func (a *Agent) clusterHealth() error {
+	if a.membership == nil {
+		return ErrClusterAbsent
+	}
+
+	members := a.membership.Members()
+	if len(members) > 1 {
+		return nil
+	}
+
+	local := ""
+	for _, m := range members {
+		if m.Name == a.membership.LocalName() {
+			local = net.JoinHostPort(m.Addr, strconv.Itoa(m.Port))
+		}
+	}
+
+	for _, seed := range a.Config.Members {
+		if seed != local {
+			return ErrClusterAbsent
+		}
+	}
+
+	return nil
+}
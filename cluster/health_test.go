@@ -0,0 +1,59 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package cluster
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/cluster/discovery"
+	"github.com/wind-c/comqtt/v2/cluster/raft"
+)
+
+// leaderPeer is a raft peer with a leader.
+type leaderPeer struct {
+	routesPeer
+}
+
+func (p *leaderPeer) GetLeader() (addr, id string) { return "127.0.0.1:8946", "c01" }
+
+// membersNode is a membership with a fixed list of alive members.
+type membersNode struct {
+	discovery.Node
+	members []discovery.Member
+}
+
+func (m *membersNode) Members() []discovery.Member { return m.members }
+func (m *membersNode) LocalName() string           { return "c02" }
+
+func TestRaftHealth(t *testing.T) {
+	a := newSnapshotAgent("c02")
+	require.ErrorIs(t, a.raftHealth(), ErrNoRaftLeader)
+
+	a.raftPeer = &leaderPeer{routesPeer{KV: raft.NewKV()}}
+	require.NoError(t, a.raftHealth())
+
+	a.raftPeer = nil
+	require.ErrorIs(t, a.raftHealth(), ErrNoRaftLeader)
+}
+
+func TestClusterHealth(t *testing.T) {
+	a := newSnapshotAgent("c02")
+	a.Config.Members = []string{"127.0.0.1:7946"}
+	require.ErrorIs(t, a.clusterHealth(), ErrClusterAbsent)
+
+	local := discovery.Member{Name: "c02", Addr: "127.0.0.1", Port: 7947}
+	node := &membersNode{members: []discovery.Member{local}}
+	a.membership = node
+	require.ErrorIs(t, a.clusterHealth(), ErrClusterAbsent)
+
+	node.members = append(node.members, discovery.Member{Name: "c01", Addr: "127.0.0.1", Port: 7946})
+	require.NoError(t, a.clusterHealth())
+
+	// a node seeded with only itself is alone by design
+	node.members = node.members[:1]
+	a.Config.Members = []string{"127.0.0.1:7947"}
+	require.NoError(t, a.clusterHealth())
+}
@@ -17,6 +17,11 @@ const (
 	RaftApply
 )
 
+// SchemaVersion is the version of the messages relayed between nodes. It is advertised
+// to the other nodes of the cluster, and must be incremented whenever Message or the
+// payloads it carries change incompatibly.
+const SchemaVersion = 1
+
 //go:generate msgp -io=false
 type Message struct {
 	Type            byte   `json:"type" msg:"type"`
@@ -5,22 +5,38 @@
 package raft
 
 import (
+	"errors"
 	"github.com/wind-c/comqtt/v2/cluster/message"
 	"github.com/wind-c/comqtt/v2/cluster/utils"
 	"sync"
 )
 
+// ErrExistingState indicates a snapshot cannot be installed as the node already has raft state.
+var ErrExistingState = errors.New("raft state already exists")
+
 type IPeer interface {
 	Join(nodeID, addr string) error
 	Leave(nodeID string) error
 	Propose(msg *message.Message) error
 	Lookup(key string) []string
 	IsApplyRight() bool
+	IsLeader() bool
 	GetLeader() (addr, id string)
 	GenPeersFile(file string) error
+	Snapshot() (*Snapshot, error)
 	Stop()
 }
 
+// Snapshot is a raft snapshot of the routing fsm, which a joining node installs before raft
+// starts, so that the leader only sends it the log entries appended after the snapshot.
+type Snapshot struct {
+	Index              uint64 // the index of the last log entry in the snapshot
+	Term               uint64 // the term of the last log entry in the snapshot
+	Configuration      []byte // the members of the cluster, encoded by the raft implementation
+	ConfigurationIndex uint64 // the index of the log entry which set the members
+	Data               []byte // the fsm, encoded as the raft implementation persists it
+}
+
 type data map[string][]string
 
 type KV struct {
@@ -38,6 +54,17 @@ func (k *KV) GetAll() *data {
 	return &k.data
 }
 
+// Copy returns a copy of all key-values pairs
+func (k *KV) Copy() map[string][]string {
+	k.RLock()
+	defer k.RUnlock()
+	m := make(map[string][]string, len(k.data))
+	for key, vs := range k.data {
+		m[key] = append([]string(nil), vs...)
+	}
+	return m
+}
+
 func (k *KV) Get(key string) []string {
 	k.RLock()
 	defer k.RUnlock()
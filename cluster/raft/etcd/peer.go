@@ -17,6 +17,7 @@ import (
 
 	"github.com/wind-c/comqtt/v2/cluster/log"
 	"github.com/wind-c/comqtt/v2/cluster/message"
+	base "github.com/wind-c/comqtt/v2/cluster/raft"
 	"github.com/wind-c/comqtt/v2/config"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -35,8 +36,20 @@ import (
 
 var (
 	ErrInvalidID = errors.New("node name must be a number")
+
+	// ErrSnapshotTimeout indicates raft did not take a snapshot in time, as it is stopped or busy.
+	ErrSnapshotTimeout = errors.New("timed out waiting for raft snapshot")
 )
 
+// snapshotTimeout is the time allowed for raft to take a snapshot for a joining node.
+const snapshotTimeout = 10 * time.Second
+
+// snapshotResult is a snapshot taken by the raft loop, or the error taking it.
+type snapshotResult struct {
+	snap raftpb.Snapshot
+	err  error
+}
+
 type commit struct {
 	data       [][]byte
 	applyDoneC chan<- struct{}
@@ -59,6 +72,8 @@ type Peer struct {
 	confState     raftpb.ConfState
 	snapshotIndex uint64
 	appliedIndex  uint64
+	applyDoneC    <-chan struct{}            // closed when the last published entries are applied
+	snapshotC     chan chan<- snapshotResult // requests for a snapshot at the applied index
 
 	node        raft.Node
 	raftStorage *raft.MemoryStorage
@@ -99,11 +114,12 @@ func Setup(conf *config.Cluster, notifyCh chan<- *message.Message) (*Peer, error
 		errorC:           make(chan error),
 		id:               uint64(id),
 		peers:            genPeers(conf),
-		walDir:           fmt.Sprintf("%v-%d", conf.RaftDir, id),
-		snapDir:          fmt.Sprintf("%v-snapshot%d", conf.RaftDir, id),
+		walDir:           walDir(conf, id),
+		snapDir:          snapDir(conf, id),
 		confState:        raftpb.ConfState{},
 		snapshotterReady: make(chan *snap.Snapshotter, 1),
 		snapCount:        defaultSnapshotCount,
+		snapshotC:        make(chan chan<- snapshotResult),
 		stopC:            make(chan struct{}),
 		httpStopC:        make(chan struct{}),
 		httpDoneC:        make(chan struct{}),
@@ -117,13 +133,23 @@ func Setup(conf *config.Cluster, notifyCh chan<- *message.Message) (*Peer, error
 	return peer, nil
 }
 
+// walDir returns the directory of the write ahead log of a node.
+func walDir(conf *config.Cluster, id int) string {
+	return fmt.Sprintf("%v-%d", conf.RaftDir, id)
+}
+
+// snapDir returns the directory of the snapshots of a node.
+func snapDir(conf *config.Cluster, id int) string {
+	return fmt.Sprintf("%v-snapshot%d", conf.RaftDir, id)
+}
+
 func (p *Peer) genLocalAddr() string {
-	addr := net.JoinHostPort(p.conf.BindAddr, strconv.Itoa(p.conf.RaftPort))
+	addr := net.JoinHostPort(p.conf.AdvertiseHost(), strconv.Itoa(p.conf.RaftPort))
 	return addr
 }
 
 func genPeers(conf *config.Cluster) []string {
-	addr := net.JoinHostPort(conf.BindAddr, strconv.Itoa(conf.RaftPort))
+	addr := net.JoinHostPort(conf.AdvertiseHost(), strconv.Itoa(conf.RaftPort))
 	return []string{"http://" + addr}
 }
 
@@ -180,6 +206,79 @@ func (p *Peer) DelByNode(node string) int {
 	return p.kvStore.DelByNode(node)
 }
 
+// Snapshot takes a raft snapshot of the kv store at the applied index, for a joining node
+// to install.
+func (p *Peer) Snapshot() (*base.Snapshot, error) {
+	resC := make(chan snapshotResult, 1)
+	select {
+	case p.snapshotC <- resC:
+	case <-time.After(snapshotTimeout):
+		return nil, ErrSnapshotTimeout
+	}
+
+	res := <-resC
+	if res.err != nil {
+		return nil, res.err
+	}
+
+	cs, err := res.snap.Metadata.ConfState.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	return &base.Snapshot{
+		Index:              res.snap.Metadata.Index,
+		Term:               res.snap.Metadata.Term,
+		Configuration:      cs,
+		ConfigurationIndex: res.snap.Metadata.Index,
+		Data:               res.snap.Data,
+	}, nil
+}
+
+// InstallSnapshot writes the raft snapshot of a peer to the snapshot and wal directories of
+// a node which has no raft state yet, so that raft restarts from it, and the kv store is
+// recovered from it, rather than the node replaying the log from the start.
+func InstallSnapshot(conf *config.Cluster, s *base.Snapshot) error {
+	id, err := strconv.Atoi(conf.NodeName)
+	if err != nil {
+		return ErrInvalidID
+	}
+
+	if wal.Exist(walDir(conf, id)) {
+		return base.ErrExistingState
+	}
+
+	var cs raftpb.ConfState
+	if err := cs.Unmarshal(s.Configuration); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(snapDir(conf, id), 0750); err != nil {
+		return err
+	}
+
+	logger := getZapLogger(conf.RaftLogLevel)
+	snapshot := raftpb.Snapshot{
+		Data:     s.Data,
+		Metadata: raftpb.SnapshotMetadata{ConfState: cs, Index: s.Index, Term: s.Term},
+	}
+	if err := snap.New(logger, snapDir(conf, id)).SaveSnap(snapshot); err != nil {
+		return err
+	}
+
+	w, err := wal.Create(logger, walDir(conf, id), nil)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	if err := w.SaveSnapshot(walpb.Snapshot{Index: s.Index, Term: s.Term, ConfState: &cs}); err != nil {
+		return err
+	}
+
+	return w.Save(raftpb.HardState{Term: s.Term, Commit: s.Index}, nil)
+}
+
 func mapRaftLogLevelToZap(raftLogLevel string) zapcore.Level {
 	raftLogLevel = strings.ToLower(raftLogLevel)
 	switch raftLogLevel {
@@ -360,9 +459,15 @@ func (p *Peer) serveChannels() {
 				p.Stop()
 				return
 			}
+			if applyDoneC != nil {
+				p.applyDoneC = applyDoneC
+			}
 			p.maybeTriggerSnapshot(applyDoneC)
 			p.node.Advance()
 
+		case resC := <-p.snapshotC:
+			resC <- p.takeSnapshot()
+
 		case err = <-p.transport.ErrorC:
 			p.writeError(err)
 			return
@@ -581,6 +686,40 @@ func (p *Peer) maybeTriggerSnapshot(applyDoneC <-chan struct{}) {
 	p.snapshotIndex = p.appliedIndex
 }
 
+// takeSnapshot returns a snapshot of the kv store at the applied index, once the published
+// entries are applied, creating and saving it unless the last snapshot is at that index.
+func (p *Peer) takeSnapshot() snapshotResult {
+	if p.applyDoneC != nil {
+		select {
+		case <-p.applyDoneC:
+		case <-p.stopC:
+			return snapshotResult{err: ErrSnapshotTimeout}
+		}
+	}
+
+	if p.appliedIndex == p.snapshotIndex {
+		snapshot, err := p.raftStorage.Snapshot()
+		if err == nil && !raft.IsEmptySnap(snapshot) {
+			return snapshotResult{snap: snapshot}
+		}
+	}
+
+	data, err := p.getSnapshot()
+	if err != nil {
+		return snapshotResult{err: err}
+	}
+	snapshot, err := p.raftStorage.CreateSnapshot(p.appliedIndex, &p.confState, data)
+	if err != nil {
+		return snapshotResult{err: err}
+	}
+	if err = p.saveSnap(snapshot); err != nil {
+		return snapshotResult{err: err}
+	}
+
+	p.snapshotIndex = p.appliedIndex
+	return snapshotResult{snap: snapshot}
+}
+
 // When there is a `raftpb.EntryConfChange` after creating the snapshot,
 // then the confState included in the snapshot is out of date, so we need
 // to update the confState before sending a snapshot to a follower.
@@ -618,6 +757,11 @@ func (p *Peer) IsApplyRight() bool {
 	return true
 }
 
+// IsLeader returns true if the node is the leader of the raft cluster.
+func (p *Peer) IsLeader() bool {
+	return p.node.Status().SoftState.Lead == p.id
+}
+
 func (p *Peer) GetLeader() (addr, id string) {
 	return "", strconv.FormatUint(p.node.Status().SoftState.Lead, 10)
 }
@@ -9,6 +9,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/wind-c/comqtt/v2/cluster/log"
 	"github.com/wind-c/comqtt/v2/cluster/message"
+	base "github.com/wind-c/comqtt/v2/cluster/raft"
 	"github.com/wind-c/comqtt/v2/config"
 	"github.com/wind-c/comqtt/v2/mqtt/packets"
 )
@@ -104,6 +105,37 @@ func TestProposeAndLookup(t *testing.T) {
 	require.Equal(t, []string{expectedValue}, result)
 }
 
+func TestSnapshotInstall(t *testing.T) {
+	peer := createTestPeer(t)
+	defer peer.Stop()
+
+	err := peer.Propose(&message.Message{Type: packets.Subscribe, NodeID: "1", Payload: []byte("filter")})
+	require.NoError(t, err)
+	time.Sleep(2 * time.Second)
+
+	s, err := peer.Snapshot()
+	require.NoError(t, err)
+	require.Greater(t, s.Index, uint64(0))
+
+	conf := &config.Cluster{
+		NodeName: "2",
+		BindAddr: "127.0.0.1",
+		RaftImpl: config.RaftImplEtcd,
+		RaftPort: 8950,
+		RaftDir:  t.TempDir(),
+	}
+	require.NoError(t, InstallSnapshot(conf, s))
+	require.ErrorIs(t, InstallSnapshot(conf, s), base.ErrExistingState)
+
+	// the store is restored from the installed snapshot rather than the log
+	node, err := Setup(conf, make(chan *message.Message, 1))
+	require.NoError(t, err)
+	defer node.Stop()
+	require.Equal(t, []string{"1"}, node.Lookup("filter"))
+
+	time.Sleep(time.Second) // let raft start before it is stopped
+}
+
 func TestGetLeader(t *testing.T) {
 	peer := createTestPeer(t)
 	defer peer.Stop()
@@ -59,8 +59,9 @@ func (f *Fsm) DelByNode(node string) int {
 	return f.DelByValue(node)
 }
 
+// Snapshot returns a copy of the routes, as they are persisted while entries are applied.
 func (f *Fsm) Snapshot() (raft.FSMSnapshot, error) {
-	return f, nil
+	return fsmSnapshot(f.Copy()), nil
 }
 
 func (f *Fsm) Restore(ir io.ReadCloser) error {
@@ -83,15 +84,20 @@ func (f *Fsm) notifyReplay() {
 	}
 }
 
-func (f *Fsm) Persist(sink raft.SnapshotSink) error {
+// fsmSnapshot is a point in time copy of the routes of the fsm.
+type fsmSnapshot map[string][]string
+
+func (s fsmSnapshot) Persist(sink raft.SnapshotSink) error {
 	var buffer bytes.Buffer
-	err := gob.NewEncoder(&buffer).Encode(f.GetAll())
-	if err != nil {
+	if err := gob.NewEncoder(&buffer).Encode(map[string][]string(s)); err != nil {
+		sink.Cancel()
 		return err
 	}
-	sink.Write(buffer.Bytes())
-	sink.Close()
-	return nil
+	if _, err := sink.Write(buffer.Bytes()); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
 }
 
-func (f *Fsm) Release() {}
+func (s fsmSnapshot) Release() {}
@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"path/filepath"
@@ -16,6 +17,7 @@ import (
 
 	"github.com/wind-c/comqtt/v2/cluster/log"
 	"github.com/wind-c/comqtt/v2/cluster/message"
+	base "github.com/wind-c/comqtt/v2/cluster/raft"
 	"github.com/wind-c/comqtt/v2/cluster/utils"
 	"github.com/wind-c/comqtt/v2/config"
 
@@ -55,6 +57,7 @@ type Peer struct {
 	raft      *raft.Raft
 	fsm       *Fsm
 	store     *raftdb.BoltStore
+	snapshots raft.SnapshotStore
 	transport raft.Transport
 }
 
@@ -89,7 +92,7 @@ func Setup(conf *config.Cluster, notifyCh chan<- *message.Message) (*Peer, error
 
 	var transport raft.Transport
 	raftAddr := net.JoinHostPort(conf.BindAddr, strconv.Itoa(conf.RaftPort))
-	addr, err := net.ResolveTCPAddr("tcp", raftAddr)
+	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(conf.AdvertiseHost(), strconv.Itoa(conf.RaftPort)))
 	if err != nil {
 		return nil, err
 	}
@@ -180,7 +183,7 @@ func Setup(conf *config.Cluster, notifyCh chan<- *message.Message) (*Peer, error
 		return nil, err
 	}
 
-	peer := &Peer{config, rf, fm, store, transport}
+	peer := &Peer{config, rf, fm, store, snapshot, transport}
 	if id, err := peer.waitForLeader(peer.electionTimeout() * 3); err != nil {
 		log.Warn("timeout waiting for raft leader", "leader", "unknown")
 	} else {
@@ -226,6 +229,80 @@ func (p *Peer) DelByNode(node string) int {
 	return p.fsm.DelByNode(node)
 }
 
+// Snapshot takes a raft snapshot of the routing fsm, or returns the latest one if no entries
+// have been applied since, for a joining node to install.
+func (p *Peer) Snapshot() (*base.Snapshot, error) {
+	if err := p.raft.Snapshot().Error(); err != nil && !errors.Is(err, raft.ErrNothingNewToSnapshot) {
+		return nil, err
+	}
+
+	snaps, err := p.snapshots.List()
+	if err != nil {
+		return nil, err
+	}
+	if len(snaps) == 0 {
+		return nil, errors.New("no raft snapshot")
+	}
+
+	meta, rc, err := p.snapshots.Open(snaps[0].ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &base.Snapshot{
+		Index:              meta.Index,
+		Term:               meta.Term,
+		Configuration:      raft.EncodeConfiguration(meta.Configuration),
+		ConfigurationIndex: meta.ConfigurationIndex,
+		Data:               data,
+	}, nil
+}
+
+// InstallSnapshot stores the raft snapshot of a peer in the raft directory of a node which
+// has no raft state yet, so that raft restores the fsm from it when it starts, and is only
+// sent the log entries appended after it.
+func InstallSnapshot(conf *config.Cluster, s *base.Snapshot) error {
+	snapshots, err := raft.NewFileSnapshotStore(conf.RaftDir, raftSnapShotRetain, log.Writer())
+	if err != nil {
+		return err
+	}
+
+	store, err := raftdb.NewBoltStore(filepath.Join(conf.RaftDir, raftDBFile))
+	if err != nil {
+		return err
+	}
+	hasState, err := raft.HasExistingState(store, store, snapshots)
+	store.Close()
+	if err != nil {
+		return err
+	}
+	if hasState {
+		return base.ErrExistingState
+	}
+
+	// the store encodes the legacy peers of the configuration with the transport, which
+	// only copies the addresses, so an in-memory one is enough
+	_, trans := raft.NewInmemTransport("")
+	defer trans.Close()
+	sink, err := snapshots.Create(raft.SnapshotVersionMax, s.Index, s.Term,
+		raft.DecodeConfiguration(s.Configuration), s.ConfigurationIndex, trans)
+	if err != nil {
+		return err
+	}
+	if _, err := sink.Write(s.Data); err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	return sink.Close()
+}
+
 func (p *Peer) electionTimeout() time.Duration {
 	return p.config.ElectionTimeout
 }
@@ -234,6 +311,11 @@ func (p *Peer) IsApplyRight() bool {
 	return p.raft.State() == raft.Leader
 }
 
+// IsLeader returns true if the node is the leader of the raft cluster.
+func (p *Peer) IsLeader() bool {
+	return p.IsApplyRight()
+}
+
 func (p *Peer) GetLeader() (addr, id string) {
 	leaderAddr, leaderId := p.raft.LeaderWithID()
 	addr = string(leaderAddr)
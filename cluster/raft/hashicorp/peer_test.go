@@ -9,6 +9,7 @@ import (
 	"github.com/hashicorp/raft"
 	"github.com/stretchr/testify/require"
 	"github.com/wind-c/comqtt/v2/cluster/message"
+	base "github.com/wind-c/comqtt/v2/cluster/raft"
 	"github.com/wind-c/comqtt/v2/config"
 	"github.com/wind-c/comqtt/v2/mqtt/packets"
 )
@@ -90,6 +91,35 @@ func TestProposeAndLookup(t *testing.T) {
 	require.Equal(t, []string{expectedValue}, result)
 }
 
+func TestSnapshotInstall(t *testing.T) {
+	peer := createTestPeer(t)
+	defer peer.Stop()
+
+	err := peer.Propose(&message.Message{Type: packets.Subscribe, NodeID: "node1", Payload: []byte("filter")})
+	require.NoError(t, err)
+
+	s, err := peer.Snapshot()
+	require.NoError(t, err)
+	require.Greater(t, s.Index, uint64(0))
+
+	conf := &config.Cluster{
+		NodeName: "node2",
+		BindAddr: "127.0.0.1",
+		RaftImpl: config.RaftImplHashicorp,
+		RaftPort: 8947,
+		RaftDir:  t.TempDir(),
+	}
+	require.NoError(t, InstallSnapshot(conf, s))
+	require.ErrorIs(t, InstallSnapshot(conf, s), base.ErrExistingState)
+
+	// raft restores the fsm from the installed snapshot rather than the log
+	node, err := Setup(conf, make(chan *message.Message, 1))
+	require.NoError(t, err)
+	defer node.Stop()
+	require.Equal(t, []string{"node1"}, node.Lookup("filter"))
+	require.Equal(t, s.Index, node.raft.AppliedIndex())
+}
+
 func TestIsApplyRight(t *testing.T) {
 	peer := createTestPeer(t)
 	defer peer.Stop()
@@ -59,3 +59,14 @@ func TestKV_DelByValue(t *testing.T) {
 	vs = kv.Get("key5")
 	require.EqualValues(t, []string{"value5"}, vs)
 }
+
+func TestKV_Copy(t *testing.T) {
+	kv := NewKV()
+	kv.Add("key1", "value1")
+
+	m := kv.Copy()
+	require.Equal(t, map[string][]string{"key1": {"value1"}}, m)
+
+	m["key1"][0] = "changed"
+	require.Equal(t, []string{"value1"}, kv.Get("key1"))
+}
@@ -13,6 +13,7 @@ import (
 const (
 	HttpGet    = "GET"
 	HttpPost   = "POST"
+	HttpPut    = "PUT"
 	HttpDelete = "DELETE"
 	Timeout    = 3 * time.Second
 )
@@ -6,8 +6,10 @@ import (
 	cs "github.com/wind-c/comqtt/v2/cluster"
 	"github.com/wind-c/comqtt/v2/cluster/discovery"
 	rt "github.com/wind-c/comqtt/v2/mqtt/rest"
+	"io"
 	"net/http"
 	"net/netip"
+	"net/url"
 	"strings"
 )
 
@@ -23,16 +25,28 @@ func New(agent *cs.Agent) *rest {
 
 func (s *rest) GenHandlers() map[string]rt.Handler {
 	return map[string]rt.Handler{
-		"GET /api/v1/node/config":               s.viewConfig,
-		"DELETE /api/v1/node/{name}":            s.leave,
-		"GET /api/v1/cluster/nodes":             s.getNodes,
-		"POST /api/v1/cluster/nodes":            s.join,
-		"POST /api/v1/cluster/peers":            s.addRaftPeer,
-		"DELETE /api/v1/cluster/peers/{name}":   s.removeRaftPeer,
-		"GET /api/v1/cluster/stat/online":       s.getOnlineCount,
-		"GET /api/v1/cluster/clients/{id}":      s.getClient,
-		"POST /api/v1/cluster/blacklist/{id}":   s.kickClient,
-		"DELETE /api/v1/cluster/blacklist/{id}": s.blanchClient,
+		"GET /api/v1/node/config":                              s.viewConfig,
+		"DELETE /api/v1/node/{name}":                           s.leave,
+		"GET /api/v1/cluster/nodes":                            s.getNodes,
+		"POST /api/v1/cluster/nodes":                           s.join,
+		"POST /api/v1/cluster/peers":                           s.addRaftPeer,
+		"DELETE /api/v1/cluster/peers/{name}":                  s.removeRaftPeer,
+		"GET /api/v1/cluster/stat/online":                      s.getOnlineCount,
+		"GET /api/v1/cluster/stat/users":                       s.getUserStats,
+		"GET /api/v1/cluster/stat/tenants":                     s.getTenantStats,
+		"GET /api/v1/cluster/clients/{id}":                     s.getClient,
+		"POST /api/v1/cluster/blacklist/{id}":                  s.kickClient,
+		"DELETE /api/v1/cluster/blacklist/{id}":                s.blanchClient,
+		"POST /api/v1/cluster/blacklist/bans/{kind}/{value}":   s.ban,
+		"DELETE /api/v1/cluster/blacklist/bans/{kind}/{value}": s.unban,
+		"PUT /api/v1/cluster/freeze":                           s.freeze,
+		"DELETE /api/v1/cluster/freeze":                        s.unfreeze,
+		"POST /api/v1/cluster/retained/import":                 s.importRetained,
+		"DELETE /api/v1/cluster/auth/cache":                    s.purgeAuthCache,
+		"DELETE /api/v1/cluster/auth/cache/{key}":              s.invalidateAuthCache,
+		"GET /api/v1/cluster/auth/metrics":                     s.getAuthMetrics,
+		"GET /api/v1/cluster/auth/failures":                    s.getAuthFailures,
+		"DELETE /api/v1/cluster/auth/failures/{kind}/{value}":  s.clearAuthFailure,
 	}
 }
 
@@ -137,6 +151,31 @@ func (s *rest) getOnlineCount(w http.ResponseWriter, r *http.Request) {
 	rt.Ok(w, rs)
 }
 
+// getUserStats return the usage of each username from all nodes in the cluster
+// GET api/v1/cluster/stat/users
+func (s *rest) getUserStats(w http.ResponseWriter, r *http.Request) {
+	urls := genUrls(s.agent.GetMemberList(), withQuery(rt.MqttGetUserStatsPath, r))
+	rs := fetchM(HttpGet, urls, nil)
+	rt.Ok(w, rs)
+}
+
+// getTenantStats return the usage of each tenant from all nodes in the cluster
+// GET api/v1/cluster/stat/tenants
+func (s *rest) getTenantStats(w http.ResponseWriter, r *http.Request) {
+	urls := genUrls(s.agent.GetMemberList(), withQuery(rt.MqttGetTenantStatsPath, r))
+	rs := fetchM(HttpGet, urls, nil)
+	rt.Ok(w, rs)
+}
+
+// withQuery returns the path with the query string of the request, if any.
+func withQuery(path string, r *http.Request) string {
+	if r.URL.RawQuery == "" {
+		return path
+	}
+
+	return path + "?" + r.URL.RawQuery
+}
+
 // getClient return a client information, search from all nodes in the cluster
 // GET api/v1/cluster/clients/{id}
 func (s *rest) getClient(w http.ResponseWriter, r *http.Request) {
@@ -167,6 +206,117 @@ func (s *rest) blanchClient(w http.ResponseWriter, r *http.Request) {
 	rt.Ok(w, rs)
 }
 
+// ban bans a client id, username or ip in the auth blacklist on all nodes in the cluster
+// POST api/v1/cluster/blacklist/bans/{kind}/{value}
+func (s *rest) ban(w http.ResponseWriter, r *http.Request) {
+	path := banPath(r)
+	urls := genUrls(s.agent.GetMemberList(), path)
+	rs := fetchM(HttpPost, urls, nil)
+	rt.Ok(w, rs)
+}
+
+// unban removes a ban from the auth blacklist on all nodes in the cluster
+// DELETE api/v1/cluster/blacklist/bans/{kind}/{value}
+func (s *rest) unban(w http.ResponseWriter, r *http.Request) {
+	path := banPath(r)
+	urls := genUrls(s.agent.GetMemberList(), path)
+	rs := fetchM(HttpDelete, urls, nil)
+	rt.Ok(w, rs)
+}
+
+// banPath returns the node path of the ban of a request.
+func banPath(r *http.Request) string {
+	path := strings.Replace(rt.MqttBanPath, "{kind}", url.PathEscape(r.PathValue("kind")), 1)
+	return strings.Replace(path, "{value}", url.PathEscape(r.PathValue("value")), 1)
+}
+
+// purgeAuthCache remove all cached auth and acl lookups on all nodes in the cluster
+// DELETE api/v1/cluster/auth/cache
+func (s *rest) purgeAuthCache(w http.ResponseWriter, r *http.Request) {
+	urls := genUrls(s.agent.GetMemberList(), rt.MqttAuthCachePath)
+	rs := fetchM(HttpDelete, urls, nil)
+	rt.Ok(w, rs)
+}
+
+// invalidateAuthCache remove the cached auth and acl lookups of a username or client id on all nodes in the cluster
+// DELETE api/v1/cluster/auth/cache/{key}
+func (s *rest) invalidateAuthCache(w http.ResponseWriter, r *http.Request) {
+	path := strings.Replace(rt.MqttAuthCacheKeyPath, "{key}", url.PathEscape(r.PathValue("key")), 1)
+	urls := genUrls(s.agent.GetMemberList(), path)
+	rs := fetchM(HttpDelete, urls, nil)
+	rt.Ok(w, rs)
+}
+
+// getAuthMetrics return the decisions, datasource latency and cache hits of the auth datasources on all nodes in the cluster
+// GET api/v1/cluster/auth/metrics
+func (s *rest) getAuthMetrics(w http.ResponseWriter, r *http.Request) {
+	urls := genUrls(s.agent.GetMemberList(), rt.MqttAuthMetricsPath)
+	rs := fetchM(HttpGet, urls, nil)
+	rt.Ok(w, rs)
+}
+
+// getAuthFailures return the failed authentications and temporary bans on all nodes in the cluster
+// GET api/v1/cluster/auth/failures
+func (s *rest) getAuthFailures(w http.ResponseWriter, r *http.Request) {
+	urls := genUrls(s.agent.GetMemberList(), rt.MqttAuthFailuresPath)
+	rs := fetchM(HttpGet, urls, nil)
+	rt.Ok(w, rs)
+}
+
+// clearAuthFailure remove the failed authentications and temporary ban of a username or
+// source ip on all nodes in the cluster
+// DELETE api/v1/cluster/auth/failures/{kind}/{value}
+func (s *rest) clearAuthFailure(w http.ResponseWriter, r *http.Request) {
+	path := strings.Replace(rt.MqttAuthFailurePath, "{kind}", url.PathEscape(r.PathValue("kind")), 1)
+	path = strings.Replace(path, "{value}", url.PathEscape(r.PathValue("value")), 1)
+	urls := genUrls(s.agent.GetMemberList(), path)
+	rs := fetchM(HttpDelete, urls, nil)
+	rt.Ok(w, rs)
+}
+
+// freeze put all nodes in the cluster into a maintenance freeze
+// PUT api/v1/cluster/freeze
+func (s *rest) freeze(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		rt.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	urls := genUrls(s.agent.GetMemberList(), rt.MqttFreezePath)
+	rs := fetchM(HttpPut, urls, body)
+	rt.Ok(w, rs)
+}
+
+// unfreeze lift the maintenance freeze on all nodes in the cluster
+// DELETE api/v1/cluster/freeze
+func (s *rest) unfreeze(w http.ResponseWriter, r *http.Request) {
+	urls := genUrls(s.agent.GetMemberList(), rt.MqttFreezePath)
+	rs := fetchM(HttpDelete, urls, nil)
+	rt.Ok(w, rs)
+}
+
+// importRetained import a retained message export on all nodes in the cluster
+// POST api/v1/cluster/retained/import?overwrite=false
+func (s *rest) importRetained(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		rt.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	path := rt.MqttRetainedImportPath
+	if r.URL.RawQuery != "" {
+		path += "?" + r.URL.RawQuery
+	}
+
+	urls := genUrls(s.agent.GetMemberList(), path)
+	rs := fetchM(HttpPost, urls, body)
+	rt.Ok(w, rs)
+}
+
 // genUrls generate urls
 func genUrls(ms []discovery.Member, path string) []string {
 	urls := make([]string, len(ms))
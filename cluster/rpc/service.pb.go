@@ -283,40 +283,132 @@ func (m *JoinRequest) GetPort() uint32 {
 	return 0
 }
 
+type SnapshotRequest struct {
+	NodeId               string   `protobuf:"bytes,1,opt,name=nodeId,proto3" json:"nodeId,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *SnapshotRequest) Reset()         { *m = SnapshotRequest{} }
+func (m *SnapshotRequest) String() string { return proto.CompactTextString(m) }
+func (*SnapshotRequest) ProtoMessage()    {}
+func (*SnapshotRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_a0b84a42fa06f626, []int{5}
+}
+
+func (m *SnapshotRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SnapshotRequest.Unmarshal(m, b)
+}
+func (m *SnapshotRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SnapshotRequest.Marshal(b, m, deterministic)
+}
+func (m *SnapshotRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SnapshotRequest.Merge(m, src)
+}
+func (m *SnapshotRequest) XXX_Size() int {
+	return xxx_messageInfo_SnapshotRequest.Size(m)
+}
+func (m *SnapshotRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_SnapshotRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SnapshotRequest proto.InternalMessageInfo
+
+func (m *SnapshotRequest) GetNodeId() string {
+	if m != nil {
+		return m.NodeId
+	}
+	return ""
+}
+
+type SnapshotResponse struct {
+	NodeId               string   `protobuf:"bytes,1,opt,name=nodeId,proto3" json:"nodeId,omitempty"`
+	Data                 []byte   `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *SnapshotResponse) Reset()         { *m = SnapshotResponse{} }
+func (m *SnapshotResponse) String() string { return proto.CompactTextString(m) }
+func (*SnapshotResponse) ProtoMessage()    {}
+func (*SnapshotResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_a0b84a42fa06f626, []int{6}
+}
+
+func (m *SnapshotResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SnapshotResponse.Unmarshal(m, b)
+}
+func (m *SnapshotResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SnapshotResponse.Marshal(b, m, deterministic)
+}
+func (m *SnapshotResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SnapshotResponse.Merge(m, src)
+}
+func (m *SnapshotResponse) XXX_Size() int {
+	return xxx_messageInfo_SnapshotResponse.Size(m)
+}
+func (m *SnapshotResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_SnapshotResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SnapshotResponse proto.InternalMessageInfo
+
+func (m *SnapshotResponse) GetNodeId() string {
+	if m != nil {
+		return m.NodeId
+	}
+	return ""
+}
+
+func (m *SnapshotResponse) GetData() []byte {
+	if m != nil {
+		return m.Data
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*PublishRequest)(nil), "PublishRequest")
 	proto.RegisterType((*ConnectRequest)(nil), "ConnectRequest")
 	proto.RegisterType((*Response)(nil), "Response")
 	proto.RegisterType((*ApplyRequest)(nil), "ApplyRequest")
 	proto.RegisterType((*JoinRequest)(nil), "JoinRequest")
+	proto.RegisterType((*SnapshotRequest)(nil), "SnapshotRequest")
+	proto.RegisterType((*SnapshotResponse)(nil), "SnapshotResponse")
 }
 
 func init() { proto.RegisterFile("service.proto", fileDescriptor_a0b84a42fa06f626) }
 
 var fileDescriptor_a0b84a42fa06f626 = []byte{
-	// 351 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xa4, 0x52, 0xcb, 0x4e, 0xc3, 0x30,
-	0x10, 0x24, 0xa1, 0x0a, 0xe9, 0x92, 0xb4, 0x92, 0x0f, 0x55, 0x54, 0x09, 0x51, 0x45, 0x42, 0xe4,
-	0xd2, 0x54, 0x82, 0x2f, 0xe0, 0x71, 0x29, 0x12, 0xa8, 0xf2, 0xa1, 0x07, 0x6e, 0xa9, 0xe3, 0x52,
-	0xab, 0xc6, 0x0e, 0xb6, 0x03, 0xca, 0x1f, 0xf0, 0x45, 0x7c, 0x1f, 0x8a, 0xe5, 0xa2, 0x84, 0x0b,
-	0x07, 0x6e, 0x3b, 0x9b, 0xc9, 0xee, 0xcc, 0xac, 0x21, 0xd6, 0x54, 0xbd, 0x33, 0x42, 0xf3, 0x4a,
-	0x49, 0x23, 0xd3, 0x4f, 0x0f, 0x46, 0xab, 0x7a, 0xc3, 0x99, 0xde, 0x61, 0xfa, 0x56, 0x53, 0x6d,
-	0xd0, 0x04, 0x02, 0x21, 0x4b, 0xba, 0x2c, 0x13, 0x6f, 0xe6, 0x65, 0x43, 0xec, 0x10, 0x9a, 0x42,
-	0x48, 0x38, 0xa3, 0xc2, 0x2c, 0xcb, 0xc4, 0xb7, 0x5f, 0x7e, 0x30, 0xca, 0x60, 0x6c, 0xe7, 0x11,
-	0xc9, 0xd7, 0x54, 0x69, 0x26, 0x45, 0x72, 0x3c, 0xf3, 0xb2, 0x18, 0xff, 0x6e, 0xa3, 0x04, 0x4e,
-	0xaa, 0xa2, 0xe1, 0xb2, 0x28, 0x93, 0xc1, 0xcc, 0xcb, 0x22, 0x7c, 0x80, 0xe9, 0x3d, 0x8c, 0xee,
-	0xa4, 0x10, 0x94, 0x98, 0x7f, 0x28, 0x49, 0xa7, 0x10, 0x62, 0xaa, 0x2b, 0x29, 0x34, 0x45, 0x23,
-	0xf0, 0xe5, 0xde, 0xfe, 0x1b, 0x62, 0x5f, 0xee, 0xd3, 0x35, 0x44, 0x37, 0x55, 0xc5, 0x9b, 0xce,
-	0xfc, 0x82, 0x98, 0x56, 0xac, 0x67, 0xc5, 0x3a, 0xd4, 0xd9, 0xeb, 0xf7, 0xf6, 0x4e, 0x20, 0xd8,
-	0x32, 0x6e, 0xa8, 0xb2, 0xe6, 0x22, 0xec, 0x50, 0xfa, 0x08, 0xa7, 0x0f, 0x92, 0x89, 0xbf, 0x64,
-	0x23, 0x18, 0x14, 0x65, 0xa9, 0xdc, 0x50, 0x5b, 0xb7, 0xbd, 0x4a, 0x2a, 0xe3, 0xd2, 0xb2, 0xf5,
-	0xd5, 0x97, 0x07, 0x01, 0xa6, 0xbc, 0x68, 0x34, 0x9a, 0x43, 0xec, 0xae, 0xb3, 0x2a, 0xc8, 0x9e,
-	0x1a, 0x34, 0xce, 0xfb, 0xd7, 0x9a, 0x0e, 0xf3, 0x83, 0xdd, 0xf4, 0xa8, 0xa5, 0xbb, 0x08, 0x9f,
-	0xa4, 0x61, 0xdb, 0x06, 0x8d, 0xf3, 0x7e, 0xa4, 0x7d, 0xfa, 0x25, 0x0c, 0x71, 0xb1, 0x35, 0x36,
-	0x13, 0x14, 0xe7, 0xdd, 0x6c, 0xfa, 0xc4, 0x0b, 0x08, 0x5b, 0x62, 0x6b, 0x12, 0x45, 0x79, 0xc7,
-	0x6b, 0x8f, 0x76, 0x7b, 0xfe, 0x7c, 0xf6, 0xc2, 0xcc, 0xae, 0xde, 0xe4, 0x44, 0xbe, 0x2e, 0x3e,
-	0x98, 0x28, 0xe7, 0x64, 0x41, 0x78, 0xad, 0x0d, 0x55, 0x0b, 0x55, 0x91, 0x4d, 0x60, 0x5f, 0xc3,
-	0xf5, 0x77, 0x00, 0x00, 0x00, 0xff, 0xff, 0xe5, 0x1d, 0xd6, 0x0c, 0x85, 0x02, 0x00, 0x00,
+	// 401 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xa4, 0x52, 0x5d, 0x8b, 0x13, 0x31,
+	0x14, 0xdd, 0xa9, 0x4b, 0x6d, 0xaf, 0x33, 0xed, 0x9a, 0x87, 0x65, 0x28, 0x88, 0x25, 0x20, 0xd6,
+	0x87, 0x4d, 0x41, 0xc1, 0x47, 0xc1, 0x0f, 0x84, 0x15, 0x94, 0x25, 0xc2, 0x3e, 0xf8, 0x96, 0x26,
+	0xa9, 0x0d, 0x8d, 0x49, 0x4c, 0x32, 0xca, 0xfc, 0x03, 0x7f, 0xad, 0xbf, 0x41, 0x26, 0xa4, 0x3a,
+	0xd3, 0x07, 0xfb, 0xb0, 0x6f, 0xf7, 0x64, 0xce, 0xdc, 0x73, 0xee, 0xb9, 0x17, 0xaa, 0x20, 0xfd,
+	0x0f, 0xc5, 0x25, 0x71, 0xde, 0x46, 0x8b, 0x7f, 0x15, 0x30, 0xbb, 0x69, 0x36, 0x5a, 0x85, 0x1d,
+	0x95, 0xdf, 0x1b, 0x19, 0x22, 0xba, 0x84, 0xb1, 0xb1, 0x42, 0x5e, 0x8b, 0xba, 0x58, 0x16, 0xab,
+	0x29, 0xcd, 0x08, 0x2d, 0x60, 0xc2, 0xb5, 0x92, 0x26, 0x5e, 0x8b, 0x7a, 0x94, 0xbe, 0xfc, 0xc5,
+	0x68, 0x05, 0xf3, 0xd4, 0x8f, 0x5b, 0x7d, 0x2b, 0x7d, 0x50, 0xd6, 0xd4, 0xf7, 0x96, 0xc5, 0xaa,
+	0xa2, 0xc7, 0xcf, 0xa8, 0x86, 0xfb, 0x8e, 0xb5, 0xda, 0x32, 0x51, 0x9f, 0x2f, 0x8b, 0x55, 0x49,
+	0x0f, 0x10, 0xbf, 0x83, 0xd9, 0x5b, 0x6b, 0x8c, 0xe4, 0xf1, 0x0e, 0x4e, 0xf0, 0x02, 0x26, 0x54,
+	0x06, 0x67, 0x4d, 0x90, 0x68, 0x06, 0x23, 0xbb, 0x4f, 0xff, 0x4e, 0xe8, 0xc8, 0xee, 0xf1, 0x2d,
+	0x94, 0xaf, 0x9d, 0xd3, 0x6d, 0xaf, 0x3f, 0xe3, 0xb1, 0x33, 0x5b, 0x24, 0xb3, 0x19, 0xf5, 0x74,
+	0x47, 0x03, 0xdd, 0x4b, 0x18, 0x6f, 0x95, 0x8e, 0xd2, 0xa7, 0xe1, 0x4a, 0x9a, 0x11, 0xfe, 0x08,
+	0x0f, 0x3e, 0x58, 0x65, 0x4e, 0xd9, 0x46, 0x70, 0xce, 0x84, 0xf0, 0xb9, 0x69, 0xaa, 0xbb, 0x37,
+	0x67, 0x7d, 0xcc, 0x69, 0xa5, 0x1a, 0x3f, 0x83, 0xf9, 0x67, 0xc3, 0x5c, 0xd8, 0xd9, 0x53, 0x49,
+	0xe0, 0x57, 0x70, 0xf1, 0x8f, 0x9a, 0xa7, 0xfe, 0x8f, 0xbc, 0x60, 0x91, 0x25, 0xf9, 0x92, 0xa6,
+	0xfa, 0xf9, 0xef, 0x02, 0xc6, 0x54, 0x6a, 0xd6, 0x06, 0x74, 0x05, 0x55, 0x3e, 0x84, 0x1b, 0xc6,
+	0xf7, 0x32, 0xa2, 0x39, 0x19, 0x1e, 0xc6, 0x62, 0x4a, 0x0e, 0x1a, 0xf8, 0xac, 0xa3, 0xe7, 0x6d,
+	0x7d, 0xb2, 0x51, 0x6d, 0x5b, 0x34, 0x27, 0xc3, 0xed, 0x0d, 0xe9, 0x4f, 0x61, 0x4a, 0xd9, 0x36,
+	0xa6, 0xf8, 0x51, 0x45, 0xfa, 0x6b, 0x18, 0x12, 0x9f, 0xc0, 0xa4, 0x23, 0x76, 0x79, 0xa2, 0x92,
+	0xf4, 0x62, 0x1d, 0xd2, 0x5e, 0x42, 0xf5, 0x5e, 0x46, 0xbe, 0x3b, 0x4c, 0x8f, 0x2e, 0xc8, 0x51,
+	0x66, 0x8b, 0x87, 0xe4, 0x38, 0x1a, 0x7c, 0xf6, 0xe6, 0xf1, 0x97, 0x47, 0x5f, 0x55, 0xdc, 0x35,
+	0x1b, 0xc2, 0xed, 0xb7, 0xf5, 0x4f, 0x65, 0xc4, 0x15, 0x5f, 0x73, 0xdd, 0x84, 0x28, 0xfd, 0xda,
+	0x3b, 0xbe, 0x19, 0xa7, 0x83, 0x7d, 0xf1, 0x67, 0x00, 0x12, 0xc6, 0x51, 0xcd, 0x28, 0x03, 0x00,
+	0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -335,6 +427,7 @@ type RelaysClient interface {
 	ConnectNotify(ctx context.Context, in *ConnectRequest, opts ...grpc.CallOption) (*Response, error)
 	RaftApply(ctx context.Context, in *ApplyRequest, opts ...grpc.CallOption) (*Response, error)
 	RaftJoin(ctx context.Context, in *JoinRequest, opts ...grpc.CallOption) (*Response, error)
+	FetchSnapshot(ctx context.Context, in *SnapshotRequest, opts ...grpc.CallOption) (*SnapshotResponse, error)
 }
 
 type relaysClient struct {
@@ -381,12 +474,22 @@ func (c *relaysClient) RaftJoin(ctx context.Context, in *JoinRequest, opts ...gr
 	return out, nil
 }
 
+func (c *relaysClient) FetchSnapshot(ctx context.Context, in *SnapshotRequest, opts ...grpc.CallOption) (*SnapshotResponse, error) {
+	out := new(SnapshotResponse)
+	err := c.cc.Invoke(ctx, "/Relays/FetchSnapshot", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // RelaysServer is the server API for Relays service.
 type RelaysServer interface {
 	PublishPacket(context.Context, *PublishRequest) (*Response, error)
 	ConnectNotify(context.Context, *ConnectRequest) (*Response, error)
 	RaftApply(context.Context, *ApplyRequest) (*Response, error)
 	RaftJoin(context.Context, *JoinRequest) (*Response, error)
+	FetchSnapshot(context.Context, *SnapshotRequest) (*SnapshotResponse, error)
 }
 
 // UnimplementedRelaysServer can be embedded to have forward compatible implementations.
@@ -405,6 +508,9 @@ func (*UnimplementedRelaysServer) RaftApply(ctx context.Context, req *ApplyReque
 func (*UnimplementedRelaysServer) RaftJoin(ctx context.Context, req *JoinRequest) (*Response, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method RaftJoin not implemented")
 }
+func (*UnimplementedRelaysServer) FetchSnapshot(ctx context.Context, req *SnapshotRequest) (*SnapshotResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method FetchSnapshot not implemented")
+}
 
 func RegisterRelaysServer(s *grpc.Server, srv RelaysServer) {
 	s.RegisterService(&_Relays_serviceDesc, srv)
@@ -482,6 +588,24 @@ func _Relays_RaftJoin_Handler(srv interface{}, ctx context.Context, dec func(int
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Relays_FetchSnapshot_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SnapshotRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RelaysServer).FetchSnapshot(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Relays/FetchSnapshot",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RelaysServer).FetchSnapshot(ctx, req.(*SnapshotRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _Relays_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "Relays",
 	HandlerType: (*RelaysServer)(nil),
@@ -502,6 +626,10 @@ var _Relays_serviceDesc = grpc.ServiceDesc{
 			MethodName: "RaftJoin",
 			Handler:    _Relays_RaftJoin_Handler,
 		},
+		{
+			MethodName: "FetchSnapshot",
+			Handler:    _Relays_FetchSnapshot_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "service.proto",
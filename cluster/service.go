@@ -6,7 +6,6 @@ package cluster
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"net"
 	"strconv"
@@ -134,6 +133,22 @@ func (s *RpcService) RaftJoin(ctx context.Context, req *crpc.JoinRequest) (*crpc
 	return &crpc.Response{Ok: true}, nil
 }
 
+// FetchSnapshot returns a compressed snapshot of the state of this node to a new node.
+func (s *RpcService) FetchSnapshot(ctx context.Context, req *crpc.SnapshotRequest) (*crpc.SnapshotResponse, error) {
+	snap, err := s.agent.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := snap.Encode()
+	if err != nil {
+		return nil, err
+	}
+	log.Info("send snapshot", "to", req.NodeId, "size", len(data))
+
+	return &crpc.SnapshotResponse{NodeId: s.agent.GetLocalName(), Data: data}, nil
+}
+
 type ClientManager struct {
 	agent *Agent
 	cs    map[string]*client
@@ -162,7 +177,7 @@ func (c *ClientManager) RemoveGrpcClient(nodeId string) {
 func (c *ClientManager) getNodeAddr(nodeId string) (string, error) {
 	m := c.agent.getNodeMember(nodeId)
 	if m == nil {
-		return "", errors.New("node not found")
+		return "", ErrNodeNotFound
 	}
 
 	return getGrpcAddr(m), nil
@@ -178,7 +193,7 @@ func (c *ClientManager) getClient(nodeId string) (*client, error) {
 
 	addr, err := c.getNodeAddr(nodeId)
 	if addr == "" || err != nil {
-		return nil, errors.New("node not found")
+		return nil, ErrNodeNotFound
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*ReqTimeout)
@@ -188,12 +203,19 @@ func (c *ClientManager) getClient(nodeId string) (*client, error) {
 		grpc_retry.WithBackoff(grpc_retry.BackoffExponential(ReqTimeout)),
 		grpc_retry.WithMax(3),
 	}
-	conn, err := grpc.DialContext(ctx, addr,
+	dialOpts := []grpc.DialOption{
 		//grpc.WithDefaultServiceConfig(serviceConfig),
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
 		grpc.WithDefaultCallOptions(grpc.WaitForReady(true)),
 		grpc.WithUnaryInterceptor(grpc_retry.UnaryClientInterceptor(retryOpts...)),
-		grpc.WithKeepaliveParams(kacp))
+		grpc.WithKeepaliveParams(kacp),
+	}
+	if dial := c.agent.dialer; dial != nil {
+		dialOpts = append(dialOpts, grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return dial(ctx, "tcp", addr)
+		}))
+	}
+	conn, err := grpc.DialContext(ctx, addr, dialOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("dialing failed: %v", err)
 	}
@@ -206,10 +228,16 @@ func (c *ClientManager) getClient(nodeId string) (*client, error) {
 }
 
 func (c *ClientManager) RelayPublishPacket(nodeId string, msg *message.Message) {
+	if err := c.relayPublishPacket(nodeId, msg); err != nil {
+		log.Error("relay publish packet", "error", err, "to", nodeId, "cid", msg.ClientID)
+	}
+}
+
+// relayPublishPacket relays a publish message to a node, returning any error.
+func (c *ClientManager) relayPublishPacket(nodeId string, msg *message.Message) error {
 	client, err := c.getClient(nodeId)
 	if err != nil {
-		log.Error("get grpc client", "error", err)
-		return
+		return err
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), ReqTimeout)
@@ -220,9 +248,8 @@ func (c *ClientManager) RelayPublishPacket(nodeId string, msg *message.Message)
 		ProtocolVersion: uint32(msg.ProtocolVersion),
 		Payload:         msg.Payload,
 	}
-	if _, err := client.PublishPacket(ctx, &req); err != nil {
-		log.Error("relay publish packet", "error", err, "to", nodeId, "cid", msg.ClientID)
-	}
+	_, err = client.PublishPacket(ctx, &req)
+	return err
 }
 
 func (c *ClientManager) ConnectNotifyToNode(nodeId, clientId string) {
@@ -246,7 +273,7 @@ func (c *ClientManager) ConnectNotifyToNode(nodeId, clientId string) {
 func (c *ClientManager) ConnectNotifyToOthers(msg *message.Message) {
 	ms := c.agent.membership.Members()
 	for _, m := range ms {
-		if m.Name == c.agent.GetLocalName() {
+		if m.Name == c.agent.GetLocalName() || !c.agent.IsCompatible(m.Name) {
 			continue
 		}
 		c.ConnectNotifyToNode(m.Name, msg.ClientID)
@@ -275,7 +302,7 @@ func (c *ClientManager) RelayRaftApply(nodeId string, msg *message.Message) {
 func (c *ClientManager) RaftApplyToOthers(msg *message.Message) {
 	ms := c.agent.membership.Members()
 	for _, m := range ms {
-		if m.Name == c.agent.GetLocalName() {
+		if m.Name == c.agent.GetLocalName() || !c.agent.IsCompatible(m.Name) {
 			continue
 		}
 		c.RelayRaftApply(m.Name, msg)
@@ -293,19 +320,37 @@ func (c *ClientManager) RelayRaftJoin(nodeId string) {
 	defer cancel()
 	req := crpc.JoinRequest{
 		NodeId: c.agent.GetLocalName(),
-		Addr:   c.agent.Config.BindAddr,
+		Addr:   c.agent.Config.AdvertiseHost(),
 		Port:   uint32(c.agent.Config.RaftPort),
 	}
 	if _, err := client.RaftJoin(ctx, &req); err != nil {
-		addr := c.agent.Config.BindAddr + ":" + strconv.Itoa(c.agent.Config.RaftPort)
+		addr := net.JoinHostPort(c.agent.Config.AdvertiseHost(), strconv.Itoa(c.agent.Config.RaftPort))
 		OnJoinLog(nodeId, addr, "raft join", err)
 	}
 }
 
+// FetchSnapshot fetches and decodes a snapshot of the state of a node.
+func (c *ClientManager) FetchSnapshot(nodeId string) (*Snapshot, error) {
+	client, err := c.getClient(nodeId)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*ReqTimeout)
+	defer cancel()
+	req := crpc.SnapshotRequest{NodeId: c.agent.GetLocalName()}
+	resp, err := client.FetchSnapshot(ctx, &req, grpc.MaxCallRecvMsgSize(snapshotMaxSize))
+	if err != nil {
+		return nil, err
+	}
+
+	return DecodeSnapshot(resp.Data)
+}
+
 func (c *ClientManager) RaftJoinToOthers() {
 	ms := c.agent.membership.Members()
 	for _, m := range ms {
-		if m.Name == c.agent.GetLocalName() {
+		if m.Name == c.agent.GetLocalName() || !c.agent.IsCompatible(m.Name) {
 			continue
 		}
 		c.RelayRaftJoin(m.Name)
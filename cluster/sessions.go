@@ -0,0 +1,75 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package cluster
+
+import "sync"
+
+// sessionIndex records the node holding the session of each client, as announced by the
+// connect notifications of the nodes, so that a client can be found without asking every node.
+type sessionIndex struct {
+	sync.RWMutex
+	nodes map[string]string // client ids keyed to the node holding their session
+}
+
+func newSessionIndex() *sessionIndex {
+	return &sessionIndex{
+		nodes: make(map[string]string),
+	}
+}
+
+// Set records the node holding the session of a client.
+func (x *sessionIndex) Set(cid, node string) {
+	x.Lock()
+	defer x.Unlock()
+	x.nodes[cid] = node
+}
+
+// Get returns the node holding the session of a client.
+func (x *sessionIndex) Get(cid string) (string, bool) {
+	x.RLock()
+	defer x.RUnlock()
+	node, ok := x.nodes[cid]
+	return node, ok
+}
+
+// DelByNode forgets the sessions held by a node, returning the number forgotten.
+func (x *sessionIndex) DelByNode(node string) int {
+	x.Lock()
+	defer x.Unlock()
+	n := 0
+	for cid, v := range x.nodes {
+		if v == node {
+			delete(x.nodes, cid)
+			n++
+		}
+	}
+	return n
+}
+
+// Copy returns a copy of the index.
+func (x *sessionIndex) Copy() map[string]string {
+	x.RLock()
+	defer x.RUnlock()
+	m := make(map[string]string, len(x.nodes))
+	for cid, node := range x.nodes {
+		m[cid] = node
+	}
+	return m
+}
+
+// Merge adds the sessions of m which are not yet known, as those announced since m was
+// taken are newer, returning the number added.
+func (x *sessionIndex) Merge(m map[string]string) int {
+	x.Lock()
+	defer x.Unlock()
+	n := 0
+	for cid, node := range m {
+		if _, ok := x.nodes[cid]; !ok {
+			x.nodes[cid] = node
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,204 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package cluster
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/cluster/log"
+	"github.com/wind-c/comqtt/v2/cluster/raft"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+const (
+	snapshotMaxSize       = 256 << 20 // the largest compressed snapshot a node will receive
+	snapshotRetryInterval = time.Second
+	snapshotMaxAttempts   = 10
+)
+
+var (
+	ErrNoSnapshotPeer = errors.New("no peer to fetch snapshot from")
+	ErrRaftNotReady   = errors.New("raft is not ready")
+)
+
+// Snapshot is a point in time copy of the state a node needs to serve clients, so that a
+// new node can be bootstrapped from a peer instead of replaying the full raft log.
+type Snapshot struct {
+	Node     string            // the node the snapshot was taken from
+	Created  int64             // the unix time the snapshot was taken
+	Raft     *raft.Snapshot    // the raft snapshot of the routing fsm
+	Retained [][]byte          // the encoded retained messages
+	Sessions map[string]string // the session index, client ids keyed to the node holding their session
+}
+
+// Snapshot takes a snapshot of the routing fsm, the retained messages and the session index
+// of this node.
+func (a *Agent) Snapshot() (*Snapshot, error) {
+	if a.raftPeer == nil {
+		return nil, ErrRaftNotReady
+	}
+
+	rs, err := a.raftPeer.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	s := &Snapshot{
+		Node:     a.GetLocalName(),
+		Created:  now,
+		Raft:     rs,
+		Sessions: a.sessions.Copy(),
+	}
+
+	for _, pk := range a.mqttServer.Topics.Messages("#") {
+		if strings.HasPrefix(pk.TopicName, mqtt.SysPrefix) {
+			continue
+		}
+
+		// carry only the remaining expiry interval, as the receiving node restarts the clock.
+		if remaining, ok := mqtt.RemainingMessageExpiry(pk, now); ok {
+			if remaining <= 0 {
+				continue
+			}
+			pk.Properties.MessageExpiryInterval = uint32(remaining)
+		}
+
+		var buf bytes.Buffer
+		pk.ProtocolVersion = 5
+		pk.Mods.AllowResponseInfo = true
+		if pk.FixedHeader.Qos > 0 && pk.PacketID == 0 {
+			pk.PacketID = 1 // a placeholder so the packet encodes, cleared when restored
+		}
+		if err := pk.PublishEncode(&buf); err != nil {
+			continue
+		}
+		s.Retained = append(s.Retained, buf.Bytes())
+	}
+
+	return s, nil
+}
+
+// Encode returns the snapshot gob encoded and gzip compressed.
+func (s *Snapshot) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := gob.NewEncoder(zw).Encode(s); err != nil {
+		return nil, err
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DecodeSnapshot decodes a snapshot encoded with Encode.
+func DecodeSnapshot(b []byte) (*Snapshot, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	s := new(Snapshot)
+	if err := gob.NewDecoder(zr).Decode(s); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// RestoreSnapshot merges the retained messages and session index of a peer snapshot into
+// those of this node, returning the number of retained messages and sessions restored. The
+// routing fsm is restored by raft from the raft snapshot, installed before raft starts.
+func (a *Agent) RestoreSnapshot(s *Snapshot) (retained, sessions int) {
+	for _, b := range s.Retained {
+		pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish}, ProtocolVersion: 5}
+		if err := a.readFixedHeader(b, &pk.FixedHeader); err != nil {
+			continue
+		}
+
+		offset := len(b) - pk.FixedHeader.Remaining
+		if err := pk.PublishDecode(b[offset:]); err != nil {
+			continue
+		}
+
+		// a message relayed since the snapshot was taken is newer than the snapshot.
+		if _, ok := a.mqttServer.Topics.RetainedMessage(pk.TopicName); ok {
+			continue
+		}
+
+		pk.PacketID = 0
+		pk.Created = time.Now().Unix()
+		a.mqttServer.Topics.RetainMessage(pk)
+		retained++
+	}
+
+	sessions = a.sessions.Merge(s.Sessions)
+	return
+}
+
+// bootstrapFromPeer fetches a snapshot from another node before raft starts, installs its
+// raft snapshot so that raft restores the routing fsm from it rather than replaying the log,
+// and restores its retained messages and session index. It retries until a snapshot is
+// restored, the attempts are exhausted or the agent is stopped.
+func (a *Agent) bootstrapFromPeer(install func(*raft.Snapshot) error) {
+	for i := 0; i < snapshotMaxAttempts; i++ {
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-time.After(snapshotRetryInterval):
+		}
+
+		node, err := a.snapshotPeer()
+		if err != nil {
+			continue
+		}
+
+		start := time.Now()
+		s, err := a.grpcClientManager.FetchSnapshot(node)
+		if err != nil {
+			log.Error("fetch snapshot", "error", err, "from", node)
+			continue
+		}
+
+		if s.Raft == nil {
+			log.Error("snapshot has no raft state", "from", node)
+			continue
+		}
+
+		if err := install(s.Raft); errors.Is(err, raft.ErrExistingState) {
+			log.Info("raft state exists, not installing snapshot", "from", node)
+		} else if err != nil {
+			log.Error("install raft snapshot", "error", err, "from", node)
+			continue
+		}
+
+		retained, sessions := a.RestoreSnapshot(s)
+		log.Info("bootstrap from snapshot", "from", node, "index", s.Raft.Index, "retained", retained, "sessions", sessions, "elapsed", time.Since(start))
+		return
+	}
+
+	log.Warn("bootstrap from snapshot failed, falling back to raft log replay")
+}
+
+// snapshotPeer returns a node a snapshot can be fetched from.
+func (a *Agent) snapshotPeer() (string, error) {
+	for _, m := range a.membership.Members() {
+		if m.Name != a.GetLocalName() {
+			return m.Name, nil
+		}
+	}
+
+	return "", ErrNoSnapshotPeer
+}
@@ -0,0 +1,175 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/cluster/message"
+	"github.com/wind-c/comqtt/v2/cluster/raft"
+	crpc "github.com/wind-c/comqtt/v2/cluster/rpc"
+	"github.com/wind-c/comqtt/v2/cluster/topics"
+	"github.com/wind-c/comqtt/v2/config"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+// routesPeer is a raft peer holding only the routing fsm.
+type routesPeer struct {
+	*raft.KV
+}
+
+func (p *routesPeer) Join(nodeID, addr string) error     { return nil }
+func (p *routesPeer) Leave(nodeID string) error          { return nil }
+func (p *routesPeer) Propose(msg *message.Message) error { return nil }
+func (p *routesPeer) Lookup(key string) []string         { return p.Get(key) }
+func (p *routesPeer) IsApplyRight() bool                 { return true }
+func (p *routesPeer) IsLeader() bool                     { return true }
+func (p *routesPeer) GetLeader() (addr, id string)       { return "", "" }
+func (p *routesPeer) GenPeersFile(file string) error     { return nil }
+func (p *routesPeer) Stop()                              {}
+
+func (p *routesPeer) Snapshot() (*raft.Snapshot, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(p.Copy()); err != nil {
+		return nil, err
+	}
+	return &raft.Snapshot{Index: 7, Term: 2, Data: buf.Bytes()}, nil
+}
+
+func decodeRoutes(t *testing.T, s *raft.Snapshot) map[string][]string {
+	require.NotNil(t, s)
+	routes := map[string][]string{}
+	require.NoError(t, gob.NewDecoder(bytes.NewReader(s.Data)).Decode(&routes))
+	return routes
+}
+
+func newSnapshotAgent(name string) *Agent {
+	a := NewAgent(&config.Cluster{NodeName: name})
+	a.raftPeer = &routesPeer{KV: raft.NewKV()}
+	a.mqttServer = mqtt.New(&mqtt.Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	a.subTree = topics.New()
+	return a
+}
+
+func retain(a *Agent, topic, payload string, expiry uint32, created int64) {
+	a.mqttServer.Topics.RetainMessage(packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true, Qos: 1},
+		TopicName:   topic,
+		Payload:     []byte(payload),
+		Properties:  packets.Properties{MessageExpiryInterval: expiry},
+		Created:     created,
+	})
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	now := time.Now().Unix()
+	leader := newSnapshotAgent("node1")
+	leader.raftPeer.(*routesPeer).Add("a/b", "node1")
+	leader.raftPeer.(*routesPeer).Add("a/#", "node2")
+	retain(leader, "a/b", "hello", 0, now)
+	retain(leader, "a/expiring", "soon", 60, now-20)
+	retain(leader, "a/expired", "gone", 5, now-20)
+	retain(leader, mqtt.SysPrefix+"/broker/uptime", "1", 0, now)
+
+	leader.sessions.Set("cl1", "node1")
+	leader.sessions.Set("cl2", "node2")
+
+	s, err := leader.Snapshot()
+	require.NoError(t, err)
+	require.Equal(t, "node1", s.Node)
+	require.Len(t, s.Retained, 2)
+
+	b, err := s.Encode()
+	require.NoError(t, err)
+	s, err = DecodeSnapshot(b)
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), s.Raft.Index)
+	require.Equal(t, map[string][]string{"a/b": {"node1"}, "a/#": {"node2"}}, decodeRoutes(t, s.Raft))
+
+	node := newSnapshotAgent("node3")
+	node.sessions.Set("cl2", "node3") // announced since the snapshot was taken
+	retained, sessions := node.RestoreSnapshot(s)
+	require.Equal(t, 2, retained)
+	require.Equal(t, 1, sessions)
+	require.Equal(t, map[string]string{"cl1": "node1", "cl2": "node3"}, node.sessions.Copy())
+
+	msgs := node.mqttServer.Topics.Messages("a/#")
+	require.Len(t, msgs, 2)
+	for _, pk := range msgs {
+		require.True(t, pk.FixedHeader.Retain)
+		if pk.TopicName == "a/expiring" {
+			require.Equal(t, "soon", string(pk.Payload))
+			require.LessOrEqual(t, pk.Properties.MessageExpiryInterval, uint32(40))
+		} else {
+			require.Equal(t, "hello", string(pk.Payload))
+			require.Equal(t, byte(1), pk.FixedHeader.Qos)
+		}
+	}
+}
+
+func TestDecodeSnapshotInvalid(t *testing.T) {
+	_, err := DecodeSnapshot([]byte("not a snapshot"))
+	require.Error(t, err)
+}
+
+func TestRpcServiceFetchSnapshot(t *testing.T) {
+	a := newSnapshotAgent("node1")
+	a.raftPeer.(*routesPeer).Add("a/b", "node2")
+
+	resp, err := NewRpcService(a).FetchSnapshot(context.Background(), &crpc.SnapshotRequest{NodeId: "node3"})
+	require.NoError(t, err)
+	require.Equal(t, "node1", resp.NodeId)
+
+	s, err := DecodeSnapshot(resp.Data)
+	require.NoError(t, err)
+	require.Equal(t, map[string][]string{"a/b": {"node2"}}, decodeRoutes(t, s.Raft))
+}
+
+func TestSnapshotRaftNotReady(t *testing.T) {
+	a := newSnapshotAgent("node1")
+	a.raftPeer = nil
+	_, err := a.Snapshot()
+	require.ErrorIs(t, err, ErrRaftNotReady)
+}
+
+func TestRestoreSnapshotKeepsNewerRetained(t *testing.T) {
+	leader := newSnapshotAgent("node1")
+	retain(leader, "a/b", "old", 0, time.Now().Unix())
+
+	node := newSnapshotAgent("node3")
+	retain(node, "a/b", "new", 0, time.Now().Unix())
+
+	s, err := leader.Snapshot()
+	require.NoError(t, err)
+	retained, _ := node.RestoreSnapshot(s)
+	require.Equal(t, 0, retained)
+	msgs := node.mqttServer.Topics.Messages("a/b")
+	require.Len(t, msgs, 1)
+	require.Equal(t, "new", string(msgs[0].Payload))
+}
+
+func TestSessionIndex(t *testing.T) {
+	x := newSessionIndex()
+	x.Set("cl1", "node1")
+	x.Set("cl2", "node2")
+	x.Set("cl3", "node2")
+
+	node, ok := x.Get("cl1")
+	require.True(t, ok)
+	require.Equal(t, "node1", node)
+
+	require.Equal(t, 1, x.Merge(map[string]string{"cl1": "node3", "cl4": "node3"}))
+	node, _ = x.Get("cl1")
+	require.Equal(t, "node1", node)
+
+	require.Equal(t, 2, x.DelByNode("node2"))
+	_, ok = x.Get("cl2")
+	require.False(t, ok)
+	require.Equal(t, map[string]string{"cl1": "node1", "cl4": "node3"}, x.Copy())
+}
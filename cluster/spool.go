@@ -0,0 +1,253 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package cluster
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/cluster/log"
+	"github.com/wind-c/comqtt/v2/cluster/message"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	RelaySpoolFile        = "relay-spool.db"
+	relaySpoolMinBackoff  = time.Second
+	relaySpoolMaxBackoff  = 30 * time.Second
+	relaySpoolOpenTimeout = time.Second
+)
+
+var ErrNodeNotFound = errors.New("node not found")
+
+// relaySendFn sends a relayed message to a node.
+type relaySendFn func(node string, msg *message.Message) error
+
+// relaySpool is a bounded on-disk queue per node of the qos 1 and 2 messages which could
+// not be relayed to it, so that they are not lost while a node or the link to it is down
+// for a short time. The messages of a node are relayed in order once it can be reached.
+type relaySpool struct {
+	sync.Mutex
+	ctx      context.Context
+	db       *bbolt.DB
+	limit    int
+	send     relaySendFn
+	counts   map[string]int  // the number of messages spooled for each node
+	draining map[string]bool // the nodes whose messages are being relayed
+}
+
+// openRelaySpool opens the spool file in dir, keeping up to limit messages for each node.
+func openRelaySpool(ctx context.Context, dir string, limit int, send relaySendFn) (*relaySpool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	db, err := bbolt.Open(filepath.Join(dir, RelaySpoolFile), 0600, &bbolt.Options{Timeout: relaySpoolOpenTimeout})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &relaySpool{
+		ctx:      ctx,
+		db:       db,
+		limit:    limit,
+		send:     send,
+		counts:   make(map[string]int),
+		draining: make(map[string]bool),
+	}
+
+	// messages spooled before a restart are relayed when their node joins again.
+	err = db.View(func(tx *bbolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bbolt.Bucket) error {
+			s.counts[string(name)] = b.Stats().KeyN
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Relay sends a message to a node, spooling it if the node cannot be reached or has
+// messages spooled before it, so that the order of its messages is kept.
+func (s *relaySpool) Relay(node string, msg *message.Message) {
+	if s.Len(node) == 0 {
+		err := s.send(node, msg)
+		if err == nil {
+			return
+		}
+		log.Warn("relay failed, spooling messages", "error", err, "to", node, "cid", msg.ClientID)
+	}
+
+	if err := s.push(node, msg.MsgpackBytes()); err != nil {
+		log.Error("relay spool", "error", err, "to", node, "cid", msg.ClientID)
+		return
+	}
+
+	s.Drain(node)
+}
+
+// Len returns the number of messages spooled for a node.
+func (s *relaySpool) Len(node string) int {
+	s.Lock()
+	defer s.Unlock()
+	return s.counts[node]
+}
+
+// Drain starts relaying the messages spooled for a node, unless they are already being
+// relayed or there are none.
+func (s *relaySpool) Drain(node string) {
+	s.Lock()
+	defer s.Unlock()
+	if s.draining[node] || s.counts[node] == 0 {
+		return
+	}
+
+	s.draining[node] = true
+	go s.drain(node)
+}
+
+// drain relays the messages spooled for a node in order, retrying with a backoff while
+// the node cannot be reached. It stops once the spool is empty or the node has left the
+// cluster, in which case the messages are kept until the node joins again.
+func (s *relaySpool) drain(node string) {
+	defer func() {
+		s.Lock()
+		delete(s.draining, node)
+		s.Unlock()
+	}()
+
+	backoff := relaySpoolMinBackoff
+	for s.ctx.Err() == nil {
+		key, data, err := s.peek(node)
+		if err != nil {
+			log.Error("relay spool read", "error", err, "to", node)
+			return
+		}
+		if key == nil {
+			return
+		}
+
+		msg := new(message.Message)
+		if err := msg.MsgpackLoad(data); err != nil {
+			log.Error("relay spool decode, message dropped", "error", err, "to", node)
+			_ = s.remove(node, key)
+			continue
+		}
+
+		if err := s.send(node, msg); err != nil {
+			if errors.Is(err, ErrNodeNotFound) {
+				return
+			}
+
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, relaySpoolMaxBackoff)
+			continue
+		}
+
+		backoff = relaySpoolMinBackoff
+		if err := s.remove(node, key); err != nil {
+			log.Error("relay spool remove", "error", err, "to", node)
+			return
+		}
+
+		if s.Len(node) == 0 {
+			log.Info("relay spool drained", "to", node)
+		}
+	}
+}
+
+// push appends a message to the spool of a node, dropping the oldest message if the
+// spool is full.
+func (s *relaySpool) push(node string, data []byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(node))
+		if err != nil {
+			return err
+		}
+
+		if s.limit > 0 && s.counts[node] >= s.limit {
+			k, _ := b.Cursor().First()
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+			s.counts[node]--
+			log.Warn("relay spool full, oldest message dropped", "to", node, "limit", s.limit)
+		}
+
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		if err := b.Put(key, data); err != nil {
+			return err
+		}
+		s.counts[node]++
+
+		return nil
+	})
+}
+
+// peek returns the oldest message spooled for a node, or a nil key if there is none.
+func (s *relaySpool) peek(node string) (key, data []byte, err error) {
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(node))
+		if b == nil {
+			return nil
+		}
+
+		k, v := b.Cursor().First()
+		if k != nil {
+			key, data = append([]byte{}, k...), append([]byte{}, v...)
+		}
+
+		return nil
+	})
+
+	return
+}
+
+// remove deletes a relayed message from the spool of a node.
+func (s *relaySpool) remove(node string, key []byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(node))
+		if b == nil || b.Get(key) == nil {
+			return nil // dropped while the spool was full
+		}
+
+		if err := b.Delete(key); err != nil {
+			return err
+		}
+		s.counts[node]--
+
+		return nil
+	})
+}
+
+// Close closes the spool file. Spooled messages are kept for when the node starts again.
+func (s *relaySpool) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,132 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/cluster/log"
+	"github.com/wind-c/comqtt/v2/cluster/message"
+)
+
+// spoolPeer records the messages relayed to it while it is reachable.
+type spoolPeer struct {
+	sync.Mutex
+	down     bool
+	gone     bool
+	received []string
+}
+
+func (p *spoolPeer) send(node string, msg *message.Message) error {
+	p.Lock()
+	defer p.Unlock()
+	if p.gone {
+		return ErrNodeNotFound
+	}
+	if p.down {
+		return errors.New("unavailable")
+	}
+	p.received = append(p.received, msg.ClientID)
+	return nil
+}
+
+func (p *spoolPeer) setDown(down bool) {
+	p.Lock()
+	defer p.Unlock()
+	p.down = down
+}
+
+func (p *spoolPeer) messages() []string {
+	p.Lock()
+	defer p.Unlock()
+	return append([]string{}, p.received...)
+}
+
+func newTestRelaySpool(t *testing.T, dir string, limit int, p *spoolPeer) *relaySpool {
+	log.Init(log.DefaultOptions())
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err := openRelaySpool(ctx, dir, limit, p.send)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		cancel()
+		s.Close()
+	})
+	return s
+}
+
+func TestRelaySpoolDirect(t *testing.T) {
+	p := new(spoolPeer)
+	s := newTestRelaySpool(t, t.TempDir(), 10, p)
+
+	s.Relay("node2", &message.Message{ClientID: "a"})
+	require.Equal(t, []string{"a"}, p.messages())
+	require.Equal(t, 0, s.Len("node2"))
+}
+
+func TestRelaySpoolDrainInOrder(t *testing.T) {
+	p := &spoolPeer{down: true}
+	s := newTestRelaySpool(t, t.TempDir(), 10, p)
+
+	s.Relay("node2", &message.Message{ClientID: "a"})
+	s.Relay("node2", &message.Message{ClientID: "b"})
+	s.Relay("node2", &message.Message{ClientID: "c"})
+	require.Equal(t, 3, s.Len("node2"))
+	require.Empty(t, p.messages())
+
+	p.setDown(false)
+	require.Eventually(t, func() bool {
+		return s.Len("node2") == 0
+	}, 3*relaySpoolMinBackoff, 10*time.Millisecond)
+	require.Equal(t, []string{"a", "b", "c"}, p.messages())
+}
+
+func TestRelaySpoolLimit(t *testing.T) {
+	p := &spoolPeer{gone: true}
+	s := newTestRelaySpool(t, t.TempDir(), 2, p)
+
+	s.Relay("node2", &message.Message{ClientID: "a"})
+	s.Relay("node2", &message.Message{ClientID: "b"})
+	s.Relay("node2", &message.Message{ClientID: "c"})
+	require.Equal(t, 2, s.Len("node2"))
+
+	key, data, err := s.peek("node2")
+	require.NoError(t, err)
+	require.NotNil(t, key)
+	msg := new(message.Message)
+	require.NoError(t, msg.MsgpackLoad(data))
+	require.Equal(t, "b", msg.ClientID)
+}
+
+func TestRelaySpoolReopen(t *testing.T) {
+	dir := t.TempDir()
+	p := &spoolPeer{gone: true}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err := openRelaySpool(ctx, dir, 10, p.send)
+	require.NoError(t, err)
+	s.Relay("node2", &message.Message{ClientID: "a"})
+	s.Relay("node3", &message.Message{ClientID: "b"})
+	require.Eventually(t, func() bool {
+		s.Lock()
+		defer s.Unlock()
+		return len(s.draining) == 0
+	}, time.Second, 10*time.Millisecond)
+	cancel()
+	require.NoError(t, s.Close())
+
+	// the spooled messages are relayed when the node joins again
+	p = new(spoolPeer)
+	s = newTestRelaySpool(t, dir, 10, p)
+	require.Equal(t, 1, s.Len("node2"))
+	require.Equal(t, 1, s.Len("node3"))
+
+	s.Drain("node2")
+	require.Eventually(t, func() bool {
+		return s.Len("node2") == 0
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{"a"}, p.messages())
+	require.Equal(t, 1, s.Len("node3"))
+}
@@ -0,0 +1,206 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package standby
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync/atomic"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+	"github.com/wind-c/comqtt/v2/cluster/log"
+)
+
+const (
+	defaultHeartbeatInterval = 1000 // milliseconds
+	defaultHPrefix           = "comqtt"
+)
+
+var ErrLeaseLost = errors.New("standby lease lost to another node")
+
+// renewScript extends the lease only if it is still held by the given node.
+var renewScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// releaseScript deletes the lease only if it is still held by the given node.
+var releaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// Options contains configuration settings for a hot standby pair.
+type Options struct {
+	Enable            bool     `yaml:"enable" json:"enable"`
+	NodeName          string   `yaml:"node-name" json:"node-name"`                   // unique name of this node, defaults to the hostname
+	HeartbeatInterval int64    `yaml:"heartbeat-interval" json:"heartbeat-interval"` // milliseconds between heartbeats and lease renewals
+	FailoverTimeout   int64    `yaml:"failover-timeout" json:"failover-timeout"`     // milliseconds without heartbeats before the standby takes over
+	ReadinessAddr     string   `yaml:"readiness-addr" json:"readiness-addr"`         // address of the readiness endpoint, disabled when empty
+	PromoteCommand    []string `yaml:"promote-command" json:"promote-command"`       // command run on becoming active, e.g. to claim a virtual ip
+	DemoteCommand     []string `yaml:"demote-command" json:"demote-command"`         // command run on ceasing to be active, e.g. to release a virtual ip
+}
+
+// Pair is one node of an active/passive pair. The active node holds a lease in redis
+// and publishes heartbeats, while the standby waits to take over the lease when the
+// heartbeats stop. Session state is shared through the redis storage hook, so the
+// standby restores it from the store when it is promoted.
+type Pair struct {
+	opts     *Options
+	client   redis.UniversalClient
+	lease    string       // the redis key of the active lease
+	channel  string       // the redis channel heartbeats are published to
+	active   atomic.Bool  // true if this node holds the lease
+	lastBeat atomic.Int64 // unix nanoseconds of the last heartbeat from the other node
+}
+
+// New returns a new instance of Pair using the given redis client and key prefix.
+func New(opts *Options, client redis.UniversalClient, prefix string) *Pair {
+	if opts.NodeName == "" {
+		opts.NodeName, _ = os.Hostname()
+	}
+	if opts.HeartbeatInterval <= 0 {
+		opts.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	if opts.FailoverTimeout <= opts.HeartbeatInterval {
+		opts.FailoverTimeout = opts.HeartbeatInterval * 3
+	}
+	if prefix == "" {
+		prefix = defaultHPrefix
+	}
+
+	return &Pair{
+		opts:    opts,
+		client:  client,
+		lease:   prefix + ":standby:lease",
+		channel: prefix + ":standby:heartbeat",
+	}
+}
+
+// Active returns true if this node is the active node of the pair.
+func (p *Pair) Active() bool {
+	return p.active.Load()
+}
+
+// ServeHTTP is a readiness endpoint which responds ok only while this node is active,
+// so that load balancers route clients to the active node.
+func (p *Pair) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.Active() {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("active"))
+		return
+	}
+
+	w.WriteHeader(http.StatusServiceUnavailable)
+	_, _ = w.Write([]byte("standby"))
+}
+
+// Run waits as the standby until the active node fails, then takes over the lease and calls
+// promote, and keeps renewing the lease while active. It returns nil when the context is
+// done, releasing the lease, or ErrLeaseLost if the lease could not be renewed in time.
+func (p *Pair) Run(ctx context.Context, promote func() error) error {
+	sub := p.client.Subscribe(ctx, p.channel)
+	defer sub.Close()
+	go p.watch(sub.Channel())
+
+	interval := time.Duration(p.opts.HeartbeatInterval) * time.Millisecond
+	timeout := time.Duration(p.opts.FailoverTimeout) * time.Millisecond
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var renewed time.Time
+	for {
+		if p.Active() {
+			ok, err := renewScript.Run(ctx, p.client, []string{p.lease}, p.opts.NodeName, timeout.Milliseconds()).Bool()
+			if err == nil && ok {
+				renewed = time.Now()
+				p.heartbeat(ctx)
+			} else if (err == nil && !ok) || time.Since(renewed) >= timeout {
+				log.Error("standby lease lost", "node", p.opts.NodeName, "error", err)
+				p.demote()
+				return ErrLeaseLost
+			}
+		} else if time.Since(time.Unix(0, p.lastBeat.Load())) >= timeout {
+			ok, err := p.client.SetNX(ctx, p.lease, p.opts.NodeName, timeout).Result()
+			if err != nil && ctx.Err() == nil {
+				log.Warn("standby acquire lease", "node", p.opts.NodeName, "error", err)
+			}
+
+			if ok {
+				renewed = time.Now()
+				p.active.Store(true)
+				log.Info("standby promoted to active", "node", p.opts.NodeName)
+				p.heartbeat(ctx)
+				runCommand(p.opts.PromoteCommand)
+				if err := promote(); err != nil {
+					p.release()
+					p.demote()
+					return err
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if p.Active() {
+				p.release()
+				p.demote()
+			}
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// watch records heartbeats published by the other node of the pair.
+func (p *Pair) watch(ch <-chan *redis.Message) {
+	for msg := range ch {
+		if msg.Payload != p.opts.NodeName {
+			p.lastBeat.Store(time.Now().UnixNano())
+		}
+	}
+}
+
+// heartbeat publishes a heartbeat on behalf of the active node.
+func (p *Pair) heartbeat(ctx context.Context) {
+	if err := p.client.Publish(ctx, p.channel, p.opts.NodeName).Err(); err != nil && ctx.Err() == nil {
+		log.Warn("standby heartbeat", "node", p.opts.NodeName, "error", err)
+	}
+}
+
+// release gives up the lease if it is still held by this node.
+func (p *Pair) release() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(p.opts.HeartbeatInterval)*time.Millisecond)
+	defer cancel()
+	if err := releaseScript.Run(ctx, p.client, []string{p.lease}, p.opts.NodeName).Err(); err != nil {
+		log.Warn("standby release lease", "node", p.opts.NodeName, "error", err)
+	}
+}
+
+// demote marks this node as no longer active.
+func (p *Pair) demote() {
+	p.active.Store(false)
+	runCommand(p.opts.DemoteCommand)
+	log.Info("standby demoted", "node", p.opts.NodeName)
+}
+
+// runCommand runs a promote or demote command, if configured.
+func runCommand(args []string) {
+	if len(args) == 0 {
+		return
+	}
+
+	if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+		log.Error("standby command", "command", args[0], "error", err, "output", string(out))
+	}
+}
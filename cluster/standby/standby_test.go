@@ -0,0 +1,137 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package standby
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	miniredis "github.com/alicebob/miniredis/v2"
+	redis "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+)
+
+func newPair(t *testing.T, addr, name string) *Pair {
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	t.Cleanup(func() { _ = client.Close() })
+	return New(&Options{
+		NodeName:          name,
+		HeartbeatInterval: 10,
+		FailoverTimeout:   50,
+	}, client, "test")
+}
+
+func run(p *Pair, promote func() error) (context.CancelFunc, chan error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Run(ctx, promote)
+	}()
+	return cancel, done
+}
+
+func TestNewDefaults(t *testing.T) {
+	p := New(&Options{NodeName: "a"}, nil, "")
+	require.Equal(t, int64(defaultHeartbeatInterval), p.opts.HeartbeatInterval)
+	require.Equal(t, int64(defaultHeartbeatInterval*3), p.opts.FailoverTimeout)
+	require.Equal(t, defaultHPrefix+":standby:lease", p.lease)
+	require.Equal(t, defaultHPrefix+":standby:heartbeat", p.channel)
+}
+
+func TestFailover(t *testing.T) {
+	m := miniredis.RunT(t)
+	a := newPair(t, m.Addr(), "a")
+	b := newPair(t, m.Addr(), "b")
+
+	promoted := make(chan string, 2)
+	cancelA, doneA := run(a, func() error {
+		promoted <- "a"
+		return nil
+	})
+	require.Equal(t, "a", <-promoted)
+	require.True(t, a.Active())
+
+	cancelB, doneB := run(b, func() error {
+		promoted <- "b"
+		return nil
+	})
+	defer cancelB()
+
+	time.Sleep(100 * time.Millisecond)
+	require.False(t, b.Active())
+	require.Empty(t, promoted)
+
+	cancelA()
+	require.NoError(t, <-doneA)
+	require.False(t, a.Active())
+
+	select {
+	case name := <-promoted:
+		require.Equal(t, "b", name)
+	case <-time.After(time.Second):
+		t.Fatal("standby was not promoted")
+	}
+	require.True(t, b.Active())
+
+	cancelB()
+	require.NoError(t, <-doneB)
+	require.False(t, m.Exists("test:standby:lease"))
+}
+
+func TestLeaseLost(t *testing.T) {
+	m := miniredis.RunT(t)
+	a := newPair(t, m.Addr(), "a")
+
+	promoted := make(chan struct{}, 1)
+	cancel, done := run(a, func() error {
+		promoted <- struct{}{}
+		return nil
+	})
+	defer cancel()
+	<-promoted
+
+	require.NoError(t, m.Set("test:standby:lease", "b"))
+	select {
+	case err := <-done:
+		require.ErrorIs(t, err, ErrLeaseLost)
+	case <-time.After(time.Second):
+		t.Fatal("lease loss was not detected")
+	}
+	require.False(t, a.Active())
+}
+
+func TestPromoteError(t *testing.T) {
+	m := miniredis.RunT(t)
+	a := newPair(t, m.Addr(), "a")
+
+	errPromote := errors.New("promote")
+	cancel, done := run(a, func() error {
+		return errPromote
+	})
+	defer cancel()
+
+	require.ErrorIs(t, <-done, errPromote)
+	require.False(t, a.Active())
+	require.False(t, m.Exists("test:standby:lease"))
+}
+
+func TestServeHTTP(t *testing.T) {
+	p := New(&Options{NodeName: "a"}, nil, "")
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Equal(t, "standby", w.Body.String())
+
+	p.active.Store(true)
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "active", w.Body.String())
+}
@@ -0,0 +1,77 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package redis
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+// RateLimitKey is a unique key to denote rate limit token buckets in the store.
+const RateLimitKey = "ratelimit"
+
+// takeTokenScript refills a token bucket for the time elapsed since it was last updated
+// and takes a token if one is available. Buckets expire once they would be full again,
+// as a full bucket is the same as a new one.
+//
+// KEYS: bucket
+// ARGV: rate per second, burst, now in milliseconds
+// Returns 1 if a token was taken.
+var takeTokenScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(b[1])
+local updated = tonumber(b[2])
+if tokens == nil or updated == nil then
+	tokens = burst
+	updated = now
+end
+if now > updated then
+	tokens = math.min(burst, tokens + (now - updated) * rate / 1000)
+	updated = now
+end
+local taken = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	taken = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', tostring(updated))
+redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) * 1000 / rate) + 1000)
+return taken
+`)
+
+// RateLimiter is an mqtt.RateLimiter which keeps token buckets in redis, so that rate
+// limits are enforced across all nodes of a cluster.
+type RateLimiter struct {
+	db     redis.UniversalClient
+	prefix string
+	log    *slog.Logger
+}
+
+// RateLimiter returns a rate limiter which keeps token buckets in the redis instance of
+// the storage.
+func (s *Storage) RateLimiter() *RateLimiter {
+	return &RateLimiter{
+		db:     s.db,
+		prefix: s.hKey(RateLimitKey) + ":",
+		log:    s.Log,
+	}
+}
+
+// Take takes a token from the bucket of a key.
+func (l *RateLimiter) Take(key string, rate, burst int64, now time.Time) (bool, error) {
+	taken, err := takeTokenScript.Run(context.Background(), l.db, []string{l.prefix + key}, rate, burst, now.UnixMilli()).Int()
+	if err != nil {
+		l.log.Error("failed to take rate limit token", "error", err, "key", key)
+		return false, err
+	}
+
+	return taken == 1, nil
+}
@@ -0,0 +1,77 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package redis
+
+import (
+	"testing"
+	"time"
+
+	miniredis "github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+)
+
+func TestRateLimiterTake(t *testing.T) {
+	m := miniredis.RunT(t)
+	defer m.Close()
+	s := newHook(t, m.Addr())
+	defer teardown(t, s)
+
+	var l mqtt.RateLimiter = s.RateLimiter()
+	now := time.Unix(100, 0)
+	for i := 0; i < 3; i++ {
+		ok, err := l.Take("user:a", 2, 3, now)
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+
+	ok, err := l.Take("user:a", 2, 3, now)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// other keys have their own buckets
+	ok, err = l.Take("user:b", 2, 3, now)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// refilled at the rate
+	ok, err = l.Take("user:a", 2, 3, now.Add(500*time.Millisecond))
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = l.Take("user:a", 2, 3, now.Add(500*time.Millisecond))
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	require.True(t, m.Exists(defaultHPrefix+":"+RateLimitKey+":user:a"))
+	require.Greater(t, m.TTL(defaultHPrefix+":"+RateLimitKey+":user:a"), time.Duration(0))
+}
+
+func TestRateLimiterShared(t *testing.T) {
+	m := miniredis.RunT(t)
+	defer m.Close()
+	s1 := newHook(t, m.Addr())
+	defer teardown(t, s1)
+	s2 := newHook(t, m.Addr())
+	defer s2.Stop()
+
+	// a client connecting to another node takes from the same bucket
+	now := time.Unix(100, 0)
+	ok, err := s1.RateLimiter().Take("user:a", 1, 1, now)
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = s2.RateLimiter().Take("user:a", 1, 1, now)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestRateLimiterError(t *testing.T) {
+	m := miniredis.RunT(t)
+	s := newHook(t, m.Addr())
+	defer s.Stop()
+	m.Close()
+
+	_, err := s.RateLimiter().Take("user:a", 1, 1, time.Now())
+	require.Error(t, err)
+}
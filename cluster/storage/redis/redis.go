@@ -7,8 +7,10 @@ package redis
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"sync/atomic"
 
 	redis "github.com/redis/go-redis/v9"
 	"github.com/wind-c/comqtt/v2/cluster/utils"
@@ -46,23 +48,117 @@ func inflightKey(cl *mqtt.Client, pk packets.Packet) string {
 	return pk.FormatID()
 }
 
+// willKey returns a primary key for a will message.
+func willKey(cl *mqtt.Client) string {
+	return cl.ID
+}
+
 // sysInfoKey returns a primary key for system info.
 func sysInfoKey() string {
 	return localIP
 }
 
+// WillKey is a unique key to denote will messages in the store.
+const WillKey = "will"
+
+// claimWillScript deletes a will message only if it still belongs to the given node,
+// so that a will which has since been re-registered by a reconnected client is kept.
+var claimWillScript = redis.NewScript(`
+local v = redis.call('HGET', KEYS[1], ARGV[1])
+if v and cjson.decode(v).node == ARGV[2] then
+	return redis.call('HDEL', KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+// establishSessionScript writes the session record and will message of a client in one
+// step, so a session taken over from another node is never left with the previous
+// owner's will. On a clean start the subscriptions and inflight messages of the
+// previous session are discarded with it.
+//
+// KEYS: clients, wills, client subscriptions, client inflights
+// ARGV: client id, client record, will record or empty, 1 if clean start
+var establishSessionScript = redis.NewScript(`
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+if ARGV[3] ~= '' then
+	redis.call('HSET', KEYS[2], ARGV[1], ARGV[3])
+else
+	redis.call('HDEL', KEYS[2], ARGV[1])
+end
+if ARGV[4] == '1' then
+	redis.call('DEL', KEYS[3], KEYS[4])
+end
+return 1
+`)
+
+// expireSessionScript deletes the session record, subscriptions and inflight messages of
+// a client in one step, so a broker crashing mid-expiry cannot leave orphaned entries.
+// The will message is deleted if requested and still owned by the given node.
+//
+// KEYS: clients, wills, client subscriptions, client inflights
+// ARGV: client id, node, 1 to delete the will message
+var expireSessionScript = redis.NewScript(`
+if ARGV[3] == '1' then
+	local v = redis.call('HGET', KEYS[2], ARGV[1])
+	if v and cjson.decode(v).node == ARGV[2] then
+		redis.call('HDEL', KEYS[2], ARGV[1])
+	end
+end
+redis.call('HDEL', KEYS[1], ARGV[1])
+redis.call('DEL', KEYS[3], KEYS[4])
+return 1
+`)
+
+// inflightScript writes an inflight message unless a later stage of the same qos flow
+// is already stored, so a delayed write cannot roll a flow back, e.g. from pubrel to publish.
+//
+// KEYS: client inflights
+// ARGV: packet key, message record, packet type of the message
+var inflightScript = redis.NewScript(`
+local v = redis.call('HGET', KEYS[1], ARGV[1])
+if v and cjson.decode(v).fixedheader.type > tonumber(ARGV[3]) then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+return 1
+`)
+
 // Options contains configuration settings for the bolt instance.
 type Options struct {
-	HPrefix string `json:"prefix" yaml:"prefix"`
-	Options *redis.Options
+	HPrefix  string `json:"prefix" yaml:"prefix"`
+	NodeName string `json:"node-name" yaml:"node-name"` // the cluster node which owns the client connections
+	Options  *redis.Options
+	// Universal is a redis cluster or sentinel failover group, used instead of Options if set.
+	Universal *redis.UniversalOptions
+}
+
+// Will is a storable representation of a client will message, including the node
+// the client is connected to so that other nodes can issue it if the node fails.
+type Will struct {
+	storage.ClientWill
+	Client string `json:"client"` // the id of the client which registered the will
+	Node   string `json:"node"`   // the name of the node the client is connected to
+}
+
+// MarshalBinary encodes the values into a json string.
+func (d Will) MarshalBinary() (data []byte, err error) {
+	return json.Marshal(d)
+}
+
+// UnmarshalBinary decodes a json string into a struct.
+func (d *Will) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, d)
 }
 
 // Storage is a persistent storage hook based using Redis as a backend.
 type Storage struct {
 	mqtt.HookBase
-	config *Options        // options for connecting to the Redis instance.
-	db     *redis.Client   // the Redis instance
-	ctx    context.Context // a context for the connection
+	config *Options              // options for connecting to the Redis instance.
+	db     redis.UniversalClient // the Redis instance, cluster or failover group
+	ctx    context.Context       // a context for the connection
 }
 
 // ID returns the id of the hook.
@@ -119,15 +215,36 @@ func (s *Storage) Init(config any) error {
 	if s.config.HPrefix == "" {
 		s.config.HPrefix = defaultHPrefix
 	}
-	s.config.HPrefix += ":"
 
-	s.Log.Info("connecting to redis service",
-		"address", s.config.Options.Addr,
-		"username", s.config.Options.Username,
-		"password-len", len(s.config.Options.Password),
-		"db", s.config.Options.DB)
+	if s.config.NodeName == "" {
+		s.config.NodeName = localIP
+	}
+
+	if s.config.Universal != nil {
+		s.Log.Info("connecting to redis service",
+			"addresses", s.config.Universal.Addrs,
+			"master", s.config.Universal.MasterName,
+			"username", s.config.Universal.Username,
+			"password-len", len(s.config.Universal.Password),
+			"db", s.config.Universal.DB)
+		s.db = redis.NewUniversalClient(s.config.Universal)
+	} else {
+		s.Log.Info("connecting to redis service",
+			"address", s.config.Options.Addr,
+			"username", s.config.Options.Username,
+			"password-len", len(s.config.Options.Password),
+			"db", s.config.Options.DB)
+		s.db = redis.NewClient(s.config.Options)
+	}
+
+	// the session scripts write the client, will, subscription and inflight hashes at once,
+	// which a redis cluster only allows if they are in the same slot, so the prefix becomes
+	// the hash tag of every key.
+	if _, ok := s.db.(*redis.ClusterClient); ok {
+		s.config.HPrefix = "{" + s.config.HPrefix + "}"
+	}
+	s.config.HPrefix += ":"
 
-	s.db = redis.NewClient(s.config.Options)
 	_, err := s.db.Ping(context.Background()).Result()
 	if err != nil {
 		return fmt.Errorf("failed to ping service: %w", err)
@@ -144,15 +261,88 @@ func (s *Storage) Stop() error {
 	return s.db.Close()
 }
 
-// OnSessionEstablished adds a client to the store when their session is established.
+// OnSessionEstablished adds a client and its will message to the store when their
+// session is established.
 func (s *Storage) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
-	s.updateClient(cl)
+	if s.db == nil {
+		s.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	var will any = ""
+	if atomic.LoadUint32(&cl.Properties.Will.Flag) == 1 {
+		will = s.will(cl)
+	}
+
+	clean := "0"
+	if cl.Properties.Clean {
+		clean = "1"
+	}
+
+	keys := []string{
+		s.hKey(storage.ClientKey),
+		s.hKey(WillKey),
+		s.hKey(utils.JoinStrings(storage.SubscriptionKey, cl.ID)),
+		s.hKey(utils.JoinStrings(storage.InflightKey, cl.ID)),
+	}
+
+	err := establishSessionScript.Run(s.ctx, s.db, keys, clientKey(cl), s.client(cl), will, clean).Err()
+	if err != nil {
+		s.Log.Error("failed to establish session", "error", err, "id", clientKey(cl))
+	}
 }
 
 // OnWillSent is called when a client sends a will message and the will message is removed
 // from the client record.
 func (s *Storage) OnWillSent(cl *mqtt.Client, pk packets.Packet) {
-	s.updateClient(cl)
+	// wills issued on behalf of a client of a failed node are sent by a transient
+	// inline client, which must not overwrite the stored client record.
+	if !cl.Net.Inline {
+		s.updateClient(cl)
+	}
+	s.deleteWill(cl)
+}
+
+// updateWill writes the will message of a client to the store, or removes it if the
+// client has no will message.
+func (s *Storage) updateWill(cl *mqtt.Client) {
+	if s.db == nil {
+		s.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	if atomic.LoadUint32(&cl.Properties.Will.Flag) == 0 {
+		s.deleteWill(cl)
+		return
+	}
+
+	in := s.will(cl)
+	err := s.db.HSet(s.ctx, s.hKey(WillKey), willKey(cl), in).Err()
+	if err != nil {
+		s.Log.Error("failed to hset will data", "error", err, "data", in)
+	}
+}
+
+// will returns the storable will message of a client.
+func (s *Storage) will(cl *mqtt.Client) *Will {
+	return &Will{
+		ClientWill: storage.ClientWill(cl.Properties.Will),
+		Client:     cl.ID,
+		Node:       s.config.NodeName,
+	}
+}
+
+// deleteWill removes the will message of a client from the store.
+func (s *Storage) deleteWill(cl *mqtt.Client) {
+	if s.db == nil {
+		s.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	err := s.db.HDel(s.ctx, s.hKey(WillKey), willKey(cl)).Err()
+	if err != nil {
+		s.Log.Error("failed to delete will data", "error", err, "id", willKey(cl))
+	}
 }
 
 // updateClient writes the client data to the store.
@@ -162,8 +352,17 @@ func (s *Storage) updateClient(cl *mqtt.Client) {
 		return
 	}
 
+	in := s.client(cl)
+	err := s.db.HSet(s.ctx, s.hKey(storage.ClientKey), clientKey(cl), in).Err()
+	if err != nil {
+		s.Log.Error("failed to hset client data", "error", storage.ErrDBFileNotOpen, "data", in)
+	}
+}
+
+// client returns the storable session record of a client.
+func (s *Storage) client(cl *mqtt.Client) *storage.Client {
 	props := cl.Properties.Props.Copy(false)
-	in := &storage.Client{
+	return &storage.Client{
 		ID:              cl.ID,
 		Remote:          cl.Net.Remote,
 		Listener:        cl.Net.Listener,
@@ -183,11 +382,6 @@ func (s *Storage) updateClient(cl *mqtt.Client) {
 		},
 		Will: storage.ClientWill(cl.Properties.Will),
 	}
-
-	err := s.db.HSet(s.ctx, s.hKey(storage.ClientKey), clientKey(cl), in).Err()
-	if err != nil {
-		s.Log.Error("failed to hset client data", "error", storage.ErrDBFileNotOpen, "data", in)
-	}
 }
 
 // OnDisconnect removes a client from the store if they were using a clean session.
@@ -197,11 +391,39 @@ func (s *Storage) OnDisconnect(cl *mqtt.Client, _ error, expire bool) {
 		return
 	}
 
+	// a client which disconnected normally has had its will message discarded.
+	if atomic.LoadUint32(&cl.Properties.Will.Flag) == 0 {
+		s.deleteWill(cl)
+	}
+
 	if !expire {
 		return
 	}
 
-	err := s.db.HDel(s.ctx, s.hKey(storage.ClientKey), clientKey(cl)).Err()
+	// the session now belongs to the client connection which took it over.
+	if cl.StopCause() == packets.ErrSessionTakenOver {
+		return
+	}
+
+	s.expireSession(cl, false)
+}
+
+// expireSession removes the session record, subscriptions and inflight messages of a
+// client from the store, and its will message if deleteWill is true.
+func (s *Storage) expireSession(cl *mqtt.Client, deleteWill bool) {
+	keys := []string{
+		s.hKey(storage.ClientKey),
+		s.hKey(WillKey),
+		s.hKey(utils.JoinStrings(storage.SubscriptionKey, cl.ID)),
+		s.hKey(utils.JoinStrings(storage.InflightKey, cl.ID)),
+	}
+
+	del := "0"
+	if deleteWill {
+		del = "1"
+	}
+
+	err := expireSessionScript.Run(s.ctx, s.db, keys, clientKey(cl), s.config.NodeName, del).Err()
 	if err != nil {
 		s.Log.Error("failed to delete client", "error", err, "id", clientKey(cl))
 	}
@@ -214,23 +436,28 @@ func (s *Storage) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes [
 		return
 	}
 
-	var in *storage.Subscription
+	// all filters of the packet are written with a single hset, which redis applies atomically.
+	values := make([]any, 0, len(pk.Filters)*2)
 	for i := 0; i < len(pk.Filters); i++ {
 		if reasonCodes[i] == 0x80 {
 			continue
 		}
-		in = &storage.Subscription{
+		values = append(values, pk.Filters[i].Filter, &storage.Subscription{
 			Qos:               reasonCodes[i],
 			Identifier:        pk.Filters[i].Identifier,
 			RetainHandling:    pk.Filters[i].RetainHandling,
 			RetainAsPublished: pk.Filters[i].RetainAsPublished,
 			NoLocal:           pk.Filters[i].NoLocal,
-		}
+		})
+	}
 
-		err := s.db.HSet(s.ctx, s.hKey(utils.JoinStrings(storage.SubscriptionKey, cl.ID)), pk.Filters[i].Filter, in).Err()
-		if err != nil {
-			s.Log.Error("failed to hset subscription data", "error", err, "data", in)
-		}
+	if len(values) == 0 {
+		return
+	}
+
+	err := s.db.HSet(s.ctx, s.hKey(utils.JoinStrings(storage.SubscriptionKey, cl.ID)), values...).Err()
+	if err != nil {
+		s.Log.Error("failed to hset subscription data", "error", err, "id", clientKey(cl))
 	}
 }
 
@@ -241,11 +468,18 @@ func (s *Storage) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes
 		return
 	}
 
+	if len(pk.Filters) == 0 {
+		return
+	}
+
+	filters := make([]string, len(pk.Filters))
 	for i := 0; i < len(pk.Filters); i++ {
-		err := s.db.HDel(s.ctx, s.hKey(utils.JoinStrings(storage.SubscriptionKey, cl.ID)), pk.Filters[i].Filter).Err()
-		if err != nil {
-			s.Log.Error("failed to delete subscription data", "error", err, "id", clientKey(cl))
-		}
+		filters[i] = pk.Filters[i].Filter
+	}
+
+	err := s.db.HDel(s.ctx, s.hKey(utils.JoinStrings(storage.SubscriptionKey, cl.ID)), filters...).Err()
+	if err != nil {
+		s.Log.Error("failed to delete subscription data", "error", err, "id", clientKey(cl))
 	}
 }
 
@@ -299,6 +533,7 @@ func (s *Storage) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, r
 	props := pk.Properties.Copy(false)
 	in := &storage.Message{
 		Origin:      pk.Origin,
+		Client:      cl.ID,
 		FixedHeader: pk.FixedHeader,
 		TopicName:   pk.TopicName,
 		Payload:     pk.Payload,
@@ -317,7 +552,8 @@ func (s *Storage) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, r
 		},
 	}
 
-	err := s.db.HSet(s.ctx, s.hKey(utils.JoinStrings(storage.InflightKey, cl.ID)), inflightKey(cl, pk), in).Err()
+	keys := []string{s.hKey(utils.JoinStrings(storage.InflightKey, cl.ID))}
+	err := inflightScript.Run(s.ctx, s.db, keys, inflightKey(cl, pk), in, int(pk.FixedHeader.Type)).Err()
 	if err != nil {
 		s.Log.Error("failed to hset qos inflight message data", "error", err, "data", in)
 	}
@@ -382,10 +618,7 @@ func (s *Storage) OnClientExpired(cl *mqtt.Client) {
 		return
 	}
 
-	err := s.db.HDel(s.ctx, s.hKey(storage.ClientKey), clientKey(cl)).Err()
-	if err != nil {
-		s.Log.Error("failed to delete expired client", "error", err, "id", clientKey(cl))
-	}
+	s.expireSession(cl, true)
 }
 
 // StoredSysInfo returns the system info from the store.
@@ -479,6 +712,84 @@ func (s *Storage) StoredRetainedMessageByTopic(topic string) (v storage.Message,
 	return v, nil
 }
 
+// StoredRetainedMessages returns all stored retained messages from the store, so that
+// a node joining the cluster can serve the retained messages published on other nodes.
+func (s *Storage) StoredRetainedMessages() (v []storage.Message, err error) {
+	if s.db == nil {
+		s.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	rows, err := s.db.HGetAll(s.ctx, s.hKey(storage.RetainedKey)).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		s.Log.Error("failed to HGetAll retained message data", "error", err)
+		return
+	}
+
+	for topic, row := range rows {
+		var d storage.Message
+		if err = d.UnmarshalBinary([]byte(row)); err != nil {
+			s.Log.Error("failed to unmarshal retained message data", "error", err, "data", row)
+		}
+
+		if d.TopicName == "" {
+			d.TopicName = topic
+		}
+
+		v = append(v, d)
+	}
+
+	return v, nil
+}
+
+// StoredWillsByNode returns the stored will messages of all clients connected to a node,
+// keyed by client id.
+func (s *Storage) StoredWillsByNode(node string) (v map[string]storage.ClientWill, err error) {
+	if s.db == nil {
+		s.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	rows, err := s.db.HGetAll(s.ctx, s.hKey(WillKey)).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		s.Log.Error("failed to HGetAll will data", "error", err)
+		return
+	}
+
+	v = make(map[string]storage.ClientWill)
+	for cid, row := range rows {
+		var d Will
+		if err = d.UnmarshalBinary([]byte(row)); err != nil {
+			s.Log.Error("failed to unmarshal will data", "error", err, "data", row)
+			continue
+		}
+
+		if d.Node == node {
+			v[cid] = d.ClientWill
+		}
+	}
+
+	return v, nil
+}
+
+// ClaimWill removes the will message of a client from the store if it is still owned by
+// the given node. It returns true only for the single caller which removed the will, and
+// which is therefore responsible for issuing it.
+func (s *Storage) ClaimWill(cid, node string) bool {
+	if s.db == nil {
+		s.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return false
+	}
+
+	n, err := claimWillScript.Run(s.ctx, s.db, []string{s.hKey(WillKey)}, cid, node).Int()
+	if err != nil {
+		s.Log.Error("failed to claim will", "error", err, "id", cid, "node", node)
+		return false
+	}
+
+	return n == 1
+}
+
 // StoredInflightMessagesByCid returns all stored inflight messages of client from the store.
 func (s *Storage) StoredInflightMessagesByCid(cid string) (v []storage.Message, err error) {
 	if s.db == nil {
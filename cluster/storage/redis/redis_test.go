@@ -135,6 +135,36 @@ func TestInitUseDefaults(t *testing.T) {
 	require.Equal(t, defaultAddr, s.config.Options.Addr)
 }
 
+func TestInitCluster(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+
+	h := new(Storage)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Universal: &redis.UniversalOptions{Addrs: []string{s.Addr()}, IsClusterMode: true},
+	})
+	require.NoError(t, err)
+	defer h.Stop()
+
+	// the client, will, subscription and inflight hashes of a session share one slot
+	require.IsType(t, new(redis.ClusterClient), h.db)
+	require.Equal(t, "{"+defaultHPrefix+"}:", h.config.HPrefix)
+	require.Equal(t, "{comqtt}:sub:cl1", h.hKey(utils.JoinStrings(storage.SubscriptionKey, "cl1")))
+
+	cl := &mqtt.Client{ID: "cl1", Properties: mqtt.ClientProperties{Clean: true}}
+	h.OnSessionEstablished(cl, packets.Packet{})
+	h.OnSubscribed(cl, pkf, []byte{0}, nil)
+	subs, err := h.StoredSubscriptionsByCid(cl.ID)
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+
+	h.OnClientExpired(cl)
+	subs, err = h.StoredSubscriptionsByCid(cl.ID)
+	require.NoError(t, err)
+	require.Empty(t, subs)
+}
+
 func TestInitBadConfig(t *testing.T) {
 	s := new(Storage)
 	s.SetOpts(logger, nil)
@@ -745,3 +775,206 @@ func TestStoredSysInfoClosedDB(t *testing.T) {
 	require.Empty(t, v)
 	require.Error(t, err)
 }
+
+func TestStoredRetainedMessages(t *testing.T) {
+	m := miniredis.RunT(t)
+	defer m.Close()
+	s := newHook(t, m.Addr())
+	defer teardown(t, s)
+
+	s.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("hello")}, 1)
+	s.OnRetainMessage(client, packets.Packet{TopicName: "d/e/f", Payload: []byte("world")}, 1)
+
+	r, err := s.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 2)
+	sort.Slice(r, func(i, j int) bool { return r[i].TopicName < r[j].TopicName })
+	require.Equal(t, "a/b/c", r[0].TopicName)
+	require.Equal(t, []byte("hello"), r[0].Payload)
+	require.Equal(t, "d/e/f", r[1].TopicName)
+}
+
+func TestStoredRetainedMessagesNoDB(t *testing.T) {
+	s := new(Storage)
+	s.SetOpts(logger, nil)
+	v, err := s.StoredRetainedMessages()
+	require.Empty(t, v)
+	require.NoError(t, err)
+}
+
+func TestOnSessionEstablishedWill(t *testing.T) {
+	m := miniredis.RunT(t)
+	defer m.Close()
+	s := newHook(t, m.Addr())
+	defer teardown(t, s)
+
+	cl := &mqtt.Client{ID: "will-client"}
+	cl.Properties.Will = mqtt.Will{Flag: 1, TopicName: "a/b/c", Payload: []byte("bye")}
+	s.OnSessionEstablished(cl, packets.Packet{})
+
+	wills, err := s.StoredWillsByNode(s.config.NodeName)
+	require.NoError(t, err)
+	require.Len(t, wills, 1)
+	require.Equal(t, "a/b/c", wills[cl.ID].TopicName)
+	require.Equal(t, []byte("bye"), wills[cl.ID].Payload)
+
+	wills, err = s.StoredWillsByNode("other")
+	require.NoError(t, err)
+	require.Empty(t, wills)
+
+	s.OnWillSent(cl, packets.Packet{})
+	wills, err = s.StoredWillsByNode(s.config.NodeName)
+	require.NoError(t, err)
+	require.Empty(t, wills)
+}
+
+func TestOnDisconnectClearsWill(t *testing.T) {
+	m := miniredis.RunT(t)
+	defer m.Close()
+	s := newHook(t, m.Addr())
+	defer teardown(t, s)
+
+	cl := &mqtt.Client{ID: "will-client"}
+	cl.Properties.Will = mqtt.Will{Flag: 1, TopicName: "a/b/c"}
+	s.OnSessionEstablished(cl, packets.Packet{})
+
+	cl.Properties.Will = mqtt.Will{}
+	s.OnDisconnect(cl, nil, false)
+
+	_, err := s.db.HGet(s.ctx, s.hKey(WillKey), willKey(cl)).Result()
+	require.ErrorIs(t, err, redis.Nil)
+}
+
+func TestClaimWill(t *testing.T) {
+	m := miniredis.RunT(t)
+	defer m.Close()
+	s := newHook(t, m.Addr())
+	defer teardown(t, s)
+
+	err := s.db.HSet(s.ctx, s.hKey(WillKey), "cl1", &Will{Client: "cl1", Node: "n1"}).Err()
+	require.NoError(t, err)
+
+	require.False(t, s.ClaimWill("cl1", "n2"))
+	require.True(t, s.ClaimWill("cl1", "n1"))
+	require.False(t, s.ClaimWill("cl1", "n1"))
+}
+
+func TestClaimWillNoDB(t *testing.T) {
+	s := new(Storage)
+	s.SetOpts(logger, nil)
+	require.False(t, s.ClaimWill("cl1", "n1"))
+}
+
+func TestOnSessionEstablishedCleanStart(t *testing.T) {
+	m := miniredis.RunT(t)
+	defer m.Close()
+	s := newHook(t, m.Addr())
+	defer teardown(t, s)
+
+	cl := &mqtt.Client{ID: "cl1"}
+	s.OnSubscribed(cl, pkf, []byte{0}, []int{1})
+	s.OnQosPublish(cl, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}, PacketID: 1}, time.Now().Unix(), 0)
+
+	s.OnSessionEstablished(cl, packets.Packet{})
+	subs, err := s.StoredSubscriptionsByCid(cl.ID)
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+
+	cl.Properties.Clean = true
+	s.OnSessionEstablished(cl, packets.Packet{})
+	subs, err = s.StoredSubscriptionsByCid(cl.ID)
+	require.NoError(t, err)
+	require.Empty(t, subs)
+	msgs, err := s.StoredInflightMessagesByCid(cl.ID)
+	require.NoError(t, err)
+	require.Empty(t, msgs)
+
+	r, err := s.StoredClientByCid(cl.ID)
+	require.NoError(t, err)
+	require.Equal(t, cl.ID, r.ID)
+}
+
+func TestOnClientExpiredRemovesSession(t *testing.T) {
+	m := miniredis.RunT(t)
+	defer m.Close()
+	s := newHook(t, m.Addr())
+	defer teardown(t, s)
+
+	cl := &mqtt.Client{ID: "cl1"}
+	s.OnSessionEstablished(cl, packets.Packet{})
+	s.OnSubscribed(cl, pkf, []byte{0}, []int{1})
+	s.OnQosPublish(cl, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}, PacketID: 1}, time.Now().Unix(), 0)
+
+	// the will now belongs to a session on another node.
+	err := s.db.HSet(s.ctx, s.hKey(WillKey), willKey(cl), &Will{Client: cl.ID, Node: "other"}).Err()
+	require.NoError(t, err)
+
+	s.OnClientExpired(cl)
+
+	_, err = s.db.HGet(s.ctx, s.hKey(storage.ClientKey), clientKey(cl)).Result()
+	require.ErrorIs(t, err, redis.Nil)
+	require.False(t, m.Exists(s.hKey(utils.JoinStrings(storage.SubscriptionKey, cl.ID))))
+	require.False(t, m.Exists(s.hKey(utils.JoinStrings(storage.InflightKey, cl.ID))))
+
+	wills, err := s.StoredWillsByNode("other")
+	require.NoError(t, err)
+	require.Len(t, wills, 1)
+}
+
+func TestOnDisconnectSessionTakenOver(t *testing.T) {
+	m := miniredis.RunT(t)
+	defer m.Close()
+	s := newHook(t, m.Addr())
+	defer teardown(t, s)
+
+	cl := &mqtt.Client{ID: "cl1"}
+	s.OnSessionEstablished(cl, packets.Packet{})
+	s.OnSubscribed(cl, pkf, []byte{0}, []int{1})
+
+	cl.Stop(packets.ErrSessionTakenOver)
+	s.OnDisconnect(cl, packets.ErrSessionTakenOver, true)
+
+	r, err := s.StoredClientByCid(cl.ID)
+	require.NoError(t, err)
+	require.Equal(t, cl.ID, r.ID)
+	subs, err := s.StoredSubscriptionsByCid(cl.ID)
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+}
+
+func TestOnSubscribedMultipleFilters(t *testing.T) {
+	m := miniredis.RunT(t)
+	defer m.Close()
+	s := newHook(t, m.Addr())
+	defer teardown(t, s)
+
+	pk := packets.Packet{Filters: packets.Subscriptions{{Filter: "a/b"}, {Filter: "c/d"}, {Filter: "e/f"}}}
+	s.OnSubscribed(client, pk, []byte{0, 0x80, 1}, []int{1, 1, 1})
+
+	subs, err := s.StoredSubscriptionsByCid(client.ID)
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+
+	s.OnUnsubscribed(client, pk, []byte{0, 0, 0}, []int{0, 0, 0})
+	subs, err = s.StoredSubscriptionsByCid(client.ID)
+	require.NoError(t, err)
+	require.Empty(t, subs)
+}
+
+func TestOnQosPublishNoStageRegression(t *testing.T) {
+	m := miniredis.RunT(t)
+	defer m.Close()
+	s := newHook(t, m.Addr())
+	defer teardown(t, s)
+
+	pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pubrel, Qos: 1}, PacketID: 7}
+	s.OnQosPublish(client, pk, time.Now().Unix(), 0)
+
+	pk.FixedHeader = packets.FixedHeader{Type: packets.Publish, Qos: 2}
+	s.OnQosPublish(client, pk, time.Now().Unix(), 0)
+
+	msgs, err := s.StoredInflightMessagesByCid(client.ID)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	require.Equal(t, packets.Pubrel, msgs[0].FixedHeader.Type)
+}
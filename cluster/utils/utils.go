@@ -104,7 +104,7 @@ func GetOutBoundIP() (ip string, err error) {
 	}
 	localAddr := conn.LocalAddr().(*net.UDPAddr)
 	//fmt.Println(localAddr.String())
-	ip = strings.Split(localAddr.String(), ":")[0]
+	ip = localAddr.IP.String()
 	return
 }
 
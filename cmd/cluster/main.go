@@ -8,8 +8,6 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	csRt "github.com/wind-c/comqtt/v2/cluster/rest"
-	"maps"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
@@ -19,25 +17,11 @@ import (
 	"strings"
 	"syscall"
 
-	"github.com/redis/go-redis/v9"
-	cs "github.com/wind-c/comqtt/v2/cluster"
+	"github.com/wind-c/comqtt/v2"
 	"github.com/wind-c/comqtt/v2/cluster/log"
-	coredis "github.com/wind-c/comqtt/v2/cluster/storage/redis"
 	"github.com/wind-c/comqtt/v2/config"
-	mqtt "github.com/wind-c/comqtt/v2/mqtt"
-	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
-	"github.com/wind-c/comqtt/v2/mqtt/listeners"
-	mqttRt "github.com/wind-c/comqtt/v2/mqtt/rest"
-	"github.com/wind-c/comqtt/v2/plugin"
-	hauth "github.com/wind-c/comqtt/v2/plugin/auth/http"
-	mauth "github.com/wind-c/comqtt/v2/plugin/auth/mysql"
-	pauth "github.com/wind-c/comqtt/v2/plugin/auth/postgresql"
-	rauth "github.com/wind-c/comqtt/v2/plugin/auth/redis"
-	cokafka "github.com/wind-c/comqtt/v2/plugin/bridge/kafka"
 )
 
-var agent *cs.Agent
-
 func pprof() {
 	go func() {
 		log.Info("listen pprof", "error", http.ListenAndServe(":6060", nil))
@@ -58,12 +42,14 @@ func realMain(ctx context.Context) error {
 	cfg := config.New()
 
 	flag.StringVar(&confFile, "conf", "", "read the program parameters from the config file")
-	flag.UintVar(&cfg.StorageWay, "storage-way", 3, "storage way options:0 memory, 1 bolt, 2 badger, 3 redis")
+	flag.UintVar(&cfg.StorageWay, "storage-way", 3, "storage way options:0 memory, 1 bolt, 2 badger, 3 redis, 4 postgres, 5 sqlite, 6 memory with snapshots, 7 cassandra, 8 dynamodb")
 	flag.UintVar(&cfg.Auth.Way, "auth-way", 0, "authentication way options:0 anonymous, 1 username and password, 2 clientid")
-	flag.UintVar(&cfg.Auth.Datasource, "auth-ds", 0, "authentication datasource options:0 free, 1 redis, 2 mysql, 3 postgresql, 4 http")
+	flag.UintVar(&cfg.Auth.Datasource, "auth-ds", 0, "authentication datasource options:0 free, 1 redis, 2 mysql, 3 postgresql, 4 http, 5 x509 client certificates, 6 jwt, 7 oauth2 introspection, 8 vault, 9 grpc, 10 sqlite")
 	flag.StringVar(&cfg.Auth.ConfPath, "auth-path", "", "config file path should correspond to the auth-datasource")
 	flag.StringVar(&cfg.Mqtt.TCP, "tcp", ":1883", "network address for mqtt tcp listener")
 	flag.StringVar(&cfg.Mqtt.WS, "ws", ":1882", "network address for mqtt websocket listener")
+	flag.StringVar(&cfg.Mqtt.QUIC, "quic", "", "network address for mqtt quic listener, requires tls")
+	flag.BoolVar(&cfg.Mqtt.ProxyProtocol, "proxy-protocol", false, "tcp connections begin with a PROXY protocol v1 or v2 header from a load balancer")
 	flag.StringVar(&cfg.Mqtt.HTTP, "http", ":8080", "network address for web info dashboard listener")
 	flag.StringVar(&cfg.Cluster.NodeName, "node-name", "", "node name must be unique in the cluster")
 	flag.StringVar(&cfg.Cluster.BindAddr, "bind-ip", "127.0.0.1", "the ip used for discovery and communication between nodes. It is usually set to the intranet ip addr.")
@@ -74,6 +60,7 @@ func realMain(ctx context.Context) error {
 	flag.StringVar(&members, "members", "", "seeds member list of cluster,such as 192.168.0.103:7946,192.168.0.104:7946")
 	flag.BoolVar(&cfg.Cluster.GrpcEnable, "grpc-enable", false, "grpc is used for raft transport and reliable communication between nodes")
 	flag.IntVar(&cfg.Cluster.GrpcPort, "grpc-port", 17946, "grpc communication port between nodes")
+	flag.BoolVar(&cfg.Cluster.SnapshotBootstrap, "snapshot-bootstrap", false, "fetch the routing and retained message state from the leader over grpc when joining, instead of waiting for the raft log to replay")
 	flag.StringVar(&cfg.Redis.Options.Addr, "redis", "127.0.0.1:6379", "redis address for cluster mode")
 	flag.StringVar(&cfg.Redis.Options.Password, "redis-pass", "", "redis password for cluster mode")
 	flag.IntVar(&cfg.Redis.Options.DB, "redis-db", 0, "redis db for cluster mode")
@@ -106,141 +93,17 @@ func realMain(ctx context.Context) error {
 		fmt.Println("log output to the files, please check")
 	}
 
-	// create server instance and init hooks
-	cfg.Mqtt.Options.Logger = log.Default()
-	server := mqtt.New(&cfg.Mqtt.Options)
+	// create the broker, its hooks and its cluster node
 	log.Info("comqtt server initializing...")
-	initStorage(server, cfg)
-	initAuth(server, cfg)
-	initBridge(server, cfg)
-
-	// init node and bind mqtt server
-	if cfg.Cluster.Members == nil {
-		onError(config.ErrClusterOpts, "members parameter etc")
-	} else {
-		initClusterNode(server, cfg)
-	}
-
-	// gen tls config
-	var listenerConfig *listeners.Config
-	if tlsConfig, err := config.GenTlsConfig(cfg); err != nil {
-		onError(err, "gen tls config")
-	} else {
-		if tlsConfig != nil {
-			listenerConfig = &listeners.Config{TLSConfig: tlsConfig}
-		}
-	}
-
-	// add tcp listener
-	tcp := listeners.NewTCP("tcp", cfg.Mqtt.TCP, listenerConfig)
-	onError(server.AddListener(tcp), "add tcp listener")
-
-	// add websocket listener
-	ws := listeners.NewWebsocket("ws", cfg.Mqtt.WS, listenerConfig)
-	onError(server.AddListener(ws), "add websocket listener")
-
-	// add http listener
-	csHls := csRt.New(agent).GenHandlers()
-	mqHls := mqttRt.New(server).GenHandlers()
-	maps.Copy(csHls, mqHls)
-	http := listeners.NewHTTP("stats", cfg.Mqtt.HTTP, nil, csHls)
-	onError(server.AddListener(http), "add http listener")
-
-	errCh := make(chan error, 1)
-	// start server
-	go func() {
-		err := server.Serve()
-		if err != nil {
-			errCh <- err
-		}
-	}()
-	log.Info("cluster node started")
-
-	// exit
-	select {
-	case err := <-errCh:
-		onError(err, "server error")
+	broker, err := comqtt.NewBroker(comqtt.WithConfig(cfg), comqtt.WithCluster(), comqtt.WithLogger(log.Default()))
+	onError(err, "init broker")
 
-	case <-ctx.Done():
-		server.Log.Warn("caught signal, stopping...")
-	}
-	agent.Stop()
-	server.Close()
+	// join the cluster and serve until a signal is caught
+	err = broker.Run(ctx)
+	onError(err, "server error")
 	return nil
 }
 
-func initAuth(server *mqtt.Server, conf *config.Config) {
-	logMsg := "init auth"
-	if conf.Auth.Way == config.AuthModeAnonymous {
-		server.AddHook(new(auth.AllowHook), nil)
-	} else if conf.Auth.Way == config.AuthModeUsername || conf.Auth.Way == config.AuthModeClientid {
-		ledger := auth.Ledger{}
-		if conf.Auth.BlacklistPath != "" {
-			onError(plugin.LoadYaml(conf.Auth.BlacklistPath, &ledger), logMsg)
-		}
-		switch conf.Auth.Datasource {
-		case config.AuthDSRedis:
-			opts := rauth.Options{}
-			onError(plugin.LoadYaml(conf.Auth.ConfPath, &opts), logMsg)
-			onError(server.AddHook(new(rauth.Auth), &opts), logMsg)
-			opts.SetBlacklist(&ledger)
-		case config.AuthDSMysql:
-			opts := mauth.Options{}
-			onError(plugin.LoadYaml(conf.Auth.ConfPath, &opts), logMsg)
-			onError(server.AddHook(new(mauth.Auth), &opts), logMsg)
-			opts.SetBlacklist(&ledger)
-		case config.AuthDSPostgresql:
-			opts := pauth.Options{}
-			onError(plugin.LoadYaml(conf.Auth.ConfPath, &opts), logMsg)
-			onError(server.AddHook(new(pauth.Auth), &opts), logMsg)
-			opts.SetBlacklist(&ledger)
-		case config.AuthDSHttp:
-			opts := hauth.Options{}
-			onError(plugin.LoadYaml(conf.Auth.ConfPath, &opts), logMsg)
-			onError(server.AddHook(new(hauth.Auth), &opts), logMsg)
-			opts.SetBlacklist(&ledger)
-		}
-	} else {
-		onError(config.ErrAuthWay, logMsg)
-	}
-}
-
-func initStorage(server *mqtt.Server, conf *config.Config) {
-	logMsg := "init storage"
-	if conf.StorageWay != config.StorageWayRedis {
-		onError(config.ErrStorageWay, logMsg)
-	}
-	err := server.AddHook(new(coredis.Storage), &coredis.Options{
-		HPrefix: conf.Redis.HPrefix,
-		Options: &redis.Options{
-			Addr:     conf.Redis.Options.Addr,
-			DB:       conf.Redis.Options.DB,
-			Username: conf.Redis.Options.Username,
-			Password: conf.Redis.Options.Password,
-		},
-	})
-	onError(err, logMsg)
-}
-
-func initBridge(server *mqtt.Server, conf *config.Config) {
-	logMsg := "init bridge"
-	if conf.BridgeWay == config.BridgeWayNone {
-		return
-	} else if conf.BridgeWay == config.BridgeWayKafka {
-		opts := cokafka.Options{}
-		onError(plugin.LoadYaml(conf.BridgePath, &opts), logMsg)
-		onError(server.AddHook(new(cokafka.Bridge), &opts), logMsg)
-	}
-}
-
-func initClusterNode(server *mqtt.Server, conf *config.Config) {
-	//setup member node
-	agent = cs.NewAgent(&conf.Cluster)
-	agent.BindMqttServer(server)
-	onError(agent.Start(), "create node and join cluster")
-	log.Info("cluster node created")
-}
-
 // onError handle errors and simplify code
 func onError(err error, msg string) {
 	if err != nil {
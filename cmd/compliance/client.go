@@ -0,0 +1,387 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+var (
+	ErrUnexpectedPacket = errors.New("unexpected packet")
+	ErrConnectRefused   = errors.New("connect refused")
+)
+
+// client is a minimal MQTT v5 client which speaks the wire protocol directly,
+// so that scenarios can both drive well-formed flows and inject malformed bytes.
+type client struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	id      string
+	timeout time.Duration
+	nextID  uint16
+}
+
+// dial opens a raw tcp connection to a broker without sending any packets.
+func dial(addr, id string, timeout time.Duration) (*client, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &client{
+		conn:    conn,
+		r:       bufio.NewReader(conn),
+		id:      id,
+		timeout: timeout,
+	}, nil
+}
+
+// packetID returns the next non-zero packet identifier.
+func (c *client) packetID() uint16 {
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID = 1
+	}
+	return c.nextID
+}
+
+// writeRaw writes arbitrary bytes to the connection.
+func (c *client) writeRaw(b []byte) error {
+	_ = c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	_, err := c.conn.Write(b)
+	return err
+}
+
+// send encodes and writes a packet to the connection.
+func (c *client) send(pk packets.Packet) error {
+	pk.ProtocolVersion = 5
+	buf := new(bytes.Buffer)
+
+	var err error
+	switch pk.FixedHeader.Type {
+	case packets.Connect:
+		err = pk.ConnectEncode(buf)
+	case packets.Disconnect:
+		err = pk.DisconnectEncode(buf)
+	case packets.Publish:
+		err = pk.PublishEncode(buf)
+	case packets.Puback:
+		err = pk.PubackEncode(buf)
+	case packets.Pubrec:
+		err = pk.PubrecEncode(buf)
+	case packets.Pubrel:
+		pk.FixedHeader.Qos = 1
+		err = pk.PubrelEncode(buf)
+	case packets.Pubcomp:
+		err = pk.PubcompEncode(buf)
+	case packets.Subscribe:
+		pk.FixedHeader.Qos = 1
+		err = pk.SubscribeEncode(buf)
+	case packets.Unsubscribe:
+		pk.FixedHeader.Qos = 1
+		err = pk.UnsubscribeEncode(buf)
+	case packets.Pingreq:
+		err = pk.PingreqEncode(buf)
+	default:
+		err = fmt.Errorf("%w: cannot encode type %d", ErrUnexpectedPacket, pk.FixedHeader.Type)
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.writeRaw(buf.Bytes())
+}
+
+// read reads and decodes the next packet, waiting at most wait.
+func (c *client) read(wait time.Duration) (pk packets.Packet, err error) {
+	_ = c.conn.SetReadDeadline(time.Now().Add(wait))
+
+	hb, err := c.r.ReadByte()
+	if err != nil {
+		return pk, err
+	}
+
+	if err = pk.FixedHeader.Decode(hb); err != nil {
+		return pk, err
+	}
+
+	pk.FixedHeader.Remaining, _, err = packets.DecodeLength(c.r)
+	if err != nil {
+		return pk, err
+	}
+
+	b := make([]byte, pk.FixedHeader.Remaining)
+	if _, err = io.ReadFull(c.r, b); err != nil {
+		return pk, err
+	}
+
+	pk.ProtocolVersion = 5
+	switch pk.FixedHeader.Type {
+	case packets.Connack:
+		err = pk.ConnackDecode(b)
+	case packets.Disconnect:
+		err = pk.DisconnectDecode(b)
+	case packets.Publish:
+		err = pk.PublishDecode(b)
+	case packets.Puback:
+		err = pk.PubackDecode(b)
+	case packets.Pubrec:
+		err = pk.PubrecDecode(b)
+	case packets.Pubrel:
+		err = pk.PubrelDecode(b)
+	case packets.Pubcomp:
+		err = pk.PubcompDecode(b)
+	case packets.Suback:
+		err = pk.SubackDecode(b)
+	case packets.Unsuback:
+		err = pk.UnsubackDecode(b)
+	case packets.Pingresp:
+		err = pk.PingrespDecode(b)
+	default:
+		err = fmt.Errorf("%w: type %d", ErrUnexpectedPacket, pk.FixedHeader.Type)
+	}
+
+	return pk, err
+}
+
+// expect reads the next packet and returns an error if it is not of the given type.
+func (c *client) expect(typ byte) (packets.Packet, error) {
+	pk, err := c.read(c.timeout)
+	if err != nil {
+		return pk, fmt.Errorf("waiting for %s: %w", packets.PacketNames[typ], err)
+	}
+
+	if pk.FixedHeader.Type != typ {
+		return pk, fmt.Errorf("%w: want %s, got %s (reason 0x%02x)", ErrUnexpectedPacket,
+			packets.PacketNames[typ], packets.PacketNames[pk.FixedHeader.Type], pk.ReasonCode)
+	}
+
+	return pk, nil
+}
+
+// connectOptions are the values used to build a CONNECT packet.
+type connectOptions struct {
+	username      string
+	password      string
+	clean         bool
+	sessionExpiry uint32
+	will          *packets.Packet
+}
+
+// connect sends a CONNECT packet and waits for a successful CONNACK.
+func (c *client) connect(o connectOptions) (packets.Packet, error) {
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Connect},
+		Connect: packets.ConnectParams{
+			ProtocolName:     []byte("MQTT"),
+			ClientIdentifier: c.id,
+			Clean:            o.clean,
+			Keepalive:        30,
+		},
+		Properties: packets.Properties{
+			SessionExpiryInterval:     o.sessionExpiry,
+			SessionExpiryIntervalFlag: o.sessionExpiry > 0,
+		},
+	}
+
+	if o.username != "" {
+		pk.Connect.UsernameFlag = true
+		pk.Connect.Username = []byte(o.username)
+	}
+
+	if o.password != "" {
+		pk.Connect.PasswordFlag = true
+		pk.Connect.Password = []byte(o.password)
+	}
+
+	if o.will != nil {
+		pk.Connect.WillFlag = true
+		pk.Connect.WillTopic = o.will.TopicName
+		pk.Connect.WillPayload = o.will.Payload
+		pk.Connect.WillQos = o.will.FixedHeader.Qos
+		pk.Connect.WillRetain = o.will.FixedHeader.Retain
+	}
+
+	if err := c.send(pk); err != nil {
+		return pk, err
+	}
+
+	ack, err := c.expect(packets.Connack)
+	if err != nil {
+		return ack, err
+	}
+
+	if ack.ReasonCode >= packets.ErrUnspecifiedError.Code {
+		return ack, fmt.Errorf("%w: reason 0x%02x %s", ErrConnectRefused, ack.ReasonCode, ack.Properties.ReasonString)
+	}
+
+	return ack, nil
+}
+
+// subscribe subscribes to a single filter and checks the granted qos.
+func (c *client) subscribe(filter string, qos byte) error {
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Subscribe},
+		PacketID:    c.packetID(),
+		Filters:     packets.Subscriptions{{Filter: filter, Qos: qos}},
+	}
+
+	if err := c.send(pk); err != nil {
+		return err
+	}
+
+	ack, err := c.expect(packets.Suback)
+	if err != nil {
+		return err
+	}
+
+	if len(ack.ReasonCodes) != 1 || ack.ReasonCodes[0] >= packets.ErrUnspecifiedError.Code {
+		return fmt.Errorf("subscribe %s refused: %v", filter, ack.ReasonCodes)
+	}
+
+	if ack.ReasonCodes[0] != qos {
+		return fmt.Errorf("subscribe %s granted qos %d, want %d", filter, ack.ReasonCodes[0], qos)
+	}
+
+	return nil
+}
+
+// publish sends a message and completes the outbound acknowledgement flow for its qos.
+func (c *client) publish(topic string, payload []byte, qos byte, retain bool) error {
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: qos, Retain: retain},
+		TopicName:   topic,
+		Payload:     payload,
+	}
+	if qos > 0 {
+		pk.PacketID = c.packetID()
+	}
+
+	if err := c.send(pk); err != nil {
+		return err
+	}
+
+	switch qos {
+	case 1:
+		ack, err := c.expect(packets.Puback)
+		if err != nil {
+			return err
+		}
+		return checkAck(ack, pk.PacketID)
+	case 2:
+		rec, err := c.expect(packets.Pubrec)
+		if err != nil {
+			return err
+		}
+		if err = checkAck(rec, pk.PacketID); err != nil {
+			return err
+		}
+
+		if err = c.send(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pubrel}, PacketID: pk.PacketID}); err != nil {
+			return err
+		}
+
+		comp, err := c.expect(packets.Pubcomp)
+		if err != nil {
+			return err
+		}
+		return checkAck(comp, pk.PacketID)
+	}
+
+	return nil
+}
+
+// receive waits for an inbound PUBLISH and completes the inbound acknowledgement flow for its qos.
+func (c *client) receive() (packets.Packet, error) {
+	pk, err := c.expect(packets.Publish)
+	if err != nil {
+		return pk, err
+	}
+
+	switch pk.FixedHeader.Qos {
+	case 1:
+		err = c.send(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Puback}, PacketID: pk.PacketID})
+	case 2:
+		if err = c.send(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pubrec}, PacketID: pk.PacketID}); err != nil {
+			return pk, err
+		}
+
+		var rel packets.Packet
+		if rel, err = c.expect(packets.Pubrel); err != nil {
+			return pk, err
+		}
+		if err = checkAck(rel, pk.PacketID); err != nil {
+			return pk, err
+		}
+
+		err = c.send(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pubcomp}, PacketID: pk.PacketID})
+	}
+
+	return pk, err
+}
+
+// silent returns an error if a PUBLISH arrives within wait.
+func (c *client) silent(wait time.Duration) error {
+	pk, err := c.read(wait)
+	if err == nil {
+		return fmt.Errorf("%w: %s on %q", ErrUnexpectedPacket, packets.PacketNames[pk.FixedHeader.Type], pk.TopicName)
+	}
+
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return nil
+	}
+
+	return err
+}
+
+// closedByServer waits for the server to drop the connection, optionally after a DISCONNECT.
+func (c *client) closedByServer() error {
+	for {
+		pk, err := c.read(c.timeout)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return errors.New("connection was not closed by server")
+			}
+			return nil // eof or reset
+		}
+
+		if pk.FixedHeader.Type != packets.Disconnect && pk.FixedHeader.Type != packets.Connack {
+			return fmt.Errorf("%w: %s before close", ErrUnexpectedPacket, packets.PacketNames[pk.FixedHeader.Type])
+		}
+	}
+}
+
+// disconnect sends a normal DISCONNECT and closes the connection.
+func (c *client) disconnect() {
+	_ = c.send(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Disconnect}})
+	_ = c.conn.Close()
+}
+
+// close drops the connection without a DISCONNECT.
+func (c *client) close() {
+	_ = c.conn.Close()
+}
+
+func checkAck(pk packets.Packet, id uint16) error {
+	if pk.PacketID != id {
+		return fmt.Errorf("%s for packet id %d, want %d", packets.PacketNames[pk.FixedHeader.Type], pk.PacketID, id)
+	}
+
+	if pk.ReasonCode >= packets.ErrUnspecifiedError.Code {
+		return fmt.Errorf("%s for packet id %d failed: reason 0x%02x", packets.PacketNames[pk.FixedHeader.Type], id, pk.ReasonCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,142 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+// Command compliance runs a scripted suite of mqtt v5 protocol scenarios against
+// a running broker or cluster and reports which of them passed. It exits with a
+// non-zero status if any scenario fails, so it can be used directly in CI.
+//
+//	compliance -addr 127.0.0.1:1883
+//	compliance -addr node1:1883,node2:1883,node3:1883 -settle 500ms -json
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/rs/xid"
+)
+
+// result is the outcome of a single scenario.
+type result struct {
+	Name     string        `json:"name"`
+	Passed   bool          `json:"passed"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// report is the outcome of a complete run.
+type report struct {
+	Results []result `json:"results"`
+	Passed  int      `json:"passed"`
+	Failed  int      `json:"failed"`
+}
+
+func main() {
+	os.Exit(realMain(os.Args[1:], os.Stdout))
+}
+
+func realMain(args []string, out io.Writer) int {
+	var addrs, filter string
+	var list, asJSON bool
+	s := new(suite)
+
+	fs := flag.NewFlagSet("compliance", flag.ContinueOnError)
+	fs.SetOutput(out)
+	fs.StringVar(&addrs, "addr", "127.0.0.1:1883", "comma separated tcp addresses of the broker or cluster nodes under test")
+	fs.StringVar(&s.username, "username", "", "username sent by every test client")
+	fs.StringVar(&s.password, "password", "", "password sent by every test client")
+	fs.DurationVar(&s.timeout, "timeout", 5*time.Second, "maximum time to wait for any expected packet")
+	fs.DurationVar(&s.settle, "settle", 500*time.Millisecond, "time allowed for subscriptions to propagate between cluster nodes")
+	fs.IntVar(&s.payloadSize, "payload", 256*1024, "payload size in bytes for the large-payload scenario")
+	fs.StringVar(&filter, "run", "", "only run scenarios whose name matches this regular expression")
+	fs.BoolVar(&list, "list", false, "list the available scenarios and exit")
+	fs.BoolVar(&asJSON, "json", false, "write the report as json")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if list {
+		for _, sc := range scenarios {
+			fmt.Fprintf(out, "%-28s %s\n", sc.name, sc.desc)
+		}
+		return 0
+	}
+
+	var re *regexp.Regexp
+	if filter != "" {
+		var err error
+		if re, err = regexp.Compile(filter); err != nil {
+			fmt.Fprintf(out, "invalid -run expression: %v\n", err)
+			return 2
+		}
+	}
+
+	for _, a := range strings.Split(addrs, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			s.addrs = append(s.addrs, a)
+		}
+	}
+	if len(s.addrs) == 0 {
+		fmt.Fprintln(out, "at least one -addr is required")
+		return 2
+	}
+	s.run = xid.New().String()
+
+	r := runSuite(s, re)
+	if asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(r)
+	} else {
+		for _, res := range r.Results {
+			if res.Passed {
+				fmt.Fprintf(out, "PASS  %-28s %s\n", res.Name, res.Duration.Round(time.Millisecond))
+			} else {
+				fmt.Fprintf(out, "FAIL  %-28s %s: %s\n", res.Name, res.Duration.Round(time.Millisecond), res.Error)
+			}
+		}
+		fmt.Fprintf(out, "\n%d passed, %d failed\n", r.Passed, r.Failed)
+	}
+
+	if r.Failed > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+// runSuite runs every scenario matching re in order.
+func runSuite(s *suite, re *regexp.Regexp) report {
+	var r report
+	for _, sc := range scenarios {
+		if re != nil && !re.MatchString(sc.name) {
+			continue
+		}
+
+		start := time.Now()
+		err := sc.run(s)
+		res := result{
+			Name:     sc.name,
+			Passed:   err == nil,
+			Duration: time.Since(start),
+		}
+
+		if err != nil {
+			res.Error = err.Error()
+			r.Failed++
+		} else {
+			r.Passed++
+		}
+
+		r.Results = append(r.Results, res)
+	}
+
+	return r
+}
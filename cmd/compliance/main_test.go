@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+	"github.com/wind-c/comqtt/v2/mqtt/listeners"
+)
+
+func newBroker(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := mqtt.New(&mqtt.Options{
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	require.NoError(t, server.AddHook(new(auth.AllowHook), nil))
+	require.NoError(t, server.AddListener(listeners.NewNet("t1", l)))
+	require.NoError(t, server.Serve())
+	t.Cleanup(func() { _ = server.Close() })
+
+	return l.Addr().String()
+}
+
+func TestRealMainPassesAgainstBroker(t *testing.T) {
+	addr := newBroker(t)
+
+	out := new(bytes.Buffer)
+	code := realMain([]string{"-addr", addr, "-timeout", "2s", "-json"}, out)
+
+	var r report
+	require.NoError(t, json.Unmarshal(out.Bytes(), &r))
+	for _, res := range r.Results {
+		require.True(t, res.Passed, "%s: %s", res.Name, res.Error)
+	}
+	require.Equal(t, len(scenarios), r.Passed)
+	require.Equal(t, 0, code)
+}
+
+func TestRealMainRunFilter(t *testing.T) {
+	addr := newBroker(t)
+
+	out := new(bytes.Buffer)
+	code := realMain([]string{"-addr", addr, "-run", "^malformed-", "-json"}, out)
+	require.Equal(t, 0, code)
+
+	var r report
+	require.NoError(t, json.Unmarshal(out.Bytes(), &r))
+	require.Equal(t, 6, r.Passed)
+}
+
+func TestRealMainFailsWithoutBroker(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	out := new(bytes.Buffer)
+	code := realMain([]string{"-addr", addr, "-run", "^connect$"}, out)
+	require.Equal(t, 1, code)
+	require.Contains(t, out.String(), "FAIL  connect")
+	require.Contains(t, out.String(), "0 passed, 1 failed")
+}
+
+func TestRealMainList(t *testing.T) {
+	out := new(bytes.Buffer)
+	require.Equal(t, 0, realMain([]string{"-list"}, out))
+	for _, sc := range scenarios {
+		require.Contains(t, out.String(), sc.name)
+	}
+}
+
+func TestRealMainInvalidArgs(t *testing.T) {
+	require.Equal(t, 2, realMain([]string{"-run", "("}, io.Discard))
+	require.Equal(t, 2, realMain([]string{"-addr", " , "}, io.Discard))
+}
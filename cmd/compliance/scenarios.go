@@ -0,0 +1,576 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+// scenario is a single named protocol check run against the target broker.
+type scenario struct {
+	name string
+	desc string
+	run  func(s *suite) error
+}
+
+// scenarios is the ordered list of checks performed by the harness.
+var scenarios = []scenario{
+	{"connect", "connect with mqtt v5 and receive a successful connack", connectScenario},
+	{"pubsub-qos0", "deliver a qos 0 message between two clients", pubsubScenario(0)},
+	{"pubsub-qos1", "deliver a qos 1 message between two clients", pubsubScenario(1)},
+	{"pubsub-qos2", "complete both qos 2 flows and deliver exactly once", qos2Scenario},
+	{"qos-downgrade", "deliver at the granted subscription qos", downgradeScenario},
+	{"unsubscribe", "stop delivery after unsubscribe", unsubscribeScenario},
+	{"retained", "deliver and clear a retained message", retainedScenario},
+	{"session-resume", "resume a persistent session and receive queued messages", sessionResumeScenario},
+	{"shared-subscription", "deliver each shared message to exactly one group member", sharedScenario},
+	{"will-message", "publish the will message on unexpected disconnect", willScenario},
+	{"large-payload", "deliver a large payload intact", largePayloadScenario},
+	{"malformed-reserved-type", "close the connection on a reserved packet type", malformedScenario([]byte{0x00, 0x00})},
+	{"malformed-remaining-length", "close the connection on an invalid remaining length", malformedScenario([]byte{0x10, 0xff, 0xff, 0xff, 0xff, 0x7f})},
+	{"malformed-protocol-name", "refuse a connect with an unknown protocol name", badProtocolScenario},
+	{"malformed-first-packet", "close the connection when the first packet is not connect", firstPacketScenario},
+	{"malformed-second-connect", "close the connection on a second connect", secondConnectScenario},
+	{"malformed-publish-wildcard", "disconnect a client publishing to a wildcard topic", wildcardPublishScenario},
+}
+
+// suite holds the target broker details shared by all scenarios.
+type suite struct {
+	addrs       []string
+	username    string
+	password    string
+	run         string
+	timeout     time.Duration
+	settle      time.Duration
+	payloadSize int
+}
+
+// node returns the broker address for the i'th role in a scenario, so that in
+// cluster mode publishers and subscribers land on different nodes.
+func (s *suite) node(i int) string {
+	return s.addrs[i%len(s.addrs)]
+}
+
+// topic returns a topic namespaced to this run.
+func (s *suite) topic(name string) string {
+	return "compliance/" + s.run + "/" + name
+}
+
+// dial connects a new client to the i'th node without sending connect.
+func (s *suite) dial(i int, name string) (*client, error) {
+	return dial(s.node(i), "compliance-"+s.run+"-"+name, s.timeout)
+}
+
+// connect dials the i'th node and completes the connect handshake.
+func (s *suite) connect(i int, name string, o connectOptions) (*client, packets.Packet, error) {
+	c, err := s.dial(i, name)
+	if err != nil {
+		return nil, packets.Packet{}, err
+	}
+
+	o.username, o.password = s.username, s.password
+	ack, err := c.connect(o)
+	if err != nil {
+		c.close()
+		return nil, ack, err
+	}
+
+	return c, ack, nil
+}
+
+// subscriber connects a clean client to the i'th node and subscribes to filter.
+func (s *suite) subscriber(i int, name, filter string, qos byte) (*client, error) {
+	c, _, err := s.connect(i, name, connectOptions{clean: true})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = c.subscribe(filter, qos); err != nil {
+		c.close()
+		return nil, err
+	}
+
+	s.wait()
+	return c, nil
+}
+
+// wait gives a cluster time to propagate subscriptions between nodes.
+func (s *suite) wait() {
+	if len(s.addrs) > 1 && s.settle > 0 {
+		time.Sleep(s.settle)
+	}
+}
+
+func connectScenario(s *suite) error {
+	c, ack, err := s.connect(0, "connect", connectOptions{clean: true})
+	if err != nil {
+		return err
+	}
+	defer c.disconnect()
+
+	if ack.SessionPresent {
+		return errors.New("session present on clean start")
+	}
+
+	return nil
+}
+
+func pubsubScenario(qos byte) func(s *suite) error {
+	return func(s *suite) error {
+		topic := s.topic(fmt.Sprintf("pubsub/%d", qos))
+		sub, err := s.subscriber(0, fmt.Sprintf("pubsub%d-sub", qos), topic, qos)
+		if err != nil {
+			return err
+		}
+		defer sub.disconnect()
+
+		pub, _, err := s.connect(1, fmt.Sprintf("pubsub%d-pub", qos), connectOptions{clean: true})
+		if err != nil {
+			return err
+		}
+		defer pub.disconnect()
+
+		payload := []byte("hello")
+		if err = pub.publish(topic, payload, qos, false); err != nil {
+			return err
+		}
+
+		pk, err := sub.receive()
+		if err != nil {
+			return err
+		}
+
+		return checkMessage(pk, topic, payload, qos)
+	}
+}
+
+func qos2Scenario(s *suite) error {
+	topic := s.topic("qos2")
+	sub, err := s.subscriber(0, "qos2-sub", topic, 2)
+	if err != nil {
+		return err
+	}
+	defer sub.disconnect()
+
+	pub, _, err := s.connect(1, "qos2-pub", connectOptions{clean: true})
+	if err != nil {
+		return err
+	}
+	defer pub.disconnect()
+
+	payload := []byte("exactly once")
+	if err = pub.publish(topic, payload, 2, false); err != nil {
+		return err
+	}
+
+	pk, err := sub.receive()
+	if err != nil {
+		return err
+	}
+
+	if err = checkMessage(pk, topic, payload, 2); err != nil {
+		return err
+	}
+
+	return sub.silent(s.timeout / 4)
+}
+
+func downgradeScenario(s *suite) error {
+	topic := s.topic("downgrade")
+	sub, err := s.subscriber(0, "downgrade-sub", topic, 0)
+	if err != nil {
+		return err
+	}
+	defer sub.disconnect()
+
+	pub, _, err := s.connect(1, "downgrade-pub", connectOptions{clean: true})
+	if err != nil {
+		return err
+	}
+	defer pub.disconnect()
+
+	payload := []byte("downgraded")
+	if err = pub.publish(topic, payload, 2, false); err != nil {
+		return err
+	}
+
+	pk, err := sub.receive()
+	if err != nil {
+		return err
+	}
+
+	return checkMessage(pk, topic, payload, 0)
+}
+
+func unsubscribeScenario(s *suite) error {
+	topic := s.topic("unsubscribe")
+	sub, err := s.subscriber(0, "unsubscribe-sub", topic, 1)
+	if err != nil {
+		return err
+	}
+	defer sub.disconnect()
+
+	err = sub.send(packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Unsubscribe},
+		PacketID:    sub.packetID(),
+		Filters:     packets.Subscriptions{{Filter: topic}},
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err = sub.expect(packets.Unsuback); err != nil {
+		return err
+	}
+	s.wait()
+
+	pub, _, err := s.connect(1, "unsubscribe-pub", connectOptions{clean: true})
+	if err != nil {
+		return err
+	}
+	defer pub.disconnect()
+
+	if err = pub.publish(topic, []byte("nobody home"), 1, false); err != nil {
+		return err
+	}
+
+	return sub.silent(s.timeout / 4)
+}
+
+func retainedScenario(s *suite) error {
+	topic := s.topic("retained")
+	pub, _, err := s.connect(1, "retained-pub", connectOptions{clean: true})
+	if err != nil {
+		return err
+	}
+	defer pub.disconnect()
+
+	payload := []byte("retained")
+	if err = pub.publish(topic, payload, 1, true); err != nil {
+		return err
+	}
+	s.wait()
+
+	sub, err := s.subscriber(0, "retained-sub", topic, 1)
+	if err != nil {
+		return err
+	}
+
+	pk, err := sub.receive()
+	sub.disconnect()
+	if err != nil {
+		return err
+	}
+
+	if err = checkMessage(pk, topic, payload, 1); err != nil {
+		return err
+	}
+
+	if !pk.FixedHeader.Retain {
+		return errors.New("retain flag not set on retained message")
+	}
+
+	// an empty retained payload clears the message for later subscribers.
+	if err = pub.publish(topic, nil, 1, true); err != nil {
+		return err
+	}
+	s.wait()
+
+	sub, err = s.subscriber(0, "retained-sub2", topic, 1)
+	if err != nil {
+		return err
+	}
+	defer sub.disconnect()
+
+	return sub.silent(s.timeout / 4)
+}
+
+func sessionResumeScenario(s *suite) error {
+	topic := s.topic("session")
+	persistent := connectOptions{clean: false, sessionExpiry: 300}
+
+	sub, _, err := s.connect(0, "session-sub", connectOptions{clean: true, sessionExpiry: 300})
+	if err != nil {
+		return err
+	}
+
+	if err = sub.subscribe(topic, 1); err != nil {
+		sub.close()
+		return err
+	}
+	sub.disconnect()
+	s.wait()
+
+	pub, _, err := s.connect(1, "session-pub", connectOptions{clean: true})
+	if err != nil {
+		return err
+	}
+	defer pub.disconnect()
+
+	payload := []byte("while you were away")
+	if err = pub.publish(topic, payload, 1, false); err != nil {
+		return err
+	}
+
+	sub, ack, err := s.connect(0, "session-sub", persistent)
+	if err != nil {
+		return err
+	}
+
+	// always expire the session so that reruns start from a clean slate.
+	defer func() {
+		sub.disconnect()
+		if c, _, err := s.connect(0, "session-sub", connectOptions{clean: true}); err == nil {
+			c.disconnect()
+		}
+	}()
+
+	if !ack.SessionPresent {
+		return errors.New("session present not set on resume")
+	}
+
+	pk, err := sub.receive()
+	if err != nil {
+		return err
+	}
+
+	return checkMessage(pk, topic, payload, 1)
+}
+
+func sharedScenario(s *suite) error {
+	const messages = 10
+	topic := s.topic("shared")
+	filter := "$share/" + s.run + "/" + topic
+
+	subs := make([]*client, 2)
+	for i := range subs {
+		c, err := s.subscriber(0, fmt.Sprintf("shared-sub%d", i), filter, 1)
+		if err != nil {
+			return err
+		}
+		defer c.disconnect()
+		subs[i] = c
+	}
+
+	pub, _, err := s.connect(1, "shared-pub", connectOptions{clean: true})
+	if err != nil {
+		return err
+	}
+	defer pub.disconnect()
+
+	for i := 0; i < messages; i++ {
+		if err = pub.publish(topic, []byte(fmt.Sprintf("%d", i)), 1, false); err != nil {
+			return err
+		}
+	}
+
+	seen := make(map[string]int)
+	deadline := time.Now().Add(s.timeout)
+	for len(seen) < messages && time.Now().Before(deadline) {
+		for _, c := range subs {
+			pk, err := c.read(s.timeout / 20)
+			if err != nil {
+				var ne net.Error
+				if errors.As(err, &ne) && ne.Timeout() {
+					continue
+				}
+				return err
+			}
+
+			if pk.FixedHeader.Type != packets.Publish {
+				return fmt.Errorf("%w: %s", ErrUnexpectedPacket, packets.PacketNames[pk.FixedHeader.Type])
+			}
+
+			if pk.FixedHeader.Qos > 0 {
+				_ = c.send(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Puback}, PacketID: pk.PacketID})
+			}
+
+			seen[string(pk.Payload)]++
+		}
+	}
+
+	if len(seen) != messages {
+		return fmt.Errorf("received %d of %d shared messages", len(seen), messages)
+	}
+
+	for k, n := range seen {
+		if n > 1 {
+			return fmt.Errorf("shared message %s delivered %d times", k, n)
+		}
+	}
+
+	for _, c := range subs {
+		if err = c.silent(s.timeout / 10); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func willScenario(s *suite) error {
+	topic := s.topic("will")
+	sub, err := s.subscriber(0, "will-sub", topic, 1)
+	if err != nil {
+		return err
+	}
+	defer sub.disconnect()
+
+	payload := []byte("gone")
+	will := &packets.Packet{TopicName: topic, Payload: payload, FixedHeader: packets.FixedHeader{Qos: 1}}
+	c, _, err := s.connect(1, "will-client", connectOptions{clean: true, will: will})
+	if err != nil {
+		return err
+	}
+	c.close()
+
+	pk, err := sub.receive()
+	if err != nil {
+		return err
+	}
+
+	return checkMessage(pk, topic, payload, 1)
+}
+
+func largePayloadScenario(s *suite) error {
+	topic := s.topic("large")
+	sub, err := s.subscriber(0, "large-sub", topic, 1)
+	if err != nil {
+		return err
+	}
+	defer sub.disconnect()
+
+	pub, _, err := s.connect(1, "large-pub", connectOptions{clean: true})
+	if err != nil {
+		return err
+	}
+	defer pub.disconnect()
+
+	payload := make([]byte, s.payloadSize)
+	for i := range payload {
+		payload[i] = byte(i % 251)
+	}
+
+	if err = pub.publish(topic, payload, 1, false); err != nil {
+		return err
+	}
+
+	pk, err := sub.receive()
+	if err != nil {
+		return err
+	}
+
+	return checkMessage(pk, topic, payload, 1)
+}
+
+func malformedScenario(b []byte) func(s *suite) error {
+	return func(s *suite) error {
+		c, err := s.dial(0, "malformed")
+		if err != nil {
+			return err
+		}
+		defer c.close()
+
+		if err = c.writeRaw(b); err != nil {
+			return err
+		}
+
+		return c.closedByServer()
+	}
+}
+
+func badProtocolScenario(s *suite) error {
+	c, err := s.dial(0, "bad-protocol")
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	err = c.send(packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Connect},
+		Connect: packets.ConnectParams{
+			ProtocolName:     []byte("MQTX"),
+			ClientIdentifier: c.id,
+			Clean:            true,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.closedByServer()
+}
+
+func firstPacketScenario(s *suite) error {
+	c, err := s.dial(0, "first-packet")
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	if err = c.publish(s.topic("first"), []byte("too soon"), 0, false); err != nil {
+		return err
+	}
+
+	return c.closedByServer()
+}
+
+func secondConnectScenario(s *suite) error {
+	c, _, err := s.connect(0, "second-connect", connectOptions{clean: true})
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	err = c.send(packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Connect},
+		Connect: packets.ConnectParams{
+			ProtocolName:     []byte("MQTT"),
+			ClientIdentifier: c.id,
+			Clean:            true,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.closedByServer()
+}
+
+func wildcardPublishScenario(s *suite) error {
+	c, _, err := s.connect(0, "wildcard-publish", connectOptions{clean: true})
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	if err = c.publish(s.topic("+"), []byte("wild"), 0, false); err != nil {
+		return err
+	}
+
+	return c.closedByServer()
+}
+
+func checkMessage(pk packets.Packet, topic string, payload []byte, qos byte) error {
+	if pk.TopicName != topic {
+		return fmt.Errorf("received topic %q, want %q", pk.TopicName, topic)
+	}
+
+	if pk.FixedHeader.Qos != qos {
+		return fmt.Errorf("received qos %d, want %d", pk.FixedHeader.Qos, qos)
+	}
+
+	if !bytes.Equal(pk.Payload, payload) {
+		return fmt.Errorf("received %d byte payload which does not match the %d bytes sent", len(pk.Payload), len(payload))
+	}
+
+	return nil
+}
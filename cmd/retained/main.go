@@ -0,0 +1,157 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+// Command retained exports the retained messages of a broker to a file and imports
+// them into a broker, using the rest api of the http listener. Messages keep their
+// qos, properties and creation time, so a broker can be restored after a wipe or an
+// environment cloned.
+//
+//	retained export -url http://127.0.0.1:8080 -filter 'devices/#' -o retained.ndjson
+//	retained import -url http://127.0.0.1:8080 -i retained.ndjson
+//	retained import -url http://node1:8080 -i retained.ndjson -cluster
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt/rest"
+)
+
+// clusterRetainedImportPath imports retained messages on every node of a cluster.
+const clusterRetainedImportPath = "/api/v1/cluster/retained/import"
+
+const usage = `usage:
+  retained export [-url url] [-filter filter] [-o file]
+  retained import [-url url] [-i file] [-keep] [-cluster]
+`
+
+func main() {
+	os.Exit(realMain(os.Args[1:], os.Stdin, os.Stdout))
+}
+
+func realMain(args []string, in io.Reader, out io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(out, usage)
+		return 2
+	}
+
+	var base, filter, file string
+	var keep, cluster bool
+	var timeout time.Duration
+
+	fs := flag.NewFlagSet("retained "+args[0], flag.ContinueOnError)
+	fs.SetOutput(out)
+	fs.StringVar(&base, "url", "http://127.0.0.1:8080", "base url of the broker http listener")
+	fs.DurationVar(&timeout, "timeout", time.Minute, "maximum time to wait for the broker")
+	switch args[0] {
+	case "export":
+		fs.StringVar(&filter, "filter", "#", "topic filter of the retained messages to export")
+		fs.StringVar(&file, "o", "-", "file to write the retained messages to, - for stdout")
+	case "import":
+		fs.StringVar(&file, "i", "-", "file to read the retained messages from, - for stdin")
+		fs.BoolVar(&keep, "keep", false, "keep existing retained messages rather than replacing them")
+		fs.BoolVar(&cluster, "cluster", false, "import on every node of a cluster")
+	default:
+		fmt.Fprint(out, usage)
+		return 2
+	}
+
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	client := &http.Client{Timeout: timeout}
+	base = strings.TrimSuffix(base, "/")
+
+	var err error
+	if args[0] == "export" {
+		err = export(client, base, filter, file, out)
+	} else {
+		err = load(client, base, file, keep, cluster, in, out)
+	}
+
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+
+	return 0
+}
+
+// export downloads the retained messages matching a topic filter to a file.
+func export(client *http.Client, base, filter, file string, out io.Writer) error {
+	resp, err := client.Get(base + rest.MqttRetainedExportPath + "?filter=" + url.QueryEscape(filter))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+
+	w := out
+	if file != "-" {
+		f, err := os.Create(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// load uploads the retained messages of a file to the broker and writes the result.
+func load(client *http.Client, base, file string, keep, cluster bool, in io.Reader, out io.Writer) error {
+	r := in
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	path := rest.MqttRetainedImportPath
+	if cluster {
+		path = clusterRetainedImportPath
+	}
+	if keep {
+		path += "?overwrite=false"
+	}
+
+	resp, err := client.Post(base+path, "application/x-ndjson", r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
+
+// checkResponse returns an error containing the body of an unsuccessful response.
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+}
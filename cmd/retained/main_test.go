@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/mqtt/rest"
+)
+
+func newBroker(t *testing.T) (*mqtt.Server, string) {
+	server := mqtt.New(&mqtt.Options{
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+
+	mux := http.NewServeMux()
+	for pattern, h := range rest.New(server).GenHandlers() {
+		mux.HandleFunc(pattern, h)
+	}
+
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return server, ts.URL
+}
+
+func TestRealMainExportImport(t *testing.T) {
+	src, srcURL := newBroker(t)
+	for _, topic := range []string{"a/b", "a/c", "b/c"} {
+		src.Topics.RetainMessage(packets.Packet{
+			FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true, Qos: 1},
+			TopicName:   topic,
+			Payload:     []byte(topic),
+			Created:     time.Now().Unix(),
+		})
+	}
+
+	file := filepath.Join(t.TempDir(), "retained.ndjson")
+	out := new(bytes.Buffer)
+	code := realMain([]string{"export", "-url", srcURL, "-filter", "a/#", "-o", file}, nil, out)
+	require.Equal(t, 0, code, out.String())
+
+	dst, dstURL := newBroker(t)
+	out.Reset()
+	code = realMain([]string{"import", "-url", dstURL, "-i", file}, nil, out)
+	require.Equal(t, 0, code, out.String())
+	require.JSONEq(t, `{"imported":2,"skipped":0}`, out.String())
+
+	pk, ok := dst.Topics.Retained.Get("a/c")
+	require.True(t, ok)
+	require.Equal(t, byte(1), pk.FixedHeader.Qos)
+	require.Equal(t, "a/c", string(pk.Payload))
+	_, ok = dst.Topics.Retained.Get("b/c")
+	require.False(t, ok)
+
+	// existing retained messages are kept
+	out.Reset()
+	code = realMain([]string{"import", "-url", dstURL, "-i", file, "-keep"}, nil, out)
+	require.Equal(t, 0, code, out.String())
+	require.JSONEq(t, `{"imported":0,"skipped":2}`, out.String())
+}
+
+func TestRealMainStdio(t *testing.T) {
+	src, srcURL := newBroker(t)
+	src.Topics.RetainMessage(packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true},
+		TopicName:   "a",
+		Payload:     []byte("1"),
+		Created:     time.Now().Unix(),
+	})
+
+	export := new(bytes.Buffer)
+	require.Equal(t, 0, realMain([]string{"export", "-url", srcURL}, nil, export))
+
+	_, dstURL := newBroker(t)
+	out := new(bytes.Buffer)
+	require.Equal(t, 0, realMain([]string{"import", "-url", dstURL}, export, out))
+	require.JSONEq(t, `{"imported":1,"skipped":0}`, out.String())
+}
+
+func TestRealMainErrors(t *testing.T) {
+	out := new(bytes.Buffer)
+	require.Equal(t, 2, realMain(nil, nil, out))
+	require.Equal(t, 2, realMain([]string{"delete"}, nil, out))
+	require.Equal(t, 2, realMain([]string{"export", "-bad"}, nil, out))
+
+	_, url := newBroker(t)
+	out.Reset()
+	require.Equal(t, 1, realMain([]string{"export", "-url", url, "-filter", "a/#/b"}, nil, out))
+	require.Contains(t, out.String(), "400")
+
+	out.Reset()
+	require.Equal(t, 1, realMain([]string{"import", "-url", url}, bytes.NewBufferString("not json"), out))
+	require.Contains(t, out.String(), "retained message 1")
+}
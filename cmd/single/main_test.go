@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"os"
 	"sync"
 	"testing"
 	"time"
@@ -9,18 +10,27 @@ import (
 	"go.uber.org/goleak"
 )
 
+// ignoreAnts ignores the goroutines of the default ants pool, started when the package is
+// initialised rather than by the server.
+var ignoreAnts = []goleak.Option{
+	goleak.IgnoreTopFunction("github.com/panjf2000/ants/v2.(*poolCommon).purgeStaleWorkers"),
+	goleak.IgnoreTopFunction("github.com/panjf2000/ants/v2.(*poolCommon).ticktock"),
+}
+
 func TestMain(m *testing.M) {
-	goleak.VerifyTestMain(m,
+	goleak.VerifyTestMain(m, append(ignoreAnts,
 		goleak.IgnoreTopFunction("github.com/golang/glog.(*fileSink).flushDaemon"),
-	)
+	)...)
 }
 
 // TestLeaks tests that there are no goroutine leaks after starting and stopping the server.
 // We should likely do some more operations here, but this is a start.
 func TestLeaks(t *testing.T) {
-	defer goleak.VerifyNone(t,
+	defer goleak.VerifyNone(t, append(ignoreAnts,
 		goleak.IgnoreTopFunction("github.com/golang/glog.(*fileSink).flushDaemon"),
-	)
+	)...)
+	// use memory storage, so that the test does not leave a bolt database in the package
+	os.Args = []string{os.Args[0], "-storage-way", "0"}
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 	defer cancel()
 	wg := sync.WaitGroup{}
@@ -11,7 +11,17 @@ import (
 	"os"
 
 	"github.com/wind-c/comqtt/v2/cluster/log"
+	"github.com/wind-c/comqtt/v2/cluster/standby"
 	comqtt "github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/est"
+	mqttauth "github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/objectstore"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/security"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/usage"
+	"github.com/wind-c/comqtt/v2/mqtt/listeners"
+	"github.com/wind-c/comqtt/v2/mqtt/revocation"
+	"github.com/wind-c/comqtt/v2/plugin"
 	"gopkg.in/yaml.v3"
 )
 
@@ -30,12 +40,18 @@ const (
 	StorageWayBolt
 	StorageWayBadger
 	StorageWayRedis
+	StorageWayPostgres
+	StorageWaySqlite
+	StorageWaySnapshot
+	StorageWayCassandra
+	StorageWayDynamoDB
 )
 
 const (
 	AuthModeAnonymous uint = iota
 	AuthModeUsername
 	AuthModeClientid
+	AuthModeAnonymousACL
 )
 
 const (
@@ -44,20 +60,54 @@ const (
 	AuthDSMysql
 	AuthDSPostgresql
 	AuthDSHttp
+	AuthDSX509
+	AuthDSJWT
+	AuthDSOAuth2
+	AuthDSVault
+	AuthDSGrpc
+	AuthDSSqlite
 )
 
+const (
+	ClientAuthRequire  = "require"  // clients must present a certificate issued by the ca-cert
+	ClientAuthOptional = "optional" // certificates are verified if presented, so clients may use passwords instead
+)
+
+const (
+	ListenerTCP          = "tcp"          // an mqtt over tcp listener
+	ListenerWebsocket    = "ws"           // an mqtt over websockets listener
+	ListenerQUIC         = "quic"         // an mqtt over quic listener, which requires a tls profile
+	ListenerUnix         = "unix"         // an mqtt over unix socket listener
+	ListenerWebTransport = "webtransport" // an experimental mqtt over webtransport listener, which requires a tls profile
+)
+
+// TlsProfileDefault is the tls profile of configured listeners serving the mqtt tls certificate.
+const TlsProfileDefault = "default"
+
 const (
 	BridgeWayNone uint = iota
 	BridgeWayKafka
+	BridgeWayMqtt
+	BridgeWayAws
+	BridgeWayInfluxDB
 )
 
 var (
 	ErrAuthWay     = errors.New("auth-way is incorrectly configured")
+	ErrAuthChain   = errors.New("auth chain datasources must be distinct and not free")
 	ErrStorageWay  = errors.New("only redis can be used in cluster mode")
+	ErrEncryption  = errors.New("storage-encryption is only supported by the bolt and badger storage")
 	ErrClusterOpts = errors.New("cluster options must be configured")
+	ErrStandbyWay  = errors.New("only redis can be used in standby mode")
 
 	ErrAppendCerts      = errors.New("append ca cert failure")
 	ErrMissingCertOrKey = errors.New("missing server certificate or private key files")
+	ErrClientAuth       = errors.New("client-auth must be require or optional")
+	ErrRevocationCA     = errors.New("crl-files and ocsp-check require a ca-cert")
+
+	ErrListenerConfig = errors.New("listeners must have an id and an address")
+	ErrListenerType   = errors.New("listener type must be tcp, ws, quic, unix or webtransport")
+	ErrTlsProfile     = errors.New("listener tls profile is not configured")
 )
 
 func New() *Config {
@@ -82,49 +132,184 @@ func parse(buf []byte) (*Config, error) {
 }
 
 type Config struct {
-	StorageWay  uint        `yaml:"storage-way"`
-	StoragePath string      `yaml:"storage-path"`
-	BridgeWay   uint        `yaml:"bridge-way"`
-	BridgePath  string      `yaml:"bridge-path"`
-	Auth        auth        `yaml:"auth"`
-	Mqtt        mqtt        `yaml:"mqtt"`
-	Cluster     Cluster     `yaml:"cluster"`
-	Redis       redis       `yaml:"redis"`
-	Log         log.Options `yaml:"log"`
-	PprofEnable bool        `yaml:"pprof-enable"`
+	StorageWay         uint                `yaml:"storage-way"`
+	StoragePath        string              `yaml:"storage-path"`
+	StorageExpiry      storageExpiry       `yaml:"storage-expiry"`       // the expiry of records kept by storage ways 1, 2, 3, 7 and 8
+	StorageWriteBehind writeBehind         `yaml:"storage-write-behind"` // the buffering of the writes of storage ways 1, 2 and 3
+	StorageEncryption  encryption          `yaml:"storage-encryption"`   // the encryption at rest of storage ways 1 and 2
+	BridgeWay          uint                `yaml:"bridge-way"`
+	BridgePath         string              `yaml:"bridge-path"`
+	UsageExport        usage.Options       `yaml:"usage-export"`
+	ObjectStore        objectstore.Options `yaml:"object-store"` // the bucket scheduled export jobs upload snapshots to
+	Security           security.Options    `yaml:"security-events"`
+	Est                est.Options         `yaml:"est"`
+	Auth               auth                `yaml:"auth"`
+	Mqtt               mqtt                `yaml:"mqtt"`
+	Cluster            Cluster             `yaml:"cluster"`
+	Redis              redis               `yaml:"redis"`
+	Badger             badger              `yaml:"badger"`    // the tuning of storage way 2
+	Memory             memory              `yaml:"memory"`    // the snapshots of storage way 6
+	Postgres           postgres            `yaml:"postgres"`  // the database of storage way 4
+	Cassandra          cassandra           `yaml:"cassandra"` // the cluster of storage way 7
+	DynamoDB           dynamoDB            `yaml:"dynamodb"`  // the table of storage way 8
+	Standby            standby.Options     `yaml:"standby"`
+	Outbound           plugin.Outbound     `yaml:"outbound"`
+	Log                log.Options         `yaml:"log"`
+	PprofEnable        bool                `yaml:"pprof-enable"`
 }
 
 type auth struct {
-	Way           uint   `yaml:"way"`
-	Datasource    uint   `yaml:"datasource"`
-	ConfPath      string `yaml:"conf-path"`
-	BlacklistPath string `yaml:"blacklist-path"`
+	Way             uint             `yaml:"way"`
+	Datasource      uint             `yaml:"datasource"`
+	ConfPath        string           `yaml:"conf-path"`
+	BlacklistPath   string           `yaml:"blacklist-path"`
+	BlacklistReload int64            `yaml:"blacklist-reload"` // seconds between checks of the blacklist file for changes, 0 disables reloading
+	Chain           []AuthLink       `yaml:"chain"`            // further datasources tried in order for clients unknown to the previous datasources
+	AnonymousACL    mqttauth.Filters `yaml:"anonymous-acl"`    // the access of clients without a username to the topics matching each filter, with auth way 3
+}
+
+// AuthLink is a datasource of an auth chain.
+type AuthLink struct {
+	Datasource uint   `yaml:"datasource"`
+	ConfPath   string `yaml:"conf-path"`
 }
 
 type mqtt struct {
-	TCP     string         `yaml:"tcp"`
-	WS      string         `yaml:"ws"`
-	HTTP    string         `yaml:"http"`
-	Tls     tls            `yaml:"tls"`
-	Options comqtt.Options `yaml:"options"`
+	TCP              string                          `yaml:"tcp"`
+	WS               string                          `yaml:"ws"`
+	QUIC             string                          `yaml:"quic"`
+	TCPAcceptors     int                             `yaml:"tcp-acceptors"` // sockets opened with SO_REUSEPORT by each tcp listener, each with its own accept loop
+	TCPSocket        *listeners.SocketConfig         `yaml:"tcp-socket"`    // keepalive, buffers, nodelay and linger of the connections of the tcp listeners
+	TCP6             string                          `yaml:"tcp6"`          // ipv6 address of a separate tcp listener, the tcp listener serves only ipv4 when set
+	WS6              string                          `yaml:"ws6"`           // ipv6 address of a separate websocket listener, the ws listener serves only ipv4 when set
+	QUIC6            string                          `yaml:"quic6"`         // ipv6 address of a separate quic listener, the quic listener serves only ipv4 when set
+	Websocket        *listeners.WebsocketConfig      `yaml:"websocket"`     // path, origin checks and compression of the websocket listeners
+	CoAP             string                          `yaml:"coap"`          // udp address of the coap gateway listener, disabled if empty
+	Mux              string                          `yaml:"mux"`           // tcp address serving mqtt, mqtt over websockets and the http api on one port, e.g. :443, disabled if empty
+	HTTP             string                          `yaml:"http"`
+	ProxyProtocol    bool                            `yaml:"proxy-protocol"`
+	Tls              tls                             `yaml:"tls"`
+	HTTPTls          tls                             `yaml:"http-tls"`           // certificate of the http listener, served over https when set
+	HTTPAuth         *listeners.HTTPAuth             `yaml:"http-auth"`          // read-only and admin credentials required by the http api of the http and mux listeners
+	TlsProfiles      map[string]tls                  `yaml:"tls-profiles"`       // named certificates of the configured listeners
+	Listeners        []Listener                      `yaml:"listeners"`          // listeners served besides the default tcp, ws and http listeners, e.g. tls on 8883 and an internal port
+	ListenerAuth     map[string]listeners.AuthPolicy `yaml:"listener-auth"`      // auth policies keyed on listener id, tcp, ws, quic, tcp6, ws6, quic6, coap or mux
+	ListenerIPFilter map[string]*listeners.IPFilter  `yaml:"listener-ip-filter"` // ip allow and deny lists keyed on listener id, including stats
+	Options          comqtt.Options                  `yaml:"options"`
 }
 
 type tls struct {
-	CACert     string `yaml:"ca-cert"`
-	ServerCert string `yaml:"server-cert"`
-	ServerKey  string `yaml:"server-key"`
+	CACert       string   `yaml:"ca-cert"`
+	ServerCert   string   `yaml:"server-cert"`
+	ServerKey    string   `yaml:"server-key"`
+	ClientAuth   string   `yaml:"client-auth"`
+	OCSPStapling bool     `yaml:"ocsp-stapling"` // staple the ocsp response of the server certificate to handshakes
+	CRLFiles     []string `yaml:"crl-files"`     // revocation lists client certificates are checked against
+	OCSPCheck    bool     `yaml:"ocsp-check"`    // check client certificates with their ocsp responders
+	SoftFail     bool     `yaml:"soft-fail"`     // accept client certificates whose revocation status is unavailable
+}
+
+// Listener is a listener served besides the default listeners, with its own address,
+// tls profile and options.
+type Listener struct {
+	ID            string                     `yaml:"id"`             // unique id of the listener, which also keys its listener-auth and listener-ip-filter
+	Type          string                     `yaml:"type"`           // tcp, ws, quic, unix or webtransport
+	Address       string                     `yaml:"address"`        // address to listen on, or the socket file of a unix listener
+	Tls           string                     `yaml:"tls"`            // default for the mqtt tls certificate, or the name of a tls profile, plain if empty
+	ProxyProtocol bool                       `yaml:"proxy-protocol"` // tcp connections begin with a PROXY protocol v1 or v2 header
+	Family        string                     `yaml:"family"`         // ipv4 or ipv6 to serve only one address family
+	Acceptors     int                        `yaml:"acceptors"`      // sockets opened with SO_REUSEPORT by a tcp listener
+	Socket        *listeners.SocketConfig    `yaml:"socket"`         // keepalive, buffers, nodelay and linger of the connections of a tcp listener
+	Websocket     *listeners.WebsocketConfig `yaml:"websocket"`      // path, origin checks and compression of a ws listener, or path and origin checks of a webtransport listener
 }
 
 type redisOptions struct {
-	Addr     string `json:"addr" yaml:"addr"`
-	Username string `json:"username" yaml:"username"`
-	Password string `json:"password" yaml:"password"`
-	DB       int    `json:"db" yaml:"db"`
+	Addr             string   `json:"addr" yaml:"addr"`
+	Addrs            []string `json:"addrs" yaml:"addrs"`               // seed nodes of a redis cluster or the sentinels of a failover group, used instead of addr if set
+	ClusterMode      bool     `json:"cluster-mode" yaml:"cluster-mode"` // whether addr is the configuration endpoint of a redis cluster
+	MasterName       string   `json:"master-name" yaml:"master-name"`   // the master monitored by the sentinels, enabling sentinel failover
+	Username         string   `json:"username" yaml:"username"`
+	Password         string   `json:"password" yaml:"password"`
+	SentinelUsername string   `json:"sentinel-username" yaml:"sentinel-username"`
+	SentinelPassword string   `json:"sentinel-password" yaml:"sentinel-password"`
+	DB               int      `json:"db" yaml:"db"` // not supported by a redis cluster
 }
 
 type redis struct {
-	HPrefix string `json:"prefix" yaml:"prefix"`
-	Options redisOptions
+	HPrefix  string `json:"prefix" yaml:"prefix"`
+	Options  redisOptions
+	Pipeline bool `json:"pipeline" yaml:"pipeline"` // send concurrent writes of the storage in pipelines
+	Multi    bool `json:"multi" yaml:"multi"`       // apply each pipeline in a MULTI/EXEC transaction
+
+	Health storage.HealthOptions `json:"health" yaml:"health"` // background pings and circuit breaking of the storage connection
+}
+
+type storageExpiry struct {
+	Retained   int64 `json:"retained" yaml:"retained"`       // seconds after which stored retained messages are deleted, 0 keeps them
+	Inflight   int64 `json:"inflight" yaml:"inflight"`       // seconds after which stored inflight messages are deleted, 0 keeps them
+	Session    int64 `json:"session" yaml:"session"`         // seconds after which the sessions of disconnected clients are deleted, 0 keeps them
+	GcInterval int64 `json:"gc-interval" yaml:"gc-interval"` // seconds between deleting expired records, an hour if 0
+
+	SessionInterval bool `json:"session-interval" yaml:"session-interval"` // delete sessions once their session expiry interval elapses
+}
+
+type writeBehind struct {
+	Enable   bool  `json:"enable" yaml:"enable"`
+	Size     int   `json:"size" yaml:"size"`         // most writes buffered before writers wait for a flush
+	Batch    int   `json:"batch" yaml:"batch"`       // buffered writes which trigger a flush before the interval elapses
+	Interval int64 `json:"interval" yaml:"interval"` // milliseconds a write is buffered at most
+}
+
+type encryption struct {
+	Key          string   `json:"key" yaml:"key"`                     // base64 encoded 16, 24 or 32 byte AES key, enables encryption if any key is set
+	KeyEnv       string   `json:"key-env" yaml:"key-env"`             // environment variable holding the key, overriding key
+	KeyFile      string   `json:"key-file" yaml:"key-file"`           // file holding the key, overriding key-env and key
+	PreviousKeys []string `json:"previous-keys" yaml:"previous-keys"` // base64 encoded keys which only decrypt values written before the key was rotated
+}
+
+type badger struct {
+	GcInterval       int64   `json:"gc-interval" yaml:"gc-interval"`                 // seconds between value log garbage collections, 5 minutes if 0, never if negative
+	GcDiscardRatio   float64 `json:"gc-discard-ratio" yaml:"gc-discard-ratio"`       // fraction of a value log file which must be discardable to rewrite it, 0.5 if 0
+	MaxTableSize     int64   `json:"max-table-size" yaml:"max-table-size"`           // bytes of each memtable and of the tables they are flushed to
+	NumMemtables     int     `json:"num-memtables" yaml:"num-memtables"`             // memtables held in memory before writes wait for them to be flushed
+	NumCompactors    int     `json:"num-compactors" yaml:"num-compactors"`           // goroutines compacting the tables
+	ValueLogFileSize int64   `json:"value-log-file-size" yaml:"value-log-file-size"` // bytes of each value log file
+	ValueThreshold   int     `json:"value-threshold" yaml:"value-threshold"`         // values of at least this many bytes are kept in the value log
+}
+
+type memory struct {
+	SnapshotInterval int64 `json:"snapshot-interval" yaml:"snapshot-interval"` // seconds between snapshots, 10 if 0, only on shutdown if negative
+}
+
+type postgres struct {
+	Dsn          string `json:"dsn" yaml:"dsn"`
+	Prefix       string `json:"prefix" yaml:"prefix"`
+	MaxOpenConns int    `json:"max-open-conns" yaml:"max-open-conns"`
+}
+
+type cassandra struct {
+	Hosts           []string `json:"hosts" yaml:"hosts"`
+	Keyspace        string   `json:"keyspace" yaml:"keyspace"`
+	Replication     string   `json:"replication" yaml:"replication"`
+	Prefix          string   `json:"prefix" yaml:"prefix"`
+	Username        string   `json:"username" yaml:"username"`
+	Password        string   `json:"password" yaml:"password"`
+	Timeout         int64    `json:"timeout" yaml:"timeout"`                   // seconds allowed for each query, 5 if 0
+	Consistency     string   `json:"consistency" yaml:"consistency"`           // consistency level of writes, local_quorum if empty
+	ReadConsistency string   `json:"read-consistency" yaml:"read-consistency"` // consistency level of reads, that of writes if empty
+}
+
+type dynamoDB struct {
+	Table           string `json:"table" yaml:"table"`
+	Region          string `json:"region" yaml:"region"`
+	Endpoint        string `json:"endpoint" yaml:"endpoint"`
+	AccessKeyID     string `json:"access-key-id" yaml:"access-key-id"`
+	SecretAccessKey string `json:"secret-access-key" yaml:"secret-access-key"`
+	BillingMode     string `json:"billing-mode" yaml:"billing-mode"` // on-demand or provisioned, on-demand if empty
+	ReadCapacity    int64  `json:"read-capacity" yaml:"read-capacity"`
+	WriteCapacity   int64  `json:"write-capacity" yaml:"write-capacity"`
+	TTLAttribute    string `json:"ttl-attribute" yaml:"ttl-attribute"`
+	ConsistentRead  bool   `json:"consistent-read" yaml:"consistent-read"`
 }
 
 type Cluster struct {
@@ -144,22 +329,81 @@ type Cluster struct {
 	RaftLogLevel         string            `yaml:"raft-log-level" json:"raft-log-level"`
 	GrpcEnable           bool              `yaml:"grpc-enable" json:"grpc-enable"`
 	GrpcPort             int               `yaml:"grpc-port" json:"grpc-port"`
+	SnapshotBootstrap    bool              `yaml:"snapshot-bootstrap" json:"snapshot-bootstrap"`
 	InboundPoolSize      int               `yaml:"inbound-pool-size" json:"inbound-pool-size"`
 	OutboundPoolSize     int               `yaml:"outbound-pool-size" json:"outbound-pool-size"`
 	InoutPoolNonblocking bool              `yaml:"inout-pool-nonblocking" json:"inout-pool-nonblocking"`
 	NodesFileDir         string            `yaml:"nodes-file-dir" json:"nodes-file-dir"`
+	RelaySpoolSize       int               `yaml:"relay-spool-size" json:"relay-spool-size"`
+	RelaySpoolDir        string            `yaml:"relay-spool-dir" json:"relay-spool-dir"`
+}
+
+// AdvertiseHost returns the host advertised to other nodes for gossip, raft and grpc, the
+// advertise address if set, or else the bind address. IPv6 hosts are returned without
+// brackets, to be joined with ports by net.JoinHostPort.
+func (c *Cluster) AdvertiseHost() string {
+	if c.AdvertiseAddr != "" {
+		return c.AdvertiseAddr
+	}
+
+	return c.BindAddr
+}
+
+// GenOutboundDialer returns the dialer of the redis and cluster relay connections, or nil
+// if no outbound option is set so that the clients keep their default dialers.
+func GenOutboundDialer(conf *Config) (plugin.DialFunc, error) {
+	if !conf.Outbound.Enabled() {
+		return nil, nil
+	}
+
+	return conf.Outbound.Dialer()
 }
 
 func GenTlsConfig(conf *Config) (*tls2.Config, error) {
-	if conf.Mqtt.Tls.ServerKey == "" && conf.Mqtt.Tls.ServerCert == "" {
+	return genTlsConfig(conf.Mqtt.Tls)
+}
+
+// GenHTTPTlsConfig returns the tls config of the http listener, or nil if the http
+// listener has no certificate of its own.
+func GenHTTPTlsConfig(conf *Config) (*tls2.Config, error) {
+	return genTlsConfig(conf.Mqtt.HTTPTls)
+}
+
+// GenListenerTlsConfig returns the tls config of a tls profile, the mqtt tls certificate
+// if the profile is default, or nil if the profile is empty.
+func GenListenerTlsConfig(conf *Config, profile string) (*tls2.Config, error) {
+	if profile == "" {
+		return nil, nil
+	}
+
+	t := conf.Mqtt.Tls
+	if profile != TlsProfileDefault {
+		var ok bool
+		if t, ok = conf.Mqtt.TlsProfiles[profile]; !ok {
+			return nil, ErrTlsProfile
+		}
+	}
+
+	tlsConfig, err := genTlsConfig(t)
+	if err == nil && tlsConfig == nil {
+		return nil, ErrMissingCertOrKey
+	}
+
+	return tlsConfig, err
+}
+
+// genTlsConfig returns the tls config of a server certificate, verifying client
+// certificates if a ca certificate is set, or nil if no certificate is set.
+func genTlsConfig(t tls) (*tls2.Config, error) {
+	if t.ServerKey == "" && t.ServerCert == "" {
 		return nil, nil
 	}
 
-	if conf.Mqtt.Tls.ServerKey == "" || conf.Mqtt.Tls.ServerCert == "" {
+	if t.ServerKey == "" || t.ServerCert == "" {
 		return nil, ErrMissingCertOrKey
 	}
 
-	cert, err := tls2.LoadX509KeyPair(conf.Mqtt.Tls.ServerCert, conf.Mqtt.Tls.ServerKey)
+	cert, err := tls2.LoadX509KeyPair(t.ServerCert, t.ServerKey)
 	if err != nil {
 		return nil, err
 	}
@@ -169,8 +413,8 @@ func GenTlsConfig(conf *Config) (*tls2.Config, error) {
 	}
 
 	// enable bidirectional authentication
-	if conf.Mqtt.Tls.CACert != "" {
-		pem, err := os.ReadFile(conf.Mqtt.Tls.CACert)
+	if t.CACert != "" {
+		pem, err := os.ReadFile(t.CACert)
 		if err != nil {
 			return nil, err
 		}
@@ -181,7 +425,29 @@ func GenTlsConfig(conf *Config) (*tls2.Config, error) {
 
 		tlsConfig.RootCAs = pool
 		tlsConfig.ClientCAs = pool
-		tlsConfig.ClientAuth = tls2.RequireAndVerifyClientCert
+		switch t.ClientAuth {
+		case "", ClientAuthRequire:
+			tlsConfig.ClientAuth = tls2.RequireAndVerifyClientCert
+		case ClientAuthOptional:
+			tlsConfig.ClientAuth = tls2.VerifyClientCertIfGiven
+		default:
+			return nil, ErrClientAuth
+		}
+	}
+
+	opts := revocation.Options{
+		OCSPStapling: t.OCSPStapling,
+		CRLFiles:     t.CRLFiles,
+		OCSPCheck:    t.OCSPCheck,
+		SoftFail:     t.SoftFail,
+	}
+	if opts.ChecksClients() && t.CACert == "" {
+		return nil, ErrRevocationCA
+	}
+	if opts.Enabled() {
+		if err := revocation.Apply(tlsConfig, opts); err != nil {
+			return nil, err
+		}
 	}
 
 	return tlsConfig, nil
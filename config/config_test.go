@@ -5,10 +5,21 @@
 package config
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/listeners"
 )
 
 var buf = []byte(`
@@ -73,6 +84,9 @@ func TestLoadConfigFromFile(t *testing.T) {
 	require.Equal(t, 7946, cfg.Cluster.BindPort)
 	require.Equal(t, "127.0.0.1:6379", cfg.Redis.Options.Addr)
 	require.Equal(t, 10240, cfg.Cluster.QueueDepth)
+	require.Equal(t, 10*time.Second, cfg.UsageExport.Timeout)
+	require.False(t, cfg.Est.Enable)
+	require.Equal(t, 365*24*time.Hour, cfg.Est.Validity)
 
 	fmt.Println(cfg)
 }
@@ -85,3 +99,278 @@ func TestParse(t *testing.T) {
 	require.Equal(t, "127.0.0.1:6379", cfg.Redis.Options.Addr)
 	require.Equal(t, 10240, cfg.Cluster.QueueDepth)
 }
+
+func TestParseListenerAuth(t *testing.T) {
+	cfg, err := parse([]byte(`
+mqtt:
+  listener-auth:
+    tcp:
+      anonymous: true
+    ws:
+      hooks: [auth-redis]
+`))
+	require.NoError(t, err)
+	require.True(t, cfg.Mqtt.ListenerAuth["tcp"].Anonymous)
+	require.Equal(t, []string{"auth-redis"}, cfg.Mqtt.ListenerAuth["ws"].Hooks)
+}
+
+func TestClusterAdvertiseHost(t *testing.T) {
+	c := &Cluster{BindAddr: "::"}
+	require.Equal(t, "::", c.AdvertiseHost())
+
+	c.AdvertiseAddr = "2001:db8::10"
+	require.Equal(t, "2001:db8::10", c.AdvertiseHost())
+}
+
+func TestParseDualStack(t *testing.T) {
+	cfg, err := parse([]byte(`
+mqtt:
+  tcp: 0.0.0.0:1883
+  tcp6: "[::]:1883"
+  ws6: "[::]:1882"
+  quic6: "[::]:14567"
+  options:
+    maximum-connections-ipv4: 100
+    maximum-connections-ipv6: 50
+`))
+	require.NoError(t, err)
+	require.Equal(t, "[::]:1883", cfg.Mqtt.TCP6)
+	require.Equal(t, "[::]:1882", cfg.Mqtt.WS6)
+	require.Equal(t, "[::]:14567", cfg.Mqtt.QUIC6)
+	require.Equal(t, int64(100), cfg.Mqtt.Options.MaximumConnectionsIPv4)
+	require.Equal(t, int64(50), cfg.Mqtt.Options.MaximumConnectionsIPv6)
+}
+
+func TestParseWebsocket(t *testing.T) {
+	cfg, err := parse([]byte(`
+mqtt:
+  websocket:
+    path: /mqtt
+    allowed-origins: [https://app.example.com, "*.example.org"]
+    compression: true
+    compression-level: 3
+`))
+	require.NoError(t, err)
+	require.Equal(t, &listeners.WebsocketConfig{
+		Path:             "/mqtt",
+		AllowedOrigins:   []string{"https://app.example.com", "*.example.org"},
+		Compression:      true,
+		CompressionLevel: 3,
+	}, cfg.Mqtt.Websocket)
+}
+
+func TestParseTCPSocket(t *testing.T) {
+	cfg, err := parse([]byte(`
+mqtt:
+  tcp-acceptors: 4
+  tcp-socket:
+    keepalive: 300
+    read-buffer: 4096
+    write-buffer: 8192
+    no-delay: false
+    linger: 0
+`))
+	require.NoError(t, err)
+	require.Equal(t, 4, cfg.Mqtt.TCPAcceptors)
+
+	noDelay, linger := false, 0
+	require.Equal(t, &listeners.SocketConfig{
+		KeepAlive:   300,
+		ReadBuffer:  4096,
+		WriteBuffer: 8192,
+		NoDelay:     &noDelay,
+		Linger:      &linger,
+	}, cfg.Mqtt.TCPSocket)
+}
+
+func TestParseListenerIPFilter(t *testing.T) {
+	cfg, err := parse([]byte(`
+mqtt:
+  listener-ip-filter:
+    stats:
+      allow: [10.0.0.0/8]
+      deny: [10.0.5.0/24, 10.0.6.1]
+`))
+	require.NoError(t, err)
+	require.Len(t, cfg.Mqtt.ListenerIPFilter, 1)
+
+	f := cfg.Mqtt.ListenerIPFilter["stats"]
+	require.Equal(t, []string{"10.0.0.0/8"}, f.Allow)
+	require.Equal(t, []string{"10.0.5.0/24", "10.0.6.1"}, f.Deny)
+	require.NoError(t, f.Compile())
+	require.True(t, f.Allowed("10.0.0.1:8080"))
+	require.False(t, f.Allowed("10.0.6.1:8080"))
+}
+
+func TestParseHTTPAuth(t *testing.T) {
+	cfg, err := parse([]byte(`
+mqtt:
+  http-tls:
+    server-cert: http.pem
+    server-key: http.key
+  http-auth:
+    read-tokens: [r1]
+    admin-tokens: [a1, a2]
+    read-users:
+      viewer: view-pass
+    admin-users:
+      admin: admin-pass
+    public: [/livez]
+`))
+	require.NoError(t, err)
+	require.Equal(t, "http.pem", cfg.Mqtt.HTTPTls.ServerCert)
+	require.Equal(t, "http.key", cfg.Mqtt.HTTPTls.ServerKey)
+	require.Equal(t, &listeners.HTTPAuth{
+		ReadTokens:  []string{"r1"},
+		AdminTokens: []string{"a1", "a2"},
+		ReadUsers:   map[string]string{"viewer": "view-pass"},
+		AdminUsers:  map[string]string{"admin": "admin-pass"},
+		Public:      []string{"/livez"},
+	}, cfg.Mqtt.HTTPAuth)
+}
+
+func TestGenHTTPTlsConfig(t *testing.T) {
+	conf := New()
+	tlsConfig, err := GenHTTPTlsConfig(conf)
+	require.NoError(t, err)
+	require.Nil(t, tlsConfig)
+
+	conf.Mqtt.HTTPTls.ServerKey = "http.key"
+	_, err = GenHTTPTlsConfig(conf)
+	require.ErrorIs(t, err, ErrMissingCertOrKey)
+}
+
+// writeTestCert writes a self-signed certificate, its key and an empty revocation list
+// signed by it to a directory.
+func writeTestCert(t *testing.T, dir string) (cert, key, crl string) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &k.PublicKey, k)
+	require.NoError(t, err)
+	parsed, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	kb, err := x509.MarshalPKCS8PrivateKey(k)
+	require.NoError(t, err)
+	crlDer, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(time.Hour),
+	}, parsed, k)
+	require.NoError(t, err)
+
+	cert, key, crl = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.crl")
+	require.NoError(t, os.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: kb}), 0600))
+	require.NoError(t, os.WriteFile(crl, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlDer}), 0600))
+	return
+}
+
+func TestParseTlsRevocation(t *testing.T) {
+	cfg, err := parse([]byte(`
+mqtt:
+  tls:
+    ocsp-stapling: true
+    crl-files: [ca.crl]
+    ocsp-check: true
+    soft-fail: true
+`))
+	require.NoError(t, err)
+	require.True(t, cfg.Mqtt.Tls.OCSPStapling)
+	require.Equal(t, []string{"ca.crl"}, cfg.Mqtt.Tls.CRLFiles)
+	require.True(t, cfg.Mqtt.Tls.OCSPCheck)
+	require.True(t, cfg.Mqtt.Tls.SoftFail)
+}
+
+func TestGenTlsConfigRevocation(t *testing.T) {
+	cert, key, crl := writeTestCert(t, t.TempDir())
+
+	conf := New()
+	conf.Mqtt.Tls = tls{ServerCert: cert, ServerKey: key, CRLFiles: []string{crl}}
+	_, err := GenTlsConfig(conf)
+	require.ErrorIs(t, err, ErrRevocationCA)
+
+	conf.Mqtt.Tls.CACert = cert
+	tlsConfig, err := GenTlsConfig(conf)
+	require.NoError(t, err)
+	require.NotNil(t, tlsConfig.VerifyPeerCertificate)
+
+	conf.Mqtt.Tls.CRLFiles = nil
+	tlsConfig, err = GenTlsConfig(conf)
+	require.NoError(t, err)
+	require.Nil(t, tlsConfig.VerifyPeerCertificate)
+
+	conf.Mqtt.Tls.OCSPStapling = true
+	_, err = GenTlsConfig(conf)
+	require.Error(t, err) // the self-signed certificate has no issuer to staple a response from
+}
+
+func TestParseListeners(t *testing.T) {
+	cfg, err := parse([]byte(`
+mqtt:
+  tls-profiles:
+    public:
+      server-cert: public.pem
+      server-key: public.key
+  listeners:
+    - id: tls
+      type: tcp
+      address: :8883
+      tls: public
+      acceptors: 4
+    - id: internal
+      type: ws
+      address: 10.0.0.1:8083
+      family: ipv4
+      websocket:
+        path: /mqtt
+`))
+	require.NoError(t, err)
+	require.Equal(t, "public.pem", cfg.Mqtt.TlsProfiles["public"].ServerCert)
+	require.Equal(t, []Listener{
+		{ID: "tls", Type: ListenerTCP, Address: ":8883", Tls: "public", Acceptors: 4},
+		{ID: "internal", Type: ListenerWebsocket, Address: "10.0.0.1:8083", Family: "ipv4", Websocket: &listeners.WebsocketConfig{Path: "/mqtt"}},
+	}, cfg.Mqtt.Listeners)
+}
+
+func TestGenListenerTlsConfig(t *testing.T) {
+	conf := New()
+	tlsConfig, err := GenListenerTlsConfig(conf, "")
+	require.NoError(t, err)
+	require.Nil(t, tlsConfig)
+
+	_, err = GenListenerTlsConfig(conf, TlsProfileDefault)
+	require.ErrorIs(t, err, ErrMissingCertOrKey)
+
+	_, err = GenListenerTlsConfig(conf, "public")
+	require.ErrorIs(t, err, ErrTlsProfile)
+
+	conf.Mqtt.TlsProfiles = map[string]tls{"public": {ServerCert: "public.pem"}}
+	_, err = GenListenerTlsConfig(conf, "public")
+	require.ErrorIs(t, err, ErrMissingCertOrKey)
+}
+
+func TestGenOutboundDialer(t *testing.T) {
+	conf := New()
+	dial, err := GenOutboundDialer(conf)
+	require.NoError(t, err)
+	require.Nil(t, dial)
+
+	conf.Outbound.LocalAddr = "127.0.0.1"
+	dial, err = GenOutboundDialer(conf)
+	require.NoError(t, err)
+	require.NotNil(t, dial)
+
+	conf.Outbound.Proxy = "ftp://127.0.0.1:21"
+	_, err = GenOutboundDialer(conf)
+	require.Error(t, err)
+}
@@ -0,0 +1,128 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+const (
+	// AnnotationPrefix prefixes the user properties with which the broker annotates messages.
+	// Properties with the prefix sent by clients are removed from annotated messages, so
+	// that clients cannot forge them.
+	AnnotationPrefix = "comqtt-"
+
+	AnnotationNodeProperty     = AnnotationPrefix + "node"      // the name of the node which received the message
+	AnnotationReceivedProperty = AnnotationPrefix + "received"  // the RFC 3339 time the message was received
+	AnnotationClientProperty   = AnnotationPrefix + "client-id" // the id of the client which published the message
+	AnnotationTenantProperty   = AnnotationPrefix + "tenant"    // the tenant of the client which published the message
+)
+
+var ErrAnnotationInvalidFilter = errors.New("annotation rule filter is invalid")
+
+// AnnotationRule selects the metadata annotated on messages published to topics matching its filter.
+type AnnotationRule struct {
+	Filter    string `yaml:"filter" json:"filter"`       // the topic filter the rule applies to
+	Node      bool   `yaml:"node" json:"node"`           // annotate the name of the receiving node
+	Timestamp bool   `yaml:"timestamp" json:"timestamp"` // annotate the time the message was received
+	ClientID  bool   `yaml:"client-id" json:"client_id"` // annotate the id of the publishing client
+	Tenant    bool   `yaml:"tenant" json:"tenant"`       // annotate the tenant of the publishing client
+}
+
+// AnnotationPolicy configures the annotation of published messages with broker metadata as
+// MQTT v5 user properties, giving subscribers and bridges the provenance of each message
+// without changes to its payload. Subscribers using MQTT v3 do not receive user properties.
+type AnnotationPolicy struct {
+	// Node is the node name annotated on messages. Cluster nodes default to their node name.
+	Node string `yaml:"node" json:"node"`
+
+	// Rules are the ordered annotation rules, the first rule matching the topic of a message applies.
+	Rules []AnnotationRule `yaml:"rules" json:"rules"`
+}
+
+// Validate returns an error if the filter of a rule is not valid.
+func (p *AnnotationPolicy) Validate() error {
+	for _, rule := range p.Rules {
+		if !IsValidFilter(rule.Filter, false) {
+			return ErrAnnotationInvalidFilter
+		}
+	}
+
+	return nil
+}
+
+// rule returns the first rule matching a topic.
+func (p *AnnotationPolicy) rule(topic string) (AnnotationRule, bool) {
+	if p == nil {
+		return AnnotationRule{}, false
+	}
+
+	for _, rule := range p.Rules {
+		if matchTopicFilter(rule.Filter, topic) {
+			return rule, true
+		}
+	}
+
+	return AnnotationRule{}, false
+}
+
+// annotate returns the packet with the metadata of the rule matching its topic added as
+// user properties, replacing any annotation properties sent by the client.
+func (s *Server) annotate(cl *Client, pk packets.Packet, now time.Time) packets.Packet {
+	if cl.Net.Inline {
+		return pk
+	}
+
+	rule, ok := s.Options.Annotation.rule(pk.TopicName)
+	if !ok {
+		return pk
+	}
+
+	user := make([]packets.UserProperty, 0, len(pk.Properties.User)+4)
+	for _, v := range pk.Properties.User {
+		if !strings.HasPrefix(v.Key, AnnotationPrefix) {
+			user = append(user, v)
+		}
+	}
+
+	if rule.Node && s.Options.Annotation.Node != "" {
+		user = append(user, packets.UserProperty{Key: AnnotationNodeProperty, Val: s.Options.Annotation.Node})
+	}
+
+	if rule.Timestamp {
+		user = append(user, packets.UserProperty{Key: AnnotationReceivedProperty, Val: now.UTC().Format(time.RFC3339Nano)})
+	}
+
+	if rule.ClientID {
+		user = append(user, packets.UserProperty{Key: AnnotationClientProperty, Val: cl.ID})
+	}
+
+	if rule.Tenant {
+		user = append(user, packets.UserProperty{Key: AnnotationTenantProperty, Val: ClientTenant(cl)})
+	}
+
+	pk.Properties.User = user
+	return pk
+}
+
+// Annotations returns the broker metadata annotated on a message, keyed on the property
+// names without the annotation prefix, or nil if it has none.
+func Annotations(pk packets.Packet) map[string]string {
+	var m map[string]string
+	for _, v := range pk.Properties.User {
+		if k, ok := strings.CutPrefix(v.Key, AnnotationPrefix); ok {
+			if m == nil {
+				m = make(map[string]string)
+			}
+			m[k] = v.Val
+		}
+	}
+
+	return m
+}
@@ -0,0 +1,120 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+func TestAnnotationPolicyValidate(t *testing.T) {
+	require.NoError(t, (&AnnotationPolicy{Rules: []AnnotationRule{{Filter: "a/#"}}}).Validate())
+	require.ErrorIs(t, (&AnnotationPolicy{Rules: []AnnotationRule{{Filter: "a/#/b"}}}).Validate(), ErrAnnotationInvalidFilter)
+}
+
+func TestAnnotationPolicyRule(t *testing.T) {
+	var p *AnnotationPolicy
+	_, ok := p.rule("a/b")
+	require.False(t, ok)
+
+	p = &AnnotationPolicy{Rules: []AnnotationRule{
+		{Filter: "a/private/#"},
+		{Filter: "a/#", Node: true},
+	}}
+
+	rule, ok := p.rule("a/private/b")
+	require.True(t, ok)
+	require.False(t, rule.Node)
+
+	rule, ok = p.rule("a/b")
+	require.True(t, ok)
+	require.True(t, rule.Node)
+
+	_, ok = p.rule("b/c")
+	require.False(t, ok)
+}
+
+func TestServerAnnotate(t *testing.T) {
+	s := newServer()
+	s.Options.Annotation = &AnnotationPolicy{
+		Node:  "node1",
+		Rules: []AnnotationRule{{Filter: "a/#", Node: true, Timestamp: true, ClientID: true, Tenant: true}},
+	}
+
+	cl, _, _ := newTestClient()
+	cl.Ext = map[string]any{TenantExtKey: "acme"}
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	pk := packets.Packet{
+		TopicName: "a/b",
+		Properties: packets.Properties{User: []packets.UserProperty{
+			{Key: "unit", Val: "celsius"},
+			{Key: AnnotationNodeProperty, Val: "forged"},
+		}},
+	}
+
+	out := s.annotate(cl, pk, now)
+	require.Equal(t, []packets.UserProperty{
+		{Key: "unit", Val: "celsius"},
+		{Key: AnnotationNodeProperty, Val: "node1"},
+		{Key: AnnotationReceivedProperty, Val: "2024-01-02T03:04:05Z"},
+		{Key: AnnotationClientProperty, Val: cl.ID},
+		{Key: AnnotationTenantProperty, Val: "acme"},
+	}, out.Properties.User)
+
+	require.Equal(t, map[string]string{
+		"node":      "node1",
+		"received":  "2024-01-02T03:04:05Z",
+		"client-id": cl.ID,
+		"tenant":    "acme",
+	}, Annotations(out))
+
+	// topics without a rule and inline clients are not annotated
+	pk.TopicName = "b/c"
+	require.Equal(t, pk, s.annotate(cl, pk, now))
+
+	pk.TopicName = "a/b"
+	cl.Net.Inline = true
+	require.Equal(t, pk, s.annotate(cl, pk, now))
+}
+
+func TestAnnotationsNone(t *testing.T) {
+	require.Nil(t, Annotations(packets.Packet{}))
+}
+
+func TestServerProcessPublishAnnotated(t *testing.T) {
+	s := newServerWithInlineClient()
+	s.Options.Annotation = &AnnotationPolicy{
+		Node:  "node1",
+		Rules: []AnnotationRule{{Filter: "a/#", Node: true}},
+	}
+
+	recv := make(chan packets.Packet, 1)
+	err := s.Subscribe("a/b", 1, func(cl *Client, sub packets.Subscription, pk packets.Packet) {
+		recv <- pk
+	})
+	require.NoError(t, err)
+
+	cl, _, _ := newTestClient()
+	cl.Properties.ProtocolVersion = 5
+	s.Clients.Add(cl)
+
+	err = s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish},
+		TopicName:   "a/b",
+		Payload:     []byte("hello"),
+	})
+	require.NoError(t, err)
+
+	select {
+	case pk := <-recv:
+		require.Equal(t, "node1", Annotations(pk)["node"])
+	case <-time.After(time.Second):
+		require.Fail(t, "no annotated message received")
+	}
+}
@@ -0,0 +1,255 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	AuthFailureUsername = "username" // failures counted for a username
+	AuthFailureIP       = "ip"       // failures counted for a source ip
+
+	defaultAuthFailureWindow = 60   // seconds failures are counted over if not configured
+	defaultAuthFailureBan    = 60   // seconds of the first ban if not configured
+	defaultAuthFailureMaxBan = 3600 // the longest ban in seconds if not configured
+)
+
+// authFailure contains the failed authentications of a username or source ip.
+type authFailure struct {
+	failures int64 // the failures counted in the current window
+	start    int64 // the unix time the current window started
+	bans     int64 // the number of times it has been banned, doubling each ban
+	until    int64 // the unix time it is banned until
+	last     int64 // the unix time of the last failure
+}
+
+// AuthFailureStat contains the failed authentications of a username or source ip.
+type AuthFailureStat struct {
+	Kind     string `json:"kind"`     // username or ip
+	Value    string `json:"value"`    // the username or source ip
+	Failures int64  `json:"failures"` // failures counted in the current window
+	Bans     int64  `json:"bans"`     // times it has been banned
+	Until    int64  `json:"until"`    // the unix time it is banned until, 0 if not banned
+}
+
+// AuthFailureStats contains the failed authentications of each username and source ip,
+// and the totals since the server started.
+type AuthFailureStats struct {
+	Failures int64             `json:"failures"` // failed authentications
+	Rejected int64             `json:"rejected"` // connections rejected while banned
+	Bans     int64             `json:"bans"`     // bans of usernames and source ips
+	Banned   int               `json:"banned"`   // usernames and source ips currently banned
+	Entries  []AuthFailureStat `json:"entries"`  // the usernames and source ips with failures or bans
+}
+
+// AuthFailures counts the failed authentications of each username and source ip, and
+// temporarily bans a username or ip which fails limit times within a window, doubling
+// the ban each time it is banned again, so that brute force attempts are rejected
+// before they reach the auth hooks.
+type AuthFailures struct {
+	internal map[string]*authFailure // failures keyed on kind and value
+	limit    int64                   // failures within the window before a ban
+	window   int64                   // seconds over which failures are counted
+	ban      int64                   // seconds of the first ban
+	maxBan   int64                   // the longest ban in seconds
+	failures int64                   // total failed authentications
+	rejected int64                   // total connections rejected while banned
+	bans     int64                   // total bans
+	sync.Mutex
+}
+
+// NewAuthFailures returns a new instance of AuthFailures, banning a username or source
+// ip for ban seconds after limit failures within window seconds, up to maxBan seconds.
+func NewAuthFailures(limit, window, ban, maxBan int64) *AuthFailures {
+	if window <= 0 {
+		window = defaultAuthFailureWindow
+	}
+	if ban <= 0 {
+		ban = defaultAuthFailureBan
+	}
+	if maxBan <= 0 {
+		maxBan = defaultAuthFailureMaxBan
+	}
+
+	return &AuthFailures{
+		internal: map[string]*authFailure{},
+		limit:    limit,
+		window:   window,
+		ban:      ban,
+		maxBan:   max(maxBan, ban),
+	}
+}
+
+// authFailureKey returns the key of the failures of a username or source ip.
+func authFailureKey(kind, value string) string {
+	return kind + ":" + value
+}
+
+// Allow returns true if neither a username nor a source ip is banned at the given time.
+// If either is banned, the seconds until the ban ends and the number of bans are returned.
+func (a *AuthFailures) Allow(username, ip string, now int64) (ok bool, backoff, bans int64) {
+	a.Lock()
+	defer a.Unlock()
+
+	for _, key := range a.keys(username, ip) {
+		if f, exists := a.internal[key]; exists && now < f.until && f.until-now > backoff {
+			backoff, bans = f.until-now, f.bans
+		}
+	}
+
+	if backoff > 0 {
+		a.rejected++
+		return false, backoff, bans
+	}
+
+	return true, 0, 0
+}
+
+// Fail counts a failed authentication of a username from a source ip at the given time,
+// banning either if it reaches the failure limit, and returns the new bans.
+func (a *AuthFailures) Fail(username, ip string, now int64) []AuthFailureStat {
+	a.Lock()
+	defer a.Unlock()
+
+	var bans []AuthFailureStat
+	a.failures++
+	for _, key := range a.keys(username, ip) {
+		f, exists := a.internal[key]
+		if !exists {
+			f = new(authFailure)
+			a.internal[key] = f
+		}
+
+		if now-f.start >= a.window {
+			f.failures, f.start = 0, now
+		}
+
+		f.failures++
+		f.last = now
+		if f.failures < a.limit {
+			continue
+		}
+
+		ban := a.ban
+		for i := int64(0); i < f.bans && ban < a.maxBan; i++ {
+			ban *= 2
+		}
+
+		f.bans++
+		f.until = now + min(ban, a.maxBan)
+		f.failures, f.start = 0, now
+		a.bans++
+
+		kind, value, _ := strings.Cut(key, ":")
+		bans = append(bans, AuthFailureStat{Kind: kind, Value: value, Bans: f.bans, Until: f.until})
+	}
+
+	return bans
+}
+
+// Succeed clears the failures of a username which authenticated successfully. The
+// failures of its source ip are kept, as they may be failures of other usernames.
+func (a *AuthFailures) Succeed(username string) {
+	if username == "" {
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	if f, ok := a.internal[authFailureKey(AuthFailureUsername, username)]; ok {
+		f.failures = 0
+	}
+}
+
+// Clear removes the failures and ban of a username or source ip, returning false if it
+// has none.
+func (a *AuthFailures) Clear(kind, value string) bool {
+	a.Lock()
+	defer a.Unlock()
+
+	key := authFailureKey(kind, value)
+	if _, ok := a.internal[key]; !ok {
+		return false
+	}
+
+	delete(a.internal, key)
+	return true
+}
+
+// ClearExpired removes the usernames and source ips which have not failed or been banned
+// for longer than the longest ban, forgetting their previous bans.
+func (a *AuthFailures) ClearExpired(now int64) {
+	a.Lock()
+	defer a.Unlock()
+
+	for key, f := range a.internal {
+		if now > max(f.last+a.window, f.until)+a.maxBan {
+			delete(a.internal, key)
+		}
+	}
+}
+
+// Stats returns the failures of each username and source ip, and the totals.
+func (a *AuthFailures) Stats(now int64) AuthFailureStats {
+	a.Lock()
+	defer a.Unlock()
+
+	stats := AuthFailureStats{
+		Failures: a.failures,
+		Rejected: a.rejected,
+		Bans:     a.bans,
+		Entries:  make([]AuthFailureStat, 0, len(a.internal)),
+	}
+
+	for _, kind := range []string{AuthFailureUsername, AuthFailureIP} {
+		for key, f := range a.internal {
+			if len(key) <= len(kind) || key[:len(kind)+1] != kind+":" {
+				continue
+			}
+
+			stat := AuthFailureStat{Kind: kind, Value: key[len(kind)+1:], Bans: f.bans}
+			if now-f.start < a.window {
+				stat.Failures = f.failures
+			}
+			if now < f.until {
+				stat.Until = f.until
+				stats.Banned++
+			}
+			stats.Entries = append(stats.Entries, stat)
+		}
+	}
+
+	sort.Slice(stats.Entries, func(i, j int) bool {
+		if stats.Entries[i].Kind != stats.Entries[j].Kind {
+			return stats.Entries[i].Kind > stats.Entries[j].Kind // usernames first
+		}
+		return stats.Entries[i].Value < stats.Entries[j].Value
+	})
+
+	return stats
+}
+
+// Len returns the number of usernames and source ips with failures or bans.
+func (a *AuthFailures) Len() int {
+	a.Lock()
+	defer a.Unlock()
+	return len(a.internal)
+}
+
+// keys returns the keys of the failures of a username and source ip, skipping either
+// if it is empty.
+func (a *AuthFailures) keys(username, ip string) []string {
+	keys := make([]string, 0, 2)
+	if username != "" {
+		keys = append(keys, authFailureKey(AuthFailureUsername, username))
+	}
+	if ip != "" {
+		keys = append(keys, authFailureKey(AuthFailureIP, ip))
+	}
+	return keys
+}
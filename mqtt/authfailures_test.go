@@ -0,0 +1,190 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+func TestNewAuthFailuresDefaults(t *testing.T) {
+	a := NewAuthFailures(3, 0, 0, 0)
+	require.Equal(t, int64(defaultAuthFailureWindow), a.window)
+	require.Equal(t, int64(defaultAuthFailureBan), a.ban)
+	require.Equal(t, int64(defaultAuthFailureMaxBan), a.maxBan)
+
+	a = NewAuthFailures(3, 10, 120, 60)
+	require.Equal(t, int64(120), a.maxBan)
+}
+
+func TestAuthFailuresBan(t *testing.T) {
+	a := NewAuthFailures(3, 60, 10, 35)
+	for i := 0; i < 2; i++ {
+		a.Fail("mochi", "10.0.0.1", 100)
+	}
+
+	ok, _, _ := a.Allow("mochi", "10.0.0.1", 100)
+	require.True(t, ok)
+
+	a.Fail("mochi", "10.0.0.1", 100)
+	ok, backoff, bans := a.Allow("mochi", "10.0.0.2", 105)
+	require.False(t, ok)
+	require.Equal(t, int64(5), backoff)
+	require.Equal(t, int64(1), bans)
+
+	ok, _, _ = a.Allow("zen", "10.0.0.1", 105)
+	require.False(t, ok)
+
+	ok, _, _ = a.Allow("zen", "10.0.0.2", 105)
+	require.True(t, ok)
+
+	ok, _, _ = a.Allow("mochi", "10.0.0.1", 110)
+	require.True(t, ok)
+}
+
+func TestAuthFailuresBackoff(t *testing.T) {
+	a := NewAuthFailures(1, 60, 10, 35)
+	for i, want := range []int64{10, 20, 35, 35} {
+		now := int64(100 * (i + 1))
+		a.Fail("mochi", "", now)
+		ok, backoff, bans := a.Allow("mochi", "", now)
+		require.False(t, ok)
+		require.Equal(t, want, backoff)
+		require.Equal(t, int64(i+1), bans)
+	}
+}
+
+func TestAuthFailuresWindow(t *testing.T) {
+	a := NewAuthFailures(2, 10, 10, 60)
+	a.Fail("mochi", "", 100)
+	a.Fail("mochi", "", 111)
+
+	ok, _, _ := a.Allow("mochi", "", 111)
+	require.True(t, ok)
+
+	a.Fail("mochi", "", 115)
+	ok, _, _ = a.Allow("mochi", "", 115)
+	require.False(t, ok)
+}
+
+func TestAuthFailuresSucceed(t *testing.T) {
+	a := NewAuthFailures(2, 60, 10, 60)
+	a.Fail("mochi", "10.0.0.1", 100)
+	a.Succeed("mochi")
+	a.Succeed("")
+	a.Fail("mochi", "10.0.0.2", 100)
+
+	ok, _, _ := a.Allow("mochi", "10.0.0.2", 100)
+	require.True(t, ok)
+
+	// the failures of the source ip are kept
+	ok, _, _ = a.Allow("zen", "10.0.0.1", 100)
+	require.True(t, ok)
+	a.Fail("zen", "10.0.0.1", 100)
+	ok, _, _ = a.Allow("zen", "10.0.0.1", 100)
+	require.False(t, ok)
+}
+
+func TestAuthFailuresClear(t *testing.T) {
+	a := NewAuthFailures(1, 60, 10, 60)
+	a.Fail("mochi", "10.0.0.1", 100)
+	require.True(t, a.Clear(AuthFailureUsername, "mochi"))
+	require.False(t, a.Clear(AuthFailureUsername, "mochi"))
+
+	ok, _, _ := a.Allow("mochi", "10.0.0.2", 100)
+	require.True(t, ok)
+
+	require.True(t, a.Clear(AuthFailureIP, "10.0.0.1"))
+	require.Equal(t, 0, a.Len())
+}
+
+func TestAuthFailuresClearExpired(t *testing.T) {
+	a := NewAuthFailures(1, 10, 10, 20)
+	a.Fail("mochi", "10.0.0.1", 100)
+	a.Fail("zen", "", 130)
+	require.Equal(t, 3, a.Len())
+
+	a.ClearExpired(130)
+	require.Equal(t, 3, a.Len())
+
+	a.ClearExpired(135)
+	require.Equal(t, 1, a.Len())
+
+	a.ClearExpired(200)
+	require.Equal(t, 0, a.Len())
+}
+
+func TestAuthFailuresStats(t *testing.T) {
+	a := NewAuthFailures(2, 60, 10, 60)
+	a.Fail("mochi", "10.0.0.1", 100)
+	a.Fail("mochi", "10.0.0.1", 100)
+	a.Fail("zen", "10.0.0.2", 100)
+	a.Allow("mochi", "", 101)
+
+	stats := a.Stats(101)
+	require.Equal(t, int64(3), stats.Failures)
+	require.Equal(t, int64(1), stats.Rejected)
+	require.Equal(t, int64(2), stats.Bans)
+	require.Equal(t, 2, stats.Banned)
+	require.Equal(t, []AuthFailureStat{
+		{Kind: AuthFailureUsername, Value: "mochi", Bans: 1, Until: 110},
+		{Kind: AuthFailureUsername, Value: "zen", Failures: 1},
+		{Kind: AuthFailureIP, Value: "10.0.0.1", Bans: 1, Until: 110},
+		{Kind: AuthFailureIP, Value: "10.0.0.2", Failures: 1},
+	}, stats.Entries)
+
+	stats = a.Stats(200)
+	require.Equal(t, 0, stats.Banned)
+	require.Equal(t, int64(0), stats.Entries[1].Failures)
+}
+
+func TestEstablishConnectionAuthFailuresBanned(t *testing.T) {
+	s := New(&Options{
+		Logger:           logger,
+		AuthFailureLimit: 2,
+	})
+	_ = s.AddHook(new(DenyHook), nil)
+	defer s.Close()
+
+	connect := userPassConnect(t)
+	for i := 0; i < 3; i++ {
+		r, w := net.Pipe()
+		o := make(chan error)
+		go func() {
+			o <- s.EstablishConnection("tcp", r)
+		}()
+
+		go func() {
+			_, _ = w.Write(connect)
+		}()
+
+		recv := make(chan []byte)
+		go func() {
+			buf, err := io.ReadAll(w)
+			require.NoError(t, err)
+			recv <- buf
+		}()
+
+		err := <-o
+		if i < 2 {
+			require.ErrorIs(t, err, packets.ErrBadUsernameOrPassword)
+		} else {
+			require.ErrorIs(t, err, packets.ErrBanned)
+		}
+		require.Equal(t, []byte{packets.Connack << 4, 2, 0, packets.Err3NotAuthorized.Code}, <-recv)
+
+		_ = w.Close()
+		_ = r.Close()
+	}
+
+	stats := s.AuthFailures.Stats(time.Now().Unix())
+	require.Equal(t, int64(2), stats.Failures)
+	require.Equal(t, int64(1), stats.Rejected)
+}
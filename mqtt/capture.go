@@ -0,0 +1,281 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+const (
+	CaptureInbound  = "in"  // packets received from clients
+	CaptureOutbound = "out" // packets sent to clients
+
+	defaultCaptureDuration = 60   // seconds
+	maxCaptureDuration     = 3600 // seconds
+	captureRedacted        = "redacted"
+)
+
+var (
+	ErrCaptureRunning    = errors.New("packet capture already running")
+	ErrCaptureNotRunning = errors.New("packet capture not running")
+)
+
+// CaptureOptions contains the settings of a packet capture.
+type CaptureOptions struct {
+	ClientID   string `json:"client_id"`   // only capture packets of this client, all clients if empty
+	Filter     string `json:"filter"`      // only capture publish packets with topics matching this filter, all packets if empty
+	MaxPayload int    `json:"max_payload"` // truncate payloads to this many bytes, unlimited when 0
+	Unredacted bool   `json:"unredacted"`  // keep payloads and usernames, which are otherwise replaced with a placeholder
+	Duration   int64  `json:"duration"`    // seconds to capture for, defaults to 60 and is capped at 3600
+}
+
+// CaptureRecord is a captured packet. Records are written to the capture file as json lines,
+// and Raw contains the encoded packet so captured sessions can be replayed to a broker.
+type CaptureRecord struct {
+	Time       int64  `json:"time"`                  // unix nanoseconds the packet was captured
+	Direction  string `json:"direction"`             // in or out
+	ClientID   string `json:"client_id"`             // the client the packet was received from or sent to
+	Remote     string `json:"remote"`                // the remote address of the client
+	Listener   string `json:"listener"`              // the listener the client connected to
+	Version    byte   `json:"protocol_version"`      // the mqtt protocol version of the client
+	Type       string `json:"type"`                  // the packet type name
+	PacketID   uint16 `json:"packet_id,omitempty"`   // the packet id
+	Topic      string `json:"topic,omitempty"`       // the publish topic name
+	Qos        byte   `json:"qos,omitempty"`         // the publish qos
+	Retain     bool   `json:"retain,omitempty"`      // the publish retain flag
+	ReasonCode byte   `json:"reason_code,omitempty"` // the reason code of acks and disconnects
+	PayloadLen int    `json:"payload_len"`           // the original payload length
+	Truncated  bool   `json:"truncated,omitempty"`   // true if the payload was truncated or redacted
+	Raw        []byte `json:"raw,omitempty"`         // the encoded packet after truncation and redaction
+}
+
+// CaptureStatus describes the current or most recent packet capture.
+type CaptureStatus struct {
+	Running bool           `json:"running"`
+	Path    string         `json:"path"`
+	Started int64          `json:"started"`
+	Ends    int64          `json:"ends"`
+	Packets int64          `json:"packets"`
+	Options CaptureOptions `json:"options"`
+}
+
+// PacketCapture records decoded packets to a file for a bounded duration, for
+// diagnosing protocol issues with clients.
+type PacketCapture struct {
+	sync.Mutex
+	dir     string        // the directory capture files are written to
+	active  atomic.Bool   // true while a capture is running
+	status  CaptureStatus // the status of the current or most recent capture
+	packets atomic.Int64  // the number of packets captured
+	file    *os.File      // the capture file
+	w       *bufio.Writer // buffered writer to the capture file
+	timer   *time.Timer   // stops the capture when the duration elapses
+}
+
+// NewPacketCapture returns a new instance of PacketCapture which writes capture files to dir,
+// or to the system temporary directory if dir is empty.
+func NewPacketCapture(dir string) *PacketCapture {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+
+	return &PacketCapture{
+		dir: dir,
+	}
+}
+
+// Start begins a new packet capture, returning the status of the capture.
+func (c *PacketCapture) Start(opts CaptureOptions) (CaptureStatus, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.active.Load() {
+		return c.status, ErrCaptureRunning
+	}
+
+	if opts.Duration <= 0 {
+		opts.Duration = defaultCaptureDuration
+	} else if opts.Duration > maxCaptureDuration {
+		opts.Duration = maxCaptureDuration
+	}
+
+	if opts.MaxPayload < 0 {
+		opts.MaxPayload = 0
+	}
+
+	now := time.Now()
+	path := filepath.Join(c.dir, fmt.Sprintf("comqtt-capture-%d.jsonl", now.UnixNano()))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return c.status, err
+	}
+
+	c.file = f
+	c.w = bufio.NewWriter(f)
+	c.packets.Store(0)
+	c.status = CaptureStatus{
+		Running: true,
+		Path:    path,
+		Started: now.Unix(),
+		Ends:    now.Unix() + opts.Duration,
+		Options: opts,
+	}
+	c.timer = time.AfterFunc(time.Duration(opts.Duration)*time.Second, func() {
+		_, _ = c.Stop()
+	})
+	c.active.Store(true)
+
+	return c.status, nil
+}
+
+// Stop ends the running packet capture and closes the capture file.
+func (c *PacketCapture) Stop() (CaptureStatus, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if !c.active.Load() {
+		return c.status, ErrCaptureNotRunning
+	}
+
+	c.active.Store(false)
+	c.timer.Stop()
+	c.status.Running = false
+	c.status.Packets = c.packets.Load()
+
+	err := c.w.Flush()
+	if cerr := c.file.Close(); err == nil {
+		err = cerr
+	}
+	c.w, c.file = nil, nil
+
+	return c.status, err
+}
+
+// Status returns the status of the current or most recent packet capture.
+func (c *PacketCapture) Status() CaptureStatus {
+	c.Lock()
+	defer c.Unlock()
+	st := c.status
+	st.Packets = c.packets.Load()
+	return st
+}
+
+// Active returns true if a packet capture is running.
+func (c *PacketCapture) Active() bool {
+	return c != nil && c.active.Load()
+}
+
+// Capture records a packet sent to or received from a client if it matches the running capture.
+// The encoded packet should be provided if available, otherwise the packet is encoded.
+func (c *PacketCapture) Capture(cl *Client, pk packets.Packet, direction string, raw []byte) {
+	if !c.Active() {
+		return
+	}
+
+	c.Lock()
+	opts := c.status.Options
+	c.Unlock()
+
+	if opts.ClientID != "" && opts.ClientID != cl.ID {
+		return
+	}
+
+	if opts.Filter != "" && (pk.FixedHeader.Type != packets.Publish || !matchTopicFilter(opts.Filter, pk.TopicName)) {
+		return
+	}
+
+	r := CaptureRecord{
+		Time:       time.Now().UnixNano(),
+		Direction:  direction,
+		ClientID:   cl.ID,
+		Remote:     cl.Net.Remote,
+		Listener:   cl.Net.Listener,
+		Version:    cl.Properties.ProtocolVersion,
+		Type:       packets.PacketNames[pk.FixedHeader.Type],
+		PacketID:   pk.PacketID,
+		Topic:      pk.TopicName,
+		Qos:        pk.FixedHeader.Qos,
+		Retain:     pk.FixedHeader.Retain,
+		ReasonCode: pk.ReasonCode,
+		PayloadLen: len(pk.Payload),
+	}
+
+	// passwords and authentication data are never captured, as the capture files can be downloaded
+	if len(pk.Connect.Password) > 0 {
+		pk.Connect.Password = []byte(captureRedacted)
+		raw = nil
+	}
+	if len(pk.Properties.AuthenticationData) > 0 {
+		pk.Properties.AuthenticationData = []byte(captureRedacted)
+		raw = nil
+	}
+
+	if !opts.Unredacted {
+		if len(pk.Payload) > 0 {
+			pk.Payload = []byte(captureRedacted)
+			r.Truncated = true
+		}
+		if len(pk.Connect.Username) > 0 {
+			pk.Connect.Username = []byte(captureRedacted)
+		}
+		if len(pk.Connect.WillPayload) > 0 {
+			pk.Connect.WillPayload = []byte(captureRedacted)
+		}
+		raw = nil
+	}
+
+	if opts.MaxPayload > 0 && len(pk.Payload) > opts.MaxPayload {
+		pk.Payload = pk.Payload[:opts.MaxPayload]
+		r.Truncated = true
+		raw = nil
+	}
+
+	if raw == nil {
+		buf := new(bytes.Buffer)
+		if err := encodePacket(pk, buf); err == nil {
+			raw = buf.Bytes()
+		}
+	}
+	r.Raw = raw
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if c.active.Load() {
+		_, _ = c.w.Write(append(b, '\n'))
+		c.packets.Add(1)
+	}
+}
+
+// ReadCapture reads the records of a capture file, for replaying or inspecting a capture.
+func ReadCapture(r io.Reader) ([]CaptureRecord, error) {
+	records := []CaptureRecord{}
+	dec := json.NewDecoder(r)
+	for {
+		var rec CaptureRecord
+		if err := dec.Decode(&rec); errors.Is(err, io.EOF) {
+			return records, nil
+		} else if err != nil {
+			return records, err
+		}
+		records = append(records, rec)
+	}
+}
@@ -0,0 +1,214 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+func readCaptureFile(t *testing.T, path string) []CaptureRecord {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	records, err := ReadCapture(f)
+	require.NoError(t, err)
+	return records
+}
+
+func TestPacketCaptureStartStop(t *testing.T) {
+	c := NewPacketCapture(t.TempDir())
+	require.False(t, c.Active())
+
+	_, err := c.Stop()
+	require.ErrorIs(t, err, ErrCaptureNotRunning)
+
+	st, err := c.Start(CaptureOptions{MaxPayload: -1})
+	require.NoError(t, err)
+	require.True(t, c.Active())
+	require.True(t, st.Running)
+	require.Equal(t, int64(defaultCaptureDuration), st.Options.Duration)
+	require.Equal(t, 0, st.Options.MaxPayload)
+	require.Equal(t, st.Started+defaultCaptureDuration, st.Ends)
+	require.FileExists(t, st.Path)
+
+	_, err = c.Start(CaptureOptions{})
+	require.ErrorIs(t, err, ErrCaptureRunning)
+
+	st, err = c.Stop()
+	require.NoError(t, err)
+	require.False(t, st.Running)
+	require.False(t, c.Active())
+	require.Equal(t, st, c.Status())
+}
+
+func TestPacketCaptureMaxDuration(t *testing.T) {
+	c := NewPacketCapture(t.TempDir())
+	st, err := c.Start(CaptureOptions{Duration: maxCaptureDuration + 1})
+	require.NoError(t, err)
+	require.Equal(t, int64(maxCaptureDuration), st.Options.Duration)
+	_, _ = c.Stop()
+}
+
+func TestPacketCaptureExpires(t *testing.T) {
+	c := NewPacketCapture(t.TempDir())
+	_, err := c.Start(CaptureOptions{Duration: 1})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return !c.Active() }, 3*time.Second, 10*time.Millisecond)
+	require.False(t, c.Status().Running)
+}
+
+func TestPacketCaptureNil(t *testing.T) {
+	var c *PacketCapture
+	require.False(t, c.Active())
+	c.Capture(new(Client), packets.Packet{}, CaptureInbound, nil)
+}
+
+func TestPacketCaptureFilters(t *testing.T) {
+	cl, _, _ := newTestClient()
+	cl.ID = "a"
+	other, _, _ := newTestClient()
+	other.ID = "b"
+
+	c := NewPacketCapture(t.TempDir())
+	_, err := c.Start(CaptureOptions{ClientID: "a", Filter: "a/+/c"})
+	require.NoError(t, err)
+
+	pub := *packets.TPacketData[packets.Publish].Get(packets.TPublishBasic).Packet
+	pub.TopicName = "a/b/c"
+	c.Capture(cl, pub, CaptureInbound, nil)
+	c.Capture(other, pub, CaptureInbound, nil)
+	c.Capture(cl, *packets.TPacketData[packets.Pingreq].Get(packets.TPingreq).Packet, CaptureInbound, nil)
+	pub.TopicName = "x/y/z"
+	c.Capture(cl, pub, CaptureOutbound, nil)
+
+	st, err := c.Stop()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), st.Packets)
+
+	records := readCaptureFile(t, st.Path)
+	require.Len(t, records, 1)
+	require.Equal(t, "a", records[0].ClientID)
+	require.Equal(t, CaptureInbound, records[0].Direction)
+	require.Equal(t, "a/b/c", records[0].Topic)
+	require.Equal(t, packets.PacketNames[packets.Publish], records[0].Type)
+}
+
+func TestPacketCaptureTruncateAndRedact(t *testing.T) {
+	cl, _, _ := newTestClient()
+
+	c := NewPacketCapture(t.TempDir())
+	_, err := c.Start(CaptureOptions{MaxPayload: 3, Unredacted: true})
+	require.NoError(t, err)
+
+	pub := *packets.TPacketData[packets.Publish].Get(packets.TPublishBasic).Packet
+	c.Capture(cl, pub, CaptureOutbound, []byte{1, 2, 3})
+	st, err := c.Stop()
+	require.NoError(t, err)
+
+	records := readCaptureFile(t, st.Path)
+	require.Len(t, records, 1)
+	require.True(t, records[0].Truncated)
+	require.Equal(t, len(pub.Payload), records[0].PayloadLen)
+
+	expected := pub
+	expected.Payload = pub.Payload[:3]
+	buf := new(bytes.Buffer)
+	require.NoError(t, encodePacket(expected, buf))
+	require.Equal(t, buf.Bytes(), records[0].Raw)
+
+	_, err = c.Start(CaptureOptions{})
+	require.NoError(t, err)
+	connect := *packets.TPacketData[packets.Connect].Get(packets.TConnectUserPass).Packet
+	c.Capture(cl, connect, CaptureInbound, nil)
+	c.Capture(cl, pub, CaptureInbound, nil)
+	st, err = c.Stop()
+	require.NoError(t, err)
+
+	records = readCaptureFile(t, st.Path)
+	require.Len(t, records, 2)
+	require.NotContains(t, string(records[0].Raw), string(connect.Connect.Password))
+	require.NotContains(t, string(records[0].Raw), string(connect.Connect.Username))
+	require.Contains(t, string(records[0].Raw), captureRedacted)
+	require.True(t, records[1].Truncated)
+	require.NotContains(t, string(records[1].Raw), string(pub.Payload))
+	require.Contains(t, string(records[1].Raw), captureRedacted)
+}
+
+func TestPacketCaptureRedactsCredentials(t *testing.T) {
+	cl, _, _ := newTestClient()
+	cl.Properties.ProtocolVersion = 5
+
+	c := NewPacketCapture(t.TempDir())
+	_, err := c.Start(CaptureOptions{Unredacted: true})
+	require.NoError(t, err)
+
+	connect := *packets.TPacketData[packets.Connect].Get(packets.TConnectUserPass).Packet
+	auth := *packets.TPacketData[packets.Auth].Get(packets.TAuth).Packet
+	c.Capture(cl, connect, CaptureInbound, nil)
+	c.Capture(cl, auth, CaptureInbound, nil)
+	st, err := c.Stop()
+	require.NoError(t, err)
+
+	records := readCaptureFile(t, st.Path)
+	require.Len(t, records, 2)
+	require.NotContains(t, string(records[0].Raw), string(connect.Connect.Password))
+	require.Contains(t, string(records[0].Raw), string(connect.Connect.Username))
+	require.NotContains(t, string(records[1].Raw), string(auth.Properties.AuthenticationData))
+	require.Contains(t, string(records[1].Raw), captureRedacted)
+}
+
+func TestEstablishConnectionCaptured(t *testing.T) {
+	s := New(&Options{
+		Logger:     logger,
+		CaptureDir: t.TempDir(),
+	})
+	_ = s.AddHook(new(AllowHook), nil)
+	defer s.Close()
+
+	_, err := s.Capture.Start(CaptureOptions{})
+	require.NoError(t, err)
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r)
+	}()
+
+	go func() {
+		_, _ = w.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectClean).RawBytes)
+		_, _ = w.Write(packets.TPacketData[packets.Disconnect].Get(packets.TDisconnect).RawBytes)
+	}()
+
+	go func() {
+		_, _ = io.ReadAll(w)
+	}()
+
+	require.NoError(t, <-o)
+	_ = w.Close()
+	_ = r.Close()
+
+	st, err := s.Capture.Stop()
+	require.NoError(t, err)
+
+	records := readCaptureFile(t, st.Path)
+	require.Len(t, records, 3)
+	require.Equal(t, CaptureInbound, records[0].Direction)
+	require.Equal(t, packets.PacketNames[packets.Connect], records[0].Type)
+	require.Equal(t, packets.TPacketData[packets.Connect].Get(packets.TConnectClean).RawBytes, records[0].Raw)
+	require.Equal(t, CaptureOutbound, records[1].Direction)
+	require.Equal(t, packets.PacketNames[packets.Connack], records[1].Type)
+	require.Equal(t, packets.TPacketData[packets.Connack].Get(packets.TConnackAcceptedNoSession).RawBytes, records[1].Raw)
+	require.Equal(t, CaptureInbound, records[2].Direction)
+	require.Equal(t, packets.PacketNames[packets.Disconnect], records[2].Type)
+}
@@ -0,0 +1,198 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/rs/xid"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+// AllListeners is the ClientIDPolicy prefixes key which applies to clients of every listener.
+const AllListeners = "*"
+
+// ClientIDPolicy restricts the client ids which clients may connect with, and configures
+// how client ids are assigned to clients which connect with an empty client id.
+type ClientIDPolicy struct {
+	// Charset is a regular expression character class of the characters allowed in a
+	// client id, such as "a-zA-Z0-9_-". Any character is allowed when empty.
+	Charset string `yaml:"charset" json:"charset"`
+
+	// MinLength is the minimum length of a client id. Not enforced when 0.
+	MinLength int `yaml:"min-length" json:"min_length"`
+
+	// MaxLength is the maximum length of a client id. Not enforced when 0.
+	MaxLength int `yaml:"max-length" json:"max_length"`
+
+	// Prefixes are the client id prefixes required of clients keyed on listener id, allowing
+	// each tenant listener to own a namespace of client ids. A client id must begin with one
+	// of the prefixes of its listener. The "*" key applies to clients of all listeners.
+	Prefixes map[string][]string `yaml:"prefixes" json:"prefixes"`
+
+	// AssignPrefix is prepended to server-assigned client ids.
+	AssignPrefix string `yaml:"assign-prefix" json:"assign_prefix"`
+
+	// Pattern is a regular expression the whole client id must match, checked when the client
+	// authenticates. Each %u is replaced with the quoted username of the client, so that a
+	// pattern such as "%u-[0-9]+" ties the client ids to the usernames owning them.
+	Pattern string `yaml:"pattern" json:"pattern"`
+
+	// UsernamePrefix requires the client id of a client connecting with a username to begin
+	// with the username, checked when the client authenticates.
+	UsernamePrefix bool `yaml:"username-prefix" json:"username_prefix"`
+
+	once    sync.Once
+	charset *regexp.Regexp // the compiled charset
+	pattern *regexp.Regexp // the compiled pattern, nil if it has a %u placeholder
+	err     error          // any error compiling the charset or pattern
+}
+
+// Compile compiles the policy charset, returning an error if it is not a valid character class.
+func (p *ClientIDPolicy) Compile() error {
+	p.once.Do(func() {
+		if p.Charset != "" {
+			p.charset, p.err = regexp.Compile("^[" + p.Charset + "]*$")
+			if p.err != nil {
+				p.err = fmt.Errorf("invalid client id charset %q: %w", p.Charset, p.err)
+				return
+			}
+		}
+
+		if p.Pattern != "" {
+			var re *regexp.Regexp
+			re, p.err = p.compilePattern("username")
+			if p.err != nil {
+				p.err = fmt.Errorf("invalid client id pattern %q: %w", p.Pattern, p.err)
+				return
+			}
+
+			if !strings.Contains(p.Pattern, "%u") {
+				p.pattern = re
+			}
+		}
+	})
+
+	return p.err
+}
+
+// compilePattern compiles the pattern anchored to the whole client id, with the username
+// of a client in place of each %u.
+func (p *ClientIDPolicy) compilePattern(username string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + strings.ReplaceAll(p.Pattern, "%u", regexp.QuoteMeta(username)) + ")$")
+}
+
+// Validate returns a reason code indicating whether a client id connecting to a listener is
+// allowed by the policy.
+func (p *ClientIDPolicy) Validate(listener, id string) packets.Code {
+	if p.Compile() != nil {
+		return packets.ErrClientIdentifierNotValid
+	}
+
+	if p.MinLength > 0 && len(id) < p.MinLength {
+		return packets.ErrClientIdentifierTooShort
+	}
+
+	if p.MaxLength > 0 && len(id) > p.MaxLength {
+		return packets.ErrClientIdentifierTooLong
+	}
+
+	if p.charset != nil && !p.charset.MatchString(id) {
+		return packets.ErrClientIdentifierInvalidChars
+	}
+
+	required := false
+	for _, key := range []string{listener, AllListeners} {
+		for _, prefix := range p.Prefixes[key] {
+			if strings.HasPrefix(id, prefix) {
+				return packets.CodeSuccess
+			}
+			required = true
+		}
+	}
+
+	if required {
+		return packets.ErrClientIdentifierInvalidPrefix
+	}
+
+	return packets.CodeSuccess
+}
+
+// Authorize returns a reason code indicating whether a client id may be used by a client
+// authenticating with a username, so that clients cannot take over the sessions of the
+// clients of other users.
+func (p *ClientIDPolicy) Authorize(username, id string) packets.Code {
+	if p.Compile() != nil {
+		return packets.ErrClientIdentifierNotValid
+	}
+
+	if p.UsernamePrefix && !strings.HasPrefix(id, username) {
+		return packets.ErrClientIdentifierNotOwned
+	}
+
+	if p.Pattern == "" {
+		return packets.CodeSuccess
+	}
+
+	re := p.pattern
+	if re == nil {
+		var err error
+		if re, err = p.compilePattern(username); err != nil {
+			return packets.ErrClientIdentifierNotValid
+		}
+	}
+
+	if !re.MatchString(id) {
+		return packets.ErrClientIdentifierNotOwned
+	}
+
+	return packets.CodeSuccess
+}
+
+// NewID returns a new server-assigned client id.
+func (p *ClientIDPolicy) NewID() string {
+	return p.AssignPrefix + xid.New().String()
+}
+
+// assignClientID assigns a client id to a client which connected with an empty client id,
+// using the id provided by any OnClientIDAssign hook, or otherwise generating one.
+func (s *Server) assignClientID(cl *Client, pk packets.Packet) {
+	if cl.Properties.Props.AssignedClientID == "" {
+		return
+	}
+
+	id := s.hooks.OnClientIDAssign(cl, pk)
+	if id == "" && s.Options.ClientIDPolicy != nil {
+		id = s.Options.ClientIDPolicy.NewID()
+	}
+
+	if id != "" {
+		cl.ID = id
+		cl.Properties.Props.AssignedClientID = id // [MQTT-3.1.3-7]
+	}
+}
+
+// validateClientID checks the client id of a connecting client against the client id policy.
+// Server-assigned client ids are not checked.
+func (s *Server) validateClientID(cl *Client) packets.Code {
+	if s.Options.ClientIDPolicy == nil || cl.Properties.Props.AssignedClientID != "" {
+		return packets.CodeSuccess
+	}
+
+	return s.Options.ClientIDPolicy.Validate(cl.Net.Listener, cl.ID)
+}
+
+// authorizeClientID checks the client id of an authenticating client against the pattern
+// and username prefix of the client id policy. Server-assigned client ids are not checked.
+func (s *Server) authorizeClientID(cl *Client) packets.Code {
+	if s.Options.ClientIDPolicy == nil || cl.Properties.Props.AssignedClientID != "" {
+		return packets.CodeSuccess
+	}
+
+	return s.Options.ClientIDPolicy.Authorize(string(cl.Properties.Username), cl.ID)
+}
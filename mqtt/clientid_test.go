@@ -0,0 +1,288 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+// connectEmptyClientIDMqtt5 is a clean MQTT v5 connect packet with an empty client id.
+var connectEmptyClientIDMqtt5 = []byte{
+	packets.Connect << 4, 13,
+	0, 4, 'M', 'Q', 'T', 'T',
+	5,     // protocol version
+	2,     // clean start
+	0, 60, // keepalive
+	0,    // properties length
+	0, 0, // client id
+}
+
+type clientIDHook struct {
+	HookBase
+	id string
+}
+
+func (h *clientIDHook) ID() string {
+	return "client-id"
+}
+
+func (h *clientIDHook) Provides(b byte) bool {
+	return b == OnClientIDAssign
+}
+
+func (h *clientIDHook) OnClientIDAssign(cl *Client, pk packets.Packet) string {
+	return h.id
+}
+
+func TestClientIDPolicyValidate(t *testing.T) {
+	p := &ClientIDPolicy{
+		Charset:   "a-z0-9-",
+		MinLength: 4,
+		MaxLength: 12,
+		Prefixes: map[string][]string{
+			"t1":         {"acme-", "globex-"},
+			AllListeners: {"shared-"},
+		},
+	}
+
+	tt := []struct {
+		listener string
+		id       string
+		code     packets.Code
+	}{
+		{listener: "t1", id: "acme-1", code: packets.CodeSuccess},
+		{listener: "t1", id: "globex-1", code: packets.CodeSuccess},
+		{listener: "t1", id: "shared-1", code: packets.CodeSuccess},
+		{listener: "t2", id: "shared-1", code: packets.CodeSuccess},
+		{listener: "t2", id: "acme-1", code: packets.ErrClientIdentifierInvalidPrefix},
+		{listener: "t1", id: "abc", code: packets.ErrClientIdentifierTooShort},
+		{listener: "t1", id: "acme-123456789", code: packets.ErrClientIdentifierTooLong},
+		{listener: "t1", id: "acme_1", code: packets.ErrClientIdentifierInvalidChars},
+		{listener: "t1", id: "Acme-1", code: packets.ErrClientIdentifierInvalidChars},
+	}
+
+	for _, tx := range tt {
+		require.Equal(t, tx.code, p.Validate(tx.listener, tx.id), tx.id)
+	}
+}
+
+func TestClientIDPolicyValidateNoRestrictions(t *testing.T) {
+	p := new(ClientIDPolicy)
+	require.Equal(t, packets.CodeSuccess, p.Validate("t1", "any id at all"))
+}
+
+func TestClientIDPolicyCompileError(t *testing.T) {
+	p := &ClientIDPolicy{Charset: "z-a"}
+	require.Error(t, p.Compile())
+	require.Equal(t, packets.ErrClientIdentifierNotValid, p.Validate("t1", "abc"))
+}
+
+func TestClientIDPolicyAuthorize(t *testing.T) {
+	tt := []struct {
+		desc     string
+		policy   *ClientIDPolicy
+		username string
+		id       string
+		code     packets.Code
+	}{
+		{desc: "no restrictions", policy: new(ClientIDPolicy), username: "alice", id: "bob-1", code: packets.CodeSuccess},
+		{desc: "username prefix", policy: &ClientIDPolicy{UsernamePrefix: true}, username: "alice", id: "alice-1", code: packets.CodeSuccess},
+		{desc: "other username prefix", policy: &ClientIDPolicy{UsernamePrefix: true}, username: "alice", id: "bob-1", code: packets.ErrClientIdentifierNotOwned},
+		{desc: "pattern", policy: &ClientIDPolicy{Pattern: "dev-[0-9]+"}, username: "alice", id: "dev-12", code: packets.CodeSuccess},
+		{desc: "pattern partial match", policy: &ClientIDPolicy{Pattern: "dev-[0-9]+"}, username: "alice", id: "dev-12x", code: packets.ErrClientIdentifierNotOwned},
+		{desc: "username pattern", policy: &ClientIDPolicy{Pattern: "%u/[a-z]+"}, username: "alice", id: "alice/sensor", code: packets.CodeSuccess},
+		{desc: "other username pattern", policy: &ClientIDPolicy{Pattern: "%u/[a-z]+"}, username: "alice", id: "bob/sensor", code: packets.ErrClientIdentifierNotOwned},
+		{desc: "quoted username", policy: &ClientIDPolicy{Pattern: "%u-1"}, username: "a.b", id: "axb-1", code: packets.ErrClientIdentifierNotOwned},
+		{desc: "invalid pattern", policy: &ClientIDPolicy{Pattern: "dev-[0-9"}, username: "alice", id: "dev-1", code: packets.ErrClientIdentifierNotValid},
+	}
+
+	for _, tx := range tt {
+		require.Equal(t, tx.code, tx.policy.Authorize(tx.username, tx.id), tx.desc)
+	}
+}
+
+func TestClientIDPolicyCompilePatternError(t *testing.T) {
+	p := &ClientIDPolicy{Pattern: "%u-(["}
+	require.Error(t, p.Compile())
+}
+
+func TestClientIDPolicyNewID(t *testing.T) {
+	p := &ClientIDPolicy{AssignPrefix: "auto-"}
+	a, b := p.NewID(), p.NewID()
+	require.True(t, strings.HasPrefix(a, "auto-"))
+	require.NotEqual(t, a, b)
+}
+
+func TestServeClientIDPolicyInvalid(t *testing.T) {
+	s := New(&Options{
+		Logger:         logger,
+		ClientIDPolicy: &ClientIDPolicy{Charset: "z-a"},
+	})
+	defer s.Close()
+	require.Error(t, s.Serve())
+}
+
+func TestEstablishConnectionClientIDRejected(t *testing.T) {
+	s := New(&Options{
+		Logger:         logger,
+		ClientIDPolicy: &ClientIDPolicy{MinLength: 5},
+	})
+	_ = s.AddHook(new(DenyHook), nil) // the policy is enforced before authentication
+	defer s.Close()
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r)
+	}()
+
+	go func() {
+		_, _ = w.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectMqtt5).RawBytes)
+	}()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := io.ReadAll(w)
+		require.NoError(t, err)
+		recv <- buf
+	}()
+
+	err := <-o
+	require.ErrorIs(t, err, packets.ErrClientIdentifierTooShort)
+	buf := <-recv
+	require.Equal(t, packets.Connack<<4, buf[0])
+	require.Equal(t, packets.ErrClientIdentifierTooShort.Code, buf[3])
+
+	_ = w.Close()
+	_ = r.Close()
+}
+
+func TestEstablishConnectionClientIDRejectedV3(t *testing.T) {
+	s := New(&Options{
+		Logger:         logger,
+		ClientIDPolicy: &ClientIDPolicy{Charset: "0-9"},
+	})
+	_ = s.AddHook(new(AllowHook), nil)
+	defer s.Close()
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r)
+	}()
+
+	go func() {
+		_, _ = w.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectClean).RawBytes)
+	}()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := io.ReadAll(w)
+		require.NoError(t, err)
+		recv <- buf
+	}()
+
+	err := <-o
+	require.ErrorIs(t, err, packets.ErrClientIdentifierInvalidChars)
+	require.Equal(t, []byte{packets.Connack << 4, 2, 0, packets.Err3ClientIdentifierNotValid.Code}, <-recv)
+
+	_ = w.Close()
+	_ = r.Close()
+}
+
+func TestEstablishConnectionClientIDNotOwned(t *testing.T) {
+	s := New(&Options{
+		Logger:         logger,
+		ClientIDPolicy: &ClientIDPolicy{Pattern: "dev-[0-9]+"},
+	})
+	_ = s.AddHook(new(AllowHook), nil)
+	defer s.Close()
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r)
+	}()
+
+	go func() {
+		_, _ = w.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectMqtt5).RawBytes)
+	}()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := io.ReadAll(w)
+		require.NoError(t, err)
+		recv <- buf
+	}()
+
+	err := <-o
+	require.ErrorIs(t, err, packets.ErrClientIdentifierNotOwned)
+	buf := <-recv
+	require.Equal(t, packets.Connack<<4, buf[0])
+	require.Equal(t, packets.ErrClientIdentifierNotOwned.Code, buf[3])
+
+	_ = w.Close()
+	_ = r.Close()
+}
+
+func TestEstablishConnectionAssignedClientID(t *testing.T) {
+	tt := []struct {
+		desc   string
+		hook   *clientIDHook
+		expect string
+	}{
+		{desc: "hook", hook: &clientIDHook{id: "hooked-id"}, expect: "hooked-id"},
+		{desc: "policy prefix", hook: &clientIDHook{}, expect: "auto-"},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			s := New(&Options{
+				Logger: logger,
+				ClientIDPolicy: &ClientIDPolicy{
+					AssignPrefix: "auto-",
+					Prefixes:     map[string][]string{AllListeners: {"tenant-"}},
+				},
+			})
+			_ = s.AddHook(new(AllowHook), nil)
+			_ = s.AddHook(tx.hook, nil)
+			defer s.Close()
+
+			r, w := net.Pipe()
+			o := make(chan error)
+			go func() {
+				o <- s.EstablishConnection("tcp", r)
+			}()
+
+			go func() {
+				_, _ = w.Write(connectEmptyClientIDMqtt5)
+				_, _ = w.Write([]byte{packets.Disconnect << 4, 0})
+			}()
+
+			recv := make(chan []byte)
+			go func() {
+				buf, err := io.ReadAll(w)
+				require.NoError(t, err)
+				recv <- buf
+			}()
+
+			// server-assigned ids are not subject to the policy prefixes
+			require.NoError(t, <-o)
+			buf := <-recv
+			require.Equal(t, packets.Connack<<4, buf[0])
+			require.Equal(t, packets.CodeSuccess.Code, buf[3])
+			require.Contains(t, string(buf), tx.expect)
+
+			_ = w.Close()
+			_ = r.Close()
+		})
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -17,7 +18,9 @@ import (
 
 	"github.com/rs/xid"
 
+	"github.com/wind-c/comqtt/v2/mqtt/listeners"
 	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/mqtt/system"
 )
 
 const (
@@ -116,11 +119,13 @@ type Client struct {
 
 // ClientConnection contains the connection transport and metadata for the client.
 type ClientConnection struct {
-	Conn     net.Conn          // the net.Conn used to establish the connection
-	bconn    *bufio.ReadWriter // a buffered net.Conn for reading packets
-	Remote   string            // the remote address of the client
-	Listener string            // listener id of the client
-	Inline   bool              // if true, the client is the built-in 'inline' embedded client
+	Conn     net.Conn             // the net.Conn used to establish the connection
+	bconn    *bufio.ReadWriter    // a buffered net.Conn for reading packets
+	Remote   string               // the remote address of the client
+	Listener string               // listener id of the client
+	Family   string               // the address family of the remote address, ipv4 or ipv6
+	Inline   bool                 // if true, the client is the built-in 'inline' embedded client
+	stats    *system.ListenerInfo // the connection counters of the listener of the client
 }
 
 // ClientProperties contains the properties which define the client behaviour.
@@ -159,6 +164,9 @@ type ClientState struct {
 	outboundQty     int32                // number of messages currently in the outbound queue
 	Keepalive       uint16               // the number of seconds the connection can wait
 	ServerKeepalive bool                 // keepalive was set by the server
+	compress        bool                 // payloads sent to the client are compressed
+	reauth          int                  // the number of auth packets of a re-authentication in progress
+	usage           atomic.Value         // the *clientUsage counters the client is metered against
 }
 
 // newClient returns a new instance of Client. This is almost exclusively used by Server
@@ -190,6 +198,7 @@ func newClient(c net.Conn, o *ops) *Client {
 				bufio.NewWriterSize(c, o.options.ClientNetWriteBufferSize),
 			),
 			Remote: c.RemoteAddr().String(),
+			Family: listeners.AddrFamily(c.RemoteAddr()),
 		}
 	}
 
@@ -253,9 +262,14 @@ func (cl *Client) ParseConnect(lid string, pk packets.Packet) {
 
 // refreshDeadline refreshes the read/write deadline for the net.Conn connection.
 func (cl *Client) refreshDeadline(keepalive uint16) {
+	var probe *ConnectionProbe
+	if cl.ops != nil && cl.ops.options != nil {
+		probe = cl.ops.options.ConnectionProbe
+	}
+
 	var expiry time.Time // nil time can be used to disable deadline if keepalive = 0
-	if keepalive > 0 {
-		expiry = time.Now().Add(time.Duration(keepalive+(keepalive/2)) * time.Second) // [MQTT-3.1.2-22]
+	if timeout := probe.timeout(keepalive); timeout > 0 {
+		expiry = time.Now().Add(timeout) // [MQTT-3.1.2-22]
 	}
 
 	if cl.Net.Conn != nil {
@@ -299,9 +313,16 @@ func (cl *Client) ResendInflightMessages(force bool) error {
 		return nil
 	}
 
+	now := time.Now().Unix()
 	for _, tk := range cl.State.Inflight.GetAll(false) {
 		if tk.FixedHeader.Type == packets.Publish {
 			tk.FixedHeader.Dup = true // [MQTT-3.3.1-1] [MQTT-3.3.1-3]
+			if remaining, ok := RemainingMessageExpiry(tk, now); ok {
+				if remaining <= 0 {
+					continue // expired messages are never delivered late, and are removed by the inflight expiry loop.
+				}
+				tk.Properties.MessageExpiryInterval = uint32(remaining) // [MQTT-3.3.2-6]
+			}
 		}
 
 		cl.ops.hooks.OnQosPublish(cl, tk, tk.Created, 0)
@@ -321,10 +342,27 @@ func (cl *Client) ResendInflightMessages(force bool) error {
 	return nil
 }
 
+// ReleaseInflights removes all inflight messages from the client without notifying
+// the hooks, e.g. when its session has been taken over and any persisted qos flows
+// now belong to the new connection.
+func (cl *Client) ReleaseInflights() {
+	for _, tk := range cl.State.Inflight.GetAll(false) {
+		if ok := cl.State.Inflight.Delete(tk.PacketID); ok {
+			atomic.AddInt64(&cl.ops.info.Inflight, -1)
+		}
+	}
+}
+
 // ClearInflights deletes all inflight messages for the client, e.g. for a disconnected user with a clean session.
+// Unless now is math.MaxInt64, as when the session ends, the pubrec and pubrel stages of qos 2 exchanges are kept,
+// as their message has already been delivered and dropping them would let a resent publish be delivered again.
 func (cl *Client) ClearInflights(now, maximumExpiry int64) []uint16 {
 	deleted := []uint16{}
 	for _, tk := range cl.State.Inflight.GetAll(false) {
+		if now < math.MaxInt64 && (tk.FixedHeader.Type == packets.Pubrec || tk.FixedHeader.Type == packets.Pubrel) {
+			continue
+		}
+
 		if (tk.Expiry > 0 && tk.Expiry < now) || tk.Created+maximumExpiry < now {
 			if ok := cl.State.Inflight.Delete(tk.PacketID); ok {
 				cl.ops.hooks.OnQosDropped(cl, tk)
@@ -399,6 +437,31 @@ func (cl *Client) Closed() bool {
 	return cl.State.open == nil || cl.State.open.Err() != nil
 }
 
+// SessionExpiry returns the unix time at which the session of a disconnected client expires,
+// being the time it disconnected plus its session expiry interval, or the maximum session
+// expiry interval of the server if it set none. It is 0 while the client is connected, or if
+// the interval is the maximum value, as such sessions never expire.
+func (cl *Client) SessionExpiry() int64 {
+	disconnected := atomic.LoadInt64(&cl.State.disconnected)
+	if disconnected == 0 {
+		return 0
+	}
+
+	expire := uint32(math.MaxUint32)
+	if cl.ops != nil && cl.ops.options != nil && cl.ops.options.Capabilities != nil {
+		expire = cl.ops.options.Capabilities.MaximumSessionExpiryInterval
+	}
+	if cl.Properties.ProtocolVersion == 5 && cl.Properties.Props.SessionExpiryIntervalFlag {
+		expire = cl.Properties.Props.SessionExpiryInterval
+	}
+
+	if expire == math.MaxUint32 {
+		return 0
+	}
+
+	return disconnected + int64(expire)
+}
+
 // ReadFixedHeader reads in the values of the next packet's fixed header.
 func (cl *Client) ReadFixedHeader(fh *packets.FixedHeader) error {
 	if cl.Net.bconn == nil {
@@ -426,6 +489,9 @@ func (cl *Client) ReadFixedHeader(fh *packets.FixedHeader) error {
 	}
 
 	atomic.AddInt64(&cl.ops.info.BytesReceived, int64(bu+1))
+	if cl.Net.stats != nil {
+		atomic.AddInt64(&cl.Net.stats.BytesReceived, int64(bu+1))
+	}
 	return nil
 }
 
@@ -442,6 +508,9 @@ func (cl *Client) ReadPacket(fh *packets.FixedHeader) (pk packets.Packet, err er
 	}
 
 	atomic.AddInt64(&cl.ops.info.BytesReceived, int64(n))
+	if cl.Net.stats != nil {
+		atomic.AddInt64(&cl.Net.stats.BytesReceived, int64(n))
+	}
 
 	// Decode the remaining packet values using a fresh copy of the bytes,
 	// otherwise the next packet will change the data of this one.
@@ -487,6 +556,9 @@ func (cl *Client) ReadPacket(fh *packets.FixedHeader) (pk packets.Packet, err er
 	}
 
 	pk, err = cl.ops.hooks.OnPacketRead(cl, pk)
+	if err == nil {
+		cl.ops.capture.Capture(cl, pk, CaptureInbound, nil)
+	}
 	return
 }
 
@@ -519,8 +591,43 @@ func (cl *Client) WritePacket(pk packets.Packet) error {
 
 	pk = cl.ops.hooks.OnPacketEncode(cl, pk)
 
-	var err error
 	buf := new(bytes.Buffer)
+	err := encodePacket(pk, buf)
+	if err != nil {
+		return err
+	}
+
+	if pk.Mods.MaxSize > 0 && uint32(buf.Len()) > pk.Mods.MaxSize {
+		return packets.ErrPacketTooLarge // [MQTT-3.1.2-24] [MQTT-3.1.2-25]
+	}
+
+	nb := net.Buffers{buf.Bytes()}
+	n, err := func() (int64, error) {
+		cl.Lock()
+		defer cl.Unlock()
+		return nb.WriteTo(cl.Net.Conn)
+	}()
+	if err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&cl.ops.info.BytesSent, n)
+	if cl.Net.stats != nil {
+		atomic.AddInt64(&cl.Net.stats.BytesSent, n)
+	}
+	atomic.AddInt64(&cl.ops.info.PacketsSent, 1)
+	if pk.FixedHeader.Type == packets.Publish {
+		atomic.AddInt64(&cl.ops.info.MessagesSent, 1)
+	}
+
+	cl.ops.hooks.OnPacketSent(cl, pk, buf.Bytes())
+	cl.ops.capture.Capture(cl, pk, CaptureOutbound, buf.Bytes())
+
+	return err
+}
+
+// encodePacket encodes a packet into buf according to its type.
+func encodePacket(pk packets.Packet, buf *bytes.Buffer) (err error) {
 	switch pk.FixedHeader.Type {
 	case packets.Connect:
 		err = pk.ConnectEncode(buf)
@@ -555,31 +662,6 @@ func (cl *Client) WritePacket(pk packets.Packet) error {
 	default:
 		err = fmt.Errorf("%w: %v", packets.ErrNoValidPacketAvailable, pk.FixedHeader.Type)
 	}
-	if err != nil {
-		return err
-	}
-
-	if pk.Mods.MaxSize > 0 && uint32(buf.Len()) > pk.Mods.MaxSize {
-		return packets.ErrPacketTooLarge // [MQTT-3.1.2-24] [MQTT-3.1.2-25]
-	}
-
-	nb := net.Buffers{buf.Bytes()}
-	n, err := func() (int64, error) {
-		cl.Lock()
-		defer cl.Unlock()
-		return nb.WriteTo(cl.Net.Conn)
-	}()
-	if err != nil {
-		return err
-	}
-
-	atomic.AddInt64(&cl.ops.info.BytesSent, n)
-	atomic.AddInt64(&cl.ops.info.PacketsSent, 1)
-	if pk.FixedHeader.Type == packets.Publish {
-		atomic.AddInt64(&cl.ops.info.MessagesSent, 1)
-	}
-
-	cl.ops.hooks.OnPacketSent(cl, pk, buf.Bytes())
 
 	return err
 }
@@ -8,6 +8,7 @@ import (
 	"context"
 	"errors"
 	"io"
+	"math"
 	"net"
 	"sync/atomic"
 	"testing"
@@ -292,6 +293,39 @@ func TestClientClearInflights(t *testing.T) {
 	require.Equal(t, 2, cl.State.Inflight.Len())
 }
 
+func TestClientClearInflightsKeepsQos2Stages(t *testing.T) {
+	cl, _, _ := newTestClient()
+
+	n := time.Now().Unix()
+	cl.State.Inflight.Set(packets.Packet{PacketID: 1, FixedHeader: packets.FixedHeader{Type: packets.Pubrec}, Created: n - 10, Expiry: n - 1})
+	cl.State.Inflight.Set(packets.Packet{PacketID: 2, FixedHeader: packets.FixedHeader{Type: packets.Pubrel, Qos: 1}, Created: n - 10})
+	cl.State.Inflight.Set(packets.Packet{PacketID: 3, FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 2}, Created: n - 10})
+
+	require.ElementsMatch(t, []uint16{3}, cl.ClearInflights(n, 4))
+	require.Equal(t, 2, cl.State.Inflight.Len())
+
+	require.ElementsMatch(t, []uint16{1, 2}, cl.ClearInflights(math.MaxInt64, 0))
+	require.Equal(t, 0, cl.State.Inflight.Len())
+}
+
+func TestClientReleaseInflights(t *testing.T) {
+	cl, _, _ := newTestClient()
+	dropped := 0
+	cl.ops.hooks = new(Hooks)
+	cl.ops.hooks.Log = logger
+	h := &qosStoreHook{onDropped: func() { dropped++ }}
+	require.NoError(t, cl.ops.hooks.Add(h, nil))
+
+	cl.State.Inflight.Set(packets.Packet{PacketID: 1})
+	cl.State.Inflight.Set(packets.Packet{PacketID: 2})
+	atomic.StoreInt64(&cl.ops.info.Inflight, 2)
+
+	cl.ReleaseInflights()
+	require.Equal(t, 0, cl.State.Inflight.Len())
+	require.Equal(t, int64(0), atomic.LoadInt64(&cl.ops.info.Inflight))
+	require.Equal(t, 0, dropped)
+}
+
 func TestClientResendInflightMessages(t *testing.T) {
 	pk1 := packets.TPacketData[packets.Puback].Get(packets.TPuback)
 	cl, r, w := newTestClient()
@@ -495,6 +529,24 @@ func TestClientClosed(t *testing.T) {
 	require.True(t, cl.Closed())
 }
 
+func TestClientSessionExpiry(t *testing.T) {
+	cl, _, _ := newTestClient()
+	defer cl.Stop(errClientStop)
+	cl.ops.options.Capabilities.MaximumSessionExpiryInterval = 600
+	require.Equal(t, int64(0), cl.SessionExpiry())
+
+	cl.State.disconnected = 1000
+	require.Equal(t, int64(1600), cl.SessionExpiry())
+
+	cl.Properties.ProtocolVersion = 5
+	cl.Properties.Props.SessionExpiryInterval = 30
+	cl.Properties.Props.SessionExpiryIntervalFlag = true
+	require.Equal(t, int64(1030), cl.SessionExpiry())
+
+	cl.Properties.Props.SessionExpiryInterval = math.MaxUint32
+	require.Equal(t, int64(0), cl.SessionExpiry())
+}
+
 func TestClientReadFixedHeaderError(t *testing.T) {
 	cl, r, _ := newTestClient()
 	defer cl.Stop(errClientStop)
@@ -744,3 +796,26 @@ var (
 		packets.TPacketData[packets.Auth].Get(packets.TAuth),
 	}
 )
+
+func TestClientResendInflightMessagesExpiry(t *testing.T) {
+	cl, r, w := newTestClient()
+	n := time.Now().Unix()
+	cl.State.Inflight.Set(packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		PacketID:    1,
+		TopicName:   "a/b/c",
+		Created:     n - 20,
+		Properties:  packets.Properties{MessageExpiryInterval: 10},
+	})
+
+	go func() {
+		err := cl.ResendInflightMessages(true)
+		require.NoError(t, err)
+		time.Sleep(time.Millisecond)
+		_ = w.Close()
+	}()
+
+	buf, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Empty(t, buf) // expired messages are never resent
+}
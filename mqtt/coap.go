@@ -0,0 +1,108 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"encoding/base64"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt/listeners"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+// CoAPPublish publishes the payload of a coap request to its topic, as an inline client of
+// the coap listener authenticated and acl checked using the server hooks.
+func (s *Server) CoAPPublish(req listeners.CoAPRequest) error {
+	if !IsValidFilter(req.Topic, true) {
+		return packets.ErrTopicNameInvalid
+	}
+
+	if req.Qos > 2 {
+		return packets.ErrProtocolViolationQosOutOfRange
+	}
+
+	cl, err := s.authenticateClient(req.Listener, req.ClientID, req.Username, req.Password, req.Remote, true)
+	if err != nil {
+		return err
+	}
+	defer s.releaseUserConnection(cl)
+
+	if !s.aclCheck(cl, req.Topic, true) {
+		s.aclDenied(cl, req.Topic, true)
+		return packets.ErrNotAuthorized
+	}
+
+	if !s.allowUserPublish(cl) {
+		return packets.ErrQuotaExceeded
+	}
+
+	return s.InjectPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Qos:    req.Qos,
+			Retain: req.Retain,
+		},
+		TopicName: req.Topic,
+		Payload:   req.Payload,
+		PacketID:  uint16(req.Qos),
+	})
+}
+
+// CoAPRead returns the payload of the retained message of the topic of a coap request,
+// or listeners.ErrCoAPNotFound if the topic has no unexpired retained message.
+func (s *Server) CoAPRead(req listeners.CoAPRequest) ([]byte, error) {
+	if !IsValidFilter(req.Topic, true) {
+		return nil, packets.ErrTopicNameInvalid
+	}
+
+	cl, err := s.authenticateClient(req.Listener, req.ClientID, req.Username, req.Password, req.Remote, true)
+	if err != nil {
+		return nil, err
+	}
+	defer s.releaseUserConnection(cl)
+
+	if !s.aclCheck(cl, req.Topic, false) {
+		s.aclDenied(cl, req.Topic, false)
+		return nil, packets.ErrNotAuthorized
+	}
+
+	for _, pk := range s.Topics.Messages(req.Topic) {
+		if remaining, expires := RemainingMessageExpiry(pk, time.Now().Unix()); expires && remaining <= 0 {
+			continue
+		}
+		return pk.Payload, nil
+	}
+
+	return nil, listeners.ErrCoAPNotFound
+}
+
+// CoAPObserve subscribes a coap request to its topic filter using an event stream of the
+// coap listener, calling notify with the payload of each matching message, including any
+// retained messages, until cancel is called.
+func (s *Server) CoAPObserve(req listeners.CoAPRequest, notify func(payload []byte)) (func(), error) {
+	es, err := s.openEventStream(req.Listener, req.ClientID, req.Username, req.Password, req.Topic, req.Remote)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			select {
+			case msg := <-es.Messages:
+				payload := []byte(msg.Payload)
+				if msg.Encoding == "base64" {
+					payload, _ = base64.StdEncoding.DecodeString(msg.Payload)
+				}
+				notify(payload)
+			case <-es.Done():
+				return
+			}
+		}
+	}()
+
+	return func() {
+		s.CloseEventStream(es)
+	}, nil
+}
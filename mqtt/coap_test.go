@@ -0,0 +1,141 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/listeners"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+func coapReq(topic string) listeners.CoAPRequest {
+	return listeners.CoAPRequest{
+		Listener: "coap",
+		Remote:   "127.0.0.1:5683",
+		Topic:    topic,
+		ClientID: "sensor",
+		Username: "web",
+		Password: "pass",
+	}
+}
+
+func TestCoAPPublishServer(t *testing.T) {
+	s := newEventStreamServer(t)
+
+	req := coapReq("a/b")
+	req.Payload = []byte("21.5")
+	req.Retain = true
+	require.NoError(t, s.CoAPPublish(req))
+
+	msgs := s.Topics.Messages("a/b")
+	require.Len(t, msgs, 1)
+	require.Equal(t, []byte("21.5"), msgs[0].Payload)
+	require.Equal(t, "sensor", msgs[0].Origin)
+
+	payload, err := s.CoAPRead(coapReq("a/b"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("21.5"), payload)
+
+	req.Payload = nil
+	require.NoError(t, s.CoAPPublish(req))
+	_, err = s.CoAPRead(coapReq("a/b"))
+	require.ErrorIs(t, err, listeners.ErrCoAPNotFound)
+}
+
+func TestCoAPPublishServerErrors(t *testing.T) {
+	s := newEventStreamServer(t)
+
+	require.ErrorIs(t, s.CoAPPublish(coapReq("a/+")), packets.ErrTopicNameInvalid)
+	require.ErrorIs(t, s.CoAPPublish(coapReq("a/secret")), packets.ErrNotAuthorized)
+
+	req := coapReq("a/b")
+	req.Qos = 3
+	require.ErrorIs(t, s.CoAPPublish(req), packets.ErrProtocolViolationQosOutOfRange)
+
+	req = coapReq("a/b")
+	req.Password = "wrong"
+	require.ErrorIs(t, s.CoAPPublish(req), packets.ErrBadUsernameOrPassword)
+
+	_, err := s.CoAPRead(req)
+	require.ErrorIs(t, err, packets.ErrBadUsernameOrPassword)
+
+	_, err = s.CoAPRead(coapReq("a/secret"))
+	require.ErrorIs(t, err, packets.ErrNotAuthorized)
+}
+
+func TestCoAPObserveServer(t *testing.T) {
+	s := newEventStreamServer(t)
+
+	received := make(chan []byte, 2)
+	cancel, err := s.CoAPObserve(coapReq("a/#"), func(payload []byte) {
+		received <- payload
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, s.Events.Len())
+
+	es := s.Events.GetAll()[0]
+	require.Equal(t, "coap", es.Client.Net.Listener)
+
+	require.NoError(t, s.CoAPPublish(listeners.CoAPRequest{
+		Listener: "coap",
+		Topic:    "a/b",
+		Username: "web",
+		Password: "pass",
+		Payload:  []byte{0xff, 0xfe},
+	}))
+
+	select {
+	case payload := <-received:
+		require.Equal(t, []byte{0xff, 0xfe}, payload)
+	case <-time.After(time.Second):
+		require.Fail(t, "no notification received")
+	}
+
+	cancel()
+	require.Equal(t, 0, s.Events.Len())
+	require.True(t, es.Client.Closed())
+
+	_, err = s.CoAPObserve(coapReq("b/#"), func([]byte) {})
+	require.ErrorIs(t, err, packets.ErrNotAuthorized)
+}
+
+func TestCoAPPublishServerIPNotAllowed(t *testing.T) {
+	s := newEventStreamServer(t)
+	defer s.Close()
+
+	filter := &listeners.IPFilter{IPRules: listeners.IPRules{Deny: []string{"127.0.0.0/8"}}}
+	require.NoError(t, s.AddListener(listeners.NewTCP("coap", "127.0.0.1:0", &listeners.Config{IPFilter: filter})))
+
+	req := coapReq("a/b")
+	req.Payload = []byte("21.5")
+	require.ErrorIs(t, s.CoAPPublish(req), packets.ErrNotAuthorized)
+
+	_, err := s.CoAPRead(coapReq("a/b"))
+	require.ErrorIs(t, err, packets.ErrNotAuthorized)
+}
+
+func TestCoAPPublishServerConnectChecks(t *testing.T) {
+	s := New(&Options{
+		Logger:                 logger,
+		MaximumUserConnections: 1,
+	})
+	require.NoError(t, s.AddHook(new(eventACLHook), nil))
+	defer s.Close()
+
+	// the user connection of a request is released once it is served
+	require.NoError(t, s.CoAPPublish(coapReq("a/b")))
+	require.NoError(t, s.CoAPPublish(coapReq("a/b")))
+	require.Equal(t, 0, s.UserConns.Count("web"))
+
+	require.True(t, s.UserConns.Acquire("web", 1, false))
+	require.ErrorIs(t, s.CoAPPublish(coapReq("a/b")), packets.ErrQuotaExceeded)
+	s.UserConns.Release("web")
+
+	s.Blacklist = []string{"sensor"}
+	require.ErrorIs(t, s.CoAPPublish(coapReq("a/b")), packets.ErrNotAuthorized)
+}
@@ -0,0 +1,218 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+const (
+	// AcceptEncodingProperty is the CONNECT user property with which a client lists the
+	// payload encodings it can decode, e.g. "gzip".
+	AcceptEncodingProperty = "accept-encoding"
+
+	// ContentEncodingProperty is the PUBLISH user property naming the encoding of the payload.
+	// The server also returns it in the CONNACK with the encoding it will use for the client.
+	ContentEncodingProperty = "content-encoding"
+
+	// GzipEncoding is the name of the gzip payload encoding.
+	GzipEncoding = "gzip"
+
+	defaultMaximumInflatedSize = 16 << 20 // the default limit of a decompressed inbound payload
+)
+
+var ErrInflatedPayloadTooLarge = errors.New("inflated payload exceeds maximum size")
+
+// CompressionPolicy configures the gzip compression of payloads exchanged with MQTT v5 clients
+// on selected listeners, reducing the data sent over metered or constrained links.
+//
+// A client opts in by sending the user property accept-encoding: gzip in its CONNECT packet,
+// which the server confirms with content-encoding: gzip in the CONNACK. Payloads sent to the
+// client are then compressed and marked with a content-encoding: gzip user property. Inbound
+// payloads marked the same way are decompressed before they are routed, so subscribers which
+// did not opt in receive them unchanged.
+type CompressionPolicy struct {
+	// Listeners are the ids of the listeners on which compression may be negotiated.
+	// "*" enables all listeners.
+	Listeners []string `yaml:"listeners" json:"listeners"`
+
+	// MinimumSize is the smallest payload in bytes which is compressed for a client, as
+	// small payloads rarely shrink enough to be worth compressing.
+	MinimumSize int `yaml:"minimum-size" json:"minimum_size"`
+
+	// Level is the gzip compression level, from 1 (fastest) to 9 (smallest). The gzip
+	// default level is used when 0.
+	Level int `yaml:"level" json:"level"`
+
+	// MaximumInflatedSize is the largest size in bytes an inbound payload may decompress to.
+	// Defaults to 16MB when 0.
+	MaximumInflatedSize int `yaml:"maximum-inflated-size" json:"maximum_inflated_size"`
+}
+
+// Validate returns an error if the compression level is not valid.
+func (p *CompressionPolicy) Validate() error {
+	if p.Level < 0 || p.Level > gzip.BestCompression {
+		return fmt.Errorf("invalid compression level %d", p.Level)
+	}
+
+	return nil
+}
+
+// Enabled returns true if compression may be negotiated by clients of a listener.
+func (p *CompressionPolicy) Enabled(listener string) bool {
+	if p == nil {
+		return false
+	}
+
+	return slices.Contains(p.Listeners, AllListeners) || slices.Contains(p.Listeners, listener)
+}
+
+// Compress returns the payload gzip compressed.
+func (p *CompressionPolicy) Compress(payload []byte) ([]byte, error) {
+	level := p.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := zw.Write(payload); err != nil {
+		return nil, err
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Inflate returns a gzip compressed payload decompressed, or an error if the payload is
+// not valid or decompresses to more than the maximum inflated size.
+func (p *CompressionPolicy) Inflate(payload []byte) ([]byte, error) {
+	limit := p.MaximumInflatedSize
+	if limit <= 0 {
+		limit = defaultMaximumInflatedSize
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	b, err := io.ReadAll(io.LimitReader(zr, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) > limit {
+		return nil, ErrInflatedPayloadTooLarge
+	}
+
+	return b, nil
+}
+
+// acceptsEncoding returns true if a list of accepted encodings contains the encoding.
+func acceptsEncoding(accepted, encoding string) bool {
+	for _, v := range strings.Split(accepted, ",") {
+		if strings.EqualFold(strings.TrimSpace(v), encoding) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// contentEncoding returns the value of the content-encoding user property of a packet,
+// and the index of the property, or -1 if the packet has none.
+func contentEncoding(pk packets.Packet) (string, int) {
+	for i, v := range pk.Properties.User {
+		if strings.EqualFold(v.Key, ContentEncodingProperty) {
+			return v.Val, i
+		}
+	}
+
+	return "", -1
+}
+
+// negotiateCompression returns true if a client asked for compressed payloads in its
+// CONNECT user properties and the listener it connected to allows compression.
+func (s *Server) negotiateCompression(cl *Client) bool {
+	if cl.Properties.ProtocolVersion != 5 || !s.Options.Compression.Enabled(cl.Net.Listener) {
+		return false
+	}
+
+	for _, v := range cl.Properties.Props.User {
+		if strings.EqualFold(v.Key, AcceptEncodingProperty) && acceptsEncoding(v.Val, GzipEncoding) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// compressPayload compresses the payload of a packet being sent to a client which negotiated
+// compression. Payloads below the minimum size, payloads already encoded and UTF-8 payloads,
+// which must be forwarded unaltered with their payload format indicator [MQTT-3.3.2-4], are
+// sent as they are, as are payloads which do not shrink.
+func (s *Server) compressPayload(out packets.Packet) packets.Packet {
+	p := s.Options.Compression
+	if len(out.Payload) == 0 || len(out.Payload) < p.MinimumSize {
+		return out
+	}
+
+	if out.Properties.PayloadFormatFlag && out.Properties.PayloadFormat == 1 {
+		return out
+	}
+
+	if _, i := contentEncoding(out); i >= 0 {
+		return out
+	}
+
+	b, err := p.Compress(out.Payload)
+	if err != nil || len(b) >= len(out.Payload) {
+		return out
+	}
+
+	out.Payload = b
+	out.Properties.User = append(out.Properties.User, packets.UserProperty{Key: ContentEncodingProperty, Val: GzipEncoding})
+	return out
+}
+
+// inflatePayload decompresses the payload of a gzip encoded packet received from a client
+// of a listener which allows compression, removing the content-encoding user property.
+// Packets from other listeners, and packets with other encodings, are returned unchanged.
+func (s *Server) inflatePayload(cl *Client, pk packets.Packet) (packets.Packet, error) {
+	if !s.Options.Compression.Enabled(cl.Net.Listener) {
+		return pk, nil
+	}
+
+	encoding, i := contentEncoding(pk)
+	if i < 0 || !strings.EqualFold(encoding, GzipEncoding) {
+		return pk, nil
+	}
+
+	b, err := s.Options.Compression.Inflate(pk.Payload)
+	if err != nil {
+		return pk, err
+	}
+
+	pk.Payload = b
+	pk.Properties.User = slices.Delete(slices.Clone(pk.Properties.User), i, i+1)
+	return pk, nil
+}
@@ -0,0 +1,183 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+func TestCompressionPolicyEnabled(t *testing.T) {
+	var p *CompressionPolicy
+	require.False(t, p.Enabled("t1"))
+
+	p = &CompressionPolicy{Listeners: []string{"t1"}}
+	require.True(t, p.Enabled("t1"))
+	require.False(t, p.Enabled("t2"))
+
+	p = &CompressionPolicy{Listeners: []string{AllListeners}}
+	require.True(t, p.Enabled("t2"))
+}
+
+func TestCompressionPolicyValidate(t *testing.T) {
+	require.NoError(t, (&CompressionPolicy{}).Validate())
+	require.NoError(t, (&CompressionPolicy{Level: 9}).Validate())
+	require.Error(t, (&CompressionPolicy{Level: 10}).Validate())
+}
+
+func TestCompressionPolicyInflate(t *testing.T) {
+	p := &CompressionPolicy{MaximumInflatedSize: 64}
+	payload := bytes.Repeat([]byte("a"), 64)
+	b, err := p.Compress(payload)
+	require.NoError(t, err)
+
+	v, err := p.Inflate(b)
+	require.NoError(t, err)
+	require.Equal(t, payload, v)
+
+	b, err = p.Compress(bytes.Repeat([]byte("a"), 65))
+	require.NoError(t, err)
+	_, err = p.Inflate(b)
+	require.ErrorIs(t, err, ErrInflatedPayloadTooLarge)
+
+	_, err = p.Inflate([]byte("not gzip"))
+	require.Error(t, err)
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	s := newServer()
+	s.Options.Compression = &CompressionPolicy{Listeners: []string{"t1"}}
+
+	cl, _, _ := newTestClient()
+	cl.Net.Listener = "t1"
+	cl.Properties.ProtocolVersion = 5
+	require.False(t, s.negotiateCompression(cl))
+
+	cl.Properties.Props.User = []packets.UserProperty{{Key: AcceptEncodingProperty, Val: "br, GZIP"}}
+	require.True(t, s.negotiateCompression(cl))
+
+	cl.Net.Listener = "t2"
+	require.False(t, s.negotiateCompression(cl))
+
+	cl.Net.Listener = "t1"
+	cl.Properties.ProtocolVersion = 4
+	require.False(t, s.negotiateCompression(cl))
+}
+
+func TestPublishToClientCompressed(t *testing.T) {
+	s := newServer()
+	s.Options.Compression = &CompressionPolicy{Listeners: []string{AllListeners}, MinimumSize: 32}
+	cl, _, _ := newTestClient()
+	cl.Properties.ProtocolVersion = 5
+	cl.State.compress = true
+	s.Clients.Add(cl)
+
+	payload := bytes.Repeat([]byte("hello"), 20)
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish},
+		TopicName:   "a/b/c",
+		Payload:     payload,
+	}
+
+	out, err := s.publishToClient(cl, packets.Subscription{Filter: "a/b/c"}, pk)
+	require.NoError(t, err)
+	require.Less(t, len(out.Payload), len(payload))
+	encoding, i := contentEncoding(out)
+	require.GreaterOrEqual(t, i, 0)
+	require.Equal(t, GzipEncoding, encoding)
+
+	v, err := s.Options.Compression.Inflate(out.Payload)
+	require.NoError(t, err)
+	require.Equal(t, payload, v)
+	require.Equal(t, payload, pk.Payload)
+}
+
+func TestCompressPayloadSkipped(t *testing.T) {
+	s := newServer()
+	s.Options.Compression = &CompressionPolicy{MinimumSize: 32}
+	payload := bytes.Repeat([]byte("hello"), 20)
+
+	pk := packets.Packet{Payload: []byte("short")}
+	require.Equal(t, pk, s.compressPayload(pk))
+
+	pk = packets.Packet{Payload: payload, Properties: packets.Properties{PayloadFormat: 1, PayloadFormatFlag: true}}
+	require.Equal(t, pk, s.compressPayload(pk))
+
+	pk = packets.Packet{Payload: payload, Properties: packets.Properties{User: []packets.UserProperty{{Key: ContentEncodingProperty, Val: "br"}}}}
+	require.Equal(t, pk, s.compressPayload(pk))
+}
+
+func TestInflatePayload(t *testing.T) {
+	s := newServer()
+	s.Options.Compression = &CompressionPolicy{Listeners: []string{"t1"}}
+	cl, _, _ := newTestClient()
+	cl.Net.Listener = "t1"
+
+	b, err := s.Options.Compression.Compress([]byte("hello"))
+	require.NoError(t, err)
+	pk := packets.Packet{
+		Payload: b,
+		Properties: packets.Properties{User: []packets.UserProperty{
+			{Key: "k", Val: "v"},
+			{Key: ContentEncodingProperty, Val: GzipEncoding},
+		}},
+	}
+
+	out, err := s.inflatePayload(cl, pk)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello"), out.Payload)
+	require.Equal(t, []packets.UserProperty{{Key: "k", Val: "v"}}, out.Properties.User)
+	require.Len(t, pk.Properties.User, 2)
+
+	cl.Net.Listener = "t2"
+	out, err = s.inflatePayload(cl, pk)
+	require.NoError(t, err)
+	require.Equal(t, pk, out)
+}
+
+func TestServerProcessPublishInflateInvalid(t *testing.T) {
+	s := newServer()
+	s.Options.Compression = &CompressionPolicy{Listeners: []string{AllListeners}}
+	cl, r, w := newTestClient()
+	cl.Properties.ProtocolVersion = 5
+	s.Clients.Add(cl)
+
+	pk := *packets.TPacketData[packets.Publish].Get(packets.TPublishQos1).Packet
+	pk.Properties.User = []packets.UserProperty{{Key: ContentEncodingProperty, Val: GzipEncoding}}
+	pk.Payload = []byte("not gzip")
+
+	go func() {
+		err := s.processPacket(cl, pk)
+		require.NoError(t, err)
+		_ = w.Close()
+	}()
+
+	buf, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, packets.Puback<<4, buf[0])
+	require.Equal(t, packets.ErrPayloadFormatInvalid.Code, buf[4])
+}
+
+func TestServerSendConnackCompression(t *testing.T) {
+	s := newServer()
+	cl, r, w := newTestClient()
+	cl.Properties.ProtocolVersion = 5
+	cl.State.compress = true
+
+	go func() {
+		err := s.SendConnack(cl, packets.CodeSuccess, false, nil)
+		require.NoError(t, err)
+		_ = w.Close()
+	}()
+
+	buf, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Contains(t, string(buf), ContentEncodingProperty)
+	require.Contains(t, string(buf), GzipEncoding)
+}
@@ -0,0 +1,82 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+// DeadLetterClientId is the id of the inline client used to publish dead letters.
+const DeadLetterClientId = "dead-letter"
+
+const (
+	DeadLetterQueueOverflow  = "queue_overflow"  // the client's outbound queue or inflight quota was full
+	DeadLetterExpired        = "expired"         // the message expired before delivery was completed
+	DeadLetterDeliveryFailed = "delivery_failed" // the client rejected delivery with an error reason code
+)
+
+// DeadLetter is the payload published to the dead letter topic when a message is dropped.
+type DeadLetter struct {
+	Reason   string `json:"reason"`             // why the message was dropped
+	ClientID string `json:"client_id"`          // the client the message was being delivered to
+	Origin   string `json:"origin,omitempty"`   // the client which published the message
+	Topic    string `json:"topic"`              // the topic of the message
+	Qos      byte   `json:"qos"`                // the qos the message was delivered at
+	Retain   bool   `json:"retain"`             // the retain flag of the message
+	Created  int64  `json:"created"`            // the unix time the message was received by the broker
+	Dropped  int64  `json:"dropped"`            // the unix time the message was dropped
+	Code     byte   `json:"code,omitempty"`     // the reason code returned by the client, if any
+	Payload  []byte `json:"payload"`            // the original payload, base64 encoded
+	Response string `json:"response,omitempty"` // the response topic of the message, if any
+}
+
+// deadLetter publishes a message which could not be delivered to a client to the dead
+// letter topic, along with the reason it was dropped. Messages on the dead letter topic
+// are never themselves dead lettered, preventing loops.
+func (s *Server) deadLetter(cl *Client, pk packets.Packet, reason string) {
+	if s.deadLetters == nil || pk.FixedHeader.Type != packets.Publish {
+		return
+	}
+
+	if pk.TopicName == "" || pk.TopicName == s.Options.DeadLetterTopic {
+		return
+	}
+
+	payload, err := json.Marshal(DeadLetter{
+		Reason:   reason,
+		ClientID: cl.ID,
+		Origin:   pk.Origin,
+		Topic:    pk.TopicName,
+		Qos:      pk.FixedHeader.Qos,
+		Retain:   pk.FixedHeader.Retain,
+		Created:  pk.Created,
+		Dropped:  time.Now().Unix(),
+		Code:     pk.ReasonCode,
+		Payload:  pk.Payload,
+		Response: pk.Properties.ResponseTopic,
+	})
+	if err != nil {
+		s.Log.Error("failed to encode dead letter", "error", err, "client", cl.ID, "topic", pk.TopicName)
+		return
+	}
+
+	atomic.AddInt64(&s.Info.DeadLettered, 1)
+	err = s.InjectPacket(s.deadLetters, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+			Qos:  s.Options.DeadLetterQos,
+		},
+		TopicName: s.Options.DeadLetterTopic,
+		Payload:   payload,
+		PacketID:  uint16(s.Options.DeadLetterQos), // inline clients never process the inbound qos flow.
+	})
+	if err != nil {
+		s.Log.Warn("failed to publish dead letter", "error", err, "client", cl.ID, "topic", pk.TopicName)
+	}
+}
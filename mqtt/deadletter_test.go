@@ -0,0 +1,137 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+func newDeadLetterServer(t *testing.T) (*Server, chan DeadLetter) {
+	s := New(&Options{
+		Logger:          logger,
+		InlineClient:    true,
+		DeadLetterTopic: "dead/letters",
+	})
+	_ = s.AddHook(new(AllowHook), nil)
+	require.NotNil(t, s.deadLetters)
+
+	recv := make(chan DeadLetter, 4)
+	err := s.Subscribe("dead/letters", 1, func(cl *Client, sub packets.Subscription, pk packets.Packet) {
+		var dl DeadLetter
+		require.NoError(t, json.Unmarshal(pk.Payload, &dl))
+		recv <- dl
+	})
+	require.NoError(t, err)
+
+	return s, recv
+}
+
+func receiveDeadLetter(t *testing.T, recv chan DeadLetter) DeadLetter {
+	select {
+	case dl := <-recv:
+		return dl
+	case <-time.After(time.Second):
+		require.Fail(t, "no dead letter received")
+	}
+
+	return DeadLetter{}
+}
+
+func TestDeadLetterDisabled(t *testing.T) {
+	s := newServer()
+	require.Nil(t, s.deadLetters)
+
+	cl, _, _ := newTestClient()
+	s.deadLetter(cl, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish}, TopicName: "a/b"}, DeadLetterExpired)
+	require.Equal(t, int64(0), s.Info.DeadLettered)
+}
+
+func TestDeadLetterQueueOverflow(t *testing.T) {
+	s, recv := newDeadLetterServer(t)
+
+	// the write loop blocks on the first packet, as nothing reads the connection, and the
+	// rest fill the outbound queue
+	cl, _, _ := newTestClient()
+	cl.State.outbound <- new(packets.Packet)
+	require.Eventually(t, func() bool {
+		return len(cl.State.outbound) == 0
+	}, time.Second, time.Millisecond)
+	for len(cl.State.outbound) < cap(cl.State.outbound) {
+		cl.State.outbound <- new(packets.Packet)
+	}
+
+	_, err := s.publishToClient(cl, packets.Subscription{Filter: "a/b"}, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish},
+		TopicName:   "a/b",
+		Payload:     []byte("hello"),
+		Origin:      "origin",
+	})
+	require.ErrorIs(t, err, packets.ErrPendingClientWritesExceeded)
+
+	dl := receiveDeadLetter(t, recv)
+	require.Equal(t, DeadLetterQueueOverflow, dl.Reason)
+	require.Equal(t, cl.ID, dl.ClientID)
+	require.Equal(t, "origin", dl.Origin)
+	require.Equal(t, "a/b", dl.Topic)
+	require.Equal(t, []byte("hello"), dl.Payload)
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.DeadLettered))
+}
+
+func TestDeadLetterExpired(t *testing.T) {
+	s, recv := newDeadLetterServer(t)
+
+	n := time.Now().Unix()
+	cl, _, _ := newTestClient()
+	cl.ops.info = s.Info
+	cl.State.Inflight.Set(packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		PacketID:    1,
+		TopicName:   "a/b",
+		Expiry:      n - 1,
+	})
+	s.Clients.Add(cl)
+
+	s.clearExpiredInflights(n)
+	dl := receiveDeadLetter(t, recv)
+	require.Equal(t, DeadLetterExpired, dl.Reason)
+	require.Equal(t, "a/b", dl.Topic)
+	require.Equal(t, byte(1), dl.Qos)
+}
+
+func TestDeadLetterDeliveryFailed(t *testing.T) {
+	s, recv := newDeadLetterServer(t)
+
+	cl, _, _ := newTestClient()
+	cl.State.Inflight.Set(packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		PacketID:    7,
+		TopicName:   "a/b",
+	})
+
+	err := s.processPuback(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Puback},
+		PacketID:    7,
+		ReasonCode:  packets.ErrNotAuthorized.Code,
+	})
+	require.NoError(t, err)
+
+	dl := receiveDeadLetter(t, recv)
+	require.Equal(t, DeadLetterDeliveryFailed, dl.Reason)
+	require.Equal(t, packets.ErrNotAuthorized.Code, dl.Code)
+}
+
+func TestDeadLetterIgnoresOwnTopic(t *testing.T) {
+	s, _ := newDeadLetterServer(t)
+
+	cl, _, _ := newTestClient()
+	s.deadLetter(cl, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish}, TopicName: "dead/letters"}, DeadLetterExpired)
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.Info.DeadLettered))
+}
@@ -0,0 +1,78 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+// drainInterval is the interval between the batches of clients disconnected by a drain.
+const drainInterval = 100 * time.Millisecond
+
+// drainCode returns the reason code and properties of the DISCONNECT packets sent to
+// MQTT v5 clients by a drain, referring them to another server if one is configured.
+func (s *Server) drainCode() (packets.Code, packets.Properties) {
+	if s.Options.DrainServerReference == "" {
+		return packets.ErrServerShuttingDown, packets.Properties{ReasonString: packets.ErrServerShuttingDown.Reason}
+	}
+
+	return packets.ErrUseAnotherServer, packets.Properties{
+		ReasonString:    packets.ErrUseAnotherServer.Reason,
+		ServerReference: s.Options.DrainServerReference,
+	}
+}
+
+// drainClients disconnects the connected clients in batches spread over the timeout,
+// rather than all at once, so that they do not all reconnect to the other servers at
+// the same moment. MQTT v5 clients are sent a DISCONNECT with the Server Shutting Down
+// reason code, or Use Another Server if a server reference is configured, while MQTT v3
+// clients are closed. Clients which disconnect themselves meanwhile are skipped. The
+// listeners must no longer accept connections.
+func (s *Server) drainClients(timeout time.Duration) {
+	code, props := s.drainCode()
+	clients := s.connectedClients()
+	s.Log.Info("draining clients", "clients", len(clients), "timeout", timeout.String())
+
+	batches := max(int(timeout/drainInterval), 1)
+	size := (len(clients) + batches - 1) / batches
+
+	tick := time.NewTicker(drainInterval)
+	defer tick.Stop()
+
+	for i, cl := range clients {
+		if i > 0 && size > 0 && i%size == 0 {
+			<-tick.C
+		}
+
+		if cl.Closed() {
+			continue
+		}
+
+		if cl.Properties.ProtocolVersion == 5 {
+			_ = cl.WritePacket(packets.Packet{
+				FixedHeader: packets.FixedHeader{Type: packets.Disconnect},
+				ReasonCode:  code.Code,
+				Properties:  props,
+			})
+		}
+		cl.Stop(code)
+	}
+
+	s.Log.Info("clients drained", "clients", len(clients))
+}
+
+// connectedClients returns the clients with open network connections.
+func (s *Server) connectedClients() []*Client {
+	var clients []*Client
+	for _, cl := range s.Clients.GetAll() {
+		if !cl.Net.Inline && !cl.Closed() {
+			clients = append(clients, cl)
+		}
+	}
+
+	return clients
+}
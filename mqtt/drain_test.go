@@ -0,0 +1,145 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/listeners"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+func readAllAsync(r net.Conn) chan []byte {
+	recv := make(chan []byte, 1)
+	go func() {
+		buf, _ := io.ReadAll(r)
+		recv <- buf
+	}()
+	return recv
+}
+
+func TestServerDrainCode(t *testing.T) {
+	s := newServer()
+	code, props := s.drainCode()
+	require.Equal(t, packets.ErrServerShuttingDown, code)
+	require.Equal(t, packets.ErrServerShuttingDown.Reason, props.ReasonString)
+	require.Empty(t, props.ServerReference)
+
+	s.Options.DrainServerReference = "node2:1883"
+	code, props = s.drainCode()
+	require.Equal(t, packets.ErrUseAnotherServer, code)
+	require.Equal(t, "node2:1883", props.ServerReference)
+}
+
+func TestServerCloseDrain(t *testing.T) {
+	s := newServer()
+	s.Options.DrainTimeout = 1
+
+	cl, r, _ := newTestClient()
+	cl.Net.Listener = "t1"
+	cl.Properties.ProtocolVersion = 5
+	s.Clients.Add(cl)
+
+	cl3, r3, _ := newTestClient()
+	cl3.ID = "mochi3"
+	cl3.Net.Listener = "t1"
+	cl3.Properties.ProtocolVersion = 4
+	s.Clients.Add(cl3)
+
+	err := s.AddListener(listeners.NewMockListener("t1", ":1882"))
+	require.NoError(t, err)
+	_ = s.Serve()
+
+	recv, recv3 := readAllAsync(r), readAllAsync(r3)
+
+	listener, ok := s.Listeners.Get("t1")
+	require.True(t, ok)
+	require.Eventually(t, listener.(*listeners.MockListener).IsServing, time.Second, time.Millisecond)
+
+	_ = s.Close()
+	require.False(t, listener.(*listeners.MockListener).IsServing())
+	require.Equal(t, packets.TPacketData[packets.Disconnect].Get(packets.TDisconnectShuttingDown).RawBytes, <-recv)
+	require.Empty(t, <-recv3)
+	require.True(t, cl.Closed())
+	require.True(t, cl3.Closed())
+}
+
+func TestServerCloseDrainServerReference(t *testing.T) {
+	s := newServer()
+	s.Options.DrainTimeout = 1
+	s.Options.DrainServerReference = "node2:1883"
+
+	cl, r, _ := newTestClient()
+	cl.Net.Listener = "t1"
+	cl.Properties.ProtocolVersion = 5
+	s.Clients.Add(cl)
+
+	err := s.AddListener(listeners.NewMockListener("t1", ":1882"))
+	require.NoError(t, err)
+	_ = s.Serve()
+
+	recv := readAllAsync(r)
+	_ = s.Close()
+
+	buf := <-recv
+	require.GreaterOrEqual(t, len(buf), 3)
+	require.Equal(t, byte(packets.Disconnect<<4), buf[0])
+	require.Equal(t, packets.ErrUseAnotherServer.Code, buf[2])
+	require.True(t, bytes.Contains(buf, []byte("node2:1883")))
+}
+
+func TestServerDrainClientsBatches(t *testing.T) {
+	s := newServer()
+
+	var recvs []chan []byte
+	for _, id := range []string{"a", "b", "c", "d"} {
+		cl, r, _ := newTestClient()
+		cl.ID = id
+		cl.Properties.ProtocolVersion = 4
+		s.Clients.Add(cl)
+		recvs = append(recvs, readAllAsync(r))
+	}
+
+	start := time.Now()
+	s.drainClients(2 * drainInterval)
+	require.GreaterOrEqual(t, time.Since(start), drainInterval)
+	for _, recv := range recvs {
+		<-recv
+	}
+
+	for _, cl := range s.Clients.GetAll() {
+		require.True(t, cl.Closed())
+	}
+}
+
+func TestServerDrainClientsSkipsInlineAndClosed(t *testing.T) {
+	s := newServer()
+
+	inline, _, _ := newTestClient()
+	inline.ID = "inline"
+	inline.Net.Inline = true
+	s.Clients.Add(inline)
+
+	closed, _, _ := newTestClient()
+	closed.ID = "closed"
+	closed.Stop(packets.CodeDisconnect)
+	s.Clients.Add(closed)
+
+	open, r, _ := newTestClient()
+	open.ID = "open"
+	s.Clients.Add(open)
+	recv := readAllAsync(r)
+
+	require.Equal(t, []*Client{open}, s.connectedClients())
+	s.drainClients(0)
+	<-recv
+	require.True(t, open.Closed())
+	require.False(t, inline.Closed())
+}
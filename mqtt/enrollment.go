@@ -0,0 +1,34 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+// EnrollmentListener is the listener id of devices enrolling for client certificates.
+const EnrollmentListener = "enrollment"
+
+// AuthenticateEnrollment authenticates a device requesting a client certificate using
+// the server auth hooks, as if it were connecting with the username and password.
+func (s *Server) AuthenticateEnrollment(username, password, remote string) bool {
+	cl := s.NewClient(nil, EnrollmentListener, EnrollmentListener+"-"+username, true)
+	cl.Net.Remote = remote
+	cl.Properties.ProtocolVersion = 5
+	cl.Properties.Username = []byte(username)
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Connect},
+		Connect: packets.ConnectParams{
+			ClientIdentifier: cl.ID,
+			Username:         []byte(username),
+			UsernameFlag:     username != "",
+			Password:         []byte(password),
+			PasswordFlag:     password != "",
+		},
+	}
+
+	return s.hooks.OnConnectAuthenticate(cl, pk)
+}
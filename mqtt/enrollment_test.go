@@ -0,0 +1,19 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthenticateEnrollment(t *testing.T) {
+	s := newServer()
+	require.True(t, s.AuthenticateEnrollment("alice", "secret", "127.0.0.1"))
+
+	s = New(&Options{Logger: logger})
+	require.False(t, s.AuthenticateEnrollment("alice", "secret", "127.0.0.1"))
+}
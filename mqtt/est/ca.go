@@ -0,0 +1,257 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package est
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	defaultValidity = 365 * 24 * time.Hour
+	defaultTimeout  = 10 * time.Second
+	maxResponseSize = 1 << 20 // the maximum size of responses from an external ca
+)
+
+var (
+	ErrNoCACert      = errors.New("no ca certificate configured")
+	ErrNoCA          = errors.New("no ca key or ca url configured")
+	ErrInvalidCACert = errors.New("invalid ca certificate")
+	ErrInvalidCAKey  = errors.New("invalid ca key")
+)
+
+// CA issues client certificates for certificate signing requests.
+type CA interface {
+	// Certificates returns the ca certificates which issued certificates chain to.
+	Certificates() []*x509.Certificate
+
+	// Sign issues a client certificate for a verified certificate signing request.
+	Sign(csr *x509.CertificateRequest) (*x509.Certificate, error)
+}
+
+// NewCA returns the ca configured by the options, which is file based if a ca key
+// is configured, or otherwise external.
+func NewCA(opts *Options) (CA, error) {
+	if opts.CACert == "" {
+		return nil, ErrNoCACert
+	}
+
+	certs, err := readCertificates(opts.CACert)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.CAKey != "" {
+		return NewFileCA(certs, opts.CAKey, opts.Validity)
+	}
+
+	if opts.CAURL != "" {
+		return NewRemoteCA(certs, opts.CAURL, opts.Timeout), nil
+	}
+
+	return nil, ErrNoCA
+}
+
+// readCertificates reads the pem encoded certificates of a file.
+func readCertificates(file string) ([]*x509.Certificate, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	certs, err := parseCertificates(b)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(certs) == 0 {
+		return nil, ErrInvalidCACert
+	}
+
+	return certs, nil
+}
+
+// parseCertificates parses the certificates of pem encoded data.
+func parseCertificates(b []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			return certs, nil
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		certs = append(certs, cert)
+	}
+}
+
+// FileCA is a ca which signs certificates with a certificate and key read from files.
+type FileCA struct {
+	certs    []*x509.Certificate
+	key      crypto.Signer
+	validity time.Duration
+}
+
+// NewFileCA returns a ca which signs with the key of a pem encoded key file, issuing
+// certificates valid for the validity period.
+func NewFileCA(certs []*x509.Certificate, keyFile string, validity time.Duration) (*FileCA, error) {
+	cb := new(bytes.Buffer)
+	for _, cert := range certs {
+		_ = pem.Encode(cb, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+
+	kb, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pair, err := tls.X509KeyPair(cb.Bytes(), kb)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCAKey, err)
+	}
+
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, ErrInvalidCAKey
+	}
+
+	if validity <= 0 {
+		validity = defaultValidity
+	}
+
+	return &FileCA{
+		certs:    certs,
+		key:      key,
+		validity: validity,
+	}, nil
+}
+
+// Certificates returns the ca certificates.
+func (ca *FileCA) Certificates() []*x509.Certificate {
+	return ca.certs
+}
+
+// Sign issues a client certificate for the subject and names of a certificate signing
+// request. The certificate does not outlive the ca certificate.
+func (ca *FileCA) Sign(csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	issuer := ca.certs[0]
+	now := time.Now()
+	notAfter := now.Add(ca.validity)
+	if notAfter.After(issuer.NotAfter) {
+		notAfter = issuer.NotAfter
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:   serial,
+		Subject:        csr.Subject,
+		DNSNames:       csr.DNSNames,
+		EmailAddresses: csr.EmailAddresses,
+		IPAddresses:    csr.IPAddresses,
+		URIs:           csr.URIs,
+		NotBefore:      now.Add(-time.Minute),
+		NotAfter:       notAfter,
+		KeyUsage:       x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, csr.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(der)
+}
+
+// RemoteCA is a ca which forwards certificate signing requests to an external ca.
+// The pem encoded request is posted to the url, which responds with the pem encoded
+// certificate issued.
+type RemoteCA struct {
+	certs  []*x509.Certificate
+	url    string
+	client *http.Client
+}
+
+// NewRemoteCA returns a ca which forwards certificate signing requests to a url.
+func NewRemoteCA(certs []*x509.Certificate, url string, timeout time.Duration) *RemoteCA {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	return &RemoteCA{
+		certs:  certs,
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// Certificates returns the ca certificates.
+func (ca *RemoteCA) Certificates() []*x509.Certificate {
+	return ca.certs
+}
+
+// Sign posts a certificate signing request to the external ca.
+func (ca *RemoteCA) Sign(csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	body := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw})
+	ctx, cancel := context.WithTimeout(context.Background(), ca.client.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ca.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-pem-file")
+
+	resp, err := ca.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, err
+	}
+
+	certs, err := parseCertificates(b)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate issued")
+	}
+
+	return certs[0], nil
+}
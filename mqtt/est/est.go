@@ -0,0 +1,252 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+// Package est implements the simple enrollment endpoints of Enrollment over Secure
+// Transport (RFC 7030), so that devices can obtain and renew the client certificates
+// they use to connect to the broker with mutual tls.
+package est
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt"
+)
+
+const (
+	CACertsPath        = "/.well-known/est/cacerts"
+	SimpleEnrollPath   = "/.well-known/est/simpleenroll"
+	SimpleReenrollPath = "/.well-known/est/simplereenroll"
+)
+
+const (
+	pkcs7ContentType = "application/pkcs7-mime; smime-type=certs-only"
+	maxRequestSize   = 64 << 10 // the maximum size of certificate signing requests
+)
+
+var (
+	ErrTLSRequired = errors.New("enrollment requires a tls http listener")
+	ErrSubject     = errors.New("certificate request subject does not match")
+)
+
+// Options contains configuration settings for certificate enrollment. The ca certificate
+// should also be the mqtt tls ca-cert, so that the certificates issued are accepted by
+// the mqtt listeners.
+type Options struct {
+	Enable   bool          `yaml:"enable" json:"enable"`
+	CACert   string        `yaml:"ca-cert" json:"ca-cert"`   // the pem encoded ca certificate file
+	CAKey    string        `yaml:"ca-key" json:"ca-key"`     // the pem encoded ca key file, for a file based ca
+	CAURL    string        `yaml:"ca-url" json:"ca-url"`     // the url of an external ca, used if there is no ca key
+	Validity time.Duration `yaml:"validity" json:"validity"` // the validity of issued certificates, defaults to 1 year
+	Timeout  time.Duration `yaml:"timeout" json:"timeout"`   // the timeout of external ca requests, defaults to 10 seconds
+}
+
+type Handler = func(http.ResponseWriter, *http.Request)
+
+// EST serves certificate enrollment requests. Devices enroll using the username and
+// password they connect with, which are checked by the server auth hooks, and renew
+// using the certificate previously issued to them.
+type EST struct {
+	server *mqtt.Server
+	ca     CA
+	roots  *x509.CertPool
+	log    *slog.Logger
+}
+
+// New returns a new instance of EST, issuing certificates from a ca.
+func New(server *mqtt.Server, ca CA) *EST {
+	roots := x509.NewCertPool()
+	for _, cert := range ca.Certificates() {
+		roots.AddCert(cert)
+	}
+
+	return &EST{
+		server: server,
+		ca:     ca,
+		roots:  roots,
+		log:    server.Log.With("module", "est"),
+	}
+}
+
+// GenHandlers returns the enrollment handlers, keyed on method and path.
+func (e *EST) GenHandlers() map[string]Handler {
+	return map[string]Handler{
+		"GET " + CACertsPath:         e.caCerts,
+		"POST " + SimpleEnrollPath:   e.simpleEnroll,
+		"POST " + SimpleReenrollPath: e.simpleReenroll,
+	}
+}
+
+// TLSConfig returns the tls config of the http listener serving enrollment requests,
+// based on the tls config of the mqtt listeners. Client certificates are requested
+// but optional, so that devices without a certificate can enroll.
+func (e *EST) TLSConfig(base *tls.Config) (*tls.Config, error) {
+	if base == nil || len(base.Certificates) == 0 {
+		return nil, ErrTLSRequired
+	}
+
+	c := base.Clone()
+	c.ClientAuth = tls.VerifyClientCertIfGiven
+	c.ClientCAs = e.roots
+	return c, nil
+}
+
+// caCerts returns the ca certificates
+// GET /.well-known/est/cacerts
+func (e *EST) caCerts(w http.ResponseWriter, r *http.Request) {
+	e.writeCerts(w, e.ca.Certificates())
+}
+
+// simpleEnroll issues a certificate to a device authenticated by username and password.
+// The common name of the request must be the username.
+// POST /.well-known/est/simpleenroll
+func (e *EST) simpleEnroll(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil {
+		http.Error(w, ErrTLSRequired.Error(), http.StatusForbidden)
+		return
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok || !e.server.AuthenticateEnrollment(username, password, r.RemoteAddr) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="est"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	csr, err := readRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if csr.Subject.CommonName != username {
+		http.Error(w, ErrSubject.Error(), http.StatusBadRequest)
+		return
+	}
+
+	e.issue(w, r, csr)
+}
+
+// simpleReenroll renews a certificate previously issued by the ca, which the device
+// presents as its tls client certificate. The subject and names of the request must
+// match the certificate being renewed.
+// POST /.well-known/est/simplereenroll
+func (e *EST) simpleReenroll(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil {
+		http.Error(w, ErrTLSRequired.Error(), http.StatusForbidden)
+		return
+	}
+
+	cert, err := e.verifyPeer(r.TLS)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	csr, err := readRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !sameIdentity(cert, csr) {
+		http.Error(w, ErrSubject.Error(), http.StatusBadRequest)
+		return
+	}
+
+	e.issue(w, r, csr)
+}
+
+// verifyPeer returns the tls client certificate of a connection, if it was issued by the ca.
+func (e *EST) verifyPeer(cs *tls.ConnectionState) (*x509.Certificate, error) {
+	if len(cs.PeerCertificates) == 0 {
+		return nil, errors.New("no client certificate")
+	}
+
+	cert := cs.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, c := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         e.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
+
+// issue signs a certificate signing request and writes the certificate issued.
+func (e *EST) issue(w http.ResponseWriter, r *http.Request, csr *x509.CertificateRequest) {
+	cert, err := e.ca.Sign(csr)
+	if err != nil {
+		e.log.Error("failed to issue certificate", "error", err, "subject", csr.Subject.String(), "remote", r.RemoteAddr)
+		http.Error(w, "certificate not issued", http.StatusInternalServerError)
+		return
+	}
+
+	e.log.Info("issued certificate", "subject", cert.Subject.String(), "serial", cert.SerialNumber.Text(16), "expires", cert.NotAfter, "remote", r.RemoteAddr)
+	e.writeCerts(w, []*x509.Certificate{cert})
+}
+
+// writeCerts writes certificates as a base64 encoded pkcs#7 certs-only message.
+func (e *EST) writeCerts(w http.ResponseWriter, certs []*x509.Certificate) {
+	b, err := certsOnly(certs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", pkcs7ContentType)
+	w.Header().Set("Content-Transfer-Encoding", "base64")
+	_, _ = w.Write([]byte(base64.StdEncoding.EncodeToString(b)))
+}
+
+// readRequest reads and verifies the base64 encoded pkcs#10 certificate signing request
+// of an enrollment request.
+func readRequest(r *http.Request) (*x509.CertificateRequest, error) {
+	b, err := io.ReadAll(io.LimitReader(r.Body, maxRequestSize))
+	if err != nil {
+		return nil, err
+	}
+
+	// the base64 encoding may be split over lines
+	b = bytes.Join(bytes.Fields(b), nil)
+	der, err := base64.StdEncoding.DecodeString(string(b))
+	if err != nil {
+		return nil, err
+	}
+
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+
+	return csr, nil
+}
+
+// sameIdentity returns true if a certificate signing request is for the subject and
+// names of a certificate.
+func sameIdentity(cert *x509.Certificate, csr *x509.CertificateRequest) bool {
+	return cert.Subject.String() == csr.Subject.String() &&
+		slices.Equal(cert.DNSNames, csr.DNSNames) &&
+		slices.Equal(cert.EmailAddresses, csr.EmailAddresses)
+}
@@ -0,0 +1,311 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package est
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+type passwordHook struct {
+	mqtt.HookBase
+}
+
+func (h *passwordHook) ID() string {
+	return "password"
+}
+
+func (h *passwordHook) Provides(b byte) bool {
+	return b == mqtt.OnConnectAuthenticate
+}
+
+func (h *passwordHook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	return string(pk.Connect.Username) == "alice" && string(pk.Connect.Password) == "secret"
+}
+
+// newTestCA writes a self-signed ca certificate and key to a directory.
+func newTestCA(t *testing.T, dir string) *Options {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	kb, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	opts := &Options{
+		Enable: true,
+		CACert: filepath.Join(dir, "ca.pem"),
+		CAKey:  filepath.Join(dir, "ca.key"),
+	}
+	require.NoError(t, os.WriteFile(opts.CACert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(opts.CAKey, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: kb}), 0600))
+	return opts
+}
+
+// newCSR returns a base64 encoded certificate signing request for a common name.
+func newCSR(t *testing.T, cn string) (string, crypto.Signer) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: cn},
+	}, key)
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(der), key
+}
+
+func parseCertsOnly(t *testing.T, body []byte) []*x509.Certificate {
+	b, err := base64.StdEncoding.DecodeString(string(body))
+	require.NoError(t, err)
+
+	var ci contentInfo
+	_, err = asn1.Unmarshal(b, &ci)
+	require.NoError(t, err)
+	require.True(t, ci.ContentType.Equal(oidSignedData))
+
+	var sd signedData
+	_, err = asn1.Unmarshal(ci.Content.Bytes, &sd)
+	require.NoError(t, err)
+
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	require.NoError(t, err)
+	return certs
+}
+
+// newTestServer returns a tls server serving the enrollment handlers.
+func newTestServer(t *testing.T, ca CA) (*httptest.Server, *EST) {
+	s := mqtt.New(&mqtt.Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	require.NoError(t, s.AddHook(new(passwordHook), nil))
+	e := New(s, ca)
+
+	mux := http.NewServeMux()
+	for path, h := range e.GenHandlers() {
+		mux.HandleFunc(path, h)
+	}
+
+	srv := httptest.NewUnstartedServer(mux)
+	srv.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: e.roots}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv, e
+}
+
+func post(t *testing.T, client *http.Client, url, user, password, csr string) (int, []byte) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBufferString(csr))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/pkcs10")
+	if user != "" {
+		req.SetBasicAuth(user, password)
+	}
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, b
+}
+
+func TestNewCA(t *testing.T) {
+	_, err := NewCA(&Options{})
+	require.ErrorIs(t, err, ErrNoCACert)
+
+	opts := newTestCA(t, t.TempDir())
+	ca, err := NewCA(opts)
+	require.NoError(t, err)
+	require.IsType(t, new(FileCA), ca)
+	require.Len(t, ca.Certificates(), 1)
+
+	_, err = NewCA(&Options{CACert: opts.CACert})
+	require.ErrorIs(t, err, ErrNoCA)
+
+	ca, err = NewCA(&Options{CACert: opts.CACert, CAURL: "http://127.0.0.1/sign"})
+	require.NoError(t, err)
+	require.IsType(t, new(RemoteCA), ca)
+
+	_, err = NewCA(&Options{CACert: opts.CAKey, CAKey: opts.CAKey})
+	require.ErrorIs(t, err, ErrInvalidCACert)
+}
+
+func TestCACerts(t *testing.T) {
+	ca, err := NewCA(newTestCA(t, t.TempDir()))
+	require.NoError(t, err)
+	srv, _ := newTestServer(t, ca)
+
+	resp, err := srv.Client().Get(srv.URL + CACertsPath)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, pkcs7ContentType, resp.Header.Get("Content-Type"))
+
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	certs := parseCertsOnly(t, b)
+	require.Len(t, certs, 1)
+	require.Equal(t, ca.Certificates()[0].Raw, certs[0].Raw)
+}
+
+func TestSimpleEnroll(t *testing.T) {
+	ca, err := NewCA(newTestCA(t, t.TempDir()))
+	require.NoError(t, err)
+	srv, _ := newTestServer(t, ca)
+	csr, _ := newCSR(t, "alice")
+
+	code, _ := post(t, srv.Client(), srv.URL+SimpleEnrollPath, "alice", "wrong", csr)
+	require.Equal(t, http.StatusUnauthorized, code)
+
+	code, _ = post(t, srv.Client(), srv.URL+SimpleEnrollPath, "", "", csr)
+	require.Equal(t, http.StatusUnauthorized, code)
+
+	bob, _ := newCSR(t, "bob")
+	code, _ = post(t, srv.Client(), srv.URL+SimpleEnrollPath, "alice", "secret", bob)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = post(t, srv.Client(), srv.URL+SimpleEnrollPath, "alice", "secret", "not base64")
+	require.Equal(t, http.StatusBadRequest, code)
+
+	code, b := post(t, srv.Client(), srv.URL+SimpleEnrollPath, "alice", "secret", csr)
+	require.Equal(t, http.StatusOK, code)
+	certs := parseCertsOnly(t, b)
+	require.Len(t, certs, 1)
+	require.Equal(t, "alice", certs[0].Subject.CommonName)
+	require.Equal(t, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, certs[0].ExtKeyUsage)
+	require.False(t, certs[0].NotAfter.After(ca.Certificates()[0].NotAfter))
+}
+
+func TestSimpleEnrollTLSRequired(t *testing.T) {
+	ca, err := NewCA(newTestCA(t, t.TempDir()))
+	require.NoError(t, err)
+	_, e := newTestServer(t, ca)
+
+	for _, h := range []Handler{e.simpleEnroll, e.simpleReenroll} {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodPost, SimpleEnrollPath, nil))
+		require.Equal(t, http.StatusForbidden, w.Code)
+	}
+}
+
+func TestSimpleReenroll(t *testing.T) {
+	ca, err := NewCA(newTestCA(t, t.TempDir()))
+	require.NoError(t, err)
+	srv, _ := newTestServer(t, ca)
+	csr, key := newCSR(t, "alice")
+
+	code, _ := post(t, srv.Client(), srv.URL+SimpleReenrollPath, "", "", csr)
+	require.Equal(t, http.StatusUnauthorized, code)
+
+	code, b := post(t, srv.Client(), srv.URL+SimpleEnrollPath, "alice", "secret", csr)
+	require.Equal(t, http.StatusOK, code)
+	cert := parseCertsOnly(t, b)[0]
+
+	transport := srv.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = []tls.Certificate{{
+		Certificate: [][]byte{cert.Raw},
+		PrivateKey:  key,
+	}}
+	client := &http.Client{Transport: transport}
+
+	bob, _ := newCSR(t, "bob")
+	code, _ = post(t, client, srv.URL+SimpleReenrollPath, "", "", bob)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	renew, _ := newCSR(t, "alice")
+	code, b = post(t, client, srv.URL+SimpleReenrollPath, "", "", renew)
+	require.Equal(t, http.StatusOK, code)
+	renewed := parseCertsOnly(t, b)[0]
+	require.Equal(t, "alice", renewed.Subject.CommonName)
+	require.NotEqual(t, cert.SerialNumber, renewed.SerialNumber)
+}
+
+func TestRemoteCA(t *testing.T) {
+	opts := newTestCA(t, t.TempDir())
+	fca, err := NewCA(opts)
+	require.NoError(t, err)
+
+	signer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		block, _ := pem.Decode(b)
+		require.NotNil(t, block)
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		require.NoError(t, err)
+		cert, err := fca.Sign(csr)
+		require.NoError(t, err)
+		_ = pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}))
+	defer signer.Close()
+
+	ca, err := NewCA(&Options{CACert: opts.CACert, CAURL: signer.URL})
+	require.NoError(t, err)
+	srv, _ := newTestServer(t, ca)
+	csr, _ := newCSR(t, "alice")
+
+	code, b := post(t, srv.Client(), srv.URL+SimpleEnrollPath, "alice", "secret", csr)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "alice", parseCertsOnly(t, b)[0].Subject.CommonName)
+}
+
+func TestRemoteCAError(t *testing.T) {
+	signer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer signer.Close()
+
+	ca := NewRemoteCA(nil, signer.URL, 0)
+	csr, _ := newCSR(t, "alice")
+	der, _ := base64.StdEncoding.DecodeString(csr)
+	req, err := x509.ParseCertificateRequest(der)
+	require.NoError(t, err)
+
+	_, err = ca.Sign(req)
+	require.Error(t, err)
+}
+
+func TestTLSConfig(t *testing.T) {
+	ca, err := NewCA(newTestCA(t, t.TempDir()))
+	require.NoError(t, err)
+	_, e := newTestServer(t, ca)
+
+	_, err = e.TLSConfig(nil)
+	require.ErrorIs(t, err, ErrTLSRequired)
+
+	base := &tls.Config{Certificates: []tls.Certificate{{}}, ClientAuth: tls.RequireAndVerifyClientCert}
+	c, err := e.TLSConfig(base)
+	require.NoError(t, err)
+	require.Equal(t, tls.VerifyClientCertIfGiven, c.ClientAuth)
+	require.Equal(t, tls.RequireAndVerifyClientCert, base.ClientAuth)
+	require.NotNil(t, c.ClientCAs)
+}
@@ -0,0 +1,311 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rs/xid"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+const (
+	EventStreamListener = "sse" // the listener name of clients subscribed via http server-sent events
+
+	EventStreamBuffer = 64 // the number of messages buffered for each event stream before messages are dropped
+
+	// EventTokenTTL is how long an event stream token may be redeemed after it is issued.
+	EventTokenTTL = 30 * time.Second
+
+	// eventStreamIDBase offsets the inline subscription identifiers used by event streams
+	// from those chosen by applications using the inline client.
+	eventStreamIDBase = 1 << 30
+)
+
+// eventToken holds the credentials of a client until its token is redeemed to open an
+// event stream.
+type eventToken struct {
+	id       string    // the client id, generated if empty
+	username string    // the username of the client
+	password string    // the password of the client
+	expires  time.Time // the time after which the token may not be redeemed
+}
+
+// EventMessage is a message delivered to an event stream.
+type EventMessage struct {
+	Topic    string `json:"topic"`    // the topic the message was published to
+	Payload  string `json:"payload"`  // the message payload
+	Encoding string `json:"encoding"` // utf8, or base64 if the payload is not valid utf8
+	Qos      byte   `json:"qos"`      // the qos the message was published with
+	Retain   bool   `json:"retain"`   // true if the message was retained
+	Created  int64  `json:"created"`  // the unix time the message was received by the broker
+}
+
+// EventStream is a subscription to a topic filter held by a web client, typically
+// consumed as http server-sent events.
+type EventStream struct {
+	Client   *Client           // the unconnected client used for authentication and acl checks
+	Filter   string            // the subscribed topic filter
+	Messages chan EventMessage // messages matching the filter
+	id       int               // the inline subscription identifier
+	dropped  int64             // messages dropped because the stream fell behind
+	done     chan struct{}     // closed when the stream is closed
+	once     sync.Once         // ensures the stream is only closed once
+}
+
+// Done returns a channel which is closed when the stream is closed, e.g. on server shutdown.
+func (e *EventStream) Done() <-chan struct{} {
+	return e.done
+}
+
+// Dropped returns the number of messages dropped because the stream fell behind.
+func (e *EventStream) Dropped() int64 {
+	return atomic.LoadInt64(&e.dropped)
+}
+
+// EventStreams contains the open event streams, keyed on subscription identifier.
+type EventStreams struct {
+	internal map[int]*EventStream
+	tokens   map[string]eventToken // the credentials of the unredeemed tokens, keyed on token
+	next     int64
+	sync.RWMutex
+}
+
+// NewEventStreams returns a new instance of EventStreams.
+func NewEventStreams() *EventStreams {
+	return &EventStreams{
+		internal: make(map[int]*EventStream),
+		tokens:   make(map[string]eventToken),
+	}
+}
+
+// Len returns the number of open event streams.
+func (e *EventStreams) Len() int {
+	e.RLock()
+	defer e.RUnlock()
+	return len(e.internal)
+}
+
+// GetAll returns all open event streams.
+func (e *EventStreams) GetAll() []*EventStream {
+	e.RLock()
+	defer e.RUnlock()
+	m := make([]*EventStream, 0, len(e.internal))
+	for _, v := range e.internal {
+		m = append(m, v)
+	}
+	return m
+}
+
+// OpenEventStream authenticates a web client using the server auth hooks, checks it may
+// read the topic filter, and subscribes it to the filter. Matching messages, including any
+// retained messages, are sent to the Messages channel of the stream. Messages are dropped
+// rather than blocking publishers if the stream falls behind. A client id is generated
+// if id is empty. The stream must be closed with CloseEventStream.
+func (s *Server) OpenEventStream(id, username, password, filter, remote string) (*EventStream, error) {
+	return s.openEventStream(EventStreamListener, id, username, password, filter, remote)
+}
+
+// IssueEventToken returns a single use token holding the credentials of a client, and the
+// time it expires, with which a browser EventSource client, which cannot set headers, opens
+// an event stream without putting the credentials in the url. The credentials are only
+// checked when the token is redeemed with OpenEventStreamToken.
+func (s *Server) IssueEventToken(id, username, password string) (string, time.Time, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", time.Time{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	now := time.Now()
+	expires := now.Add(EventTokenTTL)
+
+	s.Events.Lock()
+	defer s.Events.Unlock()
+	for k, v := range s.Events.tokens {
+		if now.After(v.expires) {
+			delete(s.Events.tokens, k)
+		}
+	}
+	s.Events.tokens[token] = eventToken{id: id, username: username, password: password, expires: expires}
+
+	return token, expires, nil
+}
+
+// OpenEventStreamToken opens an event stream with the credentials of a token issued by
+// IssueEventToken, which can only be redeemed once.
+func (s *Server) OpenEventStreamToken(token, filter, remote string) (*EventStream, error) {
+	s.Events.Lock()
+	t, ok := s.Events.tokens[token]
+	delete(s.Events.tokens, token)
+	s.Events.Unlock()
+
+	if !ok || time.Now().After(t.expires) {
+		return nil, packets.ErrBadUsernameOrPassword
+	}
+
+	return s.OpenEventStream(t.id, t.username, t.password, filter, remote)
+}
+
+// openEventStream opens an event stream for a client of a listener.
+func (s *Server) openEventStream(listener, id, username, password, filter, remote string) (*EventStream, error) {
+	if !IsValidFilter(filter, false) || strings.HasPrefix(strings.ToUpper(filter), SharePrefix) {
+		return nil, packets.ErrTopicFilterInvalid
+	}
+
+	cl, err := s.authenticateClient(listener, id, username, password, remote, false)
+	if err != nil {
+		return nil, err
+	}
+	id = cl.ID
+
+	if !s.aclCheck(cl, filter, false) {
+		s.aclDenied(cl, filter, false)
+		s.releaseUserConnection(cl)
+		cl.Stop(packets.ErrNotAuthorized)
+		return nil, packets.ErrNotAuthorized
+	}
+
+	es := &EventStream{
+		Client:   cl,
+		Filter:   filter,
+		Messages: make(chan EventMessage, EventStreamBuffer),
+		id:       eventStreamIDBase + int(atomic.AddInt64(&s.Events.next, 1)),
+		done:     make(chan struct{}),
+	}
+
+	sub := InlineSubscription{
+		Subscription: packets.Subscription{Filter: filter, Identifier: es.id},
+		Handler: func(_ *Client, _ packets.Subscription, pk packets.Packet) {
+			s.sendEventStream(es, pk)
+		},
+	}
+
+	s.Events.Lock()
+	s.Events.internal[es.id] = es
+	s.Events.Unlock()
+
+	_, count := s.Topics.InlineSubscribe(sub)
+	s.hooks.OnSubscribed(cl, packets.Packet{
+		Origin:      id,
+		FixedHeader: packets.FixedHeader{Type: packets.Subscribe},
+		Filters:     packets.Subscriptions{sub.Subscription},
+	}, []byte{packets.CodeSuccess.Code}, []int{count})
+
+	for _, pkv := range s.Topics.Messages(filter) { // [MQTT-3.8.4-4]
+		s.sendEventStream(es, pkv)
+	}
+
+	s.Log.Debug("event stream opened", "client", id, "remote", remote, "filter", filter)
+	return es, nil
+}
+
+// CloseEventStream unsubscribes an event stream and closes its done channel.
+func (s *Server) CloseEventStream(es *EventStream) {
+	es.once.Do(func() {
+		s.Events.Lock()
+		delete(s.Events.internal, es.id)
+		s.Events.Unlock()
+
+		_, count := s.Topics.InlineUnsubscribe(es.id, es.Filter)
+		s.hooks.OnUnsubscribed(es.Client, packets.Packet{
+			Origin:      es.Client.ID,
+			FixedHeader: packets.FixedHeader{Type: packets.Unsubscribe},
+			Filters:     packets.Subscriptions{{Filter: es.Filter, Identifier: es.id}},
+		}, []byte{packets.CodeSuccess.Code}, []int{count})
+
+		close(es.done)
+		s.releaseUserConnection(es.Client)
+		es.Client.Stop(nil) // ends the write loop of the client
+		s.Log.Debug("event stream closed", "client", es.Client.ID, "filter", es.Filter, "dropped", es.Dropped())
+	})
+}
+
+// closeEventStreams closes all open event streams.
+func (s *Server) closeEventStreams() {
+	for _, es := range s.Events.GetAll() {
+		s.CloseEventStream(es)
+	}
+}
+
+// sendEventStream delivers a message to an event stream without blocking.
+func (s *Server) sendEventStream(es *EventStream, pk packets.Packet) {
+	if remaining, expires := RemainingMessageExpiry(pk, time.Now().Unix()); expires && remaining <= 0 {
+		return
+	}
+
+	if !s.aclCheck(es.Client, pk.TopicName, false) {
+		return
+	}
+
+	msg := EventMessage{
+		Topic:    pk.TopicName,
+		Payload:  string(pk.Payload),
+		Encoding: "utf8",
+		Qos:      pk.FixedHeader.Qos,
+		Retain:   pk.FixedHeader.Retain,
+		Created:  pk.Created,
+	}
+
+	if !utf8.Valid(pk.Payload) {
+		msg.Payload = base64.StdEncoding.EncodeToString(pk.Payload)
+		msg.Encoding = "base64"
+	}
+
+	select {
+	case es.Messages <- msg:
+	default:
+		atomic.AddInt64(&es.dropped, 1)
+	}
+}
+
+// authenticateClient returns an unconnected client of a listener for a device or web client
+// which does not connect over mqtt, authenticated with a username and password by the same
+// checks as mqtt clients. A client id is generated if id is empty. Clients from remote
+// addresses the ip filter of the listener does not allow are not authorized. The client
+// counts towards the connections of its username until released with releaseUserConnection.
+func (s *Server) authenticateClient(listener, id, username, password, remote string, inline bool) (*Client, error) {
+	if !s.allowedIP(listener, remote) {
+		return nil, packets.ErrNotAuthorized
+	}
+
+	assigned := ""
+	if id == "" {
+		id = listener + "-" + xid.New().String()
+		assigned = id // generated ids are not checked against the client id policy
+	}
+
+	cl := s.NewClient(nil, listener, id, inline)
+	cl.Properties.Props.AssignedClientID = assigned
+	cl.Net.Remote = remote
+	cl.Properties.ProtocolVersion = 5
+	cl.Properties.Username = []byte(username)
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Connect},
+		Connect: packets.ConnectParams{
+			ClientIdentifier: id,
+			Username:         []byte(username),
+			UsernameFlag:     username != "",
+			Password:         []byte(password),
+			PasswordFlag:     password != "",
+		},
+	}
+
+	if _, err := s.authorizeConnect(cl, pk); err != nil {
+		if !inline {
+			cl.Stop(err)
+		}
+		return nil, err
+	}
+
+	return cl, nil
+}
@@ -0,0 +1,291 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+// eventACLHook authenticates the user "web" and denies reading a/secret.
+type eventACLHook struct {
+	HookBase
+}
+
+func (h *eventACLHook) ID() string {
+	return "event-acl"
+}
+
+func (h *eventACLHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{OnConnectAuthenticate, OnACLCheck}, []byte{b})
+}
+
+func (h *eventACLHook) OnConnectAuthenticate(cl *Client, pk packets.Packet) bool {
+	return string(pk.Connect.Username) == "web" && string(pk.Connect.Password) == "pass"
+}
+
+func (h *eventACLHook) OnACLCheck(cl *Client, topic string, write bool) bool {
+	return string(cl.Properties.Username) == "web" && topic != "a/secret" && topic != "b/#"
+}
+
+func newEventStreamServer(t *testing.T) *Server {
+	s := New(&Options{Logger: logger})
+	require.NoError(t, s.AddHook(new(eventACLHook), nil))
+	return s
+}
+
+func receiveEvent(t *testing.T, es *EventStream) EventMessage {
+	select {
+	case msg := <-es.Messages:
+		return msg
+	case <-time.After(time.Second):
+		require.Fail(t, "no event received")
+	}
+	return EventMessage{}
+}
+
+func TestOpenEventStreamInvalidFilter(t *testing.T) {
+	s := newEventStreamServer(t)
+
+	_, err := s.OpenEventStream("", "web", "pass", "", "")
+	require.ErrorIs(t, err, packets.ErrTopicFilterInvalid)
+
+	_, err = s.OpenEventStream("", "web", "pass", "$share/g/a/#", "")
+	require.ErrorIs(t, err, packets.ErrTopicFilterInvalid)
+	require.Equal(t, 0, s.Events.Len())
+}
+
+func TestOpenEventStreamNotAuthenticated(t *testing.T) {
+	s := newEventStreamServer(t)
+
+	_, err := s.OpenEventStream("", "web", "wrong", "a/#", "")
+	require.ErrorIs(t, err, packets.ErrBadUsernameOrPassword)
+	require.Equal(t, 0, s.Events.Len())
+}
+
+func TestOpenEventStreamNotAuthorized(t *testing.T) {
+	s := newEventStreamServer(t)
+
+	_, err := s.OpenEventStream("", "web", "pass", "b/#", "")
+	require.ErrorIs(t, err, packets.ErrNotAuthorized)
+	require.Equal(t, 0, s.Events.Len())
+}
+
+func TestEventStreamDelivery(t *testing.T) {
+	s := newEventStreamServer(t)
+	s.Topics.RetainMessage(packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true},
+		TopicName:   "a/retained",
+		Payload:     []byte("kept"),
+		Created:     time.Now().Unix(),
+	})
+
+	es, err := s.OpenEventStream("dashboard", "web", "pass", "a/#", "127.0.0.1:1234")
+	require.NoError(t, err)
+	require.Equal(t, "dashboard", es.Client.ID)
+	require.Equal(t, EventStreamListener, es.Client.Net.Listener)
+	require.Equal(t, 1, s.Events.Len())
+
+	msg := receiveEvent(t, es)
+	require.Equal(t, "a/retained", msg.Topic)
+	require.Equal(t, "kept", msg.Payload)
+	require.True(t, msg.Retain)
+
+	s.PublishToSubscribers(packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   "a/b",
+		Payload:     []byte("hello"),
+	}, true)
+	msg = receiveEvent(t, es)
+	require.Equal(t, "a/b", msg.Topic)
+	require.Equal(t, "hello", msg.Payload)
+	require.Equal(t, "utf8", msg.Encoding)
+	require.Equal(t, byte(1), msg.Qos)
+	require.NotZero(t, msg.Created)
+
+	s.PublishToSubscribers(packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish},
+		TopicName:   "a/bin",
+		Payload:     []byte{0xff, 0xfe},
+	}, true)
+	msg = receiveEvent(t, es)
+	require.Equal(t, "base64", msg.Encoding)
+	require.Equal(t, "//4=", msg.Payload)
+
+	// per message acl checks apply within the filter.
+	s.PublishToSubscribers(packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish},
+		TopicName:   "a/secret",
+		Payload:     []byte("hidden"),
+	}, true)
+	require.Len(t, es.Messages, 0)
+
+	s.CloseEventStream(es)
+	s.CloseEventStream(es)
+	require.Equal(t, 0, s.Events.Len())
+	_, ok := <-es.Done()
+	require.False(t, ok)
+
+	s.PublishToSubscribers(packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish},
+		TopicName:   "a/b",
+		Payload:     []byte("gone"),
+	}, true)
+	require.Len(t, es.Messages, 0)
+}
+
+func TestEventStreamGeneratedID(t *testing.T) {
+	s := newEventStreamServer(t)
+
+	es, err := s.OpenEventStream("", "web", "pass", "a/#", "")
+	require.NoError(t, err)
+	defer s.CloseEventStream(es)
+	require.Contains(t, es.Client.ID, EventStreamListener+"-")
+}
+
+func TestOpenEventStreamToken(t *testing.T) {
+	s := newEventStreamServer(t)
+
+	token, expires, err := s.IssueEventToken("web-1", "web", "pass")
+	require.NoError(t, err)
+	require.NotEmpty(t, token)
+	require.WithinDuration(t, time.Now().Add(EventTokenTTL), expires, time.Second)
+
+	es, err := s.OpenEventStreamToken(token, "a/#", "")
+	require.NoError(t, err)
+	defer s.CloseEventStream(es)
+	require.Equal(t, "web-1", es.Client.ID)
+
+	// tokens are single use
+	_, err = s.OpenEventStreamToken(token, "a/#", "")
+	require.ErrorIs(t, err, packets.ErrBadUsernameOrPassword)
+
+	_, err = s.OpenEventStreamToken("unknown", "a/#", "")
+	require.ErrorIs(t, err, packets.ErrBadUsernameOrPassword)
+}
+
+func TestOpenEventStreamTokenExpired(t *testing.T) {
+	s := newEventStreamServer(t)
+
+	token, _, err := s.IssueEventToken("", "web", "pass")
+	require.NoError(t, err)
+	s.Events.tokens[token] = eventToken{username: "web", password: "pass", expires: time.Now().Add(-time.Second)}
+
+	_, err = s.OpenEventStreamToken(token, "a/#", "")
+	require.ErrorIs(t, err, packets.ErrBadUsernameOrPassword)
+	require.Equal(t, 0, s.Events.Len())
+
+	// expired tokens are removed when another is issued
+	s.Events.tokens["stale"] = eventToken{expires: time.Now().Add(-time.Second)}
+	_, _, err = s.IssueEventToken("", "web", "pass")
+	require.NoError(t, err)
+	require.NotContains(t, s.Events.tokens, "stale")
+	require.Len(t, s.Events.tokens, 1)
+}
+
+func TestOpenEventStreamTokenNotAuthenticated(t *testing.T) {
+	s := newEventStreamServer(t)
+
+	token, _, err := s.IssueEventToken("", "web", "wrong")
+	require.NoError(t, err)
+
+	_, err = s.OpenEventStreamToken(token, "a/#", "")
+	require.ErrorIs(t, err, packets.ErrBadUsernameOrPassword)
+}
+
+func TestEventStreamDropsWhenFull(t *testing.T) {
+	s := newEventStreamServer(t)
+
+	es, err := s.OpenEventStream("", "web", "pass", "a/#", "")
+	require.NoError(t, err)
+	defer s.CloseEventStream(es)
+
+	for i := 0; i < EventStreamBuffer+3; i++ {
+		s.PublishToSubscribers(packets.Packet{
+			FixedHeader: packets.FixedHeader{Type: packets.Publish},
+			TopicName:   "a/b",
+			Payload:     []byte("x"),
+		}, true)
+	}
+
+	require.Len(t, es.Messages, EventStreamBuffer)
+	require.Equal(t, int64(3), es.Dropped())
+}
+
+func TestEventStreamSkipsExpired(t *testing.T) {
+	s := newEventStreamServer(t)
+
+	es, err := s.OpenEventStream("", "web", "pass", "a/#", "")
+	require.NoError(t, err)
+	defer s.CloseEventStream(es)
+
+	s.sendEventStream(es, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish},
+		TopicName:   "a/b",
+		Created:     time.Now().Unix() - 10,
+		Properties:  packets.Properties{MessageExpiryInterval: 5},
+	})
+	require.Len(t, es.Messages, 0)
+}
+
+func TestServerCloseClosesEventStreams(t *testing.T) {
+	s := newEventStreamServer(t)
+
+	es, err := s.OpenEventStream("", "web", "pass", "a/#", "")
+	require.NoError(t, err)
+
+	require.NoError(t, s.Close())
+	select {
+	case <-es.Done():
+	default:
+		require.Fail(t, "event stream not closed")
+	}
+	require.Equal(t, 0, s.Events.Len())
+}
+
+func TestOpenEventStreamConnectChecks(t *testing.T) {
+	s := New(&Options{
+		Logger:                 logger,
+		MaximumUserConnections: 1,
+		ClientIDPolicy:         &ClientIDPolicy{Pattern: "web-[0-9]+"},
+	})
+	require.NoError(t, s.AddHook(new(eventACLHook), nil))
+	s.AuthFailures = NewAuthFailures(3, 60, 60, 60)
+	defer s.Close()
+
+	s.Blacklist = []string{"web-0"}
+	_, err := s.OpenEventStream("web-0", "web", "pass", "a/#", "127.0.0.1:1234")
+	require.ErrorIs(t, err, packets.ErrNotAuthorized)
+
+	_, err = s.OpenEventStream("dashboard", "web", "pass", "a/#", "127.0.0.1:1234")
+	require.ErrorIs(t, err, packets.ErrClientIdentifierNotOwned)
+
+	es, err := s.OpenEventStream("web-1", "web", "pass", "a/#", "127.0.0.1:1234")
+	require.NoError(t, err)
+	require.Equal(t, 1, s.UserConns.Count("web"))
+
+	_, err = s.OpenEventStream("web-2", "web", "pass", "a/#", "127.0.0.1:1234")
+	require.ErrorIs(t, err, packets.ErrQuotaExceeded)
+
+	s.CloseEventStream(es)
+	require.Equal(t, 0, s.UserConns.Count("web"))
+
+	s.Freeze.Start(FreezeOptions{Connections: true})
+	_, err = s.OpenEventStream("web-1", "web", "pass", "a/#", "127.0.0.1:1234")
+	require.ErrorIs(t, err, packets.ErrServerUnavailable)
+	_, _ = s.Freeze.Stop()
+
+	// the refused client id and failed authentications count towards banning the username
+	_, err = s.OpenEventStream("web-1", "web", "wrong", "a/#", "127.0.0.1:1234")
+	require.ErrorIs(t, err, packets.ErrBadUsernameOrPassword)
+	_, err = s.OpenEventStream("web-1", "web", "wrong", "a/#", "127.0.0.1:1234")
+	require.ErrorIs(t, err, packets.ErrBadUsernameOrPassword)
+	_, err = s.OpenEventStream("web-1", "web", "pass", "a/#", "127.0.0.1:1234")
+	require.ErrorIs(t, err, packets.ErrBanned)
+}
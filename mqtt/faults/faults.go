@@ -0,0 +1,240 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+// Package faults injects artificial latency, errors and drops at key points of the broker,
+// such as storage writes, auth calls, cluster relays and raft applies, so that the
+// resilience of a running broker or cluster can be verified.
+package faults
+
+import (
+	"errors"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	PointStorageWrite = "storage-write" // writes of storage hooks, such as saving sessions and retained messages
+	PointAuth         = "auth"          // authentication and acl checks of auth hooks
+	PointClusterRelay = "cluster-relay" // publish messages relayed to other cluster nodes
+	PointRaftApply    = "raft-apply"    // subscription changes applied to the raft log
+)
+
+var (
+	ErrDisabled     = errors.New("fault injection is not enabled")                                       // faults cannot be set unless enabled
+	ErrInvalidPoint = errors.New("fault point must be storage-write, auth, cluster-relay or raft-apply") // the point is unknown
+	ErrInvalidRate  = errors.New("fault error and drop rates must be between 0 and 1")                   // a rate is out of range
+	ErrNotFound     = errors.New("fault not found")                                                      // no fault is set at the point
+	ErrInjected     = errors.New("injected fault")                                                       // returned by calls failed by a fault
+	ErrDropped      = errors.New("injected drop")                                                        // returned by calls dropped by a fault
+)
+
+// Fault describes the faults injected at a point. Each call at the point is delayed by
+// the latency, and then fails with the error rate or is dropped with the drop rate.
+type Fault struct {
+	Point     string  `json:"point" yaml:"point"`
+	Latency   int64   `json:"latency,omitempty" yaml:"latency"`       // milliseconds of latency added to each call
+	ErrorRate float64 `json:"error_rate,omitempty" yaml:"error-rate"` // the fraction of calls which fail, from 0 to 1
+	DropRate  float64 `json:"drop_rate,omitempty" yaml:"drop-rate"`   // the fraction of calls which are silently dropped, from 0 to 1
+	Duration  int64   `json:"duration,omitempty" yaml:"duration"`     // seconds after which the fault is removed, never if 0
+}
+
+// Status describes a fault and the calls it affected.
+type Status struct {
+	Fault
+	Expires int64 `json:"expires,omitempty"` // the unix time the fault is removed
+	Calls   int64 `json:"calls"`             // the number of calls at the point
+	Errors  int64 `json:"errors"`            // the number of calls failed
+	Drops   int64 `json:"drops"`             // the number of calls dropped
+}
+
+// fault is a fault with its counters.
+type fault struct {
+	Fault
+	expires time.Time
+	calls   atomic.Int64
+	errors  atomic.Int64
+	drops   atomic.Int64
+}
+
+// Injector contains the faults injected at each point. A nil Injector injects nothing.
+type Injector struct {
+	sync.RWMutex
+	enabled  bool
+	internal map[string]*fault // faults keyed on point
+	active   atomic.Int64      // the number of faults, so that calls are not slowed without any
+}
+
+// NewInjector returns a new instance of Injector. Faults can only be set if enabled.
+func NewInjector(enabled bool) *Injector {
+	return &Injector{
+		enabled:  enabled,
+		internal: map[string]*fault{},
+	}
+}
+
+// Enabled returns true if faults can be set.
+func (i *Injector) Enabled() bool {
+	return i != nil && i.enabled
+}
+
+// Set validates and sets the fault at a point, replacing any fault already set there.
+func (i *Injector) Set(f Fault) (Status, error) {
+	if !i.Enabled() {
+		return Status{}, ErrDisabled
+	}
+
+	switch f.Point {
+	case PointStorageWrite, PointAuth, PointClusterRelay, PointRaftApply:
+	default:
+		return Status{}, ErrInvalidPoint
+	}
+
+	if f.ErrorRate < 0 || f.ErrorRate > 1 || f.DropRate < 0 || f.DropRate > 1 {
+		return Status{}, ErrInvalidRate
+	}
+
+	n := &fault{Fault: f}
+	if f.Duration > 0 {
+		n.expires = time.Now().Add(time.Duration(f.Duration) * time.Second)
+	}
+
+	i.Lock()
+	defer i.Unlock()
+	i.internal[f.Point] = n
+	i.active.Store(int64(len(i.internal)))
+
+	return n.status(), nil
+}
+
+// Clear removes the fault at a point.
+func (i *Injector) Clear(point string) error {
+	if i == nil {
+		return ErrNotFound
+	}
+
+	i.Lock()
+	defer i.Unlock()
+	if _, ok := i.internal[point]; !ok {
+		return ErrNotFound
+	}
+
+	delete(i.internal, point)
+	i.active.Store(int64(len(i.internal)))
+	return nil
+}
+
+// ClearAll removes all faults.
+func (i *Injector) ClearAll() {
+	if i == nil {
+		return
+	}
+
+	i.Lock()
+	defer i.Unlock()
+	i.internal = map[string]*fault{}
+	i.active.Store(0)
+}
+
+// Get returns the status of the fault at a point.
+func (i *Injector) Get(point string) (Status, bool) {
+	if i == nil {
+		return Status{}, false
+	}
+
+	i.RLock()
+	defer i.RUnlock()
+	f, ok := i.internal[point]
+	if !ok {
+		return Status{}, false
+	}
+
+	return f.status(), true
+}
+
+// GetAll returns the status of all faults, sorted by point.
+func (i *Injector) GetAll() []Status {
+	v := []Status{}
+	if i == nil {
+		return v
+	}
+
+	i.RLock()
+	defer i.RUnlock()
+	for _, f := range i.internal {
+		v = append(v, f.status())
+	}
+
+	sort.Slice(v, func(a, b int) bool {
+		return v[a].Point < v[b].Point
+	})
+
+	return v
+}
+
+// Inject injects the fault at a point into a call, sleeping for its latency and then
+// returning ErrInjected if the call should fail or ErrDropped if it should be dropped.
+// Expired faults are removed.
+func (i *Injector) Inject(point string) error {
+	if i == nil || i.active.Load() == 0 {
+		return nil
+	}
+
+	i.RLock()
+	f, ok := i.internal[point]
+	i.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	if !f.expires.IsZero() && time.Now().After(f.expires) {
+		i.expire(f)
+		return nil
+	}
+
+	f.calls.Add(1)
+	if f.Latency > 0 {
+		time.Sleep(time.Duration(f.Latency) * time.Millisecond)
+	}
+
+	if f.ErrorRate > 0 && rand.Float64() < f.ErrorRate {
+		f.errors.Add(1)
+		return ErrInjected
+	}
+
+	if f.DropRate > 0 && rand.Float64() < f.DropRate {
+		f.drops.Add(1)
+		return ErrDropped
+	}
+
+	return nil
+}
+
+// expire removes an expired fault, unless it has been replaced.
+func (i *Injector) expire(f *fault) {
+	i.Lock()
+	defer i.Unlock()
+	if i.internal[f.Point] == f {
+		delete(i.internal, f.Point)
+		i.active.Store(int64(len(i.internal)))
+	}
+}
+
+// status returns the status of a fault.
+func (f *fault) status() Status {
+	s := Status{
+		Fault:  f.Fault,
+		Calls:  f.calls.Load(),
+		Errors: f.errors.Load(),
+		Drops:  f.drops.Load(),
+	}
+
+	if !f.expires.IsZero() {
+		s.Expires = f.expires.Unix()
+	}
+
+	return s
+}
@@ -0,0 +1,102 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package faults
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInjectorDisabled(t *testing.T) {
+	i := NewInjector(false)
+	require.False(t, i.Enabled())
+
+	_, err := i.Set(Fault{Point: PointAuth, ErrorRate: 1})
+	require.ErrorIs(t, err, ErrDisabled)
+	require.NoError(t, i.Inject(PointAuth))
+}
+
+func TestInjectorNil(t *testing.T) {
+	var i *Injector
+	require.False(t, i.Enabled())
+	require.NoError(t, i.Inject(PointAuth))
+	require.ErrorIs(t, i.Clear(PointAuth), ErrNotFound)
+	require.Empty(t, i.GetAll())
+	i.ClearAll()
+}
+
+func TestInjectorSet(t *testing.T) {
+	i := NewInjector(true)
+
+	_, err := i.Set(Fault{Point: "disk"})
+	require.ErrorIs(t, err, ErrInvalidPoint)
+
+	_, err = i.Set(Fault{Point: PointAuth, ErrorRate: 1.5})
+	require.ErrorIs(t, err, ErrInvalidRate)
+
+	_, err = i.Set(Fault{Point: PointAuth, DropRate: -1})
+	require.ErrorIs(t, err, ErrInvalidRate)
+
+	st, err := i.Set(Fault{Point: PointRaftApply, Duration: 60})
+	require.NoError(t, err)
+	require.InDelta(t, time.Now().Unix()+60, st.Expires, 1)
+
+	_, err = i.Set(Fault{Point: PointAuth, ErrorRate: 1})
+	require.NoError(t, err)
+
+	all := i.GetAll()
+	require.Len(t, all, 2)
+	require.Equal(t, PointAuth, all[0].Point)
+	require.Equal(t, PointRaftApply, all[1].Point)
+
+	require.NoError(t, i.Clear(PointAuth))
+	require.ErrorIs(t, i.Clear(PointAuth), ErrNotFound)
+	_, ok := i.Get(PointAuth)
+	require.False(t, ok)
+
+	i.ClearAll()
+	require.Empty(t, i.GetAll())
+}
+
+func TestInjectorInject(t *testing.T) {
+	i := NewInjector(true)
+	require.NoError(t, i.Inject(PointAuth))
+
+	_, err := i.Set(Fault{Point: PointAuth, ErrorRate: 1})
+	require.NoError(t, err)
+	_, err = i.Set(Fault{Point: PointClusterRelay, DropRate: 1})
+	require.NoError(t, err)
+	_, err = i.Set(Fault{Point: PointStorageWrite, Latency: 20})
+	require.NoError(t, err)
+
+	require.ErrorIs(t, i.Inject(PointAuth), ErrInjected)
+	require.ErrorIs(t, i.Inject(PointClusterRelay), ErrDropped)
+	require.NoError(t, i.Inject(PointRaftApply))
+
+	start := time.Now()
+	require.NoError(t, i.Inject(PointStorageWrite))
+	require.GreaterOrEqual(t, time.Since(start), time.Millisecond*20)
+
+	st, _ := i.Get(PointAuth)
+	require.Equal(t, int64(1), st.Calls)
+	require.Equal(t, int64(1), st.Errors)
+
+	st, _ = i.Get(PointClusterRelay)
+	require.Equal(t, int64(1), st.Drops)
+}
+
+func TestInjectorInjectExpired(t *testing.T) {
+	i := NewInjector(true)
+	_, err := i.Set(Fault{Point: PointAuth, ErrorRate: 1, Duration: 1})
+	require.NoError(t, err)
+
+	i.internal[PointAuth].expires = time.Now().Add(-time.Second)
+	require.NoError(t, i.Inject(PointAuth))
+	_, ok := i.Get(PointAuth)
+	require.False(t, ok)
+	require.Equal(t, int64(0), i.active.Load())
+}
@@ -0,0 +1,142 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrNotFrozen = errors.New("broker not frozen")
+
+// FreezeOptions contains the changes refused while the broker is frozen. If none of
+// Connections, Subscriptions or Retained are set, all of them are refused.
+type FreezeOptions struct {
+	Connections   bool   `json:"connections"`   // refuse new client connections
+	Subscriptions bool   `json:"subscriptions"` // refuse new subscriptions
+	Retained      bool   `json:"retained"`      // refuse changes to retained messages
+	Reason        string `json:"reason"`        // a description of the maintenance, sent to v5 clients as the reason string
+	Duration      int64  `json:"duration"`      // seconds until the freeze ends automatically, 0 until it is lifted
+}
+
+// FreezeStatus describes the current or most recent freeze.
+type FreezeStatus struct {
+	Frozen                bool          `json:"frozen"`
+	Started               int64         `json:"started"`
+	Ends                  int64         `json:"ends"`
+	RefusedConnections    int64         `json:"refused_connections"`
+	RefusedSubscriptions  int64         `json:"refused_subscriptions"`
+	RefusedRetainMessages int64         `json:"refused_retain_messages"`
+	Options               FreezeOptions `json:"options"`
+}
+
+// Freeze holds the broker in a maintenance window in which existing clients stay
+// connected and messages flow, but new connections, new subscriptions and changes
+// to retained messages may be refused, e.g. while a storage backend is maintained.
+type Freeze struct {
+	sync.Mutex
+	status FreezeStatus // the current or most recent freeze
+}
+
+// NewFreeze returns a new instance of Freeze.
+func NewFreeze() *Freeze {
+	return new(Freeze)
+}
+
+// Start freezes the broker, replacing the options of any freeze already in place.
+func (f *Freeze) Start(opts FreezeOptions) FreezeStatus {
+	if !opts.Connections && !opts.Subscriptions && !opts.Retained {
+		opts.Connections, opts.Subscriptions, opts.Retained = true, true, true
+	}
+
+	if opts.Duration < 0 {
+		opts.Duration = 0
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	now := time.Now().Unix()
+	f.status = FreezeStatus{
+		Frozen:  true,
+		Started: now,
+		Options: opts,
+	}
+
+	if opts.Duration > 0 {
+		f.status.Ends = now + opts.Duration
+	}
+
+	return f.status
+}
+
+// Stop lifts the freeze.
+func (f *Freeze) Stop() (FreezeStatus, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.expire(time.Now().Unix())
+	if !f.status.Frozen {
+		return f.status, ErrNotFrozen
+	}
+
+	f.status.Frozen = false
+	f.status.Ends = time.Now().Unix()
+	return f.status, nil
+}
+
+// Status returns the status of the current or most recent freeze.
+func (f *Freeze) Status() FreezeStatus {
+	f.Lock()
+	defer f.Unlock()
+
+	f.expire(time.Now().Unix())
+	return f.status
+}
+
+// AllowConnect returns true if new client connections are allowed, or false
+// and the reason for the freeze if they are refused.
+func (f *Freeze) AllowConnect() (bool, string) {
+	return f.allow(func(o FreezeOptions) bool { return o.Connections }, func(s *FreezeStatus) { s.RefusedConnections++ })
+}
+
+// AllowSubscribe returns true if new subscriptions are allowed, or false
+// and the reason for the freeze if they are refused.
+func (f *Freeze) AllowSubscribe() (bool, string) {
+	return f.allow(func(o FreezeOptions) bool { return o.Subscriptions }, func(s *FreezeStatus) { s.RefusedSubscriptions++ })
+}
+
+// AllowRetain returns true if retained messages may be changed, or false
+// and the reason for the freeze if they are refused.
+func (f *Freeze) AllowRetain() (bool, string) {
+	return f.allow(func(o FreezeOptions) bool { return o.Retained }, func(s *FreezeStatus) { s.RefusedRetainMessages++ })
+}
+
+// allow returns false if the broker is frozen and the option selected by refused is set,
+// in which case the refusal is counted.
+func (f *Freeze) allow(refused func(FreezeOptions) bool, count func(*FreezeStatus)) (bool, string) {
+	if f == nil {
+		return true, ""
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	f.expire(time.Now().Unix())
+	if !f.status.Frozen || !refused(f.status.Options) {
+		return true, ""
+	}
+
+	count(&f.status)
+	return false, f.status.Options.Reason
+}
+
+// expire lifts a freeze which has reached its end time. The lock must be held.
+func (f *Freeze) expire(now int64) {
+	if f.status.Frozen && f.status.Ends > 0 && now >= f.status.Ends {
+		f.status.Frozen = false
+	}
+}
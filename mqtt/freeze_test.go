@@ -0,0 +1,182 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+func TestFreezeDefaultsToAll(t *testing.T) {
+	f := NewFreeze()
+	ok, _ := f.AllowConnect()
+	require.True(t, ok)
+
+	st := f.Start(FreezeOptions{Reason: "maintenance"})
+	require.True(t, st.Frozen)
+	require.NotZero(t, st.Started)
+	require.Zero(t, st.Ends)
+	require.True(t, st.Options.Connections)
+	require.True(t, st.Options.Subscriptions)
+	require.True(t, st.Options.Retained)
+
+	ok, reason := f.AllowConnect()
+	require.False(t, ok)
+	require.Equal(t, "maintenance", reason)
+	ok, _ = f.AllowSubscribe()
+	require.False(t, ok)
+	ok, _ = f.AllowRetain()
+	require.False(t, ok)
+
+	st = f.Status()
+	require.Equal(t, int64(1), st.RefusedConnections)
+	require.Equal(t, int64(1), st.RefusedSubscriptions)
+	require.Equal(t, int64(1), st.RefusedRetainMessages)
+}
+
+func TestFreezeSelectedOptions(t *testing.T) {
+	f := NewFreeze()
+	f.Start(FreezeOptions{Retained: true})
+
+	ok, _ := f.AllowConnect()
+	require.True(t, ok)
+	ok, _ = f.AllowSubscribe()
+	require.True(t, ok)
+	ok, _ = f.AllowRetain()
+	require.False(t, ok)
+}
+
+func TestFreezeStop(t *testing.T) {
+	f := NewFreeze()
+	_, err := f.Stop()
+	require.ErrorIs(t, err, ErrNotFrozen)
+
+	f.Start(FreezeOptions{})
+	st, err := f.Stop()
+	require.NoError(t, err)
+	require.False(t, st.Frozen)
+
+	ok, _ := f.AllowConnect()
+	require.True(t, ok)
+}
+
+func TestFreezeExpires(t *testing.T) {
+	f := NewFreeze()
+	st := f.Start(FreezeOptions{Duration: 60})
+	require.Equal(t, st.Started+60, st.Ends)
+
+	f.status.Ends = time.Now().Unix() - 1
+	ok, _ := f.AllowConnect()
+	require.True(t, ok)
+	require.False(t, f.Status().Frozen)
+
+	_, err := f.Stop()
+	require.ErrorIs(t, err, ErrNotFrozen)
+}
+
+func TestFreezeNil(t *testing.T) {
+	var f *Freeze
+	ok, _ := f.AllowConnect()
+	require.True(t, ok)
+}
+
+func TestEstablishConnectionFrozen(t *testing.T) {
+	s := New(&Options{Logger: logger})
+	_ = s.AddHook(new(AllowHook), nil)
+	defer s.Close()
+	s.Freeze.Start(FreezeOptions{Connections: true, Reason: "storage maintenance"})
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r)
+	}()
+
+	go func() {
+		_, _ = w.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectMqtt5).RawBytes)
+	}()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := io.ReadAll(w)
+		require.NoError(t, err)
+		recv <- buf
+	}()
+
+	err := <-o
+	require.ErrorIs(t, err, packets.ErrServerUnavailable)
+	buf := <-recv
+	require.Equal(t, packets.Connack<<4, buf[0])
+	require.Equal(t, packets.ErrServerUnavailable.Code, buf[3])
+	require.Contains(t, string(buf), "storage maintenance")
+	require.Equal(t, int64(1), s.Freeze.Status().RefusedConnections)
+
+	_ = w.Close()
+	_ = r.Close()
+}
+
+func TestServerProcessSubscribeFrozen(t *testing.T) {
+	s := newServer()
+	cl, r, w := newTestClient()
+	cl.Properties.ProtocolVersion = 5
+	s.Freeze.Start(FreezeOptions{Subscriptions: true, Reason: "storage maintenance"})
+
+	go func() {
+		err := s.processPacket(cl, *packets.TPacketData[packets.Subscribe].Get(packets.TSubscribeMqtt5).Packet)
+		require.NoError(t, err)
+		_ = w.Close()
+	}()
+
+	buf, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, packets.Suback<<4, buf[0])
+	require.Equal(t, packets.ErrImplementationSpecificError.Code, buf[len(buf)-1])
+	require.Contains(t, string(buf), "storage maintenance")
+	require.Equal(t, 0, cl.State.Subscriptions.Len())
+	require.Equal(t, int64(0), s.Info.Subscriptions)
+}
+
+func TestServerProcessSubscribeFrozenRenewal(t *testing.T) {
+	s := newServer()
+	cl, _, _ := newTestClient()
+	pk := *packets.TPacketData[packets.Subscribe].Get(packets.TSubscribeMqtt5).Packet
+	for _, sub := range pk.Filters {
+		cl.State.Subscriptions.Add(sub.Filter, sub)
+	}
+	s.Freeze.Start(FreezeOptions{Subscriptions: true})
+
+	ok, _ := s.frozenSubscribe(cl, pk.Filters[0].Filter)
+	require.True(t, ok)
+	ok, reason := s.frozenSubscribe(cl, "other/filter")
+	require.False(t, ok)
+	require.Equal(t, packets.ErrImplementationSpecificError.Reason, reason)
+}
+
+func TestServerRetainMessageFrozen(t *testing.T) {
+	s := newServer()
+	cl, _, _ := newTestClient()
+	s.Freeze.Start(FreezeOptions{Retained: true})
+
+	s.retainMessage(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true},
+		TopicName:   "a/b/c",
+		Payload:     []byte("hello"),
+	})
+	require.Len(t, s.Topics.Messages("a/b/c"), 0)
+
+	_, err := s.Freeze.Stop()
+	require.NoError(t, err)
+	s.retainMessage(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true},
+		TopicName:   "a/b/c",
+		Payload:     []byte("hello"),
+	})
+	require.Len(t, s.Topics.Messages("a/b/c"), 1)
+}
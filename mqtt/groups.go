@@ -0,0 +1,278 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GroupExtKey is the client Ext key which auth hooks can use to place a client into
+// groups, as either a string or a []string of group names.
+const GroupExtKey = "groups"
+
+// GroupClientPlaceholder is replaced by the client id in group command topics.
+const GroupClientPlaceholder = "%c"
+
+var (
+	ErrGroupNotFound       = errors.New("client group not found")                // the group does not exist
+	ErrGroupNoCommandTopic = errors.New("client group has no command topic set") // the group cannot be published to
+)
+
+// GroupACLRule overrides the ACL checks of group members for topics matching the filter.
+type GroupACLRule struct {
+	Filter string `json:"filter" yaml:"filter"` // the topic filter the rule applies to
+	Read   bool   `json:"read" yaml:"read"`     // members may subscribe to matching topics
+	Write  bool   `json:"write" yaml:"write"`   // members may publish to matching topics
+}
+
+// ClientGroup is a named set of clients which can be operated on together.
+type ClientGroup struct {
+	Name         string         `json:"name" yaml:"name"`
+	CommandTopic string         `json:"command_topic,omitempty" yaml:"command-topic"` // the command topic of each member, %c is replaced by the client id
+	PublishRate  int64          `json:"publish_rate,omitempty" yaml:"publish-rate"`   // the maximum publishes per second for each member, 0 is unlimited
+	ACL          []GroupACLRule `json:"acl,omitempty" yaml:"acl"`                     // ordered acl overrides for members, the first matching rule applies
+	Members      []string       `json:"members,omitempty" yaml:"-"`                   // the ids of the member clients
+}
+
+// ClientGroups contains the client groups known to the broker.
+type ClientGroups struct {
+	internal map[string]*ClientGroup    // groups keyed on name
+	members  map[string]map[string]bool // group names keyed on client id
+	limiter  RateLimiter                // the limiter holding the publish rate buckets of members
+	sync.RWMutex
+}
+
+// NewClientGroups returns an instance of ClientGroups.
+func NewClientGroups() *ClientGroups {
+	return &ClientGroups{
+		internal: map[string]*ClientGroup{},
+		members:  map[string]map[string]bool{},
+		limiter:  NewMemoryRateLimiter(),
+	}
+}
+
+// SetLimiter sets the limiter holding the publish rate buckets of members, e.g. to
+// limit publish rates across a cluster.
+func (g *ClientGroups) SetLimiter(l RateLimiter) {
+	g.Lock()
+	defer g.Unlock()
+	g.limiter = l
+}
+
+// Set adds or updates the configuration of a group, keeping any existing members.
+func (g *ClientGroups) Set(val ClientGroup) {
+	g.Lock()
+	defer g.Unlock()
+
+	if existing, ok := g.internal[val.Name]; ok {
+		val.Members = existing.Members
+	} else {
+		val.Members = []string{}
+	}
+
+	g.internal[val.Name] = &val
+}
+
+// Get returns a copy of a group.
+func (g *ClientGroups) Get(name string) (ClientGroup, bool) {
+	g.RLock()
+	defer g.RUnlock()
+
+	if val, ok := g.internal[name]; ok {
+		return g.copy(val), true
+	}
+
+	return ClientGroup{}, false
+}
+
+// GetAll returns a copy of all groups, ordered by name.
+func (g *ClientGroups) GetAll() []ClientGroup {
+	g.RLock()
+	defer g.RUnlock()
+
+	v := make([]ClientGroup, 0, len(g.internal))
+	for _, val := range g.internal {
+		v = append(v, g.copy(val))
+	}
+
+	sort.Slice(v, func(i, j int) bool { return v[i].Name < v[j].Name })
+	return v
+}
+
+// copy returns a copy of a group which can be safely used outside of the lock.
+func (g *ClientGroups) copy(val *ClientGroup) ClientGroup {
+	v := *val
+	v.ACL = append([]GroupACLRule{}, val.ACL...)
+	v.Members = append([]string{}, val.Members...)
+	sort.Strings(v.Members)
+	return v
+}
+
+// Delete removes a group and all of its memberships.
+func (g *ClientGroups) Delete(name string) {
+	g.Lock()
+	defer g.Unlock()
+
+	if val, ok := g.internal[name]; ok {
+		for _, id := range val.Members {
+			delete(g.members[id], name)
+			if len(g.members[id]) == 0 {
+				delete(g.members, id)
+			}
+		}
+	}
+
+	delete(g.internal, name)
+}
+
+// Add places a client into a group, creating the group if it does not exist.
+func (g *ClientGroups) Add(name, id string) {
+	g.Lock()
+	defer g.Unlock()
+
+	val, ok := g.internal[name]
+	if !ok {
+		val = &ClientGroup{Name: name}
+		g.internal[name] = val
+	}
+
+	if _, ok := g.members[id]; !ok {
+		g.members[id] = map[string]bool{}
+	}
+
+	if g.members[id][name] {
+		return
+	}
+
+	g.members[id][name] = true
+	val.Members = append(val.Members, id)
+}
+
+// Remove removes a client from a group.
+func (g *ClientGroups) Remove(name, id string) {
+	g.Lock()
+	defer g.Unlock()
+
+	val, ok := g.internal[name]
+	if !ok || !g.members[id][name] {
+		return
+	}
+
+	for i, m := range val.Members {
+		if m == id {
+			val.Members = append(val.Members[:i], val.Members[i+1:]...)
+			break
+		}
+	}
+
+	delete(g.members[id], name)
+	if len(g.members[id]) == 0 {
+		delete(g.members, id)
+	}
+}
+
+// GroupsOf returns the names of the groups a client belongs to.
+func (g *ClientGroups) GroupsOf(id string) []string {
+	g.RLock()
+	defer g.RUnlock()
+
+	v := make([]string, 0, len(g.members[id]))
+	for name := range g.members[id] {
+		v = append(v, name)
+	}
+
+	sort.Strings(v)
+	return v
+}
+
+// AllowPublish returns false if a client has exceeded the publish rate of any of its
+// groups, otherwise it counts the publish.
+func (g *ClientGroups) AllowPublish(id string, now int64) bool {
+	g.RLock()
+	defer g.RUnlock()
+
+	allow := true
+	for name := range g.members[id] {
+		val := g.internal[name]
+		if val.PublishRate <= 0 {
+			continue
+		}
+
+		if !takeToken(g.limiter, GroupRateLimitKey+name+":"+id, val.PublishRate, val.PublishRate, time.Unix(now, 0)) {
+			allow = false
+		}
+	}
+
+	return allow
+}
+
+// ACLCheck applies the acl overrides of the groups a client belongs to. If no rule
+// matches the topic, matched is false and the regular acl checks should be used.
+func (g *ClientGroups) ACLCheck(id, topic string, write bool) (allowed, matched bool) {
+	g.RLock()
+	defer g.RUnlock()
+
+	names := make([]string, 0, len(g.members[id]))
+	for name := range g.members[id] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, rule := range g.internal[name].ACL {
+			if !matchTopicFilter(rule.Filter, topic) {
+				continue
+			}
+
+			if write {
+				return rule.Write, true
+			}
+			return rule.Read, true
+		}
+	}
+
+	return false, false
+}
+
+// matchTopicFilter returns true if a topic or filter is matched by a filter,
+// accounting for wildcards.
+func matchTopicFilter(filter, topic string) bool {
+	filterParts := strings.Split(filter, "/")
+	topicParts := strings.Split(topic, "/")
+
+	for i, part := range filterParts {
+		if part == "#" {
+			return true
+		}
+
+		if i >= len(topicParts) {
+			return false
+		}
+
+		if part != "+" && part != topicParts[i] {
+			return false
+		}
+	}
+
+	return len(filterParts) == len(topicParts)
+}
+
+// clientGroupNames returns the group names a client has been given by auth hooks.
+// Groups are never taken from values supplied by the client itself, as group acl
+// overrides could otherwise be used to escalate privileges.
+func clientGroupNames(cl *Client) []string {
+	switch v := cl.Ext[GroupExtKey].(type) {
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	}
+
+	return nil
+}
@@ -0,0 +1,199 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+func TestClientGroupsAddRemove(t *testing.T) {
+	g := NewClientGroups()
+	g.Add("sensors", "c1")
+	g.Add("sensors", "c2")
+	g.Add("sensors", "c1")
+	g.Add("admins", "c1")
+
+	group, ok := g.Get("sensors")
+	require.True(t, ok)
+	require.Equal(t, []string{"c1", "c2"}, group.Members)
+	require.Equal(t, []string{"admins", "sensors"}, g.GroupsOf("c1"))
+
+	g.Remove("sensors", "c1")
+	group, _ = g.Get("sensors")
+	require.Equal(t, []string{"c2"}, group.Members)
+	require.Equal(t, []string{"admins"}, g.GroupsOf("c1"))
+
+	g.Delete("admins")
+	_, ok = g.Get("admins")
+	require.False(t, ok)
+	require.Empty(t, g.GroupsOf("c1"))
+	require.Len(t, g.GetAll(), 1)
+}
+
+func TestClientGroupsSetKeepsMembers(t *testing.T) {
+	g := NewClientGroups()
+	g.Add("sensors", "c1")
+	g.Set(ClientGroup{Name: "sensors", CommandTopic: "cmd/%c", Members: []string{"x"}})
+
+	group, ok := g.Get("sensors")
+	require.True(t, ok)
+	require.Equal(t, "cmd/%c", group.CommandTopic)
+	require.Equal(t, []string{"c1"}, group.Members)
+}
+
+func TestClientGroupsAllowPublish(t *testing.T) {
+	g := NewClientGroups()
+	g.Set(ClientGroup{Name: "limited", PublishRate: 2})
+	g.Add("limited", "c1")
+
+	require.True(t, g.AllowPublish("c1", 100))
+	require.True(t, g.AllowPublish("c1", 100))
+	require.False(t, g.AllowPublish("c1", 100))
+	require.True(t, g.AllowPublish("c1", 101))
+	require.True(t, g.AllowPublish("c2", 100))
+}
+
+func TestClientGroupsACLCheck(t *testing.T) {
+	g := NewClientGroups()
+	g.Set(ClientGroup{Name: "ops", ACL: []GroupACLRule{
+		{Filter: "ops/secret/#", Read: false, Write: false},
+		{Filter: "ops/#", Read: true, Write: true},
+	}})
+	g.Add("ops", "c1")
+
+	allowed, matched := g.ACLCheck("c1", "ops/a", true)
+	require.True(t, matched)
+	require.True(t, allowed)
+
+	allowed, matched = g.ACLCheck("c1", "ops/secret/a", false)
+	require.True(t, matched)
+	require.False(t, allowed)
+
+	_, matched = g.ACLCheck("c1", "other", true)
+	require.False(t, matched)
+
+	_, matched = g.ACLCheck("c2", "ops/a", true)
+	require.False(t, matched)
+}
+
+func TestMatchTopicFilter(t *testing.T) {
+	require.True(t, matchTopicFilter("a/+/c", "a/b/c"))
+	require.True(t, matchTopicFilter("a/#", "a"))
+	require.True(t, matchTopicFilter("a/#", "a/b/c"))
+	require.False(t, matchTopicFilter("a/+", "a/b/c"))
+	require.False(t, matchTopicFilter("a/b/c", "a/b"))
+}
+
+func TestClientGroupNames(t *testing.T) {
+	cl, _, _ := newTestClient()
+	require.Nil(t, clientGroupNames(cl))
+
+	cl.Ext = map[string]any{GroupExtKey: "a"}
+	require.Equal(t, []string{"a"}, clientGroupNames(cl))
+
+	cl.Ext = map[string]any{GroupExtKey: []string{"a", "b"}}
+	require.Equal(t, []string{"a", "b"}, clientGroupNames(cl))
+}
+
+func TestServerGroupACLOverride(t *testing.T) {
+	s := New(&Options{Logger: logger})
+	_ = s.AddHook(new(DenyHook), nil)
+
+	cl, _, _ := newTestClient()
+	require.False(t, s.aclCheck(cl, "a/b", true))
+
+	s.Groups.Set(ClientGroup{Name: "g", ACL: []GroupACLRule{{Filter: "a/#", Write: true}}})
+	s.Groups.Add("g", cl.ID)
+	require.True(t, s.aclCheck(cl, "a/b", true))
+	require.False(t, s.aclCheck(cl, "a/b", false))
+	require.False(t, s.aclCheck(cl, "b", true))
+}
+
+func TestServerPublishToGroup(t *testing.T) {
+	s := New(&Options{Logger: logger})
+	_ = s.AddHook(new(AllowHook), nil)
+
+	_, err := s.PublishToGroup("missing", []byte("x"), false, 0)
+	require.ErrorIs(t, err, ErrGroupNotFound)
+
+	s.Groups.Add("g", "c1")
+	_, err = s.PublishToGroup("g", []byte("x"), false, 0)
+	require.ErrorIs(t, err, ErrGroupNoCommandTopic)
+
+	cl, r, w := newTestClient()
+	defer w.Close()
+	go func() {
+		_, _ = io.ReadAll(r)
+	}()
+	cl.ID = "c1"
+	s.Clients.Add(cl)
+	s.Groups.Add("g", "c2")
+	s.Groups.Set(ClientGroup{Name: "g", CommandTopic: "cmd/" + GroupClientPlaceholder})
+
+	err = s.processSubscribe(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Subscribe},
+		PacketID:    1,
+		Filters:     packets.Subscriptions{{Filter: "cmd/c1"}},
+	})
+	require.NoError(t, err)
+
+	n, err := s.PublishToGroup("g", []byte("x"), false, 0)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+}
+
+func TestServerPublishToGroupRetainWithoutInlineClient(t *testing.T) {
+	s := New(&Options{Logger: logger, InlineClient: false})
+	_ = s.AddHook(new(AllowHook), nil)
+	require.Nil(t, s.inlineClient)
+
+	cl, r, w := newTestClient()
+	defer w.Close()
+	go func() {
+		_, _ = io.ReadAll(r)
+	}()
+	cl.ID = "c1"
+	s.Clients.Add(cl)
+	s.Groups.Add("g", "c1")
+	s.Groups.Set(ClientGroup{Name: "g", CommandTopic: "cmd/" + GroupClientPlaceholder})
+
+	n, err := s.PublishToGroup("g", []byte("x"), true, 0)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	_, ok := s.Topics.RetainedMessage("cmd/c1")
+	require.True(t, ok)
+
+	// the refused retained message is logged with the inline client
+	s.Freeze.Start(FreezeOptions{Retained: true})
+	n, err = s.PublishToGroup("g", []byte("y"), true, 0)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	pk, _ := s.Topics.RetainedMessage("cmd/c1")
+	require.Equal(t, []byte("x"), pk.Payload)
+}
+
+func TestServerDisconnectGroup(t *testing.T) {
+	s := New(&Options{Logger: logger})
+
+	_, err := s.DisconnectGroup("missing")
+	require.ErrorIs(t, err, ErrGroupNotFound)
+
+	cl, r, w := newTestClient()
+	defer w.Close()
+	go func() {
+		_, _ = io.ReadAll(r)
+	}()
+	s.Clients.Add(cl)
+	s.Groups.Add("g", cl.ID)
+
+	n, err := s.DisconnectGroup("g")
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.True(t, cl.Closed())
+}
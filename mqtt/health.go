@@ -0,0 +1,139 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	HealthOK          = "ok"          // the status of a probe whose checks all passed
+	HealthUnavailable = "unavailable" // the status of a probe with a failed check
+)
+
+var (
+	ErrServerNotStarted   = errors.New("server not started")    // the server has not finished serving its listeners
+	ErrServerStopped      = errors.New("server stopped")        // the server has been closed
+	ErrListenerNotServing = errors.New("listeners not serving") // listeners have stopped accepting connections
+)
+
+// HealthChecker is implemented by hooks, such as storage hooks, which can report whether
+// the resources they depend on are reachable. Hooks which are not healthy fail the
+// readiness probe of the server.
+type HealthChecker interface {
+	Healthy() error
+}
+
+// HealthCheck returns an error if the part of the broker it checks is not ready, e.g. a
+// cluster node which has not joined its cluster.
+type HealthCheck func() error
+
+// Health is the result of a liveness, readiness or startup probe.
+type Health struct {
+	Status string            `json:"status"` // ok if all the checks passed, otherwise unavailable
+	Checks map[string]string `json:"checks"` // ok or the error of each check, keyed on check name
+}
+
+// OK returns true if all the checks of the probe passed.
+func (h Health) OK() bool {
+	return h.Status == HealthOK
+}
+
+// newHealth returns the result of a probe from the errors of its checks.
+func newHealth(errs map[string]error) Health {
+	h := Health{Status: HealthOK, Checks: make(map[string]string, len(errs))}
+	for name, err := range errs {
+		if err != nil {
+			h.Status = HealthUnavailable
+			h.Checks[name] = err.Error()
+			continue
+		}
+		h.Checks[name] = HealthOK
+	}
+
+	return h
+}
+
+// healthChecks are the named readiness checks added to the server.
+type healthChecks struct {
+	sync.RWMutex
+	internal map[string]HealthCheck
+}
+
+// AddReadyCheck adds a named check to the readiness probe of the server, replacing any
+// existing check with the same name.
+func (s *Server) AddReadyCheck(name string, check HealthCheck) {
+	s.readyChecks.Lock()
+	defer s.readyChecks.Unlock()
+	if s.readyChecks.internal == nil {
+		s.readyChecks.internal = make(map[string]HealthCheck)
+	}
+	s.readyChecks.internal[name] = check
+}
+
+// serverHealth returns an error if the server has been closed, or if started is true
+// and the server has not finished starting.
+func (s *Server) serverHealth(started bool) error {
+	select {
+	case <-s.done:
+		return ErrServerStopped
+	default:
+	}
+
+	if started && atomic.LoadUint32(&s.started) == 0 {
+		return ErrServerNotStarted
+	}
+
+	return nil
+}
+
+// Livez returns the result of the liveness probe, which fails once the server is closed.
+func (s *Server) Livez() Health {
+	return newHealth(map[string]error{
+		"server": s.serverHealth(false),
+	})
+}
+
+// Startupz returns the result of the startup probe, which passes once the server has
+// read its stored state and started serving its listeners.
+func (s *Server) Startupz() Health {
+	return newHealth(map[string]error{
+		"server": s.serverHealth(true),
+	})
+}
+
+// Readyz returns the result of the readiness probe, which passes when the server has
+// started, all of its listeners are serving, the hooks implementing HealthChecker are
+// healthy, and the checks added with AddReadyCheck pass.
+func (s *Server) Readyz() Health {
+	errs := map[string]error{
+		"server":    s.serverHealth(true),
+		"listeners": nil,
+	}
+
+	if down := s.Listeners.NotServing(); len(down) > 0 && errs["server"] == nil {
+		errs["listeners"] = fmt.Errorf("%w: %s", ErrListenerNotServing, strings.Join(down, ", "))
+	}
+
+	for _, hook := range s.hooks.GetAll() {
+		if c, ok := hook.(HealthChecker); ok {
+			errs[hook.ID()] = c.Healthy()
+		}
+	}
+
+	s.readyChecks.RLock()
+	checks := maps.Clone(s.readyChecks.internal)
+	s.readyChecks.RUnlock()
+	for name, check := range checks {
+		errs[name] = check()
+	}
+
+	return newHealth(errs)
+}
@@ -0,0 +1,89 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/listeners"
+)
+
+// healthHook is a hook reporting a configurable health.
+type healthHook struct {
+	HookBase
+	err error
+}
+
+func (h *healthHook) ID() string {
+	return "health"
+}
+
+func (h *healthHook) Healthy() error {
+	return h.err
+}
+
+func TestHealthStartup(t *testing.T) {
+	s := newServer()
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t1", ":1882")))
+
+	require.True(t, s.Livez().OK())
+	h := s.Startupz()
+	require.False(t, h.OK())
+	require.Equal(t, HealthUnavailable, h.Status)
+	require.Equal(t, ErrServerNotStarted.Error(), h.Checks["server"])
+	require.False(t, s.Readyz().OK())
+
+	require.NoError(t, s.Serve())
+	require.True(t, s.Startupz().OK())
+	require.Equal(t, Health{Status: HealthOK, Checks: map[string]string{"server": HealthOK, "listeners": HealthOK}}, s.Readyz())
+
+	require.NoError(t, s.Close())
+	require.Equal(t, ErrServerStopped.Error(), s.Livez().Checks["server"])
+	require.False(t, s.Startupz().OK())
+	require.False(t, s.Readyz().OK())
+}
+
+func TestHealthReadyListenerNotServing(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	require.NoError(t, s.AddListener(listeners.NewTCP("t1", "127.0.0.1:0", nil)))
+	require.NoError(t, s.Serve())
+
+	s.Listeners.Close("t1", s.closeListenerClients)
+	require.Eventually(t, func() bool {
+		return !s.Readyz().OK()
+	}, time.Second, time.Millisecond)
+	require.Equal(t, "listeners not serving: t1", s.Readyz().Checks["listeners"])
+	require.True(t, s.Livez().OK())
+}
+
+func TestHealthReadyHooksAndChecks(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	hook := new(healthHook)
+	require.NoError(t, s.AddHook(hook, nil))
+	require.NoError(t, s.Serve())
+	require.True(t, s.Readyz().OK())
+
+	hook.err = errors.New("storage unreachable")
+	h := s.Readyz()
+	require.False(t, h.OK())
+	require.Equal(t, "storage unreachable", h.Checks["health"])
+	hook.err = nil
+
+	var ready error
+	s.AddReadyCheck("raft", func() error {
+		return ready
+	})
+	require.True(t, s.Readyz().OK())
+	require.Equal(t, HealthOK, s.Readyz().Checks["raft"])
+
+	ready = errors.New("no leader")
+	require.Equal(t, "no leader", s.Readyz().Checks["raft"])
+	require.True(t, s.Livez().OK())
+}
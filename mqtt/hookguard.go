@@ -0,0 +1,171 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"sync/atomic"
+
+	"github.com/wind-c/comqtt/v2/mqtt/faults"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+// ErrHookPanic indicates a hook method panicked. The panic is recovered, so that a faulty
+// hook cannot take down the broker.
+var ErrHookPanic = errors.New("hook panicked")
+
+// HookStats contains the failure counters of a hook.
+type HookStats struct {
+	ID          string `json:"id"`
+	Panics      int64  `json:"panics"`      // the number of calls which panicked
+	Errors      int64  `json:"errors"`      // the number of calls which returned an error
+	Consecutive int64  `json:"consecutive"` // the number of consecutive calls which failed
+	Disabled    bool   `json:"disabled"`    // true if the hook is bypassed after too many failures
+}
+
+// hookGuard counts the failures of a hook.
+type hookGuard struct {
+	panics      atomic.Int64
+	errors      atomic.Int64
+	consecutive atomic.Int64
+	disabled    atomic.Bool
+}
+
+// addGuard starts counting the failures of a hook. Hooks sharing an id share counters.
+func (h *Hooks) addGuard(hook Hook) {
+	m, _ := h.guards.Load().(map[string]*hookGuard)
+	if _, ok := m[hook.ID()]; ok {
+		return
+	}
+
+	n := make(map[string]*hookGuard, len(m)+1)
+	for id, g := range m {
+		n[id] = g
+	}
+	n[hook.ID()] = new(hookGuard)
+	h.guards.Store(n)
+}
+
+// guard returns the failure counters of a hook, or nil if it was not added.
+func (h *Hooks) guard(hook Hook) *hookGuard {
+	m, _ := h.guards.Load().(map[string]*hookGuard)
+	return m[hook.ID()]
+}
+
+// provides returns true if a hook provides a hook method and has not been disabled.
+func (h *Hooks) provides(hook Hook, b byte) bool {
+	if !hook.Provides(b) {
+		return false
+	}
+
+	g := h.guard(hook)
+	return g == nil || !g.disabled.Load()
+}
+
+// call calls a hook method, recovering from any panic, and counts the failure of the
+// hook if it panics or returns an error other than a packets.Code. Injected faults fail
+// or drop the call without calling the method.
+func (h *Hooks) call(hook Hook, b byte, fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", ErrHookPanic, r)
+			h.Log.Error("recovered from hook panic", "hook", hook.ID(), "method", b, "error", err, "stack", string(debug.Stack()))
+		}
+
+		h.record(hook, err)
+	}()
+
+	if point := faultPoint(hook, b); point != "" {
+		if err := h.Faults.Inject(point); errors.Is(err, faults.ErrDropped) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return fn()
+}
+
+// faultPoint returns the fault injection point of a hook method, the auth checks of any
+// hook or the writes of storage hooks, or an empty string if faults are not injected.
+func faultPoint(hook Hook, b byte) string {
+	switch b {
+	case OnConnectAuthenticate, OnACLCheck, OnEnhancedAuth:
+		return faults.PointAuth
+	case OnSessionEstablished, OnDisconnect, OnSubscribed, OnUnsubscribed, OnRetainMessage, OnQosPublish,
+		OnQosComplete, OnQosDropped, OnClientExpired, OnRetainedExpired, OnWillSent, OnSysInfoTick:
+		if hook.Provides(StoredClients) {
+			return faults.PointStorageWrite
+		}
+	}
+
+	return ""
+}
+
+// record records the result of a hook method call. A hook is disabled, and bypassed by
+// all further calls, once it fails more consecutive times than the failure limit.
+func (h *Hooks) record(hook Hook, err error) {
+	g := h.guard(hook)
+	if g == nil {
+		return
+	}
+
+	// codes are the decisions of hooks, such as rejecting a packet, rather than failures
+	if err == nil || errors.As(err, new(packets.Code)) {
+		if g.consecutive.Load() != 0 {
+			g.consecutive.Store(0)
+		}
+		return
+	}
+
+	if errors.Is(err, ErrHookPanic) {
+		g.panics.Add(1)
+	} else {
+		g.errors.Add(1)
+	}
+
+	n := g.consecutive.Add(1)
+	if h.FailureLimit > 0 && n >= h.FailureLimit && g.disabled.CompareAndSwap(false, true) {
+		h.Log.Error("hook disabled after consecutive failures", "hook", hook.ID(), "failures", n, "error", err)
+	}
+}
+
+// Stats returns the failure counters of each hook, ordered by id.
+func (h *Hooks) Stats() []HookStats {
+	m, _ := h.guards.Load().(map[string]*hookGuard)
+	v := make([]HookStats, 0, len(m))
+	for id, g := range m {
+		v = append(v, HookStats{
+			ID:          id,
+			Panics:      g.panics.Load(),
+			Errors:      g.errors.Load(),
+			Consecutive: g.consecutive.Load(),
+			Disabled:    g.disabled.Load(),
+		})
+	}
+
+	sort.Slice(v, func(i, j int) bool { return v[i].ID < v[j].ID })
+	return v
+}
+
+// Enable re-enables a hook which was disabled after too many failures, returning false
+// if there is no hook with the id.
+func (h *Hooks) Enable(id string) bool {
+	m, _ := h.guards.Load().(map[string]*hookGuard)
+	g, ok := m[id]
+	if !ok {
+		return false
+	}
+
+	g.consecutive.Store(0)
+	if g.disabled.CompareAndSwap(true, false) {
+		h.Log.Info("hook enabled", "hook", id)
+	}
+
+	return true
+}
@@ -0,0 +1,180 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/faults"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+type panicHook struct {
+	HookBase
+	id     string
+	panic  bool
+	called int
+}
+
+func (h *panicHook) ID() string {
+	return h.id
+}
+
+func (h *panicHook) Provides(b byte) bool {
+	return b == OnPublished || b == OnConnectAuthenticate || b == OnPublish
+}
+
+func (h *panicHook) OnPublished(cl *Client, pk packets.Packet) {
+	h.called++
+	if h.panic {
+		panic("bad hook")
+	}
+}
+
+func (h *panicHook) OnConnectAuthenticate(cl *Client, pk packets.Packet) bool {
+	if h.panic {
+		panic("bad hook")
+	}
+	return true
+}
+
+func (h *panicHook) OnPublish(cl *Client, pk packets.Packet) (packets.Packet, error) {
+	return pk, packets.ErrRejectPacket
+}
+
+func TestHooksPanicRecovered(t *testing.T) {
+	h := &Hooks{Log: logger}
+	bad := &panicHook{id: "bad", panic: true}
+	good := &panicHook{id: "good"}
+	require.NoError(t, h.Add(bad, nil))
+	require.NoError(t, h.Add(good, nil))
+
+	cl, _, _ := newTestClient()
+	h.OnPublished(cl, packets.Packet{})
+	require.Equal(t, 1, bad.called)
+	require.Equal(t, 1, good.called)
+	require.True(t, h.OnConnectAuthenticate(cl, packets.Packet{}))
+
+	require.Equal(t, []HookStats{
+		{ID: "bad", Panics: 2, Consecutive: 2},
+		{ID: "good"},
+	}, h.Stats())
+}
+
+func TestHooksFailureLimit(t *testing.T) {
+	h := &Hooks{Log: logger, FailureLimit: 2}
+	bad := &panicHook{id: "bad", panic: true}
+	require.NoError(t, h.Add(bad, nil))
+
+	cl, _, _ := newTestClient()
+	h.OnPublished(cl, packets.Packet{})
+	require.True(t, h.Provides(OnPublished))
+	h.OnPublished(cl, packets.Packet{})
+	require.False(t, h.Provides(OnPublished))
+	require.True(t, h.Stats()[0].Disabled)
+
+	h.OnPublished(cl, packets.Packet{})
+	require.Equal(t, 2, bad.called)
+
+	bad.panic = false
+	require.False(t, h.Enable("missing"))
+	require.True(t, h.Enable("bad"))
+	h.OnPublished(cl, packets.Packet{})
+	require.Equal(t, 3, bad.called)
+	require.Equal(t, HookStats{ID: "bad", Panics: 2}, h.Stats()[0])
+}
+
+func TestHooksFailureCodesNotCounted(t *testing.T) {
+	h := &Hooks{Log: logger, FailureLimit: 1}
+	require.NoError(t, h.Add(&panicHook{id: "reject"}, nil))
+
+	cl, _, _ := newTestClient()
+	_, err := h.OnPublish(cl, packets.Packet{})
+	require.ErrorIs(t, err, packets.ErrRejectPacket)
+	require.Equal(t, HookStats{ID: "reject"}, h.Stats()[0])
+}
+
+func TestHooksStoredErrorCounted(t *testing.T) {
+	h := &Hooks{Log: logger, FailureLimit: 1}
+	require.NoError(t, h.Add(&modifiedHookBase{fail: true}, nil))
+
+	_, err := h.StoredClients()
+	require.Error(t, err)
+	require.Equal(t, HookStats{ID: "modified", Errors: 1, Consecutive: 1, Disabled: true}, h.Stats()[0])
+
+	_, err = h.StoredClients()
+	require.NoError(t, err)
+}
+
+func TestServerHookStats(t *testing.T) {
+	s := New(&Options{Logger: logger, HookFailureLimit: 1})
+	require.NoError(t, s.AddHook(&panicHook{id: "bad", panic: true}, nil))
+
+	cl, _, _ := newTestClient()
+	require.False(t, s.hooks.OnConnectAuthenticate(cl, packets.Packet{}))
+	require.True(t, s.HookStats()[0].Disabled)
+	require.True(t, s.EnableHook("bad"))
+	require.False(t, s.HookStats()[0].Disabled)
+}
+
+// faultHook counts the storage writes of a hook providing storage.
+type faultHook struct {
+	HookBase
+	retained int
+}
+
+func (h *faultHook) ID() string {
+	return "fault-storage"
+}
+
+func (h *faultHook) Provides(b byte) bool {
+	return b == StoredClients || b == OnRetainMessage || b == OnPublished
+}
+
+func (h *faultHook) OnRetainMessage(cl *Client, pk packets.Packet, r int64) {
+	h.retained++
+}
+
+func TestHooksFaultInjected(t *testing.T) {
+	s := New(&Options{Logger: logger, FaultInjection: true})
+	require.NoError(t, s.AddHook(&panicHook{id: "auth"}, nil))
+	store := new(faultHook)
+	require.NoError(t, s.AddHook(store, nil))
+
+	cl, _, _ := newTestClient()
+	require.True(t, s.hooks.OnConnectAuthenticate(cl, packets.Packet{}))
+
+	_, err := s.Faults.Set(faults.Fault{Point: faults.PointAuth, ErrorRate: 1})
+	require.NoError(t, err)
+	require.False(t, s.hooks.OnConnectAuthenticate(cl, packets.Packet{}))
+
+	_, err = s.Faults.Set(faults.Fault{Point: faults.PointStorageWrite, DropRate: 1})
+	require.NoError(t, err)
+	s.hooks.OnRetainMessage(cl, packets.Packet{}, 1)
+	require.Equal(t, 0, store.retained)
+
+	_, err = s.Faults.Set(faults.Fault{Point: faults.PointStorageWrite, ErrorRate: 1})
+	require.NoError(t, err)
+	s.hooks.OnRetainMessage(cl, packets.Packet{}, 1)
+	require.Equal(t, 0, store.retained)
+
+	require.Equal(t, []HookStats{
+		{ID: "auth", Errors: 1, Consecutive: 1},
+		{ID: "fault-storage", Errors: 1, Consecutive: 1},
+	}, s.HookStats())
+
+	s.Faults.ClearAll()
+	s.hooks.OnRetainMessage(cl, packets.Packet{}, 1)
+	require.Equal(t, 1, store.retained)
+	require.True(t, s.hooks.OnConnectAuthenticate(cl, packets.Packet{}))
+}
+
+func TestFaultPoint(t *testing.T) {
+	require.Equal(t, faults.PointAuth, faultPoint(new(panicHook), OnACLCheck))
+	require.Equal(t, faults.PointStorageWrite, faultPoint(new(faultHook), OnRetainMessage))
+	require.Equal(t, "", faultPoint(new(panicHook), OnRetainMessage))
+	require.Equal(t, "", faultPoint(new(faultHook), OnPublished))
+}
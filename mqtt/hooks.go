@@ -8,10 +8,13 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"slices"
 	"sync"
 	"sync/atomic"
 
+	"github.com/wind-c/comqtt/v2/mqtt/faults"
 	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
+	"github.com/wind-c/comqtt/v2/mqtt/listeners"
 	"github.com/wind-c/comqtt/v2/mqtt/packets"
 	"github.com/wind-c/comqtt/v2/mqtt/system"
 )
@@ -51,6 +54,10 @@ const (
 	OnClientExpired
 	OnRetainedExpired
 	OnPublishedWithSharedFilters
+	OnClientIDAssign
+	OnUsageReport
+	OnEnhancedAuth
+	OnSecurityEvent
 	StoredClients
 	StoredSubscriptions
 	StoredInflightMessages
@@ -108,6 +115,10 @@ type Hook interface {
 	OnClientExpired(cl *Client)
 	OnRetainedExpired(filter string)
 	OnPublishedWithSharedFilters(pk packets.Packet, sharedFilters map[string]bool)
+	OnClientIDAssign(cl *Client, pk packets.Packet) string                // generate the id of a client which connected with an empty client id
+	OnUsageReport(report UsageReport)                                     // export the usage of users and tenants over a reporting period
+	OnEnhancedAuth(cl *Client, pk packets.Packet) (packets.Packet, error) // continue or complete an mqtt v5 authentication exchange
+	OnSecurityEvent(ev SecurityEvent)                                     // export failed authentications, acl denials, blacklist hits and bans
 	StoredClients() ([]storage.Client, error)
 	StoredSubscriptions() ([]storage.Subscription, error)
 	StoredInflightMessages() ([]storage.Message, error)
@@ -132,6 +143,72 @@ type Hooks struct {
 	qty        int64          // the number of hooks in use
 	sync.Mutex                // a mutex for locking when adding hooks
 	halting    atomic.Bool    // If true, the hooks are halting and no more work should be done.
+
+	guards       atomic.Value     // a map[string]*hookGuard of the failure counters of each hook
+	FailureLimit int64            // the consecutive failures after which a hook is disabled and bypassed, never if 0
+	Faults       *faults.Injector // faults injected into auth calls and storage writes, nil if none
+	wal          *WAL             // the write-ahead log of the inflight messages, appended to before the hooks are called, nil if none
+
+	listenerAuth sync.Map  // the *listeners.AuthPolicy of listeners, keyed on listener id
+	Blacklist    Blacklist // the blacklist denying clients before the auth hooks are called, nil if none
+}
+
+// SetListenerAuth sets the policy by which the clients of a listener are authenticated
+// and acl checked, or removes it if nil so that the clients are checked by all auth hooks.
+func (h *Hooks) SetListenerAuth(id string, policy *listeners.AuthPolicy) {
+	if policy == nil {
+		h.listenerAuth.Delete(id)
+		return
+	}
+
+	h.listenerAuth.Store(id, policy)
+}
+
+// ListenerAuth returns the auth policy of a listener, or nil if it has none.
+func (h *Hooks) ListenerAuth(id string) *listeners.AuthPolicy {
+	if v, ok := h.listenerAuth.Load(id); ok {
+		return v.(*listeners.AuthPolicy)
+	}
+
+	return nil
+}
+
+// blacklistAuth returns false if the blacklist denies a client, marking the client as
+// blacklisted so that its failed authentication is reported as a blacklist hit.
+func (h *Hooks) blacklistAuth(cl *Client) bool {
+	if h.Blacklist == nil {
+		return true
+	}
+
+	if n, ok := h.Blacklist.BlacklistAuth(cl); n >= 0 && !ok {
+		if cl.Ext == nil {
+			cl.Ext = make(map[string]interface{})
+		}
+		cl.Ext[BlacklistedExtKey] = true
+		return false
+	}
+
+	return true
+}
+
+// blacklistACL returns false if the blacklist denies a client access to a topic. Access
+// allowed by the blacklist is still checked by the auth hooks.
+func (h *Hooks) blacklistACL(cl *Client, topic string, write bool) bool {
+	if h.Blacklist == nil {
+		return true
+	}
+
+	if n, ok := h.Blacklist.BlacklistACL(cl, topic, write); n >= 0 {
+		return ok
+	}
+
+	return true
+}
+
+// authHook returns true if a hook may authenticate and acl check clients under a
+// listener auth policy.
+func authHook(policy *listeners.AuthPolicy, hook Hook) bool {
+	return policy == nil || len(policy.Hooks) == 0 || slices.Contains(policy.Hooks, hook.ID())
 }
 
 // Len returns the number of hooks added.
@@ -143,7 +220,7 @@ func (h *Hooks) Len() int64 {
 func (h *Hooks) Provides(b ...byte) bool {
 	for _, hook := range h.GetAll() {
 		for _, hb := range b {
-			if hook.Provides(hb) {
+			if h.provides(hook, hb) {
 				return true
 			}
 		}
@@ -169,6 +246,7 @@ func (h *Hooks) Add(hook Hook, config any) error {
 
 	i = append(i, hook)
 	h.internal.Store(i)
+	h.addGuard(hook)
 	atomic.AddInt64(&h.qty, 1)
 	h.wg.Add(1)
 
@@ -209,8 +287,11 @@ func (h *Hooks) OnSysInfoTick(sys *system.Info) {
 	}
 
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnSysInfoTick) {
-			hook.OnSysInfoTick(sys)
+		if h.provides(hook, OnSysInfoTick) {
+			h.call(hook, OnSysInfoTick, func() error {
+				hook.OnSysInfoTick(sys)
+				return nil
+			})
 		}
 	}
 }
@@ -218,8 +299,11 @@ func (h *Hooks) OnSysInfoTick(sys *system.Info) {
 // OnStarted is called when the server has successfully started.
 func (h *Hooks) OnStarted() {
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnStarted) {
-			hook.OnStarted()
+		if h.provides(hook, OnStarted) {
+			h.call(hook, OnStarted, func() error {
+				hook.OnStarted()
+				return nil
+			})
 		}
 	}
 }
@@ -227,8 +311,11 @@ func (h *Hooks) OnStarted() {
 // OnStopped is called when the server has successfully stopped.
 func (h *Hooks) OnStopped() {
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnStopped) {
-			hook.OnStopped()
+		if h.provides(hook, OnStopped) {
+			h.call(hook, OnStopped, func() error {
+				hook.OnStopped()
+				return nil
+			})
 		}
 	}
 }
@@ -240,8 +327,10 @@ func (h *Hooks) OnConnect(cl *Client, pk packets.Packet) error {
 	}
 
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnConnect) {
-			err := hook.OnConnect(cl, pk)
+		if h.provides(hook, OnConnect) {
+			err := h.call(hook, OnConnect, func() error {
+				return hook.OnConnect(cl, pk)
+			})
 			if err != nil {
 				return err
 			}
@@ -258,8 +347,11 @@ func (h *Hooks) OnSessionEstablish(cl *Client, pk packets.Packet) {
 	}
 
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnSessionEstablish) {
-			hook.OnSessionEstablish(cl, pk)
+		if h.provides(hook, OnSessionEstablish) {
+			h.call(hook, OnSessionEstablish, func() error {
+				hook.OnSessionEstablish(cl, pk)
+				return nil
+			})
 		}
 	}
 }
@@ -271,21 +363,30 @@ func (h *Hooks) OnSessionEstablished(cl *Client, pk packets.Packet) {
 	}
 
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnSessionEstablished) {
-			hook.OnSessionEstablished(cl, pk)
+		if h.provides(hook, OnSessionEstablished) {
+			h.call(hook, OnSessionEstablished, func() error {
+				hook.OnSessionEstablished(cl, pk)
+				return nil
+			})
 		}
 	}
 }
 
 // OnDisconnect is called when a client is disconnected for any reason.
 func (h *Hooks) OnDisconnect(cl *Client, err error, expire bool) {
+	if expire && cl.StopCause() != packets.ErrSessionTakenOver {
+		h.wal.expire(cl.ID)
+	}
 	if h.halting.Load() {
 		return
 	}
 
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnDisconnect) {
-			hook.OnDisconnect(cl, err, expire)
+		if h.provides(hook, OnDisconnect) {
+			h.call(hook, OnDisconnect, func() error {
+				hook.OnDisconnect(cl, err, expire)
+				return nil
+			})
 		}
 	}
 }
@@ -298,8 +399,12 @@ func (h *Hooks) OnPacketRead(cl *Client, pk packets.Packet) (pkx packets.Packet,
 
 	pkx = pk
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnPacketRead) {
-			npk, err := hook.OnPacketRead(cl, pkx)
+		if h.provides(hook, OnPacketRead) {
+			var npk packets.Packet
+			err := h.call(hook, OnPacketRead, func() (err error) {
+				npk, err = hook.OnPacketRead(cl, pkx)
+				return
+			})
 			if err != nil && errors.Is(err, packets.ErrRejectPacket) {
 				h.Log.Debug("packet rejected", "hook", hook.ID(), "packet", pkx)
 				return pk, err
@@ -323,8 +428,12 @@ func (h *Hooks) OnAuthPacket(cl *Client, pk packets.Packet) (pkx packets.Packet,
 
 	pkx = pk
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnAuthPacket) {
-			npk, err := hook.OnAuthPacket(cl, pkx)
+		if h.provides(hook, OnAuthPacket) {
+			var npk packets.Packet
+			err := h.call(hook, OnAuthPacket, func() (err error) {
+				npk, err = hook.OnAuthPacket(cl, pkx)
+				return
+			})
 			if err != nil {
 				return pk, err
 			}
@@ -343,8 +452,11 @@ func (h *Hooks) OnPacketEncode(cl *Client, pk packets.Packet) packets.Packet {
 	}
 
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnPacketEncode) {
-			pk = hook.OnPacketEncode(cl, pk)
+		if h.provides(hook, OnPacketEncode) {
+			h.call(hook, OnPacketEncode, func() error {
+				pk = hook.OnPacketEncode(cl, pk)
+				return nil
+			})
 		}
 	}
 
@@ -358,8 +470,11 @@ func (h *Hooks) OnPacketProcessed(cl *Client, pk packets.Packet, err error) {
 	}
 
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnPacketProcessed) {
-			hook.OnPacketProcessed(cl, pk, err)
+		if h.provides(hook, OnPacketProcessed) {
+			h.call(hook, OnPacketProcessed, func() error {
+				hook.OnPacketProcessed(cl, pk, err)
+				return nil
+			})
 		}
 	}
 }
@@ -372,8 +487,11 @@ func (h *Hooks) OnPacketSent(cl *Client, pk packets.Packet, b []byte) {
 	}
 
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnPacketSent) {
-			hook.OnPacketSent(cl, pk, b)
+		if h.provides(hook, OnPacketSent) {
+			h.call(hook, OnPacketSent, func() error {
+				hook.OnPacketSent(cl, pk, b)
+				return nil
+			})
 		}
 	}
 }
@@ -388,8 +506,11 @@ func (h *Hooks) OnSubscribe(cl *Client, pk packets.Packet) packets.Packet {
 	}
 
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnSubscribe) {
-			pk = hook.OnSubscribe(cl, pk)
+		if h.provides(hook, OnSubscribe) {
+			h.call(hook, OnSubscribe, func() error {
+				pk = hook.OnSubscribe(cl, pk)
+				return nil
+			})
 		}
 	}
 	return pk
@@ -402,8 +523,11 @@ func (h *Hooks) OnSubscribed(cl *Client, pk packets.Packet, reasonCodes []byte,
 	}
 
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnSubscribed) {
-			hook.OnSubscribed(cl, pk, reasonCodes, counts)
+		if h.provides(hook, OnSubscribed) {
+			h.call(hook, OnSubscribed, func() error {
+				hook.OnSubscribed(cl, pk, reasonCodes, counts)
+				return nil
+			})
 		}
 	}
 }
@@ -418,8 +542,11 @@ func (h *Hooks) OnSelectSubscribers(subs *Subscribers, pk packets.Packet) *Subsc
 	}
 
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnSelectSubscribers) {
-			subs = hook.OnSelectSubscribers(subs, pk)
+		if h.provides(hook, OnSelectSubscribers) {
+			h.call(hook, OnSelectSubscribers, func() error {
+				subs = hook.OnSelectSubscribers(subs, pk)
+				return nil
+			})
 		}
 	}
 	return subs
@@ -435,8 +562,11 @@ func (h *Hooks) OnUnsubscribe(cl *Client, pk packets.Packet) packets.Packet {
 	}
 
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnUnsubscribe) {
-			pk = hook.OnUnsubscribe(cl, pk)
+		if h.provides(hook, OnUnsubscribe) {
+			h.call(hook, OnUnsubscribe, func() error {
+				pk = hook.OnUnsubscribe(cl, pk)
+				return nil
+			})
 		}
 	}
 	return pk
@@ -449,8 +579,11 @@ func (h *Hooks) OnUnsubscribed(cl *Client, pk packets.Packet, reasonCodes []byte
 	}
 
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnUnsubscribed) {
-			hook.OnUnsubscribed(cl, pk, reasonCodes, counts)
+		if h.provides(hook, OnUnsubscribed) {
+			h.call(hook, OnUnsubscribed, func() error {
+				hook.OnUnsubscribed(cl, pk, reasonCodes, counts)
+				return nil
+			})
 		}
 	}
 }
@@ -465,8 +598,12 @@ func (h *Hooks) OnPublish(cl *Client, pk packets.Packet) (pkx packets.Packet, er
 
 	pkx = pk
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnPublish) {
-			npk, err := hook.OnPublish(cl, pkx)
+		if h.provides(hook, OnPublish) {
+			var npk packets.Packet
+			err := h.call(hook, OnPublish, func() (err error) {
+				npk, err = hook.OnPublish(cl, pkx)
+				return
+			})
 			if err != nil {
 				if errors.Is(err, packets.ErrRejectPacket) {
 					h.Log.Debug("publish packet rejected",
@@ -495,8 +632,11 @@ func (h *Hooks) OnPublished(cl *Client, pk packets.Packet) {
 	}
 
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnPublished) {
-			hook.OnPublished(cl, pk)
+		if h.provides(hook, OnPublished) {
+			h.call(hook, OnPublished, func() error {
+				hook.OnPublished(cl, pk)
+				return nil
+			})
 		}
 	}
 }
@@ -509,8 +649,11 @@ func (h *Hooks) OnPublishDropped(cl *Client, pk packets.Packet) {
 	}
 
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnPublishDropped) {
-			hook.OnPublishDropped(cl, pk)
+		if h.provides(hook, OnPublishDropped) {
+			h.call(hook, OnPublishDropped, func() error {
+				hook.OnPublishDropped(cl, pk)
+				return nil
+			})
 		}
 	}
 }
@@ -522,8 +665,11 @@ func (h *Hooks) OnRetainMessage(cl *Client, pk packets.Packet, r int64) {
 	}
 
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnRetainMessage) {
-			hook.OnRetainMessage(cl, pk, r)
+		if h.provides(hook, OnRetainMessage) {
+			h.call(hook, OnRetainMessage, func() error {
+				hook.OnRetainMessage(cl, pk, r)
+				return nil
+			})
 		}
 	}
 }
@@ -535,8 +681,11 @@ func (h *Hooks) OnRetainPublished(cl *Client, pk packets.Packet) {
 	}
 
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnRetainPublished) {
-			hook.OnRetainPublished(cl, pk)
+		if h.provides(hook, OnRetainPublished) {
+			h.call(hook, OnRetainPublished, func() error {
+				hook.OnRetainPublished(cl, pk)
+				return nil
+			})
 		}
 	}
 }
@@ -545,13 +694,17 @@ func (h *Hooks) OnRetainPublished(cl *Client, pk packets.Packet) {
 // In other words, this method is called when a new inflight message is created or resent.
 // It is typically used to store a new inflight message.
 func (h *Hooks) OnQosPublish(cl *Client, pk packets.Packet, sent int64, resends int) {
+	h.wal.publish(cl, pk, sent)
 	if h.halting.Load() {
 		return
 	}
 
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnQosPublish) {
-			hook.OnQosPublish(cl, pk, sent, resends)
+		if h.provides(hook, OnQosPublish) {
+			h.call(hook, OnQosPublish, func() error {
+				hook.OnQosPublish(cl, pk, sent, resends)
+				return nil
+			})
 		}
 	}
 }
@@ -560,13 +713,17 @@ func (h *Hooks) OnQosPublish(cl *Client, pk packets.Packet, sent int64, resends
 // In other words, when an inflight message is resolved.
 // It is typically used to delete an inflight message from a store.
 func (h *Hooks) OnQosComplete(cl *Client, pk packets.Packet) {
+	h.wal.remove(cl.ID, pk.PacketID)
 	if h.halting.Load() {
 		return
 	}
 
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnQosComplete) {
-			hook.OnQosComplete(cl, pk)
+		if h.provides(hook, OnQosComplete) {
+			h.call(hook, OnQosComplete, func() error {
+				hook.OnQosComplete(cl, pk)
+				return nil
+			})
 		}
 	}
 }
@@ -575,13 +732,17 @@ func (h *Hooks) OnQosComplete(cl *Client, pk packets.Packet) {
 // an inflight message expires or is abandoned. It is typically used to delete an
 // inflight message from a store.
 func (h *Hooks) OnQosDropped(cl *Client, pk packets.Packet) {
+	h.wal.remove(cl.ID, pk.PacketID)
 	if h.halting.Load() {
 		return
 	}
 
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnQosDropped) {
-			hook.OnQosDropped(cl, pk)
+		if h.provides(hook, OnQosDropped) {
+			h.call(hook, OnQosDropped, func() error {
+				hook.OnQosDropped(cl, pk)
+				return nil
+			})
 		}
 	}
 }
@@ -594,8 +755,11 @@ func (h *Hooks) OnPacketIDExhausted(cl *Client, pk packets.Packet) {
 	}
 
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnPacketIDExhausted) {
-			hook.OnPacketIDExhausted(cl, pk)
+		if h.provides(hook, OnPacketIDExhausted) {
+			h.call(hook, OnPacketIDExhausted, func() error {
+				hook.OnPacketIDExhausted(cl, pk)
+				return nil
+			})
 		}
 	}
 }
@@ -610,8 +774,12 @@ func (h *Hooks) OnWill(cl *Client, will Will) Will {
 	}
 
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnWill) {
-			mlwt, err := hook.OnWill(cl, will)
+		if h.provides(hook, OnWill) {
+			var mlwt Will
+			err := h.call(hook, OnWill, func() (err error) {
+				mlwt, err = hook.OnWill(cl, will)
+				return
+			})
 			if err != nil {
 				h.Log.Error("parse will error",
 					"error", err,
@@ -633,21 +801,28 @@ func (h *Hooks) OnWillSent(cl *Client, pk packets.Packet) {
 	}
 
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnWillSent) {
-			hook.OnWillSent(cl, pk)
+		if h.provides(hook, OnWillSent) {
+			h.call(hook, OnWillSent, func() error {
+				hook.OnWillSent(cl, pk)
+				return nil
+			})
 		}
 	}
 }
 
 // OnClientExpired is called when a client session has expired and should be deleted.
 func (h *Hooks) OnClientExpired(cl *Client) {
+	h.wal.expire(cl.ID)
 	if h.halting.Load() {
 		return
 	}
 
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnClientExpired) {
-			hook.OnClientExpired(cl)
+		if h.provides(hook, OnClientExpired) {
+			h.call(hook, OnClientExpired, func() error {
+				hook.OnClientExpired(cl)
+				return nil
+			})
 		}
 	}
 }
@@ -659,8 +834,11 @@ func (h *Hooks) OnRetainedExpired(filter string) {
 	}
 
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnRetainedExpired) {
-			hook.OnRetainedExpired(filter)
+		if h.provides(hook, OnRetainedExpired) {
+			h.call(hook, OnRetainedExpired, func() error {
+				hook.OnRetainedExpired(filter)
+				return nil
+			})
 		}
 	}
 }
@@ -672,8 +850,101 @@ func (h *Hooks) OnPublishedWithSharedFilters(pk packets.Packet, sharedFilters ma
 	}
 
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnPublishedWithSharedFilters) {
-			hook.OnPublishedWithSharedFilters(pk, sharedFilters)
+		if h.provides(hook, OnPublishedWithSharedFilters) {
+			h.call(hook, OnPublishedWithSharedFilters, func() error {
+				hook.OnPublishedWithSharedFilters(pk, sharedFilters)
+				return nil
+			})
+		}
+	}
+}
+
+// OnClientIDAssign is called when a client connects with an empty client id and the server
+// must assign one. The first non-empty id returned by a hook is used, otherwise the server
+// generates an id itself.
+func (h *Hooks) OnClientIDAssign(cl *Client, pk packets.Packet) string {
+	if h.halting.Load() {
+		return ""
+	}
+
+	for _, hook := range h.GetAll() {
+		if h.provides(hook, OnClientIDAssign) {
+			var id string
+			h.call(hook, OnClientIDAssign, func() error {
+				id = hook.OnClientIDAssign(cl, pk)
+				return nil
+			})
+			if id != "" {
+				return id
+			}
+		}
+	}
+
+	return ""
+}
+
+// OnUsageReport is called at the end of each usage reporting period with the usage of
+// each user and tenant over the period, so it can be exported for metering and billing.
+func (h *Hooks) OnUsageReport(report UsageReport) {
+	if h.halting.Load() {
+		return
+	}
+
+	for _, hook := range h.GetAll() {
+		if h.provides(hook, OnUsageReport) {
+			h.call(hook, OnUsageReport, func() error {
+				hook.OnUsageReport(report)
+				return nil
+			})
+		}
+	}
+}
+
+// OnEnhancedAuth is called with the connect packet of an MQTT v5 client which connects
+// with an authentication method, and with each auth packet the client sends to continue
+// the exchange or to re-authenticate. The first hook which supports the method returns
+// an auth packet with a continue authentication reason code and the challenge to send to
+// the client, or with a success reason code once the client is authenticated. Hooks
+// return a bad authentication method error for the methods they do not support. Only
+// the hooks selected by the auth policy of the listener of the client are called.
+func (h *Hooks) OnEnhancedAuth(cl *Client, pk packets.Packet) (packets.Packet, error) {
+	if h.halting.Load() {
+		return packets.Packet{}, packets.ErrNotAuthorized
+	}
+
+	policy := h.ListenerAuth(cl.Net.Listener)
+	for _, hook := range h.GetAll() {
+		if h.provides(hook, OnEnhancedAuth) && authHook(policy, hook) {
+			res := packets.Packet{ReasonCode: packets.ErrNotAuthorized.Code} // if the call is bypassed
+			err := h.call(hook, OnEnhancedAuth, func() (err error) {
+				res, err = hook.OnEnhancedAuth(cl, pk)
+				return
+			})
+			if code, ok := err.(packets.Code); ok && code.Code == packets.ErrBadAuthenticationMethod.Code {
+				continue
+			}
+
+			return res, err
+		}
+	}
+
+	return packets.Packet{}, packets.ErrBadAuthenticationMethod
+}
+
+// OnSecurityEvent is called when a client fails to authenticate, is denied access to a
+// topic, is rejected by a blacklist, or when a username, client id or ip is banned, so
+// that security events can be exported to an audit system.
+func (h *Hooks) OnSecurityEvent(ev SecurityEvent) {
+	if h.halting.Load() {
+		return
+	}
+
+	for _, hook := range h.GetAll() {
+		if h.provides(hook, OnSecurityEvent) {
+			h.call(hook, OnSecurityEvent, func() error {
+				hook.OnSecurityEvent(ev)
+				return nil
+			})
 		}
 	}
 }
@@ -682,8 +953,12 @@ func (h *Hooks) OnPublishedWithSharedFilters(pk packets.Packet, sharedFilters ma
 // populate the server clients list before start.
 func (h *Hooks) StoredClients() (v []storage.Client, err error) {
 	for _, hook := range h.GetAll() {
-		if hook.Provides(StoredClients) {
-			v, err := hook.StoredClients()
+		if h.provides(hook, StoredClients) {
+			var v []storage.Client
+			err := h.call(hook, StoredClients, func() (err error) {
+				v, err = hook.StoredClients()
+				return
+			})
 			if err != nil {
 				h.Log.Error("failed to load clients", "error", err, "hook", hook.ID())
 				return v, err
@@ -702,8 +977,12 @@ func (h *Hooks) StoredClients() (v []storage.Client, err error) {
 // used to populate the server subscriptions list before start.
 func (h *Hooks) StoredSubscriptions() (v []storage.Subscription, err error) {
 	for _, hook := range h.GetAll() {
-		if hook.Provides(StoredSubscriptions) {
-			v, err := hook.StoredSubscriptions()
+		if h.provides(hook, StoredSubscriptions) {
+			var v []storage.Subscription
+			err := h.call(hook, StoredSubscriptions, func() (err error) {
+				v, err = hook.StoredSubscriptions()
+				return
+			})
 			if err != nil {
 				h.Log.Error("failed to load subscriptions", "error", err, "hook", hook.ID())
 				return v, err
@@ -722,8 +1001,12 @@ func (h *Hooks) StoredSubscriptions() (v []storage.Subscription, err error) {
 // and is used to populate the restored clients with inflight messages before start.
 func (h *Hooks) StoredInflightMessages() (v []storage.Message, err error) {
 	for _, hook := range h.GetAll() {
-		if hook.Provides(StoredInflightMessages) {
-			v, err := hook.StoredInflightMessages()
+		if h.provides(hook, StoredInflightMessages) {
+			var v []storage.Message
+			err := h.call(hook, StoredInflightMessages, func() (err error) {
+				v, err = hook.StoredInflightMessages()
+				return
+			})
 			if err != nil {
 				h.Log.Error("failed to load inflight messages", "error", err, "hook", hook.ID())
 				return v, err
@@ -742,8 +1025,12 @@ func (h *Hooks) StoredInflightMessages() (v []storage.Message, err error) {
 // and is used to populate the server topics with retained messages before start.
 func (h *Hooks) StoredRetainedMessages() (v []storage.Message, err error) {
 	for _, hook := range h.GetAll() {
-		if hook.Provides(StoredRetainedMessages) {
-			v, err := hook.StoredRetainedMessages()
+		if h.provides(hook, StoredRetainedMessages) {
+			var v []storage.Message
+			err := h.call(hook, StoredRetainedMessages, func() (err error) {
+				v, err = hook.StoredRetainedMessages()
+				return
+			})
 			if err != nil {
 				h.Log.Error("failed to load retained messages", "error", err, "hook", hook.ID())
 				return v, err
@@ -765,8 +1052,12 @@ func (h *Hooks) StoredSysInfo() (v storage.SystemInfo, err error) {
 	}
 
 	for _, hook := range h.GetAll() {
-		if hook.Provides(StoredSysInfo) {
-			v, err := hook.StoredSysInfo()
+		if h.provides(hook, StoredSysInfo) {
+			var v storage.SystemInfo
+			err := h.call(hook, StoredSysInfo, func() (err error) {
+				v, err = hook.StoredSysInfo()
+				return
+			})
 			if err != nil {
 				h.Log.Error("failed to load $SYS info", "error", err, "hook", hook.ID())
 				return v, err
@@ -788,8 +1079,12 @@ func (h *Hooks) StoredClientByCid(cid string) (v storage.Client, err error) {
 	}
 
 	for _, hook := range h.GetAll() {
-		if hook.Provides(StoredClientByCid) {
-			v, err := hook.StoredClientByCid(cid)
+		if h.provides(hook, StoredClientByCid) {
+			var v storage.Client
+			err := h.call(hook, StoredClientByCid, func() (err error) {
+				v, err = hook.StoredClientByCid(cid)
+				return
+			})
 			if err != nil {
 				h.Log.Error("failed to load clients", "error", err, "hook", hook.ID())
 				return v, err
@@ -811,8 +1106,12 @@ func (h *Hooks) StoredSubscriptionsByCid(cid string) (v []storage.Subscription,
 	}
 
 	for _, hook := range h.GetAll() {
-		if hook.Provides(StoredSubscriptionsByCid) {
-			v, err := hook.StoredSubscriptionsByCid(cid)
+		if h.provides(hook, StoredSubscriptionsByCid) {
+			var v []storage.Subscription
+			err := h.call(hook, StoredSubscriptionsByCid, func() (err error) {
+				v, err = hook.StoredSubscriptionsByCid(cid)
+				return
+			})
 			if err != nil {
 				h.Log.Error("failed to get subscriptions", "error", err, "hook", hook.ID())
 				return v, err
@@ -834,8 +1133,12 @@ func (h *Hooks) StoredInflightMessagesByCid(cid string) (v []storage.Message, er
 	}
 
 	for _, hook := range h.GetAll() {
-		if hook.Provides(StoredInflightMessagesByCid) {
-			v, err := hook.StoredInflightMessagesByCid(cid)
+		if h.provides(hook, StoredInflightMessagesByCid) {
+			var v []storage.Message
+			err := h.call(hook, StoredInflightMessagesByCid, func() (err error) {
+				v, err = hook.StoredInflightMessagesByCid(cid)
+				return
+			})
 			if err != nil {
 				h.Log.Error("failed to get inflight messages", "error", err, "hook", hook.ID())
 				return v, err
@@ -857,8 +1160,12 @@ func (h *Hooks) StoredRetainedMessageByTopic(topic string) (v storage.Message, e
 	}
 
 	for _, hook := range h.GetAll() {
-		if hook.Provides(StoredRetainedMessageByTopic) {
-			v, err := hook.StoredRetainedMessageByTopic(topic)
+		if h.provides(hook, StoredRetainedMessageByTopic) {
+			var v storage.Message
+			err := h.call(hook, StoredRetainedMessageByTopic, func() (err error) {
+				v, err = hook.StoredRetainedMessageByTopic(topic)
+				return
+			})
 			if err != nil {
 				h.Log.Error("failed to get retained message", "error", err, "hook", hook.ID())
 				return v, err
@@ -876,15 +1183,31 @@ func (h *Hooks) StoredRetainedMessageByTopic(topic string) (v storage.Message, e
 // OnConnectAuthenticate is called when a user attempts to authenticate with the server.
 // An implementation of this method MUST be used to allow or deny access to the
 // server (see hooks/auth/allow_all or basic). It can be used in custom hooks to
-// check connecting users against an existing user database.
+// check connecting users against an existing user database. Clients denied by the
+// blacklist are rejected before any hook is called, and only the hooks selected by the
+// auth policy of the listener of the client are called.
 func (h *Hooks) OnConnectAuthenticate(cl *Client, pk packets.Packet) bool {
 	if h.halting.Load() {
 		return false
 	}
 
+	if !h.blacklistAuth(cl) {
+		return false
+	}
+
+	policy := h.ListenerAuth(cl.Net.Listener)
+	if policy != nil && policy.Anonymous {
+		return true
+	}
+
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnConnectAuthenticate) {
-			if ok := hook.OnConnectAuthenticate(cl, pk); ok {
+		if h.provides(hook, OnConnectAuthenticate) && authHook(policy, hook) {
+			var ok bool
+			h.call(hook, OnConnectAuthenticate, func() error {
+				ok = hook.OnConnectAuthenticate(cl, pk)
+				return nil
+			})
+			if ok {
 				return true
 			}
 		}
@@ -897,14 +1220,30 @@ func (h *Hooks) OnConnectAuthenticate(cl *Client, pk packets.Packet) bool {
 // An implementation of this method MUST be used to allow or deny access to the
 // (see hooks/auth/allow_all or basic). It can be used in custom hooks to
 // check publishing and subscribing users against an existing permissions or roles database.
+// Access denied by the blacklist is rejected before any hook is called, and only the hooks
+// selected by the auth policy of the listener of the client are called.
 func (h *Hooks) OnACLCheck(cl *Client, topic string, write bool) bool {
 	if h.halting.Load() {
 		return false
 	}
 
+	if !h.blacklistACL(cl, topic, write) {
+		return false
+	}
+
+	policy := h.ListenerAuth(cl.Net.Listener)
+	if policy != nil && policy.Anonymous {
+		return true
+	}
+
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnACLCheck) {
-			if ok := hook.OnACLCheck(cl, topic, write); ok {
+		if h.provides(hook, OnACLCheck) && authHook(policy, hook) {
+			var ok bool
+			h.call(hook, OnACLCheck, func() error {
+				ok = hook.OnACLCheck(cl, topic, write)
+				return nil
+			})
+			if ok {
 				return true
 			}
 		}
@@ -1072,6 +1411,22 @@ func (h *HookBase) OnRetainedExpired(topic string) {}
 // OnPublishedWithSharedFilters is called when a client has published a message to cluster.
 func (h *HookBase) OnPublishedWithSharedFilters(pk packets.Packet, sharedFilters map[string]bool) {}
 
+// OnClientIDAssign is called when the server must assign an id to a client.
+func (h *HookBase) OnClientIDAssign(cl *Client, pk packets.Packet) string {
+	return ""
+}
+
+// OnUsageReport is called with the usage of users and tenants over a reporting period.
+func (h *HookBase) OnUsageReport(report UsageReport) {}
+
+// OnEnhancedAuth is called to continue or complete the authentication exchange of a client.
+func (h *HookBase) OnEnhancedAuth(cl *Client, pk packets.Packet) (packets.Packet, error) {
+	return pk, packets.ErrBadAuthenticationMethod
+}
+
+// OnSecurityEvent is called with a failed authentication, acl denial, blacklist hit or ban.
+func (h *HookBase) OnSecurityEvent(ev SecurityEvent) {}
+
 // StoredClients returns all clients from a store.
 func (h *HookBase) StoredClients() (v []storage.Client, err error) {
 	return
@@ -0,0 +1,117 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package auth
+
+import (
+	"bytes"
+
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+// AnonymousOptions contains the configuration for the anonymous auth hook.
+type AnonymousOptions struct {
+	ACL       Filters // the access of anonymous clients to the topics matching each filter
+	blacklist *Ledger // the blacklist shared with the datasource auth hooks
+}
+
+// SetBlacklist sets the blacklist checked before anonymous clients are allowed.
+func (o *AnonymousOptions) SetBlacklist(bl *Ledger) {
+	o.blacklist = bl
+}
+
+// AnonymousHook is an authentication hook which allows clients connecting without a
+// username, restricting them to the topics of an acl, such as read only access to
+// public/#. Clients with a username are left to the other auth hooks. The blacklist
+// shared with the other auth hooks is checked first, as any auth hook allowing a client
+// is enough for it to connect.
+type AnonymousHook struct {
+	mqtt.HookBase
+	config *AnonymousOptions
+}
+
+// ID returns the ID of the hook.
+func (h *AnonymousHook) ID() string {
+	return "anonymous-auth"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *AnonymousHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnACLCheck,
+	}, []byte{b})
+}
+
+// Init configures the hook with the acl of anonymous clients.
+func (h *AnonymousHook) Init(config any) error {
+	if _, ok := config.(*AnonymousOptions); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		config = new(AnonymousOptions)
+	}
+
+	h.config = config.(*AnonymousOptions)
+	h.Log.Info("loaded anonymous acl", "filters", len(h.config.ACL))
+	return nil
+}
+
+// OnConnectAuthenticate returns true if a client connects without a username and is
+// not denied by the blacklist.
+func (h *AnonymousHook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	if len(cl.Properties.Username) > 0 {
+		return false
+	}
+
+	if h.config.blacklist == nil {
+		return true
+	}
+
+	if n, ok := h.config.blacklist.BlacklistAuth(cl); n >= 0 {
+		if !ok {
+			if cl.Ext == nil {
+				cl.Ext = make(map[string]interface{})
+			}
+			cl.Ext[mqtt.BlacklistedExtKey] = true
+		}
+		return ok
+	}
+
+	return true
+}
+
+// OnACLCheck returns true if an anonymous client has read or write access to a topic.
+// The most specific filter matching the topic decides, and topics matching no filter
+// are denied.
+func (h *AnonymousHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	if len(cl.Properties.Username) > 0 {
+		return false
+	}
+
+	if h.config.blacklist != nil {
+		if n, ok := h.config.blacklist.BlacklistACL(cl, topic, write); n >= 0 {
+			return ok
+		}
+	}
+
+	ok := false
+	matched := -1
+	for filter, access := range h.config.ACL {
+		if len(filter) <= matched || !filter.FilterMatches(topic) {
+			continue
+		}
+
+		matched = len(filter)
+		if write {
+			ok = access == WriteOnly || access == ReadWrite
+		} else {
+			ok = access == ReadOnly || access == ReadWrite
+		}
+	}
+
+	return ok
+}
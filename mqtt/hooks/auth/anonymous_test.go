@@ -0,0 +1,94 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+func newAnonymousHook(t *testing.T, acl Filters) *AnonymousHook {
+	h := new(AnonymousHook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&AnonymousOptions{ACL: acl}))
+	return h
+}
+
+func TestAnonymousID(t *testing.T) {
+	h := new(AnonymousHook)
+	require.Equal(t, "anonymous-auth", h.ID())
+}
+
+func TestAnonymousProvides(t *testing.T) {
+	h := new(AnonymousHook)
+	require.True(t, h.Provides(mqtt.OnACLCheck))
+	require.True(t, h.Provides(mqtt.OnConnectAuthenticate))
+	require.False(t, h.Provides(mqtt.OnPublished))
+}
+
+func TestAnonymousInit(t *testing.T) {
+	h := new(AnonymousHook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(nil))
+	require.Empty(t, h.config.ACL)
+
+	require.ErrorIs(t, h.Init(map[string]any{}), mqtt.ErrInvalidConfigType)
+}
+
+func TestAnonymousOnConnectAuthenticate(t *testing.T) {
+	h := newAnonymousHook(t, nil)
+	require.True(t, h.OnConnectAuthenticate(new(mqtt.Client), packets.Packet{}))
+
+	cl := new(mqtt.Client)
+	cl.Properties.Username = []byte("mochi")
+	require.False(t, h.OnConnectAuthenticate(cl, packets.Packet{}))
+}
+
+func TestAnonymousOnACLCheck(t *testing.T) {
+	h := newAnonymousHook(t, Filters{
+		"public/#":         ReadOnly,
+		"public/private/#": Deny,
+		"public/inbox":     ReadWrite,
+	})
+
+	cl := new(mqtt.Client)
+	require.True(t, h.OnACLCheck(cl, "public/news", false))
+	require.False(t, h.OnACLCheck(cl, "public/news", true))
+	require.False(t, h.OnACLCheck(cl, "public/private/a", false))
+	require.True(t, h.OnACLCheck(cl, "public/inbox", true))
+	require.False(t, h.OnACLCheck(cl, "devices/a", false))
+
+	cl.Properties.Username = []byte("mochi")
+	require.False(t, h.OnACLCheck(cl, "public/news", false))
+}
+
+func TestAnonymousBlacklist(t *testing.T) {
+	h := newAnonymousHook(t, Filters{"public/#": ReadWrite})
+	h.config.SetBlacklist(&Ledger{
+		Auth: AuthRules{
+			{Remote: "10.0.0.*", Allow: false},
+		},
+		ACL: ACLRules{
+			{Client: "sensor*", Filters: Filters{"public/cmd/#": ReadOnly}},
+		},
+	})
+
+	cl := new(mqtt.Client)
+	cl.Net.Remote = "10.0.0.1"
+	require.False(t, h.OnConnectAuthenticate(cl, packets.Packet{}))
+	require.Equal(t, true, cl.Ext[mqtt.BlacklistedExtKey])
+
+	cl = new(mqtt.Client)
+	cl.ID = "sensor1"
+	cl.Net.Remote = "192.168.0.1"
+	require.True(t, h.OnConnectAuthenticate(cl, packets.Packet{}))
+	require.Nil(t, cl.Ext[mqtt.BlacklistedExtKey])
+	require.False(t, h.OnACLCheck(cl, "public/cmd/reboot", true))
+	require.True(t, h.OnACLCheck(cl, "public/cmd/reboot", false))
+	require.True(t, h.OnACLCheck(cl, "public/news", true))
+}
@@ -264,6 +264,58 @@ func (l *Ledger) ACLOk(cl *mqtt.Client, topic string, write bool) (n int, ok boo
 	return 0, true
 }
 
+// BlacklistAuth returns the index of the first auth rule of a blacklist matching a client
+// and whether it allows the client, or -1 if no rule matches. Unlike AuthOk, passwords
+// are not checked, as a blacklist denies clients by their id, username or remote address,
+// such as the host:* of a banned ip.
+func (l *Ledger) BlacklistAuth(cl *mqtt.Client) (n int, ok bool) {
+	l.Lock()
+	rules := l.Auth
+	l.Unlock()
+
+	for n, rule := range rules {
+		if rule.Client.Matches(cl.ID) &&
+			rule.Username.Matches(string(cl.Properties.Username)) &&
+			rule.Remote.Matches(cl.Net.Remote) {
+			return n, rule.Allow
+		}
+	}
+
+	return -1, false
+}
+
+// BlacklistACL returns the index of the first acl rule of a blacklist deciding the access
+// of a client to a topic and whether it allows the access, or -1 if no rule decides. A
+// matching rule without filters allows all topics.
+func (l *Ledger) BlacklistACL(cl *mqtt.Client, topic string, write bool) (n int, ok bool) {
+	l.Lock()
+	rules := l.ACL
+	l.Unlock()
+
+	for n, rule := range rules {
+		if !rule.Client.Matches(cl.ID) ||
+			!rule.Username.Matches(string(cl.Properties.Username)) ||
+			!rule.Remote.Matches(cl.Net.Remote) {
+			continue
+		}
+
+		if len(rule.Filters) == 0 {
+			return n, true
+		}
+
+		for filter, access := range rule.Filters {
+			if filter.FilterMatches(topic) {
+				if write {
+					return n, access == WriteOnly || access == ReadWrite
+				}
+				return n, access == ReadOnly || access == ReadWrite
+			}
+		}
+	}
+
+	return -1, false
+}
+
 // ToJSON encodes the values into a JSON string.
 func (l *Ledger) ToJSON() (data []byte, err error) {
 	return json.Marshal(l)
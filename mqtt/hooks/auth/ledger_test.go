@@ -574,6 +574,58 @@ func TestLedgerUpdate(t *testing.T) {
 	require.NotSame(t, n, old)
 }
 
+func TestLedgerBlacklistAuth(t *testing.T) {
+	bl := &Ledger{
+		Auth: AuthRules{
+			{Client: "banned"},
+			{Remote: "10.0.0.1:*"},
+			{Username: "trusted", Allow: true},
+		},
+	}
+
+	tt := []struct {
+		cl *mqtt.Client
+		n  int
+		ok bool
+	}{
+		{&mqtt.Client{ID: "banned", Net: mqtt.ClientConnection{Remote: "127.0.0.1:1883"}}, 0, false},
+		{&mqtt.Client{ID: "cl1", Net: mqtt.ClientConnection{Remote: "10.0.0.1:50210"}}, 1, false},
+		{&mqtt.Client{ID: "cl1", Net: mqtt.ClientConnection{Remote: "10.0.0.10:50210"}, Properties: mqtt.ClientProperties{Username: []byte("trusted")}}, 2, true},
+		{&mqtt.Client{ID: "cl1", Net: mqtt.ClientConnection{Remote: "10.0.0.10:50210"}}, -1, false},
+	}
+
+	for _, tx := range tt {
+		n, ok := bl.BlacklistAuth(tx.cl)
+		require.Equal(t, tx.n, n, tx.cl.ID)
+		require.Equal(t, tx.ok, ok, tx.cl.ID)
+	}
+}
+
+func TestLedgerBlacklistACL(t *testing.T) {
+	bl := &Ledger{
+		ACL: ACLRules{
+			{Client: "reader", Filters: Filters{"a/#": ReadOnly}},
+			{Client: "any"},
+		},
+	}
+
+	reader := &mqtt.Client{ID: "reader"}
+	n, ok := bl.BlacklistACL(reader, "a/b", false)
+	require.Equal(t, 0, n)
+	require.True(t, ok)
+
+	n, ok = bl.BlacklistACL(reader, "a/b", true)
+	require.Equal(t, 0, n)
+	require.False(t, ok)
+
+	n, _ = bl.BlacklistACL(reader, "b/c", true)
+	require.Equal(t, -1, n)
+
+	n, ok = bl.BlacklistACL(&mqtt.Client{ID: "any"}, "b/c", true)
+	require.Equal(t, 1, n)
+	require.True(t, ok)
+}
+
 func TestLedgerToJSON(t *testing.T) {
 	data, err := ledgerStruct.ToJSON()
 	require.NoError(t, err)
@@ -0,0 +1,193 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+// Package objectstore is a hook uploading the snapshots of scheduled export jobs to an
+// object store with the S3 api, such as Amazon S3, Google Cloud Storage or MinIO.
+package objectstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt"
+)
+
+const (
+	defaultRegion  = "us-east-1"
+	defaultTimeout = time.Minute
+)
+
+var (
+	ErrNoBucket      = errors.New("object store endpoint and bucket are required")
+	ErrNoCredentials = errors.New("object store access key and secret key are required")
+)
+
+// Options contains configuration settings for the object store.
+type Options struct {
+	Endpoint  string        `yaml:"endpoint" json:"endpoint"`     // the url of the api, such as https://s3.eu-west-1.amazonaws.com, https://storage.googleapis.com or http://minio:9000
+	Region    string        `yaml:"region" json:"region"`         // the region of the bucket, defaults to us-east-1
+	Bucket    string        `yaml:"bucket" json:"bucket"`         // the bucket the snapshots are uploaded to
+	Prefix    string        `yaml:"prefix" json:"prefix"`         // prepended to the names of the snapshots, such as backups/broker-1/
+	AccessKey string        `yaml:"access-key" json:"access-key"` // the access key id, or the AWS_ACCESS_KEY_ID environment variable if empty
+	SecretKey string        `yaml:"secret-key" json:"-"`          // the secret access key, or the AWS_SECRET_ACCESS_KEY environment variable if empty
+	Timeout   time.Duration `yaml:"timeout" json:"timeout"`       // the timeout of uploads, defaults to 1 minute
+}
+
+// Hook uploads the snapshots of scheduled export jobs to a bucket of an object store,
+// addressing the bucket in the path of the endpoint and signing the requests with AWS
+// signature version 4, which Google Cloud Storage accepts with HMAC keys.
+type Hook struct {
+	mqtt.HookBase
+	config *Options
+	client *http.Client
+	now    func() time.Time // the time requests are signed at
+}
+
+// ID returns the ID of the hook.
+func (h *Hook) ID() string {
+	return "object-store"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *Hook) Provides(b byte) bool {
+	return false
+}
+
+// Init is called when the hook is initialized.
+func (h *Hook) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		return ErrNoBucket
+	}
+
+	h.config = config.(*Options)
+	if h.config.Endpoint == "" || h.config.Bucket == "" {
+		return ErrNoBucket
+	}
+
+	if h.config.AccessKey == "" {
+		h.config.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+
+	if h.config.SecretKey == "" {
+		h.config.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+
+	if h.config.AccessKey == "" || h.config.SecretKey == "" {
+		return ErrNoCredentials
+	}
+
+	if h.config.Region == "" {
+		h.config.Region = defaultRegion
+	}
+
+	if h.config.Timeout <= 0 {
+		h.config.Timeout = defaultTimeout
+	}
+
+	h.client = &http.Client{Timeout: h.config.Timeout}
+	h.now = time.Now
+	return nil
+}
+
+// StoreSnapshot uploads a gzip compressed snapshot to the bucket, named by the prefix
+// and the name.
+func (h *Hook) StoreSnapshot(name string, data []byte) error {
+	u := strings.TrimSuffix(h.config.Endpoint, "/") + (&url.URL{Path: "/" + h.config.Bucket + "/" + h.config.Prefix + name}).EscapedPath()
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/gzip")
+
+	sum := sha256.Sum256(data)
+	h.sign(req, hex.EncodeToString(sum[:]), h.now())
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	h.Log.Info("uploaded snapshot", "bucket", h.config.Bucket, "name", h.config.Prefix+name, "bytes", len(data))
+	return nil
+}
+
+// sign signs a request with AWS signature version 4, with the sha256 hash of its payload,
+// signing the host and every header of the request.
+func (h *Hook) sign(req *http.Request, payloadHash string, now time.Time) {
+	stamp := now.UTC().Format("20060102T150405Z")
+	date := stamp[:8]
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonical strings.Builder
+	for _, k := range names {
+		canonical.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	request := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonical.String(),
+		signed,
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(request))
+
+	scope := date + "/" + h.config.Region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+h.config.SecretKey), date)
+	for _, v := range []string{h.config.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, v)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		h.config.AccessKey, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+// hmacSHA256 returns the hmac-sha256 of data with a key.
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
@@ -0,0 +1,156 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package security
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt"
+)
+
+const (
+	defaultTimeout = 10 * time.Second
+	defaultBuffer  = 1024
+)
+
+var ErrNoWebhook = errors.New("no security event webhook configured")
+
+// Options contains configuration settings for the security event export.
+type Options struct {
+	Webhook string        `yaml:"webhook" json:"webhook"` // a url security events are posted to as json
+	Timeout time.Duration `yaml:"timeout" json:"timeout"` // the timeout of webhook requests, defaults to 10 seconds
+	Types   []string      `yaml:"types" json:"types"`     // the types of events exported, all types when empty
+	Buffer  int           `yaml:"buffer" json:"buffer"`   // events queued for the webhook before new events are dropped, defaults to 1024
+}
+
+// Hook posts the security events of the server, such as failed authentications, acl
+// denials, blacklist hits and bans, to a webhook, so that they can be collected by a
+// SIEM. Events are posted in the background, and dropped if the webhook falls behind.
+type Hook struct {
+	mqtt.HookBase
+	config  *Options
+	client  *http.Client
+	events  chan mqtt.SecurityEvent
+	dropped int64 // events dropped because the queue was full
+	wg      sync.WaitGroup
+}
+
+// ID returns the ID of the hook.
+func (h *Hook) ID() string {
+	return "security-events"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *Hook) Provides(b byte) bool {
+	return b == mqtt.OnSecurityEvent
+}
+
+// Init is called when the hook is initialized.
+func (h *Hook) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		return ErrNoWebhook
+	}
+
+	h.config = config.(*Options)
+	if h.config.Webhook == "" {
+		return ErrNoWebhook
+	}
+
+	if h.config.Timeout <= 0 {
+		h.config.Timeout = defaultTimeout
+	}
+
+	if h.config.Buffer <= 0 {
+		h.config.Buffer = defaultBuffer
+	}
+
+	h.client = &http.Client{Timeout: h.config.Timeout}
+	h.events = make(chan mqtt.SecurityEvent, h.config.Buffer)
+	h.wg.Add(1)
+	go h.run()
+	return nil
+}
+
+// Stop posts the queued events and stops the hook.
+func (h *Hook) Stop() error {
+	if h.events != nil {
+		close(h.events)
+		h.wg.Wait()
+		h.events = nil
+	}
+	return nil
+}
+
+// Dropped returns the number of events dropped because the webhook fell behind.
+func (h *Hook) Dropped() int64 {
+	return atomic.LoadInt64(&h.dropped)
+}
+
+// OnSecurityEvent queues a security event to be posted to the webhook.
+func (h *Hook) OnSecurityEvent(ev mqtt.SecurityEvent) {
+	if len(h.config.Types) > 0 && !slices.Contains(h.config.Types, ev.Type) {
+		return
+	}
+
+	select {
+	case h.events <- ev:
+	default:
+		if atomic.AddInt64(&h.dropped, 1) == 1 {
+			h.Log.Warn("security event webhook is falling behind, dropping events", "url", h.config.Webhook)
+		}
+	}
+}
+
+// run posts the queued events to the webhook until the hook is stopped.
+func (h *Hook) run() {
+	defer h.wg.Done()
+	for ev := range h.events {
+		if err := h.post(ev); err != nil {
+			h.Log.Error("failed to post security event", "error", err, "url", h.config.Webhook, "type", ev.Type)
+		}
+	}
+}
+
+// post sends an event to the webhook as json.
+func (h *Hook) post(ev mqtt.SecurityEvent) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.config.Webhook, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
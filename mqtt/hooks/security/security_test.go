@@ -0,0 +1,95 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package security
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+)
+
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func newHook(t *testing.T, opts *Options) *Hook {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(opts))
+	return h
+}
+
+func TestID(t *testing.T) {
+	h := new(Hook)
+	require.Equal(t, "security-events", h.ID())
+}
+
+func TestProvides(t *testing.T) {
+	h := new(Hook)
+	require.True(t, h.Provides(mqtt.OnSecurityEvent))
+	require.False(t, h.Provides(mqtt.OnPublished))
+}
+
+func TestInitBadConfig(t *testing.T) {
+	h := new(Hook)
+	require.ErrorIs(t, h.Init(map[string]any{}), mqtt.ErrInvalidConfigType)
+	require.ErrorIs(t, h.Init(nil), ErrNoWebhook)
+	require.ErrorIs(t, h.Init(&Options{}), ErrNoWebhook)
+}
+
+func TestOnSecurityEventWebhook(t *testing.T) {
+	received := make(chan mqtt.SecurityEvent, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+
+		var ev mqtt.SecurityEvent
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&ev))
+		received <- ev
+	}))
+	defer srv.Close()
+
+	h := newHook(t, &Options{Webhook: srv.URL, Types: []string{mqtt.SecurityAuthFailure, mqtt.SecurityBanned}})
+	h.OnSecurityEvent(mqtt.SecurityEvent{Type: mqtt.SecurityACLDenied, ClientID: "c1", Topic: "a/b", Timestamp: 100})
+	h.OnSecurityEvent(mqtt.SecurityEvent{Type: mqtt.SecurityAuthFailure, ClientID: "c1", Username: "alice", Timestamp: 101})
+	h.OnSecurityEvent(mqtt.SecurityEvent{Type: mqtt.SecurityBanned, Kind: "ip", Value: "10.0.0.1", Duration: 60, Timestamp: 102})
+	require.NoError(t, h.Stop())
+
+	require.Len(t, received, 2)
+	require.Equal(t, mqtt.SecurityEvent{Type: mqtt.SecurityAuthFailure, ClientID: "c1", Username: "alice", Timestamp: 101}, <-received)
+	require.Equal(t, mqtt.SecurityEvent{Type: mqtt.SecurityBanned, Kind: "ip", Value: "10.0.0.1", Duration: 60, Timestamp: 102}, <-received)
+}
+
+func TestOnSecurityEventDropped(t *testing.T) {
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer srv.Close()
+
+	h := newHook(t, &Options{Webhook: srv.URL, Buffer: 1})
+	for i := 0; i < 5; i++ {
+		h.OnSecurityEvent(mqtt.SecurityEvent{Type: mqtt.SecurityAuthFailure})
+	}
+	require.Positive(t, h.Dropped())
+
+	close(block)
+	require.NoError(t, h.Stop())
+}
+
+func TestOnSecurityEventWebhookError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	h := newHook(t, &Options{Webhook: srv.URL})
+	require.Error(t, h.post(mqtt.SecurityEvent{Type: mqtt.SecurityAuthFailure}))
+	require.NoError(t, h.Stop())
+}
@@ -9,18 +9,28 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/wind-c/comqtt/v2/mqtt"
 	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
 	"github.com/wind-c/comqtt/v2/mqtt/packets"
 	"github.com/wind-c/comqtt/v2/mqtt/system"
 
+	"github.com/dgraph-io/badger"
 	"github.com/timshannon/badgerhold"
 )
 
 const (
 	// defaultDbFile is the default file path for the badger db file.
 	defaultDbFile = ".badger"
+
+	// defaultGcInterval is the default time between value log garbage collections.
+	defaultGcInterval = 5 * time.Minute
+
+	// defaultGcDiscardRatio is the default fraction of a value log file which must be
+	// discardable for the garbage collection to rewrite it.
+	defaultGcDiscardRatio = 0.5
 )
 
 // clientKey returns a primary key for a client.
@@ -52,13 +62,48 @@ func sysInfoKey() string {
 type Options struct {
 	Options *badgerhold.Options
 	Path    string
+	Expiry  storage.Expiry // the ages after which stored records are deleted
+
+	// GcInterval is how often the value log is garbage collected, reclaiming the disk space
+	// of deleted and overwritten records. It is defaultGcInterval if 0, and never if negative.
+	GcInterval time.Duration
+
+	// GcDiscardRatio is the fraction of a value log file which must be discardable for the
+	// garbage collection to rewrite it, defaultGcDiscardRatio if 0.
+	GcDiscardRatio float64
+
+	// The tuning options below override those of Options, or the badger defaults, if set.
+	MaxTableSize     int64 // the size of each memtable and of the tables they are flushed to
+	NumMemtables     int   // the memtables held in memory before writes wait for them to be flushed
+	NumCompactors    int   // the goroutines compacting the tables
+	ValueLogFileSize int64 // the size of each value log file, the unit the garbage collection reclaims
+	ValueThreshold   int   // values of at least this many bytes are kept in the value log instead of the tables
+
+	// WriteBehind buffers the writes of the hook, applying them in batches of one transaction.
+	WriteBehind storage.WriteBehind
+
+	// Encryption encrypts the records written by the hook with AES-GCM. Their keys are not
+	// encrypted, as badgerhold encodes keys with the same encoder and must find them again.
+	Encryption storage.Encryption
+}
+
+// write is a write buffered in write-behind mode, upserting or deleting a record.
+type write struct {
+	key    string // the key of the record
+	data   any    // the record to upsert, or a record of the type to delete
+	delete bool   // delete the record instead of upserting it
 }
 
 // Hook is a persistent storage hook based using BadgerDB file store as a backend.
 type Hook struct {
 	mqtt.HookBase
-	config *Options          // options for configuring the BadgerDB instance.
-	db     *badgerhold.Store // the BadgerDB instance.
+	config  *Options               // options for configuring the BadgerDB instance.
+	db      *badgerhold.Store      // the BadgerDB instance.
+	cancel  chan struct{}          // stops the garbage collection and the deleting of expired records
+	wg      sync.WaitGroup         // the background goroutines, which must end before the instance is closed
+	buffer  *storage.Buffer[write] // the buffered writes in write-behind mode
+	cipher  *storage.Cipher        // seals and opens the records if encryption is enabled
+	metrics mqtt.StorageRecorder   // counts the writes and reads of the hook
 }
 
 // ID returns the id of the hook.
@@ -103,26 +148,246 @@ func (h *Hook) Init(config any) error {
 	if h.config.Path == "" {
 		h.config.Path = defaultDbFile
 	}
+	if h.config.GcInterval == 0 {
+		h.config.GcInterval = defaultGcInterval
+	}
+	if h.config.GcDiscardRatio == 0 {
+		h.config.GcDiscardRatio = defaultGcDiscardRatio
+	}
+
+	var err error
+	if h.config.Encryption.Enabled() {
+		h.cipher, err = storage.NewCipher(h.config.Encryption)
+		if err != nil {
+			return err
+		}
+	}
+
+	h.db, err = badgerhold.Open(h.options())
+	if err != nil {
+		return err
+	}
 
+	h.cancel = make(chan struct{})
+	if h.config.GcInterval > 0 {
+		h.wg.Add(1)
+		go h.collectValueLog(h.config.GcInterval, h.cancel)
+	}
+	if h.config.Expiry.Enabled() {
+		h.wg.Add(1)
+		go h.gc(h.config.Expiry.GcInterval(), h.cancel)
+	}
+
+	if h.config.WriteBehind.Enabled {
+		h.buffer = storage.NewBuffer(h.config.WriteBehind, h.applyWrites)
+	}
+
+	return nil
+}
+
+// options returns the options the badger instance is opened with.
+func (h *Hook) options() badgerhold.Options {
 	options := badgerhold.DefaultOptions
+	if h.config.Options != nil {
+		options = *h.config.Options
+		if options.Encoder == nil || options.Decoder == nil {
+			options.Encoder, options.Decoder = badgerhold.DefaultEncode, badgerhold.DefaultDecode
+		}
+	}
+
 	options.Dir = h.config.Path
 	options.ValueDir = h.config.Path
 	options.Logger = h
+	if h.config.MaxTableSize > 0 {
+		options.MaxTableSize = h.config.MaxTableSize
+	}
+	if h.config.NumMemtables > 0 {
+		options.NumMemtables = h.config.NumMemtables
+	}
+	if h.config.NumCompactors > 0 {
+		options.NumCompactors = h.config.NumCompactors
+	}
+	if h.config.ValueLogFileSize > 0 {
+		options.ValueLogFileSize = h.config.ValueLogFileSize
+	}
+	if h.config.ValueThreshold > 0 {
+		options.ValueThreshold = h.config.ValueThreshold
+	}
+	if h.cipher != nil {
+		options.Encoder, options.Decoder = h.sealed(options.Encoder, options.Decoder)
+	}
 
-	var err error
-	h.db, err = badgerhold.Open(options)
-	if err != nil {
-		return err
+	return options
+}
+
+// sealed returns an encoder and decoder which encrypt the records encoded by encode,
+// leaving the string keys of the records, which must encode the same each time, as they are.
+func (h *Hook) sealed(encode badgerhold.EncodeFunc, decode badgerhold.DecodeFunc) (badgerhold.EncodeFunc, badgerhold.DecodeFunc) {
+	sealedEncode := func(value any) ([]byte, error) {
+		b, err := encode(value)
+		if _, ok := value.(string); ok || err != nil {
+			return b, err
+		}
+		return h.cipher.Seal(b)
 	}
 
-	return nil
+	sealedDecode := func(data []byte, value any) error {
+		b, err := h.cipher.Open(data)
+		if err != nil {
+			return err
+		}
+		return decode(b, value)
+	}
+
+	return sealedEncode, sealedDecode
 }
 
-// Stop closes the badger instance.
+// Stop closes the badger instance once its background goroutines have ended and any
+// buffered writes have been applied.
 func (h *Hook) Stop() error {
+	if h.cancel != nil {
+		close(h.cancel)
+		h.cancel = nil
+	}
+	h.wg.Wait()
+
+	if h.buffer != nil {
+		h.buffer.Stop()
+		h.buffer = nil
+	}
+
 	return h.db.Close()
 }
 
+// Healthy returns an error if the badger instance is not open for reading.
+func (h *Hook) Healthy() error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	return h.db.Badger().View(func(txn *badger.Txn) error {
+		return nil
+	})
+}
+
+// StorageMetrics returns the writes and reads of the hook, the writes buffered in
+// write-behind mode and the size of the lsm tree and value log.
+func (h *Hook) StorageMetrics() mqtt.StorageMetrics {
+	var pending int
+	if h.buffer != nil {
+		pending = h.buffer.Len()
+	}
+
+	var size int64
+	if h.db != nil {
+		lsm, vlog := h.db.Badger().Size()
+		size = lsm + vlog
+	}
+
+	return h.metrics.Metrics(h.ID(), pending, size)
+}
+
+// Compact runs value log garbage collection until no more log files can be rewritten.
+func (h *Hook) Compact() error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	for {
+		err := h.db.Badger().RunValueLogGC(h.config.GcDiscardRatio)
+		if errors.Is(err, badger.ErrNoRewrite) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// upsert writes a record to the store, or buffers the write in write-behind mode.
+func (h *Hook) upsert(key string, data any) error {
+	start := time.Now()
+	if h.buffer != nil {
+		h.buffer.Add(write{key: key, data: data})
+		h.metrics.Write(start, nil)
+		return nil
+	}
+
+	err := h.db.Upsert(key, data)
+	h.metrics.Write(start, err)
+	return err
+}
+
+// delete deletes a record from the store, or buffers the delete in write-behind mode.
+func (h *Hook) delete(key string, dataType any) error {
+	start := time.Now()
+	if h.buffer != nil {
+		h.buffer.Add(write{key: key, data: dataType, delete: true})
+		h.metrics.Write(start, nil)
+		return nil
+	}
+
+	err := h.db.Delete(key, dataType)
+	h.metrics.Write(start, notFound(err))
+	return err
+}
+
+// find reads the records matching a query from the store.
+func (h *Hook) find(result any, query *badgerhold.Query) error {
+	start := time.Now()
+	err := h.db.Find(result, query)
+	h.metrics.Read(start, notFound(err))
+	return err
+}
+
+// notFound returns nil if err is badgerhold.ErrNotFound, which is not a failure of the store.
+func notFound(err error) error {
+	if errors.Is(err, badgerhold.ErrNotFound) {
+		return nil
+	}
+
+	return err
+}
+
+// applyWrites applies a batch of buffered writes in one transaction, or in several if the
+// batch is too big for badger to commit at once.
+func (h *Hook) applyWrites(batch []write) {
+	tx := h.db.Badger().NewTransaction(true)
+	defer func() { tx.Discard() }()
+
+	var n int // the writes in the transaction
+	for _, w := range batch {
+		err := h.applyWrite(tx, w)
+		if errors.Is(err, badger.ErrTxnTooBig) {
+			if err = tx.Commit(); err != nil {
+				h.metrics.WriteFailed(n)
+				h.Log.Error("failed to apply buffered writes", "error", err)
+			}
+			tx, n = h.db.Badger().NewTransaction(true), 0
+			err = h.applyWrite(tx, w)
+		}
+		if err != nil && !errors.Is(err, badgerhold.ErrNotFound) {
+			h.metrics.WriteFailed(1)
+			h.Log.Error("failed to apply buffered write", "error", err, "key", w.key)
+		} else if err == nil {
+			n++
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		h.metrics.WriteFailed(n)
+		h.Log.Error("failed to apply buffered writes", "error", err)
+	}
+}
+
+// applyWrite applies a buffered write in a transaction.
+func (h *Hook) applyWrite(tx *badger.Txn, w write) error {
+	if w.delete {
+		return h.db.TxDelete(tx, w.key, w.data)
+	}
+
+	return h.db.TxUpsert(tx, w.key, w.data)
+}
+
 // OnSessionEstablished adds a client to the store when their session is established.
 func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
 	h.updateClient(cl)
@@ -162,31 +427,35 @@ func (h *Hook) updateClient(cl *mqtt.Client) {
 		},
 		Will: storage.ClientWill(cl.Properties.Will),
 	}
+	if cl.Closed() {
+		in.Disconnected = time.Now().Unix()
+		in.Expires = cl.SessionExpiry()
+	}
 
-	err := h.db.Upsert(in.ID, in)
+	err := h.upsert(in.ID, in)
 	if err != nil {
 		h.Log.Error("failed to upsert client data", "error", err, "data", in)
 	}
 }
 
-// OnDisconnect removes a client from the store if their session has expired.
+// OnDisconnect removes a client from the store if their session has expired, or records
+// the time they disconnected otherwise.
 func (h *Hook) OnDisconnect(cl *mqtt.Client, _ error, expire bool) {
 	if h.db == nil {
 		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
 		return
 	}
 
-	h.updateClient(cl)
-
-	if !expire {
+	if cl.StopCause() == packets.ErrSessionTakenOver {
 		return
 	}
 
-	if cl.StopCause() == packets.ErrSessionTakenOver {
+	if !expire {
+		h.updateClient(cl)
 		return
 	}
 
-	err := h.db.Delete(clientKey(cl), new(storage.Client))
+	err := h.delete(clientKey(cl), new(storage.Client))
 	if err != nil {
 		h.Log.Error("failed to delete client data", "error", err, "data", clientKey(cl))
 	}
@@ -215,7 +484,7 @@ func (h *Hook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []by
 			in.RetainAsPublished = pk.Filters[i].RetainAsPublished
 		}
 
-		err := h.db.Upsert(in.ID, in)
+		err := h.upsert(in.ID, in)
 		if err != nil {
 			h.Log.Error("failed to upsert subscription data", "error", err, "data", in)
 		}
@@ -230,7 +499,7 @@ func (h *Hook) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []
 	}
 
 	for i := 0; i < len(pk.Filters); i++ {
-		err := h.db.Delete(subscriptionKey(cl, pk.Filters[i].Filter), new(storage.Subscription))
+		err := h.delete(subscriptionKey(cl, pk.Filters[i].Filter), new(storage.Subscription))
 		if err != nil {
 			h.Log.Error("failed to delete subscription data", "error", err, "data", subscriptionKey(cl, pk.Filters[i].Filter))
 		}
@@ -245,7 +514,7 @@ func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
 	}
 
 	if r == -1 {
-		err := h.db.Delete(retainedKey(pk.TopicName), new(storage.Message))
+		err := h.delete(retainedKey(pk.TopicName), new(storage.Message))
 		if err != nil {
 			h.Log.Error("failed to delete retained message data", "error", err, "data", retainedKey(pk.TopicName))
 		}
@@ -274,7 +543,7 @@ func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
 		},
 	}
 
-	err := h.db.Upsert(in.ID, in)
+	err := h.upsert(in.ID, in)
 	if err != nil {
 		h.Log.Error("failed to upsert retained message data", "error", err, "data", in)
 	}
@@ -292,6 +561,7 @@ func (h *Hook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, rese
 		ID:          inflightKey(cl, pk),
 		T:           storage.InflightKey,
 		Origin:      pk.Origin,
+		Client:      cl.ID,
 		PacketID:    pk.PacketID,
 		FixedHeader: pk.FixedHeader,
 		TopicName:   pk.TopicName,
@@ -310,7 +580,7 @@ func (h *Hook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, rese
 		},
 	}
 
-	err := h.db.Upsert(in.ID, in)
+	err := h.upsert(in.ID, in)
 	if err != nil {
 		h.Log.Error("failed to upsert qos inflight data", "error", err, "data", in)
 	}
@@ -323,7 +593,7 @@ func (h *Hook) OnQosComplete(cl *mqtt.Client, pk packets.Packet) {
 		return
 	}
 
-	err := h.db.Delete(inflightKey(cl, pk), new(storage.Message))
+	err := h.delete(inflightKey(cl, pk), new(storage.Message))
 	if err != nil {
 		h.Log.Error("failed to delete inflight message data", "error", err, "data", inflightKey(cl, pk))
 	}
@@ -351,7 +621,7 @@ func (h *Hook) OnSysInfoTick(sys *system.Info) {
 		Info: *sys.Clone(),
 	}
 
-	err := h.db.Upsert(in.ID, in)
+	err := h.upsert(in.ID, in)
 	if err != nil {
 		h.Log.Error("failed to upsert $SYS data", "error", err, "data", in)
 	}
@@ -364,7 +634,7 @@ func (h *Hook) OnRetainedExpired(filter string) {
 		return
 	}
 
-	err := h.db.Delete(retainedKey(filter), new(storage.Message))
+	err := h.delete(retainedKey(filter), new(storage.Message))
 	if err != nil {
 		h.Log.Error("failed to delete expired retained message data", "error", err, "id", retainedKey(filter))
 	}
@@ -377,7 +647,7 @@ func (h *Hook) OnClientExpired(cl *mqtt.Client) {
 		return
 	}
 
-	err := h.db.Delete(clientKey(cl), new(storage.Client))
+	err := h.delete(clientKey(cl), new(storage.Client))
 	if err != nil {
 		h.Log.Error("failed to delete expired client data", "error", err, "id", clientKey(cl))
 	}
@@ -390,7 +660,7 @@ func (h *Hook) StoredClients() (v []storage.Client, err error) {
 		return
 	}
 
-	err = h.db.Find(&v, badgerhold.Where("T").Eq(storage.ClientKey))
+	err = h.find(&v, badgerhold.Where("T").Eq(storage.ClientKey))
 	if err != nil && !errors.Is(err, badgerhold.ErrNotFound) {
 		return
 	}
@@ -405,7 +675,7 @@ func (h *Hook) StoredSubscriptions() (v []storage.Subscription, err error) {
 		return
 	}
 
-	err = h.db.Find(&v, badgerhold.Where("T").Eq(storage.SubscriptionKey))
+	err = h.find(&v, badgerhold.Where("T").Eq(storage.SubscriptionKey))
 	if err != nil && !errors.Is(err, badgerhold.ErrNotFound) {
 		return
 	}
@@ -420,7 +690,7 @@ func (h *Hook) StoredRetainedMessages() (v []storage.Message, err error) {
 		return
 	}
 
-	err = h.db.Find(&v, badgerhold.Where("T").Eq(storage.RetainedKey))
+	err = h.find(&v, badgerhold.Where("T").Eq(storage.RetainedKey))
 	if err != nil && !errors.Is(err, badgerhold.ErrNotFound) {
 		return
 	}
@@ -435,7 +705,7 @@ func (h *Hook) StoredInflightMessages() (v []storage.Message, err error) {
 		return
 	}
 
-	err = h.db.Find(&v, badgerhold.Where("T").Eq(storage.InflightKey))
+	err = h.find(&v, badgerhold.Where("T").Eq(storage.InflightKey))
 	if err != nil && !errors.Is(err, badgerhold.ErrNotFound) {
 		return
 	}
@@ -443,6 +713,46 @@ func (h *Hook) StoredInflightMessages() (v []storage.Message, err error) {
 	return v, nil
 }
 
+// StoredRetainedMessage returns the stored retained message of a topic, and false if there is none.
+func (h *Hook) StoredRetainedMessage(topic string) (v storage.Message, ok bool, err error) {
+	if h.db == nil {
+		return v, false, storage.ErrDBFileNotOpen
+	}
+
+	if h.buffer != nil {
+		h.buffer.Flush()
+	}
+
+	start := time.Now()
+	err = h.db.Get(retainedKey(topic), &v)
+	h.metrics.Read(start, notFound(err))
+	if errors.Is(err, badgerhold.ErrNotFound) {
+		return v, false, nil
+	} else if err != nil {
+		return v, false, err
+	}
+
+	return v, true, nil
+}
+
+// StoredClientInflightMessages returns the stored inflight messages of a client.
+func (h *Hook) StoredClientInflightMessages(cid string) (v []storage.Message, err error) {
+	if h.db == nil {
+		return nil, storage.ErrDBFileNotOpen
+	}
+
+	if h.buffer != nil {
+		h.buffer.Flush()
+	}
+
+	err = h.find(&v, badgerhold.Where("T").Eq(storage.InflightKey).And("Client").Eq(cid))
+	if err != nil && !errors.Is(err, badgerhold.ErrNotFound) {
+		return nil, err
+	}
+
+	return v, nil
+}
+
 // StoredSysInfo returns the system info from the store.
 func (h *Hook) StoredSysInfo() (v storage.SystemInfo, err error) {
 	if h.db == nil {
@@ -450,7 +760,9 @@ func (h *Hook) StoredSysInfo() (v storage.SystemInfo, err error) {
 		return
 	}
 
+	start := time.Now()
 	err = h.db.Get(storage.SysInfoKey, &v)
+	h.metrics.Read(start, notFound(err))
 	if err != nil && !errors.Is(err, badgerhold.ErrNotFound) {
 		return
 	}
@@ -458,6 +770,106 @@ func (h *Hook) StoredSysInfo() (v storage.SystemInfo, err error) {
 	return v, nil
 }
 
+// collectValueLog garbage collects the value log at an interval until cancelled.
+func (h *Hook) collectValueLog(interval time.Duration, cancel chan struct{}) {
+	defer h.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cancel:
+			return
+		case <-ticker.C:
+			err := h.Compact()
+			if errors.Is(err, badger.ErrRejected) { // a compact job is already collecting it
+				continue
+			}
+			if err != nil {
+				h.Log.Error("failed to garbage collect value log", "error", err)
+			}
+		}
+	}
+}
+
+// gc deletes expired records at an interval until cancelled.
+func (h *Hook) gc(interval time.Duration, cancel chan struct{}) {
+	defer h.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cancel:
+			return
+		case <-ticker.C:
+			if err := h.clearExpired(time.Now()); err != nil {
+				h.Log.Error("failed to delete expired records", "error", err)
+			}
+		}
+	}
+}
+
+// clearExpired deletes the retained messages, inflight messages and sessions which are
+// older than their expiry, each session together with its subscriptions and inflight messages.
+func (h *Hook) clearExpired(now time.Time) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	if cutoff := storage.Cutoff(h.config.Expiry.Retained, now); cutoff > 0 {
+		err := h.db.DeleteMatching(new(storage.Message), badgerhold.Where("T").Eq(storage.RetainedKey).And("Created").Lt(cutoff))
+		if err != nil {
+			return err
+		}
+	}
+
+	if cutoff := storage.Cutoff(h.config.Expiry.Inflight, now); cutoff > 0 {
+		err := h.db.DeleteMatching(new(storage.Message), badgerhold.Where("T").Eq(storage.InflightKey).And("Created").Lt(cutoff))
+		if err != nil {
+			return err
+		}
+	}
+
+	var sessions *badgerhold.Query
+	if cutoff := storage.Cutoff(h.config.Expiry.Session, now); cutoff > 0 {
+		sessions = badgerhold.Where("Disconnected").Gt(int64(0)).And("Disconnected").Lt(cutoff)
+	}
+	if h.config.Expiry.SessionInterval {
+		elapsed := badgerhold.Where("Expires").Gt(int64(0)).And("Expires").Lt(now.Unix())
+		if sessions == nil {
+			sessions = elapsed
+		} else {
+			sessions = sessions.Or(elapsed)
+		}
+	}
+
+	if sessions != nil {
+		var clients []storage.Client
+		err := h.db.Find(&clients, sessions)
+		if err != nil && !errors.Is(err, badgerhold.ErrNotFound) {
+			return err
+		}
+
+		for _, c := range clients {
+			err = h.db.Badger().Update(func(tx *badger.Txn) error {
+				if err := h.db.TxDelete(tx, c.ID, new(storage.Client)); err != nil {
+					return err
+				}
+				if err := h.db.TxDeleteMatching(tx, new(storage.Subscription), badgerhold.Where("Client").Eq(c.ID)); err != nil {
+					return err
+				}
+				return h.db.TxDeleteMatching(tx, new(storage.Message), badgerhold.Where("T").Eq(storage.InflightKey).And("Client").Eq(c.ID))
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
 // Errorf satisfies the badger interface for an error logger.
 func (h *Hook) Errorf(m string, v ...interface{}) {
 	h.Log.Error(fmt.Sprintf(strings.ToLower(strings.Trim(m, "\n")), v...), "v", v)
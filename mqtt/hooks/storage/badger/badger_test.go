@@ -5,12 +5,14 @@
 package badger
 
 import (
+	"bytes"
 	"log/slog"
 	"os"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/dgraph-io/badger"
 	"github.com/stretchr/testify/require"
 	"github.com/timshannon/badgerhold"
 	"github.com/wind-c/comqtt/v2/mqtt"
@@ -109,6 +111,87 @@ func TestInitUseDefaults(t *testing.T) {
 	defer teardown(t, h.config.Path, h)
 
 	require.Equal(t, defaultDbFile, h.config.Path)
+	require.Equal(t, defaultGcInterval, h.config.GcInterval)
+	require.Equal(t, defaultGcDiscardRatio, h.config.GcDiscardRatio)
+}
+
+func TestOptions(t *testing.T) {
+	h := new(Hook)
+	h.config = &Options{Path: "test"}
+	o := h.options()
+	require.Equal(t, "test", o.Dir)
+	require.Equal(t, "test", o.ValueDir)
+	require.Equal(t, badgerhold.DefaultOptions.MaxTableSize, o.MaxTableSize)
+	require.NotNil(t, o.Encoder)
+
+	base := badgerhold.Options{Options: badger.DefaultOptions("")}
+	base.SyncWrites = false
+	h.config = &Options{
+		Options:          &base,
+		Path:             "test",
+		MaxTableSize:     8 << 20,
+		NumMemtables:     2,
+		NumCompactors:    1,
+		ValueLogFileSize: 64 << 20,
+		ValueThreshold:   1024,
+	}
+	o = h.options()
+	require.False(t, o.SyncWrites)
+	require.NotNil(t, o.Encoder)
+	require.NotNil(t, o.Decoder)
+	require.Equal(t, int64(8<<20), o.MaxTableSize)
+	require.Equal(t, 2, o.NumMemtables)
+	require.Equal(t, 1, o.NumCompactors)
+	require.Equal(t, int64(64<<20), o.ValueLogFileSize)
+	require.Equal(t, 1024, o.ValueThreshold)
+}
+
+func TestInitGcDisabled(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{GcInterval: -1})
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	require.Equal(t, time.Duration(-1), h.config.GcInterval)
+}
+
+func TestCollectValueLog(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{GcInterval: time.Millisecond})
+	require.NoError(t, err)
+
+	time.Sleep(10 * time.Millisecond)
+	teardown(t, h.config.Path, h)
+}
+
+func TestCompact(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	require.NoError(t, h.Compact())
+}
+
+func TestCompactNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.ErrorIs(t, h.Compact(), storage.ErrDBFileNotOpen)
+}
+
+func TestHealthy(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.ErrorIs(t, h.Healthy(), storage.ErrDBFileNotOpen)
+
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	require.NoError(t, h.Healthy())
 }
 
 func TestOnSessionEstablishedThenOnDisconnect(t *testing.T) {
@@ -144,6 +227,204 @@ func TestOnSessionEstablishedThenOnDisconnect(t *testing.T) {
 	require.Empty(t, r3.ID)
 }
 
+func TestOnDisconnectRecordsTime(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	h.OnDisconnect(client, nil, false)
+	r := new(storage.Client)
+	err = h.db.Get(clientKey(client), r)
+	require.NoError(t, err)
+	require.InDelta(t, time.Now().Unix(), r.Disconnected, 1)
+	require.Zero(t, r.Expires)
+
+	cl := &mqtt.Client{ID: "expiring", Properties: mqtt.ClientProperties{ProtocolVersion: 5}}
+	cl.Properties.Props.SessionExpiryInterval = 60
+	cl.Properties.Props.SessionExpiryIntervalFlag = true
+	cl.Stop(nil)
+	h.OnDisconnect(cl, nil, false)
+	r = new(storage.Client)
+	err = h.db.Get(clientKey(cl), r)
+	require.NoError(t, err)
+	require.InDelta(t, time.Now().Unix()+60, r.Expires, 1)
+}
+
+func TestInitExpiry(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{Expiry: storage.Expiry{Session: time.Hour}})
+	require.NoError(t, err)
+	require.NotNil(t, h.cancel)
+
+	teardown(t, h.config.Path, h)
+	require.Nil(t, h.cancel)
+}
+
+func TestClearExpired(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{Expiry: storage.Expiry{Retained: time.Hour, Inflight: time.Minute, Session: time.Hour}})
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	now := time.Now()
+	old := now.Add(-2 * time.Hour).Unix()
+	require.NoError(t, h.db.Upsert("cl1", &storage.Client{ID: "cl1", T: storage.ClientKey, Disconnected: old}))
+	require.NoError(t, h.db.Upsert("cl2", &storage.Client{ID: "cl2", T: storage.ClientKey, Disconnected: now.Unix()}))
+	require.NoError(t, h.db.Upsert("cl3", &storage.Client{ID: "cl3", T: storage.ClientKey}))
+	require.NoError(t, h.db.Upsert("sub_cl1:a/b", &storage.Subscription{ID: "sub_cl1:a/b", T: storage.SubscriptionKey, Client: "cl1", Filter: "a/b"}))
+	require.NoError(t, h.db.Upsert("sub_cl2:a/b", &storage.Subscription{ID: "sub_cl2:a/b", T: storage.SubscriptionKey, Client: "cl2", Filter: "a/b"}))
+	require.NoError(t, h.db.Upsert("ifm_cl1:1", &storage.Message{ID: "ifm_cl1:1", T: storage.InflightKey, Client: "cl1", Created: now.Unix()}))
+	require.NoError(t, h.db.Upsert("ifm_cl2:1", &storage.Message{ID: "ifm_cl2:1", T: storage.InflightKey, Client: "cl2", Created: now.Add(-time.Hour).Unix()}))
+	require.NoError(t, h.db.Upsert("ifm_cl2:2", &storage.Message{ID: "ifm_cl2:2", T: storage.InflightKey, Client: "cl2", Created: now.Unix()}))
+	require.NoError(t, h.db.Upsert("ret_a/b", &storage.Message{ID: "ret_a/b", T: storage.RetainedKey, Created: old}))
+	require.NoError(t, h.db.Upsert("ret_a/c", &storage.Message{ID: "ret_a/c", T: storage.RetainedKey, Created: now.Unix()}))
+
+	err = h.clearExpired(now)
+	require.NoError(t, err)
+
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 2)
+	require.Equal(t, "cl2", clients[0].ID)
+	require.Equal(t, "cl3", clients[1].ID)
+
+	subs, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+	require.Equal(t, "sub_cl2:a/b", subs[0].ID)
+
+	inflight, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, inflight, 1)
+	require.Equal(t, "ifm_cl2:2", inflight[0].ID)
+
+	retained, err := h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, retained, 1)
+	require.Equal(t, "ret_a/c", retained[0].ID)
+}
+
+func TestClearExpiredSessionInterval(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{Expiry: storage.Expiry{SessionInterval: true}})
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	now := time.Now()
+	require.NoError(t, h.db.Upsert("cl1", &storage.Client{ID: "cl1", T: storage.ClientKey, Disconnected: now.Unix() - 60, Expires: now.Unix() - 30}))
+	require.NoError(t, h.db.Upsert("cl2", &storage.Client{ID: "cl2", T: storage.ClientKey, Disconnected: now.Unix() - 60, Expires: now.Unix() + 30}))
+	require.NoError(t, h.db.Upsert("cl3", &storage.Client{ID: "cl3", T: storage.ClientKey, Disconnected: now.Unix() - 60}))
+	require.NoError(t, h.db.Upsert("sub_cl1:a/b", &storage.Subscription{ID: "sub_cl1:a/b", T: storage.SubscriptionKey, Client: "cl1", Filter: "a/b"}))
+	require.NoError(t, h.db.Upsert("ifm_cl1:1", &storage.Message{ID: "ifm_cl1:1", T: storage.InflightKey, Client: "cl1", Created: now.Unix()}))
+
+	err = h.clearExpired(now)
+	require.NoError(t, err)
+
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 2)
+	require.Equal(t, "cl2", clients[0].ID)
+	require.Equal(t, "cl3", clients[1].ID)
+
+	subs, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Empty(t, subs)
+
+	inflight, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Empty(t, inflight)
+}
+
+func TestClearExpiredNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.clearExpired(time.Now())
+	require.ErrorIs(t, err, storage.ErrDBFileNotOpen)
+}
+
+func TestWriteBehind(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{WriteBehind: storage.WriteBehind{Enabled: true, Interval: time.Hour}})
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+	require.NotNil(t, h.buffer)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnSubscribed(client, pkf, []byte{0}, []int{1})
+	require.Equal(t, 2, h.buffer.Len())
+
+	r := new(storage.Client)
+	err = h.db.Get(clientKey(client), r)
+	require.ErrorIs(t, err, badgerhold.ErrNotFound)
+
+	h.buffer.Flush()
+	err = h.db.Get(clientKey(client), r)
+	require.NoError(t, err)
+	require.Equal(t, client.ID, r.ID)
+
+	subs, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+
+	h.OnUnsubscribed(client, pkf, []byte{0}, []int{0})
+	h.OnUnsubscribed(client, pkf, []byte{0}, []int{0}) // deleting a missing record is not an error
+	h.buffer.Flush()
+	subs, err = h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Empty(t, subs)
+}
+
+func TestWriteBehindStopFlushes(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{WriteBehind: storage.WriteBehind{Enabled: true, Interval: time.Hour}})
+	require.NoError(t, err)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	require.NoError(t, h.Stop())
+	require.Nil(t, h.buffer)
+
+	err = h.Init(&Options{})
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+}
+
+func TestStorageMetrics(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{WriteBehind: storage.WriteBehind{Enabled: true, Interval: time.Hour}})
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnSubscribed(client, pkf, []byte{0}, []int{1})
+	m := h.StorageMetrics()
+	require.Equal(t, h.ID(), m.ID)
+	require.Equal(t, int64(2), m.Writes)
+	require.Equal(t, int64(2), m.Pending)
+
+	h.buffer.Flush()
+	_, err = h.StoredClients()
+	require.NoError(t, err)
+	_, err = h.StoredSysInfo() // a missing record is not a failed read
+	require.NoError(t, err)
+	m = h.StorageMetrics()
+	require.Equal(t, int64(0), m.Pending)
+	require.Equal(t, int64(2), m.Reads)
+	require.Equal(t, int64(0), m.ReadErrors)
+	require.Equal(t, int64(0), m.WriteErrors)
+}
+
 func TestOnClientExpired(t *testing.T) {
 	h := new(Hook)
 	h.SetOpts(logger, nil)
@@ -637,6 +918,60 @@ func TestStoredInflightMessages(t *testing.T) {
 	require.Equal(t, "i3", r[2].ID)
 }
 
+func TestStoredRetainedMessage(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{WriteBehind: storage.WriteBehind{Enabled: true, Interval: time.Hour}})
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("hello")}, 1)
+
+	// the buffered write is flushed before reading
+	m, ok, err := h.StoredRetainedMessage("a/b/c")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, []byte("hello"), m.Payload)
+
+	_, ok, err = h.StoredRetainedMessage("d/e/f")
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestStoredClientInflightMessages(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{WriteBehind: storage.WriteBehind{Enabled: true, Interval: time.Hour}})
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	h.OnQosPublish(client, packets.Packet{PacketID: 1, TopicName: "a/b/c", Payload: []byte("1")}, 0, 0)
+	h.OnQosPublish(client, packets.Packet{PacketID: 2, TopicName: "a/b/c", Payload: []byte("2")}, 0, 0)
+	h.OnQosPublish(&mqtt.Client{ID: "test2"}, packets.Packet{PacketID: 1, TopicName: "a/b/c"}, 0, 0)
+
+	r, err := h.StoredClientInflightMessages(client.ID)
+	require.NoError(t, err)
+	require.Len(t, r, 2)
+	for _, m := range r {
+		require.Equal(t, client.ID, m.Client)
+	}
+
+	r, err = h.StoredClientInflightMessages("other")
+	require.NoError(t, err)
+	require.Empty(t, r)
+}
+
+func TestStoredColdNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	_, ok, err := h.StoredRetainedMessage("a/b/c")
+	require.False(t, ok)
+	require.ErrorIs(t, err, storage.ErrDBFileNotOpen)
+
+	_, err = h.StoredClientInflightMessages(client.ID)
+	require.ErrorIs(t, err, storage.ErrDBFileNotOpen)
+}
+
 func TestStoredInflightMessagesNoDB(t *testing.T) {
 	h := new(Hook)
 	h.SetOpts(logger, nil)
@@ -702,3 +1037,45 @@ func TestDebugf(t *testing.T) {
 	h.SetOpts(logger, nil)
 	h.Debugf("test", 1, 2, 3)
 }
+
+func TestEncryption(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{Encryption: storage.Encryption{Key: key}})
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b", Payload: []byte("secret-payload"), Created: time.Now().Unix()}, 1)
+
+	r := new(storage.Message)
+	err = h.db.Get(retainedKey("a/b"), r)
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret-payload"), r.Payload)
+
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+	require.Equal(t, "test.addr", clients[0].Remote)
+
+	err = h.db.Badger().View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			v, err := it.Item().ValueCopy(nil)
+			require.NoError(t, err)
+			require.False(t, bytes.Contains(v, []byte("secret-payload")))
+			require.False(t, bytes.Contains(v, []byte("test.addr")))
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestEncryptionInvalidKey(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{Encryption: storage.Encryption{Key: []byte("short")}})
+	require.ErrorIs(t, err, storage.ErrInvalidEncryptionKey)
+}
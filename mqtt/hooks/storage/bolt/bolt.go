@@ -7,7 +7,10 @@ package bolt
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/wind-c/comqtt/v2/mqtt"
@@ -16,7 +19,6 @@ import (
 	"github.com/wind-c/comqtt/v2/mqtt/system"
 
 	sgob "github.com/asdine/storm/codec/gob"
-	"github.com/asdine/storm/v3"
 	"go.etcd.io/bbolt"
 )
 
@@ -26,6 +28,30 @@ const (
 
 	// defaultTimeout is the default time to hold a connection to the file.
 	defaultTimeout = 250 * time.Millisecond
+
+	// defaultCommitSize is the most writes waiting to be committed before writers wait for a commit.
+	defaultCommitSize = 10000
+
+	// keySeparator separates the client id from the filter or packet id in composite keys.
+	// Client ids are mqtt strings, which cannot contain it.
+	keySeparator = "\x00"
+)
+
+var (
+	clientsBucket       = []byte("clients")       // the clients by client id
+	subscriptionsBucket = []byte("subscriptions") // the subscriptions by client id and filter
+	retainedBucket      = []byte("retained")      // the retained messages by topic
+	inflightBucket      = []byte("inflight")      // the inflight messages by client id and packet id
+	sysInfoBucket       = []byte("sysinfo")       // the system info
+
+	// legacyBuckets are the buckets written by earlier versions of the hook, which kept the
+	// records in storm buckets by their type.
+	legacyBuckets = [][]byte{[]byte("Client"), []byte("Subscription"), []byte("Message"), []byte("SystemInfo"), []byte("__storm_db")}
+)
+
+var (
+	// ErrNotFound indicates a record is not in the store.
+	ErrNotFound = errors.New("record not found")
 )
 
 // clientKey returns a primary key for a client.
@@ -33,19 +59,21 @@ func clientKey(cl *mqtt.Client) string {
 	return cl.ID
 }
 
-// subscriptionKey returns a primary key for a subscription.
+// subscriptionKey returns a primary key for a subscription, prefixed by the client id so
+// that the subscriptions of a client are adjacent.
 func subscriptionKey(cl *mqtt.Client, filter string) string {
-	return storage.SubscriptionKey + "_" + cl.ID + ":" + filter
+	return cl.ID + keySeparator + filter
 }
 
 // retainedKey returns a primary key for a retained message.
 func retainedKey(topic string) string {
-	return storage.RetainedKey + "_" + topic
+	return topic
 }
 
-// inflightKey returns a primary key for an inflight message.
+// inflightKey returns a primary key for an inflight message, prefixed by the client id so
+// that the inflight messages of a client are adjacent.
 func inflightKey(cl *mqtt.Client, pk packets.Packet) string {
-	return storage.InflightKey + "_" + cl.ID + ":" + pk.FormatID()
+	return cl.ID + keySeparator + pk.FormatID()
 }
 
 // sysInfoKey returns a primary key for system info.
@@ -57,13 +85,34 @@ func sysInfoKey() string {
 type Options struct {
 	Options *bbolt.Options
 	Path    string
+	Expiry  storage.Expiry // the ages after which stored records are deleted
+
+	// WriteBehind buffers the writes of the hook, applying them in batches of one transaction.
+	WriteBehind storage.WriteBehind
+
+	// Encryption encrypts the records written by the hook with AES-GCM.
+	Encryption storage.Encryption
+}
+
+// write is a write waiting to be committed, putting or deleting a record.
+type write struct {
+	bucket []byte     // the bucket of the record
+	key    string     // the key of the record
+	value  []byte     // the encoded record, or nil to delete the record
+	done   chan error // receives the result of the write if the writer waits for it
 }
 
-// Hook is a persistent storage hook based using boltdb file store as a backend.
+// Hook is a persistent storage hook based using boltdb file store as a backend. Each type
+// of record is kept in its own bucket, and the writes made while a transaction is being
+// committed are committed together in the next one.
 type Hook struct {
 	mqtt.HookBase
-	config *Options  // options for configuring the boltdb instance.
-	db     *storm.DB // the boltdb instance.
+	config  *Options               // options for configuring the boltdb instance.
+	db      *bbolt.DB              // the boltdb instance.
+	cancel  chan struct{}          // stops deleting expired records
+	buffer  *storage.Buffer[write] // the writes waiting to be committed
+	cipher  *storage.Cipher        // seals and opens the records if encryption is enabled
+	metrics mqtt.StorageRecorder   // counts the writes and reads of the hook
 }
 
 // ID returns the id of the hook.
@@ -94,7 +143,8 @@ func (h *Hook) Provides(b byte) bool {
 	}, []byte{b})
 }
 
-// Init initializes and connects to the boltdb instance.
+// Init initializes and connects to the boltdb instance, migrating the records written by
+// earlier versions of the hook to their buckets.
 func (h *Hook) Init(config any) error {
 	if _, ok := config.(*Options); !ok && config != nil {
 		return mqtt.ErrInvalidConfigType
@@ -107,7 +157,8 @@ func (h *Hook) Init(config any) error {
 	h.config = config.(*Options)
 	if h.config.Options == nil {
 		h.config.Options = &bbolt.Options{
-			Timeout: defaultTimeout,
+			Timeout:      defaultTimeout,
+			FreelistType: bbolt.FreelistMapType, // frees pages in constant time in large files
 		}
 	}
 	if h.config.Path == "" {
@@ -115,19 +166,343 @@ func (h *Hook) Init(config any) error {
 	}
 
 	var err error
-	h.db, err = storm.Open(h.config.Path, storm.BoltOptions(0600, h.config.Options), storm.Codec(sgob.Codec))
+	if h.config.Encryption.Enabled() {
+		h.cipher, err = storage.NewCipher(h.config.Encryption)
+		if err != nil {
+			return err
+		}
+	}
+
+	h.db, err = bbolt.Open(h.config.Path, 0600, h.config.Options)
+	if err != nil {
+		return err
+	}
+
+	err = h.db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{clientsBucket, subscriptionsBucket, retainedBucket, inflightBucket, sysInfoBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return h.migrate(tx)
+	})
 	if err != nil {
+		_ = h.db.Close()
 		return err
 	}
 
+	if h.config.Expiry.Enabled() {
+		h.cancel = make(chan struct{})
+		go h.gc(h.config.Expiry.GcInterval(), h.cancel)
+	}
+
+	if h.config.WriteBehind.Enabled {
+		h.buffer = storage.NewBuffer(h.config.WriteBehind, h.applyWrites)
+	} else {
+		// writers wait for their writes, which are committed with those made meanwhile
+		h.buffer = storage.NewBuffer(storage.WriteBehind{Size: defaultCommitSize, Batch: 1, Interval: time.Second}, h.applyWrites)
+	}
+
 	return nil
 }
 
-// Stop closes the boltdb instance.
+// Stop closes the boltdb instance, once any buffered writes have been applied.
 func (h *Hook) Stop() error {
+	if h.cancel != nil {
+		close(h.cancel)
+		h.cancel = nil
+	}
+
+	if h.buffer != nil {
+		h.buffer.Stop()
+		h.buffer = nil
+	}
+
 	return h.db.Close()
 }
 
+// Healthy returns an error if the boltdb file is not open.
+func (h *Hook) Healthy() error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	return h.db.View(func(tx *bbolt.Tx) error {
+		return nil
+	})
+}
+
+// StorageMetrics returns the writes and reads of the hook, the writes waiting to be
+// committed and the size of the boltdb file.
+func (h *Hook) StorageMetrics() mqtt.StorageMetrics {
+	var pending int
+	if h.buffer != nil {
+		pending = h.buffer.Len()
+	}
+
+	var size int64
+	if h.db != nil {
+		_ = h.db.View(func(tx *bbolt.Tx) error {
+			size = tx.Size()
+			return nil
+		})
+	}
+
+	return h.metrics.Metrics(h.ID(), pending, size)
+}
+
+// encode encodes a record as json, encrypting it if encryption is enabled.
+func (h *Hook) encode(v any) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil || h.cipher == nil {
+		return b, err
+	}
+
+	return h.cipher.Seal(b)
+}
+
+// decode decrypts a record if encryption is enabled, and decodes it from json.
+func (h *Hook) decode(data []byte, v any) error {
+	if h.cipher != nil {
+		var err error
+		if data, err = h.cipher.Open(data); err != nil {
+			return err
+		}
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// put writes a record to a bucket, waiting for it to be committed unless in write-behind mode.
+func (h *Hook) put(bucket []byte, key string, data any) error {
+	value, err := h.encode(data)
+	if err != nil {
+		return err
+	}
+
+	return h.write(write{bucket: bucket, key: key, value: value})
+}
+
+// delete deletes a record from a bucket, waiting for it to be committed unless in write-behind mode.
+func (h *Hook) delete(bucket []byte, key string) error {
+	return h.write(write{bucket: bucket, key: key})
+}
+
+// write buffers a write, and waits for its result unless in write-behind mode.
+func (h *Hook) write(w write) error {
+	if h.buffer == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	start := time.Now()
+	if h.config.WriteBehind.Enabled {
+		h.buffer.Add(w)
+		h.metrics.Write(start, nil)
+		return nil
+	}
+
+	w.done = make(chan error, 1)
+	h.buffer.Add(w)
+	err := <-w.done
+	h.metrics.Write(start, err)
+	return err
+}
+
+// applyWrites commits a batch of writes in one transaction, returning the result of each
+// write to its writer, or logging it in write-behind mode.
+func (h *Hook) applyWrites(batch []write) {
+	errs := make([]error, len(batch))
+	err := h.db.Update(func(tx *bbolt.Tx) error {
+		for i, w := range batch {
+			b := tx.Bucket(w.bucket)
+			if w.value == nil {
+				errs[i] = b.Delete([]byte(w.key))
+			} else {
+				errs[i] = b.Put([]byte(w.key), w.value)
+			}
+		}
+		return nil
+	})
+
+	for i, w := range batch {
+		if err != nil {
+			errs[i] = err
+		}
+
+		if w.done != nil {
+			w.done <- errs[i]
+		} else if errs[i] != nil {
+			h.metrics.WriteFailed(1)
+			h.Log.Error("failed to apply buffered write", "error", errs[i], "bucket", string(w.bucket), "key", w.key)
+		}
+	}
+}
+
+// get reads a record from a bucket.
+func (h *Hook) get(bucket []byte, key string, v any) error {
+	start := time.Now()
+	err := h.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(bucket).Get([]byte(key))
+		if data == nil {
+			return ErrNotFound
+		}
+		return h.decode(data, v)
+	})
+	if errors.Is(err, ErrNotFound) {
+		h.metrics.Read(start, nil)
+	} else {
+		h.metrics.Read(start, err)
+	}
+
+	return err
+}
+
+// storedRecords reads all the records of a bucket.
+func storedRecords[T any](h *Hook, bucket []byte) (v []T, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	start := time.Now()
+	err = h.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(_, data []byte) error {
+			var r T
+			if err := h.decode(data, &r); err != nil {
+				return err
+			}
+			v = append(v, r)
+			return nil
+		})
+	})
+	h.metrics.Read(start, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// deletePrefix deletes the records of a bucket whose keys start with prefix.
+func deletePrefix(b *bbolt.Bucket, prefix []byte) error {
+	var keys [][]byte
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, k)
+	}
+
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrate moves the records of the storm buckets written by earlier versions of the hook
+// to the bucket of their type, removing the storm buckets.
+func (h *Hook) migrate(tx *bbolt.Tx) error {
+	n := 0
+	for _, name := range legacyBuckets {
+		b := tx.Bucket(name)
+		if b == nil {
+			continue
+		}
+
+		err := b.ForEach(func(k, data []byte) error {
+			if data == nil {
+				return nil // a storm index or metadata bucket
+			}
+			n++
+			return h.migrateRecord(tx, string(name), data)
+		})
+		if err != nil {
+			return err
+		}
+
+		if err = tx.DeleteBucket(name); err != nil {
+			return err
+		}
+	}
+
+	if n > 0 {
+		h.Log.Info("migrated bolt records to the bucket of their type", "records", n)
+	}
+
+	return nil
+}
+
+// migrateRecord writes a record of a storm bucket to the bucket of its type.
+func (h *Hook) migrateRecord(tx *bbolt.Tx, bucket string, data []byte) error {
+	var bucketName []byte
+	var key string
+	var v any
+
+	switch bucket {
+	case "Client":
+		c := new(storage.Client)
+		if err := h.legacyDecode(data, c); err != nil {
+			return err
+		}
+		bucketName, key, v = clientsBucket, c.ID, c
+	case "Subscription":
+		s := new(storage.Subscription)
+		if err := h.legacyDecode(data, s); err != nil {
+			return err
+		}
+		s.ID = s.Client + keySeparator + s.Filter
+		bucketName, key, v = subscriptionsBucket, s.ID, s
+	case "Message":
+		m := new(storage.Message)
+		if err := h.legacyDecode(data, m); err != nil {
+			return err
+		}
+		switch m.T {
+		case storage.RetainedKey:
+			m.ID = retainedKey(m.TopicName)
+			bucketName, key, v = retainedBucket, m.ID, m
+		case storage.InflightKey:
+			if m.Client == "" { // written before the client was stored with the message
+				id := strings.TrimPrefix(m.ID, storage.InflightKey+"_")
+				m.Client = id[:max(strings.LastIndex(id, ":"), 0)]
+			}
+			m.ID = m.Client + keySeparator + strconv.Itoa(int(m.PacketID))
+			bucketName, key, v = inflightBucket, m.ID, m
+		default:
+			return nil
+		}
+	case "SystemInfo":
+		s := new(storage.SystemInfo)
+		if err := h.legacyDecode(data, s); err != nil {
+			return err
+		}
+		bucketName, key, v = sysInfoBucket, sysInfoKey(), s
+	default:
+		return nil // the storm version
+	}
+
+	value, err := h.encode(v)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(bucketName).Put([]byte(key), value)
+}
+
+// legacyDecode decodes a record written with the gob codec of storm, decrypting it first
+// if encryption is enabled.
+func (h *Hook) legacyDecode(data []byte, v any) error {
+	if h.cipher != nil {
+		var err error
+		if data, err = h.cipher.Open(data); err != nil {
+			return err
+		}
+	}
+
+	return sgob.Codec.Unmarshal(data, v)
+}
+
 // OnSessionEstablished adds a client to the store when their session is established.
 func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
 	h.updateClient(cl)
@@ -167,29 +542,36 @@ func (h *Hook) updateClient(cl *mqtt.Client) {
 		},
 		Will: storage.ClientWill(cl.Properties.Will),
 	}
-	err := h.db.Save(in)
+	if cl.Closed() {
+		in.Disconnected = time.Now().Unix()
+		in.Expires = cl.SessionExpiry()
+	}
+
+	err := h.put(clientsBucket, in.ID, in)
 	if err != nil {
 		h.Log.Error("failed to save client data", "error", err, "data", in)
 	}
 }
 
-// OnDisconnect removes a client from the store if they were using a clean session.
+// OnDisconnect removes a client from the store if they were using a clean session, or
+// records the time they disconnected otherwise.
 func (h *Hook) OnDisconnect(cl *mqtt.Client, _ error, expire bool) {
 	if h.db == nil {
 		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
 		return
 	}
 
-	if !expire {
+	if cl.StopCause() == packets.ErrSessionTakenOver {
 		return
 	}
 
-	if cl.StopCause() == packets.ErrSessionTakenOver {
+	if !expire {
+		h.updateClient(cl)
 		return
 	}
 
-	err := h.db.DeleteStruct(&storage.Client{ID: clientKey(cl)})
-	if err != nil && !errors.Is(err, storm.ErrNotFound) {
+	err := h.delete(clientsBucket, clientKey(cl))
+	if err != nil {
 		h.Log.Error("failed to delete client", "error", err, "id", clientKey(cl))
 	}
 }
@@ -217,7 +599,7 @@ func (h *Hook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []by
 			in.RetainAsPublished = pk.Filters[i].RetainAsPublished
 		}
 
-		err := h.db.Save(in)
+		err := h.put(subscriptionsBucket, in.ID, in)
 		if err != nil {
 			h.Log.Error("failed to save subscription data", "error", err, "client", cl.ID, "data", in)
 		}
@@ -232,9 +614,7 @@ func (h *Hook) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []
 	}
 
 	for i := 0; i < len(pk.Filters); i++ {
-		err := h.db.DeleteStruct(&storage.Subscription{
-			ID: subscriptionKey(cl, pk.Filters[i].Filter),
-		})
+		err := h.delete(subscriptionsBucket, subscriptionKey(cl, pk.Filters[i].Filter))
 		if err != nil {
 			h.Log.Error("failed to delete client", "error", err, "id", subscriptionKey(cl, pk.Filters[i].Filter))
 		}
@@ -249,9 +629,7 @@ func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
 	}
 
 	if r == -1 {
-		err := h.db.DeleteStruct(&storage.Message{
-			ID: retainedKey(pk.TopicName),
-		})
+		err := h.delete(retainedBucket, retainedKey(pk.TopicName))
 		if err != nil {
 			h.Log.Error("failed to delete retained publish", "error", err, "id", retainedKey(pk.TopicName))
 		}
@@ -278,7 +656,7 @@ func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
 			User:                   props.User,
 		},
 	}
-	err := h.db.Save(in)
+	err := h.put(retainedBucket, in.ID, in)
 	if err != nil {
 		h.Log.Error("failed to save retained publish data", "error", err, "client", cl.ID, "data", in)
 	}
@@ -296,6 +674,8 @@ func (h *Hook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, rese
 		ID:          inflightKey(cl, pk),
 		T:           storage.InflightKey,
 		Origin:      pk.Origin,
+		Client:      cl.ID,
+		PacketID:    pk.PacketID,
 		FixedHeader: pk.FixedHeader,
 		TopicName:   pk.TopicName,
 		Payload:     pk.Payload,
@@ -313,7 +693,7 @@ func (h *Hook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, rese
 		},
 	}
 
-	err := h.db.Save(in)
+	err := h.put(inflightBucket, in.ID, in)
 	if err != nil {
 		h.Log.Error("failed to save qos inflight data", "error", err, "client", cl.ID, "data", in)
 	}
@@ -326,9 +706,7 @@ func (h *Hook) OnQosComplete(cl *mqtt.Client, pk packets.Packet) {
 		return
 	}
 
-	err := h.db.DeleteStruct(&storage.Message{
-		ID: inflightKey(cl, pk),
-	})
+	err := h.delete(inflightBucket, inflightKey(cl, pk))
 	if err != nil {
 		h.Log.Error("failed to delete inflight data", "error", err, "id", inflightKey(cl, pk))
 	}
@@ -353,10 +731,10 @@ func (h *Hook) OnSysInfoTick(sys *system.Info) {
 	in := &storage.SystemInfo{
 		ID:   sysInfoKey(),
 		T:    storage.SysInfoKey,
-		Info: *sys,
+		Info: *sys.Clone(),
 	}
 
-	err := h.db.Save(in)
+	err := h.put(sysInfoBucket, in.ID, in)
 	if err != nil {
 		h.Log.Error("failed to save $SYS data", "error", err, "data", in)
 	}
@@ -369,7 +747,7 @@ func (h *Hook) OnRetainedExpired(filter string) {
 		return
 	}
 
-	if err := h.db.DeleteStruct(&storage.Message{ID: retainedKey(filter)}); err != nil {
+	if err := h.delete(retainedBucket, retainedKey(filter)); err != nil {
 		h.Log.Error("failed to delete retained publish", "error", err, "id", retainedKey(filter))
 	}
 }
@@ -381,83 +759,195 @@ func (h *Hook) OnClientExpired(cl *mqtt.Client) {
 		return
 	}
 
-	err := h.db.DeleteStruct(&storage.Client{ID: clientKey(cl)})
-	if err != nil && !errors.Is(err, storm.ErrNotFound) {
+	err := h.delete(clientsBucket, clientKey(cl))
+	if err != nil {
 		h.Log.Error("failed to delete expired client", "error", err, "id", clientKey(cl))
 	}
 }
 
 // StoredClients returns all stored clients from the store.
 func (h *Hook) StoredClients() (v []storage.Client, err error) {
+	return storedRecords[storage.Client](h, clientsBucket)
+}
+
+// StoredSubscriptions returns all stored subscriptions from the store.
+func (h *Hook) StoredSubscriptions() (v []storage.Subscription, err error) {
+	return storedRecords[storage.Subscription](h, subscriptionsBucket)
+}
+
+// StoredRetainedMessages returns all stored retained messages from the store.
+func (h *Hook) StoredRetainedMessages() (v []storage.Message, err error) {
+	return storedRecords[storage.Message](h, retainedBucket)
+}
+
+// StoredInflightMessages returns all stored inflight messages from the store.
+func (h *Hook) StoredInflightMessages() (v []storage.Message, err error) {
+	return storedRecords[storage.Message](h, inflightBucket)
+}
+
+// StoredRetainedMessage returns the stored retained message of a topic, and false if there is none.
+func (h *Hook) StoredRetainedMessage(topic string) (v storage.Message, ok bool, err error) {
 	if h.db == nil {
-		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
-		return
+		return v, false, storage.ErrDBFileNotOpen
 	}
 
-	err = h.db.Find("T", storage.ClientKey, &v)
-	if err != nil && !errors.Is(err, storm.ErrNotFound) {
-		return
+	if h.config.WriteBehind.Enabled {
+		h.buffer.Flush()
 	}
 
-	return v, nil
+	err = h.get(retainedBucket, retainedKey(topic), &v)
+	if errors.Is(err, ErrNotFound) {
+		return v, false, nil
+	} else if err != nil {
+		return v, false, err
+	}
+
+	return v, true, nil
 }
 
-// StoredSubscriptions returns all stored subscriptions from the store.
-func (h *Hook) StoredSubscriptions() (v []storage.Subscription, err error) {
+// StoredClientInflightMessages returns the stored inflight messages of a client.
+func (h *Hook) StoredClientInflightMessages(cid string) (v []storage.Message, err error) {
 	if h.db == nil {
-		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
-		return
+		return nil, storage.ErrDBFileNotOpen
 	}
 
-	err = h.db.Find("T", storage.SubscriptionKey, &v)
-	if err != nil && !errors.Is(err, storm.ErrNotFound) {
-		return
+	if h.config.WriteBehind.Enabled {
+		h.buffer.Flush()
+	}
+
+	start := time.Now()
+	prefix := []byte(cid + keySeparator)
+	err = h.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(inflightBucket).Cursor()
+		for k, data := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, data = c.Next() {
+			var m storage.Message
+			if err := h.decode(data, &m); err != nil {
+				return err
+			}
+			v = append(v, m)
+		}
+		return nil
+	})
+	h.metrics.Read(start, err)
+	if err != nil {
+		return nil, err
 	}
 
 	return v, nil
 }
 
-// StoredRetainedMessages returns all stored retained messages from the store.
-func (h *Hook) StoredRetainedMessages() (v []storage.Message, err error) {
+// StoredSysInfo returns the system info from the store.
+func (h *Hook) StoredSysInfo() (v storage.SystemInfo, err error) {
 	if h.db == nil {
 		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
 		return
 	}
 
-	err = h.db.Find("T", storage.RetainedKey, &v)
-	if err != nil && !errors.Is(err, storm.ErrNotFound) {
+	err = h.get(sysInfoBucket, sysInfoKey(), &v)
+	if err != nil && !errors.Is(err, ErrNotFound) {
 		return
 	}
 
 	return v, nil
 }
 
-// StoredInflightMessages returns all stored inflight messages from the store.
-func (h *Hook) StoredInflightMessages() (v []storage.Message, err error) {
-	if h.db == nil {
-		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
-		return
+// gc deletes expired records at an interval until cancelled.
+func (h *Hook) gc(interval time.Duration, cancel chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cancel:
+			return
+		case <-ticker.C:
+			if err := h.clearExpired(time.Now()); err != nil {
+				h.Log.Error("failed to delete expired records", "error", err)
+			}
+		}
 	}
+}
 
-	err = h.db.Find("T", storage.InflightKey, &v)
-	if err != nil && !errors.Is(err, storm.ErrNotFound) {
-		return
+// clearExpired deletes the retained messages, inflight messages and sessions which are
+// older than their expiry, each session together with its subscriptions and inflight messages.
+func (h *Hook) clearExpired(now time.Time) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
 	}
 
-	return v, nil
+	return h.db.Update(func(tx *bbolt.Tx) error {
+		if cutoff := storage.Cutoff(h.config.Expiry.Retained, now); cutoff > 0 {
+			err := deleteWhere(h, tx.Bucket(retainedBucket), func(m *storage.Message) bool {
+				return m.Created < cutoff
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if cutoff := storage.Cutoff(h.config.Expiry.Inflight, now); cutoff > 0 {
+			err := deleteWhere(h, tx.Bucket(inflightBucket), func(m *storage.Message) bool {
+				return m.Created < cutoff
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		cutoff := storage.Cutoff(h.config.Expiry.Session, now)
+		if cutoff == 0 && !h.config.Expiry.SessionInterval {
+			return nil
+		}
+
+		var expired []string
+		err := deleteWhere(h, tx.Bucket(clientsBucket), func(c *storage.Client) bool {
+			ok := cutoff > 0 && c.Disconnected > 0 && c.Disconnected < cutoff ||
+				h.config.Expiry.SessionInterval && c.Expires > 0 && c.Expires < now.Unix()
+			if ok {
+				expired = append(expired, c.ID)
+			}
+			return ok
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, id := range expired {
+			prefix := []byte(id + keySeparator)
+			if err = deletePrefix(tx.Bucket(subscriptionsBucket), prefix); err != nil {
+				return err
+			}
+			if err = deletePrefix(tx.Bucket(inflightBucket), prefix); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
 }
 
-// StoredSysInfo returns the system info from the store.
-func (h *Hook) StoredSysInfo() (v storage.SystemInfo, err error) {
-	if h.db == nil {
-		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
-		return
+// deleteWhere deletes the records of a bucket which match expired.
+func deleteWhere[T any](h *Hook, b *bbolt.Bucket, expired func(*T) bool) error {
+	var keys [][]byte
+	err := b.ForEach(func(k, data []byte) error {
+		r := new(T)
+		if err := h.decode(data, r); err != nil {
+			return err
+		}
+		if expired(r) {
+			keys = append(keys, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	err = h.db.One("ID", storage.SysInfoKey, &v)
-	if err != nil && !errors.Is(err, storm.ErrNotFound) {
-		return
+	for _, k := range keys {
+		if err = b.Delete(k); err != nil {
+			return err
+		}
 	}
 
-	return v, nil
+	return nil
 }
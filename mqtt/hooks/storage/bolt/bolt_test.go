@@ -5,8 +5,12 @@
 package bolt
 
 import (
+	"bytes"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -15,8 +19,10 @@ import (
 	"github.com/wind-c/comqtt/v2/mqtt/packets"
 	"github.com/wind-c/comqtt/v2/mqtt/system"
 
+	sgob "github.com/asdine/storm/codec/gob"
 	"github.com/asdine/storm/v3"
 	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
 )
 
 var (
@@ -50,17 +56,17 @@ func TestClientKey(t *testing.T) {
 
 func TestSubscriptionKey(t *testing.T) {
 	k := subscriptionKey(&mqtt.Client{ID: "cl1"}, "a/b/c")
-	require.Equal(t, storage.SubscriptionKey+"_cl1:a/b/c", k)
+	require.Equal(t, "cl1\x00a/b/c", k)
 }
 
 func TestRetainedKey(t *testing.T) {
 	k := retainedKey("a/b/c")
-	require.Equal(t, storage.RetainedKey+"_a/b/c", k)
+	require.Equal(t, "a/b/c", k)
 }
 
 func TestInflightKey(t *testing.T) {
 	k := inflightKey(&mqtt.Client{ID: "cl1"}, packets.Packet{PacketID: 1})
-	require.Equal(t, storage.InflightKey+"_cl1:1", k)
+	require.Equal(t, "cl1\x001", k)
 }
 
 func TestSysInfoKey(t *testing.T) {
@@ -111,6 +117,19 @@ func TestInitUseDefaults(t *testing.T) {
 	require.Equal(t, defaultDbFile, h.config.Path)
 }
 
+func TestHealthy(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.ErrorIs(t, h.Healthy(), storage.ErrDBFileNotOpen)
+
+	err := h.Init(nil)
+	require.NoError(t, err)
+	require.NoError(t, h.Healthy())
+
+	teardown(t, h.config.Path, h)
+	require.Error(t, h.Healthy())
+}
+
 func TestInitBadPath(t *testing.T) {
 	h := new(Hook)
 	h.SetOpts(logger, nil)
@@ -130,7 +149,7 @@ func TestOnSessionEstablishedThenOnDisconnect(t *testing.T) {
 	h.OnSessionEstablished(client, packets.Packet{})
 
 	r := new(storage.Client)
-	err = h.db.One("ID", clientKey(client), r)
+	err = h.get(clientsBucket, clientKey(client), r)
 	require.NoError(t, err)
 	require.Equal(t, client.ID, r.ID)
 	require.Equal(t, client.Net.Remote, r.Remote)
@@ -141,18 +160,216 @@ func TestOnSessionEstablishedThenOnDisconnect(t *testing.T) {
 
 	h.OnDisconnect(client, nil, false)
 	r2 := new(storage.Client)
-	err = h.db.One("ID", clientKey(client), r2)
+	err = h.get(clientsBucket, clientKey(client), r2)
 	require.NoError(t, err)
 	require.Equal(t, client.ID, r.ID)
 
 	h.OnDisconnect(client, nil, true)
 	r3 := new(storage.Client)
-	err = h.db.One("ID", clientKey(client), r3)
+	err = h.get(clientsBucket, clientKey(client), r3)
 	require.Error(t, err)
-	require.ErrorIs(t, storm.ErrNotFound, err)
+	require.ErrorIs(t, ErrNotFound, err)
 	require.Empty(t, r3.ID)
 }
 
+func TestOnDisconnectRecordsTime(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	h.OnDisconnect(client, nil, false)
+	r := new(storage.Client)
+	err = h.get(clientsBucket, clientKey(client), r)
+	require.NoError(t, err)
+	require.InDelta(t, time.Now().Unix(), r.Disconnected, 1)
+	require.Zero(t, r.Expires)
+
+	cl := &mqtt.Client{ID: "expiring", Properties: mqtt.ClientProperties{ProtocolVersion: 5}}
+	cl.Properties.Props.SessionExpiryInterval = 60
+	cl.Properties.Props.SessionExpiryIntervalFlag = true
+	cl.Stop(nil)
+	h.OnDisconnect(cl, nil, false)
+	r = new(storage.Client)
+	err = h.get(clientsBucket, clientKey(cl), r)
+	require.NoError(t, err)
+	require.InDelta(t, time.Now().Unix()+60, r.Expires, 1)
+}
+
+func TestInitExpiry(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{Expiry: storage.Expiry{Session: time.Hour}})
+	require.NoError(t, err)
+	require.NotNil(t, h.cancel)
+
+	teardown(t, h.config.Path, h)
+	require.Nil(t, h.cancel)
+}
+
+func TestClearExpired(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{Expiry: storage.Expiry{Retained: time.Hour, Inflight: time.Minute, Session: time.Hour}})
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	now := time.Now()
+	old := now.Add(-2 * time.Hour).Unix()
+	require.NoError(t, h.put(clientsBucket, "cl1", &storage.Client{ID: "cl1", T: storage.ClientKey, Disconnected: old}))
+	require.NoError(t, h.put(clientsBucket, "cl2", &storage.Client{ID: "cl2", T: storage.ClientKey, Disconnected: now.Unix()}))
+	require.NoError(t, h.put(clientsBucket, "cl3", &storage.Client{ID: "cl3", T: storage.ClientKey}))
+	require.NoError(t, h.put(subscriptionsBucket, "cl1"+keySeparator+"a/b", &storage.Subscription{ID: "sub_cl1:a/b", T: storage.SubscriptionKey, Client: "cl1", Filter: "a/b"}))
+	require.NoError(t, h.put(subscriptionsBucket, "cl2"+keySeparator+"a/b", &storage.Subscription{ID: "sub_cl2:a/b", T: storage.SubscriptionKey, Client: "cl2", Filter: "a/b"}))
+	require.NoError(t, h.put(inflightBucket, "cl1"+keySeparator+"1", &storage.Message{ID: "ifm_cl1:1", T: storage.InflightKey, Client: "cl1", Created: now.Unix()}))
+	require.NoError(t, h.put(inflightBucket, "cl2"+keySeparator+"1", &storage.Message{ID: "ifm_cl2:1", T: storage.InflightKey, Client: "cl2", Created: now.Add(-time.Hour).Unix()}))
+	require.NoError(t, h.put(inflightBucket, "cl2"+keySeparator+"2", &storage.Message{ID: "ifm_cl2:2", T: storage.InflightKey, Client: "cl2", Created: now.Unix()}))
+	require.NoError(t, h.put(retainedBucket, "a/b", &storage.Message{ID: "ret_a/b", T: storage.RetainedKey, Created: old}))
+	require.NoError(t, h.put(retainedBucket, "a/c", &storage.Message{ID: "ret_a/c", T: storage.RetainedKey, Created: now.Unix()}))
+
+	err = h.clearExpired(now)
+	require.NoError(t, err)
+
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 2)
+	require.Equal(t, "cl2", clients[0].ID)
+	require.Equal(t, "cl3", clients[1].ID)
+
+	subs, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+	require.Equal(t, "sub_cl2:a/b", subs[0].ID)
+
+	inflight, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, inflight, 1)
+	require.Equal(t, "ifm_cl2:2", inflight[0].ID)
+
+	retained, err := h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, retained, 1)
+	require.Equal(t, "ret_a/c", retained[0].ID)
+}
+
+func TestClearExpiredSessionInterval(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{Expiry: storage.Expiry{SessionInterval: true}})
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	now := time.Now()
+	require.NoError(t, h.put(clientsBucket, "cl1", &storage.Client{ID: "cl1", T: storage.ClientKey, Disconnected: now.Unix() - 60, Expires: now.Unix() - 30}))
+	require.NoError(t, h.put(clientsBucket, "cl2", &storage.Client{ID: "cl2", T: storage.ClientKey, Disconnected: now.Unix() - 60, Expires: now.Unix() + 30}))
+	require.NoError(t, h.put(clientsBucket, "cl3", &storage.Client{ID: "cl3", T: storage.ClientKey, Disconnected: now.Unix() - 60}))
+	require.NoError(t, h.put(subscriptionsBucket, "cl1"+keySeparator+"a/b", &storage.Subscription{ID: "sub_cl1:a/b", T: storage.SubscriptionKey, Client: "cl1", Filter: "a/b"}))
+	require.NoError(t, h.put(inflightBucket, "cl1"+keySeparator+"1", &storage.Message{ID: "ifm_cl1:1", T: storage.InflightKey, Client: "cl1", Created: now.Unix()}))
+
+	err = h.clearExpired(now)
+	require.NoError(t, err)
+
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 2)
+	require.Equal(t, "cl2", clients[0].ID)
+	require.Equal(t, "cl3", clients[1].ID)
+
+	subs, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Empty(t, subs)
+
+	inflight, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Empty(t, inflight)
+}
+
+func TestClearExpiredNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.clearExpired(time.Now())
+	require.ErrorIs(t, err, storage.ErrDBFileNotOpen)
+}
+
+func TestWriteBehind(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{WriteBehind: storage.WriteBehind{Enabled: true, Interval: time.Hour}})
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+	require.NotNil(t, h.buffer)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnSubscribed(client, pkf, []byte{0}, []int{1})
+	require.Equal(t, 2, h.buffer.Len())
+
+	r := new(storage.Client)
+	err = h.get(clientsBucket, clientKey(client), r)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	h.buffer.Flush()
+	err = h.get(clientsBucket, clientKey(client), r)
+	require.NoError(t, err)
+	require.Equal(t, client.ID, r.ID)
+
+	subs, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+
+	h.OnUnsubscribed(client, pkf, []byte{0}, []int{0})
+	h.OnUnsubscribed(client, pkf, []byte{0}, []int{0}) // deleting a missing record is not an error
+	h.buffer.Flush()
+	subs, err = h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Empty(t, subs)
+}
+
+func TestWriteBehindStopFlushes(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{WriteBehind: storage.WriteBehind{Enabled: true, Interval: time.Hour}})
+	require.NoError(t, err)
+	defer os.Remove(h.config.Path)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	require.NoError(t, h.Stop())
+	require.Nil(t, h.buffer)
+
+	err = h.Init(&Options{})
+	require.NoError(t, err)
+	defer h.Stop()
+
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+}
+
+func TestStorageMetrics(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{WriteBehind: storage.WriteBehind{Enabled: true, Interval: time.Hour}})
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnSubscribed(client, pkf, []byte{0}, []int{1})
+	m := h.StorageMetrics()
+	require.Equal(t, h.ID(), m.ID)
+	require.Equal(t, int64(2), m.Writes)
+	require.Equal(t, int64(2), m.Pending)
+	require.Greater(t, m.Size, int64(0))
+
+	h.buffer.Flush()
+	_, err = h.StoredClients()
+	require.NoError(t, err)
+	m = h.StorageMetrics()
+	require.Equal(t, int64(0), m.Pending)
+	require.Equal(t, int64(1), m.Reads)
+	require.Equal(t, int64(0), m.ReadErrors)
+	require.Equal(t, int64(0), m.WriteErrors)
+}
+
 func TestOnSessionEstablishedNoDB(t *testing.T) {
 	h := new(Hook)
 	h.SetOpts(logger, nil)
@@ -180,7 +397,7 @@ func TestOnWillSent(t *testing.T) {
 	h.OnWillSent(c1, packets.Packet{})
 
 	r := new(storage.Client)
-	err = h.db.One("ID", clientKey(client), r)
+	err = h.get(clientsBucket, clientKey(client), r)
 	require.NoError(t, err)
 
 	require.Equal(t, uint32(1), r.Will.Flag)
@@ -197,18 +414,18 @@ func TestOnClientExpired(t *testing.T) {
 	cl := &mqtt.Client{ID: "cl1"}
 	clientKey := clientKey(cl)
 
-	err = h.db.Save(&storage.Client{ID: cl.ID})
+	err = h.put(clientsBucket, cl.ID, &storage.Client{ID: cl.ID})
 	require.NoError(t, err)
 
 	r := new(storage.Client)
-	err = h.db.One("ID", clientKey, r)
+	err = h.get(clientsBucket, clientKey, r)
 	require.NoError(t, err)
 	require.Equal(t, cl.ID, r.ID)
 
 	h.OnClientExpired(cl)
-	err = h.db.One("ID", clientKey, r)
+	err = h.get(clientsBucket, clientKey, r)
 	require.Error(t, err)
-	require.ErrorIs(t, storm.ErrNotFound, err)
+	require.ErrorIs(t, ErrNotFound, err)
 }
 
 func TestOnClientExpiredClosedDB(t *testing.T) {
@@ -274,16 +491,16 @@ func TestOnSubscribedThenOnUnsubscribed(t *testing.T) {
 	h.OnSubscribed(client, pkf, []byte{0}, nil)
 	r := new(storage.Subscription)
 
-	err = h.db.One("ID", subscriptionKey(client, pkf.Filters[0].Filter), r)
+	err = h.get(subscriptionsBucket, subscriptionKey(client, pkf.Filters[0].Filter), r)
 	require.NoError(t, err)
 	require.Equal(t, client.ID, r.Client)
 	require.Equal(t, pkf.Filters[0].Filter, r.Filter)
 	require.Equal(t, byte(0), r.Qos)
 
 	h.OnUnsubscribed(client, pkf, nil, nil)
-	err = h.db.One("ID", subscriptionKey(client, pkf.Filters[0].Filter), r)
+	err = h.get(subscriptionsBucket, subscriptionKey(client, pkf.Filters[0].Filter), r)
 	require.Error(t, err)
-	require.Equal(t, storm.ErrNotFound, err)
+	require.Equal(t, ErrNotFound, err)
 }
 
 func TestOnSubscribedNoDB(t *testing.T) {
@@ -334,21 +551,21 @@ func TestOnRetainMessageThenUnset(t *testing.T) {
 	h.OnRetainMessage(client, pk, 1)
 
 	r := new(storage.Message)
-	err = h.db.One("ID", retainedKey(pk.TopicName), r)
+	err = h.get(retainedBucket, retainedKey(pk.TopicName), r)
 	require.NoError(t, err)
 	require.Equal(t, pk.TopicName, r.TopicName)
 	require.Equal(t, pk.Payload, r.Payload)
 
 	h.OnRetainMessage(client, pk, -1)
-	err = h.db.One("ID", retainedKey(pk.TopicName), r)
+	err = h.get(retainedBucket, retainedKey(pk.TopicName), r)
 	require.Error(t, err)
-	require.Equal(t, storm.ErrNotFound, err)
+	require.Equal(t, ErrNotFound, err)
 
 	// coverage: delete deleted
 	h.OnRetainMessage(client, pk, -1)
-	err = h.db.One("ID", retainedKey(pk.TopicName), r)
+	err = h.get(retainedBucket, retainedKey(pk.TopicName), r)
 	require.Error(t, err)
-	require.Equal(t, storm.ErrNotFound, err)
+	require.Equal(t, ErrNotFound, err)
 }
 
 func TestOnRetainedExpired(t *testing.T) {
@@ -364,18 +581,18 @@ func TestOnRetainedExpired(t *testing.T) {
 		TopicName: "a/b/c",
 	}
 
-	err = h.db.Save(m)
+	err = h.put(retainedBucket, m.ID, m)
 	require.NoError(t, err)
 
 	r := new(storage.Message)
-	err = h.db.One("ID", m.ID, r)
+	err = h.get(retainedBucket, m.ID, r)
 	require.NoError(t, err)
 	require.Equal(t, m.TopicName, r.TopicName)
 
 	h.OnRetainedExpired(m.TopicName)
-	err = h.db.One("ID", m.ID, r)
+	err = h.get(retainedBucket, m.ID, r)
 	require.Error(t, err)
-	require.Equal(t, storm.ErrNotFound, err)
+	require.Equal(t, ErrNotFound, err)
 }
 
 func TestOnRetainedExpiredClosedDB(t *testing.T) {
@@ -427,7 +644,7 @@ func TestOnQosPublishThenQOSComplete(t *testing.T) {
 	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
 
 	r := new(storage.Message)
-	err = h.db.One("ID", inflightKey(client, pk), r)
+	err = h.get(inflightBucket, inflightKey(client, pk), r)
 	require.NoError(t, err)
 	require.Equal(t, pk.TopicName, r.TopicName)
 	require.Equal(t, pk.Payload, r.Payload)
@@ -438,9 +655,31 @@ func TestOnQosPublishThenQOSComplete(t *testing.T) {
 
 	// OnQosDropped is a passthrough to OnQosComplete here
 	h.OnQosDropped(client, pk)
-	err = h.db.One("ID", inflightKey(client, pk), r)
+	err = h.get(inflightBucket, inflightKey(client, pk), r)
 	require.Error(t, err)
-	require.Equal(t, storm.ErrNotFound, err)
+	require.Equal(t, ErrNotFound, err)
+}
+
+func TestOnQosPublishPubrelStage(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Pubrel, Qos: 1},
+		PacketID:    7,
+		Origin:      "publisher",
+	}
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+
+	r, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, client.ID, r[0].Client)
+	require.Equal(t, uint16(7), r[0].ToPacket().PacketID)
+	require.Equal(t, packets.Pubrel, r[0].ToPacket().FixedHeader.Type)
 }
 
 func TestOnQosPublishNoDB(t *testing.T) {
@@ -494,7 +733,7 @@ func TestOnSysInfoTick(t *testing.T) {
 	h.OnSysInfoTick(info)
 
 	r := new(storage.SystemInfo)
-	err = h.db.One("ID", storage.SysInfoKey, r)
+	err = h.get(sysInfoBucket, sysInfoKey(), r)
 	require.NoError(t, err)
 	require.Equal(t, info.Version, r.Version)
 	require.Equal(t, info.BytesReceived, r.BytesReceived)
@@ -524,13 +763,13 @@ func TestStoredClients(t *testing.T) {
 	defer teardown(t, h.config.Path, h)
 
 	// populate with clients
-	err = h.db.Save(&storage.Client{ID: "cl1", T: storage.ClientKey})
+	err = h.put(clientsBucket, "cl1", &storage.Client{ID: "cl1", T: storage.ClientKey})
 	require.NoError(t, err)
 
-	err = h.db.Save(&storage.Client{ID: "cl2", T: storage.ClientKey})
+	err = h.put(clientsBucket, "cl2", &storage.Client{ID: "cl2", T: storage.ClientKey})
 	require.NoError(t, err)
 
-	err = h.db.Save(&storage.Client{ID: "cl3", T: storage.ClientKey})
+	err = h.put(clientsBucket, "cl3", &storage.Client{ID: "cl3", T: storage.ClientKey})
 	require.NoError(t, err)
 
 	r, err := h.StoredClients()
@@ -568,13 +807,13 @@ func TestStoredSubscriptions(t *testing.T) {
 	defer teardown(t, h.config.Path, h)
 
 	// populate with subscriptions
-	err = h.db.Save(&storage.Subscription{ID: "sub1", T: storage.SubscriptionKey})
+	err = h.put(subscriptionsBucket, "sub1", &storage.Subscription{ID: "sub1", T: storage.SubscriptionKey})
 	require.NoError(t, err)
 
-	err = h.db.Save(&storage.Subscription{ID: "sub2", T: storage.SubscriptionKey})
+	err = h.put(subscriptionsBucket, "sub2", &storage.Subscription{ID: "sub2", T: storage.SubscriptionKey})
 	require.NoError(t, err)
 
-	err = h.db.Save(&storage.Subscription{ID: "sub3", T: storage.SubscriptionKey})
+	err = h.put(subscriptionsBucket, "sub3", &storage.Subscription{ID: "sub3", T: storage.SubscriptionKey})
 	require.NoError(t, err)
 
 	r, err := h.StoredSubscriptions()
@@ -612,16 +851,16 @@ func TestStoredRetainedMessages(t *testing.T) {
 	defer teardown(t, h.config.Path, h)
 
 	// populate with messages
-	err = h.db.Save(&storage.Message{ID: "m1", T: storage.RetainedKey})
+	err = h.put(retainedBucket, "m1", &storage.Message{ID: "m1", T: storage.RetainedKey})
 	require.NoError(t, err)
 
-	err = h.db.Save(&storage.Message{ID: "m2", T: storage.RetainedKey})
+	err = h.put(retainedBucket, "m2", &storage.Message{ID: "m2", T: storage.RetainedKey})
 	require.NoError(t, err)
 
-	err = h.db.Save(&storage.Message{ID: "m3", T: storage.RetainedKey})
+	err = h.put(retainedBucket, "m3", &storage.Message{ID: "m3", T: storage.RetainedKey})
 	require.NoError(t, err)
 
-	err = h.db.Save(&storage.Message{ID: "i3", T: storage.InflightKey})
+	err = h.put(inflightBucket, "i3", &storage.Message{ID: "i3", T: storage.InflightKey})
 	require.NoError(t, err)
 
 	r, err := h.StoredRetainedMessages()
@@ -659,16 +898,16 @@ func TestStoredInflightMessages(t *testing.T) {
 	defer teardown(t, h.config.Path, h)
 
 	// populate with messages
-	err = h.db.Save(&storage.Message{ID: "i1", T: storage.InflightKey})
+	err = h.put(inflightBucket, "i1", &storage.Message{ID: "i1", T: storage.InflightKey})
 	require.NoError(t, err)
 
-	err = h.db.Save(&storage.Message{ID: "i2", T: storage.InflightKey})
+	err = h.put(inflightBucket, "i2", &storage.Message{ID: "i2", T: storage.InflightKey})
 	require.NoError(t, err)
 
-	err = h.db.Save(&storage.Message{ID: "i3", T: storage.InflightKey})
+	err = h.put(inflightBucket, "i3", &storage.Message{ID: "i3", T: storage.InflightKey})
 	require.NoError(t, err)
 
-	err = h.db.Save(&storage.Message{ID: "m1", T: storage.RetainedKey})
+	err = h.put(retainedBucket, "m1", &storage.Message{ID: "m1", T: storage.RetainedKey})
 	require.NoError(t, err)
 
 	r, err := h.StoredInflightMessages()
@@ -679,6 +918,60 @@ func TestStoredInflightMessages(t *testing.T) {
 	require.Equal(t, "i3", r[2].ID)
 }
 
+func TestStoredRetainedMessage(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{WriteBehind: storage.WriteBehind{Enabled: true, Interval: time.Hour}})
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("hello")}, 1)
+
+	// the buffered write is flushed before reading
+	m, ok, err := h.StoredRetainedMessage("a/b/c")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, []byte("hello"), m.Payload)
+
+	_, ok, err = h.StoredRetainedMessage("d/e/f")
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestStoredClientInflightMessages(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{WriteBehind: storage.WriteBehind{Enabled: true, Interval: time.Hour}})
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	h.OnQosPublish(client, packets.Packet{PacketID: 1, TopicName: "a/b/c", Payload: []byte("1")}, 0, 0)
+	h.OnQosPublish(client, packets.Packet{PacketID: 2, TopicName: "a/b/c", Payload: []byte("2")}, 0, 0)
+	h.OnQosPublish(&mqtt.Client{ID: "test2"}, packets.Packet{PacketID: 1, TopicName: "a/b/c"}, 0, 0)
+
+	r, err := h.StoredClientInflightMessages(client.ID)
+	require.NoError(t, err)
+	require.Len(t, r, 2)
+	for _, m := range r {
+		require.Equal(t, client.ID, m.Client)
+	}
+
+	r, err = h.StoredClientInflightMessages("other")
+	require.NoError(t, err)
+	require.Empty(t, r)
+}
+
+func TestStoredColdNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	_, ok, err := h.StoredRetainedMessage("a/b/c")
+	require.False(t, ok)
+	require.ErrorIs(t, err, storage.ErrDBFileNotOpen)
+
+	_, err = h.StoredClientInflightMessages(client.ID)
+	require.ErrorIs(t, err, storage.ErrDBFileNotOpen)
+}
+
 func TestStoredInflightMessagesNoDB(t *testing.T) {
 	h := new(Hook)
 	h.SetOpts(logger, nil)
@@ -706,7 +999,7 @@ func TestStoredSysInfo(t *testing.T) {
 	defer teardown(t, h.config.Path, h)
 
 	// populate with sys info
-	err = h.db.Save(&storage.SystemInfo{
+	err = h.put(sysInfoBucket, sysInfoKey(), &storage.SystemInfo{
 		ID: storage.SysInfoKey,
 		Info: system.Info{
 			Version: "2.0.0",
@@ -738,3 +1031,135 @@ func TestStoredSysInfoClosedDB(t *testing.T) {
 	require.Empty(t, v)
 	require.Error(t, err)
 }
+
+func TestEncryption(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{Encryption: storage.Encryption{Key: key}})
+	require.NoError(t, err)
+	path := h.config.Path
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b", Payload: []byte("secret-payload"), Created: time.Now().Unix()}, 1)
+
+	retained, err := h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, retained, 1)
+	require.Equal(t, []byte("secret-payload"), retained[0].Payload)
+	require.NoError(t, h.Stop())
+
+	raw, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(raw, []byte("secret-payload")))
+	require.False(t, bytes.Contains(raw, []byte("test.addr")))
+
+	h = new(Hook)
+	h.SetOpts(logger, nil)
+	err = h.Init(&Options{Encryption: storage.Encryption{Key: bytes.Repeat([]byte{2}, 16), PreviousKeys: [][]byte{key}}})
+	require.NoError(t, err)
+	defer teardown(t, path, h)
+
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+	require.Equal(t, "test.addr", clients[0].Remote)
+}
+
+func TestEncryptionInvalidKey(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{Encryption: storage.Encryption{Key: []byte("short")}})
+	require.ErrorIs(t, err, storage.ErrInvalidEncryptionKey)
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cl := &mqtt.Client{ID: "cl" + strconv.Itoa(i)}
+			h.OnSessionEstablished(cl, packets.Packet{})
+			h.OnSubscribed(cl, pkf, []byte{0}, []int{1})
+		}(i)
+	}
+	wg.Wait()
+	require.Equal(t, 0, h.buffer.Len()) // each writer waited for its write to be committed
+
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 50)
+
+	subs, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 50)
+}
+
+func TestWriteStopped(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	teardown(t, h.config.Path, h)
+
+	err = h.put(clientsBucket, "cl1", &storage.Client{ID: "cl1"})
+	require.ErrorIs(t, err, storage.ErrDBFileNotOpen)
+}
+
+func TestMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bolt.db")
+	db, err := storm.Open(path, storm.Codec(sgob.Codec))
+	require.NoError(t, err)
+	require.NoError(t, db.Save(&storage.Client{ID: "cl1", T: storage.ClientKey, Remote: "test.addr"}))
+	require.NoError(t, db.Save(&storage.Subscription{ID: "sub_cl1:a/b", T: storage.SubscriptionKey, Client: "cl1", Filter: "a/b"}))
+	require.NoError(t, db.Save(&storage.Message{ID: "ret_a/b", T: storage.RetainedKey, TopicName: "a/b", Payload: []byte("hello")}))
+	require.NoError(t, db.Save(&storage.Message{ID: "ifm_cl:1:7", T: storage.InflightKey, PacketID: 7}))
+	require.NoError(t, db.Save(&storage.SystemInfo{ID: storage.SysInfoKey, T: storage.SysInfoKey, Info: system.Info{Version: "2.0.0"}}))
+	require.NoError(t, db.Close())
+
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err = h.Init(&Options{Path: path})
+	require.NoError(t, err)
+	defer h.Stop()
+
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+	require.Equal(t, "test.addr", clients[0].Remote)
+
+	subs, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+	require.Equal(t, "cl1"+keySeparator+"a/b", subs[0].ID)
+
+	retained, err := h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, retained, 1)
+	require.Equal(t, []byte("hello"), retained[0].Payload)
+
+	inflight, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, inflight, 1)
+	require.Equal(t, "cl:1", inflight[0].Client)
+	require.Equal(t, "cl:1"+keySeparator+"7", inflight[0].ID)
+
+	sys, err := h.StoredSysInfo()
+	require.NoError(t, err)
+	require.Equal(t, "2.0.0", sys.Version)
+
+	err = h.db.View(func(tx *bbolt.Tx) error {
+		for _, name := range legacyBuckets {
+			require.Nil(t, tx.Bucket(name))
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
@@ -0,0 +1,155 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-co
+// SPDX-FileContributor: mochi-co
+
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	DefaultWriteBehindSize     = 10000                  // the most writes buffered if no size is set
+	DefaultWriteBehindBatch    = 500                    // the buffered writes which trigger a flush if no batch is set
+	DefaultWriteBehindInterval = 100 * time.Millisecond // the longest a write is buffered if no interval is set
+)
+
+// WriteBehind contains the settings of the write-behind mode of a storage hook, in which its
+// writes are buffered in memory and applied in batches by a background worker. The writes
+// buffered when the broker crashes are lost, in exchange for far fewer round trips to the store.
+type WriteBehind struct {
+	Enabled  bool
+	Size     int           // the most writes buffered before writers wait for a flush
+	Batch    int           // the buffered writes which trigger a flush before the interval elapses
+	Interval time.Duration // the longest a write is buffered before it is flushed
+}
+
+// Buffer is a bounded buffer of writes to a store, applied in batches in the order they
+// were added, when the interval elapses or the batch size is reached.
+type Buffer[T any] struct {
+	mu      sync.Mutex
+	full    *sync.Cond    // signalled when buffered writes are taken for a flush
+	pending []T           // the buffered writes
+	flushMu sync.Mutex    // serializes flushes, so that batches are applied in order
+	apply   func([]T)     // applies a batch of writes to the store
+	config  WriteBehind   // the sizes and interval of the buffer
+	kick    chan struct{} // triggers a flush once a batch is buffered
+	cancel  chan struct{} // stops the worker
+	done    chan struct{} // closed once the worker has flushed the last writes
+	stopped bool          // writes added once stopped are applied as they are added
+}
+
+// NewBuffer returns a buffer which applies its writes with apply, and starts its worker.
+func NewBuffer[T any](config WriteBehind, apply func([]T)) *Buffer[T] {
+	if config.Size <= 0 {
+		config.Size = DefaultWriteBehindSize
+	}
+	if config.Batch <= 0 {
+		config.Batch = DefaultWriteBehindBatch
+	}
+	if config.Batch > config.Size {
+		config.Batch = config.Size
+	}
+	if config.Interval <= 0 {
+		config.Interval = DefaultWriteBehindInterval
+	}
+
+	b := &Buffer[T]{
+		apply:  apply,
+		config: config,
+		kick:   make(chan struct{}, 1),
+		cancel: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	b.full = sync.NewCond(&b.mu)
+
+	go b.run()
+	return b
+}
+
+// Add buffers a write, waiting for a flush if the buffer is full. Once the buffer is
+// stopped, the write is applied at once, after any writes still buffered.
+func (b *Buffer[T]) Add(w T) {
+	b.mu.Lock()
+	for len(b.pending) >= b.config.Size && !b.stopped {
+		b.full.Wait()
+	}
+
+	if b.stopped {
+		b.mu.Unlock()
+		b.flushMu.Lock()
+		defer b.flushMu.Unlock()
+
+		b.mu.Lock()
+		batch := append(b.pending, w)
+		b.pending = nil
+		b.mu.Unlock()
+		b.apply(batch)
+		return
+	}
+
+	b.pending = append(b.pending, w)
+	n := len(b.pending)
+	b.mu.Unlock()
+
+	if n >= b.config.Batch {
+		select {
+		case b.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Len returns the number of buffered writes.
+func (b *Buffer[T]) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.pending)
+}
+
+// Flush applies the buffered writes.
+func (b *Buffer[T]) Flush() {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.mu.Lock()
+	batch := b.pending
+	b.pending = nil
+	b.full.Broadcast()
+	b.mu.Unlock()
+
+	if len(batch) > 0 {
+		b.apply(batch)
+	}
+}
+
+// Stop stops the worker once it has applied the buffered writes.
+func (b *Buffer[T]) Stop() {
+	b.mu.Lock()
+	b.stopped = true
+	b.full.Broadcast()
+	b.mu.Unlock()
+
+	close(b.cancel)
+	<-b.done
+}
+
+// run flushes the buffered writes at the interval, or whenever a batch is buffered, until stopped.
+func (b *Buffer[T]) run() {
+	defer close(b.done)
+	ticker := time.NewTicker(b.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.cancel:
+			b.Flush()
+			return
+		case <-ticker.C:
+			b.Flush()
+		case <-b.kick:
+			b.Flush()
+		}
+	}
+}
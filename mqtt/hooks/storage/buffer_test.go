@@ -0,0 +1,117 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-co
+// SPDX-FileContributor: mochi-co
+
+package storage
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// appliedWrites records the batches applied by a buffer.
+type appliedWrites struct {
+	sync.Mutex
+	batches [][]int
+}
+
+func (a *appliedWrites) apply(batch []int) {
+	a.Lock()
+	defer a.Unlock()
+	a.batches = append(a.batches, batch)
+}
+
+func (a *appliedWrites) writes() []int {
+	a.Lock()
+	defer a.Unlock()
+	var v []int
+	for _, b := range a.batches {
+		v = append(v, b...)
+	}
+	return v
+}
+
+func TestNewBufferDefaults(t *testing.T) {
+	b := NewBuffer(WriteBehind{Size: 10, Batch: 20}, func([]int) {})
+	defer b.Stop()
+	require.Equal(t, 10, b.config.Size)
+	require.Equal(t, 10, b.config.Batch)
+	require.Equal(t, DefaultWriteBehindInterval, b.config.Interval)
+
+	b2 := NewBuffer(WriteBehind{}, func([]int) {})
+	defer b2.Stop()
+	require.Equal(t, DefaultWriteBehindSize, b2.config.Size)
+	require.Equal(t, DefaultWriteBehindBatch, b2.config.Batch)
+}
+
+func TestBufferFlushOnBatch(t *testing.T) {
+	a := new(appliedWrites)
+	b := NewBuffer(WriteBehind{Batch: 3, Interval: time.Hour}, a.apply)
+	defer b.Stop()
+
+	b.Add(1)
+	b.Add(2)
+	require.Equal(t, 2, b.Len())
+	b.Add(3)
+	require.Eventually(t, func() bool { return len(a.writes()) == 3 }, time.Second, time.Millisecond)
+	require.Equal(t, []int{1, 2, 3}, a.writes())
+	require.Equal(t, 0, b.Len())
+}
+
+func TestBufferFlushOnInterval(t *testing.T) {
+	a := new(appliedWrites)
+	b := NewBuffer(WriteBehind{Interval: time.Millisecond}, a.apply)
+	defer b.Stop()
+
+	b.Add(1)
+	require.Eventually(t, func() bool { return len(a.writes()) == 1 }, time.Second, time.Millisecond)
+}
+
+func TestBufferStopFlushes(t *testing.T) {
+	a := new(appliedWrites)
+	b := NewBuffer(WriteBehind{Interval: time.Hour}, a.apply)
+
+	b.Add(1)
+	b.Add(2)
+	b.Stop()
+	require.Equal(t, []int{1, 2}, a.writes())
+}
+
+func TestBufferAddAfterStop(t *testing.T) {
+	a := new(appliedWrites)
+	b := NewBuffer(WriteBehind{Interval: time.Hour}, a.apply)
+
+	b.Add(1)
+	b.Stop()
+	b.Add(2)
+	require.Equal(t, []int{1, 2}, a.writes())
+	require.Equal(t, 0, b.Len())
+}
+
+func TestBufferAddWaitsWhenFull(t *testing.T) {
+	a := new(appliedWrites)
+	b := NewBuffer(WriteBehind{Size: 2, Batch: 2, Interval: time.Hour}, a.apply)
+	defer b.Stop()
+
+	b.Flush() // nothing to apply
+	require.Empty(t, a.batches)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= 5; i++ {
+			b.Add(i)
+		}
+	}()
+	wg.Wait()
+	b.Flush()
+
+	require.Equal(t, []int{1, 2, 3, 4, 5}, a.writes())
+	for _, batch := range a.batches {
+		require.LessOrEqual(t, len(batch), 2)
+	}
+}
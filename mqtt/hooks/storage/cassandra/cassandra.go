@@ -0,0 +1,975 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+// Package cassandra is a persistent storage hook keeping the sessions, subscriptions,
+// retained and inflight messages of a broker in a cassandra or scylladb cluster, for fleets
+// too large to keep in the memory of redis. Records expire with native ttls rather than
+// being scanned for.
+package cassandra
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/mqtt/system"
+)
+
+const (
+	defaultHost        = "127.0.0.1"
+	defaultKeyspace    = "comqtt"
+	defaultPrefix      = "comqtt_"
+	defaultConsistency = "local_quorum"
+	defaultReplication = "{'class': 'SimpleStrategy', 'replication_factor': 1}"
+	defaultTimeout     = 5 * time.Second
+
+	// healthTimeout is the time allowed for the cluster to answer a health check query.
+	healthTimeout = 2 * time.Second
+
+	// maxTTL is the longest ttl cassandra accepts, of 20 years.
+	maxTTL = 630720000
+)
+
+var (
+	ErrInvalidConsistency = errors.New("invalid cassandra consistency level")
+)
+
+// clientKey returns a primary key for a client.
+func clientKey(cl *mqtt.Client) string {
+	return cl.ID
+}
+
+// retainedKey returns a primary key for a retained message.
+func retainedKey(topic string) string {
+	return topic
+}
+
+// inflightKey returns the key of an inflight message among those of its client.
+func inflightKey(pk packets.Packet) string {
+	return pk.FormatID()
+}
+
+// sysInfoKey returns a primary key for system info.
+func sysInfoKey() string {
+	return storage.SysInfoKey
+}
+
+// Options contains configuration settings for the cassandra cluster.
+type Options struct {
+	Hosts       []string      // contact points of the cluster, such as 10.0.0.1 or 10.0.0.1:9042
+	Keyspace    string        // keyspace of the tables, created if it does not exist
+	Replication string        // replication of the keyspace if it is created, such as {'class': 'NetworkTopologyStrategy', 'dc1': 3}
+	Prefix      string        // prefix of the names of the tables
+	Username    string        // username of password authentication, if any
+	Password    string        // password of password authentication
+	Timeout     time.Duration // timeout of each query, 5 seconds if 0
+
+	// Consistency is the consistency level of writes, and ReadConsistency of reads, such as
+	// one, local_one, quorum or local_quorum. Both default to local_quorum, and reads default
+	// to the consistency of writes.
+	Consistency     string
+	ReadConsistency string
+
+	// Expiry sets the ttls of the records. The ages of retained and inflight messages count
+	// from when they were published, and the session age from when its client disconnected.
+	Expiry storage.Expiry
+}
+
+// Hook is a persistent storage hook using a cassandra or scylladb cluster as a backend.
+type Hook struct {
+	mqtt.HookBase
+	config  *Options             // options for connecting to the cluster.
+	db      *gocql.Session       // the session of the cluster.
+	ctx     context.Context      // a context for the queries
+	write   gocql.Consistency    // the consistency level of writes
+	read    gocql.Consistency    // the consistency level of reads
+	metrics mqtt.StorageRecorder // counts the writes and reads of the hook
+}
+
+// ID returns the id of the hook.
+func (h *Hook) ID() string {
+	return "cassandra-db"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+		mqtt.OnSubscribed,
+		mqtt.OnUnsubscribed,
+		mqtt.OnRetainMessage,
+		mqtt.OnQosPublish,
+		mqtt.OnQosComplete,
+		mqtt.OnQosDropped,
+		mqtt.OnWillSent,
+		mqtt.OnSysInfoTick,
+		mqtt.OnClientExpired,
+		mqtt.OnRetainedExpired,
+		mqtt.StoredClients,
+		mqtt.StoredInflightMessages,
+		mqtt.StoredRetainedMessages,
+		mqtt.StoredSubscriptions,
+		mqtt.StoredSysInfo,
+	}, []byte{b})
+}
+
+// table returns the qualified name of the table of a kind of record, such as storage.ClientKey.
+func (h *Hook) table(key string) string {
+	return quoteIdentifier(h.config.Keyspace) + "." + quoteIdentifier(h.config.Prefix+key)
+}
+
+// quoteIdentifier quotes a keyspace or table name.
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// Init initializes and connects to the cassandra cluster, creating the keyspace and tables
+// if they do not exist.
+func (h *Hook) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	h.ctx = context.Background()
+
+	if config == nil {
+		config = new(Options)
+	}
+
+	h.config = config.(*Options)
+	if len(h.config.Hosts) == 0 {
+		h.config.Hosts = []string{defaultHost}
+	}
+	if h.config.Keyspace == "" {
+		h.config.Keyspace = defaultKeyspace
+	}
+	if h.config.Replication == "" {
+		h.config.Replication = defaultReplication
+	}
+	if h.config.Prefix == "" {
+		h.config.Prefix = defaultPrefix
+	}
+	if h.config.Timeout <= 0 {
+		h.config.Timeout = defaultTimeout
+	}
+	if h.config.Consistency == "" {
+		h.config.Consistency = defaultConsistency
+	}
+	if h.config.ReadConsistency == "" {
+		h.config.ReadConsistency = h.config.Consistency
+	}
+
+	var err error
+	if h.write, err = gocql.ParseConsistencyWrapper(h.config.Consistency); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidConsistency, h.config.Consistency)
+	}
+	if h.read, err = gocql.ParseConsistencyWrapper(h.config.ReadConsistency); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidConsistency, h.config.ReadConsistency)
+	}
+
+	h.Log.Info("connecting to cassandra", "hosts", h.config.Hosts, "keyspace", h.config.Keyspace,
+		"consistency", h.config.Consistency, "read_consistency", h.config.ReadConsistency)
+
+	cluster := gocql.NewCluster(h.config.Hosts...)
+	cluster.Consistency = h.write
+	cluster.Timeout = h.config.Timeout
+	cluster.ConnectTimeout = h.config.Timeout
+	if h.config.Username != "" {
+		cluster.Authenticator = gocql.PasswordAuthenticator{
+			Username: h.config.Username,
+			Password: h.config.Password,
+		}
+	}
+
+	db, err := cluster.CreateSession()
+	if err != nil {
+		return fmt.Errorf("failed to connect to cassandra: %w", err)
+	}
+
+	h.db = db
+	if err := h.createTables(); err != nil {
+		h.db.Close()
+		h.db = nil
+		return fmt.Errorf("failed to create tables: %w", err)
+	}
+
+	h.Log.Info("connected to cassandra")
+
+	return nil
+}
+
+// createTables creates the keyspace and the tables of the records if they do not exist.
+// Each record is kept as the same json document as the redis storage hook writes. The
+// subscriptions and inflight messages of a client share a partition, so that they are
+// read, refreshed and deleted together.
+func (h *Hook) createTables() error {
+	for _, q := range []string{
+		fmt.Sprintf("create keyspace if not exists %s with replication = %s", quoteIdentifier(h.config.Keyspace), h.config.Replication),
+		fmt.Sprintf("create table if not exists %s (id text primary key, data blob)", h.table(storage.ClientKey)),
+		fmt.Sprintf("create table if not exists %s (client_id text, filter text, data blob, primary key (client_id, filter))", h.table(storage.SubscriptionKey)),
+		fmt.Sprintf("create table if not exists %s (topic text primary key, data blob)", h.table(storage.RetainedKey)),
+		fmt.Sprintf("create table if not exists %s (client_id text, id text, type int, data blob, primary key (client_id, id))", h.table(storage.InflightKey)),
+		fmt.Sprintf("create table if not exists %s (id text primary key, data blob)", h.table(storage.SysInfoKey)),
+	} {
+		if err := h.db.Query(q).WithContext(h.ctx).Consistency(gocql.All).Exec(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Stop closes the cassandra session.
+func (h *Hook) Stop() error {
+	h.Log.Info("disconnecting from cassandra")
+	if h.db != nil {
+		h.db.Close()
+	}
+
+	return nil
+}
+
+// Healthy queries the local node of the cluster, returning an error if it cannot be reached.
+func (h *Hook) Healthy() error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	ctx, cancel := context.WithTimeout(h.ctx, healthTimeout)
+	defer cancel()
+	var version string
+	return h.db.Query("select release_version from system.local").WithContext(ctx).Consistency(gocql.One).Scan(&version)
+}
+
+// StorageMetrics returns the writes and reads of the hook. The size of the tables is not
+// known to the driver, so it is not reported.
+func (h *Hook) StorageMetrics() mqtt.StorageMetrics {
+	return h.metrics.Metrics(h.ID(), 0, 0)
+}
+
+// exec runs a statement which writes to the store.
+func (h *Hook) exec(q string, args ...any) error {
+	start := time.Now()
+	err := h.db.Query(q, args...).WithContext(h.ctx).Consistency(h.write).Exec()
+	h.metrics.Write(start, err)
+	return err
+}
+
+// batch runs the statements added by a function as a logged batch, so that they are all
+// applied eventually if any is. The batch is counted as one write.
+func (h *Hook) batch(fn func(b *gocql.Batch) error) error {
+	start := time.Now()
+	b := h.db.NewBatch(gocql.LoggedBatch).WithContext(h.ctx)
+	b.SetConsistency(h.write)
+	err := fn(b)
+	if err == nil && b.Size() > 0 {
+		err = h.db.ExecuteBatch(b)
+	}
+	h.metrics.Write(start, err)
+	return err
+}
+
+// ttl returns the smallest of the ttls which are set, in seconds, 0 if none are. A ttl
+// which has already elapsed is 1, so that the record expires at once.
+func ttl(ttls ...int64) int64 {
+	var v int64
+	for _, t := range ttls {
+		if t == 0 {
+			continue
+		}
+		if t < 1 {
+			t = 1
+		}
+		if v == 0 || t < v {
+			v = t
+		}
+	}
+
+	return min(v, maxTTL)
+}
+
+// ageTTL returns the seconds left until a record created at a time reaches an age, 0 if
+// the age is disabled.
+func ageTTL(created int64, age time.Duration, now int64) int64 {
+	if age <= 0 {
+		return 0
+	}
+	return created + int64(age/time.Second) - now
+}
+
+// messageTTL returns the seconds left until a message expires, by its message expiry
+// interval or the age after which messages are deleted, 0 if it never expires.
+func messageTTL(msg *storage.Message, age time.Duration, now int64) int64 {
+	created := msg.Created
+	if created == 0 {
+		created = now
+	}
+
+	var expiry int64
+	if msg.Properties.MessageExpiryInterval > 0 {
+		expiry = created + int64(msg.Properties.MessageExpiryInterval) - now
+	}
+
+	return ttl(expiry, ageTTL(created, age, now))
+}
+
+// inflightTTL returns the ttl of an inflight message of a client whose session expires
+// after sessionTTL seconds. The stages of qos 2 exchanges are only removed with their
+// session, as their message has already been delivered.
+func (h *Hook) inflightTTL(msg *storage.Message, sessionTTL, now int64) int64 {
+	if msg.FixedHeader.Type == packets.Pubrec || msg.FixedHeader.Type == packets.Pubrel {
+		return sessionTTL
+	}
+
+	return ttl(sessionTTL, messageTTL(msg, h.config.Expiry.Inflight, now))
+}
+
+// sessionTTL returns the seconds left until the session of a disconnected client expires,
+// by the session age of the expiry or its session expiry interval, 0 while it is connected
+// or if it never expires. The session age counts from now, as the time the client
+// disconnected is not known to hooks.
+func (h *Hook) sessionTTL(cl *mqtt.Client, now int64) int64 {
+	if !cl.Closed() {
+		return 0
+	}
+
+	var interval int64
+	if h.config.Expiry.SessionInterval {
+		if expires := cl.SessionExpiry(); expires > 0 {
+			interval = expires - now
+		}
+	}
+
+	return ttl(int64(h.config.Expiry.Session/time.Second), interval)
+}
+
+// OnSessionEstablished adds a client to the store when their session is established.
+func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	in, err := h.client(cl).MarshalBinary()
+	if err != nil {
+		h.Log.Error("failed to marshal client data", "error", err, "id", clientKey(cl))
+		return
+	}
+
+	// on a clean start the subscriptions and inflight messages of the previous session are
+	// discarded in the same batch as the session record is written.
+	err = h.batch(func(b *gocql.Batch) error {
+		b.Query(fmt.Sprintf("insert into %s (id, data) values (?, ?)", h.table(storage.ClientKey)), clientKey(cl), in)
+		if cl.Properties.Clean {
+			h.deleteClientRows(b, clientKey(cl), storage.SubscriptionKey, storage.InflightKey)
+		}
+		return nil
+	})
+	if err != nil {
+		h.Log.Error("failed to establish session", "error", err, "id", clientKey(cl))
+		return
+	}
+
+	// a resumed session no longer expires while its client is connected.
+	if !cl.Properties.Clean && h.expiresSessions() {
+		h.refreshSession(cl, 0)
+	}
+}
+
+// OnWillSent is called when a client sends a Will Message and the Will Message is removed from the client record.
+func (h *Hook) OnWillSent(cl *mqtt.Client, pk packets.Packet) {
+	h.updateClient(cl)
+}
+
+// updateClient writes the client data to the store, expiring it with its session.
+func (h *Hook) updateClient(cl *mqtt.Client) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	in := h.client(cl)
+	data, err := in.MarshalBinary()
+	if err == nil {
+		q := fmt.Sprintf("insert into %s (id, data) values (?, ?) using ttl ?", h.table(storage.ClientKey))
+		err = h.exec(q, clientKey(cl), data, h.sessionTTL(cl, time.Now().Unix()))
+	}
+	if err != nil {
+		h.Log.Error("failed to save client data", "error", err, "data", in)
+	}
+}
+
+// deleteClientRows adds the deletion of the partitions of a client from the tables of some
+// kinds of record to a batch.
+func (h *Hook) deleteClientRows(b *gocql.Batch, id string, keys ...string) {
+	for _, key := range keys {
+		b.Query(fmt.Sprintf("delete from %s where client_id = ?", h.table(key)), id)
+	}
+}
+
+// expiresSessions returns true if stored sessions expire after their clients disconnect.
+func (h *Hook) expiresSessions() bool {
+	return h.config.Expiry.Session > 0 || h.config.Expiry.SessionInterval
+}
+
+// refreshSession rewrites the subscriptions and inflight messages of a client with the ttl
+// of its session, so that they expire together with the session record, or never while
+// the client is connected.
+func (h *Hook) refreshSession(cl *mqtt.Client, sessionTTL int64) {
+	now := time.Now().Unix()
+	err := h.batch(func(b *gocql.Batch) error {
+		subs, err := h.clientRows(storage.SubscriptionKey, clientKey(cl))
+		if err != nil {
+			return err
+		}
+
+		q := fmt.Sprintf("insert into %s (client_id, filter, data) values (?, ?, ?) using ttl ?", h.table(storage.SubscriptionKey))
+		for _, row := range subs {
+			var d storage.Subscription
+			if err := d.UnmarshalBinary(row); err != nil {
+				return err
+			}
+			b.Query(q, clientKey(cl), d.Filter, row, sessionTTL)
+		}
+
+		inflight, err := h.clientRows(storage.InflightKey, clientKey(cl))
+		if err != nil {
+			return err
+		}
+
+		q = fmt.Sprintf("insert into %s (client_id, id, type, data) values (?, ?, ?, ?) using ttl ?", h.table(storage.InflightKey))
+		for _, row := range inflight {
+			var d storage.Message
+			if err := d.UnmarshalBinary(row); err != nil {
+				return err
+			}
+			b.Query(q, clientKey(cl), strconv.FormatUint(uint64(d.PacketID), 10), int(d.FixedHeader.Type), row, h.inflightTTL(&d, sessionTTL, now))
+		}
+
+		return nil
+	})
+	if err != nil {
+		h.Log.Error("failed to refresh session expiry", "error", err, "id", clientKey(cl))
+	}
+}
+
+// client returns the storable session record of a client.
+func (h *Hook) client(cl *mqtt.Client) *storage.Client {
+	props := cl.Properties.Props.Copy(false)
+	in := &storage.Client{
+		ID:              clientKey(cl),
+		T:               storage.ClientKey,
+		Remote:          cl.Net.Remote,
+		Listener:        cl.Net.Listener,
+		Username:        cl.Properties.Username,
+		Clean:           cl.Properties.Clean,
+		ProtocolVersion: cl.Properties.ProtocolVersion,
+		Properties: storage.ClientProperties{
+			SessionExpiryInterval:     props.SessionExpiryInterval,
+			SessionExpiryIntervalFlag: props.SessionExpiryIntervalFlag,
+			AuthenticationMethod:      props.AuthenticationMethod,
+			AuthenticationData:        props.AuthenticationData,
+			RequestProblemInfo:        props.RequestProblemInfo,
+			RequestResponseInfo:       props.RequestResponseInfo,
+			ReceiveMaximum:            props.ReceiveMaximum,
+			TopicAliasMaximum:         props.TopicAliasMaximum,
+			User:                      props.User,
+			MaximumPacketSize:         props.MaximumPacketSize,
+		},
+		Will: storage.ClientWill(cl.Properties.Will),
+	}
+	if cl.Closed() {
+		in.Disconnected = time.Now().Unix()
+		in.Expires = cl.SessionExpiry()
+	}
+
+	return in
+}
+
+// OnDisconnect removes a client from the store if they were using a clean session, or
+// records the time they disconnected and sets the ttl of their session otherwise.
+func (h *Hook) OnDisconnect(cl *mqtt.Client, _ error, expire bool) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	if cl.StopCause() == packets.ErrSessionTakenOver {
+		return
+	}
+
+	if expire {
+		h.expireSession(cl)
+		return
+	}
+
+	h.updateClient(cl)
+	if h.expiresSessions() {
+		h.refreshSession(cl, h.sessionTTL(cl, time.Now().Unix()))
+	}
+}
+
+// expireSession removes the session record, subscriptions and inflight messages of a
+// client from the store in one batch.
+func (h *Hook) expireSession(cl *mqtt.Client) {
+	err := h.batch(func(b *gocql.Batch) error {
+		b.Query(fmt.Sprintf("delete from %s where id = ?", h.table(storage.ClientKey)), clientKey(cl))
+		h.deleteClientRows(b, clientKey(cl), storage.SubscriptionKey, storage.InflightKey)
+		return nil
+	})
+	if err != nil {
+		h.Log.Error("failed to delete client", "error", err, "id", clientKey(cl))
+	}
+}
+
+// OnSubscribed adds one or more client subscriptions to the store.
+func (h *Hook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte, counts []int) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	if len(pk.Filters) == 0 {
+		return
+	}
+
+	// all filters of the packet are written in one batch, with the ttl of the session if
+	// they are restored while the client is disconnected.
+	sessionTTL := h.sessionTTL(cl, time.Now().Unix())
+	q := fmt.Sprintf("insert into %s (client_id, filter, data) values (?, ?, ?) using ttl ?", h.table(storage.SubscriptionKey))
+	err := h.batch(func(b *gocql.Batch) error {
+		for i := 0; i < len(pk.Filters); i++ {
+			in := &storage.Subscription{
+				ID:     cl.ID + ":" + pk.Filters[i].Filter,
+				T:      storage.SubscriptionKey,
+				Client: cl.ID,
+				Filter: pk.Filters[i].Filter,
+				Qos:    reasonCodes[i],
+			}
+			if pk.ProtocolVersion == 5 {
+				in.Identifier = pk.Filters[i].Identifier
+				in.NoLocal = pk.Filters[i].NoLocal
+				in.RetainHandling = pk.Filters[i].RetainHandling
+				in.RetainAsPublished = pk.Filters[i].RetainAsPublished
+			}
+
+			data, err := in.MarshalBinary()
+			if err != nil {
+				return err
+			}
+
+			b.Query(q, cl.ID, in.Filter, data, sessionTTL)
+		}
+
+		return nil
+	})
+	if err != nil {
+		h.Log.Error("failed to save subscription data", "error", err, "id", clientKey(cl))
+	}
+}
+
+// OnUnsubscribed removes one or more client subscriptions from the store.
+func (h *Hook) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte, counts []int) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	if len(pk.Filters) == 0 {
+		return
+	}
+
+	filters := make([]string, len(pk.Filters))
+	for i := 0; i < len(pk.Filters); i++ {
+		filters[i] = pk.Filters[i].Filter
+	}
+
+	q := fmt.Sprintf("delete from %s where client_id = ? and filter in ?", h.table(storage.SubscriptionKey))
+	if err := h.exec(q, cl.ID, filters); err != nil {
+		h.Log.Error("failed to delete subscription data", "error", err, "id", clientKey(cl))
+	}
+}
+
+// OnRetainMessage adds a retained message for a topic to the store, expiring it with its
+// message expiry interval or the retained age of the expiry.
+func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	if r == -1 {
+		h.deleteRetained(pk.TopicName)
+		return
+	}
+
+	props := pk.Properties.Copy(false)
+	in := &storage.Message{
+		ID:          retainedKey(pk.TopicName),
+		T:           storage.RetainedKey,
+		FixedHeader: pk.FixedHeader,
+		TopicName:   pk.TopicName,
+		Payload:     pk.Payload,
+		Created:     pk.Created,
+		Origin:      pk.Origin,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			PayloadFormatFlag:      props.PayloadFormatFlag,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			TopicAlias:             props.TopicAlias,
+			User:                   props.User,
+		},
+	}
+
+	data, err := in.MarshalBinary()
+	if err == nil {
+		q := fmt.Sprintf("insert into %s (topic, data) values (?, ?) using ttl ?", h.table(storage.RetainedKey))
+		err = h.exec(q, retainedKey(pk.TopicName), data, messageTTL(in, h.config.Expiry.Retained, time.Now().Unix()))
+	}
+	if err != nil {
+		h.Log.Error("failed to save retained message data", "error", err, "data", in)
+	}
+}
+
+// deleteRetained deletes the retained message of a topic from the store.
+func (h *Hook) deleteRetained(topic string) {
+	q := fmt.Sprintf("delete from %s where topic = ?", h.table(storage.RetainedKey))
+	if err := h.exec(q, retainedKey(topic)); err != nil {
+		h.Log.Error("failed to delete retained message data", "error", err, "id", retainedKey(topic))
+	}
+}
+
+// OnQosPublish adds or updates an inflight message in the store, expiring it with its
+// message expiry interval, the inflight age of the expiry, or the session of a
+// disconnected client.
+func (h *Hook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, resends int) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	props := pk.Properties.Copy(false)
+	in := &storage.Message{
+		ID:          cl.ID + ":" + inflightKey(pk),
+		T:           storage.InflightKey,
+		Origin:      pk.Origin,
+		Client:      cl.ID,
+		PacketID:    pk.PacketID,
+		FixedHeader: pk.FixedHeader,
+		TopicName:   pk.TopicName,
+		Payload:     pk.Payload,
+		Sent:        sent,
+		Created:     pk.Created,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			PayloadFormatFlag:      props.PayloadFormatFlag,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			TopicAlias:             props.TopicAlias,
+			User:                   props.User,
+		},
+	}
+
+	data, err := in.MarshalBinary()
+	if err == nil {
+		now := time.Now().Unix()
+		err = h.saveInflight(cl.ID, inflightKey(pk), pk, data, h.inflightTTL(in, h.sessionTTL(cl, now), now))
+	}
+	if err != nil {
+		h.Log.Error("failed to save qos inflight message data", "error", err, "data", in)
+	}
+}
+
+// saveInflight writes an inflight message to the store. A message is not overwritten by
+// an earlier stage of the same qos flow, so a delayed Publish cannot replace its Pubrec or
+// Pubrel. Only qos 2 Publish writes can regress, so only they are made as lightweight
+// transactions, which insert the message if it is not stored and otherwise overwrite it
+// if the stored stage is also a Publish.
+func (h *Hook) saveInflight(cid, id string, pk packets.Packet, data []byte, ttl int64) error {
+	q := fmt.Sprintf("insert into %s (client_id, id, type, data) values (?, ?, ?, ?) using ttl ?", h.table(storage.InflightKey))
+	if pk.FixedHeader.Type != packets.Publish || pk.FixedHeader.Qos < 2 {
+		return h.exec(q, cid, id, int(pk.FixedHeader.Type), data, ttl)
+	}
+
+	start := time.Now()
+	stored := map[string]any{}
+	applied, err := h.db.Query(q+" if not exists", cid, id, int(pk.FixedHeader.Type), data, ttl).
+		WithContext(h.ctx).SerialConsistency(gocql.LocalSerial).MapScanCAS(stored)
+	if err == nil && !applied {
+		if t, ok := stored["type"].(int); !ok || t <= int(packets.Publish) {
+			err = h.db.Query(q, cid, id, int(pk.FixedHeader.Type), data, ttl).WithContext(h.ctx).Consistency(h.write).Exec()
+		}
+	}
+	h.metrics.Write(start, err)
+
+	return err
+}
+
+// OnQosComplete removes a resolved inflight message from the store.
+func (h *Hook) OnQosComplete(cl *mqtt.Client, pk packets.Packet) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	q := fmt.Sprintf("delete from %s where client_id = ? and id = ?", h.table(storage.InflightKey))
+	if err := h.exec(q, cl.ID, inflightKey(pk)); err != nil {
+		h.Log.Error("failed to delete qos inflight message data", "error", err, "id", cl.ID+":"+inflightKey(pk))
+	}
+}
+
+// OnQosDropped removes a dropped inflight message from the store.
+func (h *Hook) OnQosDropped(cl *mqtt.Client, pk packets.Packet) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+	}
+
+	h.OnQosComplete(cl, pk)
+}
+
+// OnSysInfoTick stores the latest system info in the store.
+func (h *Hook) OnSysInfoTick(sys *system.Info) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	in := &storage.SystemInfo{
+		ID:   sysInfoKey(),
+		T:    storage.SysInfoKey,
+		Info: *sys,
+	}
+
+	data, err := in.MarshalBinary()
+	if err == nil {
+		err = h.exec(fmt.Sprintf("insert into %s (id, data) values (?, ?)", h.table(storage.SysInfoKey)), sysInfoKey(), data)
+	}
+	if err != nil {
+		h.Log.Error("failed to save server info data", "error", err, "data", in)
+	}
+}
+
+// OnRetainedExpired deletes expired retained messages from the store.
+func (h *Hook) OnRetainedExpired(filter string) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	h.deleteRetained(filter)
+}
+
+// OnClientExpired deleted expired clients from the store.
+func (h *Hook) OnClientExpired(cl *mqtt.Client) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	h.expireSession(cl)
+}
+
+// scan reads the json documents returned by a query, page by page.
+func (h *Hook) scan(q string, args ...any) (v [][]byte, err error) {
+	start := time.Now()
+	defer func() { h.metrics.Read(start, err) }()
+
+	iter := h.db.Query(q, args...).WithContext(h.ctx).Consistency(h.read).Iter()
+	scanner := iter.Scanner()
+	for scanner.Next() {
+		var data []byte
+		if err := scanner.Scan(&data); err != nil {
+			_ = iter.Close()
+			return nil, err
+		}
+		v = append(v, data)
+	}
+
+	return v, scanner.Err()
+}
+
+// rows returns the json documents of the records of a table.
+func (h *Hook) rows(key string) ([][]byte, error) {
+	return h.scan(fmt.Sprintf("select data from %s", h.table(key)))
+}
+
+// clientRows returns the json documents of the records of a client in a table.
+func (h *Hook) clientRows(key, cid string) ([][]byte, error) {
+	return h.scan(fmt.Sprintf("select data from %s where client_id = ?", h.table(key)), cid)
+}
+
+// StoredClients returns all stored clients from the store.
+func (h *Hook) StoredClients() (v []storage.Client, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	rows, err := h.rows(storage.ClientKey)
+	if err != nil {
+		h.Log.Error("failed to select client data", "error", err)
+		return
+	}
+
+	for _, row := range rows {
+		var d storage.Client
+		if err = d.UnmarshalBinary(row); err != nil {
+			h.Log.Error("failed to unmarshal client data", "error", err, "data", row)
+		}
+
+		v = append(v, d)
+	}
+
+	return v, nil
+}
+
+// StoredSubscriptions returns all stored subscriptions from the store.
+func (h *Hook) StoredSubscriptions() (v []storage.Subscription, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	rows, err := h.rows(storage.SubscriptionKey)
+	if err != nil {
+		h.Log.Error("failed to select subscription data", "error", err)
+		return
+	}
+
+	for _, row := range rows {
+		var d storage.Subscription
+		if err = d.UnmarshalBinary(row); err != nil {
+			h.Log.Error("failed to unmarshal subscription data", "error", err, "data", row)
+		}
+
+		v = append(v, d)
+	}
+
+	return v, nil
+}
+
+// StoredRetainedMessages returns all stored retained messages from the store.
+func (h *Hook) StoredRetainedMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	rows, err := h.rows(storage.RetainedKey)
+	if err != nil {
+		h.Log.Error("failed to select retained message data", "error", err)
+		return
+	}
+
+	for _, row := range rows {
+		var d storage.Message
+		if err = d.UnmarshalBinary(row); err != nil {
+			h.Log.Error("failed to unmarshal retained message data", "error", err, "data", row)
+		}
+
+		v = append(v, d)
+	}
+
+	return v, nil
+}
+
+// StoredInflightMessages returns all stored inflight messages from the store.
+func (h *Hook) StoredInflightMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	rows, err := h.rows(storage.InflightKey)
+	if err != nil {
+		h.Log.Error("failed to select inflight message data", "error", err)
+		return
+	}
+
+	for _, row := range rows {
+		var d storage.Message
+		if err = d.UnmarshalBinary(row); err != nil {
+			h.Log.Error("failed to unmarshal inflight message data", "error", err, "data", row)
+		}
+
+		v = append(v, d)
+	}
+
+	return v, nil
+}
+
+// StoredRetainedMessage returns the retained message of a topic, and false if there is none.
+func (h *Hook) StoredRetainedMessage(topic string) (v storage.Message, ok bool, err error) {
+	if h.db == nil {
+		return v, false, storage.ErrDBFileNotOpen
+	}
+
+	rows, err := h.scan(fmt.Sprintf("select data from %s where topic = ?", h.table(storage.RetainedKey)), retainedKey(topic))
+	if err != nil || len(rows) == 0 {
+		return v, false, err
+	}
+
+	if err = v.UnmarshalBinary(rows[0]); err != nil {
+		return v, false, err
+	}
+
+	return v, true, nil
+}
+
+// StoredClientInflightMessages returns the inflight messages of a client.
+func (h *Hook) StoredClientInflightMessages(cid string) (v []storage.Message, err error) {
+	if h.db == nil {
+		return nil, storage.ErrDBFileNotOpen
+	}
+
+	rows, err := h.clientRows(storage.InflightKey, cid)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		var d storage.Message
+		if err = d.UnmarshalBinary(row); err != nil {
+			return nil, err
+		}
+		v = append(v, d)
+	}
+
+	return v, nil
+}
+
+// StoredSysInfo returns the system info from the store.
+func (h *Hook) StoredSysInfo() (v storage.SystemInfo, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	rows, err := h.scan(fmt.Sprintf("select data from %s where id = ?", h.table(storage.SysInfoKey)), sysInfoKey())
+	if err != nil || len(rows) == 0 {
+		return
+	}
+
+	if err = v.UnmarshalBinary(rows[0]); err != nil {
+		h.Log.Error("failed to unmarshal sys info data", "error", err, "data", rows[0])
+	}
+
+	return v, nil
+}
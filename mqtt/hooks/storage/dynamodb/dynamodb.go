@@ -0,0 +1,1131 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+// Package dynamodb is a persistent storage hook keeping the sessions, subscriptions, retained
+// and inflight messages of a broker in an AWS DynamoDB table, for AWS deployments which would
+// otherwise run redis only to persist them. Records expire with the native ttl of the table.
+package dynamodb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/mqtt/system"
+)
+
+const (
+	defaultTable        = "comqtt"
+	defaultTTLAttribute = "expires"
+	defaultCapacity     = 5
+
+	// BillingOnDemand bills the table per request, and BillingProvisioned by its read and write capacity.
+	BillingOnDemand    = "on-demand"
+	BillingProvisioned = "provisioned"
+
+	// healthTimeout is the time allowed for the table to be described by a health check.
+	healthTimeout = 2 * time.Second
+
+	// createTimeout is the time allowed for a created table to become active.
+	createTimeout = 2 * time.Minute
+
+	// batchSize is the most items written by a single batch write.
+	batchSize = 25
+
+	// the names of the key and record attributes of the items.
+	attrPartition = "pk"
+	attrSort      = "sk"
+	attrType      = "t"
+	attrStage     = "st"
+	attrData      = "data"
+)
+
+var (
+	ErrInvalidBillingMode = errors.New("invalid dynamodb billing mode")
+)
+
+// clientPartition returns the partition key shared by the session record, subscriptions and
+// inflight messages of a client.
+func clientPartition(id string) string {
+	return storage.ClientKey + "#" + id
+}
+
+// clientKey returns the sort key of the session record of a client.
+func clientKey(cl *mqtt.Client) string {
+	return storage.ClientKey
+}
+
+// subscriptionKey returns the sort key of a subscription of a client.
+func subscriptionKey(filter string) string {
+	return storage.SubscriptionKey + "#" + filter
+}
+
+// retainedKey returns the partition key of a retained message.
+func retainedKey(topic string) string {
+	return storage.RetainedKey + "#" + topic
+}
+
+// inflightKey returns the sort key of an inflight message of a client.
+func inflightKey(id uint16) string {
+	return storage.InflightKey + "#" + strconv.FormatUint(uint64(id), 10)
+}
+
+// sysInfoKey returns the partition key of system info.
+func sysInfoKey() string {
+	return storage.SysInfoKey
+}
+
+// Options contains configuration settings for the dynamodb table.
+type Options struct {
+	Table           string // name of the table, created if it does not exist
+	Region          string // region of the table, from the aws configuration of the environment if empty
+	Endpoint        string // endpoint of the service, such as http://localhost:8000 for dynamodb local
+	AccessKeyID     string // static credentials, from the aws configuration of the environment if empty
+	SecretAccessKey string
+
+	// BillingMode of the table if it is created, on-demand or provisioned with the ReadCapacity
+	// and WriteCapacity units, 5 each if 0. Defaults to on-demand.
+	BillingMode   string
+	ReadCapacity  int64
+	WriteCapacity int64
+
+	TTLAttribute   string // attribute holding the unix time items expire at, enabled as the ttl of a created table
+	ConsistentRead bool   // read with strongly consistent reads rather than eventually consistent ones
+
+	// Expiry sets the times items expire at. The ages of retained and inflight messages count
+	// from when they were published, and the session age from when its client disconnected.
+	Expiry storage.Expiry
+}
+
+// Hook is a persistent storage hook using an AWS DynamoDB table as a backend.
+type Hook struct {
+	mqtt.HookBase
+	config  *Options             // options for connecting to the table.
+	db      *dynamodb.Client     // the dynamodb client.
+	ctx     context.Context      // a context for the requests
+	metrics mqtt.StorageRecorder // counts the writes and reads of the hook
+}
+
+// ID returns the id of the hook.
+func (h *Hook) ID() string {
+	return "dynamodb-db"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+		mqtt.OnSubscribed,
+		mqtt.OnUnsubscribed,
+		mqtt.OnRetainMessage,
+		mqtt.OnQosPublish,
+		mqtt.OnQosComplete,
+		mqtt.OnQosDropped,
+		mqtt.OnWillSent,
+		mqtt.OnSysInfoTick,
+		mqtt.OnClientExpired,
+		mqtt.OnRetainedExpired,
+		mqtt.StoredClients,
+		mqtt.StoredInflightMessages,
+		mqtt.StoredRetainedMessages,
+		mqtt.StoredSubscriptions,
+		mqtt.StoredSysInfo,
+	}, []byte{b})
+}
+
+// Init initializes the dynamodb client, creating the table if it does not exist.
+func (h *Hook) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	h.ctx = context.Background()
+
+	if config == nil {
+		config = new(Options)
+	}
+
+	h.config = config.(*Options)
+	if h.config.Table == "" {
+		h.config.Table = defaultTable
+	}
+	if h.config.TTLAttribute == "" {
+		h.config.TTLAttribute = defaultTTLAttribute
+	}
+	switch strings.ToLower(h.config.BillingMode) {
+	case "", BillingOnDemand:
+		h.config.BillingMode = BillingOnDemand
+	case BillingProvisioned:
+		h.config.BillingMode = BillingProvisioned
+		if h.config.ReadCapacity <= 0 {
+			h.config.ReadCapacity = defaultCapacity
+		}
+		if h.config.WriteCapacity <= 0 {
+			h.config.WriteCapacity = defaultCapacity
+		}
+	default:
+		return fmt.Errorf("%w: %s", ErrInvalidBillingMode, h.config.BillingMode)
+	}
+
+	h.Log.Info("connecting to dynamodb", "table", h.config.Table, "region", h.config.Region, "endpoint", h.config.Endpoint)
+
+	db, err := h.client()
+	if err != nil {
+		return fmt.Errorf("failed to configure dynamodb: %w", err)
+	}
+
+	h.db = db
+	if err := h.createTable(); err != nil {
+		h.db = nil
+		return fmt.Errorf("failed to create table: %w", err)
+	}
+
+	h.Log.Info("connected to dynamodb")
+
+	return nil
+}
+
+// client returns a dynamodb client configured by the options and the aws configuration of
+// the environment.
+func (h *Hook) client() (*dynamodb.Client, error) {
+	var opts []func(*awsconfig.LoadOptions) error
+	if h.config.Region != "" {
+		opts = append(opts, awsconfig.WithRegion(h.config.Region))
+	}
+	if h.config.AccessKeyID != "" {
+		opts = append(opts, awsconfig.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(h.config.AccessKeyID, h.config.SecretAccessKey, "")))
+	}
+
+	cfg, err := awsconfig.LoadDefaultConfig(h.ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+		if h.config.Endpoint != "" {
+			o.BaseEndpoint = aws.String(h.config.Endpoint)
+		}
+	}), nil
+}
+
+// createTable creates the table if it does not exist, with ttl enabled on the ttl attribute.
+// Each record is kept as an item with the same json document as the redis storage hook
+// writes. The session record, subscriptions and inflight messages of a client share a
+// partition, so that they are read, refreshed and deleted with one query.
+func (h *Hook) createTable() error {
+	_, err := h.db.DescribeTable(h.ctx, &dynamodb.DescribeTableInput{TableName: aws.String(h.config.Table)})
+	if err == nil {
+		return nil
+	}
+
+	var notFound *types.ResourceNotFoundException
+	if !errors.As(err, &notFound) {
+		return err
+	}
+
+	in := &dynamodb.CreateTableInput{
+		TableName: aws.String(h.config.Table),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String(attrPartition), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String(attrSort), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String(attrPartition), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String(attrSort), KeyType: types.KeyTypeRange},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	}
+	if h.config.BillingMode == BillingProvisioned {
+		in.BillingMode = types.BillingModeProvisioned
+		in.ProvisionedThroughput = &types.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(h.config.ReadCapacity),
+			WriteCapacityUnits: aws.Int64(h.config.WriteCapacity),
+		}
+	}
+
+	h.Log.Info("creating dynamodb table", "table", h.config.Table, "billing_mode", h.config.BillingMode)
+	if _, err := h.db.CreateTable(h.ctx, in); err != nil {
+		var inUse *types.ResourceInUseException
+		if !errors.As(err, &inUse) { // created by another broker meanwhile
+			return err
+		}
+	}
+
+	err = dynamodb.NewTableExistsWaiter(h.db).Wait(h.ctx, &dynamodb.DescribeTableInput{TableName: aws.String(h.config.Table)}, createTimeout)
+	if err != nil {
+		return err
+	}
+
+	_, err = h.db.UpdateTimeToLive(h.ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(h.config.Table),
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{
+			AttributeName: aws.String(h.config.TTLAttribute),
+			Enabled:       aws.Bool(true),
+		},
+	})
+
+	return err
+}
+
+// Stop closes the hook. The dynamodb client holds no connections which need closing.
+func (h *Hook) Stop() error {
+	h.Log.Info("disconnecting from dynamodb")
+	return nil
+}
+
+// Healthy describes the table, returning an error if it cannot be reached.
+func (h *Hook) Healthy() error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	ctx, cancel := context.WithTimeout(h.ctx, healthTimeout)
+	defer cancel()
+	_, err := h.db.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(h.config.Table)})
+	return err
+}
+
+// StorageMetrics returns the writes and reads of the hook, and the size of the table, which
+// dynamodb updates about every six hours.
+func (h *Hook) StorageMetrics() mqtt.StorageMetrics {
+	var size int64
+	if h.db != nil {
+		ctx, cancel := context.WithTimeout(h.ctx, healthTimeout)
+		defer cancel()
+		if out, err := h.db.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(h.config.Table)}); err == nil {
+			size = aws.ToInt64(out.Table.TableSizeBytes)
+		}
+	}
+
+	return h.metrics.Metrics(h.ID(), 0, size)
+}
+
+// expiresAt returns the earliest of the unix times which are set, 0 if none are.
+func expiresAt(times ...int64) int64 {
+	var v int64
+	for _, t := range times {
+		if t > 0 && (v == 0 || t < v) {
+			v = t
+		}
+	}
+
+	return v
+}
+
+// messageExpires returns the unix time a message expires at, by its message expiry
+// interval or the age after which messages are deleted, 0 if it never expires.
+func messageExpires(msg *storage.Message, age time.Duration, now int64) int64 {
+	created := msg.Created
+	if created == 0 {
+		created = now
+	}
+
+	var expiry, aged int64
+	if msg.Properties.MessageExpiryInterval > 0 {
+		expiry = created + int64(msg.Properties.MessageExpiryInterval)
+	}
+	if age > 0 {
+		aged = created + int64(age/time.Second)
+	}
+
+	return expiresAt(expiry, aged)
+}
+
+// sessionExpires returns the unix time the session of a disconnected client expires at, by
+// the session age of the expiry or its session expiry interval, 0 while it is connected or
+// if it never expires.
+func (h *Hook) sessionExpires(cl *mqtt.Client, now int64) int64 {
+	if !cl.Closed() {
+		return 0
+	}
+
+	var aged, interval int64
+	if h.config.Expiry.Session > 0 {
+		aged = now + int64(h.config.Expiry.Session/time.Second)
+	}
+	if h.config.Expiry.SessionInterval {
+		interval = cl.SessionExpiry()
+	}
+
+	return expiresAt(aged, interval)
+}
+
+// inflightExpires returns the unix time an inflight message of a client whose session
+// expires at session expires at. The stages of qos 2 exchanges are only removed with their
+// session, as their message has already been delivered.
+func (h *Hook) inflightExpires(msg *storage.Message, session, now int64) int64 {
+	if msg.FixedHeader.Type == packets.Pubrec || msg.FixedHeader.Type == packets.Pubrel {
+		return session
+	}
+
+	return expiresAt(session, messageExpires(msg, h.config.Expiry.Inflight, now))
+}
+
+// item returns a dynamodb item holding a record, expiring at a unix time if it is set.
+func (h *Hook) item(pk, sk, t string, data []byte, expires int64) map[string]types.AttributeValue {
+	v := map[string]types.AttributeValue{
+		attrPartition: &types.AttributeValueMemberS{Value: pk},
+		attrSort:      &types.AttributeValueMemberS{Value: sk},
+		attrType:      &types.AttributeValueMemberS{Value: t},
+		attrData:      &types.AttributeValueMemberB{Value: data},
+	}
+	if expires > 0 {
+		v[h.config.TTLAttribute] = &types.AttributeValueMemberN{Value: strconv.FormatInt(expires, 10)}
+	}
+
+	return v
+}
+
+// key returns the primary key of an item.
+func key(pk, sk string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		attrPartition: &types.AttributeValueMemberS{Value: pk},
+		attrSort:      &types.AttributeValueMemberS{Value: sk},
+	}
+}
+
+// put writes an item to the table.
+func (h *Hook) put(item map[string]types.AttributeValue) error {
+	start := time.Now()
+	_, err := h.db.PutItem(h.ctx, &dynamodb.PutItemInput{TableName: aws.String(h.config.Table), Item: item})
+	h.metrics.Write(start, err)
+	return err
+}
+
+// delete deletes an item from the table.
+func (h *Hook) delete(pk, sk string) error {
+	start := time.Now()
+	_, err := h.db.DeleteItem(h.ctx, &dynamodb.DeleteItemInput{TableName: aws.String(h.config.Table), Key: key(pk, sk)})
+	h.metrics.Write(start, err)
+	return err
+}
+
+// batch applies put and delete requests in batches of up to 25, retrying the requests
+// which were not processed. Each batch is counted as one write.
+func (h *Hook) batch(reqs []types.WriteRequest) error {
+	for len(reqs) > 0 {
+		n := min(len(reqs), batchSize)
+		start := time.Now()
+		out, err := h.db.BatchWriteItem(h.ctx, &dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]types.WriteRequest{h.config.Table: reqs[:n]},
+		})
+		h.metrics.Write(start, err)
+		if err != nil {
+			return err
+		}
+
+		reqs = append(out.UnprocessedItems[h.config.Table], reqs[n:]...)
+	}
+
+	return nil
+}
+
+// OnSessionEstablished adds a client to the store when their session is established. On a
+// clean start the subscriptions and inflight messages of the previous session are discarded,
+// and a resumed session no longer expires while its client is connected.
+func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	if cl.Properties.Clean {
+		h.clearSession(cl)
+	} else if h.expiresSessions() {
+		h.refreshSession(cl, 0)
+	}
+
+	h.updateClient(cl)
+}
+
+// OnWillSent is called when a client sends a Will Message and the Will Message is removed from the client record.
+func (h *Hook) OnWillSent(cl *mqtt.Client, pk packets.Packet) {
+	h.updateClient(cl)
+}
+
+// updateClient writes the client data to the store, expiring it with its session.
+func (h *Hook) updateClient(cl *mqtt.Client) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	in := h.clientRecord(cl)
+	data, err := in.MarshalBinary()
+	if err == nil {
+		err = h.put(h.item(clientPartition(cl.ID), clientKey(cl), storage.ClientKey, data, h.sessionExpires(cl, time.Now().Unix())))
+	}
+	if err != nil {
+		h.Log.Error("failed to save client data", "error", err, "data", in)
+	}
+}
+
+// clientRecord returns the storable session record of a client.
+func (h *Hook) clientRecord(cl *mqtt.Client) *storage.Client {
+	props := cl.Properties.Props.Copy(false)
+	in := &storage.Client{
+		ID:              cl.ID,
+		T:               storage.ClientKey,
+		Remote:          cl.Net.Remote,
+		Listener:        cl.Net.Listener,
+		Username:        cl.Properties.Username,
+		Clean:           cl.Properties.Clean,
+		ProtocolVersion: cl.Properties.ProtocolVersion,
+		Properties: storage.ClientProperties{
+			SessionExpiryInterval:     props.SessionExpiryInterval,
+			SessionExpiryIntervalFlag: props.SessionExpiryIntervalFlag,
+			AuthenticationMethod:      props.AuthenticationMethod,
+			AuthenticationData:        props.AuthenticationData,
+			RequestProblemInfo:        props.RequestProblemInfo,
+			RequestResponseInfo:       props.RequestResponseInfo,
+			ReceiveMaximum:            props.ReceiveMaximum,
+			TopicAliasMaximum:         props.TopicAliasMaximum,
+			User:                      props.User,
+			MaximumPacketSize:         props.MaximumPacketSize,
+		},
+		Will: storage.ClientWill(cl.Properties.Will),
+	}
+	if cl.Closed() {
+		in.Disconnected = time.Now().Unix()
+		in.Expires = cl.SessionExpiry()
+	}
+
+	return in
+}
+
+// expiresSessions returns true if stored sessions expire after their clients disconnect.
+func (h *Hook) expiresSessions() bool {
+	return h.config.Expiry.Session > 0 || h.config.Expiry.SessionInterval
+}
+
+// clientItems returns the items of the partition of a client whose sort keys begin with a
+// prefix, or all of them if it is empty.
+func (h *Hook) clientItems(cid, prefix string) (v []map[string]types.AttributeValue, err error) {
+	start := time.Now()
+	defer func() { h.metrics.Read(start, err) }()
+
+	in := &dynamodb.QueryInput{
+		TableName:                 aws.String(h.config.Table),
+		KeyConditionExpression:    aws.String("#pk = :pk"),
+		ExpressionAttributeNames:  map[string]string{"#pk": attrPartition},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":pk": &types.AttributeValueMemberS{Value: clientPartition(cid)}},
+		ConsistentRead:            aws.Bool(h.config.ConsistentRead),
+	}
+	if prefix != "" {
+		in.KeyConditionExpression = aws.String("#pk = :pk and begins_with(#sk, :sk)")
+		in.ExpressionAttributeNames["#sk"] = attrSort
+		in.ExpressionAttributeValues[":sk"] = &types.AttributeValueMemberS{Value: prefix}
+	}
+	h.unexpired(&in.FilterExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+
+	p := dynamodb.NewQueryPaginator(h.db, in)
+	for p.HasMorePages() {
+		out, err := p.NextPage(h.ctx)
+		if err != nil {
+			return nil, err
+		}
+		v = append(v, out.Items...)
+	}
+
+	return v, nil
+}
+
+// unexpired sets a filter expression skipping items which have expired but not yet been
+// deleted, as dynamodb deletes expired items some time after they expire.
+func (h *Hook) unexpired(filter **string, names map[string]string, values map[string]types.AttributeValue) {
+	names["#ttl"] = h.config.TTLAttribute
+	values[":now"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)}
+	expr := "(attribute_not_exists(#ttl) or #ttl > :now)"
+	if *filter != nil {
+		expr = **filter + " and " + expr
+	}
+	*filter = aws.String(expr)
+}
+
+// clearSession deletes the subscriptions and inflight messages of a client.
+func (h *Hook) clearSession(cl *mqtt.Client) {
+	items, err := h.clientItems(cl.ID, "")
+	if err != nil {
+		h.Log.Error("failed to select client session", "error", err, "id", cl.ID)
+		return
+	}
+
+	var reqs []types.WriteRequest
+	for _, item := range items {
+		if sk, _ := attrString(item, attrSort); sk != clientKey(cl) {
+			reqs = append(reqs, types.WriteRequest{DeleteRequest: &types.DeleteRequest{Key: key(clientPartition(cl.ID), sk)}})
+		}
+	}
+
+	if err := h.batch(reqs); err != nil {
+		h.Log.Error("failed to clear client session", "error", err, "id", cl.ID)
+	}
+}
+
+// refreshSession rewrites the subscriptions and inflight messages of a client to expire with
+// its session at a unix time, or never while the client is connected if it is 0.
+func (h *Hook) refreshSession(cl *mqtt.Client, session int64) {
+	items, err := h.clientItems(cl.ID, "")
+	if err != nil {
+		h.Log.Error("failed to select client session", "error", err, "id", cl.ID)
+		return
+	}
+
+	now := time.Now().Unix()
+	var reqs []types.WriteRequest
+	for _, item := range items {
+		sk, _ := attrString(item, attrSort)
+		t, _ := attrString(item, attrType)
+		data, _ := item[attrData].(*types.AttributeValueMemberB)
+		if data == nil {
+			continue
+		}
+
+		var refreshed map[string]types.AttributeValue
+		switch t {
+		case storage.SubscriptionKey:
+			refreshed = h.item(clientPartition(cl.ID), sk, t, data.Value, session)
+		case storage.InflightKey:
+			var d storage.Message
+			if err := d.UnmarshalBinary(data.Value); err != nil {
+				h.Log.Error("failed to unmarshal inflight message data", "error", err, "data", data.Value)
+				continue
+			}
+			refreshed = h.item(clientPartition(cl.ID), sk, t, data.Value, h.inflightExpires(&d, session, now))
+			refreshed[attrStage] = item[attrStage]
+		default:
+			continue
+		}
+
+		reqs = append(reqs, types.WriteRequest{PutRequest: &types.PutRequest{Item: refreshed}})
+	}
+
+	if err := h.batch(reqs); err != nil {
+		h.Log.Error("failed to refresh session expiry", "error", err, "id", cl.ID)
+	}
+}
+
+// attrString returns the value of a string attribute of an item.
+func attrString(item map[string]types.AttributeValue, name string) (string, bool) {
+	v, ok := item[name].(*types.AttributeValueMemberS)
+	if !ok {
+		return "", false
+	}
+	return v.Value, true
+}
+
+// OnDisconnect removes a client from the store if they were using a clean session, or
+// records the time they disconnected and sets the expiry of their session otherwise.
+func (h *Hook) OnDisconnect(cl *mqtt.Client, _ error, expire bool) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	if cl.StopCause() == packets.ErrSessionTakenOver {
+		return
+	}
+
+	if expire {
+		h.expireSession(cl)
+		return
+	}
+
+	h.updateClient(cl)
+	if h.expiresSessions() {
+		h.refreshSession(cl, h.sessionExpires(cl, time.Now().Unix()))
+	}
+}
+
+// expireSession removes the session record, subscriptions and inflight messages of a client
+// from the store.
+func (h *Hook) expireSession(cl *mqtt.Client) {
+	h.clearSession(cl)
+	if err := h.delete(clientPartition(cl.ID), clientKey(cl)); err != nil {
+		h.Log.Error("failed to delete client", "error", err, "id", cl.ID)
+	}
+}
+
+// OnSubscribed adds one or more client subscriptions to the store.
+func (h *Hook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte, counts []int) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	session := h.sessionExpires(cl, time.Now().Unix())
+	reqs := make([]types.WriteRequest, 0, len(pk.Filters))
+	for i := 0; i < len(pk.Filters); i++ {
+		in := &storage.Subscription{
+			ID:     cl.ID + ":" + pk.Filters[i].Filter,
+			T:      storage.SubscriptionKey,
+			Client: cl.ID,
+			Filter: pk.Filters[i].Filter,
+			Qos:    reasonCodes[i],
+		}
+		if pk.ProtocolVersion == 5 {
+			in.Identifier = pk.Filters[i].Identifier
+			in.NoLocal = pk.Filters[i].NoLocal
+			in.RetainHandling = pk.Filters[i].RetainHandling
+			in.RetainAsPublished = pk.Filters[i].RetainAsPublished
+		}
+
+		data, err := in.MarshalBinary()
+		if err != nil {
+			h.Log.Error("failed to marshal subscription data", "error", err, "data", in)
+			return
+		}
+
+		item := h.item(clientPartition(cl.ID), subscriptionKey(in.Filter), storage.SubscriptionKey, data, session)
+		reqs = append(reqs, types.WriteRequest{PutRequest: &types.PutRequest{Item: item}})
+	}
+
+	if err := h.batch(reqs); err != nil {
+		h.Log.Error("failed to save subscription data", "error", err, "id", cl.ID)
+	}
+}
+
+// OnUnsubscribed removes one or more client subscriptions from the store.
+func (h *Hook) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte, counts []int) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	reqs := make([]types.WriteRequest, 0, len(pk.Filters))
+	for i := 0; i < len(pk.Filters); i++ {
+		reqs = append(reqs, types.WriteRequest{DeleteRequest: &types.DeleteRequest{
+			Key: key(clientPartition(cl.ID), subscriptionKey(pk.Filters[i].Filter)),
+		}})
+	}
+
+	if err := h.batch(reqs); err != nil {
+		h.Log.Error("failed to delete subscription data", "error", err, "id", cl.ID)
+	}
+}
+
+// OnRetainMessage adds a retained message for a topic to the store, expiring it with its
+// message expiry interval or the retained age of the expiry.
+func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	if r == -1 {
+		h.deleteRetained(pk.TopicName)
+		return
+	}
+
+	props := pk.Properties.Copy(false)
+	in := &storage.Message{
+		ID:          pk.TopicName,
+		T:           storage.RetainedKey,
+		FixedHeader: pk.FixedHeader,
+		TopicName:   pk.TopicName,
+		Payload:     pk.Payload,
+		Created:     pk.Created,
+		Origin:      pk.Origin,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			PayloadFormatFlag:      props.PayloadFormatFlag,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			TopicAlias:             props.TopicAlias,
+			User:                   props.User,
+		},
+	}
+
+	data, err := in.MarshalBinary()
+	if err == nil {
+		expires := messageExpires(in, h.config.Expiry.Retained, time.Now().Unix())
+		err = h.put(h.item(retainedKey(pk.TopicName), storage.RetainedKey, storage.RetainedKey, data, expires))
+	}
+	if err != nil {
+		h.Log.Error("failed to save retained message data", "error", err, "data", in)
+	}
+}
+
+// deleteRetained deletes the retained message of a topic from the store.
+func (h *Hook) deleteRetained(topic string) {
+	if err := h.delete(retainedKey(topic), storage.RetainedKey); err != nil {
+		h.Log.Error("failed to delete retained message data", "error", err, "id", topic)
+	}
+}
+
+// OnQosPublish adds or updates an inflight message in the store, expiring it with its
+// message expiry interval, the inflight age of the expiry, or the session of a disconnected
+// client. A message is not overwritten by an earlier stage of the same qos flow, so a
+// delayed Publish cannot replace its Pubrec or Pubrel.
+func (h *Hook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, resends int) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	props := pk.Properties.Copy(false)
+	in := &storage.Message{
+		ID:          cl.ID + ":" + pk.FormatID(),
+		T:           storage.InflightKey,
+		Origin:      pk.Origin,
+		Client:      cl.ID,
+		PacketID:    pk.PacketID,
+		FixedHeader: pk.FixedHeader,
+		TopicName:   pk.TopicName,
+		Payload:     pk.Payload,
+		Sent:        sent,
+		Created:     pk.Created,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			PayloadFormatFlag:      props.PayloadFormatFlag,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			TopicAlias:             props.TopicAlias,
+			User:                   props.User,
+		},
+	}
+
+	data, err := in.MarshalBinary()
+	if err != nil {
+		h.Log.Error("failed to marshal qos inflight message data", "error", err, "data", in)
+		return
+	}
+
+	now := time.Now().Unix()
+	item := h.item(clientPartition(cl.ID), inflightKey(pk.PacketID), storage.InflightKey, data, h.inflightExpires(in, h.sessionExpires(cl, now), now))
+	stage := &types.AttributeValueMemberN{Value: strconv.Itoa(int(pk.FixedHeader.Type))}
+	item[attrStage] = stage
+
+	start := time.Now()
+	_, err = h.db.PutItem(h.ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(h.config.Table),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(#st) or #st <= :st or #ttl <= :now"),
+		ExpressionAttributeNames: map[string]string{
+			"#st":  attrStage,
+			"#ttl": h.config.TTLAttribute,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":st":  stage,
+			":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(now, 10)},
+		},
+	})
+
+	var stale *types.ConditionalCheckFailedException
+	if errors.As(err, &stale) {
+		err = nil // a later stage is already stored
+	}
+	h.metrics.Write(start, err)
+	if err != nil {
+		h.Log.Error("failed to save qos inflight message data", "error", err, "data", in)
+	}
+}
+
+// OnQosComplete removes a resolved inflight message from the store.
+func (h *Hook) OnQosComplete(cl *mqtt.Client, pk packets.Packet) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	if err := h.delete(clientPartition(cl.ID), inflightKey(pk.PacketID)); err != nil {
+		h.Log.Error("failed to delete qos inflight message data", "error", err, "id", cl.ID+":"+pk.FormatID())
+	}
+}
+
+// OnQosDropped removes a dropped inflight message from the store.
+func (h *Hook) OnQosDropped(cl *mqtt.Client, pk packets.Packet) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+	}
+
+	h.OnQosComplete(cl, pk)
+}
+
+// OnSysInfoTick stores the latest system info in the store.
+func (h *Hook) OnSysInfoTick(sys *system.Info) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	in := &storage.SystemInfo{
+		ID:   sysInfoKey(),
+		T:    storage.SysInfoKey,
+		Info: *sys,
+	}
+
+	data, err := in.MarshalBinary()
+	if err == nil {
+		err = h.put(h.item(sysInfoKey(), storage.SysInfoKey, storage.SysInfoKey, data, 0))
+	}
+	if err != nil {
+		h.Log.Error("failed to save server info data", "error", err, "data", in)
+	}
+}
+
+// OnRetainedExpired deletes expired retained messages from the store.
+func (h *Hook) OnRetainedExpired(filter string) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	h.deleteRetained(filter)
+}
+
+// OnClientExpired deleted expired clients from the store.
+func (h *Hook) OnClientExpired(cl *mqtt.Client) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	h.expireSession(cl)
+}
+
+// records returns the json documents of the unexpired items of a kind of record, scanning
+// the whole table.
+func (h *Hook) records(t string) (v [][]byte, err error) {
+	start := time.Now()
+	defer func() { h.metrics.Read(start, err) }()
+
+	in := &dynamodb.ScanInput{
+		TableName:                 aws.String(h.config.Table),
+		FilterExpression:          aws.String("#t = :t"),
+		ExpressionAttributeNames:  map[string]string{"#t": attrType},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":t": &types.AttributeValueMemberS{Value: t}},
+		ConsistentRead:            aws.Bool(h.config.ConsistentRead),
+	}
+	h.unexpired(&in.FilterExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+
+	p := dynamodb.NewScanPaginator(h.db, in)
+	for p.HasMorePages() {
+		out, err := p.NextPage(h.ctx)
+		if err != nil {
+			return nil, err
+		}
+		v = append(v, itemData(out.Items)...)
+	}
+
+	return v, nil
+}
+
+// itemData returns the json documents of items.
+func itemData(items []map[string]types.AttributeValue) [][]byte {
+	v := make([][]byte, 0, len(items))
+	for _, item := range items {
+		if data, ok := item[attrData].(*types.AttributeValueMemberB); ok {
+			v = append(v, data.Value)
+		}
+	}
+
+	return v
+}
+
+// record returns the json document of an unexpired item, or nil if there is none.
+func (h *Hook) record(pk, sk string) (v []byte, err error) {
+	start := time.Now()
+	defer func() { h.metrics.Read(start, err) }()
+
+	out, err := h.db.GetItem(h.ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(h.config.Table),
+		Key:            key(pk, sk),
+		ConsistentRead: aws.Bool(h.config.ConsistentRead),
+	})
+	if err != nil || out.Item == nil {
+		return nil, err
+	}
+
+	if ttl, ok := out.Item[h.config.TTLAttribute].(*types.AttributeValueMemberN); ok {
+		if expires, _ := strconv.ParseInt(ttl.Value, 10, 64); expires > 0 && expires <= time.Now().Unix() {
+			return nil, nil
+		}
+	}
+
+	if data, ok := out.Item[attrData].(*types.AttributeValueMemberB); ok {
+		return data.Value, nil
+	}
+
+	return nil, nil
+}
+
+// StoredClients returns all stored clients from the store.
+func (h *Hook) StoredClients() (v []storage.Client, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	rows, err := h.records(storage.ClientKey)
+	if err != nil {
+		h.Log.Error("failed to scan client data", "error", err)
+		return
+	}
+
+	for _, row := range rows {
+		var d storage.Client
+		if err = d.UnmarshalBinary(row); err != nil {
+			h.Log.Error("failed to unmarshal client data", "error", err, "data", row)
+		}
+
+		v = append(v, d)
+	}
+
+	return v, nil
+}
+
+// StoredSubscriptions returns all stored subscriptions from the store.
+func (h *Hook) StoredSubscriptions() (v []storage.Subscription, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	rows, err := h.records(storage.SubscriptionKey)
+	if err != nil {
+		h.Log.Error("failed to scan subscription data", "error", err)
+		return
+	}
+
+	for _, row := range rows {
+		var d storage.Subscription
+		if err = d.UnmarshalBinary(row); err != nil {
+			h.Log.Error("failed to unmarshal subscription data", "error", err, "data", row)
+		}
+
+		v = append(v, d)
+	}
+
+	return v, nil
+}
+
+// StoredRetainedMessages returns all stored retained messages from the store.
+func (h *Hook) StoredRetainedMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	rows, err := h.records(storage.RetainedKey)
+	if err != nil {
+		h.Log.Error("failed to scan retained message data", "error", err)
+		return
+	}
+
+	for _, row := range rows {
+		var d storage.Message
+		if err = d.UnmarshalBinary(row); err != nil {
+			h.Log.Error("failed to unmarshal retained message data", "error", err, "data", row)
+		}
+
+		v = append(v, d)
+	}
+
+	return v, nil
+}
+
+// StoredInflightMessages returns all stored inflight messages from the store.
+func (h *Hook) StoredInflightMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	rows, err := h.records(storage.InflightKey)
+	if err != nil {
+		h.Log.Error("failed to scan inflight message data", "error", err)
+		return
+	}
+
+	for _, row := range rows {
+		var d storage.Message
+		if err = d.UnmarshalBinary(row); err != nil {
+			h.Log.Error("failed to unmarshal inflight message data", "error", err, "data", row)
+		}
+
+		v = append(v, d)
+	}
+
+	return v, nil
+}
+
+// StoredRetainedMessage returns the retained message of a topic, and false if there is none.
+func (h *Hook) StoredRetainedMessage(topic string) (v storage.Message, ok bool, err error) {
+	if h.db == nil {
+		return v, false, storage.ErrDBFileNotOpen
+	}
+
+	row, err := h.record(retainedKey(topic), storage.RetainedKey)
+	if err != nil || row == nil {
+		return v, false, err
+	}
+
+	if err = v.UnmarshalBinary(row); err != nil {
+		return v, false, err
+	}
+
+	return v, true, nil
+}
+
+// StoredClientInflightMessages returns the inflight messages of a client.
+func (h *Hook) StoredClientInflightMessages(cid string) (v []storage.Message, err error) {
+	if h.db == nil {
+		return nil, storage.ErrDBFileNotOpen
+	}
+
+	items, err := h.clientItems(cid, storage.InflightKey+"#")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range itemData(items) {
+		var d storage.Message
+		if err = d.UnmarshalBinary(row); err != nil {
+			return nil, err
+		}
+		v = append(v, d)
+	}
+
+	return v, nil
+}
+
+// StoredSysInfo returns the system info from the store.
+func (h *Hook) StoredSysInfo() (v storage.SystemInfo, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	row, err := h.record(sysInfoKey(), storage.SysInfoKey)
+	if err != nil || row == nil {
+		return
+	}
+
+	if err = v.UnmarshalBinary(row); err != nil {
+		h.Log.Error("failed to unmarshal sys info data", "error", err, "data", row)
+	}
+
+	return v, nil
+}
@@ -0,0 +1,544 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package dynamodb
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/mqtt/system"
+)
+
+// testEndpoint is the endpoint of dynamodb local, which the tests run against when it is running.
+const testEndpoint = "http://localhost:8000"
+
+var (
+	logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	client = &mqtt.Client{
+		ID: "test",
+		Net: mqtt.ClientConnection{
+			Remote:   "test.addr",
+			Listener: "listener",
+		},
+		Properties: mqtt.ClientProperties{
+			Username: []byte("username"),
+			Clean:    false,
+		},
+	}
+
+	pkf = packets.Packet{Filters: packets.Subscriptions{{Filter: "a/b/c"}}}
+)
+
+func hasDynamoDB() bool {
+	c, err := net.Dial("tcp", "localhost:8000")
+	if err != nil {
+		return false
+	}
+	_ = c.Close()
+	return true
+}
+
+// newHook returns a hook writing to a table named after the test, which is deleted when the
+// test ends.
+func newHook(t *testing.T) *Hook {
+	if !hasDynamoDB() {
+		t.Skip("no dynamodb local running")
+	}
+
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(&Options{
+		Table:           "comqtt_" + t.Name(),
+		Region:          "us-east-1",
+		Endpoint:        testEndpoint,
+		AccessKeyID:     "test",
+		SecretAccessKey: "test",
+		ConsistentRead:  true,
+	})
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		if h.db == nil {
+			return
+		}
+		_, _ = h.db.DeleteTable(h.ctx, &dynamodb.DeleteTableInput{TableName: aws.String(h.config.Table)})
+		_ = h.Stop()
+	})
+
+	return h
+}
+
+func TestClientKey(t *testing.T) {
+	require.Equal(t, "cl#cl1", clientPartition("cl1"))
+	require.Equal(t, storage.ClientKey, clientKey(&mqtt.Client{ID: "cl1"}))
+}
+
+func TestSubscriptionKey(t *testing.T) {
+	require.Equal(t, "sub#a/b/c", subscriptionKey("a/b/c"))
+}
+
+func TestRetainedKey(t *testing.T) {
+	require.Equal(t, "ret#a/b/c", retainedKey("a/b/c"))
+}
+
+func TestInflightKey(t *testing.T) {
+	require.Equal(t, "ifm#1", inflightKey(1))
+}
+
+func TestSysInfoKey(t *testing.T) {
+	require.Equal(t, storage.SysInfoKey, sysInfoKey())
+}
+
+func TestID(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.Equal(t, "dynamodb-db", h.ID())
+}
+
+func TestProvides(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.True(t, h.Provides(mqtt.OnSessionEstablished))
+	require.True(t, h.Provides(mqtt.OnDisconnect))
+	require.True(t, h.Provides(mqtt.OnSubscribed))
+	require.True(t, h.Provides(mqtt.OnUnsubscribed))
+	require.True(t, h.Provides(mqtt.OnRetainMessage))
+	require.True(t, h.Provides(mqtt.OnQosPublish))
+	require.True(t, h.Provides(mqtt.OnQosComplete))
+	require.True(t, h.Provides(mqtt.OnQosDropped))
+	require.True(t, h.Provides(mqtt.OnSysInfoTick))
+	require.True(t, h.Provides(mqtt.OnClientExpired))
+	require.True(t, h.Provides(mqtt.OnRetainedExpired))
+	require.True(t, h.Provides(mqtt.StoredClients))
+	require.True(t, h.Provides(mqtt.StoredInflightMessages))
+	require.True(t, h.Provides(mqtt.StoredRetainedMessages))
+	require.True(t, h.Provides(mqtt.StoredSubscriptions))
+	require.True(t, h.Provides(mqtt.StoredSysInfo))
+	require.False(t, h.Provides(mqtt.OnACLCheck))
+	require.False(t, h.Provides(mqtt.OnConnectAuthenticate))
+}
+
+func TestItem(t *testing.T) {
+	h := new(Hook)
+	h.config = &Options{TTLAttribute: defaultTTLAttribute}
+
+	item := h.item("cl#cl1", "cl", storage.ClientKey, []byte("{}"), 0)
+	require.Len(t, item, 4)
+	require.Equal(t, &types.AttributeValueMemberB{Value: []byte("{}")}, item[attrData])
+
+	item = h.item("cl#cl1", "cl", storage.ClientKey, []byte("{}"), 100)
+	require.Equal(t, &types.AttributeValueMemberN{Value: "100"}, item[defaultTTLAttribute])
+}
+
+func TestInitBadConfig(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(map[string]any{})
+	require.Error(t, err)
+}
+
+func TestInitBadBillingMode(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(&Options{BillingMode: "free"})
+	require.ErrorIs(t, err, ErrInvalidBillingMode)
+	require.Nil(t, h.db)
+}
+
+func TestInitBadEndpoint(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(&Options{
+		Region:          "us-east-1",
+		Endpoint:        "http://127.0.0.1:1",
+		AccessKeyID:     "test",
+		SecretAccessKey: "test",
+		BillingMode:     "Provisioned",
+	})
+	require.Error(t, err)
+	require.Nil(t, h.db)
+	require.Equal(t, defaultTable, h.config.Table)
+	require.Equal(t, defaultTTLAttribute, h.config.TTLAttribute)
+	require.Equal(t, BillingProvisioned, h.config.BillingMode)
+	require.Equal(t, int64(defaultCapacity), h.config.ReadCapacity)
+	require.Equal(t, int64(defaultCapacity), h.config.WriteCapacity)
+}
+
+func TestExpiresAt(t *testing.T) {
+	require.Equal(t, int64(0), expiresAt())
+	require.Equal(t, int64(0), expiresAt(0, 0))
+	require.Equal(t, int64(5), expiresAt(0, 10, 5))
+}
+
+func TestMessageExpires(t *testing.T) {
+	now := time.Now().Unix()
+	msg := &storage.Message{Created: now - 10}
+	require.Equal(t, int64(0), messageExpires(msg, 0, now))
+	require.Equal(t, now+50, messageExpires(msg, time.Minute, now))
+
+	msg.Properties.MessageExpiryInterval = 30
+	require.Equal(t, now+20, messageExpires(msg, time.Minute, now))
+
+	msg.Created = 0
+	require.Equal(t, now+30, messageExpires(msg, 0, now))
+}
+
+func TestSessionExpires(t *testing.T) {
+	h := new(Hook)
+	h.config = &Options{Expiry: storage.Expiry{Session: time.Hour, SessionInterval: true}}
+	now := time.Now().Unix()
+
+	cl := mqtt.New(nil).NewClient(nil, "t1", "cl1", false)
+	require.Equal(t, int64(0), h.sessionExpires(cl, now))
+
+	cl.Stop(nil)
+	require.Equal(t, now+3600, h.sessionExpires(cl, now))
+
+	cl.Properties.ProtocolVersion = 5
+	cl.Properties.Props.SessionExpiryIntervalFlag = true
+	cl.Properties.Props.SessionExpiryInterval = 60
+	require.InDelta(t, now+60, h.sessionExpires(cl, now), 1)
+
+	h.config.Expiry.Session = 0
+	h.config.Expiry.SessionInterval = false
+	require.Equal(t, int64(0), h.sessionExpires(cl, now))
+}
+
+func TestInflightExpires(t *testing.T) {
+	h := new(Hook)
+	h.config = &Options{Expiry: storage.Expiry{Inflight: time.Minute}}
+	now := time.Now().Unix()
+
+	msg := &storage.Message{Created: now, FixedHeader: packets.FixedHeader{Type: packets.Publish}}
+	require.Equal(t, now+60, h.inflightExpires(msg, 0, now))
+	require.Equal(t, now+30, h.inflightExpires(msg, now+30, now))
+
+	msg.FixedHeader.Type = packets.Pubrel
+	require.Equal(t, int64(0), h.inflightExpires(msg, 0, now))
+	require.Equal(t, now+300, h.inflightExpires(msg, now+300, now))
+}
+
+func TestHealthyNoDB(t *testing.T) {
+	h := new(Hook)
+	require.ErrorIs(t, h.Healthy(), storage.ErrDBFileNotOpen)
+}
+
+func TestNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnWillSent(client, packets.Packet{})
+	h.OnDisconnect(client, nil, true)
+	h.OnClientExpired(client)
+	h.OnSubscribed(client, pkf, []byte{0}, nil)
+	h.OnUnsubscribed(client, pkf, nil, nil)
+	h.OnRetainMessage(client, packets.Packet{}, 1)
+	h.OnRetainedExpired("a/b/c")
+	h.OnQosPublish(client, packets.Packet{}, time.Now().Unix(), 0)
+	h.OnQosComplete(client, packets.Packet{})
+	h.OnQosDropped(client, packets.Packet{})
+	h.OnSysInfoTick(new(system.Info))
+
+	clients, err := h.StoredClients()
+	require.Empty(t, clients)
+	require.NoError(t, err)
+	subs, err := h.StoredSubscriptions()
+	require.Empty(t, subs)
+	require.NoError(t, err)
+	retained, err := h.StoredRetainedMessages()
+	require.Empty(t, retained)
+	require.NoError(t, err)
+	inflight, err := h.StoredInflightMessages()
+	require.Empty(t, inflight)
+	require.NoError(t, err)
+	sys, err := h.StoredSysInfo()
+	require.Empty(t, sys)
+	require.NoError(t, err)
+}
+
+func TestHealthy(t *testing.T) {
+	h := newHook(t)
+	require.NoError(t, h.Healthy())
+}
+
+func TestStorageMetrics(t *testing.T) {
+	h := newHook(t)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnSubscribed(client, pkf, []byte{1}, []int{1})
+	_, err := h.StoredClients()
+	require.NoError(t, err)
+	_, err = h.StoredSysInfo() // a missing record is not a failed read
+	require.NoError(t, err)
+
+	m := h.StorageMetrics()
+	require.Equal(t, h.ID(), m.ID)
+	require.Equal(t, int64(2), m.Writes)
+	require.Equal(t, int64(0), m.WriteErrors)
+	require.Equal(t, int64(2), m.Reads)
+	require.Equal(t, int64(0), m.ReadErrors)
+}
+
+func TestOnSessionEstablishedThenOnDisconnect(t *testing.T) {
+	h := newHook(t)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	r, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, client.ID, r[0].ID)
+	require.Equal(t, client.Net.Remote, r[0].Remote)
+	require.Equal(t, client.Net.Listener, r[0].Listener)
+	require.Equal(t, client.Properties.Username, r[0].Username)
+	require.Equal(t, client.Properties.Clean, r[0].Clean)
+
+	h.OnDisconnect(client, nil, false)
+	r, err = h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+
+	h.OnDisconnect(client, nil, true)
+	r, err = h.StoredClients()
+	require.NoError(t, err)
+	require.Empty(t, r)
+}
+
+func TestOnWillSent(t *testing.T) {
+	h := newHook(t)
+
+	cl := &mqtt.Client{ID: "cl1"}
+	cl.Properties.Will.Flag = 1
+	h.OnWillSent(cl, packets.Packet{})
+
+	r, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, uint32(1), r[0].Will.Flag)
+}
+
+func TestOnSessionEstablishedCleanStart(t *testing.T) {
+	h := newHook(t)
+
+	cl := &mqtt.Client{ID: "cl1"}
+	other := &mqtt.Client{ID: "cl10"}
+	pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}, PacketID: 1}
+	h.OnSubscribed(cl, pkf, []byte{0}, nil)
+	h.OnSubscribed(other, pkf, []byte{0}, nil)
+	h.OnQosPublish(cl, pk, time.Now().Unix(), 0)
+	h.OnQosPublish(other, pk, time.Now().Unix(), 0)
+
+	h.OnSessionEstablished(cl, packets.Packet{})
+	subs, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+
+	cl.Properties.Clean = true
+	h.OnSessionEstablished(cl, packets.Packet{})
+	subs, err = h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+	require.Equal(t, other.ID, subs[0].Client)
+
+	msgs, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	require.Equal(t, other.ID, msgs[0].Client)
+}
+
+func TestOnClientExpiredRemovesSession(t *testing.T) {
+	h := newHook(t)
+
+	cl := &mqtt.Client{ID: "cl1"}
+	h.OnSessionEstablished(cl, packets.Packet{})
+	h.OnSubscribed(cl, pkf, []byte{0}, nil)
+	h.OnQosPublish(cl, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}, PacketID: 1}, time.Now().Unix(), 0)
+
+	h.OnClientExpired(cl)
+
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Empty(t, clients)
+	subs, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Empty(t, subs)
+	msgs, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Empty(t, msgs)
+}
+
+func TestOnSubscribedThenOnUnsubscribed(t *testing.T) {
+	h := newHook(t)
+
+	pk := packets.Packet{ProtocolVersion: 5, Filters: packets.Subscriptions{{Filter: "a/b", Identifier: 3}, {Filter: "c/d"}}}
+	h.OnSubscribed(client, pk, []byte{0, 1}, nil)
+
+	subs, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+	sort.Slice(subs, func(i, j int) bool { return subs[i].Filter < subs[j].Filter })
+	require.Equal(t, client.ID, subs[0].Client)
+	require.Equal(t, 3, subs[0].Identifier)
+	require.Equal(t, byte(1), subs[1].Qos)
+
+	h.OnUnsubscribed(client, pk, nil, nil)
+	subs, err = h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Empty(t, subs)
+}
+
+func TestOnRetainMessageThenUnset(t *testing.T) {
+	h := newHook(t)
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Retain: true},
+		Payload:     []byte("hello"),
+		TopicName:   "a/b/c",
+	}
+	h.OnRetainMessage(client, pk, 1)
+
+	r, err := h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, pk.TopicName, r[0].TopicName)
+	require.Equal(t, pk.Payload, r[0].Payload)
+
+	h.OnRetainMessage(client, pk, -1)
+	r, err = h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Empty(t, r)
+
+	h.OnRetainMessage(client, pk, 1)
+	h.OnRetainedExpired(pk.TopicName)
+	r, err = h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Empty(t, r)
+}
+
+func TestOnQosPublishThenQOSComplete(t *testing.T) {
+	h := newHook(t)
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 2},
+		PacketID:    7,
+		Payload:     []byte("hello"),
+		TopicName:   "a/b/c",
+	}
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+
+	r, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, pk.TopicName, r[0].TopicName)
+	require.Equal(t, pk.Payload, r[0].Payload)
+	require.Equal(t, uint16(7), r[0].ToPacket().PacketID)
+	require.True(t, time.Now().Unix()-1 < r[0].Sent)
+
+	// OnQosDropped is a passthrough to OnQosComplete here
+	h.OnQosDropped(client, pk)
+	r, err = h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Empty(t, r)
+}
+
+func TestOnQosPublishNoStageRegression(t *testing.T) {
+	h := newHook(t)
+
+	pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pubrel, Qos: 1}, PacketID: 7}
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+
+	pk.FixedHeader = packets.FixedHeader{Type: packets.Publish, Qos: 2}
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+
+	r, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, packets.Pubrel, r[0].ToPacket().FixedHeader.Type)
+}
+
+func TestOnSysInfoTick(t *testing.T) {
+	h := newHook(t)
+
+	r, err := h.StoredSysInfo()
+	require.NoError(t, err)
+	require.Empty(t, r.ID)
+
+	info := &system.Info{Version: "2.0.0", BytesReceived: 100}
+	h.OnSysInfoTick(info)
+	info.BytesReceived = 200
+	h.OnSysInfoTick(info)
+
+	r, err = h.StoredSysInfo()
+	require.NoError(t, err)
+	require.Equal(t, sysInfoKey(), r.ID)
+	require.Equal(t, int64(200), r.Info.BytesReceived)
+}
+
+func TestOnRetainMessageExpires(t *testing.T) {
+	h := newHook(t)
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Retain: true},
+		Payload:     []byte("hello"),
+		TopicName:   "a/b/c",
+		Created:     time.Now().Unix(),
+		Properties:  packets.Properties{MessageExpiryInterval: 1},
+	}
+	h.OnRetainMessage(client, pk, 1)
+
+	msg, ok, err := h.StoredRetainedMessage(pk.TopicName)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, pk.Payload, msg.Payload)
+
+	time.Sleep(2 * time.Second)
+	_, ok, err = h.StoredRetainedMessage(pk.TopicName)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestOnDisconnectExpiresSession(t *testing.T) {
+	h := newHook(t)
+	h.config.Expiry = storage.Expiry{Session: time.Second}
+
+	cl := mqtt.New(nil).NewClient(nil, "t1", "cl1", false)
+	h.OnSessionEstablished(cl, packets.Packet{})
+	h.OnSubscribed(cl, pkf, []byte{0}, nil)
+	h.OnQosPublish(cl, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}, PacketID: 1}, time.Now().Unix(), 0)
+
+	msgs, err := h.StoredClientInflightMessages(cl.ID)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+
+	cl.Stop(nil)
+	h.OnDisconnect(cl, nil, false)
+	time.Sleep(2 * time.Second)
+
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Empty(t, clients)
+	subs, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Empty(t, subs)
+	msgs, err = h.StoredClientInflightMessages(cl.ID)
+	require.NoError(t, err)
+	require.Empty(t, msgs)
+}
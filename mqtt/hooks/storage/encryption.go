@@ -0,0 +1,114 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-co
+// SPDX-FileContributor: mochi-co
+
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	// ErrInvalidEncryptionKey indicates an encryption key is not a 16, 24 or 32 byte AES key.
+	ErrInvalidEncryptionKey = errors.New("encryption key must be 16, 24 or 32 bytes")
+
+	// ErrDecryptFailed indicates a stored value could not be decrypted with any of the keys.
+	ErrDecryptFailed = errors.New("failed to decrypt stored value")
+)
+
+// sealedPrefix marks a value sealed by a Cipher, distinguishing it from values written
+// before encryption was enabled.
+var sealedPrefix = []byte("\x00aes-gcm\x00")
+
+// Encryption contains the settings of the encryption at rest of the values written by a
+// storage hook. Keys, such as client ids and topic names, are not encrypted.
+type Encryption struct {
+	Key          []byte   // the AES key which encrypts written values, enabling encryption if set
+	PreviousKeys [][]byte // keys which only decrypt values written before the key was rotated
+}
+
+// Enabled returns true if written values are encrypted.
+func (e Encryption) Enabled() bool {
+	return len(e.Key) > 0
+}
+
+// DecodeKey decodes a base64 encoded AES key, e.g. from a config file or environment variable.
+func DecodeKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("decode encryption key: %w", err)
+	}
+
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	default:
+		return nil, ErrInvalidEncryptionKey
+	}
+}
+
+// Cipher seals and opens stored values with AES-GCM, using a random nonce for each value.
+type Cipher struct {
+	aeads []cipher.AEAD // the current key first, followed by the previous keys
+}
+
+// NewCipher returns a cipher for the keys of the encryption settings.
+func NewCipher(e Encryption) (*Cipher, error) {
+	c := new(Cipher)
+	for _, key := range append([][]byte{e.Key}, e.PreviousKeys...) {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, ErrInvalidEncryptionKey
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		c.aeads = append(c.aeads, aead)
+	}
+
+	return c, nil
+}
+
+// Seal encrypts a value with the current key.
+func (c *Cipher) Seal(plaintext []byte) ([]byte, error) {
+	aead := c.aeads[0]
+	out := make([]byte, len(sealedPrefix)+aead.NonceSize(), len(sealedPrefix)+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	copy(out, sealedPrefix)
+	nonce := out[len(sealedPrefix):]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(out, nonce, plaintext, nil), nil
+}
+
+// Open decrypts a sealed value with the first key which authenticates it. Values written
+// before encryption was enabled are returned unchanged, and are sealed when next written.
+func (c *Cipher) Open(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, sealedPrefix) {
+		return data, nil
+	}
+
+	data = data[len(sealedPrefix):]
+	for _, aead := range c.aeads {
+		if len(data) < aead.NonceSize() {
+			break
+		}
+
+		nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+		if plaintext, err := aead.Open(nil, nonce, ciphertext, nil); err == nil {
+			return plaintext, nil
+		}
+	}
+
+	return nil, ErrDecryptFailed
+}
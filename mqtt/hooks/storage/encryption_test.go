@@ -0,0 +1,90 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-co
+// SPDX-FileContributor: mochi-co
+
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testKey  = bytes.Repeat([]byte{1}, 32)
+	otherKey = bytes.Repeat([]byte{2}, 16)
+)
+
+func TestEncryptionEnabled(t *testing.T) {
+	require.False(t, Encryption{}.Enabled())
+	require.True(t, Encryption{Key: testKey}.Enabled())
+}
+
+func TestDecodeKey(t *testing.T) {
+	key, err := DecodeKey(base64.StdEncoding.EncodeToString(testKey))
+	require.NoError(t, err)
+	require.Equal(t, testKey, key)
+
+	_, err = DecodeKey(base64.StdEncoding.EncodeToString([]byte("short")))
+	require.ErrorIs(t, err, ErrInvalidEncryptionKey)
+
+	_, err = DecodeKey("not base64!")
+	require.Error(t, err)
+}
+
+func TestNewCipherInvalidKey(t *testing.T) {
+	_, err := NewCipher(Encryption{Key: []byte("short")})
+	require.ErrorIs(t, err, ErrInvalidEncryptionKey)
+
+	_, err = NewCipher(Encryption{Key: testKey, PreviousKeys: [][]byte{[]byte("short")}})
+	require.ErrorIs(t, err, ErrInvalidEncryptionKey)
+}
+
+func TestCipherSealOpen(t *testing.T) {
+	c, err := NewCipher(Encryption{Key: testKey})
+	require.NoError(t, err)
+
+	a, err := c.Seal([]byte("secret"))
+	require.NoError(t, err)
+	require.NotContains(t, string(a), "secret")
+
+	b, err := c.Seal([]byte("secret"))
+	require.NoError(t, err)
+	require.NotEqual(t, a, b) // random nonces
+
+	v, err := c.Open(a)
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret"), v)
+}
+
+func TestCipherOpenPlaintext(t *testing.T) {
+	c, err := NewCipher(Encryption{Key: testKey})
+	require.NoError(t, err)
+
+	v, err := c.Open([]byte(`{"id":"cl1"}`))
+	require.NoError(t, err)
+	require.Equal(t, []byte(`{"id":"cl1"}`), v)
+}
+
+func TestCipherOpenRotatedKey(t *testing.T) {
+	old, err := NewCipher(Encryption{Key: otherKey})
+	require.NoError(t, err)
+	sealed, err := old.Seal([]byte("secret"))
+	require.NoError(t, err)
+
+	c, err := NewCipher(Encryption{Key: testKey})
+	require.NoError(t, err)
+	_, err = c.Open(sealed)
+	require.ErrorIs(t, err, ErrDecryptFailed)
+
+	c, err = NewCipher(Encryption{Key: testKey, PreviousKeys: [][]byte{otherKey}})
+	require.NoError(t, err)
+	v, err := c.Open(sealed)
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret"), v)
+
+	_, err = c.Open(sealed[:len(sealedPrefix)+2])
+	require.ErrorIs(t, err, ErrDecryptFailed)
+}
@@ -0,0 +1,270 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-co
+// SPDX-FileContributor: mochi-co
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	UnavailableDegrade    = "degrade"     // keep serving without the store while it is unavailable
+	UnavailableFailClosed = "fail-closed" // refuse what needs the store while it is unavailable
+
+	CircuitClosed   = "closed"    // the store is available
+	CircuitOpen     = "open"      // the store is unavailable, and operations fail at once
+	CircuitHalfOpen = "half-open" // the store is being pinged to see if it has recovered
+
+	defaultHealthInterval   = 5  // seconds between pings while the store is available
+	defaultHealthFailures   = 3  // consecutive failures which open the circuit
+	defaultHealthMaxBackoff = 30 // most seconds between pings while the store is unavailable
+	healthMinBackoff        = time.Second
+	healthPingTimeout       = 2 * time.Second
+)
+
+var (
+	ErrUnavailable              = errors.New("store is unavailable")
+	ErrInvalidUnavailablePolicy = errors.New("on-storage-unavailable must be degrade or fail-closed")
+)
+
+// HealthOptions configures the health checks of the connection to a store, which open a
+// circuit once the store fails a number of consecutive times, failing operations at once
+// until a ping succeeds again.
+type HealthOptions struct {
+	Interval             int64  `yaml:"interval" json:"interval"`                             // seconds between pings while the store is available, default 5, -1 disables the checks
+	Failures             int    `yaml:"failures" json:"failures"`                             // consecutive failed pings or operations which open the circuit, default 3
+	MaxBackoff           int64  `yaml:"max-backoff" json:"max-backoff"`                       // most seconds between reconnect attempts while the circuit is open, default 30
+	OnStorageUnavailable string `yaml:"on-storage-unavailable" json:"on-storage-unavailable"` // degrade or fail-closed, default degrade
+}
+
+// Validate checks the health options and sets their defaults.
+func (o *HealthOptions) Validate() error {
+	if o.Interval == 0 {
+		o.Interval = defaultHealthInterval
+	}
+	if o.Failures <= 0 {
+		o.Failures = defaultHealthFailures
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = defaultHealthMaxBackoff
+	}
+
+	switch o.OnStorageUnavailable {
+	case "":
+		o.OnStorageUnavailable = UnavailableDegrade
+	case UnavailableDegrade, UnavailableFailClosed:
+	default:
+		return ErrInvalidUnavailablePolicy
+	}
+
+	return nil
+}
+
+// HealthStatus is the state of the circuit of a store connection.
+type HealthStatus struct {
+	State    string    `json:"state"`    // closed, open or half-open
+	Since    time.Time `json:"since"`    // when the circuit entered the state
+	Failures int       `json:"failures"` // the current consecutive failures
+	Outages  int64     `json:"outages"`  // the times the circuit has opened
+	Rejected int64     `json:"rejected"` // the operations failed at once while the circuit was open
+}
+
+// Health pings the connection to a store in the background, and opens a circuit once pings
+// or operations fail a number of consecutive times, so that operations fail at once with
+// ErrUnavailable rather than each waiting on the store. While the circuit is open the store
+// is pinged with an exponential backoff, reconnecting, and the circuit is closed once a ping
+// succeeds. A nil Health is always available.
+type Health struct {
+	sync.Mutex
+	opts    HealthOptions
+	ping    func(ctx context.Context) error
+	log     *slog.Logger
+	status  HealthStatus
+	backoff time.Duration // the wait before the next ping while the circuit is open
+	opened  chan struct{} // wakes the checks when operations open the circuit
+	cancel  chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewHealth returns the health of a store connection checked with ping, and starts the
+// checks, or nil if the options disable them. The options must be validated.
+func NewHealth(opts HealthOptions, ping func(ctx context.Context) error, log *slog.Logger) *Health {
+	if opts.Interval < 0 {
+		return nil
+	}
+
+	h := &Health{
+		opts:   opts,
+		ping:   ping,
+		log:    log,
+		status: HealthStatus{State: CircuitClosed, Since: time.Now()},
+		opened: make(chan struct{}, 1),
+		cancel: make(chan struct{}),
+	}
+
+	h.wg.Add(1)
+	go h.run()
+	return h
+}
+
+// Allow returns ErrUnavailable if the circuit is not closed, counting the rejected operation.
+func (h *Health) Allow() error {
+	if h == nil {
+		return nil
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	if h.status.State == CircuitClosed {
+		return nil
+	}
+
+	h.status.Rejected++
+	return ErrUnavailable
+}
+
+// Available returns true if the circuit is closed.
+func (h *Health) Available() bool {
+	if h == nil {
+		return true
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	return h.status.State == CircuitClosed
+}
+
+// FailClosed returns true if the store is unavailable and the policy is to fail closed.
+func (h *Health) FailClosed() bool {
+	return h != nil && h.opts.OnStorageUnavailable == UnavailableFailClosed && !h.Available()
+}
+
+// Record records whether an operation on the store failed because it could not be reached,
+// opening the circuit once the failures reach the threshold.
+func (h *Health) Record(failed bool) {
+	if h == nil {
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	if h.status.State != CircuitClosed {
+		return
+	}
+
+	if !failed {
+		h.status.Failures = 0
+		return
+	}
+
+	h.status.Failures++
+	if h.status.Failures >= h.opts.Failures {
+		h.open()
+		select {
+		case h.opened <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Status returns the state of the circuit.
+func (h *Health) Status() HealthStatus {
+	if h == nil {
+		return HealthStatus{State: CircuitClosed}
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	return h.status
+}
+
+// Stop stops the checks.
+func (h *Health) Stop() {
+	if h == nil {
+		return
+	}
+
+	close(h.cancel)
+	h.wg.Wait()
+}
+
+// open opens the circuit, with the lock held.
+func (h *Health) open() {
+	h.status.State = CircuitOpen
+	h.status.Since = time.Now()
+	h.status.Outages++
+	h.backoff = healthMinBackoff
+	h.log.Warn("store is unavailable, failing operations until it recovers",
+		"failures", h.status.Failures, "on-storage-unavailable", h.opts.OnStorageUnavailable)
+}
+
+// run pings the store every interval while the circuit is closed, and with an exponential
+// backoff while it is open, until stopped.
+func (h *Health) run() {
+	defer h.wg.Done()
+
+	interval := time.Duration(h.opts.Interval) * time.Second
+	for {
+		h.Lock()
+		wait := interval
+		if h.status.State != CircuitClosed {
+			wait = h.backoff
+		}
+		h.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-h.cancel:
+			timer.Stop()
+			return
+		case <-h.opened:
+			timer.Stop()
+			continue
+		case <-timer.C:
+		}
+
+		h.check()
+	}
+}
+
+// check pings the store, closing the circuit if it is open and the ping succeeds, or
+// counting the failure and backing off if it fails.
+func (h *Health) check() {
+	h.Lock()
+	closed := h.status.State == CircuitClosed
+	if !closed {
+		h.status.State = CircuitHalfOpen
+	}
+	h.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), healthPingTimeout)
+	err := h.ping(ctx)
+	cancel()
+
+	if closed {
+		h.Record(err != nil)
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	if err != nil {
+		h.status.State = CircuitOpen
+		h.backoff = min(h.backoff*2, time.Duration(h.opts.MaxBackoff)*time.Second)
+		h.log.Debug("store is still unavailable", "error", err, "retry", h.backoff)
+		return
+	}
+
+	h.log.Info("store is available again", "unavailable", time.Since(h.status.Since).Round(time.Millisecond))
+	h.status = HealthStatus{
+		State:    CircuitClosed,
+		Since:    time.Now(),
+		Outages:  h.status.Outages,
+		Rejected: h.status.Rejected,
+	}
+}
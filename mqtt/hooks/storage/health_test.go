@@ -0,0 +1,150 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 mochi-co
+// SPDX-FileContributor: mochi-co
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	healthLog = slog.New(slog.NewTextHandler(os.Stdout, nil))
+	errPing   = errors.New("connection refused")
+)
+
+// testPing is a ping which fails while down is set.
+type testPing struct {
+	down  atomic.Bool
+	pings atomic.Int64
+}
+
+func (p *testPing) ping(ctx context.Context) error {
+	p.pings.Add(1)
+	if p.down.Load() {
+		return errPing
+	}
+	return nil
+}
+
+// newTestHealth returns a health whose background checks never run, so the
+// tests drive check directly.
+func newTestHealth(opts HealthOptions, p *testPing) *Health {
+	if opts.Interval == 0 {
+		opts.Interval = 3600
+	}
+	_ = opts.Validate()
+	return NewHealth(opts, p.ping, healthLog)
+}
+
+func TestHealthOptionsValidate(t *testing.T) {
+	o := HealthOptions{}
+	require.NoError(t, o.Validate())
+	require.Equal(t, int64(defaultHealthInterval), o.Interval)
+	require.Equal(t, defaultHealthFailures, o.Failures)
+	require.Equal(t, int64(defaultHealthMaxBackoff), o.MaxBackoff)
+	require.Equal(t, UnavailableDegrade, o.OnStorageUnavailable)
+
+	o = HealthOptions{Interval: -1, OnStorageUnavailable: UnavailableFailClosed}
+	require.NoError(t, o.Validate())
+	require.Equal(t, int64(-1), o.Interval)
+	require.Equal(t, UnavailableFailClosed, o.OnStorageUnavailable)
+
+	o = HealthOptions{OnStorageUnavailable: "retry"}
+	require.ErrorIs(t, o.Validate(), ErrInvalidUnavailablePolicy)
+}
+
+func TestHealthDisabled(t *testing.T) {
+	h := NewHealth(HealthOptions{Interval: -1}, new(testPing).ping, healthLog)
+	require.Nil(t, h)
+
+	h.Record(true)
+	require.NoError(t, h.Allow())
+	require.True(t, h.Available())
+	require.False(t, h.FailClosed())
+	require.Equal(t, CircuitClosed, h.Status().State)
+	h.Stop()
+}
+
+func TestHealthRecordOpens(t *testing.T) {
+	h := newTestHealth(HealthOptions{Failures: 2}, new(testPing))
+	defer h.Stop()
+
+	h.Record(true)
+	h.Record(false)
+	h.Record(true)
+	require.NoError(t, h.Allow())
+	require.Equal(t, 1, h.Status().Failures)
+
+	h.Record(true)
+	require.ErrorIs(t, h.Allow(), ErrUnavailable)
+	require.ErrorIs(t, h.Allow(), ErrUnavailable)
+	require.False(t, h.Available())
+	require.False(t, h.FailClosed())
+
+	st := h.Status()
+	require.Equal(t, CircuitOpen, st.State)
+	require.Equal(t, int64(1), st.Outages)
+	require.Equal(t, int64(2), st.Rejected)
+}
+
+func TestHealthFailClosed(t *testing.T) {
+	h := newTestHealth(HealthOptions{Failures: 1, OnStorageUnavailable: UnavailableFailClosed}, new(testPing))
+	defer h.Stop()
+
+	require.False(t, h.FailClosed())
+	h.Record(true)
+	require.True(t, h.FailClosed())
+}
+
+func TestHealthCheckBackoff(t *testing.T) {
+	p := new(testPing)
+	h := newTestHealth(HealthOptions{Failures: 1, MaxBackoff: 3}, p)
+	defer h.Stop()
+
+	// failed pings count towards opening the circuit while it is closed
+	p.down.Store(true)
+	h.check()
+	require.Equal(t, CircuitOpen, h.Status().State)
+	require.Equal(t, healthMinBackoff, h.backoff)
+
+	h.check()
+	require.Equal(t, CircuitOpen, h.Status().State)
+	require.Equal(t, 2*time.Second, h.backoff)
+	h.check()
+	require.Equal(t, 3*time.Second, h.backoff)
+
+	require.ErrorIs(t, h.Allow(), ErrUnavailable)
+	p.down.Store(false)
+	h.check()
+
+	st := h.Status()
+	require.Equal(t, CircuitClosed, st.State)
+	require.Equal(t, 0, st.Failures)
+	require.Equal(t, int64(1), st.Outages)
+	require.Equal(t, int64(1), st.Rejected)
+	require.NoError(t, h.Allow())
+}
+
+func TestHealthRunRecovers(t *testing.T) {
+	p := new(testPing)
+	h := newTestHealth(HealthOptions{Failures: 1}, p)
+	defer h.Stop()
+
+	p.down.Store(true)
+	h.Record(true)
+	require.False(t, h.Available())
+
+	// the circuit is pinged after the minimum backoff, and closes once a ping succeeds
+	p.down.Store(false)
+	require.Eventually(t, h.Available, 3*time.Second, 10*time.Millisecond)
+	require.Positive(t, p.pings.Load())
+}
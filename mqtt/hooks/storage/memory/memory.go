@@ -0,0 +1,615 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package memory
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/mqtt/system"
+)
+
+const (
+	// defaultSnapshotFile is the default file path for the snapshot file.
+	defaultSnapshotFile = ".snapshot"
+
+	// defaultInterval is the default time between snapshots.
+	defaultInterval = 10 * time.Second
+)
+
+// clientKey returns a primary key for a client.
+func clientKey(cl *mqtt.Client) string {
+	return cl.ID
+}
+
+// subscriptionKey returns a primary key for a subscription.
+func subscriptionKey(cl *mqtt.Client, filter string) string {
+	return storage.SubscriptionKey + "_" + cl.ID + ":" + filter
+}
+
+// retainedKey returns a primary key for a retained message.
+func retainedKey(topic string) string {
+	return storage.RetainedKey + "_" + topic
+}
+
+// inflightKey returns a primary key for an inflight message.
+func inflightKey(cl *mqtt.Client, pk packets.Packet) string {
+	return storage.InflightKey + "_" + cl.ID + ":" + pk.FormatID()
+}
+
+// sysInfoKey returns a primary key for system info.
+func sysInfoKey() string {
+	return storage.SysInfoKey
+}
+
+// Options contains configuration settings for the memory store and its snapshots.
+type Options struct {
+	Path string // the file the records are snapshotted to and restored from
+
+	// Interval is how often the records are snapshotted if they have changed since the last
+	// snapshot. It is defaultInterval if 0, and the records are only snapshotted when the
+	// hook is stopped if negative.
+	Interval time.Duration
+}
+
+// records contains the stored records by their keys, and is the content of a snapshot file.
+type records struct {
+	Clients       map[string]storage.Client       `json:"clients"`
+	Subscriptions map[string]storage.Subscription `json:"subscriptions"`
+	Retained      map[string]storage.Message      `json:"retained"`
+	Inflight      map[string]storage.Message      `json:"inflight"`
+	SysInfo       storage.SystemInfo              `json:"sysinfo"`
+}
+
+// newRecords returns an empty set of records.
+func newRecords() *records {
+	return &records{
+		Clients:       map[string]storage.Client{},
+		Subscriptions: map[string]storage.Subscription{},
+		Retained:      map[string]storage.Message{},
+		Inflight:      map[string]storage.Message{},
+	}
+}
+
+// Hook is a storage hook which keeps the records in memory, snapshotting them to a file
+// periodically and when stopped, and restoring them from the file when started. Writes
+// never wait for the disk, but those made since the last snapshot are lost if the broker
+// crashes.
+type Hook struct {
+	mqtt.HookBase
+	config  *Options             // options for configuring the snapshots
+	mu      sync.RWMutex         // guards the records
+	db      *records             // the stored records
+	dirty   atomic.Bool          // the records have changed since the last snapshot
+	unsaved atomic.Int64         // the writes made since the last snapshot
+	cancel  chan struct{}        // stops the periodic snapshots
+	wg      sync.WaitGroup       // the snapshot goroutine, which must end before the final snapshot
+	fileMu  sync.Mutex           // serializes the writing of the snapshot file
+	metrics mqtt.StorageRecorder // counts the writes and reads of the hook
+}
+
+// ID returns the id of the hook.
+func (h *Hook) ID() string {
+	return "memory-snapshot"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+		mqtt.OnSubscribed,
+		mqtt.OnUnsubscribed,
+		mqtt.OnRetainMessage,
+		mqtt.OnWillSent,
+		mqtt.OnQosPublish,
+		mqtt.OnQosComplete,
+		mqtt.OnQosDropped,
+		mqtt.OnSysInfoTick,
+		mqtt.OnClientExpired,
+		mqtt.OnRetainedExpired,
+		mqtt.StoredClients,
+		mqtt.StoredInflightMessages,
+		mqtt.StoredRetainedMessages,
+		mqtt.StoredSubscriptions,
+		mqtt.StoredSysInfo,
+	}, []byte{b})
+}
+
+// Init restores the records from the snapshot file, if it exists, and starts the
+// periodic snapshots.
+func (h *Hook) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		config = new(Options)
+	}
+
+	h.config = config.(*Options)
+	if h.config.Path == "" {
+		h.config.Path = defaultSnapshotFile
+	}
+	if h.config.Interval == 0 {
+		h.config.Interval = defaultInterval
+	}
+
+	db, err := h.restore()
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	h.db = db
+	h.mu.Unlock()
+
+	h.cancel = make(chan struct{})
+	if h.config.Interval > 0 {
+		h.wg.Add(1)
+		go h.snapshotEvery(h.config.Interval, h.cancel)
+	}
+
+	return nil
+}
+
+// restore reads the records from the snapshot file, returning empty records if there is
+// no snapshot yet.
+func (h *Hook) restore() (*records, error) {
+	db := newRecords()
+	data, err := os.ReadFile(h.config.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return db, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, db); err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// Stop ends the periodic snapshots and writes a final snapshot of the records.
+func (h *Hook) Stop() error {
+	if h.cancel != nil {
+		close(h.cancel)
+		h.cancel = nil
+	}
+	h.wg.Wait()
+
+	if h.db == nil {
+		return nil
+	}
+
+	return h.Snapshot()
+}
+
+// Healthy returns an error if the records have not been restored.
+func (h *Hook) Healthy() error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	return nil
+}
+
+// StorageMetrics returns the writes and reads of the hook, the writes made since the last
+// snapshot and the size of the snapshot file.
+func (h *Hook) StorageMetrics() mqtt.StorageMetrics {
+	var size int64
+	if h.config != nil {
+		if fi, err := os.Stat(h.config.Path); err == nil {
+			size = fi.Size()
+		}
+	}
+
+	return h.metrics.Metrics(h.ID(), int(h.unsaved.Load()), size)
+}
+
+// Snapshot writes the records to the snapshot file if they have changed since the last
+// snapshot. The file is replaced atomically, so a crash while writing it leaves the
+// previous snapshot intact.
+func (h *Hook) Snapshot() error {
+	h.fileMu.Lock()
+	defer h.fileMu.Unlock()
+
+	if !h.dirty.Swap(false) {
+		return nil
+	}
+
+	h.mu.RLock()
+	data, err := json.Marshal(h.db)
+	unsaved := h.unsaved.Load()
+	h.mu.RUnlock()
+	if err == nil {
+		err = writeFile(h.config.Path, data)
+	}
+	if err != nil {
+		h.dirty.Store(true) // retry with the next snapshot
+		return err
+	}
+
+	h.unsaved.Add(-unsaved)
+	return nil
+}
+
+// writeFile writes data to a temporary file beside path, syncs it, and renames it to path.
+func writeFile(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // fails harmlessly once renamed
+
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// snapshotEvery snapshots the records each interval until cancel is closed.
+func (h *Hook) snapshotEvery(interval time.Duration, cancel chan struct{}) {
+	defer h.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cancel:
+			return
+		case <-ticker.C:
+			if err := h.Snapshot(); err != nil {
+				h.Log.Error("failed to snapshot records", "error", err, "path", h.config.Path)
+			}
+		}
+	}
+}
+
+// update applies a change to the records, marking them as changed.
+func (h *Hook) update(f func(db *records)) {
+	start := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f(h.db)
+	h.dirty.Store(true)
+	h.unsaved.Add(1)
+	h.metrics.Write(start, nil)
+}
+
+// read reads the records, returning an error if they have not been restored.
+func (h *Hook) read(f func(db *records)) error {
+	start := time.Now()
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var err error
+	if h.db == nil {
+		err = storage.ErrDBFileNotOpen
+	} else {
+		f(h.db)
+	}
+	h.metrics.Read(start, err)
+	return err
+}
+
+// OnSessionEstablished adds a client to the store when their session is established.
+func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	h.updateClient(cl)
+}
+
+// OnWillSent is called when a client sends a Will Message and the Will Message is removed from the client record.
+func (h *Hook) OnWillSent(cl *mqtt.Client, pk packets.Packet) {
+	h.updateClient(cl)
+}
+
+// updateClient writes the client data to the store.
+func (h *Hook) updateClient(cl *mqtt.Client) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	props := cl.Properties.Props.Copy(false)
+	in := storage.Client{
+		ID:              clientKey(cl),
+		T:               storage.ClientKey,
+		Remote:          cl.Net.Remote,
+		Listener:        cl.Net.Listener,
+		Username:        cl.Properties.Username,
+		Clean:           cl.Properties.Clean,
+		ProtocolVersion: cl.Properties.ProtocolVersion,
+		Properties: storage.ClientProperties{
+			SessionExpiryInterval: props.SessionExpiryInterval,
+			AuthenticationMethod:  props.AuthenticationMethod,
+			AuthenticationData:    props.AuthenticationData,
+			RequestProblemInfo:    props.RequestProblemInfo,
+			RequestResponseInfo:   props.RequestResponseInfo,
+			ReceiveMaximum:        props.ReceiveMaximum,
+			TopicAliasMaximum:     props.TopicAliasMaximum,
+			User:                  props.User,
+			MaximumPacketSize:     props.MaximumPacketSize,
+		},
+		Will: storage.ClientWill(cl.Properties.Will),
+	}
+	if cl.Closed() {
+		in.Disconnected = time.Now().Unix()
+		in.Expires = cl.SessionExpiry()
+	}
+
+	h.update(func(db *records) {
+		db.Clients[in.ID] = in
+	})
+}
+
+// OnDisconnect removes a client from the store if their session has expired, or records
+// the time they disconnected otherwise.
+func (h *Hook) OnDisconnect(cl *mqtt.Client, _ error, expire bool) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	if cl.StopCause() == packets.ErrSessionTakenOver {
+		return
+	}
+
+	if !expire {
+		h.updateClient(cl)
+		return
+	}
+
+	h.update(func(db *records) {
+		delete(db.Clients, clientKey(cl))
+	})
+}
+
+// OnSubscribed adds one or more client subscriptions to the store.
+func (h *Hook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte, counts []int) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	h.update(func(db *records) {
+		for i := 0; i < len(pk.Filters); i++ {
+			in := storage.Subscription{
+				ID:     subscriptionKey(cl, pk.Filters[i].Filter),
+				T:      storage.SubscriptionKey,
+				Client: cl.ID,
+				Filter: pk.Filters[i].Filter,
+				Qos:    reasonCodes[i],
+			}
+			if pk.ProtocolVersion == 5 {
+				in.Identifier = pk.Filters[i].Identifier
+				in.NoLocal = pk.Filters[i].NoLocal
+				in.RetainHandling = pk.Filters[i].RetainHandling
+				in.RetainAsPublished = pk.Filters[i].RetainAsPublished
+			}
+			db.Subscriptions[in.ID] = in
+		}
+	})
+}
+
+// OnUnsubscribed removes one or more client subscriptions from the store.
+func (h *Hook) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte, counts []int) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	h.update(func(db *records) {
+		for i := 0; i < len(pk.Filters); i++ {
+			delete(db.Subscriptions, subscriptionKey(cl, pk.Filters[i].Filter))
+		}
+	})
+}
+
+// OnRetainMessage adds a retained message for a topic to the store.
+func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	if r == -1 {
+		h.update(func(db *records) {
+			delete(db.Retained, retainedKey(pk.TopicName))
+		})
+		return
+	}
+
+	props := pk.Properties.Copy(false)
+	in := storage.Message{
+		ID:          retainedKey(pk.TopicName),
+		T:           storage.RetainedKey,
+		FixedHeader: pk.FixedHeader,
+		TopicName:   pk.TopicName,
+		Payload:     pk.Payload,
+		Created:     pk.Created,
+		Origin:      pk.Origin,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			TopicAlias:             props.TopicAlias,
+			User:                   props.User,
+		},
+	}
+
+	h.update(func(db *records) {
+		db.Retained[in.ID] = in
+	})
+}
+
+// OnQosPublish adds or updates an inflight message in the store.
+func (h *Hook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, resends int) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	props := pk.Properties.Copy(false)
+	in := storage.Message{
+		ID:          inflightKey(cl, pk),
+		T:           storage.InflightKey,
+		Origin:      pk.Origin,
+		Client:      cl.ID,
+		PacketID:    pk.PacketID,
+		FixedHeader: pk.FixedHeader,
+		TopicName:   pk.TopicName,
+		Payload:     pk.Payload,
+		Sent:        sent,
+		Created:     pk.Created,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			TopicAlias:             props.TopicAlias,
+			User:                   props.User,
+		},
+	}
+
+	h.update(func(db *records) {
+		db.Inflight[in.ID] = in
+	})
+}
+
+// OnQosComplete removes a resolved inflight message from the store.
+func (h *Hook) OnQosComplete(cl *mqtt.Client, pk packets.Packet) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	h.update(func(db *records) {
+		delete(db.Inflight, inflightKey(cl, pk))
+	})
+}
+
+// OnQosDropped removes a dropped inflight message from the store.
+func (h *Hook) OnQosDropped(cl *mqtt.Client, pk packets.Packet) {
+	h.OnQosComplete(cl, pk)
+}
+
+// OnSysInfoTick stores the latest system info in the store.
+func (h *Hook) OnSysInfoTick(sys *system.Info) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	in := storage.SystemInfo{
+		ID:   sysInfoKey(),
+		T:    storage.SysInfoKey,
+		Info: *sys.Clone(),
+	}
+
+	h.update(func(db *records) {
+		db.SysInfo = in
+	})
+}
+
+// OnRetainedExpired deletes expired retained messages from the store.
+func (h *Hook) OnRetainedExpired(filter string) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	h.update(func(db *records) {
+		delete(db.Retained, retainedKey(filter))
+	})
+}
+
+// OnClientExpired deleted expired clients from the store.
+func (h *Hook) OnClientExpired(cl *mqtt.Client) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	h.update(func(db *records) {
+		delete(db.Clients, clientKey(cl))
+	})
+}
+
+// StoredClients returns all stored clients from the store.
+func (h *Hook) StoredClients() (v []storage.Client, err error) {
+	err = h.read(func(db *records) {
+		for _, c := range db.Clients {
+			v = append(v, c)
+		}
+	})
+
+	return v, err
+}
+
+// StoredSubscriptions returns all stored subscriptions from the store.
+func (h *Hook) StoredSubscriptions() (v []storage.Subscription, err error) {
+	err = h.read(func(db *records) {
+		for _, s := range db.Subscriptions {
+			v = append(v, s)
+		}
+	})
+
+	return v, err
+}
+
+// StoredRetainedMessages returns all stored retained messages from the store.
+func (h *Hook) StoredRetainedMessages() (v []storage.Message, err error) {
+	err = h.read(func(db *records) {
+		for _, m := range db.Retained {
+			v = append(v, m)
+		}
+	})
+
+	return v, err
+}
+
+// StoredInflightMessages returns all stored inflight messages from the store.
+func (h *Hook) StoredInflightMessages() (v []storage.Message, err error) {
+	err = h.read(func(db *records) {
+		for _, m := range db.Inflight {
+			v = append(v, m)
+		}
+	})
+
+	return v, err
+}
+
+// StoredSysInfo returns the system info from the store.
+func (h *Hook) StoredSysInfo() (v storage.SystemInfo, err error) {
+	err = h.read(func(db *records) {
+		v = db.SysInfo
+	})
+
+	return v, err
+}
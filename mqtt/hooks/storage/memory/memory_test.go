@@ -0,0 +1,237 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package memory
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/mqtt/system"
+)
+
+var (
+	logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	client = &mqtt.Client{
+		ID: "test",
+		Net: mqtt.ClientConnection{
+			Remote:   "test.addr",
+			Listener: "listener",
+		},
+		Properties: mqtt.ClientProperties{
+			Username: []byte("username"),
+			Clean:    false,
+		},
+	}
+
+	pkf = packets.Packet{Filters: packets.Subscriptions{{Filter: "a/b/c"}}}
+)
+
+func newHook(t *testing.T, opts *Options) *Hook {
+	if opts.Path == "" {
+		opts.Path = filepath.Join(t.TempDir(), "comqtt.snapshot")
+	}
+
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(opts))
+	return h
+}
+
+func TestID(t *testing.T) {
+	h := new(Hook)
+	require.Equal(t, "memory-snapshot", h.ID())
+}
+
+func TestProvides(t *testing.T) {
+	h := new(Hook)
+	require.True(t, h.Provides(mqtt.OnSessionEstablished))
+	require.True(t, h.Provides(mqtt.OnDisconnect))
+	require.True(t, h.Provides(mqtt.OnSubscribed))
+	require.True(t, h.Provides(mqtt.OnRetainMessage))
+	require.True(t, h.Provides(mqtt.OnQosPublish))
+	require.True(t, h.Provides(mqtt.StoredClients))
+	require.True(t, h.Provides(mqtt.StoredSysInfo))
+	require.False(t, h.Provides(mqtt.OnACLCheck))
+}
+
+func TestInitBadConfig(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(map[string]any{})
+	require.Error(t, err)
+}
+
+func TestInitUseDefaults(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.ErrorIs(t, h.Healthy(), storage.ErrDBFileNotOpen)
+
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer os.Remove(defaultSnapshotFile)
+
+	require.Equal(t, defaultSnapshotFile, h.config.Path)
+	require.Equal(t, defaultInterval, h.config.Interval)
+	require.NoError(t, h.Healthy())
+	require.NoError(t, h.Stop())
+}
+
+func TestInitCorruptSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "comqtt.snapshot")
+	require.NoError(t, os.WriteFile(path, []byte("{"), 0600))
+
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.Error(t, h.Init(&Options{Path: path}))
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	h := newHook(t, &Options{Interval: -1})
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnSubscribed(client, pkf, []byte{1}, []int{1})
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("hello"), Created: 100}, 1)
+	h.OnQosPublish(client, packets.Packet{PacketID: 2, TopicName: "a/b/c", Payload: []byte("queued")}, 10, 0)
+	h.OnSysInfoTick(&system.Info{Version: "2.0.0", BytesReceived: 100})
+	require.NoError(t, h.Stop())
+
+	h2 := newHook(t, &Options{Path: h.config.Path, Interval: -1})
+	defer h2.Stop()
+
+	clients, err := h2.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+	require.Equal(t, client.ID, clients[0].ID)
+	require.Equal(t, client.Properties.Username, clients[0].Username)
+	require.Equal(t, client.Net.Listener, clients[0].Listener)
+
+	subs, err := h2.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+	require.Equal(t, "a/b/c", subs[0].Filter)
+	require.Equal(t, byte(1), subs[0].Qos)
+
+	retained, err := h2.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, retained, 1)
+	require.Equal(t, []byte("hello"), retained[0].Payload)
+
+	inflight, err := h2.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, inflight, 1)
+	require.Equal(t, uint16(2), inflight[0].PacketID)
+	require.Equal(t, int64(10), inflight[0].Sent)
+
+	sys, err := h2.StoredSysInfo()
+	require.NoError(t, err)
+	require.Equal(t, "2.0.0", sys.Version)
+	require.Equal(t, int64(100), sys.BytesReceived)
+}
+
+func TestDeletes(t *testing.T) {
+	h := newHook(t, &Options{Interval: -1})
+	defer h.Stop()
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnSubscribed(client, pkf, []byte{0}, []int{1})
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c"}, 1)
+	h.OnRetainMessage(client, packets.Packet{TopicName: "d/e/f"}, 1)
+	h.OnQosPublish(client, packets.Packet{PacketID: 1}, 0, 0)
+	h.OnQosPublish(client, packets.Packet{PacketID: 2}, 0, 0)
+
+	h.OnUnsubscribed(client, pkf, []byte{0}, []int{0})
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c"}, -1)
+	h.OnRetainedExpired("d/e/f")
+	h.OnQosComplete(client, packets.Packet{PacketID: 1})
+	h.OnQosDropped(client, packets.Packet{PacketID: 2})
+	h.OnClientExpired(client)
+
+	require.Empty(t, h.db.Clients)
+	require.Empty(t, h.db.Subscriptions)
+	require.Empty(t, h.db.Retained)
+	require.Empty(t, h.db.Inflight)
+}
+
+func TestOnDisconnect(t *testing.T) {
+	h := newHook(t, &Options{Interval: -1})
+	defer h.Stop()
+
+	cl := &mqtt.Client{ID: "expiring", Properties: mqtt.ClientProperties{ProtocolVersion: 5}}
+	cl.Properties.Props.SessionExpiryInterval = 60
+	cl.Properties.Props.SessionExpiryIntervalFlag = true
+	cl.Stop(nil)
+	h.OnDisconnect(cl, nil, false)
+	r := h.db.Clients[clientKey(cl)]
+	require.InDelta(t, time.Now().Unix(), r.Disconnected, 1)
+	require.InDelta(t, time.Now().Unix()+60, r.Expires, 1)
+
+	h.OnDisconnect(cl, nil, true)
+	require.NotContains(t, h.db.Clients, clientKey(cl))
+}
+
+func TestSnapshotOnlyWhenChanged(t *testing.T) {
+	h := newHook(t, &Options{Interval: -1})
+	defer h.Stop()
+
+	require.NoError(t, h.Snapshot())
+	_, err := os.Stat(h.config.Path)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	require.NoError(t, h.Snapshot())
+	require.FileExists(t, h.config.Path)
+	require.False(t, h.dirty.Load())
+}
+
+func TestSnapshotFailureRetries(t *testing.T) {
+	h := newHook(t, &Options{Path: filepath.Join(t.TempDir(), "missing", "comqtt.snapshot"), Interval: -1})
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	require.Error(t, h.Snapshot())
+	require.True(t, h.dirty.Load())
+	require.Error(t, h.Stop())
+}
+
+func TestSnapshotEvery(t *testing.T) {
+	h := newHook(t, &Options{Interval: time.Millisecond})
+	defer h.Stop()
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(h.config.Path)
+		return err == nil
+	}, time.Second, time.Millisecond)
+}
+
+func TestStorageMetrics(t *testing.T) {
+	h := newHook(t, &Options{Interval: -1})
+	defer h.Stop()
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnSubscribed(client, pkf, []byte{1}, []int{1})
+	_, err := h.StoredClients()
+	require.NoError(t, err)
+
+	m := h.StorageMetrics()
+	require.Equal(t, h.ID(), m.ID)
+	require.Equal(t, int64(2), m.Writes)
+	require.Equal(t, int64(1), m.Reads)
+	require.Equal(t, int64(2), m.Pending)
+	require.Equal(t, int64(0), m.Size)
+
+	require.NoError(t, h.Snapshot())
+	m = h.StorageMetrics()
+	require.Equal(t, int64(0), m.Pending)
+	require.Greater(t, m.Size, int64(0))
+}
@@ -0,0 +1,388 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package postgres
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/mqtt/system"
+)
+
+// testDsn is the database the tests run against when a postgresql server is running locally.
+const testDsn = "host=localhost port=5432 user=postgres password=12345678 dbname=comqtt sslmode=disable"
+
+var (
+	logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	client = &mqtt.Client{
+		ID: "test",
+		Net: mqtt.ClientConnection{
+			Remote:   "test.addr",
+			Listener: "listener",
+		},
+		Properties: mqtt.ClientProperties{
+			Username: []byte("username"),
+			Clean:    false,
+		},
+	}
+
+	pkf = packets.Packet{Filters: packets.Subscriptions{{Filter: "a/b/c"}}}
+)
+
+func hasPostgresql() bool {
+	c, err := net.Dial("tcp", "localhost:5432")
+	if err != nil {
+		return false
+	}
+	_ = c.Close()
+	return true
+}
+
+// newHook returns a hook writing to tables prefixed with the name of the test, which are
+// dropped when the test ends.
+func newHook(t *testing.T) *Hook {
+	if !hasPostgresql() {
+		t.Skip("no postgresql server running")
+	}
+
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(&Options{
+		Dsn:    testDsn,
+		Prefix: strings.ToLower(t.Name()) + "_",
+	})
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		if h.DB() == nil {
+			return
+		}
+		for _, key := range []string{storage.ClientKey, storage.SubscriptionKey, storage.RetainedKey, storage.InflightKey, storage.SysInfoKey} {
+			_, _ = h.DB().Exec(fmt.Sprintf("drop table if exists %s", h.Table(key)))
+		}
+		_ = h.Stop()
+	})
+
+	return h
+}
+
+func TestID(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.Equal(t, "postgres-db", h.ID())
+}
+
+func TestProvides(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.True(t, h.Provides(mqtt.OnSessionEstablished))
+	require.True(t, h.Provides(mqtt.OnDisconnect))
+	require.True(t, h.Provides(mqtt.OnSubscribed))
+	require.True(t, h.Provides(mqtt.OnUnsubscribed))
+	require.True(t, h.Provides(mqtt.OnRetainMessage))
+	require.True(t, h.Provides(mqtt.OnQosPublish))
+	require.True(t, h.Provides(mqtt.OnQosComplete))
+	require.True(t, h.Provides(mqtt.OnQosDropped))
+	require.True(t, h.Provides(mqtt.OnSysInfoTick))
+	require.True(t, h.Provides(mqtt.StoredClients))
+	require.True(t, h.Provides(mqtt.StoredInflightMessages))
+	require.True(t, h.Provides(mqtt.StoredRetainedMessages))
+	require.True(t, h.Provides(mqtt.StoredSubscriptions))
+	require.True(t, h.Provides(mqtt.StoredSysInfo))
+	require.False(t, h.Provides(mqtt.OnACLCheck))
+	require.False(t, h.Provides(mqtt.OnConnectAuthenticate))
+}
+
+func TestTable(t *testing.T) {
+	require.Equal(t, `"comqtt_cl"`, dialect{prefix: defaultPrefix}.Table(storage.ClientKey))
+	require.Equal(t, "$2", dialect{}.Bindvar(2))
+}
+
+func TestInitBadConfig(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(map[string]any{})
+	require.Error(t, err)
+}
+
+func TestInitBadDsn(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(&Options{Dsn: "host=127.0.0.1 port=1 dbname=comqtt sslmode=disable connect_timeout=1"})
+	require.Error(t, err)
+	require.Nil(t, h.DB())
+	require.Equal(t, defaultPrefix, h.config.Prefix)
+}
+
+func TestHealthyNoDB(t *testing.T) {
+	h := new(Hook)
+	require.ErrorIs(t, h.Healthy(), storage.ErrDBFileNotOpen)
+}
+
+func TestNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnWillSent(client, packets.Packet{})
+	h.OnDisconnect(client, nil, true)
+	h.OnClientExpired(client)
+	h.OnSubscribed(client, pkf, []byte{0}, nil)
+	h.OnUnsubscribed(client, pkf, nil, nil)
+	h.OnRetainMessage(client, packets.Packet{}, 1)
+	h.OnRetainedExpired("a/b/c")
+	h.OnQosPublish(client, packets.Packet{}, time.Now().Unix(), 0)
+	h.OnQosComplete(client, packets.Packet{})
+	h.OnQosDropped(client, packets.Packet{})
+	h.OnSysInfoTick(new(system.Info))
+
+	clients, err := h.StoredClients()
+	require.Empty(t, clients)
+	require.NoError(t, err)
+	subs, err := h.StoredSubscriptions()
+	require.Empty(t, subs)
+	require.NoError(t, err)
+	retained, err := h.StoredRetainedMessages()
+	require.Empty(t, retained)
+	require.NoError(t, err)
+	inflight, err := h.StoredInflightMessages()
+	require.Empty(t, inflight)
+	require.NoError(t, err)
+	sys, err := h.StoredSysInfo()
+	require.Empty(t, sys)
+	require.NoError(t, err)
+}
+
+func TestHealthy(t *testing.T) {
+	h := newHook(t)
+	require.NoError(t, h.Healthy())
+}
+
+func TestStorageMetrics(t *testing.T) {
+	h := newHook(t)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnSubscribed(client, pkf, []byte{1}, []int{1})
+	_, err := h.StoredClients()
+	require.NoError(t, err)
+	_, err = h.StoredSysInfo() // a missing record is not a failed read
+	require.NoError(t, err)
+
+	m := h.StorageMetrics()
+	require.Equal(t, h.ID(), m.ID)
+	require.Equal(t, int64(2), m.Writes)
+	require.Equal(t, int64(0), m.WriteErrors)
+	require.Equal(t, int64(2), m.Reads)
+	require.Equal(t, int64(0), m.ReadErrors)
+	require.Greater(t, m.Size, int64(0))
+}
+
+func TestOnSessionEstablishedThenOnDisconnect(t *testing.T) {
+	h := newHook(t)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	r, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, client.ID, r[0].ID)
+	require.Equal(t, client.Net.Remote, r[0].Remote)
+	require.Equal(t, client.Net.Listener, r[0].Listener)
+	require.Equal(t, client.Properties.Username, r[0].Username)
+	require.Equal(t, client.Properties.Clean, r[0].Clean)
+
+	h.OnDisconnect(client, nil, false)
+	r, err = h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+
+	h.OnDisconnect(client, nil, true)
+	r, err = h.StoredClients()
+	require.NoError(t, err)
+	require.Empty(t, r)
+}
+
+func TestOnWillSent(t *testing.T) {
+	h := newHook(t)
+
+	cl := &mqtt.Client{ID: "cl1"}
+	cl.Properties.Will.Flag = 1
+	h.OnWillSent(cl, packets.Packet{})
+
+	r, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, uint32(1), r[0].Will.Flag)
+}
+
+func TestOnSessionEstablishedCleanStart(t *testing.T) {
+	h := newHook(t)
+
+	cl := &mqtt.Client{ID: "cl1"}
+	other := &mqtt.Client{ID: "cl10"}
+	pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}, PacketID: 1}
+	h.OnSubscribed(cl, pkf, []byte{0}, nil)
+	h.OnSubscribed(other, pkf, []byte{0}, nil)
+	h.OnQosPublish(cl, pk, time.Now().Unix(), 0)
+	h.OnQosPublish(other, pk, time.Now().Unix(), 0)
+
+	h.OnSessionEstablished(cl, packets.Packet{})
+	subs, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+
+	cl.Properties.Clean = true
+	h.OnSessionEstablished(cl, packets.Packet{})
+	subs, err = h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+	require.Equal(t, other.ID, subs[0].Client)
+
+	msgs, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	require.Equal(t, other.ID, msgs[0].Client)
+}
+
+func TestOnClientExpiredRemovesSession(t *testing.T) {
+	h := newHook(t)
+
+	cl := &mqtt.Client{ID: "cl1"}
+	h.OnSessionEstablished(cl, packets.Packet{})
+	h.OnSubscribed(cl, pkf, []byte{0}, nil)
+	h.OnQosPublish(cl, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}, PacketID: 1}, time.Now().Unix(), 0)
+
+	h.OnClientExpired(cl)
+
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Empty(t, clients)
+	subs, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Empty(t, subs)
+	msgs, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Empty(t, msgs)
+}
+
+func TestOnSubscribedThenOnUnsubscribed(t *testing.T) {
+	h := newHook(t)
+
+	pk := packets.Packet{ProtocolVersion: 5, Filters: packets.Subscriptions{{Filter: "a/b", Identifier: 3}, {Filter: "c/d"}}}
+	h.OnSubscribed(client, pk, []byte{0, 1}, nil)
+
+	subs, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+	sort.Slice(subs, func(i, j int) bool { return subs[i].Filter < subs[j].Filter })
+	require.Equal(t, client.ID, subs[0].Client)
+	require.Equal(t, 3, subs[0].Identifier)
+	require.Equal(t, byte(1), subs[1].Qos)
+
+	h.OnUnsubscribed(client, pk, nil, nil)
+	subs, err = h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Empty(t, subs)
+}
+
+func TestOnRetainMessageThenUnset(t *testing.T) {
+	h := newHook(t)
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Retain: true},
+		Payload:     []byte("hello"),
+		TopicName:   "a/b/c",
+	}
+	h.OnRetainMessage(client, pk, 1)
+
+	r, err := h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, pk.TopicName, r[0].TopicName)
+	require.Equal(t, pk.Payload, r[0].Payload)
+
+	h.OnRetainMessage(client, pk, -1)
+	r, err = h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Empty(t, r)
+
+	h.OnRetainMessage(client, pk, 1)
+	h.OnRetainedExpired(pk.TopicName)
+	r, err = h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Empty(t, r)
+}
+
+func TestOnQosPublishThenQOSComplete(t *testing.T) {
+	h := newHook(t)
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 2},
+		PacketID:    7,
+		Payload:     []byte("hello"),
+		TopicName:   "a/b/c",
+	}
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+
+	r, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, pk.TopicName, r[0].TopicName)
+	require.Equal(t, pk.Payload, r[0].Payload)
+	require.Equal(t, uint16(7), r[0].ToPacket().PacketID)
+	require.True(t, time.Now().Unix()-1 < r[0].Sent)
+
+	// OnQosDropped is a passthrough to OnQosComplete here
+	h.OnQosDropped(client, pk)
+	r, err = h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Empty(t, r)
+}
+
+func TestOnQosPublishNoStageRegression(t *testing.T) {
+	h := newHook(t)
+
+	pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pubrel, Qos: 1}, PacketID: 7}
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+
+	pk.FixedHeader = packets.FixedHeader{Type: packets.Publish, Qos: 2}
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+
+	r, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, packets.Pubrel, r[0].ToPacket().FixedHeader.Type)
+}
+
+func TestOnSysInfoTick(t *testing.T) {
+	h := newHook(t)
+
+	r, err := h.StoredSysInfo()
+	require.NoError(t, err)
+	require.Empty(t, r.ID)
+
+	info := &system.Info{Version: "2.0.0", BytesReceived: 100}
+	h.OnSysInfoTick(info)
+	info.BytesReceived = 200
+	h.OnSysInfoTick(info)
+
+	r, err = h.StoredSysInfo()
+	require.NoError(t, err)
+	require.Equal(t, storage.SysInfoKey, r.ID)
+	require.Equal(t, int64(200), r.Info.BytesReceived)
+}
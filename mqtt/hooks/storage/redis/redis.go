@@ -7,8 +7,13 @@ package redis
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/wind-c/comqtt/v2/mqtt"
 	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
@@ -21,9 +26,24 @@ import (
 // defaultAddr is the default address to the redis service.
 const defaultAddr = "localhost:6379"
 
+// healthTimeout is the time allowed for the redis service to answer a health check ping.
+const healthTimeout = 2 * time.Second
+
 // defaultHPrefix is a prefix to better identify hsets created by comqtt.
 const defaultHPrefix = "comqtt-"
 
+// scanCount is the number of keys asked of each scan for the hashes of the clients.
+const scanCount = 1000
+
+// globEscaper escapes the characters of a key prefix which a scan would match as a pattern.
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// errNoClient indicates a record of a shared hash has no client to move it to.
+var errNoClient = errors.New("record has no client")
+
+// defaultPipelineSize is the most writes waiting to be pipelined before writers wait for a flush.
+const defaultPipelineSize = 10000
+
 // clientKey returns a primary key for a client.
 func clientKey(cl *mqtt.Client) string {
 	return cl.ID
@@ -49,18 +69,126 @@ func sysInfoKey() string {
 	return storage.SysInfoKey
 }
 
+// establishSessionScript writes the session record of a client and, on a clean start,
+// discards the subscriptions and inflight messages of its previous session in one step.
+//
+// KEYS: clients, subscriptions of the client, inflights of the client
+// ARGV: client id, client record, 1 if clean start
+var establishSessionScript = redis.NewScript(`
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+if ARGV[3] == '1' then
+	redis.call('DEL', KEYS[2], KEYS[3])
+end
+return 1
+`)
+
+// expireSessionScript deletes the session record, subscriptions and inflight messages of
+// a client in one step, so a broker crashing mid-expiry cannot leave orphaned entries.
+//
+// KEYS: clients, subscriptions of the client, inflights of the client
+// ARGV: client id
+var expireSessionScript = redis.NewScript(`
+redis.call('HDEL', KEYS[1], ARGV[1])
+redis.call('DEL', KEYS[2], KEYS[3])
+return 1
+`)
+
+// inflightScript writes an inflight message unless a later stage of the same qos flow
+// is already stored, so a delayed write cannot roll a flow back, e.g. from pubrel to publish.
+//
+// KEYS: inflights of the client
+// ARGV: packet key, message record, packet type of the message
+var inflightScript = redis.NewScript(`
+local v = redis.call('HGET', KEYS[1], ARGV[1])
+if v and cjson.decode(v).fixedheader.type > tonumber(ARGV[3]) then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+return 1
+`)
+
+// expireMessagesScript deletes the messages of a hash which were created before a cutoff.
+//
+// KEYS: messages
+// ARGV: cutoff unix time
+var expireMessagesScript = redis.NewScript(`
+local n = 0
+local rows = redis.call('HGETALL', KEYS[1])
+for i = 1, #rows, 2 do
+	if cjson.decode(rows[i + 1]).created < tonumber(ARGV[1]) then
+		redis.call('HDEL', KEYS[1], rows[i])
+		n = n + 1
+	end
+end
+return n
+`)
+
+// expireSessionsScript deletes the session records of the clients which disconnected before
+// a cutoff, or whose sessions expired before now, together with their subscriptions and
+// inflight messages. The keys of the hashes of each client are built from their prefixes,
+// which share the hash tag of the clients hash in a redis cluster.
+//
+// KEYS: clients
+// ARGV: cutoff unix time or 0, now unix time or 0, subscriptions prefix, inflights prefix
+var expireSessionsScript = redis.NewScript(`
+local n = 0
+local cutoff, now = tonumber(ARGV[1]), tonumber(ARGV[2])
+local rows = redis.call('HGETALL', KEYS[1])
+for i = 1, #rows, 2 do
+	local c = cjson.decode(rows[i + 1])
+	if (cutoff > 0 and c.disconnected and c.disconnected < cutoff) or (now > 0 and c.expires and c.expires < now) then
+		redis.call('HDEL', KEYS[1], rows[i])
+		redis.call('DEL', ARGV[3] .. rows[i], ARGV[4] .. rows[i])
+		n = n + 1
+	end
+end
+return n
+`)
+
 // Options contains configuration settings for the bolt instance.
 type Options struct {
-	HPrefix string
-	Options *redis.Options
+	HPrefix   string
+	Options   *redis.Options
+	Universal *redis.UniversalOptions // a redis cluster or sentinel failover group, used instead of Options if set
+	Expiry    storage.Expiry          // the ages after which stored records are deleted
+
+	// WriteBehind buffers the writes of the hook, sending them in batches of one pipeline.
+	WriteBehind storage.WriteBehind
+
+	// Pipeline sends the writes made while a pipeline is in flight together in the next one,
+	// each writer waiting until its own write is applied. Under high connect and publish churn
+	// this makes far fewer round trips without the loss of writes of write-behind mode, which
+	// takes precedence if enabled.
+	Pipeline bool
+
+	// Multi sends each pipeline of writes as a MULTI/EXEC transaction, so that it is applied
+	// whole or not at all, and other clients never see part of it.
+	Multi bool
+
+	// Health pings the redis service in the background, failing writes and reads at once
+	// while it is unavailable rather than each waiting on it, until it is reachable again.
+	// With the fail-closed policy, new connections are refused while it is unavailable.
+	Health storage.HealthOptions
+}
+
+// write is a write to the store, a command or a script run with keys.
+type write struct {
+	script *redis.Script // the script to run with keys and args, or nil to run args as a command
+	keys   []string      // the keys of the script
+	args   []any         // the arguments of the script, or the command and its arguments
+	done   chan error    // receives the result of a pipelined write, nil in write-behind mode
 }
 
 // Hook is a persistent storage hook based using Redis as a backend.
 type Hook struct {
 	mqtt.HookBase
-	config *Options        // options for connecting to the Redis instance.
-	db     *redis.Client   // the Redis instance
-	ctx    context.Context // a context for the connection
+	config  *Options               // options for connecting to the Redis instance.
+	db      redis.UniversalClient  // the Redis instance, cluster or failover group
+	ctx     context.Context        // a context for the connection
+	cancel  chan struct{}          // stops deleting expired records
+	buffer  *storage.Buffer[write] // the buffered writes in write-behind mode
+	metrics mqtt.StorageRecorder   // counts the writes and reads of the hook
+	health  *storage.Health        // the circuit of the connection, nil if not checked
 }
 
 // ID returns the id of the hook.
@@ -71,6 +199,7 @@ func (h *Hook) ID() string {
 // Provides indicates which hook methods this hook provides.
 func (h *Hook) Provides(b byte) bool {
 	return bytes.Contains([]byte{
+		mqtt.OnConnect,
 		mqtt.OnSessionEstablished,
 		mqtt.OnDisconnect,
 		mqtt.OnSubscribed,
@@ -96,6 +225,12 @@ func (h *Hook) hKey(s string) string {
 	return h.config.HPrefix + s
 }
 
+// clientHKey returns the key of the hash holding the subscriptions or inflight messages
+// of a client, so that they can be deleted with the key rather than field by field.
+func (h *Hook) clientHKey(t, id string) string {
+	return h.hKey(t + ":" + id)
+}
+
 // Init initializes and connects to the redis service.
 func (h *Hook) Init(config any) error {
 	if _, ok := config.(*Options); !ok && config != nil {
@@ -116,34 +251,433 @@ func (h *Hook) Init(config any) error {
 	if h.config.HPrefix == "" {
 		h.config.HPrefix = defaultHPrefix
 	}
+	if err := h.config.Health.Validate(); err != nil {
+		return err
+	}
 
-	h.Log.Info("connecting to redis service",
-		"address", h.config.Options.Addr,
-		"username", h.config.Options.Username,
-		"password-len", len(h.config.Options.Password),
-		"db", h.config.Options.DB)
+	if h.config.Universal != nil {
+		h.Log.Info("connecting to redis service",
+			"addresses", h.config.Universal.Addrs,
+			"master", h.config.Universal.MasterName,
+			"username", h.config.Universal.Username,
+			"password-len", len(h.config.Universal.Password),
+			"db", h.config.Universal.DB)
+		h.db = redis.NewUniversalClient(h.config.Universal)
+	} else {
+		h.Log.Info("connecting to redis service",
+			"address", h.config.Options.Addr,
+			"username", h.config.Options.Username,
+			"password-len", len(h.config.Options.Password),
+			"db", h.config.Options.DB)
+		h.db = redis.NewClient(h.config.Options)
+	}
+
+	// the session scripts write several hashes at once, which a redis cluster only allows
+	// if they are in the same slot, so the prefix becomes the hash tag of every key.
+	if _, ok := h.db.(*redis.ClusterClient); ok {
+		h.config.HPrefix = "{" + h.config.HPrefix + "}"
+	}
 
-	h.db = redis.NewClient(h.config.Options)
 	_, err := h.db.Ping(context.Background()).Result()
 	if err != nil {
 		return fmt.Errorf("failed to ping service: %w", err)
 	}
 
 	h.Log.Info("connected to redis service")
+	if err := h.migrate(); err != nil {
+		return fmt.Errorf("failed to migrate stored sessions: %w", err)
+	}
+
+	h.health = storage.NewHealth(h.config.Health, func(ctx context.Context) error {
+		return h.db.Ping(ctx).Err()
+	}, h.Log)
+
+	if h.config.Expiry.Enabled() {
+		h.cancel = make(chan struct{})
+		go h.gc(h.config.Expiry.GcInterval(), h.cancel)
+	}
+
+	if h.config.WriteBehind.Enabled {
+		h.buffer = storage.NewBuffer(h.config.WriteBehind, h.applyWrites)
+	} else if h.config.Pipeline {
+		// a write is flushed as soon as it is added, or once the pipeline in flight is applied
+		h.buffer = storage.NewBuffer(storage.WriteBehind{Size: defaultPipelineSize, Batch: 1, Interval: time.Second}, h.applyWrites)
+	}
+
+	return nil
+}
+
+// migrate moves the subscriptions and inflight messages which earlier versions kept in one
+// hash shared by all clients, keyed client:id, into the hashes of their clients.
+func (h *Hook) migrate() error {
+	for _, t := range []string{storage.SubscriptionKey, storage.InflightKey} {
+		rows, err := h.db.HGetAll(h.ctx, h.hKey(t)).Result()
+		if err != nil {
+			return err
+		}
+
+		if len(rows) == 0 {
+			continue
+		}
+
+		pipe := h.db.TxPipeline()
+		for field, row := range rows {
+			cid, row, err := h.migrateRecord(t, field, row)
+			if err != nil {
+				h.Log.Warn("dropping stored record without a client", "key", h.hKey(t), "field", field, "error", err)
+				continue
+			}
+
+			pipe.HSet(h.ctx, h.clientHKey(t, cid), strings.TrimPrefix(field, cid+":"), row)
+		}
+		pipe.Del(h.ctx, h.hKey(t))
+
+		if _, err := pipe.Exec(h.ctx); err != nil {
+			return err
+		}
+
+		h.Log.Info("moved stored records into the hashes of their clients", "key", h.hKey(t), "records", len(rows))
+	}
 
 	return nil
 }
 
-// Stop closes the redis connection.
+// migrateRecord returns the client of a record of a shared hash, and the record with its
+// client set. Inflight messages stored before messages recorded their client are keyed
+// <client id>:<packet id>, so the client is taken from the field.
+func (h *Hook) migrateRecord(t, field, row string) (string, string, error) {
+	var d struct {
+		Client string `json:"client"`
+	}
+	if err := json.Unmarshal([]byte(row), &d); err != nil {
+		return "", "", err
+	}
+
+	if d.Client != "" {
+		return d.Client, row, nil
+	}
+
+	i := strings.LastIndex(field, ":")
+	if t != storage.InflightKey || i <= 0 {
+		return "", "", errNoClient
+	}
+
+	var m storage.Message
+	if err := m.UnmarshalBinary([]byte(row)); err != nil {
+		return "", "", err
+	}
+
+	m.Client = field[:i]
+	b, err := m.MarshalBinary()
+	if err != nil {
+		return "", "", err
+	}
+
+	return m.Client, string(b), nil
+}
+
+// Stop closes the redis connection, once any buffered writes have been sent.
 func (h *Hook) Stop() error {
+	if h.cancel != nil {
+		close(h.cancel)
+		h.cancel = nil
+	}
+
+	if h.buffer != nil {
+		h.buffer.Stop()
+		h.buffer = nil
+	}
+
+	h.health.Stop()
+	h.health = nil
+
 	h.Log.Info("disconnecting from redis service")
 
 	return h.db.Close()
 }
 
+// Healthy pings the redis service, returning an error if it cannot be reached.
+func (h *Hook) Healthy() error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	if err := h.health.Allow(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(h.ctx, healthTimeout)
+	defer cancel()
+	return h.db.Ping(ctx).Err()
+}
+
+// StorageMetrics returns the writes and reads of the hook, the buffered or pipelined writes
+// and the memory used by the redis service, as reported by the node it is connected to, and
+// the state of the circuit of the connection.
+func (h *Hook) StorageMetrics() mqtt.StorageMetrics {
+	var pending int
+	if h.buffer != nil {
+		pending = h.buffer.Len()
+	}
+
+	var size int64
+	if h.db != nil && h.health.Available() {
+		ctx, cancel := context.WithTimeout(h.ctx, healthTimeout)
+		defer cancel()
+		if info, err := h.db.Info(ctx, "memory").Result(); err == nil {
+			size = usedMemory(info)
+		}
+	}
+
+	m := h.metrics.Metrics(h.ID(), pending, size)
+	if h.health != nil {
+		m.Circuit = h.health.Status().State
+	}
+
+	return m
+}
+
+// HealthStatus returns the state of the circuit of the connection to the redis service.
+func (h *Hook) HealthStatus() storage.HealthStatus {
+	return h.health.Status()
+}
+
+// unreachable returns true if err is a failure to reach the redis service, rather than
+// a missing value or an error replied by the service.
+func unreachable(err error) bool {
+	var reply redis.Error
+	return err != nil && !errors.Is(err, redis.Nil) && !errors.As(err, &reply)
+}
+
+// failed logs a failed write or read, at debug level if the redis service is unavailable,
+// as the outage is logged when it begins.
+func (h *Hook) failed(msg string, err error, args ...any) {
+	if errors.Is(err, storage.ErrUnavailable) {
+		h.Log.Debug(msg, append([]any{"error", err}, args...)...)
+		return
+	}
+
+	h.Log.Error(msg, append([]any{"error", err}, args...)...)
+}
+
+// OnConnect refuses new connections while the redis service is unavailable, if the
+// policy is to fail closed, as their sessions could not be stored.
+func (h *Hook) OnConnect(cl *mqtt.Client, pk packets.Packet) error {
+	if h.health.FailClosed() {
+		h.Log.Debug("connection refused while redis is unavailable", "client", cl.ID)
+		return packets.ErrServerUnavailable
+	}
+
+	return nil
+}
+
+// usedMemory returns the used_memory field of the memory section of an INFO reply.
+func usedMemory(info string) int64 {
+	for _, line := range strings.Split(info, "\n") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(line), "used_memory:"); ok {
+			n, _ := strconv.ParseInt(v, 10, 64)
+			return n
+		}
+	}
+
+	return 0
+}
+
+// exec runs a write on the store, buffers it in write-behind mode, or adds it to the next
+// pipeline and waits until it is applied. It fails at once while the store is unavailable.
+func (h *Hook) exec(w write) error {
+	start := time.Now()
+	if err := h.health.Allow(); err != nil {
+		h.metrics.Write(start, err)
+		return err
+	}
+
+	err := h.send(w)
+	if h.buffer == nil {
+		h.health.Record(unreachable(err))
+	}
+	h.metrics.Write(start, notNil(err))
+	return err
+}
+
+// send runs or buffers a write for exec.
+func (h *Hook) send(w write) error {
+	if h.buffer != nil && !h.config.WriteBehind.Enabled {
+		w.done = make(chan error, 1)
+		h.buffer.Add(w)
+		return <-w.done
+	}
+
+	if h.buffer != nil {
+		h.buffer.Add(w)
+		return nil
+	}
+
+	if w.script != nil {
+		return w.script.Run(h.ctx, h.db, w.keys, w.args...).Err()
+	}
+
+	return h.db.Do(h.ctx, w.args...).Err()
+}
+
+// hgetall reads all the fields of a hash, failing at once while the store is unavailable.
+func (h *Hook) hgetall(key string) (map[string]string, error) {
+	start := time.Now()
+	if err := h.health.Allow(); err != nil {
+		h.metrics.Read(start, err)
+		return nil, err
+	}
+
+	rows, err := h.db.HGetAll(h.ctx, key).Result()
+	h.health.Record(unreachable(err))
+	h.metrics.Read(start, err)
+	return rows, err
+}
+
+// hgetallClients reads all the fields of the hashes of a type of record held for each
+// client, failing at once while the store is unavailable.
+func (h *Hook) hgetallClients(t string) ([]string, error) {
+	start := time.Now()
+	if err := h.health.Allow(); err != nil {
+		h.metrics.Read(start, err)
+		return nil, err
+	}
+
+	keys, err := h.clientHKeys(t)
+	var rows []string
+	if err == nil && len(keys) > 0 {
+		pipe := h.db.Pipeline()
+		cmds := make([]*redis.MapStringStringCmd, len(keys))
+		for i, key := range keys {
+			cmds[i] = pipe.HGetAll(h.ctx, key)
+		}
+
+		_, err = pipe.Exec(h.ctx)
+		for _, cmd := range cmds {
+			for _, row := range cmd.Val() {
+				rows = append(rows, row)
+			}
+		}
+	}
+
+	h.health.Record(unreachable(err))
+	h.metrics.Read(start, err)
+	return rows, err
+}
+
+// clientHKeys returns the keys of the hashes of a type of record held for each client. In a
+// redis cluster they share the hash tag of the prefix, so each master is scanned for them.
+func (h *Hook) clientHKeys(t string) ([]string, error) {
+	match := globEscaper.Replace(h.clientHKey(t, "")) + "*"
+	scan := func(ctx context.Context, c redis.Cmdable) ([]string, error) {
+		var keys []string
+		iter := c.Scan(ctx, 0, match, scanCount).Iterator()
+		for iter.Next(ctx) {
+			keys = append(keys, iter.Val())
+		}
+
+		return keys, iter.Err()
+	}
+
+	cc, ok := h.db.(*redis.ClusterClient)
+	if !ok {
+		return scan(h.ctx, h.db)
+	}
+
+	var mu sync.Mutex
+	var keys []string
+	err := cc.ForEachMaster(h.ctx, func(ctx context.Context, c *redis.Client) error {
+		k, err := scan(ctx, c)
+		mu.Lock()
+		keys = append(keys, k...)
+		mu.Unlock()
+		return err
+	})
+
+	return keys, err
+}
+
+// notNil returns nil if err is redis.Nil, which is a missing value rather than a failure.
+func notNil(err error) error {
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+
+	return err
+}
+
+// hset sets the fields of a hash to the values, given as field and value pairs.
+func (h *Hook) hset(key string, values ...any) error {
+	return h.exec(write{args: append([]any{"hset", key}, values...)})
+}
+
+// hdel deletes fields from a hash.
+func (h *Hook) hdel(key string, fields ...string) error {
+	args := []any{"hdel", key}
+	for _, f := range fields {
+		args = append(args, f)
+	}
+
+	return h.exec(write{args: args})
+}
+
+// run runs a script with keys and args.
+func (h *Hook) run(script *redis.Script, keys []string, args ...any) error {
+	return h.exec(write{script: script, keys: keys, args: args})
+}
+
+// applyWrites sends a batch of buffered writes in one pipeline, or one transaction if Multi
+// is set, returning the result of each pipelined write to its writer. The scripts are sent
+// whole rather than by their hashes, as the script cache of the service may have been flushed.
+func (h *Hook) applyWrites(batch []write) {
+	pipe := h.db.Pipeline()
+	if h.config.Multi {
+		pipe = h.db.TxPipeline()
+	}
+
+	cmds := make([]*redis.Cmd, len(batch))
+	for i, w := range batch {
+		if w.script != nil {
+			cmds[i] = w.script.Eval(h.ctx, pipe, w.keys, w.args...)
+		} else {
+			cmds[i] = pipe.Do(h.ctx, w.args...)
+		}
+	}
+
+	_, err := pipe.Exec(h.ctx)
+	h.health.Record(unreachable(err))
+	for i, cmd := range cmds {
+		err := cmd.Err()
+		if errors.Is(err, redis.Nil) {
+			err = nil
+		}
+
+		if batch[i].done != nil {
+			batch[i].done <- err
+		} else if err != nil {
+			h.metrics.WriteFailed(1)
+			h.failed("failed to apply buffered write", err, "command", cmd.Name())
+		}
+	}
+}
+
 // OnSessionEstablished adds a client to the store when their session is established.
 func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
-	h.updateClient(cl)
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	clean := "0"
+	if cl.Properties.Clean {
+		clean = "1"
+	}
+
+	keys := []string{h.hKey(storage.ClientKey), h.clientHKey(storage.SubscriptionKey, cl.ID), h.clientHKey(storage.InflightKey, cl.ID)}
+	err := h.run(establishSessionScript, keys, clientKey(cl), h.client(cl), clean)
+	if err != nil {
+		h.failed("failed to establish session", err, "id", clientKey(cl))
+	}
 }
 
 // OnWillSent is called when a client sends a Will Message and the Will Message is removed from the client record.
@@ -158,6 +692,15 @@ func (h *Hook) updateClient(cl *mqtt.Client) {
 		return
 	}
 
+	in := h.client(cl)
+	err := h.hset(h.hKey(storage.ClientKey), clientKey(cl), in)
+	if err != nil {
+		h.failed("failed to hset client data", err, "data", in)
+	}
+}
+
+// client returns the storable session record of a client.
+func (h *Hook) client(cl *mqtt.Client) *storage.Client {
 	props := cl.Properties.Props.Copy(false)
 	in := &storage.Client{
 		ID:              clientKey(cl),
@@ -180,31 +723,41 @@ func (h *Hook) updateClient(cl *mqtt.Client) {
 		},
 		Will: storage.ClientWill(cl.Properties.Will),
 	}
-
-	err := h.db.HSet(h.ctx, h.hKey(storage.ClientKey), clientKey(cl), in).Err()
-	if err != nil {
-		h.Log.Error("failed to hset client data", "error", err, "data", in)
+	if cl.Closed() {
+		in.Disconnected = time.Now().Unix()
+		in.Expires = cl.SessionExpiry()
 	}
+
+	return in
 }
 
-// OnDisconnect removes a client from the store if they were using a clean session.
+// OnDisconnect removes a client from the store if they were using a clean session, or
+// records the time they disconnected otherwise.
 func (h *Hook) OnDisconnect(cl *mqtt.Client, _ error, expire bool) {
 	if h.db == nil {
 		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
 		return
 	}
 
-	if !expire {
+	if cl.StopCause() == packets.ErrSessionTakenOver {
 		return
 	}
 
-	if cl.StopCause() == packets.ErrSessionTakenOver {
+	if !expire {
+		h.updateClient(cl)
 		return
 	}
 
-	err := h.db.HDel(h.ctx, h.hKey(storage.ClientKey), clientKey(cl)).Err()
+	h.expireSession(cl)
+}
+
+// expireSession removes the session record, subscriptions and inflight messages of a
+// client from the store.
+func (h *Hook) expireSession(cl *mqtt.Client) {
+	keys := []string{h.hKey(storage.ClientKey), h.clientHKey(storage.SubscriptionKey, cl.ID), h.clientHKey(storage.InflightKey, cl.ID)}
+	err := h.run(expireSessionScript, keys, clientKey(cl))
 	if err != nil {
-		h.Log.Error("failed to delete client", "error", err, "id", clientKey(cl))
+		h.failed("failed to delete client", err, "id", clientKey(cl))
 	}
 }
 
@@ -215,9 +768,10 @@ func (h *Hook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []by
 		return
 	}
 
-	var in *storage.Subscription
+	// all filters of the packet are written with a single hset, which redis applies atomically.
+	values := make([]any, 0, len(pk.Filters)*2)
 	for i := 0; i < len(pk.Filters); i++ {
-		in = &storage.Subscription{
+		in := &storage.Subscription{
 			ID:     subscriptionKey(cl, pk.Filters[i].Filter),
 			T:      storage.SubscriptionKey,
 			Client: cl.ID,
@@ -231,10 +785,16 @@ func (h *Hook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []by
 			in.RetainAsPublished = pk.Filters[i].RetainAsPublished
 		}
 
-		err := h.db.HSet(h.ctx, h.hKey(storage.SubscriptionKey), subscriptionKey(cl, pk.Filters[i].Filter), in).Err()
-		if err != nil {
-			h.Log.Error("failed to hset subscription data", "error", err, "data", in)
-		}
+		values = append(values, pk.Filters[i].Filter, in)
+	}
+
+	if len(values) == 0 {
+		return
+	}
+
+	err := h.hset(h.clientHKey(storage.SubscriptionKey, cl.ID), values...)
+	if err != nil {
+		h.failed("failed to hset subscription data", err, "id", clientKey(cl))
 	}
 }
 
@@ -245,11 +805,18 @@ func (h *Hook) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []
 		return
 	}
 
+	if len(pk.Filters) == 0 {
+		return
+	}
+
+	fields := make([]string, len(pk.Filters))
 	for i := 0; i < len(pk.Filters); i++ {
-		err := h.db.HDel(h.ctx, h.hKey(storage.SubscriptionKey), subscriptionKey(cl, pk.Filters[i].Filter)).Err()
-		if err != nil {
-			h.Log.Error("failed to delete subscription data", "error", err, "id", clientKey(cl))
-		}
+		fields[i] = pk.Filters[i].Filter
+	}
+
+	err := h.hdel(h.clientHKey(storage.SubscriptionKey, cl.ID), fields...)
+	if err != nil {
+		h.failed("failed to delete subscription data", err, "id", clientKey(cl))
 	}
 }
 
@@ -261,9 +828,9 @@ func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
 	}
 
 	if r == -1 {
-		err := h.db.HDel(h.ctx, h.hKey(storage.RetainedKey), retainedKey(pk.TopicName)).Err()
+		err := h.hdel(h.hKey(storage.RetainedKey), retainedKey(pk.TopicName))
 		if err != nil {
-			h.Log.Error("failed to delete retained message data", "error", err, "id", retainedKey(pk.TopicName))
+			h.failed("failed to delete retained message data", err, "id", retainedKey(pk.TopicName))
 		}
 
 		return
@@ -290,9 +857,9 @@ func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
 		},
 	}
 
-	err := h.db.HSet(h.ctx, h.hKey(storage.RetainedKey), retainedKey(pk.TopicName), in).Err()
+	err := h.hset(h.hKey(storage.RetainedKey), retainedKey(pk.TopicName), in)
 	if err != nil {
-		h.Log.Error("failed to hset retained message data", "error", err, "data", in)
+		h.failed("failed to hset retained message data", err, "data", in)
 	}
 }
 
@@ -308,6 +875,8 @@ func (h *Hook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, rese
 		ID:          inflightKey(cl, pk),
 		T:           storage.InflightKey,
 		Origin:      pk.Origin,
+		Client:      cl.ID,
+		PacketID:    pk.PacketID,
 		FixedHeader: pk.FixedHeader,
 		TopicName:   pk.TopicName,
 		Payload:     pk.Payload,
@@ -325,9 +894,10 @@ func (h *Hook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, rese
 		},
 	}
 
-	err := h.db.HSet(h.ctx, h.hKey(storage.InflightKey), inflightKey(cl, pk), in).Err()
+	keys := []string{h.clientHKey(storage.InflightKey, cl.ID)}
+	err := h.run(inflightScript, keys, pk.FormatID(), in, int(pk.FixedHeader.Type))
 	if err != nil {
-		h.Log.Error("failed to hset qos inflight message data", "error", err, "data", in)
+		h.failed("failed to hset qos inflight message data", err, "data", in)
 	}
 }
 
@@ -338,9 +908,9 @@ func (h *Hook) OnQosComplete(cl *mqtt.Client, pk packets.Packet) {
 		return
 	}
 
-	err := h.db.HDel(h.ctx, h.hKey(storage.InflightKey), inflightKey(cl, pk)).Err()
+	err := h.hdel(h.clientHKey(storage.InflightKey, cl.ID), pk.FormatID())
 	if err != nil {
-		h.Log.Error("failed to delete qos inflight message data", "error", err, "id", inflightKey(cl, pk))
+		h.failed("failed to delete qos inflight message data", err, "id", inflightKey(cl, pk))
 	}
 }
 
@@ -366,9 +936,9 @@ func (h *Hook) OnSysInfoTick(sys *system.Info) {
 		Info: *sys,
 	}
 
-	err := h.db.HSet(h.ctx, h.hKey(storage.SysInfoKey), sysInfoKey(), in).Err()
+	err := h.hset(h.hKey(storage.SysInfoKey), sysInfoKey(), in)
 	if err != nil {
-		h.Log.Error("failed to hset server info data", "error", err, "data", in)
+		h.failed("failed to hset server info data", err, "data", in)
 	}
 }
 
@@ -379,9 +949,9 @@ func (h *Hook) OnRetainedExpired(filter string) {
 		return
 	}
 
-	err := h.db.HDel(h.ctx, h.hKey(storage.RetainedKey), retainedKey(filter)).Err()
+	err := h.hdel(h.hKey(storage.RetainedKey), retainedKey(filter))
 	if err != nil {
-		h.Log.Error("failed to delete expired retained message", "error", err, "id", retainedKey(filter))
+		h.failed("failed to delete expired retained message", err, "id", retainedKey(filter))
 	}
 }
 
@@ -392,12 +962,76 @@ func (h *Hook) OnClientExpired(cl *mqtt.Client) {
 		return
 	}
 
-	err := h.db.HDel(h.ctx, h.hKey(storage.ClientKey), clientKey(cl)).Err()
-	if err != nil {
-		h.Log.Error("failed to delete expired client", "error", err, "id", clientKey(cl))
+	h.expireSession(cl)
+}
+
+// gc deletes expired records at an interval until cancelled.
+func (h *Hook) gc(interval time.Duration, cancel chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cancel:
+			return
+		case <-ticker.C:
+			if err := h.clearExpired(time.Now()); err != nil {
+				h.failed("failed to delete expired records", err)
+			}
+		}
 	}
 }
 
+// clearExpired deletes the retained messages, inflight messages and sessions which are
+// older than their expiry, each session together with its subscriptions and inflight messages.
+func (h *Hook) clearExpired(now time.Time) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	if err := h.health.Allow(); err != nil {
+		return err
+	}
+
+	if cutoff := storage.Cutoff(h.config.Expiry.Retained, now); cutoff > 0 {
+		err := expireMessagesScript.Run(h.ctx, h.db, []string{h.hKey(storage.RetainedKey)}, cutoff).Err()
+		if err != nil {
+			return fmt.Errorf("retained messages: %w", err)
+		}
+	}
+
+	if cutoff := storage.Cutoff(h.config.Expiry.Inflight, now); cutoff > 0 {
+		keys, err := h.clientHKeys(storage.InflightKey)
+		if err != nil {
+			return fmt.Errorf("inflight messages: %w", err)
+		}
+
+		for _, key := range keys {
+			err := expireMessagesScript.Run(h.ctx, h.db, []string{key}, cutoff).Err()
+			if err != nil {
+				return fmt.Errorf("inflight messages: %w", err)
+			}
+		}
+	}
+
+	cutoff := storage.Cutoff(h.config.Expiry.Session, now)
+	var elapsed int64
+	if h.config.Expiry.SessionInterval {
+		elapsed = now.Unix()
+	}
+
+	if cutoff > 0 || elapsed > 0 {
+		keys := []string{h.hKey(storage.ClientKey)}
+		err := expireSessionsScript.Run(h.ctx, h.db, keys, cutoff, elapsed,
+			h.clientHKey(storage.SubscriptionKey, ""), h.clientHKey(storage.InflightKey, "")).Err()
+		if err != nil {
+			return fmt.Errorf("sessions: %w", err)
+		}
+	}
+
+	return nil
+}
+
 // StoredClients returns all stored clients from the store.
 func (h *Hook) StoredClients() (v []storage.Client, err error) {
 	if h.db == nil {
@@ -405,9 +1039,9 @@ func (h *Hook) StoredClients() (v []storage.Client, err error) {
 		return
 	}
 
-	rows, err := h.db.HGetAll(h.ctx, h.hKey(storage.ClientKey)).Result()
+	rows, err := h.hgetall(h.hKey(storage.ClientKey))
 	if err != nil && !errors.Is(err, redis.Nil) {
-		h.Log.Error("failed to HGetAll client data", "error", err)
+		h.failed("failed to HGetAll client data", err)
 		return
 	}
 
@@ -430,9 +1064,9 @@ func (h *Hook) StoredSubscriptions() (v []storage.Subscription, err error) {
 		return
 	}
 
-	rows, err := h.db.HGetAll(h.ctx, h.hKey(storage.SubscriptionKey)).Result()
+	rows, err := h.hgetallClients(storage.SubscriptionKey)
 	if err != nil && !errors.Is(err, redis.Nil) {
-		h.Log.Error("failed to HGetAll subscription data", "error", err)
+		h.failed("failed to HGetAll subscription data", err)
 		return
 	}
 
@@ -455,9 +1089,9 @@ func (h *Hook) StoredRetainedMessages() (v []storage.Message, err error) {
 		return
 	}
 
-	rows, err := h.db.HGetAll(h.ctx, h.hKey(storage.RetainedKey)).Result()
+	rows, err := h.hgetall(h.hKey(storage.RetainedKey))
 	if err != nil && !errors.Is(err, redis.Nil) {
-		h.Log.Error("failed to HGetAll retained message data", "error", err)
+		h.failed("failed to HGetAll retained message data", err)
 		return
 	}
 
@@ -480,9 +1114,9 @@ func (h *Hook) StoredInflightMessages() (v []storage.Message, err error) {
 		return
 	}
 
-	rows, err := h.db.HGetAll(h.ctx, h.hKey(storage.InflightKey)).Result()
+	rows, err := h.hgetallClients(storage.InflightKey)
 	if err != nil && !errors.Is(err, redis.Nil) {
-		h.Log.Error("failed to HGetAll inflight message data", "error", err)
+		h.failed("failed to HGetAll inflight message data", err)
 		return
 	}
 
@@ -505,7 +1139,15 @@ func (h *Hook) StoredSysInfo() (v storage.SystemInfo, err error) {
 		return
 	}
 
+	start := time.Now()
+	if err = h.health.Allow(); err != nil {
+		h.metrics.Read(start, err)
+		return
+	}
+
 	row, err := h.db.HGet(h.ctx, h.hKey(storage.SysInfoKey), storage.SysInfoKey).Result()
+	h.health.Record(unreachable(err))
+	h.metrics.Read(start, notNil(err))
 	if err != nil && !errors.Is(err, redis.Nil) {
 		return
 	}
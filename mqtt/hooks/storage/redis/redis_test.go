@@ -5,9 +5,11 @@
 package redis
 
 import (
+	"fmt"
 	"log/slog"
 	"os"
 	"sort"
+	"sync"
 	"testing"
 	"time"
 
@@ -94,6 +96,7 @@ func TestID(t *testing.T) {
 func TestProvides(t *testing.T) {
 	h := new(Hook)
 	h.SetOpts(logger, nil)
+	require.True(t, h.Provides(mqtt.OnConnect))
 	require.True(t, h.Provides(mqtt.OnSessionEstablished))
 	require.True(t, h.Provides(mqtt.OnDisconnect))
 	require.True(t, h.Provides(mqtt.OnSubscribed))
@@ -120,6 +123,60 @@ func TestHKey(t *testing.T) {
 	require.Equal(t, defaultHPrefix+"test", h.hKey("test"))
 }
 
+func TestHealthy(t *testing.T) {
+	s := miniredis.RunT(t)
+	h := newHook(t, s.Addr())
+	defer h.Stop()
+	require.NoError(t, h.Healthy())
+
+	s.Close()
+	require.Error(t, h.Healthy())
+}
+
+func TestHealthCircuit(t *testing.T) {
+	s := miniredis.RunT(t)
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Options: &redis.Options{
+			Addr:       s.Addr(),
+			MaxRetries: -1,
+		},
+		Health: storage.HealthOptions{
+			Interval:             3600,
+			Failures:             2,
+			OnStorageUnavailable: storage.UnavailableFailClosed,
+		},
+	})
+	require.NoError(t, err)
+	defer h.Stop()
+	require.NoError(t, h.OnConnect(client, packets.Packet{}))
+
+	// the circuit opens once writes fail to reach redis
+	s.Close()
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("x")}, 1)
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("x")}, 1)
+	require.Equal(t, storage.CircuitOpen, h.HealthStatus().State)
+	require.ErrorIs(t, h.Healthy(), storage.ErrUnavailable)
+	require.ErrorIs(t, h.OnConnect(client, packets.Packet{}), packets.ErrServerUnavailable)
+	require.Equal(t, storage.CircuitOpen, h.StorageMetrics().Circuit)
+
+	_, err = h.StoredRetainedMessages()
+	require.ErrorIs(t, err, storage.ErrUnavailable)
+
+	// and closes once redis can be pinged again
+	require.NoError(t, s.Restart())
+	require.Eventually(t, func() bool {
+		return h.HealthStatus().State == storage.CircuitClosed
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, h.OnConnect(client, packets.Packet{}))
+	require.NoError(t, h.Healthy())
+
+	st := h.HealthStatus()
+	require.Equal(t, int64(1), st.Outages)
+	require.Positive(t, st.Rejected)
+}
+
 func TestInitUseDefaults(t *testing.T) {
 	s := miniredis.RunT(t)
 	s.StartAddr(defaultAddr)
@@ -135,6 +192,52 @@ func TestInitUseDefaults(t *testing.T) {
 	require.Equal(t, defaultAddr, h.config.Options.Addr)
 }
 
+func TestInitUniversal(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Universal: &redis.UniversalOptions{Addrs: []string{s.Addr()}},
+	})
+	require.NoError(t, err)
+	defer teardown(t, h)
+
+	require.IsType(t, new(redis.Client), h.db)
+	require.Equal(t, defaultHPrefix, h.config.HPrefix)
+}
+
+func TestInitCluster(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Universal: &redis.UniversalOptions{Addrs: []string{s.Addr()}, IsClusterMode: true},
+	})
+	require.NoError(t, err)
+	defer h.Stop()
+
+	// every key shares the hash tag of the prefix, so the session scripts run in one slot
+	require.IsType(t, new(redis.ClusterClient), h.db)
+	require.Equal(t, "{"+defaultHPrefix+"}", h.config.HPrefix)
+	require.Equal(t, "{comqtt-}cl", h.hKey(storage.ClientKey))
+
+	cl := &mqtt.Client{ID: "cl1", Properties: mqtt.ClientProperties{Clean: true}}
+	h.OnSessionEstablished(cl, packets.Packet{})
+	h.OnSubscribed(cl, pkf, []byte{0}, nil)
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+
+	h.OnClientExpired(cl)
+	subs, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Empty(t, subs)
+}
+
 func TestInitBadConfig(t *testing.T) {
 	h := new(Hook)
 	h.SetOpts(logger, nil)
@@ -143,6 +246,14 @@ func TestInitBadConfig(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestInitBadHealth(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(&Options{Health: storage.HealthOptions{OnStorageUnavailable: "retry"}})
+	require.ErrorIs(t, err, storage.ErrInvalidUnavailablePolicy)
+}
+
 func TestInitBadAddr(t *testing.T) {
 	h := new(Hook)
 	h.SetOpts(logger, nil)
@@ -154,6 +265,49 @@ func TestInitBadAddr(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestInitMovesSharedHashes(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+
+	sub, err := (&storage.Subscription{ID: "cl1:a/b", T: storage.SubscriptionKey, Client: "cl1", Filter: "a/b"}).MarshalBinary()
+	require.NoError(t, err)
+	msg, err := (&storage.Message{ID: "cl1:7", T: storage.InflightKey, Client: "cl1", PacketID: 7}).MarshalBinary()
+	require.NoError(t, err)
+	s.HSet(defaultHPrefix+storage.SubscriptionKey, "cl1:a/b", string(sub))
+	s.HSet(defaultHPrefix+storage.SubscriptionKey, "orphan", "{}")
+	s.HSet(defaultHPrefix+storage.InflightKey, "cl1:7", string(msg))
+
+	// inflight messages stored before messages recorded their client
+	legacy, err := (&storage.Message{ID: "cl:2:9", T: storage.InflightKey, PacketID: 9, TopicName: "a/b"}).MarshalBinary()
+	require.NoError(t, err)
+	s.HSet(defaultHPrefix+storage.InflightKey, "cl:2:9", string(legacy))
+	s.HSet(defaultHPrefix+storage.InflightKey, "orphan", string(legacy))
+
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+
+	require.False(t, s.Exists(defaultHPrefix+storage.SubscriptionKey))
+	require.False(t, s.Exists(defaultHPrefix+storage.InflightKey))
+	require.Equal(t, []string{"a/b"}, h.db.HKeys(h.ctx, h.clientHKey(storage.SubscriptionKey, "cl1")).Val())
+	require.Equal(t, []string{"7"}, h.db.HKeys(h.ctx, h.clientHKey(storage.InflightKey, "cl1")).Val())
+	require.Equal(t, []string{"9"}, h.db.HKeys(h.ctx, h.clientHKey(storage.InflightKey, "cl:2")).Val())
+
+	msgs, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	for _, m := range msgs {
+		if m.PacketID == 9 {
+			require.Equal(t, "cl:2", m.Client)
+			require.Equal(t, "a/b", m.TopicName)
+		}
+	}
+
+	subs, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+	require.Equal(t, "a/b", subs[0].Filter)
+}
+
 func TestOnSessionEstablishedThenOnDisconnect(t *testing.T) {
 	s := miniredis.RunT(t)
 	defer s.Close()
@@ -316,7 +470,7 @@ func TestOnSubscribedThenOnUnsubscribed(t *testing.T) {
 	h.OnSubscribed(client, pkf, []byte{0}, nil)
 
 	r := new(storage.Subscription)
-	row, err := h.db.HGet(h.ctx, h.hKey(storage.SubscriptionKey), subscriptionKey(client, pkf.Filters[0].Filter)).Result()
+	row, err := h.db.HGet(h.ctx, h.clientHKey(storage.SubscriptionKey, client.ID), pkf.Filters[0].Filter).Result()
 	require.NoError(t, err)
 	err = r.UnmarshalBinary([]byte(row))
 	require.NoError(t, err)
@@ -325,7 +479,7 @@ func TestOnSubscribedThenOnUnsubscribed(t *testing.T) {
 	require.Equal(t, byte(0), r.Qos)
 
 	h.OnUnsubscribed(client, pkf, nil, nil)
-	_, err = h.db.HGet(h.ctx, h.hKey(storage.SubscriptionKey), subscriptionKey(client, pkf.Filters[0].Filter)).Result()
+	_, err = h.db.HGet(h.ctx, h.clientHKey(storage.SubscriptionKey, client.ID), pkf.Filters[0].Filter).Result()
 	require.Error(t, err)
 	require.ErrorIs(t, err, redis.Nil)
 }
@@ -480,7 +634,7 @@ func TestOnQosPublishThenQOSComplete(t *testing.T) {
 	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
 
 	r := new(storage.Message)
-	row, err := h.db.HGet(h.ctx, h.hKey(storage.InflightKey), inflightKey(client, pk)).Result()
+	row, err := h.db.HGet(h.ctx, h.clientHKey(storage.InflightKey, client.ID), pk.FormatID()).Result()
 	require.NoError(t, err)
 	err = r.UnmarshalBinary([]byte(row))
 	require.NoError(t, err)
@@ -493,11 +647,32 @@ func TestOnQosPublishThenQOSComplete(t *testing.T) {
 
 	// OnQosDropped is a passthrough to OnQosComplete here
 	h.OnQosDropped(client, pk)
-	_, err = h.db.HGet(h.ctx, h.hKey(storage.InflightKey), inflightKey(client, pk)).Result()
+	_, err = h.db.HGet(h.ctx, h.clientHKey(storage.InflightKey, client.ID), pk.FormatID()).Result()
 	require.Error(t, err)
 	require.ErrorIs(t, err, redis.Nil)
 }
 
+func TestOnQosPublishPubrelStage(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Pubrel, Qos: 1},
+		PacketID:    7,
+		Origin:      "publisher",
+	}
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+
+	r, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, client.ID, r[0].Client)
+	require.Equal(t, uint16(7), r[0].ToPacket().PacketID)
+	require.Equal(t, packets.Pubrel, r[0].ToPacket().FixedHeader.Type)
+}
+
 func TestOnQosPublishNoDB(t *testing.T) {
 	s := miniredis.RunT(t)
 	defer s.Close()
@@ -576,6 +751,198 @@ func TestOnSysInfoTickNoDB(t *testing.T) {
 	h.OnSysInfoTick(new(system.Info))
 }
 
+func TestOnDisconnectRecordsTime(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+
+	h.OnDisconnect(client, nil, false)
+	r := new(storage.Client)
+	row, err := h.db.HGet(h.ctx, h.hKey(storage.ClientKey), clientKey(client)).Result()
+	require.NoError(t, err)
+	err = r.UnmarshalBinary([]byte(row))
+	require.NoError(t, err)
+	require.InDelta(t, time.Now().Unix(), r.Disconnected, 1)
+	require.Zero(t, r.Expires)
+
+	cl := &mqtt.Client{ID: "expiring", Properties: mqtt.ClientProperties{ProtocolVersion: 5}}
+	cl.Properties.Props.SessionExpiryInterval = 60
+	cl.Properties.Props.SessionExpiryIntervalFlag = true
+	cl.Stop(nil)
+	h.OnDisconnect(cl, nil, false)
+	r = new(storage.Client)
+	row, err = h.db.HGet(h.ctx, h.hKey(storage.ClientKey), clientKey(cl)).Result()
+	require.NoError(t, err)
+	err = r.UnmarshalBinary([]byte(row))
+	require.NoError(t, err)
+	require.InDelta(t, time.Now().Unix()+60, r.Expires, 1)
+}
+
+func TestInitExpiry(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Options: &redis.Options{Addr: s.Addr()},
+		Expiry:  storage.Expiry{Session: time.Hour},
+	})
+	require.NoError(t, err)
+	require.NotNil(t, h.cancel)
+
+	teardown(t, h)
+	require.Nil(t, h.cancel)
+}
+
+func TestClearExpired(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+	h.config.Expiry = storage.Expiry{Retained: time.Hour, Inflight: time.Minute, Session: time.Hour}
+
+	now := time.Now()
+	old := now.Add(-2 * time.Hour).Unix()
+	hset := func(key, field string, v any) {
+		require.NoError(t, h.db.HSet(h.ctx, h.hKey(key), field, v).Err())
+	}
+	hset(storage.ClientKey, "cl1", &storage.Client{ID: "cl1", T: storage.ClientKey, Disconnected: old})
+	hset(storage.ClientKey, "cl2", &storage.Client{ID: "cl2", T: storage.ClientKey, Disconnected: now.Unix()})
+	hset(storage.ClientKey, "cl3", &storage.Client{ID: "cl3", T: storage.ClientKey})
+	hset(storage.SubscriptionKey+":cl1", "a/b", &storage.Subscription{T: storage.SubscriptionKey, Client: "cl1", Filter: "a/b"})
+	hset(storage.SubscriptionKey+":cl2", "a/b", &storage.Subscription{T: storage.SubscriptionKey, Client: "cl2", Filter: "a/b"})
+	hset(storage.InflightKey+":cl1", "1", &storage.Message{T: storage.InflightKey, Client: "cl1", Created: now.Unix()})
+	hset(storage.InflightKey+":cl2", "1", &storage.Message{T: storage.InflightKey, Client: "cl2", Created: now.Add(-time.Hour).Unix()})
+	hset(storage.InflightKey+":cl2", "2", &storage.Message{T: storage.InflightKey, Client: "cl2", Created: now.Unix()})
+	hset(storage.RetainedKey, "a/b", &storage.Message{T: storage.RetainedKey, TopicName: "a/b", Created: old})
+	hset(storage.RetainedKey, "a/c", &storage.Message{T: storage.RetainedKey, TopicName: "a/c", Created: now.Unix()})
+
+	err := h.clearExpired(now)
+	require.NoError(t, err)
+
+	fields := func(key string) []string {
+		v, err := h.db.HKeys(h.ctx, h.hKey(key)).Result()
+		require.NoError(t, err)
+		sort.Strings(v)
+		return v
+	}
+	require.Equal(t, []string{"cl2", "cl3"}, fields(storage.ClientKey))
+	require.Empty(t, fields(storage.SubscriptionKey+":cl1"))
+	require.Equal(t, []string{"a/b"}, fields(storage.SubscriptionKey+":cl2"))
+	require.Empty(t, fields(storage.InflightKey+":cl1"))
+	require.Equal(t, []string{"2"}, fields(storage.InflightKey+":cl2"))
+	require.Equal(t, []string{"a/c"}, fields(storage.RetainedKey))
+}
+
+func TestClearExpiredSessionInterval(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+	h.config.Expiry = storage.Expiry{SessionInterval: true}
+
+	now := time.Now()
+	hset := func(key, field string, v any) {
+		require.NoError(t, h.db.HSet(h.ctx, h.hKey(key), field, v).Err())
+	}
+	hset(storage.ClientKey, "cl1", &storage.Client{ID: "cl1", T: storage.ClientKey, Disconnected: now.Unix() - 60, Expires: now.Unix() - 30})
+	hset(storage.ClientKey, "cl2", &storage.Client{ID: "cl2", T: storage.ClientKey, Disconnected: now.Unix() - 60, Expires: now.Unix() + 30})
+	hset(storage.ClientKey, "cl3", &storage.Client{ID: "cl3", T: storage.ClientKey, Disconnected: now.Unix() - 60})
+	hset(storage.SubscriptionKey+":cl1", "a/b", &storage.Subscription{T: storage.SubscriptionKey, Client: "cl1", Filter: "a/b"})
+	hset(storage.InflightKey+":cl1", "1", &storage.Message{T: storage.InflightKey, Client: "cl1", Created: now.Unix()})
+
+	err := h.clearExpired(now)
+	require.NoError(t, err)
+
+	clients, err := h.db.HKeys(h.ctx, h.hKey(storage.ClientKey)).Result()
+	require.NoError(t, err)
+	sort.Strings(clients)
+	require.Equal(t, []string{"cl2", "cl3"}, clients)
+	require.Equal(t, int64(0), h.db.Exists(h.ctx, h.clientHKey(storage.SubscriptionKey, "cl1"), h.clientHKey(storage.InflightKey, "cl1")).Val())
+}
+
+func TestClearExpiredNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.clearExpired(time.Now())
+	require.ErrorIs(t, err, storage.ErrDBFileNotOpen)
+}
+
+func TestWriteBehind(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Options:     &redis.Options{Addr: s.Addr()},
+		WriteBehind: storage.WriteBehind{Enabled: true, Interval: time.Hour},
+	})
+	require.NoError(t, err)
+	defer teardown(t, h)
+	require.NotNil(t, h.buffer)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnSubscribed(client, pkf, []byte{0}, []int{1})
+	h.OnQosPublish(client, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}, PacketID: 1}, time.Now().Unix(), 0)
+	require.Equal(t, 3, h.buffer.Len())
+
+	n, err := h.db.HLen(h.ctx, h.hKey(storage.ClientKey)).Result()
+	require.NoError(t, err)
+	require.Equal(t, int64(0), n)
+
+	h.buffer.Flush()
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+	require.Equal(t, client.ID, clients[0].ID)
+
+	subs, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+
+	inflight, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, inflight, 1)
+
+	h.OnUnsubscribed(client, pkf, []byte{0}, []int{0})
+	h.OnQosComplete(client, packets.Packet{PacketID: 1})
+	h.buffer.Flush()
+
+	subs, err = h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Empty(t, subs)
+
+	inflight, err = h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Empty(t, inflight)
+}
+
+func TestWriteBehindStopFlushes(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Options:     &redis.Options{Addr: s.Addr()},
+		WriteBehind: storage.WriteBehind{Enabled: true, Interval: time.Hour},
+	})
+	require.NoError(t, err)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	require.NoError(t, h.Stop())
+	require.Nil(t, h.buffer)
+
+	h = newHook(t, s.Addr())
+	defer teardown(t, h)
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+}
+
 func TestStoredClients(t *testing.T) {
 	s := miniredis.RunT(t)
 	defer s.Close()
@@ -630,13 +997,13 @@ func TestStoredSubscriptions(t *testing.T) {
 	defer teardown(t, h)
 
 	// populate with subscriptions
-	err := h.db.HSet(h.ctx, h.hKey(storage.SubscriptionKey), "sub1", &storage.Subscription{ID: "sub1", T: storage.SubscriptionKey}).Err()
+	err := h.db.HSet(h.ctx, h.clientHKey(storage.SubscriptionKey, "cl1"), "sub1", &storage.Subscription{ID: "sub1", T: storage.SubscriptionKey}).Err()
 	require.NoError(t, err)
 
-	err = h.db.HSet(h.ctx, h.hKey(storage.SubscriptionKey), "sub2", &storage.Subscription{ID: "sub2", T: storage.SubscriptionKey}).Err()
+	err = h.db.HSet(h.ctx, h.clientHKey(storage.SubscriptionKey, "cl1"), "sub2", &storage.Subscription{ID: "sub2", T: storage.SubscriptionKey}).Err()
 	require.NoError(t, err)
 
-	err = h.db.HSet(h.ctx, h.hKey(storage.SubscriptionKey), "sub3", &storage.Subscription{ID: "sub3", T: storage.SubscriptionKey}).Err()
+	err = h.db.HSet(h.ctx, h.clientHKey(storage.SubscriptionKey, "cl2"), "sub3", &storage.Subscription{ID: "sub3", T: storage.SubscriptionKey}).Err()
 	require.NoError(t, err)
 
 	r, err := h.StoredSubscriptions()
@@ -685,7 +1052,7 @@ func TestStoredRetainedMessages(t *testing.T) {
 	err = h.db.HSet(h.ctx, h.hKey(storage.RetainedKey), "m3", &storage.Message{ID: "m3", T: storage.RetainedKey}).Err()
 	require.NoError(t, err)
 
-	err = h.db.HSet(h.ctx, h.hKey(storage.InflightKey), "i3", &storage.Message{ID: "i3", T: storage.InflightKey}).Err()
+	err = h.db.HSet(h.ctx, h.clientHKey(storage.InflightKey, "cl2"), "i3", &storage.Message{ID: "i3", T: storage.InflightKey}).Err()
 	require.NoError(t, err)
 
 	r, err := h.StoredRetainedMessages()
@@ -725,13 +1092,13 @@ func TestStoredInflightMessages(t *testing.T) {
 	defer teardown(t, h)
 
 	// populate with messages
-	err := h.db.HSet(h.ctx, h.hKey(storage.InflightKey), "i1", &storage.Message{ID: "i1", T: storage.InflightKey}).Err()
+	err := h.db.HSet(h.ctx, h.clientHKey(storage.InflightKey, "cl1"), "i1", &storage.Message{ID: "i1", T: storage.InflightKey}).Err()
 	require.NoError(t, err)
 
-	err = h.db.HSet(h.ctx, h.hKey(storage.InflightKey), "i2", &storage.Message{ID: "i2", T: storage.InflightKey}).Err()
+	err = h.db.HSet(h.ctx, h.clientHKey(storage.InflightKey, "cl1"), "i2", &storage.Message{ID: "i2", T: storage.InflightKey}).Err()
 	require.NoError(t, err)
 
-	err = h.db.HSet(h.ctx, h.hKey(storage.InflightKey), "i3", &storage.Message{ID: "i3", T: storage.InflightKey}).Err()
+	err = h.db.HSet(h.ctx, h.clientHKey(storage.InflightKey, "cl2"), "i3", &storage.Message{ID: "i3", T: storage.InflightKey}).Err()
 	require.NoError(t, err)
 
 	err = h.db.HSet(h.ctx, h.hKey(storage.RetainedKey), "m3", &storage.Message{ID: "m3", T: storage.RetainedKey}).Err()
@@ -809,3 +1176,187 @@ func TestStoredSysInfoClosedDB(t *testing.T) {
 	require.Empty(t, v)
 	require.Error(t, err)
 }
+
+func TestOnSessionEstablishedCleanStart(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+
+	cl := &mqtt.Client{ID: "cl1"}
+	other := &mqtt.Client{ID: "cl10"}
+	pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}, PacketID: 1}
+	h.OnSubscribed(cl, pkf, []byte{0}, nil)
+	h.OnSubscribed(other, pkf, []byte{0}, nil)
+	h.OnQosPublish(cl, pk, time.Now().Unix(), 0)
+	h.OnQosPublish(other, pk, time.Now().Unix(), 0)
+
+	h.OnSessionEstablished(cl, packets.Packet{})
+	subs, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+
+	cl.Properties.Clean = true
+	h.OnSessionEstablished(cl, packets.Packet{})
+	subs, err = h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+	require.Equal(t, other.ID, subs[0].Client)
+
+	msgs, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	require.Equal(t, other.ID, msgs[0].Client)
+}
+
+func TestOnClientExpiredRemovesSession(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+
+	cl := &mqtt.Client{ID: "cl1"}
+	h.OnSessionEstablished(cl, packets.Packet{})
+	h.OnSubscribed(cl, pkf, []byte{0}, nil)
+	h.OnQosPublish(cl, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}, PacketID: 1}, time.Now().Unix(), 0)
+
+	h.OnClientExpired(cl)
+
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Empty(t, clients)
+	subs, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Empty(t, subs)
+	msgs, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Empty(t, msgs)
+}
+
+func TestOnSubscribedMultipleFilters(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+
+	pk := packets.Packet{Filters: packets.Subscriptions{{Filter: "a/b"}, {Filter: "c/d"}}}
+	h.OnSubscribed(client, pk, []byte{0, 1}, nil)
+
+	subs, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+
+	h.OnUnsubscribed(client, pk, nil, nil)
+	subs, err = h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Empty(t, subs)
+}
+
+func TestOnQosPublishNoStageRegression(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+
+	pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pubrel, Qos: 1}, PacketID: 7}
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+
+	pk.FixedHeader = packets.FixedHeader{Type: packets.Publish, Qos: 2}
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+
+	r, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, packets.Pubrel, r[0].ToPacket().FixedHeader.Type)
+}
+
+func TestPipeline(t *testing.T) {
+	for _, multi := range []bool{false, true} {
+		s := miniredis.RunT(t)
+		h := new(Hook)
+		h.SetOpts(logger, nil)
+		err := h.Init(&Options{
+			Options:  &redis.Options{Addr: s.Addr()},
+			Pipeline: true,
+			Multi:    multi,
+		})
+		require.NoError(t, err)
+		require.NotNil(t, h.buffer)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				cl := &mqtt.Client{ID: fmt.Sprintf("cl%d", i), Properties: mqtt.ClientProperties{ProtocolVersion: 5}}
+				h.OnSessionEstablished(cl, packets.Packet{})
+				h.OnSubscribed(cl, pkf, []byte{1}, []int{1})
+			}(i)
+		}
+		wg.Wait()
+		require.Equal(t, 0, h.buffer.Len()) // each writer waited for its write
+
+		clients, err := h.StoredClients()
+		require.NoError(t, err)
+		require.Len(t, clients, 50)
+
+		subs, err := h.StoredSubscriptions()
+		require.NoError(t, err)
+		require.Len(t, subs, 50)
+
+		teardown(t, h)
+		s.Close()
+	}
+}
+
+func TestPipelineError(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		Options:  &redis.Options{Addr: s.Addr()},
+		Pipeline: true,
+	})
+	require.NoError(t, err)
+	defer teardown(t, h)
+
+	require.NoError(t, h.db.Set(h.ctx, h.hKey(storage.RetainedKey), "not a hash", 0).Err())
+	err = h.hset(h.hKey(storage.RetainedKey), "a/b", "v")
+	require.Error(t, err)
+
+	err = h.hset(h.hKey(storage.SysInfoKey), sysInfoKey(), "v")
+	require.NoError(t, err)
+}
+
+func TestStorageMetrics(t *testing.T) {
+	s := miniredis.RunT(t)
+	h := newHook(t, s.Addr())
+	defer h.Stop()
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	_, err := h.StoredClients()
+	require.NoError(t, err)
+	_, err = h.StoredSysInfo() // a missing record is not a failed read
+	require.NoError(t, err)
+
+	m := h.StorageMetrics()
+	require.Equal(t, h.ID(), m.ID)
+	require.Equal(t, int64(1), m.Writes)
+	require.Equal(t, int64(0), m.WriteErrors)
+	require.Equal(t, int64(2), m.Reads)
+	require.Equal(t, int64(0), m.ReadErrors)
+	require.Equal(t, int64(0), m.Pending)
+
+	s.Close()
+	_, err = h.StoredClients()
+	require.Error(t, err)
+	require.Equal(t, int64(1), h.StorageMetrics().ReadErrors)
+}
+
+func TestUsedMemory(t *testing.T) {
+	info := "# Memory\r\nused_memory:1048576\r\nused_memory_human:1.00M\r\n"
+	require.Equal(t, int64(1048576), usedMemory(info))
+	require.Equal(t, int64(0), usedMemory("# Memory\r\n"))
+}
@@ -0,0 +1,126 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+// Package sqlite is a persistent storage hook keeping the sessions, subscriptions,
+// retained and inflight messages of a broker in a single sqlite database file, which can
+// be inspected with the sqlite3 shell.
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage/sqlstore"
+)
+
+// defaultDbFile is the default file path for the sqlite database file.
+const defaultDbFile = "sqlite.db"
+
+// defaultBusyTimeout is the default milliseconds a write waits while another process, such
+// as the sqlite3 shell, is writing to the database file.
+const defaultBusyTimeout = 5000
+
+// tables are the names of the tables of each kind of record.
+var tables = map[string]string{
+	storage.ClientKey:       "clients",
+	storage.SubscriptionKey: "subscriptions",
+	storage.RetainedKey:     "retained",
+	storage.InflightKey:     "inflight",
+	storage.SysInfoKey:      "sysinfo",
+}
+
+// dialect is the sql of sqlite. The json documents of the records are kept as text, so that
+// they can be queried with the json functions of sqlite.
+type dialect struct{}
+
+func (dialect) Table(key string) string {
+	return tables[key]
+}
+
+func (dialect) Bindvar(int) string {
+	return "?"
+}
+
+func (dialect) JSONType() string {
+	return "text"
+}
+
+// Size returns the size of the database file, as the tables are all the file holds.
+func (dialect) Size(ctx context.Context, db *sql.DB, _ []string) (size int64, err error) {
+	q := "select page_count * page_size from pragma_page_count(), pragma_page_size()"
+	err = db.QueryRowContext(ctx, q).Scan(&size)
+	return
+}
+
+// Options contains configuration settings for the sqlite database.
+type Options struct {
+	Path        string // the database file, created if it does not exist
+	BusyTimeout int    // milliseconds a write waits while the file is locked, default 5000
+}
+
+// Hook is a persistent storage hook using a sqlite database file as a backend.
+type Hook struct {
+	sqlstore.Hook
+	config *Options // options for opening the database file.
+}
+
+// ID returns the id of the hook.
+func (h *Hook) ID() string {
+	return "sqlite-db"
+}
+
+// Init initializes and opens the sqlite database file, creating the tables if they do not
+// exist.
+func (h *Hook) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		config = new(Options)
+	}
+
+	h.config = config.(*Options)
+	if h.config.Path == "" {
+		h.config.Path = defaultDbFile
+	}
+	if h.config.BusyTimeout <= 0 {
+		h.config.BusyTimeout = defaultBusyTimeout
+	}
+
+	h.Log.Info("opening sqlite", "path", h.config.Path)
+
+	// the write-ahead log lets the file be read by the sqlite3 shell while the broker writes
+	// to it, and one connection serializes the writes of the broker.
+	dsn := fmt.Sprintf("file:%s?_busy_timeout=%d&_journal_mode=WAL&_synchronous=NORMAL", h.config.Path, h.config.BusyTimeout)
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return err
+	}
+	db.SetMaxOpenConns(1)
+
+	if err := h.Open(db, dialect{}); err != nil {
+		return err
+	}
+
+	h.Log.Info("opened sqlite")
+
+	return nil
+}
+
+// Stop closes the sqlite database.
+func (h *Hook) Stop() error {
+	h.Log.Info("closing sqlite")
+
+	return h.Close()
+}
+
+// StorageMetrics returns the writes and reads of the hook and the size of the database file.
+func (h *Hook) StorageMetrics() mqtt.StorageMetrics {
+	return h.Metrics(h.ID())
+}
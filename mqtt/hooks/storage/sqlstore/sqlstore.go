@@ -0,0 +1,752 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+// Package sqlstore is the base of the storage hooks which keep the sessions, subscriptions,
+// retained and inflight messages of a broker in a database/sql database. The hooks differ
+// only in how they open the database and in their Dialect.
+package sqlstore
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/mqtt/system"
+)
+
+// healthTimeout is the time allowed for the database to answer a health check ping.
+const healthTimeout = 2 * time.Second
+
+// keys are the kinds of record, each kept in its own table.
+var keys = []string{
+	storage.ClientKey,
+	storage.SubscriptionKey,
+	storage.RetainedKey,
+	storage.InflightKey,
+	storage.SysInfoKey,
+}
+
+// Dialect is the sql of a database which differs from one database to another.
+type Dialect interface {
+	// Table returns the quoted name of the table of a kind of record, such as storage.ClientKey.
+	Table(key string) string
+
+	// Bindvar returns the placeholder of the nth argument of a statement, counting from 1.
+	Bindvar(n int) string
+
+	// JSONType returns the column type the json documents of the records are kept in.
+	JSONType() string
+
+	// Size returns the bytes used by the tables, including their indexes.
+	Size(ctx context.Context, db *sql.DB, tables []string) (int64, error)
+}
+
+// clientKey returns a primary key for a client.
+func clientKey(cl *mqtt.Client) string {
+	return cl.ID
+}
+
+// retainedKey returns a primary key for a retained message.
+func retainedKey(topic string) string {
+	return topic
+}
+
+// inflightKey returns the key of an inflight message among those of its client.
+func inflightKey(pk packets.Packet) string {
+	return pk.FormatID()
+}
+
+// sysInfoKey returns a primary key for system info.
+func sysInfoKey() string {
+	return storage.SysInfoKey
+}
+
+// Hook is a persistent storage hook using a database/sql database as a backend. It is
+// embedded by the hooks of each database, which open the database and pass it to Open.
+type Hook struct {
+	mqtt.HookBase
+	dialect Dialect              // the sql of the database.
+	db      *sql.DB              // the database connection pool.
+	ctx     context.Context      // a context for the queries
+	metrics mqtt.StorageRecorder // counts the writes and reads of the hook
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+		mqtt.OnSubscribed,
+		mqtt.OnUnsubscribed,
+		mqtt.OnRetainMessage,
+		mqtt.OnQosPublish,
+		mqtt.OnQosComplete,
+		mqtt.OnQosDropped,
+		mqtt.OnWillSent,
+		mqtt.OnSysInfoTick,
+		mqtt.OnClientExpired,
+		mqtt.OnRetainedExpired,
+		mqtt.StoredClients,
+		mqtt.StoredInflightMessages,
+		mqtt.StoredRetainedMessages,
+		mqtt.StoredSubscriptions,
+		mqtt.StoredSysInfo,
+	}, []byte{b})
+}
+
+// Open pings the database and creates the tables of the records if they do not exist. The
+// database is closed if either fails.
+func (h *Hook) Open(db *sql.DB, dialect Dialect) error {
+	h.ctx = context.Background()
+	h.dialect = dialect
+
+	if err := db.PingContext(h.ctx); err != nil {
+		db.Close()
+		return fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	h.db = db
+	if err := h.createTables(); err != nil {
+		h.db.Close()
+		h.db = nil
+		return fmt.Errorf("failed to create tables: %w", err)
+	}
+
+	return nil
+}
+
+// createTables creates the tables of the records if they do not exist. Each record is kept
+// as the same json document as the redis storage hook writes, passed to the database as a
+// string since some drivers send byte slices as binary.
+func (h *Hook) createTables() error {
+	data := h.dialect.JSONType()
+	for _, q := range []string{
+		fmt.Sprintf("create table if not exists %s (id text primary key, data %s not null)", h.Table(storage.ClientKey), data),
+		fmt.Sprintf("create table if not exists %s (client_id text not null, filter text not null, data %s not null, primary key (client_id, filter))", h.Table(storage.SubscriptionKey), data),
+		fmt.Sprintf("create table if not exists %s (topic text primary key, data %s not null)", h.Table(storage.RetainedKey), data),
+		fmt.Sprintf("create table if not exists %s (client_id text not null, id text not null, type smallint not null, data %s not null, primary key (client_id, id))", h.Table(storage.InflightKey), data),
+		fmt.Sprintf("create table if not exists %s (id text primary key, data %s not null)", h.Table(storage.SysInfoKey), data),
+	} {
+		if _, err := h.db.ExecContext(h.ctx, q); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DB returns the database, or nil if it has not been opened.
+func (h *Hook) DB() *sql.DB {
+	return h.db
+}
+
+// Table returns the quoted name of the table of a kind of record, such as storage.ClientKey.
+func (h *Hook) Table(key string) string {
+	return h.dialect.Table(key)
+}
+
+// bindvars returns the placeholders of the first n arguments of a statement.
+func (h *Hook) bindvars(n int) string {
+	v := make([]string, n)
+	for i := range v {
+		v[i] = h.dialect.Bindvar(i + 1)
+	}
+	return strings.Join(v, ", ")
+}
+
+// Close closes the database.
+func (h *Hook) Close() error {
+	if h.db == nil {
+		return nil
+	}
+
+	return h.db.Close()
+}
+
+// Healthy pings the database, returning an error if it cannot be reached.
+func (h *Hook) Healthy() error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	ctx, cancel := context.WithTimeout(h.ctx, healthTimeout)
+	defer cancel()
+	return h.db.PingContext(ctx)
+}
+
+// Metrics returns the writes and reads of the hook with the given id and the size of its
+// tables.
+func (h *Hook) Metrics(id string) mqtt.StorageMetrics {
+	var size int64
+	if h.db != nil {
+		tables := make([]string, len(keys))
+		for i, key := range keys {
+			tables[i] = h.Table(key)
+		}
+
+		ctx, cancel := context.WithTimeout(h.ctx, healthTimeout)
+		defer cancel()
+		size, _ = h.dialect.Size(ctx, h.db, tables)
+	}
+
+	return h.metrics.Metrics(id, 0, size)
+}
+
+// exec runs a statement which writes to the store.
+func (h *Hook) exec(q string, args ...any) error {
+	start := time.Now()
+	_, err := h.db.ExecContext(h.ctx, q, args...)
+	h.metrics.Write(start, err)
+	return err
+}
+
+// tx runs a function in a transaction, committing it if the function succeeds. The
+// transaction is counted as one write.
+func (h *Hook) tx(fn func(tx *sql.Tx) error) error {
+	start := time.Now()
+	err := h.commit(fn)
+	h.metrics.Write(start, err)
+	return err
+}
+
+// commit runs a function in a transaction for tx.
+func (h *Hook) commit(fn func(tx *sql.Tx) error) error {
+	tx, err := h.db.BeginTx(h.ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// OnSessionEstablished adds a client to the store when their session is established.
+func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	in, err := h.client(cl).MarshalBinary()
+	if err != nil {
+		h.Log.Error("failed to marshal client data", "error", err, "id", clientKey(cl))
+		return
+	}
+
+	// on a clean start the subscriptions and inflight messages of the previous session are
+	// discarded in the same transaction as the session record is written.
+	err = h.tx(func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(h.ctx, h.upsertClientSql(), clientKey(cl), string(in)); err != nil {
+			return err
+		}
+
+		if !cl.Properties.Clean {
+			return nil
+		}
+
+		return h.deleteClientRows(tx, clientKey(cl), storage.SubscriptionKey, storage.InflightKey)
+	})
+	if err != nil {
+		h.Log.Error("failed to establish session", "error", err, "id", clientKey(cl))
+	}
+}
+
+// OnWillSent is called when a client sends a Will Message and the Will Message is removed from the client record.
+func (h *Hook) OnWillSent(cl *mqtt.Client, pk packets.Packet) {
+	h.updateClient(cl)
+}
+
+// updateClient writes the client data to the store.
+func (h *Hook) updateClient(cl *mqtt.Client) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	in := h.client(cl)
+	data, err := in.MarshalBinary()
+	if err == nil {
+		err = h.exec(h.upsertClientSql(), clientKey(cl), string(data))
+	}
+	if err != nil {
+		h.Log.Error("failed to save client data", "error", err, "data", in)
+	}
+}
+
+// upsertClientSql returns the statement writing the session record of a client.
+func (h *Hook) upsertClientSql() string {
+	return fmt.Sprintf("insert into %s (id, data) values (%s) on conflict (id) do update set data = excluded.data",
+		h.Table(storage.ClientKey), h.bindvars(2))
+}
+
+// deleteClientRows deletes the rows of a client from the tables of some kinds of record.
+func (h *Hook) deleteClientRows(tx *sql.Tx, id string, keys ...string) error {
+	for _, key := range keys {
+		q := fmt.Sprintf("delete from %s where client_id = %s", h.Table(key), h.dialect.Bindvar(1))
+		if _, err := tx.ExecContext(h.ctx, q, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// client returns the storable session record of a client.
+func (h *Hook) client(cl *mqtt.Client) *storage.Client {
+	props := cl.Properties.Props.Copy(false)
+	return &storage.Client{
+		ID:              clientKey(cl),
+		T:               storage.ClientKey,
+		Remote:          cl.Net.Remote,
+		Listener:        cl.Net.Listener,
+		Username:        cl.Properties.Username,
+		Clean:           cl.Properties.Clean,
+		ProtocolVersion: cl.Properties.ProtocolVersion,
+		Properties: storage.ClientProperties{
+			SessionExpiryInterval: props.SessionExpiryInterval,
+			AuthenticationMethod:  props.AuthenticationMethod,
+			AuthenticationData:    props.AuthenticationData,
+			RequestProblemInfo:    props.RequestProblemInfo,
+			RequestResponseInfo:   props.RequestResponseInfo,
+			ReceiveMaximum:        props.ReceiveMaximum,
+			TopicAliasMaximum:     props.TopicAliasMaximum,
+			User:                  props.User,
+			MaximumPacketSize:     props.MaximumPacketSize,
+		},
+		Will: storage.ClientWill(cl.Properties.Will),
+	}
+}
+
+// OnDisconnect removes a client from the store if they were using a clean session.
+func (h *Hook) OnDisconnect(cl *mqtt.Client, _ error, expire bool) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	if !expire {
+		return
+	}
+
+	if cl.StopCause() == packets.ErrSessionTakenOver {
+		return
+	}
+
+	h.expireSession(cl)
+}
+
+// expireSession removes the session record, subscriptions and inflight messages of a
+// client from the store in one transaction.
+func (h *Hook) expireSession(cl *mqtt.Client) {
+	err := h.tx(func(tx *sql.Tx) error {
+		q := fmt.Sprintf("delete from %s where id = %s", h.Table(storage.ClientKey), h.dialect.Bindvar(1))
+		if _, err := tx.ExecContext(h.ctx, q, clientKey(cl)); err != nil {
+			return err
+		}
+
+		return h.deleteClientRows(tx, clientKey(cl), storage.SubscriptionKey, storage.InflightKey)
+	})
+	if err != nil {
+		h.Log.Error("failed to delete client", "error", err, "id", clientKey(cl))
+	}
+}
+
+// OnSubscribed adds one or more client subscriptions to the store.
+func (h *Hook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte, counts []int) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	if len(pk.Filters) == 0 {
+		return
+	}
+
+	// all filters of the packet are written in one transaction.
+	q := fmt.Sprintf("insert into %s (client_id, filter, data) values (%s) on conflict (client_id, filter) do update set data = excluded.data",
+		h.Table(storage.SubscriptionKey), h.bindvars(3))
+	err := h.tx(func(tx *sql.Tx) error {
+		for i := 0; i < len(pk.Filters); i++ {
+			in := &storage.Subscription{
+				ID:     cl.ID + ":" + pk.Filters[i].Filter,
+				T:      storage.SubscriptionKey,
+				Client: cl.ID,
+				Filter: pk.Filters[i].Filter,
+				Qos:    reasonCodes[i],
+			}
+			if pk.ProtocolVersion == 5 {
+				in.Identifier = pk.Filters[i].Identifier
+				in.NoLocal = pk.Filters[i].NoLocal
+				in.RetainHandling = pk.Filters[i].RetainHandling
+				in.RetainAsPublished = pk.Filters[i].RetainAsPublished
+			}
+
+			data, err := in.MarshalBinary()
+			if err != nil {
+				return err
+			}
+
+			if _, err := tx.ExecContext(h.ctx, q, cl.ID, in.Filter, string(data)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		h.Log.Error("failed to save subscription data", "error", err, "id", clientKey(cl))
+	}
+}
+
+// OnUnsubscribed removes one or more client subscriptions from the store.
+func (h *Hook) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte, counts []int) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	if len(pk.Filters) == 0 {
+		return
+	}
+
+	q := fmt.Sprintf("delete from %s where client_id = %s and filter = %s",
+		h.Table(storage.SubscriptionKey), h.dialect.Bindvar(1), h.dialect.Bindvar(2))
+	err := h.tx(func(tx *sql.Tx) error {
+		for i := 0; i < len(pk.Filters); i++ {
+			if _, err := tx.ExecContext(h.ctx, q, cl.ID, pk.Filters[i].Filter); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		h.Log.Error("failed to delete subscription data", "error", err, "id", clientKey(cl))
+	}
+}
+
+// OnRetainMessage adds a retained message for a topic to the store.
+func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	if r == -1 {
+		h.deleteRetained(pk.TopicName)
+		return
+	}
+
+	props := pk.Properties.Copy(false)
+	in := &storage.Message{
+		ID:          retainedKey(pk.TopicName),
+		T:           storage.RetainedKey,
+		FixedHeader: pk.FixedHeader,
+		TopicName:   pk.TopicName,
+		Payload:     pk.Payload,
+		Created:     pk.Created,
+		Origin:      pk.Origin,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			TopicAlias:             props.TopicAlias,
+			User:                   props.User,
+		},
+	}
+
+	data, err := in.MarshalBinary()
+	if err == nil {
+		q := fmt.Sprintf("insert into %s (topic, data) values (%s) on conflict (topic) do update set data = excluded.data",
+			h.Table(storage.RetainedKey), h.bindvars(2))
+		err = h.exec(q, retainedKey(pk.TopicName), string(data))
+	}
+	if err != nil {
+		h.Log.Error("failed to save retained message data", "error", err, "data", in)
+	}
+}
+
+// deleteRetained deletes the retained message of a topic from the store.
+func (h *Hook) deleteRetained(topic string) {
+	q := fmt.Sprintf("delete from %s where topic = %s", h.Table(storage.RetainedKey), h.dialect.Bindvar(1))
+	if err := h.exec(q, retainedKey(topic)); err != nil {
+		h.Log.Error("failed to delete retained message data", "error", err, "id", retainedKey(topic))
+	}
+}
+
+// OnQosPublish adds or updates an inflight message in the store.
+func (h *Hook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, resends int) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	props := pk.Properties.Copy(false)
+	in := &storage.Message{
+		ID:          cl.ID + ":" + inflightKey(pk),
+		T:           storage.InflightKey,
+		Origin:      pk.Origin,
+		Client:      cl.ID,
+		PacketID:    pk.PacketID,
+		FixedHeader: pk.FixedHeader,
+		TopicName:   pk.TopicName,
+		Payload:     pk.Payload,
+		Sent:        sent,
+		Created:     pk.Created,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			TopicAlias:             props.TopicAlias,
+			User:                   props.User,
+		},
+	}
+
+	// a message is not overwritten by an earlier stage of the same qos flow, so a delayed
+	// write cannot roll a flow back, e.g. from pubrel to publish.
+	data, err := in.MarshalBinary()
+	if err == nil {
+		t := h.Table(storage.InflightKey)
+		q := fmt.Sprintf("insert into %s (client_id, id, type, data) values (%s) on conflict (client_id, id) do update set type = excluded.type, data = excluded.data where %s.type <= excluded.type",
+			t, h.bindvars(4), t)
+		err = h.exec(q, cl.ID, inflightKey(pk), int(pk.FixedHeader.Type), string(data))
+	}
+	if err != nil {
+		h.Log.Error("failed to save qos inflight message data", "error", err, "data", in)
+	}
+}
+
+// OnQosComplete removes a resolved inflight message from the store.
+func (h *Hook) OnQosComplete(cl *mqtt.Client, pk packets.Packet) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	q := fmt.Sprintf("delete from %s where client_id = %s and id = %s",
+		h.Table(storage.InflightKey), h.dialect.Bindvar(1), h.dialect.Bindvar(2))
+	if err := h.exec(q, cl.ID, inflightKey(pk)); err != nil {
+		h.Log.Error("failed to delete qos inflight message data", "error", err, "id", cl.ID+":"+inflightKey(pk))
+	}
+}
+
+// OnQosDropped removes a dropped inflight message from the store.
+func (h *Hook) OnQosDropped(cl *mqtt.Client, pk packets.Packet) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+	}
+
+	h.OnQosComplete(cl, pk)
+}
+
+// OnSysInfoTick stores the latest system info in the store.
+func (h *Hook) OnSysInfoTick(sys *system.Info) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	in := &storage.SystemInfo{
+		ID:   sysInfoKey(),
+		T:    storage.SysInfoKey,
+		Info: *sys,
+	}
+
+	data, err := in.MarshalBinary()
+	if err == nil {
+		q := fmt.Sprintf("insert into %s (id, data) values (%s) on conflict (id) do update set data = excluded.data",
+			h.Table(storage.SysInfoKey), h.bindvars(2))
+		err = h.exec(q, sysInfoKey(), string(data))
+	}
+	if err != nil {
+		h.Log.Error("failed to save server info data", "error", err, "data", in)
+	}
+}
+
+// OnRetainedExpired deletes expired retained messages from the store.
+func (h *Hook) OnRetainedExpired(filter string) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	h.deleteRetained(filter)
+}
+
+// OnClientExpired deleted expired clients from the store.
+func (h *Hook) OnClientExpired(cl *mqtt.Client) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	h.expireSession(cl)
+}
+
+// rows returns the json documents of the records of a table.
+func (h *Hook) rows(key string) (v [][]byte, err error) {
+	start := time.Now()
+	defer func() { h.metrics.Read(start, err) }()
+
+	rows, err := h.db.QueryContext(h.ctx, fmt.Sprintf("select data from %s", h.Table(key)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		v = append(v, data)
+	}
+
+	return v, rows.Err()
+}
+
+// StoredClients returns all stored clients from the store.
+func (h *Hook) StoredClients() (v []storage.Client, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	rows, err := h.rows(storage.ClientKey)
+	if err != nil {
+		h.Log.Error("failed to select client data", "error", err)
+		return
+	}
+
+	for _, row := range rows {
+		var d storage.Client
+		if err = d.UnmarshalBinary(row); err != nil {
+			h.Log.Error("failed to unmarshal client data", "error", err, "data", row)
+		}
+
+		v = append(v, d)
+	}
+
+	return v, nil
+}
+
+// StoredSubscriptions returns all stored subscriptions from the store.
+func (h *Hook) StoredSubscriptions() (v []storage.Subscription, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	rows, err := h.rows(storage.SubscriptionKey)
+	if err != nil {
+		h.Log.Error("failed to select subscription data", "error", err)
+		return
+	}
+
+	for _, row := range rows {
+		var d storage.Subscription
+		if err = d.UnmarshalBinary(row); err != nil {
+			h.Log.Error("failed to unmarshal subscription data", "error", err, "data", row)
+		}
+
+		v = append(v, d)
+	}
+
+	return v, nil
+}
+
+// StoredRetainedMessages returns all stored retained messages from the store.
+func (h *Hook) StoredRetainedMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	rows, err := h.rows(storage.RetainedKey)
+	if err != nil {
+		h.Log.Error("failed to select retained message data", "error", err)
+		return
+	}
+
+	for _, row := range rows {
+		var d storage.Message
+		if err = d.UnmarshalBinary(row); err != nil {
+			h.Log.Error("failed to unmarshal retained message data", "error", err, "data", row)
+		}
+
+		v = append(v, d)
+	}
+
+	return v, nil
+}
+
+// StoredInflightMessages returns all stored inflight messages from the store.
+func (h *Hook) StoredInflightMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	rows, err := h.rows(storage.InflightKey)
+	if err != nil {
+		h.Log.Error("failed to select inflight message data", "error", err)
+		return
+	}
+
+	for _, row := range rows {
+		var d storage.Message
+		if err = d.UnmarshalBinary(row); err != nil {
+			h.Log.Error("failed to unmarshal inflight message data", "error", err, "data", row)
+		}
+
+		v = append(v, d)
+	}
+
+	return v, nil
+}
+
+// StoredSysInfo returns the system info from the store.
+func (h *Hook) StoredSysInfo() (v storage.SystemInfo, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	var row []byte
+	q := fmt.Sprintf("select data from %s where id = %s", h.Table(storage.SysInfoKey), h.dialect.Bindvar(1))
+	start := time.Now()
+	err = h.db.QueryRowContext(h.ctx, q, sysInfoKey()).Scan(&row)
+	if errors.Is(err, sql.ErrNoRows) {
+		h.metrics.Read(start, nil)
+		return v, nil
+	}
+
+	h.metrics.Read(start, err)
+	if err != nil {
+		return
+	}
+
+	if err = v.UnmarshalBinary(row); err != nil {
+		h.Log.Error("failed to unmarshal sys info data", "error", err, "data", row)
+	}
+
+	return v, nil
+}
@@ -0,0 +1,60 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+// numbered is a dialect with numbered placeholders and prefixed tables.
+type numbered struct{}
+
+func (numbered) Table(key string) string { return "t_" + key }
+func (numbered) Bindvar(n int) string    { return ":" + strconv.Itoa(n) }
+func (numbered) JSONType() string        { return "json" }
+
+func (numbered) Size(context.Context, *sql.DB, []string) (int64, error) { return 0, nil }
+
+func TestClientKey(t *testing.T) {
+	k := clientKey(&mqtt.Client{ID: "cl1"})
+	require.Equal(t, "cl1", k)
+}
+
+func TestRetainedKey(t *testing.T) {
+	k := retainedKey("a/b/c")
+	require.Equal(t, "a/b/c", k)
+}
+
+func TestInflightKey(t *testing.T) {
+	k := inflightKey(packets.Packet{PacketID: 1})
+	require.Equal(t, "1", k)
+}
+
+func TestSysInfoKey(t *testing.T) {
+	require.Equal(t, storage.SysInfoKey, sysInfoKey())
+}
+
+func TestDialect(t *testing.T) {
+	h := &Hook{dialect: numbered{}}
+	require.Equal(t, "t_"+storage.ClientKey, h.Table(storage.ClientKey))
+	require.Equal(t, ":1, :2, :3", h.bindvars(3))
+	require.Equal(t, "insert into t_cl (id, data) values (:1, :2) on conflict (id) do update set data = excluded.data", h.upsertClientSql())
+}
+
+func TestNoDB(t *testing.T) {
+	h := new(Hook)
+	require.Nil(t, h.DB())
+	require.NoError(t, h.Close())
+	require.ErrorIs(t, h.Healthy(), storage.ErrDBFileNotOpen)
+	require.Equal(t, int64(0), h.Metrics("sql-db").Size)
+}
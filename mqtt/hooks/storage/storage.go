@@ -7,6 +7,7 @@ package storage
 import (
 	"encoding/json"
 	"errors"
+	"time"
 
 	"github.com/wind-c/comqtt/v2/mqtt/packets"
 	"github.com/wind-c/comqtt/v2/mqtt/system"
@@ -20,6 +21,11 @@ const (
 	ClientKey       = "cl"  // unique key to denote clients in a store
 )
 
+const (
+	// DefaultExpiryInterval is how often a storage hook deletes expired records if no interval is set.
+	DefaultExpiryInterval = time.Hour
+)
+
 var (
 	// ErrDBFileNotOpen indicates that the file database (e.g. bolt/badger) wasn't open for reading.
 	ErrDBFileNotOpen = errors.New("db file not open")
@@ -27,15 +33,17 @@ var (
 
 // Client is a storable representation of an MQTT client.
 type Client struct {
-	Will            ClientWill       `json:"will,omitempty"`       // will topic and payload data if applicable
-	Properties      ClientProperties `json:"properties,omitempty"` // the connect properties for the client
-	Username        []byte           `json:"username,omitempty"`   // the username of the client
-	ID              string           `json:"id" storm:"id"`        // the client id / storage key
-	T               string           `json:"t,omitempty"`          // the data type (client)
-	Remote          string           `json:"remote,omitempty"`     // the remote address of the client
-	Listener        string           `json:"listener,omitempty"`   // the listener the client connected on
-	ProtocolVersion byte             `json:"protocolVersion"`      // mqtt protocol version of the client
-	Clean           bool             `json:"clean,omitempty"`      // if the client requested a clean start/session
+	Will            ClientWill       `json:"will,omitempty"`         // will topic and payload data if applicable
+	Properties      ClientProperties `json:"properties,omitempty"`   // the connect properties for the client
+	Username        []byte           `json:"username,omitempty"`     // the username of the client
+	ID              string           `json:"id" storm:"id"`          // the client id / storage key
+	T               string           `json:"t,omitempty"`            // the data type (client)
+	Remote          string           `json:"remote,omitempty"`       // the remote address of the client
+	Listener        string           `json:"listener,omitempty"`     // the listener the client connected on
+	ProtocolVersion byte             `json:"protocolVersion"`        // mqtt protocol version of the client
+	Clean           bool             `json:"clean,omitempty"`        // if the client requested a clean start/session
+	Disconnected    int64            `json:"disconnected,omitempty"` // the time the client disconnected in unixtime, 0 while connected
+	Expires         int64            `json:"expires,omitempty"`      // the time the session expires in unixtime, 0 while connected or if it never expires
 }
 
 // ClientProperties contains a limited set of the mqtt v5 properties specific to a client connection.
@@ -77,6 +85,41 @@ func (d *Client) UnmarshalBinary(data []byte) error {
 	return json.Unmarshal(data, d)
 }
 
+// Expiry contains the ages after which a storage hook deletes the records it would otherwise
+// keep forever, such as the sessions of clients which never return. Each age is disabled if 0.
+type Expiry struct {
+	Retained time.Duration // retained messages are deleted this long after they were published
+	Inflight time.Duration // queued inflight messages are deleted this long after they were published
+	Session  time.Duration // sessions are deleted with their subscriptions and inflight messages this long after the client disconnected
+	Interval time.Duration // how often expired records are deleted, DefaultExpiryInterval if 0
+
+	// SessionInterval deletes sessions once their session expiry interval has elapsed, by the
+	// expiry time stored with the client, even if the broker was stopped when it elapsed.
+	SessionInterval bool
+}
+
+// Enabled returns true if any of the records expire.
+func (e Expiry) Enabled() bool {
+	return e.Retained > 0 || e.Inflight > 0 || e.Session > 0 || e.SessionInterval
+}
+
+// GcInterval returns how often expired records are deleted.
+func (e Expiry) GcInterval() time.Duration {
+	if e.Interval <= 0 {
+		return DefaultExpiryInterval
+	}
+	return e.Interval
+}
+
+// Cutoff returns the unix time before which a record expires after the age d, or 0 if
+// the age is disabled.
+func Cutoff(d time.Duration, now time.Time) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return now.Add(-d).Unix()
+}
+
 // Message is a storable representation of an MQTT message (specifically publish).
 type Message struct {
 	Properties  MessageProperties   `json:"properties,omitempty"`    // -
@@ -84,6 +127,7 @@ type Message struct {
 	T           string              `json:"t,omitempty"`             // the data type
 	ID          string              `json:"id,omitempty" storm:"id"` // the storage key
 	Origin      string              `json:"origin"`                  // the id of the client who sent the message
+	Client      string              `json:"client,omitempty"`        // the id of the client whose session holds the message (if inflight)
 	TopicName   string              `json:"topic_name"`              // the topic the message was sent to (if retained)
 	FixedHeader packets.FixedHeader `json:"fixedheader"`             // the header properties of the message
 	Created     int64               `json:"created"`                 // the time the message was created in unixtime
@@ -143,6 +187,9 @@ func (d *Message) ToPacket() packets.Packet {
 	// continue pointing at the values from the storage packet.
 	pk = pk.Copy(true)
 	pk.FixedHeader.Dup = d.FixedHeader.Dup
+	if d.Properties.MessageExpiryInterval > 0 {
+		pk.Expiry = d.Created + int64(d.Properties.MessageExpiryInterval)
+	}
 
 	return pk
 }
@@ -112,7 +112,7 @@ var (
 			InflightDropped:  17,
 		},
 	}
-	sysInfoJSON = []byte(`{"version":"2.0.0","started":1,"time":0,"uptime":2,"bytes_received":3,"bytes_sent":4,"clients_connected":5,"clients_disconnected":0,"clients_maximum":7,"clients_total":0,"messages_received":10,"messages_sent":11,"messages_dropped":20,"retained":15,"inflight":16,"inflight_dropped":17,"subscriptions":0,"packets_received":12,"packets_sent":13,"memory_alloc":0,"threads":0,"t":"info","id":"id"}`)
+	sysInfoJSON = []byte(`{"version":"2.0.0","started":1,"time":0,"uptime":2,"bytes_received":3,"bytes_sent":4,"clients_connected":5,"clients_connected_ipv4":0,"clients_connected_ipv6":0,"clients_disconnected":0,"clients_maximum":7,"clients_total":0,"clients_reaped":0,"messages_received":10,"messages_sent":11,"messages_dropped":20,"dead_lettered":0,"retained":15,"retained_evicted":0,"retained_rejected":0,"inflight":16,"inflight_dropped":17,"flow_stalls":0,"subscriptions":0,"packets_received":12,"packets_sent":13,"memory_alloc":0,"threads":0,"t":"info","id":"id"}`)
 )
 
 func TestClientMarshalBinary(t *testing.T) {
@@ -223,6 +223,26 @@ func TestMessageToPacket(t *testing.T) {
 		},
 		PacketID: 100,
 		Created:  d.Created,
+		Expiry:   d.Created + int64(d.Properties.MessageExpiryInterval),
 	}, pk)
 
 }
+
+func TestExpiryEnabled(t *testing.T) {
+	require.False(t, Expiry{}.Enabled())
+	require.False(t, Expiry{Interval: time.Minute}.Enabled())
+	require.True(t, Expiry{Retained: time.Hour}.Enabled())
+	require.True(t, Expiry{Inflight: time.Hour}.Enabled())
+	require.True(t, Expiry{Session: time.Hour}.Enabled())
+}
+
+func TestExpiryGcInterval(t *testing.T) {
+	require.Equal(t, DefaultExpiryInterval, Expiry{}.GcInterval())
+	require.Equal(t, time.Minute, Expiry{Interval: time.Minute}.GcInterval())
+}
+
+func TestCutoff(t *testing.T) {
+	now := time.Unix(1000, 0)
+	require.Equal(t, int64(0), Cutoff(0, now))
+	require.Equal(t, int64(400), Cutoff(10*time.Minute, now))
+}
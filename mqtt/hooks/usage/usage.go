@@ -0,0 +1,177 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package usage
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt"
+)
+
+const defaultTimeout = 10 * time.Second
+
+// Kinds of usage in csv exports.
+const (
+	KindUser   = "user"
+	KindTenant = "tenant"
+)
+
+var ErrNoExport = errors.New("no usage export configured")
+
+// csvHeader is the header row of csv exports.
+var csvHeader = []string{
+	"start", "end", "kind", "name",
+	"messages_received", "messages_sent", "bytes_received", "bytes_sent",
+	"connections", "connection_seconds", "connection_minutes",
+}
+
+// Options contains configuration settings for the usage export.
+type Options struct {
+	CSVFile string        `yaml:"csv-file" json:"csv-file"` // a csv file usage reports are appended to
+	Webhook string        `yaml:"webhook" json:"webhook"`   // a url usage reports are posted to as json
+	Timeout time.Duration `yaml:"timeout" json:"timeout"`   // the timeout of webhook requests, defaults to 10 seconds
+}
+
+// Hook exports the usage reports of the server to a csv file and/or a webhook, so that
+// the usage of users and tenants can be metered and billed.
+type Hook struct {
+	mqtt.HookBase
+	config *Options
+	client *http.Client
+}
+
+// ID returns the ID of the hook.
+func (h *Hook) ID() string {
+	return "usage-export"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *Hook) Provides(b byte) bool {
+	return b == mqtt.OnUsageReport
+}
+
+// Init is called when the hook is initialized.
+func (h *Hook) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		return ErrNoExport
+	}
+
+	h.config = config.(*Options)
+	if h.config.CSVFile == "" && h.config.Webhook == "" {
+		return ErrNoExport
+	}
+
+	if h.config.Timeout <= 0 {
+		h.config.Timeout = defaultTimeout
+	}
+
+	h.client = &http.Client{Timeout: h.config.Timeout}
+	return nil
+}
+
+// OnUsageReport exports a usage report.
+func (h *Hook) OnUsageReport(report mqtt.UsageReport) {
+	if h.config.CSVFile != "" {
+		if err := h.writeCSV(report); err != nil {
+			h.Log.Error("failed to write usage report", "error", err, "file", h.config.CSVFile)
+		}
+	}
+
+	if h.config.Webhook != "" {
+		if err := h.post(report); err != nil {
+			h.Log.Error("failed to post usage report", "error", err, "url", h.config.Webhook)
+		}
+	}
+}
+
+// writeCSV appends a row for each user and tenant of a report to the csv file, writing
+// the header row first if the file is new.
+func (h *Hook) writeCSV(report mqtt.UsageReport) error {
+	f, err := os.OpenFile(h.config.CSVFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	w := csv.NewWriter(f)
+	if fi.Size() == 0 {
+		_ = w.Write(csvHeader)
+	}
+
+	for _, st := range report.Users {
+		_ = w.Write(csvRow(report, KindUser, st))
+	}
+
+	for _, st := range report.Tenants {
+		_ = w.Write(csvRow(report, KindTenant, st))
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+// csvRow returns the csv row of the usage of a user or tenant.
+func csvRow(report mqtt.UsageReport, kind string, st mqtt.UsageStat) []string {
+	return []string{
+		strconv.FormatInt(report.Start, 10),
+		strconv.FormatInt(report.End, 10),
+		kind,
+		st.Name,
+		strconv.FormatInt(st.MessagesReceived, 10),
+		strconv.FormatInt(st.MessagesSent, 10),
+		strconv.FormatInt(st.BytesReceived, 10),
+		strconv.FormatInt(st.BytesSent, 10),
+		strconv.FormatInt(st.Connections, 10),
+		strconv.FormatInt(st.ConnectionSeconds, 10),
+		strconv.FormatFloat(st.ConnectionMinutes, 'f', 2, 64),
+	}
+}
+
+// post sends a report to the webhook as json.
+func (h *Hook) post(report mqtt.UsageReport) error {
+	b, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.config.Webhook, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package usage
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+)
+
+var (
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	report = mqtt.UsageReport{
+		Start:   100,
+		End:     160,
+		Users:   []mqtt.UsageStat{{Name: "alice", MessagesReceived: 2, BytesReceived: 10, ConnectionSeconds: 90, ConnectionMinutes: 1.5}},
+		Tenants: []mqtt.UsageStat{{Name: "t1", MessagesSent: 3, BytesSent: 30, Connections: 1}},
+	}
+)
+
+func newHook(t *testing.T, opts *Options) *Hook {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(opts))
+	return h
+}
+
+func TestID(t *testing.T) {
+	h := new(Hook)
+	require.Equal(t, "usage-export", h.ID())
+}
+
+func TestProvides(t *testing.T) {
+	h := new(Hook)
+	require.True(t, h.Provides(mqtt.OnUsageReport))
+	require.False(t, h.Provides(mqtt.OnPublished))
+}
+
+func TestInitBadConfig(t *testing.T) {
+	h := new(Hook)
+	require.ErrorIs(t, h.Init(map[string]any{}), mqtt.ErrInvalidConfigType)
+	require.ErrorIs(t, h.Init(nil), ErrNoExport)
+	require.ErrorIs(t, h.Init(&Options{}), ErrNoExport)
+}
+
+func TestOnUsageReportCSV(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "usage.csv")
+	h := newHook(t, &Options{CSVFile: file})
+
+	h.OnUsageReport(report)
+	h.OnUsageReport(report)
+
+	f, err := os.Open(file)
+	require.NoError(t, err)
+	defer f.Close()
+
+	rows, err := csv.NewReader(f).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, 5)
+	require.Equal(t, csvHeader, rows[0])
+	require.Equal(t, []string{"100", "160", KindUser, "alice", "2", "0", "10", "0", "0", "90", "1.50"}, rows[1])
+	require.Equal(t, []string{"100", "160", KindTenant, "t1", "0", "3", "0", "30", "1", "0", "0.00"}, rows[2])
+}
+
+func TestOnUsageReportWebhook(t *testing.T) {
+	received := make(chan mqtt.UsageReport, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+
+		var v mqtt.UsageReport
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&v))
+		received <- v
+	}))
+	defer srv.Close()
+
+	h := newHook(t, &Options{Webhook: srv.URL})
+	h.OnUsageReport(report)
+	require.Equal(t, report, <-received)
+}
+
+func TestPostWebhookError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	h := newHook(t, &Options{Webhook: srv.URL})
+	require.Error(t, h.post(report))
+}
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
+	"github.com/wind-c/comqtt/v2/mqtt/listeners"
 	"github.com/wind-c/comqtt/v2/mqtt/packets"
 	"github.com/wind-c/comqtt/v2/mqtt/system"
 
@@ -236,6 +237,8 @@ func TestHooksNonReturns(t *testing.T) {
 			h.OnStarted()
 			h.OnStopped()
 			h.OnSysInfoTick(new(system.Info))
+			h.OnUsageReport(UsageReport{})
+			h.OnSecurityEvent(SecurityEvent{})
 			h.OnSessionEstablish(cl, packets.Packet{})
 			h.OnSessionEstablished(cl, packets.Packet{})
 			h.OnDisconnect(cl, nil, false)
@@ -288,6 +291,70 @@ func TestHooksOnACLCheck(t *testing.T) {
 	require.True(t, ok)
 }
 
+func TestHooksListenerAuth(t *testing.T) {
+	h := new(Hooks)
+	cl := &Client{Net: ClientConnection{Listener: "public"}}
+
+	// anonymous listeners are allowed without auth hooks
+	h.SetListenerAuth("public", &listeners.AuthPolicy{Anonymous: true})
+	require.True(t, h.OnConnectAuthenticate(cl, packets.Packet{}))
+	require.True(t, h.OnACLCheck(cl, "a/b/c", true))
+
+	err := h.Add(new(modifiedHookBase), nil)
+	require.NoError(t, err)
+
+	// only the hooks of the policy are used
+	h.SetListenerAuth("public", &listeners.AuthPolicy{Hooks: []string{"auth-redis"}})
+	require.False(t, h.OnConnectAuthenticate(cl, packets.Packet{}))
+	require.False(t, h.OnACLCheck(cl, "a/b/c", true))
+	require.True(t, h.OnConnectAuthenticate(new(Client), packets.Packet{}))
+
+	h.SetListenerAuth("public", &listeners.AuthPolicy{Hooks: []string{"auth-redis", "modified"}})
+	require.True(t, h.OnConnectAuthenticate(cl, packets.Packet{}))
+	require.True(t, h.OnACLCheck(cl, "a/b/c", true))
+
+	h.SetListenerAuth("public", nil)
+	require.Nil(t, h.ListenerAuth("public"))
+	require.True(t, h.OnConnectAuthenticate(cl, packets.Packet{}))
+}
+
+// denyBlacklist is a blacklist denying the clients with an id.
+type denyBlacklist string
+
+func (b denyBlacklist) BlacklistAuth(cl *Client) (int, bool) {
+	if cl.ID == string(b) {
+		return 0, false
+	}
+	return -1, false
+}
+
+func (b denyBlacklist) BlacklistACL(cl *Client, topic string, write bool) (int, bool) {
+	return b.BlacklistAuth(cl)
+}
+
+func TestHooksListenerAuthBlacklist(t *testing.T) {
+	h := &Hooks{Blacklist: denyBlacklist("banned")}
+	h.SetListenerAuth("public", &listeners.AuthPolicy{Anonymous: true})
+
+	// anonymous listeners still deny the clients of the blacklist
+	cl := &Client{ID: "banned", Net: ClientConnection{Listener: "public"}}
+	require.False(t, h.OnConnectAuthenticate(cl, packets.Packet{}))
+	require.Equal(t, true, cl.Ext[BlacklistedExtKey])
+	require.False(t, h.OnACLCheck(cl, "a/b/c", true))
+
+	cl = &Client{ID: "zen", Net: ClientConnection{Listener: "public"}}
+	require.True(t, h.OnConnectAuthenticate(cl, packets.Packet{}))
+	require.True(t, h.OnACLCheck(cl, "a/b/c", true))
+
+	// the blacklist is checked before the auth hooks of the other listeners
+	err := h.Add(new(modifiedHookBase), nil)
+	require.NoError(t, err)
+	cl = &Client{ID: "banned", Net: ClientConnection{Listener: "tcp"}}
+	require.False(t, h.OnConnectAuthenticate(cl, packets.Packet{}))
+	require.False(t, h.OnACLCheck(cl, "a/b/c", true))
+	require.True(t, h.OnConnectAuthenticate(&Client{ID: "zen"}, packets.Packet{}))
+}
+
 func TestHooksOnSubscribe(t *testing.T) {
 	h := new(Hooks)
 	err := h.Add(new(modifiedHookBase), nil)
@@ -665,3 +732,42 @@ func TestHookBaseStoreSysInfo(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, "", v.Version)
 }
+
+func TestHooksOnEnhancedAuth(t *testing.T) {
+	h := new(Hooks)
+	cl := new(Client)
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Connect},
+		Properties:  packets.Properties{AuthenticationMethod: "challenge"},
+	}
+
+	_, err := h.OnEnhancedAuth(cl, pk)
+	require.ErrorIs(t, err, packets.ErrBadAuthenticationMethod)
+
+	err = h.Add(new(modifiedHookBase), nil)
+	require.NoError(t, err)
+	err = h.Add(new(enhancedAuthHook), nil)
+	require.NoError(t, err)
+
+	res, err := h.OnEnhancedAuth(cl, pk)
+	require.NoError(t, err)
+	require.Equal(t, packets.CodeContinueAuthentication.Code, res.ReasonCode)
+	require.Equal(t, []byte("nonce"), res.Properties.AuthenticationData)
+
+	pk.Properties.AuthenticationMethod = "SHA-1"
+	_, err = h.OnEnhancedAuth(cl, pk)
+	require.ErrorIs(t, err, packets.ErrBadAuthenticationMethod)
+}
+
+func TestHooksOnClientIDAssign(t *testing.T) {
+	h := new(Hooks)
+	require.Equal(t, "", h.OnClientIDAssign(new(Client), packets.Packet{}))
+
+	err := h.Add(new(modifiedHookBase), nil)
+	require.NoError(t, err)
+	require.Equal(t, "", h.OnClientIDAssign(new(Client), packets.Packet{}))
+
+	err = h.Add(&clientIDHook{id: "assigned"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, "assigned", h.OnClientIDAssign(new(Client), packets.Packet{}))
+}
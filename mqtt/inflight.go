@@ -16,10 +16,12 @@ import (
 type Inflight struct {
 	sync.RWMutex
 	internal            map[uint16]packets.Packet // internal contains the inflight packets
+	cold                map[uint16]bool           // the packets spilled to the cold store, kept without their payload
 	receiveQuota        int32                     // remaining inbound qos quota for flow control
 	sendQuota           int32                     // remaining outbound qos quota for flow control
 	maximumReceiveQuota int32                     // maximum allowed receive quota
 	maximumSendQuota    int32                     // maximum allowed send quota
+	stalls              int64                     // the number of messages held back because the send quota was exhausted
 }
 
 // NewInflights returns a new instance of an Inflight packets map.
@@ -36,6 +38,7 @@ func (i *Inflight) Set(m packets.Packet) bool {
 
 	_, ok := i.internal[m.PacketID]
 	i.internal[m.PacketID] = m
+	delete(i.cold, m.PacketID)
 	return !ok
 }
 
@@ -67,6 +70,9 @@ func (i *Inflight) Clone() *Inflight {
 	for k, v := range i.internal {
 		c.internal[k] = v
 	}
+	for k := range i.cold {
+		c.markCold(k)
+	}
 	return c
 }
 
@@ -111,6 +117,7 @@ func (i *Inflight) Delete(id uint16) bool {
 
 	_, ok := i.internal[id]
 	delete(i.internal, id)
+	delete(i.cold, id)
 
 	return ok
 }
@@ -154,3 +161,115 @@ func (i *Inflight) ResetSendQuota(n int32) {
 	atomic.StoreInt32(&i.sendQuota, n)
 	atomic.StoreInt32(&i.maximumSendQuota, n)
 }
+
+// SetMaximumSendQuota changes the maximum allowed send quota of a connected client, adjusting
+// the remaining send quota by the difference so that messages already inflight are respected.
+// The quota is swapped rather than stored, so that concurrent increases and decreases by the
+// client goroutines are not lost.
+func (i *Inflight) SetMaximumSendQuota(n int32) {
+	i.Lock()
+	defer i.Unlock()
+
+	diff := n - atomic.SwapInt32(&i.maximumSendQuota, n)
+	for {
+		current := atomic.LoadInt32(&i.sendQuota)
+		quota := current + diff
+		if quota < 0 {
+			quota = 0
+		} else if quota > n {
+			quota = n
+		}
+		if atomic.CompareAndSwapInt32(&i.sendQuota, current, quota) {
+			return
+		}
+	}
+}
+
+// SendQuota returns the remaining and maximum outbound qos quota.
+func (i *Inflight) SendQuota() (remaining, maximum int32) {
+	return atomic.LoadInt32(&i.sendQuota), atomic.LoadInt32(&i.maximumSendQuota)
+}
+
+// ReceiveQuota returns the remaining and maximum inbound qos quota.
+func (i *Inflight) ReceiveQuota() (remaining, maximum int32) {
+	return atomic.LoadInt32(&i.receiveQuota), atomic.LoadInt32(&i.maximumReceiveQuota)
+}
+
+// Stalls returns the number of messages which were held back because the send quota was exhausted.
+func (i *Inflight) Stalls() int64 {
+	return atomic.LoadInt64(&i.stalls)
+}
+
+// markCold marks a packet as spilled to the cold store, with the lock held.
+func (i *Inflight) markCold(id uint16) {
+	if i.cold == nil {
+		i.cold = map[uint16]bool{}
+	}
+	i.cold[id] = true
+}
+
+// spill drops the payloads and properties of the publish packets from memory, as they are
+// in the cold store, returning the number of packets spilled. The packets stay in the map
+// without them, so that their packet ids are not reused and they still expire.
+func (i *Inflight) spill() int {
+	i.Lock()
+	defer i.Unlock()
+
+	var n int
+	for id, pk := range i.internal {
+		if pk.FixedHeader.Type != packets.Publish || i.cold[id] {
+			continue
+		}
+
+		pk.Payload = nil
+		pk.Properties = packets.Properties{}
+		i.internal[id] = pk
+		i.markCold(id)
+		n++
+	}
+
+	return n
+}
+
+// warm restores the spilled packets from the packets read from the cold store, keeping
+// their expiry, and deletes and returns the ids of any spilled packets which were missing.
+func (i *Inflight) warm(pks []packets.Packet) []uint16 {
+	i.Lock()
+	defer i.Unlock()
+
+	for _, pk := range pks {
+		if m, ok := i.internal[pk.PacketID]; ok && i.cold[pk.PacketID] {
+			pk.Expiry = m.Expiry
+			i.internal[pk.PacketID] = pk
+			delete(i.cold, pk.PacketID)
+		}
+	}
+
+	var missing []uint16
+	for id := range i.cold {
+		delete(i.internal, id)
+		missing = append(missing, id)
+	}
+	i.cold = nil
+
+	return missing
+}
+
+// isCold returns true if a packet has been spilled to the cold store.
+func (i *Inflight) isCold(id uint16) bool {
+	i.RLock()
+	defer i.RUnlock()
+	return i.cold[id]
+}
+
+// hasCold returns true if any packets have been spilled to the cold store.
+func (i *Inflight) hasCold() bool {
+	return i.coldLen() > 0
+}
+
+// coldLen returns the number of packets spilled to the cold store.
+func (i *Inflight) coldLen() int {
+	i.RLock()
+	defer i.RUnlock()
+	return len(i.cold)
+}
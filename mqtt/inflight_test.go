@@ -5,6 +5,7 @@
 package mqtt
 
 import (
+	"sync"
 	"sync/atomic"
 	"testing"
 
@@ -197,3 +198,57 @@ func TestNextImmediate(t *testing.T) {
 	_, ok = cl.State.Inflight.NextImmediate()
 	require.False(t, ok)
 }
+
+func TestSetMaximumSendQuota(t *testing.T) {
+	i := NewInflights()
+	i.ResetSendQuota(5)
+	i.DecreaseSendQuota()
+	i.DecreaseSendQuota()
+
+	i.SetMaximumSendQuota(10)
+	remaining, maximum := i.SendQuota()
+	require.Equal(t, int32(8), remaining)
+	require.Equal(t, int32(10), maximum)
+
+	i.SetMaximumSendQuota(1)
+	remaining, maximum = i.SendQuota()
+	require.Equal(t, int32(0), remaining)
+	require.Equal(t, int32(1), maximum)
+}
+
+func TestSetMaximumSendQuotaConcurrent(t *testing.T) {
+	i := NewInflights()
+	i.ResetSendQuota(1000)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 500; j++ {
+			i.DecreaseSendQuota()
+		}
+	}()
+	for j := 0; j < 100; j++ {
+		i.SetMaximumSendQuota(2000)
+		i.SetMaximumSendQuota(1000)
+	}
+	wg.Wait()
+
+	remaining, maximum := i.SendQuota()
+	require.Equal(t, int32(500), remaining)
+	require.Equal(t, int32(1000), maximum)
+}
+
+func TestInflightQuotaStats(t *testing.T) {
+	i := NewInflights()
+	i.ResetReceiveQuota(4)
+	i.DecreaseReceiveQuota()
+
+	remaining, maximum := i.ReceiveQuota()
+	require.Equal(t, int32(3), remaining)
+	require.Equal(t, int32(4), maximum)
+
+	require.Equal(t, int64(0), i.Stalls())
+	atomic.AddInt64(&i.stalls, 2)
+	require.Equal(t, int64(2), i.Stalls())
+}
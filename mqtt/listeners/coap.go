@@ -0,0 +1,742 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package listeners
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+const (
+	CoAPTopicPath       = "ps" // the first uri path segment of topics, e.g. /ps/sensors/1/temp
+	CoAPMaxObservations = 4096 // the maximum observations of a listener
+	coapMaxMessageSize  = 1<<16 - 1
+	coapDedupSize       = 1024              // the confirmable responses kept to answer retransmissions
+	coapExchangeTime    = 247 * time.Second // the exchange lifetime of confirmable messages
+)
+
+var (
+	// ErrCoAPNotFound indicates that a topic has no retained message to read.
+	ErrCoAPNotFound = errors.New("no retained message")
+
+	errCoAPMalformed = errors.New("malformed coap message")
+)
+
+// coap message types.
+const (
+	coapCON byte = iota
+	coapNON
+	coapACK
+	coapRST
+)
+
+// coap request and response codes, class << 5 | detail.
+const (
+	coapEmpty             byte = 0
+	coapGET               byte = 1
+	coapPOST              byte = 2
+	coapPUT               byte = 3
+	coapDELETE            byte = 4
+	coapDeleted           byte = 2<<5 | 2
+	coapChanged           byte = 2<<5 | 4
+	coapContent           byte = 2<<5 | 5
+	coapBadRequest        byte = 4<<5 | 0
+	coapUnauthorized      byte = 4<<5 | 1
+	coapBadOption         byte = 4<<5 | 2
+	coapForbidden         byte = 4<<5 | 3
+	coapNotFound          byte = 4<<5 | 4
+	coapNotAllowed        byte = 4<<5 | 5
+	coapTooMany           byte = 4<<5 | 29
+	coapInternalError     byte = 5<<5 | 0
+	coapUnavailable       byte = 5<<5 | 3
+	coapLinkFormat             = 40 // the application/link-format content format
+	coapOctetStream            = 42 // the application/octet-stream content format
+	coapObserveRegister        = 0  // the observe option value registering an observation
+	coapObserveDeregister      = 1  // the observe option value cancelling an observation
+)
+
+// coap option numbers.
+const (
+	coapOptionUriHost       uint16 = 3
+	coapOptionObserve       uint16 = 6
+	coapOptionUriPort       uint16 = 7
+	coapOptionUriPath       uint16 = 11
+	coapOptionContentFormat uint16 = 12
+	coapOptionUriQuery      uint16 = 15
+	coapOptionAccept        uint16 = 17
+)
+
+// CoAPRequest is a request from a constrained device to publish to, read or observe a topic.
+type CoAPRequest struct {
+	Listener string // the id of the listener which received the request
+	Remote   string // the remote address of the device
+	Topic    string // the topic of the request, or a topic filter when observing
+	ClientID string // the client id of the device, from the client_id query, generated if empty
+	Username string // the username of the device, from the username query
+	Password string // the password of the device, from the password query
+	Retain   bool   // publish as a retained message, from the retain query
+	Qos      byte   // the qos to publish at, from the qos query
+	Payload  []byte // the payload to publish
+}
+
+// CoAPGateway maps the requests of a CoAP listener onto the broker, authenticating and
+// acl checking each request as a client of the listener.
+type CoAPGateway interface {
+	// CoAPPublish publishes the payload of a request to its topic.
+	CoAPPublish(req CoAPRequest) error
+
+	// CoAPRead returns the payload of the retained message of the topic of a request,
+	// or ErrCoAPNotFound if it has none.
+	CoAPRead(req CoAPRequest) ([]byte, error)
+
+	// CoAPObserve subscribes to the topic of a request, calling notify with the payload
+	// of each matching message until cancel is called.
+	CoAPObserve(req CoAPRequest, notify func(payload []byte)) (cancel func(), err error)
+}
+
+// coapOption is an option of a coap message.
+type coapOption struct {
+	number uint16
+	value  []byte
+}
+
+// coapMessage is a coap message, as described in RFC 7252.
+type coapMessage struct {
+	typ       byte
+	code      byte
+	messageID uint16
+	token     []byte
+	options   []coapOption
+	payload   []byte
+}
+
+// option returns the values of an option of the message.
+func (m *coapMessage) option(number uint16) [][]byte {
+	var v [][]byte
+	for _, o := range m.options {
+		if o.number == number {
+			v = append(v, o.value)
+		}
+	}
+	return v
+}
+
+// observe returns the value of the observe option, or -1 if it is not set.
+func (m *coapMessage) observe() int {
+	v := m.option(coapOptionObserve)
+	if len(v) == 0 {
+		return -1
+	}
+	return int(coapUint(v[0]))
+}
+
+// decodeCoAP decodes a coap message from a datagram.
+func decodeCoAP(b []byte) (*coapMessage, error) {
+	if len(b) < 4 || b[0]>>6 != 1 {
+		return nil, errCoAPMalformed
+	}
+
+	m := &coapMessage{
+		typ:       b[0] >> 4 & 0x3,
+		code:      b[1],
+		messageID: binary.BigEndian.Uint16(b[2:4]),
+	}
+
+	tkl := int(b[0] & 0xf)
+	if tkl > 8 || len(b) < 4+tkl {
+		return nil, errCoAPMalformed
+	}
+	m.token = append([]byte{}, b[4:4+tkl]...)
+
+	b = b[4+tkl:]
+	var number uint16
+	for len(b) > 0 {
+		if b[0] == 0xff {
+			if len(b) == 1 {
+				return nil, errCoAPMalformed // a payload marker must be followed by a payload
+			}
+			m.payload = append([]byte{}, b[1:]...)
+			break
+		}
+
+		delta, length := int(b[0]>>4), int(b[0]&0xf)
+		b = b[1:]
+
+		var err error
+		if delta, b, err = coapExtended(delta, b); err != nil {
+			return nil, err
+		}
+		if length, b, err = coapExtended(length, b); err != nil {
+			return nil, err
+		}
+
+		if len(b) < length || int(number)+delta > 0xffff {
+			return nil, errCoAPMalformed
+		}
+
+		number += uint16(delta)
+		m.options = append(m.options, coapOption{number: number, value: append([]byte{}, b[:length]...)})
+		b = b[length:]
+	}
+
+	return m, nil
+}
+
+// coapExtended reads the extended value of an option delta or length.
+func coapExtended(v int, b []byte) (int, []byte, error) {
+	switch v {
+	case 13:
+		if len(b) < 1 {
+			return 0, nil, errCoAPMalformed
+		}
+		return int(b[0]) + 13, b[1:], nil
+	case 14:
+		if len(b) < 2 {
+			return 0, nil, errCoAPMalformed
+		}
+		return int(binary.BigEndian.Uint16(b)) + 269, b[2:], nil
+	case 15:
+		return 0, nil, errCoAPMalformed
+	default:
+		return v, b, nil
+	}
+}
+
+// encode encodes the message as a datagram.
+func (m *coapMessage) encode() []byte {
+	b := make([]byte, 4, 4+len(m.token)+len(m.payload)+16)
+	b[0] = 1<<6 | m.typ<<4 | byte(len(m.token))
+	b[1] = m.code
+	binary.BigEndian.PutUint16(b[2:], m.messageID)
+	b = append(b, m.token...)
+
+	options := append([]coapOption{}, m.options...)
+	sort.SliceStable(options, func(i, j int) bool {
+		return options[i].number < options[j].number
+	})
+
+	var number uint16
+	for _, o := range options {
+		delta, dx := coapNibble(int(o.number - number))
+		length, lx := coapNibble(len(o.value))
+		b = append(b, byte(delta<<4|length))
+		b = append(b, dx...)
+		b = append(b, lx...)
+		b = append(b, o.value...)
+		number = o.number
+	}
+
+	if len(m.payload) > 0 {
+		b = append(b, 0xff)
+		b = append(b, m.payload...)
+	}
+
+	return b
+}
+
+// coapNibble returns the nibble and extended bytes encoding an option delta or length.
+func coapNibble(v int) (int, []byte) {
+	switch {
+	case v < 13:
+		return v, nil
+	case v < 269:
+		return 13, []byte{byte(v - 13)}
+	default:
+		return 14, binary.BigEndian.AppendUint16(nil, uint16(v-269))
+	}
+}
+
+// coapUint returns an option value as an unsigned integer.
+func coapUint(b []byte) uint32 {
+	var v uint32
+	for _, c := range b {
+		v = v<<8 | uint32(c)
+	}
+	return v
+}
+
+// coapUintValue returns an unsigned integer as a minimal option value.
+func coapUintValue(v uint32) []byte {
+	var b []byte
+	for ; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	return b
+}
+
+// coapObservation is the observation of a topic by a device.
+type coapObservation struct {
+	addr    net.Addr
+	token   []byte
+	cancel  func()
+	seq     atomic.Uint32 // the observe sequence number of the last notification
+	lastID  atomic.Uint32 // the message id of the last notification
+	ready   chan struct{} // closed once the registration has been answered
+	stopped chan struct{} // closed once the observation is cancelled
+	once    sync.Once
+}
+
+// coapResponse is a response to a confirmable request, kept to answer retransmissions.
+type coapResponse struct {
+	b       []byte
+	created time.Time
+}
+
+// CoAP is a listener for constrained devices using the Constrained Application Protocol
+// over udp, mapping requests onto publishes, retained message reads and subscriptions
+// of a gateway. Requests to /ps/{topic} are served: PUT and POST publish the payload,
+// GET reads the retained message, GET with the observe option subscribes to the topic,
+// and DELETE clears the retained message. DTLS is not supported.
+type CoAP struct {
+	sync.RWMutex
+	id           string                      // the internal id of the listener
+	address      string                      // the network address to bind to
+	config       *Config                     // configuration values for the listener
+	gateway      CoAPGateway                 // maps requests onto the broker
+	conn         net.PacketConn              // the udp socket of the listener
+	log          *slog.Logger                // server logger
+	observations map[string]*coapObservation // observations keyed on remote address and token
+	responses    map[string]coapResponse     // recent confirmable responses keyed on remote address and message id
+	messageID    atomic.Uint32               // the message id of the last message sent by the listener
+	end          uint32                      // ensure the close methods are only called once
+}
+
+// NewCoAP initialises and returns a new CoAP listener, listening on an address and
+// serving requests with a gateway, usually the mqtt server.
+func NewCoAP(id, address string, config *Config, gateway CoAPGateway) *CoAP {
+	if config == nil {
+		config = new(Config)
+	}
+
+	return &CoAP{
+		id:           id,
+		address:      address,
+		config:       config,
+		gateway:      gateway,
+		observations: map[string]*coapObservation{},
+		responses:    map[string]coapResponse{},
+	}
+}
+
+// ID returns the id of the listener.
+func (l *CoAP) ID() string {
+	return l.id
+}
+
+// Address returns the address of the listener.
+func (l *CoAP) Address() string {
+	if l.conn != nil {
+		return l.conn.LocalAddr().String()
+	}
+	return l.address
+}
+
+// Config returns the config of the listener.
+func (l *CoAP) Config() *Config {
+	return l.config
+}
+
+// Protocol returns the protocol of the listener.
+func (l *CoAP) Protocol() string {
+	return "coap"
+}
+
+// Init initializes the listener.
+func (l *CoAP) Init(log *slog.Logger) error {
+	l.log = log
+
+	network, err := l.config.Network("udp")
+	if err != nil {
+		return err
+	}
+
+	l.conn, err = net.ListenPacket(network, l.address)
+	return err
+}
+
+// Serve starts waiting for coap requests, serving each with the gateway.
+func (l *CoAP) Serve(establish EstablishFn) {
+	buf := make([]byte, coapMaxMessageSize)
+	for {
+		if atomic.LoadUint32(&l.end) == 1 {
+			return
+		}
+
+		n, addr, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			if atomic.LoadUint32(&l.end) == 1 {
+				return
+			}
+			continue
+		}
+
+		m, err := decodeCoAP(buf[:n])
+		if err != nil {
+			continue // malformed messages are silently ignored
+		}
+
+		go l.handle(addr, m)
+	}
+}
+
+// Close closes the listener and cancels all observations.
+func (l *CoAP) Close(closeClients CloseFn) {
+	l.Lock()
+	defer l.Unlock()
+
+	if atomic.CompareAndSwapUint32(&l.end, 0, 1) {
+		if l.conn != nil {
+			_ = l.conn.Close()
+		}
+
+		for key, o := range l.observations {
+			o.stop()
+			delete(l.observations, key)
+		}
+	}
+
+	closeClients(l.id)
+}
+
+// Observations returns the number of observations.
+func (l *CoAP) Observations() int {
+	l.RLock()
+	defer l.RUnlock()
+	return len(l.observations)
+}
+
+// handle handles a coap message from a device.
+func (l *CoAP) handle(addr net.Addr, m *coapMessage) {
+	switch {
+	case m.typ == coapRST:
+		l.reset(addr, m.messageID)
+		return
+	case m.typ == coapACK:
+		return
+	case m.code == coapEmpty:
+		if m.typ == coapCON { // a ping
+			l.send(addr, &coapMessage{typ: coapRST, messageID: m.messageID})
+		}
+		return
+	case m.code > coapDELETE:
+		return // responses are not expected
+	}
+
+	key := addr.String() + "/" + strconv.Itoa(int(m.messageID))
+	if m.typ == coapCON {
+		if b, ok := l.response(key); ok {
+			_, _ = l.conn.WriteTo(b, addr) // a retransmission
+			return
+		}
+	}
+
+	res, o := l.serve(addr, m)
+	res.token = m.token
+	if m.typ == coapCON {
+		res.typ, res.messageID = coapACK, m.messageID
+	} else {
+		res.typ, res.messageID = coapNON, l.nextMessageID()
+	}
+
+	b := res.encode()
+	if m.typ == coapCON {
+		l.keepResponse(key, b)
+	}
+	_, _ = l.conn.WriteTo(b, addr)
+
+	if o != nil {
+		close(o.ready)
+	}
+}
+
+// serve returns the response to a request, and the observation it registered, if any.
+func (l *CoAP) serve(addr net.Addr, m *coapMessage) (*coapMessage, *coapObservation) {
+	for _, o := range m.options {
+		if o.number&1 == 1 && !coapKnownOption(o.number) {
+			return &coapMessage{code: coapBadOption}, nil // unrecognised critical options must be rejected
+		}
+	}
+
+	var path []string
+	for _, v := range m.option(coapOptionUriPath) {
+		path = append(path, string(v))
+	}
+
+	if m.code == coapGET && len(path) == 2 && path[0] == ".well-known" && path[1] == "core" {
+		return &coapMessage{
+			code:    coapContent,
+			options: []coapOption{{number: coapOptionContentFormat, value: coapUintValue(coapLinkFormat)}},
+			payload: []byte(`</` + CoAPTopicPath + `>;rt="core.ps";ct=42`),
+		}, nil
+	}
+
+	if len(path) < 2 || path[0] != CoAPTopicPath {
+		return &coapMessage{code: coapNotFound}, nil
+	}
+
+	req, ok := l.request(addr, m, strings.Join(path[1:], "/"))
+	if !ok {
+		return &coapMessage{code: coapBadRequest}, nil
+	}
+
+	switch m.code {
+	case coapPUT, coapPOST:
+		if err := l.gateway.CoAPPublish(req); err != nil {
+			return &coapMessage{code: coapErrorCode(err)}, nil
+		}
+		return &coapMessage{code: coapChanged}, nil
+	case coapDELETE:
+		req.Retain, req.Payload = true, nil // an empty retained message clears the retained message
+		if err := l.gateway.CoAPPublish(req); err != nil {
+			return &coapMessage{code: coapErrorCode(err)}, nil
+		}
+		return &coapMessage{code: coapDeleted}, nil
+	case coapGET:
+		observe := m.observe()
+		if observe == coapObserveRegister {
+			return l.observe(addr, m.token, req)
+		}
+
+		if observe == coapObserveDeregister {
+			l.cancel(addr.String() + "/" + hex.EncodeToString(m.token))
+		}
+
+		payload, err := l.gateway.CoAPRead(req)
+		if err != nil {
+			return &coapMessage{code: coapErrorCode(err)}, nil
+		}
+		return &coapMessage{code: coapContent, options: coapContentOptions(), payload: payload}, nil
+	default:
+		return &coapMessage{code: coapNotAllowed}, nil
+	}
+}
+
+// request returns the gateway request of a coap request, or false if its query is invalid.
+func (l *CoAP) request(addr net.Addr, m *coapMessage, topic string) (CoAPRequest, bool) {
+	req := CoAPRequest{
+		Listener: l.id,
+		Remote:   addr.String(),
+		Topic:    topic,
+		Payload:  m.payload,
+	}
+
+	for _, v := range m.option(coapOptionUriQuery) {
+		key, value, _ := strings.Cut(string(v), "=")
+		switch key {
+		case "client_id":
+			req.ClientID = value
+		case "username":
+			req.Username = value
+		case "password":
+			req.Password = value
+		case "retain":
+			req.Retain = value == "" || value == "true" || value == "1"
+		case "qos":
+			qos, err := strconv.Atoi(value)
+			if err != nil || qos < 0 || qos > 2 {
+				return req, false
+			}
+			req.Qos = byte(qos)
+		}
+	}
+
+	return req, true
+}
+
+// observe registers an observation of the topic of a request, replacing any observation
+// with the same token, and returns the response to the registration.
+func (l *CoAP) observe(addr net.Addr, token []byte, req CoAPRequest) (*coapMessage, *coapObservation) {
+	key := addr.String() + "/" + hex.EncodeToString(token)
+	l.cancel(key)
+
+	if l.Observations() >= CoAPMaxObservations {
+		return &coapMessage{code: coapUnavailable}, nil
+	}
+
+	o := &coapObservation{
+		addr:    addr,
+		token:   token,
+		ready:   make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	o.seq.Store(1)
+
+	cancel, err := l.gateway.CoAPObserve(req, func(payload []byte) {
+		l.notify(o, payload)
+	})
+	if err != nil {
+		close(o.ready)
+		return &coapMessage{code: coapErrorCode(err)}, nil
+	}
+	o.cancel = cancel
+
+	l.Lock()
+	if atomic.LoadUint32(&l.end) == 1 {
+		l.Unlock()
+		o.stop()
+		return &coapMessage{code: coapUnavailable}, nil
+	}
+	l.observations[key] = o
+	l.Unlock()
+
+	l.log.Debug("coap observation registered", "listener", l.id, "remote", req.Remote, "topic", req.Topic)
+	return &coapMessage{
+		code:    coapContent,
+		options: append(coapContentOptions(), coapOption{number: coapOptionObserve, value: coapUintValue(1)}),
+	}, o
+}
+
+// notify sends a notification of a message to an observer, once the registration of the
+// observation has been answered.
+func (l *CoAP) notify(o *coapObservation, payload []byte) {
+	select {
+	case <-o.ready:
+	case <-o.stopped:
+		return
+	}
+
+	id := l.nextMessageID()
+	o.lastID.Store(uint32(id))
+	seq := o.seq.Add(1) & 0xffffff // observe sequence numbers are 24 bits
+
+	l.send(o.addr, &coapMessage{
+		typ:       coapNON,
+		code:      coapContent,
+		messageID: id,
+		token:     o.token,
+		options:   append(coapContentOptions(), coapOption{number: coapOptionObserve, value: coapUintValue(seq)}),
+		payload:   payload,
+	})
+}
+
+// reset cancels the observation whose notification a device rejected with a reset.
+func (l *CoAP) reset(addr net.Addr, messageID uint16) {
+	remote := addr.String()
+	l.RLock()
+	var key string
+	for k, o := range l.observations {
+		if o.addr.String() == remote && o.lastID.Load() == uint32(messageID) {
+			key = k
+			break
+		}
+	}
+	l.RUnlock()
+
+	if key != "" {
+		l.cancel(key)
+	}
+}
+
+// cancel cancels an observation.
+func (l *CoAP) cancel(key string) {
+	l.Lock()
+	o, ok := l.observations[key]
+	delete(l.observations, key)
+	l.Unlock()
+
+	if ok {
+		o.stop()
+	}
+}
+
+// stop cancels the subscription of an observation.
+func (o *coapObservation) stop() {
+	o.once.Do(func() {
+		close(o.stopped)
+		if o.cancel != nil {
+			o.cancel()
+		}
+	})
+}
+
+// send sends a message to a device.
+func (l *CoAP) send(addr net.Addr, m *coapMessage) {
+	if _, err := l.conn.WriteTo(m.encode(), addr); err != nil && atomic.LoadUint32(&l.end) == 0 {
+		l.log.Debug("coap send failed", "listener", l.id, "remote", addr.String(), "error", err)
+	}
+}
+
+// nextMessageID returns the message id of a new message sent by the listener.
+func (l *CoAP) nextMessageID() uint16 {
+	return uint16(l.messageID.Add(1))
+}
+
+// response returns the response kept for a confirmable request.
+func (l *CoAP) response(key string) ([]byte, bool) {
+	l.RLock()
+	defer l.RUnlock()
+	r, ok := l.responses[key]
+	if !ok || time.Since(r.created) > coapExchangeTime {
+		return nil, false
+	}
+	return r.b, true
+}
+
+// keepResponse keeps the response to a confirmable request, so that retransmissions of
+// the request are answered without being served again.
+func (l *CoAP) keepResponse(key string, b []byte) {
+	l.Lock()
+	defer l.Unlock()
+	if len(l.responses) >= coapDedupSize {
+		for k, r := range l.responses {
+			if time.Since(r.created) > coapExchangeTime {
+				delete(l.responses, k)
+			}
+		}
+
+		if len(l.responses) >= coapDedupSize {
+			l.responses = map[string]coapResponse{}
+		}
+	}
+
+	l.responses[key] = coapResponse{b: b, created: time.Now()}
+}
+
+// coapKnownOption returns true if an option is understood by the listener.
+func coapKnownOption(number uint16) bool {
+	switch number {
+	case coapOptionUriHost, coapOptionUriPort, coapOptionUriPath, coapOptionUriQuery, coapOptionObserve,
+		coapOptionContentFormat, coapOptionAccept:
+		return true
+	}
+	return false
+}
+
+// coapContentOptions returns the options of a response with a message payload.
+func coapContentOptions() []coapOption {
+	return []coapOption{{number: coapOptionContentFormat, value: coapUintValue(coapOctetStream)}}
+}
+
+// coapErrorCode returns the response code of a gateway error.
+func coapErrorCode(err error) byte {
+	switch {
+	case errors.Is(err, ErrCoAPNotFound):
+		return coapNotFound
+	case errors.Is(err, packets.ErrBadUsernameOrPassword):
+		return coapUnauthorized
+	case errors.Is(err, packets.ErrNotAuthorized), errors.Is(err, packets.ErrBanned),
+		errors.Is(err, packets.ErrClientIdentifierNotOwned), errors.Is(err, packets.ErrClientIdentifierNotValid):
+		return coapForbidden
+	case errors.Is(err, packets.ErrQuotaExceeded):
+		return coapTooMany
+	case errors.Is(err, packets.ErrServerUnavailable):
+		return coapUnavailable
+	case errors.Is(err, packets.ErrTopicNameInvalid), errors.Is(err, packets.ErrTopicFilterInvalid):
+		return coapBadRequest
+	default:
+		return coapInternalError
+	}
+}
@@ -0,0 +1,345 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package listeners
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+// mockGateway records coap requests and serves a single retained message.
+type mockGateway struct {
+	sync.Mutex
+	published []CoAPRequest
+	retained  map[string][]byte
+	notify    func([]byte)
+	cancelled bool
+}
+
+func (g *mockGateway) CoAPPublish(req CoAPRequest) error {
+	g.Lock()
+	defer g.Unlock()
+	if req.Username != "dev" {
+		return packets.ErrBadUsernameOrPassword
+	}
+	g.published = append(g.published, req)
+	return nil
+}
+
+func (g *mockGateway) CoAPRead(req CoAPRequest) ([]byte, error) {
+	g.Lock()
+	defer g.Unlock()
+	if req.Topic == "secret" {
+		return nil, packets.ErrNotAuthorized
+	}
+	if b, ok := g.retained[req.Topic]; ok {
+		return b, nil
+	}
+	return nil, ErrCoAPNotFound
+}
+
+func (g *mockGateway) CoAPObserve(req CoAPRequest, notify func([]byte)) (func(), error) {
+	g.Lock()
+	defer g.Unlock()
+	g.notify = notify
+	return func() {
+		g.Lock()
+		defer g.Unlock()
+		g.cancelled = true
+	}, nil
+}
+
+func (g *mockGateway) isCancelled() bool {
+	g.Lock()
+	defer g.Unlock()
+	return g.cancelled
+}
+
+func newCoAPTest(t *testing.T) (*CoAP, *mockGateway, net.Conn) {
+	g := &mockGateway{retained: map[string][]byte{"a/b": []byte("kept")}}
+	l := NewCoAP("coap", "127.0.0.1:0", nil, g)
+	require.NoError(t, l.Init(logger))
+	go l.Serve(MockEstablisher)
+	t.Cleanup(func() {
+		l.Close(MockCloser)
+	})
+
+	conn, err := net.Dial("udp", l.Address())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	return l, g, conn
+}
+
+func coapRequest(typ, code byte, id uint16, path string, query ...string) *coapMessage {
+	m := &coapMessage{typ: typ, code: code, messageID: id, token: []byte{0x1, 0x2}}
+	for _, p := range splitPath(path) {
+		m.options = append(m.options, coapOption{number: coapOptionUriPath, value: []byte(p)})
+	}
+	for _, q := range query {
+		m.options = append(m.options, coapOption{number: coapOptionUriQuery, value: []byte(q)})
+	}
+	return m
+}
+
+func splitPath(path string) []string {
+	var v []string
+	start := 0
+	for i := 0; i <= len(path); i++ {
+		if i == len(path) || path[i] == '/' {
+			if i > start {
+				v = append(v, path[start:i])
+			}
+			start = i + 1
+		}
+	}
+	return v
+}
+
+func coapRoundTrip(t *testing.T, conn net.Conn, m *coapMessage) *coapMessage {
+	_, err := conn.Write(m.encode())
+	require.NoError(t, err)
+	return coapReceive(t, conn)
+}
+
+func coapReceive(t *testing.T, conn net.Conn) *coapMessage {
+	buf := make([]byte, 1500)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	res, err := decodeCoAP(buf[:n])
+	require.NoError(t, err)
+	return res
+}
+
+func TestCoAPEncodeDecode(t *testing.T) {
+	m := &coapMessage{
+		typ:       coapCON,
+		code:      coapPUT,
+		messageID: 0x1234,
+		token:     []byte{0xa, 0xb, 0xc},
+		options: []coapOption{
+			{number: coapOptionUriQuery, value: []byte("username=dev")},
+			{number: coapOptionUriPath, value: []byte("ps")},
+			{number: coapOptionUriPath, value: make([]byte, 300)},
+			{number: 2049, value: []byte{1}},
+		},
+		payload: []byte("hello"),
+	}
+
+	d, err := decodeCoAP(m.encode())
+	require.NoError(t, err)
+	require.Equal(t, m.typ, d.typ)
+	require.Equal(t, m.code, d.code)
+	require.Equal(t, m.messageID, d.messageID)
+	require.Equal(t, m.token, d.token)
+	require.Equal(t, m.payload, d.payload)
+	require.Len(t, d.options, 4)
+	require.Equal(t, coapOptionUriPath, d.options[0].number)
+	require.Len(t, d.option(coapOptionUriPath)[1], 300)
+	require.Equal(t, []byte("username=dev"), d.option(coapOptionUriQuery)[0])
+	require.Equal(t, uint16(2049), d.options[3].number)
+}
+
+func TestCoAPDecodeMalformed(t *testing.T) {
+	for _, b := range [][]byte{
+		{0x40, 0x01},             // too short
+		{0x80, 0x01, 0x00, 0x01}, // wrong version
+		{0x49, 0x01, 0x00, 0x01}, // token too long
+		{0x40, 0x01, 0x00, 0x01, 0xff},
+		{0x40, 0x01, 0x00, 0x01, 0xf1, 0x00},
+		{0x40, 0x01, 0x00, 0x01, 0xb5, 'p'},
+	} {
+		_, err := decodeCoAP(b)
+		require.ErrorIs(t, err, errCoAPMalformed)
+	}
+}
+
+func TestCoAPUintValue(t *testing.T) {
+	require.Empty(t, coapUintValue(0))
+	require.Equal(t, []byte{0x1, 0x0}, coapUintValue(256))
+	require.Equal(t, uint32(0xabcdef), coapUint(coapUintValue(0xabcdef)))
+}
+
+func TestCoAPErrorCode(t *testing.T) {
+	require.Equal(t, coapNotFound, coapErrorCode(ErrCoAPNotFound))
+	require.Equal(t, coapUnauthorized, coapErrorCode(packets.ErrBadUsernameOrPassword))
+	require.Equal(t, coapForbidden, coapErrorCode(packets.ErrNotAuthorized))
+	require.Equal(t, coapForbidden, coapErrorCode(packets.ErrBanned))
+	require.Equal(t, coapForbidden, coapErrorCode(packets.ErrClientIdentifierNotOwned))
+	require.Equal(t, coapTooMany, coapErrorCode(packets.ErrQuotaExceeded))
+	require.Equal(t, coapUnavailable, coapErrorCode(packets.ErrServerUnavailable))
+	require.Equal(t, coapBadRequest, coapErrorCode(packets.ErrTopicNameInvalid))
+	require.Equal(t, coapInternalError, coapErrorCode(packets.ErrServerBusy))
+}
+
+func TestNewCoAP(t *testing.T) {
+	l := NewCoAP("coap", testAddr, nil, nil)
+	require.Equal(t, "coap", l.ID())
+	require.Equal(t, testAddr, l.Address())
+	require.Equal(t, "coap", l.Protocol())
+	require.NotNil(t, l.Config())
+}
+
+func TestCoAPInitInvalidFamily(t *testing.T) {
+	l := NewCoAP("coap", "127.0.0.1:0", &Config{Family: "ipx"}, nil)
+	require.ErrorIs(t, l.Init(logger), ErrInvalidFamily)
+}
+
+func TestCoAPPublish(t *testing.T) {
+	_, g, conn := newCoAPTest(t)
+
+	m := coapRequest(coapCON, coapPUT, 1, "ps/a/b", "username=dev", "qos=1", "retain")
+	m.payload = []byte("21.5")
+	res := coapRoundTrip(t, conn, m)
+	require.Equal(t, coapACK, res.typ)
+	require.Equal(t, coapChanged, res.code)
+	require.Equal(t, uint16(1), res.messageID)
+	require.Equal(t, m.token, res.token)
+
+	res = coapRoundTrip(t, conn, m) // a retransmission is answered without publishing again
+	require.Equal(t, coapChanged, res.code)
+
+	g.Lock()
+	require.Len(t, g.published, 1)
+	req := g.published[0]
+	g.Unlock()
+	require.Equal(t, "coap", req.Listener)
+	require.Equal(t, "a/b", req.Topic)
+	require.Equal(t, []byte("21.5"), req.Payload)
+	require.Equal(t, byte(1), req.Qos)
+	require.True(t, req.Retain)
+}
+
+func TestCoAPPublishErrors(t *testing.T) {
+	_, _, conn := newCoAPTest(t)
+
+	res := coapRoundTrip(t, conn, coapRequest(coapNON, coapPOST, 1, "ps/a/b"))
+	require.Equal(t, coapNON, res.typ)
+	require.Equal(t, coapUnauthorized, res.code)
+
+	res = coapRoundTrip(t, conn, coapRequest(coapCON, coapPOST, 2, "ps/a/b", "qos=3"))
+	require.Equal(t, coapBadRequest, res.code)
+
+	res = coapRoundTrip(t, conn, coapRequest(coapCON, coapPOST, 3, "other/a/b"))
+	require.Equal(t, coapNotFound, res.code)
+
+	m := coapRequest(coapCON, coapPOST, 4, "ps/a/b")
+	m.options = append(m.options, coapOption{number: 9, value: []byte{1}})
+	res = coapRoundTrip(t, conn, m)
+	require.Equal(t, coapBadOption, res.code)
+}
+
+func TestCoAPDelete(t *testing.T) {
+	_, g, conn := newCoAPTest(t)
+
+	res := coapRoundTrip(t, conn, coapRequest(coapCON, coapDELETE, 1, "ps/a/b", "username=dev"))
+	require.Equal(t, coapDeleted, res.code)
+
+	g.Lock()
+	defer g.Unlock()
+	require.Len(t, g.published, 1)
+	require.True(t, g.published[0].Retain)
+	require.Empty(t, g.published[0].Payload)
+}
+
+func TestCoAPRead(t *testing.T) {
+	_, _, conn := newCoAPTest(t)
+
+	res := coapRoundTrip(t, conn, coapRequest(coapCON, coapGET, 1, "ps/a/b"))
+	require.Equal(t, coapContent, res.code)
+	require.Equal(t, []byte("kept"), res.payload)
+
+	res = coapRoundTrip(t, conn, coapRequest(coapCON, coapGET, 2, "ps/a/c"))
+	require.Equal(t, coapNotFound, res.code)
+
+	res = coapRoundTrip(t, conn, coapRequest(coapCON, coapGET, 3, "ps/secret"))
+	require.Equal(t, coapForbidden, res.code)
+}
+
+func TestCoAPDiscovery(t *testing.T) {
+	_, _, conn := newCoAPTest(t)
+
+	res := coapRoundTrip(t, conn, coapRequest(coapCON, coapGET, 1, ".well-known/core"))
+	require.Equal(t, coapContent, res.code)
+	require.Contains(t, string(res.payload), "</ps>")
+}
+
+func TestCoAPPing(t *testing.T) {
+	_, _, conn := newCoAPTest(t)
+
+	res := coapRoundTrip(t, conn, &coapMessage{typ: coapCON, messageID: 7})
+	require.Equal(t, coapRST, res.typ)
+	require.Equal(t, uint16(7), res.messageID)
+}
+
+func TestCoAPObserve(t *testing.T) {
+	l, g, conn := newCoAPTest(t)
+
+	m := coapRequest(coapCON, coapGET, 1, "ps/a/+")
+	m.options = append(m.options, coapOption{number: coapOptionObserve})
+	res := coapRoundTrip(t, conn, m)
+	require.Equal(t, coapContent, res.code)
+	require.Equal(t, 1, res.observe())
+	require.Equal(t, 1, l.Observations())
+
+	g.Lock()
+	notify := g.notify
+	g.Unlock()
+	notify([]byte("22.0"))
+
+	n := coapReceive(t, conn)
+	require.Equal(t, coapNON, n.typ)
+	require.Equal(t, coapContent, n.code)
+	require.Equal(t, m.token, n.token)
+	require.Equal(t, 2, n.observe())
+	require.Equal(t, []byte("22.0"), n.payload)
+
+	// a reset of the notification cancels the observation
+	_, err := conn.Write((&coapMessage{typ: coapRST, messageID: n.messageID}).encode())
+	require.NoError(t, err)
+	require.Eventually(t, g.isCancelled, time.Second, time.Millisecond*10)
+	require.Equal(t, 0, l.Observations())
+}
+
+func TestCoAPObserveDeregister(t *testing.T) {
+	l, g, conn := newCoAPTest(t)
+
+	m := coapRequest(coapCON, coapGET, 1, "ps/a/b")
+	m.options = append(m.options, coapOption{number: coapOptionObserve})
+	coapRoundTrip(t, conn, m)
+	require.Equal(t, 1, l.Observations())
+
+	m = coapRequest(coapCON, coapGET, 2, "ps/a/b")
+	m.options = append(m.options, coapOption{number: coapOptionObserve, value: coapUintValue(coapObserveDeregister)})
+	res := coapRoundTrip(t, conn, m)
+	require.Equal(t, coapContent, res.code)
+	require.Equal(t, []byte("kept"), res.payload)
+	require.True(t, g.isCancelled())
+	require.Equal(t, 0, l.Observations())
+}
+
+func TestCoAPCloseCancelsObservations(t *testing.T) {
+	l, g, conn := newCoAPTest(t)
+
+	m := coapRequest(coapCON, coapGET, 1, "ps/a/b")
+	m.options = append(m.options, coapOption{number: coapOptionObserve})
+	coapRoundTrip(t, conn, m)
+
+	var closed string
+	l.Close(func(id string) {
+		closed = id
+	})
+	require.Equal(t, "coap", closed)
+	require.True(t, g.isCancelled())
+	require.Equal(t, 0, l.Observations())
+}
@@ -0,0 +1,64 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package listeners
+
+import (
+	"errors"
+	"net"
+)
+
+const (
+	FamilyIPv4 = "ipv4" // the ipv4 address family
+	FamilyIPv6 = "ipv6" // the ipv6 address family
+)
+
+// ErrInvalidFamily indicates a listener was configured with an unknown address family.
+var ErrInvalidFamily = errors.New("listener family must be ipv4, ipv6 or empty")
+
+// Network returns the network of the address family of the config for a base network
+// such as tcp or udp, e.g. tcp6 for ipv6. The base network, which listens on both
+// families where the address allows it, is returned if the config has no family.
+func (c *Config) Network(base string) (string, error) {
+	switch c.Family {
+	case "":
+		return base, nil
+	case FamilyIPv4:
+		return base + "4", nil
+	case FamilyIPv6:
+		return base + "6", nil
+	default:
+		return "", ErrInvalidFamily
+	}
+}
+
+// AddrFamily returns the address family of an address, ipv4 or ipv6, or an empty string
+// if it is not an ip address. IPv4 addresses mapped to ipv6 are ipv4.
+func AddrFamily(addr net.Addr) string {
+	var ip net.IP
+	switch a := addr.(type) {
+	case nil:
+		return ""
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.IPAddr:
+		ip = a.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return ""
+		}
+		ip = net.ParseIP(host)
+	}
+
+	if ip == nil {
+		return ""
+	} else if ip.To4() != nil {
+		return FamilyIPv4
+	}
+
+	return FamilyIPv6
+}
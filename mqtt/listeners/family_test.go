@@ -0,0 +1,53 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package listeners
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigNetwork(t *testing.T) {
+	tt := []struct {
+		family  string
+		network string
+		err     error
+	}{
+		{family: "", network: "tcp"},
+		{family: FamilyIPv4, network: "tcp4"},
+		{family: FamilyIPv6, network: "tcp6"},
+		{family: "ipx", err: ErrInvalidFamily},
+	}
+
+	for _, tx := range tt {
+		network, err := (&Config{Family: tx.family}).Network("tcp")
+		require.ErrorIs(t, err, tx.err, tx.family)
+		require.Equal(t, tx.network, network, tx.family)
+	}
+}
+
+func TestAddrFamily(t *testing.T) {
+	require.Equal(t, FamilyIPv4, AddrFamily(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1883}))
+	require.Equal(t, FamilyIPv4, AddrFamily(&net.TCPAddr{IP: net.ParseIP("::ffff:10.0.0.1"), Port: 1883}))
+	require.Equal(t, FamilyIPv6, AddrFamily(&net.TCPAddr{IP: net.ParseIP("::1"), Port: 1883}))
+	require.Equal(t, FamilyIPv6, AddrFamily(&net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 14567}))
+	require.Equal(t, FamilyIPv6, AddrFamily(&net.IPAddr{IP: net.ParseIP("2001:db8::1")}))
+	require.Equal(t, "", AddrFamily(&net.UnixAddr{Name: "/tmp/mqtt.sock", Net: "unix"}))
+	require.Equal(t, "", AddrFamily(nil))
+}
+
+func TestTCPInitFamily(t *testing.T) {
+	l := NewTCP("t1", "127.0.0.1:0", &Config{Family: FamilyIPv6})
+	require.Error(t, l.Init(logger))
+
+	l = NewTCP("t1", "127.0.0.1:0", &Config{Family: "ipx"})
+	require.ErrorIs(t, l.Init(logger), ErrInvalidFamily)
+
+	l = NewTCP("t1", "127.0.0.1:0", &Config{Family: FamilyIPv4})
+	require.NoError(t, l.Init(logger))
+	l.Close(MockCloser)
+}
@@ -0,0 +1,157 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package listeners
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// DefaultHTTPAuthPublic are the paths served without credentials when HTTPAuth.Public is
+// unset: the health probes, and certificate enrollment and the event streams, which
+// authenticate clients themselves.
+var DefaultHTTPAuthPublic = []string{"/livez", "/readyz", "/startupz", "/.well-known/est/", "/api/v1/mqtt/events", "/api/v1/mqtt/events/token"}
+
+// DefaultHTTPAuthAdmin are the paths which only admin credentials may read when HTTPAuth.Admin
+// is unset: the packet captures, broker snapshots, session and retained message exports, which
+// hold the payloads and credentials of clients.
+var DefaultHTTPAuthAdmin = []string{"/api/v1/mqtt/capture/file", "/api/v1/mqtt/snapshot", "/api/v1/mqtt/clients/*/session", "/api/v1/mqtt/retained/export"}
+
+// HTTPAuth requires the requests of an http listener to carry a bearer token or basic auth
+// credentials. Read-only credentials may only make GET and HEAD requests, while admin
+// credentials may make any request. Only admin credentials may read the admin paths.
+type HTTPAuth struct {
+	// ReadTokens and AdminTokens are the bearer tokens of read-only and admin clients.
+	ReadTokens  []string `yaml:"read-tokens" json:"-"`
+	AdminTokens []string `yaml:"admin-tokens" json:"-"`
+
+	// ReadUsers and AdminUsers are the basic auth passwords of read-only and admin clients,
+	// keyed on username.
+	ReadUsers  map[string]string `yaml:"read-users" json:"-"`
+	AdminUsers map[string]string `yaml:"admin-users" json:"-"`
+
+	// Public are the paths served without credentials, matching paths with the prefix if
+	// ending in a slash. DefaultHTTPAuthPublic is used when nil.
+	Public []string `yaml:"public" json:"public"`
+
+	// Admin are the paths which read-only credentials may not read, matching as Public does,
+	// with * matching a single level. DefaultHTTPAuthAdmin is used when nil.
+	Admin []string `yaml:"admin" json:"admin"`
+}
+
+// httpAccess is the access granted to the credentials of a request.
+type httpAccess int
+
+const (
+	httpAccessNone httpAccess = iota
+	httpAccessRead
+	httpAccessAdmin
+)
+
+// Wrap returns a handler which serves the requests allowed by the auth with next,
+// responding 401 to requests without valid credentials and 403 to requests which
+// the credentials may not make. Next is returned if the auth is nil.
+func (a *HTTPAuth) Wrap(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.public(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		switch a.access(r) {
+		case httpAccessNone:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="comqtt"`)
+			w.Header().Add("WWW-Authenticate", `Basic realm="comqtt"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		case httpAccessRead:
+			if r.Method != http.MethodGet && r.Method != http.MethodHead || a.admin(r.URL.Path) {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// public returns true if a path is served without credentials.
+func (a *HTTPAuth) public(p string) bool {
+	if a.Public == nil {
+		return matchPaths(DefaultHTTPAuthPublic, p)
+	}
+	return matchPaths(a.Public, p)
+}
+
+// admin returns true if a path may only be read with admin credentials.
+func (a *HTTPAuth) admin(p string) bool {
+	if a.Admin == nil {
+		return matchPaths(DefaultHTTPAuthAdmin, p)
+	}
+	return matchPaths(a.Admin, p)
+}
+
+// matchPaths returns true if a path is one of the paths, has one of the paths ending in a
+// slash as a prefix, or matches one of the paths with * matching a single level.
+func matchPaths(paths []string, p string) bool {
+	for _, m := range paths {
+		if p == m || strings.HasSuffix(m, "/") && strings.HasPrefix(p, m) {
+			return true
+		}
+		if ok, _ := path.Match(m, p); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// access returns the access granted to the bearer token or basic auth credentials of
+// a request.
+func (a *HTTPAuth) access(r *http.Request) httpAccess {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		switch {
+		case matchSecret(a.AdminTokens, token):
+			return httpAccessAdmin
+		case matchSecret(a.ReadTokens, token):
+			return httpAccessRead
+		}
+		return httpAccessNone
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return httpAccessNone
+	}
+
+	if p, ok := a.AdminUsers[username]; ok && matchSecret([]string{p}, password) {
+		return httpAccessAdmin
+	}
+
+	if p, ok := a.ReadUsers[username]; ok && matchSecret([]string{p}, password) {
+		return httpAccessRead
+	}
+
+	return httpAccessNone
+}
+
+// matchSecret returns true if a secret is one of the non-empty secrets, comparing in
+// constant time.
+func matchSecret(secrets []string, secret string) bool {
+	matched := false
+	for _, s := range secrets {
+		if s != "" && subtle.ConstantTimeCompare([]byte(s), []byte(secret)) == 1 {
+			matched = true
+		}
+	}
+
+	return matched
+}
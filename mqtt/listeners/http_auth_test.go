@@ -0,0 +1,136 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package listeners
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testHTTPAuth = &HTTPAuth{
+	ReadTokens:  []string{"read-token"},
+	AdminTokens: []string{"admin-token"},
+	ReadUsers:   map[string]string{"viewer": "view-pass"},
+	AdminUsers:  map[string]string{"admin": "admin-pass"},
+}
+
+func serveHTTPAuth(a *HTTPAuth, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	a.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})).ServeHTTP(w, r)
+	return w
+}
+
+func TestHTTPAuthNil(t *testing.T) {
+	var a *HTTPAuth
+	w := serveHTTPAuth(a, httptest.NewRequest(http.MethodPost, "/api/v1/mqtt/message", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestHTTPAuthBearer(t *testing.T) {
+	tt := []struct {
+		token  string
+		method string
+		code   int
+	}{
+		{"", http.MethodGet, http.StatusUnauthorized},
+		{"wrong", http.MethodGet, http.StatusUnauthorized},
+		{"read-token", http.MethodGet, http.StatusOK},
+		{"read-token", http.MethodHead, http.StatusOK},
+		{"read-token", http.MethodPost, http.StatusForbidden},
+		{"read-token", http.MethodDelete, http.StatusForbidden},
+		{"admin-token", http.MethodGet, http.StatusOK},
+		{"admin-token", http.MethodPut, http.StatusOK},
+	}
+
+	for _, tx := range tt {
+		r := httptest.NewRequest(tx.method, "/api/v1/mqtt/config", nil)
+		if tx.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tx.token)
+		}
+		w := serveHTTPAuth(testHTTPAuth, r)
+		require.Equal(t, tx.code, w.Code, tx.token+" "+tx.method)
+	}
+}
+
+func TestHTTPAuthUnauthorizedChallenge(t *testing.T) {
+	w := serveHTTPAuth(testHTTPAuth, httptest.NewRequest(http.MethodGet, "/api/v1/mqtt/config", nil))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.Equal(t, []string{`Bearer realm="comqtt"`, `Basic realm="comqtt"`}, w.Header().Values("WWW-Authenticate"))
+}
+
+func TestHTTPAuthBasic(t *testing.T) {
+	tt := []struct {
+		username string
+		password string
+		method   string
+		code     int
+	}{
+		{"viewer", "view-pass", http.MethodGet, http.StatusOK},
+		{"viewer", "view-pass", http.MethodPost, http.StatusForbidden},
+		{"viewer", "wrong", http.MethodGet, http.StatusUnauthorized},
+		{"admin", "admin-pass", http.MethodPost, http.StatusOK},
+		{"admin", "view-pass", http.MethodGet, http.StatusUnauthorized},
+		{"nobody", "", http.MethodGet, http.StatusUnauthorized},
+	}
+
+	for _, tx := range tt {
+		r := httptest.NewRequest(tx.method, "/api/v1/mqtt/config", nil)
+		r.SetBasicAuth(tx.username, tx.password)
+		w := serveHTTPAuth(testHTTPAuth, r)
+		require.Equal(t, tx.code, w.Code, tx.username+" "+tx.method)
+	}
+}
+
+func TestHTTPAuthEmptySecrets(t *testing.T) {
+	a := &HTTPAuth{ReadTokens: []string{""}, AdminUsers: map[string]string{"admin": ""}}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/mqtt/config", nil)
+	r.Header.Set("Authorization", "Bearer ")
+	require.Equal(t, http.StatusUnauthorized, serveHTTPAuth(a, r).Code)
+
+	r = httptest.NewRequest(http.MethodGet, "/api/v1/mqtt/config", nil)
+	r.SetBasicAuth("admin", "")
+	require.Equal(t, http.StatusUnauthorized, serveHTTPAuth(a, r).Code)
+}
+
+func TestHTTPAuthPublic(t *testing.T) {
+	for _, path := range []string{"/livez", "/readyz", "/startupz", "/.well-known/est/simpleenroll", "/api/v1/mqtt/events?filter=a/%23", "/api/v1/mqtt/events/token"} {
+		w := serveHTTPAuth(testHTTPAuth, httptest.NewRequest(http.MethodPost, path, nil))
+		require.Equal(t, http.StatusOK, w.Code, path)
+	}
+
+	w := serveHTTPAuth(testHTTPAuth, httptest.NewRequest(http.MethodGet, "/livez/other", nil))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+
+	a := &HTTPAuth{AdminTokens: []string{"admin-token"}, Public: []string{"/mqtt/"}}
+	require.Equal(t, http.StatusOK, serveHTTPAuth(a, httptest.NewRequest(http.MethodGet, "/mqtt/stats", nil)).Code)
+	require.Equal(t, http.StatusUnauthorized, serveHTTPAuth(a, httptest.NewRequest(http.MethodGet, "/livez", nil)).Code)
+}
+
+func TestHTTPAuthAdminPaths(t *testing.T) {
+	for _, path := range []string{"/api/v1/mqtt/capture/file", "/api/v1/mqtt/snapshot", "/api/v1/mqtt/clients/cl1/session", "/api/v1/mqtt/retained/export?filter=a/%23"} {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("Authorization", "Bearer read-token")
+		require.Equal(t, http.StatusForbidden, serveHTTPAuth(testHTTPAuth, r).Code, path)
+
+		r = httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("Authorization", "Bearer admin-token")
+		require.Equal(t, http.StatusOK, serveHTTPAuth(testHTTPAuth, r).Code, path)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/mqtt/clients/cl1", nil)
+	r.Header.Set("Authorization", "Bearer read-token")
+	require.Equal(t, http.StatusOK, serveHTTPAuth(testHTTPAuth, r).Code)
+
+	a := &HTTPAuth{ReadTokens: []string{"read-token"}, Admin: []string{}}
+	r = httptest.NewRequest(http.MethodGet, "/api/v1/mqtt/snapshot", nil)
+	r.Header.Set("Authorization", "Bearer read-token")
+	require.Equal(t, http.StatusOK, serveHTTPAuth(a, r).Code)
+}
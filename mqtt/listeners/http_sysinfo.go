@@ -66,6 +66,11 @@ func (l *HTTPStats) Address() string {
 	return l.address
 }
 
+// Config returns the config of the listener.
+func (l *HTTPStats) Config() *Config {
+	return l.config
+}
+
 // Protocol returns the address of the listener.
 func (l *HTTPStats) Protocol() string {
 	if l.listen != nil && l.listen.TLSConfig != nil {
@@ -86,11 +91,18 @@ func (l *HTTPStats) Init(_ *slog.Logger) error {
 		mux.HandleFunc("/", l.jsonHandler)
 	}
 
+	handler := l.config.HTTPAuth.Wrap(mux)
 	l.listen = &http.Server{
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 5 * time.Second,
 		Addr:         l.address,
-		Handler:      mux,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !l.config.IPFilter.Allowed(r.RemoteAddr) {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			handler.ServeHTTP(w, r)
+		}),
 	}
 
 	if l.config.TLSConfig != nil {
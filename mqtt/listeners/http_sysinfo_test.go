@@ -125,3 +125,34 @@ func TestHTTPStatsServeTLSAndClose(t *testing.T) {
 	time.Sleep(time.Millisecond)
 	l.Close(MockCloser)
 }
+
+func TestHTTPStatsIPFilter(t *testing.T) {
+	filter := new(IPFilter)
+	require.NoError(t, filter.Set(IPRules{Deny: []string{"127.0.0.0/8", "::1"}}))
+
+	l := NewHTTPStats("t1", testAddr, &Config{IPFilter: filter}, &system.Info{Version: "test"})
+	err := l.Init(logger)
+	require.NoError(t, err)
+
+	o := make(chan bool)
+	go func(o chan bool) {
+		l.Serve(MockEstablisher)
+		o <- true
+	}(o)
+
+	time.Sleep(time.Millisecond)
+
+	resp, err := http.Get("http://localhost" + testAddr + "/mqtt/stats")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	require.NoError(t, filter.Set(IPRules{}))
+	resp, err = http.Get("http://localhost" + testAddr + "/mqtt/stats")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	l.Close(MockCloser)
+	<-o
+}
@@ -0,0 +1,137 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package listeners
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ErrInvalidIPRule indicates an ip filter rule is not an ip address or cidr.
+var ErrInvalidIPRule = errors.New("ip filter rules must be ip addresses or cidrs")
+
+// IPRules are the cidrs or ip addresses from which the connections of a listener are
+// allowed or denied.
+type IPRules struct {
+	// Allow are the cidrs connections are allowed from, such as 10.0.0.0/8. Connections
+	// from any ip are allowed when empty.
+	Allow []string `yaml:"allow" json:"allow"`
+
+	// Deny are the cidrs connections are denied from, taking precedence over Allow.
+	Deny []string `yaml:"deny" json:"deny"`
+}
+
+// IPFilter allows or denies the connections of a listener by their source ip, e.g. so
+// that an internal listener only accepts connections from within a vpc. The rules may
+// be replaced while the listener is serving.
+type IPFilter struct {
+	IPRules `yaml:",inline"` // the configured rules, compiled by Compile
+	mu      sync.RWMutex
+	allow   []netip.Prefix
+	deny    []netip.Prefix
+}
+
+// Compile compiles the configured rules of the filter.
+func (f *IPFilter) Compile() error {
+	f.mu.RLock()
+	rules := f.IPRules
+	f.mu.RUnlock()
+	return f.Set(rules)
+}
+
+// Set replaces the rules of the filter.
+func (f *IPFilter) Set(rules IPRules) error {
+	allow, err := parseIPRules(rules.Allow)
+	if err != nil {
+		return err
+	}
+
+	deny, err := parseIPRules(rules.Deny)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.IPRules = IPRules{Allow: slices.Clone(rules.Allow), Deny: slices.Clone(rules.Deny)}
+	f.allow, f.deny = allow, deny
+	return nil
+}
+
+// Rules returns a copy of the rules of the filter, with empty rather than nil lists.
+func (f *IPFilter) Rules() IPRules {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return IPRules{Allow: append([]string{}, f.Allow...), Deny: append([]string{}, f.Deny...)}
+}
+
+// Allowed returns true if a connection from a remote address, with or without a port,
+// is allowed. Remote addresses which are not ips, such as those of unix sockets, are
+// always allowed.
+func (f *IPFilter) Allowed(remote string) bool {
+	if f == nil {
+		return true
+	}
+
+	host := remote
+	if h, _, err := net.SplitHostPort(remote); err == nil {
+		host = h
+	}
+
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return true
+	}
+	ip = ip.Unmap()
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, p := range f.deny {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(f.allow) == 0 {
+		return true
+	}
+
+	for _, p := range f.allow {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseIPRules parses cidrs and ip addresses as prefixes.
+func parseIPRules(rules []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(rules))
+	for _, rule := range rules {
+		rule = strings.TrimSpace(rule)
+		if strings.Contains(rule, "/") {
+			p, err := netip.ParsePrefix(rule)
+			if err != nil {
+				return nil, ErrInvalidIPRule
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+
+		ip, err := netip.ParseAddr(rule)
+		if err != nil {
+			return nil, ErrInvalidIPRule
+		}
+		ip = ip.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+	}
+
+	return prefixes, nil
+}
@@ -0,0 +1,63 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package listeners
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPFilterAllowed(t *testing.T) {
+	f := new(IPFilter)
+	require.NoError(t, f.Set(IPRules{
+		Allow: []string{"10.0.0.0/8", "192.168.1.10", "fd00::/8"},
+		Deny:  []string{"10.0.5.0/24"},
+	}))
+
+	require.True(t, f.Allowed("10.1.2.3:1883"))
+	require.True(t, f.Allowed("10.1.2.3"))
+	require.True(t, f.Allowed("192.168.1.10:5000"))
+	require.True(t, f.Allowed("[fd00::1]:1883"))
+	require.True(t, f.Allowed("[::ffff:10.1.2.3]:1883"))
+	require.False(t, f.Allowed("10.0.5.1:1883"))
+	require.False(t, f.Allowed("192.168.1.11:5000"))
+	require.False(t, f.Allowed("[2001:db8::1]:1883"))
+	require.True(t, f.Allowed("pipe"))
+}
+
+func TestIPFilterDenyOnly(t *testing.T) {
+	f := new(IPFilter)
+	require.True(t, f.Allowed("10.0.0.1:1883"))
+
+	require.NoError(t, f.Set(IPRules{Deny: []string{"10.0.0.1"}}))
+	require.False(t, f.Allowed("10.0.0.1:1883"))
+	require.True(t, f.Allowed("10.0.0.2:1883"))
+
+	require.NoError(t, f.Set(IPRules{}))
+	require.True(t, f.Allowed("10.0.0.1:1883"))
+}
+
+func TestIPFilterNil(t *testing.T) {
+	var f *IPFilter
+	require.True(t, f.Allowed("10.0.0.1:1883"))
+}
+
+func TestIPFilterCompile(t *testing.T) {
+	f := &IPFilter{IPRules: IPRules{Allow: []string{"10.0.0.0/8"}}}
+	require.True(t, f.Allowed("192.168.0.1:1883"))
+	require.NoError(t, f.Compile())
+	require.False(t, f.Allowed("192.168.0.1:1883"))
+	require.Equal(t, IPRules{Allow: []string{"10.0.0.0/8"}, Deny: []string{}}, f.Rules())
+}
+
+func TestIPFilterInvalidRule(t *testing.T) {
+	f := new(IPFilter)
+	require.NoError(t, f.Set(IPRules{Allow: []string{"10.0.0.0/8"}}))
+
+	require.ErrorIs(t, f.Set(IPRules{Allow: []string{"10.0.0.0/33"}}), ErrInvalidIPRule)
+	require.ErrorIs(t, f.Set(IPRules{Deny: []string{"example.com"}}), ErrInvalidIPRule)
+	require.Equal(t, []string{"10.0.0.0/8"}, f.Rules().Allow)
+}
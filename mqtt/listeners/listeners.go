@@ -7,6 +7,7 @@ package listeners
 import (
 	"crypto/tls"
 	"net"
+	"slices"
 	"sync"
 
 	"log/slog"
@@ -17,6 +18,60 @@ type Config struct {
 	// TLSConfig is a tls.Config configuration to be used with the listener.
 	// See examples folder for basic and mutual-tls use.
 	TLSConfig *tls.Config
+
+	// ProxyProtocol indicates connections begin with a PROXY protocol v1 or v2 header,
+	// as sent by load balancers such as HAProxy and AWS NLB, so that clients are seen
+	// with their original address. Connections without a header are refused.
+	ProxyProtocol bool
+
+	// Family binds the listener to the ipv4 or ipv6 address family only, so that each
+	// family of a dual-stack host can be served on separate addresses. The listener binds
+	// to both families where the address allows it when empty.
+	Family string
+
+	// Acceptors opens a tcp listener on that many sockets bound to the same address with
+	// SO_REUSEPORT, each with its own accept loop, so that the kernel spreads new
+	// connections across them rather than a single accept loop becoming the bottleneck.
+	// A single socket is used when 0 or 1. Only supported on linux and the bsds.
+	Acceptors int
+
+	// Socket tunes the keepalive, buffers, nodelay and linger of the connections accepted
+	// by a tcp listener. The defaults of the operating system and go are kept when nil.
+	Socket *SocketConfig
+
+	// Websocket configures the path, origin checks and compression of websocket listeners.
+	// Websocket listeners serve all paths and origins without compression when nil.
+	Websocket *WebsocketConfig
+
+	// IPFilter allows or denies the connections of the listener by their source ip.
+	// Connections from any ip are allowed when nil.
+	IPFilter *IPFilter
+
+	// HTTPAuth requires the http api requests of an http or mux listener to carry read-only
+	// or admin credentials. Requests are served without credentials when nil.
+	HTTPAuth *HTTPAuth
+
+	// Auth selects how the clients of the listener are authenticated and acl checked.
+	// Clients are checked by all auth hooks when nil.
+	Auth *AuthPolicy
+}
+
+// AuthPolicy selects how the clients of a listener are authenticated and acl checked, e.g.
+// so that clients of an internal listener are anonymous while a public listener requires
+// credentials.
+type AuthPolicy struct {
+	// Anonymous allows the clients of the listener to connect, publish and subscribe
+	// without being checked by any auth hook.
+	Anonymous bool `yaml:"anonymous" json:"anonymous"`
+
+	// Hooks are the ids of the hooks which authenticate and acl check the clients of the
+	// listener, such as auth-redis. All hooks are used when empty.
+	Hooks []string `yaml:"hooks" json:"hooks"`
+}
+
+// Configurable is implemented by listeners which expose the config they were created with.
+type Configurable interface {
+	Config() *Config
 }
 
 // EstablishFn is a callback function for establishing new clients.
@@ -40,6 +95,7 @@ type Listener interface {
 type Listeners struct {
 	wg       sync.WaitGroup      // a waitgroup that waits for all listeners to finish.
 	internal map[string]Listener // a map of active listeners.
+	serving  map[string]bool     // the listeners which have been started and have not stopped serving.
 	sync.RWMutex
 }
 
@@ -81,17 +137,42 @@ func (l *Listeners) Delete(id string) {
 
 // Serve starts a listener serving from the internal map.
 func (l *Listeners) Serve(id string, establisher EstablishFn) {
-	l.RLock()
-	defer l.RUnlock()
+	l.Lock()
+	defer l.Unlock()
 	listener := l.internal[id]
+	if l.serving == nil {
+		l.serving = map[string]bool{}
+	}
+	l.serving[id] = true
 
 	go func(e EstablishFn) {
 		defer l.wg.Done()
 		l.wg.Add(1)
 		listener.Serve(e)
+
+		l.Lock()
+		delete(l.serving, id)
+		l.Unlock()
 	}(establisher)
 }
 
+// NotServing returns the sorted ids of the listeners in the internal map which are not
+// serving, having not been started or having stopped accepting connections.
+func (l *Listeners) NotServing() []string {
+	l.RLock()
+	defer l.RUnlock()
+
+	var ids []string
+	for id := range l.internal {
+		if !l.serving[id] {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+
+	return ids
+}
+
 // ServeAll starts all listeners serving from the internal map.
 func (l *Listeners) ServeAll(establisher EstablishFn) {
 	l.RLock()
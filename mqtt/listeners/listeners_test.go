@@ -141,6 +141,21 @@ func TestServeAllListeners(t *testing.T) {
 	require.False(t, l.internal["t3"].(*MockListener).IsServing())
 }
 
+func TestNotServing(t *testing.T) {
+	l := New()
+	l.Add(NewMockListener("t2", testAddr))
+	l.Add(NewMockListener("t1", testAddr))
+	require.Equal(t, []string{"t1", "t2"}, l.NotServing())
+
+	l.Serve("t1", MockEstablisher)
+	require.Equal(t, []string{"t2"}, l.NotServing())
+
+	l.Close("t1", MockCloser)
+	require.Eventually(t, func() bool {
+		return len(l.NotServing()) == 2
+	}, time.Second, time.Millisecond)
+}
+
 func TestCloseListener(t *testing.T) {
 	l := New()
 	mocked := NewMockListener("t1", testAddr)
@@ -0,0 +1,323 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package listeners
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"log/slog"
+
+	"github.com/gorilla/websocket"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+const (
+	ALPNMQTT = "mqtt"     // the alpn protocol of mqtt over tls
+	ALPNHTTP = "http/1.1" // the alpn protocol of https and mqtt over wss
+
+	muxHandshakeTimeout = 10 * time.Second // the time allowed for the tls handshake and first byte of a connection
+)
+
+// Mux is a listener serving mqtt, mqtt over websockets and the http api on a single port,
+// such as 443 behind firewalls which allow nothing else. Connections are routed by the
+// alpn protocol negotiated during the tls handshake, or by sniffing their first byte if
+// none was negotiated: mqtt connections begin with a CONNECT packet, while anything else
+// is served as http, upgrading websocket requests to mqtt over websockets.
+type Mux struct {
+	sync.RWMutex
+	id        string             // the internal id of the listener
+	address   string             // the network address to bind to
+	config    *Config            // configuration values for the listener
+	handlers  map[string]Handler // the http handlers, keyed on pattern
+	listen    net.Listener       // a net.Listener which will listen for new connections
+	tlsConfig *tls.Config        // the tls config of the listener, offering the mqtt and http alpn protocols
+	http      *http.Server       // serves the http connections
+	queue     *connQueue         // the http connections waiting to be served
+	ws        *Websocket         // upgrades websocket requests to mqtt over websockets
+	log       *slog.Logger       // server logger
+	end       uint32             // ensure the close methods are only called once
+}
+
+// NewMux initialises and returns a new Mux listener, listening on an address and serving
+// http requests other than websocket upgrades with the handlers.
+func NewMux(id, address string, config *Config, handlers map[string]Handler) *Mux {
+	if config == nil {
+		config = new(Config)
+	}
+
+	return &Mux{
+		id:       id,
+		address:  address,
+		config:   config,
+		handlers: handlers,
+	}
+}
+
+// ID returns the id of the listener.
+func (l *Mux) ID() string {
+	return l.id
+}
+
+// Address returns the address of the listener.
+func (l *Mux) Address() string {
+	if l.listen != nil {
+		return l.listen.Addr().String()
+	}
+	return l.address
+}
+
+// Config returns the config of the listener.
+func (l *Mux) Config() *Config {
+	return l.config
+}
+
+// Protocol returns the protocol of the listener.
+func (l *Mux) Protocol() string {
+	if l.config.TLSConfig != nil {
+		return "tls-mux"
+	}
+
+	return "mux"
+}
+
+// Init initializes the listener.
+func (l *Mux) Init(log *slog.Logger) error {
+	l.log = log
+
+	network, err := l.config.Network("tcp")
+	if err != nil {
+		return err
+	}
+
+	l.ws = NewWebsocket(l.id, l.address, l.config)
+	if err := l.ws.Init(log); err != nil {
+		return err
+	}
+
+	if l.config.TLSConfig != nil {
+		l.tlsConfig = l.config.TLSConfig.Clone()
+		for _, proto := range []string{ALPNMQTT, ALPNHTTP} {
+			if !slices.Contains(l.tlsConfig.NextProtos, proto) {
+				l.tlsConfig.NextProtos = append(l.tlsConfig.NextProtos, proto)
+			}
+		}
+	}
+
+	mux := http.NewServeMux()
+	for pattern, handler := range l.handlers {
+		mux.HandleFunc(pattern, handler)
+	}
+	api := l.config.HTTPAuth.Wrap(mux)
+
+	l.http = &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if l.isWebsocket(r) {
+				l.ws.handler(w, r)
+				return
+			}
+			api.ServeHTTP(w, r)
+		}),
+		ReadTimeout:  60 * time.Second,
+		WriteTimeout: 60 * time.Second,
+	}
+
+	l.listen, err = net.Listen(network, l.address)
+	if err != nil {
+		return err
+	}
+	l.queue = newConnQueue(l.listen.Addr())
+
+	return nil
+}
+
+// isWebsocket returns true if a request is a websocket upgrade on the websocket path.
+func (l *Mux) isWebsocket(r *http.Request) bool {
+	if !websocket.IsWebSocketUpgrade(r) {
+		return false
+	}
+
+	if c := l.config.Websocket; c != nil && c.Path != "" {
+		return r.URL.Path == c.Path
+	}
+
+	return true
+}
+
+// Serve starts waiting for new connections, routing each to the mqtt establish
+// callback or the http server.
+func (l *Mux) Serve(establish EstablishFn) {
+	l.ws.establish = establish
+	go func() {
+		_ = l.http.Serve(l.queue)
+	}()
+
+	for {
+		if atomic.LoadUint32(&l.end) == 1 {
+			return
+		}
+
+		conn, err := l.listen.Accept()
+		if err != nil {
+			return
+		}
+
+		if atomic.LoadUint32(&l.end) == 0 {
+			go l.route(conn, establish)
+		}
+	}
+}
+
+// route completes any proxy header and tls handshake of a connection and passes it to
+// the mqtt establish callback or the http server.
+func (l *Mux) route(conn net.Conn, establish EstablishFn) {
+	_ = conn.SetDeadline(time.Now().Add(muxHandshakeTimeout))
+
+	if l.config.ProxyProtocol {
+		pc, err := readProxyHeader(conn)
+		if err != nil {
+			l.log.Warn("unable to read proxy protocol header", "type", "mux", "error", err, "remote-address", conn.RemoteAddr().String())
+			_ = conn.Close()
+			return
+		}
+		conn = pc
+	}
+
+	if !l.config.IPFilter.Allowed(conn.RemoteAddr().String()) {
+		_ = conn.Close()
+		return
+	}
+
+	proto := ""
+	if l.tlsConfig != nil {
+		tc := tls.Server(conn, l.tlsConfig)
+		if err := tc.Handshake(); err != nil {
+			l.log.Debug("tls handshake failed", "type", "mux", "error", err, "remote-address", conn.RemoteAddr().String())
+			_ = tc.Close()
+			return
+		}
+		conn, proto = tc, tc.ConnectionState().NegotiatedProtocol
+	}
+
+	if proto == "" {
+		pc := &peekConn{Conn: conn, r: bufio.NewReader(conn)}
+		b, err := pc.r.Peek(1)
+		if err != nil {
+			_ = conn.Close()
+			return
+		}
+
+		conn, proto = pc, ALPNHTTP
+		if b[0]>>4 == packets.Connect {
+			proto = ALPNMQTT
+		}
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	if proto != ALPNMQTT {
+		if !l.queue.push(conn) {
+			_ = conn.Close()
+		}
+		return
+	}
+
+	if err := establish(l.id, conn); err != nil {
+		l.log.Warn("unable to establish connection on listener", "type", "mux", "error", err, "remote-address", conn.RemoteAddr().String())
+	}
+}
+
+// Close closes the listener and any client connections.
+func (l *Mux) Close(closeClients CloseFn) {
+	l.Lock()
+	defer l.Unlock()
+
+	if atomic.CompareAndSwapUint32(&l.end, 0, 1) {
+		if l.listen != nil {
+			_ = l.listen.Close()
+		}
+
+		if l.http != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_ = l.http.Shutdown(ctx)
+		}
+
+		if l.queue != nil {
+			_ = l.queue.Close()
+		}
+	}
+
+	closeClients(l.id)
+}
+
+// peekConn is a connection whose first bytes have been peeked.
+type peekConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read reads the peeked bytes before the rest of the connection.
+func (c *peekConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// connQueue is a net.Listener accepting the connections routed to it, so that an
+// http server can serve connections accepted by another listener.
+type connQueue struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+// newConnQueue returns a new instance of connQueue.
+func newConnQueue(addr net.Addr) *connQueue {
+	return &connQueue{
+		addr:  addr,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// push queues a connection to be accepted, returning false if the queue is closed.
+func (q *connQueue) push(conn net.Conn) bool {
+	select {
+	case q.conns <- conn:
+		return true
+	case <-q.done:
+		return false
+	}
+}
+
+// Accept returns the next queued connection.
+func (q *connQueue) Accept() (net.Conn, error) {
+	select {
+	case conn := <-q.conns:
+		return conn, nil
+	case <-q.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the queue.
+func (q *connQueue) Close() error {
+	q.once.Do(func() {
+		close(q.done)
+	})
+	return nil
+}
+
+// Addr returns the address of the listener the connections were accepted by.
+func (q *connQueue) Addr() net.Addr {
+	return q.addr
+}
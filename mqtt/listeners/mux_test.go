@@ -0,0 +1,203 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package listeners
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func newMuxTest(t *testing.T, config *Config) (*Mux, chan []byte) {
+	l := NewMux("mux", "127.0.0.1:0", config, map[string]Handler{
+		"GET /api/v1/ping": func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("pong"))
+		},
+	})
+	require.NoError(t, l.Init(logger))
+
+	established := make(chan []byte, 1)
+	go l.Serve(func(id string, c net.Conn) error {
+		b := make([]byte, 2)
+		_, err := io.ReadFull(c, b)
+		established <- b
+		return err
+	})
+	t.Cleanup(func() {
+		l.Close(MockCloser)
+	})
+
+	return l, established
+}
+
+func receiveEstablished(t *testing.T, established chan []byte) []byte {
+	select {
+	case b := <-established:
+		return b
+	case <-time.After(time.Second):
+		require.Fail(t, "connection not established")
+	}
+	return nil
+}
+
+func TestNewMux(t *testing.T) {
+	l := NewMux("mux", testAddr, nil, nil)
+	require.Equal(t, "mux", l.ID())
+	require.Equal(t, testAddr, l.Address())
+	require.Equal(t, "mux", l.Protocol())
+	require.NotNil(t, l.Config())
+
+	l = NewMux("mux", testAddr, &Config{TLSConfig: tlsConfigBasic}, nil)
+	require.Equal(t, "tls-mux", l.Protocol())
+}
+
+func TestMuxInitInvalidFamily(t *testing.T) {
+	l := NewMux("mux", "127.0.0.1:0", &Config{Family: "ipx"}, nil)
+	require.ErrorIs(t, l.Init(logger), ErrInvalidFamily)
+}
+
+func TestMuxInitALPN(t *testing.T) {
+	l := NewMux("mux", "127.0.0.1:0", &Config{TLSConfig: tlsConfigBasic}, nil)
+	require.NoError(t, l.Init(logger))
+	defer l.Close(MockCloser)
+	require.Equal(t, []string{ALPNMQTT, ALPNHTTP}, l.tlsConfig.NextProtos)
+	require.Empty(t, tlsConfigBasic.NextProtos)
+}
+
+func TestMuxALPNMQTT(t *testing.T) {
+	l, established := newMuxTest(t, &Config{TLSConfig: tlsConfigBasic})
+
+	conn, err := tls.Dial("tcp", l.Address(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{ALPNMQTT}}) // #nosec G402
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, ALPNMQTT, conn.ConnectionState().NegotiatedProtocol)
+
+	_, err = conn.Write([]byte{0x10, 0x00})
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x10, 0x00}, receiveEstablished(t, established))
+}
+
+func TestMuxSniffMQTT(t *testing.T) {
+	l, established := newMuxTest(t, &Config{TLSConfig: tlsConfigBasic})
+
+	conn, err := tls.Dial("tcp", l.Address(), &tls.Config{InsecureSkipVerify: true}) // #nosec G402
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte{0x10, 0x01})
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x10, 0x01}, receiveEstablished(t, established))
+}
+
+func TestMuxSniffMQTTPlain(t *testing.T) {
+	l, established := newMuxTest(t, nil)
+
+	conn, err := net.Dial("tcp", l.Address())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte{0x10, 0x02})
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x10, 0x02}, receiveEstablished(t, established))
+}
+
+func TestMuxHTTPS(t *testing.T) {
+	l, _ := newMuxTest(t, &Config{TLSConfig: tlsConfigBasic})
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true, NextProtos: []string{ALPNHTTP}}}} // #nosec G402
+	resp, err := client.Get("https://" + l.Address() + "/api/v1/ping")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "pong", string(body))
+	require.Equal(t, ALPNHTTP, resp.TLS.NegotiatedProtocol)
+}
+
+func TestMuxHTTPPlain(t *testing.T) {
+	l, _ := newMuxTest(t, nil)
+
+	resp, err := http.Get("http://" + l.Address() + "/api/v1/ping")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "pong", string(body))
+}
+
+func TestMuxWebsocket(t *testing.T) {
+	l, established := newMuxTest(t, &Config{
+		TLSConfig: tlsConfigBasic,
+		Websocket: &WebsocketConfig{Path: "/mqtt"},
+	})
+
+	dialer := websocket.Dialer{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // #nosec G402
+		Subprotocols:    []string{"mqtt"},
+	}
+
+	_, resp, err := dialer.Dial("wss://"+l.Address()+"/other", nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	ws, _, err := dialer.Dial("wss://"+l.Address()+"/mqtt", nil)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	require.NoError(t, ws.WriteMessage(websocket.BinaryMessage, []byte{0x10, 0x03}))
+	require.Equal(t, []byte{0x10, 0x03}, receiveEstablished(t, established))
+}
+
+func TestMuxServeAndClose(t *testing.T) {
+	l := NewMux("mux", "127.0.0.1:0", nil, nil)
+	require.NoError(t, l.Init(logger))
+
+	o := make(chan bool)
+	go func() {
+		l.Serve(MockEstablisher)
+		o <- true
+	}()
+
+	var closed bool
+	l.Close(func(id string) {
+		closed = true
+	})
+	require.True(t, closed)
+
+	select {
+	case <-o:
+	case <-time.After(time.Second):
+		require.Fail(t, "serve did not return after close")
+	}
+}
+
+func TestMuxIPFilter(t *testing.T) {
+	filter := new(IPFilter)
+	require.NoError(t, filter.Set(IPRules{Allow: []string{"10.0.0.0/8"}}))
+	l, established := newMuxTest(t, &Config{IPFilter: filter})
+
+	conn, err := net.Dial("tcp", l.Address())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, _ = conn.Write([]byte{0x10, 0x04})
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	select {
+	case <-established:
+		require.Fail(t, "denied connection established")
+	default:
+	}
+}
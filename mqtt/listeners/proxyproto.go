@@ -0,0 +1,197 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package listeners
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyHeaderTimeout is the maximum time to wait for the PROXY protocol header of a connection.
+const proxyHeaderTimeout = 5 * time.Second
+
+var (
+	// ErrInvalidProxyHeader indicates a connection did not begin with a valid PROXY protocol header.
+	ErrInvalidProxyHeader = errors.New("invalid proxy protocol header")
+
+	// proxyV2Signature begins every PROXY protocol v2 header.
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// proxyConn is a connection accepted from a proxy, which reports the addresses of
+// the original connection given in its PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+// Read reads from the buffer of the header before the connection.
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// NetConn returns the connection from the proxy.
+func (c *proxyConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// RemoteAddr returns the source address of the original connection.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address of the original connection.
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// readProxyHeader reads the PROXY protocol v1 or v2 header of a connection, returning a
+// connection which reports the original addresses. Connections from the proxy itself,
+// such as health checks, keep their own addresses.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	pc := &proxyConn{Conn: conn, r: bufio.NewReader(conn)}
+	b, err := pc.r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(b, proxyV2Signature) {
+		err = pc.readV2()
+	} else if bytes.HasPrefix(b, []byte("PROXY ")) {
+		err = pc.readV1()
+	} else {
+		err = ErrInvalidProxyHeader
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return pc, nil
+}
+
+// readV1 reads a human readable v1 header, such as "PROXY TCP4 1.2.3.4 5.6.7.8 5000 1883\r\n".
+func (c *proxyConn) readV1() error {
+	var line []byte
+	for len(line) < 107 { // the maximum length of a v1 header
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return ErrInvalidProxyHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return ErrInvalidProxyHeader
+	}
+
+	remote, err := proxyAddr(fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+	local, err := proxyAddr(fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+
+	c.remote, c.local = remote, local
+	return nil
+}
+
+// readV2 reads a binary v2 header.
+func (c *proxyConn) readV2() error {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		return err
+	}
+
+	if header[12]>>4 != 2 {
+		return ErrInvalidProxyHeader
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return err
+	}
+
+	switch header[12] & 0x0f {
+	case 0x0: // LOCAL, sent by the proxy for its own connections
+		return nil
+	case 0x1: // PROXY
+	default:
+		return ErrInvalidProxyHeader
+	}
+
+	var size int
+	switch header[13] >> 4 {
+	case 0x1: // AF_INET
+		size = net.IPv4len
+	case 0x2: // AF_INET6
+		size = net.IPv6len
+	default: // AF_UNSPEC and AF_UNIX carry no ip addresses
+		return nil
+	}
+
+	if len(payload) < size*2+4 {
+		return ErrInvalidProxyHeader
+	}
+
+	c.remote = &net.TCPAddr{
+		IP:   net.IP(payload[:size]),
+		Port: int(binary.BigEndian.Uint16(payload[size*2:])),
+	}
+	c.local = &net.TCPAddr{
+		IP:   net.IP(payload[size : size*2]),
+		Port: int(binary.BigEndian.Uint16(payload[size*2+2:])),
+	}
+
+	return nil
+}
+
+// proxyAddr returns the tcp address of an ip and port given in a v1 header.
+func proxyAddr(ip, port string) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	if addr.IP == nil {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+	addr.Port = int(p)
+
+	return addr, nil
+}
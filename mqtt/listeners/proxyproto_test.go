@@ -0,0 +1,151 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package listeners
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// proxyV2Header returns a v2 PROXY header for a tcp over ipv4 connection.
+func proxyV2Header(command byte, src, dst string, sport, dport uint16) []byte {
+	b := append([]byte{}, proxyV2Signature...)
+	b = append(b, 0x20|command, 0x11, 0, 12)
+	b = append(b, net.ParseIP(src).To4()...)
+	b = append(b, net.ParseIP(dst).To4()...)
+	b = binary.BigEndian.AppendUint16(b, sport)
+	b = binary.BigEndian.AppendUint16(b, dport)
+	return b
+}
+
+// readTestProxyHeader writes data to a pipe and reads its proxy header.
+func readTestProxyHeader(t *testing.T, data []byte) (net.Conn, error) {
+	r, w := net.Pipe()
+	t.Cleanup(func() {
+		r.Close()
+		w.Close()
+	})
+
+	go func() {
+		_, _ = w.Write(data)
+	}()
+
+	return readProxyHeader(r)
+}
+
+func TestReadProxyHeaderV1(t *testing.T) {
+	conn, err := readTestProxyHeader(t, []byte("PROXY TCP4 192.168.0.1 10.0.0.1 56324 1883\r\nmqtt"))
+	require.NoError(t, err)
+	require.Equal(t, "192.168.0.1:56324", conn.RemoteAddr().String())
+	require.Equal(t, "10.0.0.1:1883", conn.LocalAddr().String())
+
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "mqtt", string(buf))
+}
+
+func TestReadProxyHeaderV1TCP6(t *testing.T) {
+	conn, err := readTestProxyHeader(t, []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 1883\r\n"))
+	require.NoError(t, err)
+	require.Equal(t, "[2001:db8::1]:56324", conn.RemoteAddr().String())
+}
+
+func TestReadProxyHeaderV1Unknown(t *testing.T) {
+	conn, err := readTestProxyHeader(t, []byte("PROXY UNKNOWN\r\n"))
+	require.NoError(t, err)
+	require.Equal(t, "pipe", conn.RemoteAddr().Network())
+}
+
+func TestReadProxyHeaderV2(t *testing.T) {
+	conn, err := readTestProxyHeader(t, append(proxyV2Header(0x1, "192.168.0.1", "10.0.0.1", 56324, 1883), "mqtt"...))
+	require.NoError(t, err)
+	require.Equal(t, "192.168.0.1:56324", conn.RemoteAddr().String())
+	require.Equal(t, "10.0.0.1:1883", conn.LocalAddr().String())
+
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "mqtt", string(buf))
+}
+
+func TestReadProxyHeaderV2Local(t *testing.T) {
+	conn, err := readTestProxyHeader(t, proxyV2Header(0x0, "192.168.0.1", "10.0.0.1", 56324, 1883))
+	require.NoError(t, err)
+	require.Equal(t, "pipe", conn.RemoteAddr().Network())
+}
+
+func TestReadProxyHeaderInvalid(t *testing.T) {
+	for _, data := range []string{
+		"\x10\x0c\x00\x04MQTT\x04\x02\x00\x3c", // a connect packet without a header
+		"PROXY TCP4 192.168.0.1 10.0.0.1 56324\r\n",
+		"PROXY TCP4 nope 10.0.0.1 56324 1883\r\n",
+		"PROXY TCP4 192.168.0.1 10.0.0.1 99999 1883\r\n",
+		"PROXY UDP4 192.168.0.1 10.0.0.1 56324 1883\r\n",
+		"PROXY TCP4 192.168.0.1 10.0.0.1 56324 1883\n",
+		string(append(proxyV2Header(0x1, "192.168.0.1", "10.0.0.1", 1, 2)[:12], 0x11, 0x11, 0, 0)),
+	} {
+		_, err := readTestProxyHeader(t, []byte(data))
+		require.ErrorIs(t, err, ErrInvalidProxyHeader, data)
+	}
+}
+
+func TestTCPProxyProtocol(t *testing.T) {
+	for _, config := range []*Config{{ProxyProtocol: true}, {ProxyProtocol: true, TLSConfig: tlsConfigBasic}} {
+		l := NewTCP("t1", "127.0.0.1:0", config)
+		err := l.Init(logger)
+		require.NoError(t, err)
+
+		remotes := make(chan string, 1)
+		go l.Serve(func(id string, c net.Conn) error {
+			remotes <- c.RemoteAddr().String()
+			return nil
+		})
+
+		conn, err := net.Dial("tcp", l.listen.Addr().String())
+		require.NoError(t, err)
+
+		_, err = conn.Write([]byte("PROXY TCP4 192.168.0.1 10.0.0.1 56324 1883\r\n"))
+		require.NoError(t, err)
+		if config.TLSConfig != nil {
+			tc := tls.Client(conn, &tls.Config{InsecureSkipVerify: true}) // nolint
+			go func() { _ = tc.Handshake() }()
+		}
+
+		require.Equal(t, "192.168.0.1:56324", <-remotes)
+		conn.Close()
+		l.Close(MockCloser)
+	}
+}
+
+func TestTCPProxyProtocolRefused(t *testing.T) {
+	l := NewTCP("t1", "127.0.0.1:0", &Config{ProxyProtocol: true})
+	err := l.Init(logger)
+	require.NoError(t, err)
+	defer l.Close(MockCloser)
+
+	established := make(chan bool, 1)
+	go l.Serve(func(id string, c net.Conn) error {
+		established <- true
+		return nil
+	})
+
+	conn, err := net.Dial("tcp", l.listen.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("\x10\x0c\x00\x04MQTT\x04\x02\x00\x3c"))
+	require.NoError(t, err)
+
+	// the connection is closed without being established
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+	require.Empty(t, established)
+}
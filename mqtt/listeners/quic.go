@@ -0,0 +1,198 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package listeners
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/quic-go/quic-go"
+)
+
+// QUICProtocol is the application protocol negotiated by MQTT over QUIC clients.
+const QUICProtocol = "mqtt"
+
+// ErrQUICRequiresTLS indicates a QUIC listener was configured without a tls config.
+var ErrQUICRequiresTLS = errors.New("quic listener requires a tls config")
+
+// QUIC is a listener for establishing client connections over QUIC. Each bidirectional
+// stream opened by a client is a separate MQTT connection, so a client can multiplex
+// several sessions over one QUIC connection, and resumed clients may send their connect
+// packet as 0-RTT data.
+type QUIC struct {
+	sync.RWMutex
+	id      string              // the internal id of the listener
+	address string              // the network address to bind to
+	listen  *quic.EarlyListener // a quic listener which will listen for new clients
+	conn    net.PacketConn      // the udp socket of the listener
+	config  *Config             // configuration values for the listener
+	log     *slog.Logger        // server logger
+	end     uint32              // ensure the close methods are only called once
+}
+
+// NewQUIC initialises and returns a new QUIC listener, listening on an address.
+func NewQUIC(id, address string, config *Config) *QUIC {
+	if config == nil {
+		config = new(Config)
+	}
+
+	return &QUIC{
+		id:      id,
+		address: address,
+		config:  config,
+	}
+}
+
+// ID returns the id of the listener.
+func (l *QUIC) ID() string {
+	return l.id
+}
+
+// Address returns the address of the listener.
+func (l *QUIC) Address() string {
+	return l.address
+}
+
+// Config returns the config of the listener.
+func (l *QUIC) Config() *Config {
+	return l.config
+}
+
+// Protocol returns the protocol of the listener.
+func (l *QUIC) Protocol() string {
+	return "quic"
+}
+
+// Init initializes the listener.
+func (l *QUIC) Init(log *slog.Logger) error {
+	l.log = log
+
+	if l.config.TLSConfig == nil {
+		return ErrQUICRequiresTLS
+	}
+
+	tlsConfig := l.config.TLSConfig.Clone()
+	if len(tlsConfig.NextProtos) == 0 {
+		tlsConfig.NextProtos = []string{QUICProtocol}
+	}
+
+	network, err := l.config.Network("udp")
+	if err != nil {
+		return err
+	}
+
+	l.conn, err = net.ListenPacket(network, l.address)
+	if err != nil {
+		return err
+	}
+
+	l.listen, err = quic.ListenEarly(l.conn, tlsConfig, &quic.Config{
+		Allow0RTT: true,
+	})
+	if err != nil {
+		_ = l.conn.Close()
+	}
+
+	return err
+}
+
+// Serve starts waiting for new QUIC connections, and calls the establish
+// connection callback for each stream opened on them.
+func (l *QUIC) Serve(establish EstablishFn) {
+	for {
+		if atomic.LoadUint32(&l.end) == 1 {
+			return
+		}
+
+		conn, err := l.listen.Accept(context.Background())
+		if err != nil {
+			return
+		}
+
+		if atomic.LoadUint32(&l.end) == 0 {
+			go l.serveConn(conn, establish)
+		}
+	}
+}
+
+// serveConn calls the establish connection callback for each stream opened on a QUIC
+// connection. Connections without open streams are closed by the idle timeout, as the
+// keepalive of the MQTT clients is the only traffic on them.
+func (l *QUIC) serveConn(conn *quic.Conn, establish EstablishFn) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+
+		go func() {
+			s := &quicStream{Stream: stream, conn: conn}
+			err := establish(l.id, s)
+			if err != nil {
+				l.log.Warn("unable to establish connection on listener", "type", "quic", "error", err, "remote-address", conn.RemoteAddr().String())
+			}
+			_ = s.Close()
+		}()
+	}
+}
+
+// Close closes the listener and any client connections.
+func (l *QUIC) Close(closeClients CloseFn) {
+	l.Lock()
+	defer l.Unlock()
+
+	if atomic.CompareAndSwapUint32(&l.end, 0, 1) {
+		closeClients(l.id)
+	}
+
+	if l.listen != nil {
+		err := l.listen.Close()
+		if err != nil {
+			return
+		}
+	}
+
+	if l.conn != nil {
+		_ = l.conn.Close() // the udp socket is not closed with the quic listener
+	}
+}
+
+// quicStream is a QUIC stream which satisfies the net.Conn interface.
+type quicStream struct {
+	*quic.Stream
+	conn   *quic.Conn
+	closed atomic.Bool
+}
+
+// LocalAddr returns the local address of the QUIC connection.
+func (s *quicStream) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the QUIC connection.
+func (s *quicStream) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// ConnectionState returns the tls state of the QUIC connection, such as the certificates
+// presented by the client.
+func (s *quicStream) ConnectionState() tls.ConnectionState {
+	return s.conn.ConnectionState().TLS
+}
+
+// Close closes both directions of the stream.
+func (s *quicStream) Close() error {
+	if !s.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+
+	s.CancelRead(0)
+	return s.Stream.Close()
+}
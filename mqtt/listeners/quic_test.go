@@ -0,0 +1,124 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package listeners
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewQUIC(t *testing.T) {
+	l := NewQUIC("q1", testAddr, nil)
+	require.Equal(t, "q1", l.id)
+	require.Equal(t, testAddr, l.address)
+	require.NotNil(t, l.config)
+}
+
+func TestQUICID(t *testing.T) {
+	l := NewQUIC("q1", testAddr, nil)
+	require.Equal(t, "q1", l.ID())
+}
+
+func TestQUICAddress(t *testing.T) {
+	l := NewQUIC("q1", testAddr, nil)
+	require.Equal(t, testAddr, l.Address())
+}
+
+func TestQUICProtocol(t *testing.T) {
+	l := NewQUIC("q1", testAddr, nil)
+	require.Equal(t, "quic", l.Protocol())
+}
+
+func TestQUICInitRequiresTLS(t *testing.T) {
+	l := NewQUIC("q1", testAddr, nil)
+	err := l.Init(logger)
+	require.ErrorIs(t, err, ErrQUICRequiresTLS)
+}
+
+func TestQUICInit(t *testing.T) {
+	l := NewQUIC("q1", "127.0.0.1:0", &Config{
+		TLSConfig: tlsConfigBasic,
+	})
+	err := l.Init(logger)
+	require.NoError(t, err)
+	defer l.Close(MockCloser)
+	require.NotNil(t, l.listen)
+	require.Empty(t, tlsConfigBasic.NextProtos)
+}
+
+func TestQUICServeAndClose(t *testing.T) {
+	l := NewQUIC("q1", "127.0.0.1:0", &Config{
+		TLSConfig: tlsConfigBasic,
+	})
+	err := l.Init(logger)
+	require.NoError(t, err)
+
+	o := make(chan bool)
+	go func(o chan bool) {
+		l.Serve(MockEstablisher)
+		o <- true
+	}(o)
+
+	time.Sleep(time.Millisecond)
+
+	var closed bool
+	l.Close(func(id string) {
+		closed = true
+	})
+
+	require.True(t, closed)
+	<-o
+
+	l.Close(MockCloser)      // coverage: close closed
+	l.Serve(MockEstablisher) // coverage: serve closed
+}
+
+func TestQUICEstablishStreams(t *testing.T) {
+	l := NewQUIC("q1", "127.0.0.1:0", &Config{
+		TLSConfig: tlsConfigBasic,
+	})
+	err := l.Init(logger)
+	require.NoError(t, err)
+
+	remotes := make(chan net.Addr, 2)
+	go l.Serve(func(id string, c net.Conn) error {
+		require.Equal(t, "q1", id)
+		remotes <- c.RemoteAddr()
+		_, err := io.Copy(c, c)
+		return err
+	})
+	defer l.Close(MockCloser)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddrEarly(ctx, l.listen.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true, // nolint
+		NextProtos:         []string{QUICProtocol},
+	}, nil)
+	require.NoError(t, err)
+	defer conn.CloseWithError(0, "")
+
+	// each stream is a separate client connection over the same quic connection
+	for _, msg := range []string{"first", "second"} {
+		stream, err := conn.OpenStreamSync(ctx)
+		require.NoError(t, err)
+		_, err = stream.Write([]byte(msg))
+		require.NoError(t, err)
+
+		buf := make([]byte, len(msg))
+		_, err = io.ReadFull(stream, buf)
+		require.NoError(t, err)
+		require.Equal(t, msg, string(buf))
+		require.Equal(t, conn.LocalAddr().(*net.UDPAddr).Port, (<-remotes).(*net.UDPAddr).Port)
+		stream.Close()
+	}
+}
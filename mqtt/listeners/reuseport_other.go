@@ -0,0 +1,14 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package listeners
+
+import "syscall"
+
+// reusePort fails as SO_REUSEPORT is not supported on this platform.
+func reusePort(_, _ string, _ syscall.RawConn) error {
+	return ErrReusePortUnsupported
+}
@@ -0,0 +1,102 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package listeners
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+)
+
+// ErrInvalidSocketConfig indicates a listener was configured with negative socket buffer sizes.
+var ErrInvalidSocketConfig = errors.New("socket read and write buffers must not be negative")
+
+// SocketConfig tunes the sockets of the connections accepted by a tcp listener, e.g. to
+// reduce the memory held by many mostly idle connections. Each option keeps the default
+// of the operating system and go when unset.
+type SocketConfig struct {
+	// KeepAlive is the seconds between tcp keepalive probes of idle connections. The go
+	// default of 15 seconds is used when 0, and keepalives are disabled when negative.
+	KeepAlive int `yaml:"keepalive" json:"keepalive"`
+
+	// ReadBuffer and WriteBuffer are the bytes of the socket receive and send buffers.
+	ReadBuffer  int `yaml:"read-buffer" json:"read_buffer"`
+	WriteBuffer int `yaml:"write-buffer" json:"write_buffer"`
+
+	// NoDelay disables nagle's algorithm when true, so that small packets are sent without
+	// delay, which is the go default, or coalesces them when false.
+	NoDelay *bool `yaml:"no-delay" json:"no_delay"`
+
+	// Linger is the seconds a closed connection waits to send unsent data. Unsent data is
+	// discarded when 0, and sent in the background after close when negative.
+	Linger *int `yaml:"linger" json:"linger"`
+}
+
+// validate returns an error if the socket config is invalid.
+func (c *SocketConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+
+	if c.ReadBuffer < 0 || c.WriteBuffer < 0 {
+		return ErrInvalidSocketConfig
+	}
+
+	return nil
+}
+
+// apply sets the socket options of an accepted connection, unwrapping tls connections.
+// Connections which are not tcp are left unchanged.
+func (c *SocketConfig) apply(conn net.Conn) error {
+	if c == nil {
+		return nil
+	}
+
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	if c.KeepAlive < 0 {
+		if err := tcp.SetKeepAlive(false); err != nil {
+			return err
+		}
+	} else if c.KeepAlive > 0 {
+		if err := tcp.SetKeepAlivePeriod(time.Duration(c.KeepAlive) * time.Second); err != nil {
+			return err
+		}
+	}
+
+	if c.ReadBuffer > 0 {
+		if err := tcp.SetReadBuffer(c.ReadBuffer); err != nil {
+			return err
+		}
+	}
+
+	if c.WriteBuffer > 0 {
+		if err := tcp.SetWriteBuffer(c.WriteBuffer); err != nil {
+			return err
+		}
+	}
+
+	if c.NoDelay != nil {
+		if err := tcp.SetNoDelay(*c.NoDelay); err != nil {
+			return err
+		}
+	}
+
+	if c.Linger != nil {
+		if err := tcp.SetLinger(*c.Linger); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,83 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package listeners
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSocketConfigValidate(t *testing.T) {
+	var c *SocketConfig
+	require.NoError(t, c.validate())
+	require.NoError(t, (&SocketConfig{ReadBuffer: 4096}).validate())
+	require.ErrorIs(t, (&SocketConfig{ReadBuffer: -1}).validate(), ErrInvalidSocketConfig)
+	require.ErrorIs(t, (&SocketConfig{WriteBuffer: -1}).validate(), ErrInvalidSocketConfig)
+}
+
+func TestSocketConfigApply(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+
+	conn, err := ln.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	noDelay, linger := false, 0
+	c := &SocketConfig{
+		KeepAlive:   300,
+		ReadBuffer:  4096,
+		WriteBuffer: 4096,
+		NoDelay:     &noDelay,
+		Linger:      &linger,
+	}
+	require.NoError(t, c.apply(conn))
+	require.NoError(t, (&SocketConfig{KeepAlive: -1}).apply(conn))
+
+	var nilConfig *SocketConfig
+	require.NoError(t, nilConfig.apply(conn))
+
+	r, w := net.Pipe()
+	defer r.Close()
+	defer w.Close()
+	require.NoError(t, c.apply(r))
+}
+
+func TestTCPInitInvalidSocket(t *testing.T) {
+	l := NewTCP("t1", testAddr, &Config{Socket: &SocketConfig{ReadBuffer: -1}})
+	require.ErrorIs(t, l.Init(logger), ErrInvalidSocketConfig)
+}
+
+func TestTCPServeSocket(t *testing.T) {
+	l := NewTCP("t1", "127.0.0.1:0", &Config{Socket: &SocketConfig{KeepAlive: 60, ReadBuffer: 8192}})
+	require.NoError(t, l.Init(logger))
+	defer l.Close(MockCloser)
+
+	established := make(chan net.Conn, 1)
+	go l.Serve(func(id string, c net.Conn) error {
+		established <- c
+		return nil
+	})
+
+	client, err := net.Dial("tcp", l.listen.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+
+	select {
+	case c := <-established:
+		_, ok := c.(*net.TCPConn)
+		require.True(t, ok)
+	case <-time.After(time.Second):
+		require.Fail(t, "connection not established")
+	}
+}
@@ -5,7 +5,9 @@
 package listeners
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -13,15 +15,25 @@ import (
 	"log/slog"
 )
 
+var (
+	// ErrInvalidAcceptors indicates a tcp listener was configured with a negative number of acceptors.
+	ErrInvalidAcceptors = errors.New("listener acceptors must not be negative")
+
+	// ErrReusePortUnsupported indicates a tcp listener was configured with several acceptors
+	// on a platform without SO_REUSEPORT.
+	ErrReusePortUnsupported = errors.New("listener acceptors require SO_REUSEPORT, which is not supported on this platform")
+)
+
 // TCP is a listener for establishing client connections on basic TCP protocol.
 type TCP struct { // [MQTT-4.2.0-1]
 	sync.RWMutex
-	id      string       // the internal id of the listener
-	address string       // the network address to bind to
-	listen  net.Listener // a net.Listener which will listen for new clients
-	config  *Config      // configuration values for the listener
-	log     *slog.Logger // server logger
-	end     uint32       // ensure the close methods are only called once
+	id      string         // the internal id of the listener
+	address string         // the network address to bind to
+	listen  net.Listener   // a net.Listener which will listen for new clients
+	extra   []net.Listener // further sockets sharing the address with SO_REUSEPORT, one for each extra acceptor
+	config  *Config        // configuration values for the listener
+	log     *slog.Logger   // server logger
+	end     uint32         // ensure the close methods are only called once
 }
 
 // NewTCP initialises and returns a new TCP listener, listening on an address.
@@ -47,6 +59,11 @@ func (l *TCP) Address() string {
 	return l.address
 }
 
+// Config returns the config of the listener.
+func (l *TCP) Config() *Config {
+	return l.config
+}
+
 // Protocol returns the address of the listener.
 func (l *TCP) Protocol() string {
 	return "tcp"
@@ -56,32 +73,115 @@ func (l *TCP) Protocol() string {
 func (l *TCP) Init(log *slog.Logger) error {
 	l.log = log
 
-	var err error
-	if l.config.TLSConfig != nil {
-		l.listen, err = tls.Listen("tcp", l.address, l.config.TLSConfig)
+	network, err := l.config.Network("tcp")
+	if err != nil {
+		return err
+	}
+
+	if l.config.Acceptors < 0 {
+		return ErrInvalidAcceptors
+	}
+
+	if err := l.config.Socket.validate(); err != nil {
+		return err
+	}
+
+	if l.config.Acceptors > 1 {
+		return l.initReusePort(network)
+	}
+
+	if l.config.ProxyProtocol {
+		l.listen, err = net.Listen(network, l.address) // tls begins after the proxy header
+	} else if l.config.TLSConfig != nil {
+		l.listen, err = tls.Listen(network, l.address, l.config.TLSConfig)
 	} else {
-		l.listen, err = net.Listen("tcp", l.address)
+		l.listen, err = net.Listen(network, l.address)
 	}
 
 	return err
 }
 
+// initReusePort opens a socket for each acceptor, bound to the same address with
+// SO_REUSEPORT. The sockets after the first bind to the address of the first, so that
+// they share the port even if the configured address lets the system choose one.
+func (l *TCP) initReusePort(network string) error {
+	lc := net.ListenConfig{Control: reusePort}
+	address := l.address
+	for i := 0; i < l.config.Acceptors; i++ {
+		ln, err := lc.Listen(context.Background(), network, address)
+		if err != nil {
+			l.closeListeners()
+			return err
+		}
+
+		if i == 0 {
+			address = ln.Addr().String()
+		}
+
+		if l.config.TLSConfig != nil && !l.config.ProxyProtocol { // tls begins after any proxy header
+			ln = tls.NewListener(ln, l.config.TLSConfig)
+		}
+
+		if i == 0 {
+			l.listen = ln
+		} else {
+			l.extra = append(l.extra, ln)
+		}
+	}
+
+	return nil
+}
+
 // Serve starts waiting for new TCP connections, and calls the establish
-// connection callback for any received.
+// connection callback for any received. Each socket of the listener is
+// accepted from by its own goroutine.
 func (l *TCP) Serve(establish EstablishFn) {
+	var wg sync.WaitGroup
+	for _, ln := range l.extra {
+		wg.Add(1)
+		go func(ln net.Listener) {
+			defer wg.Done()
+			l.accept(ln, establish)
+		}(ln)
+	}
+
+	l.accept(l.listen, establish)
+	wg.Wait()
+}
+
+// accept accepts connections from a socket of the listener until it is closed.
+func (l *TCP) accept(ln net.Listener, establish EstablishFn) {
 	for {
 		if atomic.LoadUint32(&l.end) == 1 {
 			return
 		}
 
-		conn, err := l.listen.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
 			return
 		}
 
+		if err := l.config.Socket.apply(conn); err != nil {
+			l.log.Warn("unable to tune socket", "type", "tcp", "error", err, "remote-address", conn.RemoteAddr().String())
+		}
+
 		if atomic.LoadUint32(&l.end) == 0 {
 			go func() {
-				err = establish(l.id, conn)
+				if l.config.ProxyProtocol {
+					pc, err := readProxyHeader(conn)
+					if err != nil {
+						l.log.Warn("unable to read proxy protocol header", "type", "tcp", "error", err, "remote-address", conn.RemoteAddr().String())
+						_ = conn.Close()
+						return
+					}
+
+					conn = pc
+					if l.config.TLSConfig != nil {
+						conn = tls.Server(pc, l.config.TLSConfig)
+					}
+				}
+
+				err := establish(l.id, conn)
 				if err != nil {
 					l.log.Warn("unable to establish connection on listener", "type", "tcp", "error", err, "remote-address", conn.RemoteAddr().String())
 				}
@@ -99,10 +199,16 @@ func (l *TCP) Close(closeClients CloseFn) {
 		closeClients(l.id)
 	}
 
+	l.closeListeners()
+}
+
+// closeListeners closes the sockets of the listener.
+func (l *TCP) closeListeners() {
 	if l.listen != nil {
-		err := l.listen.Close()
-		if err != nil {
-			return
-		}
+		_ = l.listen.Close()
+	}
+
+	for _, ln := range l.extra {
+		_ = ln.Close()
 	}
 }
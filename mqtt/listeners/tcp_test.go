@@ -129,3 +129,50 @@ func TestTCPEstablishThenEnd(t *testing.T) {
 	l.Close(MockCloser)
 	<-o
 }
+
+func TestTCPInitInvalidAcceptors(t *testing.T) {
+	l := NewTCP("t1", testAddr, &Config{Acceptors: -1})
+	require.ErrorIs(t, l.Init(logger), ErrInvalidAcceptors)
+}
+
+func TestTCPAcceptors(t *testing.T) {
+	l := NewTCP("t1", "127.0.0.1:0", &Config{Acceptors: 4})
+	require.NoError(t, l.Init(logger))
+	require.Len(t, l.extra, 3)
+
+	address := l.listen.Addr().String()
+	for _, ln := range l.extra {
+		require.Equal(t, address, ln.Addr().String())
+	}
+
+	established := make(chan struct{}, 16)
+	o := make(chan bool)
+	go func() {
+		l.Serve(func(id string, c net.Conn) error {
+			established <- struct{}{}
+			return c.Close()
+		})
+		o <- true
+	}()
+
+	for i := 0; i < 16; i++ {
+		conn, err := net.Dial("tcp", address)
+		require.NoError(t, err)
+		_ = conn.Close()
+	}
+
+	for i := 0; i < 16; i++ {
+		select {
+		case <-established:
+		case <-time.After(time.Second):
+			require.Fail(t, "connection not established")
+		}
+	}
+
+	l.Close(MockCloser)
+	select {
+	case <-o:
+	case <-time.After(time.Second):
+		require.Fail(t, "serve did not return after close")
+	}
+}
@@ -5,11 +5,14 @@
 package listeners
 
 import (
+	"compress/flate"
 	"context"
 	"errors"
 	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -22,8 +25,78 @@ import (
 var (
 	// ErrInvalidMessage indicates that a message payload was not valid.
 	ErrInvalidMessage = errors.New("message type not binary")
+
+	// ErrInvalidWebsocketPath indicates that a websocket path does not begin with a slash.
+	ErrInvalidWebsocketPath = errors.New("websocket path must begin with /")
+
+	// ErrInvalidCompressionLevel indicates that a websocket compression level is not a flate level.
+	ErrInvalidCompressionLevel = errors.New("websocket compression level must be between -2 and 9")
 )
 
+// WebsocketConfig configures the path, origin checks and compression of a websocket listener.
+type WebsocketConfig struct {
+	// Path is the url path on which connections are upgraded, such as /mqtt. All paths
+	// are served when empty.
+	Path string `yaml:"path" json:"path"`
+
+	// AllowedOrigins are the origins allowed to connect from browsers, to protect against
+	// cross-site websocket hijacking. Each is a full origin such as https://app.example.com,
+	// a host such as app.example.com, a host wildcard such as *.example.com, or * for any
+	// origin. Requests without an origin, which are not sent by browsers, are always allowed.
+	// All origins are allowed when empty.
+	AllowedOrigins []string `yaml:"allowed-origins" json:"allowed_origins"`
+
+	// CheckOrigin returns true if the origin of an upgrade request is allowed, replacing
+	// the AllowedOrigins check.
+	CheckOrigin func(r *http.Request) bool `yaml:"-" json:"-"`
+
+	// Compression negotiates permessage-deflate compression with clients which support it.
+	Compression bool `yaml:"compression" json:"compression"`
+
+	// CompressionLevel is the flate level of compressed messages, the default level when 0.
+	CompressionLevel int `yaml:"compression-level" json:"compression_level"`
+}
+
+// checkOrigin returns true if the origin of an upgrade request is allowed.
+func (c *WebsocketConfig) checkOrigin(r *http.Request) bool {
+	if c.CheckOrigin != nil {
+		return c.CheckOrigin(r)
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" || len(c.AllowedOrigins) == 0 {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	for _, allowed := range c.AllowedOrigins {
+		if matchOrigin(allowed, origin, u.Hostname()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchOrigin returns true if an origin and its host match an allowed origin, host or
+// host wildcard.
+func matchOrigin(allowed, origin, host string) bool {
+	switch {
+	case allowed == "*":
+		return true
+	case strings.Contains(allowed, "://"):
+		return strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin)
+	case strings.HasPrefix(allowed, "*."):
+		return len(host) > len(allowed)-1 && strings.HasSuffix(strings.ToLower(host), strings.ToLower(allowed[1:]))
+	default:
+		return strings.EqualFold(allowed, host)
+	}
+}
+
 // Websocket is a listener for establishing websocket connections.
 type Websocket struct { // [MQTT-4.2.0-1]
 	sync.RWMutex
@@ -66,6 +139,11 @@ func (l *Websocket) Address() string {
 	return l.address
 }
 
+// Config returns the config of the listener.
+func (l *Websocket) Config() *Config {
+	return l.config
+}
+
 // Protocol returns the address of the listener.
 func (l *Websocket) Protocol() string {
 	if l.config.TLSConfig != nil {
@@ -79,8 +157,29 @@ func (l *Websocket) Protocol() string {
 func (l *Websocket) Init(log *slog.Logger) error {
 	l.log = log
 
+	if _, err := l.config.Network("tcp"); err != nil {
+		return err
+	}
+
+	path := "/"
+	if c := l.config.Websocket; c != nil {
+		if c.Path != "" {
+			if !strings.HasPrefix(c.Path, "/") {
+				return ErrInvalidWebsocketPath
+			}
+			path = c.Path
+		}
+
+		if c.CompressionLevel != 0 && (c.CompressionLevel < flate.HuffmanOnly || c.CompressionLevel > flate.BestCompression) {
+			return ErrInvalidCompressionLevel
+		}
+
+		l.upgrader.CheckOrigin = c.checkOrigin
+		l.upgrader.EnableCompression = c.Compression
+	}
+
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", l.handler)
+	mux.HandleFunc(path, l.handler)
 	l.listen = &http.Server{
 		Addr:         l.address,
 		Handler:      mux,
@@ -100,6 +199,10 @@ func (l *Websocket) handler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer c.Close()
 
+	if cfg := l.config.Websocket; cfg != nil && cfg.Compression && cfg.CompressionLevel != 0 {
+		_ = c.SetCompressionLevel(cfg.CompressionLevel) // validated in Init
+	}
+
 	err = l.establish(l.id, &wsConn{Conn: c.UnderlyingConn(), c: c})
 	if err != nil {
 		l.log.Warn("unable to establish connection on listener", "type", "websocket", "error", err, "remote-address", c.RemoteAddr().String())
@@ -111,10 +214,17 @@ func (l *Websocket) handler(w http.ResponseWriter, r *http.Request) {
 func (l *Websocket) Serve(establish EstablishFn) {
 	l.establish = establish
 
+	network, _ := l.config.Network("tcp") // validated in Init
+	ln, err := net.Listen(network, l.address)
+	if err != nil {
+		l.log.Error("failed to listen", "error", err, "address", l.address)
+		return
+	}
+
 	if l.listen.TLSConfig != nil {
-		_ = l.listen.ListenAndServeTLS("", "")
+		_ = l.listen.ServeTLS(ln, "", "")
 	} else {
-		_ = l.listen.ListenAndServe()
+		_ = l.listen.Serve(ln)
 	}
 }
 
@@ -193,3 +303,8 @@ func (ws *wsConn) Write(p []byte) (int, error) {
 func (ws *wsConn) Close() error {
 	return ws.Conn.Close()
 }
+
+// NetConn returns the underlying connection of the websocket connection.
+func (ws *wsConn) NetConn() net.Conn {
+	return ws.Conn
+}
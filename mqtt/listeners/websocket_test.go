@@ -153,3 +153,82 @@ func TestWebsocketConnectionReads(t *testing.T) {
 	s.Close()
 	_ = ws.Close()
 }
+
+func TestWebsocketInitInvalidConfig(t *testing.T) {
+	l := NewWebsocket("t1", testAddr, &Config{Websocket: &WebsocketConfig{Path: "mqtt"}})
+	require.ErrorIs(t, l.Init(logger), ErrInvalidWebsocketPath)
+
+	l = NewWebsocket("t1", testAddr, &Config{Websocket: &WebsocketConfig{Compression: true, CompressionLevel: 10}})
+	require.ErrorIs(t, l.Init(logger), ErrInvalidCompressionLevel)
+}
+
+func TestWebsocketCheckOrigin(t *testing.T) {
+	c := &WebsocketConfig{AllowedOrigins: []string{"https://app.example.com", "dash.example.com", "*.example.org"}}
+
+	tt := []struct {
+		origin string
+		ok     bool
+	}{
+		{origin: "", ok: true},
+		{origin: "https://app.example.com", ok: true},
+		{origin: "http://app.example.com", ok: false},
+		{origin: "https://dash.example.com:8443", ok: true},
+		{origin: "https://a.b.example.org", ok: true},
+		{origin: "https://example.org", ok: false},
+		{origin: "https://evil.com", ok: false},
+		{origin: "https://app.example.com.evil.com", ok: false},
+	}
+
+	for _, tx := range tt {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tx.origin != "" {
+			r.Header.Set("Origin", tx.origin)
+		}
+		require.Equal(t, tx.ok, c.checkOrigin(r), tx.origin)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Origin", "https://evil.com")
+	require.True(t, (&WebsocketConfig{}).checkOrigin(r))
+	require.True(t, (&WebsocketConfig{AllowedOrigins: []string{"*"}}).checkOrigin(r))
+
+	c.CheckOrigin = func(r *http.Request) bool { return true }
+	require.True(t, c.checkOrigin(r))
+}
+
+func TestWebsocketPathOriginAndCompression(t *testing.T) {
+	l := NewWebsocket("t1", testAddr, &Config{
+		Websocket: &WebsocketConfig{
+			Path:             "/mqtt",
+			AllowedOrigins:   []string{"https://app.example.com"},
+			Compression:      true,
+			CompressionLevel: 1,
+		},
+	})
+	require.NoError(t, l.Init(logger))
+
+	e := make(chan bool, 1)
+	l.establish = func(id string, c net.Conn) error {
+		e <- true
+		return nil
+	}
+
+	s := httptest.NewServer(l.listen.Handler)
+	defer s.Close()
+	addr := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	_, resp, err := websocket.DefaultDialer.Dial(addr+"/other", nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	_, resp, err = websocket.DefaultDialer.Dial(addr+"/mqtt", http.Header{"Origin": []string{"https://evil.com"}})
+	require.Error(t, err)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	dialer := &websocket.Dialer{EnableCompression: true}
+	ws, resp, err := dialer.Dial(addr+"/mqtt", http.Header{"Origin": []string{"https://app.example.com"}})
+	require.NoError(t, err)
+	require.Contains(t, resp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate")
+	require.True(t, <-e)
+	_ = ws.Close()
+}
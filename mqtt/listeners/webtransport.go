@@ -0,0 +1,224 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package listeners
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+)
+
+// ErrWebTransportRequiresTLS indicates a WebTransport listener was configured without a tls config.
+var ErrWebTransportRequiresTLS = errors.New("webtransport listener requires a tls config")
+
+// WebTransport is an experimental listener for establishing client connections over
+// WebTransport sessions on HTTP/3, for browsers where websockets are blocked or perform
+// poorly. As with the QUIC listener, each bidirectional stream opened on a session is a
+// separate MQTT connection. The path and allowed origins of the websocket config apply
+// to the session requests.
+type WebTransport struct {
+	sync.RWMutex
+	id        string               // the internal id of the listener
+	address   string               // the network address to bind to
+	config    *Config              // configuration values for the listener
+	server    *webtransport.Server // the http/3 server upgrading requests to webtransport sessions
+	conn      net.PacketConn       // the udp socket of the listener
+	log       *slog.Logger         // server logger
+	establish EstablishFn          // the server's establish connection handler
+	end       uint32               // ensure the close methods are only called once
+}
+
+// NewWebTransport initialises and returns a new WebTransport listener, listening on an address.
+func NewWebTransport(id, address string, config *Config) *WebTransport {
+	if config == nil {
+		config = new(Config)
+	}
+
+	return &WebTransport{
+		id:      id,
+		address: address,
+		config:  config,
+	}
+}
+
+// ID returns the id of the listener.
+func (l *WebTransport) ID() string {
+	return l.id
+}
+
+// Address returns the address of the listener.
+func (l *WebTransport) Address() string {
+	if l.conn != nil {
+		return l.conn.LocalAddr().String()
+	}
+	return l.address
+}
+
+// Config returns the config of the listener.
+func (l *WebTransport) Config() *Config {
+	return l.config
+}
+
+// Protocol returns the protocol of the listener.
+func (l *WebTransport) Protocol() string {
+	return "webtransport"
+}
+
+// Init initializes the listener.
+func (l *WebTransport) Init(log *slog.Logger) error {
+	l.log = log
+
+	if l.config.TLSConfig == nil {
+		return ErrWebTransportRequiresTLS
+	}
+
+	network, err := l.config.Network("udp")
+	if err != nil {
+		return err
+	}
+
+	path := "/"
+	checkOrigin := func(r *http.Request) bool {
+		return true
+	}
+	if c := l.config.Websocket; c != nil {
+		if c.Path != "" {
+			if !strings.HasPrefix(c.Path, "/") {
+				return ErrInvalidWebsocketPath
+			}
+			path = c.Path
+		}
+		checkOrigin = c.checkOrigin
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, l.handler)
+
+	l.server = &webtransport.Server{
+		H3: http3.Server{
+			TLSConfig: http3.ConfigureTLSConfig(l.config.TLSConfig.Clone()),
+			Handler:   mux,
+		},
+		CheckOrigin: checkOrigin,
+	}
+
+	l.conn, err = net.ListenPacket(network, l.address)
+	return err
+}
+
+// handler upgrades a request to a webtransport session and serves its streams.
+func (l *WebTransport) handler(w http.ResponseWriter, r *http.Request) {
+	if !l.config.IPFilter.Allowed(r.RemoteAddr) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	session, err := l.server.Upgrade(w, r)
+	if err != nil {
+		l.log.Debug("unable to upgrade webtransport session", "error", err, "remote-address", r.RemoteAddr)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	l.serveSession(session)
+}
+
+// serveSession calls the establish connection callback for each stream opened on a
+// webtransport session, until the session is closed.
+func (l *WebTransport) serveSession(session *webtransport.Session) {
+	for {
+		stream, err := session.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+
+		go func() {
+			s := &webTransportStream{Stream: stream, session: session}
+			err := l.establish(l.id, s)
+			if err != nil {
+				l.log.Warn("unable to establish connection on listener", "type", "webtransport", "error", err, "remote-address", session.RemoteAddr().String())
+			}
+			_ = s.Close()
+		}()
+	}
+}
+
+// Serve starts waiting for new webtransport sessions, and calls the establish
+// connection callback for each stream opened on them.
+func (l *WebTransport) Serve(establish EstablishFn) {
+	if atomic.LoadUint32(&l.end) == 1 {
+		return
+	}
+
+	l.establish = establish
+	_ = l.server.Serve(l.conn)
+}
+
+// Close closes the listener and any client connections.
+func (l *WebTransport) Close(closeClients CloseFn) {
+	l.Lock()
+	defer l.Unlock()
+
+	if atomic.CompareAndSwapUint32(&l.end, 0, 1) {
+		closeClients(l.id)
+	}
+
+	if l.server != nil {
+		_ = l.server.Close()
+	}
+
+	if l.conn != nil {
+		_ = l.conn.Close() // the udp socket is not closed with the http/3 server
+	}
+}
+
+// webTransportStream is a WebTransport stream which satisfies the net.Conn interface.
+type webTransportStream struct {
+	*webtransport.Stream
+	session *webtransport.Session
+	closed  atomic.Bool
+}
+
+// LocalAddr returns the local address of the WebTransport session.
+func (s *webTransportStream) LocalAddr() net.Addr {
+	return s.session.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the WebTransport session.
+func (s *webTransportStream) RemoteAddr() net.Addr {
+	return s.session.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines of the stream.
+func (s *webTransportStream) SetDeadline(t time.Time) error {
+	_ = s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+// ConnectionState returns the tls state of the WebTransport session, such as the
+// certificates presented by the client.
+func (s *webTransportStream) ConnectionState() tls.ConnectionState {
+	return s.session.ConnectionState().TLS
+}
+
+// Close closes both directions of the stream.
+func (s *webTransportStream) Close() error {
+	if !s.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+
+	s.CancelRead(0)
+	return s.Stream.Close()
+}
@@ -0,0 +1,183 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package listeners
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/quic-go/webtransport-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewWebTransport(t *testing.T) {
+	l := NewWebTransport("wt1", testAddr, nil)
+	require.Equal(t, "wt1", l.id)
+	require.Equal(t, testAddr, l.address)
+	require.NotNil(t, l.config)
+}
+
+func TestWebTransportID(t *testing.T) {
+	l := NewWebTransport("wt1", testAddr, nil)
+	require.Equal(t, "wt1", l.ID())
+}
+
+func TestWebTransportAddress(t *testing.T) {
+	l := NewWebTransport("wt1", testAddr, nil)
+	require.Equal(t, testAddr, l.Address())
+}
+
+func TestWebTransportProtocol(t *testing.T) {
+	l := NewWebTransport("wt1", testAddr, nil)
+	require.Equal(t, "webtransport", l.Protocol())
+}
+
+func TestWebTransportInitRequiresTLS(t *testing.T) {
+	l := NewWebTransport("wt1", testAddr, nil)
+	err := l.Init(logger)
+	require.ErrorIs(t, err, ErrWebTransportRequiresTLS)
+}
+
+func TestWebTransportInitInvalidPath(t *testing.T) {
+	l := NewWebTransport("wt1", "127.0.0.1:0", &Config{
+		TLSConfig: tlsConfigBasic,
+		Websocket: &WebsocketConfig{Path: "mqtt"},
+	})
+	err := l.Init(logger)
+	require.ErrorIs(t, err, ErrInvalidWebsocketPath)
+}
+
+func TestWebTransportServeAndClose(t *testing.T) {
+	l := NewWebTransport("wt1", "127.0.0.1:0", &Config{
+		TLSConfig: tlsConfigBasic,
+	})
+	err := l.Init(logger)
+	require.NoError(t, err)
+	require.Empty(t, tlsConfigBasic.NextProtos)
+
+	o := make(chan bool)
+	go func(o chan bool) {
+		l.Serve(MockEstablisher)
+		o <- true
+	}(o)
+
+	time.Sleep(time.Millisecond)
+
+	var closed bool
+	l.Close(func(id string) {
+		closed = true
+	})
+
+	require.True(t, closed)
+	<-o
+
+	l.Close(MockCloser)      // coverage: close closed
+	l.Serve(MockEstablisher) // coverage: serve closed
+}
+
+func dialWebTransport(t *testing.T, ctx context.Context, url string, header http.Header) (*http.Response, *webtransport.Session, error) {
+	d := &webtransport.Dialer{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true, // nolint
+		},
+	}
+	t.Cleanup(func() {
+		_ = d.Close()
+	})
+	return d.Dial(ctx, url, header)
+}
+
+func TestWebTransportEstablishStreams(t *testing.T) {
+	l := NewWebTransport("wt1", "127.0.0.1:0", &Config{
+		TLSConfig: tlsConfigBasic,
+		Websocket: &WebsocketConfig{Path: "/mqtt"},
+	})
+	err := l.Init(logger)
+	require.NoError(t, err)
+
+	remotes := make(chan net.Addr, 2)
+	go l.Serve(func(id string, c net.Conn) error {
+		require.Equal(t, "wt1", id)
+		remotes <- c.RemoteAddr()
+		_, err := io.Copy(c, c)
+		return err
+	})
+	defer l.Close(MockCloser)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, session, err := dialWebTransport(t, ctx, "https://"+l.Address()+"/mqtt", nil)
+	require.NoError(t, err)
+	defer session.CloseWithError(0, "")
+
+	// each stream is a separate client connection over the same session
+	for _, msg := range []string{"first", "second"} {
+		stream, err := session.OpenStreamSync(ctx)
+		require.NoError(t, err)
+		_, err = stream.Write([]byte(msg))
+		require.NoError(t, err)
+
+		buf := make([]byte, len(msg))
+		_, err = io.ReadFull(stream, buf)
+		require.NoError(t, err)
+		require.Equal(t, msg, string(buf))
+		require.Equal(t, session.LocalAddr().(*net.UDPAddr).Port, (<-remotes).(*net.UDPAddr).Port)
+		stream.Close()
+	}
+}
+
+func TestWebTransportRejected(t *testing.T) {
+	filter := &IPFilter{IPRules: IPRules{Deny: []string{"127.0.0.1"}}}
+	require.NoError(t, filter.Compile())
+
+	tests := []struct {
+		desc   string
+		config *Config
+		path   string
+		header http.Header
+		status int
+	}{
+		{
+			desc:   "path",
+			config: &Config{TLSConfig: tlsConfigBasic, Websocket: &WebsocketConfig{Path: "/mqtt"}},
+			path:   "/other",
+			status: http.StatusNotFound,
+		},
+		{
+			desc:   "origin",
+			config: &Config{TLSConfig: tlsConfigBasic, Websocket: &WebsocketConfig{AllowedOrigins: []string{"app.example.com"}}},
+			path:   "/",
+			header: http.Header{"Origin": []string{"https://evil.example.com"}},
+			status: http.StatusBadRequest,
+		},
+		{
+			desc:   "ip filter",
+			config: &Config{TLSConfig: tlsConfigBasic, IPFilter: filter},
+			path:   "/",
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			l := NewWebTransport("wt1", "127.0.0.1:0", tt.config)
+			require.NoError(t, l.Init(logger))
+			go l.Serve(MockEstablisher)
+			defer l.Close(MockCloser)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			resp, _, err := dialWebTransport(t, ctx, "https://"+l.Address()+tt.path, tt.header)
+			require.Error(t, err)
+			require.NotNil(t, resp)
+			require.Equal(t, tt.status, resp.StatusCode)
+		})
+	}
+}
@@ -0,0 +1,123 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+// retainedPacingPoll is the interval at which paced retained delivery checks whether
+// the outbound queue of a client has drained.
+const retainedPacingPoll = 10 * time.Millisecond
+
+// RetainedPacing configures the delivery of retained messages to new subscriptions, so
+// that a broad filter matching many retained messages is delivered gradually behind the
+// live traffic of the client, rather than filling its outbound queue at once.
+type RetainedPacing struct {
+	// Threshold specifies the number of retained messages of a subscription which are
+	// delivered immediately. Any further messages are paced. All are paced when 0.
+	Threshold int `yaml:"threshold"`
+
+	// Rate specifies the maximum number of retained messages per second delivered to
+	// each paced subscription. Unlimited when 0.
+	Rate int64 `yaml:"rate"`
+
+	// MaxPending specifies the number of packets waiting in the outbound queue of a client
+	// above which paced delivery waits, so that live messages are written first. Defaults
+	// to a quarter of the maximum client writes pending.
+	MaxPending int32 `yaml:"max-pending"`
+}
+
+// immediate returns how many of the retained messages of a subscription are delivered
+// without pacing.
+func (p *RetainedPacing) immediate(n int) int {
+	if p == nil {
+		return n
+	}
+
+	return min(max(p.Threshold, 0), n)
+}
+
+// maxPending returns the outbound queue length above which paced delivery waits.
+func (p *RetainedPacing) maxPending(writesPending int32) int32 {
+	if p.MaxPending > 0 {
+		return p.MaxPending
+	}
+
+	return max(writesPending/4, 1)
+}
+
+// interval returns the time between paced retained messages.
+func (p *RetainedPacing) interval() time.Duration {
+	if p.Rate <= 0 {
+		return 0
+	}
+
+	return time.Second / time.Duration(p.Rate)
+}
+
+// paceRetained delivers retained messages to a subscription of a client at the configured
+// rate, waiting while the outbound queue or the send quota of the client are taken up by
+// live traffic. Delivery stops if the client disconnects or unsubscribes.
+func (s *Server) paceRetained(cl *Client, sub packets.Subscription, msgs []packets.Packet) {
+	p := s.Options.RetainedPacing
+	interval := p.interval()
+	maxPending := p.maxPending(s.Options.Capabilities.MaximumClientWritesPending)
+
+	next := time.Now()
+	for _, pk := range msgs {
+		for !retainedReady(cl, sub, pk, maxPending) {
+			if !s.pacingWait(cl, retainedPacingPoll) {
+				return
+			}
+		}
+
+		if d := time.Until(next); d > 0 && !s.pacingWait(cl, d) {
+			return
+		}
+
+		if _, ok := cl.State.Subscriptions.Get(sub.Filter); !ok {
+			return
+		}
+
+		s.publishRetained(cl, sub, pk)
+		if now := time.Now(); next.Before(now) {
+			next = now
+		}
+		next = next.Add(interval)
+	}
+}
+
+// retainedReady returns true if a paced retained message can be delivered to a client
+// without delaying its live traffic.
+func retainedReady(cl *Client, sub packets.Subscription, pk packets.Packet, maxPending int32) bool {
+	if atomic.LoadInt32(&cl.State.outboundQty) > maxPending {
+		return false
+	}
+
+	if min(pk.FixedHeader.Qos, sub.Qos) > 0 && atomic.LoadInt32(&cl.State.Inflight.maximumSendQuota) > 0 {
+		return atomic.LoadInt32(&cl.State.Inflight.sendQuota) > 0
+	}
+
+	return true
+}
+
+// pacingWait waits for a duration, returning false if the client or server stopped first.
+func (s *Server) pacingWait(cl *Client, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return !cl.Closed()
+	case <-cl.State.open.Done():
+		return false
+	case <-s.done:
+		return false
+	}
+}
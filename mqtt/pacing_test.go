@@ -0,0 +1,138 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+func TestRetainedPacingDefaults(t *testing.T) {
+	var p *RetainedPacing
+	require.Equal(t, 10, p.immediate(10))
+
+	p = &RetainedPacing{Threshold: 4}
+	require.Equal(t, 4, p.immediate(10))
+	require.Equal(t, 2, p.immediate(2))
+	require.Equal(t, int32(256), p.maxPending(1024))
+	require.Equal(t, int32(1), p.maxPending(2))
+	require.Equal(t, time.Duration(0), p.interval())
+
+	p = &RetainedPacing{MaxPending: 8, Rate: 100}
+	require.Equal(t, 0, p.immediate(10))
+	require.Equal(t, int32(8), p.maxPending(1024))
+	require.Equal(t, 10*time.Millisecond, p.interval())
+}
+
+// retainPacingPacketLen is the encoded length of each qos 0 retained message.
+const retainPacingPacketLen = 12
+
+func retainPacingMessages(s *Server, n int) {
+	for i := 0; i < n; i++ {
+		s.Topics.RetainMessage(packets.Packet{
+			FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true},
+			TopicName:   fmt.Sprintf("a/%d", i),
+			Payload:     []byte("hello"),
+			Created:     time.Now().Unix(),
+		})
+	}
+}
+
+func TestPublishRetainedToClientPaced(t *testing.T) {
+	s := newServer()
+	s.Options.RetainedPacing = &RetainedPacing{Threshold: 2, MaxPending: 1}
+	retainPacingMessages(s, 6)
+
+	cl, r, _ := newTestClient()
+	sub := packets.Subscription{Filter: "a/#"}
+	cl.State.Subscriptions.Add(sub.Filter, sub)
+
+	s.publishRetainedToClient(cl, sub, false)
+	require.Equal(t, int32(2), atomic.LoadInt32(&cl.State.outboundQty))
+
+	// the remaining messages are only queued as the client drains its queue
+	time.Sleep(retainedPacingPoll * 3)
+	require.Equal(t, int32(2), atomic.LoadInt32(&cl.State.outboundQty))
+
+	_ = r.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 6*retainPacingPacketLen)
+	_, err := io.ReadFull(r, buf)
+	require.NoError(t, err)
+}
+
+func TestPublishRetainedToClientPacedUnsubscribed(t *testing.T) {
+	s := newServer()
+	s.Options.RetainedPacing = &RetainedPacing{Rate: 20}
+	retainPacingMessages(s, 10)
+
+	cl, r, _ := newTestClient()
+	sub := packets.Subscription{Filter: "a/#"}
+	cl.State.Subscriptions.Add(sub.Filter, sub)
+
+	var received atomic.Int64
+	go func() {
+		buf := make([]byte, retainPacingPacketLen)
+		for {
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return
+			}
+			received.Add(1)
+		}
+	}()
+
+	s.publishRetainedToClient(cl, sub, false)
+	require.Eventually(t, func() bool {
+		return received.Load() > 0
+	}, time.Second, time.Millisecond)
+
+	cl.State.Subscriptions.Delete(sub.Filter)
+	time.Sleep(200 * time.Millisecond)
+	require.Less(t, received.Load(), int64(10))
+	_ = r.Close()
+}
+
+func TestPaceRetainedClientClosed(t *testing.T) {
+	s := newServer()
+	s.Options.RetainedPacing = &RetainedPacing{MaxPending: 1}
+	retainPacingMessages(s, 3)
+
+	cl, _, _ := newTestClient()
+	sub := packets.Subscription{Filter: "a/#"}
+	cl.State.Subscriptions.Add(sub.Filter, sub)
+	atomic.StoreInt32(&cl.State.outboundQty, 2)
+
+	done := make(chan bool)
+	go func() {
+		s.paceRetained(cl, sub, s.Topics.Messages(sub.Filter))
+		done <- true
+	}()
+
+	cl.Stop(nil)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		require.Fail(t, "paced delivery did not stop")
+	}
+}
+
+func TestRetainedReadySendQuota(t *testing.T) {
+	cl, _, _ := newTestClient()
+	pk := packets.Packet{FixedHeader: packets.FixedHeader{Qos: 1}}
+	sub := packets.Subscription{Qos: 1}
+	require.True(t, retainedReady(cl, sub, pk, 1))
+
+	atomic.StoreInt32(&cl.State.Inflight.sendQuota, 0)
+	require.False(t, retainedReady(cl, sub, pk, 1))
+	require.True(t, retainedReady(cl, packets.Subscription{}, pk, 1))
+
+	atomic.StoreInt32(&cl.State.outboundQty, 2)
+	require.False(t, retainedReady(cl, packets.Subscription{}, pk, 1))
+}
@@ -128,6 +128,12 @@ var (
 	ErrWildcardSubscriptionsNotSupported      = Code{Code: 0xA2, Reason: "wildcard subscriptions not supported"}
 	ErrInlineSubscriptionHandlerInvalid       = Code{Code: 0xA3, Reason: "inline subscription handler not valid."}
 
+	// Client identifier policy violations, sent as client identifier not valid.
+	ErrClientIdentifierTooShort      = Code{Code: 0x85, Reason: "client identifier too short"}
+	ErrClientIdentifierInvalidChars  = Code{Code: 0x85, Reason: "client identifier contains invalid characters"}
+	ErrClientIdentifierInvalidPrefix = Code{Code: 0x85, Reason: "client identifier missing required prefix"}
+	ErrClientIdentifierNotOwned      = Code{Code: 0x85, Reason: "client identifier not permitted for username"}
+
 	// MQTTv3 specific bytes.
 	Err3UnsupportedProtocolVersion = Code{Code: 0x01}
 	Err3ClientIdentifierNotValid   = Code{Code: 0x02}
@@ -139,11 +145,19 @@ var (
 	// This is required because MQTTv3 has different return byte specification.
 	// See http://docs.oasis-open.org/mqtt/mqtt/v3.1.1/os/mqtt-v3.1.1-os.html#_Toc385349257
 	V5CodesToV3 = map[Code]Code{
-		ErrUnsupportedProtocolVersion: Err3UnsupportedProtocolVersion,
-		ErrClientIdentifierNotValid:   Err3ClientIdentifierNotValid,
-		ErrServerUnavailable:          Err3ServerUnavailable,
-		ErrMalformedUsername:          ErrMalformedUsernameOrPassword,
-		ErrMalformedPassword:          ErrMalformedUsernameOrPassword,
-		ErrBadUsernameOrPassword:      Err3NotAuthorized,
+		ErrUnsupportedProtocolVersion:    Err3UnsupportedProtocolVersion,
+		ErrClientIdentifierNotValid:      Err3ClientIdentifierNotValid,
+		ErrClientIdentifierTooShort:      Err3ClientIdentifierNotValid,
+		ErrClientIdentifierTooLong:       Err3ClientIdentifierNotValid,
+		ErrClientIdentifierInvalidChars:  Err3ClientIdentifierNotValid,
+		ErrClientIdentifierInvalidPrefix: Err3ClientIdentifierNotValid,
+		ErrClientIdentifierNotOwned:      Err3ClientIdentifierNotValid,
+		ErrServerUnavailable:             Err3ServerUnavailable,
+		ErrServerBusy:                    Err3ServerUnavailable,
+		ErrMalformedUsername:             ErrMalformedUsernameOrPassword,
+		ErrMalformedPassword:             ErrMalformedUsernameOrPassword,
+		ErrBadUsernameOrPassword:         Err3NotAuthorized,
+		ErrQuotaExceeded:                 Err3NotAuthorized,
+		ErrBanned:                        Err3NotAuthorized,
 	}
 )
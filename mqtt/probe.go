@@ -0,0 +1,114 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"errors"
+	"math"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// ConnectionProbe configures the active probing of idle client connections, so that
+// half-open connections, such as those silently dropped by NAT gateways, are reaped
+// sooner than the one and a half times keepalive rule allows.
+//
+// MQTT does not allow the server to send pings, so idle connections are probed with tcp
+// keepalive, which is answered by the operating system of the client, and MQTT v5
+// clients are asked to ping at least once per idle timeout with a server keepalive.
+type ConnectionProbe struct {
+	// IdleTimeout specifies the number of seconds after which a connection which has not
+	// sent any packet is reaped, if shorter than one and a half times the client keepalive.
+	// Disabled when 0.
+	IdleTimeout int64 `yaml:"idle-timeout"`
+
+	// TCPKeepalive specifies the number of seconds a tcp connection is idle before tcp
+	// keepalive probes are sent. The operating system default is used when 0.
+	TCPKeepalive int64 `yaml:"tcp-keepalive"`
+
+	// TCPInterval specifies the number of seconds between unanswered tcp keepalive probes.
+	// The operating system default is used when 0.
+	TCPInterval int64 `yaml:"tcp-interval"`
+
+	// TCPCount specifies the number of unanswered tcp keepalive probes after which the
+	// connection is dropped. The operating system default is used when 0.
+	TCPCount int `yaml:"tcp-count"`
+}
+
+// keepalive returns the server keepalive in seconds which MQTT v5 clients are asked to
+// use, so that their pings arrive before the idle timeout, or 0 if not enabled.
+func (p *ConnectionProbe) keepalive() uint16 {
+	if p == nil || p.IdleTimeout <= 0 {
+		return 0
+	}
+
+	return uint16(min(p.IdleTimeout*2/3, math.MaxUint16))
+}
+
+// timeout returns the duration a connection may be idle, given the client keepalive.
+func (p *ConnectionProbe) timeout(keepalive uint16) time.Duration {
+	timeout := time.Duration(keepalive+(keepalive/2)) * time.Second // [MQTT-3.1.2-22]
+	if p == nil || p.IdleTimeout <= 0 {
+		return timeout
+	}
+
+	idle := time.Duration(p.IdleTimeout) * time.Second
+	if keepalive == 0 || idle < timeout {
+		return idle
+	}
+
+	return timeout
+}
+
+// probeConn enables tcp keepalive probes on the tcp connection underlying a client
+// connection, returning false if there is no tcp connection.
+func (p *ConnectionProbe) probeConn(c net.Conn) bool {
+	if p == nil || p.TCPKeepalive <= 0 && p.TCPInterval <= 0 && p.TCPCount <= 0 {
+		return false
+	}
+
+	for {
+		switch conn := c.(type) {
+		case *net.TCPConn:
+			return conn.SetKeepAliveConfig(net.KeepAliveConfig{
+				Enable:   true,
+				Idle:     p.seconds(p.TCPKeepalive),
+				Interval: p.seconds(p.TCPInterval),
+				Count:    p.count(),
+			}) == nil
+		case interface{ NetConn() net.Conn }: // tls and websocket connections
+			c = conn.NetConn()
+		default:
+			return false
+		}
+	}
+}
+
+// seconds returns a number of seconds as a keepalive config duration, where -1 selects
+// the operating system default.
+func (p *ConnectionProbe) seconds(v int64) time.Duration {
+	if v <= 0 {
+		return -1
+	}
+
+	return time.Duration(v) * time.Second
+}
+
+// count returns the keepalive config probe count, where -1 selects the operating system default.
+func (p *ConnectionProbe) count() int {
+	if p.TCPCount <= 0 {
+		return -1
+	}
+
+	return p.TCPCount
+}
+
+// isReaped returns true if a connection read error indicates the connection was idle for
+// too long or did not answer tcp keepalive probes.
+func isReaped(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, syscall.ETIMEDOUT)
+}
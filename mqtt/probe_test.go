@@ -0,0 +1,126 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+func TestConnectionProbeTimeout(t *testing.T) {
+	var p *ConnectionProbe
+	require.Equal(t, 15*time.Second, p.timeout(10))
+	require.Equal(t, time.Duration(0), p.timeout(0))
+
+	p = &ConnectionProbe{IdleTimeout: 60}
+	require.Equal(t, 15*time.Second, p.timeout(10))
+	require.Equal(t, 60*time.Second, p.timeout(0))
+	require.Equal(t, 60*time.Second, p.timeout(3600))
+}
+
+func TestConnectionProbeKeepalive(t *testing.T) {
+	var p *ConnectionProbe
+	require.Equal(t, uint16(0), p.keepalive())
+	require.Equal(t, uint16(40), (&ConnectionProbe{IdleTimeout: 60}).keepalive())
+	require.Equal(t, uint16(65535), (&ConnectionProbe{IdleTimeout: 1 << 20}).keepalive())
+}
+
+func TestConnectionProbeConn(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+
+	var p *ConnectionProbe
+	require.False(t, p.probeConn(c))
+	require.False(t, new(ConnectionProbe).probeConn(c))
+
+	p = &ConnectionProbe{TCPKeepalive: 30, TCPInterval: 5, TCPCount: 3}
+	require.True(t, p.probeConn(c))
+	require.True(t, p.probeConn(tls.Client(c, &tls.Config{})))
+
+	r, w := net.Pipe()
+	defer r.Close()
+	defer w.Close()
+	require.False(t, p.probeConn(r))
+}
+
+func TestIsReaped(t *testing.T) {
+	require.True(t, isReaped(os.ErrDeadlineExceeded))
+	require.True(t, isReaped(&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ETIMEDOUT)}))
+	require.False(t, isReaped(io.EOF))
+	require.False(t, isReaped(packets.ErrKeepAliveTimeout))
+}
+
+func TestServerProbeKeepalive(t *testing.T) {
+	s := newServer()
+	s.Options.ConnectionProbe = &ConnectionProbe{IdleTimeout: 60}
+
+	cl, _, _ := newTestClient()
+	cl.Properties.ProtocolVersion = 5
+	cl.State.Keepalive = 0
+	s.probeKeepalive(cl)
+	require.Equal(t, uint16(40), cl.State.Keepalive)
+	require.True(t, cl.State.ServerKeepalive)
+
+	cl, _, _ = newTestClient()
+	cl.Properties.ProtocolVersion = 5
+	cl.State.Keepalive = 20
+	s.probeKeepalive(cl)
+	require.Equal(t, uint16(20), cl.State.Keepalive)
+	require.False(t, cl.State.ServerKeepalive)
+
+	cl, _, _ = newTestClient()
+	cl.Properties.ProtocolVersion = 4
+	cl.State.Keepalive = 3600
+	s.probeKeepalive(cl)
+	require.Equal(t, uint16(3600), cl.State.Keepalive)
+	require.False(t, cl.State.ServerKeepalive)
+}
+
+func TestEstablishConnectionReaped(t *testing.T) {
+	s := newServer()
+	s.Options.ConnectionProbe = &ConnectionProbe{IdleTimeout: 1}
+	defer s.Close()
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r)
+	}()
+
+	go func() {
+		_, _ = w.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectClean).RawBytes)
+	}()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, _ := io.ReadAll(w)
+		recv <- buf
+	}()
+
+	select {
+	case err := <-o:
+		require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle connection was not reaped")
+	}
+
+	require.Equal(t, packets.TPacketData[packets.Connack].Get(packets.TConnackAcceptedNoSession).RawBytes, <-recv)
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.ClientsReaped))
+	_ = w.Close()
+}
@@ -0,0 +1,104 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	ConnectRateLimitKey   = "connect"     // the rate limit key of the connection rate of the broker
+	ConnectIPRateLimitKey = "connect-ip:" // the rate limit key prefix of the connection rates of source ips
+	GroupRateLimitKey     = "group:"      // the rate limit key prefix of the publish rates of group members
+	UserRateLimitKey      = "user:"       // the rate limit key prefix of the publish rates of usernames
+	ClientRateLimitKey    = "client:"     // the rate limit key prefix of the publish rates of clients without a username
+)
+
+// RateLimiter takes tokens from token buckets which limit the rate of connections and
+// publishes. The default limiter keeps the buckets in memory, so each node enforces its
+// own limits. A limiter shared by the nodes of a cluster, such as the redis limiter,
+// enforces limits across the cluster, so that clients cannot multiply their quota by
+// connecting to different nodes.
+type RateLimiter interface {
+	// Take takes a token from the bucket of a key, which holds up to burst tokens and is
+	// refilled with rate tokens per second, returning false if the bucket is empty.
+	Take(key string, rate, burst int64, now time.Time) (bool, error)
+}
+
+// takeToken takes a token from a bucket of a limiter. Limits are not enforced if the
+// limiter fails, so that an unavailable shared limiter cannot take the broker down.
+func takeToken(l RateLimiter, key string, rate, burst int64, now time.Time) bool {
+	if burst < rate {
+		burst = rate
+	}
+
+	ok, err := l.Take(key, rate, burst, now)
+	return ok || err != nil
+}
+
+// tokenBucket is a token bucket held in memory.
+type tokenBucket struct {
+	tokens  float64   // the tokens in the bucket
+	updated time.Time // the time the bucket was last refilled
+	full    time.Time // the time at which the bucket will be full again
+}
+
+// MemoryRateLimiter is a RateLimiter which keeps token buckets in memory.
+type MemoryRateLimiter struct {
+	internal map[string]*tokenBucket
+	sync.Mutex
+}
+
+// NewMemoryRateLimiter returns a new instance of MemoryRateLimiter.
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	return &MemoryRateLimiter{
+		internal: map[string]*tokenBucket{},
+	}
+}
+
+// Take takes a token from the bucket of a key.
+func (l *MemoryRateLimiter) Take(key string, rate, burst int64, now time.Time) (bool, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	b, ok := l.internal[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), updated: now}
+		l.internal[key] = b
+	}
+
+	if elapsed := now.Sub(b.updated); elapsed > 0 {
+		b.tokens = min(float64(burst), b.tokens+elapsed.Seconds()*float64(rate))
+		b.updated = now
+	}
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+
+	b.full = b.updated.Add(time.Duration((float64(burst) - b.tokens) / float64(rate) * float64(time.Second)))
+	return allowed, nil
+}
+
+// ClearExpired removes buckets which have refilled, as they are the same as new buckets.
+func (l *MemoryRateLimiter) ClearExpired(now time.Time) {
+	l.Lock()
+	defer l.Unlock()
+
+	for key, b := range l.internal {
+		if !now.Before(b.full) {
+			delete(l.internal, key)
+		}
+	}
+}
+
+// Len returns the number of buckets held.
+func (l *MemoryRateLimiter) Len() int {
+	l.Lock()
+	defer l.Unlock()
+	return len(l.internal)
+}
@@ -0,0 +1,127 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+type failingRateLimiter struct{}
+
+func (l failingRateLimiter) Take(key string, rate, burst int64, now time.Time) (bool, error) {
+	return false, errors.New("unavailable")
+}
+
+func TestMemoryRateLimiterTake(t *testing.T) {
+	l := NewMemoryRateLimiter()
+	now := time.Unix(100, 0)
+
+	for i := 0; i < 3; i++ {
+		ok, err := l.Take("a", 2, 3, now)
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+
+	ok, _ := l.Take("a", 2, 3, now)
+	require.False(t, ok)
+	ok, _ = l.Take("b", 2, 3, now)
+	require.True(t, ok)
+
+	ok, _ = l.Take("a", 2, 3, now.Add(500*time.Millisecond))
+	require.True(t, ok)
+	ok, _ = l.Take("a", 2, 3, now.Add(500*time.Millisecond))
+	require.False(t, ok)
+}
+
+func TestMemoryRateLimiterClearExpired(t *testing.T) {
+	l := NewMemoryRateLimiter()
+	now := time.Unix(100, 0)
+	_, _ = l.Take("a", 1, 2, now)
+	_, _ = l.Take("b", 1, 1, now)
+	require.Equal(t, 2, l.Len())
+
+	l.ClearExpired(now.Add(time.Second))
+	require.Equal(t, 0, l.Len())
+
+	_, _ = l.Take("a", 1, 2, now)
+	_, _ = l.Take("a", 1, 2, now)
+	l.ClearExpired(now.Add(time.Second))
+	require.Equal(t, 1, l.Len())
+	l.ClearExpired(now.Add(2 * time.Second))
+	require.Equal(t, 0, l.Len())
+}
+
+func TestTakeTokenFailOpen(t *testing.T) {
+	require.True(t, takeToken(failingRateLimiter{}, "a", 1, 1, time.Now()))
+}
+
+func TestServerSetRateLimiter(t *testing.T) {
+	s := New(&Options{Logger: logger, ConnectRateLimit: 1})
+	l := NewMemoryRateLimiter()
+	s.SetRateLimiter(l)
+	require.Equal(t, l, s.limiter)
+	require.Equal(t, l, s.Groups.limiter)
+	require.Equal(t, l, s.Throttle.limiter)
+
+	ok, _, _ := s.Throttle.Allow("a", 100, false)
+	require.True(t, ok)
+	ok, _ = l.Take(ConnectRateLimitKey, 1, 1, time.Unix(100, 0))
+	require.False(t, ok)
+}
+
+func TestServerAllowUserPublish(t *testing.T) {
+	s := newServer()
+	cl, _, _ := newTestClient()
+	require.True(t, s.allowUserPublish(cl))
+
+	s.Options.UserPublishRate = 1
+	s.Options.UserPublishBurst = 2
+	cl.Properties.Username = []byte("user")
+	require.True(t, s.allowUserPublish(cl))
+	require.True(t, s.allowUserPublish(cl))
+	require.False(t, s.allowUserPublish(cl))
+
+	// clients with the same username share the quota
+	cl2, _, _ := newTestClient()
+	cl2.ID = "other"
+	cl2.Properties.Username = []byte("user")
+	require.False(t, s.allowUserPublish(cl2))
+
+	// clients without a username are limited on their client id
+	cl2.Properties.Username = nil
+	require.True(t, s.allowUserPublish(cl2))
+}
+
+func TestServerProcessPublishUserRateLimited(t *testing.T) {
+	s := newServer()
+	s.Options.UserPublishRate = 1
+	cl, r, w := newTestClient()
+	cl.Properties.ProtocolVersion = 5
+	cl.Properties.Username = []byte("user")
+	s.Clients.Add(cl)
+
+	pk := *packets.TPacketData[packets.Publish].Get(packets.TPublishQos1).Packet
+	require.True(t, s.allowUserPublish(cl))
+
+	go func() {
+		err := s.processPacket(cl, pk)
+		require.NoError(t, err)
+		_ = w.Close()
+	}()
+
+	buf := make([]byte, 64)
+	n, _ := r.Read(buf)
+	ack := packets.Packet{ProtocolVersion: 5}
+	require.NoError(t, ack.FixedHeader.Decode(buf[0]))
+	require.Equal(t, packets.Puback, ack.FixedHeader.Type)
+	ack.FixedHeader.Remaining = int(buf[1])
+	require.NoError(t, ack.PubackDecode(buf[2:n]))
+	require.Equal(t, packets.ErrQuotaExceeded.Code, ack.ReasonCode)
+}
@@ -1,28 +1,42 @@
 package rest
 
 import (
+	"sort"
+
 	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
 )
 
 type client struct {
-	ID              string   `json:"id"`
-	IP              string   `json:"ip"`
-	Online          bool     `json:"online"`
-	Username        string   `json:"username"`
-	TopicFilters    []string `json:"topic_filters"`
-	ProtocolVersion byte     `json:"protocol_version"`
-	SessionClean    bool     `json:"session_clean"`
-	WillTopicName   string   `json:"will_topic_name"`
-	WillPayload     string   `json:"will_payload"`
-	WillRetain      bool     `json:"will_retain"`
-	InflightCount   int      `json:"inflight_count"`
+	ID              string         `json:"id"`
+	IP              string         `json:"ip"`
+	Online          bool           `json:"online"`
+	Username        string         `json:"username"`
+	TopicFilters    []string       `json:"topic_filters"`
+	Subscriptions   []subscription `json:"subscriptions"`
+	ProtocolVersion byte           `json:"protocol_version"`
+	SessionClean    bool           `json:"session_clean"`
+	WillTopicName   string         `json:"will_topic_name"`
+	WillPayload     string         `json:"will_payload"`
+	WillRetain      bool           `json:"will_retain"`
+	InflightCount   int            `json:"inflight_count"`
+	SendQuota       int32          `json:"send_quota"`
+	SendMaximum     int32          `json:"send_maximum"`
+	ReceiveQuota    int32          `json:"receive_quota"`
+	ReceiveMaximum  int32          `json:"receive_maximum"`
+	FlowStalls      int64          `json:"flow_stalls"`
+	Groups          []string       `json:"groups"`
 }
 
 func genClient(cl *mqtt.Client) client {
-	filters := make([]string, 0, len(cl.State.Subscriptions.GetAll()))
-	for k := range cl.State.Subscriptions.GetAll() {
+	subs := cl.State.Subscriptions.GetAll()
+	filters := make([]string, 0, len(subs))
+	subscriptions := make([]subscription, 0, len(subs))
+	for k, sub := range subs {
 		filters = append(filters, k)
+		subscriptions = append(subscriptions, genSubscription(sub))
 	}
+	sort.Slice(subscriptions, func(i, j int) bool { return subscriptions[i].Filter < subscriptions[j].Filter })
 
 	nc := client{
 		ID:              cl.ID,
@@ -30,12 +44,16 @@ func genClient(cl *mqtt.Client) client {
 		Online:          !cl.Closed(),
 		Username:        string(cl.Properties.Username),
 		TopicFilters:    filters,
+		Subscriptions:   subscriptions,
 		ProtocolVersion: cl.Properties.ProtocolVersion,
 		SessionClean:    cl.Properties.Clean,
 		WillTopicName:   cl.Properties.Will.TopicName,
 		WillRetain:      cl.Properties.Will.Retain,
 		InflightCount:   cl.State.Inflight.Len(),
+		FlowStalls:      cl.State.Inflight.Stalls(),
 	}
+	nc.SendQuota, nc.SendMaximum = cl.State.Inflight.SendQuota()
+	nc.ReceiveQuota, nc.ReceiveMaximum = cl.State.Inflight.ReceiveQuota()
 	if cl.Properties.Will.Payload != nil {
 		nc.WillPayload = string(cl.Properties.Will.Payload)
 	}
@@ -43,9 +61,51 @@ func genClient(cl *mqtt.Client) client {
 	return nc
 }
 
+type subscription struct {
+	Filter            string `json:"filter"`
+	Qos               byte   `json:"qos"`
+	NoLocal           bool   `json:"no_local"`
+	RetainAsPublished bool   `json:"retain_as_published"`
+	RetainHandling    byte   `json:"retain_handling"`
+	Identifier        int    `json:"identifier,omitempty"`
+}
+
+func genSubscription(sub packets.Subscription) subscription {
+	return subscription{
+		Filter:            sub.Filter,
+		Qos:               sub.Qos,
+		NoLocal:           sub.NoLocal,
+		RetainAsPublished: sub.RetainAsPublished,
+		RetainHandling:    sub.RetainHandling,
+		Identifier:        sub.Identifier,
+	}
+}
+
 type message struct {
 	TopicName string `json:"topic_name"`
 	Payload   string `json:"payload"`
 	Retain    bool   `json:"retain"`
 	Qos       byte   `json:"qos"`
 }
+
+type receiveMaximum struct {
+	ReceiveMaximum uint16 `json:"receive_maximum"`
+}
+
+type groupMessage struct {
+	Payload string `json:"payload"`
+	Retain  bool   `json:"retain"`
+	Qos     byte   `json:"qos"`
+}
+
+// eventCredentials are the credentials of an event stream client exchanged for a token.
+type eventCredentials struct {
+	ClientID string `json:"client_id"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type eventToken struct {
+	Token   string `json:"token"`
+	Expires int64  `json:"expires"`
+}
@@ -2,21 +2,77 @@ package rest
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/faults"
+	"github.com/wind-c/comqtt/v2/mqtt/listeners"
 	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"io"
 	"net/http"
 	"slices"
+	"time"
 )
 
 const (
-	MqttGetOverallPath     = "/api/v1/mqtt/stat/overall"
-	MqttGetOnlinePath      = "/api/v1/mqtt/stat/online"
-	MqttGetClientPath      = "/api/v1/mqtt/clients/{id}"
-	MqttGetBlacklistPath   = "/api/v1/mqtt/blacklist"
-	MqttAddBlacklistPath   = "/api/v1/mqtt/blacklist/{id}"
-	MqttDelBlacklistPath   = "/api/v1/mqtt/blacklist/{id}"
-	MqttPublishMessagePath = "/api/v1/mqtt/message"
-	MqttGetConfigPath      = "/api/v1/mqtt/config"
+	MqttGetOverallPath       = "/api/v1/mqtt/stat/overall"
+	MqttGetOnlinePath        = "/api/v1/mqtt/stat/online"
+	MqttGetTopicStatsPath    = "/api/v1/mqtt/stat/topics"
+	MqttGetUserStatsPath     = "/api/v1/mqtt/stat/users"
+	MqttGetTenantStatsPath   = "/api/v1/mqtt/stat/tenants"
+	MqttGetClientPath        = "/api/v1/mqtt/clients/{id}"
+	MqttClientReceiveMax     = "/api/v1/mqtt/clients/{id}/receive-maximum"
+	MqttClientSessionPath    = "/api/v1/mqtt/clients/{id}/session"
+	MqttSessionImportPath    = "/api/v1/mqtt/sessions/import"
+	MqttGetBlacklistPath     = "/api/v1/mqtt/blacklist"
+	MqttAddBlacklistPath     = "/api/v1/mqtt/blacklist/{id}"
+	MqttDelBlacklistPath     = "/api/v1/mqtt/blacklist/{id}"
+	MqttBansPath             = "/api/v1/mqtt/blacklist/bans"
+	MqttBanPath              = "/api/v1/mqtt/blacklist/bans/{kind}/{value}"
+	MqttPublishMessagePath   = "/api/v1/mqtt/message"
+	MqttGetConfigPath        = "/api/v1/mqtt/config"
+	MqttGetGroupsPath        = "/api/v1/mqtt/groups"
+	MqttGroupPath            = "/api/v1/mqtt/groups/{name}"
+	MqttGroupClientPath      = "/api/v1/mqtt/groups/{name}/clients/{id}"
+	MqttGroupPublishPath     = "/api/v1/mqtt/groups/{name}/publish"
+	MqttGroupKickPath        = "/api/v1/mqtt/groups/{name}/kick"
+	MqttCapturePath          = "/api/v1/mqtt/capture"
+	MqttCaptureFilePath      = "/api/v1/mqtt/capture/file"
+	MqttEventsPath           = "/api/v1/mqtt/events"
+	MqttEventTokenPath       = "/api/v1/mqtt/events/token"
+	MqttFreezePath           = "/api/v1/mqtt/freeze"
+	MqttSchedulePath         = "/api/v1/mqtt/schedule"
+	MqttScheduleJobPath      = "/api/v1/mqtt/schedule/{name}"
+	MqttRunJobPath           = "/api/v1/mqtt/schedule/{name}/run"
+	MqttFaultsPath           = "/api/v1/mqtt/faults"
+	MqttFaultPath            = "/api/v1/mqtt/faults/{point}"
+	MqttGetHooksPath         = "/api/v1/mqtt/hooks"
+	MqttEnableHookPath       = "/api/v1/mqtt/hooks/{id}/enable"
+	MqttRetainedExportPath   = "/api/v1/mqtt/retained/export"
+	MqttRetainedImportPath   = "/api/v1/mqtt/retained/import"
+	MqttRetainedLimitsPath   = "/api/v1/mqtt/retained/limits"
+	MqttSnapshotPath         = "/api/v1/mqtt/snapshot"
+	MqttTieringPath          = "/api/v1/mqtt/tiering"
+	MqttWALPath              = "/api/v1/mqtt/wal"
+	MqttListenerIPFilterPath = "/api/v1/mqtt/listeners/{id}/ip-filter"
+	MqttAuthCachePath        = "/api/v1/mqtt/auth/cache"
+	MqttAuthCacheKeyPath     = "/api/v1/mqtt/auth/cache/{key}"
+	MqttAuthMetricsPath      = "/api/v1/mqtt/auth/metrics"
+	MqttAuthFailuresPath     = "/api/v1/mqtt/auth/failures"
+	MqttStorageMetricsPath   = "/api/v1/mqtt/storage/metrics"
+	MqttAuthFailurePath      = "/api/v1/mqtt/auth/failures/{kind}/{value}"
+	LivezPath                = "/livez"
+	ReadyzPath               = "/readyz"
+	StartupzPath             = "/startupz"
+)
+
+// eventKeepalive is the interval at which comments are sent to idle event streams,
+// preventing proxies from closing the connection.
+const eventKeepalive = 15 * time.Second
+
+const (
+	EventUsernameHeader = "X-Mqtt-Username" // the username of an event stream client
+	EventPasswordHeader = "X-Mqtt-Password" // the password of an event stream client
 )
 
 type Handler = func(http.ResponseWriter, *http.Request)
@@ -33,14 +89,70 @@ func New(server *mqtt.Server) *Rest {
 
 func (s *Rest) GenHandlers() map[string]Handler {
 	return map[string]Handler{
-		"GET " + MqttGetConfigPath:       s.viewConfig,
-		"GET " + MqttGetOverallPath:      s.getOverallInfo,
-		"GET " + MqttGetOnlinePath:       s.getOnlineCount,
-		"GET " + MqttGetClientPath:       s.getClient,
-		"GET " + MqttGetBlacklistPath:    s.blacklist,
-		"POST " + MqttAddBlacklistPath:   s.kickClient,
-		"DELETE " + MqttDelBlacklistPath: s.blanchClient,
-		"POST " + MqttPublishMessagePath: s.publishMessage,
+		"GET " + MqttGetConfigPath:           s.viewConfig,
+		"GET " + MqttGetOverallPath:          s.getOverallInfo,
+		"GET " + MqttGetOnlinePath:           s.getOnlineCount,
+		"GET " + MqttGetTopicStatsPath:       s.getTopicStats,
+		"GET " + MqttGetUserStatsPath:        s.getUserStats,
+		"GET " + MqttGetTenantStatsPath:      s.getTenantStats,
+		"GET " + MqttGetClientPath:           s.getClient,
+		"PUT " + MqttClientReceiveMax:        s.setClientReceiveMaximum,
+		"GET " + MqttClientSessionPath:       s.exportSession,
+		"POST " + MqttSessionImportPath:      s.importSession,
+		"GET " + MqttGetBlacklistPath:        s.blacklist,
+		"POST " + MqttAddBlacklistPath:       s.kickClient,
+		"DELETE " + MqttDelBlacklistPath:     s.blanchClient,
+		"GET " + MqttBansPath:                s.getBans,
+		"POST " + MqttBanPath:                s.ban,
+		"DELETE " + MqttBanPath:              s.unban,
+		"POST " + MqttPublishMessagePath:     s.publishMessage,
+		"GET " + MqttGetGroupsPath:           s.getGroups,
+		"GET " + MqttGroupPath:               s.getGroup,
+		"PUT " + MqttGroupPath:               s.setGroup,
+		"DELETE " + MqttGroupPath:            s.deleteGroup,
+		"POST " + MqttGroupClientPath:        s.addGroupClient,
+		"DELETE " + MqttGroupClientPath:      s.removeGroupClient,
+		"POST " + MqttGroupPublishPath:       s.publishGroup,
+		"POST " + MqttGroupKickPath:          s.kickGroup,
+		"GET " + MqttCapturePath:             s.getCapture,
+		"POST " + MqttCapturePath:            s.startCapture,
+		"DELETE " + MqttCapturePath:          s.stopCapture,
+		"GET " + MqttCaptureFilePath:         s.getCaptureFile,
+		"GET " + MqttEventsPath:              s.subscribeEvents,
+		"POST " + MqttEventTokenPath:         s.issueEventToken,
+		"GET " + MqttFreezePath:              s.getFreeze,
+		"PUT " + MqttFreezePath:              s.freeze,
+		"DELETE " + MqttFreezePath:           s.unfreeze,
+		"GET " + MqttSchedulePath:            s.getSchedule,
+		"POST " + MqttSchedulePath:           s.addJob,
+		"GET " + MqttScheduleJobPath:         s.getJob,
+		"DELETE " + MqttScheduleJobPath:      s.removeJob,
+		"POST " + MqttRunJobPath:             s.runJob,
+		"GET " + MqttFaultsPath:              s.getFaults,
+		"POST " + MqttFaultsPath:             s.setFault,
+		"DELETE " + MqttFaultsPath:           s.clearFaults,
+		"DELETE " + MqttFaultPath:            s.clearFault,
+		"GET " + MqttGetHooksPath:            s.getHooks,
+		"POST " + MqttEnableHookPath:         s.enableHook,
+		"GET " + MqttRetainedExportPath:      s.exportRetained,
+		"POST " + MqttRetainedImportPath:     s.importRetained,
+		"GET " + MqttRetainedLimitsPath:      s.getRetainedLimits,
+		"GET " + MqttTieringPath:             s.getTiering,
+		"GET " + MqttWALPath:                 s.getWAL,
+		"GET " + MqttSnapshotPath:            s.exportSnapshot,
+		"POST " + MqttSnapshotPath:           s.restoreSnapshot,
+		"GET " + MqttListenerIPFilterPath:    s.getIPFilter,
+		"PUT " + MqttListenerIPFilterPath:    s.setIPFilter,
+		"DELETE " + MqttListenerIPFilterPath: s.clearIPFilter,
+		"DELETE " + MqttAuthCachePath:        s.purgeAuthCache,
+		"DELETE " + MqttAuthCacheKeyPath:     s.invalidateAuthCache,
+		"GET " + MqttAuthMetricsPath:         s.getAuthMetrics,
+		"GET " + MqttAuthFailuresPath:        s.getAuthFailures,
+		"DELETE " + MqttAuthFailurePath:      s.clearAuthFailure,
+		"GET " + MqttStorageMetricsPath:      s.getStorageMetrics,
+		"GET " + LivezPath:                   s.livez,
+		"GET " + ReadyzPath:                  s.readyz,
+		"GET " + StartupzPath:                s.startupz,
 	}
 }
 
@@ -63,17 +175,134 @@ func (s *Rest) getOnlineCount(w http.ResponseWriter, r *http.Request) {
 	Ok(w, count)
 }
 
+// getTopicStats return the statistics of topic trees
+// GET api/v1/mqtt/stat/topics
+func (s *Rest) getTopicStats(w http.ResponseWriter, r *http.Request) {
+	if s.server.TopicStats == nil {
+		Error(w, http.StatusNotFound, "topic stats not enabled")
+		return
+	}
+
+	if prefix := r.URL.Query().Get("prefix"); prefix != "" {
+		if st, ok := s.server.TopicStats.Get(prefix); ok {
+			Ok(w, st)
+		} else {
+			Error(w, http.StatusNotFound, "topic prefix not found")
+		}
+		return
+	}
+
+	Ok(w, s.server.TopicStats.GetAll())
+}
+
+// getUserStats return the usage of each username since the broker started
+// GET api/v1/mqtt/stat/users
+func (s *Rest) getUserStats(w http.ResponseWriter, r *http.Request) {
+	if s.server.Usage == nil {
+		Error(w, http.StatusNotFound, "usage stats not enabled")
+		return
+	}
+
+	s.usageStats(w, s.server.Usage.Users(time.Now().Unix()), r.URL.Query().Get("user"))
+}
+
+// getTenantStats return the usage of each tenant since the broker started
+// GET api/v1/mqtt/stat/tenants
+func (s *Rest) getTenantStats(w http.ResponseWriter, r *http.Request) {
+	if s.server.Usage == nil {
+		Error(w, http.StatusNotFound, "usage stats not enabled")
+		return
+	}
+
+	s.usageStats(w, s.server.Usage.Tenants(time.Now().Unix()), r.URL.Query().Get("tenant"))
+}
+
+// usageStats writes all usage stats, or only the stats of name if it is not empty.
+func (s *Rest) usageStats(w http.ResponseWriter, stats []mqtt.UsageStat, name string) {
+	if name == "" {
+		Ok(w, stats)
+		return
+	}
+
+	for _, st := range stats {
+		if st.Name == name {
+			Ok(w, st)
+			return
+		}
+	}
+
+	Error(w, http.StatusNotFound, "usage not found")
+}
+
 // getClient return a client information
 // GET api/v1/mqtt/clients/{id}
 func (s *Rest) getClient(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 	if cl, ol := s.server.Clients.Get(id); ol {
-		Ok(w, genClient(cl))
+		nc := genClient(cl)
+		nc.Groups = s.server.Groups.GroupsOf(id)
+		Ok(w, nc)
 	} else {
 		Error(w, http.StatusNotFound, "client not found")
 	}
 }
 
+// exportSession download the session of a client with its subscriptions, inflight and queued messages as json
+// GET api/v1/mqtt/clients/{id}/session
+func (s *Rest) exportSession(w http.ResponseWriter, r *http.Request) {
+	se, err := s.server.ExportSession(r.PathValue("id"))
+	if err != nil {
+		Error(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	Ok(w, se)
+}
+
+// importSession restore a session exported from another node, replacing an existing disconnected session only if overwrite is true
+// POST api/v1/mqtt/sessions/import?overwrite=false
+func (s *Rest) importSession(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	overwrite := r.URL.Query().Get("overwrite") == "true"
+	res, err := s.server.ImportSession(r.Body, overwrite)
+	if errors.Is(err, mqtt.ErrSessionFrozen) || errors.Is(err, mqtt.ErrSessionExists) || errors.Is(err, mqtt.ErrSessionConnected) {
+		Error(w, http.StatusConflict, err.Error())
+		return
+	} else if err != nil {
+		Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	Ok(w, res)
+}
+
+// setClientReceiveMaximum change the receive maximum applied to messages sent to a client
+// PUT api/v1/mqtt/clients/{id}/receive-maximum
+func (s *Rest) setClientReceiveMaximum(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var rm receiveMaximum
+	if err := json.NewDecoder(r.Body).Decode(&rm); err != nil {
+		Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if rm.ReceiveMaximum == 0 {
+		Error(w, http.StatusBadRequest, "receive maximum must be greater than 0")
+		return
+	}
+
+	cl, ok := s.server.Clients.Get(r.PathValue("id"))
+	if !ok || cl.Closed() {
+		Error(w, http.StatusNotFound, "client not found")
+		return
+	}
+
+	rm.ReceiveMaximum = s.server.SetClientReceiveMaximum(cl, rm.ReceiveMaximum)
+	Ok(w, rm)
+}
+
 // publishMessage a message
 // POST api/v1/mqtt/message
 func (s *Rest) publishMessage(w http.ResponseWriter, r *http.Request) {
@@ -92,37 +321,730 @@ func (s *Rest) publishMessage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// kickClient disconnect the client and add it to the blacklist
+// kickClient disconnect the client and ban its client id in the auth blacklist
 // POST api/v1/mqtt/blacklist/{id}
 func (s *Rest) kickClient(w http.ResponseWriter, r *http.Request) {
-	cid := r.PathValue("id")
-	if !slices.Contains(s.server.Blacklist, cid) {
-		s.server.Blacklist = append(s.server.Blacklist, cid)
+	if s.server.Bans == nil {
+		Error(w, http.StatusNotFound, "auth blacklist not enabled")
+		return
 	}
-	if cl, ol := s.server.Clients.Get(cid); ol {
-		s.server.DisconnectClient(cl, packets.ErrNotAuthorized)
-		Ok(w, cid)
-	} else {
+
+	cid := r.PathValue("id")
+	n, err := s.server.Bans.Ban(mqtt.BanClient, cid)
+	if err != nil {
+		Error(w, http.StatusBadRequest, err.Error())
+	} else if n == 0 {
 		Error(w, http.StatusNotFound, "client not found")
+	} else {
+		Ok(w, cid)
 	}
 }
 
-// blanchClient remove from the blacklist
+// blanchClient remove the ban of a client id from the auth blacklist
 // DELETE api/v1/mqtt/blacklist/{id}
 func (s *Rest) blanchClient(w http.ResponseWriter, r *http.Request) {
 	cid := r.PathValue("id")
-	if slices.Contains(s.server.Blacklist, cid) {
-		slices.DeleteFunc(s.server.Blacklist, func(s string) bool { return s == cid })
-		Ok(w, cid)
+	if s.server.Bans == nil || !s.server.Bans.Unban(mqtt.BanClient, cid) {
+		Error(w, http.StatusNotFound, "client not found")
+		return
 	}
+
+	Ok(w, cid)
 }
 
-// blacklist return to the blacklist
+// blacklist return the client ids banned in the auth blacklist
 // GET api/v1/mqtt/blacklist
 func (s *Rest) blacklist(w http.ResponseWriter, r *http.Request) {
-	if s.server.Blacklist == nil {
+	if s.server.Bans == nil {
 		Error(w, http.StatusNotFound, "blacklist not found")
+		return
+	}
+
+	ids := make([]string, 0)
+	for _, ban := range s.server.Bans.Bans() {
+		if ban.Kind == mqtt.BanClient {
+			ids = append(ids, ban.Value)
+		}
+	}
+	Ok(w, ids)
+}
+
+// getBans return the client ids, usernames and ips banned at runtime by the auth blacklist
+// GET api/v1/mqtt/blacklist/bans
+func (s *Rest) getBans(w http.ResponseWriter, r *http.Request) {
+	if s.server.Bans == nil {
+		Error(w, http.StatusNotFound, "auth blacklist not enabled")
+		return
+	}
+
+	Ok(w, s.server.Bans.Bans())
+}
+
+// ban bans a client id, username or ip in the auth blacklist, disconnecting the matching clients
+// POST api/v1/mqtt/blacklist/bans/{kind}/{value}
+func (s *Rest) ban(w http.ResponseWriter, r *http.Request) {
+	if s.server.Bans == nil {
+		Error(w, http.StatusNotFound, "auth blacklist not enabled")
+		return
+	}
+
+	n, err := s.server.Bans.Ban(r.PathValue("kind"), r.PathValue("value"))
+	if err != nil {
+		Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	Ok(w, n)
+}
+
+// unban removes a ban from the auth blacklist
+// DELETE api/v1/mqtt/blacklist/bans/{kind}/{value}
+func (s *Rest) unban(w http.ResponseWriter, r *http.Request) {
+	if s.server.Bans == nil || !s.server.Bans.Unban(r.PathValue("kind"), r.PathValue("value")) {
+		Error(w, http.StatusNotFound, "ban not found")
+		return
+	}
+
+	Ok(w, r.PathValue("value"))
+}
+
+// getGroups return all client groups
+// GET api/v1/mqtt/groups
+func (s *Rest) getGroups(w http.ResponseWriter, r *http.Request) {
+	Ok(w, s.server.Groups.GetAll())
+}
+
+// getGroup return a client group
+// GET api/v1/mqtt/groups/{name}
+func (s *Rest) getGroup(w http.ResponseWriter, r *http.Request) {
+	if group, ok := s.server.Groups.Get(r.PathValue("name")); ok {
+		Ok(w, group)
+	} else {
+		Error(w, http.StatusNotFound, mqtt.ErrGroupNotFound.Error())
+	}
+}
+
+// setGroup create or update the configuration of a client group
+// PUT api/v1/mqtt/groups/{name}
+func (s *Rest) setGroup(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var group mqtt.ClientGroup
+	if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+		Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	group.Name = r.PathValue("name")
+	s.server.Groups.Set(group)
+	group, _ = s.server.Groups.Get(group.Name)
+	Ok(w, group)
+}
+
+// deleteGroup remove a client group
+// DELETE api/v1/mqtt/groups/{name}
+func (s *Rest) deleteGroup(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if _, ok := s.server.Groups.Get(name); !ok {
+		Error(w, http.StatusNotFound, mqtt.ErrGroupNotFound.Error())
+		return
+	}
+
+	s.server.Groups.Delete(name)
+	Ok(w, name)
+}
+
+// addGroupClient add a client to a group
+// POST api/v1/mqtt/groups/{name}/clients/{id}
+func (s *Rest) addGroupClient(w http.ResponseWriter, r *http.Request) {
+	name, cid := r.PathValue("name"), r.PathValue("id")
+	s.server.Groups.Add(name, cid)
+	Ok(w, cid)
+}
+
+// removeGroupClient remove a client from a group
+// DELETE api/v1/mqtt/groups/{name}/clients/{id}
+func (s *Rest) removeGroupClient(w http.ResponseWriter, r *http.Request) {
+	name, cid := r.PathValue("name"), r.PathValue("id")
+	if !slices.Contains(s.server.Groups.GroupsOf(cid), name) {
+		Error(w, http.StatusNotFound, "client not in group")
+		return
+	}
+
+	s.server.Groups.Remove(name, cid)
+	Ok(w, cid)
+}
+
+// publishGroup publish a message to the command topic of each member of a group
+// POST api/v1/mqtt/groups/{name}/publish
+func (s *Rest) publishGroup(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var msg groupMessage
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	n, err := s.server.PublishToGroup(r.PathValue("name"), []byte(msg.Payload), msg.Retain, msg.Qos)
+	if errors.Is(err, mqtt.ErrGroupNotFound) {
+		Error(w, http.StatusNotFound, err.Error())
+	} else if err != nil {
+		Error(w, http.StatusBadRequest, err.Error())
+	} else {
+		Ok(w, n)
+	}
+}
+
+// kickGroup disconnect all members of a group
+// POST api/v1/mqtt/groups/{name}/kick
+func (s *Rest) kickGroup(w http.ResponseWriter, r *http.Request) {
+	if n, err := s.server.DisconnectGroup(r.PathValue("name")); err != nil {
+		Error(w, http.StatusNotFound, err.Error())
+	} else {
+		Ok(w, n)
+	}
+}
+
+// getCapture return the status of the current or most recent packet capture
+// GET api/v1/mqtt/capture
+func (s *Rest) getCapture(w http.ResponseWriter, r *http.Request) {
+	Ok(w, s.server.Capture.Status())
+}
+
+// startCapture start capturing packets to a file for a bounded duration
+// POST api/v1/mqtt/capture
+func (s *Rest) startCapture(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var opts mqtt.CaptureOptions
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	st, err := s.server.Capture.Start(opts)
+	if errors.Is(err, mqtt.ErrCaptureRunning) {
+		Error(w, http.StatusConflict, err.Error())
+	} else if err != nil {
+		Error(w, http.StatusInternalServerError, err.Error())
+	} else {
+		Ok(w, st)
+	}
+}
+
+// stopCapture stop the running packet capture
+// DELETE api/v1/mqtt/capture
+func (s *Rest) stopCapture(w http.ResponseWriter, r *http.Request) {
+	st, err := s.server.Capture.Stop()
+	if errors.Is(err, mqtt.ErrCaptureNotRunning) {
+		Error(w, http.StatusNotFound, err.Error())
+	} else if err != nil {
+		Error(w, http.StatusInternalServerError, err.Error())
+	} else {
+		Ok(w, st)
+	}
+}
+
+// getCaptureFile download the file of the most recent finished packet capture
+// GET api/v1/mqtt/capture/file
+func (s *Rest) getCaptureFile(w http.ResponseWriter, r *http.Request) {
+	st := s.server.Capture.Status()
+	if st.Path == "" {
+		Error(w, http.StatusNotFound, "no packet capture")
+		return
+	} else if st.Running {
+		Error(w, http.StatusConflict, mqtt.ErrCaptureRunning.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	http.ServeFile(w, r, st.Path)
+}
+
+// getFreeze return the status of the current or most recent maintenance freeze
+// GET api/v1/mqtt/freeze
+func (s *Rest) getFreeze(w http.ResponseWriter, r *http.Request) {
+	Ok(w, s.server.Freeze.Status())
+}
+
+// freeze refuse new connections, subscriptions or retained message changes while
+// existing clients stay connected, the body is optional and freezes everything if empty
+// PUT api/v1/mqtt/freeze
+func (s *Rest) freeze(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var opts mqtt.FreezeOptions
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil && !errors.Is(err, io.EOF) {
+		Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	st := s.server.Freeze.Start(opts)
+	s.server.Log.Info("broker frozen", "reason", opts.Reason, "ends", st.Ends)
+	Ok(w, st)
+}
+
+// unfreeze lift the maintenance freeze
+// DELETE api/v1/mqtt/freeze
+func (s *Rest) unfreeze(w http.ResponseWriter, r *http.Request) {
+	st, err := s.server.Freeze.Stop()
+	if errors.Is(err, mqtt.ErrNotFrozen) {
+		Error(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	s.server.Log.Info("broker unfrozen", "refused_connections", st.RefusedConnections,
+		"refused_subscriptions", st.RefusedSubscriptions, "refused_retain_messages", st.RefusedRetainMessages)
+	Ok(w, st)
+}
+
+// getSchedule return the status of all scheduled jobs
+// GET api/v1/mqtt/schedule
+func (s *Rest) getSchedule(w http.ResponseWriter, r *http.Request) {
+	Ok(w, s.server.Scheduler.GetAll())
+}
+
+// addJob add a scheduled job
+// POST api/v1/mqtt/schedule
+func (s *Rest) addJob(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var job mqtt.ScheduledJob
+	if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+		Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	st, err := s.server.Scheduler.Add(job)
+	if errors.Is(err, mqtt.ErrJobExists) {
+		Error(w, http.StatusConflict, err.Error())
+	} else if err != nil {
+		Error(w, http.StatusBadRequest, err.Error())
+	} else {
+		s.server.Log.Info("scheduled job added", "job", job.Name, "type", job.Type, "schedule", job.Schedule)
+		Ok(w, st)
+	}
+}
+
+// getJob return the status of a scheduled job
+// GET api/v1/mqtt/schedule/{name}
+func (s *Rest) getJob(w http.ResponseWriter, r *http.Request) {
+	if st, ok := s.server.Scheduler.Get(r.PathValue("name")); !ok {
+		Error(w, http.StatusNotFound, mqtt.ErrJobNotFound.Error())
+	} else {
+		Ok(w, st)
+	}
+}
+
+// removeJob remove a scheduled job
+// DELETE api/v1/mqtt/schedule/{name}
+func (s *Rest) removeJob(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if err := s.server.Scheduler.Remove(name); err != nil {
+		Error(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	s.server.Log.Info("scheduled job removed", "job", name)
+	Ok(w, name)
+}
+
+// runJob run a scheduled job immediately
+// POST api/v1/mqtt/schedule/{name}/run
+func (s *Rest) runJob(w http.ResponseWriter, r *http.Request) {
+	st, err := s.server.RunJob(r.PathValue("name"))
+	if errors.Is(err, mqtt.ErrJobNotFound) {
+		Error(w, http.StatusNotFound, err.Error())
+	} else if err != nil {
+		Error(w, http.StatusInternalServerError, err.Error())
 	} else {
-		Ok(w, s.server.Blacklist)
+		Ok(w, st)
+	}
+}
+
+// getFaults return the injected faults and the calls they affected
+// GET api/v1/mqtt/faults
+func (s *Rest) getFaults(w http.ResponseWriter, r *http.Request) {
+	Ok(w, s.server.Faults.GetAll())
+}
+
+// setFault inject latency, errors or drops at a point, replacing any fault set there
+// POST api/v1/mqtt/faults
+func (s *Rest) setFault(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var f faults.Fault
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	st, err := s.server.Faults.Set(f)
+	if errors.Is(err, faults.ErrDisabled) {
+		Error(w, http.StatusForbidden, err.Error())
+	} else if err != nil {
+		Error(w, http.StatusBadRequest, err.Error())
+	} else {
+		s.server.Log.Warn("fault injected", "point", f.Point, "latency", f.Latency, "error_rate", f.ErrorRate, "drop_rate", f.DropRate, "duration", f.Duration)
+		Ok(w, st)
+	}
+}
+
+// clearFaults remove all injected faults
+// DELETE api/v1/mqtt/faults
+func (s *Rest) clearFaults(w http.ResponseWriter, r *http.Request) {
+	s.server.Faults.ClearAll()
+	s.server.Log.Info("faults cleared")
+	Ok(w, s.server.Faults.GetAll())
+}
+
+// clearFault remove the fault injected at a point
+// DELETE api/v1/mqtt/faults/{point}
+func (s *Rest) clearFault(w http.ResponseWriter, r *http.Request) {
+	point := r.PathValue("point")
+	if err := s.server.Faults.Clear(point); err != nil {
+		Error(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	s.server.Log.Info("fault cleared", "point", point)
+	Ok(w, point)
+}
+
+// getHooks return the panics and errors of each hook, and whether it has been disabled
+// GET api/v1/mqtt/hooks
+func (s *Rest) getHooks(w http.ResponseWriter, r *http.Request) {
+	Ok(w, s.server.HookStats())
+}
+
+// enableHook re-enable a hook disabled after too many consecutive failures
+// POST api/v1/mqtt/hooks/{id}/enable
+func (s *Rest) enableHook(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !s.server.EnableHook(id) {
+		Error(w, http.StatusNotFound, "hook not found")
+		return
+	}
+
+	Ok(w, id)
+}
+
+// purgeAuthCache remove all cached auth and acl lookups of the auth datasources
+// DELETE api/v1/mqtt/auth/cache
+func (s *Rest) purgeAuthCache(w http.ResponseWriter, r *http.Request) {
+	Ok(w, s.server.InvalidateAuthCache(""))
+}
+
+// invalidateAuthCache remove the cached auth and acl lookups of a username or client id
+// DELETE api/v1/mqtt/auth/cache/{key}
+func (s *Rest) invalidateAuthCache(w http.ResponseWriter, r *http.Request) {
+	Ok(w, s.server.InvalidateAuthCache(r.PathValue("key")))
+}
+
+// getAuthMetrics return the decisions, datasource latency and cache hits of each auth datasource
+// GET api/v1/mqtt/auth/metrics
+func (s *Rest) getAuthMetrics(w http.ResponseWriter, r *http.Request) {
+	Ok(w, s.server.AuthMetrics())
+}
+
+// getStorageMetrics return the writes, reads, latency, pending writes and size of each storage hook
+// GET api/v1/mqtt/storage/metrics
+func (s *Rest) getStorageMetrics(w http.ResponseWriter, r *http.Request) {
+	Ok(w, s.server.StorageMetrics())
+}
+
+// getAuthFailures return the failed authentications and temporary bans of each username and source ip
+// GET api/v1/mqtt/auth/failures
+func (s *Rest) getAuthFailures(w http.ResponseWriter, r *http.Request) {
+	if s.server.AuthFailures == nil {
+		Error(w, http.StatusNotFound, "auth failure limit not enabled")
+		return
+	}
+
+	Ok(w, s.server.AuthFailures.Stats(time.Now().Unix()))
+}
+
+// clearAuthFailure remove the failed authentications and temporary ban of a username or source ip
+// DELETE api/v1/mqtt/auth/failures/{kind}/{value}
+func (s *Rest) clearAuthFailure(w http.ResponseWriter, r *http.Request) {
+	if s.server.AuthFailures == nil || !s.server.AuthFailures.Clear(r.PathValue("kind"), r.PathValue("value")) {
+		Error(w, http.StatusNotFound, "auth failure not found")
+		return
+	}
+
+	Ok(w, r.PathValue("value"))
+}
+
+// getIPFilter return the ip allow and deny lists of a listener
+// GET api/v1/mqtt/listeners/{id}/ip-filter
+func (s *Rest) getIPFilter(w http.ResponseWriter, r *http.Request) {
+	f, ok := s.server.ListenerIPFilter(r.PathValue("id"))
+	if !ok {
+		Error(w, http.StatusNotFound, "listener not found")
+		return
+	}
+
+	Ok(w, f.Rules())
+}
+
+// setIPFilter replace the ip allow and deny lists of a listener, applied to new connections
+// PUT api/v1/mqtt/listeners/{id}/ip-filter
+func (s *Rest) setIPFilter(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	id := r.PathValue("id")
+	f, ok := s.server.ListenerIPFilter(id)
+	if !ok {
+		Error(w, http.StatusNotFound, "listener not found")
+		return
+	}
+
+	var rules listeners.IPRules
+	if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+		Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := f.Set(rules); err != nil {
+		Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.server.Log.Info("listener ip filter updated", "listener", id, "allow", rules.Allow, "deny", rules.Deny)
+	Ok(w, f.Rules())
+}
+
+// clearIPFilter clear the ip allow and deny lists of a listener, allowing connections from any ip
+// DELETE api/v1/mqtt/listeners/{id}/ip-filter
+func (s *Rest) clearIPFilter(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	f, ok := s.server.ListenerIPFilter(id)
+	if !ok {
+		Error(w, http.StatusNotFound, "listener not found")
+		return
+	}
+
+	_ = f.Set(listeners.IPRules{})
+	s.server.Log.Info("listener ip filter cleared", "listener", id)
+	Ok(w, id)
+}
+
+// livez liveness probe, failing once the server is closed
+// GET livez
+func (s *Rest) livez(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, s.server.Livez())
+}
+
+// readyz readiness probe, failing while a listener is not serving, a storage hook is unreachable, or a cluster node has no raft leader or has not joined
+// GET readyz
+func (s *Rest) readyz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, s.server.Readyz())
+}
+
+// startupz startup probe, passing once the server has started serving its listeners
+// GET startupz
+func (s *Rest) startupz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, s.server.Startupz())
+}
+
+// writeHealth writes the result of a probe, with a 503 status if any check failed.
+func writeHealth(w http.ResponseWriter, h mqtt.Health) {
+	if !h.OK() {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(h)
+		return
+	}
+
+	Ok(w, h)
+}
+
+// exportRetained download the retained messages matching a topic filter as newline delimited json
+// GET api/v1/mqtt/retained/export?filter=a/b/#
+func (s *Rest) exportRetained(w http.ResponseWriter, r *http.Request) {
+	filter := r.URL.Query().Get("filter")
+	if filter != "" && !mqtt.IsValidFilter(filter, false) {
+		Error(w, http.StatusBadRequest, "invalid filter")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="retained.ndjson"`)
+	if _, err := s.server.ExportRetained(w, filter); err != nil {
+		s.server.Log.Error("failed to export retained messages", "error", err)
+	}
+}
+
+// importRetained retain the messages of a retained message export, replacing existing retained messages unless overwrite is false
+// POST api/v1/mqtt/retained/import?overwrite=false
+func (s *Rest) importRetained(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	overwrite := r.URL.Query().Get("overwrite") != "false"
+	res, err := s.server.ImportRetained(r.Body, overwrite)
+	if errors.Is(err, mqtt.ErrRetainedFrozen) || errors.Is(err, packets.ErrRetainNotSupported) {
+		Error(w, http.StatusConflict, err.Error())
+		return
+	} else if err != nil {
+		Error(w, http.StatusBadRequest, fmt.Sprintf("%s, %d imported before the error", err, res.Imported))
+		return
+	}
+
+	Ok(w, res)
+}
+
+// getRetainedLimits return the retained limits with their retained messages, bytes, evictions and rejections
+// GET api/v1/mqtt/retained/limits
+func (s *Rest) getRetainedLimits(w http.ResponseWriter, r *http.Request) {
+	Ok(w, s.server.Topics.RetainedLimits())
+}
+
+// getTiering return the hot and cold retained and queued messages, and the cold messages read back from storage
+// GET api/v1/mqtt/tiering
+func (s *Rest) getTiering(w http.ResponseWriter, r *http.Request) {
+	Ok(w, s.server.TieringStatus())
+}
+
+// getWAL return the size, live inflight messages, appends and compactions of the write-ahead log
+// GET api/v1/mqtt/wal
+func (s *Rest) getWAL(w http.ResponseWriter, r *http.Request) {
+	st, ok := s.server.WALStatus()
+	if !ok {
+		Error(w, http.StatusNotFound, "write-ahead log not enabled")
+		return
+	}
+
+	Ok(w, st)
+}
+
+// exportSnapshot download the persistent sessions, subscriptions, inflight and retained messages as newline delimited json
+// GET api/v1/mqtt/snapshot
+func (s *Rest) exportSnapshot(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="snapshot.ndjson"`)
+	if _, err := s.server.ExportSnapshot(w); err != nil {
+		s.server.Log.Error("failed to export snapshot", "error", err)
+	}
+}
+
+// restoreSnapshot restore the sessions and retained messages of a snapshot, keeping existing sessions and retained messages
+// POST api/v1/mqtt/snapshot
+func (s *Rest) restoreSnapshot(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	res, err := s.server.ImportSnapshot(r.Body)
+	if errors.Is(err, mqtt.ErrSnapshotFrozen) {
+		Error(w, http.StatusConflict, err.Error())
+		return
+	} else if err != nil {
+		Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	Ok(w, res)
+}
+
+// issueEventToken exchange the credentials of a client for a short-lived single use token opening an event stream
+// POST api/v1/mqtt/events/token
+func (s *Rest) issueEventToken(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var creds eventCredentials
+	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+		Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	token, expires, err := s.server.IssueEventToken(creds.ClientID, creds.Username, creds.Password)
+	if err != nil {
+		Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	Ok(w, eventToken{Token: token, Expires: expires.Unix()})
+}
+
+// subscribeEvents stream the messages matching a topic filter as server-sent events.
+// Credentials are taken from the X-Mqtt-Username and X-Mqtt-Password headers, or from a
+// token of issueEventToken for browser EventSource clients which cannot set headers.
+// GET api/v1/mqtt/events?filter=a/b/#&client_id=&token=
+func (s *Rest) subscribeEvents(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := q.Get("filter")
+	if filter == "" {
+		Error(w, http.StatusBadRequest, "filter is required")
+		return
+	}
+
+	var es *mqtt.EventStream
+	var err error
+	if token := q.Get("token"); token != "" {
+		es, err = s.server.OpenEventStreamToken(token, filter, r.RemoteAddr)
+	} else {
+		es, err = s.server.OpenEventStream(q.Get("client_id"), r.Header.Get(EventUsernameHeader),
+			r.Header.Get(EventPasswordHeader), filter, r.RemoteAddr)
+	}
+	if errors.Is(err, packets.ErrBadUsernameOrPassword) {
+		Error(w, http.StatusUnauthorized, err.Error())
+		return
+	} else if errors.Is(err, packets.ErrNotAuthorized) || errors.Is(err, packets.ErrClientIdentifierNotOwned) ||
+		errors.Is(err, packets.ErrClientIdentifierNotValid) {
+		Error(w, http.StatusForbidden, err.Error())
+		return
+	} else if errors.Is(err, packets.ErrBanned) || errors.Is(err, packets.ErrQuotaExceeded) {
+		Error(w, http.StatusTooManyRequests, err.Error())
+		return
+	} else if errors.Is(err, packets.ErrServerUnavailable) {
+		Error(w, http.StatusServiceUnavailable, err.Error())
+		return
+	} else if err != nil {
+		Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer s.server.CloseEventStream(es)
+
+	// the stream outlives the write timeout of the http listener.
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+
+	var seq int64
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-es.Done():
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case msg := <-es.Messages:
+			data, err := json.Marshal(msg)
+			if err != nil {
+				continue
+			}
+
+			seq++
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: message\ndata: %s\n\n", seq, data); err != nil {
+				return
+			}
+		}
+
+		if err := rc.Flush(); err != nil {
+			return
+		}
 	}
 }
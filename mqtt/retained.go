@@ -0,0 +1,139 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+// ErrRetainedFrozen indicates retained messages cannot be imported during a maintenance freeze.
+var ErrRetainedFrozen = errors.New("retained messages are frozen")
+
+// RetainedImport contains the result of a retained message import.
+type RetainedImport struct {
+	Imported int `json:"imported"` // the number of retained messages imported
+	Skipped  int `json:"skipped"`  // the number of expired, empty, invalid or existing messages skipped
+}
+
+// ExportRetained writes the retained messages matching a topic filter as newline
+// delimited json storage messages, ordered by topic, returning the number written.
+// $SYS messages are not exported, as they are recreated by the broker.
+func (s *Server) ExportRetained(w io.Writer, filter string) (int, error) {
+	if filter == "" {
+		filter = "#"
+	}
+
+	msgs := s.Topics.Messages(filter)
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].TopicName < msgs[j].TopicName })
+
+	n := 0
+	enc := json.NewEncoder(w)
+	for _, pk := range msgs {
+		if strings.HasPrefix(pk.TopicName, SysPrefix) {
+			continue
+		}
+
+		if err := enc.Encode(retainedMessage(pk)); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// ImportRetained reads retained messages written by ExportRetained and retains them,
+// keeping their qos, properties and creation time so that message expiry intervals
+// continue from the export. Existing retained messages are replaced unless overwrite is
+// false. Expired and empty messages are skipped.
+func (s *Server) ImportRetained(r io.Reader, overwrite bool) (RetainedImport, error) {
+	var res RetainedImport
+	if s.Options.Capabilities.RetainAvailable == 0 {
+		return res, packets.ErrRetainNotSupported
+	}
+
+	if ok, _ := s.Freeze.AllowRetain(); !ok {
+		return res, ErrRetainedFrozen
+	}
+
+	cl := s.NewClient(nil, LocalListener, InlineClientId, true)
+	dec := json.NewDecoder(r)
+	for line := 1; ; line++ {
+		var msg storage.Message
+		if err := dec.Decode(&msg); errors.Is(err, io.EOF) {
+			return res, nil
+		} else if err != nil {
+			return res, fmt.Errorf("retained message %d: %w", line, err)
+		}
+
+		pk := msg.ToPacket()
+		pk.FixedHeader.Type = packets.Publish
+		pk.FixedHeader.Retain = true
+		if pk.Created == 0 {
+			pk.Created = time.Now().Unix()
+		}
+
+		if !s.importable(pk, overwrite, time.Now().Unix()) {
+			res.Skipped++
+			continue
+		}
+
+		if !s.retainMessage(cl, pk) {
+			res.Skipped++
+			continue
+		}
+		res.Imported++
+	}
+}
+
+// importable returns true if an imported retained message should be retained.
+func (s *Server) importable(pk packets.Packet, overwrite bool, now int64) bool {
+	if len(pk.Payload) == 0 || !IsValidFilter(pk.TopicName, true) || strings.HasPrefix(pk.TopicName, SysPrefix) {
+		return false
+	}
+
+	if remaining, ok := RemainingMessageExpiry(pk, now); ok && remaining <= 0 {
+		return false
+	}
+
+	if !overwrite {
+		if _, ok := s.Topics.RetainedMessage(pk.TopicName); ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// retainedMessage returns the storable representation of a retained message.
+func retainedMessage(pk packets.Packet) storage.Message {
+	return storage.Message{
+		ID:          pk.TopicName,
+		T:           storage.RetainedKey,
+		FixedHeader: pk.FixedHeader,
+		TopicName:   pk.TopicName,
+		Payload:     pk.Payload,
+		Created:     pk.Created,
+		Origin:      pk.Origin,
+		Properties: storage.MessageProperties{
+			PayloadFormat:         pk.Properties.PayloadFormat,
+			PayloadFormatFlag:     pk.Properties.PayloadFormatFlag,
+			MessageExpiryInterval: pk.Properties.MessageExpiryInterval,
+			ContentType:           pk.Properties.ContentType,
+			ResponseTopic:         pk.Properties.ResponseTopic,
+			CorrelationData:       pk.Properties.CorrelationData,
+			User:                  pk.Properties.User,
+		},
+	}
+}
@@ -0,0 +1,119 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+func retainTestMessage(s *Server, topic, payload string, qos byte, expiry uint32, created int64) {
+	s.Topics.RetainMessage(packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true, Qos: qos},
+		TopicName:   topic,
+		Payload:     []byte(payload),
+		Properties: packets.Properties{
+			MessageExpiryInterval: expiry,
+			ContentType:           "text/plain",
+			User:                  []packets.UserProperty{{Key: "k", Val: "v"}},
+		},
+		Created: created,
+		Origin:  "cl1",
+	})
+}
+
+func TestExportImportRetained(t *testing.T) {
+	now := time.Now().Unix()
+	s := newServer()
+	retainTestMessage(s, "a/b", "hello", 1, 0, now)
+	retainTestMessage(s, "a/c", "soon", 2, 60, now-20)
+	retainTestMessage(s, "b/c", "other", 0, 0, now)
+	retainTestMessage(s, SysPrefix+"/broker/uptime", "1", 0, 0, now)
+
+	var buf bytes.Buffer
+	n, err := s.ExportRetained(&buf, "a/#")
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.Equal(t, 2, strings.Count(buf.String(), "\n"))
+
+	d := newServer()
+	res, err := d.ImportRetained(bytes.NewReader(buf.Bytes()), true)
+	require.NoError(t, err)
+	require.Equal(t, RetainedImport{Imported: 2}, res)
+
+	pk, ok := d.Topics.Retained.Get("a/c")
+	require.True(t, ok)
+	require.True(t, pk.FixedHeader.Retain)
+	require.Equal(t, byte(2), pk.FixedHeader.Qos)
+	require.Equal(t, "soon", string(pk.Payload))
+	require.Equal(t, uint32(60), pk.Properties.MessageExpiryInterval)
+	require.Equal(t, "text/plain", pk.Properties.ContentType)
+	require.Equal(t, []packets.UserProperty{{Key: "k", Val: "v"}}, pk.Properties.User)
+	require.Equal(t, now-20, pk.Created)
+	require.Equal(t, now+40, pk.Expiry)
+	require.Equal(t, int64(2), d.Info.Retained)
+
+	_, ok = d.Topics.Retained.Get("b/c")
+	require.False(t, ok)
+}
+
+func TestExportRetainedAll(t *testing.T) {
+	s := newServer()
+	retainTestMessage(s, "b", "2", 0, 0, 1)
+	retainTestMessage(s, "a", "1", 0, 0, 1)
+	retainTestMessage(s, SysPrefix+"/broker/uptime", "1", 0, 0, 1)
+
+	var buf bytes.Buffer
+	n, err := s.ExportRetained(&buf, "")
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.Less(t, strings.Index(buf.String(), `"topic_name":"a"`), strings.Index(buf.String(), `"topic_name":"b"`))
+}
+
+func TestImportRetainedSkipped(t *testing.T) {
+	now := time.Now().Unix()
+	s := newServer()
+	retainTestMessage(s, "a/expired", "gone", 0, 5, now-20)
+	retainTestMessage(s, "a/existing", "new", 0, 0, now)
+
+	var buf bytes.Buffer
+	_, err := s.ExportRetained(&buf, "#")
+	require.NoError(t, err)
+	buf.WriteString(`{"topic_name":"a/empty","payload":""}` + "\n")
+	buf.WriteString(`{"topic_name":"a/+","payload":"aW52YWxpZA=="}` + "\n")
+
+	d := newServer()
+	retainTestMessage(d, "a/existing", "old", 0, 0, now)
+	res, err := d.ImportRetained(bytes.NewReader(buf.Bytes()), false)
+	require.NoError(t, err)
+	require.Equal(t, RetainedImport{Skipped: 4}, res)
+
+	pk, _ := d.Topics.Retained.Get("a/existing")
+	require.Equal(t, "old", string(pk.Payload))
+}
+
+func TestImportRetainedInvalid(t *testing.T) {
+	s := newServer()
+	res, err := s.ImportRetained(strings.NewReader(`{"topic_name":"a","payload":"MQ=="}`+"\nnot json"), true)
+	require.ErrorContains(t, err, "retained message 2")
+	require.Equal(t, 1, res.Imported)
+}
+
+func TestImportRetainedUnavailable(t *testing.T) {
+	s := newServer()
+	s.Freeze.Start(FreezeOptions{Retained: true})
+	_, err := s.ImportRetained(strings.NewReader(""), true)
+	require.ErrorIs(t, err, ErrRetainedFrozen)
+
+	s = newServer()
+	s.Options.Capabilities.RetainAvailable = 0
+	_, err = s.ImportRetained(strings.NewReader(""), true)
+	require.ErrorIs(t, err, packets.ErrRetainNotSupported)
+}
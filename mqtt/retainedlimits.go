@@ -0,0 +1,229 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const (
+	RetainedEvictLRU  = "lru"        // evict the least recently set or delivered retained messages
+	RetainedRejectNew = "reject-new" // reject new retained messages, keeping the existing ones
+)
+
+var (
+	ErrRetainedLimit         = errors.New("retained message limit reached")
+	ErrRetainedLimitEviction = errors.New("retained limit eviction must be lru or reject-new")
+)
+
+// RetainedLimit caps the number and bytes of the retained messages on the topics beginning
+// with a prefix, or on all topics if the prefix is empty. The bytes of a retained message
+// are the length of its topic and payload.
+type RetainedLimit struct {
+	Prefix      string `yaml:"prefix" json:"prefix"`             // the topic prefix, such as sensors/, or empty for all topics
+	MaxMessages int    `yaml:"max-messages" json:"max_messages"` // the maximum number of retained messages, unlimited if 0
+	MaxBytes    int64  `yaml:"max-bytes" json:"max_bytes"`       // the maximum bytes of the retained messages, unlimited if 0
+	Eviction    string `yaml:"eviction" json:"eviction"`         // lru or reject-new, defaults to reject-new
+}
+
+// Validate checks the retained limit and sets its default eviction policy.
+func (l *RetainedLimit) Validate() error {
+	if l.MaxMessages < 0 || l.MaxBytes < 0 {
+		return fmt.Errorf("retained limit %q: maximums must not be negative", l.Prefix)
+	}
+
+	switch l.Eviction {
+	case "":
+		l.Eviction = RetainedRejectNew
+	case RetainedEvictLRU, RetainedRejectNew:
+	default:
+		return fmt.Errorf("retained limit %q: %w", l.Prefix, ErrRetainedLimitEviction)
+	}
+
+	return nil
+}
+
+// RetainedLimitStatus is a retained limit with the retained messages it currently
+// accounts for, and the messages it has evicted or rejected.
+type RetainedLimitStatus struct {
+	RetainedLimit
+	Messages int   `json:"messages"`
+	Bytes    int64 `json:"bytes"`
+	Evicted  int64 `json:"evicted"`
+	Rejected int64 `json:"rejected"`
+}
+
+// retainedLimit is a retained limit with its retained messages, most recently used first.
+type retainedLimit struct {
+	status RetainedLimitStatus
+	lru    *list.List
+}
+
+// over returns true if the limit would be exceeded by n more messages and b more bytes.
+func (l *retainedLimit) over(n int, b int64) bool {
+	return (l.status.MaxMessages > 0 && l.status.Messages+n > l.status.MaxMessages) ||
+		(l.status.MaxBytes > 0 && l.status.Bytes+b > l.status.MaxBytes)
+}
+
+// retainedEntry is a retained message accounted for by the limits.
+type retainedEntry struct {
+	size  int64
+	elems []*list.Element // the element of the message in the list of each limit, nil if the limit doesn't apply
+}
+
+// retainedLimits accounts for the retained messages of each topic against the limits
+// which apply to it.
+type retainedLimits struct {
+	sync.Mutex
+	limits  []*retainedLimit
+	entries map[string]*retainedEntry
+}
+
+// newRetainedLimits returns the accounting of a set of validated retained limits.
+func newRetainedLimits(limits []RetainedLimit) *retainedLimits {
+	rl := &retainedLimits{
+		limits:  make([]*retainedLimit, len(limits)),
+		entries: map[string]*retainedEntry{},
+	}
+
+	for i, l := range limits {
+		rl.limits[i] = &retainedLimit{
+			status: RetainedLimitStatus{RetainedLimit: l},
+			lru:    list.New(),
+		}
+	}
+
+	return rl
+}
+
+// admit accounts for a retained message of a size on a topic, replacing any retained
+// message on the same topic. If a reject-new limit would be exceeded, or the message
+// can never fit within a limit, ErrRetainedLimit is returned. Otherwise the least recently
+// used messages of any exceeded lru limits are evicted, and their topics returned.
+func (rl *retainedLimits) admit(topic string, size int64) ([]string, error) {
+	rl.Lock()
+	defer rl.Unlock()
+
+	var n int
+	var b = size
+	e, exists := rl.entries[topic]
+	if exists {
+		b -= e.size
+	} else {
+		n = 1
+	}
+
+	for _, l := range rl.limits {
+		if !strings.HasPrefix(topic, l.status.Prefix) {
+			continue
+		}
+
+		if (l.status.Eviction == RetainedRejectNew && l.over(n, b)) || (l.status.MaxBytes > 0 && size > l.status.MaxBytes) {
+			l.status.Rejected++
+			return nil, ErrRetainedLimit
+		}
+	}
+
+	var evicted []string
+	for _, l := range rl.limits {
+		if l.status.Eviction != RetainedEvictLRU || !strings.HasPrefix(topic, l.status.Prefix) {
+			continue
+		}
+
+		for el := l.lru.Back(); el != nil && l.over(n, b); {
+			victim := el.Value.(string)
+			el = el.Prev()
+			if victim == topic {
+				continue
+			}
+
+			rl.drop(victim)
+			l.status.Evicted++
+			evicted = append(evicted, victim)
+		}
+	}
+
+	if !exists {
+		e = &retainedEntry{elems: make([]*list.Element, len(rl.limits))}
+		rl.entries[topic] = e
+	}
+
+	for i, l := range rl.limits {
+		if !strings.HasPrefix(topic, l.status.Prefix) {
+			continue
+		}
+
+		if exists {
+			l.status.Bytes += size - e.size
+			l.lru.MoveToFront(e.elems[i])
+			continue
+		}
+
+		l.status.Messages++
+		l.status.Bytes += size
+		e.elems[i] = l.lru.PushFront(topic)
+	}
+	e.size = size
+
+	return evicted, nil
+}
+
+// remove stops accounting for the retained message on a topic.
+func (rl *retainedLimits) remove(topic string) {
+	rl.Lock()
+	defer rl.Unlock()
+	rl.drop(topic)
+}
+
+// drop stops accounting for the retained message on a topic, with the lock held.
+func (rl *retainedLimits) drop(topic string) {
+	e, ok := rl.entries[topic]
+	if !ok {
+		return
+	}
+
+	for i, el := range e.elems {
+		if el != nil {
+			rl.limits[i].lru.Remove(el)
+			rl.limits[i].status.Messages--
+			rl.limits[i].status.Bytes -= e.size
+		}
+	}
+
+	delete(rl.entries, topic)
+}
+
+// touch marks the retained messages on topics as recently used.
+func (rl *retainedLimits) touch(topics []string) {
+	rl.Lock()
+	defer rl.Unlock()
+
+	for _, topic := range topics {
+		if e, ok := rl.entries[topic]; ok {
+			for i, el := range e.elems {
+				if el != nil {
+					rl.limits[i].lru.MoveToFront(el)
+				}
+			}
+		}
+	}
+}
+
+// status returns the usage of each limit.
+func (rl *retainedLimits) status() []RetainedLimitStatus {
+	rl.Lock()
+	defer rl.Unlock()
+
+	st := make([]RetainedLimitStatus, len(rl.limits))
+	for i, l := range rl.limits {
+		st[i] = l.status
+	}
+
+	return st
+}
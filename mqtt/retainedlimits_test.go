@@ -0,0 +1,202 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+func retainedPacket(topic, payload string) packets.Packet {
+	return packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true},
+		TopicName:   topic,
+		Payload:     []byte(payload),
+	}
+}
+
+func isRetained(x *TopicsIndex, topic string) bool {
+	_, ok := x.Retained.Get(topic)
+	return ok
+}
+
+func TestRetainedLimitValidate(t *testing.T) {
+	l := RetainedLimit{MaxMessages: 10}
+	require.NoError(t, l.Validate())
+	require.Equal(t, RetainedRejectNew, l.Eviction)
+
+	l = RetainedLimit{MaxMessages: 10, Eviction: RetainedEvictLRU}
+	require.NoError(t, l.Validate())
+	require.Equal(t, RetainedEvictLRU, l.Eviction)
+
+	l = RetainedLimit{Eviction: "fifo"}
+	require.ErrorIs(t, l.Validate(), ErrRetainedLimitEviction)
+
+	l = RetainedLimit{MaxBytes: -1}
+	require.Error(t, l.Validate())
+}
+
+func TestRetainedLimitsRejectNew(t *testing.T) {
+	x := NewTopicsIndex()
+	_, err := x.SetRetainedLimits([]RetainedLimit{{MaxMessages: 2}})
+	require.NoError(t, err)
+
+	require.Equal(t, int64(1), x.RetainMessage(retainedPacket("a/1", "x")))
+	require.Equal(t, int64(1), x.RetainMessage(retainedPacket("a/2", "x")))
+
+	r, evicted, err := x.TryRetainMessage(retainedPacket("a/3", "x"))
+	require.ErrorIs(t, err, ErrRetainedLimit)
+	require.Equal(t, int64(0), r)
+	require.Empty(t, evicted)
+	require.False(t, isRetained(x, "a/3"))
+	require.Empty(t, x.Messages("a/3"))
+
+	// replacing and deleting existing retained messages is still allowed
+	_, _, err = x.TryRetainMessage(retainedPacket("a/1", "yy"))
+	require.NoError(t, err)
+	require.Equal(t, int64(-1), x.RetainMessage(packets.Packet{TopicName: "a/2"}))
+	_, _, err = x.TryRetainMessage(retainedPacket("a/3", "x"))
+	require.NoError(t, err)
+
+	st := x.RetainedLimits()
+	require.Len(t, st, 1)
+	require.Equal(t, 2, st[0].Messages)
+	require.Equal(t, int64(len("a/1yy")+len("a/3x")), st[0].Bytes)
+	require.Equal(t, int64(1), st[0].Rejected)
+}
+
+func TestRetainedLimitsLRU(t *testing.T) {
+	x := NewTopicsIndex()
+	_, err := x.SetRetainedLimits([]RetainedLimit{{Prefix: "a/", MaxMessages: 2, Eviction: RetainedEvictLRU}})
+	require.NoError(t, err)
+
+	x.RetainMessage(retainedPacket("a/1", "x"))
+	x.RetainMessage(retainedPacket("a/2", "x"))
+	x.RetainMessage(retainedPacket("b/1", "x")) // not limited
+
+	x.touchRetained(x.Messages("a/1"))
+	_, evicted, err := x.TryRetainMessage(retainedPacket("a/3", "x"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"a/2"}, evicted)
+	require.False(t, isRetained(x, "a/2"))
+	require.Nil(t, x.seek("a/2", 0))
+	require.True(t, isRetained(x, "a/1"))
+	require.True(t, isRetained(x, "a/3"))
+	require.True(t, isRetained(x, "b/1"))
+
+	st := x.RetainedLimits()
+	require.Equal(t, 2, st[0].Messages)
+	require.Equal(t, int64(1), st[0].Evicted)
+}
+
+func TestRetainedLimitsLRUBytes(t *testing.T) {
+	x := NewTopicsIndex()
+	_, err := x.SetRetainedLimits([]RetainedLimit{{MaxBytes: 10, Eviction: RetainedEvictLRU}})
+	require.NoError(t, err)
+
+	x.RetainMessage(retainedPacket("a", "1234"))
+	x.RetainMessage(retainedPacket("b", "1234"))
+	_, evicted, err := x.TryRetainMessage(retainedPacket("c", "12345678"))
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"a", "b"}, evicted)
+
+	_, _, err = x.TryRetainMessage(retainedPacket("d", "12345678901"))
+	require.ErrorIs(t, err, ErrRetainedLimit)
+	require.True(t, isRetained(x, "c"))
+}
+
+func TestRetainedLimitsMixed(t *testing.T) {
+	x := NewTopicsIndex()
+	_, err := x.SetRetainedLimits([]RetainedLimit{
+		{MaxMessages: 3},
+		{Prefix: "a/", MaxMessages: 1, Eviction: RetainedEvictLRU},
+	})
+	require.NoError(t, err)
+
+	x.RetainMessage(retainedPacket("a/1", "x"))
+	x.RetainMessage(retainedPacket("b/1", "x"))
+	x.RetainMessage(retainedPacket("b/2", "x"))
+
+	// the global limit is full, so the lru limit may not evict to make room
+	_, _, err = x.TryRetainMessage(retainedPacket("a/2", "x"))
+	require.ErrorIs(t, err, ErrRetainedLimit)
+
+	x.RetainMessage(packets.Packet{TopicName: "b/2"})
+	_, evicted, err := x.TryRetainMessage(retainedPacket("a/2", "x"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"a/1"}, evicted)
+	require.Equal(t, 2, x.RetainedLimits()[0].Messages)
+}
+
+func TestRetainedLimitsSys(t *testing.T) {
+	x := NewTopicsIndex()
+	_, err := x.SetRetainedLimits([]RetainedLimit{{MaxMessages: 1}})
+	require.NoError(t, err)
+
+	x.RetainMessage(retainedPacket("a", "x"))
+	_, _, err = x.TryRetainMessage(retainedPacket(SysPrefix+"/broker/uptime", "1"))
+	require.NoError(t, err)
+	require.Equal(t, 1, x.RetainedLimits()[0].Messages)
+}
+
+func TestRetainedLimitsDeleteRetained(t *testing.T) {
+	x := NewTopicsIndex()
+	_, err := x.SetRetainedLimits([]RetainedLimit{{MaxMessages: 1}})
+	require.NoError(t, err)
+
+	x.RetainMessage(retainedPacket("a/b", "x"))
+	x.DeleteRetained("a/b")
+	require.False(t, isRetained(x, "a/b"))
+	require.Nil(t, x.seek("a/b", 0))
+	require.Equal(t, 0, x.RetainedLimits()[0].Messages)
+
+	_, _, err = x.TryRetainMessage(retainedPacket("c", "x"))
+	require.NoError(t, err)
+}
+
+func TestSetRetainedLimitsExisting(t *testing.T) {
+	x := NewTopicsIndex()
+	for i, topic := range []string{"c", "a", "b"} {
+		pk := retainedPacket(topic, "x")
+		pk.Created = int64(i + 1)
+		x.RetainMessage(pk)
+	}
+
+	removed, err := x.SetRetainedLimits([]RetainedLimit{{MaxMessages: 2}})
+	require.NoError(t, err)
+	require.Equal(t, []string{"b"}, removed)
+	require.Equal(t, 2, x.Retained.Len())
+
+	_, err = x.SetRetainedLimits([]RetainedLimit{{Eviction: "fifo"}})
+	require.ErrorIs(t, err, ErrRetainedLimitEviction)
+
+	_, err = x.SetRetainedLimits(nil)
+	require.NoError(t, err)
+	require.Empty(t, x.RetainedLimits())
+	x.RetainMessage(retainedPacket("d", "x"))
+	require.Equal(t, 3, x.Retained.Len())
+}
+
+func TestServerRetainMessageLimits(t *testing.T) {
+	s := newServer()
+	_, err := s.Topics.SetRetainedLimits([]RetainedLimit{
+		{Prefix: "a/", MaxMessages: 1},
+		{Prefix: "b/", MaxMessages: 1, Eviction: RetainedEvictLRU},
+	})
+	require.NoError(t, err)
+
+	cl, _, _ := newTestClient()
+	require.True(t, s.retainMessage(cl, retainedPacket("a/1", "x")))
+	require.False(t, s.retainMessage(cl, retainedPacket("a/2", "x")))
+	require.Equal(t, int64(1), s.Info.RetainedRejected)
+
+	require.True(t, s.retainMessage(cl, retainedPacket("b/1", "x")))
+	require.True(t, s.retainMessage(cl, retainedPacket("b/2", "x")))
+	require.Equal(t, int64(1), s.Info.RetainedEvicted)
+	require.Equal(t, int64(2), s.Info.Retained)
+	require.False(t, isRetained(s.Topics, "b/1"))
+}
@@ -0,0 +1,242 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package revocation
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// crlReload is the minimum interval between reloads of expired revocation lists.
+const crlReload = time.Minute
+
+// checker checks the verified chains of client certificates for revoked certificates.
+type checker struct {
+	mu       sync.RWMutex
+	opts     *Options
+	crls     []*x509.RevocationList // the loaded revocation lists
+	loaded   time.Time              // when the revocation lists were loaded
+	statuses map[string]ocspStatus  // the cached ocsp statuses of client certificates, keyed on issuer and serial
+}
+
+// ocspStatus is a cached ocsp status of a certificate.
+type ocspStatus struct {
+	status  int
+	expires time.Time
+}
+
+// newChecker returns a checker, loading the revocation lists of the options.
+func newChecker(opts *Options) (*checker, error) {
+	ch := &checker{
+		opts:     opts,
+		statuses: make(map[string]ocspStatus),
+	}
+
+	crls, err := loadCRLs(opts.CRLFiles)
+	if err != nil {
+		return nil, err
+	}
+	ch.crls, ch.loaded = crls, time.Now()
+
+	return ch, nil
+}
+
+// verify returns nil if any of the verified chains has no revoked certificates. A
+// connection without a client certificate has no chains and is not checked.
+func (ch *checker) verify(chains [][]*x509.Certificate) error {
+	var err error
+	for _, chain := range chains {
+		if err = ch.verifyChain(chain); err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// verifyChain checks each certificate of a chain against the revocation lists of its
+// issuer, and the client certificate with its ocsp responders.
+func (ch *checker) verifyChain(chain []*x509.Certificate) error {
+	for i := 0; i < len(chain)-1; i++ {
+		if err := ch.checkCRL(chain[i], chain[i+1]); err != nil {
+			return err
+		}
+	}
+
+	if ch.opts.OCSPCheck && len(chain) > 1 {
+		return ch.checkOCSP(chain[0], chain[1])
+	}
+
+	return nil
+}
+
+// checkCRL checks a certificate against the revocation lists signed by its issuer,
+// reloading the lists once they expire.
+func (ch *checker) checkCRL(cert, issuer *x509.Certificate) error {
+	if len(ch.opts.CRLFiles) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	crls := ch.issuerCRLs(issuer)
+	if expired(crls, now) {
+		ch.reload(now)
+		crls = ch.issuerCRLs(issuer)
+	}
+
+	for _, crl := range crls {
+		for _, entry := range crl.RevokedCertificateEntries {
+			if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return fmt.Errorf("%w: %s", ErrCertRevoked, cert.Subject.String())
+			}
+		}
+	}
+
+	if expired(crls, now) && !ch.opts.SoftFail {
+		return ErrCRLExpired
+	}
+
+	return nil
+}
+
+// issuerCRLs returns the revocation lists signed by an issuer.
+func (ch *checker) issuerCRLs(issuer *x509.Certificate) []*x509.RevocationList {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+
+	var crls []*x509.RevocationList
+	for _, crl := range ch.crls {
+		if bytes.Equal(crl.RawIssuer, issuer.RawSubject) && crl.CheckSignatureFrom(issuer) == nil {
+			crls = append(crls, crl)
+		}
+	}
+
+	return crls
+}
+
+// reload reloads the revocation lists if they were not loaded recently, keeping the
+// current lists if they cannot be loaded.
+func (ch *checker) reload(now time.Time) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if now.Sub(ch.loaded) < crlReload {
+		return
+	}
+	ch.loaded = now
+
+	crls, err := loadCRLs(ch.opts.CRLFiles)
+	if err != nil {
+		ch.opts.Log.Warn("unable to reload certificate revocation lists", "error", err)
+		return
+	}
+	ch.crls = crls
+}
+
+// checkOCSP checks the status of a client certificate with its ocsp responders,
+// caching the status until the response expires.
+func (ch *checker) checkOCSP(cert, issuer *x509.Certificate) error {
+	key := string(issuer.RawSubject) + cert.SerialNumber.String()
+	now := time.Now()
+
+	ch.mu.RLock()
+	st, ok := ch.statuses[key]
+	ch.mu.RUnlock()
+
+	if !ok || now.After(st.expires) {
+		resp, err := query(context.Background(), ch.opts, cert, issuer)
+		if errors.Is(err, ErrNoOCSPServer) {
+			return nil
+		}
+
+		if err != nil {
+			if ch.opts.SoftFail {
+				return nil
+			}
+			return err
+		}
+
+		st = ocspStatus{status: resp.Status, expires: expiry(resp.ThisUpdate, resp.NextUpdate)}
+		ch.mu.Lock()
+		for k, v := range ch.statuses {
+			if now.After(v.expires) {
+				delete(ch.statuses, k)
+			}
+		}
+		ch.statuses[key] = st
+		ch.mu.Unlock()
+	}
+
+	switch st.status {
+	case ocsp.Good:
+		return nil
+	case ocsp.Revoked:
+		return fmt.Errorf("%w: %s", ErrCertRevoked, cert.Subject.String())
+	default:
+		if ch.opts.SoftFail {
+			return nil
+		}
+		return ErrOCSPUnknown
+	}
+}
+
+// expired returns true if any of the revocation lists has passed its next update.
+func expired(crls []*x509.RevocationList, now time.Time) bool {
+	for _, crl := range crls {
+		if !crl.NextUpdate.IsZero() && now.After(crl.NextUpdate) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// loadCRLs reads the pem or der revocation lists of files.
+func loadCRLs(files []string) ([]*x509.RevocationList, error) {
+	var crls []*x509.RevocationList
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		if !bytes.Contains(b, []byte("-----BEGIN")) {
+			crl, err := x509.ParseRevocationList(b)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", file, err)
+			}
+			crls = append(crls, crl)
+			continue
+		}
+
+		for {
+			var block *pem.Block
+			block, b = pem.Decode(b)
+			if block == nil {
+				break
+			}
+			if block.Type != "X509 CRL" {
+				continue
+			}
+
+			crl, err := x509.ParseRevocationList(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", file, err)
+			}
+			crls = append(crls, crl)
+		}
+	}
+
+	return crls, nil
+}
@@ -0,0 +1,179 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+// Package revocation staples ocsp responses to the server certificates of a tls config
+// and checks the client certificates of mutual tls against certificate revocation lists
+// and ocsp responders.
+package revocation
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	defaultTimeout  = 5 * time.Second
+	maxResponseSize = 1 << 20   // the maximum size of ocsp responses
+	defaultValidity = time.Hour // how long responses without a next update are used
+)
+
+var (
+	ErrCertRevoked  = errors.New("certificate revoked")
+	ErrCRLExpired   = errors.New("certificate revocation list expired")
+	ErrOCSPUnknown  = errors.New("certificate status unknown to the ocsp responder")
+	ErrOCSPFailed   = errors.New("ocsp responder unavailable")
+	ErrNoIssuer     = errors.New("ocsp stapling requires the issuer certificate after the server certificate")
+	ErrNoOCSPServer = errors.New("certificate names no ocsp responder")
+)
+
+// Options configures ocsp stapling and the revocation checks of client certificates.
+type Options struct {
+	// OCSPStapling staples the ocsp response of each server certificate to the tls
+	// handshakes, refreshing it halfway through its validity.
+	OCSPStapling bool
+
+	// CRLFiles are the pem or der certificate revocation lists against which the client
+	// certificates and their intermediates are checked, reloaded once they expire.
+	CRLFiles []string
+
+	// OCSPCheck checks client certificates with the ocsp responders named in them.
+	OCSPCheck bool
+
+	// SoftFail accepts client certificates whose status cannot be determined, because an
+	// ocsp responder is unavailable or a revocation list has expired. Revoked certificates
+	// are always rejected.
+	SoftFail bool
+
+	Timeout time.Duration // the time allowed for each ocsp request, 5 seconds if 0
+	Client  *http.Client  // the client making ocsp requests, http.DefaultClient if nil
+	Log     *slog.Logger  // logs stapling failures, slog.Default if nil
+}
+
+// Enabled returns true if stapling or any revocation check is configured.
+func (o Options) Enabled() bool {
+	return o.OCSPStapling || o.ChecksClients()
+}
+
+// ChecksClients returns true if the client certificates are checked for revocation.
+func (o Options) ChecksClients() bool {
+	return len(o.CRLFiles) > 0 || o.OCSPCheck
+}
+
+// Apply configures a server tls config to staple ocsp responses to its certificates
+// and to reject revoked client certificates, as set in the options.
+func Apply(c *tls.Config, opts Options) error {
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	if opts.Log == nil {
+		opts.Log = slog.Default()
+	}
+
+	if opts.OCSPStapling {
+		staplers := make([]*stapler, 0, len(c.Certificates))
+		for i := range c.Certificates {
+			st, err := newStapler(c.Certificates[i], &opts)
+			if err != nil {
+				return err
+			}
+			staplers = append(staplers, st)
+		}
+		c.GetCertificate = getCertificate(staplers)
+	}
+
+	if opts.ChecksClients() {
+		ch, err := newChecker(&opts)
+		if err != nil {
+			return err
+		}
+
+		next := c.VerifyPeerCertificate
+		c.VerifyPeerCertificate = func(raw [][]byte, chains [][]*x509.Certificate) error {
+			if next != nil {
+				if err := next(raw, chains); err != nil {
+					return err
+				}
+			}
+			return ch.verify(chains)
+		}
+	}
+
+	return nil
+}
+
+// query returns the ocsp response for a certificate from the first of its responders
+// which answers.
+func query(ctx context.Context, opts *Options, cert, issuer *x509.Certificate) (*ocsp.Response, error) {
+	if len(cert.OCSPServer) == 0 {
+		return nil, ErrNoOCSPServer
+	}
+
+	req, err := ocsp.CreateRequest(cert, issuer, &ocsp.RequestOptions{Hash: crypto.SHA1})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	errs := make([]error, 0, len(cert.OCSPServer))
+	for _, url := range cert.OCSPServer {
+		resp, err := post(ctx, opts.Client, url, req, cert, issuer)
+		if err == nil {
+			return resp, nil
+		}
+		errs = append(errs, err)
+	}
+
+	return nil, fmt.Errorf("%w: %w", ErrOCSPFailed, errors.Join(errs...))
+}
+
+// post sends an ocsp request to a responder and parses its response.
+func post(ctx context.Context, client *http.Client, url string, req []byte, cert, issuer *x509.Certificate) (*ocsp.Response, error) {
+	hr, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	hr.Header.Set("Content-Type", "application/ocsp-request")
+	hr.Header.Set("Accept", "application/ocsp-response")
+
+	resp, err := client.Do(hr)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, err
+	}
+
+	return ocsp.ParseResponseForCert(body, cert, issuer)
+}
+
+// expiry returns when an ocsp response or revocation list should no longer be used.
+func expiry(thisUpdate, nextUpdate time.Time) time.Time {
+	if nextUpdate.IsZero() {
+		return thisUpdate.Add(defaultValidity)
+	}
+	return nextUpdate
+}
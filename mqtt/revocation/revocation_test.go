@@ -0,0 +1,346 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package revocation
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ocsp"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &testCA{cert: cert, key: key}
+}
+
+// issue returns a certificate issued by the ca, naming an ocsp responder if not empty.
+func (ca *testCA) issue(t *testing.T, serial int64, responder string, usage x509.ExtKeyUsage) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	if responder != "" {
+		tmpl.OCSPServer = []string{responder}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+}
+
+// writeCRL writes a pem revocation list of the ca revoking serials to a directory.
+func (ca *testCA) writeCRL(t *testing.T, dir string, nextUpdate time.Time, serials ...int64) string {
+	entries := make([]x509.RevocationListEntry, 0, len(serials))
+	for _, serial := range serials {
+		entries = append(entries, x509.RevocationListEntry{SerialNumber: big.NewInt(serial), RevocationTime: time.Now().Add(-time.Minute)})
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                time.Now().Add(-2 * time.Hour),
+		NextUpdate:                nextUpdate,
+		RevokedCertificateEntries: entries,
+	}, ca.cert, ca.key)
+	require.NoError(t, err)
+
+	file := filepath.Join(dir, "ca.crl")
+	require.NoError(t, os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0600))
+	return file
+}
+
+// responder serves ocsp responses from the ca with the status of each serial, good
+// unless set, counting the requests.
+func (ca *testCA) responder(t *testing.T, statuses map[int64]int, requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		req, err := ocsp.ParseRequest(body)
+		require.NoError(t, err)
+
+		tmpl := ocsp.Response{
+			Status:       statuses[req.SerialNumber.Int64()],
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}
+		if tmpl.Status == ocsp.Revoked {
+			tmpl.RevokedAt = time.Now().Add(-time.Minute)
+		}
+		resp, err := ocsp.CreateResponse(ca.cert, ca.cert, tmpl, ca.key)
+		require.NoError(t, err)
+
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		_, _ = w.Write(resp)
+	}))
+}
+
+func (ca *testCA) chain(cert tls.Certificate) [][]*x509.Certificate {
+	return [][]*x509.Certificate{{cert.Leaf, ca.cert}}
+}
+
+func TestOptionsEnabled(t *testing.T) {
+	require.False(t, Options{}.Enabled())
+	require.True(t, Options{OCSPStapling: true}.Enabled())
+	require.False(t, Options{OCSPStapling: true}.ChecksClients())
+	require.True(t, Options{OCSPCheck: true}.ChecksClients())
+	require.True(t, Options{CRLFiles: []string{"ca.crl"}}.ChecksClients())
+}
+
+func TestApplyCRL(t *testing.T) {
+	ca := newTestCA(t)
+	file := ca.writeCRL(t, t.TempDir(), time.Now().Add(time.Hour), 3)
+
+	c := new(tls.Config)
+	require.NoError(t, Apply(c, Options{CRLFiles: []string{file}}))
+	require.NotNil(t, c.VerifyPeerCertificate)
+
+	require.NoError(t, c.VerifyPeerCertificate(nil, ca.chain(ca.issue(t, 2, "", x509.ExtKeyUsageClientAuth))))
+	require.ErrorIs(t, c.VerifyPeerCertificate(nil, ca.chain(ca.issue(t, 3, "", x509.ExtKeyUsageClientAuth))), ErrCertRevoked)
+	require.NoError(t, c.VerifyPeerCertificate(nil, nil))
+}
+
+func TestApplyCRLExpired(t *testing.T) {
+	ca := newTestCA(t)
+	file := ca.writeCRL(t, t.TempDir(), time.Now().Add(-time.Hour))
+	cert := ca.issue(t, 2, "", x509.ExtKeyUsageClientAuth)
+
+	c := new(tls.Config)
+	require.NoError(t, Apply(c, Options{CRLFiles: []string{file}}))
+	require.ErrorIs(t, c.VerifyPeerCertificate(nil, ca.chain(cert)), ErrCRLExpired)
+
+	c = new(tls.Config)
+	require.NoError(t, Apply(c, Options{CRLFiles: []string{file}, SoftFail: true}))
+	require.NoError(t, c.VerifyPeerCertificate(nil, ca.chain(cert)))
+}
+
+func TestApplyCRLInvalid(t *testing.T) {
+	dir := t.TempDir()
+	require.Error(t, Apply(new(tls.Config), Options{CRLFiles: []string{filepath.Join(dir, "missing.crl")}}))
+
+	file := filepath.Join(dir, "bad.crl")
+	require.NoError(t, os.WriteFile(file, []byte("bad"), 0600))
+	require.Error(t, Apply(new(tls.Config), Options{CRLFiles: []string{file}}))
+}
+
+func TestApplyOCSPCheck(t *testing.T) {
+	ca := newTestCA(t)
+	var requests int32
+	srv := ca.responder(t, map[int64]int{3: ocsp.Revoked, 4: ocsp.Unknown}, &requests)
+	defer srv.Close()
+
+	c := new(tls.Config)
+	require.NoError(t, Apply(c, Options{OCSPCheck: true}))
+
+	good := ca.chain(ca.issue(t, 2, srv.URL, x509.ExtKeyUsageClientAuth))
+	require.NoError(t, c.VerifyPeerCertificate(nil, good))
+	require.NoError(t, c.VerifyPeerCertificate(nil, good))
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests)) // cached
+
+	require.ErrorIs(t, c.VerifyPeerCertificate(nil, ca.chain(ca.issue(t, 3, srv.URL, x509.ExtKeyUsageClientAuth))), ErrCertRevoked)
+	require.ErrorIs(t, c.VerifyPeerCertificate(nil, ca.chain(ca.issue(t, 4, srv.URL, x509.ExtKeyUsageClientAuth))), ErrOCSPUnknown)
+	require.NoError(t, c.VerifyPeerCertificate(nil, ca.chain(ca.issue(t, 5, "", x509.ExtKeyUsageClientAuth))))
+}
+
+func TestApplyOCSPCheckUnavailable(t *testing.T) {
+	ca := newTestCA(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	chain := ca.chain(ca.issue(t, 2, srv.URL, x509.ExtKeyUsageClientAuth))
+
+	c := new(tls.Config)
+	require.NoError(t, Apply(c, Options{OCSPCheck: true}))
+	require.ErrorIs(t, c.VerifyPeerCertificate(nil, chain), ErrOCSPFailed)
+
+	c = new(tls.Config)
+	require.NoError(t, Apply(c, Options{OCSPCheck: true, SoftFail: true}))
+	require.NoError(t, c.VerifyPeerCertificate(nil, chain))
+}
+
+func TestApplyChainsVerifyPeerCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	file := ca.writeCRL(t, t.TempDir(), time.Now().Add(time.Hour))
+
+	called := false
+	c := &tls.Config{
+		VerifyPeerCertificate: func([][]byte, [][]*x509.Certificate) error {
+			called = true
+			return nil
+		},
+	}
+	require.NoError(t, Apply(c, Options{CRLFiles: []string{file}}))
+	require.NoError(t, c.VerifyPeerCertificate(nil, ca.chain(ca.issue(t, 2, "", x509.ExtKeyUsageClientAuth))))
+	require.True(t, called)
+}
+
+func TestApplyOCSPStapling(t *testing.T) {
+	ca := newTestCA(t)
+	var requests int32
+	srv := ca.responder(t, nil, &requests)
+	defer srv.Close()
+
+	c := &tls.Config{Certificates: []tls.Certificate{ca.issue(t, 2, srv.URL, x509.ExtKeyUsageServerAuth)}}
+	require.NoError(t, Apply(c, Options{OCSPStapling: true}))
+	require.NotNil(t, c.GetCertificate)
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	cert, err := c.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	resp, err := ocsp.ParseResponse(cert.OCSPStaple, ca.cert)
+	require.NoError(t, err)
+	require.Equal(t, ocsp.Good, resp.Status)
+}
+
+func TestApplyOCSPStaplingUnavailable(t *testing.T) {
+	ca := newTestCA(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	c := &tls.Config{Certificates: []tls.Certificate{ca.issue(t, 2, srv.URL, x509.ExtKeyUsageServerAuth)}}
+	require.NoError(t, Apply(c, Options{OCSPStapling: true}))
+
+	cert, err := c.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	require.Nil(t, cert.OCSPStaple)
+}
+
+func TestApplyOCSPStaplingInvalid(t *testing.T) {
+	ca := newTestCA(t)
+
+	cert := ca.issue(t, 2, "", x509.ExtKeyUsageServerAuth)
+	err := Apply(&tls.Config{Certificates: []tls.Certificate{cert}}, Options{OCSPStapling: true})
+	require.ErrorIs(t, err, ErrNoOCSPServer)
+
+	cert = ca.issue(t, 2, "http://127.0.0.1:1", x509.ExtKeyUsageServerAuth)
+	cert.Certificate = cert.Certificate[:1]
+	err = Apply(&tls.Config{Certificates: []tls.Certificate{cert}}, Options{OCSPStapling: true})
+	require.ErrorIs(t, err, ErrNoIssuer)
+}
+
+func TestStaplerRefresh(t *testing.T) {
+	ca := newTestCA(t)
+	var requests int32
+	srv := ca.responder(t, nil, &requests)
+	defer srv.Close()
+
+	c := &tls.Config{Certificates: []tls.Certificate{ca.issue(t, 2, srv.URL, x509.ExtKeyUsageServerAuth)}}
+	st, err := newStapler(c.Certificates[0], &Options{Timeout: time.Second, Client: http.DefaultClient, Log: slogDiscard()})
+	require.NoError(t, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	st.mu.Lock()
+	st.refreshAt = time.Now().Add(-time.Second)
+	st.mu.Unlock()
+
+	require.NotNil(t, st.certificate().OCSPStaple)
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&requests) == 2 && atomic.LoadUint32(&st.refreshing) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestHandshake(t *testing.T) {
+	ca := newTestCA(t)
+	var requests int32
+	srv := ca.responder(t, map[int64]int{3: ocsp.Revoked}, &requests)
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	server := &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, 2, srv.URL, x509.ExtKeyUsageServerAuth)},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	require.NoError(t, Apply(server, Options{OCSPStapling: true, OCSPCheck: true}))
+
+	handshake := func(client tls.Certificate) (tls.ConnectionState, error) {
+		c, s := net.Pipe()
+		defer c.Close()
+		defer s.Close()
+
+		go func() {
+			_ = tls.Server(s, server).Handshake()
+		}()
+
+		cc := tls.Client(c, &tls.Config{
+			RootCAs:      pool,
+			ServerName:   "localhost",
+			Certificates: []tls.Certificate{client},
+			MaxVersion:   tls.VersionTLS12, // client certificates are rejected during the handshake
+		})
+		err := cc.Handshake()
+		return cc.ConnectionState(), err
+	}
+
+	state, err := handshake(ca.issue(t, 4, srv.URL, x509.ExtKeyUsageClientAuth))
+	require.NoError(t, err)
+	require.NotEmpty(t, state.OCSPResponse)
+
+	_, err = handshake(ca.issue(t, 3, srv.URL, x509.ExtKeyUsageClientAuth))
+	require.Error(t, err)
+}
+
+func slogDiscard() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
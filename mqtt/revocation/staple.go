@@ -0,0 +1,147 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package revocation
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// stapleRetry is the interval between attempts to fetch a staple after a failure.
+const stapleRetry = time.Minute
+
+// stapler keeps the ocsp response of a server certificate stapled to it.
+type stapler struct {
+	mu         sync.RWMutex
+	cert       *tls.Certificate  // the certificate with its current staple
+	leaf       *x509.Certificate // the parsed server certificate
+	issuer     *x509.Certificate // the issuer of the server certificate
+	expires    time.Time         // when the current staple expires
+	refreshAt  time.Time         // when the staple is next fetched
+	refreshing uint32            // a staple is being fetched
+	opts       *Options          // the stapling options
+}
+
+// newStapler returns a stapler for a certificate whose chain includes its issuer,
+// fetching its first staple. A certificate is served without a staple until one can
+// be fetched.
+func newStapler(cert tls.Certificate, opts *Options) (*stapler, error) {
+	if len(cert.Certificate) < 2 {
+		return nil, ErrNoIssuer
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, err
+	}
+
+	if len(leaf.OCSPServer) == 0 {
+		return nil, ErrNoOCSPServer
+	}
+
+	cert.Leaf = leaf
+	st := &stapler{
+		cert:   &cert,
+		leaf:   leaf,
+		issuer: issuer,
+		opts:   opts,
+	}
+	st.refresh()
+
+	return st, nil
+}
+
+// certificate returns the certificate with its current staple, fetching a new staple
+// in the background when it is due.
+func (st *stapler) certificate() *tls.Certificate {
+	st.mu.RLock()
+	cert, due := st.cert, time.Now().After(st.refreshAt)
+	st.mu.RUnlock()
+
+	if due && atomic.CompareAndSwapUint32(&st.refreshing, 0, 1) {
+		go func() {
+			defer atomic.StoreUint32(&st.refreshing, 0)
+			st.refresh()
+		}()
+	}
+
+	return cert
+}
+
+// refresh fetches a new staple, keeping the current staple until it expires if the
+// responder is unavailable.
+func (st *stapler) refresh() {
+	now := time.Now()
+	resp, err := query(context.Background(), st.opts, st.leaf, st.issuer)
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if err != nil {
+		st.opts.Log.Warn("unable to fetch ocsp staple", "subject", st.leaf.Subject.String(), "error", err)
+		st.refreshAt = now.Add(stapleRetry)
+		if now.After(st.expires) && st.cert.OCSPStaple != nil {
+			cert := *st.cert
+			cert.OCSPStaple = nil
+			st.cert = &cert
+		}
+		return
+	}
+
+	if resp.Status != ocsp.Good {
+		st.opts.Log.Warn("server certificate not good", "subject", st.leaf.Subject.String(), "status", statusName(resp.Status))
+	}
+
+	cert := *st.cert
+	cert.OCSPStaple = resp.Raw
+	st.cert = &cert
+	st.expires = expiry(resp.ThisUpdate, resp.NextUpdate)
+	st.refreshAt = resp.ThisUpdate.Add(st.expires.Sub(resp.ThisUpdate) / 2)
+	if st.refreshAt.Before(now) {
+		st.refreshAt = now.Add(stapleRetry)
+	}
+}
+
+// statusName returns the name of an ocsp certificate status.
+func statusName(status int) string {
+	switch status {
+	case ocsp.Good:
+		return "good"
+	case ocsp.Revoked:
+		return "revoked"
+	default:
+		return "unknown"
+	}
+}
+
+// getCertificate returns a tls GetCertificate callback serving the first stapled
+// certificate supported by each client.
+func getCertificate(staplers []*stapler) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		for _, st := range staplers {
+			cert := st.certificate()
+			if hello.SupportsCertificate(cert) == nil {
+				return cert, nil
+			}
+		}
+
+		if len(staplers) == 0 {
+			return nil, nil
+		}
+
+		return staplers[0].certificate(), nil
+	}
+}
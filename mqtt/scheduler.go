@@ -0,0 +1,424 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+// SchedulerClientId is the id of the inline client used to publish scheduled messages.
+const SchedulerClientId = "scheduler"
+
+const (
+	JobPublish         = "publish"          // publish a message to a topic
+	JobRetainedCleanup = "retained-cleanup" // delete expired or old retained messages
+	JobCompact         = "compact"          // compact the storage of hooks which support it
+	JobSessionGC       = "session-gc"       // delete expired or long disconnected sessions
+	JobExport          = "export"           // export a snapshot to the hooks which keep them
+
+	// JobExportLatest is the name of the copy of the last snapshot of an export job.
+	JobExportLatest = "snapshot-latest.ndjson.gz"
+
+	// JobTimestampPlaceholder is replaced in publish payloads with the unix time of the run.
+	JobTimestampPlaceholder = "${timestamp}"
+
+	// JobTimePlaceholder is replaced in publish payloads with the RFC 3339 time of the run.
+	JobTimePlaceholder = "${time}"
+)
+
+var (
+	ErrJobNotFound        = errors.New("scheduled job not found")                                                             // the job does not exist
+	ErrJobExists          = errors.New("scheduled job already exists")                                                        // a job with the name exists
+	ErrJobInvalidName     = errors.New("scheduled job name is required")                                                      // the job has no name
+	ErrJobInvalidType     = errors.New("scheduled job type must be publish, retained-cleanup, compact, session-gc or export") // the job type is unknown
+	ErrJobInvalidTopic    = errors.New("scheduled job topic is invalid")                                                      // the topic or filter of the job is invalid
+	ErrJobInvalidCronSpec = errors.New("scheduled job schedule is invalid")                                                   // the schedule could not be parsed
+	ErrJobNoSnapshotStore = errors.New("no hook keeps exported snapshots")                                                    // an export job has nowhere to upload its snapshot
+)
+
+// Compactor is implemented by hooks, such as storage hooks, whose data can be compacted
+// by scheduled compact jobs.
+type Compactor interface {
+	Compact() error
+}
+
+// SnapshotStore is implemented by hooks, such as the object store hook, which keep the
+// snapshots exported by scheduled export jobs.
+type SnapshotStore interface {
+	// StoreSnapshot keeps a gzip compressed snapshot under a name.
+	StoreSnapshot(name string, data []byte) error
+}
+
+// ScheduledJob is a job run by the broker on a cron schedule.
+type ScheduledJob struct {
+	Name       string `json:"name" yaml:"name"`
+	Schedule   string `json:"schedule" yaml:"schedule"`                 // a standard five field cron spec, or a descriptor such as @hourly or @every 30s
+	Type       string `json:"type" yaml:"type"`                         // the type of the job
+	LeaderOnly bool   `json:"leader_only,omitempty" yaml:"leader-only"` // only run the job on the leader of a cluster
+	Topic      string `json:"topic,omitempty" yaml:"topic"`             // the topic to publish to, or the filter of retained messages to clean up
+	Payload    string `json:"payload,omitempty" yaml:"payload"`         // the payload to publish, with time placeholders
+	Qos        byte   `json:"qos,omitempty" yaml:"qos"`                 // the qos to publish at
+	Retain     bool   `json:"retain,omitempty" yaml:"retain"`           // publish as a retained message
+	MaxAge     int64  `json:"max_age,omitempty" yaml:"max-age"`         // seconds after which retained messages or disconnected sessions are deleted, their expiry when 0
+}
+
+// JobStatus describes a scheduled job and its runs.
+type JobStatus struct {
+	ScheduledJob
+	Next      int64  `json:"next"`                 // the unix time of the next run
+	LastRun   int64  `json:"last_run,omitempty"`   // the unix time of the last run
+	LastError string `json:"last_error,omitempty"` // the error of the last run, if it failed
+	Runs      int64  `json:"runs"`                 // the number of runs
+	Skipped   int64  `json:"skipped"`              // the number of leader only runs skipped on followers
+}
+
+// scheduledJob is a job with its parsed schedule.
+type scheduledJob struct {
+	status   JobStatus
+	schedule cron.Schedule
+	next     time.Time
+}
+
+// Scheduler contains the scheduled jobs of the broker.
+type Scheduler struct {
+	sync.RWMutex
+	internal map[string]*scheduledJob // jobs keyed on name
+	leader   atomic.Value             // func() bool returning true if the node is the cluster leader
+}
+
+// NewScheduler returns a new instance of Scheduler.
+func NewScheduler() *Scheduler {
+	return &Scheduler{
+		internal: map[string]*scheduledJob{},
+	}
+}
+
+// SetLeader sets the func which reports whether the broker is the leader of its cluster,
+// deciding if leader only jobs are run. Brokers which are not clustered are always leader.
+func (s *Scheduler) SetLeader(fn func() bool) {
+	s.leader.Store(fn)
+}
+
+// IsLeader returns true if leader only jobs should be run.
+func (s *Scheduler) IsLeader() bool {
+	if fn, ok := s.leader.Load().(func() bool); ok && fn != nil {
+		return fn()
+	}
+	return true
+}
+
+// Add validates and adds a job, returning its status.
+func (s *Scheduler) Add(job ScheduledJob) (JobStatus, error) {
+	if job.Name == "" {
+		return JobStatus{}, ErrJobInvalidName
+	}
+
+	switch job.Type {
+	case JobPublish:
+		if !IsValidFilter(job.Topic, true) {
+			return JobStatus{}, ErrJobInvalidTopic
+		}
+		if job.Qos > 2 {
+			return JobStatus{}, packets.ErrProtocolViolationQosOutOfRange
+		}
+	case JobRetainedCleanup:
+		if job.Topic != "" && !IsValidFilter(job.Topic, false) {
+			return JobStatus{}, ErrJobInvalidTopic
+		}
+	case JobCompact, JobSessionGC, JobExport:
+	default:
+		return JobStatus{}, ErrJobInvalidType
+	}
+
+	schedule, err := cron.ParseStandard(job.Schedule)
+	if err != nil {
+		return JobStatus{}, fmt.Errorf("%w: %w", ErrJobInvalidCronSpec, err)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.internal[job.Name]; ok {
+		return JobStatus{}, ErrJobExists
+	}
+
+	sj := &scheduledJob{
+		status:   JobStatus{ScheduledJob: job},
+		schedule: schedule,
+		next:     schedule.Next(time.Now()),
+	}
+	sj.status.Next = sj.next.Unix()
+	s.internal[job.Name] = sj
+
+	return sj.status, nil
+}
+
+// Remove removes a job.
+func (s *Scheduler) Remove(name string) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.internal[name]; !ok {
+		return ErrJobNotFound
+	}
+
+	delete(s.internal, name)
+	return nil
+}
+
+// Get returns the status of a job.
+func (s *Scheduler) Get(name string) (JobStatus, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	sj, ok := s.internal[name]
+	if !ok {
+		return JobStatus{}, false
+	}
+
+	return sj.status, true
+}
+
+// GetAll returns the status of all jobs, sorted by name.
+func (s *Scheduler) GetAll() []JobStatus {
+	s.RLock()
+	defer s.RUnlock()
+	jobs := make([]JobStatus, 0, len(s.internal))
+	for _, sj := range s.internal {
+		jobs = append(jobs, sj.status)
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Name < jobs[j].Name
+	})
+
+	return jobs
+}
+
+// Len returns the number of jobs.
+func (s *Scheduler) Len() int {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.internal)
+}
+
+// due returns the jobs due to run at a time, and moves them to their next run.
+func (s *Scheduler) due(now time.Time) []ScheduledJob {
+	s.Lock()
+	defer s.Unlock()
+	var jobs []ScheduledJob
+	for _, sj := range s.internal {
+		if sj.next.After(now) {
+			continue
+		}
+
+		sj.next = sj.schedule.Next(now)
+		sj.status.Next = sj.next.Unix()
+		jobs = append(jobs, sj.status.ScheduledJob)
+	}
+
+	return jobs
+}
+
+// record records the result of a run of a job.
+func (s *Scheduler) record(name string, now time.Time, skipped bool, err error) {
+	s.Lock()
+	defer s.Unlock()
+	sj, ok := s.internal[name]
+	if !ok {
+		return
+	}
+
+	if skipped {
+		sj.status.Skipped++
+		return
+	}
+
+	sj.status.Runs++
+	sj.status.LastRun = now.Unix()
+	sj.status.LastError = ""
+	if err != nil {
+		sj.status.LastError = err.Error()
+	}
+}
+
+// runScheduledJobs runs the jobs which are due, skipping leader only jobs if the
+// broker is not the leader of its cluster.
+func (s *Server) runScheduledJobs(now time.Time) {
+	for _, job := range s.Scheduler.due(now) {
+		if job.LeaderOnly && !s.Scheduler.IsLeader() {
+			s.Scheduler.record(job.Name, now, true, nil)
+			continue
+		}
+
+		err := s.runJob(job, now)
+		if err != nil {
+			s.Log.Warn("scheduled job failed", "error", err, "job", job.Name, "type", job.Type)
+		}
+		s.Scheduler.record(job.Name, now, false, err)
+	}
+}
+
+// RunJob runs a scheduled job immediately, regardless of its schedule and whether
+// the broker is the leader of its cluster.
+func (s *Server) RunJob(name string) (JobStatus, error) {
+	status, ok := s.Scheduler.Get(name)
+	if !ok {
+		return JobStatus{}, ErrJobNotFound
+	}
+
+	now := time.Now()
+	err := s.runJob(status.ScheduledJob, now)
+	s.Scheduler.record(name, now, false, err)
+	status, _ = s.Scheduler.Get(name)
+
+	return status, err
+}
+
+// runJob runs a job.
+func (s *Server) runJob(job ScheduledJob, now time.Time) error {
+	switch job.Type {
+	case JobPublish:
+		return s.publishScheduled(job, now)
+	case JobRetainedCleanup:
+		s.cleanupRetained(job, now)
+	case JobCompact:
+		return s.compactHooks()
+	case JobSessionGC:
+		s.collectSessions(job, now)
+	case JobExport:
+		return s.exportSnapshot(now)
+	default:
+		return ErrJobInvalidType
+	}
+
+	return nil
+}
+
+// publishScheduled publishes the message of a publish job.
+func (s *Server) publishScheduled(job ScheduledJob, now time.Time) error {
+	payload := strings.NewReplacer(
+		JobTimestampPlaceholder, strconv.FormatInt(now.Unix(), 10),
+		JobTimePlaceholder, now.UTC().Format(time.RFC3339),
+	).Replace(job.Payload)
+
+	return s.InjectPacket(s.scheduler, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Qos:    job.Qos,
+			Retain: job.Retain,
+		},
+		TopicName: job.Topic,
+		Payload:   []byte(payload),
+		PacketID:  uint16(job.Qos), // inline clients never process the inbound qos flow.
+	})
+}
+
+// cleanupRetained deletes the retained messages matching the filter of a job which are
+// older than its max age, or which have expired if it has no max age.
+func (s *Server) cleanupRetained(job ScheduledJob, now time.Time) {
+	if job.MaxAge <= 0 && job.Topic == "" {
+		s.clearExpiredRetainedMessages(now.Unix())
+		return
+	}
+
+	filter := job.Topic
+	if filter == "" {
+		filter = "#"
+	}
+
+	for _, pk := range s.Topics.Messages(filter) {
+		expired := (pk.Expiry > 0 && pk.Expiry < now.Unix()) || pk.Created+s.Options.Capabilities.MaximumMessageExpiryInterval < now.Unix()
+		if job.MaxAge > 0 {
+			expired = pk.Created+job.MaxAge < now.Unix()
+		}
+
+		if expired {
+			s.Topics.DeleteRetained(pk.TopicName)
+			s.hooks.OnRetainedExpired(pk.TopicName)
+		}
+	}
+}
+
+// compactHooks compacts the data of each hook which supports compaction.
+func (s *Server) compactHooks() error {
+	var errs []error
+	for _, hook := range s.hooks.GetAll() {
+		if c, ok := hook.(Compactor); ok {
+			if err := c.Compact(); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", hook.ID(), err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// collectSessions deletes the sessions of clients which have been disconnected for
+// longer than the max age of a job, or which have expired if it has no max age.
+func (s *Server) collectSessions(job ScheduledJob, now time.Time) {
+	if job.MaxAge <= 0 {
+		s.clearExpiredClients(now.Unix())
+		return
+	}
+
+	for id, cl := range s.Clients.GetAll() {
+		disconnected := atomic.LoadInt64(&cl.State.disconnected)
+		if disconnected == 0 || disconnected+job.MaxAge >= now.Unix() {
+			continue
+		}
+
+		s.UnsubscribeClient(cl)
+		s.hooks.OnClientExpired(cl)
+		s.Clients.Delete(id)
+	}
+}
+
+// exportSnapshot compresses a snapshot of the broker and gives it to each hook which keeps
+// snapshots, named by the time of the run and again as the latest snapshot, so that a
+// broker can be rebuilt from the last export without listing the snapshots.
+func (s *Server) exportSnapshot(now time.Time) error {
+	var stores []Hook
+	for _, hook := range s.hooks.GetAll() {
+		if _, ok := hook.(SnapshotStore); ok {
+			stores = append(stores, hook)
+		}
+	}
+	if len(stores) == 0 {
+		return ErrJobNoSnapshotStore
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := s.ExportSnapshot(zw); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	name := "snapshot-" + now.UTC().Format("20060102T150405Z") + ".ndjson.gz"
+	var errs []error
+	for _, hook := range stores {
+		store := hook.(SnapshotStore)
+		for _, n := range []string{name, JobExportLatest} {
+			if err := store.StoreSnapshot(n, buf.Bytes()); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", hook.ID(), err))
+				break
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
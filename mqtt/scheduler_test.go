@@ -0,0 +1,285 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+// compactHook counts the compactions of a hook supporting Compactor.
+type compactHook struct {
+	HookBase
+	compacted int
+	err       error
+}
+
+func (h *compactHook) ID() string {
+	return "compact-hook"
+}
+
+func (h *compactHook) Compact() error {
+	h.compacted++
+	return h.err
+}
+
+// snapshotStoreHook keeps the snapshots of export jobs.
+type snapshotStoreHook struct {
+	HookBase
+	snapshots map[string][]byte
+	err       error
+}
+
+func (h *snapshotStoreHook) ID() string {
+	return "snapshot-store"
+}
+
+func (h *snapshotStoreHook) StoreSnapshot(name string, data []byte) error {
+	if h.err != nil {
+		return h.err
+	}
+	h.snapshots[name] = data
+	return nil
+}
+
+func TestSchedulerAdd(t *testing.T) {
+	sc := NewScheduler()
+
+	_, err := sc.Add(ScheduledJob{Schedule: "@hourly", Type: JobCompact})
+	require.ErrorIs(t, err, ErrJobInvalidName)
+
+	_, err = sc.Add(ScheduledJob{Name: "a", Schedule: "@hourly", Type: "reboot"})
+	require.ErrorIs(t, err, ErrJobInvalidType)
+
+	_, err = sc.Add(ScheduledJob{Name: "a", Schedule: "@hourly", Type: JobPublish, Topic: "a/#"})
+	require.ErrorIs(t, err, ErrJobInvalidTopic)
+
+	_, err = sc.Add(ScheduledJob{Name: "a", Schedule: "@hourly", Type: JobPublish, Topic: "a/b", Qos: 3})
+	require.ErrorIs(t, err, packets.ErrProtocolViolationQosOutOfRange)
+
+	_, err = sc.Add(ScheduledJob{Name: "a", Schedule: "@hourly", Type: JobRetainedCleanup, Topic: "a/#/b"})
+	require.ErrorIs(t, err, ErrJobInvalidTopic)
+
+	_, err = sc.Add(ScheduledJob{Name: "a", Schedule: "* * *", Type: JobCompact})
+	require.ErrorIs(t, err, ErrJobInvalidCronSpec)
+
+	st, err := sc.Add(ScheduledJob{Name: "b", Schedule: "@every 10s", Type: JobSessionGC})
+	require.NoError(t, err)
+	require.InDelta(t, time.Now().Unix()+10, st.Next, 1)
+
+	_, err = sc.Add(ScheduledJob{Name: "a", Schedule: "0 3 * * *", Type: JobCompact})
+	require.NoError(t, err)
+
+	_, err = sc.Add(ScheduledJob{Name: "a", Schedule: "@hourly", Type: JobCompact})
+	require.ErrorIs(t, err, ErrJobExists)
+
+	jobs := sc.GetAll()
+	require.Len(t, jobs, 2)
+	require.Equal(t, "a", jobs[0].Name)
+	require.Equal(t, "b", jobs[1].Name)
+
+	require.NoError(t, sc.Remove("a"))
+	require.ErrorIs(t, sc.Remove("a"), ErrJobNotFound)
+	_, ok := sc.Get("a")
+	require.False(t, ok)
+	require.Equal(t, 1, sc.Len())
+}
+
+func TestSchedulerDue(t *testing.T) {
+	sc := NewScheduler()
+	_, err := sc.Add(ScheduledJob{Name: "a", Schedule: "@every 10s", Type: JobCompact})
+	require.NoError(t, err)
+
+	now := time.Now()
+	require.Empty(t, sc.due(now))
+
+	jobs := sc.due(now.Add(time.Second * 11))
+	require.Len(t, jobs, 1)
+	require.Equal(t, "a", jobs[0].Name)
+
+	st, _ := sc.Get("a")
+	require.Equal(t, now.Add(time.Second*21).Unix(), st.Next)
+	require.Empty(t, sc.due(now.Add(time.Second*12)))
+}
+
+func TestSchedulerIsLeader(t *testing.T) {
+	sc := NewScheduler()
+	require.True(t, sc.IsLeader())
+
+	sc.SetLeader(func() bool { return false })
+	require.False(t, sc.IsLeader())
+}
+
+func TestServerRunScheduledJobsLeaderOnly(t *testing.T) {
+	s := newServer()
+	h := new(compactHook)
+	require.NoError(t, s.AddHook(h, nil))
+
+	_, err := s.Scheduler.Add(ScheduledJob{Name: "a", Schedule: "@every 1s", Type: JobCompact, LeaderOnly: true})
+	require.NoError(t, err)
+	_, err = s.Scheduler.Add(ScheduledJob{Name: "b", Schedule: "@every 1s", Type: JobCompact})
+	require.NoError(t, err)
+
+	s.Scheduler.SetLeader(func() bool { return false })
+	s.runScheduledJobs(time.Now().Add(time.Second * 2))
+	require.Equal(t, 1, h.compacted)
+
+	st, _ := s.Scheduler.Get("a")
+	require.Equal(t, int64(1), st.Skipped)
+	require.Equal(t, int64(0), st.Runs)
+
+	s.Scheduler.SetLeader(func() bool { return true })
+	s.runScheduledJobs(time.Now().Add(time.Second * 4))
+	require.Equal(t, 3, h.compacted)
+
+	st, _ = s.Scheduler.Get("a")
+	require.Equal(t, int64(1), st.Runs)
+	require.NotZero(t, st.LastRun)
+}
+
+func TestServerRunJobPublish(t *testing.T) {
+	s := newServerWithInlineClient()
+
+	recv := make(chan packets.Packet, 1)
+	err := s.Subscribe("broker/heartbeat", 1, func(cl *Client, sub packets.Subscription, pk packets.Packet) {
+		recv <- pk
+	})
+	require.NoError(t, err)
+
+	_, err = s.Scheduler.Add(ScheduledJob{
+		Name:     "heartbeat",
+		Schedule: "@every 30s",
+		Type:     JobPublish,
+		Topic:    "broker/heartbeat",
+		Payload:  "alive ${timestamp}",
+		Retain:   true,
+	})
+	require.NoError(t, err)
+
+	now := time.Now().Unix()
+	st, err := s.RunJob("heartbeat")
+	require.NoError(t, err)
+	require.Equal(t, int64(1), st.Runs)
+
+	select {
+	case pk := <-recv:
+		require.Equal(t, SchedulerClientId, pk.Origin)
+		require.Contains(t, []string{
+			"alive " + strconv.FormatInt(now, 10),
+			"alive " + strconv.FormatInt(now+1, 10),
+		}, string(pk.Payload))
+	case <-time.After(time.Second):
+		require.Fail(t, "no scheduled message received")
+	}
+
+	require.Len(t, s.Topics.Messages("broker/heartbeat"), 1)
+
+	_, err = s.RunJob("missing")
+	require.ErrorIs(t, err, ErrJobNotFound)
+}
+
+func TestServerRunJobRetainedCleanup(t *testing.T) {
+	s := newServer()
+	now := time.Now().Unix()
+
+	for topic, created := range map[string]int64{
+		"sensors/old": now - 100,
+		"sensors/new": now - 10,
+		"other/old":   now - 100,
+	} {
+		s.Topics.RetainMessage(packets.Packet{
+			FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true},
+			TopicName:   topic,
+			Payload:     []byte("x"),
+			Created:     created,
+		})
+	}
+
+	_, err := s.Scheduler.Add(ScheduledJob{Name: "a", Schedule: "@daily", Type: JobRetainedCleanup, Topic: "sensors/#", MaxAge: 60})
+	require.NoError(t, err)
+
+	_, err = s.RunJob("a")
+	require.NoError(t, err)
+	require.Len(t, s.Topics.Messages("sensors/#"), 1)
+	require.Len(t, s.Topics.Messages("other/#"), 1)
+}
+
+func TestServerRunJobSessionGC(t *testing.T) {
+	s := newServer()
+	now := time.Now().Unix()
+
+	for id, disconnected := range map[string]int64{"old": now - 100, "new": now - 10, "online": 0} {
+		cl, _, _ := newTestClient()
+		cl.ID = id
+		cl.State.disconnected = disconnected
+		s.Clients.Add(cl)
+	}
+
+	_, err := s.Scheduler.Add(ScheduledJob{Name: "a", Schedule: "@daily", Type: JobSessionGC, MaxAge: 60})
+	require.NoError(t, err)
+
+	_, err = s.RunJob("a")
+	require.NoError(t, err)
+
+	_, ok := s.Clients.Get("old")
+	require.False(t, ok)
+	_, ok = s.Clients.Get("new")
+	require.True(t, ok)
+	_, ok = s.Clients.Get("online")
+	require.True(t, ok)
+}
+
+func TestServerRunJobCompactError(t *testing.T) {
+	s := newServer()
+	h := &compactHook{err: errors.New("test")}
+	require.NoError(t, s.AddHook(h, nil))
+
+	_, err := s.Scheduler.Add(ScheduledJob{Name: "a", Schedule: "@daily", Type: JobCompact})
+	require.NoError(t, err)
+
+	st, err := s.RunJob("a")
+	require.Error(t, err)
+	require.Equal(t, "compact-hook: test", st.LastError)
+	require.Equal(t, 1, h.compacted)
+}
+
+func TestServerServeInvalidSchedule(t *testing.T) {
+	s := newServer()
+	s.Options.Schedule = []ScheduledJob{{Name: "a", Schedule: "@daily", Type: "reboot"}}
+	require.ErrorIs(t, s.Serve(), ErrJobInvalidType)
+}
+
+func TestServerRunJobExport(t *testing.T) {
+	now := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	s := snapshotTestServer(now.Unix())
+	_, err := s.Scheduler.Add(ScheduledJob{Name: "a", Schedule: "@hourly", Type: JobExport})
+	require.NoError(t, err)
+
+	st, err := s.RunJob("a")
+	require.ErrorIs(t, err, ErrJobNoSnapshotStore)
+	require.Equal(t, ErrJobNoSnapshotStore.Error(), st.LastError)
+
+	h := &snapshotStoreHook{snapshots: map[string][]byte{}}
+	require.NoError(t, s.AddHook(h, nil))
+	require.NoError(t, s.runJob(ScheduledJob{Name: "a", Type: JobExport}, now))
+	require.Len(t, h.snapshots, 2)
+	require.Contains(t, h.snapshots, "snapshot-20240501T030000Z.ndjson.gz")
+	require.Equal(t, h.snapshots["snapshot-20240501T030000Z.ndjson.gz"], h.snapshots[JobExportLatest])
+
+	d := newServer()
+	res, err := d.ImportSnapshot(bytes.NewReader(h.snapshots[JobExportLatest]))
+	require.NoError(t, err)
+	require.Equal(t, SnapshotCounts{Clients: 1, Subscriptions: 1, Inflight: 1, Retained: 1}, res.Restored)
+
+	h.err = errors.New("test")
+	err = s.runJob(ScheduledJob{Name: "a", Type: JobExport}, now)
+	require.EqualError(t, err, "snapshot-store: test")
+}
@@ -0,0 +1,101 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+// Types of security events.
+const (
+	SecurityAuthFailure = "auth-failure" // a client failed to authenticate
+	SecurityACLDenied   = "acl-denied"   // a client was denied access to a topic
+	SecurityBlacklisted = "blacklisted"  // a client was rejected by a blacklist
+	SecurityBanned      = "banned"       // a client id, username or ip was banned
+)
+
+// BlacklistedExtKey is the client Ext key set by auth hooks for clients which were
+// rejected by a blacklist rather than for their credentials.
+const BlacklistedExtKey = "blacklisted"
+
+// Blacklist decides the clients and topic access denied regardless of the auth hooks,
+// such as the blacklist ledger of the auth plugins holding the runtime bans.
+type Blacklist interface {
+	// BlacklistAuth returns the index of the first rule matching a client and whether it
+	// allows the client, or -1 if no rule matches.
+	BlacklistAuth(cl *Client) (n int, ok bool)
+	// BlacklistACL returns the index of the first rule deciding the access of a client to
+	// a topic and whether it allows the access, or -1 if no rule decides.
+	BlacklistACL(cl *Client, topic string, write bool) (n int, ok bool)
+}
+
+// SecurityEvent is a failed authentication, acl denial, blacklist hit or ban, passed to
+// the OnSecurityEvent hooks to be exported to an audit system.
+type SecurityEvent struct {
+	Type      string `json:"type"`               // the type of event
+	ClientID  string `json:"clientid,omitempty"` // the id of the client
+	Username  string `json:"username,omitempty"` // the username of the client
+	Remote    string `json:"remote,omitempty"`   // the remote address of the client
+	Listener  string `json:"listener,omitempty"` // the listener the client connected on
+	Topic     string `json:"topic,omitempty"`    // the topic or filter of an acl denial
+	Write     bool   `json:"write,omitempty"`    // true if an acl denial was of a publish
+	Kind      string `json:"kind,omitempty"`     // the kind of value banned, such as username or ip
+	Value     string `json:"value,omitempty"`    // the value banned
+	Duration  int64  `json:"duration,omitempty"` // the seconds of a temporary ban, 0 until it is removed
+	Reason    string `json:"reason,omitempty"`   // why the client was rejected or banned
+	Timestamp int64  `json:"ts"`                 // the unix time of the event
+}
+
+// SecurityEvent passes a security event to the OnSecurityEvent hooks, setting its
+// timestamp if it is not set.
+func (s *Server) SecurityEvent(ev SecurityEvent) {
+	if !s.hooks.Provides(OnSecurityEvent) {
+		return
+	}
+
+	if ev.Timestamp == 0 {
+		ev.Timestamp = time.Now().Unix()
+	}
+
+	s.hooks.OnSecurityEvent(ev)
+}
+
+// clientSecurityEvent passes a security event of a client to the OnSecurityEvent hooks.
+func (s *Server) clientSecurityEvent(typ string, cl *Client, reason string) {
+	s.SecurityEvent(SecurityEvent{
+		Type:     typ,
+		ClientID: cl.ID,
+		Username: string(cl.Properties.Username),
+		Remote:   cl.Net.Remote,
+		Listener: cl.Net.Listener,
+		Reason:   reason,
+	})
+}
+
+// authFailureEvent passes a failed authentication of a client to the OnSecurityEvent hooks,
+// as a blacklist hit if an auth hook rejected the client by its blacklist.
+func (s *Server) authFailureEvent(cl *Client) {
+	if blacklisted, _ := cl.Ext[BlacklistedExtKey].(bool); blacklisted {
+		s.clientSecurityEvent(SecurityBlacklisted, cl, "auth blacklist")
+		return
+	}
+
+	s.clientSecurityEvent(SecurityAuthFailure, cl, packets.ErrBadUsernameOrPassword.Reason)
+}
+
+// aclDenied passes an acl denial of a client to the OnSecurityEvent hooks.
+func (s *Server) aclDenied(cl *Client, topic string, write bool) {
+	s.SecurityEvent(SecurityEvent{
+		Type:     SecurityACLDenied,
+		ClientID: cl.ID,
+		Username: string(cl.Properties.Username),
+		Remote:   cl.Net.Remote,
+		Listener: cl.Net.Listener,
+		Topic:    topic,
+		Write:    write,
+	})
+}
@@ -0,0 +1,161 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+// securityHook records the security events of the server.
+type securityHook struct {
+	HookBase
+	mu     sync.Mutex
+	events []SecurityEvent
+}
+
+func (h *securityHook) ID() string {
+	return "security-events"
+}
+
+func (h *securityHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{OnSecurityEvent}, []byte{b})
+}
+
+func (h *securityHook) OnSecurityEvent(ev SecurityEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, ev)
+}
+
+func (h *securityHook) Events() []SecurityEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]SecurityEvent{}, h.events...)
+}
+
+// blacklistHook denies clients as though they were rejected by a blacklist.
+type blacklistHook struct {
+	HookBase
+}
+
+func (h *blacklistHook) ID() string {
+	return "blacklist"
+}
+
+func (h *blacklistHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{OnConnectAuthenticate}, []byte{b})
+}
+
+func (h *blacklistHook) OnConnectAuthenticate(cl *Client, pk packets.Packet) bool {
+	cl.Ext = map[string]any{BlacklistedExtKey: true}
+	return false
+}
+
+// connectDenied connects the mochi username to a server which denies it.
+func connectDenied(t *testing.T, s *Server) {
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r)
+	}()
+
+	go func() {
+		_, _ = w.Write(userPassConnect(t))
+	}()
+
+	go func() {
+		_, _ = io.ReadAll(w)
+	}()
+
+	require.Error(t, <-o)
+	_ = w.Close()
+	_ = r.Close()
+}
+
+func TestSecurityEventNoHook(t *testing.T) {
+	s := New(&Options{Logger: logger})
+	defer s.Close()
+	s.SecurityEvent(SecurityEvent{Type: SecurityBanned})
+}
+
+func TestSecurityEventAuthFailure(t *testing.T) {
+	s := New(&Options{
+		Logger:           logger,
+		AuthFailureLimit: 1,
+	})
+	h := new(securityHook)
+	_ = s.AddHook(h, nil)
+	_ = s.AddHook(new(DenyHook), nil)
+	defer s.Close()
+
+	connectDenied(t, s)
+
+	events := h.Events()
+	require.Len(t, events, 3)
+	require.Equal(t, SecurityAuthFailure, events[0].Type)
+	require.Equal(t, "mochi", events[0].Username)
+	require.Equal(t, packets.ErrBadUsernameOrPassword.Reason, events[0].Reason)
+	require.NotZero(t, events[0].Timestamp)
+
+	require.Equal(t, SecurityBanned, events[1].Type)
+	require.Equal(t, AuthFailureUsername, events[1].Kind)
+	require.Equal(t, "mochi", events[1].Value)
+	require.Equal(t, int64(defaultAuthFailureBan), events[1].Duration)
+	require.Equal(t, SecurityBanned, events[2].Type)
+	require.Equal(t, AuthFailureIP, events[2].Kind)
+}
+
+func TestSecurityEventBlacklisted(t *testing.T) {
+	s := New(&Options{Logger: logger})
+	h := new(securityHook)
+	_ = s.AddHook(h, nil)
+	_ = s.AddHook(new(blacklistHook), nil)
+	defer s.Close()
+
+	connectDenied(t, s)
+
+	events := h.Events()
+	require.Len(t, events, 1)
+	require.Equal(t, SecurityBlacklisted, events[0].Type)
+	require.Equal(t, "auth blacklist", events[0].Reason)
+}
+
+func TestSecurityEventACLDenied(t *testing.T) {
+	s := New(&Options{Logger: logger})
+	h := new(securityHook)
+	_ = s.AddHook(h, nil)
+	_ = s.AddHook(new(DenyHook), nil)
+	defer s.Close()
+
+	cl, r, w := newTestClient()
+	defer cl.Stop(errClientStop)
+	cl.Properties.Username = []byte("mochi")
+	go func() {
+		_, _ = io.ReadAll(r)
+	}()
+
+	err := s.processSubscribe(cl, *packets.TPacketData[packets.Subscribe].Get(packets.TSubscribe).Packet)
+	require.NoError(t, err)
+	_ = w.Close()
+
+	events := h.Events()
+	require.Len(t, events, 1)
+	require.Equal(t, SecurityEvent{
+		Type:      SecurityACLDenied,
+		ClientID:  cl.ID,
+		Username:  "mochi",
+		Remote:    cl.Net.Remote,
+		Listener:  cl.Net.Listener,
+		Topic:     "a/b/c",
+		Timestamp: events[0].Timestamp,
+	}, events[0])
+}
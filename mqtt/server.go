@@ -6,6 +6,7 @@
 package mqtt
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"math"
@@ -19,6 +20,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/wind-c/comqtt/v2/mqtt/faults"
 	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
 	"github.com/wind-c/comqtt/v2/mqtt/listeners"
 	"github.com/wind-c/comqtt/v2/mqtt/packets"
@@ -32,6 +34,7 @@ const (
 	defaultSysTopicInterval int64 = 1               // the interval between $SYS topic publishes
 	LocalListener                 = "local"
 	InlineClientId                = "inline"
+	maxAuthRounds                 = 16 // the maximum number of rounds of an enhanced authentication exchange
 )
 
 var (
@@ -54,6 +57,9 @@ var (
 	ErrListenerIDExists       = errors.New("listener id already exists")                               // a listener with the same id already exists
 	ErrConnectionClosed       = errors.New("connection not open")                                      // connection is closed
 	ErrInlineClientNotEnabled = errors.New("please set Options.InlineClient=true to use this feature") // inline client is not enabled by default
+	ErrMessageExpired         = errors.New("message expiry interval has elapsed")                      // the message expired before it could be delivered
+	ErrBannedIP               = errors.New("connection from banned ip")                                // the source ip is banned for exceeding its connection rate
+	ErrIPNotAllowed           = errors.New("connection from ip not allowed by listener")               // the source ip is not allowed by the ip filter of the listener
 )
 
 // Capabilities indicates the capabilities and features provided by the server.
@@ -113,6 +119,158 @@ type Options struct {
 	// Enable Inline client to allow direct subscribing and publishing from the parent codebase,
 	// with negligible performance difference (disabled by default to prevent confusion in statistics).
 	InlineClient bool `yaml:"inline-client"`
+
+	// TopicStatsDepth enables per topic tree statistics, grouping topics by their first
+	// TopicStatsDepth levels. Statistics are disabled when 0.
+	TopicStatsDepth int `yaml:"topic-stats-depth"`
+
+	// ConnectRateLimit specifies the maximum number of connections accepted per second.
+	// Connections over the limit are rejected as server busy. Unlimited when 0.
+	ConnectRateLimit int64 `yaml:"connect-rate-limit"`
+
+	// ConnectRateBurst specifies the number of connections which may be accepted at once
+	// before the connection rate limit applies. The rate limit is used if it is lower.
+	ConnectRateBurst int64 `yaml:"connect-rate-burst"`
+
+	// ConnectIPRateLimit specifies the maximum number of connections accepted per second
+	// from each source ip, checked before authentication. Connections over the limit are
+	// rejected as server busy. Unlimited when 0.
+	ConnectIPRateLimit int64 `yaml:"connect-ip-rate-limit"`
+
+	// ConnectIPRateBurst specifies the number of connections which may be accepted at once
+	// from each source ip. The ip rate limit is used if it is lower.
+	ConnectIPRateBurst int64 `yaml:"connect-ip-rate-burst"`
+
+	// ConnectIPBan specifies the seconds for which a source ip exceeding the ip rate limit
+	// is banned. Connections from banned ips are closed before their connect packet is
+	// read. Only the connections over the limit are rejected when 0.
+	ConnectIPBan int64 `yaml:"connect-ip-ban"`
+
+	// MaximumConnections specifies the maximum number of connected clients before new
+	// connections are rejected as server busy. Unlimited when 0.
+	MaximumConnections int64 `yaml:"maximum-connections"`
+
+	// MaximumConnectionsIPv4 and MaximumConnectionsIPv6 specify the maximum number of
+	// clients connected over each address family before new connections of the family
+	// are rejected as server busy. Unlimited when 0.
+	MaximumConnectionsIPv4 int64 `yaml:"maximum-connections-ipv4"`
+	MaximumConnectionsIPv6 int64 `yaml:"maximum-connections-ipv6"`
+
+	// MaximumUserConnections specifies the maximum number of clients connected with each
+	// username before new connections of the username are rejected as quota exceeded.
+	// Auth hooks may set the maximum of a username in the max-connections client Ext
+	// value. Unlimited when 0.
+	MaximumUserConnections int64 `yaml:"maximum-user-connections"`
+
+	// AuthFailureLimit specifies the number of failed authentications of a username or
+	// source ip within the AuthFailureWindow seconds before it is temporarily banned.
+	// Connections of banned usernames and ips are rejected as banned before they are
+	// authenticated. Disabled when 0.
+	AuthFailureLimit int64 `yaml:"auth-failure-limit"`
+
+	// AuthFailureWindow specifies the seconds over which failed authentications are
+	// counted. Defaults to 60.
+	AuthFailureWindow int64 `yaml:"auth-failure-window"`
+
+	// AuthFailureBan and AuthFailureMaxBan specify the seconds of the first ban of a username
+	// or source ip, which doubles each time it is banned again up to the max ban. Default to
+	// 60 and 3600.
+	AuthFailureBan    int64 `yaml:"auth-failure-ban"`
+	AuthFailureMaxBan int64 `yaml:"auth-failure-max-ban"`
+
+	// ConnectBackoff specifies the progressive backoff windows in seconds which are hinted
+	// to MQTT v5 clients that are rejected as server busy. Each consecutive rejection of a
+	// client moves to the next window, and reconnecting within a window is also rejected.
+	ConnectBackoff []int64 `yaml:"connect-backoff"`
+
+	// DeadLetterTopic specifies a topic to which messages that are dropped due to queue
+	// overflow, expiry, or failed delivery are published along with the reason they were
+	// dropped. Bridges can consume dead letters by subscribing to this topic. Disabled when empty.
+	DeadLetterTopic string `yaml:"dead-letter-topic"`
+
+	// DeadLetterQos specifies the qos at which dead letters are published.
+	DeadLetterQos byte `yaml:"dead-letter-qos"`
+
+	// ClientIDPolicy restricts the client ids clients may connect with and configures the
+	// assignment of client ids to clients connecting with an empty client id. The charset,
+	// lengths and prefixes of client ids are checked before authentication, and the pattern
+	// and username prefix when clients authenticate. Not enforced when nil.
+	ClientIDPolicy *ClientIDPolicy `yaml:"client-id-policy"`
+
+	// CaptureDir specifies the directory packet capture files are written to. The system
+	// temporary directory is used when empty.
+	CaptureDir string `yaml:"capture-dir"`
+
+	// Compression configures the gzip compression of payloads for MQTT v5 clients which
+	// negotiate it on the selected listeners. Disabled when nil.
+	Compression *CompressionPolicy `yaml:"compression"`
+
+	// UsageStats enables metering of the messages, bytes and connection time of each
+	// username and tenant, e.g. for billing the users of a managed broker.
+	UsageStats bool `yaml:"usage-stats"`
+
+	// UsageReportInterval specifies the interval in seconds at which usage reports are
+	// passed to OnUsageReport hooks for export. Reports are disabled when 0.
+	UsageReportInterval int64 `yaml:"usage-report-interval"`
+
+	// HookFailureLimit specifies the number of consecutive panics or errors after which
+	// a hook is disabled and bypassed, so that a faulty hook cannot degrade the broker.
+	// Panics in hooks are always recovered. Hooks are never disabled when 0.
+	HookFailureLimit int64 `yaml:"hook-failure-limit"`
+
+	// ConnectionProbe configures the probing of idle connections with tcp keepalive and
+	// an idle timeout, so that half-open connections are reaped sooner. Disabled when nil.
+	ConnectionProbe *ConnectionProbe `yaml:"connection-probe"`
+
+	// UserPublishRate specifies the maximum publishes per second of each username, shared
+	// by all clients connecting with the username. Unlimited when 0.
+	UserPublishRate int64 `yaml:"user-publish-rate"`
+
+	// UserPublishBurst specifies the number of publishes a username may send at once before
+	// being limited to the publish rate. Defaults to the publish rate.
+	UserPublishBurst int64 `yaml:"user-publish-burst"`
+
+	// RetainedPacing configures the gradual delivery of retained messages to subscriptions
+	// matching many of them. All are delivered immediately when nil.
+	RetainedPacing *RetainedPacing `yaml:"retained-pacing"`
+
+	// RetainedLimits caps the number and bytes of the retained messages, globally with an
+	// empty prefix or for the topics beginning with a prefix, evicting the least recently
+	// used retained messages or rejecting new ones once a limit is reached.
+	RetainedLimits []RetainedLimit `yaml:"retained-limits"`
+
+	// Tiering keeps only the hot retained messages and the queued messages of recently
+	// connected clients in memory, spilling the cold ones to a bolt or badger storage hook.
+	// All are kept in memory when nil.
+	Tiering *TieringOptions `yaml:"tiering"`
+
+	// WAL appends the inflight messages to a write-ahead log before the storage hooks are
+	// called, and replays it on startup, so that messages being delivered are not lost if
+	// the broker crashes before a buffered storage hook writes them. Disabled when nil.
+	WAL *WALOptions `yaml:"wal"`
+
+	// Schedule specifies the jobs the broker runs on cron schedules, such as periodic
+	// publishes and maintenance jobs. Jobs may also be managed while the broker runs.
+	Schedule []ScheduledJob `yaml:"schedule"`
+
+	// Annotation configures the annotation of messages with broker metadata, such as the
+	// receiving node and the publishing client, as MQTT v5 user properties. Disabled when nil.
+	Annotation *AnnotationPolicy `yaml:"annotation"`
+
+	// DrainTimeout specifies the seconds over which Close disconnects the connected clients
+	// in batches after the listeners stop accepting connections, so that the clients do not
+	// all reconnect to the other servers at once. Clients are disconnected at once when 0.
+	DrainTimeout int64 `yaml:"drain-timeout"`
+
+	// DrainServerReference specifies the server which MQTT v5 clients disconnected by a
+	// drain are referred to with the Use Another Server reason code, rather than Server
+	// Shutting Down, e.g. the address of another node behind a different load balancer.
+	DrainServerReference string `yaml:"drain-server-reference"`
+
+	// FaultInjection enables the injection of latency, errors and drops into storage writes,
+	// auth calls, cluster relays and raft applies, to verify the resilience of a running
+	// broker or cluster. It must never be enabled in production.
+	FaultInjection bool `yaml:"fault-injection"`
 }
 
 // Server is an MQTT broker server. It should be created with server.New()
@@ -122,13 +280,32 @@ type Server struct {
 	Listeners    *listeners.Listeners // listeners are network interfaces which listen for new connections
 	Clients      *Clients             // clients known to the broker
 	Topics       *TopicsIndex         // an index of topic filter subscriptions and retained messages
+	TopicStats   *TopicStats          // statistics for topic trees, nil if not enabled
+	Usage        *Usage               // usage metering of users and tenants, nil if not enabled
+	Groups       *ClientGroups        // named groups of clients for group-targeted operations
+	Throttle     *ConnectThrottle     // connection throttling and client backoff, nil if not enabled
+	UserConns    *UserConnections     // the clients connected with each username, to limit their connections
+	AuthFailures *AuthFailures        // failed authentications and temporary bans, nil if not enabled
+	Capture      *PacketCapture       // packet capture for troubleshooting clients
+	Events       *EventStreams        // topic filter subscriptions held by http server-sent event clients
+	Freeze       *Freeze              // maintenance freeze of new connections, subscriptions and retained messages
+	Scheduler    *Scheduler           // cron scheduled publishes and maintenance jobs
+	Faults       *faults.Injector     // injected faults for resilience testing
+	limiter      RateLimiter          // the token buckets of connection and publish rate limits
 	Info         *system.Info         // values about the server commonly known as $SYS topics
 	loop         *loop                // loop contains tickers for the system event loop
 	done         chan bool            // indicate that the server is ending
+	started      uint32               // 1 once the server has started serving its listeners
+	readyChecks  healthChecks         // the checks added to the readiness probe
 	Log          *slog.Logger         // minimal no-alloc logger
 	hooks        *Hooks               // hooks contains hooks for extra functionality such as auth and persistent storage
 	inlineClient *Client              // inlineClient is a special client used for inline subscriptions and inline Publish
-	Blacklist    []string             // blacklist of client id
+	deadLetters  *Client              // deadLetters is an inline client used to publish dead letters, nil if not enabled
+	scheduler    *Client              // scheduler is an inline client used to publish the messages of scheduled jobs
+	Blacklist    []string             // client ids which are always denied, see Bans for the bans managed at runtime
+	Bans         BlacklistManager     // runtime bans of the auth blacklist, nil if not enabled
+	cold         ColdStore            // the store cold retained and queued messages are read from, nil if not tiering
+	coldLoads    atomic.Int64         // the cold queued messages read from the store
 }
 
 // loop contains interval tickers for the system events loop.
@@ -138,15 +315,18 @@ type loop struct {
 	inflightExpiry *time.Ticker     // interval ticker for cleaning up expired inflight messages
 	retainedExpiry *time.Ticker     // interval ticker for cleaning retained messages
 	willDelaySend  *time.Ticker     // interval ticker for sending Will Messages with a delay
+	usageReport    *time.Ticker     // interval ticker for reporting usage, nil if not enabled
+	scheduledJobs  *time.Ticker     // interval ticker for running due scheduled jobs
 	willDelayed    *packets.Packets // activate LWT packets which will be sent after a delay
 }
 
 // ops contains server values which can be propagated to other structs.
 type ops struct {
-	options *Options     // a pointer to the server options and capabilities, for referencing in clients
-	info    *system.Info // pointers to server system info
-	hooks   *Hooks       // pointer to the server hooks
-	log     *slog.Logger // a structured logger for the client
+	options *Options       // a pointer to the server options and capabilities, for referencing in clients
+	info    *system.Info   // pointers to server system info
+	hooks   *Hooks         // pointer to the server hooks
+	log     *slog.Logger   // a structured logger for the client
+	capture *PacketCapture // packet capture for troubleshooting
 }
 
 // New returns a new instance of comqtt broker. Optional parameters
@@ -162,6 +342,8 @@ func New(opts *Options) *Server {
 		done:      make(chan bool),
 		Clients:   NewClients(),
 		Topics:    NewTopicsIndex(),
+		Groups:    NewClientGroups(),
+		UserConns: NewUserConnections(),
 		Listeners: listeners.New(),
 		loop: &loop{
 			sysTopics:      time.NewTicker(time.Second * time.Duration(opts.SysTopicResendInterval)),
@@ -169,19 +351,60 @@ func New(opts *Options) *Server {
 			inflightExpiry: time.NewTicker(time.Second),
 			retainedExpiry: time.NewTicker(time.Second),
 			willDelaySend:  time.NewTicker(time.Second),
+			scheduledJobs:  time.NewTicker(time.Second),
 			willDelayed:    packets.NewPackets(),
 		},
 		Options: opts,
 		Info: &system.Info{
-			Version: Version,
-			Started: time.Now().Unix(),
+			Version:   Version,
+			Started:   time.Now().Unix(),
+			Listeners: system.NewListenersInfo(),
 		},
 		Log: opts.Logger,
 		hooks: &Hooks{
-			Log: opts.Logger,
+			Log:          opts.Logger,
+			FailureLimit: opts.HookFailureLimit,
 		},
+		Capture:   NewPacketCapture(opts.CaptureDir),
+		Events:    NewEventStreams(),
+		Freeze:    NewFreeze(),
+		Scheduler: NewScheduler(),
+		Faults:    faults.NewInjector(opts.FaultInjection),
+		limiter:   NewMemoryRateLimiter(),
+	}
+	s.hooks.Faults = s.Faults
+
+	if s.Options.TopicStatsDepth > 0 {
+		s.TopicStats = NewTopicStats(s.Options.TopicStatsDepth)
+	}
+
+	if s.Options.UsageStats {
+		s.Usage = NewUsage(time.Now().Unix())
+		if s.Options.UsageReportInterval > 0 {
+			s.loop.usageReport = time.NewTicker(time.Second * time.Duration(s.Options.UsageReportInterval))
+		}
+	}
+
+	if s.Options.ConnectRateLimit > 0 || s.Options.MaximumConnections > 0 || s.Options.ConnectIPRateLimit > 0 ||
+		s.Options.MaximumConnectionsIPv4 > 0 || s.Options.MaximumConnectionsIPv6 > 0 {
+		s.Throttle = NewConnectThrottle(s.Options.ConnectRateLimit, s.Options.ConnectBackoff)
+		s.Throttle.SetBurst(s.Options.ConnectRateBurst)
+		s.Throttle.LimitIPs(s.Options.ConnectIPRateLimit, s.Options.ConnectIPRateBurst, s.Options.ConnectIPBan)
+	}
+
+	if s.Options.AuthFailureLimit > 0 {
+		s.AuthFailures = NewAuthFailures(s.Options.AuthFailureLimit, s.Options.AuthFailureWindow,
+			s.Options.AuthFailureBan, s.Options.AuthFailureMaxBan)
 	}
 
+	s.SetRateLimiter(s.limiter)
+
+	if s.Options.DeadLetterTopic != "" {
+		s.deadLetters = s.NewClient(nil, LocalListener, DeadLetterClientId, true)
+	}
+
+	s.scheduler = s.NewClient(nil, LocalListener, SchedulerClientId, true)
+
 	if s.Options.InlineClient {
 		s.inlineClient = s.NewClient(nil, LocalListener, InlineClientId, true)
 		s.Clients.Add(s.inlineClient)
@@ -226,6 +449,7 @@ func (s *Server) NewClient(c net.Conn, listener string, id string, inline bool)
 		info:    s.Info,
 		hooks:   s.hooks,
 		log:     s.Log,
+		capture: s.Capture,
 	})
 
 	cl.ID = id
@@ -243,6 +467,125 @@ func (s *Server) NewClient(c net.Conn, listener string, id string, inline bool)
 	return cl
 }
 
+// SetRateLimiter sets the limiter holding the token buckets of the connection and publish
+// rate limits. A limiter shared by the nodes of a cluster enforces the limits across the
+// cluster rather than on each node.
+func (s *Server) SetRateLimiter(l RateLimiter) {
+	s.limiter = l
+	s.Groups.SetLimiter(l)
+	if s.Throttle != nil {
+		s.Throttle.SetLimiter(l)
+	}
+}
+
+// HookStats returns the failure counters of each hook.
+func (s *Server) HookStats() []HookStats {
+	return s.hooks.Stats()
+}
+
+// EnableHook re-enables a hook which was disabled after too many consecutive failures,
+// returning false if there is no hook with the id.
+func (s *Server) EnableHook(id string) bool {
+	return s.hooks.Enable(id)
+}
+
+// AuthCacheInvalidator is implemented by auth hooks which cache the auth and acl lookups
+// of their datasource, so that changes to the datasource can be applied immediately.
+type AuthCacheInvalidator interface {
+	// InvalidateAuthCache removes the cached lookups of a username or client id, or all
+	// cached lookups if the key is empty, returning the number of lookups removed.
+	InvalidateAuthCache(key string) int
+}
+
+// InvalidateAuthCache removes the cached lookups of a username or client id from each
+// auth hook which caches them, or all cached lookups if the key is empty, returning the
+// number of lookups removed.
+func (s *Server) InvalidateAuthCache(key string) int {
+	n := 0
+	for _, hook := range s.hooks.GetAll() {
+		if c, ok := hook.(AuthCacheInvalidator); ok {
+			n += c.InvalidateAuthCache(key)
+		}
+	}
+
+	return n
+}
+
+// AuthMetrics contains the decisions, datasource latency and cache hits of an auth hook.
+type AuthMetrics struct {
+	ID           string           `json:"id"`
+	AuthAllowed  int64            `json:"auth_allowed"`   // clients allowed to connect
+	AuthDenied   int64            `json:"auth_denied"`    // clients denied from connecting
+	AuthUnknown  int64            `json:"auth_unknown"`   // clients left to the next datasource of an auth chain
+	AclAllowed   int64            `json:"acl_allowed"`    // publishes and subscriptions allowed
+	AclDenied    int64            `json:"acl_denied"`     // publishes and subscriptions denied
+	CacheHits    int64            `json:"cache_hits"`     // lookups answered by the cache
+	CacheMisses  int64            `json:"cache_misses"`   // lookups not in the cache
+	CacheHitRate float64          `json:"cache_hit_rate"` // the fraction of lookups answered by the cache
+	Latency      LatencyHistogram `json:"latency"`        // the latency of lookups in the datasource
+}
+
+// LatencyHistogram is a histogram of the milliseconds taken by lookups.
+type LatencyHistogram struct {
+	Count   int64           `json:"count"`   // the number of lookups
+	Sum     float64         `json:"sum"`     // the total milliseconds of the lookups
+	Buckets []LatencyBucket `json:"buckets"` // the cumulative counts of lookups, by upper bound
+}
+
+// LatencyBucket is the number of lookups which took at most Le milliseconds.
+type LatencyBucket struct {
+	Le    float64 `json:"le"`
+	Count int64   `json:"count"`
+}
+
+// AuthMetricsProvider is implemented by auth hooks which count their decisions, the latency
+// of their datasource and the hits of their cache.
+type AuthMetricsProvider interface {
+	// AuthMetrics returns the current metrics of the hook.
+	AuthMetrics() AuthMetrics
+}
+
+// AuthMetrics returns the metrics of each auth hook which counts them.
+func (s *Server) AuthMetrics() []AuthMetrics {
+	ms := []AuthMetrics{}
+	for _, hook := range s.hooks.GetAll() {
+		if p, ok := hook.(AuthMetricsProvider); ok {
+			ms = append(ms, p.AuthMetrics())
+		}
+	}
+
+	return ms
+}
+
+const (
+	BanClient   = "client"   // bans a client id
+	BanUsername = "username" // bans a username
+	BanIP       = "ip"       // bans the remote ip of clients
+)
+
+// Ban is a client id, username or ip banned by the auth blacklist.
+type Ban struct {
+	Kind  string `json:"kind"` // client, username or ip
+	Value string `json:"value"`
+}
+
+// BlacklistManager manages the bans of the auth blacklist at runtime.
+type BlacklistManager interface {
+	// Ban bans a client id, username or ip, returning the number of connected clients
+	// which were disconnected.
+	Ban(kind, value string) (int, error)
+	// Unban removes a ban, returning false if there was no such ban.
+	Unban(kind, value string) bool
+	// Bans returns the bans added at runtime.
+	Bans() []Ban
+}
+
+// SetBlacklist sets the blacklist denying clients before any auth hook is called, including
+// the clients of anonymous listeners. It should be called before s.Serve().
+func (s *Server) SetBlacklist(bl Blacklist) {
+	s.hooks.Blacklist = bl
+}
+
 // AddHook attaches a new Hook to the server. Ideally, this should be called
 // before the server is started with s.Serve().
 func (s *Server) AddHook(hook Hook, config any) error {
@@ -261,22 +604,89 @@ func (s *Server) AddListener(l listeners.Listener) error {
 		return ErrListenerIDExists
 	}
 
+	if c, ok := l.(listeners.Configurable); ok && c.Config() != nil {
+		if c.Config().IPFilter == nil {
+			c.Config().IPFilter = new(listeners.IPFilter) // so the filter can be set while serving
+		} else if err := c.Config().IPFilter.Compile(); err != nil {
+			return err
+		}
+	}
+
 	nl := s.Log.With(slog.String("listener", l.ID()))
 	err := l.Init(nl)
 	if err != nil {
 		return err
 	}
 
+	if c, ok := l.(listeners.Configurable); ok && c.Config() != nil {
+		s.hooks.SetListenerAuth(l.ID(), c.Config().Auth)
+	}
+
 	s.Listeners.Add(l)
+	s.Info.Listeners.Get(l.ID())
 	s.Log.Info("attached listener", "id", l.ID(), "protocol", l.Protocol(), "address", l.Address())
 	return nil
 }
 
+// ListenerIPFilter returns the ip filter of a listener, or false if the listener does
+// not exist or cannot be filtered.
+func (s *Server) ListenerIPFilter(id string) (*listeners.IPFilter, bool) {
+	l, ok := s.Listeners.Get(id)
+	if !ok {
+		return nil, false
+	}
+
+	c, ok := l.(listeners.Configurable)
+	if !ok || c.Config() == nil || c.Config().IPFilter == nil {
+		return nil, false
+	}
+
+	return c.Config().IPFilter, true
+}
+
+// allowedIP returns true if the ip filter of a listener allows a remote address.
+func (s *Server) allowedIP(listener, remote string) bool {
+	f, ok := s.ListenerIPFilter(listener)
+	return !ok || f.Allowed(remote)
+}
+
 // Serve starts the event loops responsible for establishing client connections
 // on all attached listeners, publishing the system topics, and starting all hooks.
 func (s *Server) Serve() error {
 	defer s.Log.Info("server started", slog.String("version", s.Info.Version))
 
+	if s.Options.ClientIDPolicy != nil {
+		if err := s.Options.ClientIDPolicy.Compile(); err != nil {
+			return err
+		}
+	}
+
+	if s.Options.Compression != nil {
+		if err := s.Options.Compression.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if s.Options.Annotation != nil {
+		if err := s.Options.Annotation.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := s.Topics.SetRetainedLimits(s.Options.RetainedLimits); err != nil {
+		return err
+	}
+
+	if err := s.setupTiering(); err != nil {
+		return err
+	}
+
+	for _, job := range s.Options.Schedule {
+		if _, err := s.Scheduler.Add(job); err != nil {
+			return fmt.Errorf("schedule %s: %w", job.Name, err)
+		}
+	}
+
 	if s.hooks.Provides(
 		StoredClients,
 		StoredInflightMessages,
@@ -290,10 +700,15 @@ func (s *Server) Serve() error {
 		}
 	}
 
+	if err := s.setupWAL(); err != nil {
+		return err
+	}
+
 	go s.eventLoop()                            // spin up event loop for issuing $SYS values and closing server.
 	s.Listeners.ServeAll(s.EstablishConnection) // start listening on all listeners.
 	s.publishSysTopics()                        // begin publishing $SYS system values.
 	s.hooks.OnStarted()
+	atomic.StoreUint32(&s.started, 1)
 
 	return nil
 }
@@ -303,6 +718,12 @@ func (s *Server) eventLoop() {
 	s.Log.Debug("system event loop started")
 	defer s.Log.Debug("system event loop halted")
 
+	var usageReport <-chan time.Time
+	if s.loop.usageReport != nil {
+		usageReport = s.loop.usageReport.C
+		defer s.loop.usageReport.Stop()
+	}
+
 	for {
 		select {
 		case <-s.done:
@@ -312,19 +733,49 @@ func (s *Server) eventLoop() {
 			s.publishSysTopics()
 		case <-s.loop.clientExpiry.C:
 			s.clearExpiredClients(time.Now().Unix())
+			if s.Throttle != nil {
+				s.Throttle.ClearExpired(time.Now().Unix())
+			}
+			if s.AuthFailures != nil {
+				s.AuthFailures.ClearExpired(time.Now().Unix())
+			}
+			if l, ok := s.limiter.(*MemoryRateLimiter); ok {
+				l.ClearExpired(time.Now())
+			}
 		case <-s.loop.retainedExpiry.C:
 			s.clearExpiredRetainedMessages(time.Now().Unix())
 		case <-s.loop.willDelaySend.C:
 			s.sendDelayedLWT(time.Now().Unix())
 		case <-s.loop.inflightExpiry.C:
-			s.clearExpiredInflights(time.Now().Unix())
+			now := time.Now().Unix()
+			s.clearExpiredInflights(now)
+			s.spillInflights(now)
+		case <-usageReport:
+			s.reportUsage(time.Now().Unix())
+		case <-s.loop.scheduledJobs.C:
+			s.runScheduledJobs(time.Now())
 		}
 	}
 }
 
 // EstablishConnection establishes a new client when a listener accepts a new connection.
 func (s *Server) EstablishConnection(listener string, c net.Conn) error {
+	stats := s.Info.Listeners.Get(listener)
+	if stats != nil {
+		atomic.AddInt64(&stats.Accepted, 1)
+	}
+
+	if !s.allowedIP(listener, c.RemoteAddr().String()) {
+		if stats != nil {
+			atomic.AddInt64(&stats.Rejected, 1)
+		}
+		_ = c.Close()
+		return ErrIPNotAllowed
+	}
+
+	s.Options.ConnectionProbe.probeConn(c)
 	cl := s.NewClient(c, listener, "", false)
+	cl.Net.stats = stats
 	return s.attachClient(cl, listener)
 }
 
@@ -332,15 +783,30 @@ func (s *Server) EstablishConnection(listener string, c net.Conn) error {
 // to the server, performs session housekeeping, and reads incoming packets.
 func (s *Server) attachClient(cl *Client, listener string) error {
 	defer cl.Stop(nil)
+
+	attached := false
+	if stats := cl.Net.stats; stats != nil {
+		defer func() {
+			if !attached {
+				atomic.AddInt64(&stats.Rejected, 1)
+			}
+		}()
+	}
+
+	if s.Throttle != nil && s.Throttle.Banned(remoteIP(cl.Net.Remote), time.Now().Unix()) {
+		return ErrBannedIP
+	}
+
 	pk, err := s.readConnectionPacket(cl)
 	if err != nil {
+		if stats := cl.Net.stats; stats != nil && failedHandshake(cl.Net.Conn) {
+			atomic.AddInt64(&stats.TLSFailures, 1)
+		}
 		return fmt.Errorf("read connection: %w", err)
 	}
 
 	cl.ParseConnect(listener, pk)
-	if slices.Contains(s.Blacklist, cl.ID) {
-		return fmt.Errorf("blacklisted client: %s", cl.ID)
-	}
+	s.assignClientID(cl, pk)
 
 	code := s.validateConnect(cl, pk) // [MQTT-3.1.4-1] [MQTT-3.1.4-2]
 	if code != packets.CodeSuccess {
@@ -350,30 +816,59 @@ func (s *Server) attachClient(cl *Client, listener string) error {
 		return code // [MQTT-3.2.2-7] [MQTT-3.1.4-6]
 	}
 
+	if err := s.throttleConnect(cl); err != nil {
+		return err
+	}
+
 	err = s.hooks.OnConnect(cl, pk)
 	if err != nil {
+		var code packets.Code
+		if errors.As(err, &code) && code.Code >= packets.ErrUnspecifiedError.Code {
+			if err := s.SendConnack(cl, code, false, nil); err != nil {
+				return fmt.Errorf("refused connection send ack: %w", err)
+			}
+		}
 		return err
 	}
 
+	s.probeKeepalive(cl)
 	cl.refreshDeadline(cl.State.Keepalive)
-	if !s.hooks.OnConnectAuthenticate(cl, pk) { // [MQTT-3.1.4-2]
-		err := s.SendConnack(cl, packets.ErrBadUsernameOrPassword, false, nil)
-		if err != nil {
-			return fmt.Errorf("invalid connection send ack: %w", err)
-		}
 
-		return packets.ErrBadUsernameOrPassword
+	ackProperties, err := s.authorizeConnect(cl, pk)
+	if err != nil {
+		return err
 	}
+	defer s.releaseUserConnection(cl)
+
+	for _, name := range clientGroupNames(cl) {
+		s.Groups.Add(name, cl.ID)
+	}
+
+	cl.State.compress = s.negotiateCompression(cl)
 
 	atomic.AddInt64(&s.Info.ClientsConnected, 1)
 	defer atomic.AddInt64(&s.Info.ClientsConnected, -1)
 
+	if connected, _ := s.familyConnections(cl.Net.Family); connected != nil {
+		atomic.AddInt64(connected, 1)
+		defer atomic.AddInt64(connected, -1)
+	}
+
+	attached = true
+	if stats := cl.Net.stats; stats != nil {
+		atomic.AddInt64(&stats.Active, 1)
+		defer atomic.AddInt64(&stats.Active, -1)
+	}
+
+	s.Usage.Connected(cl, time.Now().Unix())
+	defer func() { s.Usage.Disconnected(cl, time.Now().Unix()) }()
+
 	s.hooks.OnSessionEstablish(cl, pk)
 
 	sessionPresent := s.inheritClientSession(pk, cl)
 	s.Clients.Add(cl) // [MQTT-4.1.0-1]
 
-	err = s.SendConnack(cl, code, sessionPresent, nil) // [MQTT-3.1.4-5] [MQTT-3.2.0-1] [MQTT-3.2.0-2] &[MQTT-3.14.0-1]
+	err = s.SendConnack(cl, code, sessionPresent, ackProperties) // [MQTT-3.1.4-5] [MQTT-3.2.0-1] [MQTT-3.2.0-2] &[MQTT-3.14.0-1]
 	if err != nil {
 		return fmt.Errorf("ack connection packet: %w", err)
 	}
@@ -391,6 +886,10 @@ func (s *Server) attachClient(cl *Client, listener string) error {
 
 	err = cl.Read(s.receivePacket)
 	if err != nil {
+		if isReaped(err) {
+			atomic.AddInt64(&s.Info.ClientsReaped, 1)
+			s.Log.Debug("reaped idle connection", "error", err, "client", cl.ID, "remote", cl.Net.Remote, "keepalive", cl.State.Keepalive)
+		}
 		s.sendLWT(cl)
 		cl.Stop(err)
 	} else {
@@ -398,7 +897,7 @@ func (s *Server) attachClient(cl *Client, listener string) error {
 	}
 	s.Log.Debug("client disconnected", "error", err, "client", cl.ID, "remote", cl.Net.Remote, "listener", listener)
 
-	expire := (cl.Properties.ProtocolVersion == 5 && cl.Properties.Props.SessionExpiryInterval == 0) || (cl.Properties.ProtocolVersion < 5 && cl.Properties.Clean)
+	expire := sessionExpires(cl)
 	s.hooks.OnDisconnect(cl, err, expire)
 
 	if expire && atomic.LoadUint32(&cl.State.isTakenOver) == 0 {
@@ -410,6 +909,319 @@ func (s *Server) attachClient(cl *Client, listener string) error {
 	return err
 }
 
+// authorizeConnect checks a connecting client against the client id blacklist, the freeze,
+// the bans of failed authentications and the client id policy, authenticates it with the
+// auth hooks, and counts it towards the connections of its username. Clients connecting
+// over mqtt and the clients of the event stream and coap gateways, which are sent no
+// connack, pass the same checks. Failed authentications are counted towards banning the
+// username and source ip of the client. The properties of the connack of an enhanced
+// authentication are returned. The client must be released with releaseUserConnection
+// once it disconnects.
+func (s *Server) authorizeConnect(cl *Client, pk packets.Packet) (*packets.Properties, error) {
+	if slices.Contains(s.Blacklist, cl.ID) {
+		s.clientSecurityEvent(SecurityBlacklisted, cl, "blacklisted client id")
+		return nil, fmt.Errorf("blacklisted client %s: %w", cl.ID, packets.ErrNotAuthorized)
+	}
+
+	if err := s.freezeConnect(cl); err != nil {
+		return nil, err
+	}
+
+	if err := s.banAuthFailures(cl); err != nil {
+		return nil, err
+	}
+
+	if code := s.authorizeClientID(cl); code != packets.CodeSuccess {
+		s.clientSecurityEvent(SecurityAuthFailure, cl, code.Reason)
+		s.countAuthFailure(cl)
+		if err := s.SendConnack(cl, code, false, nil); err != nil {
+			return nil, fmt.Errorf("invalid connection send ack: %w", err)
+		}
+
+		return nil, code
+	}
+
+	var ackProperties *packets.Properties
+	if cl.Properties.ProtocolVersion == 5 && pk.Properties.AuthenticationMethod != "" {
+		var err error
+		ackProperties, err = s.authenticateEnhanced(cl, pk) // [MQTT-4.12.0-1]
+		if err != nil {
+			return nil, err
+		}
+	} else if !s.hooks.OnConnectAuthenticate(cl, pk) { // [MQTT-3.1.4-2]
+		s.failAuthentication(cl)
+		err := s.SendConnack(cl, packets.ErrBadUsernameOrPassword, false, nil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid connection send ack: %w", err)
+		}
+
+		return nil, packets.ErrBadUsernameOrPassword
+	}
+
+	if s.AuthFailures != nil {
+		s.AuthFailures.Succeed(string(cl.Properties.Username))
+	}
+
+	if err := s.limitUserConnections(cl); err != nil {
+		return nil, err
+	}
+
+	return ackProperties, nil
+}
+
+// authenticateEnhanced runs the enhanced authentication exchange of an MQTT v5 client
+// which connected with an authentication method, sending each challenge of the hooks to
+// the client in an auth packet and passing its response back to the hooks, until the
+// client is authenticated. The properties of the connack are returned on success,
+// otherwise the failed authentication is counted and the client is sent a connack with
+// the reason it was refused, which is bad authentication method if no hook supports the
+// method.
+func (s *Server) authenticateEnhanced(cl *Client, pk packets.Packet) (*packets.Properties, error) {
+	method := pk.Properties.AuthenticationMethod
+	for round := 1; ; round++ {
+		res, err := s.hooks.OnEnhancedAuth(cl, pk)
+		code := enhancedAuthCode(res, err, round)
+		if code == packets.CodeSuccess {
+			return &packets.Properties{
+				AuthenticationMethod: method, // [MQTT-4.12.0-5]
+				AuthenticationData:   res.Properties.AuthenticationData,
+			}, nil
+		}
+
+		if code == packets.CodeContinueAuthentication {
+			if err = s.sendAuth(cl, code, method, res.Properties.AuthenticationData); err != nil {
+				return nil, fmt.Errorf("send auth: %w", err)
+			}
+
+			pk, err = s.readAuthPacket(cl, method)
+			if err == nil {
+				continue
+			} else if !errors.As(err, &code) {
+				return nil, fmt.Errorf("read auth: %w", err)
+			}
+		}
+
+		s.failAuthentication(cl)
+		if err := s.SendConnack(cl, code, false, nil); err != nil {
+			return nil, fmt.Errorf("invalid connection send ack: %w", err)
+		}
+
+		return nil, code
+	}
+}
+
+// readAuthPacket reads the next auth packet of an enhanced authentication exchange, which
+// must continue the exchange with the same authentication method.
+func (s *Server) readAuthPacket(cl *Client, method string) (pk packets.Packet, err error) {
+	fh := new(packets.FixedHeader)
+	if err = cl.ReadFixedHeader(fh); err != nil {
+		return
+	}
+
+	if fh.Type != packets.Auth {
+		return pk, packets.ErrProtocolViolation // [MQTT-4.12.0-4]
+	}
+
+	if pk, err = cl.ReadPacket(fh); err != nil {
+		return
+	}
+	cl.refreshDeadline(cl.State.Keepalive)
+
+	if pk.ReasonCode != packets.CodeContinueAuthentication.Code {
+		return pk, packets.ErrProtocolViolationInvalidReason
+	}
+
+	if pk.Properties.AuthenticationMethod != method {
+		return pk, packets.ErrProtocolViolation // [MQTT-4.12.0-5]
+	}
+
+	return s.hooks.OnAuthPacket(cl, pk)
+}
+
+// sendAuth sends an auth packet with a reason code and authentication data to a client.
+func (s *Server) sendAuth(cl *Client, code packets.Code, method string, data []byte) error {
+	return cl.WritePacket(packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Auth,
+		},
+		ReasonCode: code.Code,
+		Properties: packets.Properties{
+			AuthenticationMethod: method,
+			AuthenticationData:   data,
+		},
+	})
+}
+
+// enhancedAuthCode returns the outcome of a round of an enhanced authentication exchange,
+// success, continue authentication, or the reason the client is refused. Exchanges are
+// refused once they run to more than maxAuthRounds rounds.
+func enhancedAuthCode(res packets.Packet, err error, round int) packets.Code {
+	if err != nil {
+		if code, ok := err.(packets.Code); ok && code.Code >= packets.ErrUnspecifiedError.Code {
+			return code
+		}
+		return packets.ErrNotAuthorized
+	}
+
+	switch res.ReasonCode {
+	case packets.CodeSuccess.Code:
+		return packets.CodeSuccess
+	case packets.CodeContinueAuthentication.Code:
+		if round < maxAuthRounds {
+			return packets.CodeContinueAuthentication
+		}
+	}
+
+	return packets.ErrNotAuthorized
+}
+
+// probeKeepalive asks an MQTT v5 client to ping before the idle timeout of the connection
+// probe, by setting a server keepalive if the client keepalive is longer or disabled. A
+// server keepalive already set by a hook is kept.
+func (s *Server) probeKeepalive(cl *Client) {
+	keepalive := s.Options.ConnectionProbe.keepalive()
+	if keepalive == 0 || cl.Properties.ProtocolVersion != 5 || cl.State.ServerKeepalive {
+		return
+	}
+
+	if cl.State.Keepalive == 0 || cl.State.Keepalive > keepalive {
+		cl.State.Keepalive = keepalive
+		cl.State.ServerKeepalive = true // [MQTT-3.1.2-21]
+	}
+}
+
+// freezeConnect rejects a client with a server unavailable connack if the broker is
+// frozen for maintenance. MQTT v5 clients are sent the reason for the freeze.
+func (s *Server) freezeConnect(cl *Client) error {
+	ok, reason := s.Freeze.AllowConnect()
+	if ok {
+		return nil
+	}
+
+	code := packets.ErrServerUnavailable
+	if cl.Properties.ProtocolVersion == 5 && reason != "" {
+		code.Reason = reason
+	}
+
+	if err := s.SendConnack(cl, code, false, nil); err != nil {
+		return fmt.Errorf("frozen connection send ack: %w", err)
+	}
+
+	s.Log.Debug("connection refused during freeze", "client", cl.ID, "remote", cl.Net.Remote)
+	return packets.ErrServerUnavailable
+}
+
+// throttleConnect rejects a client with a server busy connack if the broker is throttling
+// connections, overloaded, or its source ip is over its connection rate. MQTT v5 clients
+// are sent a hint of how long to back off.
+func (s *Server) throttleConnect(cl *Client) error {
+	if s.Throttle == nil {
+		return nil
+	}
+
+	now := time.Now().Unix()
+	overloaded := s.Options.MaximumConnections > 0 &&
+		atomic.LoadInt64(&s.Info.ClientsConnected) >= s.Options.MaximumConnections
+	if connected, maximum := s.familyConnections(cl.Net.Family); maximum > 0 {
+		overloaded = overloaded || atomic.LoadInt64(connected) >= maximum
+	}
+
+	ipOK, ipBackoff := s.Throttle.AllowIP(remoteIP(cl.Net.Remote), now)
+	ok, backoff, attempts := s.Throttle.Allow(cl.ID, now, overloaded || !ipOK)
+	if ok {
+		return nil
+	}
+	backoff = max(backoff, ipBackoff)
+
+	var properties *packets.Properties
+	if cl.Properties.ProtocolVersion == 5 {
+		properties = backoffProperties(backoff, attempts)
+	}
+
+	if err := s.SendConnack(cl, packets.ErrServerBusy, false, properties); err != nil {
+		return fmt.Errorf("throttled connection send ack: %w", err)
+	}
+
+	s.Log.Debug("connection throttled", "client", cl.ID, "remote", cl.Net.Remote, "backoff", backoff, "attempts", attempts)
+	return packets.ErrServerBusy
+}
+
+// banAuthFailures rejects a client with a banned connack if its username or source ip
+// is temporarily banned for failing to authenticate too many times. MQTT v5 clients are
+// sent a hint of how long to back off.
+func (s *Server) banAuthFailures(cl *Client) error {
+	if s.AuthFailures == nil {
+		return nil
+	}
+
+	ok, backoff, bans := s.AuthFailures.Allow(string(cl.Properties.Username), remoteIP(cl.Net.Remote), time.Now().Unix())
+	if ok {
+		return nil
+	}
+
+	var properties *packets.Properties
+	if cl.Properties.ProtocolVersion == 5 {
+		properties = backoffProperties(backoff, bans)
+	}
+
+	if err := s.SendConnack(cl, packets.ErrBanned, false, properties); err != nil {
+		return fmt.Errorf("banned connection send ack: %w", err)
+	}
+
+	s.Log.Debug("connection banned after failed authentications", "client", cl.ID, "remote", cl.Net.Remote, "backoff", backoff, "bans", bans)
+	return packets.ErrBanned
+}
+
+// failAuthentication counts a failed authentication of a client, and passes it and the
+// bans it causes to the OnSecurityEvent hooks.
+func (s *Server) failAuthentication(cl *Client) {
+	s.authFailureEvent(cl)
+	s.countAuthFailure(cl)
+}
+
+// countAuthFailure counts a failed authentication of a client towards banning its username
+// and source ip.
+func (s *Server) countAuthFailure(cl *Client) {
+	if s.AuthFailures == nil {
+		return
+	}
+
+	now := time.Now().Unix()
+	for _, ban := range s.AuthFailures.Fail(string(cl.Properties.Username), remoteIP(cl.Net.Remote), now) {
+		s.SecurityEvent(SecurityEvent{
+			Type:      SecurityBanned,
+			ClientID:  cl.ID,
+			Username:  string(cl.Properties.Username),
+			Remote:    cl.Net.Remote,
+			Listener:  cl.Net.Listener,
+			Kind:      ban.Kind,
+			Value:     ban.Value,
+			Duration:  ban.Until - now,
+			Reason:    "failed authentications",
+			Timestamp: now,
+		})
+	}
+}
+
+// familyConnections returns the counter of clients connected over an address family and
+// the maximum connections of the family, or nil if the family is not ipv4 or ipv6.
+func (s *Server) familyConnections(family string) (*int64, int64) {
+	switch family {
+	case listeners.FamilyIPv4:
+		return &s.Info.ClientsConnected4, s.Options.MaximumConnectionsIPv4
+	case listeners.FamilyIPv6:
+		return &s.Info.ClientsConnected6, s.Options.MaximumConnectionsIPv6
+	default:
+		return nil, 0
+	}
+}
+
+// failedHandshake returns true if a tls connection did not complete its handshake.
+func failedHandshake(c net.Conn) bool {
+	tc, ok := c.(interface{ ConnectionState() tls.ConnectionState })
+	return ok && !tc.ConnectionState().HandshakeComplete
+}
+
 // readConnectionPacket reads the first incoming header for a connection, and if
 // acceptable, returns the valid connection packet.
 func (s *Server) readConnectionPacket(cl *Client) (pk packets.Packet, err error) {
@@ -469,7 +1281,7 @@ func (s *Server) validateConnect(cl *Client, pk packets.Packet) packets.Code {
 		return packets.ErrRetainNotSupported // [MQTT-3.2.2-13]
 	}
 
-	return code
+	return s.validateClientID(cl)
 }
 
 // inheritClientSession inherits the state of an existing client sharing the same
@@ -488,6 +1300,7 @@ func (s *Server) inheritClientSession(pk packets.Packet, cl *Client) bool {
 		atomic.StoreUint32(&existing.State.isTakenOver, 1)
 		if existing.State.Inflight.Len() > 0 {
 			cl.State.Inflight = existing.State.Inflight.Clone() // [MQTT-3.1.2-5]
+			s.warmInflights(cl)
 			if cl.State.Inflight.maximumReceiveQuota == 0 && cl.ops.options.Capabilities.ReceiveMaximum != 0 {
 				cl.State.Inflight.ResetReceiveQuota(int32(cl.ops.options.Capabilities.ReceiveMaximum)) // server receive max per client
 				cl.State.Inflight.ResetSendQuota(int32(cl.Properties.Props.ReceiveMaximum))            // client receive max
@@ -498,6 +1311,7 @@ func (s *Server) inheritClientSession(pk packets.Packet, cl *Client) bool {
 			isNew, count := s.Topics.Subscribe(cl.ID, sub) // [MQTT-3.8.4-3]
 			if isNew {
 				atomic.AddInt64(&s.Info.Subscriptions, 1)
+				s.TopicStats.Subscribed(sub.Filter, 1)
 				s.hooks.OnSubscribed(existing, packets.Packet{Filters: []packets.Subscription{sub}}, []byte{sub.Qos}, []int{count})
 			}
 			cl.State.Subscriptions.Add(sub.Filter, sub)
@@ -505,9 +1319,10 @@ func (s *Server) inheritClientSession(pk packets.Packet, cl *Client) bool {
 		}
 
 		// Clean the state of the existing client to prevent sequential take-overs
-		// from increasing memory usage by inflights + subs * client-id.
+		// from increasing memory usage by inflights + subs * client-id. The inflights
+		// now belong to the new session, so they must remain in any persistent store.
 		s.UnsubscribeClient(existing)
-		existing.ClearInflights(math.MaxInt64, 0)
+		existing.ReleaseInflights()
 
 		s.Log.Debug("session taken over", "client", cl.ID, "old_remote", existing.Net.Remote, "new_remote", cl.Net.Remote)
 
@@ -523,7 +1338,7 @@ func (s *Server) inheritClientSession(pk packets.Packet, cl *Client) bool {
 		return false
 	}
 
-	if s.loadClientHistory(cl.ID) {
+	if s.loadClientHistory(cl) {
 		cl.InheritWay = InheritWayRemote
 		return true
 	}
@@ -573,6 +1388,10 @@ func (s *Server) SendConnack(cl *Client, reason packets.Code, present bool, prop
 		properties.AssignedClientID = cl.Properties.Props.AssignedClientID // [MQTT-3.1.3-7] [MQTT-3.2.2-16]
 	}
 
+	if cl.State.compress {
+		properties.User = append(properties.User, packets.UserProperty{Key: ContentEncodingProperty, Val: GzipEncoding})
+	}
+
 	if cl.Properties.Props.SessionExpiryInterval > s.Options.Capabilities.MaximumSessionExpiryInterval {
 		properties.SessionExpiryInterval = s.Options.Capabilities.MaximumSessionExpiryInterval
 		properties.SessionExpiryIntervalFlag = true
@@ -592,18 +1411,25 @@ func (s *Server) SendConnack(cl *Client, reason packets.Code, present bool, prop
 }
 
 // loadClientHistory loads history info of client
-func (s *Server) loadClientHistory(cid string) bool {
-	ss, err := s.hooks.StoredSubscriptionsByCid(cid)
+func (s *Server) loadClientHistory(cl *Client) bool {
+	ss, err := s.hooks.StoredSubscriptionsByCid(cl.ID)
 	if err != nil {
 		return false
 	}
 	s.loadSubscriptions(ss)
 
-	fs, err := s.hooks.StoredInflightMessagesByCid(cid)
+	fs, err := s.hooks.StoredInflightMessagesByCid(cl.ID)
 	if err != nil {
 		return false
 	}
-	s.loadInflight(fs)
+
+	// the client is not yet in the clients map, so the inflight messages are
+	// restored to it directly, including any qos 2 flows part way through.
+	for _, msg := range fs {
+		if cl.State.Inflight.Set(msg.ToPacket()) {
+			atomic.AddInt64(&s.Info.Inflight, 1)
+		}
+	}
 
 	if len(ss) > 0 || len(fs) > 0 {
 		return true
@@ -668,6 +1494,20 @@ func (s *Server) processPacket(cl *Client, pk packets.Packet) error {
 	if cl.State.Inflight.Len() > 0 && atomic.LoadInt32(&cl.State.Inflight.sendQuota) > 0 {
 		next, ok := cl.State.Inflight.NextImmediate()
 		if ok {
+			remaining, expires := RemainingMessageExpiry(next, time.Now().Unix())
+			if expires && remaining <= 0 {
+				if ok := cl.State.Inflight.Delete(next.PacketID); ok {
+					atomic.AddInt64(&s.Info.Inflight, -1)
+					s.hooks.OnQosDropped(cl, next)
+					s.deadLetter(cl, next, DeadLetterExpired)
+				}
+				return nil
+			}
+
+			if expires {
+				next.Properties.MessageExpiryInterval = uint32(remaining) // [MQTT-3.3.2-6]
+			}
+
 			_ = cl.WritePacket(next)
 			if ok := cl.State.Inflight.Delete(next.PacketID); ok {
 				atomic.AddInt64(&s.Info.Inflight, -1)
@@ -803,6 +1643,22 @@ func (s *Server) InjectPacket(cl *Client, pk packets.Packet) error {
 	return nil
 }
 
+// allowUserPublish returns false if the username of a client has exceeded the user
+// publish rate, otherwise it counts the publish. Clients without a username are
+// limited on their client id.
+func (s *Server) allowUserPublish(cl *Client) bool {
+	if s.Options.UserPublishRate <= 0 {
+		return true
+	}
+
+	key := UserRateLimitKey + string(cl.Properties.Username)
+	if len(cl.Properties.Username) == 0 {
+		key = ClientRateLimitKey + cl.ID
+	}
+
+	return takeToken(s.limiter, key, s.Options.UserPublishRate, s.Options.UserPublishBurst, time.Now())
+}
+
 // processPublish processes a Publish packet.
 func (s *Server) processPublish(cl *Client, pk packets.Packet) error {
 	if !cl.Net.Inline && !IsValidFilter(pk.TopicName, true) {
@@ -813,7 +1669,8 @@ func (s *Server) processPublish(cl *Client, pk packets.Packet) error {
 		return s.DisconnectClient(cl, packets.ErrReceiveMaximum) // ~[MQTT-3.3.4-7] ~[MQTT-3.3.4-8]
 	}
 
-	if !cl.Net.Inline && !s.hooks.OnACLCheck(cl, pk.TopicName, true) {
+	if !cl.Net.Inline && !s.aclCheck(cl, pk.TopicName, true) {
+		s.aclDenied(cl, pk.TopicName, true)
 		if pk.FixedHeader.Qos == 0 {
 			return nil
 		}
@@ -831,12 +1688,35 @@ func (s *Server) processPublish(cl *Client, pk packets.Packet) error {
 		return cl.WritePacket(ack)
 	}
 
+	if !cl.Net.Inline && (!s.Groups.AllowPublish(cl.ID, time.Now().Unix()) || !s.allowUserPublish(cl)) {
+		if pk.FixedHeader.Qos == 0 {
+			return nil
+		}
+
+		if cl.Properties.ProtocolVersion != 5 {
+			return s.DisconnectClient(cl, packets.ErrQuotaExceeded)
+		}
+
+		ackType := packets.Puback
+		if pk.FixedHeader.Qos == 2 {
+			ackType = packets.Pubrec
+		}
+
+		ack := s.buildAck(pk.PacketID, ackType, 0, pk.Properties, packets.ErrQuotaExceeded)
+		return cl.WritePacket(ack)
+	}
+
 	pk.Origin = cl.ID
 	pk.Created = time.Now().Unix()
 
 	if !cl.Net.Inline {
 		if pki, ok := cl.State.Inflight.Get(pk.PacketID); ok {
 			if pki.FixedHeader.Type == packets.Pubrec { // [MQTT-4.3.3-10]
+				if pk.FixedHeader.Dup {
+					// the client is resuming an exchange we already received, e.g. after a
+					// restart or session takeover, so acknowledge without delivering again.
+					return cl.WritePacket(pki)
+				}
 				ack := s.buildAck(pk.PacketID, packets.Pubrec, 0, pk.Properties, packets.ErrPacketIdentifierInUse)
 				return cl.WritePacket(ack)
 			}
@@ -854,6 +1734,26 @@ func (s *Server) processPublish(cl *Client, pk packets.Packet) error {
 		pk.FixedHeader.Qos = s.Options.Capabilities.MaximumQos // [MQTT-3.2.2-9] Reduce qos based on server max qos capability
 	}
 
+	pk, err := s.inflatePayload(cl, pk)
+	if err != nil {
+		s.Log.Debug("failed to inflate payload", "error", err, "client", cl.ID, "listener", cl.Net.Listener)
+		if pk.FixedHeader.Qos == 0 {
+			return nil
+		}
+
+		ackType := packets.Puback
+		if pk.FixedHeader.Qos == 2 {
+			ackType = packets.Pubrec
+		}
+
+		ack := s.buildAck(pk.PacketID, ackType, 0, pk.Properties, packets.ErrPayloadFormatInvalid)
+		return cl.WritePacket(ack)
+	}
+
+	s.TopicStats.Received(pk.TopicName, len(pk.Payload))
+	s.Usage.Received(cl, pk.TopicName, len(pk.Payload))
+	pk = s.annotate(cl, pk, time.Now())
+
 	pkx, err := s.hooks.OnPublish(cl, pk)
 	if err == nil {
 		pk = pkx
@@ -914,15 +1814,64 @@ func (s *Server) processPublish(cl *Client, pk packets.Packet) error {
 
 // retainMessage adds a message to a topic, and if a persistent store is provided,
 // adds the message to the store to be reloaded if necessary.
-func (s *Server) retainMessage(cl *Client, pk packets.Packet) {
+func (s *Server) retainMessage(cl *Client, pk packets.Packet) bool {
 	if s.Options.Capabilities.RetainAvailable == 0 || pk.Ignore {
-		return
+		return false
+	}
+
+	if ok, _ := s.Freeze.AllowRetain(); !ok {
+		s.Log.Debug("retained message refused during freeze", "client", cl.ID, "topic", pk.TopicName)
+		return false
 	}
 
 	out := pk.Copy(false)
-	r := s.Topics.RetainMessage(out)
+	if out.Created > 0 {
+		out.Expiry = s.messageExpiry(out)
+	}
+
+	r, evicted, err := s.Topics.TryRetainMessage(out)
+	if err != nil {
+		atomic.AddInt64(&s.Info.RetainedRejected, 1)
+		s.Log.Debug("retained message rejected", "error", err, "client", cl.ID, "topic", pk.TopicName)
+		return false
+	}
+
+	s.evictRetained(evicted)
 	s.hooks.OnRetainMessage(cl, pk, r)
-	atomic.StoreInt64(&s.Info.Retained, int64(s.Topics.Retained.Len()))
+	if r == 1 {
+		s.Topics.tierRetained(out.TopicName)
+	}
+	atomic.StoreInt64(&s.Info.Retained, int64(s.Topics.RetainedLen()))
+	return true
+}
+
+// evictRetained removes the retained messages evicted by the retained limits from the stores.
+func (s *Server) evictRetained(topics []string) {
+	for _, topic := range topics {
+		s.hooks.OnRetainedExpired(topic)
+	}
+	atomic.AddInt64(&s.Info.RetainedEvicted, int64(len(topics)))
+}
+
+// messageExpiry returns the unix time at which a message expires, using the message expiry
+// interval if set, or the server maximum message expiry interval otherwise.
+func (s *Server) messageExpiry(pk packets.Packet) int64 {
+	if pk.Properties.MessageExpiryInterval > 0 {
+		return pk.Created + int64(pk.Properties.MessageExpiryInterval)
+	}
+
+	return pk.Created + s.Options.Capabilities.MaximumMessageExpiryInterval
+}
+
+// RemainingMessageExpiry returns the number of seconds remaining before a message expires
+// according to its message expiry interval, and false if the message has no expiry interval.
+// The remaining interval is what must be forwarded with the message [MQTT-3.3.2-6].
+func RemainingMessageExpiry(pk packets.Packet, now int64) (int64, bool) {
+	if pk.Properties.MessageExpiryInterval == 0 || pk.Created == 0 {
+		return 0, false
+	}
+
+	return pk.Created + int64(pk.Properties.MessageExpiryInterval) - now, true
 }
 
 // PublishToSubscribers publishes a publish packet to all subscribers with matching topic filters.
@@ -941,10 +1890,7 @@ func (s *Server) PublishToSubscribers(pk packets.Packet, local bool) {
 		pk.Created = time.Now().Unix()
 	}
 
-	pk.Expiry = pk.Created + s.Options.Capabilities.MaximumMessageExpiryInterval
-	if pk.Properties.MessageExpiryInterval > 0 {
-		pk.Expiry = pk.Created + int64(pk.Properties.MessageExpiryInterval)
-	}
+	pk.Expiry = s.messageExpiry(pk)
 
 	sharedFilters := make(map[string]bool)
 	subscribers := s.Topics.Subscribers(pk.TopicName)
@@ -998,13 +1944,23 @@ func (s *Server) publishToClient(cl *Client, sub packets.Subscription, pk packet
 	}
 
 	out := pk.Copy(false)
-	if !s.hooks.OnACLCheck(cl, pk.TopicName, false) {
+	remaining, expires := RemainingMessageExpiry(pk, time.Now().Unix())
+	if expires && remaining <= 0 {
+		s.deadLetter(cl, out, DeadLetterExpired)
+		return out, ErrMessageExpired
+	}
+
+	if !s.aclCheck(cl, pk.TopicName, false) {
 		return out, packets.ErrNotAuthorized
 	}
 	if !sub.FwdRetainedFlag && ((cl.Properties.ProtocolVersion == 5 && !sub.RetainAsPublished) || cl.Properties.ProtocolVersion < 5) { // ![MQTT-3.3.1-13] [v3 MQTT-3.3.1-9]
 		out.FixedHeader.Retain = false // [MQTT-3.3.1-12]
 	}
 
+	if cl.State.compress {
+		out = s.compressPayload(out)
+	}
+
 	if len(sub.Identifiers) > 0 { // [MQTT-3.3.4-3]
 		out.Properties.SubscriptionIdentifier = []int{}
 		for _, id := range sub.Identifiers {
@@ -1037,6 +1993,7 @@ func (s *Server) publishToClient(cl *Client, sub packets.Subscription, pk packet
 		if err != nil {
 			s.hooks.OnPacketIDExhausted(cl, pk)
 			s.Log.Warn("packet ids exhausted", "error", err, "client", cl.ID, "listener", cl.Net.Listener)
+			s.deadLetter(cl, out, DeadLetterQueueOverflow)
 			return out, packets.ErrQuotaExceeded
 		}
 
@@ -1050,6 +2007,8 @@ func (s *Server) publishToClient(cl *Client, sub packets.Subscription, pk packet
 		}
 
 		if sentQuota == 0 && atomic.LoadInt32(&cl.State.Inflight.maximumSendQuota) > 0 {
+			atomic.AddInt64(&cl.State.Inflight.stalls, 1)
+			atomic.AddInt64(&s.Info.FlowStalls, 1)
 			out.Expiry = -1
 			cl.State.Inflight.Set(out)
 			return out, nil
@@ -1060,14 +2019,23 @@ func (s *Server) publishToClient(cl *Client, sub packets.Subscription, pk packet
 		return out, packets.CodeDisconnect
 	}
 
+	// the inflight copy keeps the original interval, so that the time spent waiting
+	// can be deducted again if the message is resent or restored from storage.
+	if expires {
+		out.Properties.MessageExpiryInterval = uint32(remaining) // [MQTT-3.3.2-6]
+	}
+
 	select {
 	case cl.State.outbound <- &out:
 		atomic.AddInt32(&cl.State.outboundQty, 1)
+		s.TopicStats.Sent(pk.TopicName, len(pk.Payload))
+		s.Usage.Sent(cl, pk.TopicName, len(out.Payload))
 	default:
 		atomic.AddInt64(&s.Info.MessagesDropped, 1)
 		cl.ops.hooks.OnPublishDropped(cl, pk)
 		cl.State.Inflight.Delete(out.PacketID) // packet was dropped due to irregular circumstances, so rollback inflight.
 		cl.State.Inflight.IncreaseSendQuota()
+		s.deadLetter(cl, out, DeadLetterQueueOverflow)
 		return out, packets.ErrPendingClientWritesExceeded
 	}
 
@@ -1084,14 +2052,114 @@ func (s *Server) publishRetainedToClient(cl *Client, sub packets.Subscription, e
 	}
 
 	sub.FwdRetainedFlag = true
-	for _, pkv := range s.Topics.Messages(sub.Filter) { // [MQTT-3.8.4-4]
-		_, err := s.publishToClient(cl, sub, pkv)
-		if err != nil {
-			s.Log.Debug("failed to publish retained message", "error", err, "client", cl.ID, "listener", cl.Net.Listener, "packet", pkv)
+	msgs := s.Topics.Messages(sub.Filter) // [MQTT-3.8.4-4]
+	s.Topics.touchRetained(msgs)
+	n := s.Options.RetainedPacing.immediate(len(msgs))
+	for _, pkv := range msgs[:n] {
+		s.publishRetained(cl, sub, pkv)
+	}
+
+	if n < len(msgs) {
+		go s.paceRetained(cl, sub, msgs[n:])
+	}
+}
+
+// publishRetained publishes a retained message to a subscription of a client.
+func (s *Server) publishRetained(cl *Client, sub packets.Subscription, pk packets.Packet) {
+	_, err := s.publishToClient(cl, sub, pk)
+	if err != nil {
+		s.Log.Debug("failed to publish retained message", "error", err, "client", cl.ID, "listener", cl.Net.Listener, "packet", pk)
+		return
+	}
+	s.hooks.OnRetainPublished(cl, pk)
+}
+
+// aclCheck returns true if a client may access a topic, applying the acl overrides
+// of the client's groups before the acl hooks.
+func (s *Server) aclCheck(cl *Client, topic string, write bool) bool {
+	if allowed, matched := s.Groups.ACLCheck(cl.ID, topic, write); matched {
+		return allowed
+	}
+
+	return s.hooks.OnACLCheck(cl, topic, write)
+}
+
+// PublishToGroup publishes a message to the command topic of each connected member
+// of a group, returning the number of members published to.
+func (s *Server) PublishToGroup(name string, payload []byte, retain bool, qos byte) (int, error) {
+	group, ok := s.Groups.Get(name)
+	if !ok {
+		return 0, ErrGroupNotFound
+	}
+
+	if group.CommandTopic == "" {
+		return 0, ErrGroupNoCommandTopic
+	}
+
+	// retained messages are set by the inline client, which is only kept if it is enabled
+	inline := s.inlineClient
+	if retain && inline == nil {
+		inline = s.NewClient(nil, LocalListener, InlineClientId, true)
+	}
+
+	n := 0
+	for _, id := range group.Members {
+		if cl, ok := s.Clients.Get(id); !ok || cl.Closed() {
 			continue
 		}
-		s.hooks.OnRetainPublished(cl, pkv)
+
+		pk := packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type:   packets.Publish,
+				Qos:    qos,
+				Retain: retain,
+			},
+			TopicName: strings.ReplaceAll(group.CommandTopic, GroupClientPlaceholder, id),
+			Payload:   payload,
+			Created:   time.Now().Unix(),
+		}
+
+		if retain {
+			s.retainMessage(inline, pk)
+		}
+
+		s.publishToSubscribers(pk)
+		n++
+	}
+
+	return n, nil
+}
+
+// SetClientReceiveMaximum changes the number of unacknowledged qos messages the server will
+// send to a connected client at once. The value is capped at the receive maximum declared by
+// the client when it connected, and the effective value is returned.
+func (s *Server) SetClientReceiveMaximum(cl *Client, n uint16) uint16 {
+	if declared := cl.Properties.Props.ReceiveMaximum; declared > 0 && n > declared {
+		n = declared
+	}
+
+	cl.State.Inflight.SetMaximumSendQuota(int32(n))
+	s.Log.Info("client receive maximum changed", "client", cl.ID, "receive_maximum", n)
+	return n
+}
+
+// DisconnectGroup disconnects all connected members of a group, returning the number
+// of clients disconnected.
+func (s *Server) DisconnectGroup(name string) (int, error) {
+	group, ok := s.Groups.Get(name)
+	if !ok {
+		return 0, ErrGroupNotFound
+	}
+
+	n := 0
+	for _, id := range group.Members {
+		if cl, ok := s.Clients.Get(id); ok && !cl.Closed() {
+			_ = s.DisconnectClient(cl, packets.ErrAdministrativeAction)
+			n++
+		}
 	}
+
+	return n, nil
 }
 
 // buildAck builds a standardised ack message for Puback, Pubrec, Pubrel, Pubcomp packets.
@@ -1120,10 +2188,16 @@ func (s *Server) buildAck(packetID uint16, pkt, qos byte, properties packets.Pro
 
 // processPuback processes a Puback packet, denoting completion of a QOS 1 packet sent from the server.
 func (s *Server) processPuback(cl *Client, pk packets.Packet) error {
-	if _, ok := cl.State.Inflight.Get(pk.PacketID); !ok {
+	sent, ok := cl.State.Inflight.Get(pk.PacketID)
+	if !ok {
 		return nil // omit, but would be packets.ErrPacketIdentifierNotFound
 	}
 
+	if pk.ReasonCode >= packets.ErrUnspecifiedError.Code {
+		sent.ReasonCode = pk.ReasonCode
+		s.deadLetter(cl, sent, DeadLetterDeliveryFailed)
+	}
+
 	if ok := cl.State.Inflight.Delete(pk.PacketID); ok { // [MQTT-4.3.2-5]
 		cl.State.Inflight.IncreaseSendQuota()
 		atomic.AddInt64(&s.Info.Inflight, -1)
@@ -1135,11 +2209,14 @@ func (s *Server) processPuback(cl *Client, pk packets.Packet) error {
 
 // processPubrec processes a Pubrec packet, denoting receipt of a QOS 2 packet sent from the server.
 func (s *Server) processPubrec(cl *Client, pk packets.Packet) error {
-	if _, ok := cl.State.Inflight.Get(pk.PacketID); !ok { // [MQTT-4.3.3-7] [MQTT-4.3.3-13]
+	sent, ok := cl.State.Inflight.Get(pk.PacketID)
+	if !ok { // [MQTT-4.3.3-7] [MQTT-4.3.3-13]
 		return cl.WritePacket(s.buildAck(pk.PacketID, packets.Pubrel, 1, pk.Properties, packets.ErrPacketIdentifierNotFound))
 	}
 
 	if pk.ReasonCode >= packets.ErrUnspecifiedError.Code || !pk.ReasonCodeValid() { // [MQTT-4.3.3-4]
+		sent.ReasonCode = pk.ReasonCode
+		s.deadLetter(cl, sent, DeadLetterDeliveryFailed)
 		if ok := cl.State.Inflight.Delete(pk.PacketID); ok {
 			atomic.AddInt64(&s.Info.Inflight, -1)
 		}
@@ -1150,6 +2227,7 @@ func (s *Server) processPubrec(cl *Client, pk packets.Packet) error {
 	ack := s.buildAck(pk.PacketID, packets.Pubrel, 1, pk.Properties, packets.CodeSuccess) // [MQTT-4.3.3-4] ![MQTT-4.3.3-6]
 	cl.State.Inflight.DecreaseReceiveQuota()                                              // -1 RECV QUOTA
 	cl.State.Inflight.Set(ack)                                                            // [MQTT-4.3.3-5]
+	s.hooks.OnQosPublish(cl, ack, ack.Created, 0)                                         // persist the pubrel stage so the publish is never resent
 	return cl.WritePacket(ack)
 }
 
@@ -1209,15 +2287,20 @@ func (s *Server) processSubscribe(cl *Client, pk packets.Packet) error {
 	filterExisted := make([]bool, len(pk.Filters))
 	reasonCodes := make([]byte, len(pk.Filters))
 	counts := make([]int, len(pk.Filters)) // An array of the number of subscribers for the same filter
+	var frozen string
 	for i, sub := range pk.Filters {
 		if code != packets.CodeSuccess {
 			reasonCodes[i] = code.Code // NB 3.9.3 Non-normative 0x91
 			continue
 		} else if !IsValidFilter(sub.Filter, false) {
 			reasonCodes[i] = packets.ErrTopicFilterInvalid.Code
+		} else if ok, reason := s.frozenSubscribe(cl, sub.Filter); !ok {
+			reasonCodes[i] = packets.ErrImplementationSpecificError.Code
+			frozen = reason
 		} else if sub.NoLocal && IsSharedFilter(sub.Filter) {
 			reasonCodes[i] = packets.ErrProtocolViolationInvalidSharedNoLocal.Code // [MQTT-3.8.3-4]
-		} else if !s.hooks.OnACLCheck(cl, sub.Filter, false) {
+		} else if !s.aclCheck(cl, sub.Filter, false) {
+			s.aclDenied(cl, sub.Filter, false)
 			reasonCodes[i] = packets.ErrNotAuthorized.Code
 			if s.Options.Capabilities.Compatibilities.ObscureNotAuthorized {
 				reasonCodes[i] = packets.ErrUnspecifiedError.Code
@@ -1226,6 +2309,7 @@ func (s *Server) processSubscribe(cl *Client, pk packets.Packet) error {
 			isNew, count := s.Topics.Subscribe(cl.ID, sub) // [MQTT-3.8.4-3]
 			if isNew {
 				atomic.AddInt64(&s.Info.Subscriptions, 1)
+				s.TopicStats.Subscribed(sub.Filter, 1)
 			}
 			cl.State.Subscriptions.Add(sub.Filter, sub) // [MQTT-3.2.2-10]
 
@@ -1256,6 +2340,8 @@ func (s *Server) processSubscribe(cl *Client, pk packets.Packet) error {
 
 	if code.Code >= packets.ErrUnspecifiedError.Code {
 		ack.Properties.ReasonString = code.Reason
+	} else if frozen != "" {
+		ack.Properties.ReasonString = frozen
 	}
 
 	s.hooks.OnSubscribed(cl, pk, reasonCodes, counts)
@@ -1275,6 +2361,21 @@ func (s *Server) processSubscribe(cl *Client, pk packets.Packet) error {
 	return nil
 }
 
+// frozenSubscribe returns false and the reason for the freeze if a subscription is refused
+// because the broker is frozen. Clients may still renew subscriptions they already hold.
+func (s *Server) frozenSubscribe(cl *Client, filter string) (bool, string) {
+	if _, ok := cl.State.Subscriptions.Get(filter); ok {
+		return true, ""
+	}
+
+	ok, reason := s.Freeze.AllowSubscribe()
+	if !ok && reason == "" {
+		reason = packets.ErrImplementationSpecificError.Reason
+	}
+
+	return ok, reason
+}
+
 // processUnsubscribe processes an unsubscribe packet.
 func (s *Server) processUnsubscribe(cl *Client, pk packets.Packet) error {
 	code := packets.CodeSuccess
@@ -1294,6 +2395,7 @@ func (s *Server) processUnsubscribe(cl *Client, pk packets.Packet) error {
 		q, count := s.Topics.Unsubscribe(sub.Filter, cl.ID)
 		if q {
 			atomic.AddInt64(&s.Info.Subscriptions, -1)
+			s.TopicStats.Subscribed(sub.Filter, -1)
 			reasonCodes[i] = packets.CodeSuccess.Code
 		} else {
 			reasonCodes[i] = packets.CodeNoSubscriptionExisted.Code
@@ -1343,6 +2445,7 @@ func (s *Server) UnsubscribeClient(cl *Client) {
 		q, count := s.Topics.Unsubscribe(k, cl.ID)
 		if q {
 			atomic.AddInt64(&s.Info.Subscriptions, -1)
+			s.TopicStats.Subscribed(k, -1)
 			reasonCodes[i] = packets.CodeSuccess.Code
 		} else {
 			reasonCodes[i] = packets.CodeNoSubscriptionExisted.Code
@@ -1355,14 +2458,41 @@ func (s *Server) UnsubscribeClient(cl *Client) {
 	s.hooks.OnUnsubscribed(cl, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Unsubscribe}, Filters: filters}, reasonCodes, counts)
 }
 
-// processAuth processes an Auth packet.
+// processAuth processes an Auth packet, re-authenticating an MQTT v5 client which
+// connected with an authentication method. A client which fails to re-authenticate is
+// disconnected.
 func (s *Server) processAuth(cl *Client, pk packets.Packet) error {
-	_, err := s.hooks.OnAuthPacket(cl, pk)
+	pk, err := s.hooks.OnAuthPacket(cl, pk)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	method := cl.Properties.Props.AuthenticationMethod
+	if method == "" || pk.Properties.AuthenticationMethod != method {
+		return packets.ErrProtocolViolation // [MQTT-4.12.0-7] [MQTT-4.12.1-1]
+	}
+
+	switch {
+	case pk.ReasonCode == packets.CodeReAuthenticate.Code:
+		cl.State.reauth = 1
+	case pk.ReasonCode == packets.CodeContinueAuthentication.Code && cl.State.reauth > 0:
+		cl.State.reauth++
+	default:
+		return packets.ErrProtocolViolationInvalidReason
+	}
+
+	res, err := s.hooks.OnEnhancedAuth(cl, pk)
+	code := enhancedAuthCode(res, err, cl.State.reauth)
+	if code != packets.CodeSuccess && code != packets.CodeContinueAuthentication {
+		cl.State.reauth = 0
+		return code // [MQTT-4.12.1-2]
+	}
+
+	if code == packets.CodeSuccess {
+		cl.State.reauth = 0
+	}
+
+	return s.sendAuth(cl, code, method, res.Properties.AuthenticationData)
 }
 
 // processDisconnect processes a Disconnect packet.
@@ -1431,26 +2561,55 @@ func (s *Server) publishSysTopics() {
 	atomic.StoreInt64(&s.Info.ClientsDisconnected, atomic.LoadInt64(&s.Info.ClientsTotal)-atomic.LoadInt64(&s.Info.ClientsConnected))
 
 	topics := map[string]string{
-		SysPrefix + "/broker/version":              s.Info.Version,
-		SysPrefix + "/broker/time":                 AtomicItoa(&s.Info.Time),
-		SysPrefix + "/broker/uptime":               AtomicItoa(&s.Info.Uptime),
-		SysPrefix + "/broker/started":              AtomicItoa(&s.Info.Started),
-		SysPrefix + "/broker/load/bytes/received":  AtomicItoa(&s.Info.BytesReceived),
-		SysPrefix + "/broker/load/bytes/sent":      AtomicItoa(&s.Info.BytesSent),
-		SysPrefix + "/broker/clients/connected":    AtomicItoa(&s.Info.ClientsConnected),
-		SysPrefix + "/broker/clients/disconnected": AtomicItoa(&s.Info.ClientsDisconnected),
-		SysPrefix + "/broker/clients/maximum":      AtomicItoa(&s.Info.ClientsMaximum),
-		SysPrefix + "/broker/clients/total":        AtomicItoa(&s.Info.ClientsTotal),
-		SysPrefix + "/broker/packets/received":     AtomicItoa(&s.Info.PacketsReceived),
-		SysPrefix + "/broker/packets/sent":         AtomicItoa(&s.Info.PacketsSent),
-		SysPrefix + "/broker/messages/received":    AtomicItoa(&s.Info.MessagesReceived),
-		SysPrefix + "/broker/messages/sent":        AtomicItoa(&s.Info.MessagesSent),
-		SysPrefix + "/broker/messages/dropped":     AtomicItoa(&s.Info.MessagesDropped),
-		SysPrefix + "/broker/messages/inflight":    AtomicItoa(&s.Info.Inflight),
-		SysPrefix + "/broker/retained":             AtomicItoa(&s.Info.Retained),
-		SysPrefix + "/broker/subscriptions":        AtomicItoa(&s.Info.Subscriptions),
-		SysPrefix + "/broker/system/memory":        AtomicItoa(&s.Info.MemoryAlloc),
-		SysPrefix + "/broker/system/threads":       AtomicItoa(&s.Info.Threads),
+		SysPrefix + "/broker/version":                s.Info.Version,
+		SysPrefix + "/broker/time":                   AtomicItoa(&s.Info.Time),
+		SysPrefix + "/broker/uptime":                 AtomicItoa(&s.Info.Uptime),
+		SysPrefix + "/broker/started":                AtomicItoa(&s.Info.Started),
+		SysPrefix + "/broker/load/bytes/received":    AtomicItoa(&s.Info.BytesReceived),
+		SysPrefix + "/broker/load/bytes/sent":        AtomicItoa(&s.Info.BytesSent),
+		SysPrefix + "/broker/clients/connected":      AtomicItoa(&s.Info.ClientsConnected),
+		SysPrefix + "/broker/clients/connected/ipv4": AtomicItoa(&s.Info.ClientsConnected4),
+		SysPrefix + "/broker/clients/connected/ipv6": AtomicItoa(&s.Info.ClientsConnected6),
+		SysPrefix + "/broker/clients/disconnected":   AtomicItoa(&s.Info.ClientsDisconnected),
+		SysPrefix + "/broker/clients/maximum":        AtomicItoa(&s.Info.ClientsMaximum),
+		SysPrefix + "/broker/clients/total":          AtomicItoa(&s.Info.ClientsTotal),
+		SysPrefix + "/broker/clients/reaped":         AtomicItoa(&s.Info.ClientsReaped),
+		SysPrefix + "/broker/packets/received":       AtomicItoa(&s.Info.PacketsReceived),
+		SysPrefix + "/broker/packets/sent":           AtomicItoa(&s.Info.PacketsSent),
+		SysPrefix + "/broker/messages/received":      AtomicItoa(&s.Info.MessagesReceived),
+		SysPrefix + "/broker/messages/sent":          AtomicItoa(&s.Info.MessagesSent),
+		SysPrefix + "/broker/messages/dropped":       AtomicItoa(&s.Info.MessagesDropped),
+		SysPrefix + "/broker/messages/deadletter":    AtomicItoa(&s.Info.DeadLettered),
+		SysPrefix + "/broker/messages/inflight":      AtomicItoa(&s.Info.Inflight),
+		SysPrefix + "/broker/messages/stalled":       AtomicItoa(&s.Info.FlowStalls),
+		SysPrefix + "/broker/retained":               AtomicItoa(&s.Info.Retained),
+		SysPrefix + "/broker/retained/evicted":       AtomicItoa(&s.Info.RetainedEvicted),
+		SysPrefix + "/broker/retained/rejected":      AtomicItoa(&s.Info.RetainedRejected),
+		SysPrefix + "/broker/subscriptions":          AtomicItoa(&s.Info.Subscriptions),
+		SysPrefix + "/broker/system/memory":          AtomicItoa(&s.Info.MemoryAlloc),
+		SysPrefix + "/broker/system/threads":         AtomicItoa(&s.Info.Threads),
+	}
+
+	s.TopicStats.UpdateRates(s.Options.SysTopicResendInterval)
+	for _, st := range s.TopicStats.GetAll() {
+		prefix := SysPrefix + "/broker/topics/" + st.Prefix
+		topics[prefix+"/messages/received"] = strconv.FormatInt(st.MessagesReceived, 10)
+		topics[prefix+"/messages/sent"] = strconv.FormatInt(st.MessagesSent, 10)
+		topics[prefix+"/messages/rate"] = strconv.FormatInt(st.MessageRate, 10)
+		topics[prefix+"/bytes/received"] = strconv.FormatInt(st.BytesReceived, 10)
+		topics[prefix+"/bytes/sent"] = strconv.FormatInt(st.BytesSent, 10)
+		topics[prefix+"/bytes/rate"] = strconv.FormatInt(st.ByteRate, 10)
+		topics[prefix+"/subscriptions"] = strconv.FormatInt(st.Subscriptions, 10)
+	}
+
+	for id, st := range s.Info.Listeners.GetAll() {
+		prefix := SysPrefix + "/broker/listeners/" + id
+		topics[prefix+"/connections/accepted"] = strconv.FormatInt(st.Accepted, 10)
+		topics[prefix+"/connections/rejected"] = strconv.FormatInt(st.Rejected, 10)
+		topics[prefix+"/connections/active"] = strconv.FormatInt(st.Active, 10)
+		topics[prefix+"/connections/tls-failures"] = strconv.FormatInt(st.TLSFailures, 10)
+		topics[prefix+"/bytes/received"] = strconv.FormatInt(st.BytesReceived, 10)
+		topics[prefix+"/bytes/sent"] = strconv.FormatInt(st.BytesSent, 10)
 	}
 
 	for topic, payload := range topics {
@@ -1466,14 +2625,31 @@ func (s *Server) publishSysTopics() {
 // Close attempts to gracefully shut down the server, all listeners, clients, and stores.
 func (s *Server) Close() error {
 	close(s.done)
-	s.Listeners.CloseAll(s.closeListenerClients)
+	s.closeEventStreams() // event streams hold http requests open, which would otherwise delay listener shutdown.
+	if s.Options.DrainTimeout > 0 {
+		s.Listeners.CloseAll(func(string) {}) // stop accepting connections, keeping the connected clients
+		s.drainClients(time.Duration(s.Options.DrainTimeout) * time.Second)
+	} else {
+		s.Listeners.CloseAll(s.closeListenerClients)
+	}
+	if s.loop.usageReport != nil {
+		s.reportUsage(time.Now().Unix()) // report the final partial period
+	}
 	s.hooks.OnStopped()
 	s.hooks.Stop()
+	if err := s.hooks.wal.Close(); err != nil {
+		s.Log.Error("failed to close write-ahead log", "error", err)
+	}
 
 	s.Log.Info("server stopped")
 	return nil
 }
 
+// reportUsage passes the usage of each user and tenant since the last report to the hooks.
+func (s *Server) reportUsage(now int64) {
+	s.hooks.OnUsageReport(s.Usage.Report(now))
+}
+
 // closeListenerClients closes all clients on the specified listener.
 func (s *Server) closeListenerClients(listener string) {
 	clients := s.Clients.GetByListener(listener)
@@ -1521,6 +2697,15 @@ func (s *Server) sendLWT(cl *Client) {
 	s.hooks.OnWillSent(cl, pk)
 }
 
+// SendRemoteLWT issues the LWT message of a client whose connection was held elsewhere,
+// such as by a cluster node which has failed.
+func (s *Server) SendRemoteLWT(id string, will Will) {
+	cl := s.NewClient(nil, LocalListener, id, true)
+	cl.Properties.Will = will
+	atomic.StoreUint32(&cl.Properties.Will.Flag, 1)
+	s.sendLWT(cl)
+}
+
 // readStore reads in any data from the persistent datastore (if applicable).
 func (s *Server) readStore() error {
 	if s.hooks.Provides(StoredClients) {
@@ -1579,12 +2764,15 @@ func (s *Server) loadServerInfo(v system.Info) {
 		atomic.StoreInt64(&s.Info.ClientsMaximum, v.ClientsMaximum)
 		atomic.StoreInt64(&s.Info.ClientsTotal, v.ClientsTotal)
 		atomic.StoreInt64(&s.Info.ClientsDisconnected, v.ClientsDisconnected)
+		atomic.StoreInt64(&s.Info.ClientsReaped, v.ClientsReaped)
 		atomic.StoreInt64(&s.Info.MessagesReceived, v.MessagesReceived)
 		atomic.StoreInt64(&s.Info.MessagesSent, v.MessagesSent)
 		atomic.StoreInt64(&s.Info.MessagesDropped, v.MessagesDropped)
+		atomic.StoreInt64(&s.Info.DeadLettered, v.DeadLettered)
 		atomic.StoreInt64(&s.Info.PacketsReceived, v.PacketsReceived)
 		atomic.StoreInt64(&s.Info.PacketsSent, v.PacketsSent)
 		atomic.StoreInt64(&s.Info.InflightDropped, v.InflightDropped)
+		atomic.StoreInt64(&s.Info.FlowStalls, v.FlowStalls)
 	}
 	atomic.StoreInt64(&s.Info.Retained, v.Retained)
 	atomic.StoreInt64(&s.Info.Inflight, v.Inflight)
@@ -1607,7 +2795,7 @@ func (s *Server) loadSubscriptions(v []storage.Subscription) {
 		if isNew, count := s.Topics.Subscribe(sub.Client, sb); isNew {
 			if cl, ok := s.Clients.Get(sub.Client); ok {
 				cl.State.Subscriptions.Add(sub.Filter, sb)
-				s.hooks.OnSubscribed(cl, packets.Packet{Filters: []packets.Subscription{sb}}, []byte{sub.Qos}, []int{count})
+				s.hooks.OnSubscribed(cl, packets.Packet{ProtocolVersion: cl.Properties.ProtocolVersion, Filters: []packets.Subscription{sb}}, []byte{sub.Qos}, []int{count})
 			}
 		}
 	}
@@ -1615,61 +2803,78 @@ func (s *Server) loadSubscriptions(v []storage.Subscription) {
 
 // loadClients restores clients from the datastore.
 func (s *Server) loadClients(v []storage.Client) {
+	now := time.Now().Unix()
 	for _, c := range v {
-		cl := s.NewClient(nil, c.Listener, c.ID, false)
-		cl.Properties.Username = c.Username
-		cl.Properties.Clean = c.Clean
-		cl.Properties.ProtocolVersion = c.ProtocolVersion
-		cl.Properties.Props = packets.Properties{
-			SessionExpiryInterval:     c.Properties.SessionExpiryInterval,
-			SessionExpiryIntervalFlag: c.Properties.SessionExpiryIntervalFlag,
-			AuthenticationMethod:      c.Properties.AuthenticationMethod,
-			AuthenticationData:        c.Properties.AuthenticationData,
-			RequestProblemInfoFlag:    c.Properties.RequestProblemInfoFlag,
-			RequestProblemInfo:        c.Properties.RequestProblemInfo,
-			RequestResponseInfo:       c.Properties.RequestResponseInfo,
-			ReceiveMaximum:            c.Properties.ReceiveMaximum,
-			TopicAliasMaximum:         c.Properties.TopicAliasMaximum,
-			User:                      c.Properties.User,
-			MaximumPacketSize:         c.Properties.MaximumPacketSize,
-		}
-		cl.Properties.Will = Will(c.Will)
+		cl := s.storedClient(c)
+		if c.Disconnected == 0 {
+			atomic.StoreInt64(&cl.State.disconnected, now) // connected when the broker stopped
+		}
 		s.Clients.Add(cl)
 	}
 }
 
+// storedClient returns a disconnected client restored from its storable representation,
+// keeping the time it disconnected so that its session expires on time.
+func (s *Server) storedClient(c storage.Client) *Client {
+	cl := s.NewClient(nil, c.Listener, c.ID, false)
+	atomic.StoreInt64(&cl.State.disconnected, c.Disconnected)
+	cl.Properties.Username = c.Username
+	cl.Properties.Clean = c.Clean
+	cl.Properties.ProtocolVersion = c.ProtocolVersion
+	cl.Properties.Props = packets.Properties{
+		SessionExpiryInterval:     c.Properties.SessionExpiryInterval,
+		SessionExpiryIntervalFlag: c.Properties.SessionExpiryIntervalFlag,
+		AuthenticationMethod:      c.Properties.AuthenticationMethod,
+		AuthenticationData:        c.Properties.AuthenticationData,
+		RequestProblemInfoFlag:    c.Properties.RequestProblemInfoFlag,
+		RequestProblemInfo:        c.Properties.RequestProblemInfo,
+		RequestResponseInfo:       c.Properties.RequestResponseInfo,
+		ReceiveMaximum:            c.Properties.ReceiveMaximum,
+		TopicAliasMaximum:         c.Properties.TopicAliasMaximum,
+		User:                      c.Properties.User,
+		MaximumPacketSize:         c.Properties.MaximumPacketSize,
+	}
+	cl.Properties.Will = Will(c.Will)
+	return cl
+}
+
 // loadInflight restores inflight messages from the datastore.
 func (s *Server) loadInflight(v []storage.Message) {
 	for _, msg := range v {
-		if client, ok := s.Clients.Get(msg.Origin); ok {
-			client.State.Inflight.Set(msg.ToPacket())
+		owner := msg.Client
+		if owner == "" {
+			owner = msg.Origin // stored before the owning client was recorded
+		}
+
+		if client, ok := s.Clients.Get(owner); ok && client.State.Inflight.Set(msg.ToPacket()) {
+			atomic.AddInt64(&s.Info.Inflight, 1)
 		}
 	}
 }
 
-// loadRetained restores retained messages from the datastore.
+// loadRetained restores retained messages from the datastore. Messages evicted or
+// rejected by the retained limits are removed from the datastore.
 func (s *Server) loadRetained(v []storage.Message) {
 	for _, msg := range v {
-		s.Topics.RetainMessage(msg.ToPacket())
+		_, evicted, err := s.Topics.TryRetainMessage(msg.ToPacket())
+		if err != nil {
+			atomic.AddInt64(&s.Info.RetainedRejected, 1)
+			evicted = append(evicted, msg.TopicName)
+		} else {
+			s.Topics.tierRetained(msg.TopicName)
+		}
+		s.evictRetained(evicted)
 	}
 }
 
 // clearExpiredClients deletes all clients which have been disconnected for longer
-// than their given expiry intervals.
+// than their given expiry intervals, together with their subscriptions and inflight messages.
 func (s *Server) clearExpiredClients(dt int64) {
 	for id, client := range s.Clients.GetAll() {
-		disconnected := atomic.LoadInt64(&client.State.disconnected)
-		if disconnected == 0 {
-			continue
-		}
-
-		expire := s.Options.Capabilities.MaximumSessionExpiryInterval
-		if client.Properties.ProtocolVersion == 5 && client.Properties.Props.SessionExpiryIntervalFlag {
-			expire = client.Properties.Props.SessionExpiryInterval
-		}
-
-		if disconnected+int64(expire) < dt {
+		if expiry := client.SessionExpiry(); expiry > 0 && expiry < dt {
 			s.hooks.OnClientExpired(client)
+			client.ClearInflights(math.MaxInt64, 0)
+			s.UnsubscribeClient(client)
 			s.Clients.Delete(id) // [MQTT-4.1.0-2]
 		}
 	}
@@ -1679,19 +2884,35 @@ func (s *Server) clearExpiredClients(dt int64) {
 func (s *Server) clearExpiredRetainedMessages(now int64) {
 	for filter, pk := range s.Topics.Retained.GetAll() {
 		if (pk.Expiry > 0 && pk.Expiry < now) || pk.Created+s.Options.Capabilities.MaximumMessageExpiryInterval < now {
-			s.Topics.Retained.Delete(filter)
+			s.Topics.DeleteRetained(filter)
 			s.hooks.OnRetainedExpired(filter)
 		}
 	}
+
+	for _, topic := range s.Topics.coldExpiredRetained(now, s.Options.Capabilities.MaximumMessageExpiryInterval) {
+		s.Topics.DeleteRetained(topic)
+		s.hooks.OnRetainedExpired(topic)
+	}
 }
 
 // clearExpiredInflights deletes any inflight messages which have expired.
 func (s *Server) clearExpiredInflights(now int64) {
 	for _, client := range s.Clients.GetAll() {
+		var inflights []packets.Packet
+		if s.deadLetters != nil {
+			inflights = s.inflightMessages(client)
+		}
+
 		if deleted := client.ClearInflights(now, s.Options.Capabilities.MaximumMessageExpiryInterval); len(deleted) > 0 {
 			for _, id := range deleted {
 				s.hooks.OnQosDropped(client, packets.Packet{PacketID: id})
 			}
+
+			for _, pk := range inflights {
+				if slices.Contains(deleted, pk.PacketID) {
+					s.deadLetter(client, pk, DeadLetterExpired)
+				}
+			}
 		}
 	}
 }
@@ -5,7 +5,9 @@
 package mqtt
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
 	"io"
 	"log/slog"
@@ -205,6 +207,56 @@ func TestServerAddHook(t *testing.T) {
 	require.Equal(t, int64(1), s.hooks.Len())
 }
 
+// cachingAuthHook is an auth hook caching lookups of its datasource.
+type cachingAuthHook struct {
+	HookBase
+	cached map[string]int
+}
+
+func (h *cachingAuthHook) ID() string {
+	return "caching-auth"
+}
+
+func (h *cachingAuthHook) InvalidateAuthCache(key string) int {
+	if key == "" {
+		n := 0
+		for k, v := range h.cached {
+			n += v
+			delete(h.cached, k)
+		}
+		return n
+	}
+
+	n := h.cached[key]
+	delete(h.cached, key)
+	return n
+}
+
+func TestServerInvalidateAuthCache(t *testing.T) {
+	s := New(&Options{Logger: logger})
+	h := &cachingAuthHook{cached: map[string]int{"u1": 2, "u2": 1}}
+	require.NoError(t, s.AddHook(new(HookBase), nil))
+	require.NoError(t, s.AddHook(h, nil))
+
+	require.Equal(t, 2, s.InvalidateAuthCache("u1"))
+	require.Equal(t, 0, s.InvalidateAuthCache("u1"))
+	require.Equal(t, 1, s.InvalidateAuthCache(""))
+	require.Empty(t, h.cached)
+}
+
+func (h *cachingAuthHook) AuthMetrics() AuthMetrics {
+	return AuthMetrics{ID: h.ID(), AuthAllowed: 3}
+}
+
+func TestServerAuthMetrics(t *testing.T) {
+	s := New(&Options{Logger: logger})
+	require.Empty(t, s.AuthMetrics())
+
+	require.NoError(t, s.AddHook(new(HookBase), nil))
+	require.NoError(t, s.AddHook(&cachingAuthHook{}, nil))
+	require.Equal(t, []AuthMetrics{{ID: "caching-auth", AuthAllowed: 3}}, s.AuthMetrics())
+}
+
 func TestServerAddListener(t *testing.T) {
 	s := newServer()
 	defer s.Close()
@@ -220,6 +272,20 @@ func TestServerAddListener(t *testing.T) {
 	require.Equal(t, ErrListenerIDExists, err)
 }
 
+func TestServerAddListenerAuthPolicy(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	policy := &listeners.AuthPolicy{Anonymous: true}
+	err := s.AddListener(listeners.NewTCP("internal", "127.0.0.1:0", &listeners.Config{Auth: policy}))
+	require.NoError(t, err)
+	require.Equal(t, policy, s.hooks.ListenerAuth("internal"))
+
+	err = s.AddListener(listeners.NewTCP("public", "127.0.0.1:0", nil))
+	require.NoError(t, err)
+	require.Nil(t, s.hooks.ListenerAuth("public"))
+}
+
 func TestServerAddListenerInitFailure(t *testing.T) {
 	s := newServer()
 	defer s.Close()
@@ -232,6 +298,154 @@ func TestServerAddListenerInitFailure(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestServerAddListenerIPFilter(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	filter := &listeners.IPFilter{IPRules: listeners.IPRules{Allow: []string{"10.0.0.0/8"}}}
+	err := s.AddListener(listeners.NewTCP("internal", "127.0.0.1:0", &listeners.Config{IPFilter: filter}))
+	require.NoError(t, err)
+	f, ok := s.ListenerIPFilter("internal")
+	require.True(t, ok)
+	require.Equal(t, filter, f)
+	require.False(t, s.allowedIP("internal", "192.168.0.1:1883"))
+	require.True(t, s.allowedIP("internal", "10.0.0.1:1883"))
+
+	err = s.AddListener(listeners.NewTCP("public", "127.0.0.1:0", nil))
+	require.NoError(t, err)
+	f, ok = s.ListenerIPFilter("public")
+	require.True(t, ok)
+	require.Empty(t, f.Rules().Allow)
+	require.True(t, s.allowedIP("public", "192.168.0.1:1883"))
+
+	_, ok = s.ListenerIPFilter("missing")
+	require.False(t, ok)
+	require.True(t, s.allowedIP("missing", "192.168.0.1:1883"))
+
+	stats := &listeners.IPFilter{IPRules: listeners.IPRules{Allow: []string{"10.0.0.0/8"}}}
+	err = s.AddListener(listeners.NewHTTPStats("stats", "127.0.0.1:0", &listeners.Config{IPFilter: stats}, nil))
+	require.NoError(t, err)
+	f, ok = s.ListenerIPFilter("stats")
+	require.True(t, ok)
+	require.False(t, f.Allowed("192.168.0.1:1883"))
+
+	bad := &listeners.IPFilter{IPRules: listeners.IPRules{Deny: []string{"10.0.0.0/40"}}}
+	err = s.AddListener(listeners.NewTCP("bad", "127.0.0.1:0", &listeners.Config{IPFilter: bad}))
+	require.ErrorIs(t, err, listeners.ErrInvalidIPRule)
+}
+
+func TestEstablishConnectionIPNotAllowed(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	filter := &listeners.IPFilter{IPRules: listeners.IPRules{Deny: []string{"127.0.0.0/8"}}}
+	err := s.AddListener(listeners.NewTCP("internal", "127.0.0.1:0", &listeners.Config{IPFilter: filter}))
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+
+	conn, err := ln.Accept()
+	require.NoError(t, err)
+
+	err = s.EstablishConnection("internal", conn)
+	require.ErrorIs(t, err, ErrIPNotAllowed)
+
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = client.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	stats := s.Info.Listeners.GetAll()["internal"]
+	require.Equal(t, int64(1), stats.Accepted)
+	require.Equal(t, int64(1), stats.Rejected)
+}
+
+func TestEstablishConnectionListenerStats(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	err := s.AddListener(listeners.NewMockListener("t1", ":1882"))
+	require.NoError(t, err)
+	require.Equal(t, &system.ListenerInfo{}, s.Info.Listeners.GetAll()["t1"])
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("t1", r)
+	}()
+
+	connect := packets.TPacketData[packets.Connect].Get(packets.TConnectClean).RawBytes
+	connack := packets.TPacketData[packets.Connack].Get(packets.TConnackAcceptedNoSession).RawBytes
+	_, err = w.Write(connect)
+	require.NoError(t, err)
+	_, err = io.ReadFull(w, make([]byte, len(connack)))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return s.Info.Listeners.GetAll()["t1"].Active == 1
+	}, time.Second, time.Millisecond)
+
+	disconnect := packets.TPacketData[packets.Disconnect].Get(packets.TDisconnect).RawBytes
+	_, err = w.Write(disconnect)
+	require.NoError(t, err)
+	require.NoError(t, <-o)
+	_ = w.Close()
+
+	require.Equal(t, &system.ListenerInfo{
+		Accepted:      1,
+		BytesReceived: int64(len(connect) + len(disconnect)),
+		BytesSent:     int64(len(connack)),
+	}, s.Info.Listeners.GetAll()["t1"])
+}
+
+func TestEstablishConnectionListenerStatsRejected(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("t1", r)
+	}()
+
+	_, _ = w.Write(packets.TPacketData[packets.Disconnect].Get(packets.TDisconnect).RawBytes)
+	require.ErrorIs(t, <-o, packets.ErrProtocolViolationRequireFirstConnect)
+	_ = w.Close()
+
+	stats := s.Info.Listeners.GetAll()["t1"]
+	require.Equal(t, int64(1), stats.Accepted)
+	require.Equal(t, int64(1), stats.Rejected)
+	require.Equal(t, int64(0), stats.Active)
+	require.Equal(t, int64(0), stats.TLSFailures)
+}
+
+func TestEstablishConnectionListenerStatsTLSFailure(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tls", tls.Server(r, new(tls.Config)))
+	}()
+
+	go func() {
+		_, _ = w.Write([]byte("not a tls client hello"))
+		_ = w.Close()
+	}()
+
+	require.Error(t, <-o)
+
+	stats := s.Info.Listeners.GetAll()["tls"]
+	require.Equal(t, int64(1), stats.Rejected)
+	require.Equal(t, int64(1), stats.TLSFailures)
+}
+
 func TestServerServe(t *testing.T) {
 	s := newServer()
 	defer s.Close()
@@ -439,8 +653,15 @@ func TestEstablishConnectionReadError(t *testing.T) {
 		o <- s.EstablishConnection("tcp", r)
 	}()
 
+	// without an authentication method, which no hook of the server supports
+	connect := *packets.TPacketData[packets.Connect].Get(packets.TConnectMqtt5).Packet
+	connect.Properties.AuthenticationMethod = ""
+	connect.Properties.AuthenticationData = nil
+	buf := new(bytes.Buffer)
+	require.NoError(t, connect.ConnectEncode(buf))
+
 	go func() {
-		_, _ = w.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectMqtt5).RawBytes)
+		_, _ = w.Write(buf.Bytes())
 		_, _ = w.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectClean).RawBytes) // second connect error
 	}()
 
@@ -781,6 +1002,250 @@ func TestEstablishConnectionBadAuthenticationAckFailure(t *testing.T) {
 	_ = r.Close()
 }
 
+// enhancedAuthHook authenticates clients with the challenge method, by a challenge and
+// a response in auth packets.
+type enhancedAuthHook struct {
+	HookBase
+}
+
+func (h *enhancedAuthHook) ID() string {
+	return "enhanced-auth"
+}
+
+func (h *enhancedAuthHook) Provides(b byte) bool {
+	return b == OnEnhancedAuth
+}
+
+func (h *enhancedAuthHook) OnEnhancedAuth(cl *Client, pk packets.Packet) (packets.Packet, error) {
+	if pk.Properties.AuthenticationMethod != "challenge" {
+		return pk, packets.ErrBadAuthenticationMethod
+	}
+
+	res := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Auth}}
+	switch {
+	case pk.FixedHeader.Type == packets.Connect || pk.ReasonCode == packets.CodeReAuthenticate.Code:
+		res.ReasonCode = packets.CodeContinueAuthentication.Code
+		res.Properties.AuthenticationData = []byte("nonce")
+	case string(pk.Properties.AuthenticationData) == "nonce-signed":
+		res.ReasonCode = packets.CodeSuccess.Code
+		res.Properties.AuthenticationData = []byte("verified")
+	default:
+		return res, packets.ErrNotAuthorized
+	}
+
+	return res, nil
+}
+
+// newEnhancedAuthPeer returns an mqtt v5 client for the remote end of a connection.
+func newEnhancedAuthPeer(c net.Conn) *Client {
+	peer, _, _ := newTestClient()
+	peer.Net.Conn = c
+	peer.Net.bconn = bufio.NewReadWriter(bufio.NewReader(c), bufio.NewWriter(c))
+	peer.Properties.ProtocolVersion = 5
+	return peer
+}
+
+// connectPeer connects a peer to the server with the challenge method.
+func connectPeer(peer *Client) {
+	go func() {
+		_ = peer.WritePacket(packets.Packet{
+			FixedHeader: packets.FixedHeader{Type: packets.Connect},
+			Connect: packets.ConnectParams{
+				ProtocolName:     []byte("MQTT"),
+				Clean:            true,
+				Keepalive:        30,
+				ClientIdentifier: "zen",
+			},
+			Properties: packets.Properties{
+				AuthenticationMethod: "challenge",
+			},
+		})
+	}()
+}
+
+func readPeerPacket(t *testing.T, peer *Client) packets.Packet {
+	fh := new(packets.FixedHeader)
+	err := peer.ReadFixedHeader(fh)
+	require.NoError(t, err)
+	pk, err := peer.ReadPacket(fh)
+	require.NoError(t, err)
+	return pk
+}
+
+func sendPeerAuth(peer *Client, data string) {
+	go func() {
+		_ = peer.WritePacket(packets.Packet{
+			FixedHeader: packets.FixedHeader{Type: packets.Auth},
+			ReasonCode:  packets.CodeContinueAuthentication.Code,
+			Properties: packets.Properties{
+				AuthenticationMethod: "challenge",
+				AuthenticationData:   []byte(data),
+			},
+		})
+	}()
+}
+
+func TestEstablishConnectionEnhancedAuth(t *testing.T) {
+	s := New(&Options{
+		Logger: logger,
+	})
+	err := s.AddHook(new(enhancedAuthHook), nil)
+	require.NoError(t, err)
+	defer s.Close()
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r)
+	}()
+
+	peer := newEnhancedAuthPeer(w)
+	connectPeer(peer)
+	pk := readPeerPacket(t, peer)
+	require.Equal(t, packets.Auth, pk.FixedHeader.Type)
+	require.Equal(t, packets.CodeContinueAuthentication.Code, pk.ReasonCode)
+	require.Equal(t, "challenge", pk.Properties.AuthenticationMethod)
+	require.Equal(t, []byte("nonce"), pk.Properties.AuthenticationData)
+
+	sendPeerAuth(peer, "nonce-signed")
+	pk = readPeerPacket(t, peer)
+	require.Equal(t, packets.Connack, pk.FixedHeader.Type)
+	require.Equal(t, packets.CodeSuccess.Code, pk.ReasonCode)
+	require.Equal(t, "challenge", pk.Properties.AuthenticationMethod)
+	require.Equal(t, []byte("verified"), pk.Properties.AuthenticationData)
+
+	_ = w.Close()
+	<-o
+	_ = r.Close()
+}
+
+func TestEstablishConnectionEnhancedAuthFailure(t *testing.T) {
+	s := New(&Options{
+		Logger: logger,
+	})
+	err := s.AddHook(new(enhancedAuthHook), nil)
+	require.NoError(t, err)
+	defer s.Close()
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r)
+	}()
+
+	peer := newEnhancedAuthPeer(w)
+	connectPeer(peer)
+	pk := readPeerPacket(t, peer)
+	require.Equal(t, packets.CodeContinueAuthentication.Code, pk.ReasonCode)
+
+	sendPeerAuth(peer, "forged")
+	pk = readPeerPacket(t, peer)
+	require.Equal(t, packets.Connack, pk.FixedHeader.Type)
+	require.Equal(t, packets.ErrNotAuthorized.Code, pk.ReasonCode)
+
+	err = <-o
+	require.ErrorIs(t, err, packets.ErrNotAuthorized)
+
+	_ = w.Close()
+	_ = r.Close()
+}
+
+func TestEstablishConnectionEnhancedAuthFailureCounted(t *testing.T) {
+	s := New(&Options{
+		Logger: logger,
+	})
+	err := s.AddHook(new(enhancedAuthHook), nil)
+	require.NoError(t, err)
+	s.AuthFailures = NewAuthFailures(1, 60, 60, 60)
+	defer s.Close()
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r)
+	}()
+
+	peer := newEnhancedAuthPeer(w)
+	connectPeer(peer)
+	pk := readPeerPacket(t, peer)
+	require.Equal(t, packets.CodeContinueAuthentication.Code, pk.ReasonCode)
+
+	sendPeerAuth(peer, "forged")
+	pk = readPeerPacket(t, peer)
+	require.Equal(t, packets.ErrNotAuthorized.Code, pk.ReasonCode)
+	require.ErrorIs(t, <-o, packets.ErrNotAuthorized)
+	require.Equal(t, int64(1), s.AuthFailures.Stats(time.Now().Unix()).Failures)
+
+	_ = w.Close()
+	_ = r.Close()
+}
+
+func TestEstablishConnectionEnhancedAuthBadMethod(t *testing.T) {
+	s := newServer()
+	err := s.AddHook(new(enhancedAuthHook), nil)
+	require.NoError(t, err)
+	defer s.Close()
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r)
+	}()
+
+	// the allow hook does not authenticate clients with an unsupported method
+	go func() {
+		_, _ = w.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectMqtt5).RawBytes)
+	}()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := io.ReadAll(w)
+		require.NoError(t, err)
+		recv <- buf
+	}()
+
+	require.ErrorIs(t, <-o, packets.ErrBadAuthenticationMethod)
+	buf := <-recv
+	require.Equal(t, packets.Connack<<4, buf[0])
+	require.Equal(t, packets.ErrBadAuthenticationMethod.Code, buf[3])
+
+	_ = w.Close()
+	_ = r.Close()
+}
+
+func TestEstablishConnectionEnhancedAuthUnexpectedPacket(t *testing.T) {
+	s := New(&Options{
+		Logger: logger,
+	})
+	err := s.AddHook(new(enhancedAuthHook), nil)
+	require.NoError(t, err)
+	defer s.Close()
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r)
+	}()
+
+	peer := newEnhancedAuthPeer(w)
+	connectPeer(peer)
+	pk := readPeerPacket(t, peer)
+	require.Equal(t, packets.CodeContinueAuthentication.Code, pk.ReasonCode)
+
+	go func() {
+		_, _ = w.Write(packets.TPacketData[packets.Pingreq].Get(packets.TPingreq).RawBytes)
+	}()
+	pk = readPeerPacket(t, peer)
+	require.Equal(t, packets.Connack, pk.FixedHeader.Type)
+	require.Equal(t, packets.ErrProtocolViolation.Code, pk.ReasonCode)
+
+	err = <-o
+	require.ErrorIs(t, err, packets.ErrProtocolViolation)
+
+	_ = w.Close()
+	_ = r.Close()
+}
+
 func TestServerEstablishConnectionInvalidConnect(t *testing.T) {
 	s := newServer()
 
@@ -898,10 +1363,57 @@ func TestServerEstablishConnectionOnConnectError(t *testing.T) {
 	}()
 
 	err = <-o
-	require.Error(t, err)
-	require.ErrorIs(t, err, errTestHook)
-
-	_ = r.Close()
+	require.Error(t, err)
+	require.ErrorIs(t, err, errTestHook)
+
+	_ = r.Close()
+}
+
+// refuseConnectHook refuses connections with a reason code.
+type refuseConnectHook struct {
+	HookBase
+	code packets.Code
+}
+
+func (h *refuseConnectHook) ID() string {
+	return "refuse-connect"
+}
+
+func (h *refuseConnectHook) Provides(b byte) bool {
+	return b == OnConnect
+}
+
+func (h *refuseConnectHook) OnConnect(cl *Client, pk packets.Packet) error {
+	return h.code
+}
+
+func TestServerEstablishConnectionOnConnectCode(t *testing.T) {
+	s := newServer()
+	err := s.AddHook(&refuseConnectHook{code: packets.ErrServerUnavailable}, nil)
+	require.NoError(t, err)
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r)
+	}()
+
+	go func() {
+		_, _ = w.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectMqtt5).RawBytes)
+	}()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := io.ReadAll(w)
+		require.NoError(t, err)
+		recv <- buf
+	}()
+
+	err = <-o
+	require.ErrorIs(t, err, packets.ErrServerUnavailable)
+	buf := <-recv
+	require.Equal(t, packets.Connack<<4, buf[0])
+	require.Equal(t, packets.ErrServerUnavailable.Code, buf[3])
 }
 
 func TestServerSendConnack(t *testing.T) {
@@ -1704,6 +2216,31 @@ func TestPublishToSubscribersSelfNoLocal(t *testing.T) {
 	require.Equal(t, []byte{}, <-receiverBuf)
 }
 
+func TestPublishToSubscribersRelayedNoLocal(t *testing.T) {
+	s := newServer()
+	cl, r, w := newTestClient()
+	s.Clients.Add(cl)
+	subbed, _ := s.Topics.Subscribe(cl.ID, packets.Subscription{Filter: "a/b/c", NoLocal: true})
+	require.True(t, subbed)
+
+	go func() {
+		pkx := *packets.TPacketData[packets.Publish].Get(packets.TPublishBasic).Packet
+		pkx.Origin = cl.ID // relayed from the node the client was connected to
+		s.PublishToSubscribers(pkx, false)
+		time.Sleep(time.Millisecond)
+		_ = w.Close()
+	}()
+
+	receiverBuf := make(chan []byte)
+	go func() {
+		buf, err := io.ReadAll(r)
+		require.NoError(t, err)
+		receiverBuf <- buf
+	}()
+
+	require.Equal(t, []byte{}, <-receiverBuf)
+}
+
 func TestPublishToSubscribers(t *testing.T) {
 	s := newServer()
 	cl, r1, w1 := newTestClient()
@@ -2954,17 +3491,94 @@ func TestServerProcessPacketDisconnectNonZeroExpiryViolation(t *testing.T) {
 
 func TestServerProcessPacketAuth(t *testing.T) {
 	s := newServer()
-	cl, r, w := newTestClient()
+	cl, _, _ := newTestClient()
+
+	err := s.processPacket(cl, *packets.TPacketData[packets.Auth].Get(packets.TAuth).Packet)
+	require.ErrorIs(t, err, packets.ErrProtocolViolation) // [MQTT-4.12.0-7] the client connected without a method
+}
+
+func TestServerProcessAuthReauthenticate(t *testing.T) {
+	s := newServer()
+	err := s.AddHook(new(enhancedAuthHook), nil)
+	require.NoError(t, err)
+
+	cl, r, _ := newTestClient()
+	cl.Properties.ProtocolVersion = 5
+	cl.Properties.Props.AuthenticationMethod = "challenge"
+	peer := newEnhancedAuthPeer(r)
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Auth},
+		ReasonCode:  packets.CodeReAuthenticate.Code,
+		Properties:  packets.Properties{AuthenticationMethod: "challenge"},
+	}
+	go func() {
+		err := s.processAuth(cl, pk)
+		require.NoError(t, err)
+	}()
 
+	res := readPeerPacket(t, peer)
+	require.Equal(t, packets.CodeContinueAuthentication.Code, res.ReasonCode)
+	require.Equal(t, []byte("nonce"), res.Properties.AuthenticationData)
+
+	pk.ReasonCode = packets.CodeContinueAuthentication.Code
+	pk.Properties.AuthenticationData = []byte("nonce-signed")
 	go func() {
-		err := s.processPacket(cl, *packets.TPacketData[packets.Auth].Get(packets.TAuth).Packet)
+		err := s.processAuth(cl, pk)
 		require.NoError(t, err)
-		_ = w.Close()
 	}()
 
-	buf, err := io.ReadAll(r)
+	res = readPeerPacket(t, peer)
+	require.Equal(t, packets.CodeSuccess.Code, res.ReasonCode)
+	require.Equal(t, []byte("verified"), res.Properties.AuthenticationData)
+}
+
+func TestServerProcessAuthReauthenticateFailure(t *testing.T) {
+	s := newServer()
+	err := s.AddHook(new(enhancedAuthHook), nil)
 	require.NoError(t, err)
-	require.Equal(t, []byte{}, buf)
+
+	cl, _, _ := newTestClient()
+	cl.Properties.ProtocolVersion = 5
+	cl.Properties.Props.AuthenticationMethod = "challenge"
+	cl.State.reauth = 1
+
+	err = s.processAuth(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Auth},
+		ReasonCode:  packets.CodeContinueAuthentication.Code,
+		Properties: packets.Properties{
+			AuthenticationMethod: "challenge",
+			AuthenticationData:   []byte("forged"),
+		},
+	})
+	require.ErrorIs(t, err, packets.ErrNotAuthorized)
+	require.Equal(t, 0, cl.State.reauth)
+}
+
+func TestServerProcessAuthContinueWithoutReauthenticate(t *testing.T) {
+	s := newServer()
+	cl, _, _ := newTestClient()
+	cl.Properties.Props.AuthenticationMethod = "challenge"
+
+	err := s.processAuth(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Auth},
+		ReasonCode:  packets.CodeContinueAuthentication.Code,
+		Properties:  packets.Properties{AuthenticationMethod: "challenge"},
+	})
+	require.ErrorIs(t, err, packets.ErrProtocolViolationInvalidReason)
+}
+
+func TestServerProcessAuthMethodChanged(t *testing.T) {
+	s := newServer()
+	cl, _, _ := newTestClient()
+	cl.Properties.Props.AuthenticationMethod = "challenge"
+
+	err := s.processAuth(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Auth},
+		ReasonCode:  packets.CodeReAuthenticate.Code,
+		Properties:  packets.Properties{AuthenticationMethod: "SHA-1"},
+	})
+	require.ErrorIs(t, err, packets.ErrProtocolViolation) // [MQTT-4.12.1-1]
 }
 
 func TestServerProcessPacketAuthInvalidReason(t *testing.T) {
@@ -3070,6 +3684,37 @@ func TestServerSendLWTRetain(t *testing.T) {
 	require.Equal(t, packets.TPacketData[packets.Publish].Get(packets.TPublishBasic).RawBytes, <-receiverBuf)
 }
 
+func TestServerSendRemoteLWT(t *testing.T) {
+	s := newServer()
+	_ = s.Serve()
+	defer s.Close()
+
+	receiver, r2, w2 := newTestClient()
+	receiver.ID = "receiver"
+	s.Clients.Add(receiver)
+	s.Topics.Subscribe(receiver.ID, packets.Subscription{Filter: "a/b/c", Qos: 0})
+
+	receiverBuf := make(chan []byte)
+	go func() {
+		buf, err := io.ReadAll(r2)
+		require.NoError(t, err)
+		receiverBuf <- buf
+	}()
+
+	go func() {
+		s.SendRemoteLWT("sender", Will{
+			TopicName: "a/b/c",
+			Payload:   []byte("hello mochi"),
+		})
+		time.Sleep(time.Millisecond * 10)
+		_ = w2.Close()
+	}()
+
+	require.Equal(t, packets.TPacketData[packets.Publish].Get(packets.TPublishBasic).RawBytes, <-receiverBuf)
+	_, ok := s.Clients.Get("sender")
+	require.False(t, ok)
+}
+
 func TestServerSendLWTDelayed(t *testing.T) {
 	s := newServer()
 	cl1, _, _ := newTestClient()
@@ -3141,7 +3786,7 @@ func TestServerReadStore(t *testing.T) {
 
 func TestServerLoadClients(t *testing.T) {
 	v := []storage.Client{
-		{ID: "mochi"},
+		{ID: "mochi", Disconnected: 100},
 		{ID: "zen"},
 		{ID: "mochi-co"},
 	}
@@ -3153,6 +3798,10 @@ func TestServerLoadClients(t *testing.T) {
 	cl, ok := s.Clients.Get("mochi")
 	require.True(t, ok)
 	require.Equal(t, "mochi", cl.ID)
+	require.Equal(t, int64(100), atomic.LoadInt64(&cl.State.disconnected))
+
+	cl, _ = s.Clients.Get("zen")
+	require.InDelta(t, time.Now().Unix(), atomic.LoadInt64(&cl.State.disconnected), 1)
 }
 
 func TestServerLoadSubscriptions(t *testing.T) {
@@ -3201,6 +3850,223 @@ func TestServerLoadInflightMessages(t *testing.T) {
 	require.True(t, ok)
 	msg, ok = cl.State.Inflight.Get(4)
 	require.True(t, ok)
+	require.Equal(t, int64(4), atomic.LoadInt64(&s.Info.Inflight))
+}
+
+func TestServerLoadInflightMessagesByOwner(t *testing.T) {
+	s := newServer()
+	s.loadClients([]storage.Client{
+		{ID: "mochi"},
+		{ID: "zen"},
+	})
+
+	s.loadInflight([]storage.Message{
+		{Origin: "zen", Client: "mochi", PacketID: 1, TopicName: "a/b/c"},
+		{Origin: "mochi", Client: "zen", PacketID: 2, FixedHeader: packets.FixedHeader{Type: packets.Pubrel, Qos: 1}},
+	})
+
+	cl, _ := s.Clients.Get("mochi")
+	_, ok := cl.State.Inflight.Get(1)
+	require.True(t, ok)
+	_, ok = cl.State.Inflight.Get(2)
+	require.False(t, ok)
+
+	cl, _ = s.Clients.Get("zen")
+	msg, ok := cl.State.Inflight.Get(2)
+	require.True(t, ok)
+	require.Equal(t, packets.Pubrel, msg.FixedHeader.Type)
+}
+
+// qosStoreHook keeps inflight messages in memory the way a storage hook would.
+type qosStoreHook struct {
+	HookBase
+	mu        sync.Mutex
+	inflight  map[string]map[uint16]storage.Message
+	onDropped func()
+}
+
+func (h *qosStoreHook) ID() string {
+	return "qos-store"
+}
+
+func (h *qosStoreHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		OnQosPublish,
+		OnQosComplete,
+		OnQosDropped,
+		StoredInflightMessagesByCid,
+	}, []byte{b})
+}
+
+func (h *qosStoreHook) OnQosPublish(cl *Client, pk packets.Packet, sent int64, resends int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.inflight == nil {
+		h.inflight = map[string]map[uint16]storage.Message{}
+	}
+	if h.inflight[cl.ID] == nil {
+		h.inflight[cl.ID] = map[uint16]storage.Message{}
+	}
+	h.inflight[cl.ID][pk.PacketID] = storage.Message{
+		Client:      cl.ID,
+		Origin:      pk.Origin,
+		FixedHeader: pk.FixedHeader,
+		TopicName:   pk.TopicName,
+		Payload:     pk.Payload,
+		PacketID:    pk.PacketID,
+		Created:     pk.Created,
+		Sent:        sent,
+	}
+}
+
+func (h *qosStoreHook) OnQosComplete(cl *Client, pk packets.Packet) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.inflight[cl.ID], pk.PacketID)
+}
+
+func (h *qosStoreHook) OnQosDropped(cl *Client, pk packets.Packet) {
+	if h.onDropped != nil {
+		h.onDropped()
+	}
+	h.OnQosComplete(cl, pk)
+}
+
+func (h *qosStoreHook) StoredInflightMessagesByCid(cid string) (v []storage.Message, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, msg := range h.inflight[cid] {
+		v = append(v, msg)
+	}
+	return v, nil
+}
+
+func (h *qosStoreHook) stage(cid string, id uint16) (byte, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	msg, ok := h.inflight[cid][id]
+	return msg.FixedHeader.Type, ok
+}
+
+func TestServerQos2StatePersistedAcrossRestart(t *testing.T) {
+	h := new(qosStoreHook)
+
+	s := newServer()
+	require.NoError(t, s.AddHook(h, nil))
+	cl, r, w := newTestClient()
+	cl.ID = "zen"
+	go func() { _, _ = io.ReadAll(r) }()
+
+	// outbound qos 2 message which has been received but not yet completed by the client.
+	out := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 2}, PacketID: 7, TopicName: "a/b/c", Created: time.Now().Unix()}
+	cl.State.Inflight.Set(out)
+	s.hooks.OnQosPublish(cl, out, out.Created, 0)
+	require.NoError(t, s.processPacket(cl, *packets.TPacketData[packets.Pubrec].Get(packets.TPubrec).Packet))
+	typ, ok := h.stage("zen", 7)
+	require.True(t, ok)
+	require.Equal(t, packets.Pubrel, typ)
+
+	// inbound qos 2 message which has been acknowledged with a pubrec.
+	in := *packets.TPacketData[packets.Publish].Get(packets.TPublishQos2).Packet
+	in.PacketID = 9
+	require.NoError(t, s.processPacket(cl, in))
+	typ, ok = h.stage("zen", 9)
+	require.True(t, ok)
+	require.Equal(t, packets.Pubrec, typ)
+	_ = w.Close()
+
+	// a restarted or different node restores the flow from the store.
+	s2 := newServer()
+	require.NoError(t, s2.AddHook(h, nil))
+	cl2, _, _ := newTestClient()
+	cl2.ID = "zen"
+	present := s2.inheritClientSession(packets.Packet{Connect: packets.ConnectParams{ClientIdentifier: "zen"}}, cl2)
+	require.True(t, present)
+	require.Equal(t, InheritWayRemote, cl2.InheritWay)
+
+	msg, ok := cl2.State.Inflight.Get(7)
+	require.True(t, ok)
+	require.Equal(t, packets.Pubrel, msg.FixedHeader.Type)
+	msg, ok = cl2.State.Inflight.Get(9)
+	require.True(t, ok)
+	require.Equal(t, packets.Pubrec, msg.FixedHeader.Type)
+	require.Equal(t, int64(2), atomic.LoadInt64(&s2.Info.Inflight))
+}
+
+func TestServerProcessPacketPublishQos2DupResumesExchange(t *testing.T) {
+	s := newServer()
+	cl, r, w := newTestClient()
+	cl.Properties.ProtocolVersion = 5
+	cl.State.Inflight.Set(packets.Packet{PacketID: 7, FixedHeader: packets.FixedHeader{Type: packets.Pubrec}})
+	atomic.StoreInt64(&s.Info.Inflight, 1)
+
+	pk := *packets.TPacketData[packets.Publish].Get(packets.TPublishQos2Mqtt5).Packet
+	pk.FixedHeader.Dup = true
+
+	go func() {
+		err := s.processPacket(cl, pk)
+		require.NoError(t, err)
+		_ = w.Close()
+	}()
+
+	buf, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, packets.TPacketData[packets.Pubrec].Get(packets.TPubrec).RawBytes, buf)
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.Inflight))
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.Info.MessagesReceived))
+}
+
+func TestServerClearExpiredInflightsKeepsQos2Stages(t *testing.T) {
+	dropped := 0
+	h := &qosStoreHook{onDropped: func() { dropped++ }}
+	s := newServer()
+	s.Options.Capabilities.MaximumMessageExpiryInterval = 4
+	require.NoError(t, s.AddHook(h, nil))
+
+	cl, _, _ := newTestClient()
+	cl.ops.hooks = s.hooks
+	cl.ops.info = s.Info
+	s.Clients.Add(cl)
+
+	// the pubrec of a received publish with a short message expiry interval, restored after a restart.
+	n := time.Now().Unix()
+	pk := packets.Packet{PacketID: 9, FixedHeader: packets.FixedHeader{Type: packets.Pubrec}, Created: n - 10, Expiry: n - 5}
+	cl.State.Inflight.Set(pk)
+	s.hooks.OnQosPublish(cl, pk, pk.Created, 0)
+
+	s.clearExpiredInflights(n)
+	require.Equal(t, 0, dropped)
+	_, ok := cl.State.Inflight.Get(9)
+	require.True(t, ok)
+	typ, ok := h.stage(cl.ID, 9)
+	require.True(t, ok)
+	require.Equal(t, packets.Pubrec, typ)
+}
+
+func TestInheritClientSessionKeepsPersistedInflight(t *testing.T) {
+	dropped := 0
+	h := &qosStoreHook{onDropped: func() { dropped++ }}
+	s := newServer()
+	require.NoError(t, s.AddHook(h, nil))
+
+	existing, _, _ := newTestClient()
+	existing.Net.Conn = nil
+	existing.ops.hooks = s.hooks
+	existing.ops.info = s.Info
+	pk := packets.Packet{PacketID: 3, FixedHeader: packets.FixedHeader{Type: packets.Pubrel, Qos: 1}}
+	existing.State.Inflight.Set(pk)
+	s.hooks.OnQosPublish(existing, pk, 0, 0)
+	s.Clients.Add(existing)
+
+	cl, _, _ := newTestClient()
+	cl.Properties.ProtocolVersion = 5
+	require.True(t, s.inheritClientSession(packets.Packet{Connect: packets.ConnectParams{ClientIdentifier: "mochi"}}, cl))
+	require.Equal(t, 1, cl.State.Inflight.Len())
+	require.Equal(t, 0, existing.State.Inflight.Len())
+	require.Equal(t, 0, dropped)
+
+	_, ok := h.stage("mochi", 3)
+	require.True(t, ok)
 }
 
 func TestServerLoadRetainedMessages(t *testing.T) {
@@ -3246,6 +4112,7 @@ func TestServerClose(t *testing.T) {
 
 	listener, ok := s.Listeners.Get("t1")
 	require.Equal(t, true, ok)
+	require.Eventually(t, listener.(*listeners.MockListener).IsServing, time.Second, time.Millisecond)
 	require.Equal(t, true, listener.(*listeners.MockListener).IsServing())
 
 	_ = s.Close()
@@ -3340,6 +4207,29 @@ func TestServerClearExpiredClients(t *testing.T) {
 	require.Equal(t, 2, s.Clients.Len())
 }
 
+func TestServerClearExpiredClientsSession(t *testing.T) {
+	s := newServer()
+	n := time.Now().Unix()
+
+	cl, _, _ := newTestClient()
+	cl.ID = "expired"
+	cl.State.disconnected = n - 10
+	cl.Properties.ProtocolVersion = 5
+	cl.Properties.Props.SessionExpiryInterval = 5
+	cl.Properties.Props.SessionExpiryIntervalFlag = true
+	s.Clients.Add(cl)
+	s.Topics.Subscribe(cl.ID, packets.Subscription{Filter: "a/b"})
+	cl.State.Subscriptions.Add("a/b", packets.Subscription{Filter: "a/b"})
+	cl.State.Inflight.Set(packets.Packet{PacketID: 1, TopicName: "a/b"})
+
+	s.clearExpiredClients(n)
+	_, ok := s.Clients.Get("expired")
+	require.False(t, ok)
+	require.Equal(t, 0, cl.State.Inflight.Len())
+	require.Equal(t, 0, cl.State.Subscriptions.Len())
+	require.NotContains(t, s.Topics.Subscribers("a/b").Subscriptions, "expired")
+}
+
 func TestLoadServerInfoRestoreOnRestart(t *testing.T) {
 	s := New(nil)
 	s.Options.Capabilities.Compatibilities.RestoreSysInfoOnRestart = true
@@ -3661,3 +4551,109 @@ func TestServerSubscribeWithRetainDifferentIdentifier(t *testing.T) {
 		require.Equal(t, true, <-finishCh)
 	}
 }
+
+func TestRemainingMessageExpiry(t *testing.T) {
+	_, ok := RemainingMessageExpiry(packets.Packet{Created: 100}, 105)
+	require.False(t, ok)
+
+	remaining, ok := RemainingMessageExpiry(packets.Packet{
+		Created:    100,
+		Properties: packets.Properties{MessageExpiryInterval: 10},
+	}, 105)
+	require.True(t, ok)
+	require.Equal(t, int64(5), remaining)
+}
+
+func TestPublishToClientMessageExpiryDecremented(t *testing.T) {
+	s := newServer()
+	cl, _, _ := newTestClient()
+	cl.Properties.ProtocolVersion = 5
+	s.Clients.Add(cl)
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   "a/b/c",
+		Created:     time.Now().Unix() - 4,
+		Properties:  packets.Properties{MessageExpiryInterval: 10},
+	}
+
+	out, err := s.publishToClient(cl, packets.Subscription{Filter: "a/b/c", Qos: 1}, pk)
+	require.NoError(t, err)
+	require.LessOrEqual(t, out.Properties.MessageExpiryInterval, uint32(6))
+	require.Greater(t, out.Properties.MessageExpiryInterval, uint32(0))
+
+	sent := <-cl.State.outbound
+	require.Equal(t, out.Properties.MessageExpiryInterval, sent.Properties.MessageExpiryInterval)
+
+	inflight, ok := cl.State.Inflight.Get(out.PacketID)
+	require.True(t, ok)
+	require.Equal(t, uint32(10), inflight.Properties.MessageExpiryInterval)
+}
+
+func TestPublishToClientMessageExpired(t *testing.T) {
+	s := newServer()
+	cl, _, _ := newTestClient()
+	s.Clients.Add(cl)
+
+	_, err := s.publishToClient(cl, packets.Subscription{Filter: "a/b/c", Qos: 1}, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   "a/b/c",
+		Created:     time.Now().Unix() - 20,
+		Properties:  packets.Properties{MessageExpiryInterval: 10},
+	})
+	require.ErrorIs(t, err, ErrMessageExpired)
+	require.Equal(t, 0, cl.State.Inflight.Len())
+	require.Len(t, cl.State.outbound, 0)
+}
+
+func TestRetainMessageSetsExpiry(t *testing.T) {
+	s := newServer()
+	cl, _, _ := newTestClient()
+
+	n := time.Now().Unix()
+	s.retainMessage(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true},
+		TopicName:   "a/b/c",
+		Payload:     []byte("hello"),
+		Created:     n,
+		Properties:  packets.Properties{MessageExpiryInterval: 10},
+	})
+
+	pk, ok := s.Topics.Retained.Get("a/b/c")
+	require.True(t, ok)
+	require.Equal(t, n+10, pk.Expiry)
+
+	s.clearExpiredRetainedMessages(n + 11)
+	_, ok = s.Topics.Retained.Get("a/b/c")
+	require.False(t, ok)
+}
+
+func TestPublishToClientExhaustedSendQuotaStalls(t *testing.T) {
+	s := newServer()
+	cl, _, _ := newTestClient()
+	s.Clients.Add(cl)
+	cl.State.Inflight.sendQuota = 0
+
+	pkx := *packets.TPacketData[packets.Publish].Get(packets.TPublishQos1).Packet
+	_, err := s.publishToClient(cl, packets.Subscription{Filter: pkx.TopicName, Qos: 1}, pkx)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), cl.State.Inflight.Stalls())
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.FlowStalls))
+}
+
+func TestServerSetClientReceiveMaximum(t *testing.T) {
+	s := newServer()
+	cl, _, _ := newTestClient()
+	cl.Properties.Props.ReceiveMaximum = 20
+	cl.State.Inflight.ResetSendQuota(20)
+
+	require.Equal(t, uint16(5), s.SetClientReceiveMaximum(cl, 5))
+	remaining, maximum := cl.State.Inflight.SendQuota()
+	require.Equal(t, int32(5), remaining)
+	require.Equal(t, int32(5), maximum)
+
+	// capped at the receive maximum declared by the client
+	require.Equal(t, uint16(20), s.SetClientReceiveMaximum(cl, 100))
+	_, maximum = cl.State.Inflight.SendQuota()
+	require.Equal(t, int32(20), maximum)
+}
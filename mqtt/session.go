@@ -0,0 +1,172 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+var (
+	// ErrSessionNotFound indicates there is no session for a client id.
+	ErrSessionNotFound = errors.New("session not found")
+
+	// ErrSessionExists indicates an imported session would replace an existing session.
+	ErrSessionExists = errors.New("session already exists")
+
+	// ErrSessionConnected indicates an imported session would replace the session of a connected client.
+	ErrSessionConnected = errors.New("session client is connected")
+
+	// ErrSessionFrozen indicates a session cannot be imported during a maintenance freeze.
+	ErrSessionFrozen = errors.New("session cannot be imported during a freeze")
+
+	// ErrInvalidSession indicates an imported session has no client id, or records of another client.
+	ErrInvalidSession = errors.New("invalid session")
+)
+
+// SessionExport is the persisted session of a single client, being its session record,
+// subscriptions and inflight messages, including the messages queued while it was
+// disconnected.
+type SessionExport struct {
+	Connected     bool                   `json:"connected"`     // true if the client was connected when exported
+	Client        storage.Client         `json:"client"`        // the session record of the client
+	Subscriptions []storage.Subscription `json:"subscriptions"` // the subscriptions of the client, ordered by filter
+	Inflight      []storage.Message      `json:"inflight"`      // the inflight and queued messages of the client, ordered by packet id
+}
+
+// SessionImport contains the result of a session import.
+type SessionImport struct {
+	Replaced      bool `json:"replaced"`      // true if an existing session was replaced
+	Subscriptions int  `json:"subscriptions"` // the subscriptions imported
+	Inflight      int  `json:"inflight"`      // the inflight messages imported
+	Skipped       int  `json:"skipped"`       // the invalid subscriptions and expired inflight messages skipped
+}
+
+// ExportSession returns the session of a client, connected or not, for migrating it to
+// another node with ImportSession or for inspecting a stuck session. Queued messages
+// spilled to storage by tiering are read back.
+func (s *Server) ExportSession(id string) (SessionExport, error) {
+	cl, ok := s.Clients.Get(id)
+	if !ok || cl.Net.Inline {
+		return SessionExport{}, ErrSessionNotFound
+	}
+
+	se := SessionExport{
+		Connected:     atomic.LoadInt64(&cl.State.disconnected) == 0,
+		Client:        snapshotClient(cl),
+		Subscriptions: []storage.Subscription{},
+		Inflight:      []storage.Message{},
+	}
+
+	subs := cl.State.Subscriptions.GetAll()
+	filters := make([]string, 0, len(subs))
+	for filter := range subs {
+		filters = append(filters, filter)
+	}
+	sort.Strings(filters)
+	for _, filter := range filters {
+		se.Subscriptions = append(se.Subscriptions, snapshotSubscription(cl, subs[filter]))
+	}
+
+	pks := s.inflightMessages(cl)
+	sort.Slice(pks, func(i, j int) bool { return pks[i].PacketID < pks[j].PacketID })
+	for _, pk := range pks {
+		se.Inflight = append(se.Inflight, inflightMessage(cl, pk))
+	}
+
+	return se, nil
+}
+
+// ImportSession reads a session written by ExportSession and restores it as the session of a
+// disconnected client, persisting it through the storage hooks, so that the client resumes it
+// when it next connects to this node. The session of a connected client is never replaced,
+// and an existing session of a disconnected client is only replaced if overwrite is true.
+// Sessions exported while their client was connected expire from the time of the import.
+func (s *Server) ImportSession(r io.Reader, overwrite bool) (SessionImport, error) {
+	var res SessionImport
+	if s.Freeze.Status().Frozen {
+		return res, ErrSessionFrozen
+	}
+
+	var se SessionExport
+	if err := json.NewDecoder(r).Decode(&se); err != nil {
+		return res, fmt.Errorf("%w: %v", ErrInvalidSession, err)
+	}
+
+	id := se.Client.ID
+	if id == "" || id == InlineClientId {
+		return res, fmt.Errorf("%w: no client id", ErrInvalidSession)
+	}
+	for _, sub := range se.Subscriptions {
+		if sub.Client != "" && sub.Client != id {
+			return res, fmt.Errorf("%w: subscription %q of client %q", ErrInvalidSession, sub.Filter, sub.Client)
+		}
+	}
+	for _, msg := range se.Inflight {
+		if msg.Client != "" && msg.Client != id {
+			return res, fmt.Errorf("%w: inflight message %d of client %q", ErrInvalidSession, msg.PacketID, msg.Client)
+		}
+	}
+
+	if existing, ok := s.Clients.Get(id); ok {
+		if atomic.LoadInt64(&existing.State.disconnected) == 0 {
+			return res, ErrSessionConnected
+		}
+		if !overwrite {
+			return res, ErrSessionExists
+		}
+
+		s.hooks.OnClientExpired(existing)
+		existing.ClearInflights(math.MaxInt64, 0)
+		s.UnsubscribeClient(existing)
+		s.Clients.Delete(id)
+		res.Replaced = true
+	}
+
+	now := time.Now().Unix()
+	cl := s.storedClient(se.Client)
+	if se.Client.Disconnected == 0 {
+		atomic.StoreInt64(&cl.State.disconnected, now)
+	}
+	s.Clients.Add(cl)
+	s.hooks.OnSessionEstablished(cl, packets.Packet{})
+
+	subs := make([]storage.Subscription, 0, len(se.Subscriptions))
+	for _, sub := range se.Subscriptions {
+		if !IsValidFilter(sub.Filter, false) {
+			res.Skipped++
+			continue
+		}
+		sub.Client = id
+		subs = append(subs, sub)
+		res.Subscriptions++
+	}
+	s.loadSubscriptions(subs)
+
+	for _, msg := range se.Inflight {
+		pk := msg.ToPacket()
+		if remaining, ok := RemainingMessageExpiry(pk, now); ok && remaining <= 0 {
+			res.Skipped++
+			continue
+		}
+
+		if cl.State.Inflight.Set(pk) {
+			atomic.AddInt64(&s.Info.Inflight, 1)
+		}
+		s.hooks.OnQosPublish(cl, pk, msg.Sent, 0)
+		res.Inflight++
+	}
+
+	return res, nil
+}
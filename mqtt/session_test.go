@@ -0,0 +1,177 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+func exportTestSession(t *testing.T, s *Server, id string) []byte {
+	se, err := s.ExportSession(id)
+	require.NoError(t, err)
+	b, err := json.Marshal(se)
+	require.NoError(t, err)
+	return b
+}
+
+func TestExportSession(t *testing.T) {
+	now := time.Now().Unix()
+	s := snapshotTestServer(now)
+	cl, _ := s.Clients.Get("persistent")
+	cl.State.Inflight.Set(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pubrel, Qos: 1}, PacketID: 2})
+
+	se, err := s.ExportSession("persistent")
+	require.NoError(t, err)
+	require.False(t, se.Connected)
+	require.Equal(t, "persistent", se.Client.ID)
+	require.Equal(t, now-30, se.Client.Disconnected)
+	require.Len(t, se.Subscriptions, 1)
+	require.Equal(t, "a/+", se.Subscriptions[0].Filter)
+	require.Len(t, se.Inflight, 2)
+	require.Equal(t, uint16(2), se.Inflight[0].PacketID)
+	require.Equal(t, uint16(7), se.Inflight[1].PacketID)
+	require.Equal(t, []byte("queued"), se.Inflight[1].Payload)
+
+	// sessions ending with their connection are exported for debugging
+	se, err = s.ExportSession("clean")
+	require.NoError(t, err)
+	require.Len(t, se.Subscriptions, 1)
+	require.Empty(t, se.Inflight)
+
+	_, err = s.ExportSession("missing")
+	require.ErrorIs(t, err, ErrSessionNotFound)
+}
+
+func TestExportSessionConnected(t *testing.T) {
+	s := newServer()
+	cl, _, _ := newTestClient()
+	cl.ID = "online"
+	s.Clients.Add(cl)
+
+	se, err := s.ExportSession("online")
+	require.NoError(t, err)
+	require.True(t, se.Connected)
+	require.Equal(t, int64(0), se.Client.Disconnected)
+}
+
+func TestImportSession(t *testing.T) {
+	now := time.Now().Unix()
+	s := snapshotTestServer(now)
+	b := exportTestSession(t, s, "persistent")
+
+	d := newServer()
+	res, err := d.ImportSession(bytes.NewReader(b), false)
+	require.NoError(t, err)
+	require.Equal(t, SessionImport{Subscriptions: 1, Inflight: 1}, res)
+
+	cl, ok := d.Clients.Get("persistent")
+	require.True(t, ok)
+	require.Equal(t, "tcp1", cl.Net.Listener)
+	require.Equal(t, uint32(300), cl.Properties.Props.SessionExpiryInterval)
+	require.Equal(t, now-30, atomic.LoadInt64(&cl.State.disconnected))
+
+	sub, ok := cl.State.Subscriptions.Get("a/+")
+	require.True(t, ok)
+	require.Equal(t, 3, sub.Identifier)
+	require.Contains(t, d.Topics.Subscribers("a/b").Subscriptions, "persistent")
+
+	pk, ok := cl.State.Inflight.Get(7)
+	require.True(t, ok)
+	require.Equal(t, "queued", string(pk.Payload))
+	require.Equal(t, int64(1), atomic.LoadInt64(&d.Info.Inflight))
+}
+
+func TestImportSessionExisting(t *testing.T) {
+	now := time.Now().Unix()
+	s := snapshotTestServer(now)
+	b := exportTestSession(t, s, "persistent")
+
+	d := newServer()
+	existing := d.NewClient(nil, "tcp2", "persistent", false)
+	atomic.StoreInt64(&existing.State.disconnected, now)
+	d.Clients.Add(existing)
+	d.Topics.Subscribe(existing.ID, packets.Subscription{Filter: "old"})
+	existing.State.Subscriptions.Add("old", packets.Subscription{Filter: "old"})
+
+	_, err := d.ImportSession(bytes.NewReader(b), false)
+	require.ErrorIs(t, err, ErrSessionExists)
+
+	res, err := d.ImportSession(bytes.NewReader(b), true)
+	require.NoError(t, err)
+	require.True(t, res.Replaced)
+
+	cl, _ := d.Clients.Get("persistent")
+	require.Equal(t, "tcp1", cl.Net.Listener)
+	require.Equal(t, 1, cl.State.Subscriptions.Len())
+	require.NotContains(t, d.Topics.Subscribers("old").Subscriptions, "persistent")
+}
+
+func TestImportSessionConnected(t *testing.T) {
+	s := snapshotTestServer(time.Now().Unix())
+	b := exportTestSession(t, s, "persistent")
+
+	d := newServer()
+	cl, _, _ := newTestClient()
+	cl.ID = "persistent"
+	d.Clients.Add(cl)
+
+	_, err := d.ImportSession(bytes.NewReader(b), true)
+	require.ErrorIs(t, err, ErrSessionConnected)
+	require.Equal(t, 0, cl.State.Subscriptions.Len())
+}
+
+func TestImportSessionSkipsExpired(t *testing.T) {
+	now := time.Now().Unix()
+	s := snapshotTestServer(now)
+	cl, _ := s.Clients.Get("persistent")
+	cl.State.Inflight.Set(packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		PacketID:    8,
+		TopicName:   "a/b",
+		Created:     now - 100,
+		Properties:  packets.Properties{MessageExpiryInterval: 10},
+	})
+	se, err := s.ExportSession("persistent")
+	require.NoError(t, err)
+	se.Subscriptions[0].Filter = "a/#/b"
+	b, err := json.Marshal(se)
+	require.NoError(t, err)
+
+	d := newServer()
+	res, err := d.ImportSession(bytes.NewReader(b), false)
+	require.NoError(t, err)
+	require.Equal(t, SessionImport{Inflight: 1, Skipped: 2}, res)
+}
+
+func TestImportSessionInvalid(t *testing.T) {
+	d := newServer()
+	_, err := d.ImportSession(strings.NewReader("{"), false)
+	require.ErrorIs(t, err, ErrInvalidSession)
+
+	_, err = d.ImportSession(strings.NewReader(`{"client":{}}`), false)
+	require.ErrorIs(t, err, ErrInvalidSession)
+
+	_, err = d.ImportSession(strings.NewReader(`{"client":{"id":"a"},"subscriptions":[{"client":"b","filter":"x"}]}`), false)
+	require.ErrorIs(t, err, ErrInvalidSession)
+
+	_, err = d.ImportSession(strings.NewReader(`{"client":{"id":"a"},"inflight":[{"client":"b","packet_id":1}]}`), false)
+	require.ErrorIs(t, err, ErrInvalidSession)
+	require.Equal(t, 0, d.Clients.Len())
+}
+
+func TestImportSessionFrozen(t *testing.T) {
+	s := newServer()
+	s.Freeze.Start(FreezeOptions{Connections: true})
+	_, err := s.ImportSession(strings.NewReader(`{"client":{"id":"a"}}`), false)
+	require.ErrorIs(t, err, ErrSessionFrozen)
+}
@@ -0,0 +1,400 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+const (
+	SnapshotKey     = "snapshot" // the data type of the header record of a snapshot
+	SnapshotVersion = 1          // the version of the snapshot format written by ExportSnapshot
+)
+
+var (
+	// ErrSnapshotFrozen indicates a snapshot cannot be restored during a maintenance freeze.
+	ErrSnapshotFrozen = errors.New("snapshot cannot be restored during a freeze")
+
+	// ErrInvalidSnapshot indicates a snapshot has no valid header, an unsupported version or an unknown record.
+	ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+	// ErrIncompleteSnapshot indicates a snapshot holds fewer or more records than its header declares, e.g. if truncated.
+	ErrIncompleteSnapshot = errors.New("incomplete snapshot")
+)
+
+// SnapshotCounts contains the number of records of each type in a snapshot.
+type SnapshotCounts struct {
+	Clients       int `json:"clients"`
+	Subscriptions int `json:"subscriptions"`
+	Inflight      int `json:"inflight"`
+	Retained      int `json:"retained"`
+}
+
+// SnapshotHeader is the first record of a snapshot.
+type SnapshotHeader struct {
+	T       string `json:"t"`       // the data type (snapshot)
+	Version int    `json:"version"` // the version of the snapshot format
+	Created int64  `json:"created"` // the time the snapshot was taken in unixtime
+	SnapshotCounts
+}
+
+// SnapshotImport contains the result of a snapshot restore.
+type SnapshotImport struct {
+	Restored SnapshotCounts `json:"restored"` // the records restored
+	Skipped  SnapshotCounts `json:"skipped"`  // the records of existing sessions, and existing, expired or invalid retained messages
+}
+
+// snapshot contains the records of a snapshot.
+type snapshot struct {
+	created       int64
+	clients       []storage.Client
+	subscriptions []storage.Subscription
+	inflight      []storage.Message
+	retained      []storage.Message
+}
+
+// counts returns the number of records of each type in the snapshot.
+func (sn *snapshot) counts() SnapshotCounts {
+	return SnapshotCounts{
+		Clients:       len(sn.clients),
+		Subscriptions: len(sn.subscriptions),
+		Inflight:      len(sn.inflight),
+		Retained:      len(sn.retained),
+	}
+}
+
+// ExportSnapshot writes the persistent state of the broker, being the sessions which
+// outlive their connections with their subscriptions and inflight messages, and the
+// retained messages, as newline delimited json storage records preceded by a header.
+// Each session is captured as a whole before anything is written, so that a slow reader
+// does not hold up the broker. $SYS messages are not exported.
+func (s *Server) ExportSnapshot(w io.Writer) (SnapshotCounts, error) {
+	var sn snapshot
+	clients := s.Clients.GetAll()
+	ids := make([]string, 0, len(clients))
+	for id := range clients {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		cl := clients[id]
+		if cl.Net.Inline || sessionExpires(cl) {
+			continue
+		}
+
+		sn.clients = append(sn.clients, snapshotClient(cl))
+
+		subs := cl.State.Subscriptions.GetAll()
+		filters := make([]string, 0, len(subs))
+		for filter := range subs {
+			filters = append(filters, filter)
+		}
+		sort.Strings(filters)
+		for _, filter := range filters {
+			sn.subscriptions = append(sn.subscriptions, snapshotSubscription(cl, subs[filter]))
+		}
+
+		for _, pk := range s.inflightMessages(cl) {
+			sn.inflight = append(sn.inflight, inflightMessage(cl, pk))
+		}
+	}
+
+	msgs := s.Topics.Messages("#")
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].TopicName < msgs[j].TopicName })
+	for _, pk := range msgs {
+		if !strings.HasPrefix(pk.TopicName, SysPrefix) {
+			sn.retained = append(sn.retained, retainedMessage(pk))
+		}
+	}
+
+	counts := sn.counts()
+	enc := json.NewEncoder(w)
+	err := enc.Encode(SnapshotHeader{
+		T:              SnapshotKey,
+		Version:        SnapshotVersion,
+		Created:        time.Now().Unix(),
+		SnapshotCounts: counts,
+	})
+	if err != nil {
+		return SnapshotCounts{}, err
+	}
+
+	for _, v := range sn.clients {
+		if err := enc.Encode(v); err != nil {
+			return SnapshotCounts{}, err
+		}
+	}
+	for _, v := range sn.subscriptions {
+		if err := enc.Encode(v); err != nil {
+			return SnapshotCounts{}, err
+		}
+	}
+	for _, v := range sn.inflight {
+		if err := enc.Encode(v); err != nil {
+			return SnapshotCounts{}, err
+		}
+	}
+	for _, v := range sn.retained {
+		if err := enc.Encode(v); err != nil {
+			return SnapshotCounts{}, err
+		}
+	}
+
+	return counts, nil
+}
+
+// ImportSnapshot reads a snapshot written by ExportSnapshot and restores its sessions,
+// subscriptions, inflight messages and retained messages, persisting them through the
+// storage hooks as when they are read from the store at startup. The whole snapshot is
+// read and checked against its header before anything is restored. Sessions of clients
+// which are already known, and retained messages which already exist, are kept, so that
+// a restore never replaces newer state. Snapshots compressed with gzip, as uploaded by
+// scheduled export jobs, are decompressed.
+func (s *Server) ImportSnapshot(r io.Reader) (SnapshotImport, error) {
+	var res SnapshotImport
+	if s.Freeze.Status().Frozen {
+		return res, ErrSnapshotFrozen
+	}
+
+	sn, err := readSnapshot(r)
+	if err != nil {
+		return res, err
+	}
+
+	now := time.Now().Unix()
+	restored := make(map[string]*Client, len(sn.clients))
+	for _, c := range sn.clients {
+		if _, ok := s.Clients.Get(c.ID); ok || c.ID == "" {
+			res.Skipped.Clients++
+			continue
+		}
+
+		cl := s.storedClient(c)
+		if c.Disconnected == 0 {
+			atomic.StoreInt64(&cl.State.disconnected, sn.created) // connected when the snapshot was taken
+		}
+		s.Clients.Add(cl)
+		s.hooks.OnSessionEstablished(cl, packets.Packet{})
+		restored[cl.ID] = cl
+		res.Restored.Clients++
+	}
+
+	subs := make([]storage.Subscription, 0, len(sn.subscriptions))
+	for _, sub := range sn.subscriptions {
+		if _, ok := restored[sub.Client]; !ok || !IsValidFilter(sub.Filter, false) {
+			res.Skipped.Subscriptions++
+			continue
+		}
+		subs = append(subs, sub)
+		res.Restored.Subscriptions++
+	}
+	s.loadSubscriptions(subs)
+
+	for _, msg := range sn.inflight {
+		cl, ok := restored[msg.Client]
+		if !ok {
+			res.Skipped.Inflight++
+			continue
+		}
+
+		pk := msg.ToPacket()
+		cl.State.Inflight.Set(pk)
+		s.hooks.OnQosPublish(cl, pk, msg.Sent, 0)
+		res.Restored.Inflight++
+	}
+
+	if s.Options.Capabilities.RetainAvailable == 0 {
+		res.Skipped.Retained = len(sn.retained)
+		return res, nil
+	}
+
+	cl := s.NewClient(nil, LocalListener, InlineClientId, true)
+	for _, msg := range sn.retained {
+		pk := msg.ToPacket()
+		pk.FixedHeader.Type = packets.Publish
+		pk.FixedHeader.Retain = true
+		if pk.Created == 0 {
+			pk.Created = now
+		}
+
+		if !s.importable(pk, false, now) {
+			res.Skipped.Retained++
+			continue
+		}
+
+		if !s.retainMessage(cl, pk) {
+			res.Skipped.Retained++
+			continue
+		}
+		res.Restored.Retained++
+	}
+
+	return res, nil
+}
+
+// readSnapshot reads and checks the header and records of a snapshot, decompressing it
+// if it starts with the gzip magic number.
+func readSnapshot(r io.Reader) (*snapshot, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+		}
+		defer zr.Close()
+		r = zr
+	} else {
+		r = br
+	}
+
+	dec := json.NewDecoder(r)
+	var header SnapshotHeader
+	if err := dec.Decode(&header); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrInvalidSnapshot, err)
+	}
+	if header.T != SnapshotKey || header.Version != SnapshotVersion {
+		return nil, fmt.Errorf("%w: unsupported header type %q version %d", ErrInvalidSnapshot, header.T, header.Version)
+	}
+
+	sn := &snapshot{created: header.Created}
+	for line := 2; ; line++ {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%w: record %d: %v", ErrInvalidSnapshot, line, err)
+		}
+
+		var rec struct {
+			T string `json:"t"`
+		}
+		if err := json.Unmarshal(raw, &rec); err != nil {
+			return nil, fmt.Errorf("%w: record %d: %v", ErrInvalidSnapshot, line, err)
+		}
+
+		var err error
+		switch rec.T {
+		case storage.ClientKey:
+			var v storage.Client
+			err = json.Unmarshal(raw, &v)
+			sn.clients = append(sn.clients, v)
+		case storage.SubscriptionKey:
+			var v storage.Subscription
+			err = json.Unmarshal(raw, &v)
+			sn.subscriptions = append(sn.subscriptions, v)
+		case storage.InflightKey:
+			var v storage.Message
+			err = json.Unmarshal(raw, &v)
+			sn.inflight = append(sn.inflight, v)
+		case storage.RetainedKey:
+			var v storage.Message
+			err = json.Unmarshal(raw, &v)
+			sn.retained = append(sn.retained, v)
+		default:
+			err = fmt.Errorf("unknown type %q", rec.T)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: record %d: %v", ErrInvalidSnapshot, line, err)
+		}
+	}
+
+	if counts := sn.counts(); counts != header.SnapshotCounts {
+		return nil, fmt.Errorf("%w: read %+v, header declares %+v", ErrIncompleteSnapshot, counts, header.SnapshotCounts)
+	}
+
+	return sn, nil
+}
+
+// sessionExpires returns true if the session of a client ends with its connection.
+func sessionExpires(cl *Client) bool {
+	return (cl.Properties.ProtocolVersion == 5 && cl.Properties.Props.SessionExpiryInterval == 0) ||
+		(cl.Properties.ProtocolVersion < 5 && cl.Properties.Clean)
+}
+
+// snapshotClient returns the storable representation of a client session.
+func snapshotClient(cl *Client) storage.Client {
+	props := cl.Properties.Props.Copy(false)
+	return storage.Client{
+		ID:              cl.ID,
+		T:               storage.ClientKey,
+		Remote:          cl.Net.Remote,
+		Listener:        cl.Net.Listener,
+		Username:        cl.Properties.Username,
+		Clean:           cl.Properties.Clean,
+		ProtocolVersion: cl.Properties.ProtocolVersion,
+		Properties: storage.ClientProperties{
+			SessionExpiryInterval:     props.SessionExpiryInterval,
+			SessionExpiryIntervalFlag: props.SessionExpiryIntervalFlag,
+			AuthenticationMethod:      props.AuthenticationMethod,
+			AuthenticationData:        props.AuthenticationData,
+			RequestProblemInfo:        props.RequestProblemInfo,
+			RequestProblemInfoFlag:    props.RequestProblemInfoFlag,
+			RequestResponseInfo:       props.RequestResponseInfo,
+			ReceiveMaximum:            props.ReceiveMaximum,
+			TopicAliasMaximum:         props.TopicAliasMaximum,
+			User:                      props.User,
+			MaximumPacketSize:         props.MaximumPacketSize,
+		},
+		Will:         storage.ClientWill(cl.Properties.Will),
+		Disconnected: atomic.LoadInt64(&cl.State.disconnected),
+		Expires:      cl.SessionExpiry(),
+	}
+}
+
+// snapshotSubscription returns the storable representation of a client subscription.
+func snapshotSubscription(cl *Client, sub packets.Subscription) storage.Subscription {
+	return storage.Subscription{
+		ID:                storage.SubscriptionKey + "_" + cl.ID + ":" + sub.Filter,
+		T:                 storage.SubscriptionKey,
+		Client:            cl.ID,
+		Filter:            sub.Filter,
+		Identifier:        sub.Identifier,
+		RetainHandling:    sub.RetainHandling,
+		Qos:               sub.Qos,
+		RetainAsPublished: sub.RetainAsPublished,
+		NoLocal:           sub.NoLocal,
+	}
+}
+
+// inflightMessage returns the storable representation of an inflight message of a client.
+func inflightMessage(cl *Client, pk packets.Packet) storage.Message {
+	return storage.Message{
+		ID:          storage.InflightKey + "_" + cl.ID + ":" + pk.FormatID(),
+		T:           storage.InflightKey,
+		Origin:      pk.Origin,
+		Client:      cl.ID,
+		PacketID:    pk.PacketID,
+		FixedHeader: pk.FixedHeader,
+		TopicName:   pk.TopicName,
+		Payload:     pk.Payload,
+		Sent:        pk.Created,
+		Created:     pk.Created,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          pk.Properties.PayloadFormat,
+			PayloadFormatFlag:      pk.Properties.PayloadFormatFlag,
+			MessageExpiryInterval:  pk.Properties.MessageExpiryInterval,
+			ContentType:            pk.Properties.ContentType,
+			ResponseTopic:          pk.Properties.ResponseTopic,
+			CorrelationData:        pk.Properties.CorrelationData,
+			SubscriptionIdentifier: pk.Properties.SubscriptionIdentifier,
+			TopicAlias:             pk.Properties.TopicAlias,
+			User:                   pk.Properties.User,
+		},
+	}
+}
@@ -0,0 +1,152 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"bytes"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+func snapshotTestServer(now int64) *Server {
+	s := newServer()
+
+	cl := s.NewClient(nil, "tcp1", "persistent", false)
+	cl.Properties.ProtocolVersion = 5
+	cl.Properties.Username = []byte("user")
+	cl.Properties.Props.SessionExpiryInterval = 300
+	cl.Properties.Props.SessionExpiryIntervalFlag = true
+	atomic.StoreInt64(&cl.State.disconnected, now-30)
+	s.Clients.Add(cl)
+	sub := packets.Subscription{Filter: "a/+", Qos: 1, Identifier: 3, NoLocal: true}
+	s.Topics.Subscribe(cl.ID, sub)
+	cl.State.Subscriptions.Add(sub.Filter, sub)
+	cl.State.Inflight.Set(packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		PacketID:    7,
+		TopicName:   "a/b",
+		Payload:     []byte("queued"),
+		Created:     now - 10,
+	})
+
+	clean := s.NewClient(nil, "tcp1", "clean", false)
+	clean.Properties.ProtocolVersion = 4
+	clean.Properties.Clean = true
+	s.Clients.Add(clean)
+	s.Topics.Subscribe(clean.ID, packets.Subscription{Filter: "b"})
+	clean.State.Subscriptions.Add("b", packets.Subscription{Filter: "b"})
+
+	retainTestMessage(s, "a/b", "hello", 1, 0, now)
+	retainTestMessage(s, SysPrefix+"/broker/uptime", "1", 0, 0, now)
+	return s
+}
+
+func TestExportImportSnapshot(t *testing.T) {
+	now := time.Now().Unix()
+	s := snapshotTestServer(now)
+
+	var buf bytes.Buffer
+	counts, err := s.ExportSnapshot(&buf)
+	require.NoError(t, err)
+	require.Equal(t, SnapshotCounts{Clients: 1, Subscriptions: 1, Inflight: 1, Retained: 1}, counts)
+	require.Equal(t, 5, strings.Count(buf.String(), "\n"))
+	require.True(t, strings.HasPrefix(buf.String(), `{"t":"snapshot","version":1,`))
+
+	d := newServer()
+	res, err := d.ImportSnapshot(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, SnapshotImport{Restored: counts}, res)
+
+	cl, ok := d.Clients.Get("persistent")
+	require.True(t, ok)
+	require.Equal(t, "tcp1", cl.Net.Listener)
+	require.Equal(t, []byte("user"), cl.Properties.Username)
+	require.Equal(t, uint32(300), cl.Properties.Props.SessionExpiryInterval)
+	require.Equal(t, now-30, atomic.LoadInt64(&cl.State.disconnected))
+
+	sub, ok := cl.State.Subscriptions.Get("a/+")
+	require.True(t, ok)
+	require.Equal(t, 3, sub.Identifier)
+	require.True(t, sub.NoLocal)
+	require.Contains(t, d.Topics.Subscribers("a/b").Subscriptions, "persistent")
+
+	pk, ok := cl.State.Inflight.Get(7)
+	require.True(t, ok)
+	require.Equal(t, "queued", string(pk.Payload))
+	require.Equal(t, now-10, pk.Created)
+
+	_, ok = d.Clients.Get("clean")
+	require.False(t, ok)
+
+	ret, ok := d.Topics.Retained.Get("a/b")
+	require.True(t, ok)
+	require.Equal(t, "hello", string(ret.Payload))
+}
+
+func TestImportSnapshotKeepsExisting(t *testing.T) {
+	now := time.Now().Unix()
+	s := snapshotTestServer(now)
+
+	var buf bytes.Buffer
+	_, err := s.ExportSnapshot(&buf)
+	require.NoError(t, err)
+
+	d := newServer()
+	existing := d.NewClient(nil, "tcp2", "persistent", false)
+	d.Clients.Add(existing)
+	retainTestMessage(d, "a/b", "newer", 0, 0, now)
+
+	res, err := d.ImportSnapshot(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, SnapshotImport{Skipped: SnapshotCounts{Clients: 1, Subscriptions: 1, Inflight: 1, Retained: 1}}, res)
+
+	cl, _ := d.Clients.Get("persistent")
+	require.Equal(t, "tcp2", cl.Net.Listener)
+	require.Equal(t, 0, cl.State.Subscriptions.Len())
+
+	ret, _ := d.Topics.Retained.Get("a/b")
+	require.Equal(t, "newer", string(ret.Payload))
+}
+
+func TestImportSnapshotInvalid(t *testing.T) {
+	s := snapshotTestServer(time.Now().Unix())
+	var buf bytes.Buffer
+	_, err := s.ExportSnapshot(&buf)
+	require.NoError(t, err)
+
+	lines := strings.SplitAfter(buf.String(), "\n")
+	d := newServer()
+	_, err = d.ImportSnapshot(strings.NewReader(strings.Join(lines[:len(lines)-2], "")))
+	require.ErrorIs(t, err, ErrIncompleteSnapshot)
+	require.Equal(t, 0, d.Clients.Len())
+
+	_, err = d.ImportSnapshot(strings.NewReader(strings.Join(lines[1:], "")))
+	require.ErrorIs(t, err, ErrInvalidSnapshot)
+
+	_, err = d.ImportSnapshot(strings.NewReader(lines[0] + `{"t":"unknown"}` + "\n"))
+	require.ErrorIs(t, err, ErrInvalidSnapshot)
+	require.ErrorContains(t, err, "record 2")
+
+	_, err = d.ImportSnapshot(strings.NewReader(`{"t":"snapshot","version":2}`))
+	require.ErrorIs(t, err, ErrInvalidSnapshot)
+}
+
+func TestImportSnapshotInvalidGzip(t *testing.T) {
+	d := newServer()
+	_, err := d.ImportSnapshot(bytes.NewReader([]byte{0x1f, 0x8b, 0}))
+	require.ErrorIs(t, err, ErrInvalidSnapshot)
+}
+
+func TestImportSnapshotFrozen(t *testing.T) {
+	s := newServer()
+	s.Freeze.Start(FreezeOptions{Connections: true})
+	_, err := s.ImportSnapshot(strings.NewReader(""))
+	require.ErrorIs(t, err, ErrSnapshotFrozen)
+}
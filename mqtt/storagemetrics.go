@@ -0,0 +1,128 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// storageLatencyBuckets are the upper bounds, in milliseconds, of the buckets of the
+// storage latency histograms.
+var storageLatencyBuckets = [...]float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 25, 50, 100, 250, 500, 1000}
+
+// StorageMetrics contains the writes, reads and size of a storage hook.
+type StorageMetrics struct {
+	ID           string           `json:"id"`
+	Writes       int64            `json:"writes"`            // writes made to the store
+	WriteErrors  int64            `json:"write_errors"`      // writes which failed, including buffered writes which failed when applied
+	Reads        int64            `json:"reads"`             // reads of the store
+	ReadErrors   int64            `json:"read_errors"`       // reads which failed
+	Pending      int64            `json:"pending"`           // writes buffered or waiting to be committed
+	Size         int64            `json:"size"`              // the bytes used by the store, 0 if unknown
+	WriteLatency LatencyHistogram `json:"write_latency"`     // the milliseconds writers waited for their writes
+	ReadLatency  LatencyHistogram `json:"read_latency"`      // the milliseconds taken by reads
+	Circuit      string           `json:"circuit,omitempty"` // closed, open or half-open if the connection to the store is health checked
+}
+
+// StorageMetricsProvider is implemented by storage hooks which count their writes and reads.
+type StorageMetricsProvider interface {
+	// StorageMetrics returns the current metrics of the hook.
+	StorageMetrics() StorageMetrics
+}
+
+// StorageMetrics returns the metrics of each storage hook which counts them.
+func (s *Server) StorageMetrics() []StorageMetrics {
+	ms := []StorageMetrics{}
+	for _, hook := range s.hooks.GetAll() {
+		if p, ok := hook.(StorageMetricsProvider); ok {
+			ms = append(ms, p.StorageMetrics())
+		}
+	}
+
+	return ms
+}
+
+// latencyCounter counts operations, their failures and their latency.
+type latencyCounter struct {
+	count   atomic.Int64
+	errors  atomic.Int64
+	latency atomic.Int64                             // the total nanoseconds of the operations
+	buckets [len(storageLatencyBuckets)]atomic.Int64 // operations by their smallest bucket
+}
+
+// add counts an operation which started at a time.
+func (c *latencyCounter) add(start time.Time, err error) {
+	d := time.Since(start)
+	c.count.Add(1)
+	c.latency.Add(int64(d))
+	if err != nil {
+		c.errors.Add(1)
+	}
+
+	ms := float64(d) / float64(time.Millisecond)
+	for i, le := range storageLatencyBuckets {
+		if ms <= le {
+			c.buckets[i].Add(1)
+			return
+		}
+	}
+}
+
+// histogram returns the cumulative latency histogram of the operations.
+func (c *latencyCounter) histogram() LatencyHistogram {
+	lh := LatencyHistogram{
+		Count:   c.count.Load(),
+		Sum:     float64(c.latency.Load()) / float64(time.Millisecond),
+		Buckets: make([]LatencyBucket, len(storageLatencyBuckets)),
+	}
+
+	var n int64
+	for i, le := range storageLatencyBuckets {
+		n += c.buckets[i].Load()
+		lh.Buckets[i] = LatencyBucket{Le: le, Count: n}
+	}
+
+	return lh
+}
+
+// StorageRecorder counts the writes and reads of a storage hook and their latency, so that
+// a degrading store shows as rising latency and errors before clients notice.
+type StorageRecorder struct {
+	writes latencyCounter
+	reads  latencyCounter
+}
+
+// Write counts a write which started at a time, and failed if err is set.
+func (r *StorageRecorder) Write(start time.Time, err error) {
+	r.writes.add(start, err)
+}
+
+// WriteFailed counts n buffered writes which were counted when they were buffered, but
+// failed when they were applied.
+func (r *StorageRecorder) WriteFailed(n int) {
+	r.writes.errors.Add(int64(n))
+}
+
+// Read counts a read which started at a time, and failed if err is set.
+func (r *StorageRecorder) Read(start time.Time, err error) {
+	r.reads.add(start, err)
+}
+
+// Metrics returns the current metrics of the storage hook with an id, with the number of
+// pending writes and the bytes used by its store.
+func (r *StorageRecorder) Metrics(id string, pending int, size int64) StorageMetrics {
+	return StorageMetrics{
+		ID:           id,
+		Writes:       r.writes.count.Load(),
+		WriteErrors:  r.writes.errors.Load(),
+		Reads:        r.reads.count.Load(),
+		ReadErrors:   r.reads.errors.Load(),
+		Pending:      int64(pending),
+		Size:         size,
+		WriteLatency: r.writes.histogram(),
+		ReadLatency:  r.reads.histogram(),
+	}
+}
@@ -0,0 +1,68 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type storageMetricsHook struct {
+	HookBase
+	metrics StorageRecorder
+}
+
+func (h *storageMetricsHook) ID() string {
+	return "storage"
+}
+
+func (h *storageMetricsHook) StorageMetrics() StorageMetrics {
+	return h.metrics.Metrics(h.ID(), 3, 4096)
+}
+
+func TestStorageRecorder(t *testing.T) {
+	r := new(StorageRecorder)
+	now := time.Now()
+	r.Write(now, nil)
+	r.Write(now.Add(-20*time.Millisecond), errors.New("test"))
+	r.WriteFailed(2)
+	r.Read(now.Add(-2*time.Second), nil)
+
+	m := r.Metrics("test", 3, 4096)
+	require.Equal(t, "test", m.ID)
+	require.Equal(t, int64(2), m.Writes)
+	require.Equal(t, int64(3), m.WriteErrors)
+	require.Equal(t, int64(1), m.Reads)
+	require.Equal(t, int64(0), m.ReadErrors)
+	require.Equal(t, int64(3), m.Pending)
+	require.Equal(t, int64(4096), m.Size)
+
+	require.Equal(t, int64(2), m.WriteLatency.Count)
+	require.GreaterOrEqual(t, m.WriteLatency.Sum, 20.0)
+	require.Len(t, m.WriteLatency.Buckets, len(storageLatencyBuckets))
+	require.Equal(t, int64(1), m.WriteLatency.Buckets[0].Count)
+	require.Equal(t, int64(2), m.WriteLatency.Buckets[len(storageLatencyBuckets)-1].Count)
+
+	require.Equal(t, int64(1), m.ReadLatency.Count)
+	require.Equal(t, int64(0), m.ReadLatency.Buckets[len(storageLatencyBuckets)-1].Count) // slower than the last bucket
+}
+
+func TestServerStorageMetrics(t *testing.T) {
+	s := newServer()
+	require.Empty(t, s.StorageMetrics())
+
+	h := new(storageMetricsHook)
+	h.metrics.Write(time.Now(), nil)
+	require.NoError(t, s.AddHook(h, nil))
+
+	ms := s.StorageMetrics()
+	require.Len(t, ms, 1)
+	require.Equal(t, "storage", ms[0].ID)
+	require.Equal(t, int64(1), ms[0].Writes)
+	require.Equal(t, int64(3), ms[0].Pending)
+}
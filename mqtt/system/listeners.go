@@ -0,0 +1,116 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package system
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+)
+
+// ListenerInfo contains atomic counters of the connections of a listener, so that a
+// saturated entry point can be told apart from the others.
+type ListenerInfo struct {
+	Accepted      int64 `json:"accepted"`       // total number of connections accepted by the listener
+	Rejected      int64 `json:"rejected"`       // total number of accepted connections which did not become connected clients
+	Active        int64 `json:"active"`         // number of currently connected clients
+	TLSFailures   int64 `json:"tls_failures"`   // total number of connections which failed the tls handshake
+	BytesReceived int64 `json:"bytes_received"` // total number of bytes received from the clients of the listener
+	BytesSent     int64 `json:"bytes_sent"`     // total number of bytes sent to the clients of the listener
+}
+
+// Clone makes a copy of ListenerInfo using atomic operation
+func (i *ListenerInfo) Clone() *ListenerInfo {
+	return &ListenerInfo{
+		Accepted:      atomic.LoadInt64(&i.Accepted),
+		Rejected:      atomic.LoadInt64(&i.Rejected),
+		Active:        atomic.LoadInt64(&i.Active),
+		TLSFailures:   atomic.LoadInt64(&i.TLSFailures),
+		BytesReceived: atomic.LoadInt64(&i.BytesReceived),
+		BytesSent:     atomic.LoadInt64(&i.BytesSent),
+	}
+}
+
+// ListenersInfo contains the counters of each listener, keyed on listener id.
+type ListenersInfo struct {
+	internal map[string]*ListenerInfo
+	sync.RWMutex
+}
+
+// NewListenersInfo returns a new instance of ListenersInfo.
+func NewListenersInfo() *ListenersInfo {
+	return &ListenersInfo{
+		internal: map[string]*ListenerInfo{},
+	}
+}
+
+// Get returns the counters of a listener, adding them if the listener has none. A nil
+// ListenersInfo has no counters.
+func (l *ListenersInfo) Get(id string) *ListenerInfo {
+	if l == nil {
+		return nil
+	}
+
+	l.RLock()
+	i, ok := l.internal[id]
+	l.RUnlock()
+	if ok {
+		return i
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if i, ok = l.internal[id]; !ok {
+		i = new(ListenerInfo)
+		l.internal[id] = i
+	}
+
+	return i
+}
+
+// GetAll returns a copy of the counters of each listener.
+func (l *ListenersInfo) GetAll() map[string]*ListenerInfo {
+	m := map[string]*ListenerInfo{}
+	if l == nil {
+		return m
+	}
+
+	l.RLock()
+	defer l.RUnlock()
+	for id, i := range l.internal {
+		m[id] = i.Clone()
+	}
+
+	return m
+}
+
+// Clone makes a copy of ListenersInfo using atomic operation
+func (l *ListenersInfo) Clone() *ListenersInfo {
+	if l == nil {
+		return nil
+	}
+
+	return &ListenersInfo{
+		internal: l.GetAll(),
+	}
+}
+
+// MarshalJSON encodes the counters of each listener as an object keyed on listener id.
+func (l *ListenersInfo) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.GetAll())
+}
+
+// UnmarshalJSON decodes the counters of each listener from an object keyed on listener id.
+func (l *ListenersInfo) UnmarshalJSON(data []byte) error {
+	m := map[string]*ListenerInfo{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	l.internal = m
+	return nil
+}
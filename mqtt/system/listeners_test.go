@@ -0,0 +1,69 @@
+package system
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenerInfoClone(t *testing.T) {
+	o := &ListenerInfo{
+		Accepted:      1,
+		Rejected:      2,
+		Active:        3,
+		TLSFailures:   4,
+		BytesReceived: 5,
+		BytesSent:     6,
+	}
+
+	require.Equal(t, o, o.Clone())
+}
+
+func TestListenersInfoGet(t *testing.T) {
+	l := NewListenersInfo()
+	i := l.Get("tcp")
+	require.NotNil(t, i)
+	require.Same(t, i, l.Get("tcp"))
+
+	i.Accepted = 2
+	all := l.GetAll()
+	require.Equal(t, map[string]*ListenerInfo{"tcp": {Accepted: 2}}, all)
+	all["tcp"].Accepted = 3
+	require.Equal(t, int64(2), i.Accepted)
+}
+
+func TestListenersInfoNil(t *testing.T) {
+	var l *ListenersInfo
+	require.Nil(t, l.Get("tcp"))
+	require.Empty(t, l.GetAll())
+	require.Nil(t, l.Clone())
+}
+
+func TestListenersInfoClone(t *testing.T) {
+	l := NewListenersInfo()
+	l.Get("tcp").Active = 1
+
+	n := l.Clone()
+	require.Equal(t, l.GetAll(), n.GetAll())
+
+	l.Get("tcp").Active = 2
+	require.Equal(t, int64(1), n.Get("tcp").Active)
+}
+
+func TestListenersInfoJSON(t *testing.T) {
+	o := &Info{Listeners: NewListenersInfo()}
+	o.Listeners.Get("tcp").BytesSent = 10
+
+	b, err := json.Marshal(o)
+	require.NoError(t, err)
+	require.Contains(t, string(b), `"listeners":{"tcp":{"accepted":0,"rejected":0,"active":0,"tls_failures":0,"bytes_received":0,"bytes_sent":10}}`)
+
+	n := new(Info)
+	require.NoError(t, json.Unmarshal(b, n))
+	require.Equal(t, o.Listeners.GetAll(), n.Listeners.GetAll())
+
+	b, err = json.Marshal(new(Info))
+	require.NoError(t, err)
+	require.NotContains(t, string(b), "listeners")
+}
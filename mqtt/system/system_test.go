@@ -15,21 +15,28 @@ func TestClone(t *testing.T) {
 		BytesReceived:       4,
 		BytesSent:           5,
 		ClientsConnected:    6,
+		ClientsConnected4:   24,
+		ClientsConnected6:   25,
 		ClientsMaximum:      7,
 		ClientsTotal:        8,
 		ClientsDisconnected: 9,
+		ClientsReaped:       23,
 		MessagesReceived:    10,
 		MessagesSent:        11,
 		MessagesDropped:     20,
+		DeadLettered:        21,
 		Retained:            12,
 		Inflight:            13,
 		InflightDropped:     14,
+		FlowStalls:          22,
 		Subscriptions:       15,
 		PacketsReceived:     16,
 		PacketsSent:         17,
 		MemoryAlloc:         18,
 		Threads:             19,
+		Listeners:           NewListenersInfo(),
 	}
+	o.Listeners.Get("tcp").Accepted = 26
 
 	n := o.Clone()
 
@@ -0,0 +1,201 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+const (
+	BackoffUserPropertyKey        = "backoff-seconds" // the connack user property containing the seconds a client should wait before reconnecting
+	BackoffAttemptUserPropertyKey = "backoff-attempt" // the connack user property containing the number of consecutive rejections
+)
+
+// defaultConnectBackoff are the progressive backoff windows in seconds used if none are configured.
+var defaultConnectBackoff = []int64{1, 2, 5, 10, 30, 60}
+
+// connectBackoff contains the backoff state of a rejected client.
+type connectBackoff struct {
+	attempts int64 // the number of consecutive rejected connection attempts
+	until    int64 // the unix time before which further attempts are rejected
+}
+
+// ConnectThrottle rejects connections while the broker is throttling or overloaded, and
+// assigns progressively longer backoff windows to clients which are repeatedly rejected.
+// Connections may also be limited for each source ip, banning ips which exceed their rate,
+// so that reconnect storms and credential stuffing floods are rejected before they reach
+// the auth hooks.
+type ConnectThrottle struct {
+	internal map[string]*connectBackoff // backoff state keyed on client id
+	bans     map[string]int64           // the unix time each banned source ip is banned until
+	windows  []int64                    // progressive backoff windows in seconds
+	rate     int64                      // the maximum connections accepted per second, 0 is unlimited
+	burst    int64                      // the connections which may be accepted at once, the rate if lower
+	ipRate   int64                      // the maximum connections accepted per second from each source ip, 0 is unlimited
+	ipBurst  int64                      // the connections which may be accepted at once from each source ip
+	ban      int64                      // seconds a source ip exceeding its rate is banned for, 0 rejects only the excess
+	limiter  RateLimiter                // the limiter holding the connection rate buckets
+	sync.Mutex
+}
+
+// NewConnectThrottle returns a new instance of ConnectThrottle.
+func NewConnectThrottle(rate int64, windows []int64) *ConnectThrottle {
+	if len(windows) == 0 {
+		windows = defaultConnectBackoff
+	}
+
+	return &ConnectThrottle{
+		internal: map[string]*connectBackoff{},
+		bans:     map[string]int64{},
+		windows:  windows,
+		rate:     rate,
+		limiter:  NewMemoryRateLimiter(),
+	}
+}
+
+// SetLimiter sets the limiter holding the connection rate bucket, e.g. to limit the
+// connection rate across a cluster.
+func (t *ConnectThrottle) SetLimiter(l RateLimiter) {
+	t.Lock()
+	defer t.Unlock()
+	t.limiter = l
+}
+
+// SetBurst sets the number of connections which may be accepted at once before the
+// connection rate applies.
+func (t *ConnectThrottle) SetBurst(burst int64) {
+	t.Lock()
+	defer t.Unlock()
+	t.burst = burst
+}
+
+// LimitIPs limits the connections accepted per second from each source ip, allowing
+// bursts of up to burst connections. A source ip which exceeds its rate is banned for
+// ban seconds if ban is set.
+func (t *ConnectThrottle) LimitIPs(rate, burst, ban int64) {
+	t.Lock()
+	defer t.Unlock()
+	t.ipRate, t.ipBurst, t.ban = rate, burst, ban
+}
+
+// AllowIP returns true if a connection from a source ip is allowed at the given time.
+// If it is rejected, the seconds the ip should wait before reconnecting are returned.
+func (t *ConnectThrottle) AllowIP(ip string, now int64) (ok bool, backoff int64) {
+	t.Lock()
+	defer t.Unlock()
+
+	if until, banned := t.bans[ip]; banned && now < until {
+		return false, until - now
+	}
+
+	if t.ipRate <= 0 || ip == "" || takeToken(t.limiter, ConnectIPRateLimitKey+ip, t.ipRate, t.ipBurst, time.Unix(now, 0)) {
+		return true, 0
+	}
+
+	if t.ban <= 0 {
+		return false, 1
+	}
+
+	t.bans[ip] = now + t.ban
+	return false, t.ban
+}
+
+// Banned returns true if a source ip is banned at the given time.
+func (t *ConnectThrottle) Banned(ip string, now int64) bool {
+	t.Lock()
+	defer t.Unlock()
+	until, ok := t.bans[ip]
+	return ok && now < until
+}
+
+// Bans returns the number of source ips currently banned.
+func (t *ConnectThrottle) Bans() int {
+	t.Lock()
+	defer t.Unlock()
+	return len(t.bans)
+}
+
+// Allow returns true if a client may connect at the given time. If overloaded is true
+// the connection is rejected regardless of the connection rate. When a client is
+// rejected, the seconds it should wait and its consecutive rejections are returned.
+func (t *ConnectThrottle) Allow(id string, now int64, overloaded bool) (ok bool, backoff, attempts int64) {
+	t.Lock()
+	defer t.Unlock()
+
+	b, exists := t.internal[id]
+	if !overloaded && (!exists || now >= b.until) {
+		if t.rate <= 0 || takeToken(t.limiter, ConnectRateLimitKey, t.rate, t.burst, time.Unix(now, 0)) {
+			delete(t.internal, id)
+			return true, 0, 0
+		}
+	}
+
+	if !exists {
+		b = new(connectBackoff)
+		t.internal[id] = b
+	}
+
+	b.attempts++
+	i := b.attempts - 1
+	if i >= int64(len(t.windows)) {
+		i = int64(len(t.windows)) - 1
+	}
+
+	backoff = t.windows[i]
+	b.until = now + backoff
+	return false, backoff, b.attempts
+}
+
+// ClearExpired removes the backoff state of clients which have not been rejected for
+// longer than the largest backoff window, and the bans which have expired.
+func (t *ConnectThrottle) ClearExpired(now int64) {
+	t.Lock()
+	defer t.Unlock()
+
+	grace := t.windows[len(t.windows)-1]
+	for id, b := range t.internal {
+		if now > b.until+grace {
+			delete(t.internal, id)
+		}
+	}
+
+	for ip, until := range t.bans {
+		if now >= until {
+			delete(t.bans, ip)
+		}
+	}
+}
+
+// Len returns the number of clients currently in backoff.
+func (t *ConnectThrottle) Len() int {
+	t.Lock()
+	defer t.Unlock()
+	return len(t.internal)
+}
+
+// remoteIP returns the ip of a remote address, or the address if it has no port.
+func remoteIP(remote string) string {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		return remote
+	}
+	return host
+}
+
+// backoffProperties returns the connack properties hinting to a client how long to
+// wait before reconnecting.
+func backoffProperties(backoff, attempts int64) *packets.Properties {
+	return &packets.Properties{
+		User: []packets.UserProperty{
+			{Key: BackoffUserPropertyKey, Val: strconv.FormatInt(backoff, 10)},
+			{Key: BackoffAttemptUserPropertyKey, Val: strconv.FormatInt(attempts, 10)},
+		},
+	}
+}
@@ -0,0 +1,315 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/listeners"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+func TestConnectThrottleRate(t *testing.T) {
+	th := NewConnectThrottle(2, []int64{1, 5})
+
+	ok, _, _ := th.Allow("a", 100, false)
+	require.True(t, ok)
+	ok, _, _ = th.Allow("b", 100, false)
+	require.True(t, ok)
+
+	ok, backoff, attempts := th.Allow("c", 100, false)
+	require.False(t, ok)
+	require.Equal(t, int64(1), backoff)
+	require.Equal(t, int64(1), attempts)
+
+	ok, _, _ = th.Allow("d", 101, false)
+	require.True(t, ok)
+}
+
+func TestConnectThrottleProgressiveBackoff(t *testing.T) {
+	th := NewConnectThrottle(0, []int64{1, 5, 10})
+
+	ok, backoff, attempts := th.Allow("a", 100, true)
+	require.False(t, ok)
+	require.Equal(t, int64(1), backoff)
+	require.Equal(t, int64(1), attempts)
+
+	// reconnecting within the window is rejected and escalates the backoff
+	ok, backoff, attempts = th.Allow("a", 100, false)
+	require.False(t, ok)
+	require.Equal(t, int64(5), backoff)
+	require.Equal(t, int64(2), attempts)
+
+	ok, backoff, _ = th.Allow("a", 105, true)
+	require.False(t, ok)
+	require.Equal(t, int64(10), backoff)
+
+	ok, backoff, _ = th.Allow("a", 115, true)
+	require.False(t, ok)
+	require.Equal(t, int64(10), backoff)
+
+	// a successful connection resets the backoff
+	ok, _, _ = th.Allow("a", 125, false)
+	require.True(t, ok)
+	require.Equal(t, 0, th.Len())
+}
+
+func TestConnectThrottleDefaultWindows(t *testing.T) {
+	th := NewConnectThrottle(1, nil)
+	require.Equal(t, defaultConnectBackoff, th.windows)
+}
+
+func TestConnectThrottleClearExpired(t *testing.T) {
+	th := NewConnectThrottle(0, []int64{1, 5})
+	_, _, _ = th.Allow("a", 100, true)
+	require.Equal(t, 1, th.Len())
+
+	th.ClearExpired(105)
+	require.Equal(t, 1, th.Len())
+
+	th.ClearExpired(107)
+	require.Equal(t, 0, th.Len())
+}
+
+func TestEstablishConnectionThrottled(t *testing.T) {
+	s := New(&Options{
+		Logger:             logger,
+		MaximumConnections: 1,
+	})
+	_ = s.AddHook(new(AllowHook), nil)
+	defer s.Close()
+	require.NotNil(t, s.Throttle)
+	s.Info.ClientsConnected = 1
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r)
+	}()
+
+	go func() {
+		_, _ = w.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectMqtt5).RawBytes)
+	}()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := io.ReadAll(w)
+		require.NoError(t, err)
+		recv <- buf
+	}()
+
+	err := <-o
+	require.ErrorIs(t, err, packets.ErrServerBusy)
+	buf := <-recv
+	require.Equal(t, packets.Connack<<4, buf[0])
+	require.Contains(t, string(buf), BackoffUserPropertyKey)
+	require.Contains(t, string(buf), BackoffAttemptUserPropertyKey)
+
+	_ = w.Close()
+	_ = r.Close()
+}
+
+func TestEstablishConnectionThrottledV3(t *testing.T) {
+	s := New(&Options{
+		Logger:             logger,
+		MaximumConnections: 1,
+	})
+	_ = s.AddHook(new(AllowHook), nil)
+	defer s.Close()
+	s.Info.ClientsConnected = 1
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r)
+	}()
+
+	go func() {
+		_, _ = w.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectClean).RawBytes)
+	}()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := io.ReadAll(w)
+		require.NoError(t, err)
+		recv <- buf
+	}()
+
+	err := <-o
+	require.ErrorIs(t, err, packets.ErrServerBusy)
+	require.Equal(t, []byte{packets.Connack << 4, 2, 0, packets.Err3ServerUnavailable.Code}, <-recv)
+
+	_ = w.Close()
+	_ = r.Close()
+}
+
+func TestServerFamilyConnections(t *testing.T) {
+	s := New(&Options{
+		Logger:                 logger,
+		MaximumConnectionsIPv6: 1,
+	})
+	defer s.Close()
+	require.NotNil(t, s.Throttle)
+
+	connected, maximum := s.familyConnections(listeners.FamilyIPv4)
+	require.Equal(t, &s.Info.ClientsConnected4, connected)
+	require.Equal(t, int64(0), maximum)
+
+	connected, maximum = s.familyConnections(listeners.FamilyIPv6)
+	require.Equal(t, &s.Info.ClientsConnected6, connected)
+	require.Equal(t, int64(1), maximum)
+
+	connected, _ = s.familyConnections("")
+	require.Nil(t, connected)
+}
+
+func TestThrottleConnectFamily(t *testing.T) {
+	s := New(&Options{
+		Logger:                 logger,
+		MaximumConnectionsIPv6: 1,
+	})
+	defer s.Close()
+	s.Info.ClientsConnected6 = 1
+
+	cl, _, _ := newTestClient()
+	cl.Net.Family = listeners.FamilyIPv4
+	require.NoError(t, s.throttleConnect(cl))
+
+	cl, r, w := newTestClient()
+	cl.Net.Family = listeners.FamilyIPv6
+	go func() {
+		_, _ = io.ReadAll(r)
+	}()
+	require.ErrorIs(t, s.throttleConnect(cl), packets.ErrServerBusy)
+
+	_ = w.Close()
+	_ = r.Close()
+}
+
+func TestConnectThrottleBurst(t *testing.T) {
+	th := NewConnectThrottle(1, []int64{1})
+	th.SetBurst(3)
+
+	for i := 0; i < 3; i++ {
+		ok, _, _ := th.Allow("a", 100, false)
+		require.True(t, ok)
+	}
+
+	ok, _, _ := th.Allow("b", 100, false)
+	require.False(t, ok)
+}
+
+func TestConnectThrottleIP(t *testing.T) {
+	th := NewConnectThrottle(0, []int64{1})
+	ok, _ := th.AllowIP("10.0.0.1", 100)
+	require.True(t, ok)
+
+	th.LimitIPs(1, 2, 0)
+	ok, _ = th.AllowIP("10.0.0.1", 100)
+	require.True(t, ok)
+	ok, _ = th.AllowIP("10.0.0.1", 100)
+	require.True(t, ok)
+
+	ok, backoff := th.AllowIP("10.0.0.1", 100)
+	require.False(t, ok)
+	require.Equal(t, int64(1), backoff)
+	require.Equal(t, 0, th.Bans())
+
+	// each source ip has its own bucket
+	ok, _ = th.AllowIP("10.0.0.2", 100)
+	require.True(t, ok)
+
+	ok, _ = th.AllowIP("10.0.0.1", 101)
+	require.True(t, ok)
+}
+
+func TestConnectThrottleIPBan(t *testing.T) {
+	th := NewConnectThrottle(0, []int64{1})
+	th.LimitIPs(1, 1, 30)
+
+	ok, _ := th.AllowIP("10.0.0.1", 100)
+	require.True(t, ok)
+
+	ok, backoff := th.AllowIP("10.0.0.1", 100)
+	require.False(t, ok)
+	require.Equal(t, int64(30), backoff)
+	require.True(t, th.Banned("10.0.0.1", 100))
+	require.False(t, th.Banned("10.0.0.2", 100))
+
+	// the ban holds even once the bucket refills
+	ok, backoff = th.AllowIP("10.0.0.1", 110)
+	require.False(t, ok)
+	require.Equal(t, int64(20), backoff)
+
+	th.ClearExpired(129)
+	require.Equal(t, 1, th.Bans())
+	th.ClearExpired(130)
+	require.Equal(t, 0, th.Bans())
+
+	ok, _ = th.AllowIP("10.0.0.1", 130)
+	require.True(t, ok)
+}
+
+func TestRemoteIP(t *testing.T) {
+	require.Equal(t, "10.0.0.1", remoteIP("10.0.0.1:1883"))
+	require.Equal(t, "::1", remoteIP("[::1]:1883"))
+	require.Equal(t, "pipe", remoteIP("pipe"))
+}
+
+func TestEstablishConnectionBannedIP(t *testing.T) {
+	s := New(&Options{
+		Logger:             logger,
+		ConnectIPRateLimit: 1,
+		ConnectIPBan:       60,
+	})
+	_ = s.AddHook(new(AllowHook), nil)
+	defer s.Close()
+	require.NotNil(t, s.Throttle)
+
+	ok, _ := s.Throttle.AllowIP("pipe", time.Now().Unix())
+	require.True(t, ok)
+	ok, _ = s.Throttle.AllowIP("pipe", time.Now().Unix())
+	require.False(t, ok)
+
+	r, w := net.Pipe()
+	defer w.Close()
+	err := s.EstablishConnection("tcp", r)
+	require.ErrorIs(t, err, ErrBannedIP)
+}
+
+func TestThrottleConnectIP(t *testing.T) {
+	s := New(&Options{
+		Logger:             logger,
+		ConnectIPRateLimit: 1,
+		ConnectIPBan:       60,
+	})
+	defer s.Close()
+
+	cl, _, _ := newTestClient()
+	cl.Net.Remote = "10.0.0.1:5000"
+	require.NoError(t, s.throttleConnect(cl))
+
+	cl, r, w := newTestClient()
+	cl.Net.Remote = "10.0.0.1:5001"
+	cl.Properties.ProtocolVersion = 5
+	recv := make(chan []byte)
+	go func() {
+		buf, _ := io.ReadAll(r)
+		recv <- buf
+	}()
+	require.ErrorIs(t, s.throttleConnect(cl), packets.ErrServerBusy)
+	_ = w.Close()
+	require.Contains(t, string(<-recv), "60")
+	require.True(t, s.Throttle.Banned("10.0.0.1", time.Now().Unix()))
+
+	cl, _, _ = newTestClient()
+	cl.ID = "other"
+	cl.Net.Remote = "10.0.0.2:5000"
+	require.NoError(t, s.throttleConnect(cl))
+}
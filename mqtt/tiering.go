@@ -0,0 +1,395 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"container/list"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+var (
+	ErrTieringNoColdStore = errors.New("tiering requires a storage hook which reads cold entries back, such as the bolt, badger, cassandra or dynamodb hooks")
+)
+
+// TieringOptions configures a two tier store, in which the hot retained messages and the
+// queued messages of recently connected clients are kept in memory, while the cold ones are
+// kept only in a storage hook and read back when needed.
+type TieringOptions struct {
+	HotRetained int   `yaml:"hot-retained" json:"hot_retained"` // the retained messages kept in memory, the least recently used are spilled to the store, 0 keeps all
+	ColdAfter   int64 `yaml:"cold-after" json:"cold_after"`     // the seconds a client is disconnected after which its queued messages are spilled to the store, 0 keeps them
+}
+
+// TieringStatus contains the number of hot and cold retained and queued messages.
+type TieringStatus struct {
+	HotRetained   int   `json:"hot_retained"`   // retained messages in memory
+	ColdRetained  int   `json:"cold_retained"`  // retained messages only in the store
+	ColdInflight  int   `json:"cold_inflight"`  // queued messages of disconnected clients only in the store
+	RetainedLoads int64 `json:"retained_loads"` // cold retained messages read from the store
+	InflightLoads int64 `json:"inflight_loads"` // cold queued messages read from the store
+}
+
+// ColdStore is implemented by storage hooks which can read a single retained message and the
+// inflight messages of a single client back from their store, so that the broker need not
+// keep them in memory. Unlike StoredInflightMessagesByCid, which restores the sessions of
+// other nodes on connect, it is only used for the messages spilled by this broker.
+type ColdStore interface {
+	// StoredRetainedMessage returns the retained message of a topic, and false if there is none.
+	StoredRetainedMessage(topic string) (storage.Message, bool, error)
+
+	// StoredClientInflightMessages returns the inflight messages of a client.
+	StoredClientInflightMessages(cid string) ([]storage.Message, error)
+}
+
+// coldRetained is a retained message which is only in the cold store.
+type coldRetained struct {
+	created int64 // the time the message was created
+	expiry  int64 // the time the message expires, 0 if it does not
+}
+
+// retainedTier keeps the spillable retained messages of an index in memory up to a maximum,
+// spilling the least recently used to the cold store.
+type retainedTier struct {
+	sync.Mutex
+	max   int                                              // the spillable retained messages kept in memory
+	lru   *list.List                                       // the hot spillable topics, most recently used first
+	hot   map[string]*list.Element                         // the elements of the hot spillable topics
+	cold  map[string]coldRetained                          // the retained messages which are only in the cold store
+	stale []string                                         // cold topics missing from the store, to be removed from the index
+	load  func(topic string) (packets.Packet, bool, error) // reads a cold retained message from the store
+	loads atomic.Int64                                     // the cold retained messages read from the store
+}
+
+// forget stops tiering the retained message on a topic, such as when it is replaced or deleted.
+func (t *retainedTier) forget(topic string) {
+	t.Lock()
+	defer t.Unlock()
+
+	if el, ok := t.hot[topic]; ok {
+		t.lru.Remove(el)
+		delete(t.hot, topic)
+	}
+	delete(t.cold, topic)
+}
+
+// get reads the cold retained message on a topic from the store, returning false if the
+// topic is not cold, the message has expired, or it is missing from the store.
+func (t *retainedTier) get(topic string) (packets.Packet, bool) {
+	t.Lock()
+	c, ok := t.cold[topic]
+	t.Unlock()
+	if !ok || (c.expiry > 0 && c.expiry < time.Now().Unix()) {
+		return packets.Packet{}, false
+	}
+
+	pk, ok, err := t.load(topic)
+	if err != nil {
+		return packets.Packet{}, false
+	}
+	t.loads.Add(1)
+
+	if !ok {
+		t.Lock()
+		if _, cold := t.cold[topic]; cold {
+			delete(t.cold, topic)
+			t.stale = append(t.stale, topic)
+		}
+		t.Unlock()
+		return packets.Packet{}, false
+	}
+
+	return pk, true
+}
+
+// isCold returns true if the retained message on a topic is only in the cold store.
+func (t *retainedTier) isCold(topic string) bool {
+	t.Lock()
+	defer t.Unlock()
+	_, ok := t.cold[topic]
+	return ok
+}
+
+// coldLen returns the number of cold retained messages.
+func (t *retainedTier) coldLen() int {
+	t.Lock()
+	defer t.Unlock()
+	return len(t.cold)
+}
+
+// setRetainedTier keeps at most max spillable retained messages of the index in memory,
+// reading cold ones back with load.
+func (x *TopicsIndex) setRetainedTier(max int, load func(topic string) (packets.Packet, bool, error)) {
+	x.root.Lock()
+	defer x.root.Unlock()
+
+	x.tier = &retainedTier{
+		max:  max,
+		lru:  list.New(),
+		hot:  map[string]*list.Element{},
+		cold: map[string]coldRetained{},
+		load: load,
+	}
+}
+
+// tierRetained marks the retained message on a topic as written to the cold store, so
+// that it is spilled from memory once it is among the least recently used.
+func (x *TopicsIndex) tierRetained(topic string) {
+	if x.tier == nil || strings.HasPrefix(topic, SysPrefix) {
+		return
+	}
+
+	x.root.Lock()
+	defer x.root.Unlock()
+
+	if _, ok := x.Retained.Get(topic); !ok {
+		return
+	}
+
+	x.tier.Lock()
+	defer x.tier.Unlock()
+	if el, ok := x.tier.hot[topic]; ok {
+		x.tier.lru.MoveToFront(el)
+	} else {
+		x.tier.hot[topic] = x.tier.lru.PushFront(topic)
+	}
+	x.spillRetained()
+}
+
+// spillRetained removes the least recently used spillable retained messages from memory
+// while there are more than the maximum, with the root and tier locks held.
+func (x *TopicsIndex) spillRetained() {
+	for x.tier.lru.Len() > x.tier.max {
+		el := x.tier.lru.Back()
+		topic := el.Value.(string)
+		x.tier.lru.Remove(el)
+		delete(x.tier.hot, topic)
+
+		if pk, ok := x.Retained.Get(topic); ok {
+			x.tier.cold[topic] = coldRetained{created: pk.Created, expiry: pk.Expiry}
+			x.Retained.Delete(topic)
+		}
+	}
+}
+
+// warmRetained returns delivered cold retained messages to memory as the most recently used,
+// and marks delivered hot ones as recently used.
+func (x *TopicsIndex) warmRetained(pks []packets.Packet) {
+	x.root.Lock()
+	defer x.root.Unlock()
+
+	x.tier.Lock()
+	defer x.tier.Unlock()
+	for _, pk := range pks {
+		if el, ok := x.tier.hot[pk.TopicName]; ok {
+			x.tier.lru.MoveToFront(el)
+		} else if _, ok := x.tier.cold[pk.TopicName]; ok {
+			delete(x.tier.cold, pk.TopicName)
+			x.Retained.Add(pk.TopicName, pk)
+			x.tier.hot[pk.TopicName] = x.tier.lru.PushFront(pk.TopicName)
+		}
+	}
+	x.spillRetained()
+}
+
+// dropStaleRetained removes the cold topics found missing from the store from the index.
+func (x *TopicsIndex) dropStaleRetained() {
+	x.tier.Lock()
+	stale := x.tier.stale
+	x.tier.stale = nil
+	x.tier.Unlock()
+
+	for _, topic := range stale {
+		x.root.Lock()
+		if _, ok := x.Retained.Get(topic); !ok {
+			x.unretain(topic)
+			if x.limits != nil {
+				x.limits.remove(topic)
+			}
+		}
+		x.root.Unlock()
+	}
+}
+
+// coldExpiredRetained returns the topics of the cold retained messages which have expired, or
+// are older than the maximum expiry.
+func (x *TopicsIndex) coldExpiredRetained(now, maximumExpiry int64) []string {
+	if x.tier == nil {
+		return nil
+	}
+
+	x.tier.Lock()
+	defer x.tier.Unlock()
+
+	var topics []string
+	for topic, c := range x.tier.cold {
+		if (c.expiry > 0 && c.expiry < now) || c.created+maximumExpiry < now {
+			topics = append(topics, topic)
+		}
+	}
+
+	return topics
+}
+
+// RetainedMessage returns the retained message on a topic, reading it from the cold store
+// if it is not in memory.
+func (x *TopicsIndex) RetainedMessage(topic string) (packets.Packet, bool) {
+	if pk, ok := x.Retained.Get(topic); ok {
+		return pk, true
+	}
+
+	if x.tier == nil {
+		return packets.Packet{}, false
+	}
+
+	return x.tier.get(topic)
+}
+
+// RetainedLen returns the number of retained messages, in memory and in the cold store.
+func (x *TopicsIndex) RetainedLen() int {
+	if x.tier == nil {
+		return x.Retained.Len()
+	}
+
+	return x.Retained.Len() + x.tier.coldLen()
+}
+
+// coldStore returns the first hook which can read cold entries back from its store.
+func (s *Server) coldStore() ColdStore {
+	for _, hook := range s.hooks.GetAll() {
+		if c, ok := hook.(ColdStore); ok {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// setupTiering starts keeping only the hot retained and queued messages in memory, if
+// tiering is configured.
+func (s *Server) setupTiering() error {
+	if s.Options.Tiering == nil || (s.Options.Tiering.HotRetained <= 0 && s.Options.Tiering.ColdAfter <= 0) {
+		return nil
+	}
+
+	store := s.coldStore()
+	if store == nil {
+		return ErrTieringNoColdStore
+	}
+	s.cold = store
+
+	if s.Options.Tiering.HotRetained > 0 {
+		s.Topics.setRetainedTier(s.Options.Tiering.HotRetained, func(topic string) (packets.Packet, bool, error) {
+			msg, ok, err := store.StoredRetainedMessage(topic)
+			if err != nil {
+				s.Log.Error("failed to read cold retained message", "error", err, "topic", topic)
+				return packets.Packet{}, false, err
+			}
+
+			return msg.ToPacket(), ok, nil
+		})
+	}
+
+	return nil
+}
+
+// spillInflights removes the payloads of the queued messages of clients which have been
+// disconnected for longer than the cold after interval from memory, as they are in the store.
+func (s *Server) spillInflights(now int64) {
+	if s.cold == nil || s.Options.Tiering.ColdAfter <= 0 {
+		return
+	}
+
+	for _, cl := range s.Clients.GetAll() {
+		disconnected := atomic.LoadInt64(&cl.State.disconnected)
+		if cl.Net.Inline || !cl.Closed() || disconnected == 0 || disconnected+s.Options.Tiering.ColdAfter > now {
+			continue
+		}
+
+		if n := cl.State.Inflight.spill(); n > 0 {
+			s.Log.Debug("spilled queued messages", "client", cl.ID, "messages", n)
+		}
+	}
+}
+
+// warmInflights restores the payloads of the cold queued messages of a client from the store.
+// Cold messages missing from the store are dropped.
+func (s *Server) warmInflights(cl *Client) {
+	if s.cold == nil || !cl.State.Inflight.hasCold() {
+		return
+	}
+
+	msgs, err := s.cold.StoredClientInflightMessages(cl.ID)
+	if err != nil {
+		s.Log.Error("failed to read cold queued messages", "error", err, "client", cl.ID)
+		return
+	}
+
+	pks := make([]packets.Packet, len(msgs))
+	for i, msg := range msgs {
+		pks[i] = msg.ToPacket()
+	}
+	s.coldLoads.Add(int64(len(pks)))
+
+	for _, id := range cl.State.Inflight.warm(pks) {
+		atomic.AddInt64(&s.Info.Inflight, -1)
+		s.hooks.OnQosDropped(cl, packets.Packet{PacketID: id})
+		s.Log.Warn("cold queued message missing from store", "client", cl.ID, "packet_id", id)
+	}
+}
+
+// inflightMessages returns the inflight messages of a client, with the payloads of any cold
+// queued messages read from the store, leaving them cold.
+func (s *Server) inflightMessages(cl *Client) []packets.Packet {
+	pks := cl.State.Inflight.GetAll(false)
+	if s.cold == nil || !cl.State.Inflight.hasCold() {
+		return pks
+	}
+
+	msgs, err := s.cold.StoredClientInflightMessages(cl.ID)
+	if err != nil {
+		s.Log.Error("failed to read cold queued messages", "error", err, "client", cl.ID)
+		return pks
+	}
+	s.coldLoads.Add(int64(len(msgs)))
+
+	stored := make(map[uint16]storage.Message, len(msgs))
+	for _, msg := range msgs {
+		stored[msg.PacketID] = msg
+	}
+
+	for i, pk := range pks {
+		if msg, ok := stored[pk.PacketID]; ok && cl.State.Inflight.isCold(pk.PacketID) {
+			pks[i] = msg.ToPacket()
+			pks[i].Expiry = pk.Expiry
+		}
+	}
+
+	return pks
+}
+
+// TieringStatus returns the number of hot and cold retained and queued messages.
+func (s *Server) TieringStatus() TieringStatus {
+	st := TieringStatus{
+		HotRetained:   s.Topics.Retained.Len(),
+		InflightLoads: s.coldLoads.Load(),
+	}
+
+	if s.Topics.tier != nil {
+		st.ColdRetained = s.Topics.tier.coldLen()
+		st.RetainedLoads = s.Topics.tier.loads.Load()
+	}
+
+	for _, cl := range s.Clients.GetAll() {
+		st.ColdInflight += cl.State.Inflight.coldLen()
+	}
+
+	return st
+}
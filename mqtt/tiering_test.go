@@ -0,0 +1,238 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+// coldStoreHook keeps retained and inflight messages in memory the way a storage hook
+// which reads cold entries back would.
+type coldStoreHook struct {
+	HookBase
+	mu       sync.Mutex
+	retained map[string]storage.Message
+	inflight map[string][]storage.Message
+}
+
+func newColdStoreHook() *coldStoreHook {
+	return &coldStoreHook{
+		retained: map[string]storage.Message{},
+		inflight: map[string][]storage.Message{},
+	}
+}
+
+func (h *coldStoreHook) ID() string {
+	return "cold-store"
+}
+
+func (h *coldStoreHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		OnRetainMessage,
+	}, []byte{b})
+}
+
+func (h *coldStoreHook) OnRetainMessage(cl *Client, pk packets.Packet, r int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if r == -1 {
+		delete(h.retained, pk.TopicName)
+		return
+	}
+
+	h.retained[pk.TopicName] = storage.Message{
+		FixedHeader: pk.FixedHeader,
+		TopicName:   pk.TopicName,
+		Payload:     pk.Payload,
+		Created:     pk.Created,
+	}
+}
+
+func (h *coldStoreHook) StoredRetainedMessage(topic string) (storage.Message, bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	m, ok := h.retained[topic]
+	return m, ok, nil
+}
+
+func (h *coldStoreHook) StoredClientInflightMessages(cid string) ([]storage.Message, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.inflight[cid], nil
+}
+
+func newTieredServer(t *testing.T, opts TieringOptions) (*Server, *coldStoreHook) {
+	s := newServer()
+	h := newColdStoreHook()
+	require.NoError(t, s.AddHook(h, nil))
+	s.Options.Tiering = &opts
+	require.NoError(t, s.setupTiering())
+	return s, h
+}
+
+func TestSetupTieringNoColdStore(t *testing.T) {
+	s := newServer()
+	require.NoError(t, s.setupTiering())
+	require.Nil(t, s.cold)
+
+	s.Options.Tiering = &TieringOptions{}
+	require.NoError(t, s.setupTiering())
+	require.Nil(t, s.cold)
+
+	s.Options.Tiering = &TieringOptions{HotRetained: 10}
+	require.ErrorIs(t, s.setupTiering(), ErrTieringNoColdStore)
+}
+
+func TestServerTieringRetained(t *testing.T) {
+	s, _ := newTieredServer(t, TieringOptions{HotRetained: 2})
+	cl, _, _ := newTestClient()
+
+	for _, topic := range []string{"a/1", "a/2", "a/3"} {
+		require.True(t, s.retainMessage(cl, retainedPacket(topic, topic)))
+	}
+	require.True(t, s.retainMessage(cl, retainedPacket(SysPrefix+"/broker/uptime", "1")))
+
+	require.Equal(t, 3, s.Topics.Retained.Len())
+	require.False(t, isRetained(s.Topics, "a/1"))
+	require.Equal(t, 4, s.Topics.RetainedLen())
+	require.Equal(t, int64(4), s.Info.Retained)
+
+	// the cold retained message is read back from the store, and returned to memory once delivered
+	pks := s.Topics.Messages("a/+")
+	require.Len(t, pks, 3)
+	pk, ok := s.Topics.RetainedMessage("a/1")
+	require.True(t, ok)
+	require.Equal(t, []byte("a/1"), pk.Payload)
+
+	s.Topics.touchRetained([]packets.Packet{pk})
+	require.True(t, isRetained(s.Topics, "a/1"))
+	require.False(t, isRetained(s.Topics, "a/2"))
+
+	st := s.TieringStatus()
+	require.Equal(t, 3, st.HotRetained)
+	require.Equal(t, 1, st.ColdRetained)
+	require.Equal(t, int64(2), st.RetainedLoads)
+
+	// deleting a cold retained message removes it from the store
+	require.True(t, s.retainMessage(cl, packets.Packet{TopicName: "a/2"}))
+	require.Equal(t, 0, s.TieringStatus().ColdRetained)
+	_, ok = s.Topics.RetainedMessage("a/2")
+	require.False(t, ok)
+	require.Equal(t, 3, s.Topics.RetainedLen())
+}
+
+func TestServerTieringRetainedMissing(t *testing.T) {
+	s, h := newTieredServer(t, TieringOptions{HotRetained: 1})
+	cl, _, _ := newTestClient()
+
+	require.True(t, s.retainMessage(cl, retainedPacket("a/1", "x")))
+	require.True(t, s.retainMessage(cl, retainedPacket("a/2", "x")))
+	delete(h.retained, "a/1")
+
+	require.Len(t, s.Topics.Messages("#"), 1)
+	require.Equal(t, 1, s.Topics.RetainedLen())
+	require.Nil(t, s.Topics.seek("a/1", 0))
+}
+
+func TestServerTieringRetainedExpiry(t *testing.T) {
+	s, _ := newTieredServer(t, TieringOptions{HotRetained: 1})
+	s.Options.Capabilities.MaximumMessageExpiryInterval = 10
+	cl, _, _ := newTestClient()
+
+	n := time.Now().Unix()
+	old := retainedPacket("a/1", "x")
+	old.Created = n - 20
+	require.True(t, s.retainMessage(cl, old))
+	fresh := retainedPacket("a/2", "x")
+	fresh.Created = n
+	require.True(t, s.retainMessage(cl, fresh))
+	require.Equal(t, 1, s.TieringStatus().ColdRetained)
+
+	s.clearExpiredRetainedMessages(n)
+	require.Equal(t, 0, s.TieringStatus().ColdRetained)
+	require.Equal(t, 1, s.Topics.RetainedLen())
+}
+
+func TestInflightSpillWarm(t *testing.T) {
+	i := NewInflights()
+	for id := uint16(1); id <= 3; id++ {
+		i.Set(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}, PacketID: id, Payload: []byte("x"), Expiry: 100})
+	}
+	i.Set(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pubrel}, PacketID: 4})
+
+	require.Equal(t, 3, i.spill())
+	require.Equal(t, 0, i.spill())
+	require.Equal(t, 3, i.coldLen())
+	require.True(t, i.isCold(1))
+	require.False(t, i.isCold(4))
+	pk, _ := i.Get(1)
+	require.Nil(t, pk.Payload)
+	require.Equal(t, int64(100), pk.Expiry)
+
+	missing := i.warm([]packets.Packet{
+		{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}, PacketID: 1, Payload: []byte("x")},
+		{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}, PacketID: 2, Payload: []byte("x")},
+	})
+	require.Equal(t, []uint16{3}, missing)
+	require.False(t, i.hasCold())
+	require.Equal(t, 3, i.Len())
+	pk, _ = i.Get(1)
+	require.Equal(t, []byte("x"), pk.Payload)
+	require.Equal(t, int64(100), pk.Expiry)
+}
+
+func TestServerTieringInflights(t *testing.T) {
+	s, h := newTieredServer(t, TieringOptions{ColdAfter: 10})
+	n := time.Now().Unix()
+
+	cl, _, _ := newTestClient()
+	cl.ID = "cold"
+	for id := uint16(1); id <= 2; id++ {
+		pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}, TopicName: "a/b", PacketID: id, Payload: []byte("x")}
+		cl.State.Inflight.Set(pk)
+		h.inflight[cl.ID] = append(h.inflight[cl.ID], storage.Message{FixedHeader: pk.FixedHeader, TopicName: pk.TopicName, PacketID: id, Payload: pk.Payload})
+	}
+	s.Clients.Add(cl)
+	s.Info.Inflight = 2
+
+	// not spilled while connected, or recently disconnected
+	s.spillInflights(n)
+	require.Equal(t, 0, cl.State.Inflight.coldLen())
+	cl.Stop(packets.CodeDisconnect)
+	cl.State.disconnected = n - 5
+	s.spillInflights(n)
+	require.Equal(t, 0, cl.State.Inflight.coldLen())
+
+	cl.State.disconnected = n - 20
+	s.spillInflights(n)
+	require.Equal(t, 2, s.TieringStatus().ColdInflight)
+	pk, _ := cl.State.Inflight.Get(1)
+	require.Nil(t, pk.Payload)
+
+	// snapshots read the cold messages without warming them
+	pks := s.inflightMessages(cl)
+	require.Len(t, pks, 2)
+	for _, pk := range pks {
+		require.Equal(t, []byte("x"), pk.Payload)
+	}
+	require.Equal(t, 2, cl.State.Inflight.coldLen())
+
+	// messages missing from the store are dropped when warmed
+	h.inflight[cl.ID] = h.inflight[cl.ID][:1]
+	s.warmInflights(cl)
+	require.False(t, cl.State.Inflight.hasCold())
+	require.Equal(t, 1, cl.State.Inflight.Len())
+	require.Equal(t, int64(1), s.Info.Inflight)
+	pk, _ = cl.State.Inflight.Get(1)
+	require.Equal(t, []byte("x"), pk.Payload)
+	require.Equal(t, int64(3), s.TieringStatus().InflightLoads)
+}
@@ -5,6 +5,7 @@
 package mqtt
 
 import (
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -360,7 +361,9 @@ func (s *Subscribers) MergeSharedSelected() {
 // TopicsIndex is a prefix/trie tree containing topic subscribers and retained messages.
 type TopicsIndex struct {
 	Retained *packets.Packets
-	root     *particle // a leaf containing a message and more leaves.
+	root     *particle       // a leaf containing a message and more leaves.
+	limits   *retainedLimits // the caps on retained messages, nil if unlimited.
+	tier     *retainedTier   // keeps the hot retained messages in memory and the cold in the store, nil if all are in memory.
 }
 
 // NewTopicsIndex returns a pointer to a new instance of Index.
@@ -466,18 +469,44 @@ func (x *TopicsIndex) Unsubscribe(filter, client string) (bool, int) {
 
 // RetainMessage saves a message payload to the end of a topic address. Returns
 // 1 if a retained message was added, and -1 if the retained message was removed.
-// 0 is returned if sequential empty payloads are received.
+// 0 is returned if sequential empty payloads are received, or if the message was
+// rejected by a retained limit.
 func (x *TopicsIndex) RetainMessage(pk packets.Packet) int64 {
+	r, _, _ := x.TryRetainMessage(pk)
+	return r
+}
+
+// TryRetainMessage saves a message payload to the end of a topic address as
+// RetainMessage does, returning the topics of any retained messages evicted to make
+// room for it, or ErrRetainedLimit if a retained limit rejected it.
+func (x *TopicsIndex) TryRetainMessage(pk packets.Packet) (int64, []string, error) {
 	x.root.Lock()
 	defer x.root.Unlock()
 
-	n := x.set(pk.TopicName, 0)
-	n.Lock()
-	defer n.Unlock()
 	if len(pk.Payload) > 0 {
+		var evicted []string
+		if x.limits != nil && !strings.HasPrefix(pk.TopicName, SysPrefix) {
+			var err error
+			evicted, err = x.limits.admit(pk.TopicName, int64(len(pk.TopicName)+len(pk.Payload)))
+			if err != nil {
+				return 0, nil, err
+			}
+
+			for _, topic := range evicted {
+				x.unretain(topic)
+			}
+		}
+
+		if x.tier != nil {
+			x.tier.forget(pk.TopicName) // tiered again once the new message is in the store
+		}
+
+		n := x.set(pk.TopicName, 0)
+		n.Lock()
+		defer n.Unlock()
 		n.retainPath = pk.TopicName
 		x.Retained.Add(pk.TopicName, pk)
-		return 1
+		return 1, evicted, nil
 	}
 
 	var out int64
@@ -485,11 +514,130 @@ func (x *TopicsIndex) RetainMessage(pk packets.Packet) int64 {
 		out = -1 // if a retained packet existed, return -1
 	}
 
+	if x.tier != nil {
+		if x.tier.isCold(pk.TopicName) {
+			out = -1
+		}
+		x.tier.forget(pk.TopicName)
+	}
+
+	n := x.set(pk.TopicName, 0)
+	n.Lock()
+	defer n.Unlock()
 	n.retainPath = ""
 	x.Retained.Delete(pk.TopicName) // [MQTT-3.3.1-6] [MQTT-3.3.1-7]
+	if x.limits != nil {
+		x.limits.remove(pk.TopicName)
+	}
 	x.trim(n)
 
-	return out
+	return out, nil, nil
+}
+
+// DeleteRetained removes the retained message on a topic, such as when it has expired.
+func (x *TopicsIndex) DeleteRetained(topic string) {
+	x.root.Lock()
+	defer x.root.Unlock()
+
+	x.unretain(topic)
+	if x.limits != nil {
+		x.limits.remove(topic)
+	}
+}
+
+// unretain removes the retained message on a topic from the index, with the root lock held.
+func (x *TopicsIndex) unretain(topic string) {
+	x.Retained.Delete(topic)
+	if x.tier != nil {
+		x.tier.forget(topic)
+	}
+	if n := x.seek(topic, 0); n != nil {
+		n.Lock()
+		n.retainPath = ""
+		n.Unlock()
+		x.trim(n)
+	}
+}
+
+// SetRetainedLimits sets the caps on the retained messages of the index, replacing any
+// set before. The retained messages already in the index are accounted for in order
+// of their creation, and the topics of any evicted or rejected by the limits are returned.
+func (x *TopicsIndex) SetRetainedLimits(limits []RetainedLimit) ([]string, error) {
+	for i := range limits {
+		if err := limits[i].Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	x.root.Lock()
+	defer x.root.Unlock()
+
+	x.limits = nil
+	if len(limits) == 0 {
+		return nil, nil
+	}
+
+	x.limits = newRetainedLimits(limits)
+	pks := x.Retained.GetAll()
+	existing := make([]packets.Packet, 0, len(pks))
+	for _, pk := range pks {
+		if !strings.HasPrefix(pk.TopicName, SysPrefix) {
+			existing = append(existing, pk)
+		}
+	}
+	sort.SliceStable(existing, func(i, j int) bool { return existing[i].Created < existing[j].Created })
+
+	var removed []string
+	for _, pk := range existing {
+		evicted, err := x.limits.admit(pk.TopicName, int64(len(pk.TopicName)+len(pk.Payload)))
+		if err != nil {
+			evicted = []string{pk.TopicName}
+		}
+
+		for _, topic := range evicted {
+			x.unretain(topic)
+		}
+		removed = append(removed, evicted...)
+	}
+
+	return removed, nil
+}
+
+// RetainedLimits returns the usage of each retained limit of the index.
+func (x *TopicsIndex) RetainedLimits() []RetainedLimitStatus {
+	x.root.Lock()
+	limits := x.limits
+	x.root.Unlock()
+
+	if limits == nil {
+		return []RetainedLimitStatus{}
+	}
+
+	return limits.status()
+}
+
+// touchRetained marks retained messages as recently used, such as when they have been
+// delivered to a new subscriber, returning cold ones to memory.
+func (x *TopicsIndex) touchRetained(pks []packets.Packet) {
+	if len(pks) == 0 {
+		return
+	}
+
+	x.root.Lock()
+	limits := x.limits
+	x.root.Unlock()
+
+	if limits != nil {
+		topics := make([]string, len(pks))
+		for i, pk := range pks {
+			topics[i] = pk.TopicName
+		}
+		limits.touch(topics)
+	}
+
+	if x.tier != nil {
+		x.warmRetained(pks)
+	}
 }
 
 // set creates a topic address in the index and returns the final particle.
@@ -540,7 +688,12 @@ func (x *TopicsIndex) trim(n *particle) {
 
 // Messages returns a slice of any retained messages which match a filter.
 func (x *TopicsIndex) Messages(filter string) []packets.Packet {
-	return x.scanMessages(filter, 0, nil, []packets.Packet{})
+	pks := x.scanMessages(filter, 0, nil, []packets.Packet{})
+	if x.tier != nil {
+		x.dropStaleRetained()
+	}
+
+	return pks
 }
 
 // scanMessages returns all retained messages on topics matching a given filter.
@@ -549,12 +702,12 @@ func (x *TopicsIndex) scanMessages(filter string, d int, n *particle, pks []pack
 		n = x.root
 	}
 
-	if len(filter) == 0 || x.Retained.Len() == 0 {
+	if len(filter) == 0 || x.RetainedLen() == 0 {
 		return pks
 	}
 
 	if !strings.ContainsRune(filter, '#') && !strings.ContainsRune(filter, '+') {
-		if pk, ok := x.Retained.Get(filter); ok {
+		if pk, ok := x.RetainedMessage(filter); ok {
 			pks = append(pks, pk)
 		}
 		return pks
@@ -569,7 +722,7 @@ func (x *TopicsIndex) scanMessages(filter string, d int, n *particle, pks []pack
 
 			if !hasNext {
 				if adjacent.retainPath != "" {
-					if pk, ok := x.Retained.Get(adjacent.retainPath); ok {
+					if pk, ok := x.RetainedMessage(adjacent.retainPath); ok {
 						pks = append(pks, pk)
 					}
 				}
@@ -587,7 +740,7 @@ func (x *TopicsIndex) scanMessages(filter string, d int, n *particle, pks []pack
 			return x.scanMessages(filter, d+1, particle, pks)
 		}
 
-		if pk, ok := x.Retained.Get(particle.retainPath); ok {
+		if pk, ok := x.RetainedMessage(particle.retainPath); ok {
 			pks = append(pks, pk)
 		}
 	}
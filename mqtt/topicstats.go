@@ -0,0 +1,193 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	maxTopicStatsPrefixes = 10000 // the maximum number of topic prefixes tracked
+	rootTopicStatsPrefix  = "#"   // the prefix used for filters which begin with a wildcard
+)
+
+// TopicStat contains the message, byte and subscriber statistics of a topic prefix.
+type TopicStat struct {
+	Prefix           string `json:"prefix"`
+	MessagesReceived int64  `json:"messages_received"` // messages published to topics under the prefix
+	MessagesSent     int64  `json:"messages_sent"`     // messages delivered to subscribers from topics under the prefix
+	BytesReceived    int64  `json:"bytes_received"`    // payload bytes published to topics under the prefix
+	BytesSent        int64  `json:"bytes_sent"`        // payload bytes delivered to subscribers
+	Subscriptions    int64  `json:"subscriptions"`     // subscriptions with filters under the prefix
+	MessageRate      int64  `json:"message_rate"`      // messages received per second over the last interval
+	ByteRate         int64  `json:"byte_rate"`         // payload bytes received per second over the last interval
+	lastMessages     int64  // messages received at the last rate calculation
+	lastBytes        int64  // bytes received at the last rate calculation
+}
+
+// TopicStats tracks statistics for topic trees, grouped by topic prefixes which
+// are truncated to a configurable number of levels.
+type TopicStats struct {
+	internal map[string]*TopicStat
+	sync.RWMutex
+	depth int
+}
+
+// NewTopicStats returns a new instance of TopicStats which groups topics by their
+// first depth levels.
+func NewTopicStats(depth int) *TopicStats {
+	return &TopicStats{
+		internal: map[string]*TopicStat{},
+		depth:    depth,
+	}
+}
+
+// prefix returns the stats prefix of a topic or filter. Filter levels are only
+// considered up to the first wildcard.
+func (t *TopicStats) prefix(topic string) string {
+	levels := strings.Split(topic, "/")
+	n := 0
+	for n < len(levels) && n < t.depth {
+		if levels[n] == "+" || levels[n] == "#" {
+			break
+		}
+		n++
+	}
+
+	if n == 0 {
+		return rootTopicStatsPrefix
+	}
+
+	return strings.Join(levels[:n], "/")
+}
+
+// get returns the stats for a topic, creating them if the prefix is not yet tracked.
+func (t *TopicStats) get(topic string) *TopicStat {
+	if strings.HasPrefix(topic, SysPrefix) {
+		return nil
+	}
+
+	if strings.HasPrefix(strings.ToLower(topic), strings.ToLower(SharePrefix)) {
+		if parts := strings.SplitN(topic, "/", 3); len(parts) == 3 {
+			topic = parts[2]
+		}
+	}
+
+	p := t.prefix(topic)
+	t.RLock()
+	st, ok := t.internal[p]
+	t.RUnlock()
+	if ok {
+		return st
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	if st, ok = t.internal[p]; ok {
+		return st
+	}
+
+	if len(t.internal) >= maxTopicStatsPrefixes {
+		return nil
+	}
+
+	st = &TopicStat{Prefix: p}
+	t.internal[p] = st
+	return st
+}
+
+// Received records a message published to a topic.
+func (t *TopicStats) Received(topic string, size int) {
+	if t == nil {
+		return
+	}
+
+	if st := t.get(topic); st != nil {
+		atomic.AddInt64(&st.MessagesReceived, 1)
+		atomic.AddInt64(&st.BytesReceived, int64(size))
+	}
+}
+
+// Sent records a message delivered to a subscriber.
+func (t *TopicStats) Sent(topic string, size int) {
+	if t == nil {
+		return
+	}
+
+	if st := t.get(topic); st != nil {
+		atomic.AddInt64(&st.MessagesSent, 1)
+		atomic.AddInt64(&st.BytesSent, int64(size))
+	}
+}
+
+// Subscribed records a change in the number of subscriptions to a filter.
+func (t *TopicStats) Subscribed(filter string, delta int64) {
+	if t == nil {
+		return
+	}
+
+	if st := t.get(filter); st != nil {
+		atomic.AddInt64(&st.Subscriptions, delta)
+	}
+}
+
+// UpdateRates recalculates the message and byte rates of all prefixes, given the
+// number of seconds elapsed since the last update.
+func (t *TopicStats) UpdateRates(interval int64) {
+	if t == nil || interval <= 0 {
+		return
+	}
+
+	t.RLock()
+	defer t.RUnlock()
+	for _, st := range t.internal {
+		messages := atomic.LoadInt64(&st.MessagesReceived)
+		bytes := atomic.LoadInt64(&st.BytesReceived)
+		atomic.StoreInt64(&st.MessageRate, (messages-st.lastMessages)/interval)
+		atomic.StoreInt64(&st.ByteRate, (bytes-st.lastBytes)/interval)
+		st.lastMessages = messages
+		st.lastBytes = bytes
+	}
+}
+
+// GetAll returns a copy of the stats of all tracked prefixes, ordered by prefix.
+func (t *TopicStats) GetAll() []TopicStat {
+	if t == nil {
+		return []TopicStat{}
+	}
+
+	t.RLock()
+	v := make([]TopicStat, 0, len(t.internal))
+	for _, st := range t.internal {
+		v = append(v, TopicStat{
+			Prefix:           st.Prefix,
+			MessagesReceived: atomic.LoadInt64(&st.MessagesReceived),
+			MessagesSent:     atomic.LoadInt64(&st.MessagesSent),
+			BytesReceived:    atomic.LoadInt64(&st.BytesReceived),
+			BytesSent:        atomic.LoadInt64(&st.BytesSent),
+			Subscriptions:    atomic.LoadInt64(&st.Subscriptions),
+			MessageRate:      atomic.LoadInt64(&st.MessageRate),
+			ByteRate:         atomic.LoadInt64(&st.ByteRate),
+		})
+	}
+	t.RUnlock()
+
+	sort.Slice(v, func(i, j int) bool { return v[i].Prefix < v[j].Prefix })
+	return v
+}
+
+// Get returns a copy of the stats of a single prefix.
+func (t *TopicStats) Get(prefix string) (TopicStat, bool) {
+	for _, st := range t.GetAll() {
+		if st.Prefix == prefix {
+			return st, true
+		}
+	}
+
+	return TopicStat{}, false
+}
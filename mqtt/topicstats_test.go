@@ -0,0 +1,121 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+func TestTopicStatsPrefix(t *testing.T) {
+	ts := NewTopicStats(2)
+	require.Equal(t, "a/b", ts.prefix("a/b/c/d"))
+	require.Equal(t, "a", ts.prefix("a"))
+	require.Equal(t, "a", ts.prefix("a/+/c"))
+	require.Equal(t, "a/b", ts.prefix("a/b/#"))
+	require.Equal(t, rootTopicStatsPrefix, ts.prefix("#"))
+	require.Equal(t, rootTopicStatsPrefix, ts.prefix("+/b"))
+}
+
+func TestTopicStatsReceivedSent(t *testing.T) {
+	ts := NewTopicStats(1)
+	ts.Received("a/b/c", 5)
+	ts.Received("a/d", 3)
+	ts.Sent("a/b", 5)
+	ts.Received("x/y", 1)
+
+	st, ok := ts.Get("a")
+	require.True(t, ok)
+	require.Equal(t, int64(2), st.MessagesReceived)
+	require.Equal(t, int64(8), st.BytesReceived)
+	require.Equal(t, int64(1), st.MessagesSent)
+	require.Equal(t, int64(5), st.BytesSent)
+
+	all := ts.GetAll()
+	require.Len(t, all, 2)
+	require.Equal(t, "a", all[0].Prefix)
+	require.Equal(t, "x", all[1].Prefix)
+}
+
+func TestTopicStatsIgnoresSys(t *testing.T) {
+	ts := NewTopicStats(1)
+	ts.Received(SysPrefix+"/broker/uptime", 5)
+	require.Empty(t, ts.GetAll())
+}
+
+func TestTopicStatsSharedFilter(t *testing.T) {
+	ts := NewTopicStats(2)
+	ts.Subscribed(SharePrefix+"/grp/a/b/c", 1)
+	ts.Subscribed("a/b/#", 1)
+	ts.Subscribed("a/b/c", -1)
+
+	st, ok := ts.Get("a/b")
+	require.True(t, ok)
+	require.Equal(t, int64(1), st.Subscriptions)
+}
+
+func TestTopicStatsUpdateRates(t *testing.T) {
+	ts := NewTopicStats(1)
+	ts.Received("a/b", 10)
+	ts.Received("a/c", 10)
+	ts.UpdateRates(2)
+
+	st, _ := ts.Get("a")
+	require.Equal(t, int64(1), st.MessageRate)
+	require.Equal(t, int64(10), st.ByteRate)
+
+	ts.UpdateRates(1)
+	st, _ = ts.Get("a")
+	require.Equal(t, int64(0), st.MessageRate)
+	require.Equal(t, int64(0), st.ByteRate)
+}
+
+func TestTopicStatsNil(t *testing.T) {
+	var ts *TopicStats
+	ts.Received("a/b", 1)
+	ts.Sent("a/b", 1)
+	ts.Subscribed("a/b", 1)
+	ts.UpdateRates(1)
+	require.Empty(t, ts.GetAll())
+}
+
+func TestServerTopicStats(t *testing.T) {
+	s := New(&Options{
+		Logger:          logger,
+		TopicStatsDepth: 1,
+	})
+	_ = s.AddHook(new(AllowHook), nil)
+	require.NotNil(t, s.TopicStats)
+
+	cl, r, w := newTestClient()
+	defer w.Close()
+	go func() {
+		_, _ = io.ReadAll(r)
+	}()
+	s.Clients.Add(cl)
+	err := s.processSubscribe(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Subscribe},
+		PacketID:    1,
+		Filters:     packets.Subscriptions{{Filter: "a/b/c"}},
+	})
+	require.NoError(t, err)
+
+	err = s.processPublish(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish},
+		TopicName:   "a/b/c",
+		Payload:     []byte("hello"),
+	})
+	require.NoError(t, err)
+
+	st, ok := s.TopicStats.Get("a")
+	require.True(t, ok)
+	require.Equal(t, int64(1), st.Subscriptions)
+	require.Equal(t, int64(1), st.MessagesReceived)
+	require.Equal(t, int64(5), st.BytesReceived)
+	require.Equal(t, int64(1), st.MessagesSent)
+}
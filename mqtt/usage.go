@@ -0,0 +1,297 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// TenantExtKey is the client Ext key which auth hooks can use to assign a client to a
+// tenant for usage metering. Clients without a tenant are metered under their listener id.
+const TenantExtKey = "tenant"
+
+const maxUsageKeys = 100000 // the maximum number of users or tenants metered
+
+// UsageStat contains the metered usage of a user or tenant.
+type UsageStat struct {
+	Name              string  `json:"name"`               // the username or tenant
+	MessagesReceived  int64   `json:"messages_received"`  // messages published by clients
+	MessagesSent      int64   `json:"messages_sent"`      // messages delivered to clients
+	BytesReceived     int64   `json:"bytes_received"`     // payload bytes published by clients
+	BytesSent         int64   `json:"bytes_sent"`         // payload bytes delivered to clients
+	Connections       int64   `json:"connections"`        // clients currently connected
+	ConnectionSeconds int64   `json:"connection_seconds"` // the seconds clients have been connected
+	ConnectionMinutes float64 `json:"connection_minutes"` // the minutes clients have been connected
+}
+
+// UsageReport contains the usage of each user and tenant over a reporting period.
+type UsageReport struct {
+	Start   int64       `json:"start"`   // the unix time the period started
+	End     int64       `json:"end"`     // the unix time the period ended
+	Users   []UsageStat `json:"users"`   // the usage of each user active in the period
+	Tenants []UsageStat `json:"tenants"` // the usage of each tenant active in the period
+}
+
+// usageCounter accumulates the usage of a user or tenant.
+type usageCounter struct {
+	name             string
+	messagesReceived int64
+	messagesSent     int64
+	bytesReceived    int64
+	bytesSent        int64
+	sync.Mutex             // guards the connection values
+	connections      int64 // clients currently connected
+	connectedSum     int64 // the sum of the connection times of connected clients
+	closedSeconds    int64 // the connected seconds of clients which have disconnected
+}
+
+// stat returns the usage of the counter at a point in time.
+func (c *usageCounter) stat(now int64) UsageStat {
+	c.Lock()
+	connections := c.connections
+	seconds := c.closedSeconds + c.connections*now - c.connectedSum
+	c.Unlock()
+
+	return UsageStat{
+		Name:              c.name,
+		MessagesReceived:  atomic.LoadInt64(&c.messagesReceived),
+		MessagesSent:      atomic.LoadInt64(&c.messagesSent),
+		BytesReceived:     atomic.LoadInt64(&c.bytesReceived),
+		BytesSent:         atomic.LoadInt64(&c.bytesSent),
+		Connections:       connections,
+		ConnectionSeconds: seconds,
+		ConnectionMinutes: float64(seconds) / 60,
+	}
+}
+
+// clientUsage holds the counters a connected client is metered against.
+type clientUsage struct {
+	user      *usageCounter
+	tenant    *usageCounter
+	connected int64 // the unix time the client connected
+}
+
+// Usage meters the messages, bytes and connection time of each user and tenant, so that
+// operators of a managed broker can bill for usage.
+type Usage struct {
+	users    map[string]*usageCounter
+	tenants  map[string]*usageCounter
+	reported map[string]UsageStat // the usage at the last report, keyed on kind and name
+	last     int64                // the unix time of the last report
+	sync.RWMutex
+}
+
+// NewUsage returns a new instance of Usage, with reporting periods starting at now.
+func NewUsage(now int64) *Usage {
+	return &Usage{
+		users:    map[string]*usageCounter{},
+		tenants:  map[string]*usageCounter{},
+		reported: map[string]UsageStat{},
+		last:     now,
+	}
+}
+
+// ClientTenant returns the tenant a client is metered under.
+func ClientTenant(cl *Client) string {
+	if v, ok := cl.Ext[TenantExtKey].(string); ok && v != "" {
+		return v
+	}
+
+	return cl.Net.Listener
+}
+
+// counter returns the counter of a name, creating it if it is not yet metered.
+func (u *Usage) counter(m map[string]*usageCounter, name string) *usageCounter {
+	u.RLock()
+	c, ok := m[name]
+	u.RUnlock()
+	if ok {
+		return c
+	}
+
+	u.Lock()
+	defer u.Unlock()
+	if c, ok = m[name]; ok {
+		return c
+	}
+
+	if len(m) >= maxUsageKeys {
+		return nil
+	}
+
+	c = &usageCounter{name: name}
+	m[name] = c
+	return c
+}
+
+// Connected starts metering a client. Inline clients are not metered.
+func (u *Usage) Connected(cl *Client, now int64) {
+	if u == nil || cl.Net.Inline {
+		return
+	}
+
+	cu := &clientUsage{
+		user:      u.counter(u.users, string(cl.Properties.Username)),
+		tenant:    u.counter(u.tenants, ClientTenant(cl)),
+		connected: now,
+	}
+
+	for _, c := range []*usageCounter{cu.user, cu.tenant} {
+		if c != nil {
+			c.Lock()
+			c.connections++
+			c.connectedSum += now
+			c.Unlock()
+		}
+	}
+
+	cl.State.usage.Store(cu)
+}
+
+// clientUsageOf returns the usage counters of a client, or nil if it is not metered.
+func clientUsageOf(cl *Client) *clientUsage {
+	cu, _ := cl.State.usage.Load().(*clientUsage)
+	return cu
+}
+
+// Disconnected stops metering a client, adding its connection time to its user and tenant.
+func (u *Usage) Disconnected(cl *Client, now int64) {
+	if u == nil {
+		return
+	}
+
+	cu := clientUsageOf(cl)
+	if cu == nil {
+		return
+	}
+
+	for _, c := range []*usageCounter{cu.user, cu.tenant} {
+		if c != nil {
+			c.Lock()
+			c.connections--
+			c.connectedSum -= cu.connected
+			c.closedSeconds += now - cu.connected
+			c.Unlock()
+		}
+	}
+
+	cl.State.usage.Store((*clientUsage)(nil))
+}
+
+// Received records a message published by a client.
+func (u *Usage) Received(cl *Client, topic string, size int) {
+	if u == nil || strings.HasPrefix(topic, SysPrefix) {
+		return
+	}
+
+	cu := clientUsageOf(cl)
+	if cu == nil {
+		return
+	}
+
+	for _, c := range []*usageCounter{cu.user, cu.tenant} {
+		if c != nil {
+			atomic.AddInt64(&c.messagesReceived, 1)
+			atomic.AddInt64(&c.bytesReceived, int64(size))
+		}
+	}
+}
+
+// Sent records a message delivered to a client.
+func (u *Usage) Sent(cl *Client, topic string, size int) {
+	if u == nil || strings.HasPrefix(topic, SysPrefix) {
+		return
+	}
+
+	cu := clientUsageOf(cl)
+	if cu == nil {
+		return
+	}
+
+	for _, c := range []*usageCounter{cu.user, cu.tenant} {
+		if c != nil {
+			atomic.AddInt64(&c.messagesSent, 1)
+			atomic.AddInt64(&c.bytesSent, int64(size))
+		}
+	}
+}
+
+// all returns the usage of all counters of a map, ordered by name.
+func (u *Usage) all(m map[string]*usageCounter, now int64) []UsageStat {
+	u.RLock()
+	v := make([]UsageStat, 0, len(m))
+	for _, c := range m {
+		v = append(v, c.stat(now))
+	}
+	u.RUnlock()
+
+	sort.Slice(v, func(i, j int) bool { return v[i].Name < v[j].Name })
+	return v
+}
+
+// Users returns the total usage of each user since the broker started.
+func (u *Usage) Users(now int64) []UsageStat {
+	if u == nil {
+		return []UsageStat{}
+	}
+
+	return u.all(u.users, now)
+}
+
+// Tenants returns the total usage of each tenant since the broker started.
+func (u *Usage) Tenants(now int64) []UsageStat {
+	if u == nil {
+		return []UsageStat{}
+	}
+
+	return u.all(u.tenants, now)
+}
+
+// Report returns the usage of each user and tenant since the last report. Users and
+// tenants without any usage in the period are omitted.
+func (u *Usage) Report(now int64) UsageReport {
+	u.Lock()
+	r := UsageReport{Start: u.last, End: now}
+	u.last = now
+	u.Unlock()
+
+	r.Users = u.delta("u:", u.Users(now))
+	r.Tenants = u.delta("t:", u.Tenants(now))
+	return r
+}
+
+// delta returns the usage accrued since the last report, recording the current totals.
+func (u *Usage) delta(kind string, totals []UsageStat) []UsageStat {
+	u.Lock()
+	defer u.Unlock()
+
+	v := make([]UsageStat, 0, len(totals))
+	for _, st := range totals {
+		prev := u.reported[kind+st.Name]
+		u.reported[kind+st.Name] = st
+
+		d := UsageStat{
+			Name:              st.Name,
+			MessagesReceived:  st.MessagesReceived - prev.MessagesReceived,
+			MessagesSent:      st.MessagesSent - prev.MessagesSent,
+			BytesReceived:     st.BytesReceived - prev.BytesReceived,
+			BytesSent:         st.BytesSent - prev.BytesSent,
+			Connections:       st.Connections,
+			ConnectionSeconds: st.ConnectionSeconds - prev.ConnectionSeconds,
+		}
+		d.ConnectionMinutes = float64(d.ConnectionSeconds) / 60
+
+		if d.MessagesReceived == 0 && d.MessagesSent == 0 && d.ConnectionSeconds == 0 && d.Connections == 0 {
+			continue
+		}
+
+		v = append(v, d)
+	}
+
+	return v
+}
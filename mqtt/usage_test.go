@@ -0,0 +1,150 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+func newUsageClient(username, listener string) *Client {
+	cl, _, _ := newTestClient()
+	cl.Properties.Username = []byte(username)
+	cl.Net.Listener = listener
+	return cl
+}
+
+func TestClientTenant(t *testing.T) {
+	cl := newUsageClient("alice", "t1")
+	require.Equal(t, "t1", ClientTenant(cl))
+
+	cl.Ext[TenantExtKey] = "acme"
+	require.Equal(t, "acme", ClientTenant(cl))
+}
+
+func TestUsageMetering(t *testing.T) {
+	u := NewUsage(100)
+	cl := newUsageClient("alice", "t1")
+	cl2 := newUsageClient("bob", "t1")
+
+	u.Connected(cl, 100)
+	u.Connected(cl2, 130)
+	u.Received(cl, "a/b", 10)
+	u.Received(cl, SysPrefix+"/broker", 10)
+	u.Sent(cl2, "a/b", 10)
+
+	users := u.Users(160)
+	require.Len(t, users, 2)
+	require.Equal(t, UsageStat{
+		Name:              "alice",
+		MessagesReceived:  1,
+		BytesReceived:     10,
+		Connections:       1,
+		ConnectionSeconds: 60,
+		ConnectionMinutes: 1,
+	}, users[0])
+	require.Equal(t, int64(1), users[1].MessagesSent)
+
+	tenants := u.Tenants(160)
+	require.Len(t, tenants, 1)
+	require.Equal(t, "t1", tenants[0].Name)
+	require.Equal(t, int64(2), tenants[0].Connections)
+	require.Equal(t, int64(90), tenants[0].ConnectionSeconds)
+
+	u.Disconnected(cl, 190)
+	u.Received(cl, "a/b", 10)
+	users = u.Users(1000)
+	require.Equal(t, int64(0), users[0].Connections)
+	require.Equal(t, int64(90), users[0].ConnectionSeconds)
+	require.Equal(t, int64(1), users[0].MessagesReceived)
+}
+
+func TestUsageInlineNotMetered(t *testing.T) {
+	u := NewUsage(0)
+	cl := newUsageClient("", LocalListener)
+	cl.Net.Inline = true
+
+	u.Connected(cl, 0)
+	u.Received(cl, "a/b", 10)
+	require.Empty(t, u.Users(10))
+}
+
+func TestUsageNil(t *testing.T) {
+	var u *Usage
+	cl := newUsageClient("alice", "t1")
+	u.Connected(cl, 0)
+	u.Received(cl, "a/b", 1)
+	u.Sent(cl, "a/b", 1)
+	u.Disconnected(cl, 0)
+	require.Empty(t, u.Users(0))
+	require.Empty(t, u.Tenants(0))
+}
+
+func TestUsageReport(t *testing.T) {
+	u := NewUsage(100)
+	cl := newUsageClient("alice", "t1")
+	u.Connected(cl, 100)
+	u.Received(cl, "a/b", 10)
+
+	r := u.Report(160)
+	require.Equal(t, int64(100), r.Start)
+	require.Equal(t, int64(160), r.End)
+	require.Len(t, r.Users, 1)
+	require.Equal(t, int64(1), r.Users[0].MessagesReceived)
+	require.Equal(t, int64(60), r.Users[0].ConnectionSeconds)
+	require.Len(t, r.Tenants, 1)
+
+	u.Disconnected(cl, 190)
+	r = u.Report(220)
+	require.Equal(t, int64(160), r.Start)
+	require.Len(t, r.Users, 1)
+	require.Equal(t, int64(0), r.Users[0].MessagesReceived)
+	require.Equal(t, int64(30), r.Users[0].ConnectionSeconds)
+	require.Equal(t, 0.5, r.Users[0].ConnectionMinutes)
+
+	r = u.Report(280)
+	require.Empty(t, r.Users)
+	require.Empty(t, r.Tenants)
+}
+
+type usageReportHook struct {
+	HookBase
+	reports []UsageReport
+}
+
+func (h *usageReportHook) ID() string {
+	return "usage-report"
+}
+
+func (h *usageReportHook) Provides(b byte) bool {
+	return b == OnUsageReport
+}
+
+func (h *usageReportHook) OnUsageReport(report UsageReport) {
+	h.reports = append(h.reports, report)
+}
+
+func TestServerUsageReport(t *testing.T) {
+	s := New(&Options{Logger: logger, UsageStats: true})
+	_ = s.AddHook(new(AllowHook), nil)
+	h := new(usageReportHook)
+	_ = s.AddHook(h, nil)
+
+	cl, _, _ := newTestClient()
+	cl.Properties.Username = []byte("alice")
+	s.Usage.Connected(cl, 0)
+
+	pk := *packets.TPacketData[packets.Publish].Get(packets.TPublishBasic).Packet
+	require.NoError(t, s.processPublish(cl, pk))
+
+	s.reportUsage(10)
+	require.Len(t, h.reports, 1)
+	require.Len(t, h.reports[0].Users, 1)
+	require.Equal(t, "alice", h.reports[0].Users[0].Name)
+	require.Equal(t, int64(1), h.reports[0].Users[0].MessagesReceived)
+	require.Equal(t, int64(len(pk.Payload)), h.reports[0].Users[0].BytesReceived)
+}
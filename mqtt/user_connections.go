@@ -0,0 +1,117 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+// MaxConnectionsExtKey is the client Ext key which auth hooks can use to set the maximum
+// concurrent connections of the username of a client, overriding the
+// MaximumUserConnections option. The value is an int, and a negative value is unlimited.
+const MaxConnectionsExtKey = "max-connections"
+
+// UserConnections counts the clients connected with each username, to limit the
+// concurrent connections of a username.
+type UserConnections struct {
+	sync.Mutex
+	counts map[string]int
+}
+
+// NewUserConnections returns a new instance of UserConnections.
+func NewUserConnections() *UserConnections {
+	return &UserConnections{
+		counts: make(map[string]int),
+	}
+}
+
+// Acquire counts a client connected with a username, returning false without counting it
+// if the username already has maximum connected clients. A client taking over the session
+// of a connected client with the same username is not limited by that client, which is
+// about to be disconnected. The maximum is unlimited when 0 or less.
+func (u *UserConnections) Acquire(username string, maximum int, takeover bool) bool {
+	u.Lock()
+	defer u.Unlock()
+
+	n := u.counts[username]
+	if takeover {
+		n--
+	}
+
+	if maximum > 0 && n >= maximum {
+		return false
+	}
+
+	u.counts[username]++
+	return true
+}
+
+// Release removes a client connected with a username from the count.
+func (u *UserConnections) Release(username string) {
+	u.Lock()
+	defer u.Unlock()
+
+	if u.counts[username] <= 1 {
+		delete(u.counts, username)
+		return
+	}
+
+	u.counts[username]--
+}
+
+// Count returns the number of clients connected with a username.
+func (u *UserConnections) Count(username string) int {
+	u.Lock()
+	defer u.Unlock()
+	return u.counts[username]
+}
+
+// maxUserConnections returns the maximum concurrent connections of the username of a
+// client, set by an auth hook or otherwise the MaximumUserConnections option.
+func (s *Server) maxUserConnections(cl *Client) int {
+	if v, ok := cl.Ext[MaxConnectionsExtKey].(int); ok && v != 0 {
+		return v
+	}
+
+	return int(s.Options.MaximumUserConnections)
+}
+
+// limitUserConnections counts a client connected with a username, rejecting it with a
+// quota exceeded connack if its username already has the maximum connected clients.
+// Clients without a username are not limited.
+func (s *Server) limitUserConnections(cl *Client) error {
+	username := string(cl.Properties.Username)
+	if s.UserConns == nil || username == "" {
+		return nil
+	}
+
+	takeover := false
+	if existing, ok := s.Clients.Get(cl.ID); ok && !existing.Closed() &&
+		string(existing.Properties.Username) == username {
+		takeover = true
+	}
+
+	maximum := s.maxUserConnections(cl)
+	if s.UserConns.Acquire(username, maximum, takeover) {
+		return nil
+	}
+
+	if err := s.SendConnack(cl, packets.ErrQuotaExceeded, false, nil); err != nil {
+		return fmt.Errorf("user connections exceeded send ack: %w", err)
+	}
+
+	s.Log.Debug("user connections exceeded", "client", cl.ID, "username", username, "remote", cl.Net.Remote, "maximum", maximum)
+	return packets.ErrQuotaExceeded
+}
+
+// releaseUserConnection removes a client counted by limitUserConnections when it disconnects.
+func (s *Server) releaseUserConnection(cl *Client) {
+	if username := string(cl.Properties.Username); s.UserConns != nil && username != "" {
+		s.UserConns.Release(username)
+	}
+}
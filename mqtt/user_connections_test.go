@@ -0,0 +1,129 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+// userPassConnect returns the raw connect packet of the mochi username.
+func userPassConnect(t *testing.T) []byte {
+	pk := *packets.TPacketData[packets.Connect].Get(packets.TConnectUserPass).Packet
+	buf := new(bytes.Buffer)
+	require.NoError(t, pk.ConnectEncode(buf))
+	return buf.Bytes()
+}
+
+func TestUserConnections(t *testing.T) {
+	u := NewUserConnections()
+	require.True(t, u.Acquire("alice", 2, false))
+	require.True(t, u.Acquire("alice", 2, false))
+	require.False(t, u.Acquire("alice", 2, false))
+	require.Equal(t, 2, u.Count("alice"))
+
+	// a client taking over a session of the username replaces a connected client
+	require.True(t, u.Acquire("alice", 2, true))
+	require.Equal(t, 3, u.Count("alice"))
+
+	for i := 0; i < 3; i++ {
+		u.Release("alice")
+	}
+	require.Equal(t, 0, u.Count("alice"))
+	require.Empty(t, u.counts)
+
+	require.True(t, u.Acquire("bob", 0, false))
+	require.True(t, u.Acquire("bob", -1, false))
+	require.Equal(t, 2, u.Count("bob"))
+}
+
+func TestMaxUserConnections(t *testing.T) {
+	s := New(&Options{
+		Logger:                 logger,
+		MaximumUserConnections: 5,
+	})
+	defer s.Close()
+
+	cl := new(Client)
+	require.Equal(t, 5, s.maxUserConnections(cl))
+
+	cl.Ext = map[string]any{MaxConnectionsExtKey: 2}
+	require.Equal(t, 2, s.maxUserConnections(cl))
+
+	cl.Ext[MaxConnectionsExtKey] = -1
+	require.Equal(t, -1, s.maxUserConnections(cl))
+}
+
+func TestEstablishConnectionUserConnectionsExceeded(t *testing.T) {
+	s := New(&Options{
+		Logger:                 logger,
+		MaximumUserConnections: 1,
+	})
+	_ = s.AddHook(new(AllowHook), nil)
+	defer s.Close()
+	require.True(t, s.UserConns.Acquire("mochi", 1, false))
+
+	connect := userPassConnect(t)
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r)
+	}()
+
+	go func() {
+		_, _ = w.Write(connect)
+	}()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := io.ReadAll(w)
+		require.NoError(t, err)
+		recv <- buf
+	}()
+
+	err := <-o
+	require.ErrorIs(t, err, packets.ErrQuotaExceeded)
+	require.Equal(t, []byte{packets.Connack << 4, 2, 0, packets.Err3NotAuthorized.Code}, <-recv)
+	require.Equal(t, 1, s.UserConns.Count("mochi"))
+
+	_ = w.Close()
+	_ = r.Close()
+}
+
+func TestEstablishConnectionUserConnectionsReleased(t *testing.T) {
+	s := New(&Options{
+		Logger:                 logger,
+		MaximumUserConnections: 1,
+	})
+	_ = s.AddHook(new(AllowHook), nil)
+	defer s.Close()
+
+	connect := userPassConnect(t)
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r)
+	}()
+
+	go func() {
+		_, _ = w.Write(connect)
+		_, _ = w.Write(packets.TPacketData[packets.Disconnect].Get(packets.TDisconnect).RawBytes)
+	}()
+
+	go func() {
+		_, _ = io.ReadAll(w)
+	}()
+
+	require.NoError(t, <-o)
+	require.Equal(t, 0, s.UserConns.Count("mochi"))
+
+	_ = w.Close()
+	_ = r.Close()
+}
@@ -0,0 +1,555 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+const (
+	defaultWALPath        = "inflight.wal"
+	defaultWALCompactSize = 64 << 20 // bytes
+
+	walHeaderSize    = 8         // the length and crc32 of a record
+	walMaxRecordSize = 512 << 20 // larger lengths can only be from a corrupt record
+
+	walPublish byte = 's' // an inflight message was set or resent
+	walRemove  byte = 'd' // an inflight message was completed or dropped
+	walExpire  byte = 'x' // all the inflight messages of a session were discarded
+)
+
+var (
+	ErrWALClosed = errors.New("write-ahead log is closed")
+)
+
+// WALOptions configures a write-ahead log of the inflight messages, which is appended to
+// before the storage hooks are called, so that the messages being delivered are not lost if
+// the broker crashes before a buffered storage hook writes them.
+type WALOptions struct {
+	Path        string `yaml:"path" json:"path"`                 // the file of the log, default inflight.wal
+	NoSync      bool   `yaml:"no-sync" json:"no_sync"`           // don't fsync each record, so only process crashes are survived
+	CompactSize int64  `yaml:"compact-size" json:"compact_size"` // the bytes after which the log is rewritten with only its live messages, default 64MiB
+}
+
+// WALStatus contains the size and activity of the write-ahead log.
+type WALStatus struct {
+	Path        string `json:"path"`
+	Size        int64  `json:"size"`        // the bytes of the log
+	Inflight    int    `json:"inflight"`    // the live inflight messages in the log
+	Appends     int64  `json:"appends"`     // the records appended since the broker started
+	Errors      int64  `json:"errors"`      // the records which failed to be appended
+	Compactions int64  `json:"compactions"` // the times the log has been rewritten
+	Replayed    int    `json:"replayed"`    // the inflight messages restored from the log on startup
+}
+
+// walRecord is a record of the log.
+type walRecord struct {
+	op      byte
+	message storage.Message
+}
+
+// walReplay is the state of the inflight messages found in the log on startup.
+type walReplay struct {
+	live    []storage.Message // the inflight messages which were still live
+	removed []storage.Message // the client and packet id of inflight messages last completed or dropped
+	torn    int64             // the bytes of a partly written last record which were truncated
+}
+
+// WAL is an append only log of the inflight messages of each client. Each record is the
+// length and crc32 of a record body, so that a record torn by a crash is detected and
+// discarded on startup. The offsets of the live records are kept so that the log can be
+// rewritten with only them once it grows beyond the compact size.
+type WAL struct {
+	sync.Mutex
+	opts        WALOptions
+	log         *slog.Logger
+	file        *os.File
+	size        int64                       // the bytes of the log
+	live        map[string]map[uint16]int64 // the offset of the last record of each live inflight message, by client and packet id
+	liveBytes   int64                       // the bytes of the live records
+	lengths     map[int64]int64             // the length of each live record, by offset
+	appends     atomic.Int64                // the records appended
+	failures    atomic.Int64                // the records which failed to be appended
+	compactions atomic.Int64                // the times the log has been rewritten
+	replayed    int                         // the inflight messages restored on startup
+	closed      bool
+}
+
+// openWAL opens or creates the log, returning the inflight messages found in it. A torn
+// record at the end of the log is truncated.
+func openWAL(opts WALOptions, log *slog.Logger) (*WAL, walReplay, error) {
+	if opts.Path == "" {
+		opts.Path = defaultWALPath
+	}
+	if opts.CompactSize <= 0 {
+		opts.CompactSize = defaultWALCompactSize
+	}
+
+	f, err := os.OpenFile(opts.Path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, walReplay{}, fmt.Errorf("open write-ahead log: %w", err)
+	}
+
+	w := &WAL{
+		opts:    opts,
+		log:     log,
+		file:    f,
+		live:    map[string]map[uint16]int64{},
+		lengths: map[int64]int64{},
+	}
+
+	rp, err := w.read()
+	if err != nil {
+		_ = f.Close()
+		return nil, walReplay{}, err
+	}
+
+	return w, rp, nil
+}
+
+// read reads the records of the log, keeping the offsets of the live ones, and truncates
+// any torn record at the end of the log.
+func (w *WAL) read() (walReplay, error) {
+	var rp walReplay
+	messages := map[string]map[uint16]storage.Message{}
+	removed := map[string]map[uint16]bool{}
+
+	r := bufio.NewReader(w.file)
+	var offset int64
+	for {
+		rec, n, err := readWALRecord(r)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			info, serr := w.file.Stat()
+			if serr != nil {
+				return rp, fmt.Errorf("read write-ahead log: %w", serr)
+			}
+			rp.torn = info.Size() - offset
+			w.log.Warn("truncating torn write-ahead log record", "offset", offset, "bytes", rp.torn, "error", err)
+			if err := w.file.Truncate(offset); err != nil {
+				return rp, fmt.Errorf("truncate write-ahead log: %w", err)
+			}
+			break
+		}
+
+		cid, id := rec.message.Client, rec.message.PacketID
+		switch rec.op {
+		case walPublish:
+			if messages[cid] == nil {
+				messages[cid] = map[uint16]storage.Message{}
+			}
+			messages[cid][id] = rec.message
+			delete(removed[cid], id)
+			w.track(cid, id, offset, n)
+		case walRemove:
+			delete(messages[cid], id)
+			if removed[cid] == nil {
+				removed[cid] = map[uint16]bool{}
+			}
+			removed[cid][id] = true
+			w.untrack(cid, id)
+		case walExpire:
+			for id := range messages[cid] {
+				if removed[cid] == nil {
+					removed[cid] = map[uint16]bool{}
+				}
+				removed[cid][id] = true
+			}
+			delete(messages, cid)
+			w.untrackClient(cid)
+		}
+		offset += n
+	}
+
+	w.size = offset
+	if _, err := w.file.Seek(offset, io.SeekStart); err != nil {
+		return rp, fmt.Errorf("seek write-ahead log: %w", err)
+	}
+
+	for _, ids := range messages {
+		for _, msg := range ids {
+			rp.live = append(rp.live, msg)
+		}
+	}
+
+	for cid, ids := range removed {
+		for id := range ids {
+			rp.removed = append(rp.removed, storage.Message{Client: cid, PacketID: id})
+		}
+	}
+
+	return rp, nil
+}
+
+// readWALRecord reads a record and returns its length in the log.
+func readWALRecord(r io.Reader) (walRecord, int64, error) {
+	var rec walRecord
+	var header [walHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return rec, 0, err // io.EOF after the last whole record
+	}
+
+	size := binary.BigEndian.Uint32(header[:4])
+	if size == 0 || size > walMaxRecordSize {
+		return rec, 0, fmt.Errorf("invalid record length %d", size)
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return rec, 0, io.ErrUnexpectedEOF
+	}
+
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:]) {
+		return rec, 0, errors.New("record checksum mismatch")
+	}
+
+	rec.op = body[0]
+	if err := json.Unmarshal(body[1:], &rec.message); err != nil {
+		return rec, 0, fmt.Errorf("decode record: %w", err)
+	}
+
+	return rec, int64(walHeaderSize + size), nil
+}
+
+// encodeWALRecord returns a record as it is written to the log.
+func encodeWALRecord(op byte, msg storage.Message) ([]byte, error) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, walHeaderSize+1+len(body))
+	b[walHeaderSize] = op
+	copy(b[walHeaderSize+1:], body)
+	binary.BigEndian.PutUint32(b[:4], uint32(1+len(body)))
+	binary.BigEndian.PutUint32(b[4:8], crc32.ChecksumIEEE(b[walHeaderSize:]))
+	return b, nil
+}
+
+// track records the offset and length of the last record of a live inflight message.
+func (w *WAL) track(cid string, id uint16, offset, n int64) {
+	w.untrack(cid, id)
+	if w.live[cid] == nil {
+		w.live[cid] = map[uint16]int64{}
+	}
+	w.live[cid][id] = offset
+	w.lengths[offset] = n
+	w.liveBytes += n
+}
+
+// untrack stops tracking an inflight message which is no longer live.
+func (w *WAL) untrack(cid string, id uint16) {
+	offset, ok := w.live[cid][id]
+	if !ok {
+		return
+	}
+
+	w.liveBytes -= w.lengths[offset]
+	delete(w.lengths, offset)
+	delete(w.live[cid], id)
+	if len(w.live[cid]) == 0 {
+		delete(w.live, cid)
+	}
+}
+
+// untrackClient stops tracking all the inflight messages of a client.
+func (w *WAL) untrackClient(cid string) {
+	for id := range w.live[cid] {
+		w.untrack(cid, id)
+	}
+}
+
+// append writes a record to the log, syncing it unless disabled, with the lock held.
+func (w *WAL) append(op byte, msg storage.Message) (int64, int64, error) {
+	if w.closed {
+		return 0, 0, ErrWALClosed
+	}
+
+	b, err := encodeWALRecord(op, msg)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	offset := w.size
+	if _, err := w.file.Write(b); err != nil {
+		return 0, 0, err
+	}
+	w.size += int64(len(b))
+
+	if !w.opts.NoSync {
+		if err := w.file.Sync(); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	w.appends.Add(1)
+	return offset, int64(len(b)), nil
+}
+
+// publish records that an inflight message of a client was set or resent.
+func (w *WAL) publish(cl *Client, pk packets.Packet, sent int64) {
+	if w == nil {
+		return
+	}
+
+	msg := inflightMessage(cl, pk)
+	msg.Sent = sent
+
+	w.Lock()
+	defer w.Unlock()
+	offset, n, err := w.append(walPublish, msg)
+	if err != nil {
+		w.failed("append inflight message", err, "client", cl.ID, "packet_id", pk.PacketID)
+		return
+	}
+
+	w.track(cl.ID, pk.PacketID, offset, n)
+	w.maybeCompact()
+}
+
+// remove records that an inflight message of a client was completed or dropped.
+func (w *WAL) remove(cid string, id uint16) {
+	if w == nil {
+		return
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	if _, ok := w.live[cid][id]; !ok {
+		return // never logged, such as when the log was enabled after it was sent
+	}
+
+	if _, _, err := w.append(walRemove, storage.Message{Client: cid, PacketID: id}); err != nil {
+		w.failed("append completed inflight message", err, "client", cid, "packet_id", id)
+		return
+	}
+
+	w.untrack(cid, id)
+	w.maybeCompact()
+}
+
+// expire records that all the inflight messages of a client were discarded with its session.
+func (w *WAL) expire(cid string) {
+	if w == nil {
+		return
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	if len(w.live[cid]) == 0 {
+		return
+	}
+
+	if _, _, err := w.append(walExpire, storage.Message{Client: cid}); err != nil {
+		w.failed("append expired session", err, "client", cid)
+		return
+	}
+
+	w.untrackClient(cid)
+	w.maybeCompact()
+}
+
+// failed counts and logs a record which failed to be appended.
+func (w *WAL) failed(msg string, err error, args ...any) {
+	w.failures.Add(1)
+	if !errors.Is(err, ErrWALClosed) {
+		w.log.Error("failed to "+msg+" to write-ahead log", append(args, "error", err)...)
+	}
+}
+
+// maybeCompact rewrites the log once it exceeds the compact size and is mostly records
+// which are no longer live, with the lock held.
+func (w *WAL) maybeCompact() {
+	if w.size < w.opts.CompactSize || w.size < 2*w.liveBytes {
+		return
+	}
+
+	if err := w.compact(); err != nil {
+		w.log.Error("failed to compact write-ahead log", "error", err)
+	}
+}
+
+// compact rewrites the log with only its live records, replacing it atomically, with the
+// lock held.
+func (w *WAL) compact() error {
+	tmp := w.opts.Path + ".compact"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	live := make(map[string]map[uint16]int64, len(w.live))
+	lengths := make(map[int64]int64, len(w.lengths))
+	bw := bufio.NewWriter(f)
+	var offset int64
+	for cid, ids := range w.live {
+		live[cid] = make(map[uint16]int64, len(ids))
+		for id, at := range ids {
+			n := w.lengths[at]
+			b := make([]byte, n)
+			if _, err := w.file.ReadAt(b, at); err != nil {
+				_ = f.Close()
+				_ = os.Remove(tmp)
+				return err
+			}
+			if _, err := bw.Write(b); err != nil {
+				_ = f.Close()
+				_ = os.Remove(tmp)
+				return err
+			}
+			live[cid][id] = offset
+			lengths[offset] = n
+			offset += n
+		}
+	}
+
+	err = bw.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, w.opts.Path)
+	}
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	_ = w.file.Close()
+	w.file = f
+	w.size = offset
+	w.live = live
+	w.lengths = lengths
+	w.compactions.Add(1)
+	if _, err := w.file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Close syncs and closes the log.
+func (w *WAL) Close() error {
+	if w == nil {
+		return nil
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	if w.closed {
+		return nil
+	}
+
+	w.closed = true
+	_ = w.file.Sync()
+	return w.file.Close()
+}
+
+// Status returns the size and activity of the log.
+func (w *WAL) Status() WALStatus {
+	w.Lock()
+	defer w.Unlock()
+
+	st := WALStatus{
+		Path:        w.opts.Path,
+		Size:        w.size,
+		Appends:     w.appends.Load(),
+		Errors:      w.failures.Load(),
+		Compactions: w.compactions.Load(),
+		Replayed:    w.replayed,
+	}
+
+	for _, ids := range w.live {
+		st.Inflight += len(ids)
+	}
+
+	return st
+}
+
+// setupWAL opens the write-ahead log of the inflight messages, if enabled, and replays it
+// over the sessions restored from the storage hooks, before any client connects. Messages
+// which were still live are restored and written to the storage hooks again, and stored
+// messages which were last completed or dropped are removed.
+func (s *Server) setupWAL() error {
+	if s.Options.WAL == nil {
+		return nil
+	}
+
+	w, rp, err := openWAL(*s.Options.WAL, s.Log.With("wal", s.Options.WAL.Path))
+	if err != nil {
+		return err
+	}
+
+	var removed int
+	for _, msg := range rp.removed {
+		cl, ok := s.Clients.Get(msg.Client)
+		if !ok {
+			continue
+		}
+
+		if pk, ok := cl.State.Inflight.Get(msg.PacketID); ok && cl.State.Inflight.Delete(msg.PacketID) {
+			atomic.AddInt64(&s.Info.Inflight, -1)
+			s.hooks.OnQosComplete(cl, pk)
+			removed++
+		}
+	}
+
+	var skipped int
+	w.Lock()
+	for _, msg := range rp.live {
+		cl, ok := s.Clients.Get(msg.Client)
+		if !ok {
+			w.untrack(msg.Client, msg.PacketID) // the session is unknown, so the message can't be delivered
+			skipped++
+			continue
+		}
+
+		pk := msg.ToPacket()
+		if cl.State.Inflight.Set(pk) {
+			atomic.AddInt64(&s.Info.Inflight, 1)
+		}
+		s.hooks.OnQosPublish(cl, pk, msg.Sent, 0)
+		w.replayed++
+	}
+
+	err = w.compact()
+	w.Unlock()
+	if err != nil {
+		_ = w.Close()
+		return fmt.Errorf("compact write-ahead log: %w", err)
+	}
+
+	s.hooks.wal = w
+	s.Log.Info("replayed write-ahead log", "path", w.opts.Path, "restored", w.replayed,
+		"removed", removed, "skipped", skipped, "torn_bytes", rp.torn)
+
+	return nil
+}
+
+// WALStatus returns the status of the write-ahead log of the inflight messages, and false
+// if it is not enabled.
+func (s *Server) WALStatus() (WALStatus, bool) {
+	if s.hooks.wal == nil {
+		return WALStatus{}, false
+	}
+
+	return s.hooks.wal.Status(), true
+}
@@ -0,0 +1,209 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package mqtt
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+func walPacket(id uint16) packets.Packet {
+	return packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   "a/b",
+		PacketID:    id,
+		Payload:     []byte("x"),
+		Created:     1,
+	}
+}
+
+func openTestWAL(t *testing.T, opts WALOptions) (*WAL, walReplay) {
+	w, rp, err := openWAL(opts, logger)
+	require.NoError(t, err)
+	return w, rp
+}
+
+func walIDs(v []storage.Message, cid string) []uint16 {
+	ids := []uint16{}
+	for _, msg := range v {
+		if msg.Client == cid {
+			ids = append(ids, msg.PacketID)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func TestWALReplay(t *testing.T) {
+	opts := WALOptions{Path: filepath.Join(t.TempDir(), "inflight.wal")}
+	w, rp := openTestWAL(t, opts)
+	require.Empty(t, rp.live)
+
+	a := &Client{ID: "a"}
+	b := &Client{ID: "b"}
+	for id := uint16(1); id <= 3; id++ {
+		w.publish(a, walPacket(id), 10)
+	}
+	w.publish(b, walPacket(1), 10)
+	w.remove("a", 2)
+	w.remove("a", 9) // never logged
+	w.expire("b")
+
+	st := w.Status()
+	require.Equal(t, 2, st.Inflight)
+	require.Equal(t, int64(6), st.Appends)
+	require.NoError(t, w.Close())
+	require.NoError(t, w.Close())
+
+	w, rp = openTestWAL(t, opts)
+	defer w.Close()
+	require.Equal(t, []uint16{1, 3}, walIDs(rp.live, "a"))
+	require.Equal(t, []uint16{2}, walIDs(rp.removed, "a"))
+	require.Equal(t, []uint16{1}, walIDs(rp.removed, "b"))
+	require.Equal(t, int64(0), rp.torn)
+
+	for _, msg := range rp.live {
+		require.Equal(t, []byte("x"), msg.Payload)
+		require.Equal(t, int64(10), msg.Sent)
+	}
+}
+
+func TestWALTornRecord(t *testing.T) {
+	opts := WALOptions{Path: filepath.Join(t.TempDir(), "inflight.wal")}
+	w, _ := openTestWAL(t, opts)
+	w.publish(&Client{ID: "a"}, walPacket(1), 0)
+	w.publish(&Client{ID: "a"}, walPacket(2), 0)
+	require.NoError(t, w.Close())
+
+	// a crash part way through writing the last record
+	info, err := os.Stat(opts.Path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(opts.Path, info.Size()-3))
+
+	w, rp := openTestWAL(t, opts)
+	require.Equal(t, []uint16{1}, walIDs(rp.live, "a"))
+	require.Positive(t, rp.torn)
+
+	w.publish(&Client{ID: "a"}, walPacket(3), 0)
+	require.NoError(t, w.Close())
+
+	w, rp = openTestWAL(t, opts)
+	defer w.Close()
+	require.Equal(t, []uint16{1, 3}, walIDs(rp.live, "a"))
+	require.Equal(t, int64(0), rp.torn)
+}
+
+func TestWALCorruptRecord(t *testing.T) {
+	opts := WALOptions{Path: filepath.Join(t.TempDir(), "inflight.wal")}
+	w, _ := openTestWAL(t, opts)
+	w.publish(&Client{ID: "a"}, walPacket(1), 0)
+	size := w.Status().Size
+	w.publish(&Client{ID: "a"}, walPacket(2), 0)
+	require.NoError(t, w.Close())
+
+	f, err := os.OpenFile(opts.Path, os.O_RDWR, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff}, size+walHeaderSize+2)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	w, rp := openTestWAL(t, opts)
+	defer w.Close()
+	require.Equal(t, []uint16{1}, walIDs(rp.live, "a"))
+	require.Equal(t, size, w.Status().Size)
+}
+
+func TestWALCompact(t *testing.T) {
+	opts := WALOptions{Path: filepath.Join(t.TempDir(), "inflight.wal"), NoSync: true, CompactSize: 1}
+	w, _ := openTestWAL(t, opts)
+
+	a := &Client{ID: "a"}
+	for id := uint16(1); id <= 10; id++ {
+		w.publish(a, walPacket(id), 0)
+		if id%2 == 0 {
+			w.remove("a", id)
+		}
+	}
+
+	st := w.Status()
+	require.Positive(t, st.Compactions)
+	require.Equal(t, 5, st.Inflight)
+	require.LessOrEqual(t, st.Size, 2*w.liveBytes)
+	require.NoError(t, w.Close())
+
+	w, rp := openTestWAL(t, opts)
+	defer w.Close()
+	require.Equal(t, []uint16{1, 3, 5, 7, 9}, walIDs(rp.live, "a"))
+	_, err := os.Stat(opts.Path + ".compact")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestWALClosed(t *testing.T) {
+	w, _ := openTestWAL(t, WALOptions{Path: filepath.Join(t.TempDir(), "inflight.wal")})
+	require.NoError(t, w.Close())
+
+	w.publish(&Client{ID: "a"}, walPacket(1), 0)
+	require.Equal(t, int64(1), w.Status().Errors)
+	require.Equal(t, 0, w.Status().Inflight)
+
+	var nw *WAL
+	nw.publish(&Client{ID: "a"}, walPacket(1), 0)
+	nw.remove("a", 1)
+	nw.expire("a")
+	require.NoError(t, nw.Close())
+}
+
+func TestServerSetupWAL(t *testing.T) {
+	opts := WALOptions{Path: filepath.Join(t.TempDir(), "inflight.wal")}
+	w, _ := openTestWAL(t, opts)
+	a := &Client{ID: "a"}
+	w.publish(a, walPacket(1), 0)
+	w.publish(a, walPacket(2), 0)
+	w.remove("a", 2)
+	w.publish(a, walPacket(3), 0)
+	w.publish(&Client{ID: "gone"}, walPacket(1), 0)
+	require.NoError(t, w.Close())
+
+	s := newServer()
+	_, ok := s.WALStatus()
+	require.False(t, ok)
+	require.NoError(t, s.setupWAL())
+	require.Nil(t, s.hooks.wal)
+
+	// the store restored the session with a message the log shows was completed
+	cl, _, _ := newTestClient()
+	cl.ID = "a"
+	cl.State.Inflight.Set(walPacket(2))
+	s.Clients.Add(cl)
+	s.Info.Inflight = 1
+
+	s.Options.WAL = &opts
+	require.NoError(t, s.setupWAL())
+	defer s.hooks.wal.Close()
+
+	require.Equal(t, 2, cl.State.Inflight.Len())
+	_, ok = cl.State.Inflight.Get(2)
+	require.False(t, ok)
+	require.Equal(t, int64(2), s.Info.Inflight)
+
+	st, ok := s.WALStatus()
+	require.True(t, ok)
+	require.Equal(t, 2, st.Replayed)
+	require.Equal(t, 2, st.Inflight)
+
+	// the hooks append to the log once it is replayed
+	s.hooks.OnQosPublish(cl, walPacket(4), 0, 0)
+	s.hooks.OnQosComplete(cl, walPacket(1))
+	require.Equal(t, 2, s.hooks.wal.Status().Inflight)
+
+	s.hooks.OnDisconnect(cl, nil, true)
+	require.Equal(t, 0, s.hooks.wal.Status().Inflight)
+}
@@ -0,0 +1,95 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind (573966@qq.com)
+
+package comqtt
+
+import (
+	"log/slog"
+	"maps"
+
+	"github.com/wind-c/comqtt/v2/config"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/listeners"
+)
+
+// Option configures a broker created with NewBroker.
+type Option func(b *Broker) error
+
+// hookSpec is a hook added to the server with its config.
+type hookSpec struct {
+	hook   mqtt.Hook
+	config any
+}
+
+// WithConfig configures the broker from a config, as read from the config files of the
+// comqtt commands. Options given after it override its values.
+func WithConfig(conf *config.Config) Option {
+	return func(b *Broker) error {
+		b.conf = conf
+		return nil
+	}
+}
+
+// WithConfigFile configures the broker from a yaml config file.
+func WithConfigFile(path string) Option {
+	return func(b *Broker) error {
+		conf, err := config.Load(path)
+		if err != nil {
+			return err
+		}
+		b.conf = conf
+		return nil
+	}
+}
+
+// WithCluster runs the broker as a node of a cluster, configured by the cluster section
+// of the config. Cluster nodes require the redis storage.
+func WithCluster() Option {
+	return func(b *Broker) error {
+		b.cluster = true
+		return nil
+	}
+}
+
+// WithLogger sets the logger of the server and its hooks, which otherwise log to the
+// default logger of the cluster log package.
+func WithLogger(logger *slog.Logger) Option {
+	return func(b *Broker) error {
+		b.logger = logger
+		return nil
+	}
+}
+
+// WithHook adds a hook to the server after the storage, auth and bridge hooks of the config.
+func WithHook(hook mqtt.Hook, config any) Option {
+	return func(b *Broker) error {
+		b.hooks = append(b.hooks, hookSpec{hook: hook, config: config})
+		return nil
+	}
+}
+
+// WithListener adds a listener to the server, alongside the listeners of the config.
+func WithListener(l listeners.Listener) Option {
+	return func(b *Broker) error {
+		b.listeners = append(b.listeners, l)
+		return nil
+	}
+}
+
+// WithoutDefaultListeners skips the tcp, websocket, quic and http listeners of the config,
+// so that only the listeners added with WithListener are served.
+func WithoutDefaultListeners() Option {
+	return func(b *Broker) error {
+		b.noDefaultListeners = true
+		return nil
+	}
+}
+
+// WithHandlers adds handlers to the http listener, keyed on their path.
+func WithHandlers(handlers map[string]listeners.Handler) Option {
+	return func(b *Broker) error {
+		maps.Copy(b.handlers, handlers)
+		return nil
+	}
+}
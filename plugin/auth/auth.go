@@ -1,11 +1,28 @@
 package auth
 
 import (
+	"regexp"
+	"strings"
+
 	"github.com/wind-c/comqtt/v2/mqtt"
 	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
 	"github.com/wind-c/comqtt/v2/mqtt/packets"
 )
 
+// SuperuserExtKey is the client Ext key set by the auth plugins for clients which
+// authenticated as a superuser, whose acl checks are skipped.
+const SuperuserExtKey = "superuser"
+
+const (
+	// UsernamePlaceholder is replaced with the username of a client in acl filters.
+	UsernamePlaceholder = "%u"
+	// ClientIDPlaceholder is replaced with the client id of a client in acl filters.
+	ClientIDPlaceholder = "%c"
+)
+
+// placeholder matches the placeholders of acl filter templates, such as ${sub}.
+var placeholder = regexp.MustCompile(`\$\{([^}]+)\}`)
+
 type HashType int
 
 const (
@@ -18,6 +35,8 @@ const (
 	HashHmacSha1
 	HashHmacSha256
 	HashHmacSha512
+	HashArgon2id
+	HashPbkdf2
 )
 
 func CheckAcl(tam map[string]auth.Access, write bool) bool {
@@ -44,18 +63,109 @@ func CheckAcl(tam map[string]auth.Access, write bool) bool {
 	//When there are multiple match filters, we use a clever method to select, usually the topic with wildcard is shorter.
 	//So avoid single-character hierarchies for specific topics
 	final := false
-	maxLen := 0
+	best := ""
 	for filter, ok := range rm {
-		l := len(filter)
-		if l > maxLen {
-			maxLen = l
-			final = ok
+		if outranks(filter, ok, best, final) {
+			best, final = filter, ok
 		}
 	}
 
 	return final
 }
 
+// outranks returns true if a matching filter decides access over another. The longer
+// filter wins, and between filters of the same length the one with fewer wildcard levels,
+// then the one denying access, so that the decision does not depend on map order.
+func outranks(filter string, ok bool, other string, otherOk bool) bool {
+	if len(filter) != len(other) {
+		return len(filter) > len(other)
+	}
+
+	if w, ow := wildcards(filter), wildcards(other); w != ow {
+		return w < ow
+	}
+
+	return !ok && otherOk
+}
+
+// wildcards returns the number of + and # levels of a filter.
+func wildcards(filter string) int {
+	n := 0
+	for _, level := range strings.Split(filter, "/") {
+		if level == "+" || level == "#" {
+			n++
+		}
+	}
+	return n
+}
+
+// SetSuperuser marks a client as a superuser, so that its acl checks are skipped.
+func SetSuperuser(cl *mqtt.Client) {
+	if cl.Ext == nil {
+		cl.Ext = make(map[string]interface{})
+	}
+	cl.Ext[SuperuserExtKey] = true
+}
+
+// IsSuperuser returns true if a client authenticated as a superuser.
+func IsSuperuser(cl *mqtt.Client) bool {
+	v, _ := cl.Ext[SuperuserExtKey].(bool)
+	return v
+}
+
+// SetMaxConnections sets the maximum concurrent connections of the username of a client
+// returned by a datasource, overriding the maximum-user-connections option of the
+// server. A negative maximum is unlimited, and 0 keeps the option.
+func SetMaxConnections(cl *mqtt.Client, maximum int) {
+	if maximum == 0 {
+		return
+	}
+	if cl.Ext == nil {
+		cl.Ext = make(map[string]interface{})
+	}
+	cl.Ext[mqtt.MaxConnectionsExtKey] = maximum
+}
+
+// ExpandFilter replaces the ${name} placeholders of an acl filter template with the
+// values returned by lookup, and returns false if any placeholder has no value.
+func ExpandFilter(tmpl string, lookup func(name string) (string, bool)) (string, bool) {
+	ok := true
+	filter := placeholder.ReplaceAllStringFunc(tmpl, func(m string) string {
+		v, found := lookup(m[2 : len(m)-1])
+		if !found || v == "" {
+			ok = false
+		}
+		return v
+	})
+
+	return filter, ok
+}
+
+// ExpandClientFilter replaces the %u and %c placeholders of an acl filter with the username
+// and client id of a client, so that one rule such as devices/%u/# covers every client.
+// It returns false if a placeholder would be replaced with an empty value or one containing
+// a topic level separator or wildcard, which would widen the filter.
+func ExpandClientFilter(cl *mqtt.Client, filter string) (string, bool) {
+	if !strings.Contains(filter, "%") {
+		return filter, true
+	}
+
+	for _, p := range []struct{ placeholder, value string }{
+		{UsernamePlaceholder, string(cl.Properties.Username)},
+		{ClientIDPlaceholder, cl.ID},
+	} {
+		if !strings.Contains(filter, p.placeholder) {
+			continue
+		}
+		if p.value == "" || strings.ContainsAny(p.value, "/+#") {
+			return "", false
+		}
+		filter = strings.ReplaceAll(filter, p.placeholder, p.value)
+	}
+
+	return filter, true
+}
+
 type Blacklist struct {
 	rules *auth.Ledger
 }
@@ -64,46 +174,76 @@ func (b *Blacklist) SetBlacklist(bl *auth.Ledger) {
 	b.rules = bl
 }
 
+// setBlacklisted marks a client as rejected by the blacklist, so that its failed
+// authentication is reported as a blacklist hit.
+func setBlacklisted(cl *mqtt.Client) {
+	if cl.Ext == nil {
+		cl.Ext = make(map[string]interface{})
+	}
+	cl.Ext[mqtt.BlacklistedExtKey] = true
+}
+
 func (b *Blacklist) CheckBLAuth(cl *mqtt.Client, pk packets.Packet) (n int, ok bool) {
+	n, ok = b.matchAuth(cl)
+	if n >= 0 && !ok {
+		setBlacklisted(cl)
+	}
+	return n, ok
+}
+
+// matchAuth returns the index of the first auth rule of the blacklist matching a client
+// and whether it allows the client, or -1 if no rule matches.
+func (b *Blacklist) matchAuth(cl *mqtt.Client) (n int, ok bool) {
 	if b.rules == nil {
 		return -1, false
 	}
-	for n, rule := range b.rules.Auth {
-		if rule.Client.Matches(cl.ID) &&
-			rule.Username.Matches(string(cl.Properties.Username)) &&
-			rule.Remote.Matches(cl.Net.Remote) {
-			return n, rule.Allow
-		}
-	}
 
-	return -1, false
+	return b.rules.BlacklistAuth(cl)
 }
 
 func (b *Blacklist) CheckBLAcl(cl *mqtt.Client, topic string, write bool) (n int, ok bool) {
 	if b.rules == nil {
 		return -1, false
 	}
-	for _, rule := range b.rules.ACL {
-		if rule.Client.Matches(cl.ID) &&
-			rule.Username.Matches(string(cl.Properties.Username)) &&
-			rule.Remote.Matches(cl.Net.Remote) {
-			if len(rule.Filters) == 0 {
-				return n, true
-			}
-
-			for filter, access := range rule.Filters {
-				if filter.FilterMatches(topic) {
-					if !write && (access == auth.ReadOnly || access == auth.ReadWrite) {
-						return n, true
-					} else if write && (access == auth.WriteOnly || access == auth.ReadWrite) {
-						return n, true
-					} else {
-						return n, false
-					}
-				}
-			}
-		}
+
+	return b.rules.BlacklistACL(cl, topic, write)
+}
+
+// AclLookup returns true if the acl of a client found in a datasource allows it to
+// subscribe or publish to a topic.
+type AclLookup func(cl *mqtt.Client, topic string, write bool) bool
+
+// AuthorizeClient returns true if a client may subscribe or publish to a topic, making the
+// checks shared by the auth datasources before finding the acl of the client with a lookup.
+// The acl of clients authenticated by another datasource of the auth chain is left to it,
+// and the other results are counted in the acl metrics of the datasource. All clients are
+// allowed in the anonymous acl mode, otherwise the blacklist decides first and superusers
+// are allowed.
+func (b *Blacklist) AuthorizeClient(id string, aclMode byte, m *Metrics, cl *mqtt.Client, topic string, write bool, lookup AclLookup) bool {
+	if !DecidedBy(cl, id) {
+		return false
 	}
 
-	return -1, false
+	if aclMode == byte(auth.AuthAnonymous) {
+		return m.Acl(true)
+	}
+
+	if n, ok := b.CheckBLAcl(cl, topic, write); n >= 0 {
+		return m.Acl(ok)
+	}
+
+	return m.Acl(IsSuperuser(cl) || lookup(cl, topic, write))
+}
+
+// AclKey returns the username or client id of a client, by which the acl mode of a
+// datasource looks up its acl, or false if the mode looks up neither.
+func AclKey(cl *mqtt.Client, aclMode byte) (string, bool) {
+	switch aclMode {
+	case byte(auth.AuthUsername):
+		return string(cl.Properties.Username), true
+	case byte(auth.AuthClientID):
+		return cl.ID, true
+	default:
+		return "", false
+	}
 }
@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+)
+
+func TestSuperuser(t *testing.T) {
+	cl := new(mqtt.Client)
+	require.False(t, IsSuperuser(cl))
+
+	SetSuperuser(cl)
+	require.True(t, IsSuperuser(cl))
+	require.Equal(t, true, cl.Ext[SuperuserExtKey])
+}
+
+func TestAuthorizeClient(t *testing.T) {
+	bl := new(Blacklist)
+	bl.SetBlacklist(&auth.Ledger{ACL: auth.ACLRules{{Client: "reader", Filters: auth.Filters{"a/#": auth.ReadOnly}}}})
+	m := new(Metrics)
+	lookups := 0
+	lookup := func(cl *mqtt.Client, topic string, write bool) bool {
+		lookups++
+		return topic == "b/c"
+	}
+	mode := byte(auth.AuthUsername)
+
+	// the acl of clients of another datasource is not checked or counted
+	cl := &mqtt.Client{ID: "cl1", Ext: map[string]interface{}{DatasourceExtKey: "auth-http"}}
+	require.False(t, bl.AuthorizeClient("auth-redis", mode, m, cl, "b/c", true, lookup))
+
+	cl = &mqtt.Client{ID: "cl1"}
+	require.True(t, bl.AuthorizeClient("auth-redis", byte(auth.AuthAnonymous), m, cl, "x/y", true, lookup))
+	require.True(t, bl.AuthorizeClient("auth-redis", mode, m, cl, "b/c", true, lookup))
+	require.False(t, bl.AuthorizeClient("auth-redis", mode, m, cl, "x/y", true, lookup))
+	require.Equal(t, 2, lookups)
+
+	// the blacklist decides before the lookup and superusers
+	reader := &mqtt.Client{ID: "reader"}
+	SetSuperuser(reader)
+	require.False(t, bl.AuthorizeClient("auth-redis", mode, m, reader, "a/b", true, lookup))
+	require.True(t, bl.AuthorizeClient("auth-redis", mode, m, reader, "x/y", true, lookup))
+	require.Equal(t, 2, lookups)
+
+	am := m.Snapshot("auth-redis", nil)
+	require.Equal(t, int64(3), am.AclAllowed)
+	require.Equal(t, int64(2), am.AclDenied)
+}
+
+func TestAclKey(t *testing.T) {
+	cl := &mqtt.Client{ID: "cl1", Properties: mqtt.ClientProperties{Username: []byte("alice")}}
+
+	key, ok := AclKey(cl, byte(auth.AuthUsername))
+	require.True(t, ok)
+	require.Equal(t, "alice", key)
+
+	key, ok = AclKey(cl, byte(auth.AuthClientID))
+	require.True(t, ok)
+	require.Equal(t, "cl1", key)
+
+	_, ok = AclKey(cl, byte(auth.AuthAnonymous))
+	require.False(t, ok)
+}
+
+func TestSetMaxConnections(t *testing.T) {
+	cl := new(mqtt.Client)
+	SetMaxConnections(cl, 0)
+	require.Nil(t, cl.Ext)
+
+	SetMaxConnections(cl, 3)
+	require.Equal(t, 3, cl.Ext[mqtt.MaxConnectionsExtKey])
+}
+
+func TestExpandFilter(t *testing.T) {
+	values := map[string]string{"sub": "device-001", "tenant": "acme", "empty": ""}
+	lookup := func(name string) (string, bool) {
+		v, ok := values[name]
+		return v, ok
+	}
+
+	filter, ok := ExpandFilter("tenants/${tenant}/devices/${sub}/#", lookup)
+	require.True(t, ok)
+	require.Equal(t, "tenants/acme/devices/device-001/#", filter)
+
+	filter, ok = ExpandFilter("broadcast/#", lookup)
+	require.True(t, ok)
+	require.Equal(t, "broadcast/#", filter)
+
+	_, ok = ExpandFilter("devices/${missing}/#", lookup)
+	require.False(t, ok)
+
+	_, ok = ExpandFilter("devices/${empty}/#", lookup)
+	require.False(t, ok)
+}
+
+func TestExpandClientFilter(t *testing.T) {
+	cl := &mqtt.Client{ID: "device-001"}
+	cl.Properties.Username = []byte("mochi")
+
+	filter, ok := ExpandClientFilter(cl, "devices/%u/%c/#")
+	require.True(t, ok)
+	require.Equal(t, "devices/mochi/device-001/#", filter)
+
+	filter, ok = ExpandClientFilter(cl, "broadcast/#")
+	require.True(t, ok)
+	require.Equal(t, "broadcast/#", filter)
+
+	cl.Properties.Username = []byte("mochi/#")
+	_, ok = ExpandClientFilter(cl, "devices/%u/#")
+	require.False(t, ok)
+
+	filter, ok = ExpandClientFilter(cl, "clients/%c")
+	require.True(t, ok)
+	require.Equal(t, "clients/device-001", filter)
+
+	cl.Properties.Username = nil
+	_, ok = ExpandClientFilter(cl, "devices/%u/#")
+	require.False(t, ok)
+}
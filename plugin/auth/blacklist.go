@@ -0,0 +1,233 @@
+package auth
+
+import (
+	"errors"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/plugin"
+)
+
+const (
+	BanClient   = mqtt.BanClient   // bans a client id
+	BanUsername = mqtt.BanUsername // bans a username
+	BanIP       = mqtt.BanIP       // bans the remote ip of clients
+)
+
+// ErrInvalidBan indicates a ban is not of a client, username or ip, or has no value.
+var ErrInvalidBan = errors.New("invalid ban, expected a client, username or ip and a value")
+
+// BlacklistManager keeps the blacklist ledger shared by the auth plugins up to date with
+// the blacklist file and the bans added at runtime, disconnecting the connected clients
+// which are denied by a change.
+type BlacklistManager struct {
+	mu      sync.Mutex
+	server  *mqtt.Server
+	ledger  *auth.Ledger
+	path    string
+	modTime time.Time    // the modification time of the loaded file
+	size    int64        // the size of the loaded file
+	file    *auth.Ledger // the rules of the loaded file
+	bans    []mqtt.Ban   // the bans added at runtime, which precede the rules of the file
+	cancel  chan struct{}
+}
+
+// NewBlacklistManager returns a manager of a blacklist ledger loaded from a file, or only
+// holding bans added at runtime if the path is empty.
+func NewBlacklistManager(server *mqtt.Server, ledger *auth.Ledger, path string) *BlacklistManager {
+	return &BlacklistManager{
+		server: server,
+		ledger: ledger,
+		path:   path,
+		file:   &auth.Ledger{Auth: ledger.Auth, ACL: ledger.ACL},
+	}
+}
+
+// Load reloads the blacklist file if it has changed since it was last loaded, returning
+// true if it was reloaded.
+func (m *BlacklistManager) Load() (bool, error) {
+	if m.path == "" {
+		return false, nil
+	}
+
+	fi, err := os.Stat(m.path)
+	if err != nil {
+		return false, err
+	}
+
+	m.mu.Lock()
+	if fi.ModTime().Equal(m.modTime) && fi.Size() == m.size {
+		m.mu.Unlock()
+		return false, nil
+	}
+
+	file := new(auth.Ledger)
+	if err := plugin.LoadYaml(m.path, file); err != nil {
+		m.mu.Unlock()
+		return false, err
+	}
+
+	m.file, m.modTime, m.size = file, fi.ModTime(), fi.Size()
+	m.apply()
+	m.mu.Unlock()
+
+	n := m.enforce()
+	m.server.Log.Info("loaded auth blacklist", "path", m.path, "auth-rules", len(file.Auth),
+		"acl-rules", len(file.ACL), "disconnected", n)
+	return true, nil
+}
+
+// Watch reloads the blacklist file every interval when it changes, until stopped.
+func (m *BlacklistManager) Watch(interval time.Duration) {
+	if m.path == "" || interval <= 0 {
+		return
+	}
+
+	m.mu.Lock()
+	if m.cancel != nil {
+		m.mu.Unlock()
+		return
+	}
+	cancel := make(chan struct{})
+	m.cancel = cancel
+	m.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-cancel:
+				return
+			case <-ticker.C:
+				if _, err := m.Load(); err != nil {
+					m.server.Log.Warn("unable to reload auth blacklist", "path", m.path, "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops watching the blacklist file.
+func (m *BlacklistManager) Stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cancel != nil {
+		close(m.cancel)
+		m.cancel = nil
+	}
+}
+
+// Ban bans a client id, username or ip, disconnecting the connected clients it matches,
+// and returns the number of clients disconnected. Bans are kept until the broker stops,
+// and must be added to the blacklist file to be kept across restarts.
+func (m *BlacklistManager) Ban(kind, value string) (int, error) {
+	ban := mqtt.Ban{Kind: kind, Value: value}
+	if _, err := banRule(ban); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	added := !slices.Contains(m.bans, ban)
+	if added {
+		m.bans = append(m.bans, ban)
+		m.apply()
+	}
+	m.mu.Unlock()
+
+	if added {
+		m.server.SecurityEvent(mqtt.SecurityEvent{Type: mqtt.SecurityBanned, Kind: kind, Value: value, Reason: "auth blacklist"})
+	}
+
+	return m.enforce(), nil
+}
+
+// Unban removes a ban added at runtime, returning false if there was no such ban.
+func (m *BlacklistManager) Unban(kind, value string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := slices.Index(m.bans, mqtt.Ban{Kind: kind, Value: value})
+	if i < 0 {
+		return false
+	}
+
+	m.bans = slices.Delete(slices.Clone(m.bans), i, i+1)
+	m.apply()
+	return true
+}
+
+// Bans returns the bans added at runtime.
+func (m *BlacklistManager) Bans() []mqtt.Ban {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.bans)
+}
+
+// apply updates the ledger with the bans followed by the rules of the file. The ledger
+// is given new slices, so that the plugins checking the old ones are not affected.
+func (m *BlacklistManager) apply() {
+	rules := make(auth.AuthRules, 0, len(m.bans)+len(m.file.Auth))
+	for _, ban := range m.bans {
+		rule, _ := banRule(ban)
+		rules = append(rules, rule)
+	}
+	rules = append(rules, m.file.Auth...)
+
+	m.ledger.Update(&auth.Ledger{Auth: rules, ACL: m.file.ACL})
+}
+
+// enforce disconnects the connected clients which the auth rules of the ledger deny,
+// returning the number disconnected.
+func (m *BlacklistManager) enforce() int {
+	bl := Blacklist{rules: m.ledger}
+	n := 0
+	for _, cl := range m.server.Clients.GetAll() {
+		if cl.Net.Inline || cl.Closed() {
+			continue
+		}
+
+		if i, ok := bl.matchAuth(cl); i >= 0 && !ok {
+			m.server.Log.Info("disconnecting blacklisted client", "client", cl.ID, "username", string(cl.Properties.Username), "remote", cl.Net.Remote)
+			m.server.SecurityEvent(mqtt.SecurityEvent{
+				Type:     mqtt.SecurityBlacklisted,
+				ClientID: cl.ID,
+				Username: string(cl.Properties.Username),
+				Remote:   cl.Net.Remote,
+				Listener: cl.Net.Listener,
+				Reason:   "auth blacklist",
+			})
+			_ = m.server.DisconnectClient(cl, packets.ErrNotAuthorized)
+			n++
+		}
+	}
+
+	return n
+}
+
+// banRule returns the auth rule denying the clients matched by a ban.
+func banRule(ban mqtt.Ban) (auth.AuthRule, error) {
+	if ban.Value == "" {
+		return auth.AuthRule{}, ErrInvalidBan
+	}
+
+	switch ban.Kind {
+	case BanClient:
+		return auth.AuthRule{Client: auth.RString(ban.Value)}, nil
+	case BanUsername:
+		return auth.AuthRule{Username: auth.RString(ban.Value)}, nil
+	case BanIP:
+		if net.ParseIP(ban.Value) == nil {
+			return auth.AuthRule{}, ErrInvalidBan
+		}
+		return auth.AuthRule{Remote: auth.RString(net.JoinHostPort(ban.Value, "*"))}, nil
+	default:
+		return auth.AuthRule{}, ErrInvalidBan
+	}
+}
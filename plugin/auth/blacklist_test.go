@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+	"github.com/wind-c/comqtt/v2/mqtt/listeners"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+)
+
+func newBlacklistClient(t *testing.T, s *mqtt.Server, id, username, remote string) *mqtt.Client {
+	r, w := net.Pipe()
+	t.Cleanup(func() {
+		_ = r.Close()
+		_ = w.Close()
+	})
+	go func() { _, _ = io.Copy(io.Discard, w) }()
+
+	cl := s.NewClient(r, "t1", id, false)
+	cl.Properties.Username = []byte(username)
+	cl.Net.Remote = remote
+	s.Clients.Add(cl)
+	return cl
+}
+
+func TestBlacklistManagerBan(t *testing.T) {
+	s := mqtt.New(nil)
+	ledger := &auth.Ledger{}
+	m := NewBlacklistManager(s, ledger, "")
+
+	a := newBlacklistClient(t, s, "a", "alice", "10.0.0.1:5000")
+	b := newBlacklistClient(t, s, "b", "bob", "10.0.0.2:5000")
+	c := newBlacklistClient(t, s, "c", "carol", "10.0.0.3:5000")
+
+	n, err := m.Ban(BanUsername, "alice")
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.True(t, a.Closed())
+	require.False(t, b.Closed())
+
+	n, err = m.Ban(BanIP, "10.0.0.2")
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.True(t, b.Closed())
+	require.False(t, c.Closed())
+
+	n, err = m.Ban(BanClient, "d")
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	_, err = m.Ban(BanUsername, "alice")
+	require.NoError(t, err)
+	require.Equal(t, []mqtt.Ban{
+		{Kind: BanUsername, Value: "alice"},
+		{Kind: BanIP, Value: "10.0.0.2"},
+		{Kind: BanClient, Value: "d"},
+	}, m.Bans())
+	require.Len(t, ledger.Auth, 3)
+
+	bl := Blacklist{rules: ledger}
+	cl := &mqtt.Client{ID: "d"}
+	i, ok := bl.CheckBLAuth(cl, packets.Packet{})
+	require.Equal(t, 2, i)
+	require.False(t, ok)
+	require.Equal(t, true, cl.Ext[mqtt.BlacklistedExtKey])
+
+	require.True(t, m.Unban(BanClient, "d"))
+	require.False(t, m.Unban(BanClient, "d"))
+	require.Len(t, ledger.Auth, 2)
+	i, _ = bl.CheckBLAuth(&mqtt.Client{ID: "d"}, packets.Packet{})
+	require.Equal(t, -1, i)
+}
+
+// connectBlacklistClient connects the zen client to a listener of a server and then
+// disconnects it, returning the error of the connection.
+func connectBlacklistClient(s *mqtt.Server, listener string) error {
+	r, w := net.Pipe()
+	defer r.Close()
+	defer w.Close()
+
+	go func() {
+		_, _ = w.Write(packets.TPacketData[packets.Connect].Get(packets.TConnectClean).RawBytes)
+		_, _ = w.Write(packets.TPacketData[packets.Disconnect].Get(packets.TDisconnect).RawBytes)
+	}()
+	go func() { _, _ = io.Copy(io.Discard, w) }()
+
+	return s.EstablishConnection(listener, r)
+}
+
+func TestBlacklistManagerBanAnonymousListener(t *testing.T) {
+	s := mqtt.New(nil)
+	defer s.Close()
+	ledger := &auth.Ledger{}
+	m := NewBlacklistManager(s, ledger, "")
+	s.SetBlacklist(ledger)
+
+	policy := &listeners.AuthPolicy{Anonymous: true}
+	require.NoError(t, s.AddListener(listeners.NewTCP("public", "127.0.0.1:0", &listeners.Config{Auth: policy})))
+	require.NoError(t, connectBlacklistClient(s, "public"))
+
+	_, err := m.Ban(BanClient, "zen")
+	require.NoError(t, err)
+	require.ErrorIs(t, connectBlacklistClient(s, "public"), packets.ErrBadUsernameOrPassword)
+
+	require.True(t, m.Unban(BanClient, "zen"))
+	require.NoError(t, connectBlacklistClient(s, "public"))
+}
+
+func TestBlacklistManagerBanInvalid(t *testing.T) {
+	m := NewBlacklistManager(mqtt.New(nil), &auth.Ledger{}, "")
+
+	for _, ban := range []mqtt.Ban{
+		{Kind: BanClient},
+		{Kind: BanIP, Value: "not-an-ip"},
+		{Kind: "topic", Value: "a/b"},
+	} {
+		_, err := m.Ban(ban.Kind, ban.Value)
+		require.ErrorIs(t, err, ErrInvalidBan)
+	}
+	require.Empty(t, m.Bans())
+}
+
+func TestBlacklistManagerLoad(t *testing.T) {
+	s := mqtt.New(nil)
+	path := filepath.Join(t.TempDir(), "blacklist.yml")
+	require.NoError(t, os.WriteFile(path, []byte("auth:\n  - username: alice\n    allow: false\n"), 0o644))
+
+	ledger := &auth.Ledger{}
+	m := NewBlacklistManager(s, ledger, path)
+	ok, err := m.Load()
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Len(t, ledger.Auth, 1)
+
+	ok, err = m.Load()
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	_, err = m.Ban(BanClient, "d")
+	require.NoError(t, err)
+
+	b := newBlacklistClient(t, s, "b", "bob", "10.0.0.2:5000")
+	require.NoError(t, os.WriteFile(path, []byte("auth:\n  - username: bob\n    allow: false\n  - username: carol\n    allow: false\n"), 0o644))
+	ok, err = m.Load()
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.True(t, b.Closed())
+	require.Equal(t, auth.AuthRules{
+		{Client: "d"},
+		{Username: "bob"},
+		{Username: "carol"},
+	}, ledger.Auth)
+}
+
+func TestBlacklistManagerWatch(t *testing.T) {
+	s := mqtt.New(nil)
+	path := filepath.Join(t.TempDir(), "blacklist.yml")
+	require.NoError(t, os.WriteFile(path, []byte("auth: []\n"), 0o644))
+
+	ledger := &auth.Ledger{}
+	m := NewBlacklistManager(s, ledger, path)
+	_, err := m.Load()
+	require.NoError(t, err)
+
+	m.Watch(10 * time.Millisecond)
+	defer m.Stop()
+
+	require.NoError(t, os.WriteFile(path, []byte("auth:\n  - client: a\n    allow: false\n"), 0o644))
+	require.Eventually(t, func() bool {
+		bl := Blacklist{rules: ledger}
+		i, _ := bl.CheckBLAuth(&mqtt.Client{ID: "a"}, packets.Packet{})
+		return i == 0
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCacheTTL        = 60    // seconds
+	defaultCacheMaxEntries = 10000 // entries
+
+	CacheAuth = "auth" // the kind of cached auth lookups
+	CacheAcl  = "acl"  // the kind of cached acl lookups
+)
+
+// CacheOptions configures an in-process cache of the auth and acl lookups of a datasource,
+// so that clients are not checked against the datasource on every connect and publish.
+type CacheOptions struct {
+	Enable      bool  `json:"enable" yaml:"enable"`
+	TTL         int64 `json:"ttl" yaml:"ttl"`                   // seconds found users and acls are cached, default 60
+	NegativeTTL int64 `json:"negative-ttl" yaml:"negative-ttl"` // seconds missing users and acls are cached, 0 to not cache them
+	MaxEntries  int   `json:"max-entries" yaml:"max-entries"`   // the least recently used lookups are evicted beyond this, default 10000
+}
+
+// cacheEntry is a cached lookup.
+type cacheEntry struct {
+	key     string
+	value   any
+	expires time.Time
+}
+
+// Cache is an lru cache of the auth and acl lookups of a datasource, keyed on the
+// kind of lookup and the username or client id. A nil Cache caches nothing.
+type Cache struct {
+	sync.Mutex
+	ttl         time.Duration
+	negativeTTL time.Duration
+	max         int
+	entries     map[string]*list.Element
+	lru         *list.List
+	hits        int64 // lookups found in the cache
+	misses      int64 // lookups not found in the cache, or expired
+}
+
+// NewCache returns a new cache, or nil if the cache is not enabled.
+func NewCache(opts CacheOptions) *Cache {
+	if !opts.Enable {
+		return nil
+	}
+
+	if opts.TTL <= 0 {
+		opts.TTL = defaultCacheTTL
+	}
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = defaultCacheMaxEntries
+	}
+
+	return &Cache{
+		ttl:         time.Duration(opts.TTL) * time.Second,
+		negativeTTL: time.Duration(opts.NegativeTTL) * time.Second,
+		max:         opts.MaxEntries,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+	}
+}
+
+func cacheKey(kind, key string) string {
+	return kind + ":" + key
+}
+
+// Get returns the cached lookup of a kind for a username or client id, and false if it
+// is not cached or has expired. Expired lookups are kept until they are set again or
+// evicted, so that they can still be served stale.
+func (c *Cache) Get(kind, key string) (any, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	el, ok := c.entries[cacheKey(kind, key)]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+
+	e := el.Value.(*cacheEntry)
+	if time.Now().After(e.expires) {
+		c.misses++
+		return nil, false
+	}
+
+	c.lru.MoveToFront(el)
+	c.hits++
+	return e.value, true
+}
+
+// Stale returns the cached lookup of a kind for a username or client id even if it has
+// expired, such as while the datasource is unavailable, and false if it is not cached.
+func (c *Cache) Stale(kind, key string) (any, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	el, ok := c.entries[cacheKey(kind, key)]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+
+	c.lru.MoveToFront(el)
+	c.hits++
+	return el.Value.(*cacheEntry).value, true
+}
+
+// Set caches the lookup of a kind for a username or client id. Negative lookups, of
+// users or acls which were not found, are cached for the negative ttl.
+func (c *Cache) Set(kind, key string, value any, negative bool) {
+	if c == nil {
+		return
+	}
+
+	ttl := c.ttl
+	if negative {
+		ttl = c.negativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	k := cacheKey(kind, key)
+	e := &cacheEntry{key: k, value: value, expires: time.Now().Add(ttl)}
+	if el, ok := c.entries[k]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	c.entries[k] = c.lru.PushFront(e)
+	for c.lru.Len() > c.max {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Invalidate removes the cached lookups of a username or client id, returning the number
+// of lookups removed.
+func (c *Cache) Invalidate(key string) int {
+	if c == nil {
+		return 0
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	n := 0
+	for _, kind := range []string{CacheAuth, CacheAcl} {
+		if el, ok := c.entries[cacheKey(kind, key)]; ok {
+			c.remove(el)
+			n++
+		}
+	}
+
+	return n
+}
+
+// Purge removes all cached lookups, returning the number of lookups removed.
+func (c *Cache) Purge() int {
+	if c == nil {
+		return 0
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	n := c.lru.Len()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	return n
+}
+
+// Len returns the number of cached lookups.
+func (c *Cache) Len() int {
+	if c == nil {
+		return 0
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	return c.lru.Len()
+}
+
+// Stats returns the number of lookups which were found in the cache and which were not.
+func (c *Cache) Stats() (hits, misses int64) {
+	if c == nil {
+		return 0, 0
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	return c.hits, c.misses
+}
+
+// remove removes a cached lookup. The cache must be locked.
+func (c *Cache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).key)
+}
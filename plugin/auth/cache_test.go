@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewCacheDisabled(t *testing.T) {
+	c := NewCache(CacheOptions{})
+	require.Nil(t, c)
+
+	c.Set(CacheAuth, "zhangsan", "rule", false)
+	_, ok := c.Get(CacheAuth, "zhangsan")
+	require.False(t, ok)
+	require.Equal(t, 0, c.Invalidate("zhangsan"))
+	require.Equal(t, 0, c.Purge())
+	require.Equal(t, 0, c.Len())
+}
+
+func TestNewCacheDefaults(t *testing.T) {
+	c := NewCache(CacheOptions{Enable: true})
+	require.NotNil(t, c)
+	require.Equal(t, defaultCacheTTL*time.Second, c.ttl)
+	require.Equal(t, time.Duration(0), c.negativeTTL)
+	require.Equal(t, defaultCacheMaxEntries, c.max)
+}
+
+func TestCacheGetSet(t *testing.T) {
+	c := NewCache(CacheOptions{Enable: true})
+
+	c.Set(CacheAuth, "zhangsan", "rule", false)
+	v, ok := c.Get(CacheAuth, "zhangsan")
+	require.True(t, ok)
+	require.Equal(t, "rule", v)
+
+	_, ok = c.Get(CacheAcl, "zhangsan")
+	require.False(t, ok)
+
+	c.Set(CacheAuth, "zhangsan", "updated", false)
+	v, ok = c.Get(CacheAuth, "zhangsan")
+	require.True(t, ok)
+	require.Equal(t, "updated", v)
+	require.Equal(t, 1, c.Len())
+}
+
+func TestCacheExpired(t *testing.T) {
+	c := NewCache(CacheOptions{Enable: true})
+
+	c.Set(CacheAuth, "zhangsan", "rule", false)
+	c.entries[cacheKey(CacheAuth, "zhangsan")].Value.(*cacheEntry).expires = time.Now().Add(-time.Second)
+
+	_, ok := c.Get(CacheAuth, "zhangsan")
+	require.False(t, ok)
+	require.Equal(t, 1, c.Len())
+
+	// expired lookups may still be served stale
+	v, ok := c.Stale(CacheAuth, "zhangsan")
+	require.True(t, ok)
+	require.Equal(t, "rule", v)
+	_, ok = c.Stale(CacheAuth, "lisi")
+	require.False(t, ok)
+
+	c.Set(CacheAuth, "zhangsan", "updated", false)
+	v, ok = c.Get(CacheAuth, "zhangsan")
+	require.True(t, ok)
+	require.Equal(t, "updated", v)
+}
+
+func TestCacheNegative(t *testing.T) {
+	c := NewCache(CacheOptions{Enable: true})
+	c.Set(CacheAuth, "lisi", nil, true)
+	_, ok := c.Get(CacheAuth, "lisi")
+	require.False(t, ok, "negative lookups are not cached without a negative ttl")
+
+	c = NewCache(CacheOptions{Enable: true, NegativeTTL: 10})
+	c.Set(CacheAuth, "lisi", nil, true)
+	v, ok := c.Get(CacheAuth, "lisi")
+	require.True(t, ok)
+	require.Nil(t, v)
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewCache(CacheOptions{Enable: true, MaxEntries: 2})
+
+	c.Set(CacheAuth, "a", 1, false)
+	c.Set(CacheAuth, "b", 2, false)
+	_, ok := c.Get(CacheAuth, "a")
+	require.True(t, ok)
+
+	c.Set(CacheAuth, "c", 3, false)
+	require.Equal(t, 2, c.Len())
+
+	_, ok = c.Get(CacheAuth, "b")
+	require.False(t, ok)
+	_, ok = c.Get(CacheAuth, "a")
+	require.True(t, ok)
+	_, ok = c.Get(CacheAuth, "c")
+	require.True(t, ok)
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	c := NewCache(CacheOptions{Enable: true})
+
+	c.Set(CacheAuth, "zhangsan", "rule", false)
+	c.Set(CacheAcl, "zhangsan", map[string]string{"a/b": "3"}, false)
+	c.Set(CacheAuth, "lisi", "rule", false)
+
+	require.Equal(t, 2, c.Invalidate("zhangsan"))
+	require.Equal(t, 0, c.Invalidate("zhangsan"))
+	require.Equal(t, 1, c.Len())
+
+	_, ok := c.Get(CacheAuth, "lisi")
+	require.True(t, ok)
+
+	require.Equal(t, 1, c.Purge())
+	require.Equal(t, 0, c.Len())
+}
+
+func TestCacheStats(t *testing.T) {
+	var c *Cache
+	hits, misses := c.Stats()
+	require.Zero(t, hits)
+	require.Zero(t, misses)
+
+	c = NewCache(CacheOptions{Enable: true})
+	c.Set(CacheAuth, "zhangsan", "rule", false)
+	c.Get(CacheAuth, "zhangsan")
+	c.Get(CacheAuth, "zhangsan")
+	c.Get(CacheAuth, "lisi")
+
+	hits, misses = c.Stats()
+	require.Equal(t, int64(2), hits)
+	require.Equal(t, int64(1), misses)
+}
@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"github.com/wind-c/comqtt/v2/mqtt"
+)
+
+// DatasourceExtKey is the client Ext key set to the id of the auth datasource which
+// decided whether a client may connect, which alone checks the acl of the client.
+const DatasourceExtKey = "auth-datasource"
+
+// Result is the result of authenticating a client with an auth datasource.
+type Result int
+
+const (
+	// Unknown indicates the datasource has no credentials for the client or is unavailable,
+	// so the next datasource of an auth chain is tried.
+	Unknown Result = iota
+	// Allow indicates the credentials of the client are valid.
+	Allow
+	// Deny indicates the client is blacklisted, or its credentials are invalid or disallowed,
+	// which no later datasource of an auth chain may override.
+	Deny
+)
+
+// Decide records the datasource which decided the result of authenticating a client,
+// and returns true if the client is allowed. Unknown results are not recorded, leaving
+// the client to the next datasource.
+func Decide(cl *mqtt.Client, id string, res Result) bool {
+	if res == Unknown {
+		return false
+	}
+
+	if cl.Ext == nil {
+		cl.Ext = make(map[string]interface{})
+	}
+	cl.Ext[DatasourceExtKey] = id
+	return res == Allow
+}
+
+// DecidedBy returns true if the authentication of a client was decided by a datasource,
+// or by none of the auth datasources. Clients denied by a datasource are not
+// authenticated by the later datasources of an auth chain, and the acl of clients is
+// only checked by the datasource which allowed them.
+func DecidedBy(cl *mqtt.Client, id string) bool {
+	v, ok := cl.Ext[DatasourceExtKey].(string)
+	return !ok || v == id
+}
+
+// ResultOf returns Allow if ok, otherwise Deny.
+func ResultOf(ok bool) Result {
+	if ok {
+		return Allow
+	}
+	return Deny
+}
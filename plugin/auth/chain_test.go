@@ -0,0 +1,31 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+)
+
+func TestDecide(t *testing.T) {
+	cl := new(mqtt.Client)
+	require.True(t, DecidedBy(cl, "auth-redis"))
+
+	require.False(t, Decide(cl, "auth-redis", Unknown))
+	require.Nil(t, cl.Ext)
+	require.True(t, DecidedBy(cl, "auth-http"))
+
+	require.False(t, Decide(cl, "auth-redis", Deny))
+	require.True(t, DecidedBy(cl, "auth-redis"))
+	require.False(t, DecidedBy(cl, "auth-http"))
+
+	cl = new(mqtt.Client)
+	require.True(t, Decide(cl, "auth-http", Allow))
+	require.Equal(t, "auth-http", cl.Ext[DatasourceExtKey])
+	require.False(t, DecidedBy(cl, "auth-redis"))
+}
+
+func TestResultOf(t *testing.T) {
+	require.Equal(t, Allow, ResultOf(true))
+	require.Equal(t, Deny, ResultOf(false))
+}
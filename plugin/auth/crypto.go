@@ -3,18 +3,50 @@ package auth
 import (
 	"crypto/hmac"
 	"crypto/md5"
+	"crypto/rand"
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
 
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
 )
 
+const (
+	argon2Memory  = 64 * 1024 // KiB
+	argon2Time    = 3
+	argon2Threads = 4
+	pbkdf2Iter    = 600000
+	saltLen       = 16
+	keyLen        = 32
+)
+
+// ErrInvalidHash indicates a PHC formatted password hash could not be parsed.
+var ErrInvalidHash = errors.New("invalid password hash")
+
+// CompareHash returns true if the plain password matches the hashed password. Hashes in
+// the PHC format of argon2id and pbkdf2, and bcrypt hashes, are detected by their prefix
+// and compared by their own algorithm whatever the hash type, so that passwords can be
+// migrated from an unsalted hash type one user at a time.
 func CompareHash(hashed, plain, key string, ht HashType) bool {
+	if detected, ok := DetectHash(hashed); ok {
+		ht = detected
+	}
+
 	var tmp string
 	switch ht {
+	case HashArgon2id:
+		return compareArgon2id(hashed, plain)
+	case HashPbkdf2:
+		return comparePbkdf2(hashed, plain)
 	case HashBcrypt:
 		if err := bcrypt.CompareHashAndPassword([]byte(hashed), []byte(plain)); err != nil {
 			return false
@@ -46,6 +78,121 @@ func CompareHash(hashed, plain, key string, ht HashType) bool {
 	return false
 }
 
+// DetectHash returns the hash type of a password hash with a self-describing prefix,
+// which are the PHC formats of argon2id and pbkdf2, and bcrypt.
+func DetectHash(hashed string) (HashType, bool) {
+	switch {
+	case strings.HasPrefix(hashed, "$argon2id$"):
+		return HashArgon2id, true
+	case strings.HasPrefix(hashed, "$pbkdf2-"):
+		return HashPbkdf2, true
+	case strings.HasPrefix(hashed, "$2a$"), strings.HasPrefix(hashed, "$2b$"), strings.HasPrefix(hashed, "$2y$"):
+		return HashBcrypt, true
+	}
+
+	return 0, false
+}
+
+// Argon2id returns the argon2id hash of a password with a random salt in the PHC format,
+// such as $argon2id$v=19$m=65536,t=3,p=4$salt$hash.
+func Argon2id(src string) string {
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return ""
+	}
+
+	h := argon2.IDKey([]byte(src), salt, argon2Time, argon2Memory, argon2Threads, keyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		b64.EncodeToString(salt), b64.EncodeToString(h))
+}
+
+// Pbkdf2 returns the pbkdf2-sha256 hash of a password with a random salt in the PHC format,
+// such as $pbkdf2-sha256$i=600000$salt$hash.
+func Pbkdf2(src string) string {
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return ""
+	}
+
+	h := pbkdf2.Key([]byte(src), salt, pbkdf2Iter, keyLen, sha256.New)
+	return fmt.Sprintf("$pbkdf2-sha256$i=%d$%s$%s", pbkdf2Iter, b64.EncodeToString(salt), b64.EncodeToString(h))
+}
+
+// b64 is the unpadded base64 encoding of the salts and hashes of the PHC format.
+var b64 = base64.RawStdEncoding
+
+// phc splits a PHC formatted hash into its parameters, salt and hash.
+func phc(hashed, id string, n int) ([]string, []byte, []byte, error) {
+	parts := strings.Split(hashed, "$")
+	if len(parts) != n+4 || parts[0] != "" || parts[1] != id {
+		return nil, nil, nil, ErrInvalidHash
+	}
+
+	salt, err := b64.DecodeString(parts[len(parts)-2])
+	if err != nil {
+		return nil, nil, nil, ErrInvalidHash
+	}
+
+	h, err := b64.DecodeString(parts[len(parts)-1])
+	if err != nil || len(h) == 0 {
+		return nil, nil, nil, ErrInvalidHash
+	}
+
+	return parts[2 : len(parts)-2], salt, h, nil
+}
+
+// compareArgon2id returns true if a password matches an argon2id hash in the PHC format.
+func compareArgon2id(hashed, plain string) bool {
+	params, salt, h, err := phc(hashed, "argon2id", 2)
+	if err != nil {
+		return false
+	}
+
+	var version int
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(params[0], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	if _, err := fmt.Sscanf(params[1], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil ||
+		memory == 0 || time == 0 || threads == 0 {
+		return false
+	}
+
+	other := argon2.IDKey([]byte(plain), salt, time, memory, threads, uint32(len(h)))
+	return subtle.ConstantTimeCompare(h, other) == 1
+}
+
+// comparePbkdf2 returns true if a password matches a pbkdf2-sha1, pbkdf2-sha256 or
+// pbkdf2-sha512 hash in the PHC format.
+func comparePbkdf2(hashed, plain string) bool {
+	id, _, _ := strings.Cut(strings.TrimPrefix(hashed, "$"), "$")
+	var digest func() hash.Hash
+	switch id {
+	case "pbkdf2-sha1":
+		digest = sha1.New
+	case "pbkdf2-sha256":
+		digest = sha256.New
+	case "pbkdf2-sha512":
+		digest = sha512.New
+	default:
+		return false
+	}
+
+	params, salt, h, err := phc(hashed, id, 1)
+	if err != nil {
+		return false
+	}
+
+	var iter int
+	if _, err := fmt.Sscanf(params[0], "i=%d", &iter); err != nil || iter <= 0 {
+		return false
+	}
+
+	other := pbkdf2.Key([]byte(plain), salt, iter, len(h), digest)
+	return subtle.ConstantTimeCompare(h, other) == 1
+}
+
 func Bcrypt(src string) string {
 	hashed, err := bcrypt.GenerateFromPassword([]byte(src), bcrypt.DefaultCost)
 	if err != nil {
@@ -1,9 +1,11 @@
 package auth
 
 import (
+	"strings"
+	"testing"
+
 	"github.com/stretchr/testify/require"
 	"golang.org/x/crypto/bcrypt"
-	"testing"
 )
 
 func TestBcrypt(t *testing.T) {
@@ -17,3 +19,57 @@ func TestBcrypt(t *testing.T) {
 	err = bcrypt.CompareHashAndPassword([]byte(hashed2), []byte(pwd))
 	require.NoError(t, err)
 }
+
+func TestArgon2id(t *testing.T) {
+	hashed := Argon2id("123456")
+	require.True(t, strings.HasPrefix(hashed, "$argon2id$v=19$m=65536,t=3,p=4$"))
+	require.NotEqual(t, hashed, Argon2id("123456"))
+	require.True(t, CompareHash(hashed, "123456", "", HashArgon2id))
+	require.False(t, CompareHash(hashed, "1234567", "", HashArgon2id))
+
+	// the reference implementation of argon2id
+	hashed = "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"
+	require.True(t, CompareHash(hashed, "password", "", HashArgon2id))
+}
+
+func TestPbkdf2(t *testing.T) {
+	hashed := Pbkdf2("123456")
+	require.True(t, strings.HasPrefix(hashed, "$pbkdf2-sha256$i=600000$"))
+	require.NotEqual(t, hashed, Pbkdf2("123456"))
+	require.True(t, CompareHash(hashed, "123456", "", HashPbkdf2))
+	require.False(t, CompareHash(hashed, "1234567", "", HashPbkdf2))
+
+	// hashlib.pbkdf2_hmac("sha512", b"123456", b"comqtt-salt-0001", 1000, 32)
+	hashed = "$pbkdf2-sha512$i=1000$Y29tcXR0LXNhbHQtMDAwMQ$y+UXBqlathdIXWpjoaUKBFVSBEfbRApCUxDGAcVpjJ8"
+	require.True(t, CompareHash(hashed, "123456", "", HashPbkdf2))
+}
+
+func TestCompareHashInvalid(t *testing.T) {
+	for _, hashed := range []string{
+		"$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ",
+		"$argon2id$v=16$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"$argon2id$v=19$m=0,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$!!",
+		"$pbkdf2-md5$i=1000$Y29tcXR0LXNhbHQtMDAwMQ$y+UXBqlathdIXWpjoaUKBFVSBEfbRApCUxDGAcVpjJ8",
+		"$pbkdf2-sha512$i=0$Y29tcXR0LXNhbHQtMDAwMQ$y+UXBqlathdIXWpjoaUKBFVSBEfbRApCUxDGAcVpjJ8",
+		"$pbkdf2-sha512$i=1000$Y29tcXR0LXNhbHQtMDAwMQ$",
+	} {
+		require.False(t, CompareHash(hashed, "123456", "", HashArgon2id), hashed)
+	}
+}
+
+func TestCompareHashDetected(t *testing.T) {
+	// unsalted hashes are migrated to self-describing hashes one user at a time
+	require.True(t, CompareHash(Sha256("123456"), "123456", "", HashSha256))
+	require.True(t, CompareHash(Argon2id("123456"), "123456", "", HashSha256))
+	require.True(t, CompareHash(Pbkdf2("123456"), "123456", "", HashSha256))
+	require.True(t, CompareHash(Bcrypt("123456"), "123456", "", HashSha256))
+	require.False(t, CompareHash(Pbkdf2("123456"), "654321", "", HashSha256))
+
+	ht, ok := DetectHash(Sha256("123456"))
+	require.False(t, ok)
+	require.Equal(t, HashType(0), ht)
+	ht, ok = DetectHash(Bcrypt("123456"))
+	require.True(t, ok)
+	require.Equal(t, HashBcrypt, ht)
+}
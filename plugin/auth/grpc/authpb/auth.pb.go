@@ -0,0 +1,664 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.6
+// 	protoc        v3.21.12
+// source: plugin/auth/grpc/authpb/auth.proto
+
+package authpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type AuthenticateRequest struct {
+	state           protoimpl.MessageState `protogen:"open.v1"`
+	User            string                 `protobuf:"bytes,1,opt,name=user,proto3" json:"user,omitempty"` // the username or client id, following the auth-mode
+	ClientId        string                 `protobuf:"bytes,2,opt,name=clientId,proto3" json:"clientId,omitempty"`
+	Username        string                 `protobuf:"bytes,3,opt,name=username,proto3" json:"username,omitempty"`
+	Password        []byte                 `protobuf:"bytes,4,opt,name=password,proto3" json:"password,omitempty"`
+	Remote          string                 `protobuf:"bytes,5,opt,name=remote,proto3" json:"remote,omitempty"`
+	Listener        string                 `protobuf:"bytes,6,opt,name=listener,proto3" json:"listener,omitempty"`
+	ProtocolVersion uint32                 `protobuf:"varint,7,opt,name=protocolVersion,proto3" json:"protocolVersion,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *AuthenticateRequest) Reset() {
+	*x = AuthenticateRequest{}
+	mi := &file_plugin_auth_grpc_authpb_auth_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AuthenticateRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AuthenticateRequest) ProtoMessage() {}
+
+func (x *AuthenticateRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_plugin_auth_grpc_authpb_auth_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AuthenticateRequest.ProtoReflect.Descriptor instead.
+func (*AuthenticateRequest) Descriptor() ([]byte, []int) {
+	return file_plugin_auth_grpc_authpb_auth_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *AuthenticateRequest) GetUser() string {
+	if x != nil {
+		return x.User
+	}
+	return ""
+}
+
+func (x *AuthenticateRequest) GetClientId() string {
+	if x != nil {
+		return x.ClientId
+	}
+	return ""
+}
+
+func (x *AuthenticateRequest) GetUsername() string {
+	if x != nil {
+		return x.Username
+	}
+	return ""
+}
+
+func (x *AuthenticateRequest) GetPassword() []byte {
+	if x != nil {
+		return x.Password
+	}
+	return nil
+}
+
+func (x *AuthenticateRequest) GetRemote() string {
+	if x != nil {
+		return x.Remote
+	}
+	return ""
+}
+
+func (x *AuthenticateRequest) GetListener() string {
+	if x != nil {
+		return x.Listener
+	}
+	return ""
+}
+
+func (x *AuthenticateRequest) GetProtocolVersion() uint32 {
+	if x != nil {
+		return x.ProtocolVersion
+	}
+	return 0
+}
+
+type AuthenticateResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Allow         bool                   `protobuf:"varint,1,opt,name=allow,proto3" json:"allow,omitempty"`
+	Superuser     bool                   `protobuf:"varint,2,opt,name=superuser,proto3" json:"superuser,omitempty"` // superusers skip acl checks
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AuthenticateResponse) Reset() {
+	*x = AuthenticateResponse{}
+	mi := &file_plugin_auth_grpc_authpb_auth_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AuthenticateResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AuthenticateResponse) ProtoMessage() {}
+
+func (x *AuthenticateResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_plugin_auth_grpc_authpb_auth_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AuthenticateResponse.ProtoReflect.Descriptor instead.
+func (*AuthenticateResponse) Descriptor() ([]byte, []int) {
+	return file_plugin_auth_grpc_authpb_auth_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *AuthenticateResponse) GetAllow() bool {
+	if x != nil {
+		return x.Allow
+	}
+	return false
+}
+
+func (x *AuthenticateResponse) GetSuperuser() bool {
+	if x != nil {
+		return x.Superuser
+	}
+	return false
+}
+
+type AclRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	User          string                 `protobuf:"bytes,1,opt,name=user,proto3" json:"user,omitempty"` // the username or client id, following the acl-mode
+	ClientId      string                 `protobuf:"bytes,2,opt,name=clientId,proto3" json:"clientId,omitempty"`
+	Username      string                 `protobuf:"bytes,3,opt,name=username,proto3" json:"username,omitempty"`
+	Topic         string                 `protobuf:"bytes,4,opt,name=topic,proto3" json:"topic,omitempty"`
+	Write         bool                   `protobuf:"varint,5,opt,name=write,proto3" json:"write,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AclRequest) Reset() {
+	*x = AclRequest{}
+	mi := &file_plugin_auth_grpc_authpb_auth_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AclRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AclRequest) ProtoMessage() {}
+
+func (x *AclRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_plugin_auth_grpc_authpb_auth_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AclRequest.ProtoReflect.Descriptor instead.
+func (*AclRequest) Descriptor() ([]byte, []int) {
+	return file_plugin_auth_grpc_authpb_auth_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *AclRequest) GetUser() string {
+	if x != nil {
+		return x.User
+	}
+	return ""
+}
+
+func (x *AclRequest) GetClientId() string {
+	if x != nil {
+		return x.ClientId
+	}
+	return ""
+}
+
+func (x *AclRequest) GetUsername() string {
+	if x != nil {
+		return x.Username
+	}
+	return ""
+}
+
+func (x *AclRequest) GetTopic() string {
+	if x != nil {
+		return x.Topic
+	}
+	return ""
+}
+
+func (x *AclRequest) GetWrite() bool {
+	if x != nil {
+		return x.Write
+	}
+	return false
+}
+
+type AclResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Allow         bool                   `protobuf:"varint,1,opt,name=allow,proto3" json:"allow,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AclResponse) Reset() {
+	*x = AclResponse{}
+	mi := &file_plugin_auth_grpc_authpb_auth_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AclResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AclResponse) ProtoMessage() {}
+
+func (x *AclResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_plugin_auth_grpc_authpb_auth_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AclResponse.ProtoReflect.Descriptor instead.
+func (*AclResponse) Descriptor() ([]byte, []int) {
+	return file_plugin_auth_grpc_authpb_auth_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *AclResponse) GetAllow() bool {
+	if x != nil {
+		return x.Allow
+	}
+	return false
+}
+
+type Ping struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Timestamp     int64                  `protobuf:"varint,1,opt,name=timestamp,proto3" json:"timestamp,omitempty"` // unix milliseconds the ping was sent
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Ping) Reset() {
+	*x = Ping{}
+	mi := &file_plugin_auth_grpc_authpb_auth_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Ping) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Ping) ProtoMessage() {}
+
+func (x *Ping) ProtoReflect() protoreflect.Message {
+	mi := &file_plugin_auth_grpc_authpb_auth_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Ping.ProtoReflect.Descriptor instead.
+func (*Ping) Descriptor() ([]byte, []int) {
+	return file_plugin_auth_grpc_authpb_auth_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *Ping) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+type Pong struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Timestamp     int64                  `protobuf:"varint,1,opt,name=timestamp,proto3" json:"timestamp,omitempty"` // the timestamp of the ping
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Pong) Reset() {
+	*x = Pong{}
+	mi := &file_plugin_auth_grpc_authpb_auth_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Pong) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Pong) ProtoMessage() {}
+
+func (x *Pong) ProtoReflect() protoreflect.Message {
+	mi := &file_plugin_auth_grpc_authpb_auth_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Pong.ProtoReflect.Descriptor instead.
+func (*Pong) Descriptor() ([]byte, []int) {
+	return file_plugin_auth_grpc_authpb_auth_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *Pong) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+var File_plugin_auth_grpc_authpb_auth_proto protoreflect.FileDescriptor
+
+const file_plugin_auth_grpc_authpb_auth_proto_rawDesc = "" +
+	"\n" +
+	"\"plugin/auth/grpc/authpb/auth.proto\x12\x0ecomqtt.auth.v1\"\xdb\x01\n" +
+	"\x13AuthenticateRequest\x12\x12\n" +
+	"\x04user\x18\x01 \x01(\tR\x04user\x12\x1a\n" +
+	"\bclientId\x18\x02 \x01(\tR\bclientId\x12\x1a\n" +
+	"\busername\x18\x03 \x01(\tR\busername\x12\x1a\n" +
+	"\bpassword\x18\x04 \x01(\fR\bpassword\x12\x16\n" +
+	"\x06remote\x18\x05 \x01(\tR\x06remote\x12\x1a\n" +
+	"\blistener\x18\x06 \x01(\tR\blistener\x12(\n" +
+	"\x0fprotocolVersion\x18\a \x01(\rR\x0fprotocolVersion\"J\n" +
+	"\x14AuthenticateResponse\x12\x14\n" +
+	"\x05allow\x18\x01 \x01(\bR\x05allow\x12\x1c\n" +
+	"\tsuperuser\x18\x02 \x01(\bR\tsuperuser\"\x84\x01\n" +
+	"\n" +
+	"AclRequest\x12\x12\n" +
+	"\x04user\x18\x01 \x01(\tR\x04user\x12\x1a\n" +
+	"\bclientId\x18\x02 \x01(\tR\bclientId\x12\x1a\n" +
+	"\busername\x18\x03 \x01(\tR\busername\x12\x14\n" +
+	"\x05topic\x18\x04 \x01(\tR\x05topic\x12\x14\n" +
+	"\x05write\x18\x05 \x01(\bR\x05write\"#\n" +
+	"\vAclResponse\x12\x14\n" +
+	"\x05allow\x18\x01 \x01(\bR\x05allow\"$\n" +
+	"\x04Ping\x12\x1c\n" +
+	"\ttimestamp\x18\x01 \x01(\x03R\ttimestamp\"$\n" +
+	"\x04Pong\x12\x1c\n" +
+	"\ttimestamp\x18\x01 \x01(\x03R\ttimestamp2\xe9\x01\n" +
+	"\x04Auth\x12[\n" +
+	"\fAuthenticate\x12#.comqtt.auth.v1.AuthenticateRequest\x1a$.comqtt.auth.v1.AuthenticateResponse\"\x00\x12E\n" +
+	"\bCheckAcl\x12\x1a.comqtt.auth.v1.AclRequest\x1a\x1b.comqtt.auth.v1.AclResponse\"\x00\x12=\n" +
+	"\tKeepalive\x12\x14.comqtt.auth.v1.Ping\x1a\x14.comqtt.auth.v1.Pong\"\x00(\x010\x01B5Z3github.com/wind-c/comqtt/v2/plugin/auth/grpc/authpbb\x06proto3"
+
+var (
+	file_plugin_auth_grpc_authpb_auth_proto_rawDescOnce sync.Once
+	file_plugin_auth_grpc_authpb_auth_proto_rawDescData []byte
+)
+
+func file_plugin_auth_grpc_authpb_auth_proto_rawDescGZIP() []byte {
+	file_plugin_auth_grpc_authpb_auth_proto_rawDescOnce.Do(func() {
+		file_plugin_auth_grpc_authpb_auth_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_plugin_auth_grpc_authpb_auth_proto_rawDesc), len(file_plugin_auth_grpc_authpb_auth_proto_rawDesc)))
+	})
+	return file_plugin_auth_grpc_authpb_auth_proto_rawDescData
+}
+
+var file_plugin_auth_grpc_authpb_auth_proto_msgTypes = make([]protoimpl.MessageInfo, 6)
+var file_plugin_auth_grpc_authpb_auth_proto_goTypes = []any{
+	(*AuthenticateRequest)(nil),  // 0: comqtt.auth.v1.AuthenticateRequest
+	(*AuthenticateResponse)(nil), // 1: comqtt.auth.v1.AuthenticateResponse
+	(*AclRequest)(nil),           // 2: comqtt.auth.v1.AclRequest
+	(*AclResponse)(nil),          // 3: comqtt.auth.v1.AclResponse
+	(*Ping)(nil),                 // 4: comqtt.auth.v1.Ping
+	(*Pong)(nil),                 // 5: comqtt.auth.v1.Pong
+}
+var file_plugin_auth_grpc_authpb_auth_proto_depIdxs = []int32{
+	0, // 0: comqtt.auth.v1.Auth.Authenticate:input_type -> comqtt.auth.v1.AuthenticateRequest
+	2, // 1: comqtt.auth.v1.Auth.CheckAcl:input_type -> comqtt.auth.v1.AclRequest
+	4, // 2: comqtt.auth.v1.Auth.Keepalive:input_type -> comqtt.auth.v1.Ping
+	1, // 3: comqtt.auth.v1.Auth.Authenticate:output_type -> comqtt.auth.v1.AuthenticateResponse
+	3, // 4: comqtt.auth.v1.Auth.CheckAcl:output_type -> comqtt.auth.v1.AclResponse
+	5, // 5: comqtt.auth.v1.Auth.Keepalive:output_type -> comqtt.auth.v1.Pong
+	3, // [3:6] is the sub-list for method output_type
+	0, // [0:3] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_plugin_auth_grpc_authpb_auth_proto_init() }
+func file_plugin_auth_grpc_authpb_auth_proto_init() {
+	if File_plugin_auth_grpc_authpb_auth_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_plugin_auth_grpc_authpb_auth_proto_rawDesc), len(file_plugin_auth_grpc_authpb_auth_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   6,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_plugin_auth_grpc_authpb_auth_proto_goTypes,
+		DependencyIndexes: file_plugin_auth_grpc_authpb_auth_proto_depIdxs,
+		MessageInfos:      file_plugin_auth_grpc_authpb_auth_proto_msgTypes,
+	}.Build()
+	File_plugin_auth_grpc_authpb_auth_proto = out.File
+	file_plugin_auth_grpc_authpb_auth_proto_goTypes = nil
+	file_plugin_auth_grpc_authpb_auth_proto_depIdxs = nil
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConnInterface
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion6
+
+// AuthClient is the client API for Auth service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type AuthClient interface {
+	// Authenticate returns whether a connecting client is allowed to connect.
+	Authenticate(ctx context.Context, in *AuthenticateRequest, opts ...grpc.CallOption) (*AuthenticateResponse, error)
+	// CheckAcl returns whether a client may publish or subscribe to a topic.
+	CheckAcl(ctx context.Context, in *AclRequest, opts ...grpc.CallOption) (*AclResponse, error)
+	// Keepalive answers each ping sent by the broker with a pong, so that the broker
+	// notices when the service becomes unavailable.
+	Keepalive(ctx context.Context, opts ...grpc.CallOption) (Auth_KeepaliveClient, error)
+}
+
+type authClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAuthClient(cc grpc.ClientConnInterface) AuthClient {
+	return &authClient{cc}
+}
+
+func (c *authClient) Authenticate(ctx context.Context, in *AuthenticateRequest, opts ...grpc.CallOption) (*AuthenticateResponse, error) {
+	out := new(AuthenticateResponse)
+	err := c.cc.Invoke(ctx, "/comqtt.auth.v1.Auth/Authenticate", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *authClient) CheckAcl(ctx context.Context, in *AclRequest, opts ...grpc.CallOption) (*AclResponse, error) {
+	out := new(AclResponse)
+	err := c.cc.Invoke(ctx, "/comqtt.auth.v1.Auth/CheckAcl", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *authClient) Keepalive(ctx context.Context, opts ...grpc.CallOption) (Auth_KeepaliveClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Auth_serviceDesc.Streams[0], "/comqtt.auth.v1.Auth/Keepalive", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &authKeepaliveClient{stream}
+	return x, nil
+}
+
+type Auth_KeepaliveClient interface {
+	Send(*Ping) error
+	Recv() (*Pong, error)
+	grpc.ClientStream
+}
+
+type authKeepaliveClient struct {
+	grpc.ClientStream
+}
+
+func (x *authKeepaliveClient) Send(m *Ping) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *authKeepaliveClient) Recv() (*Pong, error) {
+	m := new(Pong)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// AuthServer is the server API for Auth service.
+type AuthServer interface {
+	// Authenticate returns whether a connecting client is allowed to connect.
+	Authenticate(context.Context, *AuthenticateRequest) (*AuthenticateResponse, error)
+	// CheckAcl returns whether a client may publish or subscribe to a topic.
+	CheckAcl(context.Context, *AclRequest) (*AclResponse, error)
+	// Keepalive answers each ping sent by the broker with a pong, so that the broker
+	// notices when the service becomes unavailable.
+	Keepalive(Auth_KeepaliveServer) error
+}
+
+// UnimplementedAuthServer can be embedded to have forward compatible implementations.
+type UnimplementedAuthServer struct {
+}
+
+func (*UnimplementedAuthServer) Authenticate(context.Context, *AuthenticateRequest) (*AuthenticateResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Authenticate not implemented")
+}
+func (*UnimplementedAuthServer) CheckAcl(context.Context, *AclRequest) (*AclResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CheckAcl not implemented")
+}
+func (*UnimplementedAuthServer) Keepalive(Auth_KeepaliveServer) error {
+	return status.Errorf(codes.Unimplemented, "method Keepalive not implemented")
+}
+
+func RegisterAuthServer(s *grpc.Server, srv AuthServer) {
+	s.RegisterService(&_Auth_serviceDesc, srv)
+}
+
+func _Auth_Authenticate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AuthenticateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AuthServer).Authenticate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/comqtt.auth.v1.Auth/Authenticate",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AuthServer).Authenticate(ctx, req.(*AuthenticateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Auth_CheckAcl_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AclRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AuthServer).CheckAcl(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/comqtt.auth.v1.Auth/CheckAcl",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AuthServer).CheckAcl(ctx, req.(*AclRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Auth_Keepalive_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(AuthServer).Keepalive(&authKeepaliveServer{stream})
+}
+
+type Auth_KeepaliveServer interface {
+	Send(*Pong) error
+	Recv() (*Ping, error)
+	grpc.ServerStream
+}
+
+type authKeepaliveServer struct {
+	grpc.ServerStream
+}
+
+func (x *authKeepaliveServer) Send(m *Pong) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *authKeepaliveServer) Recv() (*Ping, error) {
+	m := new(Ping)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+var _Auth_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "comqtt.auth.v1.Auth",
+	HandlerType: (*AuthServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Authenticate",
+			Handler:    _Auth_Authenticate_Handler,
+		},
+		{
+			MethodName: "CheckAcl",
+			Handler:    _Auth_CheckAcl_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Keepalive",
+			Handler:       _Auth_Keepalive_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "plugin/auth/grpc/authpb/auth.proto",
+}
@@ -0,0 +1,377 @@
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/plugin"
+	pa "github.com/wind-c/comqtt/v2/plugin/auth"
+	"github.com/wind-c/comqtt/v2/plugin/auth/grpc/authpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	FailClosed = "closed" // clients are denied while the auth service is unavailable
+	FailOpen   = "open"   // clients are allowed while the auth service is unavailable
+
+	defaultDeadline = 2000 // milliseconds to wait for each call
+	keepaliveMisses = 3    // unanswered keepalive intervals after which the service is unavailable
+)
+
+var (
+	ErrNoAddr            = errors.New("auth service addr is required")
+	ErrInvalidFailPolicy = errors.New("invalid fail-policy, expected closed or open")
+	ErrInvalidCa         = errors.New("no certificates found in tls-ca")
+	ErrKeepaliveTimeout  = errors.New("auth service keepalive timed out")
+)
+
+type Options struct {
+	pa.Blacklist
+	AuthMode   byte            `json:"auth-mode" yaml:"auth-mode"`
+	AclMode    byte            `json:"acl-mode" yaml:"acl-mode"`
+	Addr       string          `json:"addr" yaml:"addr"` // host:port of the auth service
+	TlsEnable  bool            `json:"tls-enable" yaml:"tls-enable"`
+	TlsCert    string          `json:"tls-cert" yaml:"tls-cert"` // client certificate presented to the auth service
+	TlsKey     string          `json:"tls-key" yaml:"tls-key"`
+	TlsCa      string          `json:"tls-ca" yaml:"tls-ca"`           // ca which verifies the auth service, the system roots if empty
+	Deadline   int64           `json:"deadline" yaml:"deadline"`       // milliseconds to wait for each call, default 2000
+	Keepalive  int64           `json:"keepalive" yaml:"keepalive"`     // seconds between keepalive pings, 0 to disable
+	FailPolicy string          `json:"fail-policy" yaml:"fail-policy"` // closed or open, default closed
+	Outbound   plugin.Outbound `json:"outbound" yaml:"outbound"`
+}
+
+// Auth is an auth controller which asks an external grpc service implementing the
+// authpb.Auth service whether clients may connect and access topics. While the service
+// is unavailable, clients are allowed or denied following the fail policy.
+type Auth struct {
+	mqtt.HookBase
+	config  *Options
+	conn    *grpc.ClientConn
+	client  authpb.AuthClient
+	healthy atomic.Bool // false while the keepalive stream is down
+	cancel  context.CancelFunc
+	metrics pa.Metrics
+}
+
+// ID returns the ID of the hook.
+func (a *Auth) ID() string {
+	return "auth-grpc"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (a *Auth) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnACLCheck,
+	}, []byte{b})
+}
+
+func (a *Auth) Init(config any) error {
+	if _, ok := config.(*Options); config == nil || (!ok && config != nil) {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	a.config = config.(*Options)
+	if a.config.Addr == "" {
+		return ErrNoAddr
+	}
+	if a.config.Deadline <= 0 {
+		a.config.Deadline = defaultDeadline
+	}
+	if a.config.FailPolicy == "" {
+		a.config.FailPolicy = FailClosed
+	}
+	if a.config.FailPolicy != FailClosed && a.config.FailPolicy != FailOpen {
+		return ErrInvalidFailPolicy
+	}
+	a.Log.Info("connecting to grpc auth service", "addr", a.config.Addr, "tls", a.config.TlsEnable,
+		"deadline", a.config.Deadline, "keepalive", a.config.Keepalive, "fail-policy", a.config.FailPolicy)
+
+	creds := insecure.NewCredentials()
+	if a.config.TlsEnable {
+		tlsConfig, err := a.config.tlsConfig()
+		if err != nil {
+			return err
+		}
+		creds = credentials.NewTLS(tlsConfig)
+	}
+
+	dialOpts := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	if a.config.Outbound.Enabled() {
+		dial, err := a.config.Outbound.Dialer()
+		if err != nil {
+			return err
+		}
+		dialOpts = append(dialOpts, grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return dial(ctx, "tcp", addr)
+		}))
+	}
+
+	conn, err := grpc.NewClient(a.config.Addr, dialOpts...)
+	if err != nil {
+		return err
+	}
+	a.conn = conn
+	a.client = authpb.NewAuthClient(conn)
+	a.healthy.Store(true)
+
+	if a.config.Keepalive > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		a.cancel = cancel
+		go a.keepalive(ctx, time.Duration(a.config.Keepalive)*time.Second)
+	}
+
+	return nil
+}
+
+// tlsConfig returns the tls config of the connection to the auth service.
+func (o *Options) tlsConfig() (*tls.Config, error) {
+	c := &tls.Config{MinVersion: tls.VersionTLS12}
+	if o.TlsCert != "" || o.TlsKey != "" {
+		cert, err := tls.LoadX509KeyPair(o.TlsCert, o.TlsKey)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	if o.TlsCa != "" {
+		b, err := os.ReadFile(o.TlsCa)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(b) {
+			return nil, ErrInvalidCa
+		}
+	}
+
+	return c, nil
+}
+
+// Stop stops the keepalive stream and closes the connection to the auth service.
+func (a *Auth) Stop() error {
+	a.Log.Info("disconnecting from grpc auth service")
+	if a.cancel != nil {
+		a.cancel()
+		a.cancel = nil
+	}
+	if a.conn != nil {
+		return a.conn.Close()
+	}
+	return nil
+}
+
+// keepalive keeps a keepalive stream open to the auth service until cancelled, marking
+// the service unavailable while the stream is down or its pings are not answered.
+func (a *Auth) keepalive(ctx context.Context, interval time.Duration) {
+	for {
+		err := a.ping(ctx, interval)
+		if ctx.Err() != nil {
+			return
+		} else if status.Code(err) == codes.Unimplemented {
+			a.Log.Warn("grpc auth service does not implement keepalive", "error", err)
+			a.healthy.Store(true)
+			return
+		}
+
+		if a.healthy.Swap(false) {
+			a.Log.Warn("grpc auth service is unavailable", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// ping sends a ping on a keepalive stream every interval, returning once the stream fails
+// or the pings have not been answered for a number of intervals.
+func (a *Auth) ping(ctx context.Context, interval time.Duration) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := a.client.Keepalive(ctx)
+	if err != nil {
+		return err
+	}
+
+	var last atomic.Int64 // unix nanoseconds of the last pong
+	last.Store(time.Now().UnixNano())
+	done := make(chan error, 1)
+	go func() {
+		for {
+			if _, err := stream.Recv(); err != nil {
+				done <- err
+				return
+			}
+			last.Store(time.Now().UnixNano())
+			if !a.healthy.Swap(true) {
+				a.Log.Info("grpc auth service is available")
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := stream.Send(&authpb.Ping{Timestamp: time.Now().UnixMilli()}); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-done:
+			return err
+		case <-ticker.C:
+			if time.Since(time.Unix(0, last.Load())) > keepaliveMisses*interval {
+				return ErrKeepaliveTimeout
+			}
+		}
+	}
+}
+
+// fail returns whether a client is allowed when the auth service could not be asked.
+func (a *Auth) fail() bool {
+	return a.config.FailPolicy == FailOpen
+}
+
+// failed returns whether a client is allowed after a call to the auth service failed,
+// following the fail policy if the service was unreachable or did not answer in time,
+// and denying it if the service answered with any other error.
+func (a *Auth) failed(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+		return a.fail()
+	default:
+		return false
+	}
+}
+
+// OnConnectAuthenticate returns true if the auth service allows the connecting client,
+// or if it is unavailable and the fail policy is open.
+func (a *Auth) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	if !pa.DecidedBy(cl, a.ID()) { // denied by an earlier datasource of the auth chain
+		return false
+	}
+
+	return pa.Decide(cl, a.ID(), a.metrics.Auth(a.authenticateClient(cl, pk)))
+}
+
+// authenticateClient returns whether the auth service allows the connecting client, or Unknown
+// if it fails and the fail policy is closed.
+func (a *Auth) authenticateClient(cl *mqtt.Client, pk packets.Packet) pa.Result {
+	if a.config.AuthMode == byte(auth.AuthAnonymous) {
+		return pa.Allow
+	}
+
+	// check blacklist
+	if n, ok := a.config.CheckBLAuth(cl, pk); n >= 0 { // It's on the blacklist
+		return pa.ResultOf(ok)
+	}
+
+	// normal verification
+	var key string
+	if a.config.AuthMode == byte(auth.AuthUsername) {
+		key = string(cl.Properties.Username)
+	} else if a.config.AuthMode == byte(auth.AuthClientID) {
+		key = cl.ID
+	} else {
+		return pa.Unknown
+	}
+
+	if !a.healthy.Load() {
+		a.Log.Debug("grpc auth service is unavailable, applying fail policy", "client", cl.ID, "fail-policy", a.config.FailPolicy)
+		return failure(a.fail())
+	}
+
+	defer a.metrics.Lookup(time.Now())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(a.config.Deadline)*time.Millisecond)
+	defer cancel()
+	res, err := a.client.Authenticate(ctx, &authpb.AuthenticateRequest{
+		User:            key,
+		ClientId:        cl.ID,
+		Username:        string(cl.Properties.Username),
+		Password:        pk.Connect.Password,
+		Remote:          cl.Net.Remote,
+		Listener:        cl.Net.Listener,
+		ProtocolVersion: uint32(cl.Properties.ProtocolVersion),
+	})
+	if err != nil {
+		a.Log.Warn("grpc auth request failed", "error", err, "client", cl.ID, "fail-policy", a.config.FailPolicy)
+		return failure(a.failed(err))
+	}
+
+	if res.GetAllow() && res.GetSuperuser() {
+		pa.SetSuperuser(cl)
+	}
+
+	return pa.ResultOf(res.GetAllow())
+}
+
+// failure returns Allow if the fail policy allows clients while the auth service fails,
+// otherwise Unknown so that the next datasource of an auth chain is tried.
+func failure(open bool) pa.Result {
+	if open {
+		return pa.Allow
+	}
+	return pa.Unknown
+}
+
+// OnACLCheck returns true if the auth service allows the client read or write access to a
+// topic, or if it is unavailable and the fail policy is open.
+func (a *Auth) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	return a.config.AuthorizeClient(a.ID(), a.config.AclMode, &a.metrics, cl, topic, write, a.lookupAcl)
+}
+
+// lookupAcl returns true if the acl of the client in the auth service allows it to
+// subscribe or publish to a topic.
+func (a *Auth) lookupAcl(cl *mqtt.Client, topic string, write bool) bool {
+	key, ok := pa.AclKey(cl, a.config.AclMode)
+	if !ok {
+		return false
+	}
+
+	if !a.healthy.Load() {
+		return a.fail()
+	}
+
+	defer a.metrics.Lookup(time.Now())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(a.config.Deadline)*time.Millisecond)
+	defer cancel()
+	res, err := a.client.CheckAcl(ctx, &authpb.AclRequest{
+		User:     key,
+		ClientId: cl.ID,
+		Username: string(cl.Properties.Username),
+		Topic:    topic,
+		Write:    write,
+	})
+	if err != nil {
+		a.Log.Warn("grpc acl request failed", "error", err, "client", cl.ID, "fail-policy", a.config.FailPolicy)
+		return a.failed(err)
+	}
+
+	return res.GetAllow()
+}
+
+// AuthMetrics returns the decisions, datasource latency and cache hits of the hook.
+func (a *Auth) AuthMetrics() mqtt.AuthMetrics {
+	return a.metrics.Snapshot(a.ID(), nil)
+}
@@ -0,0 +1,308 @@
+package grpc
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/plugin"
+	pa "github.com/wind-c/comqtt/v2/plugin/auth"
+	"github.com/wind-c/comqtt/v2/plugin/auth/grpc/authpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const path = "./conf.yml"
+
+var (
+	// Currently, the input is directed to /dev/null. If you need to
+	// output to stdout, just modify 'io.Discard' here to 'os.Stdout'.
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	pkc = packets.Packet{Connect: packets.ConnectParams{Password: []byte("321654")}}
+)
+
+func newClient(id, username string) *mqtt.Client {
+	return &mqtt.Client{
+		ID: id,
+		Net: mqtt.ClientConnection{
+			Remote:   "test.addr",
+			Listener: "listener",
+		},
+		Properties: mqtt.ClientProperties{
+			Username:        []byte(username),
+			ProtocolVersion: 5,
+		},
+	}
+}
+
+// authService is a test auth service allowing zhangsan with the password 321654 to
+// write to a/# and read b/#, and root as a superuser.
+type authService struct {
+	authpb.UnimplementedAuthServer
+	auths   atomic.Int32
+	acls    atomic.Int32
+	pongs   atomic.Bool // whether keepalive pings are answered
+	lastReq atomic.Pointer[authpb.AuthenticateRequest]
+}
+
+func (s *authService) Authenticate(ctx context.Context, req *authpb.AuthenticateRequest) (*authpb.AuthenticateResponse, error) {
+	s.auths.Add(1)
+	s.lastReq.Store(req)
+	switch {
+	case req.User == "slow":
+		<-ctx.Done()
+		return nil, ctx.Err()
+	case req.User == "broken":
+		return nil, status.Error(codes.Internal, "broken")
+	case req.User == "root":
+		return &authpb.AuthenticateResponse{Allow: true, Superuser: true}, nil
+	}
+	return &authpb.AuthenticateResponse{Allow: req.User == "zhangsan" && string(req.Password) == "321654"}, nil
+}
+
+func (s *authService) CheckAcl(ctx context.Context, req *authpb.AclRequest) (*authpb.AclResponse, error) {
+	s.acls.Add(1)
+	if req.User != "zhangsan" {
+		return &authpb.AclResponse{}, nil
+	}
+	allow := plugin.MatchTopic("a/#", req.Topic) || (!req.Write && plugin.MatchTopic("b/#", req.Topic))
+	return &authpb.AclResponse{Allow: allow}, nil
+}
+
+func (s *authService) Keepalive(stream authpb.Auth_KeepaliveServer) error {
+	for {
+		ping, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if !s.pongs.Load() {
+			continue
+		}
+		if err := stream.Send(&authpb.Pong{Timestamp: ping.Timestamp}); err != nil {
+			return err
+		}
+	}
+}
+
+func newService(t *testing.T) (*authService, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	svc := new(authService)
+	svc.pongs.Store(true)
+	srv := grpc.NewServer()
+	authpb.RegisterAuthServer(srv, svc)
+	go func() {
+		_ = srv.Serve(ln)
+	}()
+	t.Cleanup(srv.Stop)
+
+	return svc, ln.Addr().String()
+}
+
+func newAuth(t *testing.T, opts *Options) *Auth {
+	a := new(Auth)
+	a.SetOpts(logger, nil)
+	if opts.AuthMode == 0 {
+		opts.AuthMode = byte(auth.AuthUsername)
+	}
+	if opts.AclMode == 0 {
+		opts.AclMode = byte(auth.AuthUsername)
+	}
+	require.NoError(t, a.Init(opts))
+	t.Cleanup(func() {
+		_ = a.Stop()
+	})
+	return a
+}
+
+func TestInitFromConfFile(t *testing.T) {
+	a := new(Auth)
+	a.SetOpts(logger, nil)
+	opts := Options{}
+	require.NoError(t, plugin.LoadYaml(path, &opts))
+	require.Equal(t, FailClosed, opts.FailPolicy)
+	require.Equal(t, int64(10), opts.Keepalive)
+	require.NoError(t, a.Init(&opts))
+	require.NoError(t, a.Stop())
+}
+
+func TestInitInvalid(t *testing.T) {
+	a := new(Auth)
+	a.SetOpts(logger, nil)
+	require.ErrorIs(t, a.Init(nil), mqtt.ErrInvalidConfigType)
+	require.ErrorIs(t, a.Init(&Options{}), ErrNoAddr)
+	require.ErrorIs(t, a.Init(&Options{Addr: "localhost:1", FailPolicy: "maybe"}), ErrInvalidFailPolicy)
+	require.Error(t, a.Init(&Options{Addr: "localhost:1", TlsEnable: true, TlsCert: "missing.crt", TlsKey: "missing.key"}))
+}
+
+func TestID(t *testing.T) {
+	a := new(Auth)
+	require.Equal(t, "auth-grpc", a.ID())
+}
+
+func TestProvides(t *testing.T) {
+	a := new(Auth)
+	require.True(t, a.Provides(mqtt.OnConnectAuthenticate))
+	require.True(t, a.Provides(mqtt.OnACLCheck))
+	require.False(t, a.Provides(mqtt.OnPublish))
+}
+
+func TestOnConnectAuthenticate(t *testing.T) {
+	svc, addr := newService(t)
+	a := newAuth(t, &Options{Addr: addr})
+
+	cl := newClient("test", "zhangsan")
+	require.True(t, a.OnConnectAuthenticate(cl, pkc))
+	req := svc.lastReq.Load()
+	require.Equal(t, "zhangsan", req.User)
+	require.Equal(t, "test", req.ClientId)
+	require.Equal(t, "test.addr", req.Remote)
+	require.Equal(t, "listener", req.Listener)
+	require.Equal(t, uint32(5), req.ProtocolVersion)
+
+	require.False(t, a.OnConnectAuthenticate(cl, packets.Packet{Connect: packets.ConnectParams{Password: []byte("wrong")}}))
+	require.False(t, a.OnConnectAuthenticate(newClient("test", "lisi"), pkc))
+}
+
+func TestOnConnectAuthenticateClientID(t *testing.T) {
+	svc, addr := newService(t)
+	a := newAuth(t, &Options{Addr: addr, AuthMode: byte(auth.AuthClientID)})
+
+	require.True(t, a.OnConnectAuthenticate(newClient("zhangsan", "other"), pkc))
+	require.Equal(t, "zhangsan", svc.lastReq.Load().User)
+	require.Equal(t, "other", svc.lastReq.Load().Username)
+}
+
+func TestOnACLCheck(t *testing.T) {
+	svc, addr := newService(t)
+	a := newAuth(t, &Options{Addr: addr})
+
+	cl := newClient("test", "zhangsan")
+	require.True(t, a.OnACLCheck(cl, "a/b", true))
+	require.True(t, a.OnACLCheck(cl, "b/c", false))
+	require.False(t, a.OnACLCheck(cl, "b/c", true))
+	require.False(t, a.OnACLCheck(cl, "c", false))
+	require.False(t, a.OnACLCheck(newClient("test", "lisi"), "a/b", true))
+	require.Equal(t, int32(5), svc.acls.Load())
+}
+
+func TestOnACLCheckSuperuser(t *testing.T) {
+	svc, addr := newService(t)
+	a := newAuth(t, &Options{Addr: addr})
+
+	cl := newClient("test", "root")
+	require.True(t, a.OnConnectAuthenticate(cl, pkc))
+	require.True(t, pa.IsSuperuser(cl))
+	require.True(t, a.OnACLCheck(cl, "any/topic", true))
+	require.Equal(t, int32(0), svc.acls.Load())
+}
+
+func TestAnonymous(t *testing.T) {
+	svc, addr := newService(t)
+	a := newAuth(t, &Options{Addr: addr})
+	a.config.AuthMode = byte(auth.AuthAnonymous)
+	a.config.AclMode = byte(auth.AuthAnonymous)
+
+	cl := newClient("test", "lisi")
+	require.True(t, a.OnConnectAuthenticate(cl, pkc))
+	require.True(t, a.OnACLCheck(cl, "c", true))
+	require.Equal(t, int32(0), svc.auths.Load())
+}
+
+func TestFailPolicy(t *testing.T) {
+	_, addr := newService(t)
+
+	closed := newAuth(t, &Options{Addr: addr, Deadline: 50})
+	open := newAuth(t, &Options{Addr: addr, Deadline: 50, FailPolicy: FailOpen})
+
+	// calls which do not answer in time follow the fail policy
+	slow := newClient("test", "slow")
+	require.False(t, closed.OnConnectAuthenticate(slow, pkc))
+	require.True(t, open.OnConnectAuthenticate(slow, pkc))
+
+	// errors answered by the service deny clients whatever the policy
+	broken := newClient("test", "broken")
+	require.False(t, closed.OnConnectAuthenticate(broken, pkc))
+	require.False(t, open.OnConnectAuthenticate(broken, pkc))
+}
+
+func TestFailPolicyUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	closed := newAuth(t, &Options{Addr: addr, Deadline: 200})
+	open := newAuth(t, &Options{Addr: addr, Deadline: 200, FailPolicy: FailOpen})
+
+	cl := newClient("test", "zhangsan")
+	require.False(t, closed.OnConnectAuthenticate(cl, pkc))
+	require.False(t, closed.OnACLCheck(cl, "a/b", true))
+	require.True(t, open.OnConnectAuthenticate(cl, pkc))
+	require.True(t, open.OnACLCheck(cl, "a/b", true))
+}
+
+func TestKeepalive(t *testing.T) {
+	svc, addr := newService(t)
+	a := newAuth(t, &Options{Addr: addr})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.keepalive(ctx, 20*time.Millisecond)
+
+	cl := newClient("test", "zhangsan")
+	require.True(t, a.OnConnectAuthenticate(cl, pkc))
+
+	// unanswered pings mark the service unavailable, denying clients without asking it
+	svc.pongs.Store(false)
+	require.Eventually(t, func() bool { return !a.healthy.Load() }, time.Second, 10*time.Millisecond)
+	auths := svc.auths.Load()
+	require.False(t, a.OnConnectAuthenticate(cl, pkc))
+	require.False(t, a.OnACLCheck(cl, "a/b", true))
+	require.Equal(t, auths, svc.auths.Load())
+
+	a.config.FailPolicy = FailOpen
+	require.True(t, a.OnConnectAuthenticate(newClient("test", "lisi"), pkc))
+	a.config.FailPolicy = FailClosed
+
+	// the service is available again once the pings are answered
+	svc.pongs.Store(true)
+	require.Eventually(t, func() bool { return a.healthy.Load() }, time.Second, 10*time.Millisecond)
+	require.True(t, a.OnConnectAuthenticate(cl, pkc))
+}
+
+func TestKeepaliveUnimplemented(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := grpc.NewServer()
+	authpb.RegisterAuthServer(srv, new(authpb.UnimplementedAuthServer))
+	go func() {
+		_ = srv.Serve(ln)
+	}()
+	defer srv.Stop()
+
+	a := newAuth(t, &Options{Addr: ln.Addr().String()})
+	done := make(chan struct{})
+	go func() {
+		a.keepalive(context.Background(), 20*time.Millisecond)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("keepalive did not stop")
+	}
+	require.True(t, a.healthy.Load())
+}
@@ -0,0 +1,77 @@
+package http
+
+import (
+	"sync"
+	"time"
+)
+
+// breaker stops requests to the auth service for a cooldown once they fail a number of
+// consecutive times, then lets a single request through to probe whether the service
+// has recovered. A nil breaker lets all requests through.
+type breaker struct {
+	sync.Mutex
+	threshold int           // the consecutive failures which open the circuit
+	cooldown  time.Duration // how long the circuit stays open
+	failures  int           // the current consecutive failures
+	openUntil time.Time     // when the open circuit lets a probe through
+	probing   bool          // a probe is in flight
+}
+
+// newBreaker returns a breaker, or nil if the options disable it.
+func newBreaker(opts BreakerOptions) *breaker {
+	if opts.Failures <= 0 {
+		return nil
+	}
+
+	if opts.Cooldown <= 0 {
+		opts.Cooldown = defaultBreakerCooldown
+	}
+
+	return &breaker{
+		threshold: opts.Failures,
+		cooldown:  time.Duration(opts.Cooldown) * time.Second,
+	}
+}
+
+// allow returns true if a request may be sent to the auth service.
+func (b *breaker) allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+
+	b.probing = true
+	return true
+}
+
+// record records whether a request to the auth service succeeded, opening the circuit
+// once the failures reach the threshold, and closing it on success.
+func (b *breaker) record(ok bool) {
+	if b == nil {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.probing = false
+	if ok {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
@@ -2,12 +2,17 @@ package http
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/wind-c/comqtt/v2/mqtt"
 	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
@@ -19,25 +24,72 @@ import (
 const (
 	TypeJson = "application/json"
 	TypeForm = "application/x-www-form-urlencoded"
+
+	defaultTimeout         = 10  // seconds to wait for a response
+	defaultBackoff         = 100 // milliseconds before the first retry
+	defaultMaxBackoff      = 2000
+	defaultBreakerCooldown = 30 // seconds the circuit stays open
+	maxResponseSize        = 1 << 20
+)
+
+var (
+	ErrCircuitOpen = errors.New("auth service circuit is open")
+	ErrInvalidCa   = errors.New("no certificates found in tls-ca")
 )
 
 type Options struct {
 	pa.Blacklist
-	AuthMode    byte   `json:"auth-mode" yaml:"auth-mode"`
-	AclMode     byte   `json:"acl-mode" yaml:"acl-mode"`
-	TlsEnable   bool   `json:"tls-enable" yaml:"tls-enable"`
-	TlsCert     string `json:"tls-cert" yaml:"tls-cert"`
-	TlsKey      string `json:"tls-key" yaml:"tls-key"`
-	Method      string `json:"method" yaml:"method"`
-	ContentType string `json:"content-type" yaml:"content-type"`
-	AuthUrl     string `json:"auth-url" yaml:"auth-url"`
-	AclUrl      string `json:"acl-url" yaml:"acl-url"`
-}
-
-// Auth is an auth controller which allows access to all connections and topics.
+	AuthMode       byte              `json:"auth-mode" yaml:"auth-mode"`
+	AclMode        byte              `json:"acl-mode" yaml:"acl-mode"`
+	TlsEnable      bool              `json:"tls-enable" yaml:"tls-enable"`
+	TlsCert        string            `json:"tls-cert" yaml:"tls-cert"` // client certificate presented to the auth service
+	TlsKey         string            `json:"tls-key" yaml:"tls-key"`
+	TlsCa          string            `json:"tls-ca" yaml:"tls-ca"` // ca which verifies the auth service, the system roots if empty
+	Method         string            `json:"method" yaml:"method"`
+	ContentType    string            `json:"content-type" yaml:"content-type"`
+	Headers        map[string]string `json:"headers" yaml:"headers"` // sent with every request, such as api keys
+	AuthUrl        string            `json:"auth-url" yaml:"auth-url"`
+	AclUrl         string            `json:"acl-url" yaml:"acl-url"`
+	BulkAcl        bool              `json:"bulk-acl" yaml:"bulk-acl"` // cache the acl returned by the auth url for the connection
+	Timeout        int64             `json:"timeout" yaml:"timeout"`   // seconds to wait for a response, default 10
+	Retry          RetryOptions      `json:"retry" yaml:"retry"`
+	CircuitBreaker BreakerOptions    `json:"circuit-breaker" yaml:"circuit-breaker"`
+	Outbound       plugin.Outbound   `json:"outbound" yaml:"outbound"`
+}
+
+// RetryOptions retries requests which fail to reach the auth service or are answered
+// with a 429 or 5xx status, with an exponential backoff.
+type RetryOptions struct {
+	Attempts   int   `json:"attempts" yaml:"attempts"`       // retries after the first request, 0 to not retry
+	Backoff    int64 `json:"backoff" yaml:"backoff"`         // milliseconds before the first retry, default 100
+	MaxBackoff int64 `json:"max-backoff" yaml:"max-backoff"` // milliseconds the backoff doubles up to, default 2000
+}
+
+// BreakerOptions stops requests to the auth service while it is down, denying clients
+// immediately instead of waiting on the service for each of them.
+type BreakerOptions struct {
+	Failures int   `json:"failures" yaml:"failures"` // consecutive failed requests which open the circuit, 0 to disable
+	Cooldown int64 `json:"cooldown" yaml:"cooldown"` // seconds before a request probes the service again, default 30
+}
+
+// authResponse is a json response of the auth url, which may carry the acl filters and
+// access of the client when bulk-acl is enabled.
+type authResponse struct {
+	Allow          bool           `json:"allow"`
+	Superuser      bool           `json:"superuser"`
+	MaxConnections int            `json:"max_connections"`
+	Acl            map[string]int `json:"acl"`
+}
+
+// Auth is an auth controller which asks an http service whether clients are allowed to
+// connect, and for the acl filters of each client.
 type Auth struct {
 	mqtt.HookBase
-	config *Options
+	config  *Options
+	client  *http.Client
+	breaker *breaker
+	acls    *aclSessions
+	metrics pa.Metrics
 }
 
 // ID returns the ID of the hook.
@@ -50,6 +102,7 @@ func (a *Auth) Provides(b byte) bool {
 	return bytes.Contains([]byte{
 		mqtt.OnConnectAuthenticate,
 		mqtt.OnACLCheck,
+		mqtt.OnDisconnect,
 	}, []byte{b})
 }
 
@@ -59,21 +112,90 @@ func (a *Auth) Init(config any) error {
 	}
 
 	a.config = config.(*Options)
-	a.Log.Info("", "auth-url", a.config.AuthUrl, "acl-url", a.config.AclUrl)
+	if a.config.Method == "" {
+		a.config.Method = http.MethodPost
+	}
+	if a.config.Timeout <= 0 {
+		a.config.Timeout = defaultTimeout
+	}
+	if a.config.Retry.Backoff <= 0 {
+		a.config.Retry.Backoff = defaultBackoff
+	}
+	if a.config.Retry.MaxBackoff <= 0 {
+		a.config.Retry.MaxBackoff = defaultMaxBackoff
+	}
+	a.Log.Info("", "auth-url", a.config.AuthUrl, "acl-url", a.config.AclUrl, "method", a.config.Method,
+		"tls", a.config.TlsEnable, "retries", a.config.Retry.Attempts, "breaker-failures", a.config.CircuitBreaker.Failures)
+
+	tlsConfig, err := a.config.tlsConfig()
+	if err != nil {
+		return err
+	}
+
+	a.client = new(http.Client)
+	if tlsConfig != nil || a.config.Outbound.Enabled() {
+		if a.client, err = a.config.Outbound.HTTPClient(tlsConfig); err != nil {
+			return err
+		}
+	}
+	a.client.Timeout = time.Duration(a.config.Timeout) * time.Second
+	a.breaker = newBreaker(a.config.CircuitBreaker)
+	a.acls = newAclSessions()
 
 	return nil
 }
 
-// OnConnectAuthenticate returns true if the connecting client has rules which provide access
-// in the auth ledger.
+// tlsConfig returns the tls config of requests to the auth service, or nil if tls is
+// not enabled.
+func (o *Options) tlsConfig() (*tls.Config, error) {
+	if !o.TlsEnable {
+		return nil, nil
+	}
+
+	c := &tls.Config{MinVersion: tls.VersionTLS12}
+	if o.TlsCert != "" || o.TlsKey != "" {
+		cert, err := tls.LoadX509KeyPair(o.TlsCert, o.TlsKey)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	if o.TlsCa != "" {
+		b, err := os.ReadFile(o.TlsCa)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(b) {
+			return nil, ErrInvalidCa
+		}
+	}
+
+	return c, nil
+}
+
+// OnConnectAuthenticate returns true if the auth service answers the username or client id
+// and password of the connecting client with 1, or when bulk-acl is enabled with an allowing
+// json response, whose acl is cached for the connection.
 func (a *Auth) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	if !pa.DecidedBy(cl, a.ID()) { // denied by an earlier datasource of the auth chain
+		return false
+	}
+
+	return pa.Decide(cl, a.ID(), a.metrics.Auth(a.authenticateClient(cl, pk)))
+}
+
+// authenticateClient returns whether the auth service allows the connecting client, or Unknown
+// if the request fails.
+func (a *Auth) authenticateClient(cl *mqtt.Client, pk packets.Packet) pa.Result {
 	if a.config.AuthMode == byte(auth.AuthAnonymous) {
-		return true
+		return pa.Allow
 	}
 
 	// check blacklist
 	if n, ok := a.config.CheckBLAuth(cl, pk); n >= 0 { // It's on the blacklist
-		return ok
+		return pa.ResultOf(ok)
 	}
 
 	// normal verification
@@ -83,121 +205,188 @@ func (a *Auth) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
 	} else if a.config.AuthMode == byte(auth.AuthClientID) {
 		key = cl.ID
 	} else {
-		return false
+		return pa.Unknown
 	}
 
-	var err error
-	var resp *http.Response
-	defer func() {
-		if resp != nil {
-			resp.Body.Close()
-		}
-	}()
-
-	if a.config.Method == "get" {
-		var builder strings.Builder
-		builder.WriteString(a.config.AuthUrl)
-		builder.WriteString("?")
-		builder.WriteString("user=")
-		builder.WriteString(key)
-		builder.WriteString("&")
-		builder.WriteString("password=")
-		builder.Write(pk.Connect.Password)
-		resp, err = http.Get(builder.String())
-	} else {
-		if a.config.ContentType == TypeJson {
-			payload := make(map[string]string, 2)
-			payload["user"] = key
-			payload["password"] = string(pk.Connect.Password)
-			bytesData, _ := json.Marshal(payload)
-			resp, err = http.Post(a.config.AuthUrl, TypeJson, bytes.NewBuffer(bytesData))
-		} else {
-			payload := url.Values{}
-			payload.Add("user", key)
-			payload.Add("password", string(pk.Connect.Password))
-			resp, err = http.Post(a.config.AuthUrl, TypeForm, strings.NewReader(payload.Encode()))
-		}
+	body, err := a.request(a.config.AuthUrl, map[string]string{
+		"user":     key,
+		"password": string(pk.Connect.Password),
+	})
+	if err != nil {
+		a.Log.Warn("auth request failed", "error", err, "client", cl.ID)
+		return pa.Unknown
 	}
 
-	if err != nil {
-		return false
+	if string(body) == "1" {
+		return pa.Allow
+	} else if !a.config.BulkAcl {
+		return pa.Deny
 	}
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return false
+
+	var res authResponse
+	if err := json.Unmarshal(body, &res); err != nil || !res.Allow {
+		return pa.Deny
 	}
-	if string(body) == "1" {
-		fmt.Println("auth success")
-		return true
-	} else {
-		fmt.Println("auth failed")
-		return false
+
+	if res.Superuser {
+		pa.SetSuperuser(cl)
+	}
+	pa.SetMaxConnections(cl, res.MaxConnections)
+
+	if res.Acl != nil {
+		a.acls.Set(cl, toAccess(res.Acl))
 	}
+
+	return pa.Allow
+}
+
+// InvalidateAuthCache removes the acls cached at connect time of the clients with a username
+// or client id, or of all clients if the key is empty, whose acl checks then request the
+// acl url.
+func (a *Auth) InvalidateAuthCache(key string) int {
+	return a.acls.Invalidate(key)
+}
+
+// OnDisconnect removes the acl cached for a client at connect time.
+func (a *Auth) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	a.acls.Delete(cl)
 }
 
 // OnACLCheck returns true if the connecting client has matching read or write access to subscribe
 // or publish to a given topic.
 func (a *Auth) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
-	if a.config.AclMode == byte(auth.AuthAnonymous) {
-		return true
+	return a.config.AuthorizeClient(a.ID(), a.config.AclMode, &a.metrics, cl, topic, write, a.lookupAcl)
+}
+
+// lookupAcl returns true if the acl of the client in the http service allows it to
+// subscribe or publish to a topic.
+func (a *Auth) lookupAcl(cl *mqtt.Client, topic string, write bool) bool {
+	cached, ok := a.acls.Get(cl)
+	if a.config.BulkAcl {
+		a.metrics.Cached(ok)
+	}
+	if ok {
+		return checkAcl(cl, cached, topic, write)
 	}
 
-	// check blacklist
-	if n, ok := a.config.CheckBLAcl(cl, topic, write); n >= 0 { // It's on the blacklist
-		return ok
+	key, ok := pa.AclKey(cl, a.config.AclMode)
+	if !ok {
+		return false
 	}
-	// normal verification
-	var key string
-	if a.config.AclMode == byte(auth.AuthUsername) {
-		key = string(cl.Properties.Username)
-	} else if a.config.AclMode == byte(auth.AuthClientID) {
-		key = cl.ID
-	} else {
+
+	body, err := a.request(a.config.AclUrl, map[string]string{"user": key})
+	if err != nil {
+		a.Log.Warn("acl request failed", "error", err, "client", cl.ID)
 		return false
 	}
-	var err error
-	var resp *http.Response
-	defer func() {
-		if resp != nil {
-			resp.Body.Close()
+
+	acl := map[string]int{}
+	if err := json.Unmarshal(body, &acl); err != nil {
+		return false
+	}
+	return checkAcl(cl, toAccess(acl), topic, write)
+}
+
+// toAccess converts the acl filters and access of a response to an acl.
+func toAccess(acl map[string]int) map[string]auth.Access {
+	fam := make(map[string]auth.Access, len(acl))
+	for filter, access := range acl {
+		fam[filter] = auth.Access(access)
+	}
+	return fam
+}
+
+// checkAcl returns true if the filters of an acl matching a topic allow read or write access,
+// expanding the placeholders of the filters for the client.
+func checkAcl(cl *mqtt.Client, acl map[string]auth.Access, topic string, write bool) bool {
+	fam := make(map[string]auth.Access)
+	for filter, access := range acl {
+		if filter, ok := pa.ExpandClientFilter(cl, filter); ok && plugin.MatchTopic(filter, topic) {
+			fam[filter] = access
 		}
-	}()
-	if a.config.Method == "get" {
-		var builder strings.Builder
-		builder.WriteString(a.config.AclUrl)
-		builder.WriteString("?")
-		builder.WriteString("user=")
-		builder.WriteString(key)
-		resp, err = http.Get(builder.String())
-	} else {
+	}
+	return pa.CheckAcl(fam, write)
+}
+
+// request sends the params to a url of the auth service, in the query of GET requests or
+// the body of other requests, retrying failures with a backoff, and returns the body of
+// the response. Requests fail immediately while the circuit breaker is open.
+func (a *Auth) request(u string, params map[string]string) ([]byte, error) {
+	if !a.breaker.allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	defer a.metrics.Lookup(time.Now())
+	backoff := time.Duration(a.config.Retry.Backoff) * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		body, retry, err := a.send(u, params)
+		if err == nil || !retry || attempt >= a.config.Retry.Attempts {
+			a.breaker.record(err == nil || !retry)
+			return body, err
+		}
+
+		a.Log.Debug("retrying auth service request", "error", err, "attempt", attempt+1, "backoff", backoff)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, time.Duration(a.config.Retry.MaxBackoff)*time.Millisecond)
+	}
+}
+
+// send sends a single request to the auth service, returning the body of the response
+// and whether a failure should be retried.
+func (a *Auth) send(u string, params map[string]string) ([]byte, bool, error) {
+	values := url.Values{}
+	for k, v := range params {
+		values.Set(k, v)
+	}
+
+	var req *http.Request
+	var err error
+	method := strings.ToUpper(a.config.Method)
+	switch {
+	case method == http.MethodGet:
+		req, err = http.NewRequest(method, u+"?"+values.Encode(), nil)
+	case a.config.ContentType == TypeJson:
+		b, _ := json.Marshal(params)
+		req, err = http.NewRequest(method, u, bytes.NewReader(b))
+	default:
+		req, err = http.NewRequest(method, u, strings.NewReader(values.Encode()))
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	if req.Body != nil {
 		if a.config.ContentType == TypeJson {
-			payload := make(map[string]string, 2)
-			payload["user"] = key
-			bytesData, _ := json.Marshal(payload)
-			resp, err = http.Post(a.config.AclUrl, TypeJson, bytes.NewBuffer(bytesData))
+			req.Header.Set("Content-Type", TypeJson)
 		} else {
-			payload := url.Values{}
-			payload.Add("user", key)
-			resp, err = http.Post(a.config.AclUrl, TypeForm, strings.NewReader(payload.Encode()))
+			req.Header.Set("Content-Type", TypeForm)
 		}
 	}
-	if err != nil {
-		return false
+	for k, v := range a.config.Headers {
+		req.Header.Set(k, v)
 	}
-	body, err := io.ReadAll(resp.Body)
+
+	resp, err := a.client.Do(req)
 	if err != nil {
-		return false
+		return nil, true, err
 	}
-	fam1 := map[string]int{}
-	if err := json.Unmarshal(body, &fam1); err != nil {
-		return false
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, true, err
 	}
-	fam2 := make(map[string]auth.Access)
-	for filter, access := range fam1 {
-		if !plugin.MatchTopic(filter, topic) {
-			continue
-		}
-		fam2[filter] = auth.Access(access)
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError {
+		return nil, true, fmt.Errorf("auth service responded %s", resp.Status)
+	} else if resp.StatusCode >= http.StatusBadRequest {
+		return nil, false, fmt.Errorf("auth service responded %s", resp.Status)
 	}
-	return pa.CheckAcl(fam2, write)
+
+	return body, false, nil
+}
+
+// AuthMetrics returns the decisions, datasource latency and cache hits of the hook.
+func (a *Auth) AuthMetrics() mqtt.AuthMetrics {
+	return a.metrics.Snapshot(a.ID(), nil)
 }
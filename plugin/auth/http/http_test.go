@@ -1,9 +1,23 @@
 package http
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
 	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"log/slog"
 
@@ -201,3 +215,281 @@ func TestAclWithGet(t *testing.T) {
 	result = a.OnACLCheck(client, topic3, true)
 	require.Equal(t, false, result)
 }
+
+func newServerAuth(t *testing.T, opts *Options) *Auth {
+	a := new(Auth)
+	a.SetOpts(logger, nil)
+	opts.AuthMode = byte(auth.AuthUsername)
+	opts.AclMode = byte(auth.AuthUsername)
+	require.NoError(t, a.Init(opts))
+	return a
+}
+
+func TestAuthenticateWithHeaders(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPut, r.Method)
+		require.Equal(t, TypeForm, r.Header.Get("Content-Type"))
+		if r.Header.Get("X-Api-Key") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		require.NoError(t, r.ParseForm())
+		require.Equal(t, "zhangsan", r.PostForm.Get("user"))
+		_, _ = w.Write([]byte("1"))
+	}))
+	defer srv.Close()
+
+	a := newServerAuth(t, &Options{
+		Method:  "put",
+		Headers: map[string]string{"X-Api-Key": "secret"},
+		AuthUrl: srv.URL,
+	})
+	require.True(t, a.OnConnectAuthenticate(client, pkc))
+
+	a.config.Headers["X-Api-Key"] = "wrong"
+	require.False(t, a.OnConnectAuthenticate(client, pkc))
+}
+
+func TestAuthenticateRetry(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("1"))
+	}))
+	defer srv.Close()
+
+	a := newServerAuth(t, &Options{
+		AuthUrl: srv.URL,
+		Retry:   RetryOptions{Attempts: 1, Backoff: 1},
+	})
+	require.False(t, a.OnConnectAuthenticate(client, pkc))
+	require.Equal(t, int32(2), requests.Load())
+
+	a.config.Retry.Attempts = 2
+	require.True(t, a.OnConnectAuthenticate(client, pkc))
+	require.Equal(t, int32(3), requests.Load())
+}
+
+func TestAuthenticateNoRetryClientError(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	a := newServerAuth(t, &Options{
+		AuthUrl: srv.URL,
+		Retry:   RetryOptions{Attempts: 3, Backoff: 1},
+	})
+	require.False(t, a.OnConnectAuthenticate(client, pkc))
+	require.Equal(t, int32(1), requests.Load())
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var requests atomic.Int32
+	up := atomic.Bool{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if !up.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte("1"))
+	}))
+	defer srv.Close()
+
+	a := newServerAuth(t, &Options{
+		AuthUrl:        srv.URL,
+		CircuitBreaker: BreakerOptions{Failures: 2},
+	})
+	require.Equal(t, time.Duration(defaultBreakerCooldown)*time.Second, a.breaker.cooldown)
+
+	require.False(t, a.OnConnectAuthenticate(client, pkc))
+	require.False(t, a.OnConnectAuthenticate(client, pkc))
+	require.Equal(t, int32(2), requests.Load())
+
+	// the circuit is open, so the service is not asked
+	require.False(t, a.OnConnectAuthenticate(client, pkc))
+	_, err := a.request(srv.URL, nil)
+	require.ErrorIs(t, err, ErrCircuitOpen)
+	require.Equal(t, int32(2), requests.Load())
+
+	// a probe closes the circuit once the service is up after the cooldown
+	up.Store(true)
+	a.breaker.openUntil = time.Now().Add(-time.Second)
+	require.True(t, a.OnConnectAuthenticate(client, pkc))
+	require.True(t, a.OnConnectAuthenticate(client, pkc))
+	require.Equal(t, int32(4), requests.Load())
+}
+
+func TestBreakerProbe(t *testing.T) {
+	b := newBreaker(BreakerOptions{Failures: 1, Cooldown: 60})
+	require.True(t, b.allow())
+	b.record(false)
+	require.False(t, b.allow())
+
+	b.openUntil = time.Now().Add(-time.Second)
+	require.True(t, b.allow())
+	require.False(t, b.allow(), "only one probe is let through")
+	b.record(false)
+	require.False(t, b.allow())
+
+	require.Nil(t, newBreaker(BreakerOptions{}))
+	require.True(t, (*breaker)(nil).allow())
+}
+
+// writeKeyPair writes a self-signed certificate and key to a directory, returning their paths.
+func writeKeyPair(t *testing.T, dir, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	kb, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600))
+	return certFile, keyFile
+}
+
+func TestAuthenticateMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeKeyPair(t, dir, "comqtt")
+	clientCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	require.NoError(t, err)
+	clientCA, err := x509.ParseCertificate(clientCert.Certificate[0])
+	require.NoError(t, err)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "comqtt", r.TLS.PeerCertificates[0].Subject.CommonName)
+		_, _ = w.Write([]byte("1"))
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: x509.NewCertPool()}
+	srv.TLS.ClientCAs.AddCert(clientCA)
+	srv.StartTLS()
+	defer srv.Close()
+
+	caFile := filepath.Join(dir, "server.crt")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600))
+
+	a := newServerAuth(t, &Options{
+		TlsEnable: true,
+		TlsCert:   certFile,
+		TlsKey:    keyFile,
+		TlsCa:     caFile,
+		AuthUrl:   srv.URL,
+	})
+	require.True(t, a.OnConnectAuthenticate(client, pkc))
+
+	// without the client certificate the handshake is refused
+	b := newServerAuth(t, &Options{TlsEnable: true, TlsCa: caFile, AuthUrl: srv.URL})
+	require.False(t, b.OnConnectAuthenticate(client, pkc))
+}
+
+func TestInitInvalidTLS(t *testing.T) {
+	a := new(Auth)
+	a.SetOpts(logger, nil)
+	require.Error(t, a.Init(&Options{TlsEnable: true, TlsCert: "missing.crt", TlsKey: "missing.key"}))
+
+	ca := filepath.Join(t.TempDir(), "ca.crt")
+	require.NoError(t, os.WriteFile(ca, []byte("not a certificate"), 0600))
+	require.ErrorIs(t, a.Init(&Options{TlsEnable: true, TlsCa: ca}), ErrInvalidCa)
+}
+
+func TestBulkAcl(t *testing.T) {
+	var aclRequests atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"allow": true, "acl": {"a/b/#": 3, "a/c": 1}}`))
+	})
+	mux.HandleFunc("/acl", func(w http.ResponseWriter, r *http.Request) {
+		aclRequests.Add(1)
+		_, _ = w.Write([]byte(`{"a/b/#": 1}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	a := newServerAuth(t, &Options{
+		AuthUrl: srv.URL + "/auth",
+		AclUrl:  srv.URL + "/acl",
+		BulkAcl: true,
+	})
+	require.True(t, a.Provides(mqtt.OnDisconnect))
+
+	cl := &mqtt.Client{ID: "bulk", Properties: mqtt.ClientProperties{Username: []byte("zhangsan")}}
+	require.True(t, a.OnConnectAuthenticate(cl, pkc))
+	require.Equal(t, 1, a.acls.Len())
+	require.True(t, a.OnACLCheck(cl, "a/b/c", true))
+	require.True(t, a.OnACLCheck(cl, "a/c", false))
+	require.False(t, a.OnACLCheck(cl, "a/c", true))
+	require.False(t, a.OnACLCheck(cl, "a/d", false))
+	require.Equal(t, int32(0), aclRequests.Load())
+
+	// invalidated acls are requested from the acl url
+	require.Equal(t, 1, a.InvalidateAuthCache("zhangsan"))
+	require.False(t, a.OnACLCheck(cl, "a/b/c", true))
+	require.Equal(t, int32(1), aclRequests.Load())
+
+	require.True(t, a.OnConnectAuthenticate(cl, pkc))
+	require.Equal(t, 1, a.InvalidateAuthCache("bulk"))
+	require.True(t, a.OnConnectAuthenticate(cl, pkc))
+	require.Equal(t, 1, a.InvalidateAuthCache(""))
+
+	// a new connection taking over the client id keeps its acl when the old one disconnects
+	require.True(t, a.OnConnectAuthenticate(cl, pkc))
+	cl2 := &mqtt.Client{ID: "bulk", Properties: mqtt.ClientProperties{Username: []byte("zhangsan")}}
+	require.True(t, a.OnConnectAuthenticate(cl2, pkc))
+	a.OnDisconnect(cl, nil, false)
+	require.Equal(t, 1, a.acls.Len())
+	a.OnDisconnect(cl2, nil, false)
+	require.Equal(t, 0, a.acls.Len())
+}
+
+func TestBulkAclResponses(t *testing.T) {
+	var response string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(response))
+	}))
+	defer srv.Close()
+
+	a := newServerAuth(t, &Options{AuthUrl: srv.URL, BulkAcl: true})
+
+	response = `{"allow": false, "acl": {"#": 3}}`
+	require.False(t, a.OnConnectAuthenticate(client, pkc))
+	response = `not json`
+	require.False(t, a.OnConnectAuthenticate(client, pkc))
+	response = "1"
+	require.True(t, a.OnConnectAuthenticate(client, pkc))
+	require.Equal(t, 0, a.acls.Len())
+
+	cl := &mqtt.Client{ID: "super", Properties: mqtt.ClientProperties{Username: []byte("root")}}
+	response = `{"allow": true, "superuser": true}`
+	require.True(t, a.OnConnectAuthenticate(cl, pkc))
+	require.True(t, a.OnACLCheck(cl, "any/topic", true))
+	require.NotContains(t, cl.Ext, mqtt.MaxConnectionsExtKey)
+
+	cl = &mqtt.Client{ID: "limited", Properties: mqtt.ClientProperties{Username: []byte("device")}}
+	response = `{"allow": true, "max_connections": 3}`
+	require.True(t, a.OnConnectAuthenticate(cl, pkc))
+	require.Equal(t, 3, cl.Ext[mqtt.MaxConnectionsExtKey])
+
+	// json responses are only accepted with bulk-acl enabled
+	a.config.BulkAcl = false
+	response = `{"allow": true}`
+	require.False(t, a.OnConnectAuthenticate(client, pkc))
+}
@@ -0,0 +1,79 @@
+package http
+
+import (
+	"sync"
+
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+)
+
+// aclSession is the acl of a connected client returned by the auth service at connect time.
+type aclSession struct {
+	cl  *mqtt.Client
+	acl map[string]auth.Access
+}
+
+// aclSessions caches the acl of each connected client for the lifetime of its connection,
+// so that acl checks do not request the acl url of the auth service.
+type aclSessions struct {
+	sync.RWMutex
+	internal map[string]aclSession // keyed on client id
+}
+
+// newAclSessions returns a new empty acl session cache.
+func newAclSessions() *aclSessions {
+	return &aclSessions{
+		internal: make(map[string]aclSession),
+	}
+}
+
+// Set caches the acl of a client, replacing the acl of any earlier connection with the
+// same client id.
+func (s *aclSessions) Set(cl *mqtt.Client, acl map[string]auth.Access) {
+	s.Lock()
+	defer s.Unlock()
+	s.internal[cl.ID] = aclSession{cl: cl, acl: acl}
+}
+
+// Get returns the cached acl of a client, and false if it has none.
+func (s *aclSessions) Get(cl *mqtt.Client) (map[string]auth.Access, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	v, ok := s.internal[cl.ID]
+	if !ok || v.cl != cl {
+		return nil, false
+	}
+	return v.acl, true
+}
+
+// Delete removes the cached acl of a client, unless it belongs to a newer connection
+// which has taken over the client id.
+func (s *aclSessions) Delete(cl *mqtt.Client) {
+	s.Lock()
+	defer s.Unlock()
+	if v, ok := s.internal[cl.ID]; ok && v.cl == cl {
+		delete(s.internal, cl.ID)
+	}
+}
+
+// Invalidate removes the cached acls of the clients with a username or client id, or of
+// all clients if the key is empty, returning the number removed.
+func (s *aclSessions) Invalidate(key string) int {
+	s.Lock()
+	defer s.Unlock()
+	var n int
+	for id, v := range s.internal {
+		if key == "" || id == key || string(v.cl.Properties.Username) == key {
+			delete(s.internal, id)
+			n++
+		}
+	}
+	return n
+}
+
+// Len returns the number of cached acls.
+func (s *aclSessions) Len() int {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.internal)
+}
@@ -0,0 +1,170 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	maxJwksSize     = 1 << 20     // the maximum size of a jwks response
+	jwksMinInterval = time.Minute // the minimum interval between fetches for unknown key ids
+)
+
+var ErrJwks = errors.New("unable to fetch jwks")
+
+// jwk is a json web key, of which rsa and p-256 ec public keys are supported.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey returns the public key of a json web key, or nil if it is not supported.
+func (k jwk) publicKey() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, nil
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) { //nolint:staticcheck
+			return nil, fmt.Errorf("key %s is not on the p-256 curve", k.Kid)
+		}
+		return pub, nil
+	}
+
+	return nil, nil
+}
+
+// jwks is a json web key set fetched from a url and refreshed periodically.
+type jwks struct {
+	sync.RWMutex
+	url     string
+	client  *http.Client
+	keys    map[string]any // the public keys, keyed on key id
+	fetched time.Time      // when the keys were last fetched
+	fetch   sync.Mutex     // serializes fetches
+}
+
+// newJwks returns a key set fetching keys from a url.
+func newJwks(url string, client *http.Client) *jwks {
+	return &jwks{
+		url:    url,
+		client: client,
+		keys:   map[string]any{},
+	}
+}
+
+// refresh fetches the keys of the key set, keeping the current keys if they cannot be
+// fetched.
+func (s *jwks) refresh() error {
+	s.fetch.Lock()
+	defer s.fetch.Unlock()
+
+	s.Lock()
+	s.fetched = time.Now()
+	s.Unlock()
+
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrJwks, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s", ErrJwks, resp.Status)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxJwksSize)).Decode(&set); err != nil {
+		return fmt.Errorf("%w: %w", ErrJwks, err)
+	}
+
+	keys := make(map[string]any, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		pub, err := k.publicKey()
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrJwks, err)
+		}
+		if pub != nil {
+			keys[k.Kid] = pub
+		}
+	}
+
+	s.Lock()
+	s.keys = keys
+	s.Unlock()
+	return nil
+}
+
+// key returns the key with a key id, fetching the keys again if the key id is unknown
+// and they were not fetched recently. Without a key id, the only key of the set is
+// returned.
+func (s *jwks) key(kid string) any {
+	if k := s.get(kid); k != nil {
+		return k
+	}
+
+	s.RLock()
+	stale := time.Since(s.fetched) > jwksMinInterval
+	s.RUnlock()
+	if !stale || s.refresh() != nil {
+		return nil
+	}
+
+	return s.get(kid)
+}
+
+// get returns the key with a key id from the current keys.
+func (s *jwks) get(kid string) any {
+	s.RLock()
+	defer s.RUnlock()
+
+	if kid == "" && len(s.keys) == 1 {
+		for _, k := range s.keys {
+			return k
+		}
+	}
+
+	return s.keys[kid]
+}
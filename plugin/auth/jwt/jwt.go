@@ -0,0 +1,397 @@
+package jwt
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/plugin"
+	pa "github.com/wind-c/comqtt/v2/plugin/auth"
+)
+
+const (
+	defaultClaim       = "sub" // the claim matched against the username or client id by default
+	defaultJwksRefresh = 3600  // the default number of seconds between jwks refreshes
+)
+
+var (
+	ErrNoKeys           = errors.New("one of secret, public-key or jwks-url is required")
+	ErrInvalidPublicKey = errors.New("public-key must be a pem encoded rsa or p-256 ecdsa public key")
+)
+
+type Options struct {
+	pa.Blacklist
+	AuthMode      byte                   `json:"auth-mode" yaml:"auth-mode"`
+	AclMode       byte                   `json:"acl-mode" yaml:"acl-mode"`
+	Algorithms    []string               `json:"algorithms" yaml:"algorithms"`
+	Secret        string                 `json:"secret" yaml:"secret"`
+	PublicKey     string                 `json:"public-key" yaml:"public-key"`
+	JwksUrl       string                 `json:"jwks-url" yaml:"jwks-url"`
+	JwksRefresh   int64                  `json:"jwks-refresh" yaml:"jwks-refresh"`
+	Issuer        string                 `json:"issuer" yaml:"issuer"`
+	Audience      string                 `json:"audience" yaml:"audience"`
+	Leeway        int64                  `json:"leeway" yaml:"leeway"`
+	UsernameClaim string                 `json:"username-claim" yaml:"username-claim"`
+	ClientIDClaim string                 `json:"clientid-claim" yaml:"clientid-claim"`
+	AclClaim      string                 `json:"acl-claim" yaml:"acl-claim"`
+	Acl           map[string]auth.Access `json:"acl" yaml:"acl"`
+	Outbound      plugin.Outbound        `json:"outbound" yaml:"outbound"`
+}
+
+// session is the verified claims of a connected client.
+type session struct {
+	cl     *mqtt.Client
+	claims Claims
+}
+
+// Auth is an auth controller which authenticates clients by a json web token passed as
+// the password. The claims of the token are matched against the username and client id
+// of the client, and acl filters are derived from the claims.
+type Auth struct {
+	mqtt.HookBase
+	config   *Options
+	secret   []byte
+	key      any   // the configured public key
+	jwks     *jwks // the key set fetched from the jwks url
+	sessions sync.Map
+	cancel   chan struct{}
+	metrics  pa.Metrics
+}
+
+// ID returns the ID of the hook.
+func (a *Auth) ID() string {
+	return "auth-jwt"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (a *Auth) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnACLCheck,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+func (a *Auth) Init(config any) error {
+	if _, ok := config.(*Options); config == nil || (!ok && config != nil) {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	a.config = config.(*Options)
+	if a.config.Secret == "" && a.config.PublicKey == "" && a.config.JwksUrl == "" {
+		return ErrNoKeys
+	}
+
+	if len(a.config.Algorithms) == 0 {
+		if a.config.Secret != "" {
+			a.config.Algorithms = append(a.config.Algorithms, AlgHS256)
+		}
+		if a.config.PublicKey != "" || a.config.JwksUrl != "" {
+			a.config.Algorithms = append(a.config.Algorithms, AlgRS256, AlgES256)
+		}
+	}
+	for _, alg := range a.config.Algorithms {
+		switch alg {
+		case AlgHS256, AlgRS256, AlgES256:
+		default:
+			return ErrInvalidAlgorithm
+		}
+	}
+
+	switch {
+	case a.config.AuthMode == byte(auth.AuthUsername) && a.config.UsernameClaim == "":
+		a.config.UsernameClaim = defaultClaim
+	case a.config.AuthMode == byte(auth.AuthClientID) && a.config.ClientIDClaim == "":
+		a.config.ClientIDClaim = defaultClaim
+	}
+
+	if a.config.Secret != "" {
+		a.secret = []byte(a.config.Secret)
+	}
+
+	if a.config.PublicKey != "" {
+		key, err := loadPublicKey(a.config.PublicKey)
+		if err != nil {
+			return err
+		}
+		a.key = key
+	}
+
+	a.Log.Info("", "algorithms", a.config.Algorithms, "jwks-url", a.config.JwksUrl, "issuer", a.config.Issuer, "audience", a.config.Audience)
+
+	if a.config.JwksUrl != "" {
+		client := http.DefaultClient
+		if a.config.Outbound.Enabled() {
+			c, err := a.config.Outbound.HTTPClient(nil)
+			if err != nil {
+				return err
+			}
+			client = c
+		}
+
+		a.jwks = newJwks(a.config.JwksUrl, client)
+		if err := a.jwks.refresh(); err != nil {
+			a.Log.Warn("unable to fetch jwks", "error", err)
+		}
+
+		if a.config.JwksRefresh <= 0 {
+			a.config.JwksRefresh = defaultJwksRefresh
+		}
+		a.cancel = make(chan struct{})
+		go a.refreshJwks(time.Duration(a.config.JwksRefresh)*time.Second, a.cancel)
+	}
+
+	return nil
+}
+
+// Stop stops refreshing the jwks.
+func (a *Auth) Stop() error {
+	if a.cancel != nil {
+		close(a.cancel)
+		a.cancel = nil
+	}
+
+	return nil
+}
+
+// refreshJwks fetches the jwks at an interval until cancelled.
+func (a *Auth) refreshJwks(interval time.Duration, cancel chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cancel:
+			return
+		case <-ticker.C:
+			if err := a.jwks.refresh(); err != nil {
+				a.Log.Warn("unable to refresh jwks", "error", err)
+			}
+		}
+	}
+}
+
+// OnConnectAuthenticate returns true if the connecting client passed a valid token as
+// its password, whose claims match its username and client id. A client connecting
+// without a username is given the username claim as its username.
+func (a *Auth) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	if !pa.DecidedBy(cl, a.ID()) { // denied by an earlier datasource of the auth chain
+		return false
+	}
+
+	return pa.Decide(cl, a.ID(), a.metrics.Auth(a.authenticateClient(cl, pk)))
+}
+
+// authenticateClient returns whether the token of the connecting client allows it, or Unknown
+// if its password is not a valid token.
+func (a *Auth) authenticateClient(cl *mqtt.Client, pk packets.Packet) pa.Result {
+	if a.config.AuthMode == byte(auth.AuthAnonymous) {
+		return pa.Allow
+	}
+
+	// check blacklist
+	if n, ok := a.config.CheckBLAuth(cl, pk); n >= 0 { // It's on the blacklist
+		return pa.ResultOf(ok)
+	}
+
+	claims, err := a.Verify(string(pk.Connect.Password))
+	if err != nil {
+		a.Log.Debug("invalid token", "error", err, "client", cl.ID)
+		return pa.Unknown
+	}
+
+	if a.config.UsernameClaim != "" {
+		username, ok := claims.String(a.config.UsernameClaim)
+		if !ok {
+			return pa.Deny
+		}
+		if len(cl.Properties.Username) == 0 {
+			cl.Properties.Username = []byte(username)
+		} else if string(cl.Properties.Username) != username {
+			return pa.Deny
+		}
+	}
+
+	if a.config.ClientIDClaim != "" {
+		if id, ok := claims.String(a.config.ClientIDClaim); !ok || cl.ID != id {
+			return pa.Deny
+		}
+	}
+
+	a.sessions.Store(cl.ID, &session{cl: cl, claims: claims})
+	return pa.Allow
+}
+
+// OnACLCheck returns true if the unexpired token of the client has matching read or
+// write access to subscribe or publish to a given topic.
+func (a *Auth) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	return a.config.AuthorizeClient(a.ID(), a.config.AclMode, &a.metrics, cl, topic, write, a.lookupAcl)
+}
+
+// lookupAcl returns true if the acl of the client in the claims of its token allows it to
+// subscribe or publish to a topic.
+func (a *Auth) lookupAcl(cl *mqtt.Client, topic string, write bool) bool {
+	v, ok := a.sessions.Load(cl.ID)
+	if !ok || v.(*session).cl != cl {
+		return false
+	}
+
+	claims := v.(*session).claims
+	if exp, ok := claims.Expires(); ok && time.Now().After(exp.Add(a.leeway())) {
+		return false
+	}
+
+	fam := make(map[string]auth.Access)
+	for filter, access := range a.Filters(claims) {
+		if filter, ok := pa.ExpandClientFilter(cl, filter); ok && plugin.MatchTopic(filter, topic) {
+			fam[filter] = access
+		}
+	}
+
+	return pa.CheckAcl(fam, write)
+}
+
+// OnDisconnect removes the claims of a disconnected client, unless it was taken over.
+func (a *Auth) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	if v, ok := a.sessions.Load(cl.ID); ok && v.(*session).cl == cl {
+		a.sessions.CompareAndDelete(cl.ID, v)
+	}
+}
+
+// Verify returns the claims of a token if it has a valid signature by an allowed
+// algorithm and key, is unexpired, and was issued by the issuer for the audience.
+func (a *Auth) Verify(token string) (Claims, error) {
+	h, claims, signed, sig, err := parse(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if !slices.Contains(a.config.Algorithms, h.Alg) {
+		return nil, ErrAlgorithm
+	}
+
+	key := a.verificationKey(h)
+	if key == nil {
+		return nil, ErrNoKey
+	}
+
+	if err := verify(h.Alg, key, signed, sig); err != nil {
+		return nil, err
+	}
+
+	if err := claims.validate(time.Now(), a.leeway(), a.config.Issuer, a.config.Audience); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// verificationKey returns the key to verify a token with, or nil if there is none.
+func (a *Auth) verificationKey(h header) any {
+	if h.Alg == AlgHS256 {
+		if a.secret == nil {
+			return nil
+		}
+		return a.secret
+	}
+
+	if a.jwks != nil && (h.Kid != "" || a.key == nil) {
+		if key := a.jwks.key(h.Kid); key != nil {
+			return key
+		}
+	}
+
+	return a.key
+}
+
+// Filters returns the acl filters of a token, from the acl filter templates with the
+// claim placeholders replaced, and the acl claim. Templates referring to a claim which
+// is missing from the token are skipped.
+func (a *Auth) Filters(claims Claims) map[string]auth.Access {
+	fam := make(map[string]auth.Access)
+
+	for tmpl, access := range a.config.Acl {
+		if filter, ok := pa.ExpandFilter(tmpl, claims.String); ok {
+			fam[filter] = access
+		}
+	}
+
+	if a.config.AclClaim != "" {
+		if m, ok := claims[a.config.AclClaim].(map[string]any); ok {
+			for filter, v := range m {
+				n, ok := v.(json.Number)
+				if !ok {
+					continue
+				}
+				if access, err := n.Int64(); err == nil && access >= int64(auth.Deny) && access <= int64(auth.ReadWrite) {
+					fam[filter] = auth.Access(access)
+				}
+			}
+		}
+	}
+
+	return fam
+}
+
+// leeway returns the allowed clock skew when validating the times of a token.
+func (a *Auth) leeway() time.Duration {
+	return time.Duration(a.config.Leeway) * time.Second
+}
+
+// loadPublicKey loads a pem encoded rsa or p-256 ecdsa public key or certificate from a file.
+func loadPublicKey(file string) (any, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrInvalidPublicKey
+	}
+
+	var key any
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key = cert.PublicKey
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return k, nil
+	case *ecdsa.PublicKey:
+		if k.Curve.Params().BitSize == 256 {
+			return k, nil
+		}
+	}
+
+	return nil, ErrInvalidPublicKey
+}
+
+// AuthMetrics returns the decisions, datasource latency and cache hits of the hook.
+func (a *Auth) AuthMetrics() mqtt.AuthMetrics {
+	return a.metrics.Snapshot(a.ID(), nil)
+}
@@ -0,0 +1,407 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/plugin"
+)
+
+const (
+	path   = "./conf.yml"
+	secret = "test-secret"
+)
+
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// sign returns a token of the claims signed by a key with an algorithm.
+func sign(t *testing.T, alg, kid string, key any, claims map[string]any) string {
+	h := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		h["kid"] = kid
+	}
+	hb, err := json.Marshal(h)
+	require.NoError(t, err)
+	cb, err := json.Marshal(claims)
+	require.NoError(t, err)
+
+	signed := base64.RawURLEncoding.EncodeToString(hb) + "." + base64.RawURLEncoding.EncodeToString(cb)
+	sum := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:])
+		require.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, sum[:])
+		require.NoError(t, err)
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// claims returns claims for a subject expiring in an hour, with extra claims.
+func claims(sub string, extra map[string]any) map[string]any {
+	c := map[string]any{"sub": sub, "exp": time.Now().Add(time.Hour).Unix()}
+	for k, v := range extra {
+		c[k] = v
+	}
+	return c
+}
+
+// jwksServer serves a json web key set of public keys keyed on key id, counting requests.
+func jwksServer(t *testing.T, keys map[string]any, requests *int64) *httptest.Server {
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+	set := struct {
+		Keys []map[string]string `json:"keys"`
+	}{}
+	for kid, key := range keys {
+		switch k := key.(type) {
+		case *rsa.PublicKey:
+			set.Keys = append(set.Keys, map[string]string{"kty": "RSA", "kid": kid, "use": "sig", "n": b64(k.N.Bytes()), "e": b64(big.NewInt(int64(k.E)).Bytes())})
+		case *ecdsa.PublicKey:
+			set.Keys = append(set.Keys, map[string]string{"kty": "EC", "kid": kid, "crv": "P-256", "x": b64(k.X.FillBytes(make([]byte, 32))), "y": b64(k.Y.FillBytes(make([]byte, 32)))})
+		}
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests != nil {
+			atomic.AddInt64(requests, 1)
+		}
+		_ = json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newAuth(t *testing.T, opts *Options) *Auth {
+	a := new(Auth)
+	a.SetOpts(logger, nil)
+	require.NoError(t, a.Init(opts))
+	t.Cleanup(func() {
+		_ = a.Stop()
+	})
+	return a
+}
+
+func connect(a *Auth, id, username, token string) (*mqtt.Client, bool) {
+	cl := &mqtt.Client{
+		ID: id,
+		Properties: mqtt.ClientProperties{
+			Username: []byte(username),
+		},
+	}
+	pk := packets.Packet{Connect: packets.ConnectParams{Password: []byte(token)}}
+	return cl, a.OnConnectAuthenticate(cl, pk)
+}
+
+func TestInitFromConfFile(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	opts := new(Options)
+	require.NoError(t, plugin.LoadYaml(path, opts))
+	opts.JwksUrl = jwksServer(t, map[string]any{"k1": &key.PublicKey}, nil).URL
+
+	a := newAuth(t, opts)
+	require.Equal(t, []string{AlgRS256, AlgES256}, a.config.Algorithms)
+	require.Equal(t, "sub", a.config.UsernameClaim)
+	require.Equal(t, auth.ReadWrite, a.config.Acl["devices/${sub}/#"])
+	require.Equal(t, int64(3600), a.config.JwksRefresh)
+	require.NotNil(t, a.jwks.get("k1"))
+}
+
+func TestInitInvalid(t *testing.T) {
+	a := new(Auth)
+	a.SetOpts(logger, nil)
+	require.ErrorIs(t, a.Init(nil), mqtt.ErrInvalidConfigType)
+	require.ErrorIs(t, a.Init(&Options{}), ErrNoKeys)
+	require.ErrorIs(t, a.Init(&Options{Secret: secret, Algorithms: []string{"none"}}), ErrInvalidAlgorithm)
+	require.Error(t, a.Init(&Options{PublicKey: "missing.pem"}))
+}
+
+func TestInitDefaults(t *testing.T) {
+	a := newAuth(t, &Options{AuthMode: byte(auth.AuthClientID), Secret: secret})
+	require.Equal(t, []string{AlgHS256}, a.config.Algorithms)
+	require.Equal(t, "sub", a.config.ClientIDClaim)
+	require.Empty(t, a.config.UsernameClaim)
+}
+
+func TestVerifyHS256(t *testing.T) {
+	a := newAuth(t, &Options{Secret: secret, Issuer: "idp", Audience: "comqtt", Leeway: 10})
+
+	valid := claims("device-001", map[string]any{"iss": "idp", "aud": []string{"other", "comqtt"}})
+	c, err := a.Verify(sign(t, AlgHS256, "", []byte(secret), valid))
+	require.NoError(t, err)
+	sub, ok := c.String("sub")
+	require.True(t, ok)
+	require.Equal(t, "device-001", sub)
+
+	tests := []struct {
+		desc  string
+		token string
+		err   error
+	}{
+		{"malformed", "abc.def", ErrMalformedToken},
+		{"wrong secret", sign(t, AlgHS256, "", []byte("other"), valid), ErrSignature},
+		{"not allowed", sign(t, "none", "", nil, valid), ErrAlgorithm},
+		{"expired", sign(t, AlgHS256, "", []byte(secret), claims("d", map[string]any{"iss": "idp", "aud": "comqtt", "exp": time.Now().Add(-time.Minute).Unix()})), ErrExpired},
+		{"not yet valid", sign(t, AlgHS256, "", []byte(secret), claims("d", map[string]any{"iss": "idp", "aud": "comqtt", "nbf": time.Now().Add(time.Minute).Unix()})), ErrNotYetValid},
+		{"issuer", sign(t, AlgHS256, "", []byte(secret), claims("d", map[string]any{"iss": "other", "aud": "comqtt"})), ErrIssuer},
+		{"audience", sign(t, AlgHS256, "", []byte(secret), claims("d", map[string]any{"iss": "idp", "aud": "other"})), ErrAudience},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			_, err := a.Verify(tt.token)
+			require.ErrorIs(t, err, tt.err)
+		})
+	}
+
+	// within the leeway
+	_, err = a.Verify(sign(t, AlgHS256, "", []byte(secret), claims("d", map[string]any{"iss": "idp", "aud": "comqtt", "exp": time.Now().Add(-5 * time.Second).Unix()})))
+	require.NoError(t, err)
+}
+
+func TestVerifyPublicKey(t *testing.T) {
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		alg string
+		key crypto.Signer
+	}{
+		{AlgRS256, rk},
+		{AlgES256, ek},
+	} {
+		t.Run(tt.alg, func(t *testing.T) {
+			der, err := x509.MarshalPKIXPublicKey(tt.key.Public())
+			require.NoError(t, err)
+			file := filepath.Join(t.TempDir(), "key.pem")
+			require.NoError(t, os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600))
+
+			a := newAuth(t, &Options{PublicKey: file})
+			_, err = a.Verify(sign(t, tt.alg, "", tt.key, claims("d", nil)))
+			require.NoError(t, err)
+
+			// hs256 tokens are not accepted without a secret, even signed with the public key
+			_, err = a.Verify(sign(t, AlgHS256, "", der, claims("d", nil)))
+			require.ErrorIs(t, err, ErrAlgorithm)
+		})
+	}
+
+	// the algorithm of the token must match the key
+	der, err := x509.MarshalPKIXPublicKey(&rk.PublicKey)
+	require.NoError(t, err)
+	file := filepath.Join(t.TempDir(), "key.pem")
+	require.NoError(t, os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600))
+	a := newAuth(t, &Options{PublicKey: file})
+	_, err = a.Verify(sign(t, AlgES256, "", ek, claims("d", nil)))
+	require.ErrorIs(t, err, ErrNoKey)
+}
+
+func TestVerifyJwks(t *testing.T) {
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	var requests int64
+	srv := jwksServer(t, map[string]any{"rsa": &rk.PublicKey, "ec": &ek.PublicKey}, &requests)
+	a := newAuth(t, &Options{JwksUrl: srv.URL})
+	require.Equal(t, int64(1), atomic.LoadInt64(&requests))
+
+	_, err = a.Verify(sign(t, AlgRS256, "rsa", rk, claims("d", nil)))
+	require.NoError(t, err)
+	_, err = a.Verify(sign(t, AlgES256, "ec", ek, claims("d", nil)))
+	require.NoError(t, err)
+
+	// signed by the wrong key of the set
+	_, err = a.Verify(sign(t, AlgES256, "rsa", ek, claims("d", nil)))
+	require.ErrorIs(t, err, ErrNoKey)
+
+	// unknown key ids refresh the keys at most once a minute
+	_, err = a.Verify(sign(t, AlgRS256, "unknown", rk, claims("d", nil)))
+	require.ErrorIs(t, err, ErrNoKey)
+	require.Equal(t, int64(1), atomic.LoadInt64(&requests))
+
+	a.jwks.fetched = time.Now().Add(-2 * jwksMinInterval)
+	_, err = a.Verify(sign(t, AlgRS256, "unknown", rk, claims("d", nil)))
+	require.ErrorIs(t, err, ErrNoKey)
+	require.Equal(t, int64(2), atomic.LoadInt64(&requests))
+}
+
+func TestJwksRefresh(t *testing.T) {
+	var requests int64
+	srv := jwksServer(t, map[string]any{}, &requests)
+	newAuth(t, &Options{JwksUrl: srv.URL, JwksRefresh: 1})
+
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&requests) >= 2
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+func TestJwksUnavailable(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	// the broker starts without the keys, which are fetched again later
+	a := newAuth(t, &Options{JwksUrl: srv.URL})
+	require.ErrorIs(t, a.jwks.refresh(), ErrJwks)
+}
+
+func TestOnConnectAuthenticateUsername(t *testing.T) {
+	a := newAuth(t, &Options{AuthMode: byte(auth.AuthUsername), Secret: secret, ClientIDClaim: "cid"})
+	token := sign(t, AlgHS256, "", []byte(secret), claims("device-001", map[string]any{"cid": "c1"}))
+
+	_, ok := connect(a, "c1", "device-001", token)
+	require.True(t, ok)
+
+	_, ok = connect(a, "c1", "device-002", token)
+	require.False(t, ok)
+
+	_, ok = connect(a, "c2", "device-001", token)
+	require.False(t, ok)
+
+	_, ok = connect(a, "c1", "device-001", "not-a-token")
+	require.False(t, ok)
+
+	// the username claim is given to clients without a username
+	cl, ok := connect(a, "c1", "", token)
+	require.True(t, ok)
+	require.Equal(t, "device-001", string(cl.Properties.Username))
+}
+
+func TestOnConnectAuthenticateClientID(t *testing.T) {
+	a := newAuth(t, &Options{AuthMode: byte(auth.AuthClientID), Secret: secret})
+	token := sign(t, AlgHS256, "", []byte(secret), claims("device-001", nil))
+
+	_, ok := connect(a, "device-001", "any", token)
+	require.True(t, ok)
+
+	_, ok = connect(a, "device-002", "any", token)
+	require.False(t, ok)
+}
+
+func TestOnConnectAuthenticateAnonymous(t *testing.T) {
+	a := newAuth(t, &Options{Secret: secret})
+	_, ok := connect(a, "c1", "", "")
+	require.True(t, ok)
+}
+
+func TestOnACLCheck(t *testing.T) {
+	a := newAuth(t, &Options{
+		AuthMode: byte(auth.AuthUsername),
+		AclMode:  byte(auth.AuthUsername),
+		Secret:   secret,
+		AclClaim: "acl",
+		Acl: map[string]auth.Access{
+			"devices/${sub}/#":              auth.ReadWrite,
+			"tenants/${tenant}/broadcast/#": auth.ReadOnly,
+		},
+	})
+
+	token := sign(t, AlgHS256, "", []byte(secret), claims("device-001", map[string]any{
+		"tenant": "acme",
+		"acl":    map[string]any{"firmware/#": 1, "devices/device-001/admin": 0, "invalid/#": "rw"},
+	}))
+	cl, ok := connect(a, "c1", "", token)
+	require.True(t, ok)
+
+	require.True(t, a.OnACLCheck(cl, "devices/device-001/state", true))
+	require.True(t, a.OnACLCheck(cl, "devices/device-001/state", false))
+	require.False(t, a.OnACLCheck(cl, "devices/device-002/state", false))
+	require.False(t, a.OnACLCheck(cl, "devices/device-001/admin", true))
+	require.True(t, a.OnACLCheck(cl, "tenants/acme/broadcast/news", false))
+	require.False(t, a.OnACLCheck(cl, "tenants/acme/broadcast/news", true))
+	require.True(t, a.OnACLCheck(cl, "firmware/v2", false))
+	require.False(t, a.OnACLCheck(cl, "invalid/topic", false))
+
+	// templates of missing claims are skipped
+	token = sign(t, AlgHS256, "", []byte(secret), claims("device-002", nil))
+	cl2, ok := connect(a, "c2", "", token)
+	require.True(t, ok)
+	require.Len(t, a.Filters(sessionClaims(t, a, cl2)), 1)
+	require.False(t, a.OnACLCheck(cl2, "tenants//broadcast/news", false))
+
+	// a client which was not authenticated has no access
+	require.False(t, a.OnACLCheck(&mqtt.Client{ID: "c3"}, "devices/device-001/state", false))
+}
+
+func TestOnACLCheckExpired(t *testing.T) {
+	a := newAuth(t, &Options{
+		AuthMode: byte(auth.AuthUsername),
+		AclMode:  byte(auth.AuthUsername),
+		Secret:   secret,
+		Acl:      map[string]auth.Access{"#": auth.ReadWrite},
+	})
+
+	cl, ok := connect(a, "c1", "", sign(t, AlgHS256, "", []byte(secret), claims("d", nil)))
+	require.True(t, ok)
+	require.True(t, a.OnACLCheck(cl, "a/b", true))
+
+	a.sessions.Store(cl.ID, &session{cl: cl, claims: Claims{"exp": json.Number("1")}})
+	require.False(t, a.OnACLCheck(cl, "a/b", true))
+}
+
+func TestOnDisconnectTakeover(t *testing.T) {
+	a := newAuth(t, &Options{AuthMode: byte(auth.AuthUsername), Secret: secret})
+	token := sign(t, AlgHS256, "", []byte(secret), claims("d", nil))
+
+	old, ok := connect(a, "c1", "", token)
+	require.True(t, ok)
+	cl, ok := connect(a, "c1", "", token)
+	require.True(t, ok)
+
+	// the disconnection of a client taken over keeps the claims of the new client
+	a.OnDisconnect(old, nil, false)
+	_, ok = a.sessions.Load("c1")
+	require.True(t, ok)
+
+	a.OnDisconnect(cl, nil, false)
+	_, ok = a.sessions.Load("c1")
+	require.False(t, ok)
+}
+
+// sessionClaims returns the claims stored for a client.
+func sessionClaims(t *testing.T, a *Auth, cl *mqtt.Client) Claims {
+	v, ok := a.sessions.Load(cl.ID)
+	require.True(t, ok)
+	return v.(*session).claims
+}
@@ -0,0 +1,194 @@
+package jwt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	AlgHS256 = "HS256" // hmac with sha-256 and a shared secret
+	AlgRS256 = "RS256" // rsassa-pkcs1-v1_5 with sha-256
+	AlgES256 = "ES256" // ecdsa with the p-256 curve and sha-256
+)
+
+var (
+	ErrMalformedToken   = errors.New("malformed token")
+	ErrAlgorithm        = errors.New("token algorithm not allowed")
+	ErrNoKey            = errors.New("no key to verify the token")
+	ErrSignature        = errors.New("invalid token signature")
+	ErrExpired          = errors.New("token expired")
+	ErrNotYetValid      = errors.New("token not yet valid")
+	ErrIssuer           = errors.New("token issuer not allowed")
+	ErrAudience         = errors.New("token audience not allowed")
+	ErrInvalidAlgorithm = errors.New("algorithms must be HS256, RS256 or ES256")
+)
+
+// header is the decoded header of a token.
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Claims are the decoded claims of a token.
+type Claims map[string]any
+
+// String returns a string claim, or the decimal of a numeric claim, and false if the
+// claim is missing or not a string or number.
+func (c Claims) String(name string) (string, bool) {
+	switch v := c[name].(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	}
+
+	return "", false
+}
+
+// time returns a numeric date claim, and false if it is missing or not a number.
+func (c Claims) time(name string) (time.Time, bool) {
+	n, ok := c[name].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(int64(f), 0), true
+}
+
+// Expires returns the expiry of the token, and false if it has no exp claim.
+func (c Claims) Expires() (time.Time, bool) {
+	return c.time("exp")
+}
+
+// audience returns true if the aud claim, a string or a list of strings, contains aud.
+func (c Claims) audience(aud string) bool {
+	switch v := c["aud"].(type) {
+	case string:
+		return v == aud
+	case []any:
+		for _, a := range v {
+			if s, ok := a.(string); ok && s == aud {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// parse decodes a compact serialized token, returning its header, claims, the signed
+// input and the signature.
+func parse(token string) (h header, claims Claims, signed, sig []byte, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return h, nil, nil, nil, ErrMalformedToken
+	}
+
+	hb, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return h, nil, nil, nil, ErrMalformedToken
+	}
+	if err := json.Unmarshal(hb, &h); err != nil {
+		return h, nil, nil, nil, ErrMalformedToken
+	}
+
+	cb, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return h, nil, nil, nil, ErrMalformedToken
+	}
+	d := json.NewDecoder(bytes.NewReader(cb))
+	d.UseNumber()
+	if err := d.Decode(&claims); err != nil || claims == nil {
+		return h, nil, nil, nil, ErrMalformedToken
+	}
+
+	sig, err = base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return h, nil, nil, nil, ErrMalformedToken
+	}
+
+	return h, claims, []byte(parts[0] + "." + parts[1]), sig, nil
+}
+
+// verify returns nil if a signature of the signed input was made by a key with an
+// algorithm.
+func verify(alg string, key any, signed, sig []byte) error {
+	sum := sha256.Sum256(signed)
+
+	switch alg {
+	case AlgHS256:
+		secret, ok := key.([]byte)
+		if !ok {
+			return ErrNoKey
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return ErrSignature
+		}
+	case AlgRS256:
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ErrNoKey
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig); err != nil {
+			return ErrSignature
+		}
+	case AlgES256:
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || pub.Curve.Params().BitSize != 256 {
+			return ErrNoKey
+		}
+		if len(sig) != 64 {
+			return ErrSignature
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, sum[:], r, s) {
+			return ErrSignature
+		}
+	default:
+		return fmt.Errorf("%w: %s", ErrAlgorithm, alg)
+	}
+
+	return nil
+}
+
+// validate returns nil if the claims are valid at a time, allowing a leeway for clock
+// skew, and were issued by the issuer for the audience if they are not empty.
+func (c Claims) validate(now time.Time, leeway time.Duration, issuer, audience string) error {
+	if exp, ok := c.time("exp"); ok && now.After(exp.Add(leeway)) {
+		return ErrExpired
+	}
+
+	if nbf, ok := c.time("nbf"); ok && now.Add(leeway).Before(nbf) {
+		return ErrNotYetValid
+	}
+
+	if issuer != "" {
+		if iss, _ := c.String("iss"); iss != issuer {
+			return ErrIssuer
+		}
+	}
+
+	if audience != "" && !c.audience(audience) {
+		return ErrAudience
+	}
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt"
+)
+
+// latencyBuckets are the upper bounds, in milliseconds, of the buckets of the datasource
+// latency histogram.
+var latencyBuckets = [...]float64{1, 2.5, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+
+// Metrics counts the decisions of an auth datasource, the latency of its lookups and the
+// hits of its cache, so that a slow or overloaded datasource can be spotted.
+type Metrics struct {
+	authAllowed atomic.Int64
+	authDenied  atomic.Int64
+	authUnknown atomic.Int64
+	aclAllowed  atomic.Int64
+	aclDenied   atomic.Int64
+	cacheHits   atomic.Int64
+	cacheMisses atomic.Int64
+	lookups     atomic.Int64
+	latency     atomic.Int64                      // the total nanoseconds of the lookups
+	buckets     [len(latencyBuckets)]atomic.Int64 // lookups by their smallest bucket
+}
+
+// Auth counts the result of authenticating a client, and returns it.
+func (m *Metrics) Auth(res Result) Result {
+	switch res {
+	case Allow:
+		m.authAllowed.Add(1)
+	case Deny:
+		m.authDenied.Add(1)
+	default:
+		m.authUnknown.Add(1)
+	}
+
+	return res
+}
+
+// Acl counts the result of an acl check, and returns it.
+func (m *Metrics) Acl(ok bool) bool {
+	if ok {
+		m.aclAllowed.Add(1)
+	} else {
+		m.aclDenied.Add(1)
+	}
+
+	return ok
+}
+
+// Cached counts a lookup in a cache of the datasource which is not a Cache, such as a
+// cache of tokens or secrets.
+func (m *Metrics) Cached(hit bool) {
+	if hit {
+		m.cacheHits.Add(1)
+	} else {
+		m.cacheMisses.Add(1)
+	}
+}
+
+// Lookup counts a lookup in the datasource which started at a time.
+func (m *Metrics) Lookup(start time.Time) {
+	d := time.Since(start)
+	m.lookups.Add(1)
+	m.latency.Add(int64(d))
+
+	ms := float64(d) / float64(time.Millisecond)
+	for i, le := range latencyBuckets {
+		if ms <= le {
+			m.buckets[i].Add(1)
+			return
+		}
+	}
+}
+
+// Snapshot returns the current metrics of the datasource with an id, including the hits
+// of its cache, which may be nil.
+func (m *Metrics) Snapshot(id string, c *Cache) mqtt.AuthMetrics {
+	am := mqtt.AuthMetrics{
+		ID:          id,
+		AuthAllowed: m.authAllowed.Load(),
+		AuthDenied:  m.authDenied.Load(),
+		AuthUnknown: m.authUnknown.Load(),
+		AclAllowed:  m.aclAllowed.Load(),
+		AclDenied:   m.aclDenied.Load(),
+		CacheHits:   m.cacheHits.Load(),
+		CacheMisses: m.cacheMisses.Load(),
+		Latency: mqtt.LatencyHistogram{
+			Count:   m.lookups.Load(),
+			Sum:     float64(m.latency.Load()) / float64(time.Millisecond),
+			Buckets: make([]mqtt.LatencyBucket, len(latencyBuckets)),
+		},
+	}
+
+	hits, misses := c.Stats()
+	am.CacheHits += hits
+	am.CacheMisses += misses
+	if total := am.CacheHits + am.CacheMisses; total > 0 {
+		am.CacheHitRate = float64(am.CacheHits) / float64(total)
+	}
+
+	var n int64
+	for i, le := range latencyBuckets {
+		n += m.buckets[i].Load()
+		am.Latency.Buckets[i] = mqtt.LatencyBucket{Le: le, Count: n}
+	}
+
+	return am
+}
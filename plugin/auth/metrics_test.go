@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+)
+
+func TestMetricsAuthAcl(t *testing.T) {
+	m := new(Metrics)
+	require.Equal(t, Allow, m.Auth(Allow))
+	require.Equal(t, Deny, m.Auth(Deny))
+	require.Equal(t, Deny, m.Auth(Deny))
+	require.Equal(t, Unknown, m.Auth(Unknown))
+	require.True(t, m.Acl(true))
+	require.False(t, m.Acl(false))
+
+	am := m.Snapshot("auth-test", nil)
+	require.Equal(t, "auth-test", am.ID)
+	require.Equal(t, int64(1), am.AuthAllowed)
+	require.Equal(t, int64(2), am.AuthDenied)
+	require.Equal(t, int64(1), am.AuthUnknown)
+	require.Equal(t, int64(1), am.AclAllowed)
+	require.Equal(t, int64(1), am.AclDenied)
+	require.Zero(t, am.CacheHitRate)
+}
+
+func TestMetricsCacheHitRate(t *testing.T) {
+	m := new(Metrics)
+	m.Cached(true)
+	m.Cached(false)
+
+	c := NewCache(CacheOptions{Enable: true})
+	c.Set(CacheAcl, "zhangsan", "acl", false)
+	c.Get(CacheAcl, "zhangsan")
+	c.Get(CacheAcl, "zhangsan")
+
+	am := m.Snapshot("auth-test", c)
+	require.Equal(t, int64(3), am.CacheHits)
+	require.Equal(t, int64(1), am.CacheMisses)
+	require.Equal(t, 0.75, am.CacheHitRate)
+}
+
+func TestMetricsLookup(t *testing.T) {
+	m := new(Metrics)
+	m.Lookup(time.Now())
+	m.Lookup(time.Now().Add(-30 * time.Millisecond))
+	m.Lookup(time.Now().Add(-time.Minute)) // beyond the largest bucket
+
+	am := m.Snapshot("auth-test", nil)
+	require.Equal(t, int64(3), am.Latency.Count)
+	require.Greater(t, am.Latency.Sum, float64(60000))
+	require.Len(t, am.Latency.Buckets, len(latencyBuckets))
+	require.Equal(t, mqtt.LatencyBucket{Le: 1, Count: 1}, am.Latency.Buckets[0])
+	require.Equal(t, int64(1), am.Latency.Buckets[4].Count) // 25ms
+	require.Equal(t, int64(2), am.Latency.Buckets[5].Count) // 50ms
+	require.Equal(t, int64(2), am.Latency.Buckets[len(latencyBuckets)-1].Count)
+}
@@ -3,6 +3,8 @@ package mysql
 import (
 	"io"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"log/slog"
@@ -101,6 +103,39 @@ func TestInitBadConfig(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestInitInvalidTls(t *testing.T) {
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(ca, []byte("not a certificate"), 0600))
+
+	a := new(Auth)
+	a.SetOpts(logger, nil)
+	err := a.Init(&Options{Dsn: DsnInfo{Host: "localhost", Tls: TlsInfo{Enable: true, Ca: ca}}})
+	require.ErrorIs(t, err, ErrInvalidCa)
+}
+
+func TestTlsConfig(t *testing.T) {
+	c, err := TlsInfo{}.config("db.example.com")
+	require.NoError(t, err)
+	require.Nil(t, c)
+
+	c, err = TlsInfo{Enable: true}.config("db.example.com")
+	require.NoError(t, err)
+	require.Equal(t, "db.example.com", c.ServerName)
+	require.Nil(t, c.RootCAs)
+	require.False(t, c.InsecureSkipVerify)
+
+	c, err = TlsInfo{Enable: true, ServerName: "mysql.internal", SkipVerify: true}.config("10.0.0.5")
+	require.NoError(t, err)
+	require.Equal(t, "mysql.internal", c.ServerName)
+	require.True(t, c.InsecureSkipVerify)
+
+	_, err = TlsInfo{Enable: true, Cert: "missing.crt", Key: "missing.key"}.config("localhost")
+	require.Error(t, err)
+
+	_, err = TlsInfo{Enable: true, Ca: "missing.pem"}.config("localhost")
+	require.Error(t, err)
+}
+
 func TestOnConnectAuthenticate(t *testing.T) {
 	if !hasMysql() {
 		t.SkipNow()
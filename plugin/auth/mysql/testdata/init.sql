@@ -5,6 +5,7 @@ CREATE TABLE auth (
     username VARCHAR(255) NOT NULL UNIQUE,
     password VARCHAR(255) NOT NULL,
     allow SMALLINT DEFAULT 1 NOT NULL,
+    superuser SMALLINT DEFAULT 0 NOT NULL,
     created TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated TIMESTAMP NULL
 );
@@ -0,0 +1,447 @@
+package oauth2
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/plugin"
+	pa "github.com/wind-c/comqtt/v2/plugin/auth"
+)
+
+const (
+	defaultUsernameClaim = "username"     // the introspection field matched against the username by default
+	defaultClientIDClaim = "client_id"    // the introspection field matched against the client id by default
+	defaultTokenTypeHint = "access_token" // the default type of the tokens passed as passwords
+	defaultCacheTTL      = 60             // the default maximum number of seconds an active token is cached
+	maxResponseSize      = 1 << 20        // the maximum size of an introspection response
+	sweepInterval        = time.Minute    // the interval between removals of expired cache entries
+)
+
+var (
+	ErrNoIntrospectionUrl = errors.New("introspection-url is required")
+	ErrIntrospection      = errors.New("introspection request failed")
+)
+
+type Options struct {
+	pa.Blacklist
+	AuthMode         byte                              `json:"auth-mode" yaml:"auth-mode"`
+	AclMode          byte                              `json:"acl-mode" yaml:"acl-mode"`
+	IntrospectionUrl string                            `json:"introspection-url" yaml:"introspection-url"`
+	ClientID         string                            `json:"client-id" yaml:"client-id"`
+	ClientSecret     string                            `json:"client-secret" yaml:"client-secret"`
+	TokenTypeHint    string                            `json:"token-type-hint" yaml:"token-type-hint"`
+	Audience         string                            `json:"audience" yaml:"audience"`
+	CacheTTL         int64                             `json:"cache-ttl" yaml:"cache-ttl"`
+	UsernameClaim    string                            `json:"username-claim" yaml:"username-claim"`
+	ClientIDClaim    string                            `json:"clientid-claim" yaml:"clientid-claim"`
+	Acl              map[string]auth.Access            `json:"acl" yaml:"acl"`
+	Scopes           map[string]map[string]auth.Access `json:"scopes" yaml:"scopes"`
+	Outbound         plugin.Outbound                   `json:"outbound" yaml:"outbound"`
+}
+
+// Introspection is the response of an introspection endpoint for a token.
+type Introspection map[string]any
+
+// Active returns true if the token is active.
+func (i Introspection) Active() bool {
+	active, _ := i["active"].(bool)
+	return active
+}
+
+// String returns a string field, or the decimal of a numeric field, and false if the
+// field is missing or not a string or number.
+func (i Introspection) String(name string) (string, bool) {
+	switch v := i[name].(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	}
+
+	return "", false
+}
+
+// Expires returns the expiry of the token, and false if the response has no exp field.
+func (i Introspection) Expires() (time.Time, bool) {
+	n, ok := i["exp"].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	exp, err := n.Int64()
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(exp, 0), true
+}
+
+// Scopes returns the space separated scopes of the token.
+func (i Introspection) Scopes() []string {
+	scope, _ := i.String("scope")
+	return strings.Fields(scope)
+}
+
+// audience returns true if the aud field, a string or a list of strings, contains aud.
+func (i Introspection) audience(aud string) bool {
+	switch v := i["aud"].(type) {
+	case string:
+		return v == aud
+	case []any:
+		for _, a := range v {
+			if s, ok := a.(string); ok && s == aud {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// entry is a cached introspection of an active token.
+type entry struct {
+	introspection Introspection
+	expires       time.Time
+}
+
+// session is the token of a connected client.
+type session struct {
+	cl    *mqtt.Client
+	token string
+}
+
+// Auth is an auth controller which authenticates clients by an oauth2 access token
+// passed as the password, which is checked with the introspection endpoint of the
+// authorization server (RFC 7662). Active tokens are cached until they expire, for at
+// most the cache ttl, after which they are introspected again so that revoked tokens
+// lose access.
+type Auth struct {
+	mqtt.HookBase
+	config   *Options
+	client   *http.Client
+	cache    map[string]*entry // active tokens, keyed on the sha-256 of the token
+	mu       sync.RWMutex
+	sessions sync.Map
+	cancel   chan struct{}
+	metrics  pa.Metrics
+}
+
+// ID returns the ID of the hook.
+func (a *Auth) ID() string {
+	return "auth-oauth2"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (a *Auth) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnACLCheck,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+func (a *Auth) Init(config any) error {
+	if _, ok := config.(*Options); config == nil || (!ok && config != nil) {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	a.config = config.(*Options)
+	if a.config.IntrospectionUrl == "" {
+		return ErrNoIntrospectionUrl
+	}
+
+	if a.config.TokenTypeHint == "" {
+		a.config.TokenTypeHint = defaultTokenTypeHint
+	}
+
+	if a.config.CacheTTL <= 0 {
+		a.config.CacheTTL = defaultCacheTTL
+	}
+
+	switch {
+	case a.config.AuthMode == byte(auth.AuthUsername) && a.config.UsernameClaim == "":
+		a.config.UsernameClaim = defaultUsernameClaim
+	case a.config.AuthMode == byte(auth.AuthClientID) && a.config.ClientIDClaim == "":
+		a.config.ClientIDClaim = defaultClientIDClaim
+	}
+
+	a.Log.Info("", "introspection-url", a.config.IntrospectionUrl, "client-id", a.config.ClientID, "cache-ttl", a.config.CacheTTL)
+
+	a.client = http.DefaultClient
+	if a.config.Outbound.Enabled() {
+		client, err := a.config.Outbound.HTTPClient(nil)
+		if err != nil {
+			return err
+		}
+		a.client = client
+	}
+
+	a.cache = make(map[string]*entry)
+	a.cancel = make(chan struct{})
+	go a.sweep(sweepInterval, a.cancel)
+
+	return nil
+}
+
+// Stop stops removing expired cache entries.
+func (a *Auth) Stop() error {
+	if a.cancel != nil {
+		close(a.cancel)
+		a.cancel = nil
+	}
+
+	return nil
+}
+
+// sweep removes expired cache entries at an interval until cancelled.
+func (a *Auth) sweep(interval time.Duration, cancel chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cancel:
+			return
+		case now := <-ticker.C:
+			a.mu.Lock()
+			for k, e := range a.cache {
+				if now.After(e.expires) {
+					delete(a.cache, k)
+				}
+			}
+			a.mu.Unlock()
+		}
+	}
+}
+
+// OnConnectAuthenticate returns true if the connecting client passed an active token as
+// its password, whose introspection matches its username and client id. A client
+// connecting without a username is given the username of the token.
+func (a *Auth) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	if !pa.DecidedBy(cl, a.ID()) { // denied by an earlier datasource of the auth chain
+		return false
+	}
+
+	return pa.Decide(cl, a.ID(), a.metrics.Auth(a.authenticateClient(cl, pk)))
+}
+
+// authenticateClient returns whether the token of the connecting client allows it, or Unknown
+// if its password is not an active token.
+func (a *Auth) authenticateClient(cl *mqtt.Client, pk packets.Packet) pa.Result {
+	if a.config.AuthMode == byte(auth.AuthAnonymous) {
+		return pa.Allow
+	}
+
+	// check blacklist
+	if n, ok := a.config.CheckBLAuth(cl, pk); n >= 0 { // It's on the blacklist
+		return pa.ResultOf(ok)
+	}
+
+	token := string(pk.Connect.Password)
+	in, err := a.Introspect(token)
+	if err != nil {
+		a.Log.Warn("unable to introspect token", "error", err, "client", cl.ID)
+		return pa.Unknown
+	}
+	if in == nil {
+		return pa.Unknown
+	}
+
+	if a.config.UsernameClaim != "" {
+		username, ok := in.String(a.config.UsernameClaim)
+		if !ok {
+			return pa.Deny
+		}
+		if len(cl.Properties.Username) == 0 {
+			cl.Properties.Username = []byte(username)
+		} else if string(cl.Properties.Username) != username {
+			return pa.Deny
+		}
+	}
+
+	if a.config.ClientIDClaim != "" {
+		if id, ok := in.String(a.config.ClientIDClaim); !ok || cl.ID != id {
+			return pa.Deny
+		}
+	}
+
+	a.sessions.Store(cl.ID, &session{cl: cl, token: token})
+	return pa.Allow
+}
+
+// OnACLCheck returns true if the token of the client is still active and has matching
+// read or write access to subscribe or publish to a given topic.
+func (a *Auth) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	return a.config.AuthorizeClient(a.ID(), a.config.AclMode, &a.metrics, cl, topic, write, a.lookupAcl)
+}
+
+// lookupAcl returns true if the acl of the client in the introspection of its token
+// allows it to subscribe or publish to a topic.
+func (a *Auth) lookupAcl(cl *mqtt.Client, topic string, write bool) bool {
+	v, ok := a.sessions.Load(cl.ID)
+	if !ok || v.(*session).cl != cl {
+		return false
+	}
+
+	in, err := a.Introspect(v.(*session).token)
+	if err != nil {
+		a.Log.Warn("unable to introspect token", "error", err, "client", cl.ID)
+		return false
+	}
+	if in == nil {
+		return false
+	}
+
+	fam := make(map[string]auth.Access)
+	for filter, access := range a.Filters(in) {
+		if filter, ok := pa.ExpandClientFilter(cl, filter); ok && plugin.MatchTopic(filter, topic) {
+			fam[filter] = access
+		}
+	}
+
+	return pa.CheckAcl(fam, write)
+}
+
+// OnDisconnect removes the token of a disconnected client, unless it was taken over.
+func (a *Auth) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	if v, ok := a.sessions.Load(cl.ID); ok && v.(*session).cl == cl {
+		a.sessions.CompareAndDelete(cl.ID, v)
+	}
+}
+
+// Introspect returns the introspection of a token if it is active and for the audience,
+// from the cache or the introspection endpoint, or nil if it is not.
+func (a *Auth) Introspect(token string) (Introspection, error) {
+	if token == "" {
+		return nil, nil
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+	now := time.Now()
+
+	a.mu.RLock()
+	e, ok := a.cache[key]
+	a.mu.RUnlock()
+	hit := ok && now.Before(e.expires)
+	a.metrics.Cached(hit)
+	if hit {
+		return e.introspection, nil
+	}
+
+	in, err := a.introspect(token)
+	a.metrics.Lookup(now)
+	if err != nil {
+		return nil, err
+	}
+
+	if !in.Active() || (a.config.Audience != "" && !in.audience(a.config.Audience)) {
+		a.mu.Lock()
+		delete(a.cache, key)
+		a.mu.Unlock()
+		return nil, nil
+	}
+
+	expires := now.Add(time.Duration(a.config.CacheTTL) * time.Second)
+	if exp, ok := in.Expires(); ok {
+		if !now.Before(exp) {
+			return nil, nil
+		}
+		if exp.Before(expires) {
+			expires = exp
+		}
+	}
+
+	a.mu.Lock()
+	a.cache[key] = &entry{introspection: in, expires: expires}
+	a.mu.Unlock()
+
+	return in, nil
+}
+
+// introspect posts a token to the introspection endpoint, authenticating with the
+// client credentials.
+func (a *Auth) introspect(token string) (Introspection, error) {
+	form := url.Values{
+		"token":           {token},
+		"token_type_hint": {a.config.TokenTypeHint},
+	}
+	req, err := http.NewRequest(http.MethodPost, a.config.IntrospectionUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if a.config.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(a.config.ClientID), url.QueryEscape(a.config.ClientSecret))
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrIntrospection, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s", ErrIntrospection, resp.Status)
+	}
+
+	var in Introspection
+	d := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize))
+	d.UseNumber()
+	if err := d.Decode(&in); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrIntrospection, err)
+	}
+
+	return in, nil
+}
+
+// Filters returns the acl filters of a token, from the acl filter templates and the
+// filters of its scopes, with the ${field} placeholders replaced by the fields of its
+// introspection. Templates referring to a missing field are skipped.
+func (a *Auth) Filters(in Introspection) map[string]auth.Access {
+	fam := make(map[string]auth.Access)
+	add := func(tmpl string, access auth.Access) {
+		filter, ok := pa.ExpandFilter(tmpl, in.String)
+		if !ok {
+			return
+		}
+
+		// a filter denied by any scope is denied, otherwise the access of the scopes is combined.
+		if prev, ok := fam[filter]; ok && (prev == auth.Deny || access == auth.Deny) {
+			fam[filter] = auth.Deny
+		} else {
+			fam[filter] = prev | access
+		}
+	}
+
+	for tmpl, access := range a.config.Acl {
+		add(tmpl, access)
+	}
+
+	for _, scope := range in.Scopes() {
+		for tmpl, access := range a.config.Scopes[scope] {
+			add(tmpl, access)
+		}
+	}
+
+	return fam
+}
+
+// AuthMetrics returns the decisions, datasource latency and cache hits of the hook.
+func (a *Auth) AuthMetrics() mqtt.AuthMetrics {
+	return a.metrics.Snapshot(a.ID(), nil)
+}
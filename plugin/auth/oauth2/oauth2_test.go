@@ -0,0 +1,336 @@
+package oauth2
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/plugin"
+)
+
+const path = "./conf.yml"
+
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// idp is an authorization server introspecting tokens, counting the requests.
+type idp struct {
+	sync.Mutex
+	tokens   map[string]map[string]any
+	requests int64
+}
+
+func newIdp(t *testing.T) (*idp, *httptest.Server) {
+	p := &idp{tokens: map[string]map[string]any{}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&p.requests, 1)
+		// client credentials are form encoded before basic authentication
+		id, secret, ok := r.BasicAuth()
+		secret, _ = url.QueryUnescape(secret)
+		if !ok || id != "comqtt" || secret != "s3cr:t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		p.Lock()
+		in, ok := p.tokens[r.PostFormValue("token")]
+		p.Unlock()
+		if !ok || r.PostFormValue("token_type_hint") != defaultTokenTypeHint {
+			in = map[string]any{"active": false}
+		}
+		_ = json.NewEncoder(w).Encode(in)
+	}))
+	t.Cleanup(srv.Close)
+	return p, srv
+}
+
+// issue adds an active token expiring in an hour, with extra fields.
+func (p *idp) issue(token string, extra map[string]any) {
+	in := map[string]any{"active": true, "exp": time.Now().Add(time.Hour).Unix()}
+	for k, v := range extra {
+		in[k] = v
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	p.tokens[token] = in
+}
+
+// revoke makes a token inactive.
+func (p *idp) revoke(token string) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.tokens, token)
+}
+
+func newAuth(t *testing.T, opts *Options) *Auth {
+	a := new(Auth)
+	a.SetOpts(logger, nil)
+	require.NoError(t, a.Init(opts))
+	t.Cleanup(func() {
+		_ = a.Stop()
+	})
+	return a
+}
+
+func connect(a *Auth, id, username, token string) (*mqtt.Client, bool) {
+	cl := &mqtt.Client{
+		ID: id,
+		Properties: mqtt.ClientProperties{
+			Username: []byte(username),
+		},
+	}
+	pk := packets.Packet{Connect: packets.ConnectParams{Password: []byte(token)}}
+	return cl, a.OnConnectAuthenticate(cl, pk)
+}
+
+func TestInitFromConfFile(t *testing.T) {
+	opts := new(Options)
+	require.NoError(t, plugin.LoadYaml(path, opts))
+
+	a := newAuth(t, opts)
+	require.Equal(t, "https://idp.example.com/oauth2/introspect", a.config.IntrospectionUrl)
+	require.Equal(t, "username", a.config.UsernameClaim)
+	require.Equal(t, int64(60), a.config.CacheTTL)
+	require.Equal(t, auth.WriteOnly, a.config.Scopes["telemetry"]["telemetry/${username}/#"])
+}
+
+func TestInitInvalid(t *testing.T) {
+	a := new(Auth)
+	a.SetOpts(logger, nil)
+	require.ErrorIs(t, a.Init(nil), mqtt.ErrInvalidConfigType)
+	require.ErrorIs(t, a.Init(&Options{}), ErrNoIntrospectionUrl)
+}
+
+func TestInitDefaults(t *testing.T) {
+	a := newAuth(t, &Options{AuthMode: byte(auth.AuthClientID), IntrospectionUrl: "http://localhost"})
+	require.Equal(t, defaultTokenTypeHint, a.config.TokenTypeHint)
+	require.Equal(t, int64(defaultCacheTTL), a.config.CacheTTL)
+	require.Equal(t, "client_id", a.config.ClientIDClaim)
+	require.Empty(t, a.config.UsernameClaim)
+}
+
+func TestIntrospectCache(t *testing.T) {
+	p, srv := newIdp(t)
+	a := newAuth(t, &Options{IntrospectionUrl: srv.URL, ClientID: "comqtt", ClientSecret: "s3cr:t"})
+
+	p.issue("t1", map[string]any{"username": "device-001"})
+	in, err := a.Introspect("t1")
+	require.NoError(t, err)
+	require.NotNil(t, in)
+	username, _ := in.String("username")
+	require.Equal(t, "device-001", username)
+
+	// active tokens are cached
+	_, err = a.Introspect("t1")
+	require.NoError(t, err)
+	require.Equal(t, int64(1), atomic.LoadInt64(&p.requests))
+
+	// inactive tokens are not
+	in, err = a.Introspect("t2")
+	require.NoError(t, err)
+	require.Nil(t, in)
+	_, _ = a.Introspect("t2")
+	require.Equal(t, int64(3), atomic.LoadInt64(&p.requests))
+
+	// empty tokens are not introspected
+	in, err = a.Introspect("")
+	require.NoError(t, err)
+	require.Nil(t, in)
+	require.Equal(t, int64(3), atomic.LoadInt64(&p.requests))
+}
+
+func TestIntrospectCacheExpiry(t *testing.T) {
+	p, srv := newIdp(t)
+	a := newAuth(t, &Options{IntrospectionUrl: srv.URL, ClientID: "comqtt", ClientSecret: "s3cr:t", CacheTTL: 3600})
+
+	// tokens are cached until they expire, for at most the cache ttl
+	p.issue("t1", map[string]any{"exp": time.Now().Add(time.Minute).Unix()})
+	_, err := a.Introspect("t1")
+	require.NoError(t, err)
+	for _, e := range a.cache {
+		require.WithinDuration(t, time.Now().Add(time.Minute), e.expires, 2*time.Second)
+	}
+
+	p.issue("t2", map[string]any{"exp": time.Now().Add(-time.Minute).Unix()})
+	in, err := a.Introspect("t2")
+	require.NoError(t, err)
+	require.Nil(t, in)
+}
+
+func TestIntrospectAudience(t *testing.T) {
+	p, srv := newIdp(t)
+	a := newAuth(t, &Options{IntrospectionUrl: srv.URL, ClientID: "comqtt", ClientSecret: "s3cr:t", Audience: "mqtt"})
+
+	p.issue("t1", map[string]any{"aud": []string{"api", "mqtt"}})
+	p.issue("t2", map[string]any{"aud": "api"})
+
+	in, err := a.Introspect("t1")
+	require.NoError(t, err)
+	require.NotNil(t, in)
+
+	in, err = a.Introspect("t2")
+	require.NoError(t, err)
+	require.Nil(t, in)
+}
+
+func TestIntrospectUnavailable(t *testing.T) {
+	p, srv := newIdp(t)
+	p.issue("t1", nil)
+
+	// wrong client credentials
+	a := newAuth(t, &Options{AuthMode: byte(auth.AuthUsername), IntrospectionUrl: srv.URL, ClientID: "comqtt", ClientSecret: "wrong"})
+	_, err := a.Introspect("t1")
+	require.ErrorIs(t, err, ErrIntrospection)
+
+	_, ok := connect(a, "c1", "", "t1")
+	require.False(t, ok)
+}
+
+func TestOnConnectAuthenticateUsername(t *testing.T) {
+	p, srv := newIdp(t)
+	a := newAuth(t, &Options{AuthMode: byte(auth.AuthUsername), IntrospectionUrl: srv.URL, ClientID: "comqtt", ClientSecret: "s3cr:t"})
+	p.issue("t1", map[string]any{"username": "device-001"})
+
+	_, ok := connect(a, "c1", "device-001", "t1")
+	require.True(t, ok)
+
+	_, ok = connect(a, "c1", "device-002", "t1")
+	require.False(t, ok)
+
+	_, ok = connect(a, "c1", "device-001", "t2")
+	require.False(t, ok)
+
+	// the username of the token is given to clients without a username
+	cl, ok := connect(a, "c1", "", "t1")
+	require.True(t, ok)
+	require.Equal(t, "device-001", string(cl.Properties.Username))
+}
+
+func TestOnConnectAuthenticateClientID(t *testing.T) {
+	p, srv := newIdp(t)
+	a := newAuth(t, &Options{AuthMode: byte(auth.AuthClientID), IntrospectionUrl: srv.URL, ClientID: "comqtt", ClientSecret: "s3cr:t"})
+	p.issue("t1", map[string]any{"client_id": "device-001"})
+
+	_, ok := connect(a, "device-001", "", "t1")
+	require.True(t, ok)
+
+	_, ok = connect(a, "device-002", "", "t1")
+	require.False(t, ok)
+}
+
+func TestOnACLCheck(t *testing.T) {
+	p, srv := newIdp(t)
+	a := newAuth(t, &Options{
+		AuthMode:         byte(auth.AuthUsername),
+		AclMode:          byte(auth.AuthUsername),
+		IntrospectionUrl: srv.URL,
+		ClientID:         "comqtt",
+		ClientSecret:     "s3cr:t",
+		Acl: map[string]auth.Access{
+			"devices/${username}/#": auth.ReadWrite,
+		},
+		Scopes: map[string]map[string]auth.Access{
+			"telemetry": {"telemetry/${username}/#": auth.WriteOnly},
+			"commands":  {"telemetry/${username}/#": auth.ReadOnly},
+			"muted":     {"devices/${username}/#": auth.Deny},
+		},
+	})
+
+	p.issue("t1", map[string]any{"username": "device-001", "scope": "openid telemetry commands"})
+	cl, ok := connect(a, "c1", "", "t1")
+	require.True(t, ok)
+
+	require.True(t, a.OnACLCheck(cl, "devices/device-001/state", true))
+	require.False(t, a.OnACLCheck(cl, "devices/device-002/state", true))
+	require.True(t, a.OnACLCheck(cl, "telemetry/device-001/temp", true))
+	require.True(t, a.OnACLCheck(cl, "telemetry/device-001/temp", false))
+
+	// a filter denied by any scope is denied
+	p.issue("t2", map[string]any{"username": "device-002", "scope": "muted"})
+	cl2, ok := connect(a, "c2", "", "t2")
+	require.True(t, ok)
+	require.False(t, a.OnACLCheck(cl2, "devices/device-002/state", false))
+
+	// a client which was not authenticated has no access
+	require.False(t, a.OnACLCheck(&mqtt.Client{ID: "c3"}, "devices/device-001/state", false))
+}
+
+func TestOnACLCheckRevoked(t *testing.T) {
+	p, srv := newIdp(t)
+	a := newAuth(t, &Options{
+		AuthMode:         byte(auth.AuthUsername),
+		AclMode:          byte(auth.AuthUsername),
+		IntrospectionUrl: srv.URL,
+		ClientID:         "comqtt",
+		ClientSecret:     "s3cr:t",
+		Acl:              map[string]auth.Access{"#": auth.ReadWrite},
+	})
+
+	p.issue("t1", map[string]any{"username": "device-001"})
+	cl, ok := connect(a, "c1", "", "t1")
+	require.True(t, ok)
+	require.True(t, a.OnACLCheck(cl, "a/b", true))
+
+	// the revocation is seen once the cache entry expires
+	p.revoke("t1")
+	require.True(t, a.OnACLCheck(cl, "a/b", true))
+	for _, e := range a.cache {
+		e.expires = time.Now().Add(-time.Second)
+	}
+	require.False(t, a.OnACLCheck(cl, "a/b", true))
+	require.Empty(t, a.cache)
+}
+
+func TestOnDisconnectTakeover(t *testing.T) {
+	p, srv := newIdp(t)
+	a := newAuth(t, &Options{AuthMode: byte(auth.AuthUsername), IntrospectionUrl: srv.URL, ClientID: "comqtt", ClientSecret: "s3cr:t"})
+	p.issue("t1", map[string]any{"username": "device-001"})
+
+	old, ok := connect(a, "c1", "", "t1")
+	require.True(t, ok)
+	cl, ok := connect(a, "c1", "", "t1")
+	require.True(t, ok)
+
+	// the disconnection of a client taken over keeps the token of the new client
+	a.OnDisconnect(old, nil, false)
+	_, ok = a.sessions.Load("c1")
+	require.True(t, ok)
+
+	a.OnDisconnect(cl, nil, false)
+	_, ok = a.sessions.Load("c1")
+	require.False(t, ok)
+}
+
+func TestSweep(t *testing.T) {
+	a := newAuth(t, &Options{IntrospectionUrl: "http://localhost"})
+	_ = a.Stop()
+
+	a.cache["expired"] = &entry{expires: time.Now().Add(-time.Second)}
+	a.cache["active"] = &entry{expires: time.Now().Add(time.Hour)}
+
+	cancel := make(chan struct{})
+	go a.sweep(10*time.Millisecond, cancel)
+	defer close(cancel)
+
+	require.Eventually(t, func() bool {
+		a.mu.RLock()
+		defer a.mu.RUnlock()
+		_, ok := a.cache["expired"]
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	require.Contains(t, a.cache, "active")
+}
@@ -0,0 +1,80 @@
+package postgresql
+
+import (
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	defaultNotifyChannel = "comqtt_auth"
+	minListenerReconnect = time.Second
+	maxListenerReconnect = time.Minute
+	listenerPingInterval = 90 * time.Second // how often an idle listener connection is checked
+)
+
+// NotifyOptions listens for notifications sent when the auth and acl tables change, and
+// invalidates the cached lookups of the user named in the payload of each notification.
+type NotifyOptions struct {
+	Enable  bool   `json:"enable" yaml:"enable"`
+	Channel string `json:"channel" yaml:"channel"` // the channel notified by the table triggers, default comqtt_auth
+}
+
+// listen starts listening on the notify channel, invalidating cached lookups until the
+// listener is closed. The listener reconnects by itself while the database is unavailable.
+func (a *Auth) listen(dsn string) error {
+	channel := a.config.Notify.Channel
+	if channel == "" {
+		channel = defaultNotifyChannel
+	}
+
+	a.listener = pq.NewListener(dsn, minListenerReconnect, maxListenerReconnect, func(ev pq.ListenerEventType, err error) {
+		switch ev {
+		case pq.ListenerEventConnectionAttemptFailed, pq.ListenerEventDisconnected:
+			a.Log.Warn("postgresql notify listener disconnected", "error", err)
+		case pq.ListenerEventReconnected:
+			a.Log.Info("postgresql notify listener reconnected", "channel", channel)
+		}
+	})
+	if err := a.listener.Listen(channel); err != nil {
+		a.listener.Close()
+		a.listener = nil
+		return err
+	}
+
+	a.Log.Info("listening for postgresql auth notifications", "channel", channel)
+	go a.notifications(a.listener)
+	return nil
+}
+
+// notifications invalidates the cached lookups named by each notification, until the
+// listener is closed.
+func (a *Auth) notifications(l *pq.Listener) {
+	ticker := time.NewTicker(listenerPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case n, ok := <-l.Notify:
+			if !ok {
+				return
+			}
+			a.notified(n)
+		case <-ticker.C:
+			go l.Ping()
+		}
+	}
+}
+
+// notified invalidates the cached lookups of the username or client id in the payload of
+// a notification, or all cached lookups if the payload is empty or the notification is
+// nil, which is received after reconnecting as notifications may have been missed.
+func (a *Auth) notified(n *pq.Notification) int {
+	var key string
+	if n != nil {
+		key = n.Extra
+	}
+
+	count := a.InvalidateAuthCache(key)
+	a.Log.Debug("invalidated cached auth lookups", "key", key, "count", count)
+	return count
+}
@@ -5,7 +5,7 @@ import (
 	"fmt"
 
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/wind-c/comqtt/v2/mqtt"
 	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
 	"github.com/wind-c/comqtt/v2/mqtt/packets"
@@ -15,11 +15,14 @@ import (
 
 type Options struct {
 	pa.Blacklist
-	AuthMode byte      `json:"auth-mode" yaml:"auth-mode"`
-	AclMode  byte      `json:"acl-mode" yaml:"acl-mode"`
-	Dsn      DsnInfo   `json:"dsn" yaml:"dsn"`
-	Auth     AuthTable `json:"auth" yaml:"auth"`
-	Acl      AclTable  `json:"acl" yaml:"acl"`
+	AuthMode byte              `json:"auth-mode" yaml:"auth-mode"`
+	AclMode  byte              `json:"acl-mode" yaml:"acl-mode"`
+	Dsn      DsnInfo           `json:"dsn" yaml:"dsn"`
+	Auth     AuthTable         `json:"auth" yaml:"auth"`
+	Acl      AclTable          `json:"acl" yaml:"acl"`
+	Replica  pa.ReplicaOptions `json:"replica" yaml:"replica"`
+	Cache    pa.CacheOptions   `json:"cache" yaml:"cache"`
+	Notify   NotifyOptions     `json:"notify" yaml:"notify"`
 }
 
 type DsnInfo struct {
@@ -33,29 +36,22 @@ type DsnInfo struct {
 	MaxIdleConns  int    `json:"max-idle-conns" yaml:"max-idle-conns"`
 }
 
-type AuthTable struct {
-	Table          string      `json:"table" yaml:"table"`
-	UserColumn     string      `json:"user-column" yaml:"user-column"`
-	PasswordColumn string      `json:"password-column" yaml:"password-column"`
-	AllowColumn    string      `json:"allow-column" yaml:"allow-column"`
-	PasswordHash   pa.HashType `json:"password-hash" yaml:"password-hash"`
-	HashKey        string      `json:"hash-key" yaml:"hash-key"`
-}
+// AuthTable is the table of the users.
+type AuthTable = pa.AuthTable
 
-type AclTable struct {
-	Table        string `json:"table" yaml:"table"`
-	UserColumn   string `json:"user-column" yaml:"user-column"`
-	TopicColumn  string `json:"topic-column" yaml:"topic-column"`
-	AccessColumn string `json:"access-column" yaml:"access-column"`
-}
+// AclTable is the table of the acl filters of the users.
+type AclTable = pa.AclTable
 
 // Auth is an auth controller which allows access to all connections and topics.
 type Auth struct {
 	mqtt.HookBase
 	config   *Options
 	db       *sqlx.DB
-	authStmt *sqlx.Stmt
-	aclStmt  *sqlx.Stmt
+	store    *pa.SqlStore
+	replica  *pa.Replica
+	cache    *pa.Cache
+	listener *pq.Listener
+	metrics  pa.Metrics
 }
 
 // ID returns the ID of the hook.
@@ -77,6 +73,7 @@ func (a *Auth) Init(config any) error {
 	}
 
 	a.config = config.(*Options)
+	a.cache = pa.NewCache(a.config.Cache)
 	a.Log.Info("connecting to postgresql",
 		"host", a.config.Dsn.Host,
 		"username", a.config.Dsn.LoginName,
@@ -85,49 +82,91 @@ func (a *Auth) Init(config any) error {
 
 	dsn := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
 		a.config.Dsn.Host, a.config.Dsn.Port, a.config.Dsn.LoginName, a.config.Dsn.LoginPassword, a.config.Dsn.Schema, a.config.Dsn.SslMode)
+
 	sqlxDB, err := sqlx.Connect("postgres", dsn)
-	if err != nil {
+	if err != nil && !a.config.Replica.Enable {
 		return err
+	} else if err != nil {
+		// the replica serves clients until the database becomes available
+		a.Log.Warn("unable to connect to postgresql, using auth replica", "error", err)
+		if sqlxDB, err = sqlx.Open("postgres", dsn); err != nil {
+			return err
+		}
 	}
 	sqlxDB.SetMaxOpenConns(a.config.Dsn.MaxOpenConns)
 	sqlxDB.SetMaxIdleConns(a.config.Dsn.MaxIdleConns)
+	a.db = sqlxDB
 
-	authSql := fmt.Sprintf(`select %s, %s from %s where %s=$1`,
-		a.config.Auth.PasswordColumn, a.config.Auth.AllowColumn, a.config.Auth.Table, a.config.Auth.UserColumn)
-	aclSql := fmt.Sprintf(`select %s, %s from %s where %s=$1`,
-		a.config.Acl.TopicColumn, a.config.Acl.AccessColumn, a.config.Acl.Table, a.config.Acl.UserColumn)
-	a.authStmt, err = sqlxDB.Preparex(authSql)
-	if err != nil {
-		a.Log.Error("Unable to create prepared statement for auth-sql", "authSql", authSql)
-		return err
+	if a.config.Replica.Enable {
+		a.replica = pa.NewReplica(a.config.Replica, pa.SqlReplicaLoader(sqlxDB, a.config.Auth.ReplicaQuery(), a.config.Acl.ReplicaQuery()), a.Log)
+		if err := a.replica.Start(); err != nil && !a.replica.Ready() {
+			return err
+		} else if err != nil {
+			a.Log.Warn("unable to sync auth replica", "error", err)
+		}
 	}
-	a.aclStmt, err = sqlxDB.Preparex(aclSql)
-	if err != nil {
-		a.Log.Error("Unable to create prepared statement for acl-sql", "aclStmt", aclSql)
+
+	a.store = pa.NewSqlStore(sqlxDB, a.config.Auth, a.config.Acl, "$1", a.cache, a.replica, &a.metrics, a.Log)
+	if err := a.store.Prepare(); err != nil && a.replica == nil {
 		return err
 	}
-	a.db = sqlxDB
+
+	if a.config.Notify.Enable {
+		if !a.config.Cache.Enable {
+			a.Log.Warn("postgresql notify is enabled without the auth cache, which it invalidates")
+		}
+		if err := a.listen(dsn); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// InvalidateAuthCache removes the cached lookups of a username or client id, or all
+// cached lookups if the key is empty.
+func (a *Auth) InvalidateAuthCache(key string) int {
+	if key == "" {
+		return a.cache.Purge()
+	}
+	return a.cache.Invalidate(key)
+}
+
 // Stop closes the postgresql connection.
 func (a *Auth) Stop() error {
 	a.Log.Info("disconnecting from postgresql")
-	a.authStmt.Close()
-	a.aclStmt.Close()
+	if a.listener != nil {
+		a.listener.Close()
+	}
+	if a.replica != nil {
+		a.replica.Stop()
+	}
+	if a.store != nil {
+		a.store.Close()
+	}
 	return a.db.Close()
 }
 
 // OnConnectAuthenticate returns true if the connecting client has rules which provide access
 // in the auth ledger.
 func (a *Auth) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	if !pa.DecidedBy(cl, a.ID()) { // denied by an earlier datasource of the auth chain
+		return false
+	}
+
+	return pa.Decide(cl, a.ID(), a.metrics.Auth(a.authenticateClient(cl, pk)))
+}
+
+// authenticateClient returns whether the auth row of the connecting client allows it, or
+// Unknown if it has no row or the database and replica are unavailable.
+func (a *Auth) authenticateClient(cl *mqtt.Client, pk packets.Packet) pa.Result {
 	if a.config.AuthMode == byte(auth.AuthAnonymous) {
-		return true
+		return pa.Allow
 	}
 
 	// check blacklist
 	if n, ok := a.config.CheckBLAuth(cl, pk); n >= 0 { // It's on the blacklist
-		return ok
+		return pa.ResultOf(ok)
 	}
 
 	// normal verification
@@ -137,61 +176,58 @@ func (a *Auth) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
 	} else if a.config.AuthMode == byte(auth.AuthClientID) {
 		key = cl.ID
 	} else {
-		return false
+		return pa.Unknown
 	}
 
-	var password string
-	var allow int
-	row := a.authStmt.QueryRowx(key)
-	err := row.Scan(&password, &allow)
-	if err != nil || allow == 0 {
-		return false
+	u, err := a.store.QueryAuth(key)
+	if err != nil {
+		return pa.Unknown
+	} else if u.Allow == 0 {
+		return pa.Deny
 	}
 
-	return pa.CompareHash(password, string(pk.Connect.Password), a.config.Auth.HashKey, a.config.Auth.PasswordHash)
+	if !pa.CompareHash(u.Password, string(pk.Connect.Password), a.config.Auth.HashKey, a.config.Auth.PasswordHash) {
+		return pa.Deny
+	}
+
+	if u.Superuser == 1 {
+		pa.SetSuperuser(cl)
+	}
+	pa.SetMaxConnections(cl, u.MaxConnections)
+
+	return pa.Allow
 }
 
 // OnACLCheck returns true if the connecting client has matching read or write access to subscribe
 // or publish to a given topic.
 func (a *Auth) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
-	if a.config.AclMode == byte(auth.AuthAnonymous) {
-		return true
-	}
-
-	// check blacklist
-	if n, ok := a.config.CheckBLAcl(cl, topic, write); n >= 0 { // It's on the blacklist
-		return ok
-	}
+	return a.config.AuthorizeClient(a.ID(), a.config.AclMode, &a.metrics, cl, topic, write, a.lookupAcl)
+}
 
-	// normal verification
-	var key string
-	if a.config.AclMode == byte(auth.AuthUsername) {
-		key = string(cl.Properties.Username)
-	} else if a.config.AclMode == byte(auth.AuthClientID) {
-		key = cl.ID
-	} else {
+// lookupAcl returns true if the acl of the client in postgresql allows it to subscribe or
+// publish to a topic.
+func (a *Auth) lookupAcl(cl *mqtt.Client, topic string, write bool) bool {
+	key, ok := pa.AclKey(cl, a.config.AclMode)
+	if !ok {
 		return false
 	}
 
-	rows, err := a.aclStmt.Query(key)
+	acl, err := a.store.QueryAcl(key)
 	if err != nil {
 		return false
 	}
 
 	fam := make(map[string]auth.Access)
-	for rows.Next() {
-		var filter string
-		var access byte
-		if err := rows.Scan(&filter, &access); err != nil {
-			continue
-		}
-
-		if !plugin.MatchTopic(filter, topic) {
-			continue
+	for filter, access := range acl {
+		if filter, ok := pa.ExpandClientFilter(cl, filter); ok && plugin.MatchTopic(filter, topic) {
+			fam[filter] = access
 		}
-
-		fam[filter] = auth.Access(access)
 	}
 
 	return pa.CheckAcl(fam, write)
 }
+
+// AuthMetrics returns the decisions, datasource latency and cache hits of the hook.
+func (a *Auth) AuthMetrics() mqtt.AuthMetrics {
+	return a.metrics.Snapshot(a.ID(), a.cache)
+}
@@ -5,12 +5,15 @@ import (
 	"log/slog"
 	"net"
 	"testing"
+	"time"
 
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/require"
 	"github.com/wind-c/comqtt/v2/mqtt"
 	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
 	"github.com/wind-c/comqtt/v2/mqtt/packets"
 	"github.com/wind-c/comqtt/v2/plugin"
+	pa "github.com/wind-c/comqtt/v2/plugin/auth"
 )
 
 const path = "./testdata/conf.yml"
@@ -135,3 +138,42 @@ func hasPostgresql() bool {
 	_ = c.Close()
 	return true
 }
+
+func TestNotified(t *testing.T) {
+	a := new(Auth)
+	a.SetOpts(logger, nil)
+	a.config = &Options{}
+	a.cache = pa.NewCache(pa.CacheOptions{Enable: true, NegativeTTL: 60})
+	a.cache.Set(pa.CacheAuth, "zhangsan", pa.ReplicaUser{Password: "321654", Allow: 1}, false)
+	a.cache.Set(pa.CacheAcl, "zhangsan", map[string]auth.Access{"a/b": auth.ReadWrite}, false)
+	a.cache.Set(pa.CacheAuth, "lisi", nil, true)
+
+	require.Equal(t, 2, a.notified(&pq.Notification{Channel: defaultNotifyChannel, Extra: "zhangsan"}))
+	require.Equal(t, 1, a.cache.Len())
+	require.Equal(t, 0, a.notified(&pq.Notification{Channel: defaultNotifyChannel, Extra: "wangwu"}))
+
+	// a reconnected listener may have missed notifications, so everything is purged
+	require.Equal(t, 1, a.notified(nil))
+	require.Equal(t, 0, a.cache.Len())
+}
+
+func TestNotifyInvalidatesCache(t *testing.T) {
+	if !hasPostgresql() {
+		t.SkipNow()
+	}
+	a := new(Auth)
+	a.SetOpts(logger, nil)
+	opts := Options{}
+	require.NoError(t, plugin.LoadYaml(path, &opts))
+	opts.Cache.Enable = true
+	opts.Notify.Enable = true
+	require.NoError(t, a.Init(&opts))
+	defer teardown(a, t)
+
+	require.True(t, a.OnConnectAuthenticate(client, pkc))
+	require.Equal(t, 1, a.cache.Len())
+
+	_, err := a.db.Exec("select pg_notify($1, $2)", defaultNotifyChannel, "zhangsan")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return a.cache.Len() == 0 }, 5*time.Second, 10*time.Millisecond)
+}
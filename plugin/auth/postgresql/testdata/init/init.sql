@@ -4,6 +4,7 @@ CREATE TABLE auth (
     username TEXT NOT NULL UNIQUE,
     password TEXT NOT NULL,
     allow smallint DEFAULT 1 NOT NULL,
+    superuser smallint DEFAULT 0 NOT NULL,
     created timestamp with time zone DEFAULT NOW(),
     updated timestamp
 );
@@ -18,6 +19,20 @@ CREATE TABLE acl(
 );
 CREATE INDEX acl_username_idx ON acl(username);
 
+CREATE FUNCTION comqtt_auth_notify() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP <> 'INSERT' THEN
+        PERFORM pg_notify('comqtt_auth', OLD.username);
+    END IF;
+    IF TG_OP <> 'DELETE' THEN
+        PERFORM pg_notify('comqtt_auth', NEW.username);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+CREATE TRIGGER auth_notify AFTER INSERT OR UPDATE OR DELETE ON auth FOR EACH ROW EXECUTE FUNCTION comqtt_auth_notify();
+CREATE TRIGGER acl_notify AFTER INSERT OR UPDATE OR DELETE ON acl FOR EACH ROW EXECUTE FUNCTION comqtt_auth_notify();
+
 INSERT INTO auth (username, password, allow) VALUES ('zhangsan', '321654', 1);
 INSERT INTO acl (username, topic, access) VALUES ('zhangsan', 'topictest/1', 2);
 
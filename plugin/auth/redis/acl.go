@@ -0,0 +1,153 @@
+package redis
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+	pa "github.com/wind-c/comqtt/v2/plugin/auth"
+)
+
+// aclRule is a filter of an acl and its access.
+type aclRule struct {
+	filter string
+	access auth.Access
+}
+
+// aclNode is a level of the wildcard filters of an acl.
+type aclNode struct {
+	children  map[string]*aclNode // literal levels
+	templates map[string]*aclNode // levels containing %u or %c, expanded for each client
+	plus      *aclNode            // the + level
+	hash      []aclRule           // filters ending, or ignoring any levels after, a # level
+	rules     []aclRule           // filters ending at this level
+}
+
+// aclTree is the compiled acl of a user. Filters without wildcards or placeholders are
+// kept in a map of exact matches, and the rest in a tree of topic levels, so that a topic
+// is checked in time proportional to its depth rather than to the number of filters.
+type aclTree struct {
+	exact map[string]auth.Access
+	root  *aclNode
+}
+
+// compileAcl compiles the acl hash of a user, which maps filters to their access. Filters
+// with an access which is not a number are ignored.
+func compileAcl(res map[string]string) *aclTree {
+	t := &aclTree{
+		exact: make(map[string]auth.Access),
+		root:  new(aclNode),
+	}
+
+	for filter, rw := range res {
+		access, err := strconv.Atoi(rw)
+		if err != nil {
+			continue
+		}
+
+		t.add(filter, auth.Access(access))
+	}
+
+	return t
+}
+
+// add adds a filter to the acl.
+func (t *aclTree) add(filter string, access auth.Access) {
+	if !strings.ContainsAny(filter, "+#") && !strings.Contains(filter, pa.UsernamePlaceholder) && !strings.Contains(filter, pa.ClientIDPlaceholder) {
+		t.exact[filter] = access
+		return
+	}
+
+	r := aclRule{filter: filter, access: access}
+	n := t.root
+	for _, level := range strings.Split(filter, "/") {
+		switch {
+		case level == "#":
+			n.hash = append(n.hash, r) // levels after # are never compared
+			return
+		case level == "+":
+			if n.plus == nil {
+				n.plus = new(aclNode)
+			}
+			n = n.plus
+		case strings.Contains(level, pa.UsernamePlaceholder) || strings.Contains(level, pa.ClientIDPlaceholder):
+			n = n.child(&n.templates, level)
+		default:
+			n = n.child(&n.children, level)
+		}
+	}
+
+	n.rules = append(n.rules, r)
+}
+
+// child returns the node of a level in a map of levels, adding it if it does not exist.
+func (n *aclNode) child(m *map[string]*aclNode, level string) *aclNode {
+	if *m == nil {
+		*m = make(map[string]*aclNode)
+	}
+
+	c, ok := (*m)[level]
+	if !ok {
+		c = new(aclNode)
+		(*m)[level] = c
+	}
+
+	return c
+}
+
+// Check returns true if the acl gives a client read or write access to a topic. As with
+// plugin.MatchTopic, a filter matches any topic it is a prefix of, and the longest matching
+// filter, after expanding its placeholders, decides. Between matching filters of the same
+// length, the one with fewer wildcard levels decides, then the one denying access.
+func (t *aclTree) Check(cl *mqtt.Client, topic string, write bool) bool {
+	fam := make(map[string]auth.Access)
+	for i := 0; i <= len(topic); i++ {
+		if i < len(topic) && topic[i] != '/' {
+			continue
+		}
+
+		if access, ok := t.exact[topic[:i]]; ok {
+			fam[topic[:i]] = access
+		}
+	}
+
+	t.root.match(cl, strings.Split(topic, "/"), 0, fam)
+	return pa.CheckAcl(fam, write)
+}
+
+// match adds the filters of a node and its descendants which match the levels of a topic,
+// where the node is reached after matching depth levels.
+func (n *aclNode) match(cl *mqtt.Client, levels []string, depth int, fam map[string]auth.Access) {
+	addRules(cl, n.rules, fam)
+	if depth == len(levels) {
+		return
+	}
+
+	addRules(cl, n.hash, fam)
+
+	level := levels[depth]
+	if c, ok := n.children[level]; ok {
+		c.match(cl, levels, depth+1, fam)
+	}
+
+	for tmpl, c := range n.templates {
+		if expanded, ok := pa.ExpandClientFilter(cl, tmpl); ok && expanded == level {
+			c.match(cl, levels, depth+1, fam)
+		}
+	}
+
+	if n.plus != nil {
+		n.plus.match(cl, levels, depth+1, fam)
+	}
+}
+
+// addRules adds matched filters to the access of a topic, keyed by the filters with their
+// placeholders expanded.
+func addRules(cl *mqtt.Client, rules []aclRule, fam map[string]auth.Access) {
+	for _, r := range rules {
+		if filter, ok := pa.ExpandClientFilter(cl, r.filter); ok {
+			fam[filter] = r.access
+		}
+	}
+}
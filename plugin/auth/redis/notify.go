@@ -0,0 +1,57 @@
+package redis
+
+import (
+	"github.com/redis/go-redis/v9"
+)
+
+const defaultNotifyChannel = "comqtt:auth"
+
+// NotifyOptions subscribes to a channel published to when the auth and acl hashes change,
+// and invalidates the cached lookups of the user named in each message.
+type NotifyOptions struct {
+	Enable  bool   `json:"enable" yaml:"enable"`
+	Channel string `json:"channel" yaml:"channel"` // the channel published to on changes, default comqtt:auth
+}
+
+// subscribe starts subscribing to the notify channel, invalidating cached lookups until the
+// subscription is closed. The subscription reconnects by itself while redis is unavailable.
+func (a *Auth) subscribe() error {
+	channel := a.config.Notify.Channel
+	if channel == "" {
+		channel = defaultNotifyChannel
+	}
+
+	a.pubsub = a.db.Subscribe(a.ctx, channel)
+	if _, err := a.pubsub.Receive(a.ctx); err != nil {
+		a.pubsub.Close()
+		a.pubsub = nil
+		return err
+	}
+
+	a.Log.Info("subscribed to redis auth notifications", "channel", channel)
+	go a.notifications(a.pubsub.ChannelWithSubscriptions())
+	return nil
+}
+
+// notifications invalidates the cached lookups named by each message, until the
+// subscription is closed.
+func (a *Auth) notifications(ch <-chan any) {
+	for msg := range ch {
+		switch m := msg.(type) {
+		case *redis.Message:
+			a.notified(m.Payload)
+		case *redis.Subscription:
+			if m.Kind == "subscribe" {
+				a.notified("") // messages may have been missed while resubscribing
+			}
+		}
+	}
+}
+
+// notified invalidates the cached lookups of the username or client id in the payload of
+// a message, or all cached lookups if the payload is empty.
+func (a *Auth) notified(key string) int {
+	count := a.InvalidateAuthCache(key)
+	a.Log.Debug("invalidated cached auth lookups", "key", key, "count", count)
+	return count
+}
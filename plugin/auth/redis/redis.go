@@ -4,12 +4,14 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"strconv"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 	"github.com/wind-c/comqtt/v2/mqtt"
 	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
 	"github.com/wind-c/comqtt/v2/mqtt/packets"
 	"github.com/wind-c/comqtt/v2/plugin"
 	pa "github.com/wind-c/comqtt/v2/plugin/auth"
@@ -26,16 +28,27 @@ const defaultAclKeyPrefix = "comqtt:acl"
 
 type Options struct {
 	pa.Blacklist
-	RedisOptions  *redisOptions `json:"redis-options" yaml:"redis-options"`
-	AuthMode      byte          `json:"auth-mode" yaml:"auth-mode"`
-	AuthKeyPrefix string        `json:"auth-prefix" yaml:"auth-prefix"`
-	AclMode       byte          `json:"acl-mode" yaml:"acl-mode"`
-	AclKeyPrefix  string        `json:"acl-prefix" yaml:"acl-prefix"`
-	PasswordHash  pa.HashType   `json:"password-hash" yaml:"password-hash"`
-	HashKey       string        `json:"hash-key" yaml:"hash-key"`
+	RedisOptions  *redisOptions         `json:"redis-options" yaml:"redis-options"`
+	AuthMode      byte                  `json:"auth-mode" yaml:"auth-mode"`
+	AuthKeyPrefix string                `json:"auth-prefix" yaml:"auth-prefix"`
+	AclMode       byte                  `json:"acl-mode" yaml:"acl-mode"`
+	AclKeyPrefix  string                `json:"acl-prefix" yaml:"acl-prefix"`
+	PasswordHash  pa.HashType           `json:"password-hash" yaml:"password-hash"`
+	HashKey       string                `json:"hash-key" yaml:"hash-key"`
+	Cache         pa.CacheOptions       `json:"cache" yaml:"cache"`
+	Notify        NotifyOptions         `json:"notify" yaml:"notify"`
+	Health        storage.HealthOptions `json:"health" yaml:"health"` // background pings and circuit breaking of the redis connection
+	Outbound      plugin.Outbound       `json:"outbound" yaml:"outbound"`
 	//Blacklist     auth.Ledger   `json:"blacklist" yaml:"blacklist"`
 }
 
+// authRule is the auth rule of a user, which skips acl checks if it is a superuser.
+type authRule struct {
+	auth.AuthRule
+	Superuser      bool `json:"superuser,omitempty"`
+	MaxConnections int  `json:"max_connections,omitempty"` // concurrent connections of the user, negative for unlimited
+}
+
 type redisOptions struct {
 	Addr     string `json:"addr" yaml:"addr"`
 	Username string `json:"username" yaml:"username"`
@@ -46,9 +59,13 @@ type redisOptions struct {
 // Auth is an auth controller which allows access to all connections and topics.
 type Auth struct {
 	mqtt.HookBase
-	config *Options
-	db     *redis.Client
-	ctx    context.Context // a context for the connection
+	config  *Options
+	db      *redis.Client
+	cache   *pa.Cache
+	pubsub  *redis.PubSub   // the subscription to the notify channel
+	ctx     context.Context // a context for the connection
+	health  *storage.Health // the circuit of the connection, nil if not checked
+	metrics pa.Metrics
 }
 
 // ID returns the ID of the hook.
@@ -86,33 +103,86 @@ func (a *Auth) Init(config any) error {
 	if a.config.AclKeyPrefix == "" {
 		a.config.AclKeyPrefix = defaultAclKeyPrefix
 	}
+	if err := a.config.Health.Validate(); err != nil {
+		return err
+	}
+	a.cache = pa.NewCache(a.config.Cache)
 
 	a.Log.Info("connecting to redis service",
 		"address", a.config.RedisOptions.Addr, "username", a.config.RedisOptions.Username,
 		"password-len", len(a.config.RedisOptions.Password),
 		"db", a.config.RedisOptions.DB)
 
-	a.db = redis.NewClient(&redis.Options{
+	opts := &redis.Options{
 		Addr:     a.config.RedisOptions.Addr,
 		Username: a.config.RedisOptions.Username,
 		Password: a.config.RedisOptions.Password,
 		DB:       a.config.RedisOptions.DB,
-	})
+	}
+	if a.config.Outbound.Enabled() {
+		dial, err := a.config.Outbound.Dialer()
+		if err != nil {
+			return err
+		}
+		opts.Dialer = dial
+	}
+
+	a.db = redis.NewClient(opts)
 	_, err := a.db.Ping(context.Background()).Result()
 	if err != nil {
 		return fmt.Errorf("failed to ping service: %w", err)
 	}
 
 	a.Log.Info("connected to redis service")
+	a.health = storage.NewHealth(a.config.Health, func(ctx context.Context) error {
+		return a.db.Ping(ctx).Err()
+	}, a.Log)
+
+	if a.config.Notify.Enable {
+		if !a.config.Cache.Enable {
+			a.Log.Warn("redis notify is enabled without the auth cache, which it invalidates")
+		}
+		if err := a.subscribe(); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 // Stop closes the redis connection.
 func (a *Auth) Stop() error {
 	a.Log.Info("disconnecting from redis service")
+	a.health.Stop()
+	a.health = nil
+	if a.pubsub != nil {
+		a.pubsub.Close()
+	}
 	return a.db.Close()
 }
 
+// Healthy returns an error while the redis service is unavailable.
+func (a *Auth) Healthy() error {
+	return a.health.Allow()
+}
+
+// unreachable returns true if err is a failure to reach the redis service, rather than
+// a missing value or an error replied by the service.
+func unreachable(err error) bool {
+	var reply redis.Error
+	return err != nil && !errors.Is(err, redis.Nil) && !errors.As(err, &reply)
+}
+
+// stale returns the expired cached lookup of a kind for a key if a lookup failed to reach the
+// redis service and the policy is to degrade, so that known users are still allowed.
+func (a *Auth) stale(kind, key string, err error) (any, bool) {
+	if !unreachable(err) || a.config.Health.OnStorageUnavailable != storage.UnavailableDegrade {
+		return nil, false
+	}
+
+	return a.cache.Stale(kind, key)
+}
+
 func (a *Auth) getAuthKey() string {
 	return a.config.AuthKeyPrefix
 }
@@ -124,13 +194,23 @@ func (a *Auth) getAclKey(uid string) string {
 // OnConnectAuthenticate returns true if the connecting client has rules which provide access
 // in the auth ledger.
 func (a *Auth) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	if !pa.DecidedBy(cl, a.ID()) { // denied by an earlier datasource of the auth chain
+		return false
+	}
+
+	return pa.Decide(cl, a.ID(), a.metrics.Auth(a.authenticateClient(cl, pk)))
+}
+
+// authenticateClient returns whether the auth rule of the connecting client allows it, or
+// Unknown if it has no auth rule.
+func (a *Auth) authenticateClient(cl *mqtt.Client, pk packets.Packet) pa.Result {
 	if a.config.AuthMode == byte(auth.AuthAnonymous) {
-		return true
+		return pa.Allow
 	}
 
 	// check blacklist
 	if n, ok := a.config.CheckBLAuth(cl, pk); n >= 0 { // It's on the blacklist
-		return ok
+		return pa.ResultOf(ok)
 	}
 
 	// normal verification
@@ -140,67 +220,122 @@ func (a *Auth) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
 	} else if a.config.AuthMode == byte(auth.AuthClientID) {
 		key = cl.ID
 	} else {
-		return false
+		return pa.Unknown
 	}
 
-	res, err := a.db.HGet(context.Background(), a.getAuthKey(), key).Result()
+	res, err := a.authRule(key)
 	if err != nil && err != redis.Nil || res == "" {
-		return false
+		return pa.Unknown
 	}
 
-	var ar auth.AuthRule
+	var ar authRule
 	if err = json.Unmarshal([]byte(res), &ar); err != nil {
 		a.Log.Error("failed to unmarshal redis auth data", "error", err, "data", res)
-		return false
+		return pa.Deny
 	}
 
 	if !ar.Allow {
-		return false
+		return pa.Deny
+	}
+
+	if !pa.CompareHash(string(ar.Password), string(pk.Connect.Password), a.config.HashKey, a.config.PasswordHash) {
+		return pa.Deny
 	}
 
-	return pa.CompareHash(string(ar.Password), string(pk.Connect.Password), a.config.HashKey, a.config.PasswordHash)
+	if ar.Superuser {
+		pa.SetSuperuser(cl)
+	}
+	pa.SetMaxConnections(cl, ar.MaxConnections)
+
+	return pa.Allow
 }
 
 // OnACLCheck returns true if the connecting client has matching read or write access to subscribe
 // or publish to a given topic.
 func (a *Auth) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
-	if a.config.AclMode == byte(auth.AuthAnonymous) {
-		return true
-	}
-
-	// check blacklist
-	if n, ok := a.config.CheckBLAcl(cl, topic, write); n >= 0 { // It's on the blacklist
-		return ok
-	}
+	return a.config.AuthorizeClient(a.ID(), a.config.AclMode, &a.metrics, cl, topic, write, a.lookupAcl)
+}
 
-	// normal verification
-	var key string
-	if a.config.AclMode == byte(auth.AuthUsername) {
-		key = string(cl.Properties.Username)
-	} else if a.config.AclMode == byte(auth.AuthClientID) {
-		key = cl.ID
-	} else {
+// lookupAcl returns true if the acl of the client in redis allows it to subscribe or
+// publish to a topic.
+func (a *Auth) lookupAcl(cl *mqtt.Client, topic string, write bool) bool {
+	key, ok := pa.AclKey(cl, a.config.AclMode)
+	if !ok {
 		return false
 	}
 
-	res, err := a.db.HGetAll(context.Background(), a.getAclKey(key)).Result()
+	acl, err := a.aclRules(key)
 	if err != nil && err != redis.Nil {
 		return false
 	}
 
-	fam := make(map[string]auth.Access)
-	for filter, rw := range res {
-		if !plugin.MatchTopic(filter, topic) {
-			continue
-		}
+	return acl.Check(cl, topic, write)
+}
 
-		access, err := strconv.Atoi(rw)
-		if err != nil {
-			continue
+// authRule returns the auth rule of a user from the cache or redis, failing at once while
+// redis is unavailable.
+func (a *Auth) authRule(key string) (string, error) {
+	if v, ok := a.cache.Get(pa.CacheAuth, key); ok {
+		return v.(string), nil
+	}
+
+	var res string
+	err := a.health.Allow()
+	if err == nil {
+		start := time.Now()
+		res, err = a.db.HGet(context.Background(), a.getAuthKey(), key).Result()
+		a.health.Record(unreachable(err))
+		a.metrics.Lookup(start)
+		if err == nil || err == redis.Nil {
+			a.cache.Set(pa.CacheAuth, key, res, res == "")
 		}
+	}
+
+	if v, ok := a.stale(pa.CacheAuth, key, err); ok {
+		return v.(string), nil
+	}
+
+	return res, err
+}
+
+// aclRules returns the compiled acl filters of a user from the cache or redis, failing at
+// once while redis is unavailable.
+func (a *Auth) aclRules(key string) (*aclTree, error) {
+	if v, ok := a.cache.Get(pa.CacheAcl, key); ok {
+		return v.(*aclTree), nil
+	}
+
+	var res map[string]string
+	err := a.health.Allow()
+	if err == nil {
+		start := time.Now()
+		res, err = a.db.HGetAll(context.Background(), a.getAclKey(key)).Result()
+		a.health.Record(unreachable(err))
+		a.metrics.Lookup(start)
+	}
+
+	if v, ok := a.stale(pa.CacheAcl, key, err); ok {
+		return v.(*aclTree), nil
+	}
+
+	acl := compileAcl(res)
+	if err == nil || err == redis.Nil {
+		a.cache.Set(pa.CacheAcl, key, acl, len(res) == 0)
+	}
+
+	return acl, err
+}
 
-		fam[filter] = auth.Access(access)
+// InvalidateAuthCache removes the cached lookups of a username or client id, or all
+// cached lookups if the key is empty.
+func (a *Auth) InvalidateAuthCache(key string) int {
+	if key == "" {
+		return a.cache.Purge()
 	}
+	return a.cache.Invalidate(key)
+}
 
-	return pa.CheckAcl(fam, write)
+// AuthMetrics returns the decisions, datasource latency and cache hits of the hook.
+func (a *Auth) AuthMetrics() mqtt.AuthMetrics {
+	return a.metrics.Snapshot(a.ID(), a.cache)
 }
@@ -5,12 +5,16 @@ import (
 	"io"
 	"log/slog"
 	"testing"
+	"time"
 
 	"github.com/alicebob/miniredis/v2"
 	"github.com/stretchr/testify/require"
 	"github.com/wind-c/comqtt/v2/mqtt"
 	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/storage"
 	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/plugin"
+	pa "github.com/wind-c/comqtt/v2/plugin/auth"
 )
 
 var (
@@ -133,3 +137,331 @@ func TestOnACLCheck(t *testing.T) {
 	result = a.OnACLCheck(client, topic2, false) //subscribe
 	require.Equal(t, true, result)
 }
+
+func TestOnACLCheckPlaceholders(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	a := newAuth(t, s.Addr())
+	defer teardown(t, a)
+
+	user := "zhangsan"
+	err := a.db.HSet(context.Background(), a.getAclKey(user), "devices/%u/%c/#", byte(auth.ReadWrite)).Err()
+	require.NoError(t, err)
+	require.True(t, a.OnACLCheck(client, "devices/zhangsan/test/state", true))
+	require.False(t, a.OnACLCheck(client, "devices/lisi/test/state", true))
+	require.False(t, a.OnACLCheck(client, "devices/%u/%c/state", true))
+}
+
+func TestOnACLCheckCached(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+
+	a := new(Auth)
+	a.SetOpts(logger, nil)
+	err := a.Init(&Options{
+		AuthMode: byte(auth.AuthUsername),
+		AclMode:  byte(auth.AuthUsername),
+		RedisOptions: &redisOptions{
+			Addr: s.Addr(),
+		},
+		Cache: pa.CacheOptions{Enable: true, NegativeTTL: 60},
+	})
+	require.NoError(t, err)
+	defer teardown(t, a)
+
+	user := "zhangsan"
+	topic := "topictest/1"
+	require.False(t, a.OnACLCheck(client, topic, true))
+
+	// the missing acl is cached until it is invalidated
+	err = a.db.HSet(context.Background(), a.getAclKey(user), topic, byte(auth.ReadWrite)).Err()
+	require.NoError(t, err)
+	require.False(t, a.OnACLCheck(client, topic, true))
+	require.Equal(t, 1, a.InvalidateAuthCache(user))
+	require.True(t, a.OnACLCheck(client, topic, true))
+
+	// the found acl is cached while redis changes
+	err = a.db.Del(context.Background(), a.getAclKey(user)).Err()
+	require.NoError(t, err)
+	require.True(t, a.OnACLCheck(client, topic, true))
+	require.Equal(t, 1, a.InvalidateAuthCache(""))
+	require.False(t, a.OnACLCheck(client, topic, true))
+}
+
+func newHealthAuth(t *testing.T, addr, policy string) *Auth {
+	a := new(Auth)
+	a.SetOpts(logger, nil)
+	err := a.Init(&Options{
+		AuthMode: byte(auth.AuthUsername),
+		AclMode:  byte(auth.AuthUsername),
+		RedisOptions: &redisOptions{
+			Addr: addr,
+		},
+		Cache:  pa.CacheOptions{Enable: true, TTL: 1},
+		Health: storage.HealthOptions{Interval: 3600, Failures: 1, OnStorageUnavailable: policy},
+	})
+	require.NoError(t, err)
+	return a
+}
+
+func TestUnavailableDegrade(t *testing.T) {
+	s := miniredis.RunT(t)
+	a := newHealthAuth(t, s.Addr(), storage.UnavailableDegrade)
+	defer a.Stop()
+
+	user := "zhangsan"
+	topic := "topictest/1"
+	err := a.db.HSet(context.Background(), a.config.AuthKeyPrefix, user, auth.AuthRule{Allow: true, Password: auth.RString("123456")}).Err()
+	require.NoError(t, err)
+	err = a.db.HSet(context.Background(), a.getAclKey(user), topic, byte(auth.ReadWrite)).Err()
+	require.NoError(t, err)
+	require.True(t, a.OnConnectAuthenticate(client, pkc))
+	require.True(t, a.OnACLCheck(client, topic, true))
+	require.NoError(t, a.Healthy())
+
+	// the expired lookups are served stale while redis is unavailable
+	time.Sleep(1100 * time.Millisecond)
+	s.Close()
+	require.True(t, a.OnConnectAuthenticate(client, pkc))
+	require.ErrorIs(t, a.Healthy(), storage.ErrUnavailable)
+	require.True(t, a.OnACLCheck(client, topic, true))
+	require.False(t, a.OnACLCheck(client, "topictest/2", true))
+
+	other := &mqtt.Client{ID: "other", Properties: mqtt.ClientProperties{Username: []byte("lisi")}}
+	require.False(t, a.OnConnectAuthenticate(other, pkc))
+}
+
+func TestUnavailableFailClosed(t *testing.T) {
+	s := miniredis.RunT(t)
+	a := newHealthAuth(t, s.Addr(), storage.UnavailableFailClosed)
+	defer a.Stop()
+
+	err := a.db.HSet(context.Background(), a.config.AuthKeyPrefix, "zhangsan", auth.AuthRule{Allow: true, Password: auth.RString("123456")}).Err()
+	require.NoError(t, err)
+	require.True(t, a.OnConnectAuthenticate(client, pkc))
+
+	time.Sleep(1100 * time.Millisecond)
+	s.Close()
+	require.False(t, a.OnConnectAuthenticate(client, pkc))
+	require.ErrorIs(t, a.Healthy(), storage.ErrUnavailable)
+}
+
+func TestOnACLCheckSuperuser(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	a := newAuth(t, s.Addr())
+	defer teardown(t, a)
+
+	err := a.db.HSet(context.Background(), a.config.AuthKeyPrefix, "zhangsan", `{"allow":true,"password":"123456","superuser":true}`).Err()
+	require.NoError(t, err)
+
+	cl := &mqtt.Client{ID: "backend", Properties: mqtt.ClientProperties{Username: []byte("zhangsan")}}
+	require.False(t, a.OnACLCheck(cl, "topictest/1", true))
+	require.True(t, a.OnConnectAuthenticate(cl, pkc))
+	require.True(t, a.OnACLCheck(cl, "topictest/1", true))
+	require.True(t, a.OnACLCheck(cl, "any/topic", false))
+}
+
+func TestOnConnectAuthenticateMaxConnections(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	a := newAuth(t, s.Addr())
+	defer teardown(t, a)
+
+	err := a.db.HSet(context.Background(), a.config.AuthKeyPrefix, "zhangsan", `{"allow":true,"password":"123456","max_connections":2}`).Err()
+	require.NoError(t, err)
+
+	cl := &mqtt.Client{ID: "device", Properties: mqtt.ClientProperties{Username: []byte("zhangsan")}}
+	require.True(t, a.OnConnectAuthenticate(cl, pkc))
+	require.Equal(t, 2, cl.Ext[mqtt.MaxConnectionsExtKey])
+}
+
+func TestOnConnectAuthenticateChain(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	a := newAuth(t, s.Addr())
+	defer teardown(t, a)
+
+	err := a.db.HSet(context.Background(), a.config.AuthKeyPrefix, "zhangsan", `{"allow":true,"password":"654321"}`).Err()
+	require.NoError(t, err)
+
+	// users without an auth rule are left to the next datasource of the chain
+	unknown := &mqtt.Client{ID: "c1", Properties: mqtt.ClientProperties{Username: []byte("lisi")}}
+	require.False(t, a.OnConnectAuthenticate(unknown, pkc))
+	require.NotContains(t, unknown.Ext, pa.DatasourceExtKey)
+
+	// users with an auth rule are denied by it
+	denied := &mqtt.Client{ID: "c2", Properties: mqtt.ClientProperties{Username: []byte("zhangsan")}}
+	require.False(t, a.OnConnectAuthenticate(denied, pkc))
+	require.Equal(t, a.ID(), denied.Ext[pa.DatasourceExtKey])
+
+	// clients decided by an earlier datasource are not authenticated or acl checked
+	other := &mqtt.Client{ID: "c3", Properties: mqtt.ClientProperties{Username: []byte("zhangsan")}}
+	require.False(t, pa.Decide(other, "auth-http", pa.Deny))
+	require.False(t, a.OnConnectAuthenticate(other, packets.Packet{Connect: packets.ConnectParams{Password: []byte("654321")}}))
+	require.True(t, pa.Decide(other, "auth-http", pa.Allow))
+	require.NoError(t, a.db.HSet(context.Background(), a.getAclKey("zhangsan"), "topictest/1", "3").Err())
+	require.False(t, a.OnACLCheck(other, "topictest/1", true))
+
+	allowed := &mqtt.Client{ID: "c4", Properties: mqtt.ClientProperties{Username: []byte("zhangsan")}}
+	require.True(t, a.OnConnectAuthenticate(allowed, packets.Packet{Connect: packets.ConnectParams{Password: []byte("654321")}}))
+	require.True(t, a.OnACLCheck(allowed, "topictest/1", true))
+}
+
+func TestCompileAcl(t *testing.T) {
+	res := map[string]string{
+		"a/bee":        "3",
+		"a/bee/c":      "0",
+		"a/+/d":        "1",
+		"a/#":          "2",
+		"x/#/y":        "3",
+		"+/r":          "1",
+		"devices/%u/#": "3",
+		"users/%c":     "1",
+		"/lead":        "3",
+		"bad":          "rw",
+	}
+
+	cls := []*mqtt.Client{
+		client,
+		{ID: "other", Properties: mqtt.ClientProperties{Username: []byte("lisi")}},
+		{ID: "a/b", Properties: mqtt.ClientProperties{Username: []byte("+")}},
+	}
+	topics := []string{
+		"a", "a/bee", "a/bee/c", "a/bee/c/d", "a/x/d", "a/x/d/e", "a/x", "x", "x/y", "x/z/y",
+		"q/r", "q/r/s", "devices/zhangsan", "devices/zhangsan/state", "devices/lisi/state",
+		"devices/+/state", "users/test", "users/other/x", "users/a/b", "/lead", "/lead/x", "bad", "",
+	}
+
+	acl := compileAcl(res)
+	for _, cl := range cls {
+		for _, topic := range topics {
+			for _, write := range []bool{false, true} {
+				// the compiled acl decides as matching every filter of the acl does
+				fam := make(map[string]auth.Access)
+				for filter, rw := range res {
+					filter, ok := pa.ExpandClientFilter(cl, filter)
+					if !ok || !plugin.MatchTopic(filter, topic) {
+						continue
+					}
+					if rw == "rw" {
+						continue
+					}
+					fam[filter] = auth.Access(rw[0] - '0')
+				}
+				require.Equal(t, pa.CheckAcl(fam, write), acl.Check(cl, topic, write), "client %s topic %q write %v", cl.ID, topic, write)
+			}
+		}
+	}
+}
+
+func TestAclTieBreak(t *testing.T) {
+	// the filters matching each topic have the same length, so the literal level and then
+	// the deny decide, whatever the order of the map
+	acls := []struct {
+		res   map[string]string
+		topic string
+		allow bool
+	}{
+		{map[string]string{"a/b": "3", "a/+": "0"}, "a/b", true},
+		{map[string]string{"a/b": "0", "a/+": "3"}, "a/b", false},
+		{map[string]string{"a/b/#": "3", "a/+/#": "0"}, "a/b/c", true},
+		{map[string]string{"a/+/c": "3", "a/b/+": "0"}, "a/b/c", false},
+		{map[string]string{"a/+/c": "0", "a/b/+": "3"}, "a/b/c", false},
+		{map[string]string{"+/b": "3", "a/+": "0", "a/#": "3"}, "a/b", false},
+	}
+
+	for _, tt := range acls {
+		for i := 0; i < 20; i++ {
+			acl := compileAcl(tt.res)
+			require.Equal(t, tt.allow, acl.Check(client, tt.topic, true), "acl %v topic %s", tt.res, tt.topic)
+		}
+	}
+}
+
+func TestNotified(t *testing.T) {
+	a := new(Auth)
+	a.SetOpts(logger, nil)
+	a.config = &Options{}
+	a.cache = pa.NewCache(pa.CacheOptions{Enable: true, NegativeTTL: 60})
+	a.cache.Set(pa.CacheAuth, "zhangsan", `{"allow":true}`, false)
+	a.cache.Set(pa.CacheAcl, "zhangsan", compileAcl(map[string]string{"a/b": "3"}), false)
+	a.cache.Set(pa.CacheAuth, "lisi", "", true)
+
+	require.Equal(t, 2, a.notified("zhangsan"))
+	require.Equal(t, 1, a.cache.Len())
+	require.Equal(t, 0, a.notified("wangwu"))
+	require.Equal(t, 1, a.notified(""))
+	require.Equal(t, 0, a.cache.Len())
+}
+
+func TestNotifyInvalidatesCache(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+
+	a := new(Auth)
+	a.SetOpts(logger, nil)
+	err := a.Init(&Options{
+		AuthMode: byte(auth.AuthUsername),
+		AclMode:  byte(auth.AuthUsername),
+		RedisOptions: &redisOptions{
+			Addr: s.Addr(),
+		},
+		Cache:  pa.CacheOptions{Enable: true},
+		Notify: NotifyOptions{Enable: true},
+	})
+	require.NoError(t, err)
+	defer teardown(t, a)
+
+	user := "zhangsan"
+	topic := "topictest/one"
+	err = a.db.HSet(context.Background(), a.getAclKey(user), "topictest/+", byte(auth.ReadWrite)).Err()
+	require.NoError(t, err)
+	require.True(t, a.OnACLCheck(client, topic, true))
+	require.Equal(t, 1, a.cache.Len())
+
+	err = a.db.HSet(context.Background(), a.getAclKey(user), topic, byte(auth.Deny)).Err()
+	require.NoError(t, err)
+	require.True(t, a.OnACLCheck(client, topic, true))
+
+	require.NoError(t, a.db.Publish(context.Background(), defaultNotifyChannel, user).Err())
+	require.Eventually(t, func() bool { return a.cache.Len() == 0 }, 5*time.Second, 10*time.Millisecond)
+	require.False(t, a.OnACLCheck(client, topic, true))
+}
+
+func TestAuthMetrics(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+
+	a := new(Auth)
+	a.SetOpts(logger, nil)
+	err := a.Init(&Options{
+		AuthMode: byte(auth.AuthUsername),
+		AclMode:  byte(auth.AuthUsername),
+		RedisOptions: &redisOptions{
+			Addr: s.Addr(),
+		},
+		Cache: pa.CacheOptions{Enable: true},
+	})
+	require.NoError(t, err)
+	defer teardown(t, a)
+
+	err = a.db.HSet(context.Background(), a.config.AuthKeyPrefix, "zhangsan", `{"allow":true,"password":"123456"}`).Err()
+	require.NoError(t, err)
+	err = a.db.HSet(context.Background(), a.getAclKey("zhangsan"), "topictest/+", byte(auth.ReadOnly)).Err()
+	require.NoError(t, err)
+
+	cl := &mqtt.Client{ID: "c1", Properties: mqtt.ClientProperties{Username: []byte("zhangsan")}}
+	require.True(t, a.OnConnectAuthenticate(cl, pkc))
+	require.False(t, a.OnACLCheck(cl, "topictest/1", true))
+	require.True(t, a.OnACLCheck(cl, "topictest/1", false))
+
+	m := a.AuthMetrics()
+	require.Equal(t, a.ID(), m.ID)
+	require.Equal(t, int64(1), m.AuthAllowed)
+	require.Equal(t, int64(1), m.AclAllowed)
+	require.Equal(t, int64(1), m.AclDenied)
+	require.Equal(t, int64(1), m.CacheHits)
+	require.Equal(t, int64(2), m.CacheMisses)
+	require.Equal(t, int64(2), m.Latency.Count)
+}
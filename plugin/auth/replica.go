@@ -0,0 +1,320 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+	"go.etcd.io/bbolt"
+)
+
+const defaultReplicaInterval = 60 // seconds
+
+var (
+	replicaBucket = []byte("replica")
+	replicaKey    = []byte("snapshot")
+
+	// ErrReplicaHashMismatch indicates a replica snapshot does not match its verification hash.
+	ErrReplicaHashMismatch = errors.New("replica snapshot hash mismatch")
+)
+
+// ReplicaOptions configures a node-local read replica of the auth and acl data of a datasource,
+// which is used to authenticate clients when the datasource is unavailable.
+type ReplicaOptions struct {
+	Enable   bool   `json:"enable" yaml:"enable"`
+	Interval int64  `json:"interval" yaml:"interval"` // seconds between syncs, default 60
+	Path     string `json:"path" yaml:"path"`         // bolt file the replica is persisted to, empty to keep it in memory only
+}
+
+// ReplicaUser is the auth data of a user in a replica.
+type ReplicaUser struct {
+	Password       string `json:"password"`
+	Allow          int    `json:"allow"`
+	Superuser      int    `json:"superuser,omitempty"`       // 1 if the acl checks of the user are skipped
+	MaxConnections int    `json:"max_connections,omitempty"` // concurrent connections of the user, negative for unlimited
+}
+
+// ReplicaSnapshot is a copy of the auth and acl data of a datasource.
+type ReplicaSnapshot struct {
+	Users  map[string]ReplicaUser            `json:"users"`
+	Acls   map[string]map[string]auth.Access `json:"acls"` // user > filter > access
+	Synced int64                             `json:"synced"`
+	Hash   string                            `json:"hash"`
+}
+
+// Sum returns the verification hash of the users and acls of the snapshot.
+func (s *ReplicaSnapshot) Sum() string {
+	// map keys are marshalled in order, so equal data always has the same hash
+	b, _ := json.Marshal(struct {
+		Users map[string]ReplicaUser            `json:"users"`
+		Acls  map[string]map[string]auth.Access `json:"acls"`
+	}{s.Users, s.Acls})
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// Verify returns an error if the snapshot does not match its verification hash.
+func (s *ReplicaSnapshot) Verify() error {
+	if s.Hash != s.Sum() {
+		return ErrReplicaHashMismatch
+	}
+	return nil
+}
+
+// ReplicaLoader reads a full snapshot of the auth and acl data from a datasource.
+type ReplicaLoader func() (*ReplicaSnapshot, error)
+
+// Replica periodically copies the auth and acl data of a datasource into memory, and
+// optionally a local bolt file, so that it can be served while the datasource is down.
+type Replica struct {
+	sync.RWMutex
+	opts ReplicaOptions
+	load ReplicaLoader
+	log  *slog.Logger
+	snap *ReplicaSnapshot
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewReplica returns a new replica which reads snapshots with the loader.
+func NewReplica(opts ReplicaOptions, load ReplicaLoader, log *slog.Logger) *Replica {
+	if opts.Interval <= 0 {
+		opts.Interval = defaultReplicaInterval
+	}
+
+	return &Replica{
+		opts: opts,
+		load: load,
+		log:  log,
+		done: make(chan struct{}),
+	}
+}
+
+// Start restores the persisted snapshot, syncs the replica and keeps it in sync until
+// Stop is called. The returned error is that of the first sync, which does not stop
+// the replica if a persisted snapshot was restored.
+func (r *Replica) Start() error {
+	if err := r.restore(); err != nil {
+		r.log.Warn("unable to restore auth replica", "path", r.opts.Path, "error", err)
+	}
+
+	err := r.Sync()
+	if err != nil && !r.Ready() {
+		return err
+	}
+
+	r.wg.Add(1)
+	go r.loop()
+	return err
+}
+
+// Stop stops syncing the replica.
+func (r *Replica) Stop() {
+	select {
+	case <-r.done:
+		return
+	default:
+		close(r.done)
+	}
+	r.wg.Wait()
+}
+
+func (r *Replica) loop() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(time.Duration(r.opts.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			if err := r.Sync(); err != nil {
+				r.log.Warn("unable to sync auth replica", "error", err)
+			}
+		}
+	}
+}
+
+// Sync replaces the replica with a new snapshot of the datasource, persisting it if
+// the data has changed.
+func (r *Replica) Sync() error {
+	snap, err := r.load()
+	if err != nil {
+		return err
+	}
+
+	snap.Synced = time.Now().Unix()
+	snap.Hash = snap.Sum()
+
+	r.Lock()
+	changed := r.snap == nil || r.snap.Hash != snap.Hash
+	r.snap = snap
+	r.Unlock()
+
+	if changed && r.opts.Path != "" {
+		if err := r.persist(snap); err != nil {
+			r.log.Warn("unable to persist auth replica", "path", r.opts.Path, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// Ready returns true if the replica holds a snapshot.
+func (r *Replica) Ready() bool {
+	r.RLock()
+	defer r.RUnlock()
+	return r.snap != nil
+}
+
+// Snapshot returns the current snapshot of the replica, or nil if it has not been synced.
+func (r *Replica) Snapshot() *ReplicaSnapshot {
+	r.RLock()
+	defer r.RUnlock()
+	return r.snap
+}
+
+// Auth returns the auth data of a user, and false if the replica does not hold the user.
+func (r *Replica) Auth(user string) (ReplicaUser, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	if r.snap == nil {
+		return ReplicaUser{}, false
+	}
+
+	u, ok := r.snap.Users[user]
+	return u, ok
+}
+
+// Acl returns the access of each filter of a user, and false if the replica has not been synced.
+func (r *Replica) Acl(user string) (map[string]auth.Access, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	if r.snap == nil {
+		return nil, false
+	}
+
+	return r.snap.Acls[user], true
+}
+
+// persist writes a snapshot to the bolt file of the replica.
+func (r *Replica) persist(snap *ReplicaSnapshot) error {
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	db, err := bbolt.Open(r.opts.Path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(replicaBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(replicaKey, b)
+	})
+}
+
+// restore loads the persisted snapshot of the replica, discarding it if it does not
+// match its verification hash.
+func (r *Replica) restore() error {
+	if r.opts.Path == "" {
+		return nil
+	}
+
+	db, err := bbolt.Open(r.opts.Path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var snap *ReplicaSnapshot
+	err = db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(replicaBucket)
+		if bucket == nil {
+			return nil
+		}
+
+		b := bucket.Get(replicaKey)
+		if b == nil {
+			return nil
+		}
+
+		snap = new(ReplicaSnapshot)
+		return json.Unmarshal(b, snap)
+	})
+	if err != nil || snap == nil {
+		return err
+	}
+
+	if err := snap.Verify(); err != nil {
+		return err
+	}
+
+	r.Lock()
+	r.snap = snap
+	r.Unlock()
+	r.log.Info("restored auth replica", "path", r.opts.Path, "users", len(snap.Users), "synced", snap.Synced)
+	return nil
+}
+
+// SqlReplicaLoader returns a loader which reads the full auth and acl tables of a sql
+// datasource. The auth query must select the user, password, allow, superuser and max
+// connections columns, and the acl query the user, topic and access columns.
+func SqlReplicaLoader(db *sqlx.DB, authSql, aclSql string) ReplicaLoader {
+	return func() (*ReplicaSnapshot, error) {
+		snap := &ReplicaSnapshot{
+			Users: make(map[string]ReplicaUser),
+			Acls:  make(map[string]map[string]auth.Access),
+		}
+
+		rows, err := db.Query(authSql)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var user string
+			var u ReplicaUser
+			if err := rows.Scan(&user, &u.Password, &u.Allow, &u.Superuser, &u.MaxConnections); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("auth replica: %w", err)
+			}
+			snap.Users[user] = u
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		rows, err = db.Query(aclSql)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var user, filter string
+			var access byte
+			if err := rows.Scan(&user, &filter, &access); err != nil {
+				return nil, fmt.Errorf("acl replica: %w", err)
+			}
+			if _, ok := snap.Acls[user]; !ok {
+				snap.Acls[user] = make(map[string]auth.Access)
+			}
+			snap.Acls[user][filter] = auth.Access(access)
+		}
+
+		return snap, rows.Err()
+	}
+}
@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+	"go.etcd.io/bbolt"
+)
+
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func testSnapshot() *ReplicaSnapshot {
+	return &ReplicaSnapshot{
+		Users: map[string]ReplicaUser{"zhangsan": {Password: "123456", Allow: 1}},
+		Acls:  map[string]map[string]auth.Access{"zhangsan": {"topictest/#": auth.WriteOnly}},
+	}
+}
+
+func TestReplicaSync(t *testing.T) {
+	down := false
+	r := NewReplica(ReplicaOptions{Enable: true}, func() (*ReplicaSnapshot, error) {
+		if down {
+			return nil, errors.New("connection refused")
+		}
+		return testSnapshot(), nil
+	}, logger)
+	require.Equal(t, int64(defaultReplicaInterval), r.opts.Interval)
+
+	_, ok := r.Auth("zhangsan")
+	require.False(t, ok)
+	_, ok = r.Acl("zhangsan")
+	require.False(t, ok)
+
+	require.NoError(t, r.Start())
+	defer r.Stop()
+
+	u, ok := r.Auth("zhangsan")
+	require.True(t, ok)
+	require.Equal(t, "123456", u.Password)
+	require.Equal(t, 1, u.Allow)
+	require.Equal(t, 0, u.Superuser)
+	_, ok = r.Auth("lisi")
+	require.False(t, ok)
+
+	acl, ok := r.Acl("zhangsan")
+	require.True(t, ok)
+	require.Equal(t, auth.WriteOnly, acl["topictest/#"])
+	require.NoError(t, r.Snapshot().Verify())
+
+	// the last snapshot is kept while the datasource is down
+	down = true
+	require.Error(t, r.Sync())
+	_, ok = r.Auth("zhangsan")
+	require.True(t, ok)
+}
+
+func TestReplicaStartUnavailable(t *testing.T) {
+	r := NewReplica(ReplicaOptions{Enable: true}, func() (*ReplicaSnapshot, error) {
+		return nil, errors.New("connection refused")
+	}, logger)
+	require.Error(t, r.Start())
+	require.False(t, r.Ready())
+}
+
+func TestReplicaRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "replica.db")
+	r := NewReplica(ReplicaOptions{Enable: true, Path: path}, func() (*ReplicaSnapshot, error) {
+		return testSnapshot(), nil
+	}, logger)
+	require.NoError(t, r.Start())
+	r.Stop()
+
+	// a node restarting while the datasource is down serves the persisted replica
+	r = NewReplica(ReplicaOptions{Enable: true, Path: path}, func() (*ReplicaSnapshot, error) {
+		return nil, errors.New("connection refused")
+	}, logger)
+	require.Error(t, r.Start())
+	defer r.Stop()
+	require.True(t, r.Ready())
+	_, ok := r.Auth("zhangsan")
+	require.True(t, ok)
+}
+
+func TestReplicaRestoreHashMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "replica.db")
+	db, err := bbolt.Open(path, 0600, nil)
+	require.NoError(t, err)
+	err = db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(replicaBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(replicaKey, []byte(`{"users":{"zhangsan":{"password":"tampered","allow":1}},"hash":"abc"}`))
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	r := NewReplica(ReplicaOptions{Enable: true, Path: path}, nil, logger)
+	require.ErrorIs(t, r.restore(), ErrReplicaHashMismatch)
+	require.False(t, r.Ready())
+}
+
+func TestReplicaSnapshotSum(t *testing.T) {
+	a, b := testSnapshot(), testSnapshot()
+	b.Synced = 100
+	require.Equal(t, a.Sum(), b.Sum())
+
+	b.Users["zhangsan"] = ReplicaUser{Password: "654321", Allow: 1}
+	require.NotEqual(t, a.Sum(), b.Sum())
+}
@@ -0,0 +1,216 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+)
+
+// AuthTable is the table of the users of a sql datasource.
+type AuthTable struct {
+	Table                string   `json:"table" yaml:"table"`
+	UserColumn           string   `json:"user-column" yaml:"user-column"`
+	PasswordColumn       string   `json:"password-column" yaml:"password-column"`
+	AllowColumn          string   `json:"allow-column" yaml:"allow-column"`
+	SuperuserColumn      string   `json:"superuser-column" yaml:"superuser-column"`             // optional, users with 1 skip acl checks
+	MaxConnectionsColumn string   `json:"max-connections-column" yaml:"max-connections-column"` // optional, overrides maximum-user-connections, negative for unlimited
+	PasswordHash         HashType `json:"password-hash" yaml:"password-hash"`
+	HashKey              string   `json:"hash-key" yaml:"hash-key"`
+}
+
+// superuserColumn returns the superuser column, or a constant 0 if the table has none.
+func (t AuthTable) superuserColumn() string {
+	if t.SuperuserColumn == "" {
+		return "0"
+	}
+	return t.SuperuserColumn
+}
+
+// maxConnectionsColumn returns the max connections column, or a constant 0 if the table
+// has none.
+func (t AuthTable) maxConnectionsColumn() string {
+	if t.MaxConnectionsColumn == "" {
+		return "0"
+	}
+	return t.MaxConnectionsColumn
+}
+
+// Query returns the query of the password, allow, superuser and max connections of a user,
+// where bindvar is the placeholder of the user in the dialect of the database, such as ?.
+func (t AuthTable) Query(bindvar string) string {
+	return fmt.Sprintf("select %s, %s, %s, %s from %s where %s=%s",
+		t.PasswordColumn, t.AllowColumn, t.superuserColumn(), t.maxConnectionsColumn(), t.Table, t.UserColumn, bindvar)
+}
+
+// ReplicaQuery returns the query of the users of the table for a replica.
+func (t AuthTable) ReplicaQuery() string {
+	return fmt.Sprintf("select %s, %s, %s, %s, %s from %s",
+		t.UserColumn, t.PasswordColumn, t.AllowColumn, t.superuserColumn(), t.maxConnectionsColumn(), t.Table)
+}
+
+// AclTable is the table of the acl filters of the users of a sql datasource.
+type AclTable struct {
+	Table        string `json:"table" yaml:"table"`
+	UserColumn   string `json:"user-column" yaml:"user-column"`
+	TopicColumn  string `json:"topic-column" yaml:"topic-column"`
+	AccessColumn string `json:"access-column" yaml:"access-column"`
+}
+
+// Query returns the query of the filters and access of a user, where bindvar is the
+// placeholder of the user in the dialect of the database, such as ?.
+func (t AclTable) Query(bindvar string) string {
+	return fmt.Sprintf("select %s, %s from %s where %s=%s",
+		t.TopicColumn, t.AccessColumn, t.Table, t.UserColumn, bindvar)
+}
+
+// ReplicaQuery returns the query of the filters of the table for a replica.
+func (t AclTable) ReplicaQuery() string {
+	return fmt.Sprintf("select %s, %s, %s from %s",
+		t.UserColumn, t.TopicColumn, t.AccessColumn, t.Table)
+}
+
+// SqlStore looks up the users and acls of a sql datasource with prepared statements,
+// through the cache of the datasource, falling back to its replica while the database is
+// unavailable. The cache and replica may be nil.
+type SqlStore struct {
+	db       *sqlx.DB
+	authSql  string
+	aclSql   string
+	authStmt *sqlx.Stmt
+	aclStmt  *sqlx.Stmt
+	mu       sync.Mutex
+	cache    *Cache
+	replica  *Replica
+	metrics  *Metrics
+	log      *slog.Logger
+}
+
+// NewSqlStore returns a store querying the auth and acl tables of a database, where bindvar
+// is the placeholder of the user in the dialect of the database.
+func NewSqlStore(db *sqlx.DB, authTable AuthTable, aclTable AclTable, bindvar string, cache *Cache, replica *Replica, metrics *Metrics, log *slog.Logger) *SqlStore {
+	return &SqlStore{
+		db:      db,
+		authSql: authTable.Query(bindvar),
+		aclSql:  aclTable.Query(bindvar),
+		cache:   cache,
+		replica: replica,
+		metrics: metrics,
+		log:     log,
+	}
+}
+
+// Prepare prepares the auth and acl statements if they have not been prepared yet, which
+// is deferred while the database is unavailable.
+func (s *SqlStore) Prepare() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.aclStmt != nil {
+		return nil
+	}
+
+	authStmt, err := s.db.Preparex(s.authSql)
+	if err != nil {
+		s.log.Error("Unable to create prepared statement for auth-sql", "authSql", s.authSql)
+		return err
+	}
+	aclStmt, err := s.db.Preparex(s.aclSql)
+	if err != nil {
+		authStmt.Close()
+		s.log.Error("Unable to create prepared statement for acl-sql", "aclStmt", s.aclSql)
+		return err
+	}
+
+	s.authStmt, s.aclStmt = authStmt, aclStmt
+	return nil
+}
+
+// Close closes the prepared statements.
+func (s *SqlStore) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.aclStmt != nil {
+		s.authStmt.Close()
+		s.aclStmt.Close()
+	}
+}
+
+// QueryAuth returns the password, allow, superuser and max connections of a user from the
+// cache or the database, falling back to the replica if the database is unavailable.
+func (s *SqlStore) QueryAuth(key string) (u ReplicaUser, err error) {
+	if v, ok := s.cache.Get(CacheAuth, key); ok {
+		if v == nil {
+			return u, sql.ErrNoRows
+		}
+		return v.(ReplicaUser), nil
+	}
+
+	defer s.metrics.Lookup(time.Now())
+	if err = s.Prepare(); err == nil {
+		err = s.authStmt.QueryRowx(key).Scan(&u.Password, &u.Allow, &u.Superuser, &u.MaxConnections)
+		if err == nil {
+			s.cache.Set(CacheAuth, key, u, false)
+			return
+		} else if errors.Is(err, sql.ErrNoRows) {
+			s.cache.Set(CacheAuth, key, nil, true)
+			return
+		}
+	}
+
+	if s.replica == nil {
+		return u, err
+	}
+
+	s.log.Debug("auth query failed, using auth replica", "error", err)
+	ru, ok := s.replica.Auth(key)
+	if !ok {
+		return u, err
+	}
+
+	return ru, nil
+}
+
+// QueryAcl returns the access of each filter of a user from the cache or the database,
+// falling back to the replica if the database is unavailable.
+func (s *SqlStore) QueryAcl(key string) (map[string]auth.Access, error) {
+	if v, ok := s.cache.Get(CacheAcl, key); ok {
+		return v.(map[string]auth.Access), nil
+	}
+
+	defer s.metrics.Lookup(time.Now())
+	err := s.Prepare()
+	if err == nil {
+		var rows *sql.Rows
+		if rows, err = s.aclStmt.Query(key); err == nil {
+			defer rows.Close()
+			acl := make(map[string]auth.Access)
+			for rows.Next() {
+				var filter string
+				var access byte
+				if err := rows.Scan(&filter, &access); err != nil {
+					continue
+				}
+				acl[filter] = auth.Access(access)
+			}
+			s.cache.Set(CacheAcl, key, acl, len(acl) == 0)
+			return acl, nil
+		}
+	}
+
+	if s.replica == nil {
+		return nil, err
+	}
+
+	s.log.Debug("acl query failed, using auth replica", "error", err)
+	acl, ok := s.replica.Acl(key)
+	if !ok {
+		return nil, err
+	}
+
+	return acl, nil
+}
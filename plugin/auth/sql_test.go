@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"database/sql"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+)
+
+var (
+	sqlAuthTable = AuthTable{Table: "auth", UserColumn: "username", PasswordColumn: "password", AllowColumn: "allow", SuperuserColumn: "superuser"}
+	sqlAclTable  = AclTable{Table: "acl", UserColumn: "username", TopicColumn: "topic", AccessColumn: "access"}
+)
+
+func TestSqlTableQueries(t *testing.T) {
+	require.Equal(t, "select password, allow, superuser, 0 from auth where username=$1", sqlAuthTable.Query("$1"))
+	require.Equal(t, "select username, password, allow, superuser, 0 from auth", sqlAuthTable.ReplicaQuery())
+	require.Equal(t, "select topic, access from acl where username=?", sqlAclTable.Query("?"))
+	require.Equal(t, "select username, topic, access from acl", sqlAclTable.ReplicaQuery())
+}
+
+func TestSqlStore(t *testing.T) {
+	db, err := sqlx.Connect("sqlite3", ":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1) // every connection to :memory: is a new database
+
+	_, err = db.Exec(`create table auth (username text, password text, allow integer, superuser integer);
+		create table acl (username text, topic text, access integer);
+		insert into auth values ('zhangsan', '123456', 1, 1);
+		insert into acl values ('zhangsan', 'a/#', 3), ('zhangsan', 'a/b', 0);`)
+	require.NoError(t, err)
+
+	m := new(Metrics)
+	s := NewSqlStore(db, sqlAuthTable, sqlAclTable, "?", NewCache(CacheOptions{Enable: true, NegativeTTL: 60}), nil, m, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer s.Close()
+
+	u, err := s.QueryAuth("zhangsan")
+	require.NoError(t, err)
+	require.Equal(t, ReplicaUser{Password: "123456", Allow: 1, Superuser: 1}, u)
+
+	_, err = s.QueryAuth("lisi")
+	require.ErrorIs(t, err, sql.ErrNoRows)
+	_, err = s.QueryAuth("lisi") // the missing user is cached
+	require.ErrorIs(t, err, sql.ErrNoRows)
+
+	acl, err := s.QueryAcl("zhangsan")
+	require.NoError(t, err)
+	require.Equal(t, map[string]auth.Access{"a/#": auth.ReadWrite, "a/b": auth.Deny}, acl)
+
+	require.Equal(t, int64(3), m.Snapshot("auth-sql", nil).Latency.Count)
+}
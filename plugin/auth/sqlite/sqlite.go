@@ -0,0 +1,227 @@
+package sqlite
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/plugin"
+	pa "github.com/wind-c/comqtt/v2/plugin/auth"
+)
+
+// defaultPath is the default path of the database file.
+const defaultPath = "auth.db"
+
+// defaultBusyTimeout is the default milliseconds a lookup waits while another process
+// is writing to the database file.
+const defaultBusyTimeout = 5000
+
+type Options struct {
+	pa.Blacklist
+	AuthMode     byte            `json:"auth-mode" yaml:"auth-mode"`
+	AclMode      byte            `json:"acl-mode" yaml:"acl-mode"`
+	Path         string          `json:"path" yaml:"path"`                 // the database file, created if it does not exist
+	BusyTimeout  int             `json:"busy-timeout" yaml:"busy-timeout"` // milliseconds a lookup waits while the file is being written, default 5000
+	CreateTables bool            `json:"create-tables" yaml:"create-tables"`
+	Auth         pa.AuthTable    `json:"auth" yaml:"auth"`
+	Acl          pa.AclTable     `json:"acl" yaml:"acl"`
+	Cache        pa.CacheOptions `json:"cache" yaml:"cache"`
+}
+
+// Auth is an auth controller which reads the auth and acl tables of an embedded sqlite
+// database file, for brokers running without an external database.
+type Auth struct {
+	mqtt.HookBase
+	config  *Options
+	db      *sqlx.DB
+	store   *pa.SqlStore
+	cache   *pa.Cache
+	metrics pa.Metrics
+}
+
+// ID returns the ID of the hook.
+func (a *Auth) ID() string {
+	return "auth-sqlite"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (a *Auth) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnACLCheck,
+	}, []byte{b})
+}
+
+func (a *Auth) Init(config any) error {
+	if _, ok := config.(*Options); config == nil || (!ok && config != nil) {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	a.config = config.(*Options)
+	if a.config.Path == "" {
+		a.config.Path = defaultPath
+	}
+	if a.config.BusyTimeout <= 0 {
+		a.config.BusyTimeout = defaultBusyTimeout
+	}
+
+	a.cache = pa.NewCache(a.config.Cache)
+	a.Log.Info("opening sqlite", "path", a.config.Path)
+
+	// the write-ahead log lets the tables be changed by other processes while they are read
+	dsn := fmt.Sprintf("file:%s?_busy_timeout=%d&_journal_mode=WAL", a.config.Path, a.config.BusyTimeout)
+	sqlxDB, err := sqlx.Connect("sqlite3", dsn)
+	if err != nil {
+		return err
+	}
+	a.db = sqlxDB
+
+	if a.config.CreateTables {
+		if err := a.createTables(); err != nil {
+			a.db.Close()
+			return err
+		}
+	}
+
+	a.store = pa.NewSqlStore(sqlxDB, a.config.Auth, a.config.Acl, "?", a.cache, nil, &a.metrics, a.Log)
+	if err := a.store.Prepare(); err != nil {
+		a.db.Close()
+		return err
+	}
+
+	return nil
+}
+
+// createTables creates the auth and acl tables with the configured columns if they do
+// not exist.
+func (a *Auth) createTables() error {
+	at := a.config.Auth
+	authSql := fmt.Sprintf("create table if not exists %s (%s text primary key, %s text not null, %s integer not null default 1",
+		at.Table, at.UserColumn, at.PasswordColumn, at.AllowColumn)
+	if at.SuperuserColumn != "" {
+		authSql += fmt.Sprintf(", %s integer not null default 0", at.SuperuserColumn)
+	}
+	if at.MaxConnectionsColumn != "" {
+		authSql += fmt.Sprintf(", %s integer not null default 0", at.MaxConnectionsColumn)
+	}
+	authSql += ")"
+
+	ct := a.config.Acl
+	aclSql := fmt.Sprintf("create table if not exists %s (%s text not null, %s text not null, %s integer not null default 3, primary key (%s, %s))",
+		ct.Table, ct.UserColumn, ct.TopicColumn, ct.AccessColumn, ct.UserColumn, ct.TopicColumn)
+
+	for _, q := range []string{authSql, aclSql} {
+		if _, err := a.db.Exec(q); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// InvalidateAuthCache removes the cached lookups of a username or client id, or all
+// cached lookups if the key is empty.
+func (a *Auth) InvalidateAuthCache(key string) int {
+	if key == "" {
+		return a.cache.Purge()
+	}
+	return a.cache.Invalidate(key)
+}
+
+// Stop closes the sqlite database.
+func (a *Auth) Stop() error {
+	a.Log.Info("closing sqlite")
+	if a.store != nil {
+		a.store.Close()
+	}
+	return a.db.Close()
+}
+
+// OnConnectAuthenticate returns true if the connecting client has rules which provide access
+// in the auth ledger.
+func (a *Auth) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	if !pa.DecidedBy(cl, a.ID()) { // denied by an earlier datasource of the auth chain
+		return false
+	}
+
+	return pa.Decide(cl, a.ID(), a.metrics.Auth(a.authenticateClient(cl, pk)))
+}
+
+// authenticateClient returns whether the auth row of the connecting client allows it, or
+// Unknown if it has no row.
+func (a *Auth) authenticateClient(cl *mqtt.Client, pk packets.Packet) pa.Result {
+	if a.config.AuthMode == byte(auth.AuthAnonymous) {
+		return pa.Allow
+	}
+
+	// check blacklist
+	if n, ok := a.config.CheckBLAuth(cl, pk); n >= 0 { // It's on the blacklist
+		return pa.ResultOf(ok)
+	}
+
+	// normal verification
+	var key string
+	if a.config.AuthMode == byte(auth.AuthUsername) {
+		key = string(cl.Properties.Username)
+	} else if a.config.AuthMode == byte(auth.AuthClientID) {
+		key = cl.ID
+	} else {
+		return pa.Unknown
+	}
+
+	u, err := a.store.QueryAuth(key)
+	if err != nil {
+		return pa.Unknown
+	} else if u.Allow == 0 {
+		return pa.Deny
+	}
+
+	if !pa.CompareHash(u.Password, string(pk.Connect.Password), a.config.Auth.HashKey, a.config.Auth.PasswordHash) {
+		return pa.Deny
+	}
+
+	if u.Superuser == 1 {
+		pa.SetSuperuser(cl)
+	}
+	pa.SetMaxConnections(cl, u.MaxConnections)
+
+	return pa.Allow
+}
+
+// OnACLCheck returns true if the connecting client has matching read or write access to subscribe
+// or publish to a given topic.
+func (a *Auth) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	return a.config.AuthorizeClient(a.ID(), a.config.AclMode, &a.metrics, cl, topic, write, a.lookupAcl)
+}
+
+// lookupAcl returns true if the acl of the client in sqlite allows it to subscribe or
+// publish to a topic.
+func (a *Auth) lookupAcl(cl *mqtt.Client, topic string, write bool) bool {
+	key, ok := pa.AclKey(cl, a.config.AclMode)
+	if !ok {
+		return false
+	}
+
+	acl, err := a.store.QueryAcl(key)
+	if err != nil {
+		return false
+	}
+
+	fam := make(map[string]auth.Access)
+	for filter, access := range acl {
+		if filter, ok := pa.ExpandClientFilter(cl, filter); ok && plugin.MatchTopic(filter, topic) {
+			fam[filter] = access
+		}
+	}
+
+	return pa.CheckAcl(fam, write)
+}
+
+// AuthMetrics returns the decisions, datasource latency and cache hits of the hook.
+func (a *Auth) AuthMetrics() mqtt.AuthMetrics {
+	return a.metrics.Snapshot(a.ID(), a.cache)
+}
@@ -0,0 +1,157 @@
+package sqlite
+
+import (
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/plugin"
+	pa "github.com/wind-c/comqtt/v2/plugin/auth"
+)
+
+const path = "./testdata/conf.yml"
+
+var (
+	// Currently, the input is directed to /dev/null. If you need to
+	// output to stdout, just modify 'io.Discard' here to 'os.Stdout'.
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	pkc = packets.Packet{Connect: packets.ConnectParams{Password: []byte("123456")}}
+)
+
+// newAuth returns a hook reading a new database file, whose tables are created from the
+// test config with plain passwords.
+func newAuth(t *testing.T, opts *Options) *Auth {
+	if opts == nil {
+		opts = new(Options)
+		require.NoError(t, plugin.LoadYaml(path, opts))
+		opts.Auth.PasswordHash = pa.HashType(0)
+	}
+	opts.Path = filepath.Join(t.TempDir(), "auth.db")
+
+	a := new(Auth)
+	a.SetOpts(logger, nil)
+	require.NoError(t, a.Init(opts))
+	t.Cleanup(func() { a.Stop() })
+
+	_, err := a.db.Exec("insert into auth (username, password, allow, superuser) values ('zhangsan', '123456', 1, 0), ('lisi', '123456', 0, 0), ('admin', '123456', 1, 1)")
+	require.NoError(t, err)
+	_, err = a.db.Exec("insert into acl (username, topic, access) values ('zhangsan', 'topictest/1', 2), ('zhangsan', 'devices/%c/#', 3), ('zhangsan', 'devices/%c/config', 1)")
+	require.NoError(t, err)
+
+	return a
+}
+
+func newClient(id, username string) *mqtt.Client {
+	return &mqtt.Client{ID: id, Properties: mqtt.ClientProperties{Username: []byte(username)}}
+}
+
+func TestID(t *testing.T) {
+	a := new(Auth)
+	require.Equal(t, "auth-sqlite", a.ID())
+}
+
+func TestProvides(t *testing.T) {
+	a := new(Auth)
+	require.True(t, a.Provides(mqtt.OnACLCheck))
+	require.True(t, a.Provides(mqtt.OnConnectAuthenticate))
+	require.False(t, a.Provides(mqtt.OnPublished))
+}
+
+func TestInitBadConfig(t *testing.T) {
+	a := new(Auth)
+	a.SetOpts(logger, nil)
+	require.ErrorIs(t, a.Init(nil), mqtt.ErrInvalidConfigType)
+	require.ErrorIs(t, a.Init(map[string]any{}), mqtt.ErrInvalidConfigType)
+}
+
+func TestInitMissingTables(t *testing.T) {
+	opts := new(Options)
+	require.NoError(t, plugin.LoadYaml(path, opts))
+	opts.Path = filepath.Join(t.TempDir(), "auth.db")
+	opts.CreateTables = false
+
+	a := new(Auth)
+	a.SetOpts(logger, nil)
+	require.Error(t, a.Init(opts))
+}
+
+func TestInitCreateTablesTwice(t *testing.T) {
+	a := newAuth(t, nil)
+	require.NoError(t, a.createTables())
+	require.Equal(t, defaultBusyTimeout, a.config.BusyTimeout)
+}
+
+func TestOnConnectAuthenticate(t *testing.T) {
+	a := newAuth(t, nil)
+
+	require.True(t, a.OnConnectAuthenticate(newClient("c1", "zhangsan"), pkc))
+	require.False(t, a.OnConnectAuthenticate(newClient("c2", "zhangsan"), packets.Packet{Connect: packets.ConnectParams{Password: []byte("654321")}}))
+	require.False(t, a.OnConnectAuthenticate(newClient("c3", "lisi"), pkc))
+
+	// users without a row are left to the next datasource of the chain
+	unknown := newClient("c4", "wangwu")
+	require.False(t, a.OnConnectAuthenticate(unknown, pkc))
+	require.NotContains(t, unknown.Ext, pa.DatasourceExtKey)
+}
+
+func TestOnACLCheck(t *testing.T) {
+	a := newAuth(t, nil)
+
+	cl := newClient("dev1", "zhangsan")
+	require.True(t, a.OnConnectAuthenticate(cl, pkc))
+	require.True(t, a.OnACLCheck(cl, "topictest/1", true))
+	require.False(t, a.OnACLCheck(cl, "topictest/1", false))
+	require.False(t, a.OnACLCheck(cl, "topictest/2", true))
+	require.True(t, a.OnACLCheck(cl, "devices/dev1/state", true))
+	require.False(t, a.OnACLCheck(cl, "devices/dev2/state", true))
+	require.True(t, a.OnACLCheck(cl, "devices/dev1/config", false))
+	require.False(t, a.OnACLCheck(cl, "devices/dev1/config", true))
+}
+
+func TestOnACLCheckSuperuser(t *testing.T) {
+	a := newAuth(t, nil)
+
+	cl := newClient("backend", "admin")
+	require.False(t, a.OnACLCheck(cl, "any/topic", true))
+	require.True(t, a.OnConnectAuthenticate(cl, pkc))
+	require.True(t, a.OnACLCheck(cl, "any/topic", true))
+}
+
+func TestOnACLCheckCached(t *testing.T) {
+	opts := new(Options)
+	require.NoError(t, plugin.LoadYaml(path, opts))
+	opts.Auth.PasswordHash = pa.HashType(0)
+	opts.Cache = pa.CacheOptions{Enable: true}
+	a := newAuth(t, opts)
+
+	cl := newClient("dev1", "zhangsan")
+	require.True(t, a.OnACLCheck(cl, "topictest/1", true))
+
+	// the cached acl is used until it is invalidated
+	_, err := a.db.Exec("delete from acl where username = 'zhangsan'")
+	require.NoError(t, err)
+	require.True(t, a.OnACLCheck(cl, "topictest/1", true))
+	require.Equal(t, 1, a.InvalidateAuthCache("zhangsan"))
+	require.False(t, a.OnACLCheck(cl, "topictest/1", true))
+
+	m := a.AuthMetrics()
+	require.Equal(t, int64(2), m.AclAllowed)
+	require.Equal(t, int64(1), m.AclDenied)
+	require.Equal(t, int64(1), m.CacheHits)
+	require.Equal(t, int64(2), m.Latency.Count)
+}
+
+func TestOnACLCheckAnonymous(t *testing.T) {
+	opts := new(Options)
+	require.NoError(t, plugin.LoadYaml(path, opts))
+	opts.AclMode = byte(auth.AuthAnonymous)
+	a := newAuth(t, opts)
+
+	require.True(t, a.OnACLCheck(newClient("c1", "wangwu"), "any/topic", true))
+}
@@ -0,0 +1,166 @@
+package vault
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxResponseSize is the maximum size of a vault response.
+const maxResponseSize = 1 << 20
+
+var (
+	ErrNotFound = errors.New("secret not found")
+	ErrVault    = errors.New("vault request failed")
+)
+
+// response is the part of a vault response used by the client.
+type response struct {
+	Data   map[string]any `json:"data"`
+	Auth   *tokenAuth     `json:"auth"`
+	Errors []string       `json:"errors"`
+}
+
+// tokenAuth is the token of a login or renewal response.
+type tokenAuth struct {
+	ClientToken   string `json:"client_token"`
+	LeaseDuration int64  `json:"lease_duration"`
+	Renewable     bool   `json:"renewable"`
+}
+
+// client reads secrets from the kv secrets engine of a vault server, with a token given
+// or obtained by an approle login.
+type client struct {
+	sync.RWMutex
+	http      *http.Client
+	address   string
+	namespace string
+	token     string
+}
+
+// do sends a request to a path of the vault api, decoding the response.
+func (c *client) do(method, path string, body any) (*response, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.address, "/")+"/v1/"+strings.TrimPrefix(path, "/"), r)
+	if err != nil {
+		return nil, err
+	}
+
+	c.RLock()
+	token := c.token
+	c.RUnlock()
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if c.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.namespace)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrVault, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+
+	var res response
+	d := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize))
+	d.UseNumber()
+	if err := d.Decode(&res); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%w: %w", ErrVault, err)
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return nil, fmt.Errorf("%w: %s %s", ErrVault, resp.Status, strings.Join(res.Errors, ", "))
+	}
+
+	return &res, nil
+}
+
+// read returns the fields of a secret at a path of a kv mount of version 1 or 2.
+func (c *client) read(mount string, version int, path string) (map[string]any, error) {
+	p := mount + "/" + path
+	if version == 2 {
+		p = mount + "/data/" + path
+	}
+
+	res, err := c.do(http.MethodGet, p, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	data := res.Data
+	if version == 2 {
+		data, _ = data["data"].(map[string]any)
+	}
+	if data == nil {
+		return nil, ErrNotFound // a deleted version of a kv v2 secret
+	}
+
+	return data, nil
+}
+
+// login obtains a token with an approle role id and secret id, returning its ttl.
+func (c *client) login(mount, roleID, secretID string) (time.Duration, bool, error) {
+	res, err := c.do(http.MethodPost, "auth/"+mount+"/login", map[string]string{
+		"role_id":   roleID,
+		"secret_id": secretID,
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	if res.Auth == nil || res.Auth.ClientToken == "" {
+		return 0, false, fmt.Errorf("%w: no token in login response", ErrVault)
+	}
+
+	c.Lock()
+	c.token = res.Auth.ClientToken
+	c.Unlock()
+
+	return time.Duration(res.Auth.LeaseDuration) * time.Second, res.Auth.Renewable, nil
+}
+
+// lookup returns the ttl of the token, and whether it is renewable.
+func (c *client) lookup() (time.Duration, bool, error) {
+	res, err := c.do(http.MethodGet, "auth/token/lookup-self", nil)
+	if err != nil {
+		return 0, false, err
+	}
+
+	var ttl int64
+	if n, ok := res.Data["ttl"].(json.Number); ok {
+		ttl, _ = n.Int64()
+	}
+	renewable, _ := res.Data["renewable"].(bool)
+	return time.Duration(ttl) * time.Second, renewable, nil
+}
+
+// renew renews the token, returning its new ttl.
+func (c *client) renew() (time.Duration, error) {
+	res, err := c.do(http.MethodPost, "auth/token/renew-self", map[string]string{})
+	if err != nil {
+		return 0, err
+	}
+	if res.Auth == nil {
+		return 0, fmt.Errorf("%w: no token in renewal response", ErrVault)
+	}
+
+	return time.Duration(res.Auth.LeaseDuration) * time.Second, nil
+}
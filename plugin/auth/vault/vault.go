@@ -0,0 +1,412 @@
+package vault
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/plugin"
+	pa "github.com/wind-c/comqtt/v2/plugin/auth"
+)
+
+const (
+	defaultAddr         = "http://127.0.0.1:8200" // the default address of the vault server
+	defaultMount        = "secret"                // the default mount of the kv secrets engine
+	defaultKVVersion    = 2                       // the default version of the kv secrets engine
+	defaultAuthPath     = "comqtt/auth"           // the default path of the credentials of each client
+	defaultAclPath      = "comqtt/acl"            // the default path of the acl filters of each client
+	defaultApproleMount = "approle"               // the default mount of the approle auth method
+	defaultCacheTTL     = 60                      // the default number of seconds secrets are cached
+	renewRetry          = time.Minute             // the interval between attempts to renew or log in again
+)
+
+var (
+	ErrNoCredentials = errors.New("vault-options requires a token or a role-id and secret-id")
+	ErrKVVersion     = errors.New("kv-version must be 1 or 2")
+)
+
+type Options struct {
+	pa.Blacklist
+	VaultOptions *vaultOptions   `json:"vault-options" yaml:"vault-options"`
+	AuthMode     byte            `json:"auth-mode" yaml:"auth-mode"`
+	AuthPath     string          `json:"auth-path" yaml:"auth-path"`
+	AclMode      byte            `json:"acl-mode" yaml:"acl-mode"`
+	AclPath      string          `json:"acl-path" yaml:"acl-path"`
+	PasswordHash pa.HashType     `json:"password-hash" yaml:"password-hash"`
+	HashKey      string          `json:"hash-key" yaml:"hash-key"`
+	CacheTTL     int64           `json:"cache-ttl" yaml:"cache-ttl"`
+	Outbound     plugin.Outbound `json:"outbound" yaml:"outbound"`
+}
+
+type vaultOptions struct {
+	Addr         string `json:"addr" yaml:"addr"`
+	Namespace    string `json:"namespace" yaml:"namespace"`
+	Token        string `json:"token" yaml:"token"`
+	RoleID       string `json:"role-id" yaml:"role-id"`
+	SecretID     string `json:"secret-id" yaml:"secret-id"`
+	ApproleMount string `json:"approle-mount" yaml:"approle-mount"`
+	Mount        string `json:"mount" yaml:"mount"`
+	KVVersion    int    `json:"kv-version" yaml:"kv-version"`
+}
+
+// entry is a cached secret, nil if it was not found.
+type entry struct {
+	data    map[string]any
+	expires time.Time
+}
+
+// Auth is an auth controller which reads the credentials and acl filters of each client
+// from the kv secrets engine of a HashiCorp Vault server, so that the passwords never
+// live in the other datasources. The vault token is renewed before it expires, and
+// secrets are cached for the cache ttl, or for longer while vault is unreachable.
+type Auth struct {
+	mqtt.HookBase
+	config  *Options
+	client  *client
+	cache   map[string]*entry // secrets, keyed on their path
+	swept   time.Time         // when expired secrets were last removed from the cache
+	mu      sync.RWMutex
+	cancel  chan struct{}
+	metrics pa.Metrics
+}
+
+// ID returns the ID of the hook.
+func (a *Auth) ID() string {
+	return "auth-vault"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (a *Auth) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnACLCheck,
+	}, []byte{b})
+}
+
+func (a *Auth) Init(config any) error {
+	if _, ok := config.(*Options); config == nil || (!ok && config != nil) {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	a.config = config.(*Options)
+	if a.config.VaultOptions == nil {
+		a.config.VaultOptions = new(vaultOptions)
+	}
+
+	vo := a.config.VaultOptions
+	if vo.Token == "" && (vo.RoleID == "" || vo.SecretID == "") {
+		return ErrNoCredentials
+	}
+	if vo.Addr == "" {
+		vo.Addr = defaultAddr
+	}
+	if vo.Mount == "" {
+		vo.Mount = defaultMount
+	}
+	if vo.KVVersion == 0 {
+		vo.KVVersion = defaultKVVersion
+	}
+	if vo.KVVersion != 1 && vo.KVVersion != 2 {
+		return ErrKVVersion
+	}
+	if vo.ApproleMount == "" {
+		vo.ApproleMount = defaultApproleMount
+	}
+	if a.config.AuthPath == "" {
+		a.config.AuthPath = defaultAuthPath
+	}
+	if a.config.AclPath == "" {
+		a.config.AclPath = defaultAclPath
+	}
+	if a.config.CacheTTL <= 0 {
+		a.config.CacheTTL = defaultCacheTTL
+	}
+
+	a.Log.Info("connecting to vault service", "address", vo.Addr, "namespace", vo.Namespace,
+		"mount", vo.Mount, "kv-version", vo.KVVersion, "approle", vo.RoleID != "")
+
+	a.client = &client{
+		http:      http.DefaultClient,
+		address:   vo.Addr,
+		namespace: vo.Namespace,
+		token:     vo.Token,
+	}
+	if a.config.Outbound.Enabled() {
+		c, err := a.config.Outbound.HTTPClient(nil)
+		if err != nil {
+			return err
+		}
+		a.client.http = c
+	}
+
+	ttl, renewable, err := a.authenticate()
+	if err != nil {
+		return err
+	}
+
+	a.cache = make(map[string]*entry)
+	a.cancel = make(chan struct{})
+	go a.renew(ttl, renewable, a.cancel)
+
+	a.Log.Info("connected to vault service", "token-ttl", ttl.String(), "renewable", renewable)
+	return nil
+}
+
+// Stop stops renewing the vault token.
+func (a *Auth) Stop() error {
+	if a.cancel != nil {
+		close(a.cancel)
+		a.cancel = nil
+	}
+
+	return nil
+}
+
+// authenticate logs in with the approle, or looks up the configured token, returning
+// the ttl of the token and whether it is renewable.
+func (a *Auth) authenticate() (time.Duration, bool, error) {
+	vo := a.config.VaultOptions
+	if vo.RoleID != "" && vo.SecretID != "" {
+		return a.client.login(vo.ApproleMount, vo.RoleID, vo.SecretID)
+	}
+
+	return a.client.lookup()
+}
+
+// renew renews the vault token when two thirds of its ttl have passed, logging in again
+// with the approle if it cannot be renewed, until cancelled. Tokens without a ttl
+// never expire and are not renewed.
+func (a *Auth) renew(ttl time.Duration, renewable bool, cancel chan struct{}) {
+	wait := ttl * 2 / 3
+	for wait > 0 {
+		select {
+		case <-cancel:
+			return
+		case <-time.After(wait):
+		}
+
+		var err error
+		if renewable {
+			if ttl, err = a.client.renew(); err == nil {
+				a.Log.Debug("renewed vault token", "ttl", ttl.String())
+				wait = ttl * 2 / 3
+				continue
+			}
+			a.Log.Warn("unable to renew vault token", "error", err)
+		}
+
+		if a.config.VaultOptions.RoleID != "" {
+			if ttl, renewable, err = a.authenticate(); err == nil {
+				a.Log.Info("logged in to vault again", "ttl", ttl.String())
+				wait = ttl * 2 / 3
+				continue
+			}
+			a.Log.Error("unable to log in to vault", "error", err)
+		} else if !renewable {
+			a.Log.Warn("vault token is not renewable and will expire", "ttl", ttl.String())
+			return
+		}
+
+		wait = renewRetry
+	}
+}
+
+// OnConnectAuthenticate returns true if the connecting client has a secret in vault
+// whose password matches the password of the client. Clients whose secret has a true
+// superuser field skip acl checks.
+func (a *Auth) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	if !pa.DecidedBy(cl, a.ID()) { // denied by an earlier datasource of the auth chain
+		return false
+	}
+
+	return pa.Decide(cl, a.ID(), a.metrics.Auth(a.authenticateClient(cl, pk)))
+}
+
+// authenticateClient returns whether the secret of the connecting client allows it, or
+// Unknown if it has no secret.
+func (a *Auth) authenticateClient(cl *mqtt.Client, pk packets.Packet) pa.Result {
+	if a.config.AuthMode == byte(auth.AuthAnonymous) {
+		return pa.Allow
+	}
+
+	// check blacklist
+	if n, ok := a.config.CheckBLAuth(cl, pk); n >= 0 { // It's on the blacklist
+		return pa.ResultOf(ok)
+	}
+
+	// normal verification
+	var key string
+	if a.config.AuthMode == byte(auth.AuthUsername) {
+		key = string(cl.Properties.Username)
+	} else if a.config.AuthMode == byte(auth.AuthClientID) {
+		key = cl.ID
+	} else {
+		return pa.Unknown
+	}
+
+	if !validKey(key) {
+		return pa.Unknown
+	}
+
+	data := a.secret(a.config.AuthPath + "/" + url.PathEscape(key))
+	if data == nil {
+		return pa.Unknown
+	}
+
+	// secrets are allowed unless the allow field is false
+	if allow, ok := data["allow"]; ok && !truthy(allow) {
+		return pa.Deny
+	}
+
+	password, ok := data["password"].(string)
+	if !ok {
+		return pa.Deny
+	}
+
+	if !pa.CompareHash(password, string(pk.Connect.Password), a.config.HashKey, a.config.PasswordHash) {
+		return pa.Deny
+	}
+
+	if truthy(data["superuser"]) {
+		pa.SetSuperuser(cl)
+	}
+	pa.SetMaxConnections(cl, integer(data["max_connections"]))
+
+	return pa.Allow
+}
+
+// OnACLCheck returns true if the connecting client has matching read or write access to
+// subscribe or publish to a given topic in its acl secret in vault.
+func (a *Auth) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	return a.config.AuthorizeClient(a.ID(), a.config.AclMode, &a.metrics, cl, topic, write, a.lookupAcl)
+}
+
+// lookupAcl returns true if the acl of the client in vault allows it to subscribe or
+// publish to a topic.
+func (a *Auth) lookupAcl(cl *mqtt.Client, topic string, write bool) bool {
+	key, ok := pa.AclKey(cl, a.config.AclMode)
+	if !ok {
+		return false
+	}
+
+	if !validKey(key) {
+		return false
+	}
+
+	fam := make(map[string]auth.Access)
+	for filter, rw := range a.secret(a.config.AclPath + "/" + url.PathEscape(key)) {
+		filter, ok := pa.ExpandClientFilter(cl, filter)
+		if !ok || !plugin.MatchTopic(filter, topic) {
+			continue
+		}
+
+		var access int
+		var err error
+		switch v := rw.(type) {
+		case json.Number:
+			access, err = strconv.Atoi(v.String())
+		case string:
+			access, err = strconv.Atoi(v)
+		default:
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		fam[filter] = auth.Access(access)
+	}
+
+	return pa.CheckAcl(fam, write)
+}
+
+// secret returns the fields of the secret at a path, from the cache or from vault. A
+// cached secret is used beyond the cache ttl if vault cannot be reached.
+func (a *Auth) secret(path string) map[string]any {
+	now := time.Now()
+
+	a.mu.RLock()
+	e, ok := a.cache[path]
+	a.mu.RUnlock()
+	hit := ok && now.Before(e.expires)
+	a.metrics.Cached(hit)
+	if hit {
+		return e.data
+	}
+
+	vo := a.config.VaultOptions
+	data, err := a.client.read(vo.Mount, vo.KVVersion, path)
+	a.metrics.Lookup(now)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		a.Log.Warn("unable to read vault secret", "error", err, "path", path)
+		if ok {
+			return e.data
+		}
+		return nil
+	}
+
+	ttl := time.Duration(a.config.CacheTTL) * time.Second
+	a.mu.Lock()
+	a.cache[path] = &entry{data: data, expires: now.Add(ttl)}
+	if now.Sub(a.swept) > ttl { // remove secrets which were not read again since they expired
+		for k, e := range a.cache {
+			if now.After(e.expires.Add(ttl)) {
+				delete(a.cache, k)
+			}
+		}
+		a.swept = now
+	}
+	a.mu.Unlock()
+
+	return data
+}
+
+// validKey returns true if a username or client id can be used as the name of a secret,
+// so that it cannot refer to the secret of another client.
+func validKey(key string) bool {
+	return key != "" && key != "." && key != ".." && !strings.Contains(key, "/")
+}
+
+// truthy returns true if a secret field is true, as a bool or a string.
+func truthy(v any) bool {
+	switch b := v.(type) {
+	case bool:
+		return b
+	case string:
+		ok, _ := strconv.ParseBool(b)
+		return ok
+	}
+
+	return false
+}
+
+// integer returns the value of a secret field holding an integer, which may be a number
+// or a string, or 0 if it is neither.
+func integer(v any) int {
+	switch n := v.(type) {
+	case json.Number:
+		i, _ := n.Int64()
+		return int(i)
+	case float64:
+		return int(n)
+	case string:
+		i, _ := strconv.Atoi(n)
+		return i
+	}
+
+	return 0
+}
+
+// AuthMetrics returns the decisions, datasource latency and cache hits of the hook.
+func (a *Auth) AuthMetrics() mqtt.AuthMetrics {
+	return a.metrics.Snapshot(a.ID(), nil)
+}
@@ -0,0 +1,337 @@
+package vault
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/plugin"
+	pa "github.com/wind-c/comqtt/v2/plugin/auth"
+)
+
+const path = "./conf.yml"
+
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// fakeVault is a vault server with a kv v2 mount at secret and a kv v1 mount at kv,
+// counting the requests of each path.
+type fakeVault struct {
+	sync.Mutex
+	secrets   map[string]map[string]any // secrets keyed on path within the mount
+	tokens    map[string]bool           // valid tokens
+	ttl       int64                     // the ttl of tokens in seconds
+	renewable bool                      // whether tokens can be renewed
+	requests  map[string]int
+	down      atomic.Bool
+}
+
+func newFakeVault(t *testing.T) (*fakeVault, *httptest.Server) {
+	v := &fakeVault{
+		secrets:   map[string]map[string]any{},
+		tokens:    map[string]bool{"root": true},
+		renewable: true,
+		requests:  map[string]int{},
+	}
+	srv := httptest.NewServer(v)
+	t.Cleanup(srv.Close)
+	return v, srv
+}
+
+func (v *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if v.down.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	v.Lock()
+	defer v.Unlock()
+	v.requests[r.URL.Path]++
+
+	if r.URL.Path == "/v1/auth/approle/login" {
+		var body map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		if body["role_id"] != "role" || body["secret_id"] != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]any{"errors": []string{"invalid role or secret id"}})
+			return
+		}
+		v.tokens["approle-token"] = true
+		_ = json.NewEncoder(w).Encode(map[string]any{"auth": map[string]any{"client_token": "approle-token", "lease_duration": v.ttl, "renewable": v.renewable}})
+		return
+	}
+
+	if !v.tokens[r.Header.Get("X-Vault-Token")] {
+		w.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(w).Encode(map[string]any{"errors": []string{"permission denied"}})
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/v1/auth/token/lookup-self":
+		_ = json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"ttl": v.ttl, "renewable": v.renewable}})
+	case r.URL.Path == "/v1/auth/token/renew-self" && r.Method == http.MethodPost:
+		if !v.renewable {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"auth": map[string]any{"lease_duration": v.ttl}})
+	case strings.HasPrefix(r.URL.Path, "/v1/secret/data/"):
+		data, ok := v.secrets[strings.TrimPrefix(r.URL.Path, "/v1/secret/data/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"data": data, "metadata": map[string]any{"version": 1}}})
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		data, ok := v.secrets[strings.TrimPrefix(r.URL.Path, "/v1/kv/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"data": data})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (v *fakeVault) put(path string, data map[string]any) {
+	v.Lock()
+	defer v.Unlock()
+	v.secrets[path] = data
+}
+
+func (v *fakeVault) count(path string) int {
+	v.Lock()
+	defer v.Unlock()
+	return v.requests[path]
+}
+
+func newAuth(t *testing.T, opts *Options) *Auth {
+	a := new(Auth)
+	a.SetOpts(logger, nil)
+	require.NoError(t, a.Init(opts))
+	t.Cleanup(func() {
+		_ = a.Stop()
+	})
+	return a
+}
+
+func newClient(id, username string) *mqtt.Client {
+	return &mqtt.Client{
+		ID: id,
+		Properties: mqtt.ClientProperties{
+			Username: []byte(username),
+		},
+	}
+}
+
+func password(pwd string) packets.Packet {
+	return packets.Packet{Connect: packets.ConnectParams{Password: []byte(pwd)}}
+}
+
+func TestInitFromConfFile(t *testing.T) {
+	_, srv := newFakeVault(t)
+
+	opts := new(Options)
+	require.NoError(t, plugin.LoadYaml(path, opts))
+	require.Equal(t, "http://127.0.0.1:8200", opts.VaultOptions.Addr)
+	opts.VaultOptions.Addr = srv.URL
+	opts.VaultOptions.Token = "root"
+
+	a := newAuth(t, opts)
+	require.Equal(t, "secret", a.config.VaultOptions.Mount)
+	require.Equal(t, 2, a.config.VaultOptions.KVVersion)
+	require.Equal(t, "comqtt/auth", a.config.AuthPath)
+	require.Equal(t, "comqtt/acl", a.config.AclPath)
+	require.Equal(t, int64(60), a.config.CacheTTL)
+}
+
+func TestInitInvalid(t *testing.T) {
+	_, srv := newFakeVault(t)
+
+	a := new(Auth)
+	a.SetOpts(logger, nil)
+	require.ErrorIs(t, a.Init(nil), mqtt.ErrInvalidConfigType)
+	require.ErrorIs(t, a.Init(&Options{}), ErrNoCredentials)
+	require.ErrorIs(t, a.Init(&Options{VaultOptions: &vaultOptions{Token: "root", KVVersion: 3}}), ErrKVVersion)
+	require.ErrorIs(t, a.Init(&Options{VaultOptions: &vaultOptions{Addr: srv.URL, Token: "wrong"}}), ErrVault)
+	require.ErrorIs(t, a.Init(&Options{VaultOptions: &vaultOptions{Addr: srv.URL, RoleID: "role", SecretID: "wrong"}}), ErrVault)
+}
+
+func TestOnConnectAuthenticate(t *testing.T) {
+	v, srv := newFakeVault(t)
+	v.put("comqtt/auth/device-001", map[string]any{"password": "pwd"})
+	v.put("comqtt/auth/device-002", map[string]any{"password": "pwd", "allow": false})
+	v.put("comqtt/auth/device-003", map[string]any{"password": "pwd", "allow": "true"})
+	v.put("comqtt/auth/shared", map[string]any{"password": "pwd"})
+
+	a := newAuth(t, &Options{
+		AuthMode:     byte(auth.AuthUsername),
+		VaultOptions: &vaultOptions{Addr: srv.URL, Token: "root"},
+	})
+
+	require.True(t, a.OnConnectAuthenticate(newClient("c1", "device-001"), password("pwd")))
+	require.False(t, a.OnConnectAuthenticate(newClient("c1", "device-001"), password("wrong")))
+	require.False(t, a.OnConnectAuthenticate(newClient("c1", "device-002"), password("pwd")))
+	require.True(t, a.OnConnectAuthenticate(newClient("c1", "device-003"), password("pwd")))
+	require.False(t, a.OnConnectAuthenticate(newClient("c1", "device-004"), password("pwd")))
+
+	// keys cannot refer to the secrets of other clients
+	require.False(t, a.OnConnectAuthenticate(newClient("c1", "device-001/../shared"), password("pwd")))
+	require.False(t, a.OnConnectAuthenticate(newClient("c1", ".."), password("pwd")))
+	require.False(t, a.OnConnectAuthenticate(newClient("c1", ""), password("pwd")))
+}
+
+func TestOnConnectAuthenticateHashedKV1(t *testing.T) {
+	v, srv := newFakeVault(t)
+	v.put("devices/auth/device-001", map[string]any{"password": pa.Sha256("pwd")})
+
+	a := newAuth(t, &Options{
+		AuthMode:     byte(auth.AuthClientID),
+		AuthPath:     "devices/auth",
+		PasswordHash: pa.HashSha256,
+		VaultOptions: &vaultOptions{Addr: srv.URL, Token: "root", Mount: "kv", KVVersion: 1},
+	})
+
+	require.True(t, a.OnConnectAuthenticate(newClient("device-001", ""), password("pwd")))
+	require.False(t, a.OnConnectAuthenticate(newClient("device-001", ""), password("wrong")))
+}
+
+func TestOnACLCheck(t *testing.T) {
+	v, srv := newFakeVault(t)
+	v.put("comqtt/acl/device-001", map[string]any{
+		"devices/device-001/#": 3,
+		"broadcast/#":          "1",
+		"broadcast/admin":      0,
+		"invalid/#":            "rw",
+	})
+
+	a := newAuth(t, &Options{
+		AclMode:      byte(auth.AuthClientID),
+		VaultOptions: &vaultOptions{Addr: srv.URL, Token: "root"},
+	})
+
+	cl := newClient("device-001", "")
+	require.True(t, a.OnACLCheck(cl, "devices/device-001/state", true))
+	require.True(t, a.OnACLCheck(cl, "broadcast/news", false))
+	require.False(t, a.OnACLCheck(cl, "broadcast/news", true))
+	require.False(t, a.OnACLCheck(cl, "broadcast/admin", false))
+	require.False(t, a.OnACLCheck(cl, "invalid/topic", false))
+	require.False(t, a.OnACLCheck(newClient("device-002", ""), "devices/device-001/state", false))
+	require.True(t, newAuth(t, &Options{VaultOptions: &vaultOptions{Addr: srv.URL, Token: "root"}}).OnACLCheck(cl, "any", true))
+}
+
+func TestOnACLCheckSuperuser(t *testing.T) {
+	v, srv := newFakeVault(t)
+	v.put("comqtt/auth/backend", map[string]any{"password": "pwd", "superuser": true, "max_connections": -1})
+	v.put("comqtt/auth/device-001", map[string]any{"password": "pwd", "superuser": "false"})
+
+	a := newAuth(t, &Options{
+		AuthMode:     byte(auth.AuthUsername),
+		AclMode:      byte(auth.AuthUsername),
+		VaultOptions: &vaultOptions{Addr: srv.URL, Token: "root"},
+	})
+
+	backend := newClient("c1", "backend")
+	require.True(t, a.OnConnectAuthenticate(backend, password("pwd")))
+	require.True(t, a.OnACLCheck(backend, "devices/device-001/cmd", true))
+	require.Equal(t, -1, backend.Ext[mqtt.MaxConnectionsExtKey])
+
+	device := newClient("c2", "device-001")
+	require.True(t, a.OnConnectAuthenticate(device, password("pwd")))
+	require.False(t, a.OnACLCheck(device, "devices/device-001/cmd", true))
+}
+
+func TestSecretCache(t *testing.T) {
+	v, srv := newFakeVault(t)
+	v.put("comqtt/auth/device-001", map[string]any{"password": "pwd"})
+
+	a := newAuth(t, &Options{
+		AuthMode:     byte(auth.AuthUsername),
+		VaultOptions: &vaultOptions{Addr: srv.URL, Token: "root"},
+	})
+
+	cl := newClient("c1", "device-001")
+	require.True(t, a.OnConnectAuthenticate(cl, password("pwd")))
+	require.True(t, a.OnConnectAuthenticate(cl, password("pwd")))
+	require.Equal(t, 1, v.count("/v1/secret/data/comqtt/auth/device-001"))
+
+	// missing secrets are cached too
+	require.False(t, a.OnConnectAuthenticate(newClient("c1", "device-002"), password("pwd")))
+	require.False(t, a.OnConnectAuthenticate(newClient("c1", "device-002"), password("pwd")))
+	require.Equal(t, 1, v.count("/v1/secret/data/comqtt/auth/device-002"))
+
+	// expired secrets are read again, or used while vault is unreachable
+	a.mu.Lock()
+	for _, e := range a.cache {
+		e.expires = time.Now().Add(-time.Second)
+	}
+	a.mu.Unlock()
+
+	v.down.Store(true)
+	require.True(t, a.OnConnectAuthenticate(cl, password("pwd")))
+	require.False(t, a.OnConnectAuthenticate(newClient("c1", "device-003"), password("pwd")))
+
+	v.down.Store(false)
+	v.put("comqtt/auth/device-001", map[string]any{"password": "changed"})
+	require.False(t, a.OnConnectAuthenticate(cl, password("pwd")))
+	require.True(t, a.OnConnectAuthenticate(cl, password("changed")))
+	require.Equal(t, 2, v.count("/v1/secret/data/comqtt/auth/device-001"))
+}
+
+func TestSecretCacheSweep(t *testing.T) {
+	v, srv := newFakeVault(t)
+	a := newAuth(t, &Options{
+		AuthMode:     byte(auth.AuthUsername),
+		VaultOptions: &vaultOptions{Addr: srv.URL, Token: "root"},
+	})
+
+	a.cache["comqtt/auth/old"] = &entry{expires: time.Now().Add(-2 * time.Hour)}
+	v.put("comqtt/auth/device-001", map[string]any{"password": "pwd"})
+	require.True(t, a.OnConnectAuthenticate(newClient("c1", "device-001"), password("pwd")))
+	require.NotContains(t, a.cache, "comqtt/auth/old")
+	require.Contains(t, a.cache, "comqtt/auth/device-001")
+}
+
+func TestRenewToken(t *testing.T) {
+	v, srv := newFakeVault(t)
+	v.ttl = 1
+
+	newAuth(t, &Options{VaultOptions: &vaultOptions{Addr: srv.URL, Token: "root"}})
+	require.Eventually(t, func() bool {
+		return v.count("/v1/auth/token/renew-self") >= 2
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+func TestRenewTokenApprole(t *testing.T) {
+	v, srv := newFakeVault(t)
+	v.ttl = 1
+	v.renewable = false
+
+	// tokens which cannot be renewed are replaced by logging in again
+	a := newAuth(t, &Options{VaultOptions: &vaultOptions{Addr: srv.URL, RoleID: "role", SecretID: "secret"}})
+	require.Equal(t, "approle-token", a.client.token)
+	require.Eventually(t, func() bool {
+		return v.count("/v1/auth/approle/login") >= 2
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+func TestRenewTokenNotExpiring(t *testing.T) {
+	v, srv := newFakeVault(t)
+
+	a := newAuth(t, &Options{VaultOptions: &vaultOptions{Addr: srv.URL, Token: "root"}})
+	_ = a.Stop()
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, 0, v.count("/v1/auth/token/renew-self"))
+}
@@ -0,0 +1,246 @@
+package x509
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/plugin"
+	pa "github.com/wind-c/comqtt/v2/plugin/auth"
+)
+
+const (
+	IdentityCN    = "cn"    // the common name of the certificate subject
+	IdentityDNS   = "dns"   // the first dns name of the subject alternative names
+	IdentityEmail = "email" // the first email address of the subject alternative names
+	IdentityURI   = "uri"   // the first uri of the subject alternative names
+
+	RoleAttributeOU = "ou" // the organizational units of the certificate subject
+	RoleAttributeO  = "o"  // the organizations of the certificate subject
+
+	// IdentityPlaceholder is replaced in role filters with the identity of the client.
+	IdentityPlaceholder = "${identity}"
+)
+
+var (
+	ErrInvalidIdentity      = errors.New("identity must be one of cn, dns, email or uri")
+	ErrInvalidRoleAttribute = errors.New("role-attribute must be one of ou, o or empty")
+)
+
+type Options struct {
+	pa.Blacklist
+	AuthMode      byte                              `json:"auth-mode" yaml:"auth-mode"`
+	AclMode       byte                              `json:"acl-mode" yaml:"acl-mode"`
+	Identity      string                            `json:"identity" yaml:"identity"`
+	RoleAttribute string                            `json:"role-attribute" yaml:"role-attribute"`
+	DefaultRoles  []string                          `json:"default-roles" yaml:"default-roles"`
+	Users         map[string][]string               `json:"users" yaml:"users"`
+	Roles         map[string]map[string]auth.Access `json:"roles" yaml:"roles"`
+}
+
+// Auth is an auth controller which authenticates clients by the verified certificate
+// they presented to a tls listener, in place of a password. The identity of the
+// certificate is mapped to the username or client id of the client, and its roles
+// to acl filters.
+type Auth struct {
+	mqtt.HookBase
+	config  *Options
+	metrics pa.Metrics
+}
+
+// ID returns the ID of the hook.
+func (a *Auth) ID() string {
+	return "auth-x509"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (a *Auth) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnACLCheck,
+	}, []byte{b})
+}
+
+func (a *Auth) Init(config any) error {
+	if _, ok := config.(*Options); config == nil || (!ok && config != nil) {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	a.config = config.(*Options)
+	if a.config.Identity == "" {
+		a.config.Identity = IdentityCN
+	}
+
+	switch a.config.Identity {
+	case IdentityCN, IdentityDNS, IdentityEmail, IdentityURI:
+	default:
+		return ErrInvalidIdentity
+	}
+
+	switch a.config.RoleAttribute {
+	case "", RoleAttributeOU, RoleAttributeO:
+	default:
+		return ErrInvalidRoleAttribute
+	}
+
+	a.Log.Info("", "identity", a.config.Identity, "role-attribute", a.config.RoleAttribute, "roles", len(a.config.Roles))
+
+	return nil
+}
+
+// OnConnectAuthenticate returns true if the connecting client presented a verified
+// certificate whose identity matches its username or client id. A client connecting
+// without a username is given the identity as its username.
+func (a *Auth) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	if !pa.DecidedBy(cl, a.ID()) { // denied by an earlier datasource of the auth chain
+		return false
+	}
+
+	return pa.Decide(cl, a.ID(), a.metrics.Auth(a.authenticateClient(cl, pk)))
+}
+
+// authenticateClient returns whether the certificate of the connecting client allows it, or
+// Unknown if it presented no certificate with an identity.
+func (a *Auth) authenticateClient(cl *mqtt.Client, pk packets.Packet) pa.Result {
+	if a.config.AuthMode == byte(auth.AuthAnonymous) {
+		return pa.Allow
+	}
+
+	// check blacklist
+	if n, ok := a.config.CheckBLAuth(cl, pk); n >= 0 { // It's on the blacklist
+		return pa.ResultOf(ok)
+	}
+
+	cert := PeerCertificate(cl.Net.Conn)
+	if cert == nil {
+		return pa.Unknown
+	}
+
+	identity := a.identity(cert)
+	if identity == "" {
+		return pa.Unknown
+	}
+
+	if a.config.AuthMode == byte(auth.AuthUsername) {
+		if len(cl.Properties.Username) == 0 {
+			cl.Properties.Username = []byte(identity)
+			return pa.Allow
+		}
+		return pa.ResultOf(string(cl.Properties.Username) == identity)
+	} else if a.config.AuthMode == byte(auth.AuthClientID) {
+		return pa.ResultOf(cl.ID == identity)
+	}
+
+	return pa.Unknown
+}
+
+// OnACLCheck returns true if a role of the certificate of the client has matching read
+// or write access to subscribe or publish to a given topic.
+func (a *Auth) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	return a.config.AuthorizeClient(a.ID(), a.config.AclMode, &a.metrics, cl, topic, write, a.lookupAcl)
+}
+
+// lookupAcl returns true if the acl of the client in the roles of its certificate allows
+// it to subscribe or publish to a topic.
+func (a *Auth) lookupAcl(cl *mqtt.Client, topic string, write bool) bool {
+	cert := PeerCertificate(cl.Net.Conn)
+	if cert == nil {
+		return false
+	}
+
+	identity := a.identity(cert)
+	if identity == "" {
+		return false
+	}
+
+	fam := make(map[string]auth.Access)
+	for _, role := range a.roles(identity, cert) {
+		for filter, access := range a.config.Roles[role] {
+			filter, ok := pa.ExpandClientFilter(cl, strings.ReplaceAll(filter, IdentityPlaceholder, identity))
+			if !ok || !plugin.MatchTopic(filter, topic) {
+				continue
+			}
+
+			// a filter denied by any role is denied, otherwise the access of the roles is combined.
+			if prev, ok := fam[filter]; ok && (prev == auth.Deny || access == auth.Deny) {
+				fam[filter] = auth.Deny
+			} else {
+				fam[filter] = prev | access
+			}
+		}
+	}
+
+	return pa.CheckAcl(fam, write)
+}
+
+// identity returns the identity of a certificate, or an empty string if it has none.
+func (a *Auth) identity(cert *x509.Certificate) string {
+	switch a.config.Identity {
+	case IdentityDNS:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case IdentityEmail:
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case IdentityURI:
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	default:
+		return cert.Subject.CommonName
+	}
+
+	return ""
+}
+
+// roles returns the roles of an identity, from the default roles, the roles configured
+// for the identity and the role attribute of its certificate.
+func (a *Auth) roles(identity string, cert *x509.Certificate) []string {
+	roles := append([]string{}, a.config.DefaultRoles...)
+	roles = append(roles, a.config.Users[identity]...)
+
+	switch a.config.RoleAttribute {
+	case RoleAttributeOU:
+		roles = append(roles, cert.Subject.OrganizationalUnit...)
+	case RoleAttributeO:
+		roles = append(roles, cert.Subject.Organization...)
+	}
+
+	return roles
+}
+
+// PeerCertificate returns the verified certificate a client presented to a tls listener,
+// or nil if the connection is not tls or the client presented no verified certificate.
+func PeerCertificate(conn net.Conn) *x509.Certificate {
+	for conn != nil {
+		if c, ok := conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+			cs := c.ConnectionState()
+			if !cs.HandshakeComplete || len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) == 0 {
+				return nil
+			}
+			return cs.VerifiedChains[0][0]
+		}
+
+		// unwrap connections such as websockets and proxied connections
+		nc, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		conn = nc.NetConn()
+	}
+
+	return nil
+}
+
+// AuthMetrics returns the decisions, datasource latency and cache hits of the hook.
+func (a *Auth) AuthMetrics() mqtt.AuthMetrics {
+	return a.metrics.Snapshot(a.ID(), nil)
+}
@@ -0,0 +1,245 @@
+package x509
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/plugin"
+)
+
+const path = "./conf.yml"
+
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// testCA issues the server and client certificates of the tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) issue(t *testing.T, subject pkix.Name, dns []string, usage x509.ExtKeyUsage) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      subject,
+		DNSNames:     dns,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// newTestClient returns a client connected over tls, presenting the certificate if given.
+func newTestClient(t *testing.T, ca *testCA, cert *tls.Certificate, id, username string) *mqtt.Client {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	server := ca.issue(t, pkix.Name{CommonName: "broker"}, []string{"broker"}, x509.ExtKeyUsageServerAuth)
+	sc, cc := net.Pipe()
+	t.Cleanup(func() {
+		sc.Close()
+		cc.Close()
+	})
+
+	srv := tls.Server(sc, &tls.Config{
+		Certificates: []tls.Certificate{server},
+		ClientCAs:    pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	})
+	cfg := &tls.Config{RootCAs: pool, ServerName: "broker"}
+	if cert != nil {
+		cfg.Certificates = []tls.Certificate{*cert}
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- tls.Client(cc, cfg).Handshake()
+	}()
+	require.NoError(t, srv.Handshake())
+	require.NoError(t, <-errs)
+
+	return &mqtt.Client{
+		ID: id,
+		Net: mqtt.ClientConnection{
+			Conn:     srv,
+			Remote:   "test.addr",
+			Listener: "listener",
+		},
+		Properties: mqtt.ClientProperties{
+			Username: []byte(username),
+		},
+	}
+}
+
+func newAuth(t *testing.T, opts *Options) *Auth {
+	a := new(Auth)
+	a.SetOpts(logger, nil)
+	require.NoError(t, a.Init(opts))
+	return a
+}
+
+func TestInitFromConfFile(t *testing.T) {
+	opts := new(Options)
+	require.NoError(t, plugin.LoadYaml(path, opts))
+
+	a := newAuth(t, opts)
+	require.Equal(t, IdentityCN, a.config.Identity)
+	require.Equal(t, RoleAttributeOU, a.config.RoleAttribute)
+	require.Equal(t, auth.ReadWrite, a.config.Roles["device"]["devices/${identity}/#"])
+	require.Equal(t, []string{"gateway"}, a.config.Users["gateway-001"])
+}
+
+func TestInitInvalid(t *testing.T) {
+	a := new(Auth)
+	a.SetOpts(logger, nil)
+	require.ErrorIs(t, a.Init(nil), mqtt.ErrInvalidConfigType)
+	require.ErrorIs(t, a.Init(&Options{Identity: "serial"}), ErrInvalidIdentity)
+	require.ErrorIs(t, a.Init(&Options{RoleAttribute: "cn"}), ErrInvalidRoleAttribute)
+}
+
+func TestOnConnectAuthenticateUsername(t *testing.T) {
+	ca := newTestCA(t)
+	cert := ca.issue(t, pkix.Name{CommonName: "device-001"}, nil, x509.ExtKeyUsageClientAuth)
+	a := newAuth(t, &Options{AuthMode: byte(auth.AuthUsername)})
+
+	cl := newTestClient(t, ca, &cert, "c1", "device-001")
+	require.True(t, a.OnConnectAuthenticate(cl, packets.Packet{}))
+
+	cl = newTestClient(t, ca, &cert, "c1", "device-002")
+	require.False(t, a.OnConnectAuthenticate(cl, packets.Packet{}))
+
+	// the identity is given to clients without a username
+	cl = newTestClient(t, ca, &cert, "c1", "")
+	require.True(t, a.OnConnectAuthenticate(cl, packets.Packet{}))
+	require.Equal(t, "device-001", string(cl.Properties.Username))
+
+	cl = newTestClient(t, ca, nil, "c1", "device-001")
+	require.False(t, a.OnConnectAuthenticate(cl, packets.Packet{}))
+}
+
+func TestOnConnectAuthenticateClientID(t *testing.T) {
+	ca := newTestCA(t)
+	cert := ca.issue(t, pkix.Name{CommonName: "device"}, []string{"device-001.fleet"}, x509.ExtKeyUsageClientAuth)
+	a := newAuth(t, &Options{AuthMode: byte(auth.AuthClientID), Identity: IdentityDNS})
+
+	cl := newTestClient(t, ca, &cert, "device-001.fleet", "")
+	require.True(t, a.OnConnectAuthenticate(cl, packets.Packet{}))
+
+	cl = newTestClient(t, ca, &cert, "device", "")
+	require.False(t, a.OnConnectAuthenticate(cl, packets.Packet{}))
+}
+
+func TestOnConnectAuthenticateNoTLS(t *testing.T) {
+	a := newAuth(t, &Options{AuthMode: byte(auth.AuthUsername)})
+	sc, cc := net.Pipe()
+	defer sc.Close()
+	defer cc.Close()
+
+	cl := &mqtt.Client{Net: mqtt.ClientConnection{Conn: sc}}
+	require.False(t, a.OnConnectAuthenticate(cl, packets.Packet{}))
+	require.True(t, newAuth(t, &Options{}).OnConnectAuthenticate(cl, packets.Packet{}))
+}
+
+func TestOnACLCheck(t *testing.T) {
+	ca := newTestCA(t)
+	a := newAuth(t, &Options{
+		AclMode:       byte(auth.AuthUsername),
+		RoleAttribute: RoleAttributeOU,
+		DefaultRoles:  []string{"device"},
+		Users:         map[string][]string{"gateway-001": {"gateway"}},
+		Roles: map[string]map[string]auth.Access{
+			"device": {
+				"devices/${identity}/#": auth.ReadWrite,
+				"broadcast/#":           auth.ReadOnly,
+			},
+			"gateway": {
+				"devices/#": auth.ReadWrite,
+			},
+			"muted": {
+				"broadcast/#": auth.Deny,
+			},
+		},
+	})
+
+	cert := ca.issue(t, pkix.Name{CommonName: "device-001"}, nil, x509.ExtKeyUsageClientAuth)
+	cl := newTestClient(t, ca, &cert, "c1", "")
+	require.True(t, a.OnACLCheck(cl, "devices/device-001/temp", true))
+	require.False(t, a.OnACLCheck(cl, "devices/device-002/temp", true))
+	require.True(t, a.OnACLCheck(cl, "broadcast/all", false))
+	require.False(t, a.OnACLCheck(cl, "broadcast/all", true))
+
+	cert = ca.issue(t, pkix.Name{CommonName: "gateway-001"}, nil, x509.ExtKeyUsageClientAuth)
+	cl = newTestClient(t, ca, &cert, "c2", "")
+	require.True(t, a.OnACLCheck(cl, "devices/device-002/temp", true))
+
+	// roles of the certificate subject, where a deny wins
+	cert = ca.issue(t, pkix.Name{CommonName: "device-003", OrganizationalUnit: []string{"muted"}}, nil, x509.ExtKeyUsageClientAuth)
+	cl = newTestClient(t, ca, &cert, "c3", "")
+	require.True(t, a.OnACLCheck(cl, "devices/device-003/temp", true))
+	require.False(t, a.OnACLCheck(cl, "broadcast/all", false))
+
+	cl = newTestClient(t, ca, nil, "c4", "device-001")
+	require.False(t, a.OnACLCheck(cl, "devices/device-001/temp", true))
+}
+
+type wrappedConn struct {
+	net.Conn
+}
+
+func (c *wrappedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func TestPeerCertificateUnwrap(t *testing.T) {
+	ca := newTestCA(t)
+	cert := ca.issue(t, pkix.Name{CommonName: "device-001"}, nil, x509.ExtKeyUsageClientAuth)
+	cl := newTestClient(t, ca, &cert, "c1", "")
+
+	c := PeerCertificate(&wrappedConn{Conn: cl.Net.Conn})
+	require.NotNil(t, c)
+	require.Equal(t, "device-001", c.Subject.CommonName)
+
+	require.Nil(t, PeerCertificate(nil))
+}
@@ -0,0 +1,621 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind
+
+package aws
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/plugin"
+)
+
+const (
+	defaultQueueSize = 1024
+	defaultRetries   = 3
+	defaultTimeout   = 10
+
+	// maxBatchEntries is the most entries sns and sqs accept in a batch.
+	maxBatchEntries = 10
+
+	// maxBatchBytes is the most bytes sns and sqs accept in the messages of a batch.
+	maxBatchBytes = 256 * 1024
+
+	// retryBackoff is the wait before the first retry of a failed batch, doubled after each retry.
+	retryBackoff = 100 * time.Millisecond
+)
+
+const (
+	// GroupByClient sets the message group id of fifo targets to the client id, so that the
+	// messages of each client are delivered in order.
+	GroupByClient = "client"
+
+	// GroupByTopic sets the message group id of fifo targets to the topic, so that the
+	// messages of each topic are delivered in order.
+	GroupByTopic = "topic"
+)
+
+const (
+	// AttrTopic is the message attribute holding the topic of a message.
+	AttrTopic = "topic"
+
+	// AttrClientID is the message attribute holding the client id of a message.
+	AttrClientID = "clientid"
+
+	// AttrUsername is the message attribute holding the username of the client of a message.
+	AttrUsername = "username"
+
+	// AttrTarget is the message attribute holding the target of a dead-lettered message.
+	AttrTarget = "target"
+
+	// AttrError is the message attribute holding the failure of a dead-lettered message.
+	AttrError = "error"
+)
+
+// ErrInvalidTarget indicates a target has no sns topic or sqs queue, both, or an invalid group by.
+var ErrInvalidTarget = errors.New("bridge-aws: invalid target")
+
+// Message is the json body of a forwarded message.
+type Message struct {
+	ClientID    string            `json:"clientid"`              // the client id
+	Username    string            `json:"username"`              // the username of the client
+	Topic       string            `json:"topic"`                 // the publish topic
+	Payload     []byte            `json:"payload,omitempty"`     // the publish payload
+	Qos         byte              `json:"qos"`                   // the publish qos
+	Retain      bool              `json:"retain,omitempty"`      // if the message was retained
+	Timestamp   int64             `json:"ts"`                    // publish time
+	Annotations map[string]string `json:"annotations,omitempty"` // the broker metadata annotated on a publish
+}
+
+// MarshalBinary encodes the values into a json string.
+func (d Message) MarshalBinary() (data []byte, err error) {
+	return json.Marshal(d)
+}
+
+// UnmarshalBinary decodes a json string into a struct.
+func (d *Message) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, d)
+}
+
+type Options struct {
+	AwsOptions awsOptions      `json:"aws-options" yaml:"aws-options"`
+	Targets    []Target        `json:"targets" yaml:"targets"`
+	QueueSize  int             `json:"queue-size" yaml:"queue-size"` // messages buffered for each target, defaults to 1024
+	Retries    int             `json:"retries" yaml:"retries"`       // sends of a failed message retried before it is dead-lettered, defaults to 3
+	Timeout    int             `json:"timeout" yaml:"timeout"`       // seconds to wait for each send, defaults to 10
+	Outbound   plugin.Outbound `json:"outbound" yaml:"outbound"`
+}
+
+type awsOptions struct {
+	Region          string `json:"region" yaml:"region"`               // from the aws configuration of the environment if empty
+	Endpoint        string `json:"endpoint" yaml:"endpoint"`           // endpoint of the services, such as http://localhost:4566 for localstack
+	AccessKeyID     string `json:"access-key-id" yaml:"access-key-id"` // static credentials, from the aws configuration of the environment if empty
+	SecretAccessKey string `json:"secret-access-key" yaml:"secret-access-key"`
+}
+
+// Target forwards the messages of selected topics to an sns topic or an sqs queue. Targets
+// whose topic arn or queue url ends with .fifo are fifo targets.
+type Target struct {
+	Topics          []string `json:"topics" yaml:"topics"`                       // publish topics forwarded, wildcard(#、+) is supported, empty indicate unrestricted
+	SNS             string   `json:"sns" yaml:"sns"`                             // arn of the sns topic
+	SQS             string   `json:"sqs" yaml:"sqs"`                             // url of the sqs queue
+	GroupBy         string   `json:"group-by" yaml:"group-by"`                   // message group id of fifo targets, client (default) or topic
+	ContentDedup    bool     `json:"content-dedup" yaml:"content-dedup"`         // the fifo target deduplicates on content, so no deduplication id is sent
+	Raw             bool     `json:"raw" yaml:"raw"`                             // the body is the payload rather than a json message, for text payloads
+	DeadLetterQueue string   `json:"dead-letter-queue" yaml:"dead-letter-queue"` // url of an sqs queue receiving the messages which could not be delivered
+}
+
+// name returns the topic arn or queue url of the target.
+func (t Target) name() string {
+	if t.SNS != "" {
+		return t.SNS
+	}
+	return t.SQS
+}
+
+// fifo returns true if the target is a fifo topic or queue.
+func (t Target) fifo() bool {
+	return strings.HasSuffix(t.name(), ".fifo")
+}
+
+// validate returns an error if the target is invalid.
+func (t Target) validate() error {
+	if (t.SNS == "") == (t.SQS == "") {
+		return fmt.Errorf("%w: set one of sns or sqs", ErrInvalidTarget)
+	}
+	if t.GroupBy != "" && t.GroupBy != GroupByClient && t.GroupBy != GroupByTopic {
+		return fmt.Errorf("%w: group by %q", ErrInvalidTarget, t.GroupBy)
+	}
+	return nil
+}
+
+// match returns true if the topic is forwarded to the target.
+func (t Target) match(topic string) bool {
+	if len(t.Topics) == 0 {
+		return true
+	}
+
+	for _, f := range t.Topics {
+		if plugin.MatchTopic(f, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// snsAPI is the part of the sns client used by the bridge.
+type snsAPI interface {
+	PublishBatch(ctx context.Context, params *sns.PublishBatchInput, optFns ...func(*sns.Options)) (*sns.PublishBatchOutput, error)
+}
+
+// sqsAPI is the part of the sqs client used by the bridge.
+type sqsAPI interface {
+	SendMessageBatch(ctx context.Context, params *sqs.SendMessageBatchInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error)
+}
+
+// entry is a message waiting to be sent to a target.
+type entry struct {
+	id       string            // the id of the entry in its batch
+	body     string            // the message body
+	attrs    map[string]string // the message attributes
+	group    string            // the message group id of fifo targets
+	dedup    string            // the message deduplication id of fifo targets
+	attempts int               // the sends which failed
+}
+
+// size returns the bytes the entry counts towards the size of a batch.
+func (e *entry) size() int {
+	n := len(e.body)
+	for k, v := range e.attrs {
+		n += len(k) + len(v) + len("String")
+	}
+	return n
+}
+
+// failure is an entry which a target did not accept.
+type failure struct {
+	entry  *entry
+	reason string
+	sender bool // the entry is invalid and fails on retry
+}
+
+// worker sends the messages of a target.
+type worker struct {
+	target Target
+	queue  chan *entry
+}
+
+type Bridge struct {
+	mqtt.HookBase
+	config  *Options
+	sns     snsAPI
+	sqs     sqsAPI
+	workers []*worker
+	ctx     context.Context // a context for the sends
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	mu      sync.RWMutex // guards the queues against sends after stop
+	stopped bool
+	seq     atomic.Uint64 // a sequence for the deduplication ids of fifo targets
+}
+
+// ID returns the ID of the hook.
+func (b *Bridge) ID() string {
+	return "bridge-aws"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (b *Bridge) Provides(bt byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnPublished,
+	}, []byte{bt})
+}
+
+// Init creates the sns and sqs clients and starts the workers of the targets. Clients
+// already set are used as they are.
+func (b *Bridge) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		config = new(Options)
+	}
+
+	b.config = config.(*Options)
+	if b.config.QueueSize <= 0 {
+		b.config.QueueSize = defaultQueueSize
+	}
+	if b.config.Retries <= 0 {
+		b.config.Retries = defaultRetries
+	}
+	if b.config.Timeout <= 0 {
+		b.config.Timeout = defaultTimeout
+	}
+
+	for _, t := range b.config.Targets {
+		if err := t.validate(); err != nil {
+			return err
+		}
+	}
+
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	if err := b.clients(); err != nil {
+		return err
+	}
+
+	b.Log.Info("connecting to aws sns and sqs",
+		"region", b.config.AwsOptions.Region,
+		"endpoint", b.config.AwsOptions.Endpoint,
+		"targets", len(b.config.Targets))
+
+	for _, t := range b.config.Targets {
+		w := &worker{
+			target: t,
+			queue:  make(chan *entry, b.config.QueueSize),
+		}
+		b.workers = append(b.workers, w)
+		b.wg.Add(1)
+		go b.run(w)
+	}
+
+	return nil
+}
+
+// clients creates the sns and sqs clients which are not already set.
+func (b *Bridge) clients() error {
+	if b.sns != nil && b.sqs != nil {
+		return nil
+	}
+
+	ao := b.config.AwsOptions
+	var opts []func(*awsconfig.LoadOptions) error
+	if ao.Region != "" {
+		opts = append(opts, awsconfig.WithRegion(ao.Region))
+	}
+	if ao.AccessKeyID != "" {
+		opts = append(opts, awsconfig.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(ao.AccessKeyID, ao.SecretAccessKey, "")))
+	}
+	if b.config.Outbound.Enabled() {
+		client, err := b.config.Outbound.HTTPClient(nil)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, awsconfig.WithHTTPClient(client))
+	}
+
+	cfg, err := awsconfig.LoadDefaultConfig(b.ctx, opts...)
+	if err != nil {
+		return err
+	}
+
+	if b.sns == nil {
+		b.sns = sns.NewFromConfig(cfg, func(o *sns.Options) {
+			if ao.Endpoint != "" {
+				o.BaseEndpoint = aws.String(ao.Endpoint)
+			}
+		})
+	}
+	if b.sqs == nil {
+		b.sqs = sqs.NewFromConfig(cfg, func(o *sqs.Options) {
+			if ao.Endpoint != "" {
+				o.BaseEndpoint = aws.String(ao.Endpoint)
+			}
+		})
+	}
+
+	return nil
+}
+
+// Stop sends the messages already queued and stops the workers.
+func (b *Bridge) Stop() error {
+	b.mu.Lock()
+	if b.stopped {
+		b.mu.Unlock()
+		return nil
+	}
+	b.stopped = true
+	for _, w := range b.workers {
+		close(w.queue)
+	}
+	b.mu.Unlock()
+
+	b.Log.Info("disconnecting from aws sns and sqs")
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+
+	// give the workers a send timeout to drain their queues, then abandon the sends
+	select {
+	case <-done:
+	case <-time.After(time.Duration(b.config.Timeout) * time.Second):
+		b.cancel()
+		<-done
+	}
+	b.cancel()
+	return nil
+}
+
+// OnPublished queues the messages published to the topics of each target. Messages are
+// dropped if a target falls behind.
+func (b *Bridge) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.stopped {
+		return
+	}
+
+	for _, w := range b.workers {
+		if !w.target.match(pk.TopicName) {
+			continue
+		}
+
+		e, err := b.newEntry(w.target, cl, pk)
+		if err != nil {
+			b.Log.Error("bridge-aws:OnPublished", "error", err)
+			continue
+		}
+
+		select {
+		case w.queue <- e:
+		default:
+			b.Log.Warn("bridge-aws: queue full, message dropped", "target", w.target.name(), "topic", pk.TopicName)
+		}
+	}
+}
+
+// newEntry returns the entry of a message for a target.
+func (b *Bridge) newEntry(t Target, cl *mqtt.Client, pk packets.Packet) (*entry, error) {
+	e := &entry{
+		body:  string(pk.Payload),
+		attrs: map[string]string{AttrTopic: pk.TopicName},
+	}
+	if cl.ID != "" {
+		e.attrs[AttrClientID] = cl.ID
+	}
+	if len(cl.Properties.Username) > 0 {
+		e.attrs[AttrUsername] = string(cl.Properties.Username)
+	}
+
+	if !t.Raw {
+		created := pk.Created
+		if created == 0 {
+			created = time.Now().Unix()
+		}
+		data, err := Message{
+			ClientID:    cl.ID,
+			Username:    string(cl.Properties.Username),
+			Topic:       pk.TopicName,
+			Payload:     pk.Payload,
+			Qos:         pk.FixedHeader.Qos,
+			Retain:      pk.FixedHeader.Retain,
+			Timestamp:   created,
+			Annotations: mqtt.Annotations(pk),
+		}.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		e.body = string(data)
+	}
+
+	if t.fifo() {
+		e.group = cl.ID
+		if t.GroupBy == GroupByTopic || e.group == "" {
+			e.group = pk.TopicName
+		}
+		if !t.ContentDedup {
+			e.dedup = strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.FormatUint(b.seq.Add(1), 36)
+		}
+	}
+
+	return e, nil
+}
+
+// run sends the messages queued for a target in batches until the queue is closed.
+func (b *Bridge) run(w *worker) {
+	defer b.wg.Done()
+
+	for e := range w.queue {
+		batch, size := []*entry{e}, e.size()
+	fill:
+		for len(batch) < maxBatchEntries {
+			select {
+			case next, ok := <-w.queue:
+				if !ok {
+					break fill
+				}
+				if size+next.size() > maxBatchBytes {
+					b.deliver(w.target, batch)
+					batch, size = nil, 0
+				}
+				batch = append(batch, next)
+				size += next.size()
+			default:
+				break fill
+			}
+		}
+		b.deliver(w.target, batch)
+	}
+}
+
+// deliver sends a batch to a target, retrying the failed messages with a backoff and
+// dead-lettering those which still fail or are invalid.
+func (b *Bridge) deliver(t Target, batch []*entry) {
+	backoff := retryBackoff
+	for len(batch) > 0 {
+		if b.ctx.Err() != nil {
+			b.Log.Warn("bridge-aws: stopped, messages dropped", "target", t.name(), "messages", len(batch))
+			return
+		}
+
+		failures := b.send(t.name(), t.SNS != "", batch)
+		batch = batch[:0]
+		for _, f := range failures {
+			f.entry.attempts++
+			if f.sender || f.entry.attempts > b.config.Retries {
+				b.deadLetter(t, f)
+				continue
+			}
+			batch = append(batch, f.entry)
+		}
+
+		if len(batch) > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+// send sends a batch to an sns topic or sqs queue, returning the messages which failed.
+func (b *Bridge) send(target string, toSNS bool, batch []*entry) []failure {
+	for i, e := range batch {
+		e.id = strconv.Itoa(i)
+	}
+
+	ctx, cancel := context.WithTimeout(b.ctx, time.Duration(b.config.Timeout)*time.Second)
+	defer cancel()
+
+	var failed []snstypes.BatchResultErrorEntry
+	var err error
+	if toSNS {
+		var out *sns.PublishBatchOutput
+		out, err = b.sns.PublishBatch(ctx, snsBatch(target, batch))
+		if err == nil {
+			failed = out.Failed
+		}
+	} else {
+		var out *sqs.SendMessageBatchOutput
+		out, err = b.sqs.SendMessageBatch(ctx, sqsBatch(target, batch))
+		if err == nil {
+			for _, f := range out.Failed {
+				failed = append(failed, snstypes.BatchResultErrorEntry{
+					Id:          f.Id,
+					Code:        f.Code,
+					Message:     f.Message,
+					SenderFault: f.SenderFault,
+				})
+			}
+		}
+	}
+
+	if err != nil {
+		b.Log.Error("bridge-aws: send failed", "error", err, "target", target, "messages", len(batch))
+		failures := make([]failure, len(batch))
+		for i, e := range batch {
+			failures[i] = failure{entry: e, reason: err.Error()}
+		}
+		return failures
+	}
+
+	failures := make([]failure, 0, len(failed))
+	for _, f := range failed {
+		i, err := strconv.Atoi(aws.ToString(f.Id))
+		if err != nil || i < 0 || i >= len(batch) {
+			continue
+		}
+		failures = append(failures, failure{
+			entry:  batch[i],
+			reason: aws.ToString(f.Code) + ": " + aws.ToString(f.Message),
+			sender: f.SenderFault,
+		})
+	}
+	return failures
+}
+
+// deadLetter sends a message which could not be delivered to the dead letter queue of
+// its target, with the target and the failure as attributes, or drops it if there is none.
+func (b *Bridge) deadLetter(t Target, f failure) {
+	b.Log.Warn("bridge-aws: message not delivered", "target", t.name(), "topic", f.entry.attrs[AttrTopic],
+		"attempts", f.entry.attempts, "reason", f.reason, "dead-letter-queue", t.DeadLetterQueue)
+	if t.DeadLetterQueue == "" {
+		return
+	}
+
+	e := *f.entry
+	e.attrs = make(map[string]string, len(f.entry.attrs)+2)
+	for k, v := range f.entry.attrs {
+		e.attrs[k] = v
+	}
+	e.attrs[AttrTarget] = t.name()
+	e.attrs[AttrError] = f.reason
+	if !strings.HasSuffix(t.DeadLetterQueue, ".fifo") {
+		e.group, e.dedup = "", ""
+	} else if e.group == "" {
+		e.group = e.attrs[AttrTopic]
+		e.dedup = strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.FormatUint(b.seq.Add(1), 36)
+	}
+
+	if failures := b.send(t.DeadLetterQueue, false, []*entry{&e}); len(failures) > 0 {
+		b.Log.Error("bridge-aws: dead letter failed, message dropped", "queue", t.DeadLetterQueue, "reason", failures[0].reason)
+	}
+}
+
+// snsBatch returns the sns batch of the entries.
+func snsBatch(arn string, batch []*entry) *sns.PublishBatchInput {
+	in := &sns.PublishBatchInput{TopicArn: aws.String(arn)}
+	for _, e := range batch {
+		attrs := make(map[string]snstypes.MessageAttributeValue, len(e.attrs))
+		for k, v := range e.attrs {
+			attrs[k] = snstypes.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(v)}
+		}
+		in.PublishBatchRequestEntries = append(in.PublishBatchRequestEntries, snstypes.PublishBatchRequestEntry{
+			Id:                     aws.String(e.id),
+			Message:                aws.String(e.body),
+			MessageAttributes:      attrs,
+			MessageGroupId:         optional(e.group),
+			MessageDeduplicationId: optional(e.dedup),
+		})
+	}
+	return in
+}
+
+// sqsBatch returns the sqs batch of the entries.
+func sqsBatch(url string, batch []*entry) *sqs.SendMessageBatchInput {
+	in := &sqs.SendMessageBatchInput{QueueUrl: aws.String(url)}
+	for _, e := range batch {
+		attrs := make(map[string]sqstypes.MessageAttributeValue, len(e.attrs))
+		for k, v := range e.attrs {
+			attrs[k] = sqstypes.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(v)}
+		}
+		in.Entries = append(in.Entries, sqstypes.SendMessageBatchRequestEntry{
+			Id:                     aws.String(e.id),
+			MessageBody:            aws.String(e.body),
+			MessageAttributes:      attrs,
+			MessageGroupId:         optional(e.group),
+			MessageDeduplicationId: optional(e.dedup),
+		})
+	}
+	return in
+}
+
+// optional returns a pointer to a string, or nil if it is empty.
+func optional(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return aws.String(s)
+}
@@ -0,0 +1,280 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/plugin"
+)
+
+var (
+	// Currently, the input is directed to /dev/null. If you need to
+	// output to stdout, just modify 'io.Discard' here to 'os.Stdout'.
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	client = &mqtt.Client{
+		ID: "test",
+		Properties: mqtt.ClientProperties{
+			Username: []byte("zhangsan"),
+		},
+	}
+
+	pkp = packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}, TopicName: "a/b/c", Payload: []byte("hello")}
+)
+
+type mockSNS struct {
+	mu      sync.Mutex
+	batches []*sns.PublishBatchInput
+}
+
+func (m *mockSNS) PublishBatch(_ context.Context, in *sns.PublishBatchInput, _ ...func(*sns.Options)) (*sns.PublishBatchOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.batches = append(m.batches, in)
+	return &sns.PublishBatchOutput{}, nil
+}
+
+func (m *mockSNS) entries() []snstypes.PublishBatchRequestEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var v []snstypes.PublishBatchRequestEntry
+	for _, b := range m.batches {
+		v = append(v, b.PublishBatchRequestEntries...)
+	}
+	return v
+}
+
+type mockSQS struct {
+	mu      sync.Mutex
+	batches []*sqs.SendMessageBatchInput
+	fail    func(url string, e sqstypes.SendMessageBatchRequestEntry) *sqstypes.BatchResultErrorEntry
+	err     error
+}
+
+func (m *mockSQS) SendMessageBatch(_ context.Context, in *sqs.SendMessageBatchInput, _ ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.batches = append(m.batches, in)
+	if m.err != nil && aws.ToString(in.QueueUrl) != "dlq" {
+		return nil, m.err
+	}
+
+	out := &sqs.SendMessageBatchOutput{}
+	for _, e := range in.Entries {
+		if m.fail != nil {
+			if f := m.fail(aws.ToString(in.QueueUrl), e); f != nil {
+				f.Id = e.Id
+				out.Failed = append(out.Failed, *f)
+			}
+		}
+	}
+	return out, nil
+}
+
+func (m *mockSQS) entries(url string) []sqstypes.SendMessageBatchRequestEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var v []sqstypes.SendMessageBatchRequestEntry
+	for _, b := range m.batches {
+		if aws.ToString(b.QueueUrl) == url {
+			v = append(v, b.Entries...)
+		}
+	}
+	return v
+}
+
+func newBridge(t *testing.T, opts *Options) (*Bridge, *mockSNS, *mockSQS) {
+	b := new(Bridge)
+	b.SetOpts(logger, nil)
+	ms, mq := new(mockSNS), new(mockSQS)
+	b.sns, b.sqs = ms, mq
+	require.NoError(t, b.Init(opts))
+	return b, ms, mq
+}
+
+func TestLoadConf(t *testing.T) {
+	opts := &Options{}
+	require.NoError(t, plugin.LoadYaml("./conf.yml", opts))
+	require.Len(t, opts.Targets, 2)
+	for _, target := range opts.Targets {
+		require.NoError(t, target.validate())
+	}
+	require.True(t, opts.Targets[1].fifo())
+}
+
+func TestTargetValidate(t *testing.T) {
+	require.ErrorIs(t, Target{}.validate(), ErrInvalidTarget)
+	require.ErrorIs(t, Target{SNS: "arn", SQS: "url"}.validate(), ErrInvalidTarget)
+	require.ErrorIs(t, Target{SQS: "url", GroupBy: "user"}.validate(), ErrInvalidTarget)
+	require.NoError(t, Target{SQS: "url", GroupBy: GroupByTopic}.validate())
+
+	b := new(Bridge)
+	b.SetOpts(logger, nil)
+	require.ErrorIs(t, b.Init(&Options{Targets: []Target{{}}}), ErrInvalidTarget)
+	require.ErrorIs(t, b.Init(struct{}{}), mqtt.ErrInvalidConfigType)
+}
+
+func TestOnPublished(t *testing.T) {
+	b, ms, mq := newBridge(t, &Options{Targets: []Target{
+		{Topics: []string{"a/#"}, SNS: "arn:aws:sns:us-east-1:1:telemetry"},
+		{Topics: []string{"x/#"}, SQS: "queue"},
+		{SQS: "raw", Raw: true},
+	}})
+
+	pk := pkp.Copy(false)
+	pk.Properties.User = []packets.UserProperty{{Key: mqtt.AnnotationNodeProperty, Val: "node1"}}
+	b.OnPublished(client, pk)
+	require.NoError(t, b.Stop())
+	b.OnPublished(client, pkp) // dropped after stop
+
+	entries := ms.entries()
+	require.Len(t, entries, 1)
+	require.Nil(t, entries[0].MessageGroupId)
+	require.Equal(t, "a/b/c", aws.ToString(entries[0].MessageAttributes[AttrTopic].StringValue))
+	require.Equal(t, "test", aws.ToString(entries[0].MessageAttributes[AttrClientID].StringValue))
+	require.Equal(t, "zhangsan", aws.ToString(entries[0].MessageAttributes[AttrUsername].StringValue))
+
+	var msg Message
+	require.NoError(t, msg.UnmarshalBinary([]byte(aws.ToString(entries[0].Message))))
+	require.Equal(t, "a/b/c", msg.Topic)
+	require.Equal(t, []byte("hello"), msg.Payload)
+	require.Equal(t, byte(1), msg.Qos)
+	require.Equal(t, map[string]string{"node": "node1"}, msg.Annotations)
+
+	require.Empty(t, mq.entries("queue"))
+	raw := mq.entries("raw")
+	require.Len(t, raw, 1)
+	require.Equal(t, "hello", aws.ToString(raw[0].MessageBody))
+}
+
+func TestOnPublishedFifo(t *testing.T) {
+	b, _, mq := newBridge(t, &Options{Targets: []Target{
+		{SQS: "by-client.fifo"},
+		{SQS: "by-topic.fifo", GroupBy: GroupByTopic, ContentDedup: true},
+	}})
+
+	b.OnPublished(client, pkp)
+	b.OnPublished(client, pkp)
+	require.NoError(t, b.Stop())
+
+	entries := mq.entries("by-client.fifo")
+	require.Len(t, entries, 2)
+	require.Equal(t, "test", aws.ToString(entries[0].MessageGroupId))
+	require.NotEmpty(t, aws.ToString(entries[0].MessageDeduplicationId))
+	require.NotEqual(t, aws.ToString(entries[0].MessageDeduplicationId), aws.ToString(entries[1].MessageDeduplicationId))
+
+	entries = mq.entries("by-topic.fifo")
+	require.Len(t, entries, 2)
+	require.Equal(t, "a/b/c", aws.ToString(entries[0].MessageGroupId))
+	require.Nil(t, entries[0].MessageDeduplicationId)
+}
+
+func TestDeadLetter(t *testing.T) {
+	b := new(Bridge)
+	b.SetOpts(logger, nil)
+	mq := new(mockSQS)
+	b.sns, b.sqs = new(mockSNS), mq
+
+	attempts := 0
+	mq.fail = func(url string, e sqstypes.SendMessageBatchRequestEntry) *sqstypes.BatchResultErrorEntry {
+		if url != "queue" {
+			return nil
+		}
+		if aws.ToString(e.MessageBody) == "invalid" {
+			return &sqstypes.BatchResultErrorEntry{Code: aws.String("InvalidMessageContents"), SenderFault: true}
+		}
+		attempts++
+		return &sqstypes.BatchResultErrorEntry{Code: aws.String("InternalError"), Message: aws.String("try again")}
+	}
+	require.NoError(t, b.Init(&Options{
+		Retries: 2,
+		Targets: []Target{{SQS: "queue", Raw: true, DeadLetterQueue: "dlq"}},
+	}))
+
+	b.OnPublished(client, pkp)
+	pk := pkp.Copy(false)
+	pk.Payload = []byte("invalid")
+	b.OnPublished(client, pk)
+	require.NoError(t, b.Stop())
+
+	require.Equal(t, 3, attempts)
+	dlq := mq.entries("dlq")
+	require.Len(t, dlq, 2)
+	bodies := map[string]string{}
+	for _, e := range dlq {
+		require.Equal(t, "queue", aws.ToString(e.MessageAttributes[AttrTarget].StringValue))
+		bodies[aws.ToString(e.MessageBody)] = aws.ToString(e.MessageAttributes[AttrError].StringValue)
+	}
+	require.Equal(t, "InternalError: try again", bodies["hello"])
+	require.Equal(t, "InvalidMessageContents: ", bodies["invalid"])
+}
+
+func TestDeadLetterSendError(t *testing.T) {
+	b, _, mq := newBridge(t, &Options{
+		Retries: 1,
+		Targets: []Target{{SQS: "queue.fifo", DeadLetterQueue: "dlq"}},
+	})
+	mq.mu.Lock()
+	mq.err = errors.New("unreachable")
+	mq.mu.Unlock()
+
+	b.OnPublished(client, pkp)
+	require.Eventually(t, func() bool {
+		return len(mq.entries("dlq")) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, b.Stop())
+
+	require.Len(t, mq.entries("queue.fifo"), 2)
+	dlq := mq.entries("dlq")
+	require.Equal(t, "unreachable", aws.ToString(dlq[0].MessageAttributes[AttrError].StringValue))
+	require.Nil(t, dlq[0].MessageGroupId)
+}
+
+func TestQueueFull(t *testing.T) {
+	b := new(Bridge)
+	b.SetOpts(logger, nil)
+	b.config = &Options{}
+	b.workers = []*worker{{target: Target{SQS: "queue"}, queue: make(chan *entry, 1)}}
+
+	b.OnPublished(client, pkp)
+	b.OnPublished(client, pkp)
+	require.Len(t, b.workers[0].queue, 1)
+}
+
+func TestBatching(t *testing.T) {
+	b, _, mq := newBridge(t, &Options{Targets: []Target{{SQS: "queue", Raw: true}}})
+	b.mu.Lock()
+	w := b.workers[0]
+	b.mu.Unlock()
+
+	// fill the queue before the worker reads it, by holding the sqs client
+	mq.mu.Lock()
+	b.OnPublished(client, pkp)
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 25; i++ {
+		b.OnPublished(client, pkp)
+	}
+	require.Len(t, w.queue, 25)
+	mq.mu.Unlock()
+	require.NoError(t, b.Stop())
+
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+	require.Len(t, mq.batches, 4)
+	require.Len(t, mq.batches[0].Entries, 1)
+	require.Len(t, mq.batches[1].Entries, 10)
+	require.Len(t, mq.batches[3].Entries, 5)
+}
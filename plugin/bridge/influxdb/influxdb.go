@@ -0,0 +1,357 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind
+
+package influxdb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/plugin"
+)
+
+const (
+	defaultAddr          = "http://localhost:8086"
+	defaultField         = "value"
+	defaultPrecision     = "ms"
+	defaultBatchSize     = 500
+	defaultFlushInterval = 1000
+	defaultQueueSize     = 10000
+	defaultRetries       = 3
+	defaultTimeout       = 10
+
+	// retryBackoff is the wait before the first retry of a failed write, doubled after each retry.
+	retryBackoff = 100 * time.Millisecond
+)
+
+var (
+	// ErrNoBucket indicates the bridge has no influxdb bucket to write to.
+	ErrNoBucket = errors.New("bridge-influxdb: no bucket configured")
+
+	// ErrInvalidPrecision indicates the precision is not one of ns, us, ms or s.
+	ErrInvalidPrecision = errors.New("bridge-influxdb: invalid precision, expected ns, us, ms or s")
+
+	// ErrInvalidRule indicates a rule has no valid topic filter or no measurement.
+	ErrInvalidRule = errors.New("bridge-influxdb: invalid rule")
+)
+
+// precisions are the durations of the precisions of the influxdb write api.
+var precisions = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+type Options struct {
+	InfluxOptions influxOptions   `json:"influxdb-options" yaml:"influxdb-options"`
+	Rules         []Rule          `json:"rules" yaml:"rules"`
+	Outbound      plugin.Outbound `json:"outbound" yaml:"outbound"`
+}
+
+type influxOptions struct {
+	Url           string `json:"url" yaml:"url"` // defaults to http://localhost:8086
+	Org           string `json:"org" yaml:"org"`
+	Bucket        string `json:"bucket" yaml:"bucket"`
+	Token         string `json:"token" yaml:"token"`
+	Precision     string `json:"precision" yaml:"precision"`           // ns, us, ms or s, defaults to ms
+	BatchSize     int    `json:"batch-size" yaml:"batch-size"`         // points per write, defaults to 500
+	FlushInterval int64  `json:"flush-interval" yaml:"flush-interval"` // milliseconds points wait for a batch to fill, defaults to 1000
+	QueueSize     int    `json:"queue-size" yaml:"queue-size"`         // points buffered before new points are dropped, defaults to 10000
+	Retries       int    `json:"retries" yaml:"retries"`               // retries of a failed write before its points are dropped, defaults to 3
+	Timeout       int64  `json:"timeout" yaml:"timeout"`               // seconds to wait for a write, defaults to 10
+}
+
+// Rule writes the payloads of the messages published to matching topics as points. The
+// measurement and tag values are templates, in which {1}..{n} are the levels of the topic,
+// and {topic}, {clientid} and {username} those of the message.
+type Rule struct {
+	Topic       string            `json:"topic" yaml:"topic"`             // the topic filter, wildcard(#、+) is supported
+	Measurement string            `json:"measurement" yaml:"measurement"` // the measurement template
+	Tags        map[string]string `json:"tags" yaml:"tags"`               // the tag templates keyed on tag name
+	Field       string            `json:"field" yaml:"field"`             // the field of number and boolean payloads, defaults to value
+	Fields      []string          `json:"fields" yaml:"fields"`           // the keys of json payloads written, including strings, all numbers and booleans if empty
+	TimeKey     string            `json:"time-key" yaml:"time-key"`       // the key of json payloads holding the point time, the publish time if empty
+}
+
+// Bridge is a hook which parses the number and json payloads of the messages published to
+// the topics of its rules and writes them as points to an influxdb v2 bucket. Points are
+// written in batches in the background, and dropped if influxdb falls behind.
+type Bridge struct {
+	mqtt.HookBase
+	config    *Options
+	client    *http.Client
+	endpoint  string        // the url of the write api
+	precision time.Duration // the precision of the point times
+	points    chan string   // the queued points in line protocol
+	dropped   int64         // points dropped because the queue was full or the write failed
+	mu        sync.RWMutex  // guards the queue against points after stop
+	stopped   bool
+	wg        sync.WaitGroup
+}
+
+// ID returns the ID of the hook.
+func (b *Bridge) ID() string {
+	return "bridge-influxdb"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (b *Bridge) Provides(bt byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnPublished,
+	}, []byte{bt})
+}
+
+// Init validates the rules and starts writing points to influxdb.
+func (b *Bridge) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		return ErrNoBucket
+	}
+
+	b.config = config.(*Options)
+	o := &b.config.InfluxOptions
+	if o.Bucket == "" {
+		return ErrNoBucket
+	}
+	if o.Url == "" {
+		o.Url = defaultAddr
+	}
+	if o.Precision == "" {
+		o.Precision = defaultPrecision
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = defaultBatchSize
+	}
+	if o.FlushInterval <= 0 {
+		o.FlushInterval = defaultFlushInterval
+	}
+	if o.QueueSize <= 0 {
+		o.QueueSize = defaultQueueSize
+	}
+	if o.Retries <= 0 {
+		o.Retries = defaultRetries
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = defaultTimeout
+	}
+
+	var ok bool
+	if b.precision, ok = precisions[o.Precision]; !ok {
+		return ErrInvalidPrecision
+	}
+
+	for i, r := range b.config.Rules {
+		if !mqtt.IsValidFilter(r.Topic, false) || r.Measurement == "" {
+			return fmt.Errorf("%w: %+v", ErrInvalidRule, r)
+		}
+		if r.Field == "" {
+			b.config.Rules[i].Field = defaultField
+		}
+	}
+
+	client, err := b.config.Outbound.HTTPClient(nil)
+	if err != nil {
+		return err
+	}
+	client.Timeout = time.Duration(o.Timeout) * time.Second
+	b.client = client
+
+	q := url.Values{}
+	q.Set("org", o.Org)
+	q.Set("bucket", o.Bucket)
+	q.Set("precision", o.Precision)
+	b.endpoint = strings.TrimRight(o.Url, "/") + "/api/v2/write?" + q.Encode()
+
+	b.Log.Info("writing to influxdb", "url", o.Url, "org", o.Org, "bucket", o.Bucket, "rules", len(b.config.Rules))
+
+	b.points = make(chan string, o.QueueSize)
+	b.wg.Add(1)
+	go b.run()
+
+	return nil
+}
+
+// Stop writes the queued points and stops the bridge.
+func (b *Bridge) Stop() error {
+	b.mu.Lock()
+	if b.stopped || b.points == nil {
+		b.mu.Unlock()
+		return nil
+	}
+	b.stopped = true
+	close(b.points)
+	b.mu.Unlock()
+
+	b.Log.Info("disconnecting from influxdb")
+	b.wg.Wait()
+	return nil
+}
+
+// Dropped returns the number of points dropped because influxdb fell behind or failed.
+func (b *Bridge) Dropped() int64 {
+	return atomic.LoadInt64(&b.dropped)
+}
+
+// OnPublished queues the payload of a message published to the topic of a rule as a
+// point, using the first rule matching the topic.
+func (b *Bridge) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	for _, r := range b.config.Rules {
+		if !plugin.MatchTopic(r.Topic, pk.TopicName) {
+			continue
+		}
+
+		p, ok := b.point(r, cl, pk)
+		if !ok {
+			return
+		}
+
+		b.mu.RLock()
+		defer b.mu.RUnlock()
+		if b.stopped {
+			return
+		}
+
+		select {
+		case b.points <- p:
+		default:
+			if atomic.AddInt64(&b.dropped, 1) == 1 {
+				b.Log.Warn("influxdb is falling behind, dropping points", "url", b.config.InfluxOptions.Url)
+			}
+		}
+		return
+	}
+}
+
+// point returns the line protocol point of a message for a rule, or false if its payload
+// has no fields or its measurement is empty.
+func (b *Bridge) point(r Rule, cl *mqtt.Client, pk packets.Packet) (string, bool) {
+	fields, ts, ok := parseFields(pk.Payload, r.Field, r.Fields, r.TimeKey, b.precision)
+	if !ok {
+		b.Log.Debug("bridge-influxdb: payload has no fields", "topic", pk.TopicName)
+		return "", false
+	}
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+
+	v := vars{
+		segments: strings.Split(pk.TopicName, "/"),
+		topic:    pk.TopicName,
+		clientID: cl.ID,
+		username: string(cl.Properties.Username),
+	}
+
+	measurement := v.expand(r.Measurement)
+	if measurement == "" {
+		b.Log.Debug("bridge-influxdb: empty measurement", "topic", pk.TopicName)
+		return "", false
+	}
+
+	tags := make(map[string]string, len(r.Tags))
+	for k, t := range r.Tags {
+		tags[k] = v.expand(t)
+	}
+
+	return line(measurement, tags, fields, ts, b.precision), true
+}
+
+// run writes the queued points in batches of up to the batch size, or those queued in a
+// flush interval, until the bridge is stopped.
+func (b *Bridge) run() {
+	defer b.wg.Done()
+
+	o := b.config.InfluxOptions
+	ticker := time.NewTicker(time.Duration(o.FlushInterval) * time.Millisecond)
+	defer ticker.Stop()
+
+	batch := make([]string, 0, o.BatchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			b.write(batch)
+			batch = batch[:0]
+		}
+	}
+
+	for {
+		select {
+		case p, ok := <-b.points:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, p)
+			if len(batch) >= o.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// write writes a batch of points, retrying with a backoff on network errors, rate limits
+// and server errors. Points which influxdb rejects are dropped.
+func (b *Bridge) write(batch []string) {
+	body := []byte(strings.Join(batch, "\n"))
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := b.post(body)
+		if err == nil {
+			return
+		}
+
+		if !retry || attempt >= b.config.InfluxOptions.Retries {
+			atomic.AddInt64(&b.dropped, int64(len(batch)))
+			b.Log.Error("bridge-influxdb: write failed, points dropped", "error", err, "points", len(batch))
+			return
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post sends points to the write api, returning true if a failed write should be retried.
+func (b *Bridge) post(body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), b.client.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if b.config.InfluxOptions.Token != "" {
+		req.Header.Set("Authorization", "Token "+b.config.InfluxOptions.Token)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return retry, fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	return false, nil
+}
@@ -0,0 +1,248 @@
+package influxdb
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/plugin"
+)
+
+var (
+	// Currently, the input is directed to /dev/null. If you need to
+	// output to stdout, just modify 'io.Discard' here to 'os.Stdout'.
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	client = &mqtt.Client{
+		ID: "dev1",
+		Properties: mqtt.ClientProperties{
+			Username: []byte("zhangsan"),
+		},
+	}
+)
+
+type mockInflux struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	lines    []string
+	status   []int // the statuses of the next responses, 204 when empty
+}
+
+func (m *mockInflux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	body, _ := io.ReadAll(r.Body)
+	m.requests = append(m.requests, r)
+
+	status := http.StatusNoContent
+	if len(m.status) > 0 {
+		status, m.status = m.status[0], m.status[1:]
+	}
+	if status == http.StatusNoContent {
+		m.lines = append(m.lines, strings.Split(string(body), "\n")...)
+	}
+	w.WriteHeader(status)
+}
+
+func (m *mockInflux) get() ([]*http.Request, []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.requests, m.lines
+}
+
+func newBridge(t *testing.T, url string, rules []Rule) *Bridge {
+	b := new(Bridge)
+	b.SetOpts(logger, nil)
+	err := b.Init(&Options{
+		InfluxOptions: influxOptions{Url: url, Org: "comqtt", Bucket: "telemetry", Token: "secret"},
+		Rules:         rules,
+	})
+	require.NoError(t, err)
+	return b
+}
+
+func publish(topic, payload string) packets.Packet {
+	return packets.Packet{TopicName: topic, Payload: []byte(payload)}
+}
+
+func TestLoadConf(t *testing.T) {
+	opts := &Options{}
+	require.NoError(t, plugin.LoadYaml("./conf.yml", opts))
+	require.Equal(t, "telemetry", opts.InfluxOptions.Bucket)
+	require.Len(t, opts.Rules, 2)
+	require.Equal(t, "ts", opts.Rules[1].TimeKey)
+}
+
+func TestInitInvalid(t *testing.T) {
+	b := new(Bridge)
+	b.SetOpts(logger, nil)
+	require.ErrorIs(t, b.Init(struct{}{}), mqtt.ErrInvalidConfigType)
+	require.ErrorIs(t, b.Init(nil), ErrNoBucket)
+	require.ErrorIs(t, b.Init(&Options{}), ErrNoBucket)
+	require.ErrorIs(t, b.Init(&Options{InfluxOptions: influxOptions{Bucket: "b", Precision: "m"}}), ErrInvalidPrecision)
+	require.ErrorIs(t, b.Init(&Options{InfluxOptions: influxOptions{Bucket: "b"}, Rules: []Rule{{Topic: "a/#/b", Measurement: "m"}}}), ErrInvalidRule)
+	require.ErrorIs(t, b.Init(&Options{InfluxOptions: influxOptions{Bucket: "b"}, Rules: []Rule{{Topic: "a"}}}), ErrInvalidRule)
+}
+
+func TestExpand(t *testing.T) {
+	v := vars{segments: []string{"sensors", "site1", "dev1"}, topic: "sensors/site1/dev1", clientID: "cl1", username: "u1"}
+	require.Equal(t, "site1", v.expand("{2}"))
+	require.Equal(t, "site1-dev1", v.expand("{2}-{3}"))
+	require.Equal(t, "", v.expand("{4}"))
+	require.Equal(t, "sensors/site1/dev1 cl1 u1", v.expand("{topic} {clientid} {username}"))
+	require.Equal(t, "{other} x", v.expand("{other} x"))
+	require.Equal(t, "open{", v.expand("open{"))
+	require.Equal(t, "plain", v.expand("plain"))
+}
+
+func TestParseFields(t *testing.T) {
+	fields, ts, ok := parseFields([]byte(" 21.5\n"), "value", nil, "", time.Millisecond)
+	require.True(t, ok)
+	require.True(t, ts.IsZero())
+	require.Equal(t, map[string]any{"value": 21.5}, fields)
+
+	fields, _, ok = parseFields([]byte("true"), "on", nil, "", time.Millisecond)
+	require.True(t, ok)
+	require.Equal(t, map[string]any{"on": true}, fields)
+
+	_, _, ok = parseFields([]byte("hello"), "value", nil, "", time.Millisecond)
+	require.False(t, ok)
+	_, _, ok = parseFields([]byte("NaN"), "value", nil, "", time.Millisecond)
+	require.False(t, ok)
+	_, _, ok = parseFields([]byte("{bad"), "value", nil, "", time.Millisecond)
+	require.False(t, ok)
+	_, _, ok = parseFields([]byte(`{"name":"x"}`), "value", nil, "", time.Millisecond)
+	require.False(t, ok)
+
+	payload := []byte(`{"temp":21.5,"ok":true,"name":"x","gps":{"lat":1,"lon":2},"ts":1700000000000}`)
+	fields, ts, ok = parseFields(payload, "value", nil, "ts", time.Millisecond)
+	require.True(t, ok)
+	require.Equal(t, map[string]any{"temp": 21.5, "ok": true, "gps_lat": 1.0, "gps_lon": 2.0}, fields)
+	require.Equal(t, int64(1700000000000), ts.UnixMilli())
+
+	fields, ts, ok = parseFields(payload, "value", []string{"name", "gps_lat"}, "", time.Millisecond)
+	require.True(t, ok)
+	require.True(t, ts.IsZero())
+	require.Equal(t, map[string]any{"name": "x", "gps_lat": 1.0}, fields)
+
+	_, ts, _ = parseFields([]byte(`{"v":1,"at":"2024-01-02T03:04:05Z"}`), "value", nil, "at", time.Second)
+	require.Equal(t, int64(1704164645), ts.Unix())
+}
+
+func TestLine(t *testing.T) {
+	ts := time.UnixMilli(1700000000123)
+	l := line("cpu load", map[string]string{"site": "a,b", "dev": "x=y", "empty": ""},
+		map[string]any{"value": 21.5, "on": true, "note": `say "hi"`}, ts, time.Millisecond)
+	require.Equal(t, `cpu\ load,dev=x\=y,site=a\,b note="say \"hi\"",on=true,value=21.5 1700000000123`, l)
+
+	l = line("m", nil, map[string]any{"value": 1e21}, ts, time.Second)
+	require.Equal(t, "m value=1e+21 1700000000", l)
+}
+
+func TestBridge(t *testing.T) {
+	mock := new(mockInflux)
+	srv := httptest.NewServer(mock)
+	defer srv.Close()
+
+	b := newBridge(t, srv.URL, []Rule{
+		{Topic: "sensors/+/+/+", Measurement: "{4}", Tags: map[string]string{"site": "{2}", "device": "{3}"}},
+		{Topic: "telemetry/#", Measurement: "telemetry", Tags: map[string]string{"device": "{clientid}", "user": "{username}"}, TimeKey: "ts"},
+		{Topic: "#", Measurement: "other"},
+	})
+
+	b.OnPublished(client, publish("sensors/site1/dev1/temp", "21.5"))
+	b.OnPublished(client, publish("telemetry/dev1", `{"temp":20,"ts":1700000000000}`))
+	b.OnPublished(client, publish("sensors/site1/dev1/temp", "not a number"))
+	require.NoError(t, b.Stop())
+	b.OnPublished(client, publish("sensors/site1/dev1/temp", "1")) // dropped after stop
+
+	reqs, lines := mock.get()
+	require.Len(t, reqs, 1)
+	require.Equal(t, http.MethodPost, reqs[0].Method)
+	require.Equal(t, "/api/v2/write", reqs[0].URL.Path)
+	require.Equal(t, "comqtt", reqs[0].URL.Query().Get("org"))
+	require.Equal(t, "telemetry", reqs[0].URL.Query().Get("bucket"))
+	require.Equal(t, "ms", reqs[0].URL.Query().Get("precision"))
+	require.Equal(t, "Token secret", reqs[0].Header.Get("Authorization"))
+
+	require.Len(t, lines, 2)
+	require.Regexp(t, `^temp,device=dev1,site=site1 value=21.5 \d+$`, lines[0])
+	require.Equal(t, "telemetry,device=dev1,user=zhangsan temp=20 1700000000000", lines[1])
+	require.Equal(t, int64(0), b.Dropped())
+}
+
+func TestBridgeBatches(t *testing.T) {
+	mock := new(mockInflux)
+	srv := httptest.NewServer(mock)
+	defer srv.Close()
+
+	b := new(Bridge)
+	b.SetOpts(logger, nil)
+	require.NoError(t, b.Init(&Options{
+		InfluxOptions: influxOptions{Url: srv.URL, Bucket: "b", BatchSize: 2, FlushInterval: 10},
+		Rules:         []Rule{{Topic: "a", Measurement: "m"}},
+	}))
+	defer b.Stop()
+
+	for i := 0; i < 5; i++ {
+		b.OnPublished(client, publish("a", "1"))
+	}
+
+	// the last point is written by the flush interval rather than a full batch
+	require.Eventually(t, func() bool {
+		_, lines := mock.get()
+		return len(lines) == 5
+	}, 5*time.Second, 10*time.Millisecond)
+	reqs, _ := mock.get()
+	require.GreaterOrEqual(t, len(reqs), 3)
+}
+
+func TestBridgeRetry(t *testing.T) {
+	mock := &mockInflux{status: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}}
+	srv := httptest.NewServer(mock)
+	defer srv.Close()
+
+	b := newBridge(t, srv.URL, []Rule{{Topic: "a", Measurement: "m"}})
+	b.OnPublished(client, publish("a", "1"))
+	require.NoError(t, b.Stop())
+
+	reqs, lines := mock.get()
+	require.Len(t, reqs, 3)
+	require.Len(t, lines, 1)
+	require.Equal(t, int64(0), b.Dropped())
+}
+
+func TestBridgeRejected(t *testing.T) {
+	mock := &mockInflux{status: []int{http.StatusBadRequest}}
+	srv := httptest.NewServer(mock)
+	defer srv.Close()
+
+	b := newBridge(t, srv.URL, []Rule{{Topic: "a", Measurement: "m"}})
+	b.OnPublished(client, publish("a", "1"))
+	require.NoError(t, b.Stop())
+
+	reqs, _ := mock.get()
+	require.Len(t, reqs, 1)
+	require.Equal(t, int64(1), b.Dropped())
+}
+
+func TestQueueFull(t *testing.T) {
+	b := new(Bridge)
+	b.SetOpts(logger, nil)
+	b.config = &Options{Rules: []Rule{{Topic: "a", Measurement: "m", Field: "value"}}}
+	b.precision = time.Millisecond
+	b.points = make(chan string, 1)
+
+	b.OnPublished(client, publish("a", "1"))
+	b.OnPublished(client, publish("a", "2"))
+	require.Len(t, b.points, 1)
+	require.Equal(t, int64(1), b.Dropped())
+}
@@ -0,0 +1,197 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind
+
+package influxdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	keyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+	stringEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// vars holds the values the templates of a rule are expanded with.
+type vars struct {
+	segments []string // the levels of the topic
+	topic    string
+	clientID string
+	username string
+}
+
+// expand replaces the {1}..{n} topic segments, {topic}, {clientid} and {username} in a
+// template. Segments which the topic does not have expand to nothing.
+func (v vars) expand(tmpl string) string {
+	if !strings.Contains(tmpl, "{") {
+		return tmpl
+	}
+
+	var sb strings.Builder
+	for {
+		i := strings.IndexByte(tmpl, '{')
+		if i < 0 {
+			break
+		}
+		j := strings.IndexByte(tmpl[i:], '}')
+		if j < 0 {
+			break
+		}
+		sb.WriteString(tmpl[:i])
+
+		name := tmpl[i+1 : i+j]
+		switch name {
+		case "topic":
+			sb.WriteString(v.topic)
+		case "clientid":
+			sb.WriteString(v.clientID)
+		case "username":
+			sb.WriteString(v.username)
+		default:
+			if n, err := strconv.Atoi(name); err == nil {
+				if n >= 1 && n <= len(v.segments) {
+					sb.WriteString(v.segments[n-1])
+				}
+			} else {
+				sb.WriteString(tmpl[i : i+j+1])
+			}
+		}
+		tmpl = tmpl[i+j+1:]
+	}
+	sb.WriteString(tmpl)
+	return sb.String()
+}
+
+// parseFields returns the fields of a payload, which is either a number or boolean, written
+// as the named field, or a json object whose numbers and booleans are written as fields,
+// with nested objects flattened into field keys joined by underscores. Strings of json
+// objects are only written if they are listed in include. If include is set, only the
+// listed keys are written. The time of the point is taken from the timeKey of json objects
+// if it is set and present, as a number in the precision or an RFC3339 string.
+func parseFields(payload []byte, field string, include []string, timeKey string, precision time.Duration) (map[string]any, time.Time, bool) {
+	payload = bytes.TrimSpace(payload)
+	if len(payload) == 0 {
+		return nil, time.Time{}, false
+	}
+
+	if payload[0] != '{' {
+		s := string(payload)
+		if f, err := strconv.ParseFloat(s, 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+			return map[string]any{field: f}, time.Time{}, true
+		}
+		if b, err := strconv.ParseBool(s); err == nil {
+			return map[string]any{field: b}, time.Time{}, true
+		}
+		return nil, time.Time{}, false
+	}
+
+	var obj map[string]any
+	if err := json.Unmarshal(payload, &obj); err != nil {
+		return nil, time.Time{}, false
+	}
+
+	var ts time.Time
+	if timeKey != "" {
+		switch t := obj[timeKey].(type) {
+		case float64:
+			ts = time.Unix(0, int64(t*float64(precision)))
+		case string:
+			ts, _ = time.Parse(time.RFC3339Nano, t)
+		}
+		delete(obj, timeKey)
+	}
+
+	fields := map[string]any{}
+	flatten(obj, "", func(key string, val any) {
+		listed := len(include) == 0 || slices.Contains(include, key)
+		switch val := val.(type) {
+		case float64:
+			if listed && !math.IsNaN(val) && !math.IsInf(val, 0) {
+				fields[key] = val
+			}
+		case bool:
+			if listed {
+				fields[key] = val
+			}
+		case string:
+			if len(include) > 0 && listed {
+				fields[key] = val
+			}
+		}
+	})
+
+	return fields, ts, len(fields) > 0
+}
+
+// flatten calls fn with the keys and scalar values of a json object, joining the keys of
+// nested objects with underscores.
+func flatten(obj map[string]any, prefix string, fn func(key string, val any)) {
+	for k, v := range obj {
+		if prefix != "" {
+			k = prefix + "_" + k
+		}
+		if nested, ok := v.(map[string]any); ok {
+			flatten(nested, k, fn)
+			continue
+		}
+		fn(k, v)
+	}
+}
+
+// line returns a point in the influxdb line protocol. Tags with empty keys or values are
+// left out, as influxdb does not accept them.
+func line(measurement string, tags map[string]string, fields map[string]any, ts time.Time, precision time.Duration) string {
+	var sb strings.Builder
+	sb.WriteString(measurementEscaper.Replace(measurement))
+
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if k != "" && v != "" {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys) // influxdb writes tags sorted by key fastest
+	for _, k := range keys {
+		sb.WriteByte(',')
+		sb.WriteString(keyEscaper.Replace(k))
+		sb.WriteByte('=')
+		sb.WriteString(keyEscaper.Replace(tags[k]))
+	}
+
+	keys = keys[:0]
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for i, k := range keys {
+		if i == 0 {
+			sb.WriteByte(' ')
+		} else {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(keyEscaper.Replace(k))
+		sb.WriteByte('=')
+		switch v := fields[k].(type) {
+		case float64:
+			sb.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+		case bool:
+			sb.WriteString(strconv.FormatBool(v))
+		case string:
+			sb.WriteByte('"')
+			sb.WriteString(stringEscaper.Replace(v))
+			sb.WriteByte('"')
+		}
+	}
+
+	sb.WriteByte(' ')
+	sb.WriteString(strconv.FormatInt(ts.UnixNano()/int64(precision), 10))
+	return sb.String()
+}
@@ -32,6 +32,10 @@ const (
 	Unsubscribe = "unsubscribe"
 	//Disconnect mqtt disconenct
 	Disconnect = "disconnect"
+	//Usage usage report of users and tenants
+	Usage = "usage"
+	//Security failed authentication, acl denial, blacklist hit or ban
+	Security = "security"
 )
 
 const (
@@ -43,18 +47,21 @@ const (
 
 // Message kafka publish message
 type Message struct {
-	Action          string   `json:"action"`
-	ClientID        string   `json:"clientid"`                  // the client id
-	Username        string   `json:"username"`                  // the username of the client
-	Remote          string   `json:"remote,omitempty"`          // the remote address of the client
-	Listener        string   `json:"listener,omitempty"`        // the listener the client connected on
-	Topics          []string `json:"topics,omitempty"`          // publish topic or subscribe/unsubscribe filters
-	reasonCodes     []byte   `json:"reasonCodes,omitempty"`     // subscribe/unsubscribe filters success(0) or failure(>0x80) code
-	Payload         []byte   `json:"payload,omitempty"`         // publish payload
-	ProtocolVersion byte     `json:"protocolVersion,omitempty"` // mqtt protocol version of the client
-	Clean           bool     `json:"clean,omitempty"`           // if the client requested a clean start/session
-	Timestamp       int64    `json:"ts"`                        // event time
-	PacketID        uint16   `json:"packetid,omitempty"`        // the packet id
+	Action          string              `json:"action"`
+	ClientID        string              `json:"clientid"`                  // the client id
+	Username        string              `json:"username"`                  // the username of the client
+	Remote          string              `json:"remote,omitempty"`          // the remote address of the client
+	Listener        string              `json:"listener,omitempty"`        // the listener the client connected on
+	Topics          []string            `json:"topics,omitempty"`          // publish topic or subscribe/unsubscribe filters
+	reasonCodes     []byte              `json:"reasonCodes,omitempty"`     // subscribe/unsubscribe filters success(0) or failure(>0x80) code
+	Payload         []byte              `json:"payload,omitempty"`         // publish payload
+	ProtocolVersion byte                `json:"protocolVersion,omitempty"` // mqtt protocol version of the client
+	Clean           bool                `json:"clean,omitempty"`           // if the client requested a clean start/session
+	Timestamp       int64               `json:"ts"`                        // event time
+	PacketID        uint16              `json:"packetid,omitempty"`        // the packet id
+	Usage           *mqtt.UsageReport   `json:"usage,omitempty"`           // the usage report of users and tenants
+	Security        *mqtt.SecurityEvent `json:"security,omitempty"`        // the security event
+	Annotations     map[string]string   `json:"annotations,omitempty"`     // the broker metadata annotated on a publish
 }
 
 // MarshalBinary encodes the values into a json string.
@@ -71,8 +78,9 @@ func (d *Message) UnmarshalBinary(data []byte) error {
 }
 
 type Options struct {
-	KafkaOptions *kafkaOptions `json:"kafka-options" yaml:"kafka-options"`
-	Rules        rules         `json:"rules" yaml:"rules"`
+	KafkaOptions *kafkaOptions   `json:"kafka-options" yaml:"kafka-options"`
+	Rules        rules           `json:"rules" yaml:"rules"`
+	Outbound     plugin.Outbound `json:"outbound" yaml:"outbound"`
 }
 
 type kafkaOptions struct {
@@ -98,6 +106,7 @@ type abstractWriter interface {
 type Bridge struct {
 	mqtt.HookBase
 	config *Options
+	dialer *kafka.Dialer
 	writer abstractWriter
 	ctx    context.Context // a context for the connection
 }
@@ -115,6 +124,8 @@ func (b *Bridge) Provides(bt byte) bool {
 		mqtt.OnPublished,
 		mqtt.OnSubscribed,
 		mqtt.OnUnsubscribed,
+		mqtt.OnUsageReport,
+		mqtt.OnSecurityEvent,
 	}, []byte{bt})
 }
 
@@ -153,6 +164,17 @@ func (b *Bridge) Init(config any) error {
 	default:
 		balancer = &kafka.LeastBytes{}
 	}
+	b.dialer = kafka.DefaultDialer
+	var transport kafka.RoundTripper = kafka.DefaultTransport
+	if b.config.Outbound.Enabled() {
+		dial, err := b.config.Outbound.Dialer()
+		if err != nil {
+			return err
+		}
+		b.dialer = &kafka.Dialer{DialFunc: dial}
+		transport = &kafka.Transport{Dial: dial}
+	}
+
 	// set up a kafkaLogger to give the kafka library a way to log errors:
 	logger := newKafkaLogger(b.Log)
 	b.writer = &kafka.Writer{
@@ -166,6 +188,7 @@ func (b *Bridge) Init(config any) error {
 		AllowAutoTopicCreation: true,
 		Completion:             b.handler,
 		ErrorLogger:            logger,
+		Transport:              transport,
 	}
 
 	// verify connect
@@ -179,7 +202,7 @@ func (b *Bridge) Init(config any) error {
 }
 
 func (b *Bridge) kafkaTopics() (map[string]struct{}, error) {
-	conn, err := kafka.Dial("tcp", b.config.KafkaOptions.Brokers[0])
+	conn, err := b.dialer.DialContext(b.ctx, "tcp", b.config.KafkaOptions.Brokers[0])
 	if err != nil {
 		return nil, err
 	}
@@ -306,13 +329,14 @@ func (b *Bridge) OnPublished(cl *mqtt.Client, pk packets.Packet) {
 
 	timestamp := genTimestamp(pk.Created)
 	msg := &Message{
-		Action:    Publish,
-		ClientID:  cl.ID,
-		Username:  string(cl.Properties.Username),
-		Topics:    []string{pk.TopicName},
-		Payload:   pk.Payload,
-		Timestamp: timestamp,
-		PacketID:  pk.PacketID,
+		Action:      Publish,
+		ClientID:    cl.ID,
+		Username:    string(cl.Properties.Username),
+		Topics:      []string{pk.TopicName},
+		Payload:     pk.Payload,
+		Timestamp:   timestamp,
+		PacketID:    pk.PacketID,
+		Annotations: mqtt.Annotations(pk),
 	}
 	data, err := msg.MarshalBinary()
 	if err != nil {
@@ -401,6 +425,54 @@ func (b *Bridge) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes
 	}
 }
 
+// OnUsageReport is called with the usage of users and tenants over a reporting period.
+func (b *Bridge) OnUsageReport(report mqtt.UsageReport) {
+	msg := &Message{
+		Action:    Usage,
+		Timestamp: report.End,
+		Usage:     &report,
+	}
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		b.Log.Error("bridge-kafka:OnUsageReport", "error", err)
+		return
+	}
+
+	err = b.writer.WriteMessages(b.ctx, kafka.Message{
+		Key:   genKey(Usage, report.End),
+		Value: data,
+	})
+	if err != nil {
+		b.Log.Error("bridge-kafka:OnUsageReport", "error", err)
+	}
+}
+
+// OnSecurityEvent is called with a failed authentication, acl denial, blacklist hit or ban.
+func (b *Bridge) OnSecurityEvent(ev mqtt.SecurityEvent) {
+	msg := &Message{
+		Action:    Security,
+		ClientID:  ev.ClientID,
+		Username:  ev.Username,
+		Remote:    ev.Remote,
+		Listener:  ev.Listener,
+		Timestamp: ev.Timestamp,
+		Security:  &ev,
+	}
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		b.Log.Error("bridge-kafka:OnSecurityEvent", "error", err)
+		return
+	}
+
+	err = b.writer.WriteMessages(b.ctx, kafka.Message{
+		Key:   genKey(Security, ev.Timestamp),
+		Value: data,
+	})
+	if err != nil {
+		b.Log.Error("bridge-kafka:OnSecurityEvent", "error", err)
+	}
+}
+
 func genKey(id string, timestamp int64) []byte {
 	var buf bytes.Buffer
 	buf.WriteString(id)
@@ -92,6 +92,10 @@ func TestBridge(t *testing.T) {
 	require.Equal(t, 4, writer.count(), "writer not called	on subscribe")
 	b.OnUnsubscribed(client, pkf, []byte{0}, []int{1})
 	require.Equal(t, 5, writer.count(), "writer not called on unsubscribe")
+	b.OnUsageReport(mqtt.UsageReport{End: 1, Users: []mqtt.UsageStat{{Name: "zhangsan"}}})
+	require.Equal(t, 6, writer.count(), "writer not called on usage report")
+	b.OnSecurityEvent(mqtt.SecurityEvent{Type: mqtt.SecurityAuthFailure, ClientID: client.ID, Timestamp: 1})
+	require.Equal(t, 7, writer.count(), "writer not called on security event")
 	err := writer.Close()
 	require.NoError(t, err, "writer close failed")
 	if !writer.isClosed() {
@@ -99,6 +103,24 @@ func TestBridge(t *testing.T) {
 	}
 }
 
+func TestOnPublishedAnnotations(t *testing.T) {
+	b := newBridge(t)
+	writer := newMockWriter()
+	b.writer = writer
+
+	pk := pkp.Copy(false)
+	pk.Properties.User = []packets.UserProperty{
+		{Key: mqtt.AnnotationNodeProperty, Val: "node1"},
+		{Key: "other", Val: "x"},
+	}
+	b.OnPublished(client, pk)
+	require.Equal(t, 1, writer.count())
+
+	var msg Message
+	require.NoError(t, msg.UnmarshalBinary(writer.getMessages()[0].Value))
+	require.Equal(t, map[string]string{"node": "node1"}, msg.Annotations)
+}
+
 type mockWriter struct {
 	mu       sync.Mutex
 	messages []kafka.Message
@@ -0,0 +1,410 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2022 wind
+// SPDX-FileContributor: wind
+
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/plugin"
+)
+
+// ClientId is the id of the inline client which publishes the messages received from
+// the remote broker, and the default client id of the bridge on the remote broker.
+const ClientId = "comqtt-bridge"
+
+const (
+	defaultAddr                 = "tcp://localhost:1883"
+	defaultKeepalive            = 30
+	defaultConnectTimeout       = 10
+	defaultReconnectInterval    = 1
+	defaultMaxReconnectInterval = 60
+)
+
+var (
+	// ErrNoServer indicates the bridge has inbound rules but no server to publish them to.
+	ErrNoServer = errors.New("bridge-mqtt: inbound rules require a server")
+
+	// ErrInvalidRule indicates a bridge rule has an invalid topic filter or qos.
+	ErrInvalidRule = errors.New("bridge-mqtt: invalid rule")
+
+	// ErrInvalidCa indicates the ca file of the remote broker has no pem certificates.
+	ErrInvalidCa = errors.New("bridge-mqtt: invalid ca file")
+
+	// ErrOutboundScheme indicates outbound options were set for a websocket remote broker.
+	ErrOutboundScheme = errors.New("bridge-mqtt: outbound options only support tcp and tls remote brokers")
+)
+
+// Options contains the configuration for the mqtt bridge.
+type Options struct {
+	Remote   Remote          `json:"remote" yaml:"remote"`
+	Out      []Rule          `json:"out" yaml:"out"` // local topics forwarded to the remote broker
+	In       []Rule          `json:"in" yaml:"in"`   // remote topics forwarded to the local broker
+	Outbound plugin.Outbound `json:"outbound" yaml:"outbound"`
+	Server   *mqtt.Server    `json:"-" yaml:"-"` // the server the inbound messages are published to
+}
+
+// Remote configures the connection to the remote broker.
+type Remote struct {
+	Address              string  `json:"address" yaml:"address"`     // tcp://, ssl://, ws:// or wss:// host:port, defaults to tcp://localhost:1883
+	ClientId             string  `json:"client-id" yaml:"client-id"` // defaults to comqtt-bridge
+	Username             string  `json:"username" yaml:"username"`
+	Password             string  `json:"password" yaml:"password"`
+	CleanSession         bool    `json:"clean-session" yaml:"clean-session"`                   // false resumes the remote session and its queued messages on reconnect
+	ProtocolVersion      uint    `json:"protocol-version" yaml:"protocol-version"`             // 3 for mqtt 3.1, 4 for mqtt 3.1.1, defaults to 4
+	Keepalive            int64   `json:"keepalive" yaml:"keepalive"`                           // seconds, defaults to 30
+	ConnectTimeout       int64   `json:"connect-timeout" yaml:"connect-timeout"`               // seconds, defaults to 10
+	ReconnectInterval    int64   `json:"reconnect-interval" yaml:"reconnect-interval"`         // seconds between connection attempts, defaults to 1
+	MaxReconnectInterval int64   `json:"max-reconnect-interval" yaml:"max-reconnect-interval"` // seconds the reconnect backoff grows to, defaults to 60
+	Tls                  TlsInfo `json:"tls" yaml:"tls"`
+}
+
+// TlsInfo configures tls connections to the remote broker.
+type TlsInfo struct {
+	Ca         string `json:"ca" yaml:"ca"`     // ca which verifies the remote broker, the system roots if empty
+	Cert       string `json:"cert" yaml:"cert"` // client certificate, for brokers requiring x509 clients
+	Key        string `json:"key" yaml:"key"`
+	ServerName string `json:"server-name" yaml:"server-name"` // name verified in the broker certificate, the host if empty
+	SkipVerify bool   `json:"skip-verify" yaml:"skip-verify"` // do not verify the broker certificate
+}
+
+// Rule selects the topics forwarded in one direction. The local topic of a message is
+// the local prefix followed by a topic matching the filter, and its remote topic is the
+// remote prefix followed by the same topic.
+type Rule struct {
+	Topic        string `json:"topic" yaml:"topic"`                 // the topic filter without prefix, wildcard(#、+) is supported
+	LocalPrefix  string `json:"local-prefix" yaml:"local-prefix"`   // the prefix of the topics on the local broker
+	RemotePrefix string `json:"remote-prefix" yaml:"remote-prefix"` // the prefix of the topics on the remote broker
+	Qos          byte   `json:"qos" yaml:"qos"`                     // the maximum qos of the forwarded messages, and of the remote subscription of inbound rules
+}
+
+// config returns the tls config of the connection to the remote broker.
+func (t TlsInfo) config(host string) (*tls.Config, error) {
+	c := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.SkipVerify,
+	}
+	if c.ServerName == "" {
+		c.ServerName = host
+	}
+
+	if t.Cert != "" || t.Key != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	if t.Ca != "" {
+		b, err := os.ReadFile(t.Ca)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(b) {
+			return nil, ErrInvalidCa
+		}
+	}
+
+	return c, nil
+}
+
+// localFilter returns the filter of the local topics of the rule.
+func (r Rule) localFilter() string {
+	return r.LocalPrefix + r.Topic
+}
+
+// remoteFilter returns the filter of the remote topics of the rule.
+func (r Rule) remoteFilter() string {
+	return r.RemotePrefix + r.Topic
+}
+
+// match returns the topic remapped from one prefix to the other if the topic matches
+// the filter of the rule under the from prefix.
+func (r Rule) match(topic, from, to string) (string, bool) {
+	if !strings.HasPrefix(topic, from) {
+		return "", false
+	}
+
+	rest := topic[len(from):]
+	if !plugin.MatchTopic(r.Topic, rest) {
+		return "", false
+	}
+
+	// wildcards do not match topics beginning with $ [MQTT-4.7.2-1]
+	if strings.HasPrefix(topic, "$") && !strings.HasPrefix(from+r.Topic, "$") {
+		return "", false
+	}
+
+	return to + rest, true
+}
+
+// validate returns an error if the filters or qos of the rule are invalid.
+func (r Rule) validate() error {
+	if r.Topic == "" || r.Qos > 2 ||
+		!mqtt.IsValidFilter(r.localFilter(), false) || !mqtt.IsValidFilter(r.remoteFilter(), false) {
+		return fmt.Errorf("%w: %+v", ErrInvalidRule, r)
+	}
+	return nil
+}
+
+// Bridge is a hook which connects to a remote mqtt broker as a client, forwarding the
+// messages published on the local broker to selected topics out, and the messages of
+// selected remote topics in, reconnecting automatically when the connection is lost.
+type Bridge struct {
+	mqtt.HookBase
+	config    *Options
+	client    paho.Client
+	local     *mqtt.Client // the inline client publishing the inbound messages
+	connected atomic.Bool
+}
+
+// ID returns the ID of the hook.
+func (b *Bridge) ID() string {
+	return "bridge-mqtt"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (b *Bridge) Provides(bt byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnPublished,
+	}, []byte{bt})
+}
+
+// Init connects to the remote broker. The bridge keeps retrying in the background if the
+// remote broker cannot be reached.
+func (b *Bridge) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		config = new(Options)
+	}
+
+	b.config = config.(*Options)
+	for _, r := range append(b.config.Out, b.config.In...) {
+		if err := r.validate(); err != nil {
+			return err
+		}
+	}
+
+	if len(b.config.In) > 0 {
+		if b.config.Server == nil {
+			return ErrNoServer
+		}
+		b.local = b.config.Server.NewClient(nil, mqtt.LocalListener, ClientId, true)
+	}
+
+	opts, err := b.clientOptions()
+	if err != nil {
+		return err
+	}
+
+	b.Log.Info("connecting to remote mqtt broker",
+		"address", b.config.Remote.Address,
+		"client-id", opts.ClientID,
+		"out", len(b.config.Out),
+		"in", len(b.config.In))
+
+	b.client = paho.NewClient(opts)
+	b.client.Connect() // retried in the background until the broker is reached
+
+	return nil
+}
+
+// clientOptions returns the options of the client connecting to the remote broker.
+func (b *Bridge) clientOptions() (*paho.ClientOptions, error) {
+	r := &b.config.Remote
+	if r.Address == "" {
+		r.Address = defaultAddr
+	}
+	if r.ClientId == "" {
+		r.ClientId = ClientId
+	}
+	if r.ProtocolVersion == 0 {
+		r.ProtocolVersion = 4
+	}
+	if r.Keepalive <= 0 {
+		r.Keepalive = defaultKeepalive
+	}
+	if r.ConnectTimeout <= 0 {
+		r.ConnectTimeout = defaultConnectTimeout
+	}
+	if r.ReconnectInterval <= 0 {
+		r.ReconnectInterval = defaultReconnectInterval
+	}
+	if r.MaxReconnectInterval < r.ReconnectInterval {
+		r.MaxReconnectInterval = max(defaultMaxReconnectInterval, r.ReconnectInterval)
+	}
+
+	u, err := url.Parse(r.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := r.Tls.config(u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+
+	opts := paho.NewClientOptions().
+		AddBroker(r.Address).
+		SetClientID(r.ClientId).
+		SetUsername(r.Username).
+		SetPassword(r.Password).
+		SetCleanSession(r.CleanSession).
+		SetProtocolVersion(r.ProtocolVersion).
+		SetKeepAlive(time.Duration(r.Keepalive) * time.Second).
+		SetConnectTimeout(time.Duration(r.ConnectTimeout) * time.Second).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(time.Duration(r.ReconnectInterval) * time.Second).
+		SetMaxReconnectInterval(time.Duration(r.MaxReconnectInterval) * time.Second).
+		SetOrderMatters(false).
+		SetTLSConfig(tlsConfig).
+		SetOnConnectHandler(b.onConnect).
+		SetConnectionLostHandler(b.onConnectionLost)
+
+	if b.config.Outbound.Enabled() {
+		dial, err := b.config.Outbound.Dialer()
+		if err != nil {
+			return nil, err
+		}
+		switch u.Scheme {
+		case "tcp", "mqtt", "ssl", "tls", "mqtts", "tcps":
+		default:
+			return nil, ErrOutboundScheme
+		}
+		opts.SetCustomOpenConnectionFn(b.openConnection(dial, tlsConfig))
+	}
+
+	return opts, nil
+}
+
+// openConnection returns a function which opens connections to the remote broker through
+// the outbound dialer.
+func (b *Bridge) openConnection(dial plugin.DialFunc, tlsConfig *tls.Config) paho.OpenConnectionFunc {
+	return func(uri *url.URL, opts paho.ClientOptions) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), opts.ConnectTimeout)
+		defer cancel()
+
+		conn, err := dial(ctx, "tcp", uri.Host)
+		if err != nil {
+			return nil, err
+		}
+
+		switch uri.Scheme {
+		case "ssl", "tls", "mqtts", "tcps":
+			tc := tls.Client(conn, tlsConfig)
+			if err := tc.HandshakeContext(ctx); err != nil {
+				_ = conn.Close()
+				return nil, err
+			}
+			return tc, nil
+		}
+
+		return conn, nil
+	}
+}
+
+// onConnect subscribes to the remote topics of the inbound rules each time the bridge
+// connects, as a clean session does not keep the subscriptions.
+func (b *Bridge) onConnect(c paho.Client) {
+	b.connected.Store(true)
+	b.Log.Info("connected to remote mqtt broker", "address", b.config.Remote.Address)
+
+	for _, r := range b.config.In {
+		t := c.Subscribe(r.remoteFilter(), r.Qos, func(_ paho.Client, m paho.Message) {
+			b.forwardIn(r, m)
+		})
+		go func() {
+			if t.Wait() && t.Error() != nil {
+				b.Log.Error("bridge-mqtt:subscribe", "error", t.Error(), "filter", r.remoteFilter())
+			}
+		}()
+	}
+}
+
+// onConnectionLost logs the loss of the connection, which is then re-established.
+func (b *Bridge) onConnectionLost(_ paho.Client, err error) {
+	b.connected.Store(false)
+	b.Log.Warn("lost connection to remote mqtt broker, reconnecting", "address", b.config.Remote.Address, "error", err)
+}
+
+// Connected returns true if the bridge is connected to the remote broker.
+func (b *Bridge) Connected() bool {
+	return b.connected.Load()
+}
+
+// Stop disconnects from the remote broker.
+func (b *Bridge) Stop() error {
+	b.Log.Info("disconnecting from remote mqtt broker")
+	if b.client != nil {
+		b.client.Disconnect(250)
+	}
+	b.connected.Store(false)
+	return nil
+}
+
+// forwardIn publishes a message received from the remote broker to the local broker.
+func (b *Bridge) forwardIn(r Rule, m paho.Message) {
+	topic, ok := r.match(m.Topic(), r.RemotePrefix, r.LocalPrefix)
+	if !ok {
+		return
+	}
+
+	qos := min(m.Qos(), r.Qos)
+	err := b.config.Server.InjectPacket(b.local, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Qos:    qos,
+			Retain: m.Retained(),
+		},
+		TopicName: topic,
+		Payload:   m.Payload(),
+		PacketID:  uint16(qos), // the inbound qos is never processed, but a packet id is needed for validity checks.
+	})
+	if err != nil {
+		b.Log.Error("bridge-mqtt:forwardIn", "error", err, "topic", topic)
+	}
+}
+
+// OnPublished forwards the messages published to the local topics of the outbound rules
+// to the remote broker. Qos 1 and 2 messages published while the remote broker is
+// unreachable are sent once the bridge reconnects.
+func (b *Bridge) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	if b.client == nil || (b.local != nil && cl == b.local) {
+		return // never send the inbound messages back to the remote broker
+	}
+
+	for _, r := range b.config.Out {
+		topic, ok := r.match(pk.TopicName, r.LocalPrefix, r.RemotePrefix)
+		if !ok {
+			continue
+		}
+
+		t := b.client.Publish(topic, min(pk.FixedHeader.Qos, r.Qos), pk.FixedHeader.Retain, pk.Payload)
+		if t.WaitTimeout(0) && t.Error() != nil {
+			b.Log.Error("bridge-mqtt:OnPublished", "error", t.Error(), "topic", topic)
+		}
+		return
+	}
+}
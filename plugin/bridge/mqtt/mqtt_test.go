@@ -0,0 +1,195 @@
+package mqtt
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wind-c/comqtt/v2/mqtt"
+	"github.com/wind-c/comqtt/v2/mqtt/hooks/auth"
+	"github.com/wind-c/comqtt/v2/mqtt/listeners"
+	"github.com/wind-c/comqtt/v2/mqtt/packets"
+	"github.com/wind-c/comqtt/v2/plugin"
+)
+
+var (
+	// Currently, the input is directed to /dev/null. If you need to
+	// output to stdout, just modify 'io.Discard' here to 'os.Stdout'.
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+)
+
+type received struct {
+	mu     sync.Mutex
+	topics []string
+}
+
+func (r *received) handler(_ *mqtt.Client, _ packets.Subscription, pk packets.Packet) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.topics = append(r.topics, pk.TopicName)
+}
+
+func (r *received) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.topics...)
+}
+
+func newTestServer(t *testing.T, addr string) *mqtt.Server {
+	s := mqtt.New(&mqtt.Options{InlineClient: true, Logger: logger})
+	require.NoError(t, s.AddHook(new(auth.AllowHook), nil))
+	if addr != "" {
+		require.NoError(t, s.AddListener(listeners.NewTCP("t1", addr, nil)))
+	}
+	require.NoError(t, s.Serve())
+	return s
+}
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestLoadConf(t *testing.T) {
+	opts := &Options{}
+	require.NoError(t, plugin.LoadYaml("./conf.yml", opts))
+	require.Equal(t, "tcp://localhost:1883", opts.Remote.Address)
+	require.Len(t, opts.Out, 1)
+	require.Len(t, opts.In, 1)
+	for _, r := range append(opts.Out, opts.In...) {
+		require.NoError(t, r.validate())
+	}
+}
+
+func TestRuleMatch(t *testing.T) {
+	r := Rule{Topic: "sensors/#", LocalPrefix: "", RemotePrefix: "edge/site1/"}
+
+	topic, ok := r.match("sensors/t1", r.LocalPrefix, r.RemotePrefix)
+	require.True(t, ok)
+	require.Equal(t, "edge/site1/sensors/t1", topic)
+
+	topic, ok = r.match("edge/site1/sensors/t1", r.RemotePrefix, r.LocalPrefix)
+	require.True(t, ok)
+	require.Equal(t, "sensors/t1", topic)
+
+	_, ok = r.match("other/t1", r.LocalPrefix, r.RemotePrefix)
+	require.False(t, ok)
+
+	_, ok = r.match("edge/site2/sensors/t1", r.RemotePrefix, r.LocalPrefix)
+	require.False(t, ok)
+
+	r = Rule{Topic: "#"}
+	_, ok = r.match("$SYS/broker/uptime", "", "")
+	require.False(t, ok)
+
+	r = Rule{Topic: "broker/#", LocalPrefix: "$SYS/"}
+	topic, ok = r.match("$SYS/broker/uptime", r.LocalPrefix, "edge/")
+	require.True(t, ok)
+	require.Equal(t, "edge/broker/uptime", topic)
+}
+
+func TestRuleValidate(t *testing.T) {
+	require.NoError(t, Rule{Topic: "a/+/c", RemotePrefix: "x/", Qos: 2}.validate())
+	require.ErrorIs(t, Rule{}.validate(), ErrInvalidRule)
+	require.ErrorIs(t, Rule{Topic: "a", Qos: 3}.validate(), ErrInvalidRule)
+	require.ErrorIs(t, Rule{Topic: "a/#/c"}.validate(), ErrInvalidRule)
+	require.ErrorIs(t, Rule{Topic: "a", LocalPrefix: "#/"}.validate(), ErrInvalidRule)
+}
+
+func TestInitInvalid(t *testing.T) {
+	b := new(Bridge)
+	b.SetOpts(logger, nil)
+	require.ErrorIs(t, b.Init(struct{}{}), mqtt.ErrInvalidConfigType)
+	require.ErrorIs(t, b.Init(&Options{Out: []Rule{{Topic: "a", Qos: 3}}}), ErrInvalidRule)
+	require.ErrorIs(t, b.Init(&Options{In: []Rule{{Topic: "a"}}}), ErrNoServer)
+
+	opts := &Options{
+		Remote:   Remote{Address: "ws://localhost:8080"},
+		Outbound: plugin.Outbound{LocalAddr: "127.0.0.1"},
+	}
+	require.ErrorIs(t, b.Init(opts), ErrOutboundScheme)
+}
+
+func TestBridge(t *testing.T) {
+	addr := freeAddr(t)
+	remote := newTestServer(t, addr)
+	defer remote.Close()
+
+	local := newTestServer(t, "")
+	defer local.Close()
+
+	b := new(Bridge)
+	err := local.AddHook(b, &Options{
+		Remote: Remote{Address: "tcp://" + addr, CleanSession: true},
+		Out: []Rule{
+			{Topic: "sensors/#", RemotePrefix: "edge/site1/", Qos: 1},
+			{Topic: "commands/#", LocalPrefix: "cloud/", RemotePrefix: "edge/site1/", Qos: 1},
+		},
+		In: []Rule{
+			{Topic: "commands/#", LocalPrefix: "cloud/", RemotePrefix: "edge/site1/", Qos: 1},
+		},
+		Server: local,
+	})
+	require.NoError(t, err)
+	defer b.Stop()
+
+	require.Eventually(t, func() bool {
+		return b.Connected() && len(remote.Topics.Subscribers("edge/site1/commands/x").Subscriptions) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	var out, in received
+	require.NoError(t, remote.Subscribe("edge/site1/#", 1, out.handler))
+	require.NoError(t, local.Subscribe("cloud/#", 1, in.handler))
+
+	// local topics are forwarded out with the remote prefix
+	require.NoError(t, local.Publish("sensors/t1", []byte("21.5"), false, 1))
+	require.NoError(t, local.Publish("other/t1", []byte("x"), false, 1))
+	require.Eventually(t, func() bool {
+		return len(out.get()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{"edge/site1/sensors/t1"}, out.get())
+
+	// remote topics are forwarded in with the local prefix, and not sent back out
+	require.NoError(t, remote.Publish("edge/site1/commands/reboot", []byte("1"), false, 1))
+	require.Eventually(t, func() bool {
+		return len(in.get()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{"cloud/commands/reboot"}, in.get())
+
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, []string{"edge/site1/sensors/t1", "edge/site1/commands/reboot"}, out.get())
+}
+
+func TestBridgeReconnect(t *testing.T) {
+	addr := freeAddr(t)
+	remote := newTestServer(t, addr)
+
+	local := newTestServer(t, "")
+	defer local.Close()
+
+	b := new(Bridge)
+	err := local.AddHook(b, &Options{
+		Remote: Remote{Address: "tcp://" + addr, CleanSession: true},
+		In:     []Rule{{Topic: "commands/#", Qos: 1}},
+		Server: local,
+	})
+	require.NoError(t, err)
+	defer b.Stop()
+
+	require.Eventually(t, b.Connected, 5*time.Second, 10*time.Millisecond)
+	remote.Close()
+	require.Eventually(t, func() bool { return !b.Connected() }, 5*time.Second, 10*time.Millisecond)
+
+	// the bridge reconnects and subscribes again once the remote broker is back
+	remote = newTestServer(t, addr)
+	defer remote.Close()
+	require.Eventually(t, func() bool {
+		return b.Connected() && len(remote.Topics.Subscribers("commands/x").Subscriptions) > 0
+	}, 10*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,277 @@
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// defaultOutboundTimeout is the default number of seconds to wait for an outbound connection.
+const defaultOutboundTimeout = 10
+
+var (
+	// ErrUnsupportedProxy indicates the scheme of an outbound proxy is not supported.
+	ErrUnsupportedProxy = errors.New("unsupported proxy scheme, expected socks5, socks5h or http")
+
+	// ErrInterfaceNoAddress indicates an outbound interface has no address to bind to.
+	ErrInterfaceNoAddress = errors.New("outbound interface has no address")
+)
+
+// DialFunc opens a connection to an address.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Outbound configures the connections which plugins open to external services, such as
+// auth servers, bridges, redis and cluster peers, for networks where they must pass a
+// proxy, leave from a specific interface or source address, or resolve names with
+// specific dns servers.
+type Outbound struct {
+	Proxy     string   `json:"proxy" yaml:"proxy"`           // socks5://[user:pass@]host:port, socks5h://... or http://[user:pass@]host:port
+	Interface string   `json:"interface" yaml:"interface"`   // network interface whose address connections are bound to
+	LocalAddr string   `json:"local-addr" yaml:"local-addr"` // source ip connections are bound to, overrides the interface
+	DNS       []string `json:"dns" yaml:"dns"`               // dns servers as host[:port] used instead of the system resolver
+	Timeout   int64    `json:"timeout" yaml:"timeout"`       // seconds to wait for a connection, defaults to 10
+}
+
+// Enabled returns true if any outbound option is set.
+func (o *Outbound) Enabled() bool {
+	return o != nil && (o.Proxy != "" || o.Interface != "" || o.LocalAddr != "" || len(o.DNS) > 0)
+}
+
+// Dialer returns a function which opens connections according to the options, through
+// the proxy if one is set.
+func (o *Outbound) Dialer() (DialFunc, error) {
+	direct, err := o.direct()
+	if err != nil || o == nil || o.Proxy == "" {
+		return direct, err
+	}
+
+	u, err := url.Parse(o.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		d, err := proxy.FromURL(u, direct)
+		if err != nil {
+			return nil, err
+		}
+		return d.(proxy.ContextDialer).DialContext, nil
+	case "http":
+		return httpProxyDialer(u, direct), nil
+	default:
+		return nil, ErrUnsupportedProxy
+	}
+}
+
+// HTTPClient returns an http client which connects according to the options. Requests
+// are sent through the proxy if one is set.
+func (o *Outbound) HTTPClient(tlsConfig *tls.Config) (*http.Client, error) {
+	direct, err := o.direct()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = direct
+	transport.TLSClientConfig = tlsConfig
+	transport.Proxy = nil
+	if o != nil && o.Proxy != "" {
+		u, err := url.Parse(o.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "socks5" && u.Scheme != "socks5h" && u.Scheme != "http" {
+			return nil, ErrUnsupportedProxy
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// Dial satisfies the proxy.Dialer interface.
+func (f DialFunc) Dial(network, addr string) (net.Conn, error) {
+	return f(context.Background(), network, addr)
+}
+
+// DialContext satisfies the proxy.ContextDialer interface.
+func (f DialFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+// direct returns a function which opens connections without the proxy, from the source
+// address and with the resolver of the options.
+func (o *Outbound) direct() (DialFunc, error) {
+	timeout := time.Duration(defaultOutboundTimeout) * time.Second
+	if o == nil {
+		return (&net.Dialer{Timeout: timeout}).DialContext, nil
+	}
+
+	if o.Timeout > 0 {
+		timeout = time.Duration(o.Timeout) * time.Second
+	}
+
+	ip, err := o.localIP()
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := func(network string) *net.Dialer {
+		d := &net.Dialer{Timeout: timeout}
+		if ip != nil {
+			switch network {
+			case "udp", "udp4", "udp6":
+				d.LocalAddr = &net.UDPAddr{IP: ip}
+			default:
+				d.LocalAddr = &net.TCPAddr{IP: ip}
+			}
+		}
+		return d
+	}
+
+	var resolver *net.Resolver
+	if len(o.DNS) > 0 {
+		servers := make([]string, len(o.DNS))
+		for i, server := range o.DNS {
+			if _, _, err := net.SplitHostPort(server); err != nil {
+				server = net.JoinHostPort(server, "53")
+			}
+			servers[i] = server
+		}
+
+		var next atomic.Uint32
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				// spread queries and their retries over the servers
+				server := servers[int(next.Add(1)-1)%len(servers)]
+				return dialer(network).DialContext(ctx, network, server)
+			},
+		}
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		d := dialer(network)
+		d.Resolver = resolver
+		return d.DialContext(ctx, network, addr)
+	}, nil
+}
+
+// localIP returns the source ip connections are bound to, or nil if not set.
+func (o *Outbound) localIP() (net.IP, error) {
+	if o.LocalAddr != "" {
+		ip := net.ParseIP(o.LocalAddr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid outbound local address %q", o.LocalAddr)
+		}
+		return ip, nil
+	}
+
+	if o.Interface == "" {
+		return nil, nil
+	}
+
+	iface, err := net.InterfaceByName(o.Interface)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var ip net.IP
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			return ipnet.IP, nil // prefer ipv4
+		}
+		if ip == nil {
+			ip = ipnet.IP
+		}
+	}
+
+	if ip == nil {
+		return nil, ErrInterfaceNoAddress
+	}
+
+	return ip, nil
+}
+
+// httpProxyDialer returns a function which opens tunnels to addresses through an http
+// proxy with the CONNECT method.
+func httpProxyDialer(u *url.URL, forward DialFunc) DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := forward(ctx, "tcp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+
+		if deadline, ok := ctx.Deadline(); ok {
+			_ = conn.SetDeadline(deadline)
+			defer conn.SetDeadline(time.Time{})
+		}
+
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
+		}
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+			req.Header.Set("Proxy-Authorization", "Basic "+auth)
+		}
+
+		if err := req.Write(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			conn.Close()
+			return nil, fmt.Errorf("proxy connect to %s: %s", addr, resp.Status)
+		}
+
+		if br.Buffered() > 0 {
+			return &bufferedConn{Conn: conn, r: br}, nil
+		}
+
+		return conn, nil
+	}
+}
+
+// bufferedConn is a connection whose first bytes were read into a buffer.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read reads from the buffer before the connection.
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,194 @@
+package plugin
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// echoListener returns a tcp listener which writes the remote address of each connection.
+func echoListener(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = io.WriteString(conn, conn.RemoteAddr().(*net.TCPAddr).IP.String())
+			conn.Close()
+		}
+	}()
+
+	return l
+}
+
+func TestOutboundEnabled(t *testing.T) {
+	var o *Outbound
+	require.False(t, o.Enabled())
+	require.False(t, new(Outbound).Enabled())
+	require.True(t, (&Outbound{LocalAddr: "127.0.0.1"}).Enabled())
+	require.True(t, (&Outbound{DNS: []string{"10.0.0.1"}}).Enabled())
+}
+
+func TestOutboundDialerLocalAddr(t *testing.T) {
+	l := echoListener(t)
+
+	var o *Outbound
+	dial, err := o.Dialer()
+	require.NoError(t, err)
+	conn, err := dial(context.Background(), "tcp", l.Addr().String())
+	require.NoError(t, err)
+	conn.Close()
+
+	o = &Outbound{LocalAddr: "127.0.0.1"}
+	dial, err = o.Dialer()
+	require.NoError(t, err)
+	conn, err = dial(context.Background(), "tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	b, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1", string(b))
+}
+
+func TestOutboundDialerInvalid(t *testing.T) {
+	_, err := (&Outbound{LocalAddr: "nope"}).Dialer()
+	require.Error(t, err)
+
+	_, err = (&Outbound{Interface: "does-not-exist0"}).Dialer()
+	require.Error(t, err)
+
+	_, err = (&Outbound{Proxy: "ftp://127.0.0.1:21"}).Dialer()
+	require.ErrorIs(t, err, ErrUnsupportedProxy)
+
+	_, err = (&Outbound{Proxy: "ftp://127.0.0.1:21"}).HTTPClient(nil)
+	require.ErrorIs(t, err, ErrUnsupportedProxy)
+}
+
+func TestOutboundDialerInterface(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	require.NoError(t, err)
+
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback == 0 {
+			continue
+		}
+
+		ip, err := (&Outbound{Interface: iface.Name}).localIP()
+		require.NoError(t, err)
+		require.True(t, ip.IsLoopback())
+		return
+	}
+
+	t.Skip("no loopback interface")
+}
+
+func TestOutboundDialerHTTPProxy(t *testing.T) {
+	l := echoListener(t)
+
+	var target, auth string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodConnect, r.Method)
+		target, auth = r.Host, r.Header.Get("Proxy-Authorization")
+
+		upstream, err := net.Dial("tcp", r.Host)
+		require.NoError(t, err)
+		defer upstream.Close()
+
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, _ = brw.WriteString("HTTP/1.1 200 Connection established\r\n\r\n")
+		_ = brw.Flush()
+		_, _ = io.Copy(conn, upstream)
+	}))
+	defer proxy.Close()
+
+	o := &Outbound{Proxy: "http://user:pass@" + proxy.Listener.Addr().String()}
+	dial, err := o.Dialer()
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := dial(ctx, "tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	b, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1", string(b))
+	require.Equal(t, l.Addr().String(), target)
+	require.Equal(t, "Basic dXNlcjpwYXNz", auth)
+}
+
+func TestOutboundDialerHTTPProxyRefused(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer proxy.Close()
+
+	dial, err := (&Outbound{Proxy: proxy.URL}).Dialer()
+	require.NoError(t, err)
+	_, err = dial(context.Background(), "tcp", "127.0.0.1:1")
+	require.ErrorContains(t, err, "403")
+}
+
+func TestOutboundHTTPClientProxy(t *testing.T) {
+	var requested string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL.String()
+		_, _ = io.WriteString(w, "1")
+	}))
+	defer proxy.Close()
+
+	client, err := (&Outbound{Proxy: proxy.URL}).HTTPClient(nil)
+	require.NoError(t, err)
+
+	resp, err := client.Get("http://auth.invalid/auth")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, "http://auth.invalid/auth", requested)
+}
+
+func TestOutboundDialerDNS(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+
+	queried := make(chan bool, 8)
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			if _, _, err := pc.ReadFrom(buf); err != nil {
+				return
+			}
+			queried <- true
+		}
+	}()
+
+	dial, err := (&Outbound{DNS: []string{pc.LocalAddr().String()}}).Dialer()
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = dial(ctx, "tcp", "broker.example.com:1883")
+	require.Error(t, err)
+
+	select {
+	case <-queried:
+	case <-time.After(time.Second):
+		require.Fail(t, "dns server not queried")
+	}
+}